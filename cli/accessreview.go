@@ -0,0 +1,170 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/spf13/cobra"
+)
+
+// Access review commands: campaigns to confirm or revoke every account and
+// API key by a deadline
+var accessReviewCmd = &cobra.Command{
+	Use:     "access-review",
+	Aliases: []string{"reviews"},
+	Short:   "Review user accounts and API keys",
+	Long:    "Commands for running access reviews, in which each account and API key is confirmed or revoked by a deadline (requires system.admin)",
+}
+
+var accessReviewListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List access reviews",
+	Run: func(cmd *cobra.Command, args []string) {
+		result := keyAPIRequest("GET", "/api/v1/access-reviews", nil, http.StatusOK)
+		reviews, _ := result["reviews"].([]interface{})
+
+		var rows [][]string
+		for _, r := range reviews {
+			review := r.(map[string]interface{})
+			counts, _ := review["counts"].(map[string]interface{})
+			rows = append(rows, []string{
+				csvValue(review["review_id"]),
+				csvValue(review["name"]),
+				csvValue(review["status"]),
+				csvValue(review["due_at"]),
+				csvValue(counts["pending"]),
+				csvValue(counts["confirmed"]),
+				csvValue(counts["revoked"]),
+				csvValue(counts["expired"]),
+			})
+		}
+		if renderList(reviews, []string{"review_id", "name", "status", "due_at", "pending", "confirmed", "revoked", "expired"}, rows, 0) {
+			return
+		}
+
+		schedule := "started manually"
+		if days, _ := result["interval_days"].(float64); days > 0 {
+			schedule = fmt.Sprintf("started every %v days", days)
+		}
+		printHeader("Found %d access reviews (%s, %v days to finish):\n\n", len(reviews), schedule, result["review_days"])
+		printHeader("%-26s %-24s %-8s %-20s %-8s %-10s %-8s %s\n", "ID", "NAME", "STATUS", "DUE", "PENDING", "CONFIRMED", "REVOKED", "EXPIRED")
+		printHeader("%s\n", strings.Repeat("-", 120))
+		for _, row := range rows {
+			fmt.Printf("%-26s %-24s %-8s %-20s %-8s %-10s %-8s %s\n", row[0], truncateString(row[1], 24), row[2], formatTime(row[3]), row[4], row[5], row[6], row[7])
+		}
+	},
+}
+
+var accessReviewStartCmd = &cobra.Command{
+	Use:   "start",
+	Short: "Start an access review of every active account and API key",
+	Long: `Start an access review. Every active account and unexpired API key is listed
+for an admin to confirm or revoke. Whatever is still pending at the deadline is
+disabled, unless ACCESS_REVIEW_DISABLE_UNREVIEWED is false on the server.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		req := map[string]interface{}{}
+		if name, _ := cmd.Flags().GetString("name"); name != "" {
+			req["name"] = name
+		}
+		if days, _ := cmd.Flags().GetInt("due-in-days"); days > 0 {
+			req["due_in_days"] = days
+		}
+		body, _ := json.Marshal(req)
+		result := keyAPIRequest("POST", "/api/v1/access-reviews", body, http.StatusCreated)
+		if renderObject(result, fmt.Sprint(result["review_id"])) {
+			return
+		}
+		counts, _ := result["counts"].(map[string]interface{})
+		fmt.Printf("Started access review %v (%v) of %v accounts and keys, due %s\n",
+			result["review_id"], result["name"], counts["pending"], formatTime(fmt.Sprint(result["due_at"])))
+	},
+}
+
+var accessReviewShowCmd = &cobra.Command{
+	Use:   "show [review-id]",
+	Short: "Show an access review and its items",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		query := url.Values{}
+		if decision, _ := cmd.Flags().GetString("decision"); decision != "" {
+			query.Set("decision", decision)
+		}
+		result := keyAPIRequest("GET", "/api/v1/access-reviews/"+url.PathEscape(args[0])+"?"+query.Encode(), nil, http.StatusOK)
+		items, _ := result["items"].([]interface{})
+
+		var rows [][]string
+		for _, i := range items {
+			item := i.(map[string]interface{})
+			subject := csvValue(item["role"])
+			if item["subject_type"] == "api_key" {
+				subject = "key " + csvValue(item["label"])
+			}
+			rows = append(rows, []string{
+				csvValue(item["item_id"]),
+				csvValue(item["username"]),
+				subject,
+				csvValue(item["last_used_at"]),
+				csvValue(item["decision"]),
+				csvValue(item["decided_by"]),
+			})
+		}
+		if renderList(items, []string{"item_id", "username", "access", "last_used_at", "decision", "decided_by"}, rows, 0) {
+			return
+		}
+
+		printHeader("%v (%v, due %s): %d items\n\n", result["name"], result["status"], formatTime(fmt.Sprint(result["due_at"])), len(items))
+		printHeader("%-8s %-20s %-24s %-20s %-10s %s\n", "ITEM", "USER", "ACCESS", "LAST USED", "DECISION", "BY")
+		printHeader("%s\n", strings.Repeat("-", 105))
+		for _, row := range rows {
+			fmt.Printf("%-8s %-20s %-24s %-20s %-10s %s\n", row[0], truncateString(row[1], 20), truncateString(row[2], 24), formatTime(row[3]), row[4], row[5])
+		}
+	},
+}
+
+var accessReviewDecideCmd = &cobra.Command{
+	Use:   "decide [review-id] [item-id] [confirm|revoke]",
+	Short: "Confirm or revoke an account or API key",
+	Long: `Confirm or revoke an item of an open access review. Revoking disables the
+account and ends its sessions, or deactivates the API key, at once.`,
+	Args:      cobra.ExactArgs(3),
+	ValidArgs: []string{"confirm", "revoke"},
+	Run: func(cmd *cobra.Command, args []string) {
+		req := map[string]string{"decision": args[2]}
+		if comment, _ := cmd.Flags().GetString("comment"); comment != "" {
+			req["comment"] = comment
+		}
+		body, _ := json.Marshal(req)
+		result := keyAPIRequest("POST", "/api/v1/access-reviews/"+url.PathEscape(args[0])+"/items/"+url.PathEscape(args[1]), body, http.StatusOK)
+		if renderObject(result, args[1]) {
+			return
+		}
+		fmt.Printf("Item %s %v\n", args[1], result["decision"])
+	},
+}
+
+var accessReviewCloseCmd = &cobra.Command{
+	Use:   "close [review-id]",
+	Short: "Close an access review before its deadline",
+	Long: `Close an open access review now. Items still pending are marked expired and,
+unless ACCESS_REVIEW_DISABLE_UNREVIEWED is false on the server, disabled.`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		result := keyAPIRequest("POST", "/api/v1/access-reviews/"+url.PathEscape(args[0])+"/close", nil, http.StatusOK)
+		if renderObject(result, args[0]) {
+			return
+		}
+		items, _ := result["items"].([]interface{})
+		fmt.Printf("Closed access review %s; %d accounts and keys were left unreviewed\n", args[0], len(items))
+		for _, i := range items {
+			item := i.(map[string]interface{})
+			if item["subject_type"] == "api_key" {
+				fmt.Printf("  key %v of %v\n", item["label"], item["username"])
+			} else {
+				fmt.Printf("  %v\n", item["username"])
+			}
+		}
+	},
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+var activityHeaders = []string{"id", "timestamp", "type", "token", "card_last_four", "source_ip", "status"}
+
+// activityQuery builds the /api/v1/activity query from the filter flags
+func activityQuery(cmd *cobra.Command) url.Values {
+	limit, _ := cmd.Flags().GetInt("limit")
+	reqType, _ := cmd.Flags().GetString("type")
+	sourceIP, _ := cmd.Flags().GetString("ip")
+	token, _ := cmd.Flags().GetString("token")
+
+	query := url.Values{}
+	query.Set("limit", strconv.Itoa(limit))
+	if reqType != "" {
+		query.Set("type", reqType)
+	}
+	if sourceIP != "" {
+		query.Set("source_ip", sourceIP)
+	}
+	if token != "" {
+		query.Set("token", token)
+	}
+	return query
+}
+
+func fetchActivity(client *TokenShieldClient, query url.Values) ([]interface{}, error) {
+	resp, err := client.makeRequest("GET", "/api/v1/activity?"+query.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		return nil, fmt.Errorf("API Error: %s", resp.Status)
+	}
+
+	var result map[string]interface{}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, fmt.Errorf("parsing response: %w", err)
+	}
+
+	// The API returns null rather than an empty list when nothing matches
+	activities, _ := result["activities"].([]interface{})
+	return activities, nil
+}
+
+func activityRow(activity map[string]interface{}) []string {
+	return []string{
+		csvValue(activity["id"]),
+		csvValue(activity["timestamp"]),
+		csvValue(activity["type"]),
+		csvValue(activity["token"]),
+		csvValue(activity["card_last_four"]),
+		csvValue(activity["source_ip"]),
+		csvValue(activity["status"]),
+	}
+}
+
+func printActivityLine(activity map[string]interface{}) {
+	lastFour := "N/A"
+	if activity["card_last_four"] != nil {
+		lastFour = activity["card_last_four"].(string)
+	}
+
+	status := "N/A"
+	if activity["status"] != nil {
+		status = fmt.Sprintf("%.0f", activity["status"].(float64))
+	}
+
+	fmt.Printf("%-20s %-12s %-8s %-15s %-20s\n",
+		formatTime(activity["timestamp"].(string)),
+		activity["type"].(string),
+		lastFour,
+		activity["source_ip"].(string),
+		status,
+	)
+}
+
+// followActivity prints the most recent matching entries, then prints new
+// ones as they arrive until interrupted. Structured output is written one
+// record at a time (JSON lines, YAML documents or CSV rows) so it can be
+// piped into other tools.
+func followActivity(client *TokenShieldClient, query url.Values, interval time.Duration) {
+	recent, err := fetchActivity(client, query)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	csvWriter := csv.NewWriter(os.Stdout)
+	switch {
+	case humanOutput():
+		printHeader("Following activity (Ctrl+C to stop):\n\n")
+		printHeader("%-20s %-12s %-8s %-15s %-20s\n", "TIMESTAMP", "TYPE", "LAST_4", "SOURCE_IP", "STATUS")
+		printHeader("%s\n", "--------------------------------------------------------------------------------")
+	case outputFormat == outputCSV && !quiet && !noHeaders:
+		csvWriter.Write(activityHeaders)
+		csvWriter.Flush()
+	}
+
+	var lastID int64
+	emit := func(a interface{}) {
+		activity := a.(map[string]interface{})
+		if id, ok := activity["id"].(float64); ok {
+			// Stream and catch-up polls can overlap; print each entry once
+			if int64(id) <= lastID {
+				return
+			}
+			lastID = int64(id)
+		}
+
+		switch {
+		case quiet:
+			fmt.Println(csvValue(activity["id"]))
+		case outputFormat == outputJSON:
+			raw, _ := json.Marshal(activity)
+			fmt.Println(string(raw))
+		case outputFormat == outputYAML:
+			fmt.Println("---")
+			exitOnOutputError(printStructured(activity))
+		case outputFormat == outputCSV:
+			csvWriter.Write(activityRow(activity))
+			csvWriter.Flush()
+		default:
+			printActivityLine(activity)
+		}
+	}
+
+	// The initial page is newest first; print it in chronological order
+	for i := len(recent) - 1; i >= 0; i-- {
+		emit(recent[i])
+	}
+
+	// Prefer the server-sent event stream and fall back to polling for
+	// servers that don't have it. Each time the stream (re)connects, a poll
+	// catches up on anything logged while it was not subscribed.
+	query.Set("limit", "1000")
+	catchUp := func() { pollActivity(client, query, lastID, emit) }
+	for {
+		err := streamActivity(client, query, catchUp, emit)
+		if err == errStreamUnsupported {
+			break
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v (reconnecting)\n", err)
+		}
+		time.Sleep(interval)
+	}
+
+	for {
+		time.Sleep(interval)
+		pollActivity(client, query, lastID, emit)
+	}
+}
+
+// pollActivity fetches and emits entries newer than lastID
+func pollActivity(client *TokenShieldClient, query url.Values, lastID int64, emit func(interface{})) {
+	query.Set("since_id", strconv.FormatInt(lastID, 10))
+	activities, err := fetchActivity(client, query)
+	if err != nil {
+		// Keep following through transient errors such as a server restart
+		fmt.Fprintf(os.Stderr, "Error: %v (retrying)\n", err)
+		return
+	}
+	for _, a := range activities {
+		emit(a)
+	}
+}
+
+var errStreamUnsupported = errors.New("event stream not supported by server")
+
+// streamActivity reads activity events from /api/v1/events/stream until the
+// connection ends. connected is called once the subscription is established.
+func streamActivity(client *TokenShieldClient, query url.Values, connected func(), emit func(interface{})) error {
+	streamQuery := url.Values{}
+	for _, key := range []string{"type", "source_ip", "token"} {
+		if v := query.Get(key); v != "" {
+			streamQuery.Set(key, v)
+		}
+	}
+	streamQuery.Set("types", "activity")
+
+	// The default client timeout would cut the stream after 30 seconds
+	streamClient := *client
+	streamClient.HTTPClient = &http.Client{}
+	resp, err := streamClient.makeRequest("GET", "/api/v1/events/stream?"+streamQuery.Encode(), nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusMethodNotAllowed:
+		return errStreamUnsupported
+	case resp.StatusCode != 200:
+		return fmt.Errorf("API Error: %s", resp.Status)
+	}
+	connected()
+
+	var eventType, data string
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case line == "":
+			if eventType == "activity" && data != "" {
+				var activity map[string]interface{}
+				if err := json.Unmarshal([]byte(data), &activity); err == nil {
+					emit(activity)
+				}
+			}
+			eventType, data = "", ""
+		case strings.HasPrefix(line, "event:"):
+			eventType = strings.TrimSpace(strings.TrimPrefix(line, "event:"))
+		case strings.HasPrefix(line, "data:"):
+			data += strings.TrimSpace(strings.TrimPrefix(line, "data:"))
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	return errors.New("event stream closed")
+}
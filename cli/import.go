@@ -0,0 +1,747 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"unicode/utf16"
+	"unicode/utf8"
+
+	"github.com/spf13/cobra"
+	"golang.org/x/term"
+)
+
+// The server rejects imports with more than 10000 records, so larger files
+// are uploaded in chunks of at most this many records
+const maxImportChunkSize = 10000
+
+// Page size used when exporting the token inventory
+const exportPageSize = 1000
+
+// importResult mirrors the CardImportResult returned by /api/v1/cards/import
+type importResult struct {
+	TotalRecords      int           `json:"total_records"`
+	SuccessfulImports int           `json:"successful_imports"`
+	FailedImports     int           `json:"failed_imports"`
+	Duplicates        int           `json:"duplicates"`
+	ImportID          string        `json:"import_id"`
+	Status            string        `json:"status"`
+	Errors            []importError `json:"errors,omitempty"`
+	ProcessingTime    string        `json:"processing_time"`
+	TokensGenerated   []importToken `json:"tokens_generated,omitempty"`
+}
+
+type importError struct {
+	RecordIndex int    `json:"record_index"`
+	Line        int    `json:"line,omitempty"`
+	ExternalID  string `json:"external_id,omitempty"`
+	CardNumber  string `json:"card_number_masked,omitempty"`
+	Error       string `json:"error"`
+	Reason      string `json:"reason"`
+}
+
+type importToken struct {
+	RecordIndex int    `json:"record_index"`
+	ExternalID  string `json:"external_id,omitempty"`
+	Token       string `json:"token,omitempty"`
+	CardType    string `json:"card_type"`
+	LastFour    string `json:"last_four"`
+}
+
+// importSummary aggregates the results of every uploaded chunk
+type importSummary struct {
+	File              string        `json:"file"`
+	Format            string        `json:"format"`
+	Chunks            int           `json:"chunks"`
+	ImportIDs         []string      `json:"import_ids"`
+	TotalRecords      int           `json:"total_records"`
+	SuccessfulImports int           `json:"successful_imports"`
+	FailedImports     int           `json:"failed_imports"`
+	Duplicates        int           `json:"duplicates"`
+	Status            string        `json:"status"`
+	ValidateOnly      bool          `json:"validate_only,omitempty"`
+	Errors            []importError `json:"errors,omitempty"`
+	TokensGenerated   []importToken `json:"tokens_generated,omitempty"`
+}
+
+var tokenImportCmd = &cobra.Command{
+	Use:   "import",
+	Short: "Import card numbers from a CSV, JSON or fixed-width file",
+	Long: `Tokenize cards in bulk from a CSV or JSON file (requires admin privileges).
+
+CSV files need a header row with at least card_number, expiry_month and
+expiry_year; card_holder, external_id, metadata and tags (key=value;key=value)
+are optional. JSON files contain an array of objects with the same fields, tags
+as an object. Tags given with --tag are set on every card, under the card's
+own. Use --file - to read stdin; gzip-compressed files are read as is.
+
+Fields that contain the delimiter, quotes or line breaks must be quoted.
+Headers are matched ignoring case, spaces and dashes, and common names such
+as "PAN" or "Exp Month" are understood; --header-alias maps others. Files
+in Latin-1, Windows-1252 or UTF-16 need --encoding unless they start with a
+byte order mark.
+
+Fixed-width files (--format fixed) need --layout, the character positions of
+each column, such as card_number=2-20,expiry=21-24,card_holder=25-50; expiry
+is read as --expiry-format, or expiry_month and expiry_year can be given
+apart. With --record-prefix only lines starting with it are read, skipping
+header and trailer records.
+
+With --validate-only the server checks every record and looks for duplicates
+the same way, but stores nothing, so a large file can be checked before it is
+imported.
+
+Large files are uploaded in chunks. Record numbers in the failure report
+refer to data records in the file, starting at 1.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		file, _ := cmd.Flags().GetString("file")
+		format, _ := cmd.Flags().GetString("format")
+		duplicates, _ := cmd.Flags().GetString("duplicates")
+		chunkSize, _ := cmd.Flags().GetInt("chunk-size")
+		batchSize, _ := cmd.Flags().GetInt("batch-size")
+		tenant, _ := cmd.Flags().GetString("tenant")
+		validateOnly, _ := cmd.Flags().GetBool("validate-only")
+		delimiter, _ := cmd.Flags().GetString("delimiter")
+		lazyQuotes, _ := cmd.Flags().GetBool("lazy-quotes")
+		encoding, _ := cmd.Flags().GetString("encoding")
+		compress, _ := cmd.Flags().GetBool("compress")
+		tags := tagFlags(cmd, "tag")
+		headerAliases := tagFlags(cmd, "header-alias")
+		layout := layoutFlag(cmd)
+		recordPrefix, _ := cmd.Flags().GetString("record-prefix")
+		expiryFormat, _ := cmd.Flags().GetString("expiry-format")
+
+		if file == "" {
+			fmt.Println("Error: --file is required")
+			os.Exit(1)
+		}
+		if format == "" {
+			format = strings.TrimPrefix(strings.ToLower(filepath.Ext(strings.TrimSuffix(file, ".gz"))), ".")
+		}
+		if format != "csv" && format != "json" && format != "fixed" {
+			fmt.Println("Error: --format must be csv, json or fixed")
+			os.Exit(1)
+		}
+		if format == "fixed" && len(layout) == 0 {
+			fmt.Println("Error: --layout is required with --format fixed")
+			os.Exit(1)
+		}
+		if duplicates != "skip" && duplicates != "overwrite" && duplicates != "error" && duplicates != "reuse" {
+			fmt.Println("Error: --duplicates must be skip, overwrite, error or reuse")
+			os.Exit(1)
+		}
+		if chunkSize <= 0 || chunkSize > maxImportChunkSize {
+			fmt.Printf("Error: --chunk-size must be between 1 and %d\n", maxImportChunkSize)
+			os.Exit(1)
+		}
+		if delimiter == `\t` {
+			delimiter = "\t"
+		}
+		comma, size := utf8.DecodeRuneInString(delimiter)
+		if size != len(delimiter) || comma == '"' || comma == '\r' || comma == '\n' || comma == utf8.RuneError {
+			fmt.Println("Error: --delimiter must be one character other than a quote or line break")
+			os.Exit(1)
+		}
+
+		data, err := readImportFile(file)
+		if err != nil {
+			fmt.Printf("Error reading %s: %v\n", file, err)
+			os.Exit(1)
+		}
+		// UTF-16 is converted here, as the file is split on its line breaks
+		if converted, ok := utf16ToUTF8(data, encoding); ok {
+			data, encoding = converted, ""
+		}
+
+		var chunks [][]byte
+		var recordLines []int // Line each CSV or fixed-width record starts on in the file
+		if format == "csv" {
+			chunks, recordLines, err = splitCSVImport(data, chunkSize, comma, lazyQuotes)
+		} else if format == "fixed" {
+			chunks, recordLines, err = splitFixedImport(data, chunkSize, recordPrefix)
+		} else {
+			chunks, err = splitJSONImport(data, chunkSize)
+		}
+		if err != nil {
+			fmt.Printf("Error parsing %s: %v\n", file, err)
+			os.Exit(1)
+		}
+
+		totalRecords := len(recordLines)
+		if format == "json" {
+			for _, chunk := range chunks {
+				totalRecords += countJSONRecords(chunk)
+			}
+		}
+
+		formatOptions := map[string]interface{}{}
+		switch format {
+		case "csv":
+			csv := map[string]interface{}{"delimiter": string(comma), "lazy_quotes": lazyQuotes}
+			if len(headerAliases) > 0 {
+				csv["header_aliases"] = headerAliases
+			}
+			formatOptions["csv"] = csv
+		case "fixed":
+			formatOptions["fixed_width"] = map[string]interface{}{
+				"columns":       layout,
+				"expiry_format": expiryFormat,
+				"record_prefix": recordPrefix,
+			}
+		}
+
+		summary := importSummary{File: file, Format: format, Chunks: len(chunks), ImportIDs: []string{}, ValidateOnly: validateOnly}
+		client := NewClient(apiURL, apiKey, adminSecret, sessionID)
+		progress := newProgressBar(totalRecords)
+
+		offset := 0
+		for i, chunk := range chunks {
+			request := map[string]interface{}{
+				"format":             format,
+				"duplicate_handling": duplicates,
+				"batch_size":         batchSize,
+				"tenant":             tenant,
+				"tags":               tags,
+				"validate_only":      validateOnly,
+			}
+			if encoding != "" {
+				request["encoding"] = encoding
+			}
+			for name, options := range formatOptions {
+				request[name] = options
+			}
+			if compress {
+				chunk = gzipChunk(chunk)
+				request["compression"] = "gzip"
+			}
+			request["data"] = base64.StdEncoding.EncodeToString(chunk)
+			reqBody, _ := json.Marshal(request)
+
+			resp, err := client.makeRequest("POST", "/api/v1/cards/import", bytes.NewReader(reqBody))
+			if err != nil {
+				progress.done()
+				fmt.Printf("Error uploading chunk %d/%d: %v\n", i+1, len(chunks), err)
+				os.Exit(1)
+			}
+
+			body, _ := io.ReadAll(resp.Body)
+			resp.Body.Close()
+
+			// 200, 206 and 400 with a result body all describe per-record outcomes;
+			// anything else (or a plain error body) aborts the import
+			var result importResult
+			if json.Unmarshal(body, &result) != nil || result.ImportID == "" {
+				progress.done()
+				var errResp map[string]interface{}
+				json.Unmarshal(body, &errResp)
+				fmt.Printf("Error importing chunk %d/%d: %s %v\n", i+1, len(chunks), resp.Status, errResp["error"])
+				if summary.TotalRecords > 0 {
+					fmt.Printf("%d records in earlier chunks were already processed (import IDs: %s)\n",
+						summary.TotalRecords, strings.Join(summary.ImportIDs, ", "))
+				}
+				os.Exit(1)
+			}
+
+			summary.ImportIDs = append(summary.ImportIDs, result.ImportID)
+			summary.TotalRecords += result.TotalRecords
+			summary.SuccessfulImports += result.SuccessfulImports
+			summary.FailedImports += result.FailedImports
+			summary.Duplicates += result.Duplicates
+			for _, e := range result.Errors {
+				e.RecordIndex += offset
+				if e.RecordIndex < len(recordLines) {
+					e.Line = recordLines[e.RecordIndex]
+				}
+				e.RecordIndex++
+				summary.Errors = append(summary.Errors, e)
+			}
+			for _, t := range result.TokensGenerated {
+				t.RecordIndex += offset + 1
+				summary.TokensGenerated = append(summary.TokensGenerated, t)
+			}
+
+			offset += result.TotalRecords
+			progress.set(offset)
+		}
+		progress.done()
+
+		switch {
+		case summary.FailedImports > 0 && summary.SuccessfulImports == 0:
+			summary.Status = "failed"
+		case summary.FailedImports > 0:
+			summary.Status = "partial"
+		default:
+			summary.Status = "completed"
+		}
+
+		if quiet {
+			for _, t := range summary.TokensGenerated {
+				if t.Token != "" {
+					fmt.Println(t.Token)
+				}
+			}
+		} else if !renderObject(summary, "") {
+			printImportSummary(summary)
+		}
+
+		if summary.FailedImports > 0 {
+			os.Exit(1)
+		}
+	},
+}
+
+var tokenExportCmd = &cobra.Command{
+	Use:   "export",
+	Short: "Export the token inventory to a CSV, JSON or fixed-width file",
+	Long: `Export token metadata (token, card type, BIN, last four digits, status,
+creation time and tags) for every token in the vault, or those with the tags
+given with --tag. Card numbers are never exported. Without --file the export
+is written to stdout.
+
+Fixed-width exports (--format fixed) write the columns given with --layout at
+their character positions, such as token=1-64,last_four=65-68; columns are
+token, card_type, first_six, last_four, is_active, created_at and tags.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		file, _ := cmd.Flags().GetString("file")
+		format, _ := cmd.Flags().GetString("format")
+		activeOnly, _ := cmd.Flags().GetBool("active-only")
+		filter := tagQuery(tagFlags(cmd, "tag"))
+		layout := layoutFlag(cmd)
+
+		if format == "" {
+			format = "csv"
+			if ext := strings.ToLower(filepath.Ext(file)); ext == ".json" {
+				format = "json"
+			}
+		}
+		if format != "csv" && format != "json" && format != "fixed" {
+			fmt.Println("Error: --format must be csv, json or fixed")
+			os.Exit(1)
+		}
+		var columns []fixedColumn
+		if format == "fixed" {
+			var err error
+			if columns, err = parseLayout(layout, tokenHeaders); err != nil {
+				fmt.Printf("Error: --layout: %v\n", err)
+				os.Exit(1)
+			}
+		}
+
+		client := NewClient(apiURL, apiKey, adminSecret, sessionID)
+		var tokens []interface{}
+		var progress *progressBar
+		for offset := 0; ; offset += exportPageSize {
+			endpoint := fmt.Sprintf("/api/v1/tokens?limit=%d&offset=%d%s", exportPageSize, offset, filter)
+			resp, err := client.makeRequest("GET", endpoint, nil)
+			if err != nil {
+				fmt.Printf("Error: %v\n", err)
+				os.Exit(1)
+			}
+
+			if resp.StatusCode != 200 {
+				resp.Body.Close()
+				fmt.Printf("API Error: %s\n", resp.Status)
+				os.Exit(1)
+			}
+
+			var result map[string]interface{}
+			err = json.NewDecoder(resp.Body).Decode(&result)
+			resp.Body.Close()
+			if err != nil {
+				fmt.Printf("Error parsing response: %v\n", err)
+				os.Exit(1)
+			}
+
+			page, _ := result["tokens"].([]interface{})
+			total, _ := result["total"].(float64)
+			if progress == nil {
+				progress = newProgressBar(int(total))
+			}
+
+			for _, t := range page {
+				token := t.(map[string]interface{})
+				if activeOnly && token["is_active"] != true {
+					continue
+				}
+				tokens = append(tokens, token)
+			}
+
+			progress.set(offset + len(page))
+			if len(page) < exportPageSize || offset+len(page) >= int(total) {
+				break
+			}
+		}
+		progress.done()
+
+		out := os.Stdout
+		if file != "" && file != "-" {
+			f, err := os.OpenFile(file, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+			if err != nil {
+				fmt.Printf("Error creating %s: %v\n", file, err)
+				os.Exit(1)
+			}
+			defer f.Close()
+			out = f
+		}
+
+		var err error
+		if format == "json" {
+			if tokens == nil {
+				tokens = []interface{}{}
+			}
+			enc := json.NewEncoder(out)
+			enc.SetIndent("", "  ")
+			err = enc.Encode(tokens)
+		} else if format == "fixed" {
+			err = writeFixedWidth(out, columns, tokenHeaders, tokenRows(tokens))
+		} else {
+			w := csv.NewWriter(out)
+			w.Write(tokenHeaders)
+			w.WriteAll(tokenRows(tokens))
+			err = w.Error()
+		}
+		if err != nil {
+			fmt.Printf("Error writing export: %v\n", err)
+			os.Exit(1)
+		}
+
+		if out != os.Stdout && humanOutput() {
+			fmt.Printf("Exported %d tokens to %s\n", len(tokens), file)
+		}
+	},
+}
+
+// fixedColumn is where a column goes in a fixed-width record
+type fixedColumn struct {
+	name       string
+	start, end int // 1-based character positions, inclusive
+}
+
+// layoutFlag returns the --layout columns, given one per flag or
+// comma-separated
+func layoutFlag(cmd *cobra.Command) map[string]string {
+	values, _ := cmd.Flags().GetStringArray("layout")
+	layout := make(map[string]string)
+	for _, value := range values {
+		for _, entry := range strings.Split(value, ",") {
+			name, position, ok := strings.Cut(strings.TrimSpace(entry), "=")
+			if !ok {
+				fmt.Printf("Error: --layout %q is not column=start-end\n", entry)
+				os.Exit(1)
+			}
+			layout[strings.TrimSpace(name)] = strings.TrimSpace(position)
+		}
+	}
+	return layout
+}
+
+// parseLayout reads fixed-width column positions given as name=start-end;
+// names must be among known
+func parseLayout(layout map[string]string, known []string) ([]fixedColumn, error) {
+	if len(layout) == 0 {
+		return nil, fmt.Errorf("give each column as name=start-end")
+	}
+	var columns []fixedColumn
+	for name, position := range layout {
+		found := false
+		for _, k := range known {
+			found = found || k == name
+		}
+		if !found {
+			return nil, fmt.Errorf("unknown column %q, use %s", name, strings.Join(known, ", "))
+		}
+		c := fixedColumn{name: name}
+		if _, err := fmt.Sscanf(position, "%d-%d", &c.start, &c.end); err != nil || c.start < 1 || c.end < c.start {
+			return nil, fmt.Errorf("invalid position %q for %s, use start-end, counting from 1", position, name)
+		}
+		columns = append(columns, c)
+	}
+	sort.Slice(columns, func(i, j int) bool { return columns[i].start < columns[j].start })
+	for i := 1; i < len(columns); i++ {
+		if columns[i].start <= columns[i-1].end {
+			return nil, fmt.Errorf("columns %s and %s overlap", columns[i-1].name, columns[i].name)
+		}
+	}
+	return columns, nil
+}
+
+// writeFixedWidth writes rows as fixed-width records, each value left-aligned
+// and padded with spaces. A value longer than its column is an error rather
+// than cut short.
+func writeFixedWidth(w io.Writer, columns []fixedColumn, headers []string, rows [][]string) error {
+	index := make(map[string]int, len(headers))
+	for i, header := range headers {
+		index[header] = i
+	}
+	for n, row := range rows {
+		var record []rune
+		for _, c := range columns {
+			value := []rune(row[index[c.name]])
+			if width := c.end - c.start + 1; len(value) > width {
+				return fmt.Errorf("record %d: %s is %d characters, the column %d", n+1, c.name, len(value), width)
+			}
+			for len(record) < c.start-1 {
+				record = append(record, ' ')
+			}
+			record = append(record, value...)
+			for len(record) < c.end {
+				record = append(record, ' ')
+			}
+		}
+		if _, err := fmt.Fprintln(w, string(record)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func readImportFile(file string) ([]byte, error) {
+	var data []byte
+	var err error
+	if file == "-" {
+		data, err = io.ReadAll(os.Stdin)
+	} else {
+		data, err = os.ReadFile(file)
+	}
+	if err != nil || !bytes.HasPrefix(data, []byte{0x1f, 0x8b}) {
+		return data, err
+	}
+	zr, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	return io.ReadAll(zr)
+}
+
+// utf16ToUTF8 converts data in UTF-16, told by its byte order mark or the
+// encoding given, to UTF-8
+func utf16ToUTF8(data []byte, encoding string) ([]byte, bool) {
+	var order binary.ByteOrder
+	switch encoding = strings.ToLower(encoding); {
+	case bytes.HasPrefix(data, []byte{0xFF, 0xFE}):
+		order, data = binary.LittleEndian, data[2:]
+	case bytes.HasPrefix(data, []byte{0xFE, 0xFF}):
+		order, data = binary.BigEndian, data[2:]
+	case encoding == "utf-16le":
+		order = binary.LittleEndian
+	case encoding == "utf-16be" || encoding == "utf-16":
+		order = binary.BigEndian
+	default:
+		return data, false
+	}
+	units := make([]uint16, len(data)/2)
+	for i := range units {
+		units[i] = order.Uint16(data[2*i:])
+	}
+	return []byte(string(utf16.Decode(units))), true
+}
+
+// splitCSVImport splits CSV data into chunks of at most size records, each
+// repeating the header row, and returns the line each record starts on.
+// Records are read the way the server reads them, so quoted fields may hold
+// the delimiter and line breaks.
+func splitCSVImport(data []byte, size int, delimiter rune, lazyQuotes bool) ([][]byte, []int, error) {
+	reader := csv.NewReader(bytes.NewReader(data))
+	reader.Comma = delimiter
+	reader.LazyQuotes = lazyQuotes
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+	if _, err := reader.Read(); err == io.EOF {
+		return nil, nil, fmt.Errorf("CSV file is empty")
+	} else if err != nil {
+		return nil, nil, err
+	}
+	header := data[:reader.InputOffset()]
+
+	var chunks [][]byte
+	var lines []int
+	var chunk []byte
+	start := reader.InputOffset()
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, nil, err
+		}
+		row := data[start:reader.InputOffset()]
+		start = reader.InputOffset()
+		if len(record) == 1 && strings.TrimSpace(record[0]) == "" {
+			continue
+		}
+
+		if chunk == nil {
+			chunk = append([]byte{}, header...)
+			if !bytes.HasSuffix(chunk, []byte("\n")) {
+				chunk = append(chunk, '\n')
+			}
+		}
+		chunk = append(chunk, row...)
+		if !bytes.HasSuffix(chunk, []byte("\n")) {
+			chunk = append(chunk, '\n')
+		}
+		line, _ := reader.FieldPos(0)
+		lines = append(lines, line)
+		if len(lines)%size == 0 {
+			chunks = append(chunks, chunk)
+			chunk = nil
+		}
+	}
+	if chunk != nil {
+		chunks = append(chunks, chunk)
+	}
+	if len(lines) == 0 {
+		return nil, nil, fmt.Errorf("CSV file has no data rows")
+	}
+	return chunks, lines, nil
+}
+
+// splitFixedImport splits fixed-width data into chunks of at most size
+// records, and returns the line each record is on. Only lines starting with
+// prefix are records; the others, such as header and trailer records, are
+// left out.
+func splitFixedImport(data []byte, size int, prefix string) ([][]byte, []int, error) {
+	var chunks [][]byte
+	var lines []int
+	var chunk []byte
+	for line, rest := 1, data; len(rest) > 0; line++ {
+		var text []byte
+		text, rest, _ = bytes.Cut(rest, []byte("\n"))
+		if len(bytes.TrimSpace(text)) == 0 || !bytes.HasPrefix(text, []byte(prefix)) {
+			continue
+		}
+		chunk = append(append(chunk, text...), '\n')
+		lines = append(lines, line)
+		if len(lines)%size == 0 {
+			chunks = append(chunks, chunk)
+			chunk = nil
+		}
+	}
+	if chunk != nil {
+		chunks = append(chunks, chunk)
+	}
+	if len(lines) == 0 {
+		return nil, nil, fmt.Errorf("file has no card records")
+	}
+	return chunks, lines, nil
+}
+
+// splitJSONImport splits a JSON array of card records into chunks of at most size records
+func splitJSONImport(data []byte, size int) ([][]byte, error) {
+	var records []json.RawMessage
+	if err := json.Unmarshal(data, &records); err != nil {
+		return nil, fmt.Errorf("expected a JSON array of card records: %v", err)
+	}
+	if len(records) == 0 {
+		return nil, fmt.Errorf("JSON file contains no records")
+	}
+
+	var chunks [][]byte
+	for i := 0; i < len(records); i += size {
+		end := i + size
+		if end > len(records) {
+			end = len(records)
+		}
+		chunk, err := json.Marshal(records[i:end])
+		if err != nil {
+			return nil, err
+		}
+		chunks = append(chunks, chunk)
+	}
+	return chunks, nil
+}
+
+func countJSONRecords(chunk []byte) int {
+	var records []json.RawMessage
+	json.Unmarshal(chunk, &records)
+	return len(records)
+}
+
+// gzipChunk compresses a chunk for upload with compression "gzip"
+func gzipChunk(chunk []byte) []byte {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	zw.Write(chunk)
+	zw.Close()
+	return buf.Bytes()
+}
+
+func printImportSummary(s importSummary) {
+	if s.ValidateOnly {
+		fmt.Printf("Validation %s (nothing was stored):\n", s.Status)
+	} else {
+		fmt.Printf("Import %s:\n", s.Status)
+	}
+	fmt.Printf("  File: %s (%s, %d chunk(s))\n", s.File, s.Format, s.Chunks)
+	fmt.Printf("  Import IDs: %s\n", strings.Join(s.ImportIDs, ", "))
+	fmt.Printf("  Total records: %d\n", s.TotalRecords)
+	fmt.Printf("  Successful: %d\n", s.SuccessfulImports)
+	fmt.Printf("  Duplicates: %d\n", s.Duplicates)
+	fmt.Printf("  Failed: %d\n", s.FailedImports)
+
+	if len(s.Errors) == 0 {
+		return
+	}
+
+	fmt.Printf("\nFailures:\n")
+	printHeader("%-8s %-8s %-20s %-12s %-25s %s\n", "RECORD", "LINE", "EXTERNAL_ID", "CARD", "ERROR", "REASON")
+	printHeader("%s\n", strings.Repeat("-", 109))
+	for _, e := range s.Errors {
+		line := "-"
+		if e.Line > 0 {
+			line = fmt.Sprint(e.Line)
+		}
+		fmt.Printf("%-8d %-8s %-20s %-12s %-25s %s\n",
+			e.RecordIndex,
+			line,
+			truncateString(e.ExternalID, 20),
+			e.CardNumber,
+			truncateString(e.Error, 25),
+			e.Reason,
+		)
+	}
+}
+
+// progressBar draws a single-line progress indicator on stderr. It stays
+// silent when stderr is not a terminal or output is machine-readable.
+type progressBar struct {
+	total   int
+	enabled bool
+}
+
+func newProgressBar(total int) *progressBar {
+	return &progressBar{
+		total:   total,
+		enabled: humanOutput() && total > 0 && term.IsTerminal(int(os.Stderr.Fd())),
+	}
+}
+
+func (p *progressBar) set(current int) {
+	if p == nil || !p.enabled {
+		return
+	}
+	if current > p.total {
+		current = p.total
+	}
+	const width = 40
+	filled := current * width / p.total
+	fmt.Fprintf(os.Stderr, "\r[%s%s] %3d%% (%d/%d)",
+		strings.Repeat("=", filled), strings.Repeat(" ", width-filled),
+		current*100/p.total, current, p.total)
+}
+
+func (p *progressBar) done() {
+	if p == nil || !p.enabled {
+		return
+	}
+	fmt.Fprintln(os.Stderr)
+}
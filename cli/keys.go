@@ -0,0 +1,395 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+// How often `key reencrypt` polls the server for job progress
+const reencryptPollInterval = 2 * time.Second
+
+// Key management commands
+var keyCmd = &cobra.Command{
+	Use:   "key",
+	Short: "Manage encryption keys",
+	Long:  "Commands for managing KEK/DEK encryption keys (requires admin privileges and USE_KEK_DEK=true on the server)",
+}
+
+var keyStatusCmd = &cobra.Command{
+	Use:   "status",
+	Short: "Show the active KEK and DEK",
+	Run: func(cmd *cobra.Command, args []string) {
+		result := keyAPIRequest("GET", "/api/v1/keys/status", nil, http.StatusOK)
+
+		if renderObject(result, "") {
+			return
+		}
+
+		fmt.Printf("Encryption Keys:\n\n")
+		printHeader("%-6s %-40s %-8s %-10s %-20s %-10s\n", "TYPE", "KEY_ID", "VERSION", "STATUS", "CREATED", "CARDS")
+		printHeader("%s\n", strings.Repeat("-", 100))
+		for _, keyType := range []string{"kek", "dek"} {
+			key, ok := result[keyType].(map[string]interface{})
+			if !ok {
+				fmt.Printf("%-6s %s\n", strings.ToUpper(keyType), "(no active key)")
+				continue
+			}
+			cards := "-"
+			if keyType == "dek" {
+				cards = csvValue(key["cards_encrypted"])
+			}
+			fmt.Printf("%-6s %-40s %-8v %-10v %-20s %-10s\n",
+				strings.ToUpper(keyType),
+				csvValue(key["key_id"]),
+				key["version"],
+				key["status"],
+				formatTime(csvValue(key["created_at"])),
+				cards,
+			)
+		}
+
+		// Retired DEKs still protecting cards, until re-encryption finishes
+		retired, _ := result["retired_deks"].([]interface{})
+		for _, r := range retired {
+			key := r.(map[string]interface{})
+			fmt.Printf("%-6s %-40s %-8v %-10v %-20s %-10s\n",
+				"DEK",
+				csvValue(key["key_id"]),
+				key["version"],
+				key["status"],
+				formatTime(csvValue(key["created_at"])),
+				csvValue(key["cards_remaining"]),
+			)
+		}
+		if legacy := csvValue(result["legacy_cards"]); legacy != "" && legacy != "0" {
+			fmt.Printf("%-6s %-40s %-8s %-10s %-20s %-10s\n", "-", "(legacy encryption)", "-", "-", "-", legacy)
+		}
+		if result["reencryption_complete"] == false {
+			fmt.Printf("\nSome cards still use retired keys. Run 'tokenshield key reencrypt' to migrate them.\n")
+		}
+	},
+}
+
+var keyRotateCmd = &cobra.Command{
+	Use:   "rotate",
+	Short: "Rotate the KEK, the DEK, or both",
+	Long: `Generate a new key and retire the current one.
+
+Rotating the DEK only affects newly tokenized cards. Run 'tokenshield key
+reencrypt' afterwards to move existing cards to the new DEK.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		keyType, _ := cmd.Flags().GetString("type")
+		force, _ := cmd.Flags().GetBool("force")
+
+		switch strings.ToLower(keyType) {
+		case "dek", "kek":
+			keyType = strings.ToUpper(keyType)
+		case "both":
+			keyType = "both"
+		default:
+			fmt.Println("Error: --type must be dek, kek or both")
+			os.Exit(1)
+		}
+
+		if !force && !confirmPrompt(fmt.Sprintf("Rotate %s now?", keyType)) {
+			fmt.Println("Cancelled")
+			return
+		}
+
+		body, _ := json.Marshal(map[string]string{"key_type": keyType})
+		result := keyAPIRequest("POST", "/api/v1/keys/rotate", body, http.StatusOK)
+
+		if renderObject(result, csvValue(result["rotation_id"])) {
+			return
+		}
+
+		fmt.Printf("Key rotation %s:\n", result["status"])
+		fmt.Printf("  Rotation ID: %s\n", result["rotation_id"])
+		fmt.Printf("  Rotated keys: %v\n", result["rotated_keys"])
+		if strings.Contains(fmt.Sprintf("%v", result["rotated_keys"]), "DEK") {
+			fmt.Printf("\nExisting cards still use the previous DEK. Run 'tokenshield key reencrypt' to migrate them.\n")
+		}
+	},
+}
+
+var keyHistoryCmd = &cobra.Command{
+	Use:   "history",
+	Short: "Show key rotation and re-encryption history",
+	Run: func(cmd *cobra.Command, args []string) {
+		limit, _ := cmd.Flags().GetInt("limit")
+
+		result := keyAPIRequest("GET", fmt.Sprintf("/api/v1/keys/rotations?limit=%d", limit), nil, http.StatusOK)
+		rotations, _ := result["rotations"].([]interface{})
+
+		var rows [][]string
+		for _, r := range rotations {
+			rotation := r.(map[string]interface{})
+			rows = append(rows, []string{
+				csvValue(rotation["rotation_id"]),
+				csvValue(rotation["key_type"]),
+				csvValue(rotation["status"]),
+				csvValue(rotation["started_at"]),
+				csvValue(rotation["completed_at"]),
+				csvValue(rotation["cards_rotated"]),
+				csvValue(rotation["cards_total"]),
+				csvValue(rotation["error_message"]),
+			})
+		}
+		if renderList(rotations, []string{"rotation_id", "key_type", "status", "started_at", "completed_at", "cards_rotated", "cards_total", "error_message"}, rows, 0) {
+			return
+		}
+
+		printHeader("Key rotation history (%d entries):\n\n", len(rotations))
+		printHeader("%-30s %-10s %-12s %-20s %-12s %s\n", "ROTATION_ID", "TYPE", "STATUS", "STARTED", "CARDS", "ERROR")
+		printHeader("%s\n", strings.Repeat("-", 110))
+		for _, row := range rows {
+			cards := "-"
+			if row[6] != "" {
+				cards = row[5] + "/" + row[6]
+			}
+			fmt.Printf("%-30s %-10s %-12s %-20s %-12s %s\n",
+				truncateString(row[0], 30),
+				row[1],
+				row[2],
+				formatTime(row[3]),
+				cards,
+				row[7],
+			)
+		}
+	},
+}
+
+var keyReencryptCmd = &cobra.Command{
+	Use:   "reencrypt",
+	Short: "Re-encrypt existing cards with the current DEK",
+	Long: `Start a server-side job that re-encrypts every card still protected by a
+retired DEK (or legacy encryption) with the current DEK, then follow its
+progress until it finishes. Use --no-wait to return as soon as the job starts.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		force, _ := cmd.Flags().GetBool("force")
+		noWait, _ := cmd.Flags().GetBool("no-wait")
+
+		if !force && !confirmPrompt("Re-encrypt all cards not using the current DEK?") {
+			fmt.Println("Cancelled")
+			return
+		}
+
+		result := keyAPIRequest("POST", "/api/v1/keys/reencrypt", nil, http.StatusAccepted)
+		rotationID := csvValue(result["rotation_id"])
+
+		if noWait {
+			if !renderObject(result, rotationID) {
+				fmt.Printf("Re-encryption started: %s (%s cards)\n", rotationID, csvValue(result["cards_total"]))
+				fmt.Printf("Follow progress with: tokenshield key history\n")
+			}
+			return
+		}
+
+		total, _ := result["cards_total"].(float64)
+		progress := newProgressBar(int(total))
+		if humanOutput() {
+			fmt.Printf("Re-encrypting %d cards (job %s)...\n", int(total), rotationID)
+		}
+
+		var job map[string]interface{}
+		for {
+			job = keyAPIRequest("GET", "/api/v1/keys/rotations/"+rotationID, nil, http.StatusOK)
+			rotated, _ := job["cards_rotated"].(float64)
+			progress.set(int(rotated))
+			if job["status"] != "in_progress" {
+				break
+			}
+			time.Sleep(reencryptPollInterval)
+		}
+		progress.done()
+
+		if !renderObject(job, rotationID) {
+			fmt.Printf("Re-encryption %s: %s/%s cards re-encrypted\n",
+				job["status"], csvValue(job["cards_rotated"]), csvValue(job["cards_total"]))
+			if job["error_message"] != nil {
+				fmt.Printf("  %s\n", job["error_message"])
+			}
+		}
+
+		if job["status"] != "completed" {
+			os.Exit(1)
+		}
+	},
+}
+
+var keyPolicyCmd = &cobra.Command{
+	Use:   "policy",
+	Short: "Manage scheduled key rotation policies",
+	Long: `Rotation policies rotate the active KEK or DEK automatically once it reaches
+a given age. The server checks them periodically; a rotation is skipped (and a
+security event raised) when a pre-rotation health check fails.`,
+}
+
+var keyPolicyListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "Show rotation policies and when each key is next due",
+	Run: func(cmd *cobra.Command, args []string) {
+		result := keyAPIRequest("GET", "/api/v1/keys/policies", nil, http.StatusOK)
+		policies, _ := result["policies"].([]interface{})
+
+		var rows [][]string
+		for _, p := range policies {
+			policy := p.(map[string]interface{})
+			rows = append(rows, []string{
+				csvValue(policy["key_type"]),
+				csvValue(policy["enabled"]),
+				csvValue(policy["interval_days"]),
+				csvValue(policy["reencrypt"]),
+				csvValue(policy["current_key_id"]),
+				csvValue(policy["next_rotation_at"]),
+				csvValue(policy["last_run_at"]),
+				csvValue(policy["last_status"]),
+				csvValue(policy["last_error"]),
+			})
+		}
+		if renderList(policies, []string{"key_type", "enabled", "interval_days", "reencrypt", "current_key_id", "next_rotation_at", "last_run_at", "last_status", "last_error"}, rows, 0) {
+			return
+		}
+
+		if len(rows) == 0 {
+			fmt.Println("No rotation policies configured")
+			return
+		}
+		printHeader("Rotation policies (checked every %v):\n\n", result["check_interval"])
+		printHeader("%-6s %-8s %-10s %-10s %-20s %-20s %s\n", "TYPE", "ENABLED", "INTERVAL", "REENCRYPT", "NEXT_ROTATION", "LAST_RUN", "LAST_STATUS")
+		printHeader("%s\n", strings.Repeat("-", 100))
+		for _, row := range rows {
+			status := row[7]
+			if row[8] != "" {
+				status += " (" + row[8] + ")"
+			}
+			fmt.Printf("%-6s %-8s %-10s %-10s %-20s %-20s %s\n",
+				row[0],
+				row[1],
+				row[2]+"d",
+				row[3],
+				formatTime(row[5]),
+				formatTime(row[6]),
+				status,
+			)
+		}
+	},
+}
+
+var keyPolicySetCmd = &cobra.Command{
+	Use:   "set [kek|dek]",
+	Short: "Create or replace the rotation policy for a key",
+	Args:  cobra.ExactArgs(1),
+	ValidArgsFunction: func(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+		return []string{"kek", "dek"}, cobra.ShellCompDirectiveNoFileComp
+	},
+	Run: func(cmd *cobra.Command, args []string) {
+		keyType := policyKeyType(args[0])
+		interval, _ := cmd.Flags().GetInt("interval-days")
+		disabled, _ := cmd.Flags().GetBool("disabled")
+		noReencrypt, _ := cmd.Flags().GetBool("no-reencrypt")
+
+		body, _ := json.Marshal(map[string]interface{}{
+			"interval_days": interval,
+			"enabled":       !disabled,
+			"reencrypt":     !noReencrypt,
+		})
+		result := keyAPIRequest("PUT", "/api/v1/keys/policies/"+keyType, body, http.StatusOK)
+
+		if renderObject(result, keyType) {
+			return
+		}
+		fmt.Printf("%s rotation policy saved: every %d days", keyType, interval)
+		if disabled {
+			fmt.Printf(" (disabled)")
+		}
+		fmt.Println()
+		if next := csvValue(result["next_rotation_at"]); next != "" {
+			fmt.Printf("  Next rotation: %s\n", formatTime(next))
+		}
+	},
+}
+
+var keyPolicyDeleteCmd = &cobra.Command{
+	Use:   "delete [kek|dek]",
+	Short: "Remove the rotation policy for a key",
+	Args:  cobra.ExactArgs(1),
+	ValidArgsFunction: func(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+		return []string{"kek", "dek"}, cobra.ShellCompDirectiveNoFileComp
+	},
+	Run: func(cmd *cobra.Command, args []string) {
+		keyType := policyKeyType(args[0])
+		keyAPIRequest("DELETE", "/api/v1/keys/policies/"+keyType, nil, http.StatusOK)
+		if humanOutput() {
+			fmt.Printf("%s rotation policy deleted\n", keyType)
+		}
+	},
+}
+
+// policyKeyType validates a kek/dek argument and returns it in upper case
+func policyKeyType(arg string) string {
+	keyType := strings.ToUpper(arg)
+	if keyType != "KEK" && keyType != "DEK" {
+		fmt.Println("Error: key type must be kek or dek")
+		os.Exit(1)
+	}
+	return keyType
+}
+
+// keyAPIRequest performs a key management call and exits on any error,
+// returning the decoded JSON body
+func keyAPIRequest(method, endpoint string, body []byte, expected int) map[string]interface{} {
+	client := NewClient(apiURL, apiKey, adminSecret, sessionID)
+
+	var resp *http.Response
+	var err error
+	if body != nil {
+		resp, err = client.makeRequest(method, endpoint, strings.NewReader(string(body)))
+	} else {
+		resp, err = client.makeRequest(method, endpoint, nil)
+	}
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+	defer resp.Body.Close()
+
+	var result map[string]interface{}
+	json.NewDecoder(resp.Body).Decode(&result)
+
+	if resp.StatusCode != expected {
+		switch {
+		case resp.StatusCode == http.StatusNotFound && strings.HasPrefix(endpoint, "/api/v1/keys/") && result == nil:
+			fmt.Println("Error: key management is not available (is USE_KEK_DEK enabled on the server?)")
+		case result["error"] != nil:
+			fmt.Printf("Error: %v\n", result["error"])
+		case result["errors"] != nil:
+			// Rotation failures report one message per key
+			fmt.Printf("Error: %s\n", resp.Status)
+			if errs, ok := result["errors"].([]interface{}); ok {
+				for _, e := range errs {
+					fmt.Printf("  %v\n", e)
+				}
+			}
+		default:
+			fmt.Printf("API Error: %s\n", resp.Status)
+		}
+		os.Exit(1)
+	}
+
+	return result
+}
+
+// confirmPrompt asks a y/N question on stdin
+func confirmPrompt(question string) bool {
+	fmt.Printf("%s (y/N): ", question)
+	var confirm string
+	fmt.Scanln(&confirm)
+	return confirm == "y" || confirm == "Y"
+}
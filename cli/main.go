@@ -1,11 +1,17 @@
 package main
 
 import (
+	"bufio"
+	"crypto/sha256"
 	"encoding/json"
 	"fmt"
 	"io"
+	"math/bits"
 	"net/http"
+	"net/url"
 	"os"
+	"sort"
+	"strconv"
 	"strings"
 	"syscall"
 	"time"
@@ -36,14 +42,17 @@ type TokenShieldClient struct {
 
 // Auth structures
 type AuthRequest struct {
-	Username string `json:"username"`
-	Password string `json:"password"`
+	Username          string `json:"username"`
+	Password          string `json:"password"`
+	ChallengeID       string `json:"challenge_id,omitempty"`
+	ChallengeResponse string `json:"challenge_response,omitempty"`
 }
 
 type AuthResponse struct {
-	SessionID string    `json:"session_id"`
-	User      User      `json:"user"`
-	ExpiresAt time.Time `json:"expires_at"`
+	SessionID             string    `json:"session_id"`
+	User                  User      `json:"user"`
+	ExpiresAt             time.Time `json:"expires_at"`
+	RequirePasswordChange bool      `json:"require_password_change"`
 }
 
 type User struct {
@@ -127,6 +136,10 @@ var versionCmd = &cobra.Command{
 			os.Exit(1)
 		}
 
+		if renderObject(result, fmt.Sprintf("%v", result["version"])) {
+			return
+		}
+
 		fmt.Printf("TokenShield CLI v1.0.0\n")
 		fmt.Printf("Server Version: %s\n", result["version"])
 		fmt.Printf("Token Format: %s\n", result["token_format"])
@@ -154,7 +167,7 @@ var configSecureCmd = &cobra.Command{
 		}
 		
 		// Check if config file contains sensitive data
-		hasSensitiveData := viper.GetString("session_id") != ""
+		hasSensitiveData := configHasSession()
 		
 		if !hasSensitiveData {
 			fmt.Printf("Configuration file %s contains no sensitive data\n", configFile)
@@ -205,6 +218,9 @@ var configShowCmd = &cobra.Command{
 		}
 		
 		fmt.Printf("Configuration file: %s\n", configFile)
+		if profile != "" {
+			fmt.Printf("Profile: %s\n", profile)
+		}
 		
 		// Check permissions
 		fileInfo, err := os.Stat(configFile)
@@ -225,12 +241,12 @@ var configShowCmd = &cobra.Command{
 		
 		// Show configured values (without revealing secrets)
 		fmt.Println("\nConfiguration:")
-		fmt.Printf("  API URL: %s\n", viper.GetString("api_url"))
+		fmt.Printf("  API URL: %s\n", apiURL)
 		
 		// API keys removed - CLI now uses session-based authentication like GUI
 		
-		if viper.GetString("session_id") != "" {
-			fmt.Printf("  Session: active (expires: %s)\n", viper.GetString("session_expires"))
+		if sessionID != "" {
+			fmt.Printf("  Session: active (expires: %s)\n", viper.GetString(configKey("session_expires")))
 		} else {
 			fmt.Printf("  Session: not logged in\n")
 		}
@@ -253,7 +269,7 @@ var tokenListCmd = &cobra.Command{
 		full, _ := cmd.Flags().GetBool("full")
 		
 		client := NewClient(apiURL, apiKey, adminSecret, sessionID)
-		endpoint := fmt.Sprintf("/api/v1/tokens?limit=%d", limit)
+		endpoint := fmt.Sprintf("/api/v1/tokens?limit=%d%s", limit, tagQuery(tagFlags(cmd, "tag")))
 		resp, err := client.makeRequest("GET", endpoint, nil)
 		if err != nil {
 			fmt.Printf("Error: %v\n", err)
@@ -274,12 +290,16 @@ var tokenListCmd = &cobra.Command{
 
 		tokens := result["tokens"].([]interface{})
 		
-		fmt.Printf("Found %d tokens:\n\n", len(tokens))
+		if renderList(tokens, tokenHeaders, tokenRows(tokens), 0) {
+			return
+		}
+		
+		printHeader("Found %d tokens:\n\n", len(tokens))
 		
 		if full {
 			// Full format for revocation - no truncation
-			fmt.Printf("%-70s %-12s %-8s %-10s %-20s\n", "TOKEN", "CARD_TYPE", "LAST_4", "ACTIVE", "CREATED")
-			fmt.Printf("%s\n", strings.Repeat("-", 120))
+			printHeader("%-70s %-12s %-8s %-10s %-20s\n", "TOKEN", "CARD_TYPE", "LAST_4", "ACTIVE", "CREATED")
+			printHeader("%s\n", strings.Repeat("-", 120))
 			
 			for _, t := range tokens {
 				token := t.(map[string]interface{})
@@ -298,8 +318,8 @@ var tokenListCmd = &cobra.Command{
 			}
 		} else {
 			// Compact format for overview
-			fmt.Printf("%-50s %-12s %-8s %-10s %-20s\n", "TOKEN", "CARD_TYPE", "LAST_4", "ACTIVE", "CREATED")
-			fmt.Printf("%s\n", strings.Repeat("-", 100))
+			printHeader("%-50s %-12s %-8s %-10s %-20s\n", "TOKEN", "CARD_TYPE", "LAST_4", "ACTIVE", "CREATED")
+			printHeader("%s\n", strings.Repeat("-", 100))
 			
 			for _, t := range tokens {
 				token := t.(map[string]interface{})
@@ -326,21 +346,42 @@ var tokenSearchCmd = &cobra.Command{
 	Run: func(cmd *cobra.Command, args []string) {
 		lastFour, _ := cmd.Flags().GetString("last-four")
 		cardType, _ := cmd.Flags().GetString("card-type")
+		holder, _ := cmd.Flags().GetString("holder")
 		limit, _ := cmd.Flags().GetInt("limit")
 		active, _ := cmd.Flags().GetBool("active")
+		sort, _ := cmd.Flags().GetString("sort")
+		order, _ := cmd.Flags().GetString("order")
 		
 		searchReq := map[string]interface{}{
 			"limit": limit,
+			"sort":  sort,
+			"order": order,
 		}
 		
 		if lastFour != "" {
-			searchReq["last_four"] = lastFour
+			searchReq["lastFour"] = lastFour
 		}
 		if cardType != "" {
-			searchReq["card_type"] = cardType
+			searchReq["cardType"] = cardType
+		}
+		if holder != "" {
+			searchReq["cardHolder"] = holder
+		}
+		for flag, field := range map[string]string{
+			"external-id": "external_id",
+			"tenant":      "tenant",
+			"expiry-from": "expiry_from",
+			"expiry-to":   "expiry_to",
+		} {
+			if value, _ := cmd.Flags().GetString(flag); value != "" {
+				searchReq[field] = value
+			}
 		}
 		if cmd.Flags().Changed("active") {
-			searchReq["is_active"] = active
+			searchReq["active"] = active
+		}
+		if tags := tagFlags(cmd, "tag"); len(tags) > 0 {
+			searchReq["tags"] = tags
 		}
 		
 		reqBody, _ := json.Marshal(searchReq)
@@ -366,9 +407,13 @@ var tokenSearchCmd = &cobra.Command{
 
 		tokens := result["tokens"].([]interface{})
 		
-		fmt.Printf("Search found %d tokens:\n\n", len(tokens))
-		fmt.Printf("%-50s %-12s %-8s %-10s %-20s\n", "TOKEN", "CARD_TYPE", "LAST_4", "ACTIVE", "CREATED")
-		fmt.Printf("%s\n", strings.Repeat("-", 100))
+		if renderList(tokens, tokenHeaders, tokenRows(tokens), 0) {
+			return
+		}
+		
+		printHeader("Search found %d tokens:\n\n", len(tokens))
+		printHeader("%-50s %-12s %-8s %-10s %-20s\n", "TOKEN", "CARD_TYPE", "LAST_4", "ACTIVE", "CREATED")
+		printHeader("%s\n", strings.Repeat("-", 100))
 		
 		for _, t := range tokens {
 			token := t.(map[string]interface{})
@@ -388,6 +433,90 @@ var tokenSearchCmd = &cobra.Command{
 	},
 }
 
+var tokenShowCmd = &cobra.Command{
+	Use:   "show [token]",
+	Short: "Show a token's card details, key and usage",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		token := args[0]
+
+		client := NewClient(apiURL, apiKey, adminSecret, sessionID)
+		resp, err := client.makeRequest("GET", fmt.Sprintf("/api/v1/tokens/%s", token), nil)
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+		defer resp.Body.Close()
+
+		if resp.StatusCode == 404 {
+			fmt.Fprintf(os.Stderr, "Token not found: %s\n", token)
+			os.Exit(1)
+		} else if resp.StatusCode != 200 {
+			fmt.Printf("API Error: %s\n", resp.Status)
+			os.Exit(1)
+		}
+
+		var result map[string]interface{}
+		if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+			fmt.Printf("Error parsing response: %v\n", err)
+			os.Exit(1)
+		}
+		if renderObject(result, token) {
+			return
+		}
+
+		// Fields missing from the response are shown as "-"
+		field := func(name string) string {
+			if v, ok := result[name]; ok && v != nil {
+				return fmt.Sprintf("%v", v)
+			}
+			return "-"
+		}
+		expiry := "-"
+		if result["expiry_month"] != nil && result["expiry_year"] != nil {
+			expiry = fmt.Sprintf("%02.0f/%.0f", result["expiry_month"], result["expiry_year"])
+		}
+		metadata := "-"
+		if result["metadata"] != nil {
+			b, _ := json.Marshal(result["metadata"])
+			metadata = string(b)
+		}
+		key := "legacy"
+		if result["encryption_key_id"] != nil {
+			key = fmt.Sprintf("%s (version %s, %s)", field("encryption_key_id"), field("encryption_key_version"), field("encryption_key_status"))
+		}
+		lastUsed := "never"
+		if result["last_used_at"] != nil {
+			lastUsed = formatTime(field("last_used_at"))
+		}
+
+		fmt.Printf("Token:       %s\n", token)
+		fmt.Printf("Card:        %s %s******%s\n", field("card_type"), field("first_six"), field("last_four"))
+		if result["card_holder_name"] != nil {
+			fmt.Printf("Holder:      %s\n", field("card_holder_name"))
+		}
+		fmt.Printf("Expiry:      %s\n", expiry)
+		fmt.Printf("Active:      %s\n", field("is_active"))
+		if result["revoked_at"] != nil {
+			purge := "never"
+			if result["purge_after"] != nil {
+				purge = formatTime(field("purge_after"))
+			}
+			fmt.Printf("Revoked:     %s (purged %s)\n", formatTime(field("revoked_at")), purge)
+		}
+		fmt.Printf("Source:      %s\n", field("source"))
+		fmt.Printf("External ID: %s\n", field("external_id"))
+		fmt.Printf("Tenant:      %s\n", field("tenant"))
+		fmt.Printf("Metadata:    %s\n", metadata)
+		if tags, _ := result["tags"].(map[string]interface{}); len(tags) > 0 {
+			fmt.Printf("Tags:        %s\n", formatTags(tags))
+		}
+		fmt.Printf("Key:         %s\n", key)
+		fmt.Printf("Created:     %s\n", formatTime(field("created_at")))
+		fmt.Printf("Uses:        %s (last used %s)\n", field("use_count"), lastUsed)
+	},
+}
+
 var tokenRevokeCmd = &cobra.Command{
 	Use:   "revoke [token]",
 	Short: "Revoke a token",
@@ -405,9 +534,18 @@ var tokenRevokeCmd = &cobra.Command{
 		defer resp.Body.Close()
 
 		if resp.StatusCode == 200 {
+			var result map[string]interface{}
+			json.NewDecoder(resp.Body).Decode(&result)
+			if renderObject(map[string]interface{}{"token": token, "revoked": true, "purge_after": result["purge_after"]}, token) {
+				return
+			}
 			fmt.Printf("Token %s revoked successfully\n", token)
+			if purgeAfter, ok := result["purge_after"].(string); ok {
+				fmt.Printf("It can be restored with 'tokenshield token restore' until %s\n", formatTime(purgeAfter))
+			}
 		} else if resp.StatusCode == 404 {
-			fmt.Printf("Token not found: %s\n", token)
+			fmt.Fprintf(os.Stderr, "Token not found: %s\n", token)
+			os.Exit(1)
 		} else {
 			fmt.Printf("API Error: %s\n", resp.Status)
 			os.Exit(1)
@@ -415,6 +553,289 @@ var tokenRevokeCmd = &cobra.Command{
 	},
 }
 
+var tokenRestoreCmd = &cobra.Command{
+	Use:   "restore [token]",
+	Short: "Restore a revoked token before it is purged",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		token := args[0]
+
+		client := NewClient(apiURL, apiKey, adminSecret, sessionID)
+		endpoint := fmt.Sprintf("/api/v1/tokens/%s/restore", token)
+		resp, err := client.makeRequest("POST", endpoint, nil)
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+		defer resp.Body.Close()
+
+		if resp.StatusCode == 200 {
+			if renderObject(map[string]interface{}{"token": token, "restored": true}, token) {
+				return
+			}
+			fmt.Printf("Token %s restored successfully\n", token)
+			return
+		}
+
+		var errResp map[string]string
+		json.NewDecoder(resp.Body).Decode(&errResp)
+		switch {
+		case resp.StatusCode == 404:
+			fmt.Fprintf(os.Stderr, "Token not found (or already purged): %s\n", token)
+		case errResp["active_token"] != "":
+			fmt.Fprintf(os.Stderr, "Error: %s: %s\n", errResp["error"], errResp["active_token"])
+		case errResp["error"] != "":
+			fmt.Fprintf(os.Stderr, "Error: %s\n", errResp["error"])
+		default:
+			fmt.Fprintf(os.Stderr, "API Error: %s\n", resp.Status)
+		}
+		os.Exit(1)
+	},
+}
+
+var tokenBulkCmd = &cobra.Command{
+	Use:   "bulk [revoke|restore|set-expiry|tag]",
+	Short: "Apply an operation to many tokens at once",
+	Long: `Apply an operation to many tokens, given with --file (one token per
+line, - for stdin) or selected with the search filter flags. The server
+changes them in transactions of --batch-size tokens and reports the outcome
+for each token; quiet mode prints the tokens that were changed.
+
+  tokenshield token bulk revoke --tenant acme
+  tokenshield token bulk set-expiry --file tokens.txt --expiry 2028-12
+  tokenshield token bulk tag --tenant acme --tag merchant=acme --untag legacy
+  tokenshield token bulk revoke --with-tag env=staging`,
+	Args:      cobra.ExactArgs(1),
+	ValidArgs: []string{"revoke", "restore", "set-expiry", "tag"},
+	Run: func(cmd *cobra.Command, args []string) {
+		req := map[string]interface{}{"operation": args[0]}
+		if batchSize, _ := cmd.Flags().GetInt("batch-size"); batchSize > 0 {
+			req["batch_size"] = batchSize
+		}
+
+		if file, _ := cmd.Flags().GetString("file"); file != "" {
+			in := os.Stdin
+			if file != "-" {
+				f, err := os.Open(file)
+				if err != nil {
+					fmt.Printf("Error: %v\n", err)
+					os.Exit(1)
+				}
+				defer f.Close()
+				in = f
+			}
+			var tokens []string
+			lines := bufio.NewScanner(in)
+			for lines.Scan() {
+				if token := strings.TrimSpace(lines.Text()); token != "" {
+					tokens = append(tokens, token)
+				}
+			}
+			if err := lines.Err(); err != nil {
+				fmt.Printf("Error reading tokens: %v\n", err)
+				os.Exit(1)
+			}
+			req["tokens"] = tokens
+		} else {
+			filter := map[string]interface{}{}
+			for flag, field := range map[string]string{
+				"last-four":   "lastFour",
+				"card-type":   "cardType",
+				"external-id": "external_id",
+				"tenant":      "tenant",
+				"expiry-from": "expiry_from",
+				"expiry-to":   "expiry_to",
+			} {
+				if value, _ := cmd.Flags().GetString(flag); value != "" {
+					filter[field] = value
+				}
+			}
+			if cmd.Flags().Changed("active") {
+				active, _ := cmd.Flags().GetBool("active")
+				filter["active"] = active
+			}
+			if tags := tagFlags(cmd, "with-tag"); len(tags) > 0 {
+				filter["tags"] = tags
+			}
+			if len(filter) == 0 {
+				fmt.Println("Error: give --file or at least one filter flag")
+				os.Exit(1)
+			}
+			req["filter"] = filter
+		}
+
+		switch args[0] {
+		case "set-expiry":
+			expiry, _ := cmd.Flags().GetString("expiry")
+			t, err := time.Parse("2006-01", expiry)
+			if err != nil {
+				fmt.Println("Error: set-expiry needs --expiry YYYY-MM")
+				os.Exit(1)
+			}
+			req["expiry_month"] = int(t.Month())
+			req["expiry_year"] = t.Year()
+		case "tag":
+			tags := map[string]interface{}{}
+			for key, value := range tagFlags(cmd, "tag") {
+				tags[key] = value
+			}
+			unset, _ := cmd.Flags().GetStringArray("untag")
+			for _, key := range unset {
+				tags[key] = nil
+			}
+			req["tags"] = tags
+		}
+
+		reqBody, _ := json.Marshal(req)
+		client := NewClient(apiURL, apiKey, adminSecret, sessionID)
+		resp, err := client.makeRequest("POST", "/api/v1/tokens/bulk", strings.NewReader(string(reqBody)))
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+		defer resp.Body.Close()
+
+		var result map[string]interface{}
+		if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+			fmt.Printf("Error parsing response: %v\n", err)
+			os.Exit(1)
+		}
+		if resp.StatusCode != 200 {
+			if result["error"] != nil {
+				fmt.Printf("Error: %v\n", result["error"])
+			} else {
+				fmt.Printf("API Error: %s\n", resp.Status)
+			}
+			os.Exit(1)
+		}
+
+		results, _ := result["results"].([]interface{})
+		if quiet {
+			for _, item := range results {
+				if r := item.(map[string]interface{}); r["status"] == "updated" {
+					fmt.Println(r["token"])
+				}
+			}
+			return
+		}
+		var rows [][]string
+		for _, item := range results {
+			r := item.(map[string]interface{})
+			reason, _ := r["reason"].(string)
+			rows = append(rows, []string{r["token"].(string), r["status"].(string), reason})
+		}
+		if renderList(result, []string{"token", "status", "reason"}, rows, 0) {
+			return
+		}
+
+		fmt.Printf("%s: %v matched, %v updated, %v skipped, %v not found, %v failed\n", args[0],
+			result["matched"], result["updated"], result["skipped"], result["not_found"], result["failed"])
+		for _, row := range rows {
+			if row[1] != "updated" {
+				fmt.Printf("  %-50s %-10s %s\n", row[0], row[1], row[2])
+			}
+		}
+	},
+}
+
+var tokenRevealCmd = &cobra.Command{
+	Use:   "reveal [token]",
+	Short: "Show the card behind a token (masked unless --full)",
+	Long: `Show the card behind a token. By default only the masked card number
+(BIN and last four digits) is shown and nothing is decrypted.
+
+--full decrypts and shows the complete card number. It requires the
+tokens.detokenize permission, a reason (recorded in the audit log) and an
+interactive confirmation, so it cannot be used from scripts.`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		token := args[0]
+		full, _ := cmd.Flags().GetBool("full")
+		reason, _ := cmd.Flags().GetString("reason")
+
+		client := NewClient(apiURL, apiKey, adminSecret, sessionID)
+		endpoint := fmt.Sprintf("/api/v1/tokens/%s/reveal", token)
+
+		method := "GET"
+		var body io.Reader
+		if full {
+			if !term.IsTerminal(int(syscall.Stdin)) {
+				fmt.Println("Error: --full requires an interactive terminal for confirmation")
+				os.Exit(1)
+			}
+			
+			stdin := bufio.NewReader(os.Stdin)
+			if reason == "" {
+				fmt.Print("Reason for revealing this card (recorded in the audit log): ")
+				line, _ := stdin.ReadString('\n')
+				reason = strings.TrimSpace(line)
+			}
+			if reason == "" {
+				fmt.Println("Error: a reason is required")
+				os.Exit(1)
+			}
+			
+			fmt.Printf("This will decrypt and display the full card number for %s.\n", token)
+			fmt.Print("Type 'reveal' to continue: ")
+			confirm, _ := stdin.ReadString('\n')
+			if strings.TrimSpace(confirm) != "reveal" {
+				fmt.Println("Cancelled")
+				return
+			}
+			
+			reqBody, _ := json.Marshal(map[string]string{"reason": reason})
+			method = "POST"
+			body = strings.NewReader(string(reqBody))
+		}
+
+		resp, err := client.makeRequest(method, endpoint, body)
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+		defer resp.Body.Close()
+
+		if resp.StatusCode != 200 {
+			var errResp map[string]string
+			json.NewDecoder(resp.Body).Decode(&errResp)
+			if resp.StatusCode == 403 && full {
+				fmt.Println("Error: revealing full card numbers requires the tokens.detokenize permission")
+			} else if errResp["error"] != "" {
+				fmt.Printf("Error: %s\n", errResp["error"])
+			} else {
+				fmt.Printf("API Error: %s\n", resp.Status)
+			}
+			os.Exit(1)
+		}
+
+		var result map[string]interface{}
+		if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+			fmt.Printf("Error parsing response: %v\n", err)
+			os.Exit(1)
+		}
+
+		id := fmt.Sprintf("%v", result["masked_card"])
+		if full {
+			id = fmt.Sprintf("%v", result["card_number"])
+		}
+		if renderObject(result, id) {
+			return
+		}
+
+		fmt.Printf("Token:     %s\n", token)
+		fmt.Printf("Card Type: %v\n", result["card_type"])
+		if full {
+			fmt.Printf("Card:      %v\n", result["card_number"])
+		} else {
+			fmt.Printf("Card:      %v\n", result["masked_card"])
+		}
+		if result["expiry"] != nil {
+			fmt.Printf("Expiry:    %v\n", result["expiry"])
+		}
+		fmt.Printf("Active:    %v\n", result["is_active"])
+	},
+}
+
 // API Key commands
 var apiKeyCmd = &cobra.Command{
 	Use:   "apikey",
@@ -447,9 +868,23 @@ var apiKeyListCmd = &cobra.Command{
 
 		apiKeys := result["api_keys"].([]interface{})
 		
-		fmt.Printf("Found %d API keys:\n\n", len(apiKeys))
-		fmt.Printf("%-30s %-20s %-10s %-20s\n", "API_KEY", "CLIENT_NAME", "ACTIVE", "CREATED")
-		fmt.Printf("%s\n", strings.Repeat("-", 80))
+		var rows [][]string
+		for _, k := range apiKeys {
+			key := k.(map[string]interface{})
+			rows = append(rows, []string{
+				csvValue(key["api_key"]),
+				csvValue(key["client_name"]),
+				csvValue(key["is_active"]),
+				csvValue(key["created_at"]),
+			})
+		}
+		if renderList(apiKeys, []string{"api_key", "client_name", "is_active", "created_at"}, rows, 0) {
+			return
+		}
+		
+		printHeader("Found %d API keys:\n\n", len(apiKeys))
+		printHeader("%-30s %-20s %-10s %-20s\n", "API_KEY", "CLIENT_NAME", "ACTIVE", "CREATED")
+		printHeader("%s\n", strings.Repeat("-", 80))
 		
 		for _, k := range apiKeys {
 			key := k.(map[string]interface{})
@@ -471,11 +906,15 @@ var apiKeyCreateCmd = &cobra.Command{
 	Run: func(cmd *cobra.Command, args []string) {
 		clientName := args[0]
 		permissions, _ := cmd.Flags().GetStringSlice("permissions")
+		signed, _ := cmd.Flags().GetBool("signed")
 		
 		createReq := map[string]interface{}{
 			"client_name": clientName,
 			"permissions": permissions,
 		}
+		if signed {
+			createReq["signed"] = true
+		}
 		
 		reqBody, _ := json.Marshal(createReq)
 		
@@ -494,10 +933,18 @@ var apiKeyCreateCmd = &cobra.Command{
 				os.Exit(1)
 			}
 			
+			if renderObject(result, fmt.Sprintf("%v", result["api_key"])) {
+				return
+			}
+			
 			fmt.Printf("API key created successfully:\n")
 			fmt.Printf("API Key: %s\n", result["api_key"])
 			fmt.Printf("Client: %s\n", result["client_name"])
 			fmt.Printf("Permissions: %v\n", result["permissions"])
+			if secret, ok := result["signing_secret"].(string); ok {
+				fmt.Printf("Signing Secret: %s\n", secret)
+				fmt.Printf("\nStore the signing secret now, it is not shown again. The key only accepts signed requests.\n")
+			}
 		} else {
 			fmt.Printf("API Error: %s\n", resp.Status)
 			os.Exit(1)
@@ -509,55 +956,44 @@ var apiKeyCreateCmd = &cobra.Command{
 var activityCmd = &cobra.Command{
 	Use:   "activity",
 	Short: "Show recent activity",
+	Long: `Show recent tokenization activity, optionally filtered by request type,
+source IP or token. With --follow, new events are printed as they happen.`,
 	Run: func(cmd *cobra.Command, args []string) {
-		limit, _ := cmd.Flags().GetInt("limit")
+		follow, _ := cmd.Flags().GetBool("follow")
+		interval, _ := cmd.Flags().GetDuration("interval")
 		
 		client := NewClient(apiURL, apiKey, adminSecret, sessionID)
-		endpoint := fmt.Sprintf("/api/v1/activity?limit=%d", limit)
-		resp, err := client.makeRequest("GET", endpoint, nil)
+		query := activityQuery(cmd)
+		
+		if follow {
+			if interval < time.Second {
+				fmt.Println("Error: --interval must be at least 1s")
+				os.Exit(1)
+			}
+			followActivity(client, query, interval)
+			return
+		}
+		
+		activities, err := fetchActivity(client, query)
 		if err != nil {
 			fmt.Printf("Error: %v\n", err)
 			os.Exit(1)
 		}
-		defer resp.Body.Close()
-
-		if resp.StatusCode != 200 {
-			fmt.Printf("API Error: %s\n", resp.Status)
-			os.Exit(1)
+		
+		var rows [][]string
+		for _, a := range activities {
+			rows = append(rows, activityRow(a.(map[string]interface{})))
 		}
-
-		var result map[string]interface{}
-		if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
-			fmt.Printf("Error parsing response: %v\n", err)
-			os.Exit(1)
+		if renderList(activities, activityHeaders, rows, 0) {
+			return
 		}
-
-		activities := result["activities"].([]interface{})
 		
-		fmt.Printf("Recent activity (%d entries):\n\n", len(activities))
-		fmt.Printf("%-20s %-12s %-8s %-15s %-20s\n", "TIMESTAMP", "TYPE", "LAST_4", "SOURCE_IP", "STATUS")
-		fmt.Printf("%s\n", strings.Repeat("-", 80))
+		printHeader("Recent activity (%d entries):\n\n", len(activities))
+		printHeader("%-20s %-12s %-8s %-15s %-20s\n", "TIMESTAMP", "TYPE", "LAST_4", "SOURCE_IP", "STATUS")
+		printHeader("%s\n", strings.Repeat("-", 80))
 		
 		for _, a := range activities {
-			activity := a.(map[string]interface{})
-			
-			lastFour := "N/A"
-			if activity["card_last_four"] != nil {
-				lastFour = activity["card_last_four"].(string)
-			}
-			
-			status := "N/A"
-			if activity["status"] != nil {
-				status = fmt.Sprintf("%.0f", activity["status"].(float64))
-			}
-			
-			fmt.Printf("%-20s %-12s %-8s %-15s %-20s\n",
-				formatTime(activity["timestamp"].(string)),
-				activity["type"].(string),
-				lastFour,
-				activity["source_ip"].(string),
-				status,
-			)
+			printActivityLine(a.(map[string]interface{}))
 		}
 	},
 }
@@ -586,6 +1022,10 @@ var statsCmd = &cobra.Command{
 			os.Exit(1)
 		}
 
+		if renderObject(result, "") {
+			return
+		}
+
 		fmt.Printf("TokenShield Statistics:\n\n")
 		fmt.Printf("Active Tokens: %.0f\n", result["active_tokens"].(float64))
 		
@@ -595,6 +1035,13 @@ var statsCmd = &cobra.Command{
 				fmt.Printf("  %s: %.0f\n", reqType, count.(float64))
 			}
 		}
+
+		if inactivity, ok := result["inactivity"].(map[string]interface{}); ok {
+			fmt.Printf("\nInactivity (users after %v days, API keys after %v days; 0 is never):\n",
+				inactivity["inactive_user_days"], inactivity["stale_api_key_days"])
+			fmt.Printf("  Users disabled: %v, warned: %v\n", inactivity["users_disabled"], inactivity["users_warned"])
+			fmt.Printf("  API keys disabled: %v, warned: %v\n", inactivity["api_keys_disabled"], inactivity["api_keys_warned"])
+		}
 	},
 }
 
@@ -631,20 +1078,43 @@ var loginCmd = &cobra.Command{
 			Password: password,
 		}
 		
-		body, _ := json.Marshal(authReq)
-		resp, err := client.makeRequest("POST", "/api/v1/auth/login", strings.NewReader(string(body)))
-		if err != nil {
-			fmt.Printf("Error: %v\n", err)
-			os.Exit(1)
-		}
-		defer resp.Body.Close()
-		
-		if resp.StatusCode != 200 {
-			var errResp map[string]string
+		var resp *http.Response
+		for attempt := 0; ; attempt++ {
+			body, _ := json.Marshal(authReq)
+			var err error
+			resp, err = client.makeRequest("POST", "/api/v1/auth/login", strings.NewReader(string(body)))
+			if err != nil {
+				fmt.Printf("Error: %v\n", err)
+				os.Exit(1)
+			}
+			if resp.StatusCode == 200 {
+				break
+			}
+			
+			var errResp struct {
+				Error       string `json:"error"`
+				Code        string `json:"code"`
+				Type        string `json:"type"`
+				ChallengeID string `json:"challenge_id"`
+				Difficulty  int    `json:"difficulty"`
+			}
 			json.NewDecoder(resp.Body).Decode(&errResp)
-			fmt.Printf("Login failed: %s\n", errResp["error"])
+			resp.Body.Close()
+			// After repeated failures the server asks for a proof of work,
+			// which the CLI can do; a CAPTCHA needs the web interface
+			if errResp.Code == "challenge_required" && errResp.Type == "pow" && attempt < 2 {
+				fmt.Fprintf(os.Stderr, "Too many failed logins; solving the server's challenge...\n")
+				authReq.ChallengeID = errResp.ChallengeID
+				authReq.ChallengeResponse = solveLoginChallenge(errResp.ChallengeID, errResp.Difficulty)
+				continue
+			}
+			fmt.Printf("Login failed: %s\n", errResp.Error)
+			if errResp.Code == "challenge_required" {
+				fmt.Printf("Solve the %s challenge by logging in through the web interface\n", errResp.Type)
+			}
 			os.Exit(1)
 		}
+		defer resp.Body.Close()
 		
 		var authResp AuthResponse
 		if err := json.NewDecoder(resp.Body).Decode(&authResp); err != nil {
@@ -653,42 +1123,61 @@ var loginCmd = &cobra.Command{
 		}
 		
 		// Save session to config
-		viper.Set("session_id", authResp.SessionID)
-		viper.Set("session_expires", authResp.ExpiresAt.Format(time.RFC3339))
-		viper.Set("username", authResp.User.Username)
+		viper.Set(configKey("session_id"), authResp.SessionID)
+		viper.Set(configKey("session_expires"), authResp.ExpiresAt.Format(time.RFC3339))
+		viper.Set(configKey("username"), authResp.User.Username)
 		
 		// Ensure API URL is saved if not already set
-		if viper.GetString("api_url") == "" {
-			viper.Set("api_url", apiURL)
+		if viper.GetString(configKey("api_url")) == "" {
+			viper.Set(configKey("api_url"), apiURL)
 		}
 		
-		// Write config file
-		if err := viper.WriteConfig(); err != nil {
-			// Config file doesn't exist, create it
-			home, err := os.UserHomeDir()
-			if err != nil {
-				fmt.Printf("Error getting home directory: %v\n", err)
-				os.Exit(1)
-			}
-			
-			configPath := home + "/.tokenshield.yaml"
-			viper.SetConfigFile(configPath)
-			
-			if err := viper.WriteConfigAs(configPath); err != nil {
-				fmt.Printf("Error creating config file: %v\n", err)
-				fmt.Printf("Session saved temporarily but won't persist\n")
-			} else {
-				fmt.Printf("Created config file: %s\n", configPath)
-				// Set secure permissions on new config file
-				os.Chmod(configPath, 0600)
-			}
+		// Write config file, creating it with secure permissions if needed
+		if configPath, err := writeConfig(); err != nil {
+			fmt.Printf("Error creating config file: %v\n", err)
+			fmt.Printf("Session saved temporarily but won't persist\n")
+		} else if configPath != "" {
+			fmt.Printf("Created config file: %s\n", configPath)
+		}
+		
+		if !humanOutput() {
+			renderObject(map[string]interface{}{
+				"username":   authResp.User.Username,
+				"role":       authResp.User.Role,
+				"expires_at": authResp.ExpiresAt.Format(time.RFC3339),
+			}, authResp.User.Username)
+			return
 		}
 		
 		fmt.Printf("Successfully logged in as %s (%s)\n", authResp.User.Username, authResp.User.Role)
 		fmt.Printf("Session expires: %s\n", authResp.ExpiresAt.Local().Format("2006-01-02 15:04:05"))
+		if authResp.RequirePasswordChange {
+			fmt.Printf("\n⚠️  Your password was set by an administrator and must be changed.\n")
+			fmt.Printf("   Run 'tokenshield passwd' to choose a new password; other commands are refused until then.\n")
+		}
 	},
 }
 
+// solveLoginChallenge finds a solution to a proof-of-work login
+// challenge: a number whose SHA-256 with the challenge ID, as
+// "challenge:number", starts with difficulty zero bits
+func solveLoginChallenge(challengeID string, difficulty int) string {
+	for n := uint64(0); ; n++ {
+		solution := strconv.FormatUint(n, 10)
+		sum := sha256.Sum256([]byte(challengeID + ":" + solution))
+		zeros := 0
+		for _, b := range sum {
+			zeros += bits.LeadingZeros8(b)
+			if b != 0 {
+				break
+			}
+		}
+		if zeros >= difficulty {
+			return solution
+		}
+	}
+}
+
 // Logout command
 var logoutCmd = &cobra.Command{
 	Use:   "logout",
@@ -705,12 +1194,61 @@ var logoutCmd = &cobra.Command{
 		defer resp.Body.Close()
 		
 		// Clear session from config
-		viper.Set("session_id", "")
-		viper.Set("session_expires", "")
-		viper.Set("username", "")
+		viper.Set(configKey("session_id"), "")
+		viper.Set(configKey("session_expires"), "")
+		viper.Set(configKey("username"), "")
 		viper.WriteConfig()
 		
-		fmt.Println("Successfully logged out")
+		if humanOutput() {
+			fmt.Println("Successfully logged out")
+		}
+	},
+}
+
+// Password change command
+var passwdCmd = &cobra.Command{
+	Use:   "passwd",
+	Short: "Change your password",
+	Run: func(cmd *cobra.Command, args []string) {
+		readPassword := func(prompt string) string {
+			fmt.Print(prompt)
+			bytePassword, err := term.ReadPassword(int(syscall.Stdin))
+			fmt.Println()
+			if err != nil {
+				fmt.Printf("Error reading password: %v\n", err)
+				os.Exit(1)
+			}
+			return string(bytePassword)
+		}
+		
+		current := readPassword("Current password: ")
+		newPassword := readPassword("New password: ")
+		if readPassword("Confirm new password: ") != newPassword {
+			fmt.Println("Error: passwords do not match")
+			os.Exit(1)
+		}
+		
+		body, _ := json.Marshal(map[string]string{
+			"current_password": current,
+			"new_password":     newPassword,
+		})
+		
+		client := NewClient(apiURL, apiKey, adminSecret, sessionID)
+		resp, err := client.makeRequest("POST", "/api/v1/auth/change-password", strings.NewReader(string(body)))
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+		defer resp.Body.Close()
+		
+		if resp.StatusCode != 200 {
+			var errResp map[string]string
+			json.NewDecoder(resp.Body).Decode(&errResp)
+			fmt.Printf("Error: %s\n", errResp["error"])
+			os.Exit(1)
+		}
+		
+		fmt.Println("Password changed successfully")
 	},
 }
 
@@ -751,9 +1289,23 @@ var userListCmd = &cobra.Command{
 			os.Exit(1)
 		}
 		
-		fmt.Printf("Users (%d total):\n\n", result.Total)
-		fmt.Printf("%-20s %-15s %-25s %-10s %-10s\n", "Username", "Role", "Email", "Active", "Created")
-		fmt.Println(strings.Repeat("-", 85))
+		var rows [][]string
+		for _, user := range result.Users {
+			rows = append(rows, []string{
+				user.Username,
+				user.Role,
+				user.Email,
+				fmt.Sprintf("%v", user.IsActive),
+				user.CreatedAt.Format(time.RFC3339),
+			})
+		}
+		if renderList(result.Users, []string{"username", "role", "email", "is_active", "created_at"}, rows, 0) {
+			return
+		}
+		
+		printHeader("Users (%d total):\n\n", result.Total)
+		printHeader("%-20s %-15s %-25s %-10s %-10s\n", "Username", "Role", "Email", "Active", "Created")
+		printHeader("%s\n", strings.Repeat("-", 85))
 		
 		for _, user := range result.Users {
 			active := "Yes"
@@ -817,6 +1369,10 @@ var userCreateCmd = &cobra.Command{
 			os.Exit(1)
 		}
 		
+		if renderObject(newUser, newUser.UserID) {
+			return
+		}
+		
 		fmt.Printf("User created successfully:\n")
 		fmt.Printf("  ID: %s\n", newUser.UserID)
 		fmt.Printf("  Username: %s\n", newUser.Username)
@@ -859,10 +1415,273 @@ var userDeleteCmd = &cobra.Command{
 			os.Exit(1)
 		}
 		
+		if renderObject(map[string]interface{}{"username": username, "deleted": true}, username) {
+			return
+		}
+		
 		fmt.Printf("User '%s' deleted successfully\n", username)
 	},
 }
 
+var userUpdateCmd = &cobra.Command{
+	Use:   "update [username]",
+	Short: "Update a user's email or full name",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		update := map[string]interface{}{}
+		if cmd.Flags().Changed("email") {
+			email, _ := cmd.Flags().GetString("email")
+			update["email"] = email
+		}
+		if cmd.Flags().Changed("full-name") {
+			fullName, _ := cmd.Flags().GetString("full-name")
+			update["full_name"] = fullName
+		}
+		
+		if len(update) == 0 {
+			fmt.Println("Error: nothing to update (use --email or --full-name)")
+			os.Exit(1)
+		}
+		
+		updateUser(args[0], update, fmt.Sprintf("User '%s' updated successfully", args[0]))
+	},
+}
+
+var userDisableCmd = &cobra.Command{
+	Use:   "disable [username]",
+	Short: "Disable a user and end their sessions",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		updateUser(args[0], map[string]interface{}{"is_active": false},
+			fmt.Sprintf("User '%s' disabled", args[0]))
+	},
+}
+
+var userEnableCmd = &cobra.Command{
+	Use:   "enable [username]",
+	Short: "Re-enable a disabled user",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		updateUser(args[0], map[string]interface{}{"is_active": true},
+			fmt.Sprintf("User '%s' enabled", args[0]))
+	},
+}
+
+var userSetRoleCmd = &cobra.Command{
+	Use:   "set-role [username] [role]",
+	Short: "Change a user's role",
+	Long: `Change a user's role to a built-in (admin, operator, viewer) or custom
+role; see "tokenshield user roles". Permissions granted beyond the old role
+are removed and the user's active sessions are ended.`,
+	Args: cobra.ExactArgs(2),
+	ValidArgsFunction: func(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+		if len(args) == 1 {
+			return []string{"admin", "operator", "viewer"}, cobra.ShellCompDirectiveNoFileComp
+		}
+		return nil, cobra.ShellCompDirectiveNoFileComp
+	},
+	Run: func(cmd *cobra.Command, args []string) {
+		username, role := args[0], args[1]
+		updateUser(username, map[string]interface{}{"role": role},
+			fmt.Sprintf("User '%s' is now %s", username, role))
+	},
+}
+
+var userRolesCmd = &cobra.Command{
+	Use:   "roles",
+	Short: "List roles and their permissions",
+	Run: func(cmd *cobra.Command, args []string) {
+		client := NewClient(apiURL, apiKey, adminSecret, sessionID)
+
+		resp, err := client.makeRequest("GET", "/api/v1/roles", nil)
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+		defer resp.Body.Close()
+
+		if resp.StatusCode != 200 {
+			var errResp map[string]string
+			json.NewDecoder(resp.Body).Decode(&errResp)
+			fmt.Printf("Error: %s\n", errResp["error"])
+			os.Exit(1)
+		}
+
+		var result struct {
+			Roles []struct {
+				Name        string   `json:"name"`
+				Description string   `json:"description"`
+				Permissions []string `json:"permissions"`
+				BuiltIn     bool     `json:"built_in"`
+				Users       int      `json:"users"`
+				UserDays    *int     `json:"inactive_user_days"`
+				KeyDays     *int     `json:"stale_api_key_days"`
+			} `json:"roles"`
+			Total int `json:"total"`
+		}
+		if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+			fmt.Printf("Error parsing response: %v\n", err)
+			os.Exit(1)
+		}
+
+		var rows [][]string
+		for _, role := range result.Roles {
+			rows = append(rows, []string{
+				role.Name,
+				fmt.Sprintf("%v", role.BuiltIn),
+				fmt.Sprintf("%d", role.Users),
+				strings.Join(role.Permissions, ","),
+			})
+		}
+		if renderList(result.Roles, []string{"name", "built_in", "users", "permissions"}, rows, 0) {
+			return
+		}
+
+		printHeader("Roles (%d total):\n\n", result.Total)
+		printHeader("%-20s %-9s %-6s %-10s %-10s %s\n", "Name", "Built-in", "Users", "Idle user", "Idle key", "Permissions")
+		printHeader("%s\n", strings.Repeat("-", 107))
+		for _, role := range result.Roles {
+			builtIn := "No"
+			if role.BuiltIn {
+				builtIn = "Yes"
+			}
+			fmt.Printf("%-20s %-9s %-6d %-10s %-10s %s\n", role.Name, builtIn, role.Users, policyDays(role.UserDays), policyDays(role.KeyDays),
+				strings.Join(role.Permissions, ", "))
+		}
+	},
+}
+
+// policyDays describes a role's inactivity policy
+func policyDays(days *int) string {
+	switch {
+	case days == nil:
+		return "default"
+	case *days == 0:
+		return "never"
+	}
+	return fmt.Sprintf("%dd", *days)
+}
+
+var userInactivityCmd = &cobra.Command{
+	Use:   "inactivity [role]",
+	Short: "Set when a role's idle users and unused API keys are disabled",
+	Long: `Set how many days a role's users can go without logging in, and their API
+keys without being used, before they are disabled. 0 never disables them and
+-1 follows the server's INACTIVE_USER_DAYS or STALE_API_KEY_DAYS again. A
+warning is raised INACTIVITY_WARNING_DAYS before anything is disabled.`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		req := map[string]int{}
+		if cmd.Flags().Changed("user-days") {
+			req["inactive_user_days"], _ = cmd.Flags().GetInt("user-days")
+		}
+		if cmd.Flags().Changed("key-days") {
+			req["stale_api_key_days"], _ = cmd.Flags().GetInt("key-days")
+		}
+		if len(req) == 0 {
+			fmt.Println("Error: give --user-days, --key-days or both")
+			os.Exit(1)
+		}
+		body, _ := json.Marshal(req)
+		result := keyAPIRequest("PUT", "/api/v1/roles/"+url.PathEscape(args[0]), body, http.StatusOK)
+		if renderObject(result, args[0]) {
+			return
+		}
+		days := func(v interface{}) string {
+			if n, ok := v.(float64); ok {
+				d := int(n)
+				return policyDays(&d)
+			}
+			return policyDays(nil)
+		}
+		fmt.Printf("Role '%s' disables idle users after: %s, unused API keys after: %s\n", args[0],
+			days(result["inactive_user_days"]), days(result["stale_api_key_days"]))
+	},
+}
+
+var userResetPasswordCmd = &cobra.Command{
+	Use:   "reset-password [username]",
+	Short: "Reset a user's password to a temporary one",
+	Long: `Replace a user's password with a generated temporary password. The user
+must change it at next login, and their active sessions are ended. The
+temporary password is shown only once.`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		username := args[0]
+		
+		force, _ := cmd.Flags().GetBool("force")
+		if !force {
+			fmt.Printf("Reset the password for user '%s'? (y/N): ", username)
+			var confirm string
+			fmt.Scanln(&confirm)
+			if confirm != "y" && confirm != "Y" {
+				fmt.Println("Cancelled")
+				return
+			}
+		}
+		
+		client := NewClient(apiURL, apiKey, adminSecret, sessionID)
+		
+		resp, err := client.makeRequest("POST", "/api/v1/users/"+username+"/reset-password", nil)
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+		defer resp.Body.Close()
+		
+		if resp.StatusCode != 200 {
+			var errResp map[string]string
+			json.NewDecoder(resp.Body).Decode(&errResp)
+			fmt.Printf("Error: %s\n", errResp["error"])
+			os.Exit(1)
+		}
+		
+		var result map[string]interface{}
+		if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+			fmt.Printf("Error parsing response: %v\n", err)
+			os.Exit(1)
+		}
+		
+		if renderObject(result, fmt.Sprintf("%v", result["temporary_password"])) {
+			return
+		}
+		
+		fmt.Printf("Password reset for user '%s'\n", result["username"])
+		fmt.Printf("  Temporary password: %s\n", result["temporary_password"])
+		fmt.Printf("  The user must change it at next login. It will not be shown again.\n")
+	},
+}
+
+// updateUser sends a partial update to PUT /api/v1/users/{username}
+func updateUser(username string, update map[string]interface{}, successMsg string) {
+	client := NewClient(apiURL, apiKey, adminSecret, sessionID)
+	
+	body, _ := json.Marshal(update)
+	resp, err := client.makeRequest("PUT", "/api/v1/users/"+username, strings.NewReader(string(body)))
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+	defer resp.Body.Close()
+	
+	if resp.StatusCode != 200 {
+		var errResp map[string]string
+		json.NewDecoder(resp.Body).Decode(&errResp)
+		fmt.Printf("Error: %s\n", errResp["error"])
+		os.Exit(1)
+	}
+	
+	result := map[string]interface{}{"username": username}
+	for k, v := range update {
+		result[k] = v
+	}
+	if renderObject(result, username) {
+		return
+	}
+	
+	fmt.Println(successMsg)
+}
+
 var whoamiCmd = &cobra.Command{
 	Use:   "whoami",
 	Short: "Show current user information",
@@ -887,6 +1706,10 @@ var whoamiCmd = &cobra.Command{
 			os.Exit(1)
 		}
 		
+		if renderObject(user, user.Username) {
+			return
+		}
+		
 		fmt.Printf("Current user:\n")
 		fmt.Printf("  Username: %s\n", user.Username)
 		fmt.Printf("  Email: %s\n", user.Email)
@@ -896,6 +1719,69 @@ var whoamiCmd = &cobra.Command{
 	},
 }
 
+// Column layout shared by token list and search in csv/quiet output
+var tokenHeaders = []string{"token", "card_type", "first_six", "last_four", "is_active", "created_at", "tags"}
+
+func tokenRows(tokens []interface{}) [][]string {
+	rows := make([][]string, 0, len(tokens))
+	for _, t := range tokens {
+		token := t.(map[string]interface{})
+		rows = append(rows, []string{
+			csvValue(token["token"]),
+			csvValue(token["card_type"]),
+			csvValue(token["first_six"]),
+			csvValue(token["last_four"]),
+			csvValue(token["is_active"]),
+			csvValue(token["created_at"]),
+			formatTags(token["tags"]),
+		})
+	}
+	return rows
+}
+
+// formatTags writes tags as "key=value;key=value", sorted by key, the form
+// the tags column of an import CSV takes
+func formatTags(v interface{}) string {
+	tags, _ := v.(map[string]interface{})
+	pairs := make([]string, 0, len(tags))
+	for key, value := range tags {
+		pairs = append(pairs, fmt.Sprintf("%s=%v", key, value))
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ";")
+}
+
+// tagFlags reads a repeatable key=value tag flag
+func tagFlags(cmd *cobra.Command, name string) map[string]string {
+	values, _ := cmd.Flags().GetStringArray(name)
+	tags := make(map[string]string, len(values))
+	for _, tag := range values {
+		key, value, ok := strings.Cut(tag, "=")
+		if !ok {
+			fmt.Printf("Error: --%s %q is not key=value\n", name, tag)
+			os.Exit(1)
+		}
+		tags[key] = value
+	}
+	return tags
+}
+
+// tagQuery turns tags into the tag parameters of the token list endpoint
+func tagQuery(tags map[string]string) string {
+	query := ""
+	for key, value := range tags {
+		query += "&tag=" + url.QueryEscape(key+"="+value)
+	}
+	return query
+}
+
+// fixedCompletions completes a flag or argument from a fixed list of values
+func fixedCompletions(values ...string) func(*cobra.Command, []string, string) ([]string, cobra.ShellCompDirective) {
+	return func(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+		return values, cobra.ShellCompDirectiveNoFileComp
+	}
+}
+
 // Utility functions
 func truncateString(s string, maxLen int) string {
 	if len(s) <= maxLen {
@@ -919,7 +1805,7 @@ func checkConfigFileSecurity() {
 	}
 	
 	// Check if config file contains sensitive data
-	hasSensitiveData := viper.GetString("session_id") != ""
+	hasSensitiveData := configHasSession()
 	
 	if !hasSensitiveData {
 		return // No sensitive data to protect
@@ -967,9 +1853,14 @@ func initConfig() {
 		fmt.Fprintln(os.Stderr, "Using config file:", viper.ConfigFileUsed())
 	}
 
+	resolveProfile()
+	if verbose && profile != "" {
+		fmt.Fprintln(os.Stderr, "Using profile:", profile)
+	}
+
 	// Set defaults from config or environment
 	if apiURL == "" {
-		apiURL = viper.GetString("api_url")
+		apiURL = viper.GetString(configKey("api_url"))
 		if apiURL == "" {
 			apiURL = "http://localhost:8090"
 		}
@@ -978,21 +1869,21 @@ func initConfig() {
 	// API keys removed - using session-based authentication only
 	// Admin secret only used as fallback for bootstrapping (e.g., creating initial user)
 	if adminSecret == "" {
-		adminSecret = viper.GetString("admin_secret")
+		adminSecret = viper.GetString(configKey("admin_secret"))
 	}
 	
 	// Load session from config
 	if sessionID == "" {
-		sessionID = viper.GetString("session_id")
+		sessionID = viper.GetString(configKey("session_id"))
 		// Check if session is expired
-		if expiresStr := viper.GetString("session_expires"); expiresStr != "" {
+		if expiresStr := viper.GetString(configKey("session_expires")); expiresStr != "" {
 			if expires, err := time.Parse(time.RFC3339, expiresStr); err == nil {
 				if time.Now().After(expires) {
 					// Session expired, clear it
 					sessionID = ""
-					viper.Set("session_id", "")
-					viper.Set("session_expires", "")
-					viper.Set("username", "")
+					viper.Set(configKey("session_id"), "")
+					viper.Set(configKey("session_expires"), "")
+					viper.Set(configKey("username"), "")
 				}
 			}
 		}
@@ -1000,6 +1891,11 @@ func initConfig() {
 	
 	// Check config file security after loading sensitive data
 	checkConfigFileSecurity()
+	
+	if err := validateOutputFormat(); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
 }
 
 func init() {
@@ -1008,23 +1904,108 @@ func init() {
 	// Global flags
 	rootCmd.PersistentFlags().StringVar(&cfgFile, "config", "", "config file (default is $HOME/.tokenshield.yaml)")
 	rootCmd.PersistentFlags().StringVar(&apiURL, "api-url", "", "TokenShield API URL (default: http://localhost:8090)")
+	rootCmd.PersistentFlags().StringVar(&profile, "profile", "", "Configuration profile to use (default: current_profile from the config file)")
 	// API key flag removed - using session-based authentication only
 	// Admin secret flag removed - using session-based authentication only
 	rootCmd.PersistentFlags().BoolVarP(&verbose, "verbose", "v", false, "verbose output")
+	rootCmd.PersistentFlags().StringVarP(&outputFormat, "output", "o", outputTable, "Output format (table, json, yaml, csv)")
+	rootCmd.PersistentFlags().BoolVar(&noHeaders, "no-headers", false, "Omit table/CSV headers and summary lines")
+	rootCmd.PersistentFlags().BoolVarP(&quiet, "quiet", "q", false, "Only print identifiers (tokens, usernames, keys), one per line")
+
+	rootCmd.RegisterFlagCompletionFunc("output", fixedCompletions(outputTable, outputJSON, outputYAML, outputCSV))
+	rootCmd.RegisterFlagCompletionFunc("profile", profileCompletions)
 
 	// Token command flags
 	tokenListCmd.Flags().IntP("limit", "l", 100, "Maximum number of tokens to list")
 	tokenListCmd.Flags().BoolP("full", "f", false, "Show full token strings (needed for revocation)")
+	tokenListCmd.Flags().StringArray("tag", nil, "Only tokens with this tag, as key=value (repeatable)")
 	tokenSearchCmd.Flags().String("last-four", "", "Filter by last four digits")
 	tokenSearchCmd.Flags().String("card-type", "", "Filter by card type (Visa, Mastercard, etc.)")
+	tokenSearchCmd.Flags().String("holder", "", "Filter by exact cardholder name (requires tokens.read_pii)")
 	tokenSearchCmd.Flags().IntP("limit", "l", 50, "Maximum number of tokens to return")
 	tokenSearchCmd.Flags().Bool("active", true, "Filter by active status")
+	tokenSearchCmd.Flags().String("external-id", "", "Filter by the external ID given at import")
+	tokenSearchCmd.Flags().String("tenant", "", "Filter by the tenant given at import")
+	tokenSearchCmd.Flags().String("expiry-from", "", "Only cards expiring in or after this month (YYYY-MM)")
+	tokenSearchCmd.Flags().String("expiry-to", "", "Only cards expiring in or before this month (YYYY-MM)")
+	tokenSearchCmd.Flags().String("sort", "created_at", "Sort by created_at or expiry")
+	tokenSearchCmd.Flags().String("order", "desc", "Sort order: asc or desc")
+	tokenSearchCmd.Flags().StringArray("tag", nil, "Filter by tag, as key=value (repeatable, all must match)")
+
+	tokenBulkCmd.Flags().String("file", "", "File of tokens, one per line (- for stdin)")
+	tokenBulkCmd.Flags().String("last-four", "", "Select by last four digits")
+	tokenBulkCmd.Flags().String("card-type", "", "Select by card type")
+	tokenBulkCmd.Flags().String("external-id", "", "Select by the external ID given at import")
+	tokenBulkCmd.Flags().String("tenant", "", "Select by the tenant given at import")
+	tokenBulkCmd.Flags().String("expiry-from", "", "Select cards expiring in or after this month (YYYY-MM)")
+	tokenBulkCmd.Flags().String("expiry-to", "", "Select cards expiring in or before this month (YYYY-MM)")
+	tokenBulkCmd.Flags().Bool("active", true, "Select by active status")
+	tokenBulkCmd.Flags().StringArray("with-tag", nil, "Select by tag, as key=value (repeatable)")
+	tokenBulkCmd.Flags().String("expiry", "", "New expiry for set-expiry (YYYY-MM)")
+	tokenBulkCmd.Flags().StringArray("tag", nil, "Tag to set, as key=value (repeatable)")
+	tokenBulkCmd.Flags().StringArray("untag", nil, "Tag key to remove (repeatable)")
+	tokenBulkCmd.Flags().Int("batch-size", 0, "Tokens changed per transaction (server default: 500)")
+	tokenRevealCmd.Flags().Bool("full", false, "Show the full card number (requires tokens.detokenize and confirmation)")
+	tokenRevealCmd.Flags().String("reason", "", "Reason for a full reveal, recorded in the audit log")
+	tokenImportCmd.Flags().String("file", "", "CSV or JSON file to import, or - for stdin (required)")
+	tokenImportCmd.Flags().String("format", "", "Input format: csv, json or fixed (default: from file extension)")
+	tokenImportCmd.Flags().String("duplicates", "skip", "How to handle cards already in the vault (skip, overwrite, error, reuse)")
+	tokenImportCmd.Flags().Int("chunk-size", 1000, "Maximum number of records uploaded per request")
+	tokenImportCmd.Flags().Int("batch-size", 100, "Number of records the server processes per transaction")
+	tokenImportCmd.Flags().String("tenant", "", "Tenant to record with every imported card")
+	tokenImportCmd.Flags().StringArray("tag", nil, "Tag to set on every imported card, as key=value (repeatable)")
+	tokenImportCmd.Flags().Bool("validate-only", false, "Check the records and report duplicates without storing anything")
+	tokenImportCmd.Flags().String("delimiter", ",", "CSV field delimiter, one character (\\t for tab)")
+	tokenImportCmd.Flags().Bool("lazy-quotes", false, "Accept quotes inside unquoted CSV fields")
+	tokenImportCmd.Flags().StringArray("header-alias", nil, "CSV header and the column it holds, as header=column (repeatable)")
+	tokenImportCmd.Flags().String("encoding", "", "Character set of the file: utf-8, latin1, windows-1252 or utf-16le/be (default: from its byte order mark, else utf-8)")
+	tokenImportCmd.Flags().Bool("compress", false, "Upload chunks gzip-compressed")
+	tokenImportCmd.Flags().StringArray("layout", nil, "Fixed-width column position, as column=start-end (repeatable, or comma-separated)")
+	tokenImportCmd.Flags().String("record-prefix", "", "Fixed width: only read lines starting with this, such as D for detail records")
+	tokenImportCmd.Flags().String("expiry-format", "MMYY", "Fixed width: layout of the expiry column (MMYY, YYMM, MMYYYY, YYYYMM)")
+	tokenImportCmd.MarkFlagRequired("file")
+	tokenImportCmd.RegisterFlagCompletionFunc("format", fixedCompletions("csv", "json", "fixed"))
+	tokenImportCmd.RegisterFlagCompletionFunc("duplicates", fixedCompletions("skip", "overwrite", "error", "reuse"))
+	tokenImportCmd.RegisterFlagCompletionFunc("expiry-format", fixedCompletions("MMYY", "YYMM", "MMYYYY", "YYYYMM"))
+	tokenImportCmd.RegisterFlagCompletionFunc("encoding", fixedCompletions("utf-8", "latin1", "windows-1252", "utf-16le", "utf-16be"))
+	tokenExportCmd.Flags().String("file", "", "Output file (default: stdout)")
+	tokenExportCmd.Flags().String("format", "", "Output format: csv, json or fixed (default: from file extension, else csv)")
+	tokenExportCmd.Flags().StringArray("layout", nil, "Fixed-width column position, as column=start-end (repeatable, or comma-separated)")
+	tokenExportCmd.Flags().Bool("active-only", false, "Only export active tokens")
+	tokenExportCmd.Flags().StringArray("tag", nil, "Only export tokens with this tag, as key=value (repeatable)")
+	tokenExportCmd.RegisterFlagCompletionFunc("format", fixedCompletions("csv", "json", "fixed"))
 
 	// API key command flags
 	apiKeyCreateCmd.Flags().StringSlice("permissions", []string{"read", "write"}, "Permissions for the API key")
+	apiKeyCreateCmd.Flags().Bool("signed", false, "Only accept requests signed with a signing secret, printed once")
+	
+	// Key command flags
+	keyRotateCmd.Flags().String("type", "dek", "Key to rotate (dek, kek, both)")
+	keyRotateCmd.RegisterFlagCompletionFunc("type", fixedCompletions("dek", "kek", "both"))
+	keyRotateCmd.Flags().BoolP("force", "f", false, "Skip confirmation prompt")
+	keyHistoryCmd.Flags().IntP("limit", "l", 20, "Maximum number of entries to show")
+	keyReencryptCmd.Flags().BoolP("force", "f", false, "Skip confirmation prompt")
+	keyReencryptCmd.Flags().Bool("no-wait", false, "Return as soon as the job has started")
+	keyPolicySetCmd.Flags().Int("interval-days", 90, "Rotate the key once it is this many days old")
+	keyPolicySetCmd.Flags().Bool("disabled", false, "Save the policy without enabling it")
+	keyPolicySetCmd.Flags().Bool("no-reencrypt", false, "Do not re-encrypt cards after a scheduled DEK rotation")
+	
+	// Test card flags
+	testcardGenerateCmd.Flags().String("brand", "visa", "Card brand ("+strings.Join(cardBrandNames(), ", ")+")")
+	testcardGenerateCmd.Flags().IntP("count", "n", 1, "Number of card numbers to generate")
+	testcardGenerateCmd.RegisterFlagCompletionFunc("brand", fixedCompletions(cardBrandNames()...))
+	
+	// TUI flags
+	tuiCmd.Flags().Duration("refresh", 5*time.Second, "Refresh interval")
 	
 	// Activity command flags
 	activityCmd.Flags().IntP("limit", "l", 50, "Maximum number of activities to show")
+	activityCmd.Flags().BoolP("follow", "f", false, "Keep polling and print new activity as it happens")
+	activityCmd.Flags().Duration("interval", 2*time.Second, "Reconnect interval for --follow, and polling interval on servers without the event stream")
+	activityCmd.Flags().String("type", "", "Only show this request type (tokenize, detokenize, forward)")
+	activityCmd.Flags().String("ip", "", "Only show requests from this source IP")
+	activityCmd.Flags().String("token", "", "Only show requests for this token")
+	activityCmd.RegisterFlagCompletionFunc("type", fixedCompletions("tokenize", "detokenize", "forward"))
 	
 	// Login command flags
 	loginCmd.Flags().StringP("username", "u", "", "Username")
@@ -1036,11 +2017,61 @@ func init() {
 	userCreateCmd.Flags().String("password", "", "Password (required)")
 	userCreateCmd.Flags().String("full-name", "", "Full name")
 	userCreateCmd.Flags().String("role", "viewer", "User role (admin, operator, viewer)")
+	userCreateCmd.RegisterFlagCompletionFunc("role", fixedCompletions("admin", "operator", "viewer"))
 	userCreateCmd.MarkFlagRequired("username")
 	userCreateCmd.MarkFlagRequired("email")
 	userCreateCmd.MarkFlagRequired("password")
 	
 	userDeleteCmd.Flags().BoolP("force", "f", false, "Skip confirmation prompt")
+	userUpdateCmd.Flags().String("email", "", "New email address")
+	userUpdateCmd.Flags().String("full-name", "", "New full name")
+	userResetPasswordCmd.Flags().BoolP("force", "f", false, "Skip confirmation prompt")
+	userInactivityCmd.Flags().Int("user-days", 0, "Days without a login before a user is disabled (0 never, -1 the server's default)")
+	userInactivityCmd.Flags().Int("key-days", 0, "Days unused before an API key is deactivated (0 never, -1 the server's default)")
+
+	// Service account command flags
+	serviceAccountCreateCmd.Flags().String("description", "", "What the service account is for")
+	serviceAccountCreateCmd.Flags().String("role", "viewer", "Role of the service account")
+	serviceAccountCreateCmd.Flags().StringSlice("permissions", nil, "Permissions beyond those of the role")
+	serviceAccountDeleteCmd.Flags().BoolP("force", "f", false, "Skip confirmation prompt")
+	serviceAccountKeyCreateCmd.Flags().String("client-name", "", "Name of the key (default: the service account name)")
+	serviceAccountKeyCreateCmd.Flags().Int("expires-in-days", 0, "Days until the key expires (default and maximum: SERVICE_ACCOUNT_KEY_DAYS on the server)")
+	serviceAccountKeyCreateCmd.Flags().Bool("signed", false, "Only accept requests signed with a signing secret, printed once")
+	serviceAccountRotateCmd.Flags().Int("overlap-hours", 24, "Hours the old key keeps working (0 to 168)")
+
+	// Audit archive command flags
+	auditArchiveListCmd.Flags().String("table", "", "user_audit_log or security_audit_log")
+	auditArchiveListCmd.RegisterFlagCompletionFunc("table", fixedCompletions("user_audit_log", "security_audit_log"))
+	for _, c := range []*cobra.Command{auditArchiveListCmd, auditArchiveQueryCmd} {
+		c.Flags().String("start", "", "Only rows from this RFC 3339 time")
+		c.Flags().String("end", "", "Only rows until this RFC 3339 time")
+	}
+	for _, name := range []string{"event-type", "severity", "user-id", "username", "ip-address", "action"} {
+		auditArchiveQueryCmd.Flags().String(name, "", "Only rows with this "+strings.ReplaceAll(name, "-", " "))
+	}
+	auditArchiveQueryCmd.Flags().Int("limit", 0, "Rows to return, at most 10000 (default 1000)")
+	auditArchiveQueryCmd.Flags().String("save", "", "Write the rows to this file as JSON lines")
+
+	// Report command flags
+	reportComplianceCmd.Flags().String("quarter", "", "Calendar quarter, like 2024-Q1")
+	reportComplianceCmd.Flags().String("start", "", "Start of the period, an RFC 3339 time or date (default 90 days ago)")
+	reportComplianceCmd.Flags().String("end", "", "End of the period, an RFC 3339 time or date including its day (default now)")
+	reportComplianceCmd.Flags().String("format", "json", "json or pdf")
+	reportComplianceCmd.RegisterFlagCompletionFunc("format", fixedCompletions("json", "pdf"))
+	reportComplianceCmd.Flags().String("file", "", "File to save the report to (default the name the server gives)")
+	reportVerifyCmd.Flags().String("signature", "", "Signature file (default the report file with .sig appended)")
+	reportVerifyCmd.Flags().String("public-key", "", "PEM public key file, to verify without the server")
+
+	// Access review command flags
+	accessReviewStartCmd.Flags().String("name", "", "Name of the review (default the quarter, like 2024-Q1 access review)")
+	accessReviewStartCmd.Flags().Int("due-in-days", 0, "Days to finish the review (default ACCESS_REVIEW_DAYS on the server)")
+	accessReviewShowCmd.Flags().String("decision", "", "Only items with this decision: pending, confirmed, revoked or expired")
+	accessReviewShowCmd.RegisterFlagCompletionFunc("decision", fixedCompletions("pending", "confirmed", "revoked", "expired"))
+	accessReviewDecideCmd.Flags().String("comment", "", "Why, kept in the review log")
+	networkTokenCryptogramCmd.Flags().String("type", "ecommerce", "Transaction type: ecommerce, recurring or card_on_file")
+	networkTokenCryptogramCmd.RegisterFlagCompletionFunc("type", fixedCompletions("ecommerce", "recurring", "card_on_file"))
+	networkTokenCryptogramCmd.Flags().String("amount", "", "Transaction amount, like 10.00")
+	networkTokenCryptogramCmd.Flags().String("currency", "", "ISO 4217 currency, like EUR")
 
 	// Add commands
 	rootCmd.AddCommand(versionCmd)
@@ -1048,25 +2079,86 @@ func init() {
 	rootCmd.AddCommand(loginCmd)
 	rootCmd.AddCommand(logoutCmd)
 	rootCmd.AddCommand(whoamiCmd)
+	rootCmd.AddCommand(passwdCmd)
 	rootCmd.AddCommand(tokenCmd)
+	rootCmd.AddCommand(networkTokenCmd)
 	rootCmd.AddCommand(apiKeyCmd)
+	rootCmd.AddCommand(keyCmd)
 	rootCmd.AddCommand(userCmd)
+	rootCmd.AddCommand(serviceAccountCmd)
+	rootCmd.AddCommand(auditArchiveCmd)
+	rootCmd.AddCommand(reportCmd)
+	rootCmd.AddCommand(accessReviewCmd)
 	rootCmd.AddCommand(activityCmd)
 	rootCmd.AddCommand(statsCmd)
+	rootCmd.AddCommand(tuiCmd)
+	rootCmd.AddCommand(testcardCmd)
+	rootCmd.AddCommand(luhnCmd)
 
 	tokenCmd.AddCommand(tokenListCmd)
 	tokenCmd.AddCommand(tokenSearchCmd)
+	tokenCmd.AddCommand(tokenShowCmd)
 	tokenCmd.AddCommand(tokenRevokeCmd)
-
+	tokenCmd.AddCommand(tokenRestoreCmd)
+	tokenCmd.AddCommand(tokenBulkCmd)
+	tokenCmd.AddCommand(tokenRevealCmd)
+	tokenCmd.AddCommand(tokenImportCmd)
+	tokenCmd.AddCommand(tokenExportCmd)
+
+	keyCmd.AddCommand(keyStatusCmd)
+	keyCmd.AddCommand(keyRotateCmd)
+	keyCmd.AddCommand(keyHistoryCmd)
+	keyCmd.AddCommand(keyReencryptCmd)
+	keyCmd.AddCommand(keyPolicyCmd)
+	keyPolicyCmd.AddCommand(keyPolicyListCmd)
+	keyPolicyCmd.AddCommand(keyPolicySetCmd)
+	keyPolicyCmd.AddCommand(keyPolicyDeleteCmd)
+	
 	apiKeyCmd.AddCommand(apiKeyListCmd)
 	apiKeyCmd.AddCommand(apiKeyCreateCmd)
 	
 	userCmd.AddCommand(userListCmd)
 	userCmd.AddCommand(userCreateCmd)
 	userCmd.AddCommand(userDeleteCmd)
+	userCmd.AddCommand(userUpdateCmd)
+	userCmd.AddCommand(userDisableCmd)
+	userCmd.AddCommand(userEnableCmd)
+	userCmd.AddCommand(userSetRoleCmd)
+	userCmd.AddCommand(userRolesCmd)
+	userCmd.AddCommand(userInactivityCmd)
+	userCmd.AddCommand(userResetPasswordCmd)
+
+	serviceAccountCmd.AddCommand(serviceAccountListCmd)
+	serviceAccountCmd.AddCommand(serviceAccountCreateCmd)
+	serviceAccountCmd.AddCommand(serviceAccountShowCmd)
+	serviceAccountCmd.AddCommand(serviceAccountDeleteCmd)
+	serviceAccountCmd.AddCommand(serviceAccountKeyCreateCmd)
+	serviceAccountCmd.AddCommand(serviceAccountRotateCmd)
+
+	auditArchiveCmd.AddCommand(auditArchiveListCmd)
+	auditArchiveCmd.AddCommand(auditArchiveQueryCmd)
+
+	reportCmd.AddCommand(reportComplianceCmd)
+	reportCmd.AddCommand(reportVerifyCmd)
+	reportCmd.AddCommand(reportSigningKeyCmd)
+	accessReviewCmd.AddCommand(accessReviewListCmd)
+	accessReviewCmd.AddCommand(accessReviewStartCmd)
+	accessReviewCmd.AddCommand(accessReviewShowCmd)
+	accessReviewCmd.AddCommand(accessReviewDecideCmd)
+	accessReviewCmd.AddCommand(accessReviewCloseCmd)
+	networkTokenCmd.AddCommand(networkTokenShowCmd)
+	networkTokenCmd.AddCommand(networkTokenProvisionCmd)
+	networkTokenCmd.AddCommand(networkTokenCryptogramCmd)
+	networkTokenCmd.AddCommand(networkTokenDeleteCmd)
 	
 	configCmd.AddCommand(configShowCmd)
 	configCmd.AddCommand(configSecureCmd)
+	configCmd.AddCommand(configUseProfileCmd)
+	configCmd.AddCommand(configProfilesCmd)
+
+	testcardCmd.AddCommand(testcardGenerateCmd)
+	luhnCmd.AddCommand(luhnCheckCmd)
+	luhnCmd.AddCommand(luhnDigitCmd)
 }
 
 func main() {
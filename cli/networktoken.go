@@ -0,0 +1,108 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/spf13/cobra"
+)
+
+// Network token commands: scheme network tokens kept beside vault tokens,
+// and the cryptograms transactions made with them need
+var networkTokenCmd = &cobra.Command{
+	Use:     "network-token",
+	Aliases: []string{"nt"},
+	Short:   "Manage scheme network tokens of stored cards",
+	Long:    "Commands for requesting network tokens from the card schemes for vault tokens, and cryptograms for transactions (requires NETWORK_TOKEN_CONNECTORS on the server)",
+}
+
+var networkTokenShowCmd = &cobra.Command{
+	Use:   "show [token]",
+	Short: "Show a token's network token",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		result := keyAPIRequest("GET", "/api/v1/tokens/"+args[0]+"/network-token", nil, http.StatusOK)
+
+		if renderObject(result, fmt.Sprintf("%v", result["token_reference_id"])) {
+			return
+		}
+		printNetworkToken(result)
+	},
+}
+
+var networkTokenProvisionCmd = &cobra.Command{
+	Use:   "provision [token]",
+	Short: "Request a network token from the card's scheme",
+	Long: `Request a network token for the card behind a vault token. The card
+number is sent to the token service of the card's scheme.`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		result := keyAPIRequest("POST", "/api/v1/tokens/"+args[0]+"/network-token", nil, http.StatusCreated)
+
+		if renderObject(result, fmt.Sprintf("%v", result["token_reference_id"])) {
+			return
+		}
+		fmt.Printf("Network token provisioned successfully:\n")
+		printNetworkToken(result)
+	},
+}
+
+var networkTokenCryptogramCmd = &cobra.Command{
+	Use:   "cryptogram [token]",
+	Short: "Get the network token with a cryptogram for a transaction",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		transactionType, _ := cmd.Flags().GetString("type")
+		amount, _ := cmd.Flags().GetString("amount")
+		currency, _ := cmd.Flags().GetString("currency")
+
+		body, _ := json.Marshal(map[string]string{
+			"transaction_type": transactionType,
+			"amount":           amount,
+			"currency":         currency,
+		})
+		result := keyAPIRequest("POST", "/api/v1/tokens/"+args[0]+"/network-token/cryptogram", body, http.StatusOK)
+
+		if renderObject(result, fmt.Sprintf("%v", result["cryptogram"])) {
+			return
+		}
+		fmt.Printf("Network Token: %s\n", result["network_token"])
+		if month, ok := result["expiry_month"].(float64); ok {
+			fmt.Printf("  Expiry: %02d/%v\n", int(month), result["expiry_year"])
+		}
+		fmt.Printf("  Scheme: %s\n", result["scheme"])
+		fmt.Printf("  Cryptogram: %s\n", result["cryptogram"])
+		if eci, ok := result["eci"].(string); ok {
+			fmt.Printf("  ECI: %s\n", eci)
+		}
+	},
+}
+
+var networkTokenDeleteCmd = &cobra.Command{
+	Use:   "delete [token]",
+	Short: "Delete a token's network token at the scheme",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		keyAPIRequest("DELETE", "/api/v1/tokens/"+args[0]+"/network-token", nil, http.StatusOK)
+
+		if humanOutput() {
+			fmt.Printf("Network token of %s deleted successfully\n", args[0])
+		}
+	},
+}
+
+func printNetworkToken(n map[string]interface{}) {
+	fmt.Printf("Network Token: %s (ending %s)\n", n["token_reference_id"], n["last_four"])
+	fmt.Printf("  Token: %s\n", n["token"])
+	fmt.Printf("  Scheme: %s\n", n["scheme"])
+	if month, ok := n["expiry_month"].(float64); ok {
+		fmt.Printf("  Expiry: %02d/%v\n", int(month), n["expiry_year"])
+	}
+	fmt.Printf("  Status: %s\n", n["status"])
+	fmt.Printf("  Cryptograms: %v\n", n["cryptograms_issued"])
+	if last, ok := n["last_cryptogram_at"].(string); ok {
+		fmt.Printf("  Last Cryptogram: %s\n", formatTime(last))
+	}
+	fmt.Printf("  Created: %s\n", formatTime(fmt.Sprint(n["created_at"])))
+}
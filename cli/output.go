@@ -0,0 +1,176 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Supported values for the global --output flag
+const (
+	outputTable = "table"
+	outputJSON  = "json"
+	outputYAML  = "yaml"
+	outputCSV   = "csv"
+)
+
+// Output settings shared by all commands
+var (
+	outputFormat string
+	noHeaders    bool
+	quiet        bool
+)
+
+func validateOutputFormat() error {
+	switch outputFormat {
+	case outputTable, outputJSON, outputYAML, outputCSV:
+		return nil
+	}
+	return fmt.Errorf("invalid output format %q (use table, json, yaml or csv)", outputFormat)
+}
+
+// humanOutput reports whether commands should print their usual
+// fixed-width tables and informational messages
+func humanOutput() bool {
+	return outputFormat == outputTable && !quiet
+}
+
+// printHeader prints table headers and preamble lines unless --no-headers is set
+func printHeader(format string, a ...interface{}) {
+	if !noHeaders {
+		fmt.Printf(format, a...)
+	}
+}
+
+// renderList prints a list result in the selected machine-readable format.
+// data is the raw API value used for json/yaml; headers and rows are used for
+// csv; idColumn selects the value printed per row in quiet mode. It returns
+// false when the caller should print its own table instead.
+func renderList(data interface{}, headers []string, rows [][]string, idColumn int) bool {
+	if quiet {
+		for _, row := range rows {
+			fmt.Println(row[idColumn])
+		}
+		return true
+	}
+
+	switch outputFormat {
+	case outputJSON, outputYAML:
+		exitOnOutputError(printStructured(data))
+	case outputCSV:
+		exitOnOutputError(printCSV(headers, rows))
+	default:
+		return false
+	}
+	return true
+}
+
+// renderObject prints a single object in the selected machine-readable format.
+// In quiet mode only id is printed (nothing if empty). CSV output is a
+// field,value listing of the top-level fields. It returns false when the
+// caller should print its own human-readable output instead.
+func renderObject(data interface{}, id string) bool {
+	if quiet {
+		if id != "" {
+			fmt.Println(id)
+		}
+		return true
+	}
+
+	switch outputFormat {
+	case outputJSON, outputYAML:
+		exitOnOutputError(printStructured(data))
+	case outputCSV:
+		generic, err := toGeneric(data)
+		if err != nil {
+			exitOnOutputError(err)
+		}
+		var rows [][]string
+		if fields, ok := generic.(map[string]interface{}); ok {
+			keys := make([]string, 0, len(fields))
+			for k := range fields {
+				keys = append(keys, k)
+			}
+			sort.Strings(keys)
+			for _, k := range keys {
+				rows = append(rows, []string{k, csvValue(fields[k])})
+			}
+		}
+		exitOnOutputError(printCSV([]string{"field", "value"}, rows))
+	default:
+		return false
+	}
+	return true
+}
+
+func printStructured(data interface{}) error {
+	// Round-trip through JSON so YAML output uses the same field names as the API
+	generic, err := toGeneric(data)
+	if err != nil {
+		return err
+	}
+
+	if outputFormat == outputYAML {
+		enc := yaml.NewEncoder(os.Stdout)
+		enc.SetIndent(2)
+		defer enc.Close()
+		return enc.Encode(generic)
+	}
+
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(generic)
+}
+
+func printCSV(headers []string, rows [][]string) error {
+	w := csv.NewWriter(os.Stdout)
+	if !noHeaders {
+		if err := w.Write(headers); err != nil {
+			return err
+		}
+	}
+	if err := w.WriteAll(rows); err != nil {
+		return err
+	}
+	return w.Error()
+}
+
+func toGeneric(data interface{}) (interface{}, error) {
+	raw, err := json.Marshal(data)
+	if err != nil {
+		return nil, err
+	}
+	var generic interface{}
+	if err := json.Unmarshal(raw, &generic); err != nil {
+		return nil, err
+	}
+	return generic, nil
+}
+
+// csvValue renders a decoded JSON value as a single CSV cell
+func csvValue(v interface{}) string {
+	switch val := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return val
+	case float64:
+		return fmt.Sprintf("%v", val)
+	case bool:
+		return fmt.Sprintf("%v", val)
+	default:
+		raw, _ := json.Marshal(val)
+		return string(raw)
+	}
+}
+
+func exitOnOutputError(err error) {
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error writing output: %v\n", err)
+		os.Exit(1)
+	}
+}
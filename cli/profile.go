@@ -0,0 +1,164 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+// profile is the named environment selected with --profile,
+// TOKENSHIELD_PROFILE or current_profile in the config file.
+// When empty, settings are read from the top level of the config.
+var profile string
+
+// resolveProfile picks the active profile once the config file is loaded
+func resolveProfile() {
+	if profile == "" {
+		profile = os.Getenv("TOKENSHIELD_PROFILE")
+	}
+	if profile == "" {
+		profile = viper.GetString("current_profile")
+	}
+}
+
+// configKey returns the config key for name in the active profile
+func configKey(name string) string {
+	if profile == "" {
+		return name
+	}
+	return "profiles." + profile + "." + name
+}
+
+func profileNames() []string {
+	names := make([]string, 0)
+	for name := range viper.GetStringMap("profiles") {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// configHasSession reports whether any profile in the config holds a session
+func configHasSession() bool {
+	if viper.GetString("session_id") != "" {
+		return true
+	}
+	for _, name := range profileNames() {
+		if viper.GetString("profiles."+name+".session_id") != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// writeConfig saves the config, creating $HOME/.tokenshield.yaml with
+// owner-only permissions if no config file exists yet. It returns the
+// path of a newly created file, or "" if an existing file was updated.
+func writeConfig() (string, error) {
+	if err := viper.WriteConfig(); err == nil {
+		return "", nil
+	}
+
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", fmt.Errorf("getting home directory: %w", err)
+	}
+
+	configPath := home + "/.tokenshield.yaml"
+	viper.SetConfigFile(configPath)
+	if err := viper.WriteConfigAs(configPath); err != nil {
+		return "", err
+	}
+	os.Chmod(configPath, 0600)
+	return configPath, nil
+}
+
+// Profile commands
+var configUseProfileCmd = &cobra.Command{
+	Use:   "use-profile [name]",
+	Short: "Set the default profile",
+	Long: `Set the profile used when --profile is not given. Each profile keeps its
+own API URL and session, so you can switch environments without logging in
+again. Use "default" to go back to the top-level settings.`,
+	Args:              cobra.ExactArgs(1),
+	ValidArgsFunction: profileCompletions,
+	Run: func(cmd *cobra.Command, args []string) {
+		name := args[0]
+		exists := name == "default" || viper.IsSet("profiles."+name)
+		if name == "default" {
+			name = ""
+		}
+
+		viper.Set("current_profile", name)
+		created, err := writeConfig()
+		if err != nil {
+			fmt.Printf("Error saving configuration: %v\n", err)
+			os.Exit(1)
+		}
+		if created != "" && humanOutput() {
+			fmt.Printf("Created config file: %s\n", created)
+		}
+
+		if renderObject(map[string]interface{}{"current_profile": args[0]}, args[0]) {
+			return
+		}
+
+		fmt.Printf("Switched to profile '%s'\n", args[0])
+		if !exists {
+			fmt.Printf("Profile '%s' has no settings yet; run 'tokenshield --api-url <url> login' to set it up\n", args[0])
+		}
+	},
+}
+
+var configProfilesCmd = &cobra.Command{
+	Use:   "profiles",
+	Short: "List configured profiles",
+	Run: func(cmd *cobra.Command, args []string) {
+		current := viper.GetString("current_profile")
+
+		var profiles []map[string]interface{}
+		var rows [][]string
+		for _, name := range profileNames() {
+			key := "profiles." + name + "."
+			loggedIn := viper.GetString(key+"session_id") != ""
+			profiles = append(profiles, map[string]interface{}{
+				"name":      name,
+				"api_url":   viper.GetString(key + "api_url"),
+				"username":  viper.GetString(key + "username"),
+				"logged_in": loggedIn,
+				"current":   name == current,
+			})
+			rows = append(rows, []string{name, viper.GetString(key + "api_url"), viper.GetString(key + "username"), fmt.Sprintf("%v", loggedIn), fmt.Sprintf("%v", name == current)})
+		}
+
+		if renderList(profiles, []string{"name", "api_url", "username", "logged_in", "current"}, rows, 0) {
+			return
+		}
+
+		if len(rows) == 0 {
+			fmt.Println("No profiles configured")
+			return
+		}
+
+		printHeader("%-2s %-15s %-40s %-15s\n", "", "Profile", "API URL", "User")
+		printHeader("%s\n", "--------------------------------------------------------------------------")
+		for _, row := range rows {
+			marker := ""
+			if row[4] == "true" {
+				marker = "*"
+			}
+			user := row[2]
+			if row[3] != "true" {
+				user = "-"
+			}
+			fmt.Printf("%-2s %-15s %-40s %-15s\n", marker, row[0], truncateString(row[1], 40), user)
+		}
+	},
+}
+
+func profileCompletions(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+	return profileNames(), cobra.ShellCompDirectiveNoFileComp
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+
+	"github.com/spf13/cobra"
+)
+
+// Report commands: compliance reports for auditors, signed by the server
+var reportCmd = &cobra.Command{
+	Use:   "report",
+	Short: "Generate and verify compliance reports",
+	Long:  "Commands for downloading signed compliance reports and checking their signatures (requires system.admin)",
+}
+
+var reportComplianceCmd = &cobra.Command{
+	Use:   "compliance",
+	Short: "Download a signed compliance report",
+	Long: `Download a report of key ages and rotations, user access, token volumes and
+detokenization access over a period. The report is saved with its Ed25519
+signature beside it, in a file named after it with .sig appended.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		query := url.Values{}
+		for _, name := range []string{"quarter", "start", "end", "format"} {
+			if value, _ := cmd.Flags().GetString(name); value != "" {
+				query.Set(name, value)
+			}
+		}
+
+		client := NewClient(apiURL, apiKey, adminSecret, sessionID)
+		resp, err := client.makeRequest("GET", "/api/v1/reports/compliance?"+query.Encode(), nil)
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+		if resp.StatusCode != http.StatusOK {
+			var result map[string]interface{}
+			json.Unmarshal(body, &result)
+			if result["error"] != nil {
+				fmt.Printf("Error: %v\n", result["error"])
+			} else {
+				fmt.Printf("API Error: %s\n", resp.Status)
+			}
+			os.Exit(1)
+		}
+		signature, err := base64.StdEncoding.DecodeString(resp.Header.Get("X-Report-Signature"))
+		if err != nil || len(signature) != ed25519.SignatureSize {
+			fmt.Println("Error: the server did not sign the report")
+			os.Exit(1)
+		}
+
+		file, _ := cmd.Flags().GetString("file")
+		if file == "" {
+			_, params, _ := mime.ParseMediaType(resp.Header.Get("Content-Disposition"))
+			file = params["filename"]
+		}
+		if file == "" {
+			file = "tokenshield-compliance." + query.Get("format")
+		}
+		if err := os.WriteFile(file, body, 0o600); err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+		if err := os.WriteFile(file+".sig", signature, 0o600); err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+		if humanOutput() {
+			fmt.Printf("Saved the report to %s and its signature to %s.sig (signing key %s)\n",
+				file, file, resp.Header.Get("X-Report-Signing-Key"))
+		}
+	},
+}
+
+var reportVerifyCmd = &cobra.Command{
+	Use:   "verify [report-file]",
+	Short: "Check a report against its signature",
+	Long: `Check a report file against the signature saved beside it. The public key is
+fetched from the server, or read from --public-key to check offline.`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		body, err := os.ReadFile(args[0])
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+		sigFile, _ := cmd.Flags().GetString("signature")
+		if sigFile == "" {
+			sigFile = args[0] + ".sig"
+		}
+		signature, err := os.ReadFile(sigFile)
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+
+		var keyPEM []byte
+		if keyFile, _ := cmd.Flags().GetString("public-key"); keyFile != "" {
+			if keyPEM, err = os.ReadFile(keyFile); err != nil {
+				fmt.Printf("Error: %v\n", err)
+				os.Exit(1)
+			}
+		} else {
+			result := keyAPIRequest("GET", "/api/v1/reports/signing-key", nil, http.StatusOK)
+			keyPEM = []byte(fmt.Sprint(result["public_key"]))
+		}
+		block, _ := pem.Decode(keyPEM)
+		if block == nil {
+			fmt.Println("Error: no PEM public key found")
+			os.Exit(1)
+		}
+		parsed, err := x509.ParsePKIXPublicKey(block.Bytes)
+		public, ok := parsed.(ed25519.PublicKey)
+		if err != nil || !ok {
+			fmt.Println("Error: the public key is not an Ed25519 key")
+			os.Exit(1)
+		}
+
+		if !ed25519.Verify(public, body, signature) {
+			fmt.Printf("FAILED: %s does not match its signature\n", args[0])
+			os.Exit(1)
+		}
+		fmt.Printf("OK: %s is signed by the report signing key\n", args[0])
+	},
+}
+
+var reportSigningKeyCmd = &cobra.Command{
+	Use:   "signing-key",
+	Short: "Print the public key reports are signed with",
+	Run: func(cmd *cobra.Command, args []string) {
+		result := keyAPIRequest("GET", "/api/v1/reports/signing-key", nil, http.StatusOK)
+		if renderObject(result, fmt.Sprint(result["key_id"])) {
+			return
+		}
+		printHeader("Key %v (%v, %v):\n", result["key_id"], result["algorithm"], result["source"])
+		fmt.Print(result["public_key"])
+	},
+}
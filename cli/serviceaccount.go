@@ -0,0 +1,237 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+// Service account commands: machine identities for integrations, which
+// cannot log in and authenticate with API keys that expire
+var serviceAccountCmd = &cobra.Command{
+	Use:     "serviceaccount",
+	Aliases: []string{"sa"},
+	Short:   "Manage service accounts",
+	Long:    "Commands for managing service accounts and their expiring API keys (requires users.read, users.write or users.delete)",
+}
+
+var serviceAccountListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List service accounts",
+	Run: func(cmd *cobra.Command, args []string) {
+		result := keyAPIRequest("GET", "/api/v1/service-accounts", nil, http.StatusOK)
+		accounts, _ := result["service_accounts"].([]interface{})
+
+		var rows [][]string
+		for _, a := range accounts {
+			account := a.(map[string]interface{})
+			active, next := activeKeys(account)
+			rows = append(rows, []string{
+				csvValue(account["name"]),
+				csvValue(account["role"]),
+				fmt.Sprint(active),
+				next,
+				csvValue(account["description"]),
+			})
+		}
+		if renderList(accounts, []string{"name", "role", "active_keys", "next_expiry", "description"}, rows, 0) {
+			return
+		}
+
+		printHeader("Found %d service accounts:\n\n", len(accounts))
+		printHeader("%-25s %-12s %-6s %-20s %s\n", "NAME", "ROLE", "KEYS", "NEXT_EXPIRY", "DESCRIPTION")
+		printHeader("%s\n", strings.Repeat("-", 90))
+		for _, row := range rows {
+			next := row[3]
+			if next != "" {
+				next = formatTime(next)
+			}
+			fmt.Printf("%-25s %-12s %-6s %-20s %s\n", row[0], row[1], row[2], next, truncateString(row[4], 30))
+		}
+	},
+}
+
+// activeKeys counts a service account's usable keys and returns the
+// earliest time one of them expires
+func activeKeys(account map[string]interface{}) (int, string) {
+	keys, _ := account["keys"].([]interface{})
+	count, next := 0, ""
+	var nextAt time.Time
+	for _, k := range keys {
+		key := k.(map[string]interface{})
+		if key["is_active"] != true || key["expired"] == true {
+			continue
+		}
+		count++
+		expires, _ := key["expires_at"].(string)
+		if at, err := time.Parse(time.RFC3339, expires); err == nil && (next == "" || at.Before(nextAt)) {
+			next, nextAt = expires, at
+		}
+	}
+	return count, next
+}
+
+var serviceAccountCreateCmd = &cobra.Command{
+	Use:   "create [name]",
+	Short: "Create a service account",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		description, _ := cmd.Flags().GetString("description")
+		role, _ := cmd.Flags().GetString("role")
+		permissions, _ := cmd.Flags().GetStringSlice("permissions")
+
+		body, _ := json.Marshal(map[string]interface{}{
+			"name":        args[0],
+			"description": description,
+			"role":        role,
+			"permissions": permissions,
+		})
+		result := keyAPIRequest("POST", "/api/v1/service-accounts", body, http.StatusCreated)
+
+		if renderObject(result, fmt.Sprintf("%v", result["name"])) {
+			return
+		}
+
+		fmt.Printf("Service account created successfully:\n")
+		fmt.Printf("  ID: %s\n", result["user_id"])
+		fmt.Printf("  Name: %s\n", result["name"])
+		fmt.Printf("  Role: %s\n", result["role"])
+		fmt.Printf("\nIt cannot log in. Issue it a key with: tokenshield serviceaccount key-create %s\n", result["name"])
+	},
+}
+
+var serviceAccountShowCmd = &cobra.Command{
+	Use:   "show [name]",
+	Short: "Show a service account and its keys",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		result := keyAPIRequest("GET", "/api/v1/service-accounts/"+args[0], nil, http.StatusOK)
+
+		if renderObject(result, fmt.Sprintf("%v", result["name"])) {
+			return
+		}
+
+		fmt.Printf("Service Account: %s\n", result["name"])
+		fmt.Printf("  ID: %s\n", result["user_id"])
+		if description, ok := result["description"].(string); ok {
+			fmt.Printf("  Description: %s\n", description)
+		}
+		fmt.Printf("  Role: %s\n", result["role"])
+		fmt.Printf("  Permissions: %v\n", result["permissions"])
+		fmt.Printf("  Created: %s\n\n", formatTime(fmt.Sprint(result["created_at"])))
+
+		keys, _ := result["keys"].([]interface{})
+		printHeader("%-30s %-20s %-10s %-20s %-20s\n", "API_KEY", "CLIENT_NAME", "STATUS", "EXPIRES", "LAST_USED")
+		printHeader("%s\n", strings.Repeat("-", 104))
+		for _, k := range keys {
+			key := k.(map[string]interface{})
+			status := "active"
+			switch {
+			case key["is_active"] != true:
+				status = "revoked"
+			case key["expired"] == true:
+				status = "expired"
+			}
+			lastUsed := "never"
+			if t, ok := key["last_used_at"].(string); ok {
+				lastUsed = formatTime(t)
+			}
+			fmt.Printf("%-30s %-20s %-10s %-20s %-20s\n",
+				key["api_key"], truncateString(fmt.Sprint(key["client_name"]), 20), status,
+				formatTime(fmt.Sprint(key["expires_at"])), lastUsed)
+		}
+	},
+}
+
+var serviceAccountDeleteCmd = &cobra.Command{
+	Use:   "delete [name]",
+	Short: "Delete a service account and its keys",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		name := args[0]
+
+		force, _ := cmd.Flags().GetBool("force")
+		if !force {
+			fmt.Printf("Are you sure you want to delete service account '%s'? Its keys stop working. (y/N): ", name)
+			var confirm string
+			fmt.Scanln(&confirm)
+			if confirm != "y" && confirm != "Y" {
+				fmt.Println("Cancelled")
+				return
+			}
+		}
+
+		keyAPIRequest("DELETE", "/api/v1/service-accounts/"+name, nil, http.StatusOK)
+
+		if renderObject(map[string]interface{}{"name": name, "deleted": true}, name) {
+			return
+		}
+
+		fmt.Printf("Service account '%s' deleted successfully\n", name)
+	},
+}
+
+var serviceAccountKeyCreateCmd = &cobra.Command{
+	Use:   "key-create [name]",
+	Short: "Issue an expiring API key to a service account",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		clientName, _ := cmd.Flags().GetString("client-name")
+		days, _ := cmd.Flags().GetInt("expires-in-days")
+		signed, _ := cmd.Flags().GetBool("signed")
+
+		req := map[string]interface{}{}
+		if clientName != "" {
+			req["client_name"] = clientName
+		}
+		if days != 0 {
+			req["expires_in_days"] = days
+		}
+		if signed {
+			req["signed"] = true
+		}
+		body, _ := json.Marshal(req)
+		result := keyAPIRequest("POST", "/api/v1/service-accounts/"+args[0]+"/keys", body, http.StatusCreated)
+
+		if renderObject(result, fmt.Sprintf("%v", result["api_key"])) {
+			return
+		}
+
+		fmt.Printf("API key created successfully:\n")
+		printServiceAccountKey(result)
+	},
+}
+
+var serviceAccountRotateCmd = &cobra.Command{
+	Use:   "rotate [name] [api-key]",
+	Short: "Replace a service account's key, keeping the old one for an overlap",
+	Args:  cobra.ExactArgs(2),
+	Run: func(cmd *cobra.Command, args []string) {
+		overlap, _ := cmd.Flags().GetInt("overlap-hours")
+
+		body, _ := json.Marshal(map[string]int{"overlap_hours": overlap})
+		result := keyAPIRequest("POST", "/api/v1/service-accounts/"+args[0]+"/keys/"+args[1]+"/rotate", body, http.StatusCreated)
+
+		if renderObject(result, fmt.Sprintf("%v", result["api_key"])) {
+			return
+		}
+
+		fmt.Printf("API key rotated successfully:\n")
+		printServiceAccountKey(result)
+		fmt.Printf("Old key %s stops working at %s\n", result["replaces"], formatTime(fmt.Sprint(result["replaced_expires_at"])))
+	},
+}
+
+func printServiceAccountKey(key map[string]interface{}) {
+	fmt.Printf("API Key: %s\n", key["api_key"])
+	fmt.Printf("Client: %s\n", key["client_name"])
+	fmt.Printf("Expires: %s\n", formatTime(fmt.Sprint(key["expires_at"])))
+	if secret, ok := key["signing_secret"].(string); ok {
+		fmt.Printf("Signing Secret: %s\n", secret)
+		fmt.Printf("\nStore the signing secret now, it is not shown again. The key only accepts signed requests.\n")
+	}
+}
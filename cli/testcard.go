@@ -0,0 +1,252 @@
+package main
+
+import (
+	"crypto/rand"
+	"fmt"
+	"math/big"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/spf13/cobra"
+)
+
+// cardBrand describes how test PANs for a brand are built
+type cardBrand struct {
+	name     string
+	prefixes []string
+	length   int
+}
+
+var cardBrands = map[string]cardBrand{
+	"visa":       {name: "Visa", prefixes: []string{"4"}, length: 16},
+	"mastercard": {name: "Mastercard", prefixes: []string{"51", "52", "53", "54", "55", "2221", "2720"}, length: 16},
+	"amex":       {name: "Amex", prefixes: []string{"34", "37"}, length: 15},
+	"discover":   {name: "Discover", prefixes: []string{"6011", "65"}, length: 16},
+	"jcb":        {name: "JCB", prefixes: []string{"3528", "3589"}, length: 16},
+	"diners":     {name: "Diners", prefixes: []string{"36"}, length: 14},
+}
+
+func cardBrandNames() []string {
+	names := make([]string, 0, len(cardBrands))
+	for name := range cardBrands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Test card commands
+var testcardCmd = &cobra.Command{
+	Use:   "testcard",
+	Short: "Generate test card numbers (offline)",
+	Long:  "Generate Luhn-valid test card numbers locally. No API calls are made.",
+}
+
+var testcardGenerateCmd = &cobra.Command{
+	Use:   "generate",
+	Short: "Generate Luhn-valid test card numbers",
+	Long: `Generate random Luhn-valid card numbers with a real brand prefix, for
+testing the tokenization proxy. The numbers are random and are not issued
+cards, but they will be detected and tokenized like real ones.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		brandName, _ := cmd.Flags().GetString("brand")
+		count, _ := cmd.Flags().GetInt("count")
+
+		brand, ok := cardBrands[strings.ToLower(brandName)]
+		if !ok {
+			fmt.Printf("Error: unknown brand %q (use %s)\n", brandName, strings.Join(cardBrandNames(), ", "))
+			os.Exit(1)
+		}
+		if count < 1 || count > 10000 {
+			fmt.Println("Error: --count must be between 1 and 10000")
+			os.Exit(1)
+		}
+
+		cards := make([]map[string]interface{}, 0, count)
+		var rows [][]string
+		for i := 0; i < count; i++ {
+			number := generateTestCard(brand)
+			cards = append(cards, map[string]interface{}{
+				"card_number": number,
+				"brand":       brand.name,
+			})
+			rows = append(rows, []string{number, brand.name})
+		}
+
+		if renderList(cards, []string{"card_number", "brand"}, rows, 0) {
+			return
+		}
+
+		for _, row := range rows {
+			fmt.Println(row[0])
+		}
+	},
+}
+
+// Luhn commands
+var luhnCmd = &cobra.Command{
+	Use:   "luhn",
+	Short: "Luhn checksum tools (offline)",
+}
+
+var luhnCheckCmd = &cobra.Command{
+	Use:   "check [number...]",
+	Short: "Check whether numbers pass the Luhn checksum",
+	Long: `Check card numbers or Luhn-format tokens. Spaces and dashes are ignored.
+Exits with status 1 if any number is invalid.`,
+	Args: cobra.MinimumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		var results []map[string]interface{}
+		var rows [][]string
+		allValid := true
+		for _, arg := range args {
+			number := normalizeCardNumber(arg)
+			valid := isDigits(number) && luhnValid(number)
+			if !valid {
+				allValid = false
+			}
+			brand := detectCardBrand(number)
+			results = append(results, map[string]interface{}{
+				"number": arg,
+				"valid":  valid,
+				"brand":  brand,
+			})
+			rows = append(rows, []string{arg, fmt.Sprintf("%v", valid), brand})
+		}
+
+		if quiet {
+			// Only print the numbers that pass, for filtering in scripts
+			for i, row := range rows {
+				if results[i]["valid"] == true {
+					fmt.Println(row[0])
+				}
+			}
+		} else if !renderList(results, []string{"number", "valid", "brand"}, rows, 0) {
+			for _, row := range rows {
+				status := "valid"
+				if row[1] != "true" {
+					status = "INVALID"
+				}
+				if row[2] != "" {
+					fmt.Printf("%s: %s (%s)\n", row[0], status, row[2])
+				} else {
+					fmt.Printf("%s: %s\n", row[0], status)
+				}
+			}
+		}
+
+		if !allValid {
+			os.Exit(1)
+		}
+	},
+}
+
+var luhnDigitCmd = &cobra.Command{
+	Use:   "digit [partial-number]",
+	Short: "Compute the Luhn check digit for a number without one",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		partial := normalizeCardNumber(args[0])
+		if partial == "" || !isDigits(partial) {
+			fmt.Println("Error: number must contain only digits")
+			os.Exit(1)
+		}
+
+		digit := luhnCheckDigit(partial)
+		if renderObject(map[string]interface{}{
+			"check_digit": digit,
+			"number":      partial + fmt.Sprint(digit),
+		}, partial+fmt.Sprint(digit)) {
+			return
+		}
+
+		fmt.Printf("Check digit: %d\n", digit)
+		fmt.Printf("Full number: %s%d\n", partial, digit)
+	},
+}
+
+// generateTestCard builds a random Luhn-valid number for the brand
+func generateTestCard(brand cardBrand) string {
+	prefix := brand.prefixes[randomInt(len(brand.prefixes))]
+
+	var b strings.Builder
+	b.WriteString(prefix)
+	for b.Len() < brand.length-1 {
+		b.WriteByte(byte('0' + randomInt(10)))
+	}
+
+	partial := b.String()
+	return partial + fmt.Sprint(luhnCheckDigit(partial))
+}
+
+// luhnCheckDigit returns the digit that makes partial+digit Luhn-valid
+func luhnCheckDigit(partial string) int {
+	sum := 0
+	// The check digit will be appended, so doubling starts with the last digit of partial
+	double := true
+	for i := len(partial) - 1; i >= 0; i-- {
+		d := int(partial[i] - '0')
+		if double {
+			d *= 2
+			if d > 9 {
+				d -= 9
+			}
+		}
+		sum += d
+		double = !double
+	}
+	return (10 - sum%10) % 10
+}
+
+func luhnValid(number string) bool {
+	if len(number) < 2 {
+		return false
+	}
+	return luhnCheckDigit(number[:len(number)-1]) == int(number[len(number)-1]-'0')
+}
+
+// detectCardBrand returns the brand name for a number, or "" if unknown
+func detectCardBrand(number string) string {
+	switch {
+	case strings.HasPrefix(number, "4"):
+		return "Visa"
+	case strings.HasPrefix(number, "34"), strings.HasPrefix(number, "37"):
+		return "Amex"
+	case strings.HasPrefix(number, "36"), strings.HasPrefix(number, "38"), strings.HasPrefix(number, "30"):
+		return "Diners"
+	case strings.HasPrefix(number, "6011"), strings.HasPrefix(number, "65"):
+		return "Discover"
+	case strings.HasPrefix(number, "35"):
+		return "JCB"
+	}
+	if len(number) >= 4 {
+		var p4 int
+		fmt.Sscanf(number[:4], "%d", &p4)
+		if (p4 >= 5100 && p4 <= 5599) || (p4 >= 2221 && p4 <= 2720) {
+			return "Mastercard"
+		}
+	}
+	return ""
+}
+
+func normalizeCardNumber(s string) string {
+	return strings.NewReplacer(" ", "", "-", "").Replace(strings.TrimSpace(s))
+}
+
+func isDigits(s string) bool {
+	for _, c := range s {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return s != ""
+}
+
+func randomInt(n int) int {
+	v, err := rand.Int(rand.Reader, big.NewInt(int64(n)))
+	if err != nil {
+		panic(err)
+	}
+	return int(v.Int64())
+}
@@ -0,0 +1,319 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+	"golang.org/x/term"
+)
+
+// A tuiView is one screen of the interactive mode: a title, the table columns
+// and a loader that fetches fresh rows from the API
+type tuiView struct {
+	title   string
+	headers []string
+	widths  []int
+	load    func(c *TokenShieldClient) ([][]string, error)
+}
+
+var tuiViews = []tuiView{
+	{
+		title:   "Tokens",
+		headers: []string{"TOKEN", "CARD_TYPE", "LAST_4", "ACTIVE", "CREATED"},
+		widths:  []int{50, 12, 8, 8, 20},
+		load: func(c *TokenShieldClient) ([][]string, error) {
+			result, err := tuiFetch(c, "/api/v1/tokens?limit=200")
+			if err != nil {
+				return nil, err
+			}
+			tokens, _ := result["tokens"].([]interface{})
+			var rows [][]string
+			for _, row := range tokenRows(tokens) {
+				// token, card_type, first_six, last_four, is_active, created_at
+				rows = append(rows, []string{row[0], row[1], row[3], row[4], formatTime(row[5])})
+			}
+			return rows, nil
+		},
+	},
+	{
+		title:   "Activity",
+		headers: []string{"TIMESTAMP", "TYPE", "TOKEN", "SOURCE_IP", "STATUS"},
+		widths:  []int{20, 12, 40, 16, 8},
+		load: func(c *TokenShieldClient) ([][]string, error) {
+			result, err := tuiFetch(c, "/api/v1/activity?limit=200")
+			if err != nil {
+				return nil, err
+			}
+			activities, _ := result["activities"].([]interface{})
+			var rows [][]string
+			for _, a := range activities {
+				activity := a.(map[string]interface{})
+				rows = append(rows, []string{
+					formatTime(csvValue(activity["timestamp"])),
+					csvValue(activity["type"]),
+					csvValue(activity["token"]),
+					csvValue(activity["source_ip"]),
+					csvValue(activity["status"]),
+				})
+			}
+			return rows, nil
+		},
+	},
+	{
+		title:   "Users",
+		headers: []string{"USERNAME", "ROLE", "EMAIL", "ACTIVE", "CREATED"},
+		widths:  []int{20, 10, 30, 8, 20},
+		load: func(c *TokenShieldClient) ([][]string, error) {
+			result, err := tuiFetch(c, "/api/v1/users")
+			if err != nil {
+				return nil, err
+			}
+			users, _ := result["users"].([]interface{})
+			var rows [][]string
+			for _, u := range users {
+				user := u.(map[string]interface{})
+				rows = append(rows, []string{
+					csvValue(user["username"]),
+					csvValue(user["role"]),
+					csvValue(user["email"]),
+					csvValue(user["is_active"]),
+					formatTime(csvValue(user["created_at"])),
+				})
+			}
+			return rows, nil
+		},
+	},
+}
+
+var tuiCmd = &cobra.Command{
+	Use:   "tui",
+	Short: "Interactive view of tokens, activity and users with live refresh",
+	Long: `Browse tokens, activity and users in a full-screen view that refreshes
+automatically.
+
+Keys:
+  1/2/3, tab   switch between Tokens, Activity and Users
+  j/k, arrows  scroll
+  g/G          jump to top/bottom
+  r            refresh now
+  q, ctrl-c    quit`,
+	Run: func(cmd *cobra.Command, args []string) {
+		refresh, _ := cmd.Flags().GetDuration("refresh")
+
+		fd := int(os.Stdin.Fd())
+		if !term.IsTerminal(fd) || !term.IsTerminal(int(os.Stdout.Fd())) {
+			fmt.Println("Error: tui requires an interactive terminal")
+			os.Exit(1)
+		}
+		if refresh < time.Second {
+			refresh = time.Second
+		}
+
+		oldState, err := term.MakeRaw(fd)
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+		// Alternate screen buffer and hidden cursor; both restored on exit
+		fmt.Print("\x1b[?1049h\x1b[?25l")
+		defer func() {
+			fmt.Print("\x1b[?25h\x1b[?1049l")
+			term.Restore(fd, oldState)
+		}()
+
+		keys := make(chan string)
+		go func() {
+			buf := make([]byte, 8)
+			for {
+				n, err := os.Stdin.Read(buf)
+				if err != nil {
+					close(keys)
+					return
+				}
+				keys <- string(buf[:n])
+			}
+		}()
+
+		client := NewClient(apiURL, apiKey, adminSecret, sessionID)
+		state := &tuiState{}
+		state.reload(client)
+		state.draw()
+
+		ticker := time.NewTicker(refresh)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				state.reload(client)
+			case key, ok := <-keys:
+				if !ok {
+					return
+				}
+				switch key {
+				case "q", "\x03":
+					return
+				case "1", "2", "3":
+					state.switchView(int(key[0] - '1'))
+					state.reload(client)
+				case "\t":
+					state.switchView((state.view + 1) % len(tuiViews))
+					state.reload(client)
+				case "j", "\x1b[B":
+					state.scroll(1)
+				case "k", "\x1b[A":
+					state.scroll(-1)
+				case " ", "\x1b[6~":
+					state.scroll(state.pageSize())
+				case "b", "\x1b[5~":
+					state.scroll(-state.pageSize())
+				case "g":
+					state.offset = 0
+				case "G":
+					state.scroll(len(state.rows))
+				case "r":
+					state.reload(client)
+				}
+			}
+			state.draw()
+		}
+	},
+}
+
+type tuiState struct {
+	view      int
+	rows      [][]string
+	offset    int
+	err       error
+	updatedAt time.Time
+}
+
+func (s *tuiState) switchView(view int) {
+	s.view = view
+	s.rows = nil
+	s.offset = 0
+}
+
+func (s *tuiState) reload(client *TokenShieldClient) {
+	rows, err := tuiViews[s.view].load(client)
+	s.err = err
+	if err == nil {
+		s.rows = rows
+		s.updatedAt = time.Now()
+		s.scroll(0)
+	}
+}
+
+func (s *tuiState) pageSize() int {
+	_, height, err := term.GetSize(int(os.Stdout.Fd()))
+	if err != nil || height < 8 {
+		return 10
+	}
+	// Title, blank line, header, separator and two footer lines
+	return height - 6
+}
+
+func (s *tuiState) scroll(delta int) {
+	s.offset += delta
+	if last := len(s.rows) - s.pageSize(); s.offset > last {
+		s.offset = last
+	}
+	if s.offset < 0 {
+		s.offset = 0
+	}
+}
+
+func (s *tuiState) draw() {
+	width, _, err := term.GetSize(int(os.Stdout.Fd()))
+	if err != nil {
+		width = 120
+	}
+	view := tuiViews[s.view]
+
+	var b strings.Builder
+	b.WriteString("\x1b[H\x1b[2J")
+
+	// Tab bar
+	b.WriteString("TokenShield  ")
+	for i, v := range tuiViews {
+		if i == s.view {
+			fmt.Fprintf(&b, "\x1b[7m %d %s \x1b[0m ", i+1, v.title)
+		} else {
+			fmt.Fprintf(&b, " %d %s  ", i+1, v.title)
+		}
+	}
+	b.WriteString("\r\n\r\n")
+
+	b.WriteString("\x1b[1m" + tuiLine(view.headers, view.widths, width) + "\x1b[0m\r\n")
+	b.WriteString(strings.Repeat("-", minInt(width, sumInts(view.widths)+len(view.widths))) + "\r\n")
+
+	end := minInt(s.offset+s.pageSize(), len(s.rows))
+	for _, row := range s.rows[s.offset:end] {
+		b.WriteString(tuiLine(row, view.widths, width) + "\r\n")
+	}
+	for i := end - s.offset; i < s.pageSize(); i++ {
+		b.WriteString("\r\n")
+	}
+
+	status := fmt.Sprintf("%d-%d of %d", minInt(s.offset+1, len(s.rows)), end, len(s.rows))
+	if !s.updatedAt.IsZero() {
+		status += "  updated " + s.updatedAt.Format("15:04:05")
+	}
+	if s.err != nil {
+		status += "  \x1b[31merror: " + s.err.Error() + "\x1b[0m"
+	}
+	b.WriteString(status + "\r\n")
+	b.WriteString("\x1b[2m1-3/tab switch  j/k scroll  g/G top/bottom  r refresh  q quit\x1b[0m")
+
+	fmt.Print(b.String())
+}
+
+// tuiLine formats one table row into fixed-width columns clipped to the terminal width
+func tuiLine(cols []string, widths []int, termWidth int) string {
+	var parts []string
+	for i, col := range cols {
+		parts = append(parts, fmt.Sprintf("%-*s", widths[i], truncateString(col, widths[i])))
+	}
+	line := strings.Join(parts, " ")
+	if len(line) > termWidth {
+		line = line[:termWidth]
+	}
+	return line
+}
+
+func tuiFetch(c *TokenShieldClient, endpoint string) (map[string]interface{}, error) {
+	resp, err := c.makeRequest("GET", endpoint, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		return nil, fmt.Errorf("%s", resp.Status)
+	}
+
+	var result map[string]interface{}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func sumInts(values []int) int {
+	total := 0
+	for _, v := range values {
+		total += v
+	}
+	return total
+}
@@ -8,9 +8,9 @@ USE tokenshield;
 CREATE TABLE IF NOT EXISTS encryption_keys (
     id INT AUTO_INCREMENT PRIMARY KEY,
     key_id VARCHAR(64) UNIQUE NOT NULL,
-    key_type ENUM('KEK', 'DEK') NOT NULL,
+    key_type ENUM('KEK', 'DEK', 'INDEX') NOT NULL COMMENT 'INDEX is the blind index HMAC key, wrapped like a DEK',
     key_version INT NOT NULL,
-    encrypted_key VARBINARY(512) COMMENT 'DEKs encrypted with KEK, KEKs stored as-is (should be in HSM)',
+    encrypted_key VARBINARY(512) COMMENT 'DEKs encrypted with KEK; KEKs sealed by passphrase or KMS (see metadata.sealed_by)',
     key_status ENUM('active', 'rotating', 'retired', 'compromised') NOT NULL,
     created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
     activated_at TIMESTAMP NULL,
@@ -21,28 +21,54 @@ CREATE TABLE IF NOT EXISTS encryption_keys (
     INDEX idx_key_version (key_type, key_version)
 ) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
 
+-- Roles users are given; a user has the permissions of their role plus any
+-- in users.permissions
+CREATE TABLE IF NOT EXISTS roles (
+    name VARCHAR(32) PRIMARY KEY,
+    description VARCHAR(255) NOT NULL DEFAULT '',
+    permissions JSON NOT NULL,
+    built_in BOOLEAN NOT NULL DEFAULT FALSE COMMENT 'Cannot be deleted; admin cannot be changed',
+    inactive_user_days INT NULL COMMENT 'NULL follows INACTIVE_USER_DAYS; 0 never disables',
+    stale_api_key_days INT NULL COMMENT 'NULL follows STALE_API_KEY_DAYS; 0 never disables',
+    created_by VARCHAR(64),
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+
+INSERT IGNORE INTO roles (name, description, permissions, built_in) VALUES
+    ('admin', 'Full access', JSON_ARRAY('system.admin'), TRUE),
+    ('operator', 'Create, search and revoke tokens', JSON_ARRAY('tokens.read', 'tokens.write', 'tokens.delete', 'tokens.read_pii', 'activity.read', 'stats.read'), TRUE),
+    ('viewer', 'Read-only access to tokens and activity', JSON_ARRAY('tokens.read', 'activity.read', 'stats.read'), TRUE);
+
 -- Users table
 CREATE TABLE IF NOT EXISTS users (
     id INT AUTO_INCREMENT PRIMARY KEY,
     user_id VARCHAR(64) UNIQUE NOT NULL,
+    account_type ENUM('human', 'service') NOT NULL DEFAULT 'human' COMMENT 'service accounts cannot log in',
     username VARCHAR(50) UNIQUE NOT NULL,
     email VARCHAR(255) UNIQUE NOT NULL,
     password_hash VARCHAR(255) NOT NULL,
     full_name VARCHAR(100),
-    role ENUM('admin', 'operator', 'viewer') NOT NULL DEFAULT 'viewer',
-    permissions JSON COMMENT 'Specific permissions: ["tokens.read", "tokens.write", "tokens.delete", "api_keys.manage", "users.manage", "system.admin"]',
+    description VARCHAR(255) NULL COMMENT 'What a service account is for',
+    role VARCHAR(32) NOT NULL DEFAULT 'viewer',
+    permissions JSON COMMENT 'Permissions granted beyond those of the role, like ["tokens.read_pii", "users.read"]',
     is_active BOOLEAN DEFAULT TRUE,
     is_email_verified BOOLEAN DEFAULT FALSE,
     created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
     updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP,
     last_login_at TIMESTAMP NULL,
+    reactivated_at TIMESTAMP NULL COMMENT 'When an admin last enabled the account',
+    inactivity_warned_at TIMESTAMP NULL COMMENT 'When the user_inactive warning was raised',
+    inactive_disabled_at TIMESTAMP NULL COMMENT 'When the account was disabled for inactivity',
     password_changed_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
     failed_login_attempts INT DEFAULT 0,
     locked_until TIMESTAMP NULL,
     created_by VARCHAR(64) COMMENT 'user_id of creator',
     INDEX idx_username (username),
     INDEX idx_email (email),
-    INDEX idx_role (role)
+    INDEX idx_role (role),
+    INDEX idx_account_type (account_type),
+    CONSTRAINT fk_users_role FOREIGN KEY (role) REFERENCES roles(name)
 ) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
 
 -- Table for storing tokenized credit cards
@@ -50,9 +76,20 @@ CREATE TABLE IF NOT EXISTS credit_cards (
     id INT AUTO_INCREMENT PRIMARY KEY,
     token VARCHAR(64) UNIQUE NOT NULL,
     card_number_encrypted VARBINARY(255) NOT NULL,
+    card_number_index VARBINARY(32) NULL COMMENT 'HMAC-SHA256 blind index of the card number',
     card_holder_name_encrypted VARBINARY(255),
-    expiry_month TINYINT NOT NULL,
-    expiry_year SMALLINT NOT NULL,
+    card_holder_name_index VARBINARY(32) NULL COMMENT 'HMAC-SHA256 blind index of the normalized cardholder name',
+    expiry_month TINYINT NULL COMMENT 'NULL when the card was tokenized without an expiry',
+    expiry_year SMALLINT NULL,
+    external_id VARCHAR(64) NULL COMMENT 'Client reference ID given at import',
+    external_id_encrypted VARBINARY(255) NULL,
+    external_id_index VARBINARY(32) NULL COMMENT 'HMAC-SHA256 blind index of the external ID',
+    tenant VARCHAR(64) NULL COMMENT 'Tenant the card was imported for',
+    source VARCHAR(16) NULL COMMENT 'How the card was tokenized: proxy or import',
+    region VARCHAR(8) NULL COMMENT 'REGION of the site that tokenized the card',
+    created_by VARCHAR(64) NULL COMMENT 'user_id of the user an imported card belongs to',
+    metadata JSON NULL COMMENT 'Client metadata given at import',
+    metadata_encrypted BLOB NULL,
     card_type VARCHAR(20), -- VISA, MASTERCARD, AMEX, etc.
     last_four_digits CHAR(4) NOT NULL,
     first_six_digits CHAR(6) NOT NULL, -- BIN for card type identification
@@ -61,9 +98,20 @@ CREATE TABLE IF NOT EXISTS credit_cards (
     created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
     updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP,
     is_active BOOLEAN DEFAULT TRUE,
+    revoked_at TIMESTAMP NULL,
+    purge_after TIMESTAMP NULL COMMENT 'When a revoked card is deleted; NULL keeps it',
     INDEX idx_token (token),
-    INDEX idx_last_four (last_four_digits),
+    INDEX idx_last_four_created (last_four_digits, created_at),
     INDEX idx_created_at (created_at),
+    INDEX idx_active_created (is_active, created_at),
+    INDEX idx_card_type_created (card_type, created_at),
+    INDEX idx_card_number_index (card_number_index),
+    INDEX idx_card_holder_name_index (card_holder_name_index),
+    INDEX idx_external_id (external_id),
+    INDEX idx_external_id_index (external_id_index),
+    INDEX idx_tenant_created (tenant, created_at),
+    INDEX idx_created_by_created (created_by, created_at),
+    INDEX idx_purge_after (purge_after),
     CONSTRAINT fk_encryption_key FOREIGN KEY (encryption_key_id) REFERENCES encryption_keys(key_id)
 ) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
 
@@ -81,7 +129,8 @@ CREATE TABLE IF NOT EXISTS token_requests (
     response_time_ms INT,
     FOREIGN KEY (token) REFERENCES credit_cards(token),
     INDEX idx_token_timestamp (token, request_timestamp),
-    INDEX idx_request_type (request_type),
+    INDEX idx_request_timestamp (request_timestamp),
+    INDEX idx_type_timestamp (request_type, request_timestamp),
     INDEX idx_user_id (user_id)
 ) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
 
@@ -91,17 +140,35 @@ CREATE TABLE IF NOT EXISTS api_keys (
     user_id VARCHAR(64) COMMENT 'User who owns this API key',
     api_key VARCHAR(64) UNIQUE NOT NULL,
     api_secret_hash VARCHAR(255) NOT NULL,
+    signing_secret_encrypted VARBINARY(255) NULL COMMENT 'HMAC secret of a key that only accepts signed requests',
+    signing_secret_key_id VARCHAR(64) NULL COMMENT 'DEK of signing_secret_encrypted; NULL for the legacy key',
     client_name VARCHAR(100) NOT NULL,
     permissions JSON,
     is_active BOOLEAN DEFAULT TRUE,
     created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
     last_used_at TIMESTAMP NULL,
+    expires_at TIMESTAMP NULL COMMENT 'NULL never expires; service account keys always do',
+    expiry_reminded_at TIMESTAMP NULL COMMENT 'When the api_key_expiring reminder was raised',
+    inactivity_warned_at TIMESTAMP NULL COMMENT 'When the api_key_stale warning was raised',
+    inactive_disabled_at TIMESTAMP NULL COMMENT 'When the key was deactivated for going unused',
     created_by VARCHAR(64) COMMENT 'user_id of creator',
     INDEX idx_api_key (api_key),
     INDEX idx_user_id (user_id),
+    INDEX idx_api_keys_expires (expires_at),
     CONSTRAINT fk_api_key_user FOREIGN KEY (user_id) REFERENCES users(user_id) ON DELETE CASCADE
 ) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
 
+-- Nonces of signed API requests, kept until their timestamp is too old to
+-- be accepted, so that a signed request cannot be replayed
+CREATE TABLE IF NOT EXISTS api_key_nonces (
+    api_key VARCHAR(64) NOT NULL,
+    nonce VARCHAR(64) NOT NULL,
+    expires_at TIMESTAMP NOT NULL,
+    PRIMARY KEY (api_key, nonce),
+    INDEX idx_api_key_nonces_expires (expires_at),
+    CONSTRAINT fk_api_key_nonces_key FOREIGN KEY (api_key) REFERENCES api_keys(api_key) ON DELETE CASCADE
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+
 -- User sessions table for managing login sessions
 CREATE TABLE IF NOT EXISTS user_sessions (
     id BIGINT AUTO_INCREMENT PRIMARY KEY,
@@ -119,6 +186,28 @@ CREATE TABLE IF NOT EXISTS user_sessions (
     INDEX idx_expires_at (expires_at)
 ) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
 
+-- Failed logins are counted per client address and per username, so that
+-- after LOGIN_CHALLENGE_AFTER failures within LOGIN_CHALLENGE_WINDOW a
+-- login must first pass a challenge. subject is a hex SHA-256 of the
+-- address or lowercased username, which need not belong to an account.
+CREATE TABLE IF NOT EXISTS login_failures (
+    scope ENUM('ip', 'username') NOT NULL,
+    subject CHAR(64) NOT NULL COMMENT 'Hex SHA-256 of the address or lowercased username',
+    failures INT NOT NULL DEFAULT 0,
+    first_failed_at TIMESTAMP NOT NULL COMMENT 'Start of the window the failures are counted in',
+    PRIMARY KEY (scope, subject),
+    INDEX idx_login_failures_first (first_failed_at)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+
+-- Proof-of-work puzzles handed to challenged logins. A row is deleted when
+-- its solution is accepted, so each puzzle solves one login.
+CREATE TABLE IF NOT EXISTS login_challenges (
+    challenge_id VARCHAR(64) PRIMARY KEY,
+    difficulty TINYINT UNSIGNED NOT NULL COMMENT 'Leading zero bits the solution hash needs',
+    expires_at TIMESTAMP NOT NULL,
+    INDEX idx_login_challenges_expires (expires_at)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+
 -- Audit log for user actions
 CREATE TABLE IF NOT EXISTS user_audit_log (
     id BIGINT AUTO_INCREMENT PRIMARY KEY,
@@ -127,6 +216,8 @@ CREATE TABLE IF NOT EXISTS user_audit_log (
     resource_type VARCHAR(50) COMMENT 'tokens, api_keys, users, system',
     resource_id VARCHAR(64) COMMENT 'ID of the affected resource',
     details JSON COMMENT 'Additional action details',
+    details_encrypted MEDIUMBLOB NULL,
+    details_key_id VARCHAR(64) NULL COMMENT 'DEK of details_encrypted; NULL for the legacy key',
     ip_address VARCHAR(45),
     user_agent TEXT,
     created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
@@ -146,6 +237,8 @@ CREATE TABLE IF NOT EXISTS security_audit_log (
     user_agent TEXT,
     endpoint VARCHAR(255) COMMENT 'API endpoint accessed',
     details JSON COMMENT 'Additional security event details',
+    details_encrypted MEDIUMBLOB NULL,
+    details_key_id VARCHAR(64) NULL COMMENT 'DEK of details_encrypted; NULL for the legacy key',
     created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
     INDEX idx_event_type (event_type),
     INDEX idx_severity (severity),
@@ -154,6 +247,89 @@ CREATE TABLE IF NOT EXISTS security_audit_log (
     INDEX idx_user_id (user_id)
 ) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
 
+-- Audit log rows past AUDIT_LOG_RETENTION_DAYS are exported to object
+-- storage as gzipped JSON lines before they are deleted. Each export is
+-- recorded here with its row range, digest and signature, which the query
+-- endpoint checks the fetched object against.
+CREATE TABLE IF NOT EXISTS audit_archives (
+    archive_id BIGINT AUTO_INCREMENT PRIMARY KEY,
+    source_table ENUM('user_audit_log', 'security_audit_log') NOT NULL,
+    store VARCHAR(16) NOT NULL COMMENT 's3, gcs or file',
+    object_key VARCHAR(512) NOT NULL,
+    first_id BIGINT NOT NULL,
+    last_id BIGINT NOT NULL,
+    first_at TIMESTAMP NOT NULL,
+    last_at TIMESTAMP NOT NULL,
+    row_count INT NOT NULL,
+    size_bytes BIGINT NOT NULL,
+    sha256 CHAR(64) NOT NULL COMMENT 'Hex SHA-256 of the object',
+    signature CHAR(64) NOT NULL COMMENT 'Hex HMAC of sha256 under the blind index key',
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    UNIQUE KEY uk_audit_archives_range (source_table, first_id),
+    INDEX idx_audit_archives_time (source_table, first_at, last_at)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+
+-- Access reviews: campaigns in which admins confirm or revoke each active
+-- account and API key by a deadline. The items keep every decision, and
+-- those still pending when a review closes are marked expired, and by
+-- default disabled.
+CREATE TABLE IF NOT EXISTS access_reviews (
+    review_id VARCHAR(64) PRIMARY KEY,
+    name VARCHAR(100) NOT NULL,
+    status ENUM('open', 'closed') NOT NULL DEFAULT 'open',
+    due_at TIMESTAMP NOT NULL,
+    reminded_at TIMESTAMP NULL COMMENT 'When the access_review_due reminder was raised',
+    created_by VARCHAR(100) NOT NULL COMMENT 'user_id, or system for scheduled reviews',
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    closed_at TIMESTAMP NULL,
+    closed_by VARCHAR(100) NULL COMMENT 'user_id, or system at the deadline',
+    INDEX idx_access_reviews_status (status, due_at)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+
+CREATE TABLE IF NOT EXISTS access_review_items (
+    id BIGINT AUTO_INCREMENT PRIMARY KEY,
+    review_id VARCHAR(64) NOT NULL,
+    subject_type ENUM('user', 'api_key') NOT NULL,
+    subject_id VARCHAR(64) NOT NULL COMMENT 'user_id or api_key',
+    user_id VARCHAR(64) NOT NULL DEFAULT '' COMMENT 'The account, or the owner of the key',
+    username VARCHAR(50) NOT NULL DEFAULT '',
+    label VARCHAR(100) NULL COMMENT 'Client name of a key',
+    role VARCHAR(32) NULL,
+    permissions JSON NULL COMMENT 'Granted beyond the role, or the key''s permissions',
+    last_used_at TIMESTAMP NULL COMMENT 'Last login, or when the key was last used, when the review started',
+    decision ENUM('pending', 'confirmed', 'revoked', 'expired') NOT NULL DEFAULT 'pending',
+    decided_by VARCHAR(100) NULL,
+    decided_at TIMESTAMP NULL,
+    comment VARCHAR(500) NULL,
+    UNIQUE KEY uniq_access_review_subject (review_id, subject_type, subject_id),
+    INDEX idx_access_review_decision (review_id, decision),
+    CONSTRAINT fk_access_review_items FOREIGN KEY (review_id) REFERENCES access_reviews(review_id) ON DELETE CASCADE
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+
+-- Network tokens: the card scheme's token for a vault card, requested
+-- through NETWORK_TOKEN_CONNECTORS and used with a cryptogram per
+-- transaction. The network token number is encrypted like the card's
+-- fields. A row whose card has been purged is deleted at the scheme and
+-- here by the cleanup job.
+CREATE TABLE IF NOT EXISTS network_tokens (
+    id INT AUTO_INCREMENT PRIMARY KEY,
+    token VARCHAR(64) UNIQUE NOT NULL COMMENT 'The vault token of the card',
+    scheme VARCHAR(16) NOT NULL COMMENT 'visa, mastercard, amex or discover',
+    token_reference_id VARCHAR(128) NOT NULL COMMENT 'The token service''s ID for the network token',
+    network_token_encrypted VARBINARY(255) NOT NULL,
+    encryption_key_id VARCHAR(64) NULL,
+    last_four CHAR(4) NOT NULL,
+    expiry_month TINYINT NULL,
+    expiry_year SMALLINT NULL,
+    status ENUM('active', 'suspended') NOT NULL DEFAULT 'active',
+    cryptograms_issued INT NOT NULL DEFAULT 0,
+    last_cryptogram_at TIMESTAMP NULL,
+    created_by VARCHAR(100) NULL COMMENT 'user_id',
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP,
+    INDEX idx_network_tokens_scheme (scheme)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+
 -- Password reset tokens
 CREATE TABLE IF NOT EXISTS password_reset_tokens (
     id INT AUTO_INCREMENT PRIMARY KEY,
@@ -171,7 +347,7 @@ CREATE TABLE IF NOT EXISTS password_reset_tokens (
 CREATE TABLE IF NOT EXISTS key_rotation_log (
     id BIGINT AUTO_INCREMENT PRIMARY KEY,
     rotation_id VARCHAR(64) UNIQUE NOT NULL,
-    key_type VARCHAR(10) DEFAULT 'DEK' COMMENT 'Type of key being rotated: KEK or DEK',
+    key_type VARCHAR(10) DEFAULT 'DEK' COMMENT 'Type of key being rotated: KEK, DEK, both, or REENCRYPT for card re-encryption jobs',
     old_key_id VARCHAR(64),
     new_key_id VARCHAR(64),
     started_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
@@ -184,6 +360,250 @@ CREATE TABLE IF NOT EXISTS key_rotation_log (
     INDEX idx_rotation_status (status, started_at)
 ) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
 
+-- Applied schema migrations (see unified-tokenizer/internal/migrate).
+-- This file is the baseline; run `unified-tokenizer migrate` after upgrades.
+CREATE TABLE IF NOT EXISTS schema_migrations (
+    version INT PRIMARY KEY,
+    name VARCHAR(255) NOT NULL,
+    applied_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+
+-- Key share configuration for sealed-boot mode (SEAL_MODE=shamir), written
+-- by `unified-tokenizer unseal-init`; the shares themselves are never stored
+CREATE TABLE IF NOT EXISTS seal_config (
+    id TINYINT PRIMARY KEY,
+    shares INT NOT NULL,
+    threshold INT NOT NULL,
+    check_value VARBINARY(128) NOT NULL COMMENT 'Known value sealed with the master key, to verify a reconstructed key',
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+
+-- Scheduled key rotation: rotate the active KEK or DEK once it is
+-- interval_days old (see /api/v1/keys/policies)
+CREATE TABLE IF NOT EXISTS key_rotation_policies (
+    key_type ENUM('KEK', 'DEK') PRIMARY KEY,
+    enabled BOOLEAN NOT NULL DEFAULT TRUE,
+    interval_days INT NOT NULL,
+    reencrypt BOOLEAN NOT NULL DEFAULT TRUE COMMENT 'Re-encrypt cards after a scheduled DEK rotation',
+    last_run_at TIMESTAMP NULL,
+    last_status VARCHAR(20) COMMENT 'running, completed, failed, or skipped when a pre-rotation check failed',
+    last_rotation_id VARCHAR(64),
+    last_error TEXT,
+    updated_by VARCHAR(100),
+    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+
+-- Vault integrity check runs and their reconciliation reports (see
+-- `unified-tokenizer verify` and /api/v1/integrity/checks)
+CREATE TABLE IF NOT EXISTS integrity_checks (
+    id BIGINT AUTO_INCREMENT PRIMARY KEY,
+    check_id VARCHAR(64) UNIQUE NOT NULL,
+    schedule_slot BIGINT NULL UNIQUE COMMENT 'Interval claimed by a scheduled run, so one replica runs each',
+    status ENUM('running', 'completed', 'failed') NOT NULL DEFAULT 'running',
+    started_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    completed_at TIMESTAMP NULL,
+    cards_checked INT NOT NULL DEFAULT 0,
+    decrypt_failures INT NOT NULL DEFAULT 0,
+    digit_mismatches INT NOT NULL DEFAULT 0,
+    luhn_failures INT NOT NULL DEFAULT 0,
+    orphaned_requests INT NOT NULL DEFAULT 0,
+    issues JSON COMMENT 'Up to 1000 findings naming the token and check, never card data',
+    error_message TEXT,
+    initiated_by VARCHAR(100),
+    INDEX idx_integrity_completed (status, completed_at)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+
+-- CORS policy set through /api/v1/cors; without a row the CORS_* settings
+-- apply
+CREATE TABLE IF NOT EXISTS cors_policy (
+    id TINYINT PRIMARY KEY COMMENT 'Always 1',
+    policy JSON NOT NULL,
+    updated_by VARCHAR(100),
+    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+
+-- Client address filters for the API and ICAP ports set through
+-- /api/v1/ip-filters; without a row a port uses the *_CIDRS settings
+CREATE TABLE IF NOT EXISTS ip_filters (
+    scope VARCHAR(16) PRIMARY KEY COMMENT 'api or icap',
+    rules JSON NOT NULL,
+    updated_by VARCHAR(100),
+    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+
+-- Detokenization quota overrides per user or API key; without a row the
+-- DETOKENIZE_QUOTA_* settings apply
+CREATE TABLE IF NOT EXISTS detokenize_quotas (
+    subject_type VARCHAR(16) NOT NULL COMMENT 'user or api_key',
+    subject_id VARCHAR(64) NOT NULL COMMENT 'user_id or api_key',
+    hourly_limit INT NULL COMMENT 'NULL for the default, 0 for unlimited',
+    daily_limit INT NULL COMMENT 'NULL for the default, 0 for unlimited',
+    updated_by VARCHAR(100),
+    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP,
+    PRIMARY KEY (subject_type, subject_id)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+
+-- Detokenizations counted per user or API key and UTC hour or day
+CREATE TABLE IF NOT EXISTS detokenize_usage (
+    subject_type VARCHAR(16) NOT NULL,
+    subject_id VARCHAR(64) NOT NULL,
+    period VARCHAR(8) NOT NULL COMMENT 'hour or day',
+    period_start DATETIME NOT NULL,
+    used INT NOT NULL DEFAULT 0,
+    PRIMARY KEY (subject_type, subject_id, period, period_start),
+    INDEX idx_detokenize_usage_start (period_start)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+
+-- Rate-limit rules set through /api/v1/rate-limits; without a row the
+-- RATE_LIMIT_RULES setting applies
+CREATE TABLE IF NOT EXISTS rate_limit_rules (
+    id TINYINT PRIMARY KEY COMMENT 'Always 1',
+    rules JSON NOT NULL,
+    updated_by VARCHAR(100),
+    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+
+-- Request counters shared by all replicas with RATE_LIMIT_BACKEND=database
+CREATE TABLE IF NOT EXISTS rate_limit_counters (
+    bucket VARCHAR(128) PRIMARY KEY COMMENT 'Rule and hashed client',
+    window_start DATETIME(6) NOT NULL,
+    window_end DATETIME(6) NOT NULL,
+    hits INT NOT NULL DEFAULT 0,
+    blocked_until DATETIME(6) NULL,
+    INDEX idx_rate_limit_window_end (window_end)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+
+-- Key/value tags on tokens, deleted with the card
+CREATE TABLE IF NOT EXISTS token_tags (
+    token VARCHAR(64) NOT NULL,
+    tag_key VARCHAR(64) NOT NULL,
+    tag_value VARCHAR(255) NOT NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (token, tag_key),
+    INDEX idx_token_tags_key_value (tag_key, tag_value),
+    CONSTRAINT fk_token_tags_token FOREIGN KEY (token) REFERENCES credit_cards(token) ON DELETE CASCADE
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+
+-- Settlement files picked up from the batch inbox. A file is claimed by
+-- inserting its row, so each is processed by one replica and only once.
+CREATE TABLE IF NOT EXISTS batch_files (
+    id BIGINT AUTO_INCREMENT PRIMARY KEY,
+    file_id VARCHAR(64) UNIQUE NOT NULL,
+    file_name VARCHAR(255) NOT NULL,
+    file_sha256 CHAR(64) NOT NULL,
+    status ENUM('processing', 'completed', 'failed') NOT NULL DEFAULT 'processing',
+    started_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    completed_at TIMESTAMP NULL,
+    rows_processed INT NOT NULL DEFAULT 0,
+    cards_tokenized INT NOT NULL DEFAULT 0,
+    cards_masked INT NOT NULL DEFAULT 0,
+    row_errors INT NOT NULL DEFAULT 0,
+    archive_name VARCHAR(255) NULL COMMENT 'Encrypted original in BATCH_ARCHIVE_DIR',
+    error_message TEXT,
+    UNIQUE KEY uq_batch_file (file_name, file_sha256),
+    INDEX idx_batch_files_started (started_at)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+
+-- Client certificate identities for mTLS on the API port. A verified
+-- certificate whose URI, DNS or email SAN or subject CN matches identity
+-- acts as user_id, limited to permissions.
+CREATE TABLE IF NOT EXISTS client_certificates (
+    id INT AUTO_INCREMENT PRIMARY KEY,
+    cert_id VARCHAR(64) UNIQUE NOT NULL,
+    identity VARCHAR(255) UNIQUE NOT NULL COMMENT 'URI:..., DNS:..., EMAIL:... or CN=...',
+    client_name VARCHAR(100) NOT NULL,
+    user_id VARCHAR(64) NOT NULL COMMENT 'User whose permissions the identity is limited to',
+    permissions JSON NOT NULL,
+    is_active BOOLEAN DEFAULT TRUE,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    last_used_at TIMESTAMP NULL,
+    created_by VARCHAR(64) COMMENT 'user_id of creator',
+    INDEX idx_client_certificates_user (user_id),
+    CONSTRAINT fk_client_certificate_user FOREIGN KEY (user_id) REFERENCES users(user_id) ON DELETE CASCADE
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+
+-- Card field rules for proxied JSON set through /api/v1/config/field-rules;
+-- without a row CARD_FIELD_MAPPINGS and DEEP_SCAN_FIELDS apply
+CREATE TABLE IF NOT EXISTS field_rules (
+    id TINYINT PRIMARY KEY COMMENT 'Always 1',
+    rules JSON NOT NULL,
+    updated_by VARCHAR(100),
+    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+
+-- Maintenance mode and the config freeze set through /api/v1/maintenance;
+-- without a row both are off
+CREATE TABLE IF NOT EXISTS maintenance_mode (
+    id TINYINT PRIMARY KEY COMMENT 'Always 1',
+    state JSON NOT NULL,
+    updated_by VARCHAR(100),
+    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+
+-- Running totals behind /api/v1/stats, the status page and /metrics, kept
+-- up to date by the application; each region writes rows of its own
+CREATE TABLE IF NOT EXISTS stats_counters (
+    name VARCHAR(64) NOT NULL COMMENT 'active_tokens, or requests:<request_type>',
+    region VARCHAR(8) NOT NULL DEFAULT '',
+    value BIGINT NOT NULL DEFAULT 0,
+    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP,
+    PRIMARY KEY (name, region)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+
+-- Token requests per minute, kept for two days for the 24 hour figures
+CREATE TABLE IF NOT EXISTS token_request_minutes (
+    minute BIGINT NOT NULL COMMENT 'Unix time divided by 60',
+    region VARCHAR(8) NOT NULL DEFAULT '',
+    request_type VARCHAR(20) NOT NULL,
+    requests BIGINT NOT NULL DEFAULT 0,
+    errors BIGINT NOT NULL DEFAULT 0,
+    PRIMARY KEY (minute, region, request_type)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+
+-- token_requests rows older than TOKEN_REQUEST_RETENTION_DAYS, moved here
+-- with TOKEN_REQUEST_ARCHIVE=table
+CREATE TABLE IF NOT EXISTS token_requests_archive (
+    id BIGINT PRIMARY KEY COMMENT 'token_requests.id',
+    token VARCHAR(64) NOT NULL,
+    user_id VARCHAR(64),
+    api_key_used VARCHAR(64),
+    request_type ENUM('tokenize', 'detokenize', 'forward') NOT NULL,
+    source_ip VARCHAR(45),
+    destination_url TEXT,
+    request_timestamp TIMESTAMP NULL,
+    response_status INT,
+    response_time_ms INT,
+    archived_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    INDEX idx_archive_token (token),
+    INDEX idx_archive_timestamp (request_timestamp)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+
+-- One-time email verification and password reset links; only a hash of
+-- each token is stored
+CREATE TABLE IF NOT EXISTS account_tokens (
+    token_hash CHAR(64) PRIMARY KEY COMMENT 'Hex SHA-256 of the token',
+    user_id VARCHAR(64) NOT NULL,
+    purpose ENUM('verify_email', 'reset_password') NOT NULL,
+    email VARCHAR(255) NOT NULL,
+    expires_at TIMESTAMP NOT NULL,
+    used_at TIMESTAMP NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    INDEX idx_account_tokens_user (user_id, purpose),
+    INDEX idx_account_tokens_expires (expires_at),
+    CONSTRAINT fk_account_tokens_user FOREIGN KEY (user_id) REFERENCES users(user_id) ON DELETE CASCADE
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+
+-- The token each card number is being stored under, keyed by its blind
+-- index, so concurrent tokenizations of one card agree on its token
+CREATE TABLE IF NOT EXISTS card_claims (
+    card_number_index VARBINARY(32) PRIMARY KEY COMMENT 'Blind index of the card number',
+    token VARCHAR(64) NOT NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    INDEX idx_card_claims_token (token)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+
+INSERT IGNORE INTO schema_migrations (version, name) VALUES (1, 'baseline'), (2, 'seal_config'), (3, 'key_rotation_policies'), (4, 'card_holder_index'), (5, 'card_number_index'), (6, 'nullable_card_expiry'), (7, 'integrity_checks'), (8, 'cors_policy'), (9, 'ip_filters'), (10, 'detokenize_quotas'), (11, 'rate_limit_rules'), (12, 'card_search_fields'), (13, 'unescape_full_names'), (14, 'card_source_metadata'), (15, 'token_restore_window'), (16, 'token_tags'), (17, 'batch_files'), (18, 'client_certificates'), (19, 'encrypted_card_fields'), (20, 'field_rules'), (21, 'maintenance_mode'), (22, 'card_regions'), (23, 'stats_counters'), (24, 'query_indexes'), (25, 'token_requests_archive'), (26, 'account_tokens'), (27, 'roles'), (28, 'card_owners'), (29, 'card_claims'), (30, 'api_key_signing'), (31, 'service_accounts'), (32, 'login_challenges'), (33, 'audit_archives'), (34, 'access_reviews'), (35, 'inactivity'), (36, 'network_tokens');
+
 -- Initial KEK (for development only - replace in production)
 INSERT IGNORE INTO encryption_keys (
     key_id, 
@@ -207,6 +627,8 @@ INSERT IGNORE INTO encryption_keys (
 -- tokens.read: Can view tokens
 -- tokens.write: Can create/tokenize
 -- tokens.delete: Can revoke tokens
+-- tokens.detokenize: Can reveal full card numbers
+-- tokens.read_pii: Can see and search cardholder names
 -- api_keys.read: Can view API keys
 -- api_keys.write: Can create API keys
 -- api_keys.delete: Can revoke API keys
@@ -219,7 +641,7 @@ INSERT IGNORE INTO encryption_keys (
 
 -- Role-based default permissions
 -- Admin: ["system.admin"] (implies all permissions)
--- Operator: ["tokens.read", "tokens.write", "tokens.delete", "activity.read", "stats.read"]
+-- Operator: ["tokens.read", "tokens.write", "tokens.delete", "tokens.read_pii", "activity.read", "stats.read"]
 -- Viewer: ["tokens.read", "activity.read", "stats.read"]
 
 -- NOTE: Default admin user will be created by the application at startup if none exists
@@ -23,6 +23,7 @@ import {
   Search as SearchIcon,
   Refresh as RefreshIcon,
   Block as BlockIcon,
+  Restore as RestoreIcon,
 } from '@mui/icons-material';
 import { DataGrid, type GridColDef, type GridRenderCellParams } from '@mui/x-data-grid';
 import { api } from '../../services/api';
@@ -103,6 +104,15 @@ export function TokenList() {
     }
   };
 
+  const handleRestore = async (token: string) => {
+    try {
+      await api.restoreToken(token);
+      loadTokens();
+    } catch (err: any) {
+      setError(err.response?.data?.error || 'Failed to restore token');
+    }
+  };
+
   const columns: GridColDef[] = [
     {
       field: 'token',
@@ -156,6 +166,15 @@ export function TokenList() {
               <BlockIcon />
             </IconButton>
           )}
+          {!params.row.is_active && canRevoke && (
+            <IconButton
+              size="small"
+              onClick={() => handleRestore(params.row.token)}
+              title="Restore"
+            >
+              <RestoreIcon />
+            </IconButton>
+          )}
         </Box>
       ),
     },
@@ -261,7 +280,8 @@ export function TokenList() {
         <DialogTitle>Revoke Token</DialogTitle>
         <DialogContent>
           <DialogContentText>
-            Are you sure you want to revoke this token? This action cannot be undone.
+            Are you sure you want to revoke this token? It can be restored until
+            its card is purged, 30 days later by default.
             <br />
             <br />
             Token: <strong>{tokenToRevoke}</strong>
@@ -26,6 +26,7 @@ export function AuthProvider({ children }: { children: ReactNode }) {
       if (api.isAuthenticated()) {
         const userData = await api.getCurrentUser();
         setUser(userData);
+        setRequirePasswordChange(!!userData.require_password_change);
       }
     } catch (err) {
       setUser(null);
@@ -105,7 +105,11 @@ class TokenShieldAPI {
   }
 
   async revokeToken(token: string): Promise<void> {
-    await this.client.post(`/tokens/${token}/revoke`);
+    await this.client.delete(`/tokens/${token}`);
+  }
+
+  async restoreToken(token: string): Promise<void> {
+    await this.client.post(`/tokens/${token}/restore`);
   }
 
   // Activity
@@ -86,6 +86,10 @@ class TokenShieldDashboard {
             const response = await this.makeRequest('/api/v1/auth/me');
             if (response.ok) {
                 this.currentUser = await response.json();
+                // The server refuses everything else until it is changed
+                if (this.currentUser.require_password_change) {
+                    this.showPasswordChangeModal(true);
+                }
                 this.showDashboard();
                 this.updateUserMenu();
                 this.checkConnection();
@@ -603,7 +607,7 @@ class TokenShieldDashboard {
                             <td>${this.formatTimestamp(token.created_at)}</td>
                             <td>
                                 <div class="table-actions">
-                                    ${token.is_active ? `<button class="btn btn-sm btn-danger" onclick="dashboard.revokeToken('${token.token}')"><i class="fas fa-ban"></i></button>` : ''}
+                                    ${token.is_active ? `<button class="btn btn-sm btn-danger" onclick="dashboard.revokeToken('${token.token}')"><i class="fas fa-ban"></i></button>` : `<button class="btn btn-sm btn-secondary" title="Restore" onclick="dashboard.restoreToken('${token.token}')"><i class="fas fa-undo"></i></button>`}
                                 </div>
                             </td>
                         </tr>
@@ -622,8 +626,8 @@ class TokenShieldDashboard {
         
         try {
             const searchData = { limit: 100 };
-            if (lastFour) searchData.last_four = lastFour;
-            if (cardType) searchData.card_type = cardType;
+            if (lastFour) searchData.lastFour = lastFour;
+            if (cardType) searchData.cardType = cardType;
             
             const data = await this.makeAPIRequest('/api/v1/tokens/search', {
                 method: 'POST',
@@ -650,6 +654,16 @@ class TokenShieldDashboard {
         }
     }
 
+    async restoreToken(token) {
+        try {
+            await this.makeAPIRequest(`/api/v1/tokens/${token}/restore`, { method: 'POST' });
+            this.showToast('Success', 'Token restored successfully', 'success');
+            await this.loadTokens(); // Refresh the table
+        } catch (error) {
+            this.showToast('Error', 'Failed to restore token', 'error');
+        }
+    }
+
     async loadAPIKeys() {
         const container = document.getElementById('apikeys-table');
         container.innerHTML = '<div class="loading">Loading API keys...</div>';
@@ -0,0 +1,70 @@
+#!/usr/bin/env python3
+"""Check that the chart's values.yaml `spec` matches the TokenShield CRD.
+
+Every field of the CRD's spec schema must appear in values.yaml (and vice
+versa), and where the CRD declares a default the values must use the same
+one. Array items are not compared. Exits non-zero on any difference.
+
+Usage: python3 k8s/helm/tokenshield/ci/check-parity.py
+"""
+
+import os
+import sys
+
+import yaml
+
+HERE = os.path.dirname(os.path.abspath(__file__))
+CHART = os.path.dirname(HERE)
+CRD = os.path.join(CHART, "..", "..", "crd", "tokenshield.yaml")
+
+
+def crd_spec_schema():
+    with open(CRD) as f:
+        crd = yaml.safe_load(f)
+    for version in crd["spec"]["versions"]:
+        if version.get("storage"):
+            return version["schema"]["openAPIV3Schema"]["properties"]["spec"]
+    sys.exit("no storage version in %s" % CRD)
+
+
+def compare(schema, values, path, problems):
+    properties = schema.get("properties", {})
+
+    if not isinstance(values, dict):
+        problems.append("%s: values has %r, CRD has an object" % (path, values))
+        return
+
+    for name, prop in properties.items():
+        field = "%s.%s" % (path, name)
+        if name not in values:
+            problems.append("%s: missing from values.yaml" % field)
+            continue
+        value = values[name]
+        if prop.get("type") == "object" and "properties" in prop:
+            compare(prop, value, field, problems)
+        elif "default" in prop and prop["default"] != value:
+            problems.append("%s: values.yaml default %r, CRD default %r" % (field, value, prop["default"]))
+
+    for name in values:
+        if name not in properties:
+            problems.append("%s.%s: not in the CRD spec" % (path, name))
+
+
+def main():
+    with open(os.path.join(CHART, "values.yaml")) as f:
+        values = yaml.safe_load(f)
+
+    problems = []
+    compare(crd_spec_schema(), values.get("spec", {}), "spec", problems)
+
+    for problem in problems:
+        print(problem)
+    if problems:
+        print("\nvalues.yaml and k8s/crd/tokenshield.yaml have drifted (%d differences)" % len(problems))
+        return 1
+    print("values.yaml matches the TokenShield CRD spec")
+    return 0
+
+
+if __name__ == "__main__":
+    sys.exit(main())
@@ -0,0 +1,111 @@
+{{/*
+Helpers mirroring k8s/operator: names, labels and env match what the
+operator creates so the two can be swapped without renaming resources.
+*/}}
+
+{{- define "tokenshield.version" -}}
+{{- default "latest" .Values.spec.version -}}
+{{- end -}}
+
+{{- define "tokenshield.image" -}}
+tokenshield/unified-tokenizer:{{ include "tokenshield.version" . }}
+{{- end -}}
+
+{{- define "tokenshield.external" -}}
+{{- if .Values.spec.database.external.host }}true{{ end -}}
+{{- end -}}
+
+{{- define "tokenshield.labels" -}}
+app: tokenshield
+component: {{ . }}
+{{- end -}}
+
+{{/* DB_* env for the in-cluster or external database (databaseEnv) */}}
+{{- define "tokenshield.databaseEnv" -}}
+{{- $db := .Values.spec.database -}}
+{{- $secret := $db.connectionSecret -}}
+{{- if include "tokenshield.external" . }}{{ $secret = $db.external.credentialsSecret }}{{ end -}}
+{{- if not $secret }}{{ fail "spec.database.connectionSecret (or external.credentialsSecret) is required" }}{{ end -}}
+{{- range $env := list (list "DB_USER" "username") (list "DB_PASSWORD" "password") (list "DB_NAME" "database") }}
+- name: {{ index $env 0 }}
+  valueFrom:
+    secretKeyRef:
+      name: {{ $secret }}
+      key: {{ index $env 1 }}
+{{- end }}
+{{- if include "tokenshield.external" . }}
+- name: DB_HOST
+  value: {{ $db.external.host | quote }}
+- name: DB_PORT
+  value: {{ default 3306 $db.external.port | quote }}
+{{- if $db.external.tls.caSecret.name }}
+- name: DB_TLS_CA
+  value: /etc/tokenshield/db-ca/{{ default "ca.crt" $db.external.tls.caSecret.key }}
+{{- else if eq $db.external.tls.mode "preferred" }}
+- name: DB_TLS
+  value: preferred
+{{- else if eq $db.external.tls.mode "required" }}
+- name: DB_TLS
+  value: skip-verify
+{{- else if eq $db.external.tls.mode "verify" }}
+- name: DB_TLS
+  value: "true"
+{{- end }}
+{{- else }}
+- name: DB_HOST
+  valueFrom:
+    secretKeyRef:
+      name: {{ $secret }}
+      key: host
+- name: DB_PORT
+  valueFrom:
+    secretKeyRef:
+      name: {{ $secret }}
+      key: port
+{{- end }}
+{{- end -}}
+
+{{/* KMS env and envFrom (applyExternalServices) */}}
+{{- define "tokenshield.kmsEnv" -}}
+{{- $kms := .Values.spec.tokenization.encryption.kms -}}
+{{- if $kms.provider }}
+{{- if not .Values.spec.tokenization.encryption.kekDek }}{{ fail "spec.tokenization.encryption.kms requires kekDek to be enabled" }}{{ end }}
+- name: KMS_PROVIDER
+  value: {{ $kms.provider | quote }}
+- name: KMS_KEY_ID
+  value: {{ $kms.keyId | quote }}
+{{- if $kms.region }}
+- name: KMS_REGION
+  value: {{ $kms.region | quote }}
+{{- end }}
+{{- end }}
+{{- end -}}
+
+{{/* Database CA volume for an external database */}}
+{{- define "tokenshield.dbCAVolume" -}}
+{{- if and (include "tokenshield.external" .) .Values.spec.database.external.tls.caSecret.name }}
+- name: db-ca
+  secret:
+    secretName: {{ .Values.spec.database.external.tls.caSecret.name }}
+{{- end }}
+{{- end -}}
+
+{{- define "tokenshield.dbCAMount" -}}
+{{- if and (include "tokenshield.external" .) .Values.spec.database.external.tls.caSecret.name }}
+- name: db-ca
+  mountPath: /etc/tokenshield/db-ca
+  readOnly: true
+{{- end }}
+{{- end -}}
+
+{{/* Scrape endpoint shared by the ServiceMonitor and PodMonitor */}}
+{{- define "tokenshield.metricsEndpoint" -}}
+- port: api
+  path: /metrics
+  interval: {{ default "30s" .Values.spec.monitoring.prometheus.interval }}
+  {{- if .Values.spec.security.tls.certManager }}
+  scheme: https
+  tlsConfig:
+    serverName: tokenshield-tokenizer.{{ .Release.Namespace }}.svc
+  {{- end }}
+{{- end -}}
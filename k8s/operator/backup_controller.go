@@ -0,0 +1,402 @@
+package controller
+
+import (
+    "context"
+    "fmt"
+    "sort"
+    "strings"
+    "time"
+
+    batchv1 "k8s.io/api/batch/v1"
+    corev1 "k8s.io/api/core/v1"
+    "k8s.io/apimachinery/pkg/api/errors"
+    metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+    "k8s.io/apimachinery/pkg/runtime"
+    "k8s.io/apimachinery/pkg/types"
+    ctrl "sigs.k8s.io/controller-runtime"
+    "sigs.k8s.io/controller-runtime/pkg/client"
+    "sigs.k8s.io/controller-runtime/pkg/log"
+
+    tokenizationv1alpha1 "github.com/tokenshield/operator/api/v1alpha1"
+)
+
+// Image with mysqldump, openssl, the AWS CLI and gsutil
+const backupImage = "tokenshield/backup:latest"
+
+// Label linking backup Jobs to their TokenShieldBackup
+const backupLabel = "tokenization.io/backup"
+
+// TokenShieldBackupReconciler runs scheduled, encrypted vault dumps for a
+// TokenShield instance and records the retained backups in status
+type TokenShieldBackupReconciler struct {
+    client.Client
+    Scheme *runtime.Scheme
+}
+
+// +kubebuilder:rbac:groups=tokenization.io,resources=tokenshieldbackups,verbs=get;list;watch;create;update;patch;delete
+// +kubebuilder:rbac:groups=tokenization.io,resources=tokenshieldbackups/status,verbs=get;update;patch
+// +kubebuilder:rbac:groups=batch,resources=cronjobs,verbs=get;list;watch;create;update;patch;delete
+// +kubebuilder:rbac:groups=batch,resources=jobs,verbs=get;list;watch
+// +kubebuilder:rbac:groups=core,resources=pods,verbs=get;list;watch
+
+func (r *TokenShieldBackupReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+    log := log.FromContext(ctx)
+
+    backup := &tokenizationv1alpha1.TokenShieldBackup{}
+    if err := r.Get(ctx, req.NamespacedName, backup); err != nil {
+        return ctrl.Result{}, client.IgnoreNotFound(err)
+    }
+
+    // The dump uses the instance's database credentials
+    ts := &tokenizationv1alpha1.TokenShield{}
+    tsName := types.NamespacedName{Name: backup.Spec.TokenShieldRef.Name, Namespace: backup.Namespace}
+    if err := r.Get(ctx, tsName, ts); err != nil {
+        backup.Status.Phase = "Failed"
+        backup.Status.Message = fmt.Sprintf("TokenShield %q not found", tsName.Name)
+        r.Status().Update(ctx, backup)
+        return ctrl.Result{RequeueAfter: time.Minute}, client.IgnoreNotFound(err)
+    }
+
+    if err := r.reconcileScript(ctx, backup); err != nil {
+        return ctrl.Result{}, err
+    }
+    if err := r.reconcileCronJob(ctx, backup, ts); err != nil {
+        log.Error(err, "Failed to reconcile backup CronJob")
+        backup.Status.Phase = "Failed"
+        backup.Status.Message = err.Error()
+        r.Status().Update(ctx, backup)
+        return ctrl.Result{}, err
+    }
+
+    if err := r.updateBackupStatus(ctx, backup); err != nil {
+        return ctrl.Result{}, err
+    }
+
+    return ctrl.Result{RequeueAfter: time.Minute * 5}, nil
+}
+
+// reconcileScript stores the backup script in a ConfigMap mounted by the Job
+func (r *TokenShieldBackupReconciler) reconcileScript(ctx context.Context, backup *tokenizationv1alpha1.TokenShieldBackup) error {
+    cm := &corev1.ConfigMap{
+        ObjectMeta: metav1.ObjectMeta{
+            Name:      backupResourceName(backup) + "-script",
+            Namespace: backup.Namespace,
+        },
+        Data: map[string]string{
+            "backup.sh": backupScript,
+        },
+    }
+
+    ctrl.SetControllerReference(backup, cm, r.Scheme)
+
+    if err := r.Create(ctx, cm); err != nil && !errors.IsAlreadyExists(err) {
+        return err
+    }
+    return nil
+}
+
+func (r *TokenShieldBackupReconciler) reconcileCronJob(ctx context.Context, backup *tokenizationv1alpha1.TokenShieldBackup, ts *tokenizationv1alpha1.TokenShield) error {
+    dest := backup.Spec.Destination
+
+    dbSecretEnv := func(name, key string) corev1.EnvVar {
+        return corev1.EnvVar{
+            Name: name,
+            ValueFrom: &corev1.EnvVarSource{
+                SecretKeyRef: &corev1.SecretKeySelector{
+                    LocalObjectReference: corev1.LocalObjectReference{
+                        Name: ts.Spec.Database.ConnectionSecret,
+                    },
+                    Key: key,
+                },
+            },
+        }
+    }
+
+    keepLast := backup.Spec.Retention.KeepLast
+    if keepLast < 1 {
+        keepLast = 7
+    }
+
+    env := []corev1.EnvVar{
+        dbSecretEnv("DB_HOST", "host"),
+        dbSecretEnv("DB_PORT", "port"),
+        dbSecretEnv("DB_USER", "username"),
+        dbSecretEnv("DB_PASSWORD", "password"),
+        dbSecretEnv("DB_NAME", "database"),
+        {
+            Name: "BACKUP_KEY",
+            ValueFrom: &corev1.EnvVarSource{
+                SecretKeyRef: &corev1.SecretKeySelector{
+                    LocalObjectReference: corev1.LocalObjectReference{
+                        Name: backup.Spec.Encryption.KeySecretRef.Name,
+                    },
+                    Key: backup.Spec.Encryption.KeySecretRef.Key,
+                },
+            },
+        },
+        {Name: "DESTINATION", Value: dest.Type},
+        {Name: "KEEP_LAST", Value: fmt.Sprintf("%d", keepLast)},
+        {Name: "MAX_AGE_DAYS", Value: fmt.Sprintf("%d", backup.Spec.Retention.MaxAgeDays)},
+    }
+
+    volumes := []corev1.Volume{
+        {
+            Name: "script",
+            VolumeSource: corev1.VolumeSource{
+                ConfigMap: &corev1.ConfigMapVolumeSource{
+                    LocalObjectReference: corev1.LocalObjectReference{
+                        Name: backupResourceName(backup) + "-script",
+                    },
+                },
+            },
+        },
+        {
+            Name:         "work",
+            VolumeSource: corev1.VolumeSource{EmptyDir: &corev1.EmptyDirVolumeSource{}},
+        },
+    }
+    mounts := []corev1.VolumeMount{
+        {Name: "script", MountPath: "/scripts"},
+        {Name: "work", MountPath: "/work"},
+    }
+    var envFrom []corev1.EnvFromSource
+
+    switch dest.Type {
+    case "s3":
+        env = append(env,
+            corev1.EnvVar{Name: "S3_BUCKET", Value: dest.S3.Bucket},
+            corev1.EnvVar{Name: "S3_PREFIX", Value: dest.S3.Prefix},
+            corev1.EnvVar{Name: "AWS_DEFAULT_REGION", Value: dest.S3.Region},
+            corev1.EnvVar{Name: "S3_ENDPOINT", Value: dest.S3.Endpoint},
+        )
+        envFrom = append(envFrom, corev1.EnvFromSource{
+            SecretRef: &corev1.SecretEnvSource{
+                LocalObjectReference: corev1.LocalObjectReference{Name: dest.S3.CredentialsSecret},
+            },
+        })
+    case "gcs":
+        env = append(env,
+            corev1.EnvVar{Name: "GCS_BUCKET", Value: dest.GCS.Bucket},
+            corev1.EnvVar{Name: "GCS_PREFIX", Value: dest.GCS.Prefix},
+            corev1.EnvVar{Name: "GOOGLE_APPLICATION_CREDENTIALS", Value: "/credentials/credentials.json"},
+        )
+        volumes = append(volumes, corev1.Volume{
+            Name: "gcs-credentials",
+            VolumeSource: corev1.VolumeSource{
+                Secret: &corev1.SecretVolumeSource{SecretName: dest.GCS.CredentialsSecret},
+            },
+        })
+        mounts = append(mounts, corev1.VolumeMount{Name: "gcs-credentials", MountPath: "/credentials", ReadOnly: true})
+    case "pvc":
+        env = append(env, corev1.EnvVar{Name: "BACKUP_DIR", Value: "/backup" + dest.PVC.Path})
+        volumes = append(volumes, corev1.Volume{
+            Name: "backup",
+            VolumeSource: corev1.VolumeSource{
+                PersistentVolumeClaim: &corev1.PersistentVolumeClaimVolumeSource{ClaimName: dest.PVC.ClaimName},
+            },
+        })
+        mounts = append(mounts, corev1.VolumeMount{Name: "backup", MountPath: "/backup"})
+    default:
+        return fmt.Errorf("unsupported backup destination: %s", dest.Type)
+    }
+
+    backoffLimit := int32(2)
+    successfulHistory := int32(3)
+    failedHistory := int32(3)
+    labels := map[string]string{
+        "app":       "tokenshield",
+        "component": "backup",
+        backupLabel: backup.Name,
+    }
+
+    cronJob := &batchv1.CronJob{
+        ObjectMeta: metav1.ObjectMeta{
+            Name:      backupResourceName(backup),
+            Namespace: backup.Namespace,
+            Labels:    labels,
+        },
+    }
+
+    _, err := ctrl.CreateOrUpdate(ctx, r.Client, cronJob, func() error {
+        cronJob.Spec = batchv1.CronJobSpec{
+            Schedule:                   backup.Spec.Schedule,
+            Suspend:                    &backup.Spec.Suspend,
+            ConcurrencyPolicy:          batchv1.ForbidConcurrent,
+            SuccessfulJobsHistoryLimit: &successfulHistory,
+            FailedJobsHistoryLimit:     &failedHistory,
+            JobTemplate: batchv1.JobTemplateSpec{
+                ObjectMeta: metav1.ObjectMeta{Labels: labels},
+                Spec: batchv1.JobSpec{
+                    BackoffLimit: &backoffLimit,
+                    Template: corev1.PodTemplateSpec{
+                        ObjectMeta: metav1.ObjectMeta{Labels: labels},
+                        Spec: corev1.PodSpec{
+                            RestartPolicy: corev1.RestartPolicyNever,
+                            Containers: []corev1.Container{
+                                {
+                                    Name:    "backup",
+                                    Image:   backupImage,
+                                    Command: []string{"/bin/sh", "/scripts/backup.sh"},
+                                    Env:     env,
+                                    EnvFrom: envFrom,
+                                    VolumeMounts: mounts,
+                                    // The script writes the backup location here for the operator
+                                    TerminationMessagePath:   "/dev/termination-log",
+                                    TerminationMessagePolicy: corev1.TerminationMessageReadFile,
+                                },
+                            },
+                            Volumes: volumes,
+                        },
+                    },
+                },
+            },
+        }
+        return ctrl.SetControllerReference(backup, cronJob, r.Scheme)
+    })
+    return err
+}
+
+// updateBackupStatus records finished Jobs in status. The backup location
+// comes from the pod termination message written by the script.
+func (r *TokenShieldBackupReconciler) updateBackupStatus(ctx context.Context, backup *tokenizationv1alpha1.TokenShieldBackup) error {
+    jobs := &batchv1.JobList{}
+    if err := r.List(ctx, jobs, client.InNamespace(backup.Namespace), client.MatchingLabels{backupLabel: backup.Name}); err != nil {
+        return err
+    }
+
+    sort.Slice(jobs.Items, func(i, j int) bool {
+        return jobs.Items[j].CreationTimestamp.Before(&jobs.Items[i].CreationTimestamp)
+    })
+
+    known := map[string]bool{}
+    for _, b := range backup.Status.Backups {
+        known[b.Name] = true
+    }
+
+    phase := "Scheduled"
+    backup.Status.Message = ""
+    for i, job := range jobs.Items {
+        if i == 0 {
+            backup.Status.LastBackupTime = &job.CreationTimestamp
+            switch {
+            case job.Status.Active > 0:
+                phase = "Running"
+            case job.Status.Failed > 0 && job.Status.Succeeded == 0:
+                phase = "Failed"
+                backup.Status.Message = fmt.Sprintf("Backup job %s failed", job.Name)
+            }
+        }
+
+        if job.Status.Succeeded == 0 || job.Status.CompletionTime == nil || known[job.Name] {
+            continue
+        }
+
+        location, err := r.backupLocation(ctx, &job)
+        if err != nil || location == "" {
+            continue
+        }
+        backup.Status.Backups = append(backup.Status.Backups, tokenizationv1alpha1.BackupRecord{
+            Name:        job.Name,
+            Location:    location,
+            CompletedAt: *job.Status.CompletionTime,
+        })
+    }
+
+    // Newest first, trimmed to the same retention the script applies
+    sort.Slice(backup.Status.Backups, func(i, j int) bool {
+        return backup.Status.Backups[j].CompletedAt.Before(&backup.Status.Backups[i].CompletedAt)
+    })
+    keepLast := backup.Spec.Retention.KeepLast
+    if keepLast < 1 {
+        keepLast = 7
+    }
+    if len(backup.Status.Backups) > keepLast {
+        backup.Status.Backups = backup.Status.Backups[:keepLast]
+    }
+    if len(backup.Status.Backups) > 0 {
+        backup.Status.LastSuccessfulBackupTime = &backup.Status.Backups[0].CompletedAt
+    }
+
+    if backup.Spec.Suspend {
+        phase = "Suspended"
+    }
+    backup.Status.Phase = phase
+
+    return r.Status().Update(ctx, backup)
+}
+
+func (r *TokenShieldBackupReconciler) backupLocation(ctx context.Context, job *batchv1.Job) (string, error) {
+    pods := &corev1.PodList{}
+    if err := r.List(ctx, pods, client.InNamespace(job.Namespace), client.MatchingLabels{"job-name": job.Name}); err != nil {
+        return "", err
+    }
+
+    for _, pod := range pods.Items {
+        for _, cs := range pod.Status.ContainerStatuses {
+            if t := cs.State.Terminated; t != nil && t.ExitCode == 0 {
+                return strings.TrimSpace(t.Message), nil
+            }
+        }
+    }
+    return "", nil
+}
+
+func backupResourceName(backup *tokenizationv1alpha1.TokenShieldBackup) string {
+    return "tokenshield-backup-" + backup.Name
+}
+
+func (r *TokenShieldBackupReconciler) SetupWithManager(mgr ctrl.Manager) error {
+    return ctrl.NewControllerManagedBy(mgr).
+        For(&tokenizationv1alpha1.TokenShieldBackup{}).
+        Owns(&batchv1.CronJob{}).
+        Owns(&corev1.ConfigMap{}).
+        Complete(r)
+}
+
+// backupScript produces a consistent dump (single transaction), encrypts it
+// with AES-256 before it leaves the pod, uploads it and applies retention.
+const backupScript = `#!/bin/sh
+set -eu
+
+NAME="tokenshield-$(date -u +%Y%m%dT%H%M%SZ).sql.gz.enc"
+FILE="/work/$NAME"
+
+mysqldump --single-transaction --quick --routines \
+  --host="$DB_HOST" --port="${DB_PORT:-3306}" \
+  --user="$DB_USER" --password="$DB_PASSWORD" "$DB_NAME" \
+  | gzip \
+  | openssl enc -aes-256-cbc -pbkdf2 -salt -pass env:BACKUP_KEY -out "$FILE"
+
+# Oldest backups beyond KEEP_LAST, or older than MAX_AGE_DAYS, are removed
+expired() {
+  sort -r | awk -v keep="$KEEP_LAST" -v cutoff="$(date -u -d "-${MAX_AGE_DAYS} days" +%Y%m%dT%H%M%SZ 2>/dev/null || echo 0)" \
+    '{ stamp = $0; sub(/.*tokenshield-/, "", stamp); sub(/\..*/, "", stamp) }
+     NR > keep || (ENVIRON["MAX_AGE_DAYS"] != "0" && stamp < cutoff) { print }'
+}
+
+case "$DESTINATION" in
+  s3)
+    ENDPOINT_ARGS=""
+    [ -n "${S3_ENDPOINT:-}" ] && ENDPOINT_ARGS="--endpoint-url $S3_ENDPOINT"
+    LOCATION="s3://$S3_BUCKET/$S3_PREFIX$NAME"
+    aws $ENDPOINT_ARGS s3 cp "$FILE" "$LOCATION"
+    aws $ENDPOINT_ARGS s3 ls "s3://$S3_BUCKET/$S3_PREFIX" | awk '{print $4}' | grep '^tokenshield-' | expired \
+      | while read -r old; do aws $ENDPOINT_ARGS s3 rm "s3://$S3_BUCKET/$S3_PREFIX$old"; done
+    ;;
+  gcs)
+    gcloud auth activate-service-account --key-file="$GOOGLE_APPLICATION_CREDENTIALS" >/dev/null
+    LOCATION="gs://$GCS_BUCKET/$GCS_PREFIX$NAME"
+    gsutil cp "$FILE" "$LOCATION"
+    gsutil ls "gs://$GCS_BUCKET/$GCS_PREFIX" | grep '/tokenshield-' | expired | while read -r old; do gsutil rm "$old"; done
+    ;;
+  pvc)
+    mkdir -p "$BACKUP_DIR"
+    LOCATION="$BACKUP_DIR/$NAME"
+    cp "$FILE" "$LOCATION"
+    ls "$BACKUP_DIR" | grep '^tokenshield-' | expired | while read -r old; do rm -f "$BACKUP_DIR/$old"; done
+    ;;
+esac
+
+rm -f "$FILE"
+echo "$LOCATION" > /dev/termination-log
+`
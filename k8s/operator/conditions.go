@@ -0,0 +1,69 @@
+package controller
+
+import (
+    "context"
+
+    appsv1 "k8s.io/api/apps/v1"
+    corev1 "k8s.io/api/core/v1"
+    "k8s.io/apimachinery/pkg/api/meta"
+    metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+    "k8s.io/apimachinery/pkg/types"
+
+    tokenizationv1alpha1 "github.com/tokenshield/operator/api/v1alpha1"
+)
+
+// Standard condition types reported in status.conditions
+const (
+    // The tokenizer has available replicas and is serving traffic
+    conditionAvailable = "Available"
+    // The operator is creating or changing components (including upgrades)
+    conditionProgressing = "Progressing"
+    // The last reconcile failed; the message holds the error
+    conditionDegraded = "Degraded"
+)
+
+// +kubebuilder:rbac:groups=core,resources=events,verbs=create;patch
+
+// setCondition records a condition against the current generation
+func setCondition(ts *tokenizationv1alpha1.TokenShield, conditionType string, status metav1.ConditionStatus, reason, message string) {
+    meta.SetStatusCondition(&ts.Status.Conditions, metav1.Condition{
+        Type:               conditionType,
+        Status:             status,
+        Reason:             reason,
+        Message:            message,
+        ObservedGeneration: ts.Generation,
+    })
+}
+
+// reconcileFailed marks the instance degraded and emits a Warning event so
+// the failure shows up in `kubectl describe` and `kubectl get events`
+func (r *TokenShieldReconciler) reconcileFailed(ts *tokenizationv1alpha1.TokenShield, reason string, err error) {
+    setCondition(ts, conditionDegraded, metav1.ConditionTrue, reason, err.Error())
+    setCondition(ts, conditionProgressing, metav1.ConditionFalse, reason, "Reconcile stopped on error")
+    r.Recorder.Event(ts, corev1.EventTypeWarning, reason, err.Error())
+}
+
+// updateAvailability sets Available from the tokenizer deployment, which
+// carries the data path; Ready mirrors it for existing clients
+func (r *TokenShieldReconciler) updateAvailability(ctx context.Context, ts *tokenizationv1alpha1.TokenShield) error {
+    deployment := &appsv1.Deployment{}
+    if err := r.Get(ctx, types.NamespacedName{Name: "tokenshield-tokenizer", Namespace: ts.Namespace}, deployment); err != nil {
+        return err
+    }
+
+    if deployment.Status.AvailableReplicas > 0 {
+        setCondition(ts, conditionAvailable, metav1.ConditionTrue, "TokenizerAvailable", "Tokenizer has available replicas")
+    } else {
+        setCondition(ts, conditionAvailable, metav1.ConditionFalse, "TokenizerUnavailable", "No tokenizer replicas are available")
+    }
+
+    // Still rolling out while not every replica runs the current template
+    if deployment.Status.UpdatedReplicas < deployment.Status.Replicas || deployment.Status.ObservedGeneration < deployment.Generation {
+        setCondition(ts, conditionProgressing, metav1.ConditionTrue, "RollingUpdate", "Tokenizer rollout in progress")
+    } else {
+        setCondition(ts, conditionProgressing, metav1.ConditionFalse, "ReconcileComplete", "All components are up to date")
+    }
+
+    ts.Status.Ready = meta.IsStatusConditionTrue(ts.Status.Conditions, conditionAvailable)
+    return nil
+}
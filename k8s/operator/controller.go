@@ -5,11 +5,16 @@ import (
     "fmt"
     
     appsv1 "k8s.io/api/apps/v1"
+    batchv1 "k8s.io/api/batch/v1"
     corev1 "k8s.io/api/core/v1"
     networkingv1 "k8s.io/api/networking/v1"
+    "k8s.io/apimachinery/pkg/api/meta"
+    metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
     "k8s.io/apimachinery/pkg/runtime"
+    "k8s.io/client-go/tools/record"
     ctrl "sigs.k8s.io/controller-runtime"
     "sigs.k8s.io/controller-runtime/pkg/client"
+    "sigs.k8s.io/controller-runtime/pkg/handler"
     "sigs.k8s.io/controller-runtime/pkg/log"
     
     tokenizationv1alpha1 "github.com/tokenshield/operator/api/v1alpha1"
@@ -18,7 +23,8 @@ import (
 // TokenShieldReconciler reconciles a TokenShield object
 type TokenShieldReconciler struct {
     client.Client
-    Scheme *runtime.Scheme
+    Scheme   *runtime.Scheme
+    Recorder record.EventRecorder
 }
 
 // +kubebuilder:rbac:groups=tokenization.io,resources=tokenshields,verbs=get;list;watch;create;update;patch;delete
@@ -38,15 +44,18 @@ func (r *TokenShieldReconciler) Reconcile(ctx context.Context, req ctrl.Request)
         return ctrl.Result{}, client.IgnoreNotFound(err)
     }
     
-    // Update status to Creating
-    tokenshield.Status.Phase = "Creating"
+    // Report progress while components are created or changed
+    setCondition(tokenshield, conditionProgressing, metav1.ConditionTrue, "Reconciling", "Reconciling components")
     if err := r.Status().Update(ctx, tokenshield); err != nil {
         return ctrl.Result{}, err
     }
     
     // Deploy components in order
     components := []func(context.Context, *tokenizationv1alpha1.TokenShield) error{
+        r.reconcileNetworkPolicies,
         r.reconcileDatabase,
+        r.reconcileCertificate,
+        r.reconcileUpgrade,
         r.reconcileTokenizer,
         r.reconcileInboundProxy,
         r.reconcileOutboundProxy,
@@ -55,19 +64,22 @@ func (r *TokenShieldReconciler) Reconcile(ctx context.Context, req ctrl.Request)
     }
     
     for _, reconcileFunc := range components {
-        if err := reconcileFunc(ctx, tokenshield); err != nil {
+        if err := reconcileFunc(ctx, tokenshield); err == errMigrationPending {
+            // Existing deployments keep serving until the migration Job finishes
+            r.Status().Update(ctx, tokenshield)
+            return ctrl.Result{RequeueAfter: 15 * time.Second}, nil
+        } else if err != nil {
             log.Error(err, "Failed to reconcile component")
-            tokenshield.Status.Phase = "Failed"
-            tokenshield.Status.Message = err.Error()
+            r.reconcileFailed(tokenshield, "ReconcileFailed", err)
             r.Status().Update(ctx, tokenshield)
             return ctrl.Result{}, err
         }
     }
     
-    // Update status to Running
-    tokenshield.Status.Phase = "Running"
-    tokenshield.Status.Ready = true
-    tokenshield.Status.Message = "All components are running"
+    meta.RemoveStatusCondition(&tokenshield.Status.Conditions, conditionDegraded)
+    if err := r.updateAvailability(ctx, tokenshield); err != nil {
+        return ctrl.Result{}, err
+    }
     
     // Set endpoints
     tokenshield.Status.Endpoints = tokenizationv1alpha1.Endpoints{
@@ -90,6 +102,11 @@ func (r *TokenShieldReconciler) Reconcile(ctx context.Context, req ctrl.Request)
 func (r *TokenShieldReconciler) reconcileDatabase(ctx context.Context, ts *tokenizationv1alpha1.TokenShield) error {
     log := log.FromContext(ctx)
     
+    // Managed databases are used as-is
+    if ts.Spec.Database.External.Host != "" {
+        return r.reconcileExternalDatabase(ctx, ts)
+    }
+    
     switch ts.Spec.Database.Type {
     case "mysql":
         return r.deployMySQL(ctx, ts)
@@ -245,6 +262,7 @@ func (r *TokenShieldReconciler) reconcileTokenizer(ctx context.Context, ts *toke
         },
         Spec: appsv1.DeploymentSpec{
             Replicas: &ts.Spec.Tokenizer.Replicas,
+            Strategy: rollingUpdateStrategy(ts),
             Selector: &metav1.LabelSelector{
                 MatchLabels: map[string]string{
                     "app":       "tokenshield",
@@ -262,7 +280,7 @@ func (r *TokenShieldReconciler) reconcileTokenizer(ctx context.Context, ts *toke
                     Containers: []corev1.Container{
                         {
                             Name:  "tokenizer",
-                            Image: "tokenshield/unified-tokenizer:latest",
+                            Image: tokenizerImage(tokenizerVersion(ts)),
                             Env: []corev1.EnvVar{
                                 {
                                     Name:  "TOKEN_FORMAT",
@@ -272,19 +290,6 @@ func (r *TokenShieldReconciler) reconcileTokenizer(ctx context.Context, ts *toke
                                     Name:  "USE_KEK_DEK",
                                     Value: fmt.Sprintf("%t", ts.Spec.Tokenization.Encryption.KekDek),
                                 },
-                                // Database connection from secret
-                                {
-                                    Name: "DB_HOST",
-                                    ValueFrom: &corev1.EnvVarSource{
-                                        SecretKeyRef: &corev1.SecretKeySelector{
-                                            LocalObjectReference: corev1.LocalObjectReference{
-                                                Name: ts.Spec.Database.ConnectionSecret,
-                                            },
-                                            Key: "host",
-                                        },
-                                    },
-                                },
-                                // ... more env vars
                             },
                             Ports: []corev1.ContainerPort{
                                 {
@@ -317,9 +322,26 @@ func (r *TokenShieldReconciler) reconcileTokenizer(ctx context.Context, ts *toke
         },
     }
     
-    ctrl.SetControllerReference(ts, deployment, r.Scheme)
+    // Database connection from the in-cluster or external database secret
+    tokenizer := &deployment.Spec.Template.Spec.Containers[0]
+    tokenizer.Env = append(tokenizer.Env, databaseEnv(ts)...)
+    
+    // External database CA and KMS settings
+    if err := applyExternalServices(ts, &deployment.Spec.Template); err != nil {
+        return err
+    }
+    
+    // Mount the cert-manager certificate when TLS is enabled
+    if err := r.applyTLS(ctx, ts, &deployment.Spec.Template); err != nil {
+        return err
+    }
     
-    if err := r.Create(ctx, deployment); err != nil && !errors.IsAlreadyExists(err) {
+    // Create or update so spec changes (such as a renewed certificate hash) roll out
+    desired := deployment.Spec
+    if _, err := ctrl.CreateOrUpdate(ctx, r.Client, deployment, func() error {
+        deployment.Spec = desired
+        return ctrl.SetControllerReference(ts, deployment, r.Scheme)
+    }); err != nil {
         return err
     }
     
@@ -372,5 +394,8 @@ func (r *TokenShieldReconciler) SetupWithManager(mgr ctrl.Manager) error {
         Owns(&appsv1.StatefulSet{}).
         Owns(&corev1.Service{}).
         Owns(&networkingv1.Ingress{}).
+        Owns(&networkingv1.NetworkPolicy{}).
+        Owns(&batchv1.Job{}).
+        Watches(&corev1.Secret{}, handler.EnqueueRequestsFromMapFunc(r.tlsSecretRequests)).
         Complete(r)
 }
\ No newline at end of file
@@ -0,0 +1,156 @@
+package controller
+
+import (
+    "context"
+    "fmt"
+
+    corev1 "k8s.io/api/core/v1"
+    "k8s.io/apimachinery/pkg/types"
+
+    tokenizationv1alpha1 "github.com/tokenshield/operator/api/v1alpha1"
+)
+
+const dbCAMountPath = "/etc/tokenshield/db-ca"
+
+// DB_TLS values understood by the tokenizer for each spec.database.external.tls.mode
+var dbTLSModes = map[string]string{
+    "disabled":  "",
+    "preferred": "preferred",
+    "required":  "skip-verify", // Encrypted, server certificate not verified
+    "verify":    "true",
+}
+
+// reconcileExternalDatabase checks that the credentials secret for a managed
+// database (RDS, Cloud SQL, ...) exists instead of deploying MySQL in-cluster
+func (r *TokenShieldReconciler) reconcileExternalDatabase(ctx context.Context, ts *tokenizationv1alpha1.TokenShield) error {
+    ext := ts.Spec.Database.External
+    if ext.Host == "" || ext.CredentialsSecret == "" {
+        return fmt.Errorf("spec.database.external requires host and credentialsSecret")
+    }
+    if _, ok := dbTLSModes[ext.TLS.Mode]; !ok && ext.TLS.Mode != "" {
+        return fmt.Errorf("unsupported database TLS mode: %s", ext.TLS.Mode)
+    }
+
+    secret := &corev1.Secret{}
+    if err := r.Get(ctx, types.NamespacedName{Name: ext.CredentialsSecret, Namespace: ts.Namespace}, secret); err != nil {
+        return fmt.Errorf("database credentials secret %q: %w", ext.CredentialsSecret, err)
+    }
+    for _, key := range []string{"username", "password", "database"} {
+        if _, ok := secret.Data[key]; !ok {
+            return fmt.Errorf("database credentials secret %q is missing key %q", ext.CredentialsSecret, key)
+        }
+    }
+
+    ts.Status.Components.Database = "External"
+    return nil
+}
+
+// databaseEnv returns the tokenizer's DB_* variables for either the
+// in-cluster database or spec.database.external
+func databaseEnv(ts *tokenizationv1alpha1.TokenShield) []corev1.EnvVar {
+    secretName := ts.Spec.Database.ConnectionSecret
+    ext := ts.Spec.Database.External
+    if ext.Host != "" {
+        secretName = ext.CredentialsSecret
+    }
+
+    fromSecret := func(name, key string) corev1.EnvVar {
+        return corev1.EnvVar{
+            Name: name,
+            ValueFrom: &corev1.EnvVarSource{
+                SecretKeyRef: &corev1.SecretKeySelector{
+                    LocalObjectReference: corev1.LocalObjectReference{Name: secretName},
+                    Key:                  key,
+                },
+            },
+        }
+    }
+
+    env := []corev1.EnvVar{
+        fromSecret("DB_USER", "username"),
+        fromSecret("DB_PASSWORD", "password"),
+        fromSecret("DB_NAME", "database"),
+    }
+
+    if ext.Host == "" {
+        return append(env, fromSecret("DB_HOST", "host"), fromSecret("DB_PORT", "port"))
+    }
+
+    port := ext.Port
+    if port == 0 {
+        port = 3306
+    }
+    env = append(env,
+        corev1.EnvVar{Name: "DB_HOST", Value: ext.Host},
+        corev1.EnvVar{Name: "DB_PORT", Value: fmt.Sprintf("%d", port)},
+    )
+    if ext.TLS.CASecret.Name != "" {
+        env = append(env, corev1.EnvVar{Name: "DB_TLS_CA", Value: dbCAMountPath + "/" + caKey(ext.TLS.CASecret.Key)})
+    } else if mode := dbTLSModes[ext.TLS.Mode]; mode != "" {
+        env = append(env, corev1.EnvVar{Name: "DB_TLS", Value: mode})
+    }
+    return env
+}
+
+// applyExternalServices mounts the database CA bundle and passes the KMS
+// settings used to wrap the KEK to the tokenizer container
+func applyExternalServices(ts *tokenizationv1alpha1.TokenShield, template *corev1.PodTemplateSpec) error {
+    ext := ts.Spec.Database.External
+    kms := ts.Spec.Tokenization.Encryption.KMS
+
+    if kms.Provider != "" && !ts.Spec.Tokenization.Encryption.KekDek {
+        return fmt.Errorf("spec.tokenization.encryption.kms requires kekDek to be enabled")
+    }
+
+    if ext.Host != "" && ext.TLS.CASecret.Name != "" {
+        template.Spec.Volumes = append(template.Spec.Volumes, corev1.Volume{
+            Name: "db-ca",
+            VolumeSource: corev1.VolumeSource{
+                Secret: &corev1.SecretVolumeSource{SecretName: ext.TLS.CASecret.Name},
+            },
+        })
+    }
+
+    for i := range template.Spec.Containers {
+        container := &template.Spec.Containers[i]
+        if container.Name != "tokenizer" {
+            continue
+        }
+
+        if ext.Host != "" && ext.TLS.CASecret.Name != "" {
+            container.VolumeMounts = append(container.VolumeMounts, corev1.VolumeMount{
+                Name:      "db-ca",
+                MountPath: dbCAMountPath,
+                ReadOnly:  true,
+            })
+        }
+
+        if kms.Provider == "" {
+            continue
+        }
+        container.Env = append(container.Env,
+            corev1.EnvVar{Name: "KMS_PROVIDER", Value: kms.Provider},
+            corev1.EnvVar{Name: "KMS_KEY_ID", Value: kms.KeyID},
+        )
+        if kms.Region != "" {
+            container.Env = append(container.Env, corev1.EnvVar{Name: "KMS_REGION", Value: kms.Region})
+        }
+        // Provider credentials (AWS_ACCESS_KEY_ID, VAULT_TOKEN, ...) come straight
+        // from the secret; omit it to use workload identity instead
+        if kms.CredentialsSecret != "" {
+            container.EnvFrom = append(container.EnvFrom, corev1.EnvFromSource{
+                SecretRef: &corev1.SecretEnvSource{
+                    LocalObjectReference: corev1.LocalObjectReference{Name: kms.CredentialsSecret},
+                },
+            })
+        }
+    }
+    return nil
+}
+
+func caKey(key string) string {
+    if key == "" {
+        return "ca.crt"
+    }
+    return key
+}
@@ -0,0 +1,94 @@
+package controller
+
+import (
+    "context"
+
+    "k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+    "k8s.io/apimachinery/pkg/runtime/schema"
+    "k8s.io/apimachinery/pkg/types"
+    ctrl "sigs.k8s.io/controller-runtime"
+    "sigs.k8s.io/controller-runtime/pkg/client"
+
+    tokenizationv1alpha1 "github.com/tokenshield/operator/api/v1alpha1"
+)
+
+// Prometheus Operator kinds, handled as unstructured like the cert-manager
+// Certificate so the operator does not depend on their Go types
+var (
+    serviceMonitorGVK = schema.GroupVersionKind{Group: "monitoring.coreos.com", Version: "v1", Kind: "ServiceMonitor"}
+    podMonitorGVK     = schema.GroupVersionKind{Group: "monitoring.coreos.com", Version: "v1", Kind: "PodMonitor"}
+)
+
+const monitorName = "tokenshield-tokenizer"
+
+// +kubebuilder:rbac:groups=monitoring.coreos.com,resources=servicemonitors;podmonitors,verbs=get;list;watch;create;update;patch;delete
+
+// reconcileMonitoring creates a ServiceMonitor and/or PodMonitor scraping the
+// tokenizer's /metrics on the API port, and removes them when disabled
+func (r *TokenShieldReconciler) reconcileMonitoring(ctx context.Context, ts *tokenizationv1alpha1.TokenShield) error {
+    prom := ts.Spec.Monitoring.Prometheus
+
+    interval := prom.Interval
+    if interval == "" {
+        interval = "30s"
+    }
+    selector := map[string]interface{}{
+        "matchLabels": map[string]interface{}{
+            "app":       "tokenshield",
+            "component": "tokenizer",
+        },
+    }
+    endpoint := map[string]interface{}{
+        "port":     "api",
+        "path":     "/metrics",
+        "interval": interval,
+    }
+    if ts.Spec.Security.TLS.CertManager {
+        endpoint["scheme"] = "https"
+        endpoint["tlsConfig"] = map[string]interface{}{"serverName": "tokenshield-tokenizer." + ts.Namespace + ".svc"}
+    }
+
+    monitors := []struct {
+        gvk         schema.GroupVersionKind
+        enabled     bool
+        endpointKey string
+    }{
+        {serviceMonitorGVK, prom.Enabled && prom.ServiceMonitor, "endpoints"},
+        {podMonitorGVK, prom.Enabled && prom.PodMonitor, "podMetricsEndpoints"},
+    }
+
+    for _, m := range monitors {
+        monitor := &unstructured.Unstructured{}
+        monitor.SetGroupVersionKind(m.gvk)
+        monitor.SetName(monitorName)
+        monitor.SetNamespace(ts.Namespace)
+
+        if !m.enabled {
+            if err := r.Get(ctx, types.NamespacedName{Name: monitorName, Namespace: ts.Namespace}, monitor); err != nil {
+                // Not found, or the Prometheus Operator CRDs are not installed
+                continue
+            }
+            if err := r.Delete(ctx, monitor); client.IgnoreNotFound(err) != nil {
+                return err
+            }
+            continue
+        }
+
+        if _, err := ctrl.CreateOrUpdate(ctx, r.Client, monitor, func() error {
+            // Prometheus instances usually select monitors by label (e.g. release=kube-prometheus)
+            labels := map[string]string{"app": "tokenshield"}
+            for k, v := range prom.Labels {
+                labels[k] = v
+            }
+            monitor.SetLabels(labels)
+            monitor.Object["spec"] = map[string]interface{}{
+                "selector":    selector,
+                m.endpointKey: []interface{}{endpoint},
+            }
+            return ctrl.SetControllerReference(ts, monitor, r.Scheme)
+        }); err != nil {
+            return err
+        }
+    }
+    return nil
+}
@@ -0,0 +1,210 @@
+package controller
+
+import (
+    "context"
+    "fmt"
+
+    corev1 "k8s.io/api/core/v1"
+    networkingv1 "k8s.io/api/networking/v1"
+    metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+    "k8s.io/apimachinery/pkg/util/intstr"
+    ctrl "sigs.k8s.io/controller-runtime"
+
+    tokenizationv1alpha1 "github.com/tokenshield/operator/api/v1alpha1"
+)
+
+// Tokenizer ports by the names used in spec.security.allowedClients[].ports
+var tokenizerPorts = map[string]int{
+    "proxy": 8080,
+    "icap":  1344,
+    "api":   8090,
+}
+
+// +kubebuilder:rbac:groups=networking.k8s.io,resources=networkpolicies,verbs=get;list;watch;create;update;patch;delete
+
+// reconcileNetworkPolicies isolates the cardholder-data components. Besides
+// TokenShield's own proxies and dashboard, only spec.security.allowedClients
+// may reach the tokenizer ports, and the tokenizer may only contact DNS, the
+// in-cluster database and spec.security.allowedEgress. The proxies are left
+// open since they front application traffic.
+func (r *TokenShieldReconciler) reconcileNetworkPolicies(ctx context.Context, ts *tokenizationv1alpha1.TokenShield) error {
+    if !ts.Spec.Security.NetworkPolicies {
+        return nil
+    }
+
+    tokenizerIngress, err := tokenizerIngressRules(ts)
+    if err != nil {
+        return err
+    }
+    tokenizerEgress, err := tokenizerEgressRules(ts)
+    if err != nil {
+        return err
+    }
+
+    policies := []*networkingv1.NetworkPolicy{
+        {
+            ObjectMeta: metav1.ObjectMeta{Name: "tokenshield-tokenizer", Namespace: ts.Namespace},
+            Spec: networkingv1.NetworkPolicySpec{
+                PodSelector: componentSelector("tokenizer"),
+                PolicyTypes: []networkingv1.PolicyType{networkingv1.PolicyTypeIngress, networkingv1.PolicyTypeEgress},
+                Ingress:     tokenizerIngress,
+                Egress:      tokenizerEgress,
+            },
+        },
+    }
+
+    // The in-cluster database only accepts the tokenizer, backup and migration jobs
+    if ts.Spec.Database.External.Host == "" {
+        policies = append(policies, &networkingv1.NetworkPolicy{
+            ObjectMeta: metav1.ObjectMeta{Name: "tokenshield-database", Namespace: ts.Namespace},
+            Spec: networkingv1.NetworkPolicySpec{
+                PodSelector: componentSelector("database"),
+                PolicyTypes: []networkingv1.PolicyType{networkingv1.PolicyTypeIngress},
+                Ingress: []networkingv1.NetworkPolicyIngressRule{
+                    {
+                        From: []networkingv1.NetworkPolicyPeer{
+                            componentPeer("tokenizer"),
+                            componentPeer("backup"),
+                            componentPeer("migrate"),
+                        },
+                        Ports: tcpPorts(3306),
+                    },
+                },
+            },
+        })
+    }
+
+    for _, policy := range policies {
+        desired := policy.Spec
+        if _, err := ctrl.CreateOrUpdate(ctx, r.Client, policy, func() error {
+            policy.Spec = desired
+            return ctrl.SetControllerReference(ts, policy, r.Scheme)
+        }); err != nil {
+            return err
+        }
+    }
+    return nil
+}
+
+func tokenizerIngressRules(ts *tokenizationv1alpha1.TokenShield) ([]networkingv1.NetworkPolicyIngressRule, error) {
+    rules := []networkingv1.NetworkPolicyIngressRule{
+        // TokenShield's own proxies (labelled by proxy type) and dashboard
+        {From: []networkingv1.NetworkPolicyPeer{componentPeer(proxyComponent(ts.Spec.Proxies.Inbound.Type, "haproxy"))}, Ports: tcpPorts(tokenizerPorts["proxy"])},
+        {From: []networkingv1.NetworkPolicyPeer{componentPeer(proxyComponent(ts.Spec.Proxies.Outbound.Type, "squid"))}, Ports: tcpPorts(tokenizerPorts["icap"])},
+        {From: []networkingv1.NetworkPolicyPeer{componentPeer("dashboard")}, Ports: tcpPorts(tokenizerPorts["api"])},
+    }
+
+    for _, c := range ts.Spec.Security.AllowedClients {
+        if len(c.NamespaceSelector) == 0 && len(c.PodSelector) == 0 {
+            return nil, fmt.Errorf("allowedClients %q needs a namespaceSelector or podSelector", c.Name)
+        }
+
+        peer := networkingv1.NetworkPolicyPeer{}
+        if len(c.NamespaceSelector) > 0 {
+            peer.NamespaceSelector = &metav1.LabelSelector{MatchLabels: c.NamespaceSelector}
+        }
+        if len(c.PodSelector) > 0 {
+            peer.PodSelector = &metav1.LabelSelector{MatchLabels: c.PodSelector}
+        }
+
+        names := c.Ports
+        if len(names) == 0 {
+            names = []string{"proxy"}
+        }
+        var ports []int
+        for _, name := range names {
+            port, ok := tokenizerPorts[name]
+            if !ok {
+                return nil, fmt.Errorf("allowedClients %q: unknown port %q (use proxy, icap or api)", c.Name, name)
+            }
+            ports = append(ports, port)
+        }
+
+        rules = append(rules, networkingv1.NetworkPolicyIngressRule{
+            From:  []networkingv1.NetworkPolicyPeer{peer},
+            Ports: tcpPorts(ports...),
+        })
+    }
+    return rules, nil
+}
+
+func tokenizerEgressRules(ts *tokenizationv1alpha1.TokenShield) ([]networkingv1.NetworkPolicyEgressRule, error) {
+    udp := corev1.ProtocolUDP
+    dnsPort := intstr.FromInt(53)
+
+    rules := []networkingv1.NetworkPolicyEgressRule{
+        // DNS
+        {
+            To: []networkingv1.NetworkPolicyPeer{
+                {
+                    NamespaceSelector: &metav1.LabelSelector{},
+                    PodSelector:       &metav1.LabelSelector{MatchLabels: map[string]string{"k8s-app": "kube-dns"}},
+                },
+            },
+            Ports: append(tcpPorts(53), networkingv1.NetworkPolicyPort{Protocol: &udp, Port: &dnsPort}),
+        },
+    }
+
+    // In-cluster database; an external database must be listed in allowedEgress
+    if ts.Spec.Database.External.Host == "" {
+        rules = append(rules, networkingv1.NetworkPolicyEgressRule{
+            To:    []networkingv1.NetworkPolicyPeer{componentPeer("database")},
+            Ports: tcpPorts(3306),
+        })
+    }
+
+    for _, e := range ts.Spec.Security.AllowedEgress {
+        peer := networkingv1.NetworkPolicyPeer{}
+        switch {
+        case e.CIDR != "":
+            peer.IPBlock = &networkingv1.IPBlock{CIDR: e.CIDR, Except: e.Except}
+        case len(e.NamespaceSelector) > 0 || len(e.PodSelector) > 0:
+            if len(e.NamespaceSelector) > 0 {
+                peer.NamespaceSelector = &metav1.LabelSelector{MatchLabels: e.NamespaceSelector}
+            }
+            if len(e.PodSelector) > 0 {
+                peer.PodSelector = &metav1.LabelSelector{MatchLabels: e.PodSelector}
+            }
+        default:
+            return nil, fmt.Errorf("allowedEgress %q needs a cidr, namespaceSelector or podSelector", e.Name)
+        }
+
+        rule := networkingv1.NetworkPolicyEgressRule{To: []networkingv1.NetworkPolicyPeer{peer}}
+        for _, p := range e.Ports {
+            protocol := corev1.Protocol(p.Protocol)
+            if protocol == "" {
+                protocol = corev1.ProtocolTCP
+            }
+            port := intstr.FromInt(p.Port)
+            rule.Ports = append(rule.Ports, networkingv1.NetworkPolicyPort{Protocol: &protocol, Port: &port})
+        }
+        rules = append(rules, rule)
+    }
+    return rules, nil
+}
+
+func proxyComponent(proxyType, fallback string) string {
+    if proxyType == "" {
+        return fallback
+    }
+    return proxyType
+}
+
+func componentSelector(component string) metav1.LabelSelector {
+    return metav1.LabelSelector{MatchLabels: map[string]string{"app": "tokenshield", "component": component}}
+}
+
+func componentPeer(component string) networkingv1.NetworkPolicyPeer {
+    selector := componentSelector(component)
+    return networkingv1.NetworkPolicyPeer{PodSelector: &selector}
+}
+
+func tcpPorts(ports ...int) []networkingv1.NetworkPolicyPort {
+    tcp := corev1.ProtocolTCP
+    var result []networkingv1.NetworkPolicyPort
+    for _, p := range ports {
+        port := intstr.FromInt(p)
+        result = append(result, networkingv1.NetworkPolicyPort{Protocol: &tcp, Port: &port})
+    }
+    return result
+}
@@ -0,0 +1,169 @@
+package controller
+
+import (
+    "context"
+    "crypto/sha256"
+    "encoding/hex"
+    "fmt"
+
+    corev1 "k8s.io/api/core/v1"
+    "k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+    "k8s.io/apimachinery/pkg/runtime/schema"
+    "k8s.io/apimachinery/pkg/types"
+    ctrl "sigs.k8s.io/controller-runtime"
+    "sigs.k8s.io/controller-runtime/pkg/client"
+    "sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+    tokenizationv1alpha1 "github.com/tokenshield/operator/api/v1alpha1"
+)
+
+// cert-manager Certificate, handled as unstructured so the operator does not
+// depend on cert-manager's Go types
+var certificateGVK = schema.GroupVersionKind{
+    Group:   "cert-manager.io",
+    Version: "v1",
+    Kind:    "Certificate",
+}
+
+const (
+    tlsSecretName = "tokenshield-tokenizer-tls"
+    tlsMountPath  = "/etc/tokenshield/tls"
+
+    // Pod template annotation holding a hash of the served certificate.
+    // In restart mode it changes on renewal, which rolls the deployment.
+    tlsHashAnnotation = "tokenization.io/tls-cert-hash"
+)
+
+// +kubebuilder:rbac:groups=cert-manager.io,resources=certificates,verbs=get;list;watch;create;update;patch;delete
+
+// reconcileCertificate requests a certificate covering the tokenizer's
+// proxy, ICAP and API ports (they share one Service) from the configured issuer
+func (r *TokenShieldReconciler) reconcileCertificate(ctx context.Context, ts *tokenizationv1alpha1.TokenShield) error {
+    tlsSpec := ts.Spec.Security.TLS
+    if !tlsSpec.CertManager {
+        return nil
+    }
+    if tlsSpec.IssuerRef.Name == "" {
+        return fmt.Errorf("spec.security.tls.issuerRef.name is required when certManager is enabled")
+    }
+
+    issuerKind := tlsSpec.IssuerRef.Kind
+    if issuerKind == "" {
+        issuerKind = "Issuer"
+    }
+
+    service := "tokenshield-tokenizer"
+    dnsNames := []interface{}{
+        service,
+        fmt.Sprintf("%s.%s", service, ts.Namespace),
+        fmt.Sprintf("%s.%s.svc", service, ts.Namespace),
+        fmt.Sprintf("%s.%s.svc.cluster.local", service, ts.Namespace),
+    }
+    for _, name := range tlsSpec.DNSNames {
+        dnsNames = append(dnsNames, name)
+    }
+
+    cert := &unstructured.Unstructured{}
+    cert.SetGroupVersionKind(certificateGVK)
+    cert.SetName(tlsSecretName)
+    cert.SetNamespace(ts.Namespace)
+
+    _, err := ctrl.CreateOrUpdate(ctx, r.Client, cert, func() error {
+        spec := map[string]interface{}{
+            "secretName": tlsSecretName,
+            "dnsNames":   dnsNames,
+            "issuerRef": map[string]interface{}{
+                "name":  tlsSpec.IssuerRef.Name,
+                "kind":  issuerKind,
+                "group": "cert-manager.io",
+            },
+            "privateKey": map[string]interface{}{
+                "algorithm":      "ECDSA",
+                "size":           int64(256),
+                "rotationPolicy": "Always",
+            },
+            "usages": []interface{}{"server auth", "digital signature", "key encipherment"},
+        }
+        if tlsSpec.Duration != "" {
+            spec["duration"] = tlsSpec.Duration
+        }
+        if tlsSpec.RenewBefore != "" {
+            spec["renewBefore"] = tlsSpec.RenewBefore
+        }
+        cert.Object["spec"] = spec
+        return ctrl.SetControllerReference(ts, cert, r.Scheme)
+    })
+    return err
+}
+
+// applyTLS mounts the certificate secret into the tokenizer pod and points
+// the tokenizer at it. The tokenizer reloads renewed files on its own; with
+// reload mode "restart" the pod template also carries a hash of the
+// certificate so a renewal triggers a rolling restart.
+func (r *TokenShieldReconciler) applyTLS(ctx context.Context, ts *tokenizationv1alpha1.TokenShield, template *corev1.PodTemplateSpec) error {
+    tlsSpec := ts.Spec.Security.TLS
+    if !tlsSpec.CertManager {
+        return nil
+    }
+
+    template.Spec.Volumes = append(template.Spec.Volumes, corev1.Volume{
+        Name: "tls",
+        VolumeSource: corev1.VolumeSource{
+            Secret: &corev1.SecretVolumeSource{SecretName: tlsSecretName},
+        },
+    })
+
+    for i := range template.Spec.Containers {
+        container := &template.Spec.Containers[i]
+        if container.Name != "tokenizer" {
+            continue
+        }
+        container.VolumeMounts = append(container.VolumeMounts, corev1.VolumeMount{
+            Name:      "tls",
+            MountPath: tlsMountPath,
+            ReadOnly:  true,
+        })
+        container.Env = append(container.Env,
+            corev1.EnvVar{Name: "TLS_CERT_FILE", Value: tlsMountPath + "/tls.crt"},
+            corev1.EnvVar{Name: "TLS_KEY_FILE", Value: tlsMountPath + "/tls.key"},
+        )
+    }
+
+    if tlsSpec.Reload != "restart" {
+        return nil
+    }
+
+    // The secret does not exist until cert-manager has issued the certificate;
+    // the Secret watch requeues us once it does
+    secret := &corev1.Secret{}
+    if err := r.Get(ctx, types.NamespacedName{Name: tlsSecretName, Namespace: ts.Namespace}, secret); err != nil {
+        return client.IgnoreNotFound(err)
+    }
+    sum := sha256.Sum256(secret.Data["tls.crt"])
+    if template.Annotations == nil {
+        template.Annotations = map[string]string{}
+    }
+    template.Annotations[tlsHashAnnotation] = hex.EncodeToString(sum[:8])
+    return nil
+}
+
+// tlsSecretRequests maps a renewed certificate secret to the TokenShield
+// instances in its namespace
+func (r *TokenShieldReconciler) tlsSecretRequests(ctx context.Context, obj client.Object) []reconcile.Request {
+    if obj.GetName() != tlsSecretName {
+        return nil
+    }
+
+    list := &tokenizationv1alpha1.TokenShieldList{}
+    if err := r.List(ctx, list, client.InNamespace(obj.GetNamespace())); err != nil {
+        return nil
+    }
+
+    var requests []reconcile.Request
+    for _, ts := range list.Items {
+        requests = append(requests, reconcile.Request{
+            NamespacedName: types.NamespacedName{Name: ts.Name, Namespace: ts.Namespace},
+        })
+    }
+    return requests
+}
@@ -0,0 +1,177 @@
+package controller
+
+import (
+    "context"
+    "errors"
+    "fmt"
+    "strings"
+
+    appsv1 "k8s.io/api/apps/v1"
+    batchv1 "k8s.io/api/batch/v1"
+    corev1 "k8s.io/api/core/v1"
+    apierrors "k8s.io/apimachinery/pkg/api/errors"
+    metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+    "k8s.io/apimachinery/pkg/types"
+    "k8s.io/apimachinery/pkg/util/intstr"
+    ctrl "sigs.k8s.io/controller-runtime"
+
+    tokenizationv1alpha1 "github.com/tokenshield/operator/api/v1alpha1"
+)
+
+const (
+    tokenizerImageRepo = "tokenshield/unified-tokenizer"
+
+    // Condition recording the last upgrade (or its failed migration)
+    conditionUpgraded = "Upgraded"
+)
+
+// errMigrationPending stops the component rollout while the migration Job
+// for a new version runs; the Job watch requeues us when it finishes
+var errMigrationPending = errors.New("schema migration in progress")
+
+// +kubebuilder:rbac:groups=batch,resources=jobs,verbs=get;list;watch;create;update;patch;delete
+
+// reconcileUpgrade runs `unified-tokenizer migrate` with the image of
+// spec.version whenever it differs from the version last rolled out. The
+// deployments keep running the old version until the migration succeeds, so
+// a failed migration never reaches the data path.
+func (r *TokenShieldReconciler) reconcileUpgrade(ctx context.Context, ts *tokenizationv1alpha1.TokenShield) error {
+    target := tokenizerVersion(ts)
+    if ts.Status.Version == target {
+        return nil
+    }
+
+    job := &batchv1.Job{}
+    name := migrationJobName(target)
+    err := r.Get(ctx, types.NamespacedName{Name: name, Namespace: ts.Namespace}, job)
+    if apierrors.IsNotFound(err) {
+        job, err = r.migrationJob(ts, target)
+        if err != nil {
+            return err
+        }
+        if err := r.Create(ctx, job); err != nil {
+            return err
+        }
+        r.Recorder.Eventf(ts, corev1.EventTypeNormal, "MigrationStarted", "Running schema migration job %s for version %s", name, target)
+        setCondition(ts, conditionProgressing, metav1.ConditionTrue, "Upgrading", fmt.Sprintf("Migrating schema for version %s", target))
+        return errMigrationPending
+    }
+    if err != nil {
+        return err
+    }
+
+    from := ts.Status.Version
+    if from == "" {
+        from = "none"
+    }
+
+    switch {
+    case jobFinished(job, batchv1.JobComplete):
+        ts.Status.Version = target
+        r.Recorder.Eventf(ts, corev1.EventTypeNormal, "Upgraded", "Schema migrated, rolling out %s", target)
+        setCondition(ts, conditionUpgraded, metav1.ConditionTrue, "MigrationSucceeded", fmt.Sprintf("Upgraded from %s to %s", from, target))
+        return nil
+    case jobFinished(job, batchv1.JobFailed):
+        setCondition(ts, conditionUpgraded, metav1.ConditionFalse, "MigrationFailed",
+            fmt.Sprintf("Migration job %s failed; still running %s. Delete the job to retry.", name, from))
+        return fmt.Errorf("schema migration for version %s failed", target)
+    default:
+        setCondition(ts, conditionProgressing, metav1.ConditionTrue, "Upgrading", fmt.Sprintf("Migrating schema for version %s", target))
+        return errMigrationPending
+    }
+}
+
+// migrationJob runs the target image in migrate mode against the same
+// database (and CA bundle) as the tokenizer
+func (r *TokenShieldReconciler) migrationJob(ts *tokenizationv1alpha1.TokenShield, version string) (*batchv1.Job, error) {
+    // Retries cover the database not being ready yet on a fresh install
+    backoffLimit := int32(6)
+    ttl := int32(7 * 24 * 3600)
+    labels := map[string]string{
+        "app":       "tokenshield",
+        "component": "migrate",
+    }
+
+    job := &batchv1.Job{
+        ObjectMeta: metav1.ObjectMeta{
+            Name:      migrationJobName(version),
+            Namespace: ts.Namespace,
+            Labels:    labels,
+        },
+        Spec: batchv1.JobSpec{
+            BackoffLimit:            &backoffLimit,
+            TTLSecondsAfterFinished: &ttl,
+            Template: corev1.PodTemplateSpec{
+                ObjectMeta: metav1.ObjectMeta{Labels: labels},
+                Spec: corev1.PodSpec{
+                    RestartPolicy: corev1.RestartPolicyNever,
+                    Containers: []corev1.Container{
+                        {
+                            // Named like the deployment container so
+                            // applyExternalServices mounts the DB CA
+                            Name:    "tokenizer",
+                            Image:   tokenizerImage(version),
+                            Command: []string{"./unified-tokenizer", "migrate"},
+                            Env:     databaseEnv(ts),
+                        },
+                    },
+                },
+            },
+        },
+    }
+
+    if err := applyExternalServices(ts, &job.Spec.Template); err != nil {
+        return nil, err
+    }
+    if err := ctrl.SetControllerReference(ts, job, r.Scheme); err != nil {
+        return nil, err
+    }
+    return job, nil
+}
+
+// rollingUpdateStrategy surges new pods before old ones are removed so an
+// upgrade never drops tokenization capacity (defaults: maxSurge 1,
+// maxUnavailable 0)
+func rollingUpdateStrategy(ts *tokenizationv1alpha1.TokenShield) appsv1.DeploymentStrategy {
+    maxSurge := intstr.FromInt(1)
+    maxUnavailable := intstr.FromInt(0)
+    if s := ts.Spec.UpgradeStrategy.MaxSurge; s != "" {
+        maxSurge = intstr.Parse(s)
+    }
+    if u := ts.Spec.UpgradeStrategy.MaxUnavailable; u != "" {
+        maxUnavailable = intstr.Parse(u)
+    }
+    return appsv1.DeploymentStrategy{
+        Type: appsv1.RollingUpdateDeploymentStrategyType,
+        RollingUpdate: &appsv1.RollingUpdateDeployment{
+            MaxSurge:       &maxSurge,
+            MaxUnavailable: &maxUnavailable,
+        },
+    }
+}
+
+func tokenizerVersion(ts *tokenizationv1alpha1.TokenShield) string {
+    if ts.Spec.Version == "" {
+        return "latest"
+    }
+    return ts.Spec.Version
+}
+
+func tokenizerImage(version string) string {
+    return tokenizerImageRepo + ":" + version
+}
+
+// migrationJobName is stable per version so reconciles find the same Job
+func migrationJobName(version string) string {
+    name := strings.ToLower(strings.NewReplacer(".", "-", "+", "-", "_", "-").Replace(version))
+    return "tokenshield-migrate-" + name
+}
+
+func jobFinished(job *batchv1.Job, conditionType batchv1.JobConditionType) bool {
+    for _, c := range job.Status.Conditions {
+        if c.Type == conditionType && c.Status == corev1.ConditionTrue {
+            return true
+        }
+    }
+    return false
+}
@@ -0,0 +1,211 @@
+package controller
+
+import (
+    "context"
+    "encoding/json"
+    "fmt"
+    "net/http"
+    "strings"
+
+    corev1 "k8s.io/api/core/v1"
+    "k8s.io/apimachinery/pkg/api/resource"
+    "k8s.io/apimachinery/pkg/types"
+    ctrl "sigs.k8s.io/controller-runtime"
+    "sigs.k8s.io/controller-runtime/pkg/client"
+    "sigs.k8s.io/controller-runtime/pkg/webhook"
+    "sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+
+    tokenizationv1alpha1 "github.com/tokenshield/operator/api/v1alpha1"
+)
+
+// Pod annotations understood by the sidecar injector
+const (
+    // "true" requests an egress sidecar
+    injectAnnotation = "tokenization.io/inject-egress"
+    // Optional "namespace/name" of the TokenShield instance; defaults to the
+    // single instance in the pod's namespace
+    instanceAnnotation = "tokenization.io/instance"
+    // Optional comma-separated hosts overriding spec.sidecarInjection.egressHosts
+    egressHostsAnnotation = "tokenization.io/egress-hosts"
+    // Set by the injector so a pod is never injected twice
+    injectedAnnotation = "tokenization.io/egress-injected"
+
+    egressContainerName = "tokenshield-egress"
+    egressListenAddr    = "127.0.0.1:15001"
+    egressCAMountPath   = "/etc/tokenshield/egress-ca"
+
+    webhookPath = "/mutate-v1-pod"
+)
+
+// Cluster-internal destinations never sent through the sidecar
+const defaultNoProxy = "localhost,127.0.0.1,.svc,.cluster.local"
+
+// +kubebuilder:webhook:path=/mutate-v1-pod,mutating=true,failurePolicy=ignore,sideEffects=None,groups="",resources=pods,verbs=create,versions=v1,name=egress.tokenization.io,admissionReviewVersions=v1
+
+// SidecarInjector adds the TokenShield egress sidecar to annotated pods. The
+// sidecar is the tokenizer image in "egress" mode: a localhost forward proxy
+// that detokenizes outbound payment requests through the instance's ICAP
+// service, so applications need neither Squid nor cluster-wide proxy settings.
+type SidecarInjector struct {
+    Client  client.Client
+    decoder admission.Decoder
+}
+
+// SetupWithManager registers the injector on the manager's webhook server
+func (i *SidecarInjector) SetupWithManager(mgr ctrl.Manager) error {
+    i.decoder = admission.NewDecoder(mgr.GetScheme())
+    mgr.GetWebhookServer().Register(webhookPath, &webhook.Admission{Handler: i})
+    return nil
+}
+
+func (i *SidecarInjector) Handle(ctx context.Context, req admission.Request) admission.Response {
+    pod := &corev1.Pod{}
+    if err := i.decoder.Decode(req, pod); err != nil {
+        return admission.Errored(http.StatusBadRequest, err)
+    }
+
+    if pod.Annotations[injectAnnotation] != "true" || pod.Annotations[injectedAnnotation] == "true" {
+        return admission.Allowed("injection not requested")
+    }
+
+    // Pods being created may not have their namespace set yet
+    namespace := pod.Namespace
+    if namespace == "" {
+        namespace = req.Namespace
+    }
+    ts, err := i.findInstance(ctx, namespace, pod.Annotations[instanceAnnotation])
+    if err != nil {
+        // Deny rather than start a payment workload that would send tokens upstream
+        return admission.Denied(err.Error())
+    }
+    if !ts.Spec.SidecarInjection.Enabled {
+        return admission.Denied(fmt.Sprintf("sidecar injection is not enabled on TokenShield %s/%s", ts.Namespace, ts.Name))
+    }
+
+    injectEgressSidecar(pod, ts)
+
+    marshaled, err := json.Marshal(pod)
+    if err != nil {
+        return admission.Errored(http.StatusInternalServerError, err)
+    }
+    return admission.PatchResponseFromRaw(req.Object.Raw, marshaled)
+}
+
+// findInstance resolves the TokenShield serving a pod: the annotated
+// "namespace/name", or the only instance in the pod's namespace
+func (i *SidecarInjector) findInstance(ctx context.Context, namespace, ref string) (*tokenizationv1alpha1.TokenShield, error) {
+    if ref != "" {
+        ns, name, ok := strings.Cut(ref, "/")
+        if !ok {
+            ns, name = namespace, ref
+        }
+        ts := &tokenizationv1alpha1.TokenShield{}
+        if err := i.Client.Get(ctx, types.NamespacedName{Name: name, Namespace: ns}, ts); err != nil {
+            return nil, fmt.Errorf("TokenShield %s/%s: %v", ns, name, err)
+        }
+        return ts, nil
+    }
+
+    list := &tokenizationv1alpha1.TokenShieldList{}
+    if err := i.Client.List(ctx, list, client.InNamespace(namespace)); err != nil {
+        return nil, err
+    }
+    if len(list.Items) != 1 {
+        return nil, fmt.Errorf("found %d TokenShield instances in %s; set the %s annotation", len(list.Items), namespace, instanceAnnotation)
+    }
+    return &list.Items[0], nil
+}
+
+// injectEgressSidecar adds the sidecar container and points the application
+// containers' HTTP_PROXY at it. HTTPS_PROXY is left alone: CONNECT tunnels
+// cannot be detokenized, so payment calls must use http:// with TLS
+// originated by the sidecar (spec.sidecarInjection.originateTLS).
+func injectEgressSidecar(pod *corev1.Pod, ts *tokenizationv1alpha1.TokenShield) {
+    spec := ts.Spec.SidecarInjection
+
+    hosts := strings.Join(spec.EgressHosts, ",")
+    if override := pod.Annotations[egressHostsAnnotation]; override != "" {
+        hosts = override
+    }
+
+    scheme := "icap"
+    if ts.Spec.Security.TLS.CertManager {
+        scheme = "icaps"
+    }
+    icapURL := fmt.Sprintf("%s://tokenshield-tokenizer.%s.svc:1344/reqmod", scheme, ts.Namespace)
+
+    sidecar := corev1.Container{
+        Name:    egressContainerName,
+        Image:   tokenizerImage(tokenizerVersion(ts)),
+        Command: []string{"./unified-tokenizer", "egress"},
+        Env: []corev1.EnvVar{
+            {Name: "EGRESS_ICAP_URL", Value: icapURL},
+            {Name: "EGRESS_HOSTS", Value: hosts},
+            {Name: "EGRESS_ORIGINATE_TLS", Value: fmt.Sprintf("%t", spec.OriginateTLS)},
+            {Name: "EGRESS_LISTEN", Value: egressListenAddr},
+        },
+        Resources: corev1.ResourceRequirements{
+            Requests: corev1.ResourceList{
+                corev1.ResourceCPU:    resource.MustParse("50m"),
+                corev1.ResourceMemory: resource.MustParse("32Mi"),
+            },
+            Limits: corev1.ResourceList{
+                corev1.ResourceCPU:    resource.MustParse("500m"),
+                corev1.ResourceMemory: resource.MustParse("128Mi"),
+            },
+        },
+    }
+
+    // CA for the tokenizer's certificate, distributed to application
+    // namespaces as a ConfigMap (e.g. by trust-manager)
+    if scheme == "icaps" && spec.CAConfigMap != "" {
+        pod.Spec.Volumes = append(pod.Spec.Volumes, corev1.Volume{
+            Name: "tokenshield-egress-ca",
+            VolumeSource: corev1.VolumeSource{
+                ConfigMap: &corev1.ConfigMapVolumeSource{
+                    LocalObjectReference: corev1.LocalObjectReference{Name: spec.CAConfigMap},
+                },
+            },
+        })
+        sidecar.VolumeMounts = append(sidecar.VolumeMounts, corev1.VolumeMount{
+            Name:      "tokenshield-egress-ca",
+            MountPath: egressCAMountPath,
+            ReadOnly:  true,
+        })
+        sidecar.Env = append(sidecar.Env, corev1.EnvVar{Name: "EGRESS_ICAP_CA", Value: egressCAMountPath + "/ca.crt"})
+    }
+
+    proxyURL := "http://" + egressListenAddr
+    for c := range pod.Spec.Containers {
+        container := &pod.Spec.Containers[c]
+        if hasEnv(container, "HTTP_PROXY") || hasEnv(container, "http_proxy") {
+            continue
+        }
+        // Both spellings: Go and curl read the lower-case one for http://
+        container.Env = append(container.Env,
+            corev1.EnvVar{Name: "HTTP_PROXY", Value: proxyURL},
+            corev1.EnvVar{Name: "http_proxy", Value: proxyURL},
+        )
+        if !hasEnv(container, "NO_PROXY") {
+            container.Env = append(container.Env,
+                corev1.EnvVar{Name: "NO_PROXY", Value: defaultNoProxy},
+                corev1.EnvVar{Name: "no_proxy", Value: defaultNoProxy},
+            )
+        }
+    }
+
+    pod.Spec.Containers = append(pod.Spec.Containers, sidecar)
+    if pod.Annotations == nil {
+        pod.Annotations = map[string]string{}
+    }
+    pod.Annotations[injectedAnnotation] = "true"
+}
+
+func hasEnv(container *corev1.Container, name string) bool {
+    for _, env := range container.Env {
+        if env.Name == name {
+            return true
+        }
+    }
+    return false
+}
@@ -0,0 +1,122 @@
+// Command loadgen drives synthetic card traffic through the tokenizer's
+// HTTP proxy, ICAP service and REST API and reports latency percentiles.
+// With -max-p99 or -max-error-rate it exits non-zero when a target misses
+// its budget, so it can gate a release.
+//
+//	go run ./cmd/loadgen -targets proxy,icap,api -concurrency 32 -duration 1m -api-key ...
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"math/rand"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"time"
+
+	"tokenshield-unified/internal/icap"
+	"tokenshield-unified/internal/loadgen"
+)
+
+func main() {
+	targets := flag.String("targets", "proxy,icap,api", "Comma-separated paths to load: proxy, icap, api")
+	proxyURL := flag.String("proxy-url", "http://localhost:8080/api/checkout", "URL posted to through the tokenizing HTTP proxy")
+	icapURL := flag.String("icap-url", "icap://localhost:1344/reqmod", "ICAP REQMOD service URL")
+	icapSecret := flag.String("icap-secret", "", "ICAP_SHARED_SECRET of the ICAP service, if it requires one")
+	apiURL := flag.String("api-url", "http://localhost:8090", "Management API base URL")
+	apiKey := flag.String("api-key", "", "API key for the api target and for seeding tokens")
+	sessionID := flag.String("session", "", "Session ID to use instead of an API key")
+	concurrency := flag.Int("concurrency", 16, "Parallel workers per target")
+	duration := flag.Duration("duration", 30*time.Second, "How long to load each target")
+	requests := flag.Int("requests", 0, "Requests per target; overrides -duration")
+	payloadSize := flag.Int("payload-size", 512, "Approximate JSON body size in bytes")
+	hitRatio := flag.Float64("token-hit-ratio", 0.9, "Fraction of icap and api requests using a token the vault knows")
+	seed := flag.Int("seed-tokens", 200, "Cards imported to obtain known tokens (needs system.admin)")
+	maxP99 := flag.Duration("max-p99", 0, "Fail if any target's p99 latency exceeds this")
+	maxErrorRate := flag.Float64("max-error-rate", 0, "Fail if any target's error fraction exceeds this (e.g. 0.01)")
+	flag.Parse()
+
+	if *concurrency < 1 || *payloadSize < 0 || *hitRatio < 0 || *hitRatio > 1 || *requests < 0 {
+		log.Fatalf("invalid flags: need concurrency >= 1, payload-size >= 0, 0 <= token-hit-ratio <= 1")
+	}
+	cfg := loadgen.Config{
+		Concurrency:   *concurrency,
+		Duration:      *duration,
+		Requests:      *requests,
+		PayloadSize:   *payloadSize,
+		TokenHitRatio: *hitRatio,
+	}
+	auth := loadgen.Auth{APIKey: *apiKey, SessionID: *sessionID}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	// One keep-alive pool sized for the workers, like a real client
+	client := &http.Client{
+		Timeout: 30 * time.Second,
+		Transport: &http.Transport{
+			MaxIdleConnsPerHost: *concurrency,
+			IdleConnTimeout:     90 * time.Second,
+		},
+	}
+
+	selected := strings.Split(*targets, ",")
+	needsTokens := false
+	for i, t := range selected {
+		selected[i] = strings.TrimSpace(t)
+		needsTokens = needsTokens || selected[i] == "icap" || selected[i] == "api"
+	}
+
+	// Known tokens make ICAP and API requests hit the vault
+	var tokens []string
+	if needsTokens && *hitRatio > 0 && *seed > 0 {
+		var err error
+		tokens, err = loadgen.SeedTokens(client, *apiURL, auth, *seed, rand.New(rand.NewSource(time.Now().UnixNano())))
+		if err != nil {
+			log.Fatalf("Seeding tokens failed (pass -seed-tokens 0 for misses only): %v", err)
+		}
+		fmt.Printf("Seeded %d tokens\n", len(tokens))
+	}
+
+	failed := false
+	for _, target := range selected {
+		var op loadgen.Op
+		switch target {
+		case "proxy":
+			op = loadgen.Proxy(client, *proxyURL, cfg)
+		case "icap":
+			icapClient, err := icap.NewClient(*icapURL, nil)
+			if err != nil {
+				log.Fatalf("Invalid -icap-url: %v", err)
+			}
+			icapClient.Secret = *icapSecret
+			op = loadgen.ICAP(icapClient, tokens, cfg)
+		case "api":
+			op = loadgen.API(client, *apiURL, auth, tokens, cfg)
+		default:
+			log.Fatalf("Unknown target %q (use proxy, icap or api)", target)
+		}
+
+		result := loadgen.Run(ctx, cfg, op)
+		result.Report(os.Stdout, target)
+
+		if *maxP99 > 0 && result.Percentile(99) > *maxP99 {
+			fmt.Printf("  FAIL: p99 %s exceeds %s\n", result.Percentile(99), *maxP99)
+			failed = true
+		}
+		if *maxErrorRate > 0 && result.Requests > 0 && float64(result.Errors)/float64(result.Requests) > *maxErrorRate {
+			fmt.Printf("  FAIL: error rate %.2f%% exceeds %.2f%%\n", 100*float64(result.Errors)/float64(result.Requests), 100**maxErrorRate)
+			failed = true
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	if failed {
+		os.Exit(1)
+	}
+}
@@ -7,3 +7,5 @@ require (
 	github.com/go-sql-driver/mysql v1.7.1
 	golang.org/x/crypto v0.14.0
 )
+
+require golang.org/x/sys v0.13.0 // indirect
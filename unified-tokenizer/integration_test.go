@@ -0,0 +1,3927 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/ed25519"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"net/smtp"
+	"net/textproto"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"tokenshield-unified/internal/apierror"
+	"tokenshield-unified/internal/charset"
+	"tokenshield-unified/internal/smtprelay"
+	"tokenshield-unified/internal/mailer"
+	"tokenshield-unified/internal/compression"
+	"tokenshield-unified/internal/ipfilter"
+	"tokenshield-unified/internal/icap"
+	"tokenshield-unified/internal/migrate"
+	"tokenshield-unified/internal/kafka"
+	"tokenshield-unified/internal/avro"
+	"tokenshield-unified/internal/secheaders"
+	"tokenshield-unified/internal/sessionbind"
+	"tokenshield-unified/internal/loginchallenge"
+	"tokenshield-unified/internal/engine"
+	"tokenshield-unified/internal/nettoken"
+
+	"github.com/fernet/fernet-go"
+	"github.com/go-sql-driver/mysql"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// The integration tests run the tokenizer against a real MySQL server.
+// They are skipped unless TEST_MYSQL_DSN points at a server the tests may
+// create databases on; docker-compose.test.yml starts a throwaway one:
+//
+//	docker-compose -f docker-compose.test.yml up -d
+//	TEST_MYSQL_DSN='root:test@tcp(127.0.0.1:3307)/' go test ./...
+//
+// Each test gets its own database with all migrations applied, and its own
+// proxy, ICAP and API servers on loopback in front of a fake upstream.
+
+const testPassword = "Integration-Test-Pass-1"
+
+// integrationEnv is a tokenizer wired to a fresh database
+type integrationEnv struct {
+	ut       *UnifiedTokenizer
+	upstream *fakeUpstream
+	proxy    *httptest.Server
+	api      *httptest.Server
+	icapAddr string
+}
+
+// fakeUpstream stands in for the application behind the proxy. It records
+// request bodies and answers with canned responses per path.
+type fakeUpstream struct {
+	*httptest.Server
+	mu        sync.Mutex
+	bodies    []string
+	responses map[string]cannedResponse
+}
+
+type cannedResponse struct {
+	contentType string
+	encoding    string // Content-Encoding the body is sent with, if any
+	body        string
+}
+
+func newFakeUpstream(t *testing.T) *fakeUpstream {
+	u := &fakeUpstream{responses: make(map[string]cannedResponse)}
+	u.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		u.mu.Lock()
+		u.bodies = append(u.bodies, string(body))
+		resp, ok := u.responses[r.URL.Path]
+		u.mu.Unlock()
+		if !ok {
+			resp = cannedResponse{contentType: "application/json", body: `{"status":"ok"}`}
+		}
+		w.Header().Set("Content-Type", resp.contentType)
+		body = []byte(resp.body)
+		if resp.encoding != "" {
+			w.Header().Set("Content-Encoding", resp.encoding)
+			body, _ = compression.Encode(resp.encoding, body)
+		}
+		w.Write(body)
+	}))
+	t.Cleanup(u.Close)
+	return u
+}
+
+// respond sets the response for path
+func (u *fakeUpstream) respond(path, contentType, body string) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.responses[path] = cannedResponse{contentType: contentType, body: body}
+}
+
+// respondEncoded sets the response for path, sent with a content coding
+func (u *fakeUpstream) respondEncoded(path, contentType, encoding, body string) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.responses[path] = cannedResponse{contentType: contentType, encoding: encoding, body: body}
+}
+
+// lastBody returns the body of the most recent request
+func (u *fakeUpstream) lastBody() string {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if len(u.bodies) == 0 {
+		return ""
+	}
+	return u.bodies[len(u.bodies)-1]
+}
+
+// newIntegrationEnv creates a database, migrates it and starts a tokenizer
+// configured by the DB_* variables for it plus env
+func newIntegrationEnv(t *testing.T, env map[string]string) *integrationEnv {
+	dsn := os.Getenv("TEST_MYSQL_DSN")
+	if dsn == "" {
+		t.Skip("TEST_MYSQL_DSN not set (see docker-compose.test.yml)")
+	}
+	cfg, err := mysql.ParseDSN(dsn)
+	if err != nil {
+		t.Fatalf("invalid TEST_MYSQL_DSN: %v", err)
+	}
+	cfg.DBName = ""
+	admin, err := sql.Open("mysql", cfg.FormatDSN())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { admin.Close() })
+
+	name := fmt.Sprintf("tokenshield_test_%d", time.Now().UnixNano())
+	if _, err := admin.Exec("CREATE DATABASE " + name); err != nil {
+		t.Fatalf("failed to create test database: %v", err)
+	}
+	t.Cleanup(func() { admin.Exec("DROP DATABASE " + name) })
+
+	cfg.DBName = name
+	db, err := sql.Open("mysql", cfg.FormatDSN())
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = migrate.Run(context.Background(), db)
+	db.Close()
+	if err != nil {
+		t.Fatalf("migrations failed: %v", err)
+	}
+
+	host, port, err := net.SplitHostPort(cfg.Addr)
+	if err != nil {
+		t.Fatalf("TEST_MYSQL_DSN needs a tcp(host:port) address: %v", err)
+	}
+	key := fernet.Key{}
+	key.Generate()
+	upstream := newFakeUpstream(t)
+	settings := map[string]string{
+		"DB_HOST":        host,
+		"DB_PORT":        port,
+		"DB_USER":        cfg.User,
+		"DB_PASSWORD":    cfg.Passwd,
+		"DB_NAME":        name,
+		"ENCRYPTION_KEY": base64.URLEncoding.EncodeToString(key[:]),
+		"APP_ENDPOINT":   upstream.URL,
+		"TEST_MODE":      "true",
+	}
+	for k, v := range env {
+		settings[k] = v
+	}
+	for k, v := range settings {
+		t.Setenv(k, v)
+	}
+
+	ut, err := NewUnifiedTokenizer()
+	if err != nil {
+		t.Fatalf("NewUnifiedTokenizer() failed: %v", err)
+	}
+	t.Cleanup(func() {
+		ut.stmts.Close()
+		ut.db.Close()
+	})
+
+	e := &integrationEnv{ut: ut, upstream: upstream}
+	e.proxy = httptest.NewServer(ut.proxyHandler())
+	t.Cleanup(e.proxy.Close)
+	e.api = httptest.NewServer(ut.apiHandler())
+	t.Cleanup(e.api.Close)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			ut.icapPool.Serve(conn)
+		}
+	}()
+	e.icapAddr = ln.Addr().String()
+	return e
+}
+
+// createUser adds an active user with testPassword and the permissions of
+// role
+func (e *integrationEnv) createUser(t *testing.T, username, role string) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(testPassword), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = e.ut.db.Exec(`
+		INSERT INTO users (user_id, username, email, password_hash, full_name, role, permissions,
+		                   is_active, is_email_verified, password_changed_at)
+		VALUES (?, ?, ?, ?, ?, ?, JSON_ARRAY(), TRUE, TRUE, NOW())
+	`, "usr_"+username, username, username+"@example.com", string(hash), username, role)
+	if err != nil {
+		t.Fatalf("failed to create user %s: %v", username, err)
+	}
+}
+
+// login returns a session ID for username
+func (e *integrationEnv) login(t *testing.T, username string) string {
+	status, body := e.call(t, "POST", "/api/v1/auth/login", nil, map[string]string{
+		"username": username,
+		"password": testPassword,
+	})
+	if status != http.StatusOK {
+		t.Fatalf("login as %s: status %d: %v", username, status, body)
+	}
+	return body["session_id"].(string)
+}
+
+// call sends a JSON request to the API and decodes the JSON response
+func (e *integrationEnv) call(t *testing.T, method, path string, header http.Header, body interface{}) (int, map[string]interface{}) {
+	var reader io.Reader
+	if body != nil {
+		data, _ := json.Marshal(body)
+		reader = bytes.NewReader(data)
+	}
+	req, err := http.NewRequest(method, e.api.URL+path, reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("%s %s: %v", method, path, err)
+	}
+	defer resp.Body.Close()
+	var decoded map[string]interface{}
+	json.NewDecoder(resp.Body).Decode(&decoded)
+	return resp.StatusCode, decoded
+}
+
+// securityEventDetails returns the decrypted details of the security
+// events of eventType
+func (e *integrationEnv) securityEventDetails(t *testing.T, eventType string) []string {
+	rows, err := e.ut.db.Query(`
+		SELECT details_encrypted, details_key_id FROM security_audit_log WHERE event_type = ?
+	`, eventType)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	var details []string
+	for rows.Next() {
+		var encrypted []byte
+		var keyID sql.NullString
+		if err := rows.Scan(&encrypted, &keyID); err != nil {
+			t.Fatal(err)
+		}
+		values, err := e.ut.decryptFields(keyID, encrypted)
+		if err != nil {
+			t.Fatalf("audit details of %s: %v", eventType, err)
+		}
+		details = append(details, values[0])
+	}
+	return details
+}
+
+func bearer(sessionID string) http.Header {
+	return http.Header{"Authorization": {"Bearer " + sessionID}}
+}
+
+func apiKeyHeader(apiKey string) http.Header {
+	return http.Header{"X-Api-Key": {apiKey}}
+}
+
+// icapResponse is a parsed ICAP response. Encapsulated holds the HTTP
+// headers section and Body the de-chunked body.
+type icapResponse struct {
+	Status       int
+	Headers      map[string]string
+	Encapsulated string
+	Body         string
+}
+
+// icapExchange sends a raw ICAP request and parses the response, checking
+// that the Encapsulated offsets and chunked body are well formed
+func (e *integrationEnv) icapExchange(t *testing.T, request string) icapResponse {
+	conn, err := net.Dial("tcp", e.icapAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	if _, err := conn.Write([]byte(request)); err != nil {
+		t.Fatal(err)
+	}
+	// The server answers one request per connection, then closes it
+	raw, err := io.ReadAll(conn)
+	if err != nil {
+		t.Fatalf("reading ICAP response: %v", err)
+	}
+
+	head, rest, ok := strings.Cut(string(raw), "\r\n\r\n")
+	if !ok {
+		t.Fatalf("ICAP response has no header terminator: %q", raw)
+	}
+	lines := strings.Split(head, "\r\n")
+	var resp icapResponse
+	if _, err := fmt.Sscanf(lines[0], "ICAP/1.0 %d", &resp.Status); err != nil {
+		t.Fatalf("bad ICAP status line %q", lines[0])
+	}
+	resp.Headers = make(map[string]string)
+	for _, line := range lines[1:] {
+		if k, v, ok := strings.Cut(line, ":"); ok {
+			resp.Headers[k] = strings.TrimSpace(v)
+		}
+	}
+
+	encapsulated := resp.Headers["Encapsulated"]
+	if encapsulated == "" {
+		if rest != "" {
+			t.Errorf("ICAP %d without Encapsulated has trailing data %q", resp.Status, rest)
+		}
+		return resp
+	}
+	bodyOffset := -1
+	for _, part := range strings.Split(encapsulated, ",") {
+		k, v, _ := strings.Cut(strings.TrimSpace(part), "=")
+		if k == "req-body" || k == "res-body" {
+			bodyOffset, _ = strconv.Atoi(v)
+		}
+	}
+	if bodyOffset < 0 || bodyOffset > len(rest) {
+		t.Fatalf("Encapsulated %q does not fit the %d bytes sent", encapsulated, len(rest))
+	}
+	resp.Encapsulated = rest[:bodyOffset]
+	if !strings.HasSuffix(resp.Encapsulated, "\r\n\r\n") {
+		t.Errorf("body offset %d does not follow the end of the HTTP headers: %q", bodyOffset, resp.Encapsulated)
+	}
+	body, err := io.ReadAll(httputil.NewChunkedReader(bufio.NewReader(strings.NewReader(rest[bodyOffset:]))))
+	if err != nil {
+		t.Fatalf("bad chunked body %q: %v", rest[bodyOffset:], err)
+	}
+	resp.Body = string(body)
+	return resp
+}
+
+// chunk encodes body as a single ICAP chunk plus the terminating chunk
+func chunk(body string) string {
+	if body == "" {
+		return "0\r\n\r\n"
+	}
+	return fmt.Sprintf("%x\r\n%s\r\n0\r\n\r\n", len(body), body)
+}
+
+func reqmodRequest(addr, body string) string {
+	httpHeaders := "POST /charge HTTP/1.1\r\nHost: gateway.example\r\n" +
+		"Content-Type: application/json\r\n" +
+		fmt.Sprintf("Content-Length: %d\r\n\r\n", len(body))
+	return fmt.Sprintf("REQMOD icap://%s/reqmod ICAP/1.0\r\nHost: %s\r\nEncapsulated: req-hdr=0, req-body=%d\r\n\r\n",
+		addr, addr, len(httpHeaders)) + httpHeaders + chunk(body)
+}
+
+func respmodRequest(addr, contentType, body string) string {
+	reqHeaders := "GET /cards HTTP/1.1\r\nHost: gateway.example\r\n\r\n"
+	resHeaders := "HTTP/1.1 200 OK\r\n" +
+		"Content-Type: " + contentType + "\r\n" +
+		fmt.Sprintf("Content-Length: %d\r\n\r\n", len(body))
+	encapsulated := fmt.Sprintf("req-hdr=0, res-hdr=%d, res-body=%d", len(reqHeaders), len(reqHeaders)+len(resHeaders))
+	if body == "" {
+		encapsulated = fmt.Sprintf("req-hdr=0, res-hdr=%d, null-body=%d", len(reqHeaders), len(reqHeaders)+len(resHeaders))
+	}
+	request := fmt.Sprintf("RESPMOD icap://%s/respmod ICAP/1.0\r\nHost: %s\r\nEncapsulated: %s\r\n\r\n", addr, addr, encapsulated) +
+		reqHeaders + resHeaders
+	if body != "" {
+		request += chunk(body)
+	}
+	return request
+}
+
+// checkRoundTrip tokenizes a card through the proxy, then detokenizes the
+// token through ICAP REQMOD and through proxy response detokenization
+func checkRoundTrip(t *testing.T, e *integrationEnv, card string) string {
+	resp, err := http.Post(e.proxy.URL+"/api/checkout", "application/json",
+		strings.NewReader(`{"card_number":"`+card+`","amount":"10.00"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	var forwarded map[string]string
+	if err := json.Unmarshal([]byte(e.upstream.lastBody()), &forwarded); err != nil {
+		t.Fatalf("upstream received %q: %v", e.upstream.lastBody(), err)
+	}
+	token := forwarded["card_number"]
+	if token == card || !e.ut.tokenRegex.MatchString(token) {
+		t.Fatalf("upstream received card_number %q, want a token", token)
+	}
+	if forwarded["amount"] != "10.00" {
+		t.Errorf("non-card field changed: %v", forwarded)
+	}
+
+	icapResp := e.icapExchange(t, reqmodRequest(e.icapAddr, `{"card":"`+token+`"}`))
+	if icapResp.Status != 200 {
+		t.Fatalf("REQMOD with a token: ICAP %d, want 200", icapResp.Status)
+	}
+	if want := `{"card":"` + card + `"}`; icapResp.Body != want {
+		t.Errorf("REQMOD body = %q, want %q", icapResp.Body, want)
+	}
+	if !strings.Contains(icapResp.Encapsulated, fmt.Sprintf("Content-Length: %d\r\n", len(icapResp.Body))) {
+		t.Errorf("REQMOD did not update Content-Length: %q", icapResp.Encapsulated)
+	}
+
+	e.upstream.respond("/api/cards", "application/json", `{"cards":[{"card_number":"`+token+`"}]}`)
+	resp, err = http.Get(e.proxy.URL + "/api/cards")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if !strings.Contains(string(body), card) || resp.Header.Get("Content-Length") != strconv.Itoa(len(body)) {
+		t.Errorf("GET /api/cards through the proxy = %q (Content-Length %s), want the card detokenized",
+			body, resp.Header.Get("Content-Length"))
+	}
+	return token
+}
+
+// TestIntegrationLegacyEncryption tests round trips with Fernet encryption
+func TestIntegrationLegacyEncryption(t *testing.T) {
+	e := newIntegrationEnv(t, nil)
+	token := checkRoundTrip(t, e, testCards[0])
+
+	var keyID sql.NullString
+	if err := e.ut.db.QueryRow("SELECT encryption_key_id FROM credit_cards WHERE token = ?", token).Scan(&keyID); err != nil {
+		t.Fatal(err)
+	}
+	if keyID.Valid {
+		t.Errorf("legacy card stored with key ID %q", keyID.String)
+	}
+
+	// HTML pages are detokenized too
+	e.upstream.respond("/my-cards", "text/html", "<td>"+token+"</td>")
+	resp, err := http.Get(e.proxy.URL + "/my-cards")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != "<td>"+testCards[0]+"</td>" {
+		t.Errorf("GET /my-cards = %q", body)
+	}
+}
+
+// TestIntegrationCardDetails tests that expiry and cardholder fields sent
+// next to the card number are stored with the token, using per-endpoint
+// field names from CARD_FIELD_MAPPINGS
+func TestIntegrationCardDetails(t *testing.T) {
+	e := newIntegrationEnv(t, map[string]string{
+		"CARD_FIELD_MAPPINGS": `{"/api/subscribe": {"expiry": "valid_thru", "card_holder": "name"}}`,
+	})
+	tokenize := func(path, body string) string {
+		resp, err := http.Post(e.proxy.URL+path, "application/json", strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		var forwarded map[string]interface{}
+		if err := json.Unmarshal([]byte(e.upstream.lastBody()), &forwarded); err != nil {
+			t.Fatalf("upstream received %q: %v", e.upstream.lastBody(), err)
+		}
+		token, _ := forwarded["card_number"].(string)
+		if !e.ut.tokenRegex.MatchString(token) {
+			t.Fatalf("upstream received card_number %q, want a token", token)
+		}
+		return token
+	}
+	stored := func(token string) (month, year sql.NullInt64, holder string) {
+		var encryptedHolder []byte
+		if err := e.ut.db.QueryRow("SELECT expiry_month, expiry_year, card_holder_name_encrypted FROM credit_cards WHERE token = ?",
+			token).Scan(&month, &year, &encryptedHolder); err != nil {
+			t.Fatal(err)
+		}
+		if encryptedHolder != nil {
+			plain, err := e.ut.decryptStoredField(encryptedHolder, sql.NullString{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			holder = plain
+		}
+		return month, year, holder
+	}
+
+	token := tokenize("/api/checkout", `{"card_number":"`+testCards[0]+`","expiry_month":"04","expiry_year":2031,"cardholder":"Jane Doe"}`)
+	if month, year, holder := stored(token); month.Int64 != 4 || year.Int64 != 2031 || holder != "Jane Doe" {
+		t.Errorf("/api/checkout stored expiry %v/%v holder %q, want 4/2031 Jane Doe", month, year, holder)
+	}
+
+	token = tokenize("/api/subscribe", `{"card_number":"`+testCards[1]+`","valid_thru":"09/28","name":"John Roe","expiry":"01/30"}`)
+	if month, year, holder := stored(token); month.Int64 != 9 || year.Int64 != 2028 || holder != "John Roe" {
+		t.Errorf("/api/subscribe stored expiry %v/%v holder %q, want 9/2028 John Roe", month, year, holder)
+	}
+
+	token = tokenize("/api/checkout", `{"card_number":"`+testCards[3]+`"}`)
+	if month, year, holder := stored(token); month.Valid || year.Valid || holder != "" {
+		t.Errorf("card sent without details stored expiry %v/%v holder %q, want NULL", month, year, holder)
+	}
+}
+
+// TestIntegrationIntegrityCheck tests the vault integrity check against
+// damaged rows, started through the API and read back as a report
+func TestIntegrationIntegrityCheck(t *testing.T) {
+	e := newIntegrationEnv(t, nil)
+	good := checkRoundTrip(t, e, testCards[0])
+	damaged := checkRoundTrip(t, e, testCards[1])
+	if _, err := e.ut.db.Exec("UPDATE credit_cards SET last_four_digits = '0000' WHERE token = ?", damaged); err != nil {
+		t.Fatal(err)
+	}
+
+	// Orphaned request rows can only be written around the foreign key
+	conn, err := e.ut.db.Conn(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, stmt := range []string{
+		"SET FOREIGN_KEY_CHECKS = 0",
+		"INSERT INTO token_requests (token, request_type) VALUES ('tok_gone', 'detokenize'), ('tok_gone', 'detokenize')",
+		"SET FOREIGN_KEY_CHECKS = 1",
+	} {
+		if _, err := conn.ExecContext(context.Background(), stmt); err != nil {
+			t.Fatal(err)
+		}
+	}
+	conn.Close()
+
+	e.createUser(t, "auditor", RoleAdmin)
+	session := e.login(t, "auditor")
+	status, body := e.call(t, "POST", "/api/v1/integrity/checks", bearer(session), nil)
+	if status != http.StatusAccepted {
+		t.Fatalf("POST /api/v1/integrity/checks: status %d: %v", status, body)
+	}
+	checkID, _ := body["check_id"].(string)
+
+	deadline := time.Now().Add(10 * time.Second)
+	for body["status"] != "completed" && body["status"] != "failed" {
+		if time.Now().After(deadline) {
+			t.Fatalf("integrity check did not finish: %v", body)
+		}
+		time.Sleep(50 * time.Millisecond)
+		_, body = e.call(t, "GET", "/api/v1/integrity/checks/"+checkID, bearer(session), nil)
+	}
+	if body["status"] != "completed" || body["cards_checked"] != 2.0 || body["digit_mismatches"] != 1.0 ||
+		body["decrypt_failures"] != 0.0 || body["luhn_failures"] != 0.0 || body["orphaned_requests"] != 2.0 {
+		t.Errorf("report = %v", body)
+	}
+	var flagged []string
+	for _, issue := range body["issues"].([]interface{}) {
+		flagged = append(flagged, issue.(map[string]interface{})["token"].(string))
+	}
+	if strings.Join(flagged, ",") != damaged+",tok_gone" || strings.Contains(fmt.Sprint(flagged), good) {
+		t.Errorf("issues name tokens %v, want %s and tok_gone", flagged, damaged)
+	}
+
+	resp, err := http.Get(e.api.URL + "/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	metrics, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	for _, want := range []string{
+		"tokenshield_integrity_cards_checked 2\n",
+		`tokenshield_integrity_issues{check="digits"} 1` + "\n",
+		`tokenshield_integrity_issues{check="orphaned_request"} 2` + "\n",
+	} {
+		if !strings.Contains(string(metrics), want) {
+			t.Errorf("metrics missing %q", want)
+		}
+	}
+}
+
+// TestIntegrationCORSPolicy tests replacing the CORS_* settings through
+// the API and going back to them
+func TestIntegrationCORSPolicy(t *testing.T) {
+	e := newIntegrationEnv(t, map[string]string{"CORS_ALLOWED_ORIGINS": "http://localhost:8081"})
+	e.createUser(t, "corsadmin", RoleAdmin)
+	session := e.login(t, "corsadmin")
+
+	allowed := func(origin string) bool {
+		req, _ := http.NewRequest("OPTIONS", e.api.URL+"/api/v1/users", nil)
+		req.Header.Set("Origin", origin)
+		req.Header.Set("Access-Control-Request-Method", "GET")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.Header.Get("Access-Control-Allow-Origin") == origin
+	}
+	if !allowed("http://localhost:8081") || allowed("https://admin.example.com") {
+		t.Fatal("configured origins should apply until a policy is set")
+	}
+
+	status, body := e.call(t, "PUT", "/api/v1/cors", bearer(session), map[string]interface{}{
+		"allowed_origins": []string{"https://*.example.com"},
+	})
+	if status != http.StatusOK || body["source"] != "api" || body["updated_by"] != "corsadmin" {
+		t.Fatalf("PUT /api/v1/cors: status %d: %v", status, body)
+	}
+	if !allowed("https://admin.example.com") || allowed("http://localhost:8081") {
+		t.Error("the policy set through the API should replace the configured one")
+	}
+	if status, body := e.call(t, "PUT", "/api/v1/cors", bearer(session), map[string]interface{}{
+		"allowed_origins": []string{"*"}, "allow_credentials": true,
+	}); status != http.StatusBadRequest {
+		t.Errorf("wildcard with credentials: status %d: %v", status, body)
+	}
+
+	status, body = e.call(t, "DELETE", "/api/v1/cors", bearer(session), nil)
+	if status != http.StatusOK || body["source"] != "config" || !allowed("http://localhost:8081") {
+		t.Errorf("DELETE /api/v1/cors: status %d: %v", status, body)
+	}
+}
+
+func TestIntegrationSecurityHeaders(t *testing.T) {
+	e := newIntegrationEnv(t, map[string]string{"SECURITY_FRAME_OPTIONS": "SAMEORIGIN"})
+
+	get := func(path string) *http.Response {
+		resp, err := http.Get(e.api.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp
+	}
+	// Refused requests carry the headers too
+	resp := get("/api/v1/users")
+	if resp.StatusCode != http.StatusUnauthorized || resp.Header.Get("X-Frame-Options") != "SAMEORIGIN" ||
+		resp.Header.Get("X-Content-Type-Options") != "nosniff" || !strings.HasPrefix(resp.Header.Get("Strict-Transport-Security"), "max-age=") ||
+		resp.Header.Get("Content-Security-Policy") != secheaders.DefaultCSP {
+		t.Errorf("GET /api/v1/users: status %d, headers %v", resp.StatusCode, resp.Header)
+	}
+	resp = get("/status")
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Security-Policy") != secheaders.DefaultPageCSP {
+		t.Errorf("GET /status: status %d, headers %v", resp.StatusCode, resp.Header)
+	}
+}
+
+// TestIntegrationMaintenance tests turning on maintenance mode and the
+// config freeze through the API and ending them
+func TestIntegrationMaintenance(t *testing.T) {
+	e := newIntegrationEnv(t, map[string]string{"MAINTENANCE_CRITICAL_DESTINATIONS": "payments.example.com"})
+	e.createUser(t, "maintadmin", RoleAdmin)
+	session := e.login(t, "maintadmin")
+
+	status, body := e.call(t, "PUT", "/api/v1/maintenance", bearer(session), map[string]interface{}{
+		"enabled": true, "config_freeze": true, "message": "Database failover", "retry_after": 120,
+	})
+	if status != http.StatusOK || body["enabled"] != true || body["updated_by"] != "maintadmin" {
+		t.Fatalf("PUT /api/v1/maintenance: status %d: %v", status, body)
+	}
+	if hosts, _ := body["critical_destinations"].([]interface{}); len(hosts) != 1 || hosts[0] != "payments.example.com" {
+		t.Errorf("critical destinations should default to MAINTENANCE_CRITICAL_DESTINATIONS: %v", body["critical_destinations"])
+	}
+
+	resp, err := http.Get(e.proxy.URL + "/api/orders")
+	if err != nil {
+		t.Fatal(err)
+	}
+	page, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusServiceUnavailable || resp.Header.Get("Retry-After") != "120" || !strings.Contains(string(page), "Database failover") {
+		t.Errorf("proxy during maintenance: status %d, Retry-After %q: %s", resp.StatusCode, resp.Header.Get("Retry-After"), page)
+	}
+	if e.ut.detokenizesFor("api.stripe.com") || !e.ut.detokenizesFor("payments.example.com:443") {
+		t.Error("only critical destinations should be detokenized for during maintenance")
+	}
+
+	status, body = e.call(t, "PUT", "/api/v1/cors", bearer(session), map[string]interface{}{"allowed_origins": []string{"https://admin.example.com"}})
+	if status != http.StatusLocked || body["code"] != apierror.ConfigFrozen {
+		t.Errorf("PUT /api/v1/cors during the freeze: status %d: %v", status, body)
+	}
+	if status, body := e.call(t, "GET", "/api/v1/cors", bearer(session), nil); status != http.StatusOK {
+		t.Errorf("GET /api/v1/cors during the freeze: status %d: %v", status, body)
+	}
+
+	status, body = e.call(t, "DELETE", "/api/v1/maintenance", bearer(session), nil)
+	if status != http.StatusOK || body["enabled"] != false || body["config_freeze"] != false {
+		t.Fatalf("DELETE /api/v1/maintenance: status %d: %v", status, body)
+	}
+	if status, body := e.call(t, "PUT", "/api/v1/cors", bearer(session), map[string]interface{}{"allowed_origins": []string{"https://admin.example.com"}}); status != http.StatusOK {
+		t.Errorf("PUT /api/v1/cors after the freeze: status %d: %v", status, body)
+	}
+	if !e.ut.detokenizesFor("api.stripe.com") {
+		t.Error("every destination should be detokenized for after maintenance")
+	}
+}
+
+// TestIntegrationFieldRules tests replacing CARD_FIELD_MAPPINGS and
+// DEEP_SCAN_FIELDS through the API and testing rules on a sample body
+func TestIntegrationFieldRules(t *testing.T) {
+	e := newIntegrationEnv(t, map[string]string{"DEEP_SCAN_FIELDS": "payload:json"})
+	e.createUser(t, "rulesadmin", RoleAdmin)
+	session := e.login(t, "rulesadmin")
+	card := testCards[0]
+
+	sample := map[string]interface{}{
+		"path":    "/api/subscribe",
+		"payload": map[string]string{"payload": `{"card_number":"` + card + `"}`, "data": `{"card_number":"` + card + `"}`},
+	}
+	fieldPaths := func(body map[string]interface{}) []string {
+		fields, _ := body["fields"].([]interface{})
+		paths := make([]string, 0, len(fields))
+		for _, f := range fields {
+			paths = append(paths, f.(map[string]interface{})["path"].(string))
+		}
+		return paths
+	}
+	status, body := e.call(t, "POST", "/api/v1/config/field-rules/test", bearer(session), sample)
+	if status != http.StatusOK || body["source"] != "config" || fmt.Sprint(fieldPaths(body)) != "[$.payload(json).card_number]" {
+		t.Fatalf("test under configured rules: status %d: %v", status, body)
+	}
+	if strings.Contains(fmt.Sprint(body), card) {
+		t.Error("test result should not contain the card number")
+	}
+
+	// Rules given with the test are tried without being applied
+	sample["rules"] = map[string]interface{}{"deep_scan_fields": "payload:json,data:json"}
+	status, body = e.call(t, "POST", "/api/v1/config/field-rules/test", bearer(session), sample)
+	if status != http.StatusOK || body["source"] != "request" || len(fieldPaths(body)) != 2 {
+		t.Fatalf("test under given rules: status %d: %v", status, body)
+	}
+	if status, body := e.call(t, "GET", "/api/v1/config/field-rules", bearer(session), nil); status != http.StatusOK || body["source"] != "config" {
+		t.Errorf("testing rules should not apply them: status %d: %v", status, body)
+	}
+
+	status, body = e.call(t, "PUT", "/api/v1/config/field-rules", bearer(session), map[string]interface{}{
+		"card_field_mappings": map[string]interface{}{"/api/subscribe": map[string]string{"expiry": "valid_thru"}},
+		"deep_scan_fields":    "data:json",
+	})
+	if status != http.StatusOK || body["source"] != "api" || body["updated_by"] != "rulesadmin" {
+		t.Fatalf("PUT /api/v1/config/field-rules: status %d: %v", status, body)
+	}
+	delete(sample, "rules")
+	status, body = e.call(t, "POST", "/api/v1/config/field-rules/test", bearer(session), sample)
+	if status != http.StatusOK || body["mapping"] != "/api/subscribe" || fmt.Sprint(fieldPaths(body)) != "[$.data(json).card_number]" {
+		t.Errorf("test under rules set through the API: status %d: %v", status, body)
+	}
+	if status, body := e.call(t, "PUT", "/api/v1/config/field-rules", bearer(session), map[string]interface{}{
+		"card_field_mappings": map[string]interface{}{"api": map[string]string{}},
+	}); status != http.StatusBadRequest {
+		t.Errorf("mapping without a leading /: status %d: %v", status, body)
+	}
+
+	status, body = e.call(t, "DELETE", "/api/v1/config/field-rules", bearer(session), nil)
+	if status != http.StatusOK || body["source"] != "config" {
+		t.Errorf("DELETE /api/v1/config/field-rules: status %d: %v", status, body)
+	}
+}
+
+// TestIntegrationIPFilters tests managing the listener IP filters, that
+// an admin cannot lock themselves out, and that blocked requests are logged
+func TestIntegrationIPFilters(t *testing.T) {
+	e := newIntegrationEnv(t, map[string]string{"ICAP_DENIED_CIDRS": "192.0.2.0/24"})
+	e.createUser(t, "ipadmin", RoleAdmin)
+	session := e.login(t, "ipadmin")
+
+	status, body := e.call(t, "GET", "/api/v1/ip-filters", bearer(session), nil)
+	if filters, _ := body["filters"].([]interface{}); status != http.StatusOK || len(filters) != 2 {
+		t.Fatalf("GET /api/v1/ip-filters: status %d: %v", status, body)
+	}
+	if e.ut.ipFilter("icap").AllowsRemote("192.0.2.5:1344") {
+		t.Error("ICAP_DENIED_CIDRS should apply until a filter is set")
+	}
+
+	// The test client connects from loopback
+	if status, body := e.call(t, "PUT", "/api/v1/ip-filters/api", bearer(session), map[string]interface{}{
+		"allow": []string{"10.0.0.0/8"},
+	}); status != http.StatusConflict {
+		t.Errorf("PUT locking out the caller: status %d: %v", status, body)
+	}
+	if status, body := e.call(t, "PUT", "/api/v1/ip-filters/api", bearer(session), map[string]interface{}{
+		"allow": []string{"10.0.0.0/8", "127.0.0.0/8", "::1"}, "deny": []string{"10.9.0.0/16"},
+	}); status != http.StatusOK || body["source"] != "api" || body["updated_by"] != "ipadmin" {
+		t.Fatalf("PUT /api/v1/ip-filters/api: status %d: %v", status, body)
+	}
+	if status, _ := e.call(t, "PUT", "/api/v1/ip-filters/smtp", bearer(session), map[string]interface{}{}); status != http.StatusNotFound {
+		t.Errorf("PUT for an unknown listener: status %d", status)
+	}
+	if status, _ := e.call(t, "PUT", "/api/v1/ip-filters/icap", bearer(session), map[string]interface{}{
+		"allow": []string{"not-a-cidr"},
+	}); status != http.StatusBadRequest {
+		t.Errorf("PUT with an invalid CIDR: status %d", status)
+	}
+	if e.ut.ipFilter("api").AllowsRemote("10.9.1.1:80") || !e.ut.ipFilter("api").AllowsRemote("10.1.1.1:80") {
+		t.Error("the filter set through the API should be in force")
+	}
+
+	// Block loopback directly, as another replica's change would
+	blocked := ipfilter.Filter{Deny: []string{"0.0.0.0/0", "::/0"}}
+	blocked.Normalize()
+	e.ut.ipFilters.Store(&map[string]*ipfilter.Filter{"api": &blocked})
+	for i := 0; i < 3; i++ {
+		if status, _ := e.call(t, "GET", "/api/v1/users", bearer(session), nil); status != http.StatusForbidden {
+			t.Errorf("request from a blocked address: status %d", status)
+		}
+	}
+	if status, _ := e.call(t, "GET", "/health", nil, nil); status != http.StatusOK {
+		t.Errorf("/health from a blocked address: status %d", status)
+	}
+	var events int
+	e.ut.db.QueryRow("SELECT COUNT(*) FROM security_audit_log WHERE event_type = 'ip_blocked'").Scan(&events)
+	if events != 1 {
+		t.Errorf("ip_blocked events = %d, want 1 for repeated attempts", events)
+	}
+
+	states, err := e.ut.loadIPFilters()
+	if err != nil {
+		t.Fatal(err)
+	}
+	e.ut.storeIPFilters(states)
+	status, body = e.call(t, "DELETE", "/api/v1/ip-filters/api", bearer(session), nil)
+	if status != http.StatusOK || body["source"] != "config" {
+		t.Errorf("DELETE /api/v1/ip-filters/api: status %d: %v", status, body)
+	}
+}
+
+// TestIntegrationDetokenizeQuotas tests that card reveals are limited per
+// user and per API key, and that quotas can be overridden and reported
+func TestIntegrationDetokenizeQuotas(t *testing.T) {
+	e := newIntegrationEnv(t, map[string]string{"DETOKENIZE_QUOTA_HOURLY": "2"})
+	e.createUser(t, "quotaadmin", RoleAdmin)
+	session := bearer(e.login(t, "quotaadmin"))
+	token := checkRoundTrip(t, e, "4532015112830366")
+	reveal := func(header http.Header) (int, map[string]interface{}) {
+		return e.call(t, "POST", "/api/v1/tokens/"+token+"/reveal", header, map[string]string{"reason": "chargeback"})
+	}
+
+	_, created := e.call(t, "POST", "/api/v1/api-keys", session, map[string]string{"client_name": "quota"})
+	apiKey := created["api_key"].(string)
+	if status, body := e.call(t, "PUT", "/api/v1/quotas/api-keys/"+apiKey, session, map[string]interface{}{"hourly_limit": 1}); status != http.StatusOK || body["source"] != "override" {
+		t.Fatalf("PUT key quota: status %d: %v", status, body)
+	}
+
+	// A user's API key is charged to the key and to the user
+	if status, body := reveal(apiKeyHeader(apiKey)); status != http.StatusOK {
+		t.Fatalf("first reveal with the key: status %d: %v", status, body)
+	}
+	if status, body := reveal(apiKeyHeader(apiKey)); status != http.StatusTooManyRequests || body["quota"] != "api_key" {
+		t.Errorf("second reveal with the key: status %d: %v", status, body)
+	}
+	if status, _ := reveal(session); status != http.StatusOK {
+		t.Errorf("reveal with the session: status %d", status)
+	}
+	status, body := reveal(session)
+	if status != http.StatusTooManyRequests || body["quota"] != "user" || body["period"] != "hour" {
+		t.Errorf("reveal over the user quota: status %d: %v", status, body)
+	}
+
+	status, body = e.call(t, "GET", "/api/v1/quotas/me", session, nil)
+	quotas, _ := body["quotas"].([]interface{})
+	if status != http.StatusOK || len(quotas) != 1 {
+		t.Fatalf("GET /api/v1/quotas/me: status %d: %v", status, body)
+	}
+	if hourly := quotas[0].(map[string]interface{})["hourly"].(map[string]interface{}); hourly["used"] != 2.0 || hourly["limit"] != 2.0 {
+		t.Errorf("hourly usage = %v, want 2 of 2 (refused reveals are not counted)", hourly)
+	}
+
+	if status, _ := e.call(t, "PUT", "/api/v1/quotas/users/usr_quotaadmin", session, map[string]interface{}{"hourly_limit": 0}); status != http.StatusOK {
+		t.Errorf("PUT user quota: status %d", status)
+	}
+	if status, _ := reveal(session); status != http.StatusOK {
+		t.Errorf("reveal with an unlimited hourly quota: status %d", status)
+	}
+	if status, _ := e.call(t, "PUT", "/api/v1/quotas/users/usr_nobody", session, map[string]interface{}{"hourly_limit": 5}); status != http.StatusNotFound {
+		t.Errorf("PUT quota for an unknown user: status %d", status)
+	}
+	if status, _ := e.call(t, "PUT", "/api/v1/quotas/users/usr_quotaadmin", session, map[string]interface{}{"daily_limit": -1}); status != http.StatusBadRequest {
+		t.Errorf("PUT a negative quota: status %d", status)
+	}
+	status, body = e.call(t, "GET", "/api/v1/quotas", session, nil)
+	if overrides, _ := body["overrides"].([]interface{}); status != http.StatusOK || len(overrides) != 2 {
+		t.Errorf("GET /api/v1/quotas: status %d: %v", status, body)
+	}
+	if status, body := e.call(t, "DELETE", "/api/v1/quotas/users/usr_quotaadmin", session, nil); status != http.StatusOK || body["source"] != "default" {
+		t.Errorf("DELETE user quota: status %d: %v", status, body)
+	}
+
+	var events int
+	e.ut.db.QueryRow("SELECT COUNT(*) FROM security_audit_log WHERE event_type = 'detokenize_quota_exceeded'").Scan(&events)
+	if events != 2 {
+		t.Errorf("detokenize_quota_exceeded events = %d, want 2", events)
+	}
+}
+
+// TestIntegrationRateLimitRules tests rules set through the API, with
+// counters kept in the database
+func TestIntegrationRateLimitRules(t *testing.T) {
+	e := newIntegrationEnv(t, map[string]string{"TEST_MODE": "false", "RATE_LIMIT_BACKEND": "database"})
+	e.createUser(t, "limitadmin", RoleAdmin)
+	admin := bearer(e.login(t, "limitadmin"))
+
+	status, body := e.call(t, "GET", "/api/v1/rate-limits", admin, nil)
+	if rules, _ := body["rules"].([]interface{}); status != http.StatusOK || body["source"] != "config" || len(rules) != 1 {
+		t.Fatalf("GET /api/v1/rate-limits: status %d: %v", status, body)
+	}
+	if status, _ := e.call(t, "PUT", "/api/v1/rate-limits", admin, map[string]interface{}{
+		"rules": []map[string]interface{}{{"class": "read", "scope": "ip", "limit": 0, "window": "1m"}},
+	}); status != http.StatusBadRequest {
+		t.Errorf("PUT with a zero limit: status %d", status)
+	}
+	status, body = e.call(t, "PUT", "/api/v1/rate-limits", admin, map[string]interface{}{
+		"rules": []map[string]interface{}{
+			{"class": "auth", "scope": "ip", "limit": 5, "window": "15m", "block": "15m"},
+			{"class": "read", "scope": "key", "limit": 3, "window": "1h"},
+		},
+	})
+	if status != http.StatusOK || body["source"] != "api" || body["updated_by"] != "limitadmin" {
+		t.Fatalf("PUT /api/v1/rate-limits: status %d: %v", status, body)
+	}
+
+	// The read rule counts per session, so a second session is unaffected
+	other := bearer(e.login(t, "limitadmin"))
+	for i := 0; i < 3; i++ {
+		if status, _ := e.call(t, "GET", "/api/v1/stats", other, nil); status != http.StatusOK {
+			t.Fatalf("read %d: status %d", i+1, status)
+		}
+	}
+	if status, body := e.call(t, "GET", "/api/v1/stats", other, nil); status != http.StatusTooManyRequests || body["retry_after"] == nil {
+		t.Errorf("read over the limit: status %d: %v", status, body)
+	}
+	if status, _ := e.call(t, "GET", "/api/v1/stats", admin, nil); status != http.StatusOK {
+		t.Errorf("read with another session: status %d", status)
+	}
+	var counters int
+	e.ut.db.QueryRow("SELECT COUNT(*) FROM rate_limit_counters").Scan(&counters)
+	if counters == 0 {
+		t.Error("no counters stored with RATE_LIMIT_BACKEND=database")
+	}
+
+	status, body = e.call(t, "DELETE", "/api/v1/rate-limits", admin, nil)
+	if status != http.StatusOK || body["source"] != "config" {
+		t.Errorf("DELETE /api/v1/rate-limits: status %d: %v", status, body)
+	}
+	if status, _ := e.call(t, "GET", "/api/v1/stats", other, nil); status != http.StatusOK {
+		t.Errorf("read after the rules were reset: status %d", status)
+	}
+
+	// The proxy class limits requests through the proxy port
+	if status, body := e.call(t, "PUT", "/api/v1/rate-limits", admin, map[string]interface{}{
+		"rules": []map[string]interface{}{{"class": "proxy", "scope": "ip", "limit": 2, "window": "1h"}},
+	}); status != http.StatusOK {
+		t.Fatalf("PUT a proxy rule: status %d: %v", status, body)
+	}
+	for i, want := range []int{http.StatusOK, http.StatusOK, http.StatusTooManyRequests} {
+		resp, err := http.Get(e.proxy.URL + "/api/orders")
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != want {
+			t.Errorf("proxy request %d: status %d, want %d", i+1, resp.StatusCode, want)
+		}
+	}
+	e.call(t, "DELETE", "/api/v1/rate-limits", admin, nil)
+}
+
+// TestIntegrationCSRF tests that the session cookie alone cannot change
+// state, while Bearer sessions are unaffected
+func TestIntegrationCSRF(t *testing.T) {
+	e := newIntegrationEnv(t, nil)
+	e.createUser(t, "csrfadmin", RoleAdmin)
+	session := e.login(t, "csrfadmin")
+	cookie := http.Header{"Cookie": {"session_id=" + session}}
+	policy := map[string]interface{}{"allowed_origins": []string{"https://admin.example.com"}}
+
+	if status, _ := e.call(t, "GET", "/api/v1/cors", cookie, nil); status != http.StatusOK {
+		t.Errorf("GET with the session cookie: status %d", status)
+	}
+	if status, body := e.call(t, "PUT", "/api/v1/cors", cookie, policy); status != http.StatusForbidden {
+		t.Errorf("PUT with the session cookie and no CSRF token: status %d: %v", status, body)
+	}
+	cookie.Set("X-CSRF-Token", csrfToken(session+"x"))
+	if status, _ := e.call(t, "PUT", "/api/v1/cors", cookie, policy); status != http.StatusForbidden {
+		t.Errorf("PUT with another session's CSRF token: status %d", status)
+	}
+	cookie.Set("X-CSRF-Token", csrfToken(session))
+	if status, body := e.call(t, "PUT", "/api/v1/cors", cookie, policy); status != http.StatusOK {
+		t.Errorf("PUT with the CSRF token: status %d: %v", status, body)
+	}
+	if status, _ := e.call(t, "DELETE", "/api/v1/cors", bearer(session), nil); status != http.StatusOK {
+		t.Errorf("DELETE with a Bearer session: status %d", status)
+	}
+
+	var events int
+	e.ut.db.QueryRow("SELECT COUNT(*) FROM security_audit_log WHERE event_type = 'csrf_rejected'").Scan(&events)
+	if events != 2 {
+		t.Errorf("%d csrf_rejected events, want 2", events)
+	}
+}
+
+// TestIntegrationKEKDEK tests round trips with envelope encryption,
+// including tokens encrypted under a DEK that has since been rotated
+func TestIntegrationKEKDEK(t *testing.T) {
+	e := newIntegrationEnv(t, map[string]string{
+		"USE_KEK_DEK":    "true",
+		"KEK_PASSPHRASE": "integration test passphrase",
+	})
+	if !e.ut.useKEKDEK || e.ut.keyManager == nil {
+		t.Fatal("KeyManager did not initialize")
+	}
+
+	oldDEK := e.ut.keyManager.getCurrentDEKID()
+	oldToken := checkRoundTrip(t, e, testCards[1])
+
+	var keyID sql.NullString
+	if err := e.ut.db.QueryRow("SELECT encryption_key_id FROM credit_cards WHERE token = ?", oldToken).Scan(&keyID); err != nil {
+		t.Fatal(err)
+	}
+	if keyID.String != oldDEK {
+		t.Errorf("card stored with key ID %q, want current DEK %q", keyID.String, oldDEK)
+	}
+
+	if err := e.ut.keyManager.RotateDEK(); err != nil {
+		t.Fatalf("RotateDEK() failed: %v", err)
+	}
+	if e.ut.keyManager.getCurrentDEKID() == oldDEK {
+		t.Fatal("DEK did not change after rotation")
+	}
+	newToken := checkRoundTrip(t, e, testCards[2])
+	if err := e.ut.db.QueryRow("SELECT encryption_key_id FROM credit_cards WHERE token = ?", newToken).Scan(&keyID); err != nil {
+		t.Fatal(err)
+	}
+	if keyID.String == oldDEK {
+		t.Error("card tokenized after rotation still uses the old DEK")
+	}
+	if got := e.ut.retrieveCard(oldToken); got != testCards[1] {
+		t.Errorf("token under the rotated DEK detokenized to %q", got)
+	}
+
+	// A tokenizer restarted with the same passphrase unwraps the stored keys
+	restarted, err := NewUnifiedTokenizer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer restarted.db.Close()
+	defer restarted.stmts.Close()
+	if got := restarted.retrieveCard(oldToken); got != testCards[1] {
+		t.Errorf("after restart, token detokenized to %q", got)
+	}
+}
+
+// TestIntegrationICAPFraming tests the ICAP responses a client sees for
+// each method and body shape
+func TestIntegrationICAPFraming(t *testing.T) {
+	e := newIntegrationEnv(t, nil)
+
+	options := e.icapExchange(t, fmt.Sprintf("OPTIONS icap://%s/reqmod ICAP/1.0\r\nHost: %s\r\n\r\n", e.icapAddr, e.icapAddr))
+	if options.Status != 200 || options.Headers["Methods"] != "REQMOD" || options.Headers["ISTag"] == "" {
+		t.Errorf("OPTIONS reqmod = %d %v", options.Status, options.Headers)
+	}
+	if options.Headers["Max-Connections"] != strconv.Itoa(e.ut.icapServer.MaxConnections) {
+		t.Errorf("Max-Connections = %q, want the pool size %d", options.Headers["Max-Connections"], e.ut.icapServer.MaxConnections)
+	}
+	options = e.icapExchange(t, fmt.Sprintf("OPTIONS icap://%s/respmod ICAP/1.0\r\nHost: %s\r\n\r\n", e.icapAddr, e.icapAddr))
+	if options.Headers["Methods"] != "RESPMOD" {
+		t.Errorf("OPTIONS respmod Methods = %q", options.Headers["Methods"])
+	}
+
+	// Bodies without known tokens are left alone
+	for _, body := range []string{`{"amount":10}`, `{"card":"tok_unknown"}`, ""} {
+		if resp := e.icapExchange(t, reqmodRequest(e.icapAddr, body)); resp.Status != 204 {
+			t.Errorf("REQMOD %q: ICAP %d, want 204", body, resp.Status)
+		}
+	}
+
+	// Card numbers in JSON responses are tokenized
+	resp := e.icapExchange(t, respmodRequest(e.icapAddr, "application/json", `{"card_number":"`+testCards[3]+`"}`))
+	if resp.Status != 200 {
+		t.Fatalf("RESPMOD with a card: ICAP %d, want 200", resp.Status)
+	}
+	if !strings.HasPrefix(resp.Headers["Encapsulated"], "res-hdr=0, res-body=") || !strings.HasPrefix(resp.Encapsulated, "HTTP/1.1 200 OK\r\n") {
+		t.Errorf("RESPMOD Encapsulated %q with headers %q", resp.Headers["Encapsulated"], resp.Encapsulated)
+	}
+	var tokenized map[string]string
+	if err := json.Unmarshal([]byte(resp.Body), &tokenized); err != nil {
+		t.Fatalf("RESPMOD body %q: %v", resp.Body, err)
+	}
+	if got := e.ut.retrieveCard(tokenized["card_number"]); got != testCards[3] {
+		t.Errorf("RESPMOD token %q detokenizes to %q", tokenized["card_number"], got)
+	}
+	if !strings.Contains(resp.Encapsulated, fmt.Sprintf("Content-Length: %d\r\n", len(resp.Body))) {
+		t.Errorf("RESPMOD did not update Content-Length: %q", resp.Encapsulated)
+	}
+
+	for _, r := range []struct{ contentType, body string }{
+		{"application/json", ""},
+		{"text/plain", testCards[3]},
+		{"application/json", `{"amount":10}`},
+	} {
+		if resp := e.icapExchange(t, respmodRequest(e.icapAddr, r.contentType, r.body)); resp.Status != 204 {
+			t.Errorf("RESPMOD %s %q: ICAP %d, want 204", r.contentType, r.body, resp.Status)
+		}
+	}
+}
+
+// TestIntegrationICAPSecret tests ICAP_SHARED_SECRET and that a field
+// rule change gives the service a new ISTag
+func TestIntegrationICAPSecret(t *testing.T) {
+	e := newIntegrationEnv(t, map[string]string{"ICAP_SHARED_SECRET": "s3cret"})
+	e.createUser(t, "icapadmin", RoleAdmin)
+	session := e.login(t, "icapadmin")
+
+	request := reqmodRequest(e.icapAddr, `{"amount":10}`)
+	if resp := e.icapExchange(t, request); resp.Status != 403 {
+		t.Errorf("REQMOD without the secret: ICAP %d, want 403", resp.Status)
+	}
+	withSecret := strings.Replace(request, "\r\nEncapsulated:", "\r\n"+icap.SecretHeader+": s3cret\r\nEncapsulated:", 1)
+	resp := e.icapExchange(t, withSecret)
+	if resp.Status != 204 || resp.Headers["ISTag"] == "" {
+		t.Fatalf("REQMOD with the secret: ICAP %d %v, want 204", resp.Status, resp.Headers)
+	}
+
+	if status, body := e.call(t, "PUT", "/api/v1/config/field-rules", bearer(session), map[string]interface{}{
+		"deep_scan_fields": "payload:json",
+	}); status != http.StatusOK {
+		t.Fatalf("PUT /api/v1/config/field-rules: status %d: %v", status, body)
+	}
+	if after := e.icapExchange(t, withSecret); after.Headers["ISTag"] == resp.Headers["ISTag"] {
+		t.Errorf("ISTag %s did not change with the field rules", after.Headers["ISTag"])
+	}
+
+	var events int
+	e.ut.db.QueryRow("SELECT COUNT(*) FROM security_audit_log WHERE event_type = 'icap_auth_failed'").Scan(&events)
+	if events != 1 {
+		t.Errorf("%d icap_auth_failed events, want 1", events)
+	}
+}
+
+// TestIntegrationCardImport tests bulk imports in both formats and the
+// duplicate handling modes
+func TestIntegrationCardImport(t *testing.T) {
+	e := newIntegrationEnv(t, nil)
+	e.createUser(t, "importer", RoleAdmin)
+	session := bearer(e.login(t, "importer"))
+	year := time.Now().Year() + 2
+
+	importCards := func(format, data, duplicates string) (int, map[string]interface{}) {
+		return e.call(t, "POST", "/api/v1/cards/import", session, map[string]interface{}{
+			"format":             format,
+			"duplicate_handling": duplicates,
+			"data":               base64.StdEncoding.EncodeToString([]byte(data)),
+		})
+	}
+	tokens := func(result map[string]interface{}) []string {
+		var found []string
+		generated, _ := result["tokens_generated"].([]interface{})
+		for _, g := range generated {
+			found = append(found, g.(map[string]interface{})["token"].(string))
+		}
+		return found
+	}
+
+	records, _ := json.Marshal([]CardImportRecord{
+		{CardNumber: testCards[0], CardHolder: "Ada Lovelace", ExpiryMonth: 1, ExpiryYear: year, ExternalID: "a"},
+		{CardNumber: testCards[1], ExpiryMonth: 2, ExpiryYear: year, ExternalID: "b"},
+	})
+	status, result := importCards("json", string(records), "skip")
+	if status != http.StatusOK || result["successful_imports"] != float64(2) {
+		t.Fatalf("JSON import: status %d: %v", status, result)
+	}
+	for i, token := range tokens(result) {
+		if got := e.ut.retrieveCard(token); got != testCards[i] {
+			t.Errorf("imported token %s detokenizes to %q, want %s", token, got, testCards[i])
+		}
+	}
+
+	csv := fmt.Sprintf("card_number,expiry_month,expiry_year,external_id\n%s,3,%d,c\n%s,4,%d,d\n", testCards[1], year, testCards[2], year)
+	status, result = importCards("csv", csv, "skip")
+	if status != http.StatusOK || result["successful_imports"] != float64(1) || result["duplicates"] != float64(1) {
+		t.Errorf("CSV import with a duplicate skipped: status %d: %v", status, result)
+	}
+
+	status, result = importCards("csv", csv, "error")
+	if status != http.StatusBadRequest || result["failed_imports"] != float64(2) {
+		t.Errorf("CSV import with duplicates as errors: status %d: %v", status, result)
+	}
+
+	invalid, _ := json.Marshal([]CardImportRecord{{CardNumber: "4532015112830367", ExpiryMonth: 1, ExpiryYear: year}})
+	status, result = importCards("json", string(invalid), "skip")
+	if status != http.StatusBadRequest || result["failed_imports"] != float64(1) {
+		t.Errorf("import of a card failing Luhn: status %d: %v", status, result)
+	}
+
+	// Compressed CSV with another delimiter and header names; errors give
+	// the line of the record
+	var gz bytes.Buffer
+	zw := gzip.NewWriter(&gz)
+	fmt.Fprintf(zw, "PAN;Exp Month;Exp Year;Name\n\n4532015112830367;1;%d;\"Doe; John\"\n", year)
+	zw.Close()
+	status, result = e.call(t, "POST", "/api/v1/cards/import", session, map[string]interface{}{
+		"format":      "csv",
+		"compression": "gzip",
+		"csv":         map[string]interface{}{"delimiter": ";"},
+		"data":        base64.StdEncoding.EncodeToString(gz.Bytes()),
+	})
+	if errs, _ := result["errors"].([]interface{}); status != http.StatusBadRequest || len(errs) != 1 || errs[0].(map[string]interface{})["line"] != float64(3) {
+		t.Errorf("gzip CSV import of a card failing Luhn: status %d: %v", status, result)
+	}
+	status, result = importCards("csv", "card_number,expiry_month,expiry_year\n4111111111111111,x,2030\n", "skip")
+	details, _ := result["details"].(map[string]interface{})
+	if rows, _ := details["rows"].([]interface{}); status != http.StatusBadRequest || len(rows) != 1 {
+		t.Errorf("CSV import of an unreadable row: status %d: %v", status, result)
+	}
+
+	var count int
+	e.ut.db.QueryRow("SELECT COUNT(*) FROM credit_cards").Scan(&count)
+	if count != 3 {
+		t.Errorf("%d cards stored, want 3", count)
+	}
+
+	// Importing needs system.admin
+	e.createUser(t, "operator", RoleOperator)
+	status, _ = e.call(t, "POST", "/api/v1/cards/import", bearer(e.login(t, "operator")), map[string]interface{}{
+		"format": "json",
+		"data":   base64.StdEncoding.EncodeToString(records),
+	})
+	if status != http.StatusForbidden {
+		t.Errorf("import as operator: status %d, want 403", status)
+	}
+}
+
+// TestIntegrationCardImportFixedWidth tests importing an acquirer-style
+// fixed-width file with header and trailer records
+func TestIntegrationCardImportFixedWidth(t *testing.T) {
+	e := newIntegrationEnv(t, nil)
+	e.createUser(t, "fixedimporter", RoleAdmin)
+	session := bearer(e.login(t, "fixedimporter"))
+	yy := time.Now().Year()%100 + 2
+
+	data := fmt.Sprintf("H%s ACQUIRER\nD%s%02d12ref-a\nD%s%02d01ref-b\nT2\n", time.Now().Format("20060102"), testCards[0], yy, testCards[1], yy+1)
+	status, result := e.call(t, "POST", "/api/v1/cards/import", session, map[string]interface{}{
+		"format": "fixed",
+		"fixed_width": map[string]interface{}{
+			"columns":       map[string]string{"card_number": "2-17", "expiry": "18-21", "external_id": "22-26"},
+			"expiry_format": "YYMM",
+			"record_prefix": "D",
+		},
+		"data": base64.StdEncoding.EncodeToString([]byte(data)),
+	})
+	if status != http.StatusOK || result["successful_imports"] != float64(2) {
+		t.Fatalf("fixed-width import: status %d: %v", status, result)
+	}
+	generated := result["tokens_generated"].([]interface{})
+	for i, g := range generated {
+		token := g.(map[string]interface{})["token"].(string)
+		if got := e.ut.retrieveCard(token); got != testCards[i] {
+			t.Errorf("imported token %s detokenizes to %q, want %s", token, got, testCards[i])
+		}
+	}
+
+	status, _ = e.call(t, "POST", "/api/v1/cards/import", session, map[string]interface{}{
+		"format":      "fixed",
+		"fixed_width": map[string]interface{}{"columns": map[string]string{"card_number": "2-17"}},
+		"data":        base64.StdEncoding.EncodeToString([]byte(data)),
+	})
+	if status != http.StatusBadRequest {
+		t.Errorf("fixed-width import without an expiry column: status %d, want 400", status)
+	}
+}
+
+// TestIntegrationCardImportValidateOnly tests that a preflight import reports
+// what an import would do, including cards repeated in the file, and stores
+// nothing
+func TestIntegrationCardImportValidateOnly(t *testing.T) {
+	e := newIntegrationEnv(t, nil)
+	e.createUser(t, "preflight", RoleAdmin)
+	session := bearer(e.login(t, "preflight"))
+	year := time.Now().Year() + 2
+
+	stored, _ := json.Marshal([]CardImportRecord{{CardNumber: testCards[0], ExpiryMonth: 1, ExpiryYear: year}})
+	if status, result := e.call(t, "POST", "/api/v1/cards/import", session, map[string]interface{}{
+		"format": "json",
+		"data":   base64.StdEncoding.EncodeToString(stored),
+	}); status != http.StatusOK {
+		t.Fatalf("import: status %d: %v", status, result)
+	}
+
+	csv := fmt.Sprintf("card_number,expiry_month,expiry_year\n%s,1,%d\n%s,2,%d\n%s,3,%d\n4532015112830367,4,%d\n",
+		testCards[0], year, testCards[1], year, testCards[1], year, year)
+	preflight := func(duplicates string) (int, map[string]interface{}) {
+		return e.call(t, "POST", "/api/v1/cards/import", session, map[string]interface{}{
+			"format":             "csv",
+			"duplicate_handling": duplicates,
+			"validate_only":      true,
+			"data":               base64.StdEncoding.EncodeToString([]byte(csv)),
+		})
+	}
+	status, result := preflight("skip")
+	if status != http.StatusPartialContent || result["validate_only"] != true ||
+		result["successful_imports"] != float64(1) || result["duplicates"] != float64(2) || result["failed_imports"] != float64(1) {
+		t.Errorf("preflight with duplicates skipped: status %d: %v", status, result)
+	}
+	if generated, _ := result["tokens_generated"].([]interface{}); len(generated) != 1 || generated[0].(map[string]interface{})["token"] != nil {
+		t.Errorf("preflight should report the card without a token: %v", generated)
+	}
+
+	status, result = preflight("error")
+	if status != http.StatusPartialContent || result["failed_imports"] != float64(3) {
+		t.Errorf("preflight with duplicates as errors: status %d: %v", status, result)
+	}
+
+	var count int
+	e.ut.db.QueryRow("SELECT COUNT(*) FROM credit_cards").Scan(&count)
+	if count != 1 {
+		t.Errorf("%d cards stored after preflight, want 1", count)
+	}
+}
+
+// TestIntegrationRegions tests tokens namespaced by region and importing the
+// same cards in a second region
+func TestIntegrationRegions(t *testing.T) {
+	e := newIntegrationEnv(t, map[string]string{"REGION": "eu1"})
+	e.createUser(t, "regionadmin", RoleAdmin)
+	session := bearer(e.login(t, "regionadmin"))
+	year := time.Now().Year() + 2
+
+	records, _ := json.Marshal([]CardImportRecord{{CardNumber: testCards[0], ExpiryMonth: 1, ExpiryYear: year}})
+	importCards := func(duplicates string) []interface{} {
+		status, result := e.call(t, "POST", "/api/v1/cards/import", session, map[string]interface{}{
+			"format":             "json",
+			"duplicate_handling": duplicates,
+			"data":               base64.StdEncoding.EncodeToString(records),
+		})
+		if status != http.StatusOK {
+			t.Fatalf("import with %s: status %d: %v", duplicates, status, result)
+		}
+		generated, _ := result["tokens_generated"].([]interface{})
+		return generated
+	}
+	first := importCards("skip")
+	if len(first) != 1 {
+		t.Fatalf("first import generated %v", first)
+	}
+	token := first[0].(map[string]interface{})["token"].(string)
+	if !strings.HasPrefix(token, "tok_eu1_") {
+		t.Errorf("token %s should be namespaced by REGION", token)
+	}
+	var stored string
+	e.ut.db.QueryRow("SELECT region FROM credit_cards WHERE token = ?", token).Scan(&stored)
+	if stored != "eu1" {
+		t.Errorf("card stored with region %q, want eu1", stored)
+	}
+
+	again := importCards("reuse")
+	if len(again) != 1 || again[0].(map[string]interface{})["token"] != token || again[0].(map[string]interface{})["existing"] != true {
+		t.Errorf("import with reuse should report the existing token %s: %v", token, again)
+	}
+	var count int
+	e.ut.db.QueryRow("SELECT COUNT(*) FROM credit_cards").Scan(&count)
+	if count != 1 {
+		t.Errorf("%d cards stored, want 1", count)
+	}
+
+	status, body := e.call(t, "GET", "/api/v1/tokens/"+token, session, nil)
+	if status != http.StatusOK || body["region"] != "eu1" {
+		t.Errorf("GET token: status %d: %v", status, body)
+	}
+}
+
+// TestIntegrationConcurrentTokenization tests that concurrent requests
+// tokenizing one card, and an import racing with them, agree on one token
+func TestIntegrationConcurrentTokenization(t *testing.T) {
+	e := newIntegrationEnv(t, map[string]string{"DETERMINISTIC_TOKENS": "true"})
+	e.createUser(t, "raceadmin", RoleAdmin)
+	session := bearer(e.login(t, "raceadmin"))
+	year := time.Now().Year() + 2
+
+	records, _ := json.Marshal([]CardImportRecord{{CardNumber: testCards[0], ExpiryMonth: 1, ExpiryYear: year}})
+	var wg sync.WaitGroup
+	tokens := make([]string, 8)
+	for i := range tokens {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if i == 0 {
+				status, result := e.call(t, "POST", "/api/v1/cards/import", session, map[string]interface{}{
+					"format":             "json",
+					"duplicate_handling": "reuse",
+					"data":               base64.StdEncoding.EncodeToString(records),
+				})
+				if generated, _ := result["tokens_generated"].([]interface{}); status == http.StatusOK && len(generated) == 1 {
+					tokens[i], _ = generated[0].(map[string]interface{})["token"].(string)
+				}
+				return
+			}
+			token, err := e.ut.tokenizeCard(testCards[0], cardDetails{})
+			if err != nil {
+				t.Errorf("tokenize: %v", err)
+			}
+			tokens[i] = token
+		}(i)
+	}
+	wg.Wait()
+	for i, token := range tokens {
+		if token == "" || token != tokens[1] {
+			t.Fatalf("concurrent tokenizations gave different tokens: %d: %q, want %q", i, token, tokens[1])
+		}
+	}
+	var count int
+	e.ut.db.QueryRow("SELECT COUNT(*) FROM credit_cards").Scan(&count)
+	if count != 1 {
+		t.Errorf("%d cards stored, want 1", count)
+	}
+
+	// Once the token is revoked, the card's claim is taken over by a new one
+	if status, body := e.call(t, "DELETE", "/api/v1/tokens/"+tokens[1], session, nil); status != http.StatusOK {
+		t.Fatalf("revoke: status %d: %v", status, body)
+	}
+	token, err := e.ut.tokenizeCard(testCards[0], cardDetails{})
+	if err != nil || token == tokens[1] {
+		t.Errorf("tokenize after revoking: %q, %v; want a new token", token, err)
+	}
+	var claimed string
+	e.ut.db.QueryRow("SELECT token FROM card_claims").Scan(&claimed)
+	if claimed != token {
+		t.Errorf("card claimed by %q, want %q", claimed, token)
+	}
+
+	// An invalid card fails alone; the valid one beside it is stored and
+	// claimed
+	mixed, _ := json.Marshal([]CardImportRecord{
+		{CardNumber: testCards[1], ExpiryMonth: 1, ExpiryYear: year},
+		{CardNumber: "4532015112830367", ExpiryMonth: 1, ExpiryYear: year},
+	})
+	_, result := e.call(t, "POST", "/api/v1/cards/import", session, map[string]interface{}{
+		"format": "json",
+		"data":   base64.StdEncoding.EncodeToString(mixed),
+	})
+	if result["successful_imports"] != float64(1) || result["failed_imports"] != float64(1) || result["status"] != "partial" {
+		t.Errorf("import with an invalid card: %v", result)
+	}
+	e.ut.db.QueryRow("SELECT COUNT(*) FROM card_claims").Scan(&count)
+	if count != 2 {
+		t.Errorf("%d card claims, want 2", count)
+	}
+}
+
+// TestIntegrationStatsCounters tests that stats come from the counters kept
+// as cards are stored, revoked and detokenized, and that a recount corrects
+// them
+func TestIntegrationStatsCounters(t *testing.T) {
+	e := newIntegrationEnv(t, nil)
+	e.createUser(t, "statsadmin", RoleAdmin)
+	session := bearer(e.login(t, "statsadmin"))
+	year := time.Now().Year() + 2
+
+	records, _ := json.Marshal([]CardImportRecord{
+		{CardNumber: testCards[0], ExpiryMonth: 1, ExpiryYear: year},
+		{CardNumber: testCards[1], ExpiryMonth: 2, ExpiryYear: year},
+	})
+	status, result := e.call(t, "POST", "/api/v1/cards/import", session, map[string]interface{}{
+		"format": "json",
+		"data":   base64.StdEncoding.EncodeToString(records),
+	})
+	if status != http.StatusOK {
+		t.Fatalf("import: status %d: %v", status, result)
+	}
+	token := result["tokens_generated"].([]interface{})[0].(map[string]interface{})["token"].(string)
+	if status, body := e.call(t, "DELETE", "/api/v1/tokens/"+token, session, nil); status != http.StatusOK {
+		t.Fatalf("revoke: status %d: %v", status, body)
+	}
+	e.ut.logTokenRequest(token, "detokenize", token[len(token)-4:])
+
+	stats := func() map[string]interface{} {
+		if err := e.ut.counters.Flush(e.ut.db); err != nil {
+			t.Fatal(err)
+		}
+		status, body := e.call(t, "GET", "/api/v1/stats", session, nil)
+		if status != http.StatusOK {
+			t.Fatalf("stats: status %d: %v", status, body)
+		}
+		return body
+	}
+	body := stats()
+	if body["active_tokens"] != float64(1) {
+		t.Errorf("active_tokens %v, want 1", body["active_tokens"])
+	}
+	if requests, _ := body["requests_24h"].(map[string]interface{}); requests["detokenize"] != float64(1) {
+		t.Errorf("requests_24h %v, want one detokenize", body["requests_24h"])
+	}
+
+	// Changed behind the application's back, then recounted
+	e.ut.db.Exec("UPDATE credit_cards SET is_active = TRUE")
+	if body := stats(); body["active_tokens"] != float64(1) {
+		t.Errorf("active_tokens %v before the recount, want 1", body["active_tokens"])
+	}
+	status, body = e.call(t, "POST", "/api/v1/stats/recount", session, nil)
+	if status != http.StatusOK || body["active_tokens"] != float64(2) {
+		t.Fatalf("recount: status %d: %v", status, body)
+	}
+	if body := stats(); body["active_tokens"] != float64(2) {
+		t.Errorf("active_tokens %v after the recount, want 2", body["active_tokens"])
+	}
+}
+
+// TestIntegrationRequestArchive tests that token requests past their
+// retention are moved to token_requests_archive and the rest are left
+func TestIntegrationRequestArchive(t *testing.T) {
+	e := newIntegrationEnv(t, map[string]string{"TOKEN_REQUEST_RETENTION_DAYS": "30"})
+	token, err := e.ut.generateToken()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := e.ut.storeCard(token, testCards[0], cardDetails{}); err != nil {
+		t.Fatal(err)
+	}
+	for _, age := range []int{90, 60, 1} {
+		if _, err := e.ut.db.Exec(`
+			INSERT INTO token_requests (token, request_type, request_timestamp)
+			VALUES (?, 'detokenize', DATE_SUB(NOW(), INTERVAL ? DAY))`, token, age); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	e.ut.archiveTokenRequests()
+	var kept, archived int
+	e.ut.db.QueryRow("SELECT COUNT(*) FROM token_requests").Scan(&kept)
+	e.ut.db.QueryRow("SELECT COUNT(*) FROM token_requests_archive WHERE token = ?", token).Scan(&archived)
+	// The tokenize request of storeCard and the one a day old are kept
+	if kept != 2 || archived != 2 {
+		t.Errorf("%d requests kept and %d archived, want 2 and 2", kept, archived)
+	}
+	if n := atomic.LoadInt64(&e.ut.requestsArchived); n != 2 {
+		t.Errorf("requestsArchived = %d, want 2", n)
+	}
+}
+
+// TestIntegrationIndexes tests that the migrations create the expected
+// indexes, and that /readyz reports one that is missing
+func TestIntegrationIndexes(t *testing.T) {
+	e := newIntegrationEnv(t, nil)
+	missing, err := migrate.MissingIndexes(context.Background(), e.ut.db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(missing) > 0 {
+		t.Errorf("migrated database is missing indexes: %v", missing)
+	}
+
+	if _, err := e.ut.db.Exec("ALTER TABLE credit_cards DROP INDEX idx_card_type_created"); err != nil {
+		t.Fatal(err)
+	}
+	e.ut.checkSchema()
+	status, body := e.call(t, "GET", "/readyz", nil, nil)
+	if status != http.StatusOK || body["status"] != "ready" {
+		t.Fatalf("readyz: status %d: %v", status, body)
+	}
+	warnings, _ := body["warnings"].([]interface{})
+	if len(warnings) != 1 || warnings[0] != "no index on credit_cards (card_type, created_at)" {
+		t.Errorf("readyz warnings %v, want the card_type index", warnings)
+	}
+}
+
+// TestIntegrationTokenSearch tests search filters on imported cards
+func TestIntegrationTokenSearch(t *testing.T) {
+	e := newIntegrationEnv(t, nil)
+	e.createUser(t, "searcher", RoleAdmin)
+	session := bearer(e.login(t, "searcher"))
+	year := time.Now().Year() + 2
+
+	records, _ := json.Marshal([]CardImportRecord{
+		{CardNumber: testCards[0], ExpiryMonth: 5, ExpiryYear: year, ExternalID: "ext-1"},
+		{CardNumber: testCards[1], ExpiryMonth: 2, ExpiryYear: year + 1, ExternalID: "ext-2"},
+	})
+	status, result := e.call(t, "POST", "/api/v1/cards/import", session, map[string]interface{}{
+		"format": "json",
+		"tenant": "acme",
+		"data":   base64.StdEncoding.EncodeToString(records),
+	})
+	if status != http.StatusOK || result["successful_imports"] != float64(2) {
+		t.Fatalf("import: status %d: %v", status, result)
+	}
+	status, _ = e.call(t, "POST", "/api/v1/cards/import", session, map[string]interface{}{
+		"format": "json",
+		"tenant": "acme'; DROP TABLE users; --",
+		"data":   base64.StdEncoding.EncodeToString(records),
+	})
+	if status != http.StatusBadRequest {
+		t.Errorf("import with an invalid tenant: status %d, want 400", status)
+	}
+
+	search := func(filters map[string]interface{}) (int, []string) {
+		status, result := e.call(t, "POST", "/api/v1/tokens/search", session, filters)
+		var found []string
+		list, _ := result["tokens"].([]interface{})
+		for _, item := range list {
+			found = append(found, item.(map[string]interface{})["external_id"].(string))
+		}
+		return status, found
+	}
+	for _, tc := range []struct {
+		filters map[string]interface{}
+		want    string
+	}{
+		{map[string]interface{}{"tenant": "acme", "sort": "expiry", "order": "asc"}, "ext-1,ext-2"},
+		{map[string]interface{}{"tenant": "acme", "sort": "expiry"}, "ext-2,ext-1"},
+		{map[string]interface{}{"tenant": "other"}, ""},
+		{map[string]interface{}{"external_id": "ext-2"}, "ext-2"},
+		{map[string]interface{}{"expiry_from": fmt.Sprintf("%d-06", year)}, "ext-2"},
+		{map[string]interface{}{"expiry_to": fmt.Sprintf("%d-05", year)}, "ext-1"},
+		{map[string]interface{}{"external_id": "ext-1' OR '1'='1"}, ""},
+	} {
+		status, found := search(tc.filters)
+		if status != http.StatusOK || strings.Join(found, ",") != tc.want {
+			t.Errorf("search %v: status %d, found %v, want %s", tc.filters, status, found, tc.want)
+		}
+	}
+
+	for _, filters := range []map[string]interface{}{
+		{"sort": "card_number_encrypted"},
+		{"sort": "created_at; DROP TABLE users"},
+		{"order": "sideways"},
+		{"expiry_from": "2030-13"},
+	} {
+		if status, _ := search(filters); status != http.StatusBadRequest {
+			t.Errorf("search %v: status %d, want 400", filters, status)
+		}
+	}
+}
+
+// TestIntegrationTokenDetail tests the details returned for a single token
+func TestIntegrationTokenDetail(t *testing.T) {
+	e := newIntegrationEnv(t, nil)
+	e.createUser(t, "support", RoleAdmin)
+	session := bearer(e.login(t, "support"))
+	year := time.Now().Year() + 2
+
+	records, _ := json.Marshal([]CardImportRecord{
+		{CardNumber: testCards[0], ExpiryMonth: 7, ExpiryYear: year, ExternalID: "ext-1", Metadata: `{"plan":"gold"}`},
+	})
+	status, result := e.call(t, "POST", "/api/v1/cards/import", session, map[string]interface{}{
+		"format": "json",
+		"tenant": "acme",
+		"data":   base64.StdEncoding.EncodeToString(records),
+	})
+	if status != http.StatusOK || result["successful_imports"] != float64(1) {
+		t.Fatalf("import: status %d: %v", status, result)
+	}
+	imported := result["tokens_generated"].([]interface{})[0].(map[string]interface{})["token"].(string)
+
+	status, detail := e.call(t, "GET", "/api/v1/tokens/"+imported, session, nil)
+	if status != http.StatusOK {
+		t.Fatalf("get imported token: status %d: %v", status, detail)
+	}
+	for field, want := range map[string]interface{}{
+		"expiry_month": float64(7),
+		"expiry_year":  float64(year),
+		"external_id":  "ext-1",
+		"tenant":       "acme",
+		"source":       "import",
+		"use_count":    float64(0),
+	} {
+		if detail[field] != want {
+			t.Errorf("imported token %s = %v, want %v", field, detail[field], want)
+		}
+	}
+	if metadata, _ := detail["metadata"].(map[string]interface{}); metadata["plan"] != "gold" {
+		t.Errorf("imported token metadata = %v", detail["metadata"])
+	}
+
+	proxied, err := e.ut.tokenizeCard(testCards[1], cardDetails{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	e.ut.retrieveCard(proxied)
+	status, detail = e.call(t, "GET", "/api/v1/tokens/"+proxied, session, nil)
+	if status != http.StatusOK || detail["source"] != "proxy" || detail["use_count"] != float64(1) || detail["last_used_at"] == nil {
+		t.Errorf("proxied token: status %d: %v", status, detail)
+	}
+	if _, ok := detail["expiry_month"]; ok {
+		t.Errorf("proxied token without expiry has expiry_month %v", detail["expiry_month"])
+	}
+
+	invalid, _ := json.Marshal([]CardImportRecord{
+		{CardNumber: testCards[2], ExpiryMonth: 1, ExpiryYear: year, Metadata: `["not", "an", "object"]`},
+	})
+	status, _ = e.call(t, "POST", "/api/v1/cards/import", session, map[string]interface{}{
+		"format": "json",
+		"data":   base64.StdEncoding.EncodeToString(invalid),
+	})
+	if status != http.StatusBadRequest {
+		t.Errorf("import with non-object metadata: status %d, want 400", status)
+	}
+}
+
+// TestIntegrationColumnEncryption tests that external IDs, metadata and
+// audit details are stored encrypted, and that plaintext stored before
+// they were is encrypted at startup
+func TestIntegrationColumnEncryption(t *testing.T) {
+	e := newIntegrationEnv(t, map[string]string{
+		"USE_KEK_DEK":    "true",
+		"KEK_PASSPHRASE": "integration test passphrase",
+	})
+	e.createUser(t, "support", RoleAdmin)
+	session := bearer(e.login(t, "support"))
+	year := time.Now().Year() + 2
+
+	records, _ := json.Marshal([]CardImportRecord{
+		{CardNumber: testCards[0], ExpiryMonth: 7, ExpiryYear: year, ExternalID: "ext-1", Metadata: `{"plan":"gold"}`},
+		{CardNumber: testCards[1], ExpiryMonth: 8, ExpiryYear: year},
+	})
+	status, result := e.call(t, "POST", "/api/v1/cards/import", session, map[string]interface{}{
+		"format": "json",
+		"data":   base64.StdEncoding.EncodeToString(records),
+	})
+	if status != http.StatusOK || result["successful_imports"] != float64(2) {
+		t.Fatalf("import: status %d: %v", status, result)
+	}
+	generated := result["tokens_generated"].([]interface{})
+	imported := generated[0].(map[string]interface{})["token"].(string)
+	legacy := generated[1].(map[string]interface{})["token"].(string)
+
+	var externalID, metadata sql.NullString
+	var encryptedExternalID, encryptedMetadata []byte
+	e.ut.db.QueryRow(`
+		SELECT external_id, metadata, external_id_encrypted, metadata_encrypted FROM credit_cards WHERE token = ?
+	`, imported).Scan(&externalID, &metadata, &encryptedExternalID, &encryptedMetadata)
+	if externalID.Valid || metadata.Valid || len(encryptedExternalID) == 0 || len(encryptedMetadata) == 0 {
+		t.Errorf("imported card stored external ID %v and metadata %v in plaintext", externalID, metadata)
+	}
+
+	// A card and audit event written before encryption, then rotated past
+	oldDEK := e.ut.keyManager.getCurrentDEKID()
+	if _, err := e.ut.db.Exec(`
+		UPDATE credit_cards SET external_id = 'ext-2', metadata = '{"plan":"silver"}' WHERE token = ?
+	`, legacy); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := e.ut.db.Exec(`
+		INSERT INTO user_audit_log (user_id, action, details) VALUES ('support', 'legacy_action', '{"reason":"before encryption"}')
+	`); err != nil {
+		t.Fatal(err)
+	}
+	if err := e.ut.keyManager.RotateDEK(); err != nil {
+		t.Fatal(err)
+	}
+	e.ut.encryptPlaintextColumns()
+
+	var keyID sql.NullString
+	e.ut.db.QueryRow(`
+		SELECT external_id, metadata, encryption_key_id FROM credit_cards WHERE token = ?
+	`, legacy).Scan(&externalID, &metadata, &keyID)
+	if externalID.Valid || metadata.Valid {
+		t.Errorf("plaintext external ID %v and metadata %v left after encryption", externalID, metadata)
+	}
+	if keyID.String == oldDEK {
+		t.Error("card should move to the current DEK with its encrypted fields")
+	}
+	if got := e.ut.retrieveCard(legacy); got != testCards[1] {
+		t.Errorf("encrypted card detokenized to %q", got)
+	}
+
+	for token, want := range map[string]string{imported: "gold", legacy: "silver"} {
+		status, detail := e.call(t, "GET", "/api/v1/tokens/"+token, session, nil)
+		if status != http.StatusOK {
+			t.Fatalf("get token: status %d: %v", status, detail)
+		}
+		if metadata, _ := detail["metadata"].(map[string]interface{}); metadata["plan"] != want {
+			t.Errorf("token metadata = %v, want plan %s", detail["metadata"], want)
+		}
+	}
+	status, result = e.call(t, "POST", "/api/v1/tokens/search", session, map[string]interface{}{"external_id": "ext-2"})
+	if items, _ := result["tokens"].([]interface{}); status != http.StatusOK || len(items) != 1 ||
+		items[0].(map[string]interface{})["external_id"] != "ext-2" {
+		t.Errorf("search by encrypted external ID: status %d: %v", status, result)
+	}
+
+	var details sql.NullString
+	var encryptedDetails []byte
+	e.ut.db.QueryRow(`
+		SELECT details, details_encrypted, details_key_id FROM user_audit_log WHERE action = 'legacy_action'
+	`).Scan(&details, &encryptedDetails, &keyID)
+	if details.Valid {
+		t.Errorf("plaintext audit details %q left after encryption", details.String)
+	}
+	if values, err := e.ut.decryptFields(keyID, encryptedDetails); err != nil || values[0] != `{"reason": "before encryption"}` {
+		t.Errorf("encrypted audit details = %q, %v", values, err)
+	}
+
+	// New events are written encrypted
+	e.ut.logAuditEvent(AuditEvent{UserID: "support", Action: "new_action", Details: map[string]interface{}{"reason": "after"}})
+	e.ut.db.QueryRow(`
+		SELECT details, details_encrypted, details_key_id FROM user_audit_log WHERE action = 'new_action'
+	`).Scan(&details, &encryptedDetails, &keyID)
+	if values, err := e.ut.decryptFields(keyID, encryptedDetails); details.Valid || err != nil || values[0] != `{"reason":"after"}` {
+		t.Errorf("new audit details: plaintext %v, encrypted %q, %v", details, values, err)
+	}
+}
+
+// TestIntegrationTokenRestore tests restoring revoked tokens and purging them
+// once the restore window has passed
+func TestIntegrationTokenRestore(t *testing.T) {
+	e := newIntegrationEnv(t, map[string]string{"TOKEN_PURGE_DAYS": "7"})
+	e.createUser(t, "operator", RoleOperator)
+	session := bearer(e.login(t, "operator"))
+
+	token, err := e.ut.tokenizeCard(testCards[0], cardDetails{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	e.ut.retrieveCard(token)
+
+	status, result := e.call(t, "DELETE", "/api/v1/tokens/"+token, session, nil)
+	if status != http.StatusOK || result["purge_after"] == nil {
+		t.Fatalf("revoke: status %d: %v", status, result)
+	}
+	if got := e.ut.retrieveCard(token); got != "" {
+		t.Errorf("revoked token detokenizes to %q", got)
+	}
+	_, again := e.call(t, "DELETE", "/api/v1/tokens/"+token, session, nil)
+	if again["purge_after"] != result["purge_after"] {
+		t.Errorf("revoking again moved the purge date from %v to %v", result["purge_after"], again["purge_after"])
+	}
+
+	status, result = e.call(t, "POST", "/api/v1/tokens/"+token+"/restore", session, nil)
+	if status != http.StatusOK {
+		t.Fatalf("restore: status %d: %v", status, result)
+	}
+	if got := e.ut.retrieveCard(token); got != testCards[0] {
+		t.Errorf("restored token detokenizes to %q, want %s", got, testCards[0])
+	}
+	if status, _ := e.call(t, "POST", "/api/v1/tokens/"+token+"/restore", session, nil); status != http.StatusConflict {
+		t.Errorf("restore of an active token: status %d, want 409", status)
+	}
+
+	// Once the window has passed the card and its history are deleted
+	e.call(t, "DELETE", "/api/v1/tokens/"+token, session, nil)
+	kept, err := e.ut.tokenizeCard(testCards[1], cardDetails{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	e.call(t, "DELETE", "/api/v1/tokens/"+kept, session, nil)
+	e.ut.db.Exec("UPDATE credit_cards SET purge_after = NOW() - INTERVAL 1 DAY WHERE token = ?", token)
+	e.ut.purgeRevokedTokens()
+
+	if status, _ := e.call(t, "GET", "/api/v1/tokens/"+token, session, nil); status != http.StatusNotFound {
+		t.Errorf("purged token: status %d, want 404", status)
+	}
+	if status, _ := e.call(t, "POST", "/api/v1/tokens/"+token+"/restore", session, nil); status != http.StatusNotFound {
+		t.Errorf("restore of a purged token: status %d, want 404", status)
+	}
+	var history int
+	e.ut.db.QueryRow("SELECT COUNT(*) FROM token_requests WHERE token = ?", token).Scan(&history)
+	if history != 0 {
+		t.Errorf("%d requests of the purged token kept", history)
+	}
+	if status, result := e.call(t, "POST", "/api/v1/tokens/"+kept+"/restore", session, nil); status != http.StatusOK {
+		t.Errorf("restore within the window: status %d: %v", status, result)
+	}
+
+	// Viewers can neither revoke nor restore
+	e.createUser(t, "viewer", RoleViewer)
+	if status, _ := e.call(t, "POST", "/api/v1/tokens/"+kept+"/restore", bearer(e.login(t, "viewer")), nil); status != http.StatusForbidden {
+		t.Errorf("restore as viewer: status %d, want 403", status)
+	}
+}
+
+// TestIntegrationBulkTokens tests bulk operations by token list and filter
+func TestIntegrationBulkTokens(t *testing.T) {
+	e := newIntegrationEnv(t, nil)
+	e.createUser(t, "operator", RoleOperator)
+	session := bearer(e.login(t, "operator"))
+
+	var tokens []string
+	for _, card := range testCards[:3] {
+		token, err := e.ut.tokenizeCard(card, cardDetails{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		tokens = append(tokens, token)
+	}
+	e.ut.db.Exec("UPDATE credit_cards SET tenant = 'acme' WHERE token IN (?, ?)", tokens[0], tokens[1])
+
+	bulk := func(body map[string]interface{}) (int, map[string]string) {
+		status, result := e.call(t, "POST", "/api/v1/tokens/bulk", session, body)
+		statuses := make(map[string]string)
+		list, _ := result["results"].([]interface{})
+		for _, item := range list {
+			r := item.(map[string]interface{})
+			statuses[r["token"].(string)] = r["status"].(string)
+		}
+		return status, statuses
+	}
+
+	status, results := bulk(map[string]interface{}{
+		"operation":  "revoke",
+		"filter":     map[string]interface{}{"tenant": "acme"},
+		"batch_size": 1,
+	})
+	if status != http.StatusOK || results[tokens[0]] != "updated" || results[tokens[1]] != "updated" || len(results) != 2 {
+		t.Fatalf("revoke by filter: status %d: %v", status, results)
+	}
+	if e.ut.retrieveCard(tokens[0]) != "" || e.ut.retrieveCard(tokens[2]) != testCards[2] {
+		t.Error("revoke by filter changed the wrong tokens")
+	}
+
+	status, results = bulk(map[string]interface{}{
+		"operation": "restore",
+		"tokens":    []string{tokens[0], tokens[2], "tok_missing"},
+	})
+	if status != http.StatusOK || results[tokens[0]] != "updated" || results[tokens[2]] != "skipped" || results["tok_missing"] != "not_found" {
+		t.Errorf("restore by list: status %d: %v", status, results)
+	}
+
+	year := time.Now().Year() + 3
+	status, results = bulk(map[string]interface{}{
+		"operation":    "set-expiry",
+		"tokens":       tokens,
+		"expiry_month": 4,
+		"expiry_year":  year,
+	})
+	var month, expiryYear int
+	e.ut.db.QueryRow("SELECT expiry_month, expiry_year FROM credit_cards WHERE token = ?", tokens[1]).Scan(&month, &expiryYear)
+	if status != http.StatusOK || month != 4 || expiryYear != year {
+		t.Errorf("set-expiry: status %d, expiry %d/%d: %v", status, month, expiryYear, results)
+	}
+
+	bulk(map[string]interface{}{"operation": "tag", "tokens": tokens, "tags": map[string]interface{}{"merchant": "acme", "env": "test"}})
+	bulk(map[string]interface{}{"operation": "tag", "tokens": tokens[:1], "tags": map[string]interface{}{"env": nil}})
+	_, detail := e.call(t, "GET", "/api/v1/tokens/"+tokens[0], session, nil)
+	if tags, _ := detail["tags"].(map[string]interface{}); len(tags) != 1 || tags["merchant"] != "acme" {
+		t.Errorf("tags after tagging = %v", detail["tags"])
+	}
+
+	// An empty filter would change every token
+	if status, _ := bulk(map[string]interface{}{"operation": "revoke", "filter": map[string]interface{}{}}); status != http.StatusBadRequest {
+		t.Errorf("revoke with an empty filter: status %d, want 400", status)
+	}
+
+	// Viewers can't change tokens
+	e.createUser(t, "viewer", RoleViewer)
+	status, _ = e.call(t, "POST", "/api/v1/tokens/bulk", bearer(e.login(t, "viewer")), map[string]interface{}{
+		"operation": "revoke",
+		"tokens":    tokens,
+	})
+	if status != http.StatusForbidden {
+		t.Errorf("bulk revoke as viewer: status %d, want 403", status)
+	}
+}
+
+// TestIntegrationOpenAPI tests that the OpenAPI document is served and
+// that every route it lists is routed by the API
+func TestIntegrationOpenAPI(t *testing.T) {
+	e := newIntegrationEnv(t, map[string]string{
+		"USE_KEK_DEK":        "true",
+		"KEK_PASSPHRASE":     "integration test passphrase",
+		"SWAGGER_UI_ENABLED": "true",
+	})
+
+	status, doc := e.call(t, "GET", "/api/v1/openapi.json", nil, nil)
+	paths, _ := doc["paths"].(map[string]interface{})
+	if status != http.StatusOK || doc["openapi"] != "3.0.3" || paths["/api/v1/tokens/{token}/tags"] == nil {
+		t.Fatalf("openapi.json: status %d: %v", status, doc["info"])
+	}
+
+	// Unauthenticated requests get past method routing to authentication,
+	// so a 404 or 405 means a listed route is not served
+	placeholder := regexp.MustCompile(`\{[a-z_]+\}`)
+	for _, route := range e.ut.apiRoutes() {
+		// Answers 404 unless sealed-boot mode is enabled
+		if route.Path == "/api/v1/unseal" {
+			continue
+		}
+		path := placeholder.ReplaceAllString(route.Path, "x")
+		if strings.HasPrefix(route.Path, "/api/v1/ip-filters/") {
+			path = "/api/v1/ip-filters/api"
+		}
+		var body interface{}
+		if route.Request != nil {
+			body = map[string]interface{}{}
+		}
+		status, _ := e.call(t, route.Method, path, nil, body)
+		if status == http.StatusNotFound || status == http.StatusMethodNotAllowed {
+			t.Errorf("%s %s: status %d", route.Method, path, status)
+		}
+		// Bodies are validated before authentication on some routes
+		if !route.Public && status != http.StatusUnauthorized && !(route.Request != nil && status == http.StatusBadRequest) {
+			t.Errorf("%s %s without credentials: status %d, want 401", route.Method, path, status)
+		}
+	}
+
+	req, _ := http.NewRequest("GET", e.api.URL+"/api/v1/docs", nil)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || !strings.HasPrefix(resp.Header.Get("Content-Type"), "text/html") {
+		t.Errorf("Swagger UI: status %d, Content-Type %s", resp.StatusCode, resp.Header.Get("Content-Type"))
+	}
+}
+
+// TestIntegrationTokenTags tests setting tags on import and through the API,
+// and filtering by them
+func TestIntegrationTokenTags(t *testing.T) {
+	e := newIntegrationEnv(t, nil)
+	e.createUser(t, "operator", RoleOperator)
+	session := bearer(e.login(t, "operator"))
+	year := time.Now().Year() + 2
+
+	csv := "card_number,expiry_month,expiry_year,tags\n" +
+		testCards[0] + ",1," + strconv.Itoa(year) + ",merchant=acme;env=test\n" +
+		testCards[1] + ",2," + strconv.Itoa(year) + ",merchant=globex\n"
+	status, result := e.call(t, "POST", "/api/v1/cards/import", session, map[string]interface{}{
+		"format": "csv",
+		"tags":   map[string]string{"env": "prod", "batch": "7"},
+		"data":   base64.StdEncoding.EncodeToString([]byte(csv)),
+	})
+	if status != http.StatusOK || result["successful_imports"] != float64(2) {
+		t.Fatalf("import: status %d: %v", status, result)
+	}
+	var tokens []string
+	for _, item := range result["tokens_generated"].([]interface{}) {
+		tokens = append(tokens, item.(map[string]interface{})["token"].(string))
+	}
+
+	// Record tags win over the import's
+	_, detail := e.call(t, "GET", "/api/v1/tokens/"+tokens[0], session, nil)
+	if tags, _ := detail["tags"].(map[string]interface{}); len(tags) != 3 || tags["env"] != "test" || tags["batch"] != "7" {
+		t.Errorf("imported tags = %v", detail["tags"])
+	}
+
+	status, result = e.call(t, "POST", "/api/v1/tokens/search", session, map[string]interface{}{
+		"tags": map[string]string{"batch": "7", "env": "prod"},
+	})
+	found, _ := result["tokens"].([]interface{})
+	if status != http.StatusOK || result["total"] != float64(1) || len(found) != 1 ||
+		found[0].(map[string]interface{})["token"] != tokens[1] {
+		t.Errorf("search by tags: status %d: %v", status, result)
+	}
+
+	status, result = e.call(t, "GET", "/api/v1/tokens?tag=merchant=acme", session, nil)
+	if status != http.StatusOK || result["total"] != float64(1) {
+		t.Errorf("list by tag: status %d: %v", status, result)
+	}
+	if status, _ := e.call(t, "GET", "/api/v1/tokens?tag=merchant", session, nil); status != http.StatusBadRequest {
+		t.Errorf("list with a malformed tag: status %d, want 400", status)
+	}
+
+	// PUT replaces every tag
+	status, result = e.call(t, "PUT", "/api/v1/tokens/"+tokens[1]+"/tags", session, map[string]interface{}{
+		"tags": map[string]string{"merchant": "acme"},
+	})
+	if tags, _ := result["tags"].(map[string]interface{}); status != http.StatusOK || len(tags) != 1 || tags["merchant"] != "acme" {
+		t.Errorf("put tags: status %d: %v", status, result)
+	}
+	if status, _ := e.call(t, "PUT", "/api/v1/tokens/tok_missing/tags", session, map[string]interface{}{"tags": map[string]string{}}); status != http.StatusNotFound {
+		t.Errorf("put tags on a missing token: status %d, want 404", status)
+	}
+
+	// Bulk operations can select tokens by tag
+	status, result = e.call(t, "POST", "/api/v1/tokens/bulk", session, map[string]interface{}{
+		"operation": "revoke",
+		"filter":    map[string]interface{}{"tags": map[string]string{"merchant": "acme"}},
+	})
+	if status != http.StatusOK || result["updated"] != float64(2) {
+		t.Errorf("bulk revoke by tag: status %d: %v", status, result)
+	}
+
+	// Viewers can read tags but not change them
+	e.createUser(t, "viewer", RoleViewer)
+	viewer := bearer(e.login(t, "viewer"))
+	if status, _ := e.call(t, "GET", "/api/v1/tokens/"+tokens[0]+"/tags", viewer, nil); status != http.StatusOK {
+		t.Errorf("get tags as viewer: status %d, want 200", status)
+	}
+	if status, _ := e.call(t, "PUT", "/api/v1/tokens/"+tokens[0]+"/tags", viewer, map[string]interface{}{"tags": map[string]string{}}); status != http.StatusForbidden {
+		t.Errorf("put tags as viewer: status %d, want 403", status)
+	}
+}
+
+// TestIntegrationAuth tests logins, sessions and API keys
+func TestIntegrationAuth(t *testing.T) {
+	e := newIntegrationEnv(t, nil)
+	e.createUser(t, "alice", RoleAdmin)
+	e.createUser(t, "victor", RoleViewer)
+
+	status, _ := e.call(t, "POST", "/api/v1/auth/login", nil, map[string]string{"username": "alice", "password": "Wrong-Password-123"})
+	if status != http.StatusUnauthorized {
+		t.Errorf("login with a wrong password: status %d, want 401", status)
+	}
+	if status, _ := e.call(t, "GET", "/api/v1/tokens", nil, nil); status != http.StatusUnauthorized {
+		t.Errorf("no credentials: status %d, want 401", status)
+	}
+
+	session := e.login(t, "alice")
+	status, me := e.call(t, "GET", "/api/v1/auth/me", bearer(session), nil)
+	if status != http.StatusOK || me["username"] != "alice" {
+		t.Errorf("GET /auth/me: status %d: %v", status, me)
+	}
+
+	// Permissions follow the role
+	viewer := bearer(e.login(t, "victor"))
+	if status, _ := e.call(t, "GET", "/api/v1/tokens", viewer, nil); status != http.StatusOK {
+		t.Errorf("viewer listing tokens: status %d, want 200", status)
+	}
+	if status, _ := e.call(t, "POST", "/api/v1/api-keys", viewer, map[string]string{"client_name": "viewer key"}); status != http.StatusForbidden {
+		t.Errorf("viewer creating an API key: status %d, want 403", status)
+	}
+
+	// API keys act with their creator's permissions until revoked
+	status, created := e.call(t, "POST", "/api/v1/api-keys", bearer(session), map[string]string{"client_name": "integration"})
+	if status != http.StatusOK {
+		t.Fatalf("creating an API key: status %d: %v", status, created)
+	}
+	apiKey := created["api_key"].(string)
+	if status, _ := e.call(t, "GET", "/api/v1/users", apiKeyHeader(apiKey), nil); status != http.StatusOK {
+		t.Errorf("API key listing users: status %d, want 200", status)
+	}
+	if status, _ := e.call(t, "DELETE", "/api/v1/api-keys/"+apiKey, bearer(session), nil); status != http.StatusOK {
+		t.Errorf("revoking the API key: status %d", status)
+	}
+	if status, _ := e.call(t, "GET", "/api/v1/users", apiKeyHeader(apiKey), nil); status != http.StatusUnauthorized {
+		t.Errorf("revoked API key: status %d, want 401", status)
+	}
+
+	if status, _ := e.call(t, "POST", "/api/v1/auth/logout", bearer(session), nil); status != http.StatusOK {
+		t.Errorf("logout: status %d", status)
+	}
+	if status, _ := e.call(t, "GET", "/api/v1/auth/me", bearer(session), nil); status != http.StatusUnauthorized {
+		t.Errorf("session after logout: status %d, want 401", status)
+	}
+
+	// Disabled users cannot log in
+	e.ut.db.Exec("UPDATE users SET is_active = FALSE WHERE username = 'victor'")
+	status, _ = e.call(t, "POST", "/api/v1/auth/login", nil, map[string]string{"username": "victor", "password": testPassword})
+	if status != http.StatusUnauthorized {
+		t.Errorf("login as a disabled user: status %d, want 401", status)
+	}
+}
+
+// TestIntegrationSignedRequests tests API keys that only accept requests
+// signed with their secret, and the replay and clock checks
+func TestIntegrationSignedRequests(t *testing.T) {
+	e := newIntegrationEnv(t, nil)
+	e.createUser(t, "signer", RoleAdmin)
+	session := bearer(e.login(t, "signer"))
+
+	status, created := e.call(t, "POST", "/api/v1/api-keys", session, map[string]interface{}{"client_name": "signed", "signed": true})
+	apiKey, _ := created["api_key"].(string)
+	secret, _ := created["signing_secret"].(string)
+	if status != http.StatusOK || apiKey == "" || len(secret) != 64 {
+		t.Fatalf("create signed key: status %d: %v", status, created)
+	}
+
+	signed := func(method, path, body string, at time.Time, nonce, secret string) (int, map[string]interface{}) {
+		req, err := http.NewRequest(method, e.api.URL+path, strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		timestamp := strconv.FormatInt(at.Unix(), 10)
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("X-API-Key", apiKey)
+		req.Header.Set("X-Timestamp", timestamp)
+		req.Header.Set("X-Nonce", nonce)
+		req.Header.Set("X-Signature", requestSignature(secret, method, path, timestamp, nonce, []byte(body)))
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		var decoded map[string]interface{}
+		json.NewDecoder(resp.Body).Decode(&decoded)
+		return resp.StatusCode, decoded
+	}
+
+	now := time.Now()
+	if status, body := signed("GET", "/api/v1/tokens?limit=5", "", now, "nonce-0000000001", secret); status != http.StatusOK {
+		t.Errorf("signed GET: status %d: %v", status, body)
+	}
+	search := `{"cardType":"visa"}`
+	if status, body := signed("POST", "/api/v1/tokens/search", search, now, "nonce-0000000002", secret); status != http.StatusOK {
+		t.Errorf("signed POST: status %d: %v", status, body)
+	}
+
+	type response struct {
+		status int
+		body   map[string]interface{}
+	}
+	var refused []response
+	check := func(status int, body map[string]interface{}) {
+		refused = append(refused, response{status, body})
+	}
+	check(signed("GET", "/api/v1/tokens?limit=5", "", now, "nonce-0000000001", secret))
+	check(signed("GET", "/api/v1/tokens?limit=5", "", now.Add(-10*time.Minute), "nonce-0000000003", secret))
+	check(signed("GET", "/api/v1/tokens?limit=5", "", now, "nonce-0000000004", strings.Repeat("0", 64)))
+	check(e.call(t, "GET", "/api/v1/tokens", apiKeyHeader(apiKey), nil))
+	for i, name := range []string{"replayed nonce", "stale timestamp", "wrong secret", "unsigned"} {
+		if refused[i].status != http.StatusUnauthorized || refused[i].body["code"] != "invalid_signature" {
+			t.Errorf("%s: status %d: %v", name, refused[i].status, refused[i].body)
+		}
+	}
+	if len(e.securityEventDetails(t, "invalid_signature")) != 3 {
+		t.Errorf("want an invalid_signature event for each bad signature")
+	}
+
+	// A key without a secret cannot sign, and the list shows which are signed
+	_, plain := e.call(t, "POST", "/api/v1/api-keys", session, map[string]string{"client_name": "plain"})
+	if status, _ := e.call(t, "GET", "/api/v1/tokens", apiKeyHeader(plain["api_key"].(string)), nil); status != http.StatusOK {
+		t.Errorf("unsigned key: status %d", status)
+	}
+	_, list := e.call(t, "GET", "/api/v1/api-keys", session, nil)
+	keys, _ := list["api_keys"].([]interface{})
+	for _, k := range keys {
+		key := k.(map[string]interface{})
+		if key["signed"] != (key["api_key"] == apiKey) {
+			t.Errorf("listed key %v", key)
+		}
+	}
+}
+
+
+// TestIntegrationServiceAccounts tests that service accounts cannot log in
+// and that their keys expire, are reminded about and rotate
+func TestIntegrationServiceAccounts(t *testing.T) {
+	e := newIntegrationEnv(t, nil)
+	e.createUser(t, "ops", RoleAdmin)
+	session := bearer(e.login(t, "ops"))
+
+	status, account := e.call(t, "POST", "/api/v1/service-accounts", session, map[string]string{"name": "billing-sync", "role": RoleOperator})
+	if status != http.StatusCreated {
+		t.Fatalf("create service account: status %d: %v", status, account)
+	}
+	if status, body := e.call(t, "POST", "/api/v1/service-accounts", session, map[string]string{"name": "ops"}); status != http.StatusConflict {
+		t.Errorf("service account named like a user: status %d: %v", status, body)
+	}
+
+	// It cannot log in, and is not managed as a user
+	if status, _ := e.call(t, "POST", "/api/v1/auth/login", nil, map[string]string{"username": "billing-sync", "password": "!"}); status != http.StatusUnauthorized {
+		t.Errorf("service account login: status %d", status)
+	}
+	if status, _ := e.call(t, "GET", "/api/v1/users/billing-sync", session, nil); status != http.StatusNotFound {
+		t.Errorf("service account as a user: status %d", status)
+	}
+
+	if status, body := e.call(t, "POST", "/api/v1/service-accounts/billing-sync/keys", session, map[string]int{"expires_in_days": 91}); status != http.StatusBadRequest {
+		t.Errorf("key past SERVICE_ACCOUNT_KEY_DAYS: status %d: %v", status, body)
+	}
+	status, created := e.call(t, "POST", "/api/v1/service-accounts/billing-sync/keys", session, map[string]string{})
+	oldKey, _ := created["api_key"].(string)
+	expiresAt, _ := time.Parse(time.RFC3339, fmt.Sprint(created["expires_at"]))
+	if status != http.StatusCreated || oldKey == "" || time.Until(expiresAt) < 89*24*time.Hour {
+		t.Fatalf("create key: status %d: %v", status, created)
+	}
+	if status, _ := e.call(t, "GET", "/api/v1/tokens", apiKeyHeader(oldKey), nil); status != http.StatusOK {
+		t.Errorf("service account key: status %d", status)
+	}
+	if status, body := e.call(t, "POST", "/api/v1/api-keys", apiKeyHeader(oldKey), map[string]string{"client_name": "forever"}); status != http.StatusForbidden {
+		t.Errorf("service account creating its own key: status %d: %v", status, body)
+	}
+
+	// A key about to expire is reminded about once
+	if _, err := e.ut.db.Exec("UPDATE api_keys SET expires_at = NOW() + INTERVAL 3 DAY WHERE api_key = ?", oldKey); err != nil {
+		t.Fatal(err)
+	}
+	e.ut.remindExpiringKeys()
+	e.ut.remindExpiringKeys()
+	if reminders := e.securityEventDetails(t, "api_key_expiring"); len(reminders) != 1 || !strings.Contains(reminders[0], oldKey) {
+		t.Errorf("reminders: %v", reminders)
+	}
+
+	// Rotating without overlap switches keys at once
+	status, rotated := e.call(t, "POST", "/api/v1/service-accounts/billing-sync/keys/"+oldKey+"/rotate", session, map[string]int{"overlap_hours": 0})
+	newKey, _ := rotated["api_key"].(string)
+	if status != http.StatusCreated || newKey == "" || rotated["replaces"] != oldKey {
+		t.Fatalf("rotate: status %d: %v", status, rotated)
+	}
+	if status, body := e.call(t, "GET", "/api/v1/tokens", apiKeyHeader(oldKey), nil); status != http.StatusUnauthorized || body["code"] != "api_key_expired" {
+		t.Errorf("rotated key: status %d: %v", status, body)
+	}
+	if status, _ := e.call(t, "GET", "/api/v1/tokens", apiKeyHeader(newKey), nil); status != http.StatusOK {
+		t.Errorf("new key: status %d", status)
+	}
+	if status, _ := e.call(t, "POST", "/api/v1/service-accounts/billing-sync/keys/"+oldKey+"/rotate", session, map[string]int{}); status != http.StatusNotFound {
+		t.Errorf("rotating an expired key: status %d", status)
+	}
+
+	_, got := e.call(t, "GET", "/api/v1/service-accounts/billing-sync", session, nil)
+	if keys, _ := got["keys"].([]interface{}); len(keys) != 2 {
+		t.Errorf("service account keys: %v", got)
+	}
+
+	// users.write alone cannot give, or get keys of, more than the caller has
+	if status, _ := e.call(t, "POST", "/api/v1/roles", session, map[string]interface{}{
+		"name": "integrator", "permissions": []string{PermUsersRead, PermUsersWrite, PermTokensRead, PermActivityRead, PermStatsRead},
+	}); status != http.StatusCreated {
+		t.Fatalf("creating the integrator role: status %d", status)
+	}
+	e.createUser(t, "ivan", "integrator")
+	integrator := bearer(e.login(t, "ivan"))
+	if status, body := e.call(t, "POST", "/api/v1/service-accounts", integrator, map[string]string{"name": "backdoor", "role": RoleAdmin}); status != http.StatusForbidden {
+		t.Errorf("integrator creating an admin service account: status %d: %v", status, body)
+	}
+	if status, body := e.call(t, "POST", "/api/v1/service-accounts/billing-sync/keys", integrator, map[string]string{}); status != http.StatusForbidden {
+		t.Errorf("integrator issuing a key of an operator account: status %d: %v", status, body)
+	}
+	if status, body := e.call(t, "POST", "/api/v1/service-accounts/billing-sync/keys/"+newKey+"/rotate", integrator, map[string]int{}); status != http.StatusForbidden {
+		t.Errorf("integrator rotating a key of an operator account: status %d: %v", status, body)
+	}
+	if status, body := e.call(t, "POST", "/api/v1/service-accounts", integrator, map[string]string{"name": "reports"}); status != http.StatusCreated {
+		t.Errorf("integrator creating a viewer service account: status %d: %v", status, body)
+	}
+	if status, body := e.call(t, "POST", "/api/v1/service-accounts/reports/keys", integrator, map[string]string{}); status != http.StatusCreated {
+		t.Errorf("integrator issuing a key of a viewer account: status %d: %v", status, body)
+	}
+	if status, _ := e.call(t, "DELETE", "/api/v1/service-accounts/billing-sync", session, nil); status != http.StatusOK {
+		t.Errorf("delete service account: status %d", status)
+	}
+	if status, _ := e.call(t, "GET", "/api/v1/tokens", apiKeyHeader(newKey), nil); status != http.StatusUnauthorized {
+		t.Errorf("key of a deleted service account: status %d", status)
+	}
+}
+
+func TestIntegrationSessionBinding(t *testing.T) {
+	e := newIntegrationEnv(t, map[string]string{"SESSION_BINDING": "step_up"})
+	e.createUser(t, "ops", RoleAdmin)
+	sessionID := e.login(t, "ops")
+	session := bearer(sessionID)
+	if status, _ := e.call(t, "GET", "/api/v1/auth/me", session, nil); status != http.StatusOK {
+		t.Fatalf("same client: status %d", status)
+	}
+
+	// Another browser must confirm the password first
+	moved := bearer(sessionID)
+	moved.Set("User-Agent", "curl/8.4.0")
+	if status, body := e.call(t, "GET", "/api/v1/auth/me", moved, nil); status != http.StatusUnauthorized || body["code"] != "reauthentication_required" {
+		t.Fatalf("other browser: status %d: %v", status, body)
+	}
+	if violations := e.securityEventDetails(t, "session_binding_violation"); len(violations) != 1 || !strings.Contains(violations[0], "user_agent") {
+		t.Errorf("violations: %v", violations)
+	}
+	if status, body := e.call(t, "POST", "/api/v1/auth/reauthenticate", moved, map[string]string{"password": testPassword}); status != http.StatusOK {
+		t.Fatalf("reauthenticate: status %d: %v", status, body)
+	}
+	if status, _ := e.call(t, "GET", "/api/v1/auth/me", moved, nil); status != http.StatusOK {
+		t.Errorf("after reauthenticating: status %d", status)
+	}
+
+	// A wrong password ends the session
+	if status, _ := e.call(t, "GET", "/api/v1/auth/me", session, nil); status != http.StatusUnauthorized {
+		t.Errorf("first browser after rebinding: status %d", status)
+	}
+	if status, _ := e.call(t, "POST", "/api/v1/auth/reauthenticate", session, map[string]string{"password": "wrong"}); status != http.StatusUnauthorized {
+		t.Errorf("wrong password: status %d", status)
+	}
+	if status, _ := e.call(t, "GET", "/api/v1/auth/me", moved, nil); status != http.StatusUnauthorized {
+		t.Errorf("session after a wrong password: status %d", status)
+	}
+
+	// Strict mode ends the session at once
+	e.ut.sessionBinding.Mode = sessionbind.Strict
+	sessionID = e.login(t, "ops")
+	session, moved = bearer(sessionID), bearer(sessionID)
+	moved.Set("User-Agent", "curl/8.4.0")
+	if status, body := e.call(t, "GET", "/api/v1/auth/me", moved, nil); status != http.StatusUnauthorized || body["code"] != "invalid_session" {
+		t.Errorf("strict, other browser: status %d: %v", status, body)
+	}
+	if status, _ := e.call(t, "GET", "/api/v1/auth/me", session, nil); status != http.StatusUnauthorized {
+		t.Errorf("strict, after a violation: status %d", status)
+	}
+}
+func TestIntegrationLoginChallenge(t *testing.T) {
+	e := newIntegrationEnv(t, map[string]string{
+		"LOGIN_CHALLENGE":            "pow",
+		"LOGIN_CHALLENGE_AFTER":      "2",
+		"LOGIN_CHALLENGE_DIFFICULTY": "8",
+	})
+	e.createUser(t, "ops", RoleAdmin)
+
+	wrong := map[string]string{"username": "ops", "password": "Wrong-passw0rd!"}
+	for i := 0; i < 2; i++ {
+		if status, body := e.call(t, "POST", "/api/v1/auth/login", nil, wrong); status != http.StatusUnauthorized || body["code"] != "invalid_credentials" {
+			t.Fatalf("failure %d: status %d: %v", i+1, status, body)
+		}
+	}
+
+	// Even the right password needs the puzzle solved now
+	login := map[string]string{"username": "ops", "password": testPassword}
+	status, body := e.call(t, "POST", "/api/v1/auth/login", nil, login)
+	details, _ := body["details"].(map[string]interface{})
+	challengeID, _ := details["challenge_id"].(string)
+	if status != http.StatusUnauthorized || body["code"] != "challenge_required" || challengeID == "" || details["difficulty"] != float64(8) {
+		t.Fatalf("challenged login: status %d: %v", status, body)
+	}
+	login["challenge_id"] = challengeID
+	login["challenge_response"] = "not-a-solution"
+	if status, body := e.call(t, "POST", "/api/v1/auth/login", nil, login); status != http.StatusUnauthorized || body["code"] != "challenge_required" {
+		t.Errorf("wrong solution: status %d: %v", status, body)
+	}
+	login["challenge_response"] = loginchallenge.Solve(challengeID, 8)
+	if status, body := e.call(t, "POST", "/api/v1/auth/login", nil, login); status != http.StatusOK {
+		t.Fatalf("solved login: status %d: %v", status, body)
+	}
+
+	// A puzzle solves one login, and the address stays challenged
+	if status, body := e.call(t, "POST", "/api/v1/auth/login", nil, login); status != http.StatusUnauthorized || body["code"] != "challenge_required" {
+		t.Errorf("reused solution: status %d: %v", status, body)
+	}
+	if events := e.securityEventDetails(t, "login_challenged"); len(events) != 1 {
+		t.Errorf("login_challenged events: %v", events)
+	}
+}
+func TestIntegrationAuditRetention(t *testing.T) {
+	dir := t.TempDir()
+	e := newIntegrationEnv(t, map[string]string{
+		"AUDIT_LOG_RETENTION_DAYS": "30",
+		"AUDIT_LOG_ARCHIVE":        "file",
+		"AUDIT_LOG_ARCHIVE_BUCKET": dir,
+	})
+	e.createUser(t, "ops", RoleAdmin)
+	session := bearer(e.login(t, "ops"))
+
+	for i := 0; i < 3; i++ {
+		e.ut.logSecurityEvent(SecurityEvent{EventType: "old_event", Severity: "low", IPAddress: "203.0.113.7",
+			Details: map[string]interface{}{"n": i}})
+	}
+	e.ut.logAuditEvent(AuditEvent{UserID: "usr_ops", Action: "old_action", ResourceType: "tokens"})
+	for _, update := range []string{
+		"UPDATE security_audit_log SET created_at = NOW() - INTERVAL 40 DAY WHERE event_type = 'old_event'",
+		"UPDATE user_audit_log SET created_at = NOW() - INTERVAL 40 DAY WHERE action = 'old_action'",
+	} {
+		if _, err := e.ut.db.Exec(update); err != nil {
+			t.Fatal(err)
+		}
+	}
+	e.ut.archiveAuditLogs()
+
+	var left int
+	e.ut.db.QueryRow("SELECT COUNT(*) FROM security_audit_log WHERE event_type = 'old_event'").Scan(&left)
+	if left != 0 {
+		t.Errorf("%d old security events left", left)
+	}
+	if details := e.securityEventDetails(t, "login_success"); len(details) == 0 {
+		t.Error("a recent security event was archived")
+	}
+
+	status, list := e.call(t, "GET", "/api/v1/audit-archives?table=security_audit_log", session, nil)
+	archives, _ := list["archives"].([]interface{})
+	if status != http.StatusOK || len(archives) != 1 {
+		t.Fatalf("list archives: status %d: %v", status, list)
+	}
+	archive := archives[0].(map[string]interface{})
+	id := fmt.Sprint(archive["archive_id"])
+	if archive["rows"] != float64(3) {
+		t.Errorf("archive: %v", archive)
+	}
+
+	status, got := e.call(t, "GET", "/api/v1/audit-archives/"+id+"/events?event_type=old_event&limit=2", session, nil)
+	events, _ := got["events"].([]interface{})
+	if status != http.StatusOK || len(events) != 2 || got["truncated"] != true || got["verified"] != true {
+		t.Fatalf("query archive: status %d: %v", status, got)
+	}
+	if details, _ := events[0].(map[string]interface{})["details"].(map[string]interface{}); details["n"] != float64(0) {
+		t.Errorf("archived event: %v", events[0])
+	}
+
+	// A changed archive is refused
+	object := filepath.Join(dir, "tokenshield-audit", filepath.FromSlash(fmt.Sprint(archive["object_key"])))
+	if err := os.WriteFile(object, []byte("forged"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if status, body := e.call(t, "GET", "/api/v1/audit-archives/"+id+"/events", session, nil); status != http.StatusBadGateway {
+		t.Errorf("tampered archive: status %d: %v", status, body)
+	}
+	if tampered := e.securityEventDetails(t, "audit_archive_tampered"); len(tampered) != 1 {
+		t.Errorf("audit_archive_tampered events: %v", tampered)
+	}
+}
+
+// TestIntegrationComplianceReport tests the signed compliance report in
+// both formats against the published signing key
+func TestIntegrationComplianceReport(t *testing.T) {
+	e := newIntegrationEnv(t, nil)
+	e.createUser(t, "ops", RoleAdmin)
+	e.createUser(t, "bob", RoleViewer)
+	session := bearer(e.login(t, "ops"))
+	for _, token := range []string{"tok_a", "tok_b", "tok_a"} {
+		e.ut.logAuditEvent(AuditEvent{UserID: "usr_ops", Action: "token_revealed", ResourceType: "token", ResourceID: token})
+	}
+
+	if status, _ := e.call(t, "GET", "/api/v1/reports/compliance", bearer(e.login(t, "bob")), nil); status != http.StatusForbidden {
+		t.Errorf("report as a viewer: status %d", status)
+	}
+	for _, bad := range []string{"quarter=2026-Q9", "start=2026-05-01&end=2026-04-01", "format=docx"} {
+		if status, _ := e.call(t, "GET", "/api/v1/reports/compliance?"+bad, session, nil); status != http.StatusBadRequest {
+			t.Errorf("report with %s: status %d", bad, status)
+		}
+	}
+
+	status, key := e.call(t, "GET", "/api/v1/reports/signing-key", session, nil)
+	if status != http.StatusOK || key["algorithm"] != "Ed25519" {
+		t.Fatalf("GET signing key: status %d: %v", status, key)
+	}
+	block, _ := pem.Decode([]byte(key["public_key"].(string)))
+	parsed, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	public := parsed.(ed25519.PublicKey)
+
+	fetch := func(format string) (*http.Response, []byte) {
+		req, _ := http.NewRequest("GET", e.api.URL+"/api/v1/reports/compliance?format="+format, nil)
+		req.Header = session.Clone()
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("report as %s: status %d: %s", format, resp.StatusCode, body)
+		}
+		signature, _ := base64.StdEncoding.DecodeString(resp.Header.Get("X-Report-Signature"))
+		if !ed25519.Verify(public, body, signature) || resp.Header.Get("X-Report-Signing-Key") != key["key_id"] {
+			t.Errorf("report as %s does not verify against the signing key", format)
+		}
+		return resp, body
+	}
+
+	_, body := fetch("json")
+	var report ComplianceReport
+	if err := json.Unmarshal(body, &report); err != nil {
+		t.Fatal(err)
+	}
+	if report.GeneratedBy != "ops" || report.AccessReview.Active < 2 || report.SigningKeyID != key["key_id"] {
+		t.Errorf("report: %+v", report)
+	}
+	if revealers := report.Detokenizations.ByIdentity; len(revealers) != 1 || revealers[0].Reveals != 3 || revealers[0].Tokens != 2 ||
+		revealers[0].Username != "ops" {
+		t.Errorf("reveals by identity: %+v", revealers)
+	}
+
+	resp, body := fetch("pdf")
+	if resp.Header.Get("Content-Type") != "application/pdf" || !bytes.HasPrefix(body, []byte("%PDF-")) ||
+		!strings.Contains(resp.Header.Get("Content-Disposition"), ".pdf") {
+		t.Errorf("PDF report: %v %q", resp.Header, body[:10])
+	}
+	var audited int
+	e.ut.db.QueryRow("SELECT COUNT(*) FROM user_audit_log WHERE action = 'compliance_report_generated'").Scan(&audited)
+	if audited != 2 {
+		t.Errorf("%d compliance_report_generated audit events, want 2", audited)
+	}
+}
+
+// capturedMail collects the account emails the service sends
+type capturedMail struct {
+	mu       sync.Mutex
+	messages []mailer.Message
+}
+
+func (c *capturedMail) Send(msg mailer.Message) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.messages = append(c.messages, msg)
+	return nil
+}
+
+// token waits for the next message to address and returns the token in it
+func (c *capturedMail) token(t *testing.T, address string) string {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(20 * time.Millisecond) {
+		c.mu.Lock()
+		for i, msg := range c.messages {
+			if msg.To == address {
+				c.messages = append(c.messages[:i], c.messages[i+1:]...)
+				c.mu.Unlock()
+				return regexp.MustCompile(`[A-Za-z0-9_-]{43}`).FindString(msg.Body)
+			}
+		}
+		c.mu.Unlock()
+	}
+	t.Fatalf("no email sent to %s", address)
+	return ""
+}
+
+// TestIntegrationAccountEmails tests email verification after a profile
+// change and the forgot-password flow
+func TestIntegrationAccountEmails(t *testing.T) {
+	e := newIntegrationEnv(t, nil)
+	mail := &capturedMail{}
+	e.ut.accountMail.sender = mail
+	e.createUser(t, "alice", RoleOperator)
+	e.createUser(t, "bob", RoleViewer)
+	session := bearer(e.login(t, "alice"))
+
+	// A new email needs the password, and is unverified until the link
+	// mailed to it is followed
+	status, _ := e.call(t, "PUT", "/api/v1/auth/me", session, map[string]string{"email": "alice@new.example.com"})
+	if status != http.StatusBadRequest {
+		t.Errorf("email change without the password: status %d, want 400", status)
+	}
+	status, _ = e.call(t, "PUT", "/api/v1/auth/me", session, map[string]string{"email": "bob@example.com", "current_password": testPassword})
+	if status != http.StatusConflict {
+		t.Errorf("changing to another user's email: status %d, want 409", status)
+	}
+	status, body := e.call(t, "PUT", "/api/v1/auth/me", session, map[string]string{
+		"full_name": "Alice Liddell", "email": "alice@new.example.com", "current_password": testPassword,
+	})
+	if status != http.StatusOK || body["verification_sent"] != true {
+		t.Fatalf("profile update: status %d: %v", status, body)
+	}
+	_, me := e.call(t, "GET", "/api/v1/auth/me", session, nil)
+	if me["email"] != "alice@new.example.com" || me["email_verified"] != false || me["full_name"] != "Alice Liddell" {
+		t.Errorf("profile after update: %v", me)
+	}
+	verifyToken := mail.token(t, "alice@new.example.com")
+	if status, _ := e.call(t, "POST", "/api/v1/auth/verify-email", nil, map[string]string{"token": verifyToken}); status != http.StatusOK {
+		t.Errorf("verifying the email: status %d", status)
+	}
+	if status, _ := e.call(t, "POST", "/api/v1/auth/verify-email", nil, map[string]string{"token": verifyToken}); status != http.StatusBadRequest {
+		t.Errorf("reusing a verification token: status %d, want 400", status)
+	}
+	if _, me := e.call(t, "GET", "/api/v1/auth/me", session, nil); me["email_verified"] != true {
+		t.Errorf("email not verified after following the link: %v", me)
+	}
+
+	// Forgot-password answers the same for unknown accounts, and only
+	// mails verified addresses
+	e.ut.db.Exec("UPDATE users SET is_email_verified = FALSE WHERE username = 'bob'")
+	for _, username := range []string{"nobody", "bob", "alice@new.example.com"} {
+		status, body := e.call(t, "POST", "/api/v1/auth/forgot-password", nil, map[string]string{"username": username})
+		if status != http.StatusAccepted || body["message"] != forgotPasswordMessage {
+			t.Errorf("forgot-password for %s: status %d: %v", username, status, body)
+		}
+	}
+	resetToken := mail.token(t, "alice@new.example.com")
+	mail.mu.Lock()
+	if len(mail.messages) != 0 {
+		t.Errorf("unexpected emails sent: %v", mail.messages)
+	}
+	mail.mu.Unlock()
+
+	status, _ = e.call(t, "POST", "/api/v1/auth/reset-password", nil, map[string]string{"token": resetToken, "new_password": "weak"})
+	if status != http.StatusBadRequest {
+		t.Errorf("reset to a weak password: status %d, want 400", status)
+	}
+	const newPassword = "Another-Password-456!"
+	status, body = e.call(t, "POST", "/api/v1/auth/reset-password", nil, map[string]string{"token": resetToken, "new_password": newPassword})
+	if status != http.StatusOK {
+		t.Fatalf("password reset: status %d: %v", status, body)
+	}
+	if status, _ := e.call(t, "GET", "/api/v1/auth/me", session, nil); status != http.StatusUnauthorized {
+		t.Errorf("session after a password reset: status %d, want 401", status)
+	}
+	if status, _ := e.call(t, "POST", "/api/v1/auth/login", nil, map[string]string{"username": "alice", "password": newPassword}); status != http.StatusOK {
+		t.Errorf("login with the new password: status %d", status)
+	}
+	status, _ = e.call(t, "POST", "/api/v1/auth/reset-password", nil, map[string]string{"token": resetToken, "new_password": "Third-Password-789!"})
+	if status != http.StatusBadRequest {
+		t.Errorf("reusing a reset token: status %d, want 400", status)
+	}
+	if n := len(e.securityEventDetails(t, "password_reset_failed")); n != 1 {
+		t.Errorf("%d password_reset_failed events, want 1", n)
+	}
+	if n := len(e.securityEventDetails(t, "password_reset_requested")); n != 3 {
+		t.Errorf("%d password_reset_requested events, want 3", n)
+	}
+}
+
+// TestIntegrationRoles tests that a custom role grants exactly its
+// permissions, and that changes to it apply to its users
+func TestIntegrationRoles(t *testing.T) {
+	e := newIntegrationEnv(t, nil)
+	e.createUser(t, "alice", RoleAdmin)
+	e.createUser(t, "victor", RoleViewer)
+	admin := bearer(e.login(t, "alice"))
+
+	status, _ := e.call(t, "POST", "/api/v1/roles", bearer(e.login(t, "victor")), map[string]interface{}{"name": "auditor", "permissions": []string{PermActivityRead}})
+	if status != http.StatusForbidden {
+		t.Errorf("viewer creating a role: status %d, want 403", status)
+	}
+	status, _ = e.call(t, "POST", "/api/v1/roles", admin, map[string]interface{}{"name": "auditor", "permissions": []string{"users.manage"}})
+	if status != http.StatusBadRequest {
+		t.Errorf("role with an unknown permission: status %d, want 400", status)
+	}
+	status, role := e.call(t, "POST", "/api/v1/roles", admin, map[string]interface{}{
+		"name": "auditor", "description": "Reviews activity", "permissions": []string{PermActivityRead, PermUsersRead},
+	})
+	if status != http.StatusCreated || role["built_in"] != false {
+		t.Fatalf("creating a role: status %d: %v", status, role)
+	}
+	if status, _ := e.call(t, "POST", "/api/v1/roles", admin, map[string]interface{}{"name": "auditor", "permissions": []string{PermStatsRead}}); status != http.StatusConflict {
+		t.Errorf("creating a duplicate role: status %d, want 409", status)
+	}
+
+	status, _ = e.call(t, "POST", "/api/v1/users", admin, map[string]string{
+		"username": "audrey", "email": "audrey@example.com", "password": testPassword, "role": "auditor",
+	})
+	if status != http.StatusCreated {
+		t.Fatalf("creating a user with the custom role: status %d", status)
+	}
+	if status, _ := e.call(t, "POST", "/api/v1/users", admin, map[string]string{
+		"username": "nobody", "email": "nobody@example.com", "password": testPassword, "role": "missing",
+	}); status != http.StatusBadRequest {
+		t.Errorf("creating a user with an unknown role: status %d, want 400", status)
+	}
+	auditor := bearer(e.login(t, "audrey"))
+	if status, _ := e.call(t, "GET", "/api/v1/activity", auditor, nil); status != http.StatusOK {
+		t.Errorf("auditor reading activity: status %d, want 200", status)
+	}
+	if status, _ := e.call(t, "GET", "/api/v1/tokens", auditor, nil); status != http.StatusForbidden {
+		t.Errorf("auditor listing tokens: status %d, want 403", status)
+	}
+
+	// A role change applies to its users at once
+	status, _ = e.call(t, "PUT", "/api/v1/roles/auditor", admin, map[string]interface{}{"permissions": []string{PermActivityRead, PermUsersRead, PermTokensRead}})
+	if status != http.StatusOK {
+		t.Fatalf("updating the role: status %d", status)
+	}
+	if status, _ := e.call(t, "GET", "/api/v1/tokens", auditor, nil); status != http.StatusOK {
+		t.Errorf("auditor listing tokens after the role change: status %d, want 200", status)
+	}
+	if _, me := e.call(t, "GET", "/api/v1/auth/me", auditor, nil); len(me["effective_permissions"].([]interface{})) != 3 {
+		t.Errorf("effective permissions of the auditor: %v", me["effective_permissions"])
+	}
+
+	if status, _ := e.call(t, "PUT", "/api/v1/roles/admin", admin, map[string]interface{}{"permissions": []string{PermTokensRead}}); status != http.StatusForbidden {
+		t.Errorf("changing the admin role: status %d, want 403", status)
+	}
+	if status, _ := e.call(t, "DELETE", "/api/v1/roles/viewer", admin, nil); status != http.StatusForbidden {
+		t.Errorf("deleting a built-in role: status %d, want 403", status)
+	}
+	if status, _ := e.call(t, "DELETE", "/api/v1/roles/auditor", admin, nil); status != http.StatusConflict {
+		t.Errorf("deleting a role in use: status %d, want 409", status)
+	}
+	e.call(t, "DELETE", "/api/v1/users/audrey", admin, nil)
+	if status, _ := e.call(t, "DELETE", "/api/v1/roles/auditor", admin, nil); status != http.StatusOK {
+		t.Errorf("deleting an unused role: status %d, want 200", status)
+	}
+	status, list := e.call(t, "GET", "/api/v1/roles", admin, nil)
+	if status != http.StatusOK || list["total"] != float64(3) {
+		t.Errorf("roles after the delete: status %d: %v", status, list)
+	}
+}
+
+// TestIntegrationOwnedResources tests that users with api_keys.own and
+// tokens.own manage only their own keys and the cards imported for them
+func TestIntegrationOwnedResources(t *testing.T) {
+	e := newIntegrationEnv(t, nil)
+	e.createUser(t, "alice", RoleAdmin)
+	admin := bearer(e.login(t, "alice"))
+	status, _ := e.call(t, "POST", "/api/v1/roles", admin, map[string]interface{}{
+		"name": "merchant", "permissions": []string{PermAPIKeysOwn, PermTokensOwn},
+	})
+	if status != http.StatusCreated {
+		t.Fatalf("creating the merchant role: status %d", status)
+	}
+	e.createUser(t, "mallory", "merchant")
+	e.createUser(t, "martin", "merchant")
+	mallory := bearer(e.login(t, "mallory"))
+	martin := bearer(e.login(t, "martin"))
+
+	keys := map[string]string{}
+	for name, session := range map[string]http.Header{"mallory": mallory, "martin": martin} {
+		status, body := e.call(t, "POST", "/api/v1/api-keys", session, map[string]string{"client_name": name + "-shop"})
+		if status != http.StatusOK {
+			t.Fatalf("%s creating an API key: status %d: %v", name, status, body)
+		}
+		keys[name] = body["api_key"].(string)
+	}
+	if status, body := e.call(t, "GET", "/api/v1/api-keys", mallory, nil); status != http.StatusOK || body["total"] != float64(1) {
+		t.Errorf("mallory listing API keys: status %d: %v", status, body)
+	}
+	if _, body := e.call(t, "GET", "/api/v1/api-keys", admin, nil); body["total"] != float64(2) {
+		t.Errorf("admin listing API keys: %v", body)
+	}
+	if status, _ := e.call(t, "DELETE", "/api/v1/api-keys/"+keys["martin"], mallory, nil); status != http.StatusNotFound {
+		t.Errorf("mallory revoking martin's key: status %d, want 404", status)
+	}
+	if status, _ := e.call(t, "DELETE", "/api/v1/api-keys/"+keys["mallory"], mallory, nil); status != http.StatusOK {
+		t.Errorf("mallory revoking her key: status %d, want 200", status)
+	}
+
+	year := time.Now().Year() + 2
+	records, _ := json.Marshal([]CardImportRecord{
+		{CardNumber: testCards[0], ExpiryMonth: 1, ExpiryYear: year},
+		{CardNumber: testCards[1], ExpiryMonth: 2, ExpiryYear: year},
+	})
+	status, result := e.call(t, "POST", "/api/v1/cards/import", admin, map[string]interface{}{
+		"format": "json", "owner": "mallory", "data": base64.StdEncoding.EncodeToString(records),
+	})
+	if status != http.StatusOK {
+		t.Fatalf("importing cards for mallory: status %d: %v", status, result)
+	}
+	checkRoundTrip(t, e, testCards[2])
+	if status, _ := e.call(t, "POST", "/api/v1/cards/import", admin, map[string]interface{}{
+		"format": "json", "owner": "nobody", "data": base64.StdEncoding.EncodeToString(records),
+	}); status != http.StatusBadRequest {
+		t.Errorf("importing for an unknown owner: status %d, want 400", status)
+	}
+
+	if _, body := e.call(t, "GET", "/api/v2/tokens", mallory, nil); body["meta"].(map[string]interface{})["total"] != float64(2) {
+		t.Errorf("mallory's tokens: %v", body["meta"])
+	}
+	if _, body := e.call(t, "GET", "/api/v2/tokens", martin, nil); body["meta"].(map[string]interface{})["total"] != float64(0) {
+		t.Errorf("martin's tokens: %v", body["meta"])
+	}
+	if _, body := e.call(t, "GET", "/api/v2/tokens", admin, nil); body["meta"].(map[string]interface{})["total"] != float64(3) {
+		t.Errorf("all tokens: %v", body["meta"])
+	}
+	token := result["tokens_generated"].([]interface{})[0].(map[string]interface{})["token"].(string)
+	if status, _ := e.call(t, "DELETE", "/api/v1/tokens/"+token, martin, nil); status != http.StatusNotFound {
+		t.Errorf("martin revoking mallory's token: status %d, want 404", status)
+	}
+	if status, _ := e.call(t, "DELETE", "/api/v1/tokens/"+token, mallory, nil); status != http.StatusOK {
+		t.Errorf("mallory revoking her token: status %d, want 200", status)
+	}
+	if status, _ := e.call(t, "GET", "/api/v1/tokens/"+token, martin, nil); status != http.StatusNotFound {
+		t.Errorf("martin reading mallory's token: status %d, want 404", status)
+	}
+	if status, body := e.call(t, "GET", "/api/v1/tokens/"+token, mallory, nil); status != http.StatusOK || body["token"] != token {
+		t.Errorf("mallory reading her token: status %d: %v", status, body)
+	}
+	if status, body := e.call(t, "POST", "/api/v1/tokens/search", mallory, map[string]interface{}{}); status != http.StatusOK || body["total"] != float64(2) {
+		t.Errorf("mallory searching tokens: status %d: %v", status, body)
+	}
+	if status, body := e.call(t, "POST", "/api/v1/tokens/search", martin, map[string]interface{}{}); status != http.StatusOK || body["total"] != float64(0) {
+		t.Errorf("martin searching tokens: status %d: %v", status, body)
+	}
+}
+
+func TestIntegrationAPIVersions(t *testing.T) {
+	e := newIntegrationEnv(t, nil)
+	e.createUser(t, "operator", RoleOperator)
+
+	// v2 serves the v1 endpoints it does not replace
+	status, result := e.call(t, "POST", "/api/v2/auth/login", nil, map[string]string{
+		"username": "operator",
+		"password": testPassword,
+	})
+	sessionID, _ := result["session_id"].(string)
+	if status != http.StatusOK || sessionID == "" {
+		t.Fatalf("v2 login: status %d: %v", status, result)
+	}
+	session := bearer(sessionID)
+
+	year := time.Now().Year() + 2
+	csv := "card_number,expiry_month,expiry_year\n" +
+		testCards[0] + ",1," + strconv.Itoa(year) + "\n" +
+		testCards[1] + ",2," + strconv.Itoa(year) + "\n"
+	status, result = e.call(t, "POST", "/api/v2/cards/import", session, map[string]interface{}{
+		"format": "csv",
+		"data":   base64.StdEncoding.EncodeToString([]byte(csv)),
+	})
+	if status != http.StatusOK || result["successful_imports"] != float64(2) {
+		t.Fatalf("v2 import: status %d: %v", status, result)
+	}
+
+	status, result = e.call(t, "GET", "/api/v2/tokens?limit=1&offset=1", session, nil)
+	data, _ := result["data"].([]interface{})
+	meta, _ := result["meta"].(map[string]interface{})
+	if status != http.StatusOK || len(data) != 1 || meta["total"] != float64(2) || meta["limit"] != float64(1) || meta["offset"] != float64(1) {
+		t.Errorf("v2 list: status %d: %v", status, result)
+	}
+	status, result = e.call(t, "GET", "/api/v1/tokens", session, nil)
+	if status != http.StatusOK || result["total"] != float64(2) {
+		t.Errorf("v1 list: status %d: %v", status, result)
+	}
+
+	if status, _ := e.call(t, "GET", "/api/v9/tokens", session, nil); status != http.StatusNotFound {
+		t.Errorf("unknown version: status %d", status)
+	}
+}
+
+func TestIntegrationErrorCodes(t *testing.T) {
+	e := newIntegrationEnv(t, nil)
+	e.createUser(t, "viewer", RoleViewer)
+	session := bearer(e.login(t, "viewer"))
+
+	for _, tc := range []struct {
+		method, path string
+		header       http.Header
+		body         interface{}
+		status       int
+		code         string
+	}{
+		{"GET", "/api/v1/tokens", nil, nil, http.StatusUnauthorized, apierror.AuthenticationRequired},
+		{"GET", "/api/v1/tokens", bearer("sess_unknown"), nil, http.StatusUnauthorized, apierror.InvalidSession},
+		{"GET", "/api/v1/tokens/tok_missing", session, nil, http.StatusNotFound, apierror.TokenNotFound},
+		{"DELETE", "/api/v1/users/someone", session, nil, http.StatusForbidden, apierror.PermissionDenied},
+		{"PATCH", "/api/v1/tokens", session, nil, http.StatusMethodNotAllowed, apierror.MethodNotAllowed},
+		{"GET", "/api/v1/no-such-endpoint", session, nil, http.StatusNotFound, apierror.NotFound},
+		{"POST", "/api/v1/auth/login", nil, map[string]string{"username": "viewer", "password": "wrong"}, http.StatusUnauthorized, apierror.InvalidCredentials},
+	} {
+		status, body := e.call(t, tc.method, tc.path, tc.header, tc.body)
+		id, _ := body["request_id"].(string)
+		if status != tc.status || body["code"] != tc.code || body["message"] == nil || body["error"] != body["message"] || !strings.HasPrefix(id, "req_") {
+			t.Errorf("%s %s: status %d: %v", tc.method, tc.path, status, body)
+		}
+	}
+}
+
+func TestIntegrationCompressedBodies(t *testing.T) {
+	e := newIntegrationEnv(t, nil)
+	card := testCards[0]
+	// A client that leaves compressed bodies as they are
+	client := &http.Client{Transport: &http.Transport{DisableCompression: true}}
+
+	// A gzipped request body is tokenized and forwarded gzipped
+	body, _ := compression.Encode("gzip", []byte(`{"card_number":"`+card+`","amount":"10.00"}`))
+	req, _ := http.NewRequest("POST", e.proxy.URL+"/api/checkout", bytes.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Content-Encoding", "gzip")
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	forwarded, err := compression.Decode("gzip", []byte(e.upstream.lastBody()), 1<<20)
+	if err != nil {
+		t.Fatalf("upstream received a body that is not gzip: %v", err)
+	}
+	var fields map[string]string
+	json.Unmarshal(forwarded, &fields)
+	token := fields["card_number"]
+	if !e.ut.tokenRegex.MatchString(token) || fields["amount"] != "10.00" {
+		t.Fatalf("upstream received %s, want the card tokenized", forwarded)
+	}
+
+	// A coding the proxy cannot read is refused rather than forwarded
+	req, _ = http.NewRequest("POST", e.proxy.URL+"/api/checkout", strings.NewReader("opaque"))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Content-Encoding", "br")
+	resp, err = client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnsupportedMediaType {
+		t.Errorf("brotli request body: status %d, want 415", resp.StatusCode)
+	}
+
+	// A gzipped response is detokenized and returned gzipped
+	e.upstream.respondEncoded("/api/cards", "application/json", "gzip", `{"cards":[{"card_number":"`+token+`"}]}`)
+	req, _ = http.NewRequest("GET", e.proxy.URL+"/api/cards", nil)
+	req.Header.Set("Accept-Encoding", "gzip, br")
+	resp, err = client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	decoded, err := compression.Decode(resp.Header.Get("Content-Encoding"), raw, 1<<20)
+	if err != nil || resp.Header.Get("Content-Encoding") != "gzip" || !strings.Contains(string(decoded), card) ||
+		resp.Header.Get("Content-Length") != strconv.Itoa(len(raw)) {
+		t.Errorf("gzipped /api/cards = %q (%v, headers %v), want the card detokenized", decoded, err, resp.Header)
+	}
+
+	// ICAP REQMOD detokenizes a deflated body and keeps its coding
+	deflated, _ := compression.Encode("deflate", []byte(`{"card":"`+token+`"}`))
+	httpHeaders := "POST /charge HTTP/1.1\r\nHost: gateway.example\r\n" +
+		"Content-Type: application/json\r\nContent-Encoding: deflate\r\n" +
+		fmt.Sprintf("Content-Length: %d\r\n\r\n", len(deflated))
+	icapResp := e.icapExchange(t, fmt.Sprintf("REQMOD icap://%s/reqmod ICAP/1.0\r\nHost: %s\r\nEncapsulated: req-hdr=0, req-body=%d\r\n\r\n",
+		e.icapAddr, e.icapAddr, len(httpHeaders))+httpHeaders+chunk(string(deflated)))
+	detokenized, err := compression.Decode("deflate", []byte(icapResp.Body), 1<<20)
+	if icapResp.Status != 200 || err != nil || string(detokenized) != `{"card":"`+card+`"}` {
+		t.Errorf("REQMOD with a deflated body: ICAP %d, body %q (%v)", icapResp.Status, detokenized, err)
+	}
+}
+
+func TestIntegrationCharsets(t *testing.T) {
+	e := newIntegrationEnv(t, nil)
+	card := testCards[0]
+	utf16 := charset.Encoding{Name: charset.UTF16LE, BOM: true}
+	latin1 := charset.Encoding{Name: charset.ISO88591}
+
+	// A UTF-16 request body is tokenized and forwarded in UTF-16
+	body, _ := utf16.Encode(`{"card_number":"` + card + `","name":"Zoë"}`)
+	resp, err := http.Post(e.proxy.URL+"/api/checkout", "application/json; charset=utf-16", bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	forwarded := []byte(e.upstream.lastBody())
+	text, err := utf16.Decode(forwarded)
+	var fields map[string]string
+	json.Unmarshal([]byte(text), &fields)
+	token := fields["card_number"]
+	if err != nil || !bytes.HasPrefix(forwarded, []byte{0xFF, 0xFE}) || !e.ut.tokenRegex.MatchString(token) || fields["name"] != "Zoë" {
+		t.Fatalf("upstream received %q, want the card tokenized in UTF-16", forwarded)
+	}
+
+	// An ISO-8859-1 request body keeps its accented characters
+	body, _ = latin1.Encode(`{"card_number":"` + card + `","name":"José"}`)
+	resp, err = http.Post(e.proxy.URL+"/api/checkout", "application/json; charset=iso-8859-1", bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	forwarded = []byte(e.upstream.lastBody())
+	if !bytes.Contains(forwarded, []byte("Jos\xe9")) || bytes.Contains(forwarded, []byte(card)) {
+		t.Errorf("upstream received %q, want the card tokenized in ISO-8859-1", forwarded)
+	}
+
+	// A charset the proxy cannot convert is refused rather than forwarded
+	resp, err = http.Post(e.proxy.URL+"/api/checkout", "application/json; charset=shift_jis", strings.NewReader(`{}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnsupportedMediaType {
+		t.Errorf("Shift_JIS request body: status %d, want 415", resp.StatusCode)
+	}
+
+	// An ISO-8859-1 page is detokenized and returned in ISO-8859-1
+	page, _ := latin1.Encode("<p>Carte de Zoë: " + token + "</p>")
+	e.upstream.respond("/my-cards", "text/html; charset=iso-8859-1", string(page))
+	resp, err = http.Get(e.proxy.URL + "/my-cards")
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if want, _ := latin1.Encode("<p>Carte de Zoë: " + card + "</p>"); !bytes.Equal(raw, want) {
+		t.Errorf("ISO-8859-1 /my-cards = %q, want %q", raw, want)
+	}
+
+	// ICAP RESPMOD tokenizes a UTF-16 response and keeps its charset
+	body, _ = utf16.Encode(`{"card":"` + card + `"}`)
+	httpHeaders := "HTTP/1.1 200 OK\r\nContent-Type: application/json; charset=utf-16\r\n" +
+		fmt.Sprintf("Content-Length: %d\r\n\r\n", len(body))
+	icapResp := e.icapExchange(t, fmt.Sprintf("RESPMOD icap://%s/respmod ICAP/1.0\r\nHost: %s\r\nEncapsulated: res-hdr=0, res-body=%d\r\n\r\n",
+		e.icapAddr, e.icapAddr, len(httpHeaders))+httpHeaders+chunk(string(body)))
+	text, err = utf16.Decode([]byte(icapResp.Body))
+	if icapResp.Status != 200 || err != nil || strings.Contains(text, card) || !strings.Contains(text, `"card":"`) {
+		t.Errorf("RESPMOD with a UTF-16 body: ICAP %d, body %q (%v)", icapResp.Status, text, err)
+	}
+}
+
+func TestIntegrationSMTPFilter(t *testing.T) {
+	e := newIntegrationEnv(t, nil)
+	card := testCards[0]
+	listen := func(s *smtprelay.Server) string {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { ln.Close() })
+		go func() {
+			for {
+				conn, err := ln.Accept()
+				if err != nil {
+					return
+				}
+				go s.Serve(conn)
+			}
+		}()
+		return ln.Addr().String()
+	}
+	relayed := make(chan string, 1)
+	next := listen(&smtprelay.Server{
+		Hostname: "next.example",
+		Filter:   func(env *smtprelay.Envelope, msg []byte) ([]byte, error) { return msg, nil },
+		Relay: func(env *smtprelay.Envelope, msg []byte) error {
+			relayed <- string(msg)
+			return nil
+		},
+	})
+	sender := &smtprelay.Sender{Addr: next, Hostname: "tokenshield.test", Timeout: 5 * time.Second}
+	filter := listen(&smtprelay.Server{Hostname: "tokenshield.test", Filter: e.ut.filterMail, Relay: sender.Send, Timeout: 5 * time.Second})
+
+	for _, action := range []string{"tokenize", "mask"} {
+		e.ut.smtpCardAction = action
+		msg := "From: agent@example.com\r\nSubject: Refund\r\nMessage-ID: <" + action + "@example.com>\r\n\r\n" +
+			"Customer card: " + card[:4] + " " + card[4:8] + " " + card[8:12] + " " + card[12:] + "\r\n"
+		if err := smtp.SendMail(filter, nil, "agent@example.com", []string{"customer@example.net"}, []byte(msg)); err != nil {
+			t.Fatalf("%s: %v", action, err)
+		}
+		got := <-relayed
+		body := strings.TrimSpace(got[strings.Index(got, "Customer card: ")+len("Customer card: "):])
+		switch {
+		case strings.Contains(normalizeCardNumber(got), card):
+			t.Errorf("%s: card relayed in the clear: %q", action, got)
+		case action == "tokenize" && !e.ut.tokenRegex.MatchString(body):
+			t.Errorf("tokenize: relayed %q, want a token", got)
+		case action == "mask" && body != "****"+card[12:]:
+			t.Errorf("mask: relayed %q, want the card masked", got)
+		}
+
+		count := 0
+		for _, details := range e.securityEventDetails(t, "email_card_numbers_replaced") {
+			if strings.Contains(details, "<"+action+"@example.com>") {
+				count++
+			}
+		}
+		if count != 1 {
+			t.Errorf("%s: %d incidents recorded, want 1", action, count)
+		}
+	}
+
+	// A message whose MIME structure cannot be followed is refused
+	broken := "Content-Type: multipart/mixed; boundary=x\r\n\r\n--x\r\n\r\n" + card + "\r\n"
+	var reply *textproto.Error
+	if err := smtp.SendMail(filter, nil, "agent@example.com", []string{"customer@example.net"}, []byte(broken)); !errors.As(err, &reply) || reply.Code != 554 {
+		t.Errorf("malformed message: %v, want 554", err)
+	}
+}
+
+// TestIntegrationCardPolicies tests refusing and flagging card numbers on
+// paths that should never receive them
+func TestIntegrationCardPolicies(t *testing.T) {
+	e := newIntegrationEnv(t, map[string]string{"PROXY_CARD_POLICIES": "/api/logs=reject,/api/search=alert"})
+	card := testCards[0]
+
+	post := func(path, contentType, body string) int {
+		resp, err := http.Post(e.proxy.URL+path, contentType, strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	if status := post("/api/logs", "text/plain", "payment failed for "+card); status != http.StatusUnprocessableEntity {
+		t.Errorf("card on a reject path: status %d, want 422", status)
+	}
+	if e.upstream.lastBody() != "" {
+		t.Error("a rejected request must not reach the application")
+	}
+	if status := post("/api/logs", "application/json", `{"message":"payment failed"}`); status != http.StatusOK {
+		t.Errorf("reject path without a card: status %d", status)
+	}
+
+	if status := post("/api/search", "application/json", `{"card_number":"`+card+`"}`); status != http.StatusOK {
+		t.Errorf("card on an alert path: status %d", status)
+	}
+	var forwarded map[string]string
+	if err := json.Unmarshal([]byte(e.upstream.lastBody()), &forwarded); err != nil || !e.ut.tokenRegex.MatchString(forwarded["card_number"]) {
+		t.Errorf("alert path forwarded %q, want the card tokenized", e.upstream.lastBody())
+	}
+
+	for eventType, want := range map[string]int{"card_data_rejected": 1, "card_data_detected": 1} {
+		var events int
+		e.ut.db.QueryRow("SELECT COUNT(*) FROM security_audit_log WHERE event_type = ?", eventType).Scan(&events)
+		if events != want {
+			t.Errorf("%d %s events, want %d", events, eventType, want)
+		}
+	}
+}
+
+func TestIntegrationDeepScan(t *testing.T) {
+	e := newIntegrationEnv(t, map[string]string{"DEEP_SCAN_FIELDS": "payload:json,data:base64"})
+	card := testCards[0]
+
+	// A webhook envelope with the card in JSON text and in base64 JSON
+	inner := `{"card_number":"` + card + `","amount":"10.00"}`
+	envelope, _ := json.Marshal(map[string]string{
+		"event":   "payment.created",
+		"payload": inner,
+		"data":    base64.StdEncoding.EncodeToString([]byte(inner)),
+		"other":   inner, // Not named by a rule
+	})
+	resp, err := http.Post(e.proxy.URL+"/api/webhooks", "application/json", bytes.NewReader(envelope))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	var forwarded map[string]string
+	if err := json.Unmarshal([]byte(e.upstream.lastBody()), &forwarded); err != nil {
+		t.Fatal(err)
+	}
+	var payload map[string]string
+	if err := json.Unmarshal([]byte(forwarded["payload"]), &payload); err != nil || !e.ut.tokenRegex.MatchString(payload["card_number"]) || payload["amount"] != "10.00" {
+		t.Errorf("forwarded payload %q, want the card tokenized", forwarded["payload"])
+	}
+	decoded, err := base64.StdEncoding.DecodeString(forwarded["data"])
+	var data map[string]string
+	if err != nil || json.Unmarshal(decoded, &data) != nil || data["card_number"] != payload["card_number"] {
+		t.Errorf("forwarded data %q (%s), want base64 JSON with the same token", forwarded["data"], decoded)
+	}
+	if forwarded["other"] != inner || forwarded["event"] != "payment.created" {
+		t.Errorf("fields without a rule changed: %v", forwarded)
+	}
+
+	// Tokens nested the same way in a response are detokenized
+	e.upstream.respond("/api/cards", "application/json", `{"payload":"{\"card_number\":\"`+payload["card_number"]+`\"}"}`)
+	resp, err = http.Get(e.proxy.URL + "/api/cards")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if !strings.Contains(string(body), card) {
+		t.Errorf("/api/cards = %s, want the nested token detokenized", body)
+	}
+}
+
+func TestIntegrationBatchWatcher(t *testing.T) {
+	inbox, output, archive := t.TempDir(), t.TempDir(), t.TempDir()
+	e := newIntegrationEnv(t, map[string]string{
+		"BATCH_INBOX":       inbox,
+		"BATCH_OUTPUT_DIR":  output,
+		"BATCH_ARCHIVE_DIR": archive,
+		"BATCH_COLUMNS":     "card_number",
+	})
+	card := testCards[0]
+	settlement := "merchant,card_number,amount\nacme," + card + ",10.00\n"
+	drop := func(name, content string) {
+		os.WriteFile(filepath.Join(inbox, name), []byte(content), 0600)
+		// Two polls: the first sees the file, the second finds it unchanged
+		e.ut.pollBatchInbox()
+		e.ut.pollBatchInbox()
+	}
+
+	drop("settlement.csv", settlement)
+	if _, err := os.Stat(filepath.Join(inbox, "settlement.csv")); !os.IsNotExist(err) {
+		t.Fatalf("file left in the inbox: %v", err)
+	}
+	out, err := os.ReadFile(filepath.Join(output, "settlement.csv"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(out)), "\n")
+	fields := strings.Split(lines[len(lines)-1], ",")
+	if len(fields) != 3 || strings.Contains(string(out), card) || e.ut.retrieveCard(fields[1]) != card {
+		t.Errorf("output = %q, want the card tokenized", out)
+	}
+
+	var report BatchFileReport
+	reportJSON, _ := os.ReadFile(filepath.Join(output, "settlement.csv.report.json"))
+	if err := json.Unmarshal(reportJSON, &report); err != nil || report.Status != "completed" || report.Report == nil || report.Tokenized != 1 {
+		t.Fatalf("report = %s, %v", reportJSON, err)
+	}
+	sealed, err := os.ReadFile(filepath.Join(archive, report.Archive))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if original, err := e.ut.openBatchArchive(sealed); err != nil || string(original) != settlement {
+		t.Errorf("archive = %q, %v, want the original", original, err)
+	}
+	var status string
+	e.ut.db.QueryRow("SELECT status FROM batch_files WHERE file_id = ?", report.FileID).Scan(&status)
+	if status != "completed" {
+		t.Errorf("batch_files status = %q", status)
+	}
+
+	// The same file dropped again is removed without being processed twice
+	os.Remove(filepath.Join(output, "settlement.csv"))
+	drop("settlement.csv", settlement)
+	if _, err := os.Stat(filepath.Join(output, "settlement.csv")); !os.IsNotExist(err) {
+		t.Errorf("duplicate file processed again: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(inbox, "settlement.csv")); !os.IsNotExist(err) {
+		t.Errorf("duplicate file left in the inbox: %v", err)
+	}
+
+	// A file without the card column fails, with a report but no output
+	drop("wrong.csv", "merchant,pan\nacme,"+card+"\n")
+	reportJSON, _ = os.ReadFile(filepath.Join(output, "wrong.csv.report.json"))
+	report = BatchFileReport{}
+	if err := json.Unmarshal(reportJSON, &report); err != nil || report.Status != "failed" || report.Error == "" {
+		t.Errorf("failed report = %s, %v", reportJSON, err)
+	}
+	if _, err := os.Stat(filepath.Join(output, "wrong.csv")); !os.IsNotExist(err) {
+		t.Errorf("output written for a failed file: %v", err)
+	}
+}
+
+func TestIntegrationKafkaBridge(t *testing.T) {
+	broker := newFakeKafkaBroker(t, map[string]int{
+		"payments": 1, "payments.sanitized": 2, "orders": 1, "orders.processor": 1, "dead-letters": 1,
+	})
+	registry := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{"schema": `{"type": "record", "name": "Payment", "fields": [
+			{"name": "card_number", "type": "string"}, {"name": "amount", "type": "long"}]}`})
+	}))
+	defer registry.Close()
+	e := newIntegrationEnv(t, map[string]string{
+		"KAFKA_BROKERS":             broker.addr,
+		"KAFKA_TOKENIZE_ROUTES":     "payments:payments.sanitized",
+		"KAFKA_DETOKENIZE_ROUTES":   "orders:orders.processor",
+		"KAFKA_DLQ_TOPIC":           "dead-letters",
+		"KAFKA_SCHEMA_REGISTRY_URL": registry.URL,
+	})
+	// run runs the bridge until done reports the messages were handled
+	run := func(done func() bool) {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		go func() {
+			for ctx.Err() == nil && !done() {
+				time.Sleep(20 * time.Millisecond)
+			}
+			cancel()
+		}()
+		if err := e.ut.runKafkaBridge(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+	sanitized := func() []kafka.Record {
+		return append(broker.records("payments.sanitized", 0), broker.records("payments.sanitized", 1)...)
+	}
+
+	card, other := testCards[0], testCards[1]
+	avroPayment, _ := avro.Encode(&avro.Schema{Type: "record", Fields: []avro.Field{
+		{Name: "card_number", Type: &avro.Schema{Type: "string"}}, {Name: "amount", Type: &avro.Schema{Type: "long"}}}},
+		map[string]interface{}{"card_number": card, "amount": int64(1000)})
+	now := time.Now()
+	broker.append("payments", 0,
+		kafka.Record{Key: []byte("order-1"), Value: []byte(`{"card_number":"` + card + `","amount":12345678901234567890,"note":"backup ` + other + `"}`), Timestamp: now},
+		kafka.Record{Value: []byte("not a message " + card), Timestamp: now},
+		kafka.Record{Key: []byte("order-2"), Value: avro.JoinWireFormat(1, avroPayment), Timestamp: now},
+		kafka.Record{Key: []byte("order-3"), Timestamp: now}, // Tombstone
+	)
+	run(func() bool { return len(sanitized()) == 3 && len(broker.records("dead-letters", 0)) == 1 })
+
+	out := sanitized()
+	if len(out) != 3 {
+		t.Fatalf("sanitized topic has %d messages, want 3", len(out))
+	}
+	var token string
+	for _, rec := range out {
+		switch string(rec.Key) {
+		case "order-1":
+			var msg map[string]interface{}
+			dec := json.NewDecoder(bytes.NewReader(rec.Value))
+			dec.UseNumber()
+			if err := dec.Decode(&msg); err != nil {
+				t.Fatal(err)
+			}
+			token, _ = msg["card_number"].(string)
+			if e.ut.retrieveCard(token) != card || strings.Contains(string(rec.Value), other) ||
+				msg["amount"].(json.Number).String() != "12345678901234567890" {
+				t.Errorf("JSON message = %s", rec.Value)
+			}
+		case "order-2":
+			_, data, err := avro.SplitWireFormat(rec.Value)
+			if err != nil || bytes.Contains(rec.Value, []byte(card)) {
+				t.Fatalf("Avro message = %q, %v", rec.Value, err)
+			}
+			if !bytes.Contains(data, []byte("tok_")) && e.ut.tokenFormat != "luhn" {
+				t.Errorf("Avro message not tokenized: %q", data)
+			}
+		case "order-3":
+			if rec.Value != nil {
+				t.Errorf("tombstone republished as %q", rec.Value)
+			}
+		default:
+			t.Errorf("unexpected message %q", rec.Key)
+		}
+	}
+	dead := broker.records("dead-letters", 0)
+	if len(dead) != 1 || strings.Contains(string(dead[0].Value), card) {
+		t.Errorf("dead letters = %+v", dead)
+	}
+	if offsets, _ := e.ut.kafkaBridge.client.CommittedOffsets("tokenshield-bridge", "payments", []int32{0}); offsets[0] != 4 {
+		t.Errorf("committed offset = %v, want 4", offsets)
+	}
+
+	// Tokens on the way to the processor are detokenized
+	broker.append("orders", 0, kafka.Record{Value: []byte(`{"card_number":"` + token + `"}`), Timestamp: now})
+	run(func() bool { return len(broker.records("orders.processor", 0)) == 1 })
+	if got := broker.records("orders.processor", 0); len(got) != 1 || !strings.Contains(string(got[0].Value), card) {
+		t.Errorf("processor topic = %+v", got)
+	}
+	// Nothing is republished twice
+	if len(sanitized()) != 3 {
+		t.Errorf("sanitized topic has %d messages after a second run", len(sanitized()))
+	}
+}
+
+// TestIntegrationClientCertificates tests services authenticating to the
+// API with client certificates mapped to identities
+func TestIntegrationClientCertificates(t *testing.T) {
+	ca := newTestCert(t, &x509.Certificate{Subject: pkix.Name{CommonName: "Test CA"}, IsCA: true, BasicConstraintsValid: true, KeyUsage: x509.KeyUsageCertSign}, nil)
+	server := newTestCert(t, &x509.Certificate{Subject: pkix.Name{CommonName: "127.0.0.1"}, IPAddresses: []net.IP{net.ParseIP("127.0.0.1")}}, ca)
+	keyDER, _ := x509.MarshalECPrivateKey(server.key)
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "ca.pem"), ca.pem, 0600)
+	os.WriteFile(filepath.Join(dir, "server.pem"), server.pem, 0600)
+	os.WriteFile(filepath.Join(dir, "server.key"), pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600)
+	e := newIntegrationEnv(t, map[string]string{
+		"TLS_CERT_FILE":  filepath.Join(dir, "server.pem"),
+		"TLS_KEY_FILE":   filepath.Join(dir, "server.key"),
+		"MTLS_CLIENT_CA": filepath.Join(dir, "ca.pem"),
+	})
+	e.createUser(t, "certadmin", RoleAdmin)
+	session := bearer(e.login(t, "certadmin"))
+	token := checkRoundTrip(t, e, "4532015112830366")
+
+	api := httptest.NewUnstartedServer(e.ut.apiHandler())
+	api.TLS = e.ut.apiTLSConfig
+	api.StartTLS()
+	defer api.Close()
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+	spiffe, _ := url.Parse("spiffe://corp/payments")
+	payments := newTestCert(t, &x509.Certificate{Subject: pkix.Name{CommonName: "payments"}, URIs: []*url.URL{spiffe}, ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}}, ca)
+	other := newTestCert(t, &x509.Certificate{Subject: pkix.Name{CommonName: "reports"}, ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}}, ca)
+	callWith := func(cert *testCert, method, path string, header http.Header, body interface{}) (int, map[string]interface{}) {
+		tlsConfig := &tls.Config{RootCAs: roots}
+		if cert != nil {
+			tlsConfig.Certificates = []tls.Certificate{cert.tlsCertificate()}
+		}
+		var reader io.Reader
+		if body != nil {
+			data, _ := json.Marshal(body)
+			reader = bytes.NewReader(data)
+		}
+		req, _ := http.NewRequest(method, api.URL+path, reader)
+		for k, v := range header {
+			req.Header[k] = v
+		}
+		if body != nil {
+			req.Header.Set("Content-Type", "application/json")
+		}
+		resp, err := (&http.Client{Transport: &http.Transport{TLSClientConfig: tlsConfig}}).Do(req)
+		if err != nil {
+			t.Fatalf("%s %s: %v", method, path, err)
+		}
+		defer resp.Body.Close()
+		var decoded map[string]interface{}
+		json.NewDecoder(resp.Body).Decode(&decoded)
+		return resp.StatusCode, decoded
+	}
+	reveal := func(cert *testCert, header http.Header) (int, map[string]interface{}) {
+		return callWith(cert, "POST", "/api/v1/tokens/"+token+"/reveal", header, map[string]string{"reason": "settlement"})
+	}
+
+	for _, bad := range []map[string]interface{}{
+		{"identity": "payments", "client_name": "payments", "permissions": []string{PermTokensRead}},
+		{"identity": "URI:spiffe://corp/payments", "client_name": "payments"},
+		{"identity": "URI:spiffe://corp/payments", "client_name": "payments", "permissions": []string{"tokens.everything"}},
+	} {
+		if status, body := e.call(t, "POST", "/api/v1/client-certs", session, bad); status != http.StatusBadRequest {
+			t.Errorf("POST %v: status %d: %v", bad, status, body)
+		}
+	}
+	status, created := e.call(t, "POST", "/api/v1/client-certs", session, map[string]interface{}{
+		"identity":    "URI:spiffe://corp/payments",
+		"client_name": "payments",
+		"permissions": []string{PermTokensRead, PermTokensDetokenize},
+	})
+	if status != http.StatusCreated {
+		t.Fatalf("POST /api/v1/client-certs: status %d: %v", status, created)
+	}
+	certID := created["cert_id"].(string)
+	if status, _ := e.call(t, "POST", "/api/v1/client-certs", session, map[string]interface{}{
+		"identity": "URI:spiffe://corp/payments", "client_name": "again", "permissions": []string{PermTokensRead},
+	}); status != http.StatusConflict {
+		t.Errorf("duplicate identity: status %d", status)
+	}
+
+	if status, body := reveal(payments, nil); status != http.StatusOK || body["card_number"] != "4532015112830366" {
+		t.Errorf("reveal with the certificate: status %d: %v", status, body)
+	}
+	if status, _ := callWith(payments, "GET", "/api/v1/users", nil, nil); status != http.StatusForbidden {
+		t.Errorf("permission the identity was not granted: status %d", status)
+	}
+	if status, _ := callWith(payments, "GET", "/api/v1/tokens", http.Header{"Origin": {"https://evil.example"}}, nil); status != http.StatusUnauthorized {
+		t.Errorf("certificate sent by a browser: status %d", status)
+	}
+	if status, _ := callWith(other, "GET", "/api/v1/tokens", nil, nil); status != http.StatusUnauthorized {
+		t.Errorf("unmapped certificate: status %d", status)
+	}
+	if status, _ := callWith(nil, "GET", "/api/v1/tokens", session, nil); status != http.StatusOK {
+		t.Errorf("session without a certificate: status %d", status)
+	}
+
+	// Quotas are charged to the identity as to an API key
+	if status, body := e.call(t, "PUT", "/api/v1/quotas/client-certs/"+certID, session, map[string]interface{}{"hourly_limit": 1}); status != http.StatusOK {
+		t.Fatalf("PUT client certificate quota: status %d: %v", status, body)
+	}
+	if status, body := reveal(payments, nil); status != http.StatusTooManyRequests || body["quota"] != "client_cert" {
+		t.Errorf("reveal over the identity's quota: status %d: %v", status, body)
+	}
+
+	status, listed := e.call(t, "GET", "/api/v1/client-certs", session, nil)
+	if certs, _ := listed["client_certs"].([]interface{}); status != http.StatusOK || len(certs) != 1 || certs[0].(map[string]interface{})["last_used_at"] == nil {
+		t.Errorf("GET /api/v1/client-certs: status %d: %v", status, listed)
+	}
+	if status, _ := e.call(t, "DELETE", "/api/v1/client-certs/"+certID, session, nil); status != http.StatusOK {
+		t.Errorf("DELETE client certificate: status %d", status)
+	}
+	if status, _ := callWith(payments, "GET", "/api/v1/tokens", nil, nil); status != http.StatusUnauthorized {
+		t.Errorf("revoked identity: status %d", status)
+	}
+}
+
+// TestIntegrationAccessReview tests a review from start to its deadline:
+// decisions take effect at once, and what is left unreviewed is disabled
+func TestIntegrationAccessReview(t *testing.T) {
+	e := newIntegrationEnv(t, nil)
+	e.createUser(t, "ops", RoleAdmin)
+	e.createUser(t, "alice", RoleOperator)
+	e.createUser(t, "bob", RoleViewer)
+	e.createUser(t, "carol", RoleViewer)
+	session := bearer(e.login(t, "ops"))
+	bobSession := bearer(e.login(t, "bob"))
+	_, created := e.call(t, "POST", "/api/v1/api-keys", session, map[string]string{"client_name": "batch"})
+	apiKey, _ := created["api_key"].(string)
+
+	if status, _ := e.call(t, "GET", "/api/v1/access-reviews", bobSession, nil); status != http.StatusForbidden {
+		t.Errorf("list as a viewer: status %d", status)
+	}
+	status, review := e.call(t, "POST", "/api/v1/access-reviews", session, map[string]interface{}{"name": "Q4", "due_in_days": 7})
+	if status != http.StatusCreated {
+		t.Fatalf("start review: status %d: %v", status, review)
+	}
+	reviewID := fmt.Sprint(review["review_id"])
+	if status, _ := e.call(t, "POST", "/api/v1/access-reviews", session, map[string]string{}); status != http.StatusConflict {
+		t.Errorf("second open review: status %d", status)
+	}
+
+	items := map[string]string{}
+	for _, i := range review["items"].([]interface{}) {
+		item := i.(map[string]interface{})
+		name := fmt.Sprint(item["username"])
+		if item["subject_type"] == "api_key" {
+			name = "key " + fmt.Sprint(item["label"])
+		}
+		items[name] = fmt.Sprint(item["item_id"])
+	}
+	for _, name := range []string{"ops", "alice", "bob", "carol", "key batch"} {
+		if items[name] == "" {
+			t.Fatalf("%s is not in the review: %v", name, items)
+		}
+	}
+	decide := func(name, decision string) (int, map[string]interface{}) {
+		return e.call(t, "POST", "/api/v1/access-reviews/"+reviewID+"/items/"+items[name], session, map[string]string{"decision": decision})
+	}
+
+	// Nobody reviews their own account or keys
+	if status, _ := decide("ops", "confirm"); status != http.StatusForbidden {
+		t.Errorf("confirming oneself: status %d", status)
+	}
+	if status, _ := decide("key batch", "confirm"); status != http.StatusForbidden {
+		t.Errorf("confirming one's own key: status %d", status)
+	}
+	if status, body := decide("alice", "confirm"); status != http.StatusOK {
+		t.Errorf("confirm alice: status %d: %v", status, body)
+	}
+	if status, _ := decide("alice", "revoke"); status != http.StatusConflict {
+		t.Errorf("deciding twice: status %d", status)
+	}
+
+	// Revoking disables the account and ends its sessions at once
+	if status, body := decide("bob", "revoke"); status != http.StatusOK {
+		t.Errorf("revoke bob: status %d: %v", status, body)
+	}
+	if status, _ := e.call(t, "GET", "/api/v1/auth/me", bobSession, nil); status != http.StatusUnauthorized {
+		t.Errorf("revoked user's session: status %d", status)
+	}
+
+	// At the deadline the unreviewed are disabled, except the default admin
+	if _, err := e.ut.db.Exec("UPDATE access_reviews SET due_at = NOW() - INTERVAL 1 MINUTE WHERE review_id = ?", reviewID); err != nil {
+		t.Fatal(err)
+	}
+	e.ut.runAccessReviews()
+	_, got := e.call(t, "GET", "/api/v1/access-reviews/"+reviewID, session, nil)
+	counts, _ := got["counts"].(map[string]interface{})
+	if got["status"] != "closed" || counts["confirmed"] != 1.0 || counts["revoked"] != 1.0 || counts["pending"] != 0.0 {
+		t.Errorf("closed review: %v", got)
+	}
+	if status, _ := e.call(t, "GET", "/api/v1/auth/me", session, nil); status != http.StatusUnauthorized {
+		t.Errorf("unreviewed user's session: status %d", status)
+	}
+	if status, _ := e.call(t, "GET", "/api/v1/tokens", apiKeyHeader(apiKey), nil); status != http.StatusUnauthorized {
+		t.Errorf("unreviewed key: status %d", status)
+	}
+	active := map[string]bool{}
+	rows, err := e.ut.db.Query("SELECT user_id, is_active FROM users")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for rows.Next() {
+		var userID string
+		var isActive bool
+		rows.Scan(&userID, &isActive)
+		active[userID] = isActive
+	}
+	rows.Close()
+	if !active["usr_admin_default"] || !active["usr_alice"] || active["usr_bob"] || active["usr_carol"] {
+		t.Errorf("accounts after the deadline: %v", active)
+	}
+	if closed := e.securityEventDetails(t, "access_review_closed"); len(closed) != 1 || !strings.Contains(closed[0], "carol") {
+		t.Errorf("access_review_closed events: %v", closed)
+	}
+}
+
+// TestIntegrationInactivity tests that idle accounts and unused keys are
+// warned about, then disabled, as their role's policy says
+func TestIntegrationInactivity(t *testing.T) {
+	e := newIntegrationEnv(t, map[string]string{"INACTIVE_USER_DAYS": "30", "STALE_API_KEY_DAYS": "60", "INACTIVITY_WARNING_DAYS": "7"})
+	e.createUser(t, "ops", RoleAdmin)
+	e.createUser(t, "alice", RoleOperator)
+	e.createUser(t, "carol", RoleViewer)
+	session := bearer(e.login(t, "ops"))
+	aliceSession := bearer(e.login(t, "alice"))
+	_, created := e.call(t, "POST", "/api/v1/api-keys", session, map[string]string{"client_name": "batch"})
+	apiKey, _ := created["api_key"].(string)
+
+	// Viewers are never disabled for inactivity
+	if status, body := e.call(t, "PUT", "/api/v1/roles/viewer", session, map[string]int{"inactive_user_days": 0}); status != http.StatusOK || body["inactive_user_days"] != 0.0 {
+		t.Fatalf("set viewer policy: status %d: %v", status, body)
+	}
+	if status, _ := e.call(t, "PUT", "/api/v1/roles/admin", session, map[string]string{"description": "x"}); status != http.StatusForbidden {
+		t.Errorf("changing the admin role's description: status %d", status)
+	}
+	for _, query := range []string{
+		"UPDATE users SET created_at = NOW() - INTERVAL 400 DAY, last_login_at = NOW() - INTERVAL 40 DAY WHERE username = 'alice'",
+		"UPDATE users SET created_at = NOW() - INTERVAL 400 DAY, last_login_at = NULL WHERE username = 'carol'",
+		"UPDATE api_keys SET created_at = NOW() - INTERVAL 100 DAY, last_used_at = NOW() - INTERVAL 70 DAY",
+	} {
+		if _, err := e.ut.db.Exec(query); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// A warning comes first, even past the deadline
+	e.ut.disableInactive()
+	e.ut.disableInactive()
+	if warnings := e.securityEventDetails(t, "user_inactive"); len(warnings) != 1 {
+		t.Errorf("user_inactive warnings: %v", warnings)
+	}
+	if warnings := e.securityEventDetails(t, "api_key_stale"); len(warnings) != 1 || !strings.Contains(warnings[0], apiKey) {
+		t.Errorf("api_key_stale warnings: %v", warnings)
+	}
+	if status, _ := e.call(t, "GET", "/api/v1/auth/me", aliceSession, nil); status != http.StatusOK {
+		t.Errorf("warned user's session: status %d", status)
+	}
+
+	// and the warning period has to pass before anything is disabled
+	if _, err := e.ut.db.Exec("UPDATE users SET inactivity_warned_at = NOW() - INTERVAL 8 DAY WHERE inactivity_warned_at IS NOT NULL"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := e.ut.db.Exec("UPDATE api_keys SET inactivity_warned_at = NOW() - INTERVAL 8 DAY WHERE inactivity_warned_at IS NOT NULL"); err != nil {
+		t.Fatal(err)
+	}
+	e.ut.disableInactive()
+	if status, _ := e.call(t, "GET", "/api/v1/auth/me", aliceSession, nil); status != http.StatusUnauthorized {
+		t.Errorf("inactive user's session: status %d", status)
+	}
+	if status, _ := e.call(t, "GET", "/api/v1/tokens", apiKeyHeader(apiKey), nil); status != http.StatusUnauthorized {
+		t.Errorf("stale key: status %d", status)
+	}
+	_, stats := e.call(t, "GET", "/api/v1/stats", session, nil)
+	inactivity, _ := stats["inactivity"].(map[string]interface{})
+	if inactivity["users_disabled"] != 1.0 || inactivity["api_keys_disabled"] != 1.0 || inactivity["inactive_user_days"] != 30.0 {
+		t.Errorf("stats: %v", stats)
+	}
+
+	// Enabling the account again restarts its inactivity
+	if status, body := e.call(t, "PUT", "/api/v1/users/alice", session, map[string]bool{"is_active": true}); status != http.StatusOK {
+		t.Fatalf("enable alice: status %d: %v", status, body)
+	}
+	e.ut.disableInactive()
+	var active bool
+	e.ut.db.QueryRow("SELECT is_active FROM users WHERE username = 'alice'").Scan(&active)
+	if !active {
+		t.Error("alice was disabled again right after being enabled")
+	}
+	e.ut.db.QueryRow("SELECT is_active FROM users WHERE username = 'carol'").Scan(&active)
+	if !active {
+		t.Error("carol was disabled although viewers are exempt")
+	}
+}
+
+// TestIntegrationPasswordChangeRequired tests that a session with a
+// temporary password can only change it
+func TestIntegrationPasswordChangeRequired(t *testing.T) {
+	e := newIntegrationEnv(t, nil)
+	e.createUser(t, "ops", RoleAdmin)
+	e.createUser(t, "bob", RoleOperator)
+	session := bearer(e.login(t, "ops"))
+
+	status, reset := e.call(t, "POST", "/api/v1/users/bob/reset-password", session, nil)
+	if status != http.StatusOK {
+		t.Fatalf("reset password: status %d: %v", status, reset)
+	}
+	tempPassword := reset["temporary_password"].(string)
+	status, login := e.call(t, "POST", "/api/v1/auth/login", nil, map[string]string{"username": "bob", "password": tempPassword})
+	if status != http.StatusOK || login["require_password_change"] != true {
+		t.Fatalf("login with the temporary password: status %d: %v", status, login)
+	}
+	bobSession := bearer(login["session_id"].(string))
+
+	for _, path := range []string{"/api/v1/tokens", "/api/v1/stats", "/api/v1/api-keys"} {
+		if status, body := e.call(t, "GET", path, bobSession, nil); status != http.StatusForbidden || body["code"] != "password_change_required" {
+			t.Errorf("GET %s before changing the password: status %d: %v", path, status, body)
+		}
+	}
+	if status, me := e.call(t, "GET", "/api/v1/auth/me", bobSession, nil); status != http.StatusOK || me["require_password_change"] != true {
+		t.Errorf("GET /api/v1/auth/me: status %d: %v", status, me)
+	}
+
+	if status, body := e.call(t, "POST", "/api/v1/auth/change-password", bobSession, map[string]string{
+		"current_password": tempPassword, "new_password": "Bobs-Own-Passw0rd!",
+	}); status != http.StatusOK {
+		t.Fatalf("change password: status %d: %v", status, body)
+	}
+	if status, body := e.call(t, "GET", "/api/v1/tokens", bobSession, nil); status != http.StatusOK {
+		t.Errorf("GET /api/v1/tokens after changing the password: status %d: %v", status, body)
+	}
+	if status, me := e.call(t, "GET", "/api/v1/auth/me", bobSession, nil); status != http.StatusOK || me["require_password_change"] != nil {
+		t.Errorf("GET /api/v1/auth/me after changing the password: status %d: %v", status, me)
+	}
+}
+
+// TestIntegrationTokenizationEngine tests handing the cards of a mapped
+// path to an external engine instead of the vault, and detokenizing the
+// engine's tokens in responses
+func TestIntegrationTokenizationEngine(t *testing.T) {
+	fake := newFakeEngine(t)
+	engines, _ := json.Marshal(map[string]engine.Config{
+		"fpe": {URL: fake.URL, TokenPattern: "fpe_[0-9]{8}", CAFile: fake.caFile},
+	})
+	e := newIntegrationEnv(t, map[string]string{
+		"TOKENIZATION_ENGINES": string(engines),
+		"CARD_FIELD_MAPPINGS":  `{"/api/wallet": {"engine": "fpe"}}`,
+	})
+	card := testCards[1]
+
+	resp, err := http.Post(e.proxy.URL+"/api/wallet/cards", "application/json", strings.NewReader(`{"card_number":"`+card+`"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	var forwarded map[string]string
+	json.Unmarshal([]byte(e.upstream.lastBody()), &forwarded)
+	token := forwarded["card_number"]
+	if token != "fpe_00009903" {
+		t.Fatalf("upstream received card_number %q, want the engine's token", token)
+	}
+	var stored, logged int
+	e.ut.db.QueryRow("SELECT COUNT(*) FROM credit_cards").Scan(&stored)
+	e.ut.db.QueryRow("SELECT COUNT(*) FROM token_requests WHERE token = ? AND request_type = 'tokenize'", token).Scan(&logged)
+	if stored != 0 || logged != 1 {
+		t.Errorf("engine tokenization stored %d cards and logged %d requests, want 0 and 1", stored, logged)
+	}
+
+	// Other paths still tokenize in the vault
+	checkRoundTrip(t, e, testCards[0])
+
+	e.upstream.respond("/api/wallet/cards", "application/json", `{"cards":[{"card_number":"`+token+`"},{"card_number":"fpe_99999999"}]}`)
+	resp, err = http.Get(e.proxy.URL + "/api/wallet/cards")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if !strings.Contains(string(body), card) || !strings.Contains(string(body), "fpe_99999999") {
+		t.Errorf("GET /api/wallet/cards through the proxy = %s, want the engine's token detokenized and the unknown one kept", body)
+	}
+
+	e.createUser(t, "rulesadmin", RoleAdmin)
+	session := bearer(e.login(t, "rulesadmin"))
+	if status, body := e.call(t, "PUT", "/api/v1/config/field-rules", session, map[string]interface{}{
+		"card_field_mappings": map[string]interface{}{"/api/wallet": map[string]string{"engine": "scheme"}},
+	}); status != http.StatusBadRequest {
+		t.Errorf("PUT rules naming an unconfigured engine: status %d: %v", status, body)
+	}
+	status, result := e.call(t, "POST", "/api/v1/config/field-rules/test", session, map[string]interface{}{
+		"path": "/api/wallet", "payload": map[string]string{"card_number": card},
+	})
+	if fields, _ := result["fields"].([]interface{}); status != http.StatusOK || len(fields) != 1 || fields[0].(map[string]interface{})["engine"] != "fpe" {
+		t.Errorf("field rule test: status %d: %v", status, result)
+	}
+	resp, err = http.Get(e.api.URL + "/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	metrics, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	for _, want := range []string{
+		`tokenshield_engine_calls_total{engine="fpe",result="tokenized"} 1` + "\n",
+		`tokenshield_engine_calls_total{engine="fpe",result="detokenized"} 1` + "\n",
+		`tokenshield_engine_calls_total{engine="fpe",result="not_found"} 1` + "\n",
+	} {
+		if !strings.Contains(string(metrics), want) {
+			t.Errorf("metrics missing %q", want)
+		}
+	}
+}
+
+func TestIntegrationNetworkTokens(t *testing.T) {
+	fake := newFakeTokenService(t)
+	connectors, _ := json.Marshal(map[string]nettoken.Config{
+		"visa": {URL: fake.URL, TokenRequestorID: "40010030273", APIKey: "secret", CAFile: fake.caFile},
+	})
+	e := newIntegrationEnv(t, map[string]string{"NETWORK_TOKEN_CONNECTORS": string(connectors)})
+	token := checkRoundTrip(t, e, testCards[0])
+	other := checkRoundTrip(t, e, testCards[1])
+	e.createUser(t, "ntadmin", RoleAdmin)
+	session := bearer(e.login(t, "ntadmin"))
+	path := "/api/v1/tokens/" + token + "/network-token"
+
+	if status, body := e.call(t, "GET", path, session, nil); status != http.StatusNotFound || body["code"] != "network_token_not_found" {
+		t.Errorf("GET before provisioning: status %d: %v", status, body)
+	}
+	status, body := e.call(t, "POST", path, session, nil)
+	if status != http.StatusCreated || body["scheme"] != "visa" || body["last_four"] != "5366" || body["status"] != "active" || body["network_token"] != nil {
+		t.Fatalf("POST network-token: status %d: %v", status, body)
+	}
+	if status, body := e.call(t, "POST", path, session, nil); status != http.StatusConflict {
+		t.Errorf("second POST network-token: status %d: %v", status, body)
+	}
+	if status, body := e.call(t, "POST", "/api/v1/tokens/"+other+"/network-token", session, nil); status != http.StatusServiceUnavailable || body["code"] != "scheme_not_configured" {
+		t.Errorf("POST network-token of a Mastercard: status %d: %v", status, body)
+	}
+	var stored []byte
+	e.ut.db.QueryRow("SELECT network_token_encrypted FROM network_tokens WHERE token = ?", token).Scan(&stored)
+	if len(stored) == 0 || bytes.Contains(stored, []byte("4895370012345366")) {
+		t.Error("the network token should be stored encrypted")
+	}
+
+	tx := map[string]string{"transaction_type": "ecommerce", "amount": "10.00", "currency": "EUR"}
+	status, body = e.call(t, "POST", path+"/cryptogram", session, tx)
+	if status != http.StatusOK || body["network_token"] != "4895370012345366" || body["cryptogram"] != "AgAAAAAA1" || body["eci"] != "05" {
+		t.Errorf("cryptogram: status %d: %v", status, body)
+	}
+	// The scheme replaces the network token with the second cryptogram
+	status, body = e.call(t, "POST", path+"/cryptogram", session, tx)
+	if status != http.StatusOK || body["network_token"] != "4895370099999999" || body["expiry_year"] != float64(2033) {
+		t.Errorf("cryptogram after reissue: status %d: %v", status, body)
+	}
+	status, body = e.call(t, "GET", path, session, nil)
+	if status != http.StatusOK || body["last_four"] != "9999" || body["cryptograms_issued"] != float64(2) {
+		t.Errorf("GET network-token: status %d: %v", status, body)
+	}
+
+	// A revoked card is refused cryptograms but keeps its network token
+	e.call(t, "DELETE", "/api/v1/tokens/"+token, session, nil)
+	if status, body := e.call(t, "POST", path+"/cryptogram", session, tx); status != http.StatusConflict || body["code"] != "token_revoked" {
+		t.Errorf("cryptogram of a revoked token: status %d: %v", status, body)
+	}
+	e.call(t, "POST", "/api/v1/tokens/"+token+"/restore", session, nil)
+
+	if status, body := e.call(t, "DELETE", path, session, nil); status != http.StatusOK {
+		t.Errorf("DELETE network-token: status %d: %v", status, body)
+	}
+	if status, _ := e.call(t, "GET", path, session, nil); status != http.StatusNotFound {
+		t.Errorf("GET after DELETE: status %d, want 404", status)
+	}
+
+	// The network token of a purged card is deleted at the scheme
+	if status, body := e.call(t, "POST", path, session, nil); status != http.StatusCreated {
+		t.Fatalf("POST network-token again: status %d: %v", status, body)
+	}
+	e.call(t, "DELETE", "/api/v1/tokens/"+token, session, nil)
+	e.ut.db.Exec("UPDATE credit_cards SET purge_after = NOW() - INTERVAL 1 MINUTE WHERE token = ?", token)
+	e.ut.purgeRevokedTokens()
+	e.ut.deleteOrphanNetworkTokens()
+	var left int
+	e.ut.db.QueryRow("SELECT COUNT(*) FROM network_tokens").Scan(&left)
+	fake.mu.Lock()
+	atScheme := len(fake.tokens)
+	fake.mu.Unlock()
+	if left != 0 || atScheme != 0 {
+		t.Errorf("after purging the card %d network tokens are stored and %d at the scheme, want none", left, atScheme)
+	}
+
+	var audited int
+	e.ut.db.QueryRow("SELECT COUNT(*) FROM user_audit_log WHERE resource_id = ? AND action LIKE 'network_token_%'", token).Scan(&audited)
+	if audited != 5 {
+		t.Errorf("%d network token audit entries, want 5", audited)
+	}
+	resp, err := http.Get(e.api.URL + "/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	metrics, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	for _, want := range []string{
+		`tokenshield_network_token_calls_total{scheme="visa",result="provisioned"} 2` + "\n",
+		`tokenshield_network_token_calls_total{scheme="visa",result="cryptogram"} 2` + "\n",
+		`tokenshield_network_token_calls_total{scheme="visa",result="deleted"} 2` + "\n",
+	} {
+		if !strings.Contains(string(metrics), want) {
+			t.Errorf("metrics missing %q", want)
+		}
+	}
+}
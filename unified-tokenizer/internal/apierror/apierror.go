@@ -0,0 +1,160 @@
+// Package apierror writes the management API's error responses and gives
+// each request an ID to quote in them. Every error has the same body:
+//
+//	{"code": "token_not_found", "message": "Token not found", "details": {...}, "request_id": "req_..."}
+//
+// Clients should branch on code, which is stable; message is for people and
+// may change. For clients written before codes existed, "error" repeats the
+// message and the details are repeated at the top level.
+package apierror
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"regexp"
+
+	"tokenshield-unified/internal/securerand"
+)
+
+// Error codes. New codes may be added; existing ones keep their meaning.
+const (
+	InvalidRequest           = "invalid_request"           // A parameter or field is missing or invalid
+	InvalidBody              = "invalid_body"              // The body could not be read or is not valid JSON
+	ValidationFailed         = "validation_failed"         // The body failed input validation; see details.validation_errors
+	UnsupportedMediaType     = "unsupported_media_type"    // The body is not application/json
+	AuthenticationRequired   = "authentication_required"   // No session or API key was given
+	InvalidCredentials       = "invalid_credentials"       // Login failed, or the current password is wrong
+	ChallengeRequired        = "challenge_required"        // Too many failed logins: pass the challenge in details and log in again
+	InvalidSession           = "invalid_session"           // The session is unknown or has expired
+	ReauthenticationRequired = "reauthentication_required" // The session is used from another network or browser; confirm the password at /api/v1/auth/reauthenticate
+	PasswordChangeRequired   = "password_change_required"  // The password is temporary; change it at /api/v1/auth/change-password first
+	PermissionDenied         = "permission_denied"         // The caller's role lacks the permission
+	CSRFRejected             = "csrf_rejected"             // A cookie-authenticated request lacked its CSRF token
+	IPBlocked                = "ip_blocked"                // The client address is refused by the IP filter
+	NotFound                 = "not_found"                 // No such resource or path
+	TokenNotFound            = "token_not_found"
+	UserNotFound             = "user_not_found"
+	APIKeyNotFound           = "api_key_not_found"
+	ClientCertNotFound       = "client_cert_not_found"
+	RoleNotFound             = "role_not_found"
+	ServiceAccountNotFound   = "service_account_not_found"
+	MethodNotAllowed         = "method_not_allowed"
+	Conflict                 = "conflict"       // The resource is not in a state that allows the request
+	AlreadyExists            = "already_exists" // A resource with that name exists
+	TokenRevoked             = "token_revoked"
+	NetworkTokenNotFound     = "network_token_not_found"
+	JobRunning               = "job_running" // A job of that kind is running; its ID is in details
+	Gone                     = "gone"        // The endpoint is past its sunset date
+	RateLimited              = "rate_limited"
+	QuotaExceeded            = "quota_exceeded"
+	VaultSealed              = "vault_sealed"
+	MaintenanceMode          = "maintenance_mode" // Paused while maintenance mode is on; see Retry-After
+	ConfigFrozen             = "config_frozen"    // Configuration changes are blocked by the config freeze
+	KEKDEKDisabled           = "kek_dek_disabled"
+	MailNotConfigured        = "mail_not_configured"   // Account emails are off: MAIL_SMTP_ADDR is not set
+	SchemeNotConfigured      = "scheme_not_configured" // NETWORK_TOKEN_CONNECTORS has no connector for the card's scheme
+	NetworkTokenFailed       = "network_token_failed"  // The scheme's token service refused or failed the request; see details
+	AccountTokenInvalid      = "account_token_invalid" // A verification or password reset token is unknown, used or expired
+	InvalidSignature         = "invalid_signature"     // A signed request was refused, or a signed API key was sent unsigned
+	APIKeyExpired            = "api_key_expired"       // The API key is past its expires_at; rotate it
+	InternalError            = "internal_error"
+)
+
+// Body is the JSON body of an error response
+type Body struct {
+	Code      string                 `json:"code"`
+	Message   string                 `json:"message"`
+	Details   map[string]interface{} `json:"details,omitempty"`
+	RequestID string                 `json:"request_id,omitempty"`
+}
+
+// MarshalJSON adds the legacy fields: "error" with the message, and each
+// detail at the top level
+func (b Body) MarshalJSON() ([]byte, error) {
+	out := make(map[string]interface{}, len(b.Details)+5)
+	for k, v := range b.Details {
+		out[k] = v
+	}
+	out["error"] = b.Message
+	out["code"] = b.Code
+	out["message"] = b.Message
+	if len(b.Details) > 0 {
+		out["details"] = b.Details
+	}
+	if b.RequestID != "" {
+		out["request_id"] = b.RequestID
+	}
+	return json.Marshal(out)
+}
+
+// Write answers r with status and an error body
+func Write(w http.ResponseWriter, r *http.Request, status int, code, message string) {
+	WriteDetails(w, r, status, code, message, nil)
+}
+
+// WriteDetails answers r with status and an error body carrying details
+func WriteDetails(w http.ResponseWriter, r *http.Request, status int, code, message string, details map[string]interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(Body{Code: code, Message: message, Details: details, RequestID: RequestID(r)})
+}
+
+// CodeForStatus is the general code for an error with status, for errors
+// that have no more specific one
+func CodeForStatus(status int) string {
+	switch status {
+	case http.StatusUnauthorized:
+		return AuthenticationRequired
+	case http.StatusForbidden:
+		return PermissionDenied
+	case http.StatusNotFound:
+		return NotFound
+	case http.StatusMethodNotAllowed:
+		return MethodNotAllowed
+	case http.StatusConflict:
+		return Conflict
+	case http.StatusGone:
+		return Gone
+	case http.StatusUnsupportedMediaType:
+		return UnsupportedMediaType
+	case http.StatusTooManyRequests:
+		return RateLimited
+	}
+	if status >= 500 {
+		return InternalError
+	}
+	return InvalidRequest
+}
+
+// RequestIDHeader carries the request ID in both directions
+const RequestIDHeader = "X-Request-ID"
+
+type requestIDKey struct{}
+
+// A request ID given by the client is kept when it looks like one
+var requestIDPattern = regexp.MustCompile(`^[A-Za-z0-9._:-]{1,64}$`)
+
+// RequestIDs gives each request an ID, taken from its X-Request-ID header
+// when it has a usable one, and returns it in the X-Request-ID response
+// header
+func RequestIDs(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(RequestIDHeader)
+		if !requestIDPattern.MatchString(id) {
+			id = "req_" + hex.EncodeToString(securerand.Bytes(12))
+		}
+		w.Header().Set(RequestIDHeader, id)
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), requestIDKey{}, id)))
+	})
+}
+
+// RequestID returns the ID RequestIDs gave r, or "" outside it
+func RequestID(r *http.Request) string {
+	if r == nil {
+		return ""
+	}
+	id, _ := r.Context().Value(requestIDKey{}).(string)
+	return id
+}
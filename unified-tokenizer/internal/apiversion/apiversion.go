@@ -0,0 +1,182 @@
+// Package apiversion routes /api/vN requests to per-version handlers. A
+// version only registers what it changes: a request for a path the version
+// does not register is served by the newest earlier version that does, so
+// v2 clients can use every v1 endpoint. Registrations can be marked
+// deprecated, which adds Deprecation, Sunset and Link headers to their
+// responses and answers 410 Gone once the sunset date has passed.
+package apiversion
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"time"
+
+	"tokenshield-unified/internal/apierror"
+)
+
+// Header is set on every versioned response to the version that served it
+const Header = "API-Version"
+
+// Deprecation marks a registration as on its way out
+type Deprecation struct {
+	Method    string    // Only requests with this method; all when empty
+	Since     time.Time // When it was deprecated
+	Sunset    time.Time // When it stops being served; never when zero
+	Successor string    // Path of what replaces it, if anything
+}
+
+// Router dispatches requests to the mux of the version in their path
+type Router struct {
+	latest       int
+	muxes        []*http.ServeMux // Indexed by version; 0 is unused
+	deprecations map[string][]Deprecation
+
+	// OnDeprecated, when set, is called for each request served by a
+	// deprecated registration, and Now replaces time.Now for sunset checks
+	OnDeprecated func(r *http.Request, version int, pattern string)
+	Now          func() time.Time
+}
+
+var versionPath = regexp.MustCompile(`^/api/v([0-9]+)(/.*)?$`)
+
+// New returns a router for versions 1 to latest
+func New(latest int) *Router {
+	rt := &Router{latest: latest, muxes: make([]*http.ServeMux, latest+1), deprecations: make(map[string][]Deprecation)}
+	for v := 1; v <= latest; v++ {
+		rt.muxes[v] = http.NewServeMux()
+	}
+	return rt
+}
+
+// Latest is the newest version served
+func (rt *Router) Latest() int {
+	return rt.latest
+}
+
+// Mux returns where version's handlers are registered. Patterns on it are
+// written with the version's prefix, /api/vN/... Paths outside /api (like
+// /health) belong on version 1's mux.
+func (rt *Router) Mux(version int) *http.ServeMux {
+	return rt.muxes[version]
+}
+
+// Deprecate marks the handler registered on version's mux under pattern as
+// deprecated
+func (rt *Router) Deprecate(version int, pattern string, d Deprecation) {
+	key := strconv.Itoa(version) + " " + pattern
+	rt.deprecations[key] = append(rt.deprecations[key], d)
+}
+
+// deprecation returns how the registration serving method on version's
+// pattern is deprecated, if it is
+func (rt *Router) deprecation(version int, pattern, method string) (Deprecation, bool) {
+	for _, d := range rt.deprecations[strconv.Itoa(version)+" "+pattern] {
+		if d.Method == "" || d.Method == method {
+			return d, true
+		}
+	}
+	return Deprecation{}, false
+}
+
+type handlerKey struct{}
+
+// Handler returns the router behind wrap, which is applied once to the
+// dispatch. Requests are resolved to a version before wrap runs, and a
+// request served by an earlier version reaches wrap with that version's
+// path, so middleware matching on /api/v1 paths applies to every version
+// that falls back to them.
+func (rt *Router) Handler(wrap func(http.Handler) http.Handler) http.Handler {
+	dispatch := wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.Context().Value(handlerKey{}).(http.Handler).ServeHTTP(w, r)
+	}))
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handler, r := rt.resolve(w, r)
+		dispatch.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), handlerKey{}, handler)))
+	})
+}
+
+func (rt *Router) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	handler, r := rt.resolve(w, r)
+	handler.ServeHTTP(w, r)
+}
+
+// resolve finds the handler for r and the request to pass it, and sets
+// the version and deprecation headers
+func (rt *Router) resolve(w http.ResponseWriter, r *http.Request) (http.Handler, *http.Request) {
+	match := versionPath.FindStringSubmatch(r.URL.Path)
+	if match == nil {
+		handler, pattern := rt.muxes[1].Handler(r)
+		if pattern == "" {
+			return errorHandler(http.StatusNotFound, apierror.NotFound, "Not found"), r
+		}
+		return handler, r
+	}
+	requested, err := strconv.Atoi(match[1])
+	if err != nil || requested < 1 || requested > rt.latest {
+		return errorHandler(http.StatusNotFound, apierror.NotFound, fmt.Sprintf("API version v%s does not exist; the latest is v%d", match[1], rt.latest)), r
+	}
+
+	for v := requested; v >= 1; v-- {
+		vr := r
+		if v != requested {
+			vr = withPath(r, "/api/v"+strconv.Itoa(v)+match[2])
+		}
+		handler, pattern := rt.muxes[v].Handler(vr)
+		if pattern == "" {
+			continue
+		}
+		w.Header().Set(Header, strconv.Itoa(v))
+		if d, ok := rt.deprecation(v, pattern, r.Method); ok {
+			if rt.OnDeprecated != nil {
+				rt.OnDeprecated(r, v, pattern)
+			}
+			if !d.Since.IsZero() {
+				w.Header().Set("Deprecation", "@"+strconv.FormatInt(d.Since.Unix(), 10))
+			} else {
+				w.Header().Set("Deprecation", "true")
+			}
+			if d.Successor != "" {
+				w.Header().Add("Link", "<"+d.Successor+">; rel=\"successor-version\"")
+			}
+			if !d.Sunset.IsZero() {
+				w.Header().Set("Sunset", d.Sunset.UTC().Format(http.TimeFormat))
+				if !rt.now().Before(d.Sunset) {
+					msg := fmt.Sprintf("%s %s was retired on %s", r.Method, r.URL.Path, d.Sunset.UTC().Format("2006-01-02"))
+					if d.Successor != "" {
+						msg += "; use " + d.Successor
+					}
+					return errorHandler(http.StatusGone, apierror.Gone, msg), vr
+				}
+			}
+		}
+		return handler, vr
+	}
+	return errorHandler(http.StatusNotFound, apierror.NotFound, "Not found"), r
+}
+
+func (rt *Router) now() time.Time {
+	if rt.Now != nil {
+		return rt.Now()
+	}
+	return time.Now()
+}
+
+// withPath returns a shallow copy of r for path
+func withPath(r *http.Request, path string) *http.Request {
+	r2 := new(http.Request)
+	*r2 = *r
+	u := *r.URL
+	u.Path = path
+	u.RawPath = ""
+	r2.URL = &u
+	return r2
+}
+
+func errorHandler(status int, code, msg string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		apierror.Write(w, r, status, code, msg)
+	})
+}
@@ -0,0 +1,540 @@
+// Package avro decodes and encodes Avro binary data with a schema, into
+// and from the generic values encoding/json uses, so the same tree walk
+// can rewrite both. It also reads the Confluent wire format, where a
+// message starts with a zero byte and a schema registry ID.
+package avro
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+)
+
+// Schema is a parsed Avro schema
+type Schema struct {
+	Type     string // null, boolean, int, long, float, double, bytes, string, record, enum, array, map, fixed or union
+	Name     string // Full name of named types
+	Fields   []Field
+	Symbols  []string
+	Items    *Schema
+	Values   *Schema
+	Size     int
+	Branches []*Schema
+}
+
+// Field is a record field
+type Field struct {
+	Name string
+	Type *Schema
+}
+
+// Parse parses a schema in its JSON form
+func Parse(text string) (*Schema, error) {
+	var v interface{}
+	if err := json.Unmarshal([]byte(text), &v); err != nil {
+		return nil, fmt.Errorf("avro: invalid schema: %v", err)
+	}
+	p := parser{named: make(map[string]*Schema)}
+	return p.parse(v, "")
+}
+
+type parser struct {
+	named map[string]*Schema
+}
+
+var primitives = map[string]bool{
+	"null": true, "boolean": true, "int": true, "long": true,
+	"float": true, "double": true, "bytes": true, "string": true,
+}
+
+func fullName(name, namespace string) string {
+	if strings.Contains(name, ".") || namespace == "" {
+		return name
+	}
+	return namespace + "." + name
+}
+
+func (p *parser) parse(v interface{}, namespace string) (*Schema, error) {
+	switch v := v.(type) {
+	case string:
+		if primitives[v] {
+			return &Schema{Type: v}, nil
+		}
+		if s, ok := p.named[fullName(v, namespace)]; ok {
+			return s, nil
+		}
+		if s, ok := p.named[v]; ok {
+			return s, nil
+		}
+		return nil, fmt.Errorf("avro: unknown type %q", v)
+	case []interface{}:
+		s := &Schema{Type: "union"}
+		for _, b := range v {
+			branch, err := p.parse(b, namespace)
+			if err != nil {
+				return nil, err
+			}
+			s.Branches = append(s.Branches, branch)
+		}
+		return s, nil
+	case map[string]interface{}:
+		return p.parseObject(v, namespace)
+	}
+	return nil, fmt.Errorf("avro: invalid schema %v", v)
+}
+
+func (p *parser) parseObject(v map[string]interface{}, namespace string) (*Schema, error) {
+	typ, ok := v["type"].(string)
+	if !ok {
+		// {"type": {...}} wraps another schema
+		return p.parse(v["type"], namespace)
+	}
+	if primitives[typ] {
+		return &Schema{Type: typ}, nil // Logical types keep their underlying encoding
+	}
+
+	s := &Schema{Type: typ}
+	switch typ {
+	case "record", "error", "enum", "fixed":
+		name, _ := v["name"].(string)
+		if name == "" {
+			return nil, fmt.Errorf("avro: %s without a name", typ)
+		}
+		if ns, ok := v["namespace"].(string); ok && !strings.Contains(name, ".") {
+			namespace = ns
+		}
+		s.Name = fullName(name, namespace)
+		if i := strings.LastIndex(s.Name, "."); i >= 0 {
+			namespace = s.Name[:i]
+		}
+		p.named[s.Name] = s // Registered first, so records can refer to themselves
+	}
+
+	switch typ {
+	case "record", "error":
+		s.Type = "record"
+		fields, _ := v["fields"].([]interface{})
+		for _, f := range fields {
+			fm, _ := f.(map[string]interface{})
+			name, _ := fm["name"].(string)
+			if name == "" {
+				return nil, fmt.Errorf("avro: field without a name in %s", s.Name)
+			}
+			ft, err := p.parse(fm["type"], namespace)
+			if err != nil {
+				return nil, err
+			}
+			s.Fields = append(s.Fields, Field{Name: name, Type: ft})
+		}
+	case "enum":
+		symbols, _ := v["symbols"].([]interface{})
+		for _, sym := range symbols {
+			str, _ := sym.(string)
+			s.Symbols = append(s.Symbols, str)
+		}
+	case "fixed":
+		size, _ := v["size"].(float64)
+		if size < 0 {
+			return nil, fmt.Errorf("avro: invalid size for %s", s.Name)
+		}
+		s.Size = int(size)
+	case "array":
+		items, err := p.parse(v["items"], namespace)
+		if err != nil {
+			return nil, err
+		}
+		s.Items = items
+	case "map":
+		values, err := p.parse(v["values"], namespace)
+		if err != nil {
+			return nil, err
+		}
+		s.Values = values
+	default:
+		return p.parse(typ, namespace)
+	}
+	return s, nil
+}
+
+// ErrWireFormat means a message is not in the Confluent wire format
+var ErrWireFormat = errors.New("avro: not in the schema registry wire format")
+
+// SplitWireFormat returns the schema ID and Avro data of a message in the
+// Confluent wire format
+func SplitWireFormat(msg []byte) (int32, []byte, error) {
+	if len(msg) < 5 || msg[0] != 0 {
+		return 0, nil, ErrWireFormat
+	}
+	return int32(binary.BigEndian.Uint32(msg[1:])), msg[5:], nil
+}
+
+// JoinWireFormat prefixes Avro data with its schema ID
+func JoinWireFormat(id int32, data []byte) []byte {
+	msg := binary.BigEndian.AppendUint32([]byte{0}, uint32(id))
+	return append(msg, data...)
+}
+
+// maxDepth bounds nesting, so a recursive schema cannot exhaust the stack
+const maxDepth = 64
+
+// Decode decodes one datum, which must take up all of data. Records and
+// maps become map[string]interface{}, arrays []interface{}, enums string,
+// bytes and fixed []byte, and a union its branch's value.
+func Decode(s *Schema, data []byte) (interface{}, error) {
+	d := decoder{buf: data}
+	v := d.value(s, 0)
+	if d.err == nil && len(d.buf) > 0 {
+		d.err = fmt.Errorf("%d bytes after the datum", len(d.buf))
+	}
+	if d.err != nil {
+		return nil, fmt.Errorf("avro: %v", d.err)
+	}
+	return v, nil
+}
+
+type decoder struct {
+	buf []byte
+	err error
+}
+
+var errShort = errors.New("data too short")
+
+func (d *decoder) long() int64 {
+	if d.err != nil {
+		return 0
+	}
+	v, n := binary.Varint(d.buf)
+	if n <= 0 {
+		d.err = errShort
+		return 0
+	}
+	d.buf = d.buf[n:]
+	return v
+}
+
+func (d *decoder) take(n int64) []byte {
+	if d.err != nil {
+		return nil
+	}
+	if n < 0 || n > int64(len(d.buf)) {
+		d.err = errShort
+		return nil
+	}
+	b := d.buf[:n:n]
+	d.buf = d.buf[n:]
+	return b
+}
+
+// count reads a block count, which is followed by a byte size when
+// negative. Items other than nulls take at least a byte, which bounds the
+// count by the data left.
+func (d *decoder) count(items *Schema) int64 {
+	n := d.long()
+	if n < 0 {
+		d.long()
+		n = -n
+	}
+	if d.err == nil && (n > int64(len(d.buf)) && items.Type != "null" || n > 1<<20) {
+		d.err = errShort
+	}
+	return n
+}
+
+func (d *decoder) value(s *Schema, depth int) interface{} {
+	if depth > maxDepth {
+		d.err = errors.New("data nested too deeply")
+		return nil
+	}
+	if d.err != nil {
+		return nil
+	}
+	switch s.Type {
+	case "null":
+		return nil
+	case "boolean":
+		b := d.take(1)
+		return b != nil && b[0] != 0
+	case "int":
+		v := d.long()
+		if v < math.MinInt32 || v > math.MaxInt32 {
+			d.err = errors.New("int out of range")
+		}
+		return int32(v)
+	case "long":
+		return d.long()
+	case "float":
+		if b := d.take(4); b != nil {
+			return math.Float32frombits(binary.LittleEndian.Uint32(b))
+		}
+		return float32(0)
+	case "double":
+		if b := d.take(8); b != nil {
+			return math.Float64frombits(binary.LittleEndian.Uint64(b))
+		}
+		return float64(0)
+	case "bytes":
+		return d.take(d.long())
+	case "string":
+		return string(d.take(d.long()))
+	case "fixed":
+		return d.take(int64(s.Size))
+	case "enum":
+		i := d.long()
+		if i < 0 || i >= int64(len(s.Symbols)) {
+			d.err = fmt.Errorf("enum %s index %d out of range", s.Name, i)
+			return nil
+		}
+		return s.Symbols[i]
+	case "union":
+		i := d.long()
+		if i < 0 || i >= int64(len(s.Branches)) {
+			d.err = fmt.Errorf("union branch %d out of range", i)
+			return nil
+		}
+		return d.value(s.Branches[i], depth+1)
+	case "record":
+		m := make(map[string]interface{}, len(s.Fields))
+		for _, f := range s.Fields {
+			m[f.Name] = d.value(f.Type, depth+1)
+		}
+		return m
+	case "array":
+		items := []interface{}{}
+		for n := d.count(s.Items); n > 0 && d.err == nil; n = d.count(s.Items) {
+			for ; n > 0 && d.err == nil; n-- {
+				items = append(items, d.value(s.Items, depth+1))
+			}
+		}
+		return items
+	case "map":
+		m := make(map[string]interface{})
+		for n := d.count(s.Values); n > 0 && d.err == nil; n = d.count(s.Values) {
+			for ; n > 0 && d.err == nil; n-- {
+				key := string(d.take(d.long()))
+				m[key] = d.value(s.Values, depth+1)
+			}
+		}
+		return m
+	}
+	d.err = fmt.Errorf("unknown type %q", s.Type)
+	return nil
+}
+
+// Encode encodes a value of the shape Decode returns. A union takes the
+// first branch the value fits; for maps, a record branch fits when the
+// map has exactly its fields.
+func Encode(s *Schema, v interface{}) ([]byte, error) {
+	b, err := encode(nil, s, v, 0)
+	if err != nil {
+		return nil, fmt.Errorf("avro: %v", err)
+	}
+	return b, nil
+}
+
+func encode(b []byte, s *Schema, v interface{}, depth int) ([]byte, error) {
+	if depth > maxDepth {
+		return nil, errors.New("value nested too deeply")
+	}
+	mismatch := func() ([]byte, error) {
+		return nil, fmt.Errorf("%T does not fit %s", v, s.Type)
+	}
+	switch s.Type {
+	case "null":
+		if v != nil {
+			return mismatch()
+		}
+		return b, nil
+	case "boolean":
+		bv, ok := v.(bool)
+		if !ok {
+			return mismatch()
+		}
+		if bv {
+			return append(b, 1), nil
+		}
+		return append(b, 0), nil
+	case "int", "long":
+		n, ok := integer(v)
+		if !ok {
+			return mismatch()
+		}
+		return binary.AppendVarint(b, n), nil
+	case "float":
+		f, ok := float(v)
+		if !ok {
+			return mismatch()
+		}
+		return binary.LittleEndian.AppendUint32(b, math.Float32bits(float32(f))), nil
+	case "double":
+		f, ok := float(v)
+		if !ok {
+			return mismatch()
+		}
+		return binary.LittleEndian.AppendUint64(b, math.Float64bits(f)), nil
+	case "bytes", "string":
+		var data []byte
+		switch v := v.(type) {
+		case string:
+			data = []byte(v)
+		case []byte:
+			data = v
+		default:
+			return mismatch()
+		}
+		return append(binary.AppendVarint(b, int64(len(data))), data...), nil
+	case "fixed":
+		data, ok := v.([]byte)
+		if !ok || len(data) != s.Size {
+			return mismatch()
+		}
+		return append(b, data...), nil
+	case "enum":
+		str, ok := v.(string)
+		if !ok {
+			return mismatch()
+		}
+		for i, sym := range s.Symbols {
+			if sym == str {
+				return binary.AppendVarint(b, int64(i)), nil
+			}
+		}
+		return nil, fmt.Errorf("%q is not a symbol of enum %s", str, s.Name)
+	case "union":
+		for i, branch := range s.Branches {
+			if fits(branch, v) {
+				return encode(binary.AppendVarint(b, int64(i)), branch, v, depth+1)
+			}
+		}
+		return nil, fmt.Errorf("%T fits no branch of the union", v)
+	case "record":
+		m, ok := v.(map[string]interface{})
+		if !ok {
+			return mismatch()
+		}
+		var err error
+		for _, f := range s.Fields {
+			if b, err = encode(b, f.Type, m[f.Name], depth+1); err != nil {
+				return nil, fmt.Errorf("field %s: %v", f.Name, err)
+			}
+		}
+		return b, nil
+	case "array":
+		items, ok := v.([]interface{})
+		if !ok {
+			return mismatch()
+		}
+		if len(items) > 0 {
+			b = binary.AppendVarint(b, int64(len(items)))
+			var err error
+			for _, item := range items {
+				if b, err = encode(b, s.Items, item, depth+1); err != nil {
+					return nil, err
+				}
+			}
+		}
+		return append(b, 0), nil
+	case "map":
+		m, ok := v.(map[string]interface{})
+		if !ok {
+			return mismatch()
+		}
+		if len(m) > 0 {
+			b = binary.AppendVarint(b, int64(len(m)))
+			var err error
+			for key, value := range m {
+				b = append(binary.AppendVarint(b, int64(len(key))), key...)
+				if b, err = encode(b, s.Values, value, depth+1); err != nil {
+					return nil, err
+				}
+			}
+		}
+		return append(b, 0), nil
+	}
+	return nil, fmt.Errorf("unknown type %q", s.Type)
+}
+
+// fits reports whether a value can be encoded with a union branch
+func fits(s *Schema, v interface{}) bool {
+	switch s.Type {
+	case "null":
+		return v == nil
+	case "boolean":
+		_, ok := v.(bool)
+		return ok
+	case "int":
+		_, ok := v.(int32)
+		return ok
+	case "long":
+		_, ok := v.(int64)
+		return ok
+	case "float":
+		_, ok := v.(float32)
+		return ok
+	case "double":
+		_, ok := v.(float64)
+		return ok
+	case "string":
+		_, ok := v.(string)
+		return ok
+	case "bytes":
+		_, ok := v.([]byte)
+		return ok
+	case "fixed":
+		data, ok := v.([]byte)
+		return ok && len(data) == s.Size
+	case "enum":
+		str, ok := v.(string)
+		if !ok {
+			return false
+		}
+		for _, sym := range s.Symbols {
+			if sym == str {
+				return true
+			}
+		}
+		return false
+	case "array":
+		_, ok := v.([]interface{})
+		return ok
+	case "map":
+		_, ok := v.(map[string]interface{})
+		return ok
+	case "record":
+		m, ok := v.(map[string]interface{})
+		if !ok || len(m) != len(s.Fields) {
+			return false
+		}
+		for _, f := range s.Fields {
+			if _, ok := m[f.Name]; !ok {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
+
+func integer(v interface{}) (int64, bool) {
+	switch v := v.(type) {
+	case int32:
+		return int64(v), true
+	case int64:
+		return v, true
+	case int:
+		return int64(v), true
+	}
+	return 0, false
+}
+
+func float(v interface{}) (float64, bool) {
+	switch v := v.(type) {
+	case float32:
+		return float64(v), true
+	case float64:
+		return v, true
+	}
+	return 0, false
+}
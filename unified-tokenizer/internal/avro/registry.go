@@ -0,0 +1,82 @@
+package avro
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// ErrUnknownSchema means the registry has no schema with an ID
+var ErrUnknownSchema = errors.New("avro: schema not found in the registry")
+
+// Registry fetches schemas by ID from a Confluent-compatible schema
+// registry, caching them; a schema ID never changes meaning
+type Registry struct {
+	URL      string
+	Username string // Basic auth, when set
+	Password string
+	Client   *http.Client
+
+	mu      sync.Mutex
+	schemas map[int32]*Schema
+}
+
+// Schema returns the schema with an ID
+func (r *Registry) Schema(id int32) (*Schema, error) {
+	r.mu.Lock()
+	s, ok := r.schemas[id]
+	r.mu.Unlock()
+	if ok {
+		return s, nil
+	}
+
+	req, err := http.NewRequest(http.MethodGet, fmt.Sprintf("%s/schemas/ids/%d", strings.TrimRight(r.URL, "/"), id), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/vnd.schemaregistry.v1+json")
+	if r.Username != "" {
+		req.SetBasicAuth(r.Username, r.Password)
+	}
+	client := r.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("avro: schema registry: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, fmt.Errorf("%w: ID %d", ErrUnknownSchema, id)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("avro: schema registry returned %s for schema %d", resp.Status, id)
+	}
+	var body struct {
+		Schema     string `json:"schema"`
+		SchemaType string `json:"schemaType"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&body); err != nil {
+		return nil, fmt.Errorf("avro: schema registry: %v", err)
+	}
+	if body.SchemaType != "" && body.SchemaType != "AVRO" {
+		return nil, fmt.Errorf("%w: ID %d is a %s schema", ErrUnknownSchema, id, body.SchemaType)
+	}
+	s, err = Parse(body.Schema)
+	if err != nil {
+		return nil, fmt.Errorf("%w: ID %d: %v", ErrUnknownSchema, id, err)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.schemas == nil {
+		r.schemas = make(map[int32]*Schema)
+	}
+	r.schemas[id] = s
+	return s, nil
+}
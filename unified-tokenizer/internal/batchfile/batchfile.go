@@ -0,0 +1,349 @@
+// Package batchfile tokenizes the card number columns of settlement files,
+// CSV or fixed-width, and masks card numbers found anywhere else in them, so
+// the output holds no card number in the clear. Fixed-width records keep
+// their length.
+package batchfile
+
+import (
+	"bytes"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"tokenshield-unified/internal/scanner"
+)
+
+// Formats
+const (
+	CSV   = "csv"
+	Fixed = "fixed"
+)
+
+// maxRowErrors bounds the row errors kept in a report; all are counted
+const maxRowErrors = 1000
+
+// Column is a column holding card numbers
+type Column struct {
+	Name       string // CSV: header name, lowercase
+	Index      int    // CSV: 1-based column number, when the file has no header
+	Start, End int    // Fixed width: 1-based character positions, inclusive
+}
+
+func (c Column) String() string {
+	switch {
+	case c.Name != "":
+		return c.Name
+	case c.Start > 0:
+		return fmt.Sprintf("%d-%d", c.Start, c.End)
+	}
+	return strconv.Itoa(c.Index)
+}
+
+// Layout describes the files to process
+type Layout struct {
+	Format       string
+	Columns      []Column
+	Delimiter    rune   // CSV field separator
+	Header       bool   // CSV: the first row names the columns
+	RecordPrefix string // Fixed width: only lines starting with it are detail records
+}
+
+// ParseColumns parses comma-separated columns: header names or 1-based
+// numbers for CSV, "start-end" positions for fixed width
+func ParseColumns(format, value string) ([]Column, error) {
+	var columns []Column
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		var c Column
+		switch format {
+		case CSV:
+			if n, err := strconv.Atoi(entry); err == nil {
+				if n < 1 {
+					return nil, fmt.Errorf("invalid column %q: numbers start at 1", entry)
+				}
+				c.Index = n
+			} else {
+				c.Name = strings.ToLower(entry)
+			}
+		case Fixed:
+			start, end, ok := strings.Cut(entry, "-")
+			var err1, err2 error
+			c.Start, err1 = strconv.Atoi(strings.TrimSpace(start))
+			c.End, err2 = strconv.Atoi(strings.TrimSpace(end))
+			if !ok || err1 != nil || err2 != nil || c.Start < 1 || c.End < c.Start {
+				return nil, fmt.Errorf("invalid column %q: want start-end positions like 21-39", entry)
+			}
+		default:
+			return nil, fmt.Errorf("unknown format %q: use csv or fixed", format)
+		}
+		columns = append(columns, c)
+	}
+	if len(columns) == 0 {
+		return nil, errors.New("no card number columns configured")
+	}
+	return columns, nil
+}
+
+// FormatError means a file does not match the layout; processing it again
+// will not help
+type FormatError struct {
+	Line    int
+	Message string
+}
+
+func (e *FormatError) Error() string {
+	if e.Line > 0 {
+		return fmt.Sprintf("line %d: %s", e.Line, e.Message)
+	}
+	return e.Message
+}
+
+// RowError is a problem with one value, which was left in place
+type RowError struct {
+	Line    int    `json:"line"`
+	Column  string `json:"column"`
+	Message string `json:"message"`
+}
+
+// Report describes what was done to a file
+type Report struct {
+	Format     string     `json:"format"`
+	Rows       int        `json:"rows"`
+	Tokenized  int        `json:"tokenized"`
+	Masked     int        `json:"masked"`
+	ErrorCount int        `json:"error_count"`
+	Errors     []RowError `json:"errors,omitempty"`
+}
+
+func (r *Report) addError(line int, column Column, message string) {
+	r.ErrorCount++
+	if len(r.Errors) < maxRowErrors {
+		r.Errors = append(r.Errors, RowError{Line: line, Column: column.String(), Message: message})
+	}
+}
+
+// Processor rewrites files in one layout
+type Processor struct {
+	Layout Layout
+	// Tokenize returns the token for a card number. An error stops the
+	// file, to be processed again later.
+	Tokenize func(cardNumber string) (string, error)
+	// Mask masks the card numbers in text without changing its length,
+	// returning how many it masked. Nil leaves other fields alone.
+	Mask func(text string) (string, int)
+}
+
+// Process returns the sanitized file and its report. A *FormatError means
+// the file cannot be processed as configured.
+func (p *Processor) Process(data []byte) ([]byte, *Report, error) {
+	if p.Layout.Format == Fixed {
+		return p.fixed(data)
+	}
+	return p.csv(data)
+}
+
+func (p *Processor) csv(data []byte) ([]byte, *Report, error) {
+	report := &Report{Format: CSV}
+	r := csv.NewReader(bytes.NewReader(data))
+	r.Comma = p.Layout.Delimiter
+	r.FieldsPerRecord = -1
+	var out bytes.Buffer
+	w := csv.NewWriter(&out)
+	w.Comma = p.Layout.Delimiter
+	w.UseCRLF = bytes.Contains(data, []byte("\r\n"))
+
+	indexes := make([]int, len(p.Layout.Columns))
+	for i, c := range p.Layout.Columns {
+		if c.Name != "" && !p.Layout.Header {
+			return nil, nil, &FormatError{Message: fmt.Sprintf("column %q is named, but the files have no header", c.Name)}
+		}
+		indexes[i] = c.Index - 1
+	}
+	for first := true; ; first = false {
+		record, err := r.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			var parseErr *csv.ParseError
+			if errors.As(err, &parseErr) {
+				return nil, nil, &FormatError{Line: parseErr.Line, Message: parseErr.Err.Error()}
+			}
+			return nil, nil, err
+		}
+		if first && p.Layout.Header {
+			if err := p.headerIndexes(record, indexes); err != nil {
+				return nil, nil, err
+			}
+			w.Write(record)
+			continue
+		}
+
+		line, _ := r.FieldPos(0)
+		report.Rows++
+		tokenized := make(map[int]bool, len(indexes))
+		for i, idx := range indexes {
+			if idx >= len(record) {
+				report.addError(line, p.Layout.Columns[i], "missing column")
+				continue
+			}
+			token, ok, err := p.tokenize(record[idx], line, p.Layout.Columns[i], report)
+			if err != nil {
+				return nil, nil, err
+			}
+			if ok {
+				record[idx] = token
+				tokenized[idx] = true
+			}
+		}
+		if p.Mask != nil {
+			for j := range record {
+				if !tokenized[j] {
+					var n int
+					record[j], n = p.Mask(record[j])
+					report.Masked += n
+				}
+			}
+		}
+		w.Write(record)
+	}
+	w.Flush()
+	if err := w.Error(); err != nil {
+		return nil, nil, err
+	}
+	return out.Bytes(), report, nil
+}
+
+// headerIndexes finds the named columns in the header row
+func (p *Processor) headerIndexes(header []string, indexes []int) error {
+	for i, c := range p.Layout.Columns {
+		if c.Name == "" {
+			continue
+		}
+		indexes[i] = -1
+		for j, name := range header {
+			if strings.ToLower(strings.TrimSpace(name)) == c.Name {
+				indexes[i] = j
+				break
+			}
+		}
+		if indexes[i] < 0 {
+			return &FormatError{Line: 1, Message: fmt.Sprintf("header has no %q column", c.Name)}
+		}
+	}
+	return nil
+}
+
+func (p *Processor) fixed(data []byte) ([]byte, *Report, error) {
+	report := &Report{Format: Fixed}
+	out := make([]byte, 0, len(data))
+	for line, rest := 1, data; len(rest) > 0; line++ {
+		end := len(rest)
+		if i := bytes.IndexByte(rest, '\n'); i >= 0 {
+			end = i + 1
+		}
+		raw := rest[:end]
+		rest = rest[end:]
+		text := strings.TrimRight(string(raw), "\r\n")
+		eol := raw[len(text):]
+		if !utf8.ValidString(text) {
+			return nil, nil, &FormatError{Line: line, Message: "not valid UTF-8"}
+		}
+
+		if strings.TrimSpace(text) != "" && strings.HasPrefix(text, p.Layout.RecordPrefix) {
+			report.Rows++
+			var err error
+			if text, err = p.fixedRecord(text, line, report); err != nil {
+				return nil, nil, err
+			}
+		}
+		if p.Mask != nil {
+			var n int
+			text, n = p.Mask(text)
+			report.Masked += n
+		}
+		out = append(append(out, text...), eol...)
+	}
+	return out, report, nil
+}
+
+// fixedRecord tokenizes the columns of one detail record. Positions count
+// characters, not bytes.
+func (p *Processor) fixedRecord(text string, line int, report *Report) (string, error) {
+	chars := []rune(text)
+	for _, c := range p.Layout.Columns {
+		if c.End > len(chars) {
+			if c.Start <= len(chars) && strings.TrimSpace(string(chars[c.Start-1:])) != "" {
+				report.addError(line, c, "record ends inside the column")
+			}
+			continue
+		}
+		field := string(chars[c.Start-1 : c.End])
+		token, ok, err := p.tokenize(field, line, c, report)
+		if err != nil || !ok {
+			if err != nil {
+				return "", err
+			}
+			continue
+		}
+		width := c.End - c.Start + 1
+		if utf8.RuneCountInString(token) > width {
+			return "", &FormatError{Line: line, Message: fmt.Sprintf(
+				"a %d-character token does not fit column %s; use TOKEN_FORMAT=luhn", len(token), c)}
+		}
+		// Keep the field's alignment: right-aligned values stay right-aligned
+		padding := strings.Repeat(" ", width-utf8.RuneCountInString(token))
+		if strings.HasPrefix(field, " ") && !strings.HasSuffix(field, " ") {
+			token = padding + token
+		} else {
+			token += padding
+		}
+		copy(chars[c.Start-1:c.End], []rune(token))
+	}
+	return string(chars), nil
+}
+
+// tokenize returns the token for a column value. ok is false when the
+// value is blank or not a card number; the latter is reported.
+func (p *Processor) tokenize(value string, line int, column Column, report *Report) (string, bool, error) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return "", false, nil
+	}
+	digits := strings.NewReplacer(" ", "", "-", "").Replace(value)
+	if !scanner.IsPAN(digits) {
+		report.addError(line, column, "not a card number")
+		return "", false, nil
+	}
+	token, err := p.Tokenize(digits)
+	if err != nil {
+		return "", false, err
+	}
+	report.Tokenized++
+	return token, true, nil
+}
+
+// MaskDigits replaces all but the last four digits of s with asterisks,
+// keeping its length and any separators
+func MaskDigits(s string) string {
+	b := []byte(s)
+	keep := 4
+	for i := len(b) - 1; i >= 0; i-- {
+		if b[i] < '0' || b[i] > '9' {
+			continue
+		}
+		if keep > 0 {
+			keep--
+			continue
+		}
+		b[i] = '*'
+	}
+	return string(b)
+}
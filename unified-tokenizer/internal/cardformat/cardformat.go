@@ -0,0 +1,130 @@
+// Package cardformat reads the card records of a bulk import. Formats are
+// registered by name: JSON, CSV and fixed-width are built in, and others,
+// such as an acquirer's own batch layout, can be added with Register.
+package cardformat
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Record is a card read from import data
+type Record struct {
+	CardNumber  string            `json:"card_number"`
+	CardHolder  string            `json:"card_holder,omitempty"`
+	ExpiryMonth int               `json:"expiry_month"`
+	ExpiryYear  int               `json:"expiry_year"`
+	ExternalID  string            `json:"external_id,omitempty"` // Client's reference ID
+	Metadata    string            `json:"metadata,omitempty"`    // Additional metadata as JSON string
+	Tags        map[string]string `json:"tags,omitempty"`        // In text formats as key=value;key=value
+	Line        int               `json:"-"`                     // Line the record starts on, in text formats
+}
+
+// Columns are the fields a record is read from; the first three are
+// required
+var Columns = []string{"card_number", "expiry_month", "expiry_year", "card_holder", "external_id", "metadata", "tags"}
+
+// Format reads the records of import data, which is UTF-8
+type Format interface {
+	Parse(data []byte) ([]Record, error)
+}
+
+// Options configure the formats; each reads its own
+type Options struct {
+	CSV        *CSVOptions        `json:"csv,omitempty"`         // How CSV data is read
+	FixedWidth *FixedWidthOptions `json:"fixed_width,omitempty"` // Layout of fixed-width data
+}
+
+// Constructor returns a format configured by the options given with an
+// import
+type Constructor func(options Options) (Format, error)
+
+var formats = map[string]Constructor{
+	"json":  newJSON,
+	"csv":   newCSV,
+	"fixed": newFixedWidth,
+}
+
+// Register adds a format. It is meant to be called from init functions,
+// and panics if the name is taken.
+func Register(name string, constructor Constructor) {
+	if _, exists := formats[name]; exists {
+		panic("cardformat: format " + name + " registered twice")
+	}
+	formats[name] = constructor
+}
+
+// Names returns the registered formats, sorted
+func Names() []string {
+	names := make([]string, 0, len(formats))
+	for name := range formats {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// New returns the format called name, configured by options
+func New(name string, options Options) (Format, error) {
+	constructor, exists := formats[name]
+	if !exists {
+		return nil, fmt.Errorf("unsupported format %q, use %s", name, strings.Join(Names(), ", "))
+	}
+	return constructor(options)
+}
+
+// maxRowErrors bounds the records listed when data cannot be read
+const maxRowErrors = 100
+
+// RowError is a record that could not be read
+type RowError struct {
+	Line  int    `json:"line"`
+	Error string `json:"error"`
+}
+
+// RowErrors lists the records of import data that could not be read
+type RowErrors struct {
+	Rows []RowError
+}
+
+func (e *RowErrors) Error() string {
+	first := e.Rows[0]
+	if len(e.Rows) == 1 {
+		return fmt.Sprintf("line %d: %s", first.Line, first.Error)
+	}
+	return fmt.Sprintf("%d records could not be read, the first on line %d: %s", len(e.Rows), first.Line, first.Error)
+}
+
+// ParseTags splits tags written as "key=value;key=value". Keys and values
+// are checked with the rest of the record.
+func ParseTags(s string) (map[string]string, error) {
+	tags := make(map[string]string)
+	for _, part := range strings.Split(s, ";") {
+		if strings.TrimSpace(part) == "" {
+			continue
+		}
+		key, value, ok := strings.Cut(part, "=")
+		if !ok {
+			return nil, fmt.Errorf("tag %q must be key=value", part)
+		}
+		tags[strings.TrimSpace(key)] = strings.TrimSpace(value)
+	}
+	return tags, nil
+}
+
+type jsonFormat struct{}
+
+func newJSON(Options) (Format, error) {
+	return jsonFormat{}, nil
+}
+
+// Parse reads a JSON array of records
+func (jsonFormat) Parse(data []byte) ([]Record, error) {
+	var records []Record
+	if err := json.Unmarshal(data, &records); err != nil {
+		return nil, err
+	}
+	return records, nil
+}
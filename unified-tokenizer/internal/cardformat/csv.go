@@ -0,0 +1,206 @@
+package cardformat
+
+import (
+	"bytes"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// CSVOptions control how CSV data is read
+type CSVOptions struct {
+	Delimiter     string            `json:"delimiter,omitempty"`      // One character, "," by default
+	LazyQuotes    bool              `json:"lazy_quotes,omitempty"`    // Accept quotes in unquoted fields and lone quotes in quoted ones
+	HeaderAliases map[string]string `json:"header_aliases,omitempty"` // Header in the file -> column it holds, e.g. "PAN": "card_number"
+}
+
+// headerAliases are other headers taken for the columns, once lowercased
+// with spaces and dashes turned into underscores
+var headerAliases = map[string]string{
+	"pan": "card_number", "card": "card_number", "cardnumber": "card_number", "card_no": "card_number", "number": "card_number",
+	"exp_month": "expiry_month", "expmonth": "expiry_month", "expiration_month": "expiry_month", "month": "expiry_month",
+	"exp_year": "expiry_year", "expyear": "expiry_year", "expiration_year": "expiry_year", "year": "expiry_year",
+	"cardholder": "card_holder", "cardholder_name": "card_holder", "holder": "card_holder", "name": "card_holder",
+	"ext_id": "external_id", "external_ref": "external_id", "reference": "external_id",
+}
+
+// csvFormat reads RFC 4180 CSV with a header row
+type csvFormat struct {
+	options   CSVOptions
+	delimiter rune
+}
+
+func newCSV(options Options) (Format, error) {
+	f := &csvFormat{delimiter: ','}
+	if options.CSV != nil {
+		f.options = *options.CSV
+	}
+	if d := f.options.Delimiter; d != "" {
+		delimiter, size := utf8.DecodeRuneInString(d)
+		if size != len(d) || delimiter == '"' || delimiter == '\r' || delimiter == '\n' || delimiter == utf8.RuneError {
+			return nil, fmt.Errorf("invalid delimiter %q: use one character other than a quote or line break", d)
+		}
+		f.delimiter = delimiter
+	}
+	for alias, column := range f.options.HeaderAliases {
+		if !slices.Contains(Columns, column) {
+			return nil, fmt.Errorf("header alias %q: unknown column %q", alias, column)
+		}
+	}
+	return f, nil
+}
+
+// normalizeHeader lowercases a header and turns spaces and dashes into
+// underscores, so "Card Number" is card_number
+func normalizeHeader(name string) string {
+	name = strings.ToLower(strings.TrimSpace(name))
+	return strings.NewReplacer(" ", "_", "-", "_").Replace(name)
+}
+
+// columns maps the header row to the index of each column read. Aliases
+// given with the import win over the built-in ones.
+func (f *csvFormat) columns(header []string) (map[string]int, error) {
+	given := make(map[string]string, len(f.options.HeaderAliases))
+	for alias, column := range f.options.HeaderAliases {
+		given[normalizeHeader(alias)] = column
+	}
+
+	columns := make(map[string]int)
+	for i, name := range header {
+		name = normalizeHeader(name)
+		column, ok := given[name]
+		if !ok && slices.Contains(Columns, name) {
+			column, ok = name, true
+		}
+		if !ok {
+			column, ok = headerAliases[name]
+		}
+		if !ok {
+			continue // Other columns are ignored
+		}
+		if previous, exists := columns[column]; exists {
+			return nil, fmt.Errorf("columns %d (%q) and %d (%q) are both %s", previous+1, header[previous], i+1, header[i], column)
+		}
+		columns[column] = i
+	}
+
+	for _, column := range Columns[:3] {
+		if _, exists := columns[column]; !exists {
+			return nil, fmt.Errorf("missing required column: %s", column)
+		}
+	}
+	return columns, nil
+}
+
+// Parse reads the records after the header row. Records that cannot be
+// read are reported together, by line, as *RowErrors.
+func (f *csvFormat) Parse(data []byte) ([]Record, error) {
+	reader := csv.NewReader(bytes.NewReader(data))
+	reader.Comma = f.delimiter
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+	reader.LazyQuotes = f.options.LazyQuotes
+
+	header, err := reader.Read()
+	if err == io.EOF {
+		return nil, fmt.Errorf("CSV must have at least a header and one data row")
+	} else if err != nil {
+		return nil, err
+	}
+	columns, err := f.columns(header)
+	if err != nil {
+		return nil, err
+	}
+
+	var records []Record
+	var rowErrors []RowError
+	for len(rowErrors) < maxRowErrors {
+		fields, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			// A quoting error leaves the rest of the data unreadable
+			line := 0
+			var parseErr *csv.ParseError
+			if errors.As(err, &parseErr) {
+				line, err = parseErr.StartLine, parseErr.Err
+			}
+			rowErrors = append(rowErrors, RowError{Line: line, Error: err.Error()})
+			break
+		}
+		line, _ := reader.FieldPos(0)
+		if len(fields) == 1 && strings.TrimSpace(fields[0]) == "" {
+			continue // Blank line
+		}
+
+		record, err := csvRecord(fields, len(header), columns)
+		if err != nil {
+			rowErrors = append(rowErrors, RowError{Line: line, Error: err.Error()})
+			continue
+		}
+		record.Line = line
+		records = append(records, record)
+	}
+	if len(rowErrors) > 0 {
+		return nil, &RowErrors{Rows: rowErrors}
+	}
+	if len(records) == 0 {
+		return nil, fmt.Errorf("CSV must have at least a header and one data row")
+	}
+	return records, nil
+}
+
+// csvRecord reads a data row. Rows may leave out trailing optional columns,
+// but a row longer than the header most likely has an unquoted delimiter in
+// a field.
+func csvRecord(fields []string, headerLength int, columns map[string]int) (Record, error) {
+	if len(fields) > headerLength {
+		return Record{}, fmt.Errorf("%d fields, the header has %d: quote fields that contain the delimiter", len(fields), headerLength)
+	}
+	values := make(map[string]string, len(columns))
+	for _, column := range Columns {
+		i, exists := columns[column]
+		if exists && i < len(fields) {
+			values[column] = strings.TrimSpace(fields[i])
+		} else if exists && slices.Contains(Columns[:3], column) {
+			return Record{}, fmt.Errorf("%d fields, missing %s", len(fields), column)
+		}
+	}
+	return recordFromValues(values)
+}
+
+// recordFromValues builds a record from the values of its columns
+func recordFromValues(values map[string]string) (Record, error) {
+	record := Record{
+		CardNumber: values["card_number"],
+		CardHolder: values["card_holder"],
+		ExternalID: values["external_id"],
+		Metadata:   values["metadata"],
+	}
+	for _, field := range []struct {
+		column string
+		dst    *int
+	}{{"expiry_month", &record.ExpiryMonth}, {"expiry_year", &record.ExpiryYear}} {
+		if value := values[field.column]; value != "" {
+			n, err := strconv.Atoi(value)
+			if err != nil {
+				return Record{}, fmt.Errorf("invalid %s: %s", field.column, value)
+			}
+			*field.dst = n
+		}
+	}
+	if values["tags"] != "" {
+		tags, err := ParseTags(values["tags"])
+		if err != nil {
+			return Record{}, err
+		}
+		record.Tags = tags
+	}
+	return record, nil
+}
@@ -0,0 +1,148 @@
+package cardformat
+
+import (
+	"fmt"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// FixedWidthOptions lay out fixed-width data, such as acquirer batch files
+type FixedWidthOptions struct {
+	Columns      map[string]string `json:"columns"`                 // Column -> "start-end", 1-based character positions, inclusive
+	ExpiryFormat string            `json:"expiry_format,omitempty"` // Layout of an "expiry" column: MMYY (default), YYMM, MMYYYY or YYYYMM
+	RecordPrefix string            `json:"record_prefix,omitempty"` // Only lines starting with it are card records, e.g. "D" between header and trailer records
+}
+
+// expiryLayouts are the offsets of the month and year in an expiry column
+var expiryLayouts = map[string]struct{ month, year, yearLength int }{
+	"MMYY":   {0, 2, 2},
+	"YYMM":   {2, 0, 2},
+	"MMYYYY": {0, 2, 4},
+	"YYYYMM": {4, 0, 4},
+}
+
+// fixedColumn is where a column is in a record
+type fixedColumn struct {
+	name       string
+	start, end int
+}
+
+func (c fixedColumn) String() string {
+	return fmt.Sprintf("%s (%d-%d)", c.name, c.start, c.end)
+}
+
+// fixedWidthFormat reads one record per line, each column at the same
+// character positions
+type fixedWidthFormat struct {
+	columns      []fixedColumn
+	expiryFormat string
+	recordPrefix string
+}
+
+func newFixedWidth(options Options) (Format, error) {
+	if options.FixedWidth == nil || len(options.FixedWidth.Columns) == 0 {
+		return nil, fmt.Errorf("fixed_width.columns is required")
+	}
+	layout := options.FixedWidth
+	f := &fixedWidthFormat{expiryFormat: strings.ToUpper(layout.ExpiryFormat), recordPrefix: layout.RecordPrefix}
+	if f.expiryFormat == "" {
+		f.expiryFormat = "MMYY"
+	}
+	if _, known := expiryLayouts[f.expiryFormat]; !known {
+		return nil, fmt.Errorf("invalid expiry_format %q, use MMYY, YYMM, MMYYYY or YYYYMM", layout.ExpiryFormat)
+	}
+
+	for name, position := range layout.Columns {
+		if !slices.Contains(Columns, name) && name != "expiry" {
+			return nil, fmt.Errorf("unknown column %q", name)
+		}
+		start, end, ok := strings.Cut(position, "-")
+		c := fixedColumn{name: name}
+		var err1, err2 error
+		c.start, err1 = strconv.Atoi(strings.TrimSpace(start))
+		c.end, err2 = strconv.Atoi(strings.TrimSpace(end))
+		if !ok || err1 != nil || err2 != nil || c.start < 1 || c.end < c.start {
+			return nil, fmt.Errorf("invalid position %q for %s, use start-end, counting from 1", position, name)
+		}
+		if name == "expiry" && c.end-c.start+1 != len(f.expiryFormat) {
+			return nil, fmt.Errorf("expiry is %d characters, %s needs %d", c.end-c.start+1, f.expiryFormat, len(f.expiryFormat))
+		}
+		f.columns = append(f.columns, c)
+	}
+	sort.Slice(f.columns, func(i, j int) bool { return f.columns[i].start < f.columns[j].start })
+
+	_, hasExpiry := layout.Columns["expiry"]
+	_, hasMonth := layout.Columns["expiry_month"]
+	_, hasYear := layout.Columns["expiry_year"]
+	switch {
+	case layout.Columns["card_number"] == "":
+		return nil, fmt.Errorf("missing required column: card_number")
+	case hasExpiry && (hasMonth || hasYear):
+		return nil, fmt.Errorf("give either expiry or expiry_month and expiry_year")
+	case !hasExpiry && !(hasMonth && hasYear):
+		return nil, fmt.Errorf("missing required columns: expiry, or expiry_month and expiry_year")
+	}
+	return f, nil
+}
+
+// Parse reads the lines starting with the record prefix; others, such as
+// header and trailer records, are skipped. Records that cannot be read are
+// reported together, by line, as *RowErrors.
+func (f *fixedWidthFormat) Parse(data []byte) ([]Record, error) {
+	var records []Record
+	var rowErrors []RowError
+	for line, rest := 1, string(data); rest != "" && len(rowErrors) < maxRowErrors; line++ {
+		var text string
+		text, rest, _ = strings.Cut(rest, "\n")
+		text = strings.TrimSuffix(text, "\r")
+		if strings.TrimSpace(text) == "" || !strings.HasPrefix(text, f.recordPrefix) {
+			continue
+		}
+
+		record, err := f.record([]rune(text))
+		if err != nil {
+			rowErrors = append(rowErrors, RowError{Line: line, Error: err.Error()})
+			continue
+		}
+		record.Line = line
+		records = append(records, record)
+	}
+	if len(rowErrors) > 0 {
+		return nil, &RowErrors{Rows: rowErrors}
+	}
+	if len(records) == 0 {
+		return nil, fmt.Errorf("no card records found")
+	}
+	return records, nil
+}
+
+// record reads the columns of one line. Positions count characters, not
+// bytes; optional columns past the end of a shorter line are empty.
+func (f *fixedWidthFormat) record(chars []rune) (Record, error) {
+	values := make(map[string]string, len(f.columns)+1)
+	for _, c := range f.columns {
+		if c.end > len(chars) && (c.name == "card_number" || strings.HasPrefix(c.name, "expiry")) {
+			return Record{}, fmt.Errorf("the record is %d characters and ends before the end of %s", len(chars), c)
+		}
+		if c.start > len(chars) {
+			continue
+		}
+		values[c.name] = strings.TrimSpace(string(chars[c.start-1 : min(c.end, len(chars))]))
+	}
+
+	if expiry, given := values["expiry"]; given && expiry != "" {
+		layout := expiryLayouts[f.expiryFormat]
+		if len(expiry) != len(f.expiryFormat) || strings.Trim(expiry, "0123456789") != "" {
+			return Record{}, fmt.Errorf("invalid expiry %q, want %s", expiry, f.expiryFormat)
+		}
+		values["expiry_month"] = expiry[layout.month : layout.month+2]
+		values["expiry_year"] = expiry[layout.year : layout.year+layout.yearLength]
+	}
+	// Two-digit years are this century
+	if year := values["expiry_year"]; len(year) == 2 {
+		values["expiry_year"] = "20" + year
+	}
+	return recordFromValues(values)
+}
@@ -0,0 +1,324 @@
+// Package charset converts bodies in the character sets legacy systems
+// send (ISO-8859-1, Windows-1252 and UTF-16) to UTF-8, so card numbers and
+// tokens in them can be found, and converts the result back so the body
+// goes on in the character set it came in.
+package charset
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"mime"
+	"strings"
+	"unicode/utf16"
+	"unicode/utf8"
+)
+
+// Canonical names of the supported character sets
+const (
+	UTF8        = "utf-8"
+	ISO88591    = "iso-8859-1"
+	Windows1252 = "windows-1252"
+	UTF16LE     = "utf-16le"
+	UTF16BE     = "utf-16be"
+)
+
+// aliases maps the charset labels accepted in Content-Type to a canonical
+// name. "utf-16" without a byte order mark is big-endian (RFC 2781).
+var aliases = map[string]string{
+	"utf-8": UTF8, "utf8": UTF8, "us-ascii": UTF8, "ascii": UTF8,
+	"iso-8859-1": ISO88591, "iso8859-1": ISO88591, "latin1": ISO88591, "latin-1": ISO88591, "l1": ISO88591,
+	"windows-1252": Windows1252, "cp1252": Windows1252,
+	"utf-16le": UTF16LE, "utf-16be": UTF16BE, "utf-16": UTF16BE,
+}
+
+var (
+	bomUTF8    = []byte{0xEF, 0xBB, 0xBF}
+	bomUTF16LE = []byte{0xFF, 0xFE}
+	bomUTF16BE = []byte{0xFE, 0xFF}
+)
+
+// UnsupportedError is returned for a charset this package cannot convert
+type UnsupportedError struct {
+	Charset string
+}
+
+func (e *UnsupportedError) Error() string {
+	return fmt.Sprintf("unsupported charset %q", e.Charset)
+}
+
+// Encoding is how a body is encoded
+type Encoding struct {
+	Name string // Canonical name
+	BOM  bool   // The body starts with a byte order mark
+}
+
+// Detect returns the encoding of a body from the charset in its
+// Content-Type, or its byte order mark. A JSON body without either is
+// told apart from UTF-16 by where its zero bytes fall (RFC 4627).
+// Anything else is taken to be UTF-8.
+func Detect(contentType string, head []byte) (Encoding, error) {
+	_, params, _ := mime.ParseMediaType(contentType)
+	label := strings.ToLower(strings.TrimSpace(params["charset"]))
+	name := ""
+	if label != "" {
+		var ok bool
+		if name, ok = aliases[label]; !ok {
+			return Encoding{}, &UnsupportedError{Charset: label}
+		}
+	}
+
+	// A byte order mark decides the byte order of plain "utf-16"
+	switch {
+	case bytes.HasPrefix(head, bomUTF8) && (name == "" || name == UTF8):
+		return Encoding{Name: UTF8, BOM: true}, nil
+	case bytes.HasPrefix(head, bomUTF16LE) && (name == "" || name == UTF16LE || label == "utf-16"):
+		return Encoding{Name: UTF16LE, BOM: true}, nil
+	case bytes.HasPrefix(head, bomUTF16BE) && (name == "" || name == UTF16BE):
+		return Encoding{Name: UTF16BE, BOM: true}, nil
+	}
+	if name != "" {
+		return Encoding{Name: name}, nil
+	}
+	if strings.Contains(strings.ToLower(contentType), "json") && len(head) >= 2 {
+		switch {
+		case head[0] == 0 && head[1] != 0:
+			return Encoding{Name: UTF16BE}, nil
+		case head[0] != 0 && head[1] == 0:
+			return Encoding{Name: UTF16LE}, nil
+		}
+	}
+	return Encoding{Name: UTF8}, nil
+}
+
+// Native reports whether the body is UTF-8 already and needs no
+// conversion
+func (e Encoding) Native() bool {
+	return (e.Name == UTF8 || e.Name == "") && !e.BOM
+}
+
+// Decode returns body as UTF-8, without its byte order mark
+func (e Encoding) Decode(body []byte) (string, error) {
+	var out strings.Builder
+	if _, err := io.Copy(&out, e.NewReader(bytes.NewReader(body))); err != nil {
+		return "", err
+	}
+	return out.String(), nil
+}
+
+// Encode returns s in the encoding, with a byte order mark if the
+// original had one
+func (e Encoding) Encode(s string) ([]byte, error) {
+	var out bytes.Buffer
+	w := e.NewWriter(&out)
+	if _, err := io.WriteString(w, s); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return out.Bytes(), nil
+}
+
+// NewReader returns r converted to UTF-8, without its byte order mark
+func (e Encoding) NewReader(r io.Reader) io.Reader {
+	br := bufio.NewReader(r)
+	if e.BOM {
+		switch e.Name {
+		case UTF8:
+			br.Discard(len(bomUTF8))
+		case UTF16LE, UTF16BE:
+			br.Discard(2)
+		}
+	}
+	if e.Name == UTF8 || e.Name == "" {
+		return br
+	}
+	return &reader{src: br, name: e.Name}
+}
+
+// NewWriter returns a writer converting UTF-8 written to it into the
+// encoding in w. Close it to flush a trailing partial character.
+func (e Encoding) NewWriter(w io.Writer) io.WriteCloser {
+	return &writer{dst: w, name: e.Name, bom: e.BOM}
+}
+
+// reader decodes a single-byte or UTF-16 stream into UTF-8
+type reader struct {
+	src  *bufio.Reader
+	name string
+	out  []byte // Decoded and not yet read
+	err  error
+}
+
+func (r *reader) Read(p []byte) (int, error) {
+	for len(r.out) == 0 && r.err == nil {
+		var c rune
+		c, r.err = r.next()
+		if r.err == nil {
+			r.out = utf8.AppendRune(r.out, c)
+		}
+	}
+	n := copy(p, r.out)
+	r.out = r.out[n:]
+	if n > 0 {
+		return n, nil
+	}
+	return 0, r.err
+}
+
+// next decodes one character
+func (r *reader) next() (rune, error) {
+	switch r.name {
+	case ISO88591:
+		b, err := r.src.ReadByte()
+		return rune(b), err
+	case Windows1252:
+		b, err := r.src.ReadByte()
+		if b >= 0x80 && b < 0xA0 {
+			return windows1252[b-0x80], err
+		}
+		return rune(b), err
+	}
+	unit, err := r.unit()
+	if err != nil {
+		return 0, err
+	}
+	if !utf16.IsSurrogate(rune(unit)) {
+		return rune(unit), nil
+	}
+	low, err := r.unit()
+	if err == io.EOF {
+		return utf8.RuneError, nil
+	} else if err != nil {
+		return 0, err
+	}
+	if c := utf16.DecodeRune(rune(unit), rune(low)); c != utf8.RuneError {
+		return c, nil
+	}
+	return utf8.RuneError, nil
+}
+
+// unit reads one UTF-16 code unit
+func (r *reader) unit() (uint16, error) {
+	var b [2]byte
+	if _, err := io.ReadFull(r.src, b[:]); err == io.ErrUnexpectedEOF {
+		return utf8.RuneError, nil // Odd trailing byte
+	} else if err != nil {
+		return 0, err
+	}
+	if r.name == UTF16LE {
+		return uint16(b[0]) | uint16(b[1])<<8, nil
+	}
+	return uint16(b[0])<<8 | uint16(b[1]), nil
+}
+
+// writer encodes UTF-8 into the encoding
+type writer struct {
+	dst     io.Writer
+	name    string
+	bom     bool
+	started bool
+	partial []byte // Start of a UTF-8 sequence split across writes
+}
+
+func (w *writer) Write(p []byte) (int, error) {
+	var out []byte
+	if !w.started {
+		w.started = true
+		if w.bom {
+			switch w.name {
+			case UTF8:
+				out = append(out, bomUTF8...)
+			case UTF16LE:
+				out = append(out, bomUTF16LE...)
+			case UTF16BE:
+				out = append(out, bomUTF16BE...)
+			}
+		}
+	}
+	data := append(w.partial, p...)
+	w.partial = nil
+	for len(data) > 0 {
+		if !utf8.FullRune(data) {
+			w.partial = append([]byte(nil), data...)
+			break
+		}
+		c, size := utf8.DecodeRune(data)
+		data = data[size:]
+		var err error
+		if out, err = w.encode(out, c); err != nil {
+			return 0, err
+		}
+	}
+	if _, err := w.dst.Write(out); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (w *writer) encode(out []byte, c rune) ([]byte, error) {
+	switch w.name {
+	case UTF8, "":
+		return utf8.AppendRune(out, c), nil
+	case ISO88591:
+		if c > 0xFF {
+			return nil, fmt.Errorf("%U cannot be written in ISO-8859-1", c)
+		}
+		return append(out, byte(c)), nil
+	case Windows1252:
+		if c < 0x80 || (c >= 0xA0 && c <= 0xFF) {
+			return append(out, byte(c)), nil
+		}
+		for i, mapped := range windows1252 {
+			if mapped == c {
+				return append(out, byte(0x80+i)), nil
+			}
+		}
+		return nil, fmt.Errorf("%U cannot be written in Windows-1252", c)
+	}
+	units := []uint16{uint16(c)}
+	if c >= 0x10000 {
+		hi, lo := utf16.EncodeRune(c)
+		units = []uint16{uint16(hi), uint16(lo)}
+	}
+	for _, u := range units {
+		if w.name == UTF16LE {
+			out = append(out, byte(u), byte(u>>8))
+		} else {
+			out = append(out, byte(u>>8), byte(u))
+		}
+	}
+	return out, nil
+}
+
+// Close writes what is left of a split character
+func (w *writer) Close() error {
+	partial := w.partial
+	w.partial = nil
+	if !w.started {
+		// An empty body still gets its byte order mark
+		if _, err := w.Write(nil); err != nil {
+			return err
+		}
+	}
+	if len(partial) == 0 {
+		return nil
+	}
+	out, err := w.encode(nil, utf8.RuneError)
+	if err != nil {
+		return err
+	}
+	_, err = w.dst.Write(out)
+	return err
+}
+
+// windows1252 holds the characters of bytes 0x80 to 0x9F. The five
+// undefined bytes map to the C1 controls, as browsers do.
+var windows1252 = [32]rune{
+	0x20AC, 0x0081, 0x201A, 0x0192, 0x201E, 0x2026, 0x2020, 0x2021,
+	0x02C6, 0x2030, 0x0160, 0x2039, 0x0152, 0x008D, 0x017D, 0x008F,
+	0x0090, 0x2018, 0x2019, 0x201C, 0x201D, 0x2022, 0x2013, 0x2014,
+	0x02DC, 0x2122, 0x0161, 0x203A, 0x0153, 0x009D, 0x017E, 0x0178,
+}
@@ -0,0 +1,106 @@
+package clientip
+
+import (
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+
+	"tokenshield-unified/internal/ipfilter"
+)
+
+// Resolver finds the address of the client behind any trusted proxies.
+// X-Forwarded-For is only believed when the connection comes from a
+// trusted proxy, and it is read from the right, since each proxy appends
+// the address it received the request from: the first entry that is not
+// itself a trusted proxy is the client. Entries further left were supplied
+// by the client and may be forged. A nil Resolver trusts no proxy.
+type Resolver struct {
+	trusted ipfilter.Filter
+}
+
+// New creates a resolver trusting proxies in the given CIDR ranges or at
+// the given addresses
+func New(cidrs []string) (*Resolver, error) {
+	r := &Resolver{trusted: ipfilter.Filter{Allow: cidrs}}
+	if err := r.trusted.Normalize(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Proxies returns the trusted ranges in canonical form
+func (r *Resolver) Proxies() []string {
+	if r == nil {
+		return []string{}
+	}
+	return r.trusted.Allow
+}
+
+// Trusted reports whether addr is a trusted proxy
+func (r *Resolver) Trusted(addr netip.Addr) bool {
+	return r != nil && !r.trusted.Empty() && r.trusted.Allows(addr)
+}
+
+// peer parses the host of a request's RemoteAddr
+func peer(req *http.Request) (string, netip.Addr, bool) {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		host = req.RemoteAddr
+	}
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		return host, netip.Addr{}, false
+	}
+	return host, addr.WithZone("").Unmap(), true
+}
+
+// TrustedPeer reports whether req came straight from a trusted proxy
+func (r *Resolver) TrustedPeer(req *http.Request) bool {
+	_, addr, ok := peer(req)
+	return ok && r.Trusted(addr)
+}
+
+// ClientIP returns the client's address for req
+func (r *Resolver) ClientIP(req *http.Request) string {
+	host, addr, ok := peer(req)
+	if !ok || !r.Trusted(addr) {
+		return host
+	}
+	client := addr
+	hops := strings.Split(strings.Join(req.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := strings.TrimSpace(hops[i])
+		if hop == "" {
+			continue
+		}
+		// Some proxies add a port, and IPv6 addresses may come in brackets
+		if h, _, err := net.SplitHostPort(hop); err == nil {
+			hop = h
+		}
+		next, err := netip.ParseAddr(strings.Trim(hop, "[]"))
+		if err != nil {
+			// Garbage from the client: the last proxy's view is all we have
+			break
+		}
+		client = next.WithZone("").Unmap()
+		if !r.Trusted(client) {
+			break
+		}
+	}
+	return client.String()
+}
+
+// HTTPS reports whether the client reached us over HTTPS: directly, or
+// through a trusted proxy that says so in X-Forwarded-Proto
+func (r *Resolver) HTTPS(req *http.Request) bool {
+	if req.TLS != nil {
+		return true
+	}
+	_, addr, ok := peer(req)
+	if !ok || !r.Trusted(addr) {
+		return false
+	}
+	protos := strings.Split(strings.Join(req.Header.Values("X-Forwarded-Proto"), ","), ",")
+	return strings.EqualFold(strings.TrimSpace(protos[len(protos)-1]), "https")
+}
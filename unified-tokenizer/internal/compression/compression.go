@@ -0,0 +1,341 @@
+// Package compression decodes and re-encodes HTTP bodies with gzip or
+// deflate content codings, so card numbers and tokens in compressed bodies
+// can be found and replaced, and gzips API responses for clients that
+// accept it.
+package compression
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// ErrTooLarge is returned when a body decodes to more than the limit given
+var ErrTooLarge = errors.New("decoded body exceeds the size limit")
+
+// UnsupportedError is returned for a content coding other than gzip,
+// deflate and identity
+type UnsupportedError struct {
+	Coding string
+}
+
+func (e *UnsupportedError) Error() string {
+	return fmt.Sprintf("unsupported content coding %q", e.Coding)
+}
+
+// codings splits a Content-Encoding value into its codings in the order
+// they were applied, leaving out identity
+func codings(contentEncoding string) ([]string, error) {
+	var list []string
+	for _, c := range strings.Split(contentEncoding, ",") {
+		c = strings.ToLower(strings.TrimSpace(c))
+		switch c {
+		case "", "identity":
+		case "gzip", "x-gzip", "deflate":
+			list = append(list, c)
+		default:
+			return nil, &UnsupportedError{Coding: c}
+		}
+	}
+	return list, nil
+}
+
+// Encoded reports whether a Content-Encoding value names any coding
+// besides identity
+func Encoded(contentEncoding string) bool {
+	for _, c := range strings.Split(contentEncoding, ",") {
+		if c = strings.ToLower(strings.TrimSpace(c)); c != "" && c != "identity" {
+			return true
+		}
+	}
+	return false
+}
+
+// Supported reports whether a body with this Content-Encoding can be
+// decoded
+func Supported(contentEncoding string) bool {
+	_, err := codings(contentEncoding)
+	return err == nil
+}
+
+// NewReader returns the decoded body read from r
+func NewReader(contentEncoding string, r io.Reader) (io.ReadCloser, error) {
+	list, err := codings(contentEncoding)
+	if err != nil {
+		return nil, err
+	}
+	rc := io.NopCloser(r)
+	for i := len(list) - 1; i >= 0; i-- {
+		switch list[i] {
+		case "gzip", "x-gzip":
+			gz, err := gzip.NewReader(rc)
+			if err != nil {
+				return nil, err
+			}
+			rc = gz
+		case "deflate":
+			rc = newDeflateReader(rc)
+		}
+	}
+	return rc, nil
+}
+
+// newDeflateReader reads "deflate" bodies, which should be zlib streams
+// but are raw DEFLATE from some servers
+func newDeflateReader(r io.Reader) io.ReadCloser {
+	br := bufio.NewReader(r)
+	header, _ := br.Peek(2)
+	if len(header) == 2 && header[0]&0x0f == 8 && (uint16(header[0])<<8|uint16(header[1]))%31 == 0 {
+		if zr, err := zlib.NewReader(br); err == nil {
+			return zr
+		}
+	}
+	return flate.NewReader(br)
+}
+
+// NewWriter returns a writer encoding what is written to it into w. Close
+// it to finish the body.
+func NewWriter(contentEncoding string, w io.Writer) (io.WriteCloser, error) {
+	list, err := codings(contentEncoding)
+	if err != nil {
+		return nil, err
+	}
+	writers := make([]io.WriteCloser, 0, len(list))
+	for i := len(list) - 1; i >= 0; i-- {
+		var wc io.WriteCloser
+		switch list[i] {
+		case "gzip", "x-gzip":
+			wc = gzip.NewWriter(w)
+		case "deflate":
+			wc = zlib.NewWriter(w)
+		}
+		writers = append(writers, wc)
+		w = wc
+	}
+	return &chain{writers: writers, w: w}, nil
+}
+
+// chain writes through nested encoders and closes them innermost first
+type chain struct {
+	writers []io.WriteCloser
+	w       io.Writer
+}
+
+func (c *chain) Write(p []byte) (int, error) {
+	return c.w.Write(p)
+}
+
+func (c *chain) Close() error {
+	for i := len(c.writers) - 1; i >= 0; i-- {
+		if err := c.writers[i].Close(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Decode returns body decoded, failing with ErrTooLarge when it decodes to
+// more than limit bytes
+func Decode(contentEncoding string, body []byte, limit int64) ([]byte, error) {
+	var out bytes.Buffer
+	if err := Copy(&out, contentEncoding, bytes.NewReader(body), limit); err != nil {
+		return nil, err
+	}
+	return out.Bytes(), nil
+}
+
+// Copy decodes r into dst, failing with ErrTooLarge when it decodes to more
+// than limit bytes
+func Copy(dst io.Writer, contentEncoding string, r io.Reader, limit int64) error {
+	rc, err := NewReader(contentEncoding, r)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	n, err := io.Copy(dst, io.LimitReader(rc, limit+1))
+	if err != nil {
+		return err
+	}
+	if n > limit {
+		return ErrTooLarge
+	}
+	return nil
+}
+
+// Encode returns body encoded with contentEncoding
+func Encode(contentEncoding string, body []byte) ([]byte, error) {
+	var out bytes.Buffer
+	w, err := NewWriter(contentEncoding, &out)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(body); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return out.Bytes(), nil
+}
+
+// AcceptEncoding narrows an Accept-Encoding header to the codings this
+// package decodes, so an upstream whose response will be inspected does
+// not choose one it cannot read. It returns "" when none are left.
+func AcceptEncoding(header string) string {
+	var kept []string
+	for _, part := range strings.Split(header, ",") {
+		coding, _, _ := strings.Cut(part, ";")
+		coding = strings.ToLower(strings.TrimSpace(coding))
+		if coding == "*" {
+			// Anything would do; name what we can read instead
+			kept = append(kept, "gzip", "deflate")
+			continue
+		}
+		if Supported(coding) && coding != "" {
+			kept = append(kept, strings.TrimSpace(part))
+		}
+	}
+	return strings.Join(kept, ", ")
+}
+
+// acceptsGzip reports whether an Accept-Encoding header allows gzip
+func acceptsGzip(header string) bool {
+	for _, part := range strings.Split(header, ",") {
+		coding, params, _ := strings.Cut(part, ";")
+		coding = strings.ToLower(strings.TrimSpace(coding))
+		if coding != "gzip" && coding != "x-gzip" && coding != "*" {
+			continue
+		}
+		name, value, _ := strings.Cut(strings.TrimSpace(params), "=")
+		if strings.TrimSpace(name) == "q" {
+			if q, err := strconv.ParseFloat(strings.TrimSpace(value), 64); err == nil && q == 0 {
+				continue
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// Gzip compresses responses of at least minSize bytes for requests that
+// accept gzip. Smaller responses, responses that already have a
+// Content-Encoding and event streams are sent as they are.
+func Gzip(next http.Handler, minSize int) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Accept-Encoding")
+		if r.Method == http.MethodHead || !acceptsGzip(r.Header.Get("Accept-Encoding")) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		gw := &gzipWriter{ResponseWriter: w, minSize: minSize}
+		defer gw.finish()
+		next.ServeHTTP(gw, r)
+	})
+}
+
+// gzipWriter holds back the start of a response until it knows whether the
+// response is big enough to compress
+type gzipWriter struct {
+	http.ResponseWriter
+	minSize int
+
+	status  int
+	buf     []byte
+	decided bool
+	gz      *gzip.Writer // Set once compressing
+}
+
+func (g *gzipWriter) WriteHeader(status int) {
+	if g.status != 0 {
+		return
+	}
+	g.status = status
+	h := g.Header()
+	if status < 200 || status == http.StatusNoContent || status == http.StatusNotModified ||
+		h.Get("Content-Encoding") != "" || strings.HasPrefix(h.Get("Content-Type"), "text/event-stream") {
+		g.decide(false)
+	}
+}
+
+func (g *gzipWriter) Write(p []byte) (int, error) {
+	if g.status == 0 {
+		g.WriteHeader(http.StatusOK)
+	}
+	if !g.decided {
+		g.buf = append(g.buf, p...)
+		if len(g.buf) >= g.minSize {
+			if err := g.decide(true); err != nil {
+				return 0, err
+			}
+		}
+		return len(p), nil
+	}
+	if g.gz != nil {
+		return g.gz.Write(p)
+	}
+	return g.ResponseWriter.Write(p)
+}
+
+// decide sends the headers, compressed or not, and what is held back
+func (g *gzipWriter) decide(compress bool) error {
+	g.decided = true
+	if compress {
+		g.Header().Set("Content-Encoding", "gzip")
+		g.Header().Del("Content-Length")
+		g.gz = gzip.NewWriter(g.ResponseWriter)
+	}
+	g.ResponseWriter.WriteHeader(g.status)
+	if len(g.buf) == 0 {
+		return nil
+	}
+	var err error
+	if g.gz != nil {
+		_, err = g.gz.Write(g.buf)
+	} else {
+		_, err = g.ResponseWriter.Write(g.buf)
+	}
+	g.buf = nil
+	return err
+}
+
+// Flush sends what is held back uncompressed if compression has not
+// started, since a flushed response is being streamed
+func (g *gzipWriter) Flush() {
+	if g.status == 0 {
+		g.WriteHeader(http.StatusOK)
+	}
+	if !g.decided {
+		g.decide(false)
+	}
+	if g.gz != nil {
+		g.gz.Flush()
+	}
+	if f, ok := g.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (g *gzipWriter) finish() {
+	if g.status == 0 {
+		return // Nothing was written; the server sends its default
+	}
+	if !g.decided {
+		g.decide(false)
+	}
+	if g.gz != nil {
+		g.gz.Close()
+	}
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer
+func (g *gzipWriter) Unwrap() http.ResponseWriter {
+	return g.ResponseWriter
+}
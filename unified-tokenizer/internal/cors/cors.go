@@ -0,0 +1,181 @@
+package cors
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// Policy decides which browser origins may call the API. An empty policy
+// allows no cross-origin requests.
+type Policy struct {
+	// AllowedOrigins are exact origins like https://admin.example.com, or
+	// wildcard subdomains like https://*.example.com. "*" allows any origin
+	// and cannot be combined with AllowCredentials.
+	AllowedOrigins   []string `json:"allowed_origins"`
+	AllowedMethods   []string `json:"allowed_methods"`
+	AllowedHeaders   []string `json:"allowed_headers"`
+	ExposedHeaders   []string `json:"exposed_headers"`
+	AllowCredentials bool     `json:"allow_credentials"`
+	MaxAge           int      `json:"max_age"` // Seconds browsers may cache a preflight
+}
+
+// DefaultMethods and DefaultHeaders apply when a policy names none
+var (
+	DefaultMethods = []string{"GET", "POST", "PUT", "DELETE"}
+	DefaultHeaders = []string{"Content-Type", "X-API-Key", "X-Admin-Secret", "Authorization", "X-CSRF-Token", "X-Timestamp", "X-Nonce", "X-Signature"}
+)
+
+// Normalize checks the policy and puts it in canonical form: origins in
+// lower case without a trailing slash, methods in upper case, and the
+// default methods and headers filled in
+func (p *Policy) Normalize() error {
+	for i, origin := range p.AllowedOrigins {
+		origin = strings.TrimRight(strings.ToLower(strings.TrimSpace(origin)), "/")
+		if origin != "*" {
+			if err := checkOrigin(origin); err != nil {
+				return err
+			}
+		} else if p.AllowCredentials {
+			return fmt.Errorf("allowed origin * cannot be used with allow_credentials")
+		}
+		p.AllowedOrigins[i] = origin
+	}
+	if len(p.AllowedMethods) == 0 {
+		p.AllowedMethods = append([]string(nil), DefaultMethods...)
+	}
+	for i, method := range p.AllowedMethods {
+		method = strings.ToUpper(strings.TrimSpace(method))
+		if method == "" || strings.ContainsAny(method, " ,") {
+			return fmt.Errorf("invalid method %q", method)
+		}
+		p.AllowedMethods[i] = method
+	}
+	if len(p.AllowedHeaders) == 0 {
+		p.AllowedHeaders = append([]string(nil), DefaultHeaders...)
+	}
+	for _, list := range [][]string{p.AllowedHeaders, p.ExposedHeaders} {
+		for i, header := range list {
+			header = strings.TrimSpace(header)
+			if header == "" || strings.ContainsAny(header, " ,:") {
+				return fmt.Errorf("invalid header name %q", header)
+			}
+			list[i] = http.CanonicalHeaderKey(header)
+		}
+	}
+	if p.AllowedOrigins == nil {
+		p.AllowedOrigins = []string{}
+	}
+	if p.ExposedHeaders == nil {
+		p.ExposedHeaders = []string{}
+	}
+	if p.MaxAge < 0 || p.MaxAge > 86400 {
+		return fmt.Errorf("max_age must be between 0 and 86400 seconds")
+	}
+	return nil
+}
+
+// checkOrigin accepts scheme://host[:port], where the host may start with
+// "*." to match any subdomain
+func checkOrigin(origin string) error {
+	u, err := url.Parse(strings.Replace(origin, "://*.", "://wildcard.", 1))
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" ||
+		u.Path != "" || u.RawQuery != "" || u.Fragment != "" || u.User != nil || strings.Contains(u.Host, "*") {
+		return fmt.Errorf("invalid origin %q: use scheme://host[:port], optionally with *. before the domain", origin)
+	}
+	return nil
+}
+
+// AllowsOrigin reports whether origin may make cross-origin requests
+func (p *Policy) AllowsOrigin(origin string) bool {
+	origin = strings.ToLower(origin)
+	for _, allowed := range p.AllowedOrigins {
+		if allowed == "*" || allowed == origin {
+			return true
+		}
+		// https://*.example.com matches https://a.example.com and
+		// https://a.b.example.com, but not https://example.com
+		if scheme, domain, ok := strings.Cut(allowed, "://*."); ok {
+			prefix := scheme + "://"
+			if strings.HasPrefix(origin, prefix) && strings.HasSuffix(origin, "."+domain) &&
+				len(origin) > len(prefix)+len(domain)+1 && !strings.Contains(origin[len(prefix):len(origin)-len(domain)-1], "/") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Apply adds the CORS response headers for r. It reports whether r was a
+// preflight request, which it has answered, so the caller should stop.
+func (p *Policy) Apply(w http.ResponseWriter, r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	preflight := r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != ""
+	w.Header().Add("Vary", "Origin")
+	if origin == "" || !p.AllowsOrigin(origin) {
+		if preflight {
+			// Without the allow headers the browser refuses the request
+			w.WriteHeader(http.StatusNoContent)
+		}
+		return preflight
+	}
+
+	if len(p.AllowedOrigins) == 1 && p.AllowedOrigins[0] == "*" {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+	} else {
+		w.Header().Set("Access-Control-Allow-Origin", origin)
+	}
+	if p.AllowCredentials {
+		w.Header().Set("Access-Control-Allow-Credentials", "true")
+	}
+	if !preflight {
+		if len(p.ExposedHeaders) > 0 {
+			w.Header().Set("Access-Control-Expose-Headers", strings.Join(p.ExposedHeaders, ", "))
+		}
+		return false
+	}
+
+	w.Header().Add("Vary", "Access-Control-Request-Method")
+	w.Header().Add("Vary", "Access-Control-Request-Headers")
+	if p.allowsMethod(r.Header.Get("Access-Control-Request-Method")) && p.allowsHeaders(r.Header.Get("Access-Control-Request-Headers")) {
+		w.Header().Set("Access-Control-Allow-Methods", strings.Join(p.AllowedMethods, ", "))
+		w.Header().Set("Access-Control-Allow-Headers", strings.Join(p.AllowedHeaders, ", "))
+		if p.MaxAge > 0 {
+			w.Header().Set("Access-Control-Max-Age", strconv.Itoa(p.MaxAge))
+		}
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return true
+}
+
+func (p *Policy) allowsMethod(method string) bool {
+	for _, m := range p.AllowedMethods {
+		if m == method {
+			return true
+		}
+	}
+	return false
+}
+
+// allowsHeaders checks an Access-Control-Request-Headers list
+func (p *Policy) allowsHeaders(requested string) bool {
+	for _, h := range strings.Split(requested, ",") {
+		h = http.CanonicalHeaderKey(strings.TrimSpace(h))
+		if h == "" {
+			continue
+		}
+		allowed := false
+		for _, a := range p.AllowedHeaders {
+			if a == h {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			return false
+		}
+	}
+	return true
+}
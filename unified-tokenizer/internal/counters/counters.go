@@ -0,0 +1,261 @@
+// Package counters keeps the running totals shown by the stats endpoints
+// and metrics, so they are read from a few summary rows instead of being
+// counted over the card and request tables on every call. Changes are
+// added up in memory and written out every few seconds, which keeps the
+// hot paths off a shared row; what a replica has not yet written is lost
+// if it stops, and Recount corrects the active token count.
+package counters
+
+import (
+	"database/sql"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Retention is how long per-minute request counts are kept
+const Retention = 48 * time.Hour
+
+// Counter names in stats_counters
+const (
+	activeTokens   = "active_tokens"
+	requestsPrefix = "requests:"
+)
+
+// Requests counts token requests, and those answered with an error
+type Requests struct {
+	Requests int64 `json:"requests"`
+	Errors   int64 `json:"errors"`
+}
+
+type minuteKey struct {
+	minute      int64
+	requestType string
+}
+
+// Counters holds the changes a replica has made since its last flush. A
+// nil *Counters ignores changes.
+type Counters struct {
+	region string
+
+	mu      sync.Mutex
+	active  int64
+	minutes map[minuteKey]Requests
+}
+
+// New returns counters writing the rows of region, "" without one
+func New(region string) *Counters {
+	return &Counters{region: region, minutes: make(map[minuteKey]Requests)}
+}
+
+// AddActive records n tokens activated, or -n deactivated
+func (c *Counters) AddActive(n int64) {
+	if c == nil || n == 0 {
+		return
+	}
+	c.mu.Lock()
+	c.active += n
+	c.mu.Unlock()
+}
+
+// Request records a token request of requestType made at the given time
+// and answered with status
+func (c *Counters) Request(requestType string, status int, at time.Time) {
+	if c == nil {
+		return
+	}
+	key := minuteKey{minute: at.Unix() / 60, requestType: requestType}
+	c.mu.Lock()
+	r := c.minutes[key]
+	r.Requests++
+	if status >= 400 {
+		r.Errors++
+	}
+	c.minutes[key] = r
+	c.mu.Unlock()
+}
+
+// take returns and clears the pending changes
+func (c *Counters) take() (int64, map[minuteKey]Requests) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	active, minutes := c.active, c.minutes
+	c.active, c.minutes = 0, make(map[minuteKey]Requests)
+	return active, minutes
+}
+
+// restore puts back changes that could not be written
+func (c *Counters) restore(active int64, minutes map[minuteKey]Requests) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.active += active
+	for key, r := range minutes {
+		pending := c.minutes[key]
+		pending.Requests += r.Requests
+		pending.Errors += r.Errors
+		c.minutes[key] = pending
+	}
+}
+
+// Flush writes the pending changes in one transaction. On failure they are
+// kept for the next flush.
+func (c *Counters) Flush(db *sql.DB) error {
+	if c == nil {
+		return nil
+	}
+	active, minutes := c.take()
+	if active == 0 && len(minutes) == 0 {
+		return nil
+	}
+	if err := c.write(db, active, minutes); err != nil {
+		c.restore(active, minutes)
+		return err
+	}
+	return nil
+}
+
+func (c *Counters) write(db *sql.DB, active int64, minutes map[minuteKey]Requests) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	totals := make(map[string]int64)
+	for key, r := range minutes {
+		totals[requestsPrefix+key.requestType] += r.Requests
+	}
+	if active != 0 {
+		totals[activeTokens] = active
+	}
+	// Always the same order, so concurrent flushes from replicas of one
+	// region lock the rows in the same order
+	names := make([]string, 0, len(totals))
+	for name := range totals {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if _, err := tx.Exec(`
+			INSERT INTO stats_counters (name, region, value) VALUES (?, ?, ?)
+			ON DUPLICATE KEY UPDATE value = value + VALUES(value)`,
+			name, c.region, totals[name]); err != nil {
+			return err
+		}
+	}
+
+	keys := make([]minuteKey, 0, len(minutes))
+	for key := range minutes {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].minute != keys[j].minute {
+			return keys[i].minute < keys[j].minute
+		}
+		return keys[i].requestType < keys[j].requestType
+	})
+	for _, key := range keys {
+		r := minutes[key]
+		if _, err := tx.Exec(`
+			INSERT INTO token_request_minutes (minute, region, request_type, requests, errors) VALUES (?, ?, ?, ?, ?)
+			ON DUPLICATE KEY UPDATE requests = requests + VALUES(requests), errors = errors + VALUES(errors)`,
+			key.minute, c.region, key.requestType, r.Requests, r.Errors); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// Prune deletes the per-minute counts of this region older than Retention
+func (c *Counters) Prune(db *sql.DB, now time.Time) error {
+	if c == nil {
+		return nil
+	}
+	_, err := db.Exec("DELETE FROM token_request_minutes WHERE region = ? AND minute < ?",
+		c.region, now.Add(-Retention).Unix()/60)
+	return err
+}
+
+// Recount sets the active token count from the card table, for when the
+// counters have drifted: after a replica stopped with changes unwritten, or
+// cards were changed directly in the database. The rows of every region
+// are folded into this region's. Changes flushed by other replicas while
+// it runs may be counted twice.
+func (c *Counters) Recount(db *sql.DB) (int64, error) {
+	if c == nil {
+		return 0, nil
+	}
+	if err := c.Flush(db); err != nil {
+		return 0, err
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+	var count int64
+	if err := tx.QueryRow("SELECT COUNT(*) FROM credit_cards WHERE is_active = TRUE").Scan(&count); err != nil {
+		return 0, err
+	}
+	if _, err := tx.Exec("DELETE FROM stats_counters WHERE name = ? AND region <> ?", activeTokens, c.region); err != nil {
+		return 0, err
+	}
+	if _, err := tx.Exec(`
+		INSERT INTO stats_counters (name, region, value) VALUES (?, ?, ?)
+		ON DUPLICATE KEY UPDATE value = VALUES(value)`,
+		activeTokens, c.region, count); err != nil {
+		return 0, err
+	}
+	return count, tx.Commit()
+}
+
+// ActiveTokens returns the number of active tokens in the vault
+func ActiveTokens(db *sql.DB) (int64, error) {
+	var n int64
+	err := db.QueryRow("SELECT COALESCE(SUM(value), 0) FROM stats_counters WHERE name = ?", activeTokens).Scan(&n)
+	return n, err
+}
+
+// RequestTotals returns the number of token requests of each type ever made
+func RequestTotals(db *sql.DB) (map[string]int64, error) {
+	rows, err := db.Query(`
+		SELECT name, SUM(value) FROM stats_counters
+		WHERE name LIKE ? GROUP BY name`, requestsPrefix+"%")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	totals := make(map[string]int64)
+	for rows.Next() {
+		var name string
+		var n int64
+		if err := rows.Scan(&name, &n); err != nil {
+			return nil, err
+		}
+		totals[strings.TrimPrefix(name, requestsPrefix)] = n
+	}
+	return totals, rows.Err()
+}
+
+// RequestsSince returns the token requests of each type made from since,
+// to the minute
+func RequestsSince(db *sql.DB, since time.Time) (map[string]Requests, error) {
+	rows, err := db.Query(`
+		SELECT request_type, SUM(requests), SUM(errors) FROM token_request_minutes
+		WHERE minute >= ? GROUP BY request_type`, since.Unix()/60)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	byType := make(map[string]Requests)
+	for rows.Next() {
+		var requestType string
+		var r Requests
+		if err := rows.Scan(&requestType, &r.Requests, &r.Errors); err != nil {
+			return nil, err
+		}
+		byType[requestType] = r
+	}
+	return byType, rows.Err()
+}
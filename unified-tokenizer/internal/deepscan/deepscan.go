@@ -0,0 +1,140 @@
+// Package deepscan finds JSON hidden inside string fields, either as JSON
+// text (a webhook envelope's "payload") or base64-encoded, so the card
+// numbers and tokens in it can be replaced and the field put back the way
+// it came.
+package deepscan
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// Modes a field can be decoded in
+const (
+	JSON   = "json"
+	Base64 = "base64"
+)
+
+// Rule names a field whose string value is decoded and scanned
+type Rule struct {
+	Field  string // Lowercase field name, or "*" for every field
+	JSON   bool   // The value may be JSON text
+	Base64 bool   // The value may be base64-encoded JSON
+}
+
+// Rules are the fields to look inside. The zero value looks inside none.
+type Rules []Rule
+
+// Parse parses comma-separated rules like "payload,data:base64,*:json". A
+// field without a mode is tried as JSON text and then as base64.
+func Parse(value string) (Rules, error) {
+	var rules Rules
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		field, mode, hasMode := strings.Cut(entry, ":")
+		rule := Rule{Field: strings.ToLower(strings.TrimSpace(field))}
+		if rule.Field == "" {
+			return nil, fmt.Errorf("invalid rule %q: missing field name", entry)
+		}
+		switch strings.ToLower(strings.TrimSpace(mode)) {
+		case JSON:
+			rule.JSON = true
+		case Base64:
+			rule.Base64 = true
+		default:
+			if hasMode {
+				return nil, fmt.Errorf("invalid rule %q: mode must be json or base64", entry)
+			}
+			rule.JSON, rule.Base64 = true, true
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+// Match returns how a field's value may be encoded. Both are false for a
+// field no rule names.
+func (rs Rules) Match(field string) (asJSON, asBase64 bool) {
+	field = strings.ToLower(field)
+	for _, r := range rs {
+		if r.Field == field || r.Field == "*" {
+			asJSON = asJSON || r.JSON
+			asBase64 = asBase64 || r.Base64
+		}
+	}
+	return asJSON, asBase64
+}
+
+// Wrapping is how a JSON value was held in its string
+type Wrapping struct {
+	Base64 *base64.Encoding // Set when the JSON text was base64-encoded
+}
+
+// Mode is JSON or Base64
+func (w Wrapping) Mode() string {
+	if w.Base64 != nil {
+		return Base64
+	}
+	return JSON
+}
+
+// encodings are tried in turn; padding and the URL alphabet are kept when
+// the value is encoded again
+var encodings = []*base64.Encoding{
+	base64.StdEncoding, base64.URLEncoding, base64.RawStdEncoding, base64.RawURLEncoding,
+}
+
+// Decode returns the JSON object or array held in s, decoded as the flags
+// allow. ok is false when s holds neither.
+func Decode(s string, asJSON, asBase64 bool) (value interface{}, w Wrapping, ok bool) {
+	if asJSON {
+		if value, ok = decodeJSON([]byte(s)); ok {
+			return value, Wrapping{}, true
+		}
+	}
+	if asBase64 && len(s) >= 4 {
+		for _, enc := range encodings {
+			text, err := enc.DecodeString(s)
+			if err != nil {
+				continue
+			}
+			if value, ok = decodeJSON(text); ok {
+				return value, Wrapping{Base64: enc}, true
+			}
+			break // Decoded, but not to JSON
+		}
+	}
+	return nil, Wrapping{}, false
+}
+
+// decodeJSON parses text that is a JSON object or array. Strings, numbers
+// and the like are left alone: "123" is a field value, not nested JSON.
+func decodeJSON(text []byte) (interface{}, bool) {
+	trimmed := bytes.TrimSpace(text)
+	if len(trimmed) == 0 || (trimmed[0] != '{' && trimmed[0] != '[') {
+		return nil, false
+	}
+	var value interface{}
+	if err := json.Unmarshal(trimmed, &value); err != nil {
+		return nil, false
+	}
+	return value, true
+}
+
+// Encode returns value as a string wrapped as it was found
+func (w Wrapping) Encode(value interface{}) (string, error) {
+	text, err := json.Marshal(value)
+	if err != nil {
+		return "", err
+	}
+	if w.Base64 != nil {
+		return w.Base64.EncodeToString(text), nil
+	}
+	return string(text), nil
+}
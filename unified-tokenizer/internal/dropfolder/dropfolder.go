@@ -0,0 +1,203 @@
+// Package dropfolder finds the files partners have finished uploading to an
+// inbox, a local directory or a directory on an SFTP server. A file is ready
+// once its size and modification time have not changed between two polls,
+// so one still being written is left alone.
+package dropfolder
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"tokenshield-unified/internal/sftp"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// File is a file in the inbox
+type File struct {
+	Name    string
+	Size    int64
+	ModTime time.Time
+}
+
+// Source is an inbox. Open returns a connection to it for one poll.
+type Source interface {
+	Open() (Conn, error)
+	String() string
+}
+
+// Conn reads and removes the files in an inbox
+type Conn interface {
+	List() ([]File, error)
+	Read(name string, limit int64) ([]byte, error)
+	Remove(name string) error
+	Close() error
+}
+
+// Temporary reports whether a file name is one uploads use before the
+// file is complete (WinSCP's .filepart, rsync's dot files and the like)
+func Temporary(name string) bool {
+	lower := strings.ToLower(name)
+	return strings.HasPrefix(name, ".") || strings.HasSuffix(lower, ".tmp") ||
+		strings.HasSuffix(lower, ".part") || strings.HasSuffix(lower, ".filepart")
+}
+
+// Dir is an inbox in a local directory, or one an SFTP server writes to
+type Dir string
+
+func (d Dir) String() string { return string(d) }
+
+// Open implements Source
+func (d Dir) Open() (Conn, error) { return d, nil }
+
+// List implements Conn
+func (d Dir) List() ([]File, error) {
+	entries, err := os.ReadDir(string(d))
+	if err != nil {
+		return nil, err
+	}
+	var files []File
+	for _, e := range entries {
+		if !e.Type().IsRegular() || Temporary(e.Name()) {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil {
+			continue // Removed since it was listed
+		}
+		files = append(files, File{Name: e.Name(), Size: info.Size(), ModTime: info.ModTime()})
+	}
+	return files, nil
+}
+
+// Read implements Conn
+func (d Dir) Read(name string, limit int64) ([]byte, error) {
+	f, err := os.Open(filepath.Join(string(d), name))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	data, err := io.ReadAll(io.LimitReader(f, limit+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) > limit {
+		return nil, fmt.Errorf("%s is larger than %d bytes", name, limit)
+	}
+	return data, nil
+}
+
+// Remove implements Conn
+func (d Dir) Remove(name string) error {
+	return os.Remove(filepath.Join(string(d), name))
+}
+
+// Close implements Conn
+func (d Dir) Close() error { return nil }
+
+// SFTP is an inbox on an SFTP server
+type SFTP struct {
+	Addr   string // host:port
+	Dir    string // Directory on the server
+	Config *ssh.ClientConfig
+}
+
+// NewSFTP returns an SFTP inbox that authenticates with a password or a
+// private key and checks the server's host key against a known_hosts file
+func NewSFTP(addr, dir, user, password, keyFile, knownHostsFile string, timeout time.Duration) (*SFTP, error) {
+	if knownHostsFile == "" {
+		return nil, fmt.Errorf("a known_hosts file is required to verify %s", addr)
+	}
+	hostKeys, err := knownhosts.New(knownHostsFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read known_hosts: %v", err)
+	}
+	config := &ssh.ClientConfig{User: user, HostKeyCallback: hostKeys, Timeout: timeout}
+	if keyFile != "" {
+		pem, err := os.ReadFile(keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read private key: %v", err)
+		}
+		signer, err := ssh.ParsePrivateKey(pem)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse private key: %v", err)
+		}
+		config.Auth = append(config.Auth, ssh.PublicKeys(signer))
+	}
+	if password != "" {
+		config.Auth = append(config.Auth, ssh.Password(password))
+	}
+	if len(config.Auth) == 0 {
+		return nil, fmt.Errorf("a password or private key is required to log in to %s", addr)
+	}
+	return &SFTP{Addr: addr, Dir: dir, Config: config}, nil
+}
+
+func (s *SFTP) String() string { return "sftp://" + s.Addr + "/" + strings.TrimPrefix(s.Dir, "/") }
+
+// Open implements Source
+func (s *SFTP) Open() (Conn, error) {
+	client, err := sftp.Dial(s.Addr, s.Config)
+	if err != nil {
+		return nil, err
+	}
+	return &sftpConn{client: client, dir: s.Dir}, nil
+}
+
+type sftpConn struct {
+	client *sftp.Client
+	dir    string
+}
+
+func (c *sftpConn) List() ([]File, error) {
+	entries, err := c.client.ReadDir(c.dir)
+	if err != nil {
+		return nil, err
+	}
+	var files []File
+	for _, e := range entries {
+		if e.IsDir || Temporary(e.Name) {
+			continue
+		}
+		files = append(files, File{Name: e.Name, Size: e.Size, ModTime: e.ModTime})
+	}
+	return files, nil
+}
+
+func (c *sftpConn) Read(name string, limit int64) ([]byte, error) {
+	return c.client.ReadFile(path.Join(c.dir, name), limit)
+}
+
+func (c *sftpConn) Remove(name string) error {
+	return c.client.Remove(path.Join(c.dir, name))
+}
+
+func (c *sftpConn) Close() error {
+	return c.client.Close()
+}
+
+// Stable tracks files between polls to tell which have finished uploading
+type Stable struct {
+	seen map[string]File
+}
+
+// Ready returns the files listed unchanged in the previous poll, and
+// remembers this poll's listing for the next
+func (s *Stable) Ready(files []File) []File {
+	var ready []File
+	seen := make(map[string]File, len(files))
+	for _, f := range files {
+		if prev, ok := s.seen[f.Name]; ok && prev.Size == f.Size && prev.ModTime.Equal(f.ModTime) {
+			ready = append(ready, f)
+		}
+		seen[f.Name] = f
+	}
+	s.seen = seen
+	return ready
+}
@@ -0,0 +1,189 @@
+package egress
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"tokenshield-unified/internal/forward"
+	"tokenshield-unified/internal/icap"
+)
+
+// Detokenizer replaces tokens in a request body with card numbers,
+// returning the body and whether it changed. *icap.Client does it through
+// the tokenizer's REQMOD service and *icap.Server in process.
+type Detokenizer interface {
+	Reqmod(req *http.Request, body []byte) ([]byte, bool, error)
+}
+
+var (
+	_ Detokenizer = (*icap.Client)(nil)
+	_ Detokenizer = (*icap.Server)(nil)
+)
+
+// Proxy is the egress sidecar: a forward proxy on localhost that passes
+// request bodies bound for payment hosts through a Detokenizer, replacing
+// tokens with card numbers on the way out. Other traffic is forwarded
+// untouched.
+type Proxy struct {
+	detokenizer  Detokenizer
+	hosts        []string
+	originateTLS bool
+	transport    *http.Transport
+
+	// DialTimeout bounds connecting to upstream hosts, including CONNECT
+	// tunnels
+	DialTimeout time.Duration
+
+	// OriginForm accepts requests sent as to the origin server, taking the
+	// upstream host from the Host header. Clients reaching the proxy over
+	// a unix socket send them this way, as with curl --unix-socket.
+	OriginForm bool
+}
+
+// New creates a proxy detokenizing requests to hosts. Entries starting with
+// "." match subdomains, as in Squid's dstdomain ACLs. With originateTLS,
+// plain-HTTP requests to those hosts are sent upstream over HTTPS, so the
+// application can send http:// URLs and the body stays readable here.
+func New(detokenizer Detokenizer, hosts []string, originateTLS bool) *Proxy {
+	p := &Proxy{
+		detokenizer:  detokenizer,
+		hosts:        hosts,
+		originateTLS: originateTLS,
+		DialTimeout:  10 * time.Second,
+	}
+	p.transport = &http.Transport{
+		Proxy:               nil, // Never loop back through HTTP_PROXY
+		DialContext:         p.dial,
+		MaxIdleConnsPerHost: 16,
+		IdleConnTimeout:     90 * time.Second,
+		TLSHandshakeTimeout: 10 * time.Second,
+	}
+	return p
+}
+
+func (p *Proxy) dial(ctx context.Context, network, addr string) (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: p.DialTimeout, KeepAlive: 30 * time.Second}
+	return dialer.DialContext(ctx, network, addr)
+}
+
+// Matches reports whether requests to host are detokenized
+func (p *Proxy) Matches(host string) bool {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.ToLower(host)
+	for _, pattern := range p.hosts {
+		pattern = strings.ToLower(pattern)
+		if strings.HasPrefix(pattern, ".") {
+			if host == pattern[1:] || strings.HasSuffix(host, pattern) {
+				return true
+			}
+		} else if host == pattern {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodConnect {
+		p.tunnel(w, r)
+		return
+	}
+	out := r.Clone(r.Context())
+	if r.URL.Host == "" {
+		if !p.OriginForm || r.Host == "" {
+			http.Error(w, "egress proxy expects absolute-form requests (set HTTP_PROXY)", http.StatusBadRequest)
+			return
+		}
+		out.URL.Scheme = "http"
+		out.URL.Host = r.Host
+	}
+	out.RequestURI = ""
+	forward.RemoveHopHeaders(out.Header)
+
+	if p.Matches(out.URL.Host) {
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, "failed to read request body", http.StatusBadRequest)
+			return
+		}
+		if len(body) > 0 {
+			// Fail closed: never send a payment request we could not process
+			detokenized, modified, err := p.detokenizer.Reqmod(r, body)
+			if err != nil {
+				log.Printf("Egress: detokenization failed for %s: %v", out.URL.Host, err)
+				http.Error(w, "detokenization failed", http.StatusBadGateway)
+				return
+			}
+			if modified {
+				log.Printf("Egress: detokenized request body for %s", out.URL.Host)
+			}
+			body = detokenized
+		}
+		out.Body = io.NopCloser(bytes.NewReader(body))
+		out.ContentLength = int64(len(body))
+		out.Header.Del("Content-Length")
+
+		if p.originateTLS && out.URL.Scheme == "http" {
+			out.URL.Scheme = "https"
+		}
+	}
+
+	resp, err := p.transport.RoundTrip(out)
+	if err != nil {
+		log.Printf("Egress: upstream request to %s failed: %v", out.URL.Host, err)
+		http.Error(w, "upstream request failed", http.StatusBadGateway)
+		return
+	}
+	defer resp.Body.Close()
+
+	forward.RemoveHopHeaders(resp.Header)
+	for name, values := range resp.Header {
+		for _, v := range values {
+			w.Header().Add(name, v)
+		}
+	}
+	w.WriteHeader(resp.StatusCode)
+	io.Copy(w, resp.Body)
+}
+
+// tunnel relays CONNECT (HTTPS) traffic as-is; it is encrypted end to end,
+// so it cannot be detokenized and is only passed through
+func (p *Proxy) tunnel(w http.ResponseWriter, r *http.Request) {
+	if p.Matches(r.Host) {
+		log.Printf("Egress: CONNECT to payment host %s is not detokenized; send http:// with originate TLS enabled", r.Host)
+	}
+
+	upstream, err := p.dial(r.Context(), "tcp", r.Host)
+	if err != nil {
+		http.Error(w, "upstream connection failed", http.StatusBadGateway)
+		return
+	}
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		upstream.Close()
+		http.Error(w, "tunneling not supported", http.StatusInternalServerError)
+		return
+	}
+	client, buffered, err := hijacker.Hijack()
+	if err != nil {
+		upstream.Close()
+		return
+	}
+	client.Write([]byte("HTTP/1.1 200 Connection Established\r\n\r\n"))
+
+	go func() {
+		// Read through the buffer in case the client sent data early
+		io.Copy(upstream, buffered)
+		upstream.Close()
+	}()
+	io.Copy(client, upstream)
+	client.Close()
+}
@@ -0,0 +1,299 @@
+// Package engine calls external tokenization engines: services that take
+// over tokenizing the card numbers of some proxied fields, like an in-house
+// format-preserving encryption library or a card scheme's network
+// tokenization. An engine implements the TokenizationEngine gRPC service
+// in engine.proto. Like the other clients here it speaks the protocol
+// directly, over net/http's HTTP/2, rather than pulling in the gRPC module.
+package engine
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"tokenshield-unified/internal/tlsreload"
+)
+
+// MaxTokenLength bounds the tokens an engine may issue, which are stored
+// in token_requests like the vault's own
+const MaxTokenLength = 64
+
+// Methods of the TokenizationEngine service
+const (
+	methodTokenize   = "/tokenshield.engine.v1.TokenizationEngine/Tokenize"
+	methodDetokenize = "/tokenshield.engine.v1.TokenizationEngine/Detokenize"
+)
+
+// ErrNotFound is returned by Detokenize for a token the engine does not know
+var ErrNotFound = errors.New("token not found by the engine")
+
+// Config is one TOKENIZATION_ENGINES entry
+type Config struct {
+	URL          string `json:"url"`                     // https://host:port of the gRPC service
+	TokenPattern string `json:"token_pattern,omitempty"` // Regular expression matching the whole of the engine's tokens; without it the engine's tokens are never detokenized
+	CAFile       string `json:"ca_file,omitempty"`       // CAs the engine's certificate must chain to instead of the system roots
+	CertFile     string `json:"cert_file,omitempty"`     // Client certificate, reloaded from disk when renewed
+	KeyFile      string `json:"key_file,omitempty"`
+	Timeout      string `json:"timeout,omitempty"` // Per call; default 2s
+}
+
+// Card is a card number sent to an engine, with what the proxied request
+// carried alongside it
+type Card struct {
+	Number      string
+	ExpiryMonth int
+	ExpiryYear  int
+	Holder      string
+}
+
+// Stats count the calls made to one engine
+type Stats struct {
+	Engine      string
+	Tokenized   int64
+	Detokenized int64
+	NotFound    int64
+	Errors      int64
+}
+
+type engine struct {
+	base    *url.URL
+	pattern *regexp.Regexp
+	timeout time.Duration
+	client  *http.Client
+	stats   *Stats
+}
+
+// Set is the configured engines, by name
+type Set struct {
+	engines map[string]*engine
+	names   []string // Sorted, so tokens are matched against patterns in a stable order
+}
+
+// ValidName checks that name is 1 to 32 lowercase letters, digits, dashes
+// and underscores
+func ValidName(name string) error {
+	if name == "" || len(name) > 32 || strings.Trim(name, "abcdefghijklmnopqrstuvwxyz0123456789-_") != "" {
+		return fmt.Errorf("invalid engine name %q: want 1 to 32 lowercase letters, digits, dashes and underscores", name)
+	}
+	return nil
+}
+
+// Parse parses TOKENIZATION_ENGINES, a JSON object from engine name to its
+// Config
+func Parse(spec string) (map[string]Config, error) {
+	if strings.TrimSpace(spec) == "" {
+		return nil, nil
+	}
+	dec := json.NewDecoder(strings.NewReader(spec))
+	dec.DisallowUnknownFields()
+	var configs map[string]Config
+	if err := dec.Decode(&configs); err != nil {
+		return nil, err
+	}
+	return configs, nil
+}
+
+// New checks the engines' settings and loads their certificates. Nothing
+// is connected to until the first call.
+func New(configs map[string]Config) (*Set, error) {
+	s := &Set{engines: make(map[string]*engine)}
+	for name, cfg := range configs {
+		if err := ValidName(name); err != nil {
+			return nil, err
+		}
+		e, err := newEngine(name, cfg)
+		if err != nil {
+			return nil, fmt.Errorf("engine %s: %v", name, err)
+		}
+		s.engines[name] = e
+		s.names = append(s.names, name)
+	}
+	sort.Strings(s.names)
+	return s, nil
+}
+
+func newEngine(name string, cfg Config) (*engine, error) {
+	base, err := url.Parse(strings.TrimSpace(cfg.URL))
+	if err != nil || base.Scheme != "https" || base.Host == "" {
+		return nil, errors.New("url must be https://host:port; card numbers are only sent over TLS")
+	}
+	e := &engine{base: base, timeout: 2 * time.Second, stats: &Stats{Engine: name}}
+	if cfg.TokenPattern != "" {
+		if e.pattern, err = regexp.Compile(`^(?:` + cfg.TokenPattern + `)$`); err != nil {
+			return nil, fmt.Errorf("invalid token_pattern: %v", err)
+		}
+	}
+	if cfg.Timeout != "" {
+		if e.timeout, err = time.ParseDuration(cfg.Timeout); err != nil || e.timeout < 10*time.Millisecond || e.timeout > time.Minute {
+			return nil, fmt.Errorf("invalid timeout %q: want a duration from 10ms to 1m", cfg.Timeout)
+		}
+	}
+
+	config := &tls.Config{MinVersion: tls.VersionTLS12}
+	if cfg.CAFile != "" {
+		caPEM, err := os.ReadFile(cfg.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read ca_file: %v", err)
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(caPEM) {
+			return nil, errors.New("ca_file contains no PEM certificates")
+		}
+	}
+	if cfg.CertFile != "" || cfg.KeyFile != "" {
+		if cfg.CertFile == "" || cfg.KeyFile == "" {
+			return nil, errors.New("cert_file and key_file must be set together")
+		}
+		reloader, err := tlsreload.New(cfg.CertFile, cfg.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load the client certificate: %v", err)
+		}
+		config.GetClientCertificate = reloader.GetClientCertificate
+	}
+	e.client = &http.Client{Transport: &http.Transport{
+		TLSClientConfig:   config,
+		ForceAttemptHTTP2: true,
+		IdleConnTimeout:   90 * time.Second,
+	}}
+	return e, nil
+}
+
+// Has reports whether name is a configured engine
+func (s *Set) Has(name string) bool {
+	if s == nil {
+		return false
+	}
+	_, ok := s.engines[name]
+	return ok
+}
+
+// Names returns the configured engines, sorted
+func (s *Set) Names() []string {
+	if s == nil {
+		return nil
+	}
+	return s.names
+}
+
+// Owner returns the engine whose token_pattern matches token, or ""
+func (s *Set) Owner(token string) string {
+	if s == nil {
+		return ""
+	}
+	for _, name := range s.names {
+		if p := s.engines[name].pattern; p != nil && p.MatchString(token) {
+			return name
+		}
+	}
+	return ""
+}
+
+// Tokenize asks engine name for the token of card
+func (s *Set) Tokenize(ctx context.Context, name string, card Card) (string, error) {
+	e, ok := s.lookup(name)
+	if !ok {
+		return "", fmt.Errorf("unknown tokenization engine %q", name)
+	}
+	request := appendString(nil, 1, card.Number)
+	request = appendInt(request, 2, card.ExpiryMonth)
+	request = appendInt(request, 3, card.ExpiryYear)
+	request = appendString(request, 4, card.Holder)
+
+	response, err := e.call(ctx, methodTokenize, request)
+	if err != nil {
+		atomic.AddInt64(&e.stats.Errors, 1)
+		return "", fmt.Errorf("engine %s: %v", name, err)
+	}
+	token, err := stringField(response, 1)
+	switch {
+	case err != nil:
+	case token == "":
+		err = errors.New("no token returned")
+	case len(token) > MaxTokenLength:
+		err = fmt.Errorf("token longer than %d characters", MaxTokenLength)
+	case token == card.Number:
+		err = errors.New("token is the card number")
+	case e.pattern != nil && !e.pattern.MatchString(token):
+		err = errors.New("token does not match token_pattern")
+	}
+	if err != nil {
+		atomic.AddInt64(&e.stats.Errors, 1)
+		return "", fmt.Errorf("engine %s: %v", name, err)
+	}
+	atomic.AddInt64(&e.stats.Tokenized, 1)
+	return token, nil
+}
+
+// Detokenize asks engine name for the card number behind token, returning
+// ErrNotFound when the engine does not know it
+func (s *Set) Detokenize(ctx context.Context, name, token string) (string, error) {
+	e, ok := s.lookup(name)
+	if !ok {
+		return "", fmt.Errorf("unknown tokenization engine %q", name)
+	}
+	response, err := e.call(ctx, methodDetokenize, appendString(nil, 1, token))
+	var status *statusError
+	if errors.As(err, &status) && status.code == codeNotFound {
+		atomic.AddInt64(&e.stats.NotFound, 1)
+		return "", ErrNotFound
+	}
+	if errors.As(err, &status) && status.code == codeUnimplemented {
+		err = errors.New("the engine does not detokenize")
+	}
+	var card string
+	if err == nil {
+		if card, err = stringField(response, 1); err == nil && card == "" {
+			err = errors.New("no card number returned")
+		}
+	}
+	if err != nil {
+		atomic.AddInt64(&e.stats.Errors, 1)
+		return "", fmt.Errorf("engine %s: %v", name, err)
+	}
+	atomic.AddInt64(&e.stats.Detokenized, 1)
+	return card, nil
+}
+
+func (s *Set) lookup(name string) (*engine, bool) {
+	if s == nil {
+		return nil, false
+	}
+	e, ok := s.engines[name]
+	return e, ok
+}
+
+func (e *engine) call(ctx context.Context, method string, request []byte) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, e.timeout)
+	defer cancel()
+	return invoke(ctx, e.client, e.base, method, request)
+}
+
+// Stats returns the call counts of each engine, ordered by name
+func (s *Set) Stats() []Stats {
+	if s == nil {
+		return nil
+	}
+	out := make([]Stats, 0, len(s.names))
+	for _, name := range s.names {
+		st := s.engines[name].stats
+		out = append(out, Stats{
+			Engine:      st.Engine,
+			Tokenized:   atomic.LoadInt64(&st.Tokenized),
+			Detokenized: atomic.LoadInt64(&st.Detokenized),
+			NotFound:    atomic.LoadInt64(&st.NotFound),
+			Errors:      atomic.LoadInt64(&st.Errors),
+		})
+	}
+	return out
+}
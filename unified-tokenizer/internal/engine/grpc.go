@@ -0,0 +1,173 @@
+package engine
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// maxMessage bounds a response message from an engine
+const maxMessage = 64 << 10
+
+// gRPC status codes the client tells apart
+const (
+	codeOK            = 0
+	codeNotFound      = 5
+	codeUnimplemented = 12
+)
+
+// statusError is a call that ended with a gRPC status other than OK
+type statusError struct {
+	code    int
+	message string
+}
+
+func (e *statusError) Error() string {
+	if e.message == "" {
+		return fmt.Sprintf("gRPC status %d", e.code)
+	}
+	return fmt.Sprintf("gRPC status %d: %s", e.code, e.message)
+}
+
+// invoke makes a unary gRPC call of method on the engine at base, sending
+// request and returning the response message. gRPC needs HTTP/2, which
+// net/http only speaks over TLS, so engines are always reached on https.
+func invoke(ctx context.Context, client *http.Client, base *url.URL, method string, request []byte) ([]byte, error) {
+	frame := make([]byte, 5, 5+len(request))
+	binary.BigEndian.PutUint32(frame[1:], uint32(len(request)))
+	frame = append(frame, request...)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, strings.TrimRight(base.String(), "/")+method, bytes.NewReader(frame))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/grpc+proto")
+	req.Header.Set("TE", "trailers")
+	req.Header.Set("User-Agent", "tokenshield-engine-client")
+	if deadline, ok := ctx.Deadline(); ok {
+		req.Header.Set("Grpc-Timeout", strconv.FormatInt(time.Until(deadline).Milliseconds()+1, 10)+"m")
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.ProtoMajor != 2 {
+		return nil, fmt.Errorf("%s answered over %s, gRPC needs HTTP/2", base.Host, resp.Proto)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s answered %s", base.Host, resp.Status)
+	}
+	if ct := resp.Header.Get("Content-Type"); !strings.HasPrefix(ct, "application/grpc") {
+		return nil, fmt.Errorf("%s answered with %q, not gRPC", base.Host, ct)
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxMessage+6))
+	if err != nil {
+		return nil, err
+	}
+
+	// The status comes in the trailers, or in the headers of a response
+	// without a message
+	status := resp.Trailer.Get("Grpc-Status")
+	message := resp.Trailer.Get("Grpc-Message")
+	if status == "" {
+		status, message = resp.Header.Get("Grpc-Status"), resp.Header.Get("Grpc-Message")
+	}
+	code, err := strconv.Atoi(status)
+	if err != nil {
+		return nil, fmt.Errorf("%s sent no gRPC status", base.Host)
+	}
+	if code != codeOK {
+		message, _ = url.PathUnescape(message)
+		return nil, &statusError{code: code, message: message}
+	}
+
+	if len(body) < 5 {
+		return nil, errors.New("gRPC response has no message")
+	}
+	if body[0] != 0 {
+		return nil, errors.New("gRPC response is compressed")
+	}
+	length := binary.BigEndian.Uint32(body[1:5])
+	if length > maxMessage || int(length) != len(body)-5 {
+		return nil, errors.New("gRPC response is not a single message")
+	}
+	return body[5:], nil
+}
+
+// Protocol buffer wire format, enough for messages of strings and integers
+
+const (
+	wireVarint  = 0
+	wireFixed64 = 1
+	wireBytes   = 2
+	wireFixed32 = 5
+)
+
+func appendString(b []byte, field int, s string) []byte {
+	if s == "" {
+		return b
+	}
+	b = binary.AppendUvarint(b, uint64(field)<<3|wireBytes)
+	b = binary.AppendUvarint(b, uint64(len(s)))
+	return append(b, s...)
+}
+
+func appendInt(b []byte, field int, v int) []byte {
+	if v == 0 {
+		return b
+	}
+	b = binary.AppendUvarint(b, uint64(field)<<3|wireVarint)
+	return binary.AppendUvarint(b, uint64(int64(v)))
+}
+
+// stringField returns the last value of a string field in message,
+// skipping the fields it does not know
+func stringField(message []byte, field int) (string, error) {
+	var value string
+	for len(message) > 0 {
+		key, n := binary.Uvarint(message)
+		if n <= 0 {
+			return "", errors.New("malformed protobuf message")
+		}
+		message = message[n:]
+		var size uint64
+		switch key & 7 {
+		case wireVarint:
+			if _, n = binary.Uvarint(message); n <= 0 {
+				return "", errors.New("malformed protobuf message")
+			}
+			size = uint64(n)
+		case wireFixed64:
+			size = 8
+		case wireFixed32:
+			size = 4
+		case wireBytes:
+			length, n := binary.Uvarint(message)
+			if n <= 0 || length > uint64(len(message)-n) {
+				return "", errors.New("malformed protobuf message")
+			}
+			message = message[n:]
+			if int(key>>3) == field {
+				value = string(message[:length])
+			}
+			size = length
+		default:
+			return "", fmt.Errorf("unsupported protobuf wire type %d", key&7)
+		}
+		if size > uint64(len(message)) {
+			return "", errors.New("malformed protobuf message")
+		}
+		message = message[size:]
+	}
+	return value, nil
+}
@@ -0,0 +1,101 @@
+package events
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Event types published by the tokenizer
+const (
+	TypeActivity = "activity"
+	TypeSecurity = "security"
+)
+
+// Event is a single message delivered to stream subscribers
+type Event struct {
+	ID   int64       `json:"id"`
+	Type string      `json:"type"`
+	Time time.Time   `json:"time"`
+	Data interface{} `json:"data"`
+}
+
+// Subscription receives events published after it was created
+type Subscription struct {
+	C       <-chan Event
+	ch      chan Event
+	dropped int64
+}
+
+// Dropped returns how many events were discarded because the subscriber
+// was not reading fast enough
+func (s *Subscription) Dropped() int64 {
+	return atomic.LoadInt64(&s.dropped)
+}
+
+// Broker fans published events out to all subscribers. Publishing never
+// blocks: a subscriber whose buffer is full misses the event instead of
+// slowing down tokenization.
+type Broker struct {
+	subscribers map[*Subscription]struct{}
+	bufferSize  int
+	nextID      int64
+	mu          sync.Mutex
+}
+
+// NewBroker creates a broker whose subscribers buffer up to bufferSize events
+func NewBroker(bufferSize int) *Broker {
+	return &Broker{
+		subscribers: make(map[*Subscription]struct{}),
+		bufferSize:  bufferSize,
+	}
+}
+
+// Subscribe registers a new subscriber. Call Unsubscribe when done.
+func (b *Broker) Subscribe() *Subscription {
+	ch := make(chan Event, b.bufferSize)
+	sub := &Subscription{C: ch, ch: ch}
+
+	b.mu.Lock()
+	b.subscribers[sub] = struct{}{}
+	b.mu.Unlock()
+	return sub
+}
+
+// Unsubscribe removes a subscriber and closes its channel
+func (b *Broker) Unsubscribe(sub *Subscription) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if _, ok := b.subscribers[sub]; ok {
+		delete(b.subscribers, sub)
+		close(sub.ch)
+	}
+}
+
+// Publish delivers an event to every subscriber
+func (b *Broker) Publish(eventType string, data interface{}) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if len(b.subscribers) == 0 {
+		return
+	}
+
+	b.nextID++
+	event := Event{ID: b.nextID, Type: eventType, Time: time.Now().UTC(), Data: data}
+	for sub := range b.subscribers {
+		select {
+		case sub.ch <- event:
+		default:
+			atomic.AddInt64(&sub.dropped, 1)
+		}
+	}
+}
+
+// Subscribers returns the number of active subscribers
+func (b *Broker) Subscribers() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return len(b.subscribers)
+}
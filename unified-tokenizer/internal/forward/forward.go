@@ -0,0 +1,172 @@
+// Package forward implements the header handling of an HTTP proxy:
+// dropping hop-by-hop headers, and telling the next hop who the client is
+// and that the request went through a proxy.
+package forward
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/textproto"
+	"strings"
+
+	"tokenshield-unified/internal/clientip"
+)
+
+// Headers that apply to a single connection and must not be forwarded
+var hopHeaders = []string{
+	"Connection", "Proxy-Connection", "Keep-Alive", "Proxy-Authenticate",
+	"Proxy-Authorization", "Te", "Trailer", "Transfer-Encoding", "Upgrade",
+}
+
+// RemoveHopHeaders deletes the hop-by-hop headers from h, including any
+// the sender named in Connection
+func RemoveHopHeaders(h http.Header) {
+	for _, field := range h.Values("Connection") {
+		for _, name := range strings.Split(field, ",") {
+			if name = textproto.TrimString(name); name != "" {
+				h.Del(name)
+			}
+		}
+	}
+	for _, name := range hopHeaders {
+		h.Del(name)
+	}
+}
+
+// Modes choose the headers telling the next hop about the client
+const (
+	XForwarded = "x-forwarded" // X-Forwarded-For, X-Forwarded-Host and X-Forwarded-Proto
+	Forwarded  = "forwarded"   // RFC 7239 Forwarded
+	Both       = "both"        // Both of the above
+	None       = "none"        // Neither; whatever the client sent is passed on
+)
+
+// Modes are the valid values of Config.Mode
+var Modes = []string{XForwarded, Forwarded, Both, None}
+
+// Config says which headers a proxy adds to what it forwards
+type Config struct {
+	Mode string // One of Modes
+	Via  string // Name given in Via headers; "" adds none
+
+	// Proxies are trusted to have set forwarded headers, so theirs are
+	// extended. From anyone else they are replaced, as a client could
+	// otherwise claim any address.
+	Proxies *clientip.Resolver
+}
+
+// Validate checks the mode and Via name
+func (c Config) Validate() error {
+	valid := false
+	for _, mode := range Modes {
+		valid = valid || c.Mode == mode
+	}
+	if !valid {
+		return fmt.Errorf("unknown mode %q (use one of %v)", c.Mode, Modes)
+	}
+	if c.Via != "" && !isToken(c.Via) {
+		return fmt.Errorf("invalid Via name %q: use a single word such as tokenshield", c.Via)
+	}
+	return nil
+}
+
+// Request sets the forwarded and Via headers of h, the headers of a
+// request being forwarded on behalf of in
+func (c Config) Request(h http.Header, in *http.Request) {
+	if c.Mode != None {
+		client, trusted := peer(in, c.Proxies)
+		if !trusted {
+			for _, name := range []string{"X-Forwarded-For", "X-Forwarded-Host", "X-Forwarded-Proto", "Forwarded"} {
+				h.Del(name)
+			}
+		}
+		proto := "http"
+		if in.TLS != nil {
+			proto = "https"
+		}
+		if c.Mode == XForwarded || c.Mode == Both {
+			appendList(h, "X-Forwarded-For", client)
+			if h.Get("X-Forwarded-Host") == "" && in.Host != "" {
+				h.Set("X-Forwarded-Host", in.Host)
+			}
+			if h.Get("X-Forwarded-Proto") == "" {
+				h.Set("X-Forwarded-Proto", proto)
+			}
+		}
+		if c.Mode == Forwarded || c.Mode == Both {
+			node := client
+			if strings.Contains(node, ":") {
+				node = "[" + node + "]"
+			}
+			element := "for=" + quote(node)
+			if in.Host != "" {
+				element += ";host=" + quote(in.Host)
+			}
+			appendList(h, "Forwarded", element+";proto="+proto)
+		}
+	}
+	c.appendVia(h, in.ProtoMajor, in.ProtoMinor)
+}
+
+// Response adds the proxy to the Via header of a response received with
+// the given protocol version
+func (c Config) Response(h http.Header, protoMajor, protoMinor int) {
+	c.appendVia(h, protoMajor, protoMinor)
+}
+
+// appendVia adds this proxy to the Via header of h
+func (c Config) appendVia(h http.Header, protoMajor, protoMinor int) {
+	if c.Via == "" {
+		return
+	}
+	version := fmt.Sprintf("%d.%d", protoMajor, protoMinor)
+	if protoMajor >= 2 {
+		version = fmt.Sprint(protoMajor)
+	}
+	appendList(h, "Via", version+" "+c.Via)
+}
+
+// appendList adds value to the comma-separated list in the header name,
+// merging any repeated fields into one
+func appendList(h http.Header, name, value string) {
+	if prior := h.Values(name); len(prior) > 0 {
+		value = strings.Join(prior, ", ") + ", " + value
+	}
+	h.Set(name, value)
+}
+
+// peer returns the address of the connection in came from and whether it
+// is a trusted proxy
+func peer(in *http.Request, proxies *clientip.Resolver) (string, bool) {
+	host, _, err := net.SplitHostPort(in.RemoteAddr)
+	if err != nil {
+		host = in.RemoteAddr
+	}
+	return host, proxies.TrustedPeer(in)
+}
+
+// quote returns s as a Forwarded parameter value, quoted unless it is a
+// token
+func quote(s string) string {
+	if isToken(s) {
+		return s
+	}
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s) + `"`
+}
+
+// isToken reports whether s is an RFC 7230 token
+func isToken(s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, c := range s {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		case strings.ContainsRune("!#$%&'*+-.^_`|~", c):
+		default:
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,143 @@
+package icap
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Client sends REQMOD requests to a TokenShield ICAP service. It is used by
+// the egress sidecar, which has no database access of its own.
+type Client struct {
+	addr      string
+	uri       string
+	host      string
+	tlsConfig *tls.Config
+	Timeout   time.Duration
+	Secret    string // Sent in SecretHeader when set
+}
+
+// NewClient parses an icap:// or icaps:// service URL such as
+// icap://tokenshield-tokenizer:1344/reqmod. tlsConfig is used for icaps://
+// and may be nil to verify against the system roots.
+func NewClient(serviceURL string, tlsConfig *tls.Config) (*Client, error) {
+	u, err := url.Parse(serviceURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid ICAP URL: %v", err)
+	}
+
+	c := &Client{host: u.Hostname(), Timeout: 10 * time.Second}
+	switch u.Scheme {
+	case "icap":
+	case "icaps":
+		if tlsConfig == nil {
+			tlsConfig = &tls.Config{MinVersion: tls.VersionTLS12}
+		}
+		c.tlsConfig = tlsConfig
+	default:
+		return nil, fmt.Errorf("invalid ICAP URL scheme %q (use icap or icaps)", u.Scheme)
+	}
+
+	port := u.Port()
+	if port == "" {
+		port = "1344"
+	}
+	c.addr = net.JoinHostPort(u.Hostname(), port)
+	c.uri = "icap://" + c.addr + u.Path
+	return c, nil
+}
+
+// Reqmod sends the request headers and body through REQMOD and returns the
+// (possibly detokenized) body, and whether the service modified it
+func (c *Client) Reqmod(req *http.Request, body []byte) ([]byte, bool, error) {
+	dialer := &net.Dialer{Timeout: c.Timeout}
+	var conn net.Conn
+	var err error
+	if c.tlsConfig != nil {
+		conn, err = tls.DialWithDialer(dialer, "tcp", c.addr, c.tlsConfig)
+	} else {
+		conn, err = dialer.Dial("tcp", c.addr)
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(c.Timeout))
+
+	// Encapsulated HTTP request headers
+	var hdr bytes.Buffer
+	fmt.Fprintf(&hdr, "%s %s HTTP/1.1\r\n", req.Method, req.URL.RequestURI())
+	fmt.Fprintf(&hdr, "Host: %s\r\n", req.Host)
+	for name, values := range req.Header {
+		for _, v := range values {
+			fmt.Fprintf(&hdr, "%s: %s\r\n", name, v)
+		}
+	}
+	hdr.WriteString("\r\n")
+
+	writer := bufio.NewWriter(conn)
+	fmt.Fprintf(writer, "REQMOD %s ICAP/1.0\r\n", c.uri)
+	fmt.Fprintf(writer, "Host: %s\r\n", c.host)
+	writer.WriteString("Allow: 204\r\n")
+	if c.Secret != "" {
+		fmt.Fprintf(writer, "%s: %s\r\n", SecretHeader, c.Secret)
+	}
+	fmt.Fprintf(writer, "Encapsulated: req-hdr=0, req-body=%d\r\n\r\n", hdr.Len())
+	writer.Write(hdr.Bytes())
+	if len(body) > 0 {
+		fmt.Fprintf(writer, "%x\r\n", len(body))
+		writer.Write(body)
+		writer.WriteString("\r\n")
+	}
+	writer.WriteString("0\r\n\r\n")
+	if err := writer.Flush(); err != nil {
+		return nil, false, err
+	}
+
+	reader := bufio.NewReader(conn)
+	status, err := reader.ReadString('\n')
+	if err != nil {
+		return nil, false, fmt.Errorf("reading ICAP response: %v", err)
+	}
+	parts := strings.SplitN(strings.TrimSpace(status), " ", 3)
+	if len(parts) < 2 {
+		return nil, false, fmt.Errorf("invalid ICAP status line %q", status)
+	}
+
+	switch parts[1] {
+	case "403":
+		return nil, false, fmt.Errorf("ICAP service refused the request: check the shared secret")
+	case "204":
+		return body, false, nil
+	case "200":
+	default:
+		return nil, false, fmt.Errorf("ICAP service returned %s", strings.TrimSpace(status))
+	}
+
+	// Skip the ICAP headers, then the encapsulated HTTP headers
+	for section := 0; section < 2; section++ {
+		for {
+			line, err := reader.ReadString('\n')
+			if err != nil {
+				return nil, false, fmt.Errorf("reading ICAP response: %v", err)
+			}
+			if strings.TrimSpace(line) == "" {
+				break
+			}
+		}
+	}
+
+	modified, err := io.ReadAll(httputil.NewChunkedReader(reader))
+	if err != nil {
+		return nil, false, fmt.Errorf("reading ICAP body: %v", err)
+	}
+	return modified, true, nil
+}
@@ -2,14 +2,32 @@ package icap
 
 import (
 	"bufio"
+	"crypto/subtle"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net"
+	"net/http"
+	"net/url"
 	"strconv"
 	"strings"
+	"sync/atomic"
+	"time"
+
+	"tokenshield-unified/internal/charset"
+	"tokenshield-unified/internal/compression"
 )
 
+// maxDecodedBody bounds a compressed body decoded to be inspected
+const maxDecodedBody = 64 << 20
+
+// SecretHeader is the ICAP request header carrying the shared secret
+const SecretHeader = "X-TokenShield-Secret"
+
+// defaultISTag is the ISTag sent until SetISTag is called
+const defaultISTag = "TS-001"
+
 // Handler interface defines the methods needed for ICAP operations
 type Handler interface {
 	TokenizeJSON(jsonStr string) (string, bool, error)
@@ -21,6 +39,29 @@ type Handler interface {
 type Server struct {
 	handler Handler
 	debug   bool
+
+	// ReadTimeout bounds reading the whole request, and WriteTimeout
+	// writing the response once it starts. Zero means no limit.
+	ReadTimeout  time.Duration
+	WriteTimeout time.Duration
+
+	// MaxConnections is advertised in OPTIONS responses; zero advertises 100
+	MaxConnections int
+
+	// Secret, when set, must be sent in SecretHeader with every REQMOD and
+	// RESPMOD request; others are answered 403. OPTIONS needs no secret.
+	Secret string
+
+	// Unauthorized, when set, is called with the client address of each
+	// request refused for a missing or wrong secret
+	Unauthorized func(remote string)
+
+	// Detokenizes, when set, is asked for the destination host of each
+	// request body; bodies for hosts it refuses are passed on unchanged
+	Detokenizes func(host string) bool
+
+	istag        atomic.Value // string
+	authFailures int64
 }
 
 // NewServer creates a new ICAP server instance
@@ -31,12 +72,70 @@ func NewServer(handler Handler, debug bool) *Server {
 	}
 }
 
+// deadlineWriter sets the connection's write deadline on the first write,
+// so time spent reading and processing the request does not count against it
+type deadlineWriter struct {
+	conn    net.Conn
+	timeout time.Duration
+	started bool
+}
+
+func (w *deadlineWriter) Write(p []byte) (int, error) {
+	if !w.started && w.timeout > 0 {
+		w.conn.SetWriteDeadline(time.Now().Add(w.timeout))
+	}
+	w.started = true
+	return w.conn.Write(p)
+}
+
+// ISTag returns the service tag sent in every response. Clients such as
+// Squid drop what they cached from the service when it changes.
+func (s *Server) ISTag() string {
+	if tag, ok := s.istag.Load().(string); ok {
+		return tag
+	}
+	return defaultISTag
+}
+
+// SetISTag changes the service tag, up to 32 characters without quotes
+func (s *Server) SetISTag(tag string) {
+	s.istag.Store(tag)
+}
+
+// istagHeader is the ISTag header line
+func (s *Server) istagHeader() string {
+	return "ISTag: \"" + s.ISTag() + "\"\r\n"
+}
+
+// AuthFailures returns how many requests were refused for a missing or
+// wrong secret
+func (s *Server) AuthFailures() int64 {
+	return atomic.LoadInt64(&s.authFailures)
+}
+
+// authorized reports whether a request's headers carry the secret, if one
+// is required
+func (s *Server) authorized(headers map[string]string) bool {
+	if s.Secret == "" {
+		return true
+	}
+	for name, value := range headers {
+		if strings.EqualFold(name, SecretHeader) {
+			return subtle.ConstantTimeCompare([]byte(value), []byte(s.Secret)) == 1
+		}
+	}
+	return false
+}
+
 // HandleConnection processes an ICAP connection
 func (s *Server) HandleConnection(conn net.Conn) {
 	defer conn.Close()
 	
+	if s.ReadTimeout > 0 {
+		conn.SetReadDeadline(time.Now().Add(s.ReadTimeout))
+	}
 	reader := bufio.NewReader(conn)
-	writer := bufio.NewWriter(conn)
+	writer := bufio.NewWriter(&deadlineWriter{conn: conn, timeout: s.WriteTimeout})
 	
 	// Read request line
 	requestLine, err := reader.ReadString('\n')
@@ -83,6 +182,17 @@ func (s *Server) HandleConnection(conn net.Conn) {
 		}
 	}
 	
+	if (method == "REQMOD" || method == "RESPMOD") && !s.authorized(headers) {
+		atomic.AddInt64(&s.authFailures, 1)
+		log.Printf("Refused ICAP %s from %s: missing or wrong %s", method, conn.RemoteAddr(), SecretHeader)
+		if s.Unauthorized != nil {
+			s.Unauthorized(conn.RemoteAddr().String())
+		}
+		writer.WriteString("ICAP/1.0 403 Forbidden\r\n" + s.istagHeader() + "Encapsulated: null-body=0\r\n\r\n")
+		writer.Flush()
+		return
+	}
+	
 	switch method {
 	case "OPTIONS":
 		s.handleICAPOptions(writer, icapURI)
@@ -107,8 +217,12 @@ func (s *Server) handleICAPOptions(writer *bufio.Writer, icapURI string) {
 		response += "Methods: REQMOD\r\n"
 	}
 	response += "Service: TokenShield Unified 1.0\r\n"
-	response += "ISTag: \"TS-001\"\r\n"
-	response += "Max-Connections: 100\r\n"
+	response += s.istagHeader()
+	maxConnections := s.MaxConnections
+	if maxConnections <= 0 {
+		maxConnections = 100
+	}
+	response += fmt.Sprintf("Max-Connections: %d\r\n", maxConnections)
 	response += "Options-TTL: 3600\r\n"
 	response += "Allow: 204\r\n"
 	response += "Preview: 0\r\n"
@@ -147,25 +261,23 @@ func (s *Server) handleICAPReqmod(reader *bufio.Reader, writer *bufio.Writer, ic
 	modified := false
 	modifiedBody := body
 	
-	if len(body) > 0 {
-		detokenized, wasModified, err := s.handler.DetokenizeJSON(string(body))
-		if err == nil && wasModified {
-			modifiedBody = []byte(detokenized)
-			modified = true
+	if len(body) > 0 && s.detokenizes(requestHost(httpRequest, httpHeaders)) {
+		if detokenized, ok, err := s.detokenizeBody(httpHeaders, body); err == nil && ok {
+			modifiedBody, modified = detokenized, true
 			log.Printf("Detokenized request body")
 		}
 	}
 	
 	if !modified {
 		// Send 204 No Content
-		response := "ICAP/1.0 204 No Content\r\n\r\n"
+		response := "ICAP/1.0 204 No Content\r\n" + s.istagHeader() + "\r\n"
 		writer.WriteString(response)
 		writer.Flush()
 		return
 	}
 	
 	// Send modified response
-	response := "ICAP/1.0 200 OK\r\n"
+	response := "ICAP/1.0 200 OK\r\n" + s.istagHeader()
 	
 	// Calculate positions
 	reqHdrLen := len(httpRequest) + 2 // +2 for \r\n
@@ -205,6 +317,68 @@ func (s *Server) handleICAPReqmod(reader *bufio.Reader, writer *bufio.Writer, ic
 	writer.Flush()
 }
 
+// detokenizes reports whether request bodies bound for host are
+// detokenized
+func (s *Server) detokenizes(host string) bool {
+	return s.Detokenizes == nil || s.Detokenizes(host)
+}
+
+// requestHost returns the host an encapsulated request is bound for, from
+// an absolute request URI or else the Host header
+func requestHost(requestLine string, headers []string) string {
+	if fields := strings.Fields(requestLine); len(fields) >= 2 {
+		if u, err := url.Parse(fields[1]); err == nil && u.Host != "" {
+			return u.Host
+		}
+	}
+	for _, hdr := range headers {
+		if name, value, ok := strings.Cut(hdr, ":"); ok && strings.EqualFold(strings.TrimSpace(name), "Host") {
+			return strings.TrimSpace(value)
+		}
+	}
+	return ""
+}
+
+// detokenizeBody detokenizes a request body, decoding it as its headers
+// describe and encoding it back. It returns the body and whether it
+// changed; a body that cannot be decoded or is not JSON is left alone.
+func (s *Server) detokenizeBody(headers []string, body []byte) ([]byte, bool, error) {
+	decoded, enc, ok := decodeBody(headers, body)
+	if !ok {
+		return body, false, nil
+	}
+	detokenized, modified, err := s.handler.DetokenizeJSON(decoded)
+	if err != nil || !modified {
+		return body, false, nil
+	}
+	encoded, ok := encodeBody(enc, detokenized)
+	if !ok {
+		return nil, false, errors.New("detokenized body could not be encoded")
+	}
+	return encoded, true, nil
+}
+
+// Reqmod detokenizes a request body in process, as the REQMOD service
+// does, for callers sharing the handler such as the local egress helper.
+// Unlike the service it reports a body it detokenized but could not encode
+// again, so the request can be refused rather than sent with tokens.
+func (s *Server) Reqmod(req *http.Request, body []byte) ([]byte, bool, error) {
+	host := req.URL.Host
+	if host == "" {
+		host = req.Host
+	}
+	if !s.detokenizes(host) {
+		return body, false, nil
+	}
+	headers := make([]string, 0, len(req.Header))
+	for name, values := range req.Header {
+		for _, v := range values {
+			headers = append(headers, name+": "+v)
+		}
+	}
+	return s.detokenizeBody(headers, body)
+}
+
 func (s *Server) handleICAPRespmod(reader *bufio.Reader, writer *bufio.Writer, icapHeaders map[string]string) {
 	// Parse encapsulated header for response modification
 	encapHeader := icapHeaders["Encapsulated"]
@@ -240,7 +414,7 @@ func (s *Server) handleICAPRespmod(reader *bufio.Reader, writer *bufio.Writer, i
 			log.Printf("RESPMOD: No body to process, sending 204 No Content")
 		}
 		response := "ICAP/1.0 204 No Content\r\n"
-		response += "ISTag: \"TS-001\"\r\n"
+		response += s.istagHeader()
 		response += "\r\n"
 		writer.WriteString(response)
 		writer.Flush()
@@ -262,13 +436,16 @@ func (s *Server) handleICAPRespmod(reader *bufio.Reader, writer *bufio.Writer, i
 				log.Printf("RESPMOD: Found JSON response, checking for cards to tokenize")
 			}
 			
-			tokenizedJSON, wasModified, err := s.handler.TokenizeJSON(string(body))
-			if err != nil {
-				log.Printf("Error tokenizing JSON response: %v", err)
-			} else if wasModified {
-				modifiedBody = []byte(tokenizedJSON)
-				modified = true
-				log.Printf("RESPMOD: Tokenized card numbers in response")
+			if decoded, enc, ok := decodeBody(httpHeaders, body); ok {
+				tokenizedJSON, wasModified, err := s.handler.TokenizeJSON(decoded)
+				if err != nil {
+					log.Printf("Error tokenizing JSON response: %v", err)
+				} else if wasModified {
+					modifiedBody, modified = encodeBody(enc, tokenizedJSON)
+					if modified {
+						log.Printf("RESPMOD: Tokenized card numbers in response")
+					}
+				}
 			}
 		}
 	}
@@ -277,7 +454,7 @@ func (s *Server) handleICAPRespmod(reader *bufio.Reader, writer *bufio.Writer, i
 	if !modified {
 		// No modification - send 204 No Content
 		response := "ICAP/1.0 204 No Content\r\n"
-		response += "ISTag: \"TS-001\"\r\n"
+		response += s.istagHeader()
 		response += "\r\n"
 		writer.WriteString(response)
 	} else {
@@ -301,7 +478,7 @@ func (s *Server) handleICAPRespmod(reader *bufio.Reader, writer *bufio.Writer, i
 		
 		// Build ICAP response
 		response := "ICAP/1.0 200 OK\r\n"
-		response += "ISTag: \"TS-001\"\r\n"
+		response += s.istagHeader()
 		response += fmt.Sprintf("Encapsulated: res-hdr=0, res-body=%d\r\n", resBodyOffset)
 		response += "\r\n"
 		
@@ -318,6 +495,75 @@ func (s *Server) handleICAPRespmod(reader *bufio.Reader, writer *bufio.Writer, i
 	writer.Flush()
 }
 
+// bodyEncoding is how an encapsulated body is encoded: its content
+// coding, if any, and its character set
+type bodyEncoding struct {
+	coding  string
+	charset charset.Encoding
+}
+
+// decodeBody returns an encapsulated body as UTF-8 text, decoded from the
+// coding its Content-Encoding header names and converted from the charset
+// its Content-Type names, and how it was encoded. ok is false when it
+// cannot be decoded, and the body is left alone.
+func decodeBody(headers []string, body []byte) (text string, enc bodyEncoding, ok bool) {
+	contentType := ""
+	for _, header := range headers {
+		name, value, _ := strings.Cut(header, ":")
+		switch {
+		case strings.EqualFold(strings.TrimSpace(name), "Content-Encoding"):
+			enc.coding = strings.TrimSpace(value)
+		case strings.EqualFold(strings.TrimSpace(name), "Content-Type"):
+			contentType = strings.TrimSpace(value)
+		}
+	}
+	if compression.Encoded(enc.coding) {
+		decoded, err := compression.Decode(enc.coding, body, maxDecodedBody)
+		if err != nil {
+			log.Printf("Body with Content-Encoding %q not inspected: %v", enc.coding, err)
+			return "", enc, false
+		}
+		body = decoded
+	} else {
+		enc.coding = ""
+	}
+	var err error
+	if enc.charset, err = charset.Detect(contentType, body); err != nil {
+		log.Printf("Body not inspected: %v", err)
+		return "", enc, false
+	}
+	if enc.charset.Native() {
+		return string(body), enc, true
+	}
+	if text, err = enc.charset.Decode(body); err != nil {
+		log.Printf("Body in %s not inspected: %v", enc.charset.Name, err)
+		return "", enc, false
+	}
+	return text, enc, true
+}
+
+// encodeBody encodes modified text back the way the body was. ok is false
+// when that fails, and the original body should be kept.
+func encodeBody(enc bodyEncoding, text string) ([]byte, bool) {
+	body := []byte(text)
+	if !enc.charset.Native() {
+		var err error
+		if body, err = enc.charset.Encode(text); err != nil {
+			log.Printf("Error encoding modified body as %s: %v", enc.charset.Name, err)
+			return nil, false
+		}
+	}
+	if enc.coding == "" {
+		return body, true
+	}
+	encoded, err := compression.Encode(enc.coding, body)
+	if err != nil {
+		log.Printf("Error encoding modified body as %q: %v", enc.coding, err)
+		return nil, false
+	}
+	return encoded, true
+}
+
 func (s *Server) parseEncapsulated(reader *bufio.Reader, encapHeader string) (string, []string, []byte, error) {
 	log.Printf("DEBUG_FORCE: parseEncapsulated called with header: %s", encapHeader)
 	
@@ -0,0 +1,103 @@
+package icap
+
+import (
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// Pool serves ICAP connections with a fixed number of workers. Connections
+// beyond that wait in a bounded queue; when the queue is full, or a
+// connection has waited longer than the queue timeout, it is answered with
+// 503 and closed, so a burst from Squid cannot grow memory without bound.
+type Pool struct {
+	server       *Server
+	queue        chan queuedConn
+	workers      int
+	queueTimeout time.Duration
+
+	active        int64
+	handled       int64
+	rejectedFull  int64
+	rejectedStale int64
+}
+
+type queuedConn struct {
+	conn     net.Conn
+	queuedAt time.Time
+}
+
+// PoolStats is a snapshot of the pool's saturation
+type PoolStats struct {
+	Workers       int
+	QueueCapacity int
+	Active        int64
+	Queued        int
+	Handled       int64
+	RejectedFull  int64 // Queue was full
+	RejectedStale int64 // Waited longer than the queue timeout
+}
+
+// NewPool starts workers goroutines handling connections through server.
+// The server advertises workers as its Max-Connections.
+func NewPool(server *Server, workers, queueSize int, queueTimeout time.Duration) *Pool {
+	server.MaxConnections = workers
+	p := &Pool{
+		server:       server,
+		queue:        make(chan queuedConn, queueSize),
+		workers:      workers,
+		queueTimeout: queueTimeout,
+	}
+	for i := 0; i < workers; i++ {
+		go p.work()
+	}
+	return p
+}
+
+// Serve queues conn for a worker without blocking, or rejects it if the
+// queue is full
+func (p *Pool) Serve(conn net.Conn) {
+	select {
+	case p.queue <- queuedConn{conn: conn, queuedAt: time.Now()}:
+	default:
+		atomic.AddInt64(&p.rejectedFull, 1)
+		go p.reject(conn)
+	}
+}
+
+func (p *Pool) work() {
+	for qc := range p.queue {
+		if p.queueTimeout > 0 && time.Since(qc.queuedAt) > p.queueTimeout {
+			atomic.AddInt64(&p.rejectedStale, 1)
+			p.reject(qc.conn)
+			continue
+		}
+		atomic.AddInt64(&p.active, 1)
+		p.server.HandleConnection(qc.conn)
+		atomic.AddInt64(&p.active, -1)
+		atomic.AddInt64(&p.handled, 1)
+	}
+}
+
+// Stats returns the current pool counters
+func (p *Pool) Stats() PoolStats {
+	return PoolStats{
+		Workers:       p.workers,
+		QueueCapacity: cap(p.queue),
+		Active:        atomic.LoadInt64(&p.active),
+		Queued:        len(p.queue),
+		Handled:       atomic.LoadInt64(&p.handled),
+		RejectedFull:  atomic.LoadInt64(&p.rejectedFull),
+		RejectedStale: atomic.LoadInt64(&p.rejectedStale),
+	}
+}
+
+// reject answers 503 without reading the request, which a pipelining
+// client would otherwise still be sending. Squid treats it as a service
+// failure: with bypass=on the message is passed through unmodified,
+// otherwise the client gets an error.
+func (p *Pool) reject(conn net.Conn) {
+	defer conn.Close()
+	conn.SetWriteDeadline(time.Now().Add(time.Second))
+	conn.Write([]byte("ICAP/1.0 503 Service Unavailable\r\n" + p.server.istagHeader() + "Encapsulated: null-body=0\r\n\r\n"))
+}
@@ -0,0 +1,115 @@
+package ipfilter
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"strings"
+)
+
+// Filter decides which client addresses may connect to a listener. Deny
+// entries win over allow entries, and an empty allow list allows every
+// address that is not denied.
+type Filter struct {
+	// Allow and Deny hold CIDR ranges like 10.0.0.0/8 or single addresses
+	Allow []string `json:"allow"`
+	Deny  []string `json:"deny"`
+
+	allow []netip.Prefix
+	deny  []netip.Prefix
+}
+
+// Normalize checks the lists and puts them in canonical form, with single
+// addresses written as /32 or /128 ranges. It must be called before Allows.
+func (f *Filter) Normalize() error {
+	var err error
+	if f.allow, err = parse(f.Allow); err != nil {
+		return err
+	}
+	if f.deny, err = parse(f.Deny); err != nil {
+		return err
+	}
+	f.Allow, f.Deny = format(f.allow), format(f.deny)
+	return nil
+}
+
+func parse(entries []string) ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+	for _, entry := range entries {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if !strings.Contains(entry, "/") {
+			addr, err := netip.ParseAddr(entry)
+			if err != nil {
+				return nil, fmt.Errorf("invalid address %q", entry)
+			}
+			addr = addr.Unmap()
+			prefixes = append(prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+			continue
+		}
+		prefix, err := netip.ParsePrefix(entry)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CIDR %q", entry)
+		}
+		if prefix.Addr().Is4In6() && prefix.Bits() >= 96 {
+			prefix = netip.PrefixFrom(prefix.Addr().Unmap(), prefix.Bits()-96)
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+	return prefixes, nil
+}
+
+func format(prefixes []netip.Prefix) []string {
+	values := make([]string, 0, len(prefixes))
+	for _, p := range prefixes {
+		values = append(values, p.String())
+	}
+	return values
+}
+
+// Empty reports whether the filter allows every address
+func (f *Filter) Empty() bool {
+	return f == nil || (len(f.allow) == 0 && len(f.deny) == 0)
+}
+
+// Allows reports whether addr may connect. A nil filter allows everything.
+func (f *Filter) Allows(addr netip.Addr) bool {
+	if f.Empty() {
+		return true
+	}
+	addr = addr.Unmap()
+	for _, p := range f.deny {
+		if p.Contains(addr) {
+			return false
+		}
+	}
+	if len(f.allow) == 0 {
+		return true
+	}
+	for _, p := range f.allow {
+		if p.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// AllowsRemote applies the filter to a host:port remote address, such as
+// http.Request.RemoteAddr or net.Conn.RemoteAddr().String(). An address
+// that cannot be parsed is only allowed by a filter that allows everything.
+func (f *Filter) AllowsRemote(remote string) bool {
+	if f.Empty() {
+		return true
+	}
+	host, _, err := net.SplitHostPort(remote)
+	if err != nil {
+		host = remote
+	}
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		return false
+	}
+	return f.Allows(addr.WithZone(""))
+}
@@ -0,0 +1,492 @@
+// Package jsonschema validates decoded JSON values against JSON Schemas. It
+// implements the part of draft 2020-12 that request bodies need: type, enum,
+// const, properties, required, additionalProperties, items, minItems,
+// maxItems, minLength, maxLength, pattern, minimum, maximum,
+// exclusiveMinimum, exclusiveMaximum, writeOnly and $ref to the root's
+// $defs. Compile rejects any other keyword, so a misspelt or unsupported
+// constraint fails loudly instead of being ignored.
+package jsonschema
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// Schema is a compiled schema
+type Schema struct {
+	never      bool // The false schema
+	types      []string
+	enum       []interface{}
+	constValue interface{}
+	hasConst   bool
+	properties map[string]*Schema
+	required   []string
+	additional *Schema // For properties not in properties; nil allows any
+	items      *Schema
+	minItems   int // -1 when not set
+	maxItems   int
+	minLength  int
+	maxLength  int
+	pattern    *regexp.Regexp
+	minimum    *float64
+	maximum    *float64
+	exclMin    *float64
+	exclMax    *float64
+	writeOnly  bool
+	ref        string
+	target     *Schema // ref resolved
+}
+
+// Error is a value that does not match its schema
+type Error struct {
+	Path      string      // Of the value, like limit, filter.tags or tokens[2]; empty for the document
+	Message   string      // Such as "must be an integer"
+	Value     interface{} // nil when the value is missing
+	WriteOnly bool        // The schema marks the value writeOnly, like a password: do not show it
+}
+
+func (e Error) Error() string {
+	if e.Path == "" {
+		return e.Message
+	}
+	return e.Path + ": " + e.Message
+}
+
+// keywords Compile accepts; annotations are accepted and ignored
+var keywords = map[string]bool{
+	"type": true, "enum": true, "const": true, "properties": true, "required": true,
+	"additionalProperties": true, "items": true, "minItems": true, "maxItems": true,
+	"minLength": true, "maxLength": true, "pattern": true, "minimum": true, "maximum": true,
+	"exclusiveMinimum": true, "exclusiveMaximum": true, "writeOnly": true, "$ref": true,
+	"$defs": true, "$schema": true, "$id": true, "$comment": true, "title": true,
+	"description": true, "examples": true, "default": true, "readOnly": true, "deprecated": true,
+}
+
+var typeNames = map[string]bool{
+	"null": true, "boolean": true, "object": true, "array": true, "number": true, "integer": true, "string": true,
+}
+
+// compiler holds the root's $defs while a schema is compiled
+type compiler struct {
+	defs map[string]*Schema
+	refs []*Schema
+}
+
+// Compile parses a JSON Schema document
+func Compile(data []byte) (*Schema, error) {
+	var doc interface{}
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return nil, fmt.Errorf("invalid JSON: %v", err)
+	}
+	return CompileValue(doc)
+}
+
+// CompileValue compiles a schema already decoded from JSON, such as one of
+// several in a document
+func CompileValue(doc interface{}) (*Schema, error) {
+	c := &compiler{defs: make(map[string]*Schema)}
+	if obj, ok := doc.(map[string]interface{}); ok {
+		if defs, ok := obj["$defs"]; ok {
+			defsObj, ok := defs.(map[string]interface{})
+			if !ok {
+				return nil, fmt.Errorf("$defs must be an object")
+			}
+			// References are resolved once everything is compiled, so
+			// definitions can refer to each other
+			for name, def := range defsObj {
+				s, err := c.compile(def, "$defs/"+name)
+				if err != nil {
+					return nil, err
+				}
+				c.defs[name] = s
+			}
+		}
+	}
+	root, err := c.compile(doc, "")
+	if err != nil {
+		return nil, err
+	}
+	for _, s := range c.refs {
+		name := strings.TrimPrefix(s.ref, "#/$defs/")
+		target, ok := c.defs[name]
+		if !ok || name == s.ref {
+			return nil, fmt.Errorf("$ref %q: only #/$defs/<name> of the root schema is supported", s.ref)
+		}
+		s.target = target
+	}
+	return root, nil
+}
+
+func (c *compiler) compile(doc interface{}, at string) (*Schema, error) {
+	fail := func(format string, args ...interface{}) (*Schema, error) {
+		where := at
+		if where == "" {
+			where = "schema"
+		}
+		return nil, fmt.Errorf("%s: %s", where, fmt.Sprintf(format, args...))
+	}
+	s := &Schema{minItems: -1, maxItems: -1, minLength: -1, maxLength: -1}
+	switch v := doc.(type) {
+	case bool:
+		s.never = !v
+		return s, nil
+	case map[string]interface{}:
+		for key := range v {
+			if !keywords[key] {
+				return fail("unsupported keyword %q", key)
+			}
+			if key == "$defs" && at != "" {
+				return fail("$defs is only supported on the root schema")
+			}
+		}
+		obj := v
+		sub := func(key string, value interface{}) (*Schema, error) {
+			path := key
+			if at != "" {
+				path = at + "/" + key
+			}
+			return c.compile(value, path)
+		}
+		count := func(key string) (int, error) {
+			raw, ok := obj[key]
+			if !ok {
+				return -1, nil
+			}
+			n, ok := raw.(float64)
+			if !ok || n < 0 || n != math.Trunc(n) {
+				return -1, fmt.Errorf("%s must be a non-negative integer", key)
+			}
+			return int(n), nil
+		}
+		number := func(key string) (*float64, error) {
+			raw, ok := obj[key]
+			if !ok {
+				return nil, nil
+			}
+			n, ok := raw.(float64)
+			if !ok {
+				return nil, fmt.Errorf("%s must be a number", key)
+			}
+			return &n, nil
+		}
+
+		switch t := obj["type"].(type) {
+		case nil:
+		case string:
+			s.types = []string{t}
+		case []interface{}:
+			for _, name := range t {
+				str, ok := name.(string)
+				if !ok {
+					return fail("type must be a string or an array of strings")
+				}
+				s.types = append(s.types, str)
+			}
+		default:
+			return fail("type must be a string or an array of strings")
+		}
+		for _, t := range s.types {
+			if !typeNames[t] {
+				return fail("unknown type %q", t)
+			}
+		}
+		if enum, ok := obj["enum"]; ok {
+			values, ok := enum.([]interface{})
+			if !ok || len(values) == 0 {
+				return fail("enum must be a non-empty array")
+			}
+			s.enum = values
+		}
+		s.constValue, s.hasConst = obj["const"]
+		if props, ok := obj["properties"]; ok {
+			propsObj, ok := props.(map[string]interface{})
+			if !ok {
+				return fail("properties must be an object")
+			}
+			s.properties = make(map[string]*Schema, len(propsObj))
+			for name, prop := range propsObj {
+				compiled, err := sub("properties/"+name, prop)
+				if err != nil {
+					return nil, err
+				}
+				s.properties[name] = compiled
+			}
+		}
+		if required, ok := obj["required"]; ok {
+			names, ok := required.([]interface{})
+			if !ok {
+				return fail("required must be an array of strings")
+			}
+			for _, name := range names {
+				str, ok := name.(string)
+				if !ok {
+					return fail("required must be an array of strings")
+				}
+				s.required = append(s.required, str)
+			}
+		}
+		if additional, ok := obj["additionalProperties"]; ok {
+			compiled, err := sub("additionalProperties", additional)
+			if err != nil {
+				return nil, err
+			}
+			s.additional = compiled
+		}
+		if items, ok := obj["items"]; ok {
+			compiled, err := sub("items", items)
+			if err != nil {
+				return nil, err
+			}
+			s.items = compiled
+		}
+		var err error
+		for key, dst := range map[string]*int{"minItems": &s.minItems, "maxItems": &s.maxItems, "minLength": &s.minLength, "maxLength": &s.maxLength} {
+			if *dst, err = count(key); err != nil {
+				return fail("%v", err)
+			}
+		}
+		if pattern, ok := obj["pattern"]; ok {
+			str, ok := pattern.(string)
+			if !ok {
+				return fail("pattern must be a string")
+			}
+			if s.pattern, err = regexp.Compile(str); err != nil {
+				return fail("invalid pattern: %v", err)
+			}
+		}
+		for key, dst := range map[string]**float64{"minimum": &s.minimum, "maximum": &s.maximum, "exclusiveMinimum": &s.exclMin, "exclusiveMaximum": &s.exclMax} {
+			if *dst, err = number(key); err != nil {
+				return fail("%v", err)
+			}
+		}
+		if writeOnly, ok := obj["writeOnly"]; ok {
+			if s.writeOnly, ok = writeOnly.(bool); !ok {
+				return fail("writeOnly must be true or false")
+			}
+		}
+		if ref, ok := obj["$ref"]; ok {
+			if s.ref, ok = ref.(string); !ok {
+				return fail("$ref must be a string")
+			}
+			c.refs = append(c.refs, s)
+		}
+		return s, nil
+	default:
+		return fail("a schema must be an object or a boolean")
+	}
+}
+
+// Validate returns how v, as decoded by encoding/json, fails to match s.
+// Object properties are checked in name order, so the errors are stable.
+func (s *Schema) Validate(v interface{}) []Error {
+	return s.validate(v, "", false)
+}
+
+func (s *Schema) validate(v interface{}, path string, writeOnly bool) []Error {
+	writeOnly = writeOnly || s.writeOnly
+	var errs []Error
+	fail := func(format string, args ...interface{}) []Error {
+		return append(errs, Error{Path: path, Message: fmt.Sprintf(format, args...), Value: v, WriteOnly: writeOnly})
+	}
+	if s.never {
+		return fail("is not allowed")
+	}
+	if s.target != nil {
+		errs = append(errs, s.target.validate(v, path, writeOnly)...)
+	}
+	if len(s.types) > 0 && !s.hasType(v) {
+		return fail("must be %s", typeList(s.types))
+	}
+	if s.enum != nil && !contains(s.enum, v) {
+		return fail("must be one of %s", valueList(s.enum))
+	}
+	if s.hasConst && !equal(s.constValue, v) {
+		return fail("must be %s", valueList([]interface{}{s.constValue}))
+	}
+
+	switch val := v.(type) {
+	case string:
+		length := utf8.RuneCountInString(val)
+		if s.minLength >= 0 && length < s.minLength {
+			errs = fail("minimum length is %d characters", s.minLength)
+		}
+		if s.maxLength >= 0 && length > s.maxLength {
+			errs = fail("maximum length is %d characters", s.maxLength)
+		}
+		if s.pattern != nil && !s.pattern.MatchString(val) {
+			errs = fail("format is invalid")
+		}
+	case float64:
+		if s.minimum != nil && val < *s.minimum {
+			errs = fail("must be at least %s", formatNumber(*s.minimum))
+		}
+		if s.maximum != nil && val > *s.maximum {
+			errs = fail("must be at most %s", formatNumber(*s.maximum))
+		}
+		if s.exclMin != nil && val <= *s.exclMin {
+			errs = fail("must be greater than %s", formatNumber(*s.exclMin))
+		}
+		if s.exclMax != nil && val >= *s.exclMax {
+			errs = fail("must be less than %s", formatNumber(*s.exclMax))
+		}
+	case []interface{}:
+		if s.minItems >= 0 && len(val) < s.minItems {
+			errs = fail("must have at least %d items", s.minItems)
+		}
+		if s.maxItems >= 0 && len(val) > s.maxItems {
+			errs = fail("must have at most %d items", s.maxItems)
+		}
+		if s.items != nil {
+			for i, item := range val {
+				errs = append(errs, s.items.validate(item, path+"["+strconv.Itoa(i)+"]", writeOnly)...)
+			}
+		}
+	case map[string]interface{}:
+		for _, name := range s.required {
+			if _, ok := val[name]; !ok {
+				prop := s.properties[name]
+				errs = append(errs, Error{Path: join(path, name), Message: "field is required", WriteOnly: prop != nil && prop.writeOnly})
+			}
+		}
+		names := make([]string, 0, len(val))
+		for name := range val {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			prop, ok := s.properties[name]
+			if !ok {
+				prop = s.additional
+			}
+			if prop == nil {
+				continue
+			}
+			if prop.never && !ok {
+				errs = append(errs, Error{Path: join(path, name), Message: "unknown field", Value: val[name], WriteOnly: writeOnly})
+				continue
+			}
+			errs = append(errs, prop.validate(val[name], join(path, name), writeOnly)...)
+		}
+	}
+	return errs
+}
+
+// hasType reports whether v is one of s's types
+func (s *Schema) hasType(v interface{}) bool {
+	for _, t := range s.types {
+		switch val := v.(type) {
+		case nil:
+			if t == "null" {
+				return true
+			}
+		case bool:
+			if t == "boolean" {
+				return true
+			}
+		case string:
+			if t == "string" {
+				return true
+			}
+		case float64:
+			if t == "number" || t == "integer" && val == math.Trunc(val) && !math.IsInf(val, 0) {
+				return true
+			}
+		case []interface{}:
+			if t == "array" {
+				return true
+			}
+		case map[string]interface{}:
+			if t == "object" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// typeList names types for an error message: "a string or null"
+func typeList(types []string) string {
+	names := make([]string, len(types))
+	for i, t := range types {
+		switch t {
+		case "null":
+			names[i] = "null"
+		case "boolean":
+			names[i] = "true or false"
+		case "integer", "array", "object":
+			names[i] = "an " + t
+		default:
+			names[i] = "a " + t
+		}
+	}
+	if len(names) == 1 {
+		return names[0]
+	}
+	return strings.Join(names[:len(names)-1], ", ") + " or " + names[len(names)-1]
+}
+
+// valueList formats values as JSON, separated by commas
+func valueList(values []interface{}) string {
+	parts := make([]string, len(values))
+	for i, v := range values {
+		data, _ := json.Marshal(v)
+		parts[i] = string(data)
+	}
+	return strings.Join(parts, ", ")
+}
+
+func formatNumber(n float64) string {
+	return strconv.FormatFloat(n, 'f', -1, 64)
+}
+
+func join(path, name string) string {
+	if path == "" {
+		return name
+	}
+	return path + "." + name
+}
+
+func contains(values []interface{}, v interface{}) bool {
+	for _, candidate := range values {
+		if equal(candidate, v) {
+			return true
+		}
+	}
+	return false
+}
+
+// equal compares decoded JSON values
+func equal(a, b interface{}) bool {
+	switch av := a.(type) {
+	case []interface{}:
+		bv, ok := b.([]interface{})
+		if !ok || len(av) != len(bv) {
+			return false
+		}
+		for i := range av {
+			if !equal(av[i], bv[i]) {
+				return false
+			}
+		}
+		return true
+	case map[string]interface{}:
+		bv, ok := b.(map[string]interface{})
+		if !ok || len(av) != len(bv) {
+			return false
+		}
+		for k, v := range av {
+			if w, ok := bv[k]; !ok || !equal(v, w) {
+				return false
+			}
+		}
+		return true
+	default:
+		return a == b
+	}
+}
@@ -0,0 +1,645 @@
+// Package kafka is a minimal Kafka client, enough to consume topic
+// partitions, produce to others and keep a consumer group's committed
+// offsets. It does not join the group: offsets are committed without a
+// generation, so only one consumer may use a group at a time. Brokers are
+// reached over TCP or TLS, optionally authenticating with SASL PLAIN or
+// SCRAM. Only uncompressed and gzip record batches can be read; produced
+// batches are uncompressed.
+package kafka
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Special offsets for ListOffsets
+const (
+	Latest   int64 = -1
+	Earliest int64 = -2
+)
+
+// maxResponse bounds a response from a broker
+const maxResponse = 128 << 20
+
+// Config says how to reach a cluster
+type Config struct {
+	Brokers  []string // Bootstrap host:port addresses
+	ClientID string
+	TLS      *tls.Config // Nil for plaintext
+	SASL     *SASL       // Nil for no authentication
+	Timeout  time.Duration
+}
+
+// Client sends requests to the brokers of a cluster. It is safe for
+// concurrent use; requests to one broker are sent one at a time.
+type Client struct {
+	config Config
+
+	mu           sync.Mutex
+	conns        map[string]*brokerConn
+	brokers      map[int32]string
+	topics       map[string][]PartitionInfo
+	coordinators map[string]string
+}
+
+// PartitionInfo is a partition and its leader
+type PartitionInfo struct {
+	ID     int32
+	Leader int32
+}
+
+// NewClient returns a client for a cluster. It connects when first used.
+func NewClient(config Config) *Client {
+	if config.Timeout <= 0 {
+		config.Timeout = 10 * time.Second
+	}
+	if config.ClientID == "" {
+		config.ClientID = "tokenshield"
+	}
+	return &Client{
+		config:       config,
+		conns:        make(map[string]*brokerConn),
+		brokers:      make(map[int32]string),
+		topics:       make(map[string][]PartitionInfo),
+		coordinators: make(map[string]string),
+	}
+}
+
+// Close closes the connections to the brokers
+func (c *Client) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for addr, bc := range c.conns {
+		bc.close()
+		delete(c.conns, addr)
+	}
+	return nil
+}
+
+// RefreshMetadata fetches the brokers and the partition leaders of topics
+func (c *Client) RefreshMetadata(topics ...string) error {
+	var e encoder
+	e.arrayLen(len(topics))
+	for _, t := range topics {
+		e.string(t)
+	}
+	var lastErr error
+	for _, addr := range c.bootstrap() {
+		resp, err := c.roundTrip(addr, apiMetadata, versionMetadata, e.buf, 0)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		return c.parseMetadata(resp, topics)
+	}
+	if lastErr == nil {
+		lastErr = errors.New("kafka: no brokers configured")
+	}
+	return lastErr
+}
+
+// bootstrap returns the configured brokers followed by the known ones
+func (c *Client) bootstrap() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	addrs := append([]string(nil), c.config.Brokers...)
+	for _, addr := range c.brokers {
+		addrs = append(addrs, addr)
+	}
+	return addrs
+}
+
+func (c *Client) parseMetadata(resp []byte, requested []string) error {
+	d := decoder{buf: resp}
+	brokers := make(map[int32]string)
+	for n := d.arrayLen(); n > 0; n-- {
+		id := d.int32()
+		host := d.string()
+		port := d.int32()
+		d.string() // Rack
+		brokers[id] = net.JoinHostPort(host, strconv.Itoa(int(port)))
+	}
+	d.int32() // Controller
+	topics := make(map[string][]PartitionInfo)
+	var topicErr error
+	for n := d.arrayLen(); n > 0; n-- {
+		code := d.int16()
+		name := d.string()
+		d.int8() // Internal
+		var partitions []PartitionInfo
+		for p := d.arrayLen(); p > 0; p-- {
+			d.int16() // Partition error: a missing leader shows as -1
+			id := d.int32()
+			leader := d.int32()
+			for r := d.arrayLen(); r > 0; r-- {
+				d.int32()
+			}
+			for r := d.arrayLen(); r > 0; r-- {
+				d.int32()
+			}
+			partitions = append(partitions, PartitionInfo{ID: id, Leader: leader})
+		}
+		if err := errorCode(code); err != nil {
+			if topicErr == nil {
+				topicErr = fmt.Errorf("topic %s: %w", name, err)
+			}
+			continue
+		}
+		topics[name] = partitions
+	}
+	if d.err != nil {
+		return d.err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for id, addr := range brokers {
+		c.brokers[id] = addr
+	}
+	for name, partitions := range topics {
+		c.topics[name] = partitions
+	}
+	if topicErr != nil {
+		return topicErr
+	}
+	for _, name := range requested {
+		if _, ok := topics[name]; !ok {
+			return fmt.Errorf("topic %s: %w", name, ErrUnknownTopicPartition)
+		}
+	}
+	return nil
+}
+
+// Partitions returns a topic's partitions, fetching its metadata if it is
+// not yet known
+func (c *Client) Partitions(topic string) ([]PartitionInfo, error) {
+	c.mu.Lock()
+	partitions, ok := c.topics[topic]
+	c.mu.Unlock()
+	if ok {
+		return partitions, nil
+	}
+	if err := c.RefreshMetadata(topic); err != nil {
+		return nil, err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.topics[topic], nil
+}
+
+// leader returns the address of the broker leading a partition
+func (c *Client) leader(topic string, partition int32) (string, error) {
+	partitions, err := c.Partitions(topic)
+	if err != nil {
+		return "", err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, p := range partitions {
+		if p.ID == partition {
+			if addr, ok := c.brokers[p.Leader]; ok {
+				return addr, nil
+			}
+			return "", fmt.Errorf("%s/%d: %w", topic, partition, ErrLeaderNotAvailable)
+		}
+	}
+	return "", fmt.Errorf("%s/%d: %w", topic, partition, ErrUnknownTopicPartition)
+}
+
+// Broker returns a broker's address
+func (c *Client) Broker(id int32) (string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	addr, ok := c.brokers[id]
+	return addr, ok
+}
+
+// forget drops cached metadata after a broker says it is stale
+func (c *Client) forget(topic string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.topics, topic)
+}
+
+// staleMetadata reports whether an error means the leader has moved
+func staleMetadata(err error) bool {
+	return errors.Is(err, ErrNotLeader) || errors.Is(err, ErrLeaderNotAvailable) ||
+		errors.Is(err, ErrUnknownTopicPartition)
+}
+
+// FetchPartition is a partition to fetch and the offset to fetch from
+type FetchPartition struct {
+	Topic     string
+	Partition int32
+	Offset    int64
+}
+
+// FetchResult is what a fetch returned for one partition. Next is the
+// offset to fetch from afterwards.
+type FetchResult struct {
+	Topic         string
+	Partition     int32
+	Records       []Record
+	Next          int64
+	HighWatermark int64
+	Err           error
+}
+
+// Fetch reads committed records from partitions led by one broker, waiting
+// up to maxWait for any to arrive. Partition errors are returned in the
+// results; Err is also set when a batch cannot be decoded.
+func (c *Client) Fetch(addr string, partitions []FetchPartition, maxWait time.Duration, maxBytes int32) ([]FetchResult, error) {
+	byTopic := make(map[string][]FetchPartition)
+	var order []string
+	for _, p := range partitions {
+		if _, ok := byTopic[p.Topic]; !ok {
+			order = append(order, p.Topic)
+		}
+		byTopic[p.Topic] = append(byTopic[p.Topic], p)
+	}
+	var e encoder
+	e.int32(-1) // Replica ID
+	e.int32(int32(maxWait / time.Millisecond))
+	e.int32(1) // Min bytes
+	e.int32(maxBytes)
+	e.int8(1) // Read committed
+	e.arrayLen(len(order))
+	for _, topic := range order {
+		e.string(topic)
+		e.arrayLen(len(byTopic[topic]))
+		for _, p := range byTopic[topic] {
+			e.int32(p.Partition)
+			e.int64(p.Offset)
+			e.int32(maxBytes)
+		}
+	}
+	resp, err := c.roundTrip(addr, apiFetch, versionFetch, e.buf, maxWait)
+	if err != nil {
+		return nil, err
+	}
+
+	offsets := make(map[string]map[int32]int64)
+	for _, p := range partitions {
+		if offsets[p.Topic] == nil {
+			offsets[p.Topic] = make(map[int32]int64)
+		}
+		offsets[p.Topic][p.Partition] = p.Offset
+	}
+	d := decoder{buf: resp}
+	d.int32() // Throttle time
+	var results []FetchResult
+	for n := d.arrayLen(); n > 0; n-- {
+		topic := d.string()
+		for p := d.arrayLen(); p > 0; p-- {
+			r := FetchResult{Topic: topic, Partition: d.int32()}
+			code := d.int16()
+			r.HighWatermark = d.int64()
+			d.int64() // Last stable offset
+			var aborted []AbortedTransaction
+			for a := d.arrayLen(); a > 0; a-- {
+				aborted = append(aborted, AbortedTransaction{ProducerID: d.int64(), FirstOffset: d.int64()})
+			}
+			data := d.bytes()
+			if d.err != nil {
+				return nil, d.err
+			}
+			from := offsets[topic][r.Partition]
+			r.Next = from
+			if r.Err = errorCode(code); r.Err == nil {
+				r.Records, r.Next, r.Err = DecodeRecords(data, from, aborted)
+			} else if staleMetadata(r.Err) {
+				c.forget(topic)
+			}
+			results = append(results, r)
+		}
+	}
+	return results, d.err
+}
+
+// Produce appends records to a partition and waits for all in-sync
+// replicas to have them
+func (c *Client) Produce(topic string, partition int32, records []Record) error {
+	addr, err := c.leader(topic, partition)
+	if err != nil {
+		return err
+	}
+	var e encoder
+	e.nullableString("") // Transactional ID
+	e.int16(-1)          // Acks: all in-sync replicas
+	e.int32(int32(c.config.Timeout / time.Millisecond))
+	e.arrayLen(1)
+	e.string(topic)
+	e.arrayLen(1)
+	e.int32(partition)
+	e.bytes(EncodeRecords(records))
+	resp, err := c.roundTrip(addr, apiProduce, versionProduce, e.buf, 0)
+	if err != nil {
+		return err
+	}
+	d := decoder{buf: resp}
+	for n := d.arrayLen(); n > 0; n-- {
+		d.string()
+		for p := d.arrayLen(); p > 0; p-- {
+			d.int32()
+			code := d.int16()
+			d.int64() // Base offset
+			d.int64() // Log append time
+			if err := errorCode(code); err != nil {
+				if staleMetadata(err) {
+					c.forget(topic)
+				}
+				return fmt.Errorf("producing to %s/%d: %w", topic, partition, err)
+			}
+		}
+	}
+	return d.err
+}
+
+// ListOffset returns the offset of a partition's first record (Earliest)
+// or the offset the next record will get (Latest)
+func (c *Client) ListOffset(topic string, partition int32, at int64) (int64, error) {
+	addr, err := c.leader(topic, partition)
+	if err != nil {
+		return 0, err
+	}
+	var e encoder
+	e.int32(-1) // Replica ID
+	e.arrayLen(1)
+	e.string(topic)
+	e.arrayLen(1)
+	e.int32(partition)
+	e.int64(at)
+	resp, err := c.roundTrip(addr, apiListOffsets, versionListOffsets, e.buf, 0)
+	if err != nil {
+		return 0, err
+	}
+	d := decoder{buf: resp}
+	offset := int64(-1)
+	for n := d.arrayLen(); n > 0; n-- {
+		d.string()
+		for p := d.arrayLen(); p > 0; p-- {
+			d.int32()
+			code := d.int16()
+			d.int64() // Timestamp
+			offset = d.int64()
+			if err := errorCode(code); err != nil {
+				if staleMetadata(err) {
+					c.forget(topic)
+				}
+				return 0, fmt.Errorf("listing offsets of %s/%d: %w", topic, partition, err)
+			}
+		}
+	}
+	if d.err == nil && offset < 0 {
+		return 0, fmt.Errorf("listing offsets of %s/%d: no offset returned", topic, partition)
+	}
+	return offset, d.err
+}
+
+// coordinator returns the address of the broker coordinating a group
+func (c *Client) coordinator(group string) (string, error) {
+	c.mu.Lock()
+	addr, ok := c.coordinators[group]
+	c.mu.Unlock()
+	if ok {
+		return addr, nil
+	}
+	var e encoder
+	e.string(group)
+	e.int8(0) // Group key
+	var lastErr error
+	for _, broker := range c.bootstrap() {
+		resp, err := c.roundTrip(broker, apiFindCoordinator, versionFindCoordinator, e.buf, 0)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		d := decoder{buf: resp}
+		d.int32() // Throttle time
+		code := d.int16()
+		d.string() // Error message
+		d.int32()  // Node ID
+		host := d.string()
+		port := d.int32()
+		if d.err != nil {
+			return "", d.err
+		}
+		if err := errorCode(code); err != nil {
+			return "", fmt.Errorf("finding the coordinator of group %s: %w", group, err)
+		}
+		addr = net.JoinHostPort(host, strconv.Itoa(int(port)))
+		c.mu.Lock()
+		c.coordinators[group] = addr
+		c.mu.Unlock()
+		return addr, nil
+	}
+	if lastErr == nil {
+		lastErr = errors.New("kafka: no brokers configured")
+	}
+	return "", lastErr
+}
+
+// groupError forgets a group's coordinator when it has moved
+func (c *Client) groupError(group string, err error) error {
+	if errors.Is(err, ErrNotCoordinator) || errors.Is(err, ErrCoordinatorNotAvail) {
+		c.mu.Lock()
+		delete(c.coordinators, group)
+		c.mu.Unlock()
+	}
+	return err
+}
+
+// CommittedOffsets returns a group's committed offsets for a topic's
+// partitions; partitions without one are left out
+func (c *Client) CommittedOffsets(group, topic string, partitions []int32) (map[int32]int64, error) {
+	addr, err := c.coordinator(group)
+	if err != nil {
+		return nil, err
+	}
+	var e encoder
+	e.string(group)
+	e.arrayLen(1)
+	e.string(topic)
+	e.arrayLen(len(partitions))
+	for _, p := range partitions {
+		e.int32(p)
+	}
+	resp, err := c.roundTrip(addr, apiOffsetFetch, versionOffsetFetch, e.buf, 0)
+	if err != nil {
+		return nil, err
+	}
+	d := decoder{buf: resp}
+	offsets := make(map[int32]int64)
+	for n := d.arrayLen(); n > 0; n-- {
+		d.string()
+		for p := d.arrayLen(); p > 0; p-- {
+			partition := d.int32()
+			offset := d.int64()
+			d.string() // Metadata
+			if err := errorCode(d.int16()); err != nil {
+				return nil, c.groupError(group, fmt.Errorf("fetching offsets of group %s: %w", group, err))
+			}
+			if offset >= 0 {
+				offsets[partition] = offset
+			}
+		}
+	}
+	return offsets, d.err
+}
+
+// CommitOffsets commits a group's offsets for a topic's partitions: the
+// offsets of the next records to consume
+func (c *Client) CommitOffsets(group, topic string, offsets map[int32]int64) error {
+	addr, err := c.coordinator(group)
+	if err != nil {
+		return err
+	}
+	var e encoder
+	e.string(group)
+	e.int32(-1)  // Generation: not a group member
+	e.string("") // Member ID
+	e.int64(-1)  // Retention: the broker's default
+	e.arrayLen(1)
+	e.string(topic)
+	e.arrayLen(len(offsets))
+	for partition, offset := range offsets {
+		e.int32(partition)
+		e.int64(offset)
+		e.nullableString("")
+	}
+	resp, err := c.roundTrip(addr, apiOffsetCommit, versionOffsetCommit, e.buf, 0)
+	if err != nil {
+		return err
+	}
+	d := decoder{buf: resp}
+	for n := d.arrayLen(); n > 0; n-- {
+		d.string()
+		for p := d.arrayLen(); p > 0; p-- {
+			d.int32()
+			if err := errorCode(d.int16()); err != nil {
+				return c.groupError(group, fmt.Errorf("committing offsets of group %s: %w", group, err))
+			}
+		}
+	}
+	return d.err
+}
+
+// brokerConn is a connection to one broker
+type brokerConn struct {
+	mu            sync.Mutex
+	conn          net.Conn
+	r             *bufio.Reader
+	correlationID int32
+	broken        bool
+}
+
+func (bc *brokerConn) close() {
+	bc.broken = true
+	bc.conn.Close()
+}
+
+// roundTrip sends a request to a broker and returns the response body,
+// after the correlation ID. extra lengthens the timeout for requests the
+// broker holds, like fetches.
+func (c *Client) roundTrip(addr string, apiKey, version int16, body []byte, extra time.Duration) ([]byte, error) {
+	bc, err := c.conn(addr)
+	if err != nil {
+		return nil, err
+	}
+	bc.mu.Lock()
+	defer bc.mu.Unlock()
+	resp, err := bc.send(c.config.ClientID, apiKey, version, body, c.config.Timeout+extra)
+	if err != nil {
+		bc.close()
+		c.mu.Lock()
+		if c.conns[addr] == bc {
+			delete(c.conns, addr)
+		}
+		c.mu.Unlock()
+		return nil, fmt.Errorf("kafka: %s: %w", addr, err)
+	}
+	return resp, nil
+}
+
+func (bc *brokerConn) send(clientID string, apiKey, version int16, body []byte, timeout time.Duration) ([]byte, error) {
+	if bc.broken {
+		return nil, errors.New("connection closed")
+	}
+	bc.correlationID++
+	var e encoder
+	e.int32(0) // Size, filled in below
+	e.int16(apiKey)
+	e.int16(version)
+	e.int32(bc.correlationID)
+	e.string(clientID)
+	e.buf = append(e.buf, body...)
+	binary.BigEndian.PutUint32(e.buf, uint32(len(e.buf)-4))
+
+	bc.conn.SetDeadline(time.Now().Add(timeout))
+	if _, err := bc.conn.Write(e.buf); err != nil {
+		return nil, err
+	}
+	var header [8]byte
+	if _, err := io.ReadFull(bc.r, header[:]); err != nil {
+		return nil, err
+	}
+	size := int32(binary.BigEndian.Uint32(header[:]))
+	if size < 4 || size > maxResponse {
+		return nil, fmt.Errorf("response of %d bytes", size)
+	}
+	if id := int32(binary.BigEndian.Uint32(header[4:])); id != bc.correlationID {
+		return nil, fmt.Errorf("response %d does not match request %d", id, bc.correlationID)
+	}
+	resp := make([]byte, size-4)
+	if _, err := io.ReadFull(bc.r, resp); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+// conn returns the connection to a broker, dialing and authenticating if
+// there is none
+func (c *Client) conn(addr string) (*brokerConn, error) {
+	c.mu.Lock()
+	bc, ok := c.conns[addr]
+	c.mu.Unlock()
+	if ok {
+		return bc, nil
+	}
+
+	dialer := &net.Dialer{Timeout: c.config.Timeout, KeepAlive: 30 * time.Second}
+	var conn net.Conn
+	var err error
+	if c.config.TLS != nil {
+		conn, err = tls.DialWithDialer(dialer, "tcp", addr, c.config.TLS)
+	} else {
+		conn, err = dialer.Dial("tcp", addr)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("kafka: %w", err)
+	}
+	bc = &brokerConn{conn: conn, r: bufio.NewReader(conn)}
+	if c.config.SASL != nil {
+		if err := c.config.SASL.authenticate(bc, c.config.ClientID, c.config.Timeout); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("kafka: %s: %w", addr, err)
+		}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if existing, ok := c.conns[addr]; ok {
+		conn.Close()
+		return existing, nil
+	}
+	c.conns[addr] = bc
+	return bc, nil
+}
@@ -0,0 +1,202 @@
+package kafka
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// API keys and the versions used. All are non-flexible versions brokers
+// from 2.1 through 4.x accept.
+const (
+	apiProduce          = 0
+	apiFetch            = 1
+	apiListOffsets      = 2
+	apiMetadata         = 3
+	apiOffsetCommit     = 8
+	apiOffsetFetch      = 9
+	apiFindCoordinator  = 10
+	apiSaslHandshake    = 17
+	apiSaslAuthenticate = 36
+
+	versionProduce          = 3
+	versionFetch            = 4
+	versionListOffsets      = 1
+	versionMetadata         = 1
+	versionOffsetCommit     = 2
+	versionOffsetFetch      = 1
+	versionFindCoordinator  = 1
+	versionSaslHandshake    = 1
+	versionSaslAuthenticate = 0
+)
+
+// Error is an error code returned by a broker
+type Error int16
+
+// Error codes the client acts on
+const (
+	ErrOffsetOutOfRange      Error = 1
+	ErrUnknownTopicPartition Error = 3
+	ErrLeaderNotAvailable    Error = 5
+	ErrNotLeader             Error = 6
+	ErrRequestTimedOut       Error = 7
+	ErrCoordinatorLoading    Error = 14
+	ErrCoordinatorNotAvail   Error = 15
+	ErrNotCoordinator        Error = 16
+	ErrTopicAuthorization    Error = 29
+	ErrGroupAuthorization    Error = 30
+	ErrSASLAuthentication    Error = 58
+)
+
+var errorNames = map[Error]string{
+	ErrOffsetOutOfRange:      "OFFSET_OUT_OF_RANGE",
+	2:                        "CORRUPT_MESSAGE",
+	ErrUnknownTopicPartition: "UNKNOWN_TOPIC_OR_PARTITION",
+	ErrLeaderNotAvailable:    "LEADER_NOT_AVAILABLE",
+	ErrNotLeader:             "NOT_LEADER_OR_FOLLOWER",
+	ErrRequestTimedOut:       "REQUEST_TIMED_OUT",
+	10:                       "MESSAGE_TOO_LARGE",
+	ErrCoordinatorLoading:    "COORDINATOR_LOAD_IN_PROGRESS",
+	ErrCoordinatorNotAvail:   "COORDINATOR_NOT_AVAILABLE",
+	ErrNotCoordinator:        "NOT_COORDINATOR",
+	19:                       "NOT_ENOUGH_REPLICAS",
+	20:                       "NOT_ENOUGH_REPLICAS_AFTER_APPEND",
+	22:                       "ILLEGAL_GENERATION",
+	25:                       "UNKNOWN_MEMBER_ID",
+	ErrTopicAuthorization:    "TOPIC_AUTHORIZATION_FAILED",
+	ErrGroupAuthorization:    "GROUP_AUTHORIZATION_FAILED",
+	33:                       "UNSUPPORTED_SASL_MECHANISM",
+	35:                       "UNSUPPORTED_VERSION",
+	ErrSASLAuthentication:    "SASL_AUTHENTICATION_FAILED",
+}
+
+func (e Error) Error() string {
+	if name, ok := errorNames[e]; ok {
+		return fmt.Sprintf("kafka: %s (error %d)", name, int16(e))
+	}
+	return fmt.Sprintf("kafka: error %d", int16(e))
+}
+
+// errorCode returns the error for a response error code, nil for none
+func errorCode(code int16) error {
+	if code == 0 {
+		return nil
+	}
+	return Error(code)
+}
+
+// encoder builds a request body
+type encoder struct {
+	buf []byte
+}
+
+func (e *encoder) int8(v int8)   { e.buf = append(e.buf, byte(v)) }
+func (e *encoder) int16(v int16) { e.buf = binary.BigEndian.AppendUint16(e.buf, uint16(v)) }
+func (e *encoder) int32(v int32) { e.buf = binary.BigEndian.AppendUint32(e.buf, uint32(v)) }
+func (e *encoder) int64(v int64) { e.buf = binary.BigEndian.AppendUint64(e.buf, uint64(v)) }
+
+func (e *encoder) string(s string) {
+	e.int16(int16(len(s)))
+	e.buf = append(e.buf, s...)
+}
+
+// nullableString writes -1 for the empty string
+func (e *encoder) nullableString(s string) {
+	if s == "" {
+		e.int16(-1)
+		return
+	}
+	e.string(s)
+}
+
+func (e *encoder) bytes(b []byte) {
+	if b == nil {
+		e.int32(-1)
+		return
+	}
+	e.int32(int32(len(b)))
+	e.buf = append(e.buf, b...)
+}
+
+func (e *encoder) arrayLen(n int) { e.int32(int32(n)) }
+
+// decoder reads a response body, remembering the first error
+type decoder struct {
+	buf []byte
+	err error
+}
+
+var errShort = errors.New("kafka: response too short")
+
+func (d *decoder) take(n int) []byte {
+	if d.err != nil {
+		return nil
+	}
+	if n < 0 || n > len(d.buf) {
+		d.err = errShort
+		d.buf = nil
+		return nil
+	}
+	b := d.buf[:n]
+	d.buf = d.buf[n:]
+	return b
+}
+
+func (d *decoder) int8() int8 {
+	if b := d.take(1); b != nil {
+		return int8(b[0])
+	}
+	return 0
+}
+
+func (d *decoder) int16() int16 {
+	if b := d.take(2); b != nil {
+		return int16(binary.BigEndian.Uint16(b))
+	}
+	return 0
+}
+
+func (d *decoder) int32() int32 {
+	if b := d.take(4); b != nil {
+		return int32(binary.BigEndian.Uint32(b))
+	}
+	return 0
+}
+
+func (d *decoder) int64() int64 {
+	if b := d.take(8); b != nil {
+		return int64(binary.BigEndian.Uint64(b))
+	}
+	return 0
+}
+
+func (d *decoder) string() string {
+	n := d.int16()
+	if n < 0 {
+		return ""
+	}
+	return string(d.take(int(n)))
+}
+
+func (d *decoder) bytes() []byte {
+	n := d.int32()
+	if n < 0 {
+		return nil
+	}
+	return d.take(int(n))
+}
+
+// arrayLen returns an array's length, treating null as empty and
+// rejecting lengths the remaining bytes cannot hold
+func (d *decoder) arrayLen() int {
+	n := d.int32()
+	if n < 0 {
+		return 0
+	}
+	if int(n) > len(d.buf) {
+		d.err = errShort
+		d.buf = nil
+		return 0
+	}
+	return int(n)
+}
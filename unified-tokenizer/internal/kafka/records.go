@@ -0,0 +1,286 @@
+package kafka
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"sort"
+	"time"
+)
+
+// Record is a message in a topic partition
+type Record struct {
+	Offset    int64
+	Key       []byte // nil when the record has no key
+	Value     []byte // nil for a tombstone
+	Headers   []Header
+	Timestamp time.Time
+}
+
+// Header is a record header
+type Header struct {
+	Key   string
+	Value []byte
+}
+
+// Record batch attributes
+const (
+	compressionMask = 0x07
+	compressionNone = 0
+	compressionGzip = 1
+	transactional   = 0x10
+	controlBatch    = 0x20
+	batchHeaderSize = 61 // From baseOffset through the record count
+	magicV2         = 2
+)
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// maxDecompressed bounds a decompressed batch
+const maxDecompressed = 64 << 20
+
+// AbortedTransaction is a transaction a fetch response says was aborted
+type AbortedTransaction struct {
+	ProducerID  int64
+	FirstOffset int64
+}
+
+// DecodeRecords decodes the record batches in a fetch response's record
+// set, skipping control batches, the batches of aborted transactions and
+// records before from. A batch cut off at the end of the set, which brokers
+// send when it exceeds the fetch size, is ignored. next is the offset to
+// fetch from afterwards; it moves past skipped batches too.
+func DecodeRecords(data []byte, from int64, aborted []AbortedTransaction) (records []Record, next int64, err error) {
+	next = from
+	sort.Slice(aborted, func(i, j int) bool { return aborted[i].FirstOffset < aborted[j].FirstOffset })
+	abortedProducers := make(map[int64]bool)
+	for len(data) >= 17 {
+		baseOffset := int64(binary.BigEndian.Uint64(data))
+		length := int(int32(binary.BigEndian.Uint32(data[8:])))
+		if length < batchHeaderSize-12 || 12+length > len(data) {
+			break
+		}
+		batch := data[:12+length]
+		data = data[12+length:]
+		if magic := batch[16]; magic != magicV2 {
+			return nil, next, fmt.Errorf("kafka: message format v%d is not supported", magic)
+		}
+		if crc32.Checksum(batch[21:], castagnoli) != binary.BigEndian.Uint32(batch[17:]) {
+			return nil, next, fmt.Errorf("kafka: corrupt record batch at offset %d", baseOffset)
+		}
+		attributes := binary.BigEndian.Uint16(batch[21:])
+		lastOffset := baseOffset + int64(int32(binary.BigEndian.Uint32(batch[23:])))
+		producerID := int64(binary.BigEndian.Uint64(batch[43:]))
+		for len(aborted) > 0 && aborted[0].FirstOffset <= lastOffset {
+			abortedProducers[aborted[0].ProducerID] = true
+			aborted = aborted[1:]
+		}
+		skip := attributes&controlBatch != 0 || attributes&transactional != 0 && abortedProducers[producerID]
+		if attributes&controlBatch != 0 {
+			// The transaction's end marker
+			delete(abortedProducers, producerID)
+		}
+		if lastOffset < from {
+			continue
+		}
+		if skip {
+			next = lastOffset + 1
+			continue
+		}
+		baseTimestamp := int64(binary.BigEndian.Uint64(batch[27:]))
+		count := int(int32(binary.BigEndian.Uint32(batch[57:])))
+		body := batch[batchHeaderSize:]
+		switch attributes & compressionMask {
+		case compressionNone:
+		case compressionGzip:
+			zr, err := gzip.NewReader(bytes.NewReader(body))
+			if err != nil {
+				return nil, next, fmt.Errorf("kafka: record batch at offset %d: %v", baseOffset, err)
+			}
+			body, err = io.ReadAll(io.LimitReader(zr, maxDecompressed+1))
+			if err != nil {
+				return nil, next, fmt.Errorf("kafka: record batch at offset %d: %v", baseOffset, err)
+			}
+			if len(body) > maxDecompressed {
+				return nil, next, fmt.Errorf("kafka: record batch at offset %d is too large", baseOffset)
+			}
+		default:
+			return nil, next, fmt.Errorf("kafka: record batch at offset %d uses compression codec %d; only gzip is supported",
+				baseOffset, attributes&compressionMask)
+		}
+
+		r := varintReader{buf: body}
+		for i := 0; i < count; i++ {
+			rec := r.record(baseOffset, baseTimestamp)
+			if r.err != nil {
+				return nil, next, fmt.Errorf("kafka: record batch at offset %d: %v", baseOffset, r.err)
+			}
+			if rec.Offset >= from {
+				records = append(records, rec)
+			}
+		}
+		next = lastOffset + 1
+	}
+	return records, next, nil
+}
+
+// EncodeRecords encodes records as one uncompressed batch, numbered from 0
+func EncodeRecords(records []Record) []byte {
+	var body []byte
+	var base, max time.Time
+	if len(records) > 0 {
+		base = records[0].Timestamp
+	}
+	for i, rec := range records {
+		if rec.Timestamp.After(max) {
+			max = rec.Timestamp
+		}
+		var r []byte
+		r = append(r, 0) // Attributes
+		r = binary.AppendVarint(r, rec.Timestamp.UnixMilli()-base.UnixMilli())
+		r = binary.AppendVarint(r, int64(i))
+		r = appendVarBytes(r, rec.Key)
+		r = appendVarBytes(r, rec.Value)
+		r = binary.AppendVarint(r, int64(len(rec.Headers)))
+		for _, h := range rec.Headers {
+			r = appendVarBytes(r, []byte(h.Key))
+			r = appendVarBytes(r, h.Value)
+		}
+		body = binary.AppendVarint(body, int64(len(r)))
+		body = append(body, r...)
+	}
+
+	b := make([]byte, 0, batchHeaderSize+len(body))
+	b = binary.BigEndian.AppendUint64(b, 0)                                    // Base offset
+	b = binary.BigEndian.AppendUint32(b, uint32(batchHeaderSize-12+len(body))) // Length
+	b = binary.BigEndian.AppendUint32(b, 0)                                    // Partition leader epoch
+	b = append(b, magicV2)
+	b = binary.BigEndian.AppendUint32(b, 0) // CRC, filled in below
+	b = binary.BigEndian.AppendUint16(b, 0) // Attributes
+	b = binary.BigEndian.AppendUint32(b, uint32(len(records)-1))
+	b = binary.BigEndian.AppendUint64(b, uint64(base.UnixMilli()))
+	b = binary.BigEndian.AppendUint64(b, uint64(max.UnixMilli()))
+	b = binary.BigEndian.AppendUint64(b, ^uint64(0)) // Producer ID -1
+	b = binary.BigEndian.AppendUint16(b, ^uint16(0)) // Producer epoch -1
+	b = binary.BigEndian.AppendUint32(b, ^uint32(0)) // Base sequence -1
+	b = binary.BigEndian.AppendUint32(b, uint32(len(records)))
+	b = append(b, body...)
+	binary.BigEndian.PutUint32(b[17:], crc32.Checksum(b[21:], castagnoli))
+	return b
+}
+
+func appendVarBytes(b, v []byte) []byte {
+	if v == nil {
+		return binary.AppendVarint(b, -1)
+	}
+	return append(binary.AppendVarint(b, int64(len(v))), v...)
+}
+
+// varintReader reads the records in a batch
+type varintReader struct {
+	buf []byte
+	err error
+}
+
+var errBadRecord = errors.New("malformed record")
+
+func (r *varintReader) varint() int64 {
+	if r.err != nil {
+		return 0
+	}
+	v, n := binary.Varint(r.buf)
+	if n <= 0 {
+		r.err = errBadRecord
+		return 0
+	}
+	r.buf = r.buf[n:]
+	return v
+}
+
+func (r *varintReader) bytes() []byte {
+	n := r.varint()
+	if r.err != nil || n < 0 {
+		return nil
+	}
+	if n > int64(len(r.buf)) {
+		r.err = errBadRecord
+		return nil
+	}
+	b := r.buf[:n:n]
+	r.buf = r.buf[n:]
+	return b
+}
+
+func (r *varintReader) record(baseOffset, baseTimestamp int64) Record {
+	length := r.varint()
+	if r.err != nil || length < 0 || length > int64(len(r.buf)) {
+		r.err = errBadRecord
+		return Record{}
+	}
+	rest := r.buf[length:]
+	r.buf = r.buf[:length]
+	if len(r.buf) == 0 {
+		r.err = errBadRecord
+		return Record{}
+	}
+	r.buf = r.buf[1:] // Attributes
+	var rec Record
+	rec.Timestamp = time.UnixMilli(baseTimestamp + r.varint())
+	rec.Offset = baseOffset + r.varint()
+	rec.Key = r.bytes()
+	rec.Value = r.bytes()
+	headers := r.varint()
+	if headers < 0 || headers > int64(len(r.buf)) {
+		r.err = errBadRecord
+	}
+	for i := int64(0); i < headers && r.err == nil; i++ {
+		key := r.bytes()
+		rec.Headers = append(rec.Headers, Header{Key: string(key), Value: r.bytes()})
+	}
+	r.buf = rest
+	return rec
+}
+
+// Partition returns the partition Kafka's default partitioner picks for a
+// key: murmur2 of the key, as the Java client computes it
+func Partition(key []byte, partitions int) int32 {
+	return int32(int(murmur2(key)&0x7fffffff) % partitions)
+}
+
+func murmur2(data []byte) uint32 {
+	const (
+		seed = 0x9747b28c
+		m    = 0x5bd1e995
+		r    = 24
+	)
+	length := len(data)
+	h := uint32(seed) ^ uint32(length)
+	for i := 0; i+4 <= length; i += 4 {
+		k := binary.LittleEndian.Uint32(data[i:])
+		k *= m
+		k ^= k >> r
+		k *= m
+		h *= m
+		h ^= k
+	}
+	tail := data[length&^3:]
+	switch len(tail) {
+	case 3:
+		h ^= uint32(tail[2]) << 16
+		fallthrough
+	case 2:
+		h ^= uint32(tail[1]) << 8
+		fallthrough
+	case 1:
+		h ^= uint32(tail[0])
+		h *= m
+	}
+	h ^= h >> 13
+	h *= m
+	h ^= h >> 15
+	return h
+}
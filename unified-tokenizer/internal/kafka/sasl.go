@@ -0,0 +1,162 @@
+package kafka
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"hash"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/pbkdf2"
+)
+
+// SASL mechanisms
+const (
+	PLAIN       = "PLAIN"
+	SCRAMSHA256 = "SCRAM-SHA-256"
+	SCRAMSHA512 = "SCRAM-SHA-512"
+)
+
+// SASL is the credentials to authenticate with
+type SASL struct {
+	Mechanism string
+	Username  string
+	Password  string
+}
+
+// Validate checks the mechanism is one the client speaks
+func (s *SASL) Validate() error {
+	switch s.Mechanism {
+	case PLAIN, SCRAMSHA256, SCRAMSHA512:
+	default:
+		return fmt.Errorf("unknown SASL mechanism %q: use PLAIN, SCRAM-SHA-256 or SCRAM-SHA-512", s.Mechanism)
+	}
+	if s.Username == "" {
+		return errors.New("a SASL username is required")
+	}
+	return nil
+}
+
+// authenticate runs the SASL exchange on a new connection
+func (s *SASL) authenticate(bc *brokerConn, clientID string, timeout time.Duration) error {
+	var e encoder
+	e.string(s.Mechanism)
+	resp, err := bc.send(clientID, apiSaslHandshake, versionSaslHandshake, e.buf, timeout)
+	if err != nil {
+		return err
+	}
+	d := decoder{buf: resp}
+	if err := errorCode(d.int16()); err != nil {
+		return fmt.Errorf("SASL handshake for %s: %w", s.Mechanism, err)
+	}
+	if d.err != nil {
+		return d.err
+	}
+
+	exchange := func(msg []byte) ([]byte, error) {
+		var e encoder
+		e.bytes(msg)
+		resp, err := bc.send(clientID, apiSaslAuthenticate, versionSaslAuthenticate, e.buf, timeout)
+		if err != nil {
+			return nil, err
+		}
+		d := decoder{buf: resp}
+		code := d.int16()
+		message := d.string()
+		data := d.bytes()
+		if err := errorCode(code); err != nil {
+			if message != "" {
+				return nil, fmt.Errorf("%w: %s", err, message)
+			}
+			return nil, err
+		}
+		return data, d.err
+	}
+
+	if s.Mechanism == PLAIN {
+		_, err := exchange([]byte("\x00" + s.Username + "\x00" + s.Password))
+		return err
+	}
+	newHash := sha256.New
+	if s.Mechanism == SCRAMSHA512 {
+		newHash = sha512.New
+	}
+	return scram(newHash, s.Username, s.Password, exchange)
+}
+
+// scram runs a SCRAM exchange (RFC 5802) without channel binding
+func scram(newHash func() hash.Hash, username, password string, exchange func([]byte) ([]byte, error)) error {
+	var raw [18]byte
+	if _, err := rand.Read(raw[:]); err != nil {
+		return err
+	}
+	nonce := base64.RawStdEncoding.EncodeToString(raw[:])
+	user := strings.NewReplacer("=", "=3D", ",", "=2C").Replace(username)
+	clientFirstBare := "n=" + user + ",r=" + nonce
+	serverFirst, err := exchange([]byte("n,," + clientFirstBare))
+	if err != nil {
+		return err
+	}
+
+	attrs := scramAttributes(string(serverFirst))
+	serverNonce, salt64, iter := attrs["r"], attrs["s"], attrs["i"]
+	if !strings.HasPrefix(serverNonce, nonce) || len(serverNonce) == len(nonce) {
+		return errors.New("SCRAM: server nonce does not extend the client's")
+	}
+	salt, err := base64.StdEncoding.DecodeString(salt64)
+	if err != nil {
+		return errors.New("SCRAM: invalid salt")
+	}
+	iterations, err := strconv.Atoi(iter)
+	if err != nil || iterations < 1 {
+		return errors.New("SCRAM: invalid iteration count")
+	}
+
+	mac := func(key []byte, msg string) []byte {
+		h := hmac.New(newHash, key)
+		h.Write([]byte(msg))
+		return h.Sum(nil)
+	}
+	salted := pbkdf2.Key([]byte(password), salt, iterations, newHash().Size(), newHash)
+	clientKey := mac(salted, "Client Key")
+	h := newHash()
+	h.Write(clientKey)
+	storedKey := h.Sum(nil)
+	clientFinalBare := "c=biws,r=" + serverNonce
+	authMessage := clientFirstBare + "," + string(serverFirst) + "," + clientFinalBare
+	proof := mac(storedKey, authMessage)
+	for i := range proof {
+		proof[i] ^= clientKey[i]
+	}
+
+	serverFinal, err := exchange([]byte(clientFinalBare + ",p=" + base64.StdEncoding.EncodeToString(proof)))
+	if err != nil {
+		return err
+	}
+	final := scramAttributes(string(serverFinal))
+	if e, ok := final["e"]; ok {
+		return fmt.Errorf("SCRAM: %s", e)
+	}
+	want := mac(mac(salted, "Server Key"), authMessage)
+	got, err := base64.StdEncoding.DecodeString(final["v"])
+	if err != nil || !hmac.Equal(got, want) {
+		return errors.New("SCRAM: server signature does not verify")
+	}
+	return nil
+}
+
+func scramAttributes(msg string) map[string]string {
+	attrs := make(map[string]string)
+	for _, part := range strings.Split(msg, ",") {
+		if k, v, ok := strings.Cut(part, "="); ok {
+			attrs[k] = v
+		}
+	}
+	return attrs
+}
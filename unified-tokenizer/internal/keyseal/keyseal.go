@@ -0,0 +1,184 @@
+package keyseal
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+)
+
+// Sealer wraps key-encryption keys so the encryption_keys table only ever
+// holds wrapped material. aad binds a sealed KEK to its key ID, so a wrapped
+// key copied onto another row does not unseal.
+type Sealer interface {
+	// Name is recorded in the key's metadata ("passphrase", "kms:aws", ...)
+	Name() string
+	Seal(kek, aad []byte) ([]byte, error)
+	Unseal(sealed, aad []byte) ([]byte, error)
+}
+
+// FromEnv returns the sealer configured by KEK_PASSPHRASE (or
+// KEK_PASSPHRASE_FILE), KMS_PROVIDER or PKCS11_MODULE, or nil when none is set
+func FromEnv() (Sealer, error) {
+	passphrase := os.Getenv("KEK_PASSPHRASE")
+	if file := os.Getenv("KEK_PASSPHRASE_FILE"); file != "" {
+		if passphrase != "" {
+			return nil, errors.New("set only one of KEK_PASSPHRASE and KEK_PASSPHRASE_FILE")
+		}
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return nil, fmt.Errorf("reading KEK_PASSPHRASE_FILE: %v", err)
+		}
+		passphrase = strings.TrimRight(string(data), "\r\n")
+	}
+	provider := os.Getenv("KMS_PROVIDER")
+	module := os.Getenv("PKCS11_MODULE")
+
+	configured := 0
+	for _, v := range []string{passphrase, provider, module} {
+		if v != "" {
+			configured++
+		}
+	}
+	switch {
+	case configured > 1:
+		return nil, errors.New("set only one of a KEK passphrase, KMS_PROVIDER and PKCS11_MODULE")
+	case passphrase != "":
+		return NewPassphrase(passphrase)
+	case provider != "":
+		return NewKMS(provider, os.Getenv("KMS_KEY_ID"), os.Getenv("KMS_REGION"))
+	case module != "":
+		cfg, err := PKCS11ConfigFromEnv()
+		if err != nil {
+			return nil, err
+		}
+		return NewPKCS11(cfg)
+	}
+	return nil, nil
+}
+
+// Argon2id parameters for passphrase sealing. They are identified by the
+// version byte of the sealed blob so they can be raised without breaking
+// existing keys.
+const (
+	passphraseV1      = 1
+	argonTime         = 3
+	argonMemory       = 64 * 1024 // KiB
+	argonThreads      = 4
+	saltSize          = 16
+	minPassphraseSize = 16
+)
+
+type passphraseSealer struct {
+	passphrase []byte
+}
+
+// NewPassphrase seals KEKs with AES-256-GCM under a key derived from the
+// passphrase with Argon2id and a per-key random salt
+func NewPassphrase(passphrase string) (Sealer, error) {
+	if len(passphrase) < minPassphraseSize {
+		return nil, fmt.Errorf("KEK passphrase must be at least %d characters", minPassphraseSize)
+	}
+	return &passphraseSealer{passphrase: []byte(passphrase)}, nil
+}
+
+func (p *passphraseSealer) Name() string { return "passphrase" }
+
+func (p *passphraseSealer) gcm(salt []byte) (cipher.AEAD, error) {
+	key := argon2.IDKey(p.passphrase, salt, argonTime, argonMemory, argonThreads, 32)
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// Seal returns version || salt || nonce || ciphertext
+func (p *passphraseSealer) Seal(kek, aad []byte) ([]byte, error) {
+	salt := make([]byte, saltSize)
+	if _, err := io.ReadFull(rand.Reader, salt); err != nil {
+		return nil, err
+	}
+	gcm, err := p.gcm(salt)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+
+	sealed := append([]byte{passphraseV1}, salt...)
+	sealed = append(sealed, nonce...)
+	return gcm.Seal(sealed, nonce, kek, aad), nil
+}
+
+func (p *passphraseSealer) Unseal(sealed, aad []byte) ([]byte, error) {
+	if len(sealed) < 1+saltSize || sealed[0] != passphraseV1 {
+		return nil, errors.New("unrecognised passphrase-sealed key format")
+	}
+	salt := sealed[1 : 1+saltSize]
+	gcm, err := p.gcm(salt)
+	if err != nil {
+		return nil, err
+	}
+	rest := sealed[1+saltSize:]
+	if len(rest) < gcm.NonceSize() {
+		return nil, errors.New("sealed key too short")
+	}
+	kek, err := gcm.Open(nil, rest[:gcm.NonceSize()], rest[gcm.NonceSize():], aad)
+	if err != nil {
+		return nil, errors.New("wrong KEK passphrase or corrupted key")
+	}
+	return kek, nil
+}
+
+type masterKeySealer struct {
+	gcm cipher.AEAD
+}
+
+// NewMasterKey seals KEKs with AES-256-GCM directly under a 32-byte key,
+// such as the one reconstructed from Shamir shares in sealed-boot mode
+func NewMasterKey(key []byte) (Sealer, error) {
+	if len(key) != 32 {
+		return nil, errors.New("master key must be 32 bytes")
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &masterKeySealer{gcm: gcm}, nil
+}
+
+func (m *masterKeySealer) Name() string { return "shamir" }
+
+// Seal returns nonce || ciphertext
+func (m *masterKeySealer) Seal(kek, aad []byte) ([]byte, error) {
+	nonce := make([]byte, m.gcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	return m.gcm.Seal(nonce, nonce, kek, aad), nil
+}
+
+func (m *masterKeySealer) Unseal(sealed, aad []byte) ([]byte, error) {
+	if len(sealed) < m.gcm.NonceSize() {
+		return nil, errors.New("sealed key too short")
+	}
+	n := m.gcm.NonceSize()
+	kek, err := m.gcm.Open(nil, sealed[:n], sealed[n:], aad)
+	if err != nil {
+		return nil, errors.New("wrong master key or corrupted key")
+	}
+	return kek, nil
+}
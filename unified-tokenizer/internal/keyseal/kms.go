@@ -0,0 +1,544 @@
+package keyseal
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The cloud KMS sealers talk to the providers' REST APIs directly so the
+// tokenizer does not pull in four SDKs. Credentials come from the standard
+// environment variables of each provider, or from workload identity.
+
+var httpClient = &http.Client{Timeout: 15 * time.Second}
+
+// NewKMS returns a sealer that wraps KEKs with a cloud KMS key:
+//
+//	aws:   KMS key ARN or alias; region from KMS_REGION or AWS_REGION
+//	gcp:   projects/.../locations/.../keyRings/.../cryptoKeys/...
+//	azure: Key Vault key URL, e.g. https://vault.vault.azure.net/keys/kek
+//	vault: Transit key name (mount from VAULT_TRANSIT_MOUNT, default "transit")
+func NewKMS(provider, keyID, region string) (Sealer, error) {
+	if keyID == "" {
+		return nil, errors.New("KMS_KEY_ID is required with KMS_PROVIDER")
+	}
+
+	switch provider {
+	case "aws":
+		if region == "" {
+			region = os.Getenv("AWS_REGION")
+		}
+		if region == "" {
+			return nil, errors.New("KMS_REGION or AWS_REGION is required for the aws KMS provider")
+		}
+		return &awsKMS{keyID: keyID, region: region}, nil
+	case "gcp":
+		return &gcpKMS{keyName: keyID}, nil
+	case "azure":
+		return &azureKMS{keyURL: strings.TrimRight(keyID, "/")}, nil
+	case "vault":
+		addr := os.Getenv("VAULT_ADDR")
+		if addr == "" {
+			return nil, errors.New("VAULT_ADDR is required for the vault KMS provider")
+		}
+		mount := os.Getenv("VAULT_TRANSIT_MOUNT")
+		if mount == "" {
+			mount = "transit"
+		}
+		return &vaultTransit{addr: strings.TrimRight(addr, "/"), mount: mount, key: keyID}, nil
+	}
+	return nil, fmt.Errorf("unknown KMS_PROVIDER %q (use aws, gcp, azure or vault)", provider)
+}
+
+// doJSON sends a JSON request and decodes a JSON response, treating any
+// non-2xx status as an error
+func doJSON(req *http.Request, out interface{}) error {
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("%s %s: %s: %s", req.Method, req.URL.Host, resp.Status, strings.TrimSpace(string(body)))
+	}
+	if out == nil {
+		return nil
+	}
+	return json.Unmarshal(body, out)
+}
+
+func newJSONRequest(method, url string, body interface{}) (*http.Request, error) {
+	var payload []byte
+	if body != nil {
+		var err error
+		if payload, err = json.Marshal(body); err != nil {
+			return nil, err
+		}
+	}
+	req, err := http.NewRequest(method, url, bytes.NewReader(payload))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	return req, nil
+}
+
+// cachedToken holds a bearer token until shortly before it expires
+type cachedToken struct {
+	value   string
+	expires time.Time
+	mu      sync.Mutex
+}
+
+func (c *cachedToken) get(fetch func() (string, time.Duration, error)) (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.value != "" && time.Now().Before(c.expires) {
+		return c.value, nil
+	}
+	value, ttl, err := fetch()
+	if err != nil {
+		return "", err
+	}
+	c.value = value
+	c.expires = time.Now().Add(ttl - time.Minute)
+	return value, nil
+}
+
+// AWS KMS
+
+type awsKMS struct {
+	keyID  string
+	region string
+	creds  awsCredentials
+	mu     sync.Mutex
+}
+
+type awsCredentials struct {
+	accessKey    string
+	secretKey    string
+	sessionToken string
+	expires      time.Time
+}
+
+func (a *awsKMS) Name() string { return "kms:aws" }
+
+func (a *awsKMS) Seal(kek, aad []byte) ([]byte, error) {
+	var out struct{ CiphertextBlob []byte }
+	err := a.call("Encrypt", map[string]interface{}{
+		"KeyId":             a.keyID,
+		"Plaintext":         kek,
+		"EncryptionContext": map[string]string{"tokenshield_key_id": string(aad)},
+	}, &out)
+	return out.CiphertextBlob, err
+}
+
+func (a *awsKMS) Unseal(sealed, aad []byte) ([]byte, error) {
+	var out struct{ Plaintext []byte }
+	err := a.call("Decrypt", map[string]interface{}{
+		"KeyId":             a.keyID,
+		"CiphertextBlob":    sealed,
+		"EncryptionContext": map[string]string{"tokenshield_key_id": string(aad)},
+	}, &out)
+	return out.Plaintext, err
+}
+
+func (a *awsKMS) call(action string, body, out interface{}) error {
+	creds, err := a.credentials()
+	if err != nil {
+		return err
+	}
+	payload, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, "https://kms."+a.region+".amazonaws.com/", bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-amz-json-1.1")
+	req.Header.Set("X-Amz-Target", "TrentService."+action)
+	signV4(req, payload, creds, a.region, "kms", time.Now().UTC())
+	return doJSON(req, out)
+}
+
+// credentials uses AWS_ACCESS_KEY_ID/AWS_SECRET_ACCESS_KEY, or exchanges the
+// projected service account token for role credentials (IRSA)
+func (a *awsKMS) credentials() (awsCredentials, error) {
+	if key := os.Getenv("AWS_ACCESS_KEY_ID"); key != "" {
+		return awsCredentials{
+			accessKey:    key,
+			secretKey:    os.Getenv("AWS_SECRET_ACCESS_KEY"),
+			sessionToken: os.Getenv("AWS_SESSION_TOKEN"),
+		}, nil
+	}
+
+	roleARN, tokenFile := os.Getenv("AWS_ROLE_ARN"), os.Getenv("AWS_WEB_IDENTITY_TOKEN_FILE")
+	if roleARN == "" || tokenFile == "" {
+		return awsCredentials{}, errors.New("no AWS credentials: set AWS_ACCESS_KEY_ID or use IRSA (AWS_ROLE_ARN and AWS_WEB_IDENTITY_TOKEN_FILE)")
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.creds.accessKey != "" && time.Now().Add(time.Minute).Before(a.creds.expires) {
+		return a.creds, nil
+	}
+
+	token, err := os.ReadFile(tokenFile)
+	if err != nil {
+		return awsCredentials{}, err
+	}
+	query := url.Values{
+		"Action":           {"AssumeRoleWithWebIdentity"},
+		"Version":          {"2011-06-15"},
+		"RoleArn":          {roleARN},
+		"RoleSessionName":  {"tokenshield"},
+		"WebIdentityToken": {strings.TrimSpace(string(token))},
+	}
+	resp, err := httpClient.Get("https://sts." + a.region + ".amazonaws.com/?" + query.Encode())
+	if err != nil {
+		return awsCredentials{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return awsCredentials{}, fmt.Errorf("AssumeRoleWithWebIdentity: %s", resp.Status)
+	}
+
+	var result struct {
+		Credentials struct {
+			AccessKeyId     string
+			SecretAccessKey string
+			SessionToken    string
+			Expiration      time.Time
+		} `xml:"AssumeRoleWithWebIdentityResult>Credentials"`
+	}
+	if err := xml.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return awsCredentials{}, fmt.Errorf("AssumeRoleWithWebIdentity: %v", err)
+	}
+	c := result.Credentials
+	a.creds = awsCredentials{accessKey: c.AccessKeyId, secretKey: c.SecretAccessKey, sessionToken: c.SessionToken, expires: c.Expiration}
+	return a.creds, nil
+}
+
+// signV4 adds AWS Signature Version 4 headers to a request with a fixed
+// body and no query string
+func signV4(req *http.Request, payload []byte, creds awsCredentials, region, service string, now time.Time) {
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	req.Header.Set("X-Amz-Date", amzDate)
+	if creds.sessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", creds.sessionToken)
+	}
+
+	headers := map[string]string{"host": req.URL.Host}
+	for name := range req.Header {
+		headers[strings.ToLower(name)] = strings.TrimSpace(req.Header.Get(name))
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	payloadHash := sha256.Sum256(payload)
+	canonical := strings.Join([]string{
+		req.Method, "/", "", canonicalHeaders.String(), signedHeaders, hex.EncodeToString(payloadHash[:]),
+	}, "\n")
+	canonicalHash := sha256.Sum256([]byte(canonical))
+
+	scope := date + "/" + region + "/" + service + "/aws4_request"
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(canonicalHash[:])
+
+	key := hmacSHA256([]byte("AWS4"+creds.secretKey), date)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, service)
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		creds.accessKey, scope, signedHeaders, signature))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// Google Cloud KMS
+
+type gcpKMS struct {
+	keyName string
+	token   cachedToken
+}
+
+func (g *gcpKMS) Name() string { return "kms:gcp" }
+
+func (g *gcpKMS) Seal(kek, aad []byte) ([]byte, error) {
+	var out struct{ Ciphertext []byte }
+	err := g.call("encrypt", map[string]interface{}{"plaintext": kek, "additionalAuthenticatedData": aad}, &out)
+	return out.Ciphertext, err
+}
+
+func (g *gcpKMS) Unseal(sealed, aad []byte) ([]byte, error) {
+	var out struct{ Plaintext []byte }
+	err := g.call("decrypt", map[string]interface{}{"ciphertext": sealed, "additionalAuthenticatedData": aad}, &out)
+	return out.Plaintext, err
+}
+
+func (g *gcpKMS) call(method string, body, out interface{}) error {
+	token, err := g.token.get(gcpAccessToken)
+	if err != nil {
+		return fmt.Errorf("GCP access token: %v", err)
+	}
+	req, err := newJSONRequest(http.MethodPost, "https://cloudkms.googleapis.com/v1/"+g.keyName+":"+method, body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	return doJSON(req, out)
+}
+
+// gcpAccessToken uses GOOGLE_OAUTH_ACCESS_TOKEN, or the metadata server
+// (GKE workload identity or the node's service account)
+func gcpAccessToken() (string, time.Duration, error) {
+	if token := os.Getenv("GOOGLE_OAUTH_ACCESS_TOKEN"); token != "" {
+		return token, time.Hour, nil
+	}
+	req, err := http.NewRequest(http.MethodGet, "http://metadata.google.internal/computeMetadata/v1/instance/service-accounts/default/token", nil)
+	if err != nil {
+		return "", 0, err
+	}
+	req.Header.Set("Metadata-Flavor", "Google")
+	var out struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}
+	if err := doJSON(req, &out); err != nil {
+		return "", 0, err
+	}
+	return out.AccessToken, time.Duration(out.ExpiresIn) * time.Second, nil
+}
+
+// Azure Key Vault
+
+// azureKMS wraps with RSA-OAEP-256, which has no associated data; the key
+// ID binding is only enforced by the other providers
+type azureKMS struct {
+	keyURL string
+	token  cachedToken
+}
+
+func (z *azureKMS) Name() string { return "kms:azure" }
+
+func (z *azureKMS) Seal(kek, aad []byte) ([]byte, error) {
+	return z.call("wrapkey", kek)
+}
+
+func (z *azureKMS) Unseal(sealed, aad []byte) ([]byte, error) {
+	return z.call("unwrapkey", sealed)
+}
+
+func (z *azureKMS) call(operation string, value []byte) ([]byte, error) {
+	token, err := z.token.get(azureAccessToken)
+	if err != nil {
+		return nil, fmt.Errorf("Azure access token: %v", err)
+	}
+	req, err := newJSONRequest(http.MethodPost, z.keyURL+"/"+operation+"?api-version=7.4", map[string]string{
+		"alg":   "RSA-OAEP-256",
+		"value": base64.RawURLEncoding.EncodeToString(value),
+	})
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	var out struct {
+		Value string `json:"value"`
+	}
+	if err := doJSON(req, &out); err != nil {
+		return nil, err
+	}
+	return base64.RawURLEncoding.DecodeString(out.Value)
+}
+
+// azureAccessToken uses a client secret or federated token (AKS workload
+// identity) for AZURE_CLIENT_ID, or the instance metadata service
+func azureAccessToken() (string, time.Duration, error) {
+	tenant, clientID := os.Getenv("AZURE_TENANT_ID"), os.Getenv("AZURE_CLIENT_ID")
+	form := url.Values{
+		"grant_type": {"client_credentials"},
+		"client_id":  {clientID},
+		"scope":      {"https://vault.azure.net/.default"},
+	}
+	switch {
+	case tenant != "" && os.Getenv("AZURE_CLIENT_SECRET") != "":
+		form.Set("client_secret", os.Getenv("AZURE_CLIENT_SECRET"))
+	case tenant != "" && os.Getenv("AZURE_FEDERATED_TOKEN_FILE") != "":
+		assertion, err := os.ReadFile(os.Getenv("AZURE_FEDERATED_TOKEN_FILE"))
+		if err != nil {
+			return "", 0, err
+		}
+		form.Set("client_assertion_type", "urn:ietf:params:oauth:client-assertion-type:jwt-bearer")
+		form.Set("client_assertion", strings.TrimSpace(string(assertion)))
+	default:
+		query := url.Values{"api-version": {"2018-02-01"}, "resource": {"https://vault.azure.net"}}
+		if clientID != "" {
+			query.Set("client_id", clientID)
+		}
+		req, err := http.NewRequest(http.MethodGet, "http://169.254.169.254/metadata/identity/oauth2/token?"+query.Encode(), nil)
+		if err != nil {
+			return "", 0, err
+		}
+		req.Header.Set("Metadata", "true")
+		var out struct {
+			AccessToken string      `json:"access_token"`
+			ExpiresIn   json.Number `json:"expires_in"`
+		}
+		if err := doJSON(req, &out); err != nil {
+			return "", 0, err
+		}
+		seconds, _ := out.ExpiresIn.Int64()
+		return out.AccessToken, time.Duration(seconds) * time.Second, nil
+	}
+
+	req, err := http.NewRequest(http.MethodPost, "https://login.microsoftonline.com/"+tenant+"/oauth2/v2.0/token", strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", 0, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	var out struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}
+	if err := doJSON(req, &out); err != nil {
+		return "", 0, err
+	}
+	return out.AccessToken, time.Duration(out.ExpiresIn) * time.Second, nil
+}
+
+// HashiCorp Vault Transit
+
+type vaultTransit struct {
+	addr  string
+	mount string
+	key   string
+	token cachedToken
+}
+
+func (v *vaultTransit) Name() string { return "kms:vault" }
+
+// Transit ciphertexts are "vault:v1:..." strings, stored as their bytes
+func (v *vaultTransit) Seal(kek, aad []byte) ([]byte, error) {
+	var out struct {
+		Data struct {
+			Ciphertext string `json:"ciphertext"`
+		} `json:"data"`
+	}
+	if err := v.call("encrypt", map[string]string{
+		"plaintext":       base64.StdEncoding.EncodeToString(kek),
+		"associated_data": base64.StdEncoding.EncodeToString(aad),
+	}, &out); err != nil {
+		return nil, err
+	}
+	return []byte(out.Data.Ciphertext), nil
+}
+
+func (v *vaultTransit) Unseal(sealed, aad []byte) ([]byte, error) {
+	var out struct {
+		Data struct {
+			Plaintext string `json:"plaintext"`
+		} `json:"data"`
+	}
+	if err := v.call("decrypt", map[string]string{
+		"ciphertext":      string(sealed),
+		"associated_data": base64.StdEncoding.EncodeToString(aad),
+	}, &out); err != nil {
+		return nil, err
+	}
+	return base64.StdEncoding.DecodeString(out.Data.Plaintext)
+}
+
+func (v *vaultTransit) call(operation string, body, out interface{}) error {
+	token, err := v.token.get(v.login)
+	if err != nil {
+		return fmt.Errorf("Vault token: %v", err)
+	}
+	req, err := newJSONRequest(http.MethodPost, v.addr+"/v1/"+v.mount+"/"+operation+"/"+v.key, body)
+	if err != nil {
+		return err
+	}
+	v.setHeaders(req, token)
+	return doJSON(req, out)
+}
+
+func (v *vaultTransit) setHeaders(req *http.Request, token string) {
+	if token != "" {
+		req.Header.Set("X-Vault-Token", token)
+	}
+	if ns := os.Getenv("VAULT_NAMESPACE"); ns != "" {
+		req.Header.Set("X-Vault-Namespace", ns)
+	}
+}
+
+// login uses VAULT_TOKEN, or the Kubernetes auth method with the pod's
+// service account when VAULT_K8S_ROLE is set
+func (v *vaultTransit) login() (string, time.Duration, error) {
+	if token := os.Getenv("VAULT_TOKEN"); token != "" {
+		return token, 24 * time.Hour, nil
+	}
+	role := os.Getenv("VAULT_K8S_ROLE")
+	if role == "" {
+		return "", 0, errors.New("set VAULT_TOKEN or VAULT_K8S_ROLE")
+	}
+	jwt, err := os.ReadFile("/var/run/secrets/kubernetes.io/serviceaccount/token")
+	if err != nil {
+		return "", 0, err
+	}
+	mount := os.Getenv("VAULT_K8S_MOUNT")
+	if mount == "" {
+		mount = "kubernetes"
+	}
+	req, err := newJSONRequest(http.MethodPost, v.addr+"/v1/auth/"+mount+"/login", map[string]string{
+		"role": role,
+		"jwt":  strings.TrimSpace(string(jwt)),
+	})
+	if err != nil {
+		return "", 0, err
+	}
+	v.setHeaders(req, "")
+	var out struct {
+		Auth struct {
+			ClientToken   string `json:"client_token"`
+			LeaseDuration int    `json:"lease_duration"`
+		} `json:"auth"`
+	}
+	if err := doJSON(req, &out); err != nil {
+		return "", 0, err
+	}
+	return out.Auth.ClientToken, time.Duration(out.Auth.LeaseDuration) * time.Second, nil
+}
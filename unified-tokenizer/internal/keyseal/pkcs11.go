@@ -0,0 +1,110 @@
+package keyseal
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// PKCS11Config selects the HSM token and AES key used to seal KEKs
+type PKCS11Config struct {
+	Module     string // Path of the vendor's PKCS#11 library
+	TokenLabel string // Token to use; takes precedence over Slot
+	Slot       int    // Slot ID, when no token label is given (-1: first slot with a token)
+	PIN        string // Crypto user PIN
+	KeyLabel   string // CKA_LABEL of an AES key with CKA_ENCRYPT and CKA_DECRYPT
+}
+
+// PKCS11ConfigFromEnv reads PKCS11_MODULE, PKCS11_TOKEN_LABEL, PKCS11_SLOT,
+// PKCS11_PIN (or PKCS11_PIN_FILE) and PKCS11_KEY_LABEL
+func PKCS11ConfigFromEnv() (PKCS11Config, error) {
+	cfg := PKCS11Config{
+		Module:     os.Getenv("PKCS11_MODULE"),
+		TokenLabel: os.Getenv("PKCS11_TOKEN_LABEL"),
+		Slot:       -1,
+		PIN:        os.Getenv("PKCS11_PIN"),
+		KeyLabel:   os.Getenv("PKCS11_KEY_LABEL"),
+	}
+	if cfg.Module == "" {
+		return cfg, fmt.Errorf("PKCS11_MODULE is not set")
+	}
+	if cfg.KeyLabel == "" {
+		cfg.KeyLabel = "tokenshield-kek"
+	}
+	if slot := os.Getenv("PKCS11_SLOT"); slot != "" {
+		n, err := strconv.Atoi(slot)
+		if err != nil || n < 0 {
+			return cfg, fmt.Errorf("invalid PKCS11_SLOT %q", slot)
+		}
+		cfg.Slot = n
+	}
+	if file := os.Getenv("PKCS11_PIN_FILE"); file != "" {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return cfg, fmt.Errorf("reading PKCS11_PIN_FILE: %v", err)
+		}
+		cfg.PIN = strings.TrimRight(string(data), "\r\n")
+	}
+	if cfg.PIN == "" {
+		return cfg, fmt.Errorf("PKCS11_PIN or PKCS11_PIN_FILE is required")
+	}
+	return cfg, nil
+}
+
+// PKCS#11 return values worth explaining to an operator
+var ckrNames = map[uint64]string{
+	0x003: "CKR_SLOT_ID_INVALID",
+	0x005: "CKR_GENERAL_ERROR",
+	0x006: "CKR_FUNCTION_FAILED",
+	0x007: "CKR_ARGUMENTS_BAD",
+	0x030: "CKR_DEVICE_ERROR",
+	0x031: "CKR_DEVICE_MEMORY",
+	0x032: "CKR_DEVICE_REMOVED",
+	0x040: "CKR_ENCRYPTED_DATA_INVALID",
+	0x041: "CKR_ENCRYPTED_DATA_LEN_RANGE",
+	0x060: "CKR_KEY_HANDLE_INVALID",
+	0x068: "CKR_KEY_FUNCTION_NOT_PERMITTED",
+	0x070: "CKR_MECHANISM_INVALID",
+	0x071: "CKR_MECHANISM_PARAM_INVALID",
+	0x0A0: "CKR_PIN_INCORRECT",
+	0x0A2: "CKR_PIN_LEN_RANGE",
+	0x0A4: "CKR_PIN_LOCKED",
+	0x0B3: "CKR_SESSION_HANDLE_INVALID",
+	0x0E0: "CKR_TOKEN_NOT_PRESENT",
+	0x0E1: "CKR_TOKEN_NOT_RECOGNIZED",
+	0x100: "CKR_USER_ALREADY_LOGGED_IN",
+	0x101: "CKR_USER_NOT_LOGGED_IN",
+	0x150: "CKR_BUFFER_TOO_SMALL",
+	0x190: "CKR_CRYPTOKI_NOT_INITIALIZED",
+	0x191: "CKR_CRYPTOKI_ALREADY_INITIALIZED",
+}
+
+var ckrHints = map[uint64]string{
+	0x003: "check PKCS11_SLOT",
+	0x032: "the HSM was disconnected",
+	0x040: "the KEK was sealed with a different HSM key",
+	0x068: "the key needs CKA_ENCRYPT and CKA_DECRYPT",
+	0x070: "the token does not support CKM_AES_GCM",
+	0x071: "the token rejected the GCM parameters; some FIPS-mode HSMs only accept internally generated IVs",
+	0x0A0: "check PKCS11_PIN",
+	0x0A4: "the user PIN is locked; reset it with the SO PIN",
+	0x0E0: "no token in the slot",
+}
+
+// pkcs11Error names the failing call and return value
+type pkcs11Error struct {
+	call string
+	rv   uint64
+}
+
+func (e *pkcs11Error) Error() string {
+	name, ok := ckrNames[e.rv]
+	if !ok {
+		name = fmt.Sprintf("CKR 0x%X", e.rv)
+	}
+	if hint := ckrHints[e.rv]; hint != "" {
+		return fmt.Sprintf("%s: %s (%s)", e.call, name, hint)
+	}
+	return fmt.Sprintf("%s: %s", e.call, name)
+}
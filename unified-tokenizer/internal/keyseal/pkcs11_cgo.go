@@ -0,0 +1,396 @@
+//go:build pkcs11 && cgo
+
+package keyseal
+
+/*
+#cgo linux LDFLAGS: -ldl
+#include <dlfcn.h>
+#include <stdlib.h>
+#include <string.h>
+
+// The subset of pkcs11.h (v2.40) used here, so no vendor headers are needed
+typedef unsigned char CK_BYTE;
+typedef unsigned long CK_ULONG;
+typedef CK_ULONG CK_RV;
+typedef CK_ULONG CK_SLOT_ID;
+typedef CK_ULONG CK_SESSION_HANDLE;
+typedef CK_ULONG CK_OBJECT_HANDLE;
+
+typedef struct { CK_BYTE major; CK_BYTE minor; } CK_VERSION;
+typedef struct { CK_ULONG type; void *pValue; CK_ULONG ulValueLen; } CK_ATTRIBUTE;
+typedef struct { CK_ULONG mechanism; void *pParameter; CK_ULONG ulParameterLen; } CK_MECHANISM;
+typedef struct {
+	CK_BYTE *pIv; CK_ULONG ulIvLen; CK_ULONG ulIvBits;
+	CK_BYTE *pAAD; CK_ULONG ulAADLen; CK_ULONG ulTagBits;
+} CK_GCM_PARAMS;
+typedef struct {
+	void *CreateMutex; void *DestroyMutex; void *LockMutex; void *UnlockMutex;
+	CK_ULONG flags; void *pReserved;
+} CK_C_INITIALIZE_ARGS;
+typedef struct {
+	CK_BYTE label[32]; CK_BYTE manufacturerID[32]; CK_BYTE model[16]; CK_BYTE serialNumber[16];
+	CK_ULONG flags;
+	CK_ULONG ulMaxSessionCount, ulSessionCount, ulMaxRwSessionCount, ulRwSessionCount;
+	CK_ULONG ulMaxPinLen, ulMinPinLen;
+	CK_ULONG ulTotalPublicMemory, ulFreePublicMemory, ulTotalPrivateMemory, ulFreePrivateMemory;
+	CK_VERSION hardwareVersion; CK_VERSION firmwareVersion;
+	CK_BYTE utcTime[16];
+} CK_TOKEN_INFO;
+
+// CK_FUNCTION_LIST up to C_Decrypt; the entries must stay in spec order
+typedef struct {
+	CK_VERSION version;
+	CK_RV (*C_Initialize)(void *);
+	CK_RV (*C_Finalize)(void *);
+	void *C_GetInfo;
+	void *C_GetFunctionList;
+	CK_RV (*C_GetSlotList)(CK_BYTE, CK_SLOT_ID *, CK_ULONG *);
+	void *C_GetSlotInfo;
+	CK_RV (*C_GetTokenInfo)(CK_SLOT_ID, CK_TOKEN_INFO *);
+	void *C_GetMechanismList;
+	void *C_GetMechanismInfo;
+	void *C_InitToken;
+	void *C_InitPIN;
+	void *C_SetPIN;
+	CK_RV (*C_OpenSession)(CK_SLOT_ID, CK_ULONG, void *, void *, CK_SESSION_HANDLE *);
+	CK_RV (*C_CloseSession)(CK_SESSION_HANDLE);
+	void *C_CloseAllSessions;
+	void *C_GetSessionInfo;
+	void *C_GetOperationState;
+	void *C_SetOperationState;
+	CK_RV (*C_Login)(CK_SESSION_HANDLE, CK_ULONG, CK_BYTE *, CK_ULONG);
+	void *C_Logout;
+	void *C_CreateObject;
+	void *C_CopyObject;
+	void *C_DestroyObject;
+	void *C_GetObjectSize;
+	void *C_GetAttributeValue;
+	void *C_SetAttributeValue;
+	CK_RV (*C_FindObjectsInit)(CK_SESSION_HANDLE, CK_ATTRIBUTE *, CK_ULONG);
+	CK_RV (*C_FindObjects)(CK_SESSION_HANDLE, CK_OBJECT_HANDLE *, CK_ULONG, CK_ULONG *);
+	CK_RV (*C_FindObjectsFinal)(CK_SESSION_HANDLE);
+	CK_RV (*C_EncryptInit)(CK_SESSION_HANDLE, CK_MECHANISM *, CK_OBJECT_HANDLE);
+	CK_RV (*C_Encrypt)(CK_SESSION_HANDLE, CK_BYTE *, CK_ULONG, CK_BYTE *, CK_ULONG *);
+	void *C_EncryptUpdate;
+	void *C_EncryptFinal;
+	CK_RV (*C_DecryptInit)(CK_SESSION_HANDLE, CK_MECHANISM *, CK_OBJECT_HANDLE);
+	CK_RV (*C_Decrypt)(CK_SESSION_HANDLE, CK_BYTE *, CK_ULONG, CK_BYTE *, CK_ULONG *);
+} CK_FUNCTION_LIST;
+
+static const char *ts_load(const char *path, CK_FUNCTION_LIST **list) {
+	void *handle = dlopen(path, RTLD_NOW | RTLD_LOCAL);
+	if (handle == NULL) {
+		return dlerror();
+	}
+	CK_RV (*getList)(CK_FUNCTION_LIST **) = (CK_RV (*)(CK_FUNCTION_LIST **))dlsym(handle, "C_GetFunctionList");
+	if (getList == NULL) {
+		return "C_GetFunctionList not exported; is this a PKCS#11 module?";
+	}
+	if (getList(list) != 0 || *list == NULL) {
+		return "C_GetFunctionList failed";
+	}
+	return NULL;
+}
+
+static CK_RV ts_initialize(CK_FUNCTION_LIST *f) {
+	CK_C_INITIALIZE_ARGS args;
+	memset(&args, 0, sizeof(args));
+	args.flags = 0x2; // CKF_OS_LOCKING_OK: called from many goroutines
+	return f->C_Initialize(&args);
+}
+
+static CK_RV ts_slots(CK_FUNCTION_LIST *f, CK_SLOT_ID *slots, CK_ULONG *count) {
+	return f->C_GetSlotList(1, slots, count);
+}
+
+static CK_RV ts_token_label(CK_FUNCTION_LIST *f, CK_SLOT_ID slot, CK_BYTE *label) {
+	CK_TOKEN_INFO info;
+	CK_RV rv = f->C_GetTokenInfo(slot, &info);
+	if (rv == 0) {
+		memcpy(label, info.label, sizeof(info.label));
+	}
+	return rv;
+}
+
+static CK_RV ts_open(CK_FUNCTION_LIST *f, CK_SLOT_ID slot, CK_SESSION_HANDLE *session) {
+	return f->C_OpenSession(slot, 0x4, NULL, NULL, session); // CKF_SERIAL_SESSION
+}
+
+static CK_RV ts_close(CK_FUNCTION_LIST *f, CK_SESSION_HANDLE session) {
+	return f->C_CloseSession(session);
+}
+
+static CK_RV ts_login(CK_FUNCTION_LIST *f, CK_SESSION_HANDLE session, CK_BYTE *pin, CK_ULONG len) {
+	return f->C_Login(session, 1, pin, len); // CKU_USER
+}
+
+static CK_RV ts_find_key(CK_FUNCTION_LIST *f, CK_SESSION_HANDLE session, CK_BYTE *label, CK_ULONG len,
+                         CK_OBJECT_HANDLE *key, CK_ULONG *found) {
+	CK_ULONG class = 4; // CKO_SECRET_KEY
+	CK_ATTRIBUTE template[2] = {
+		{0x000, &class, sizeof(class)}, // CKA_CLASS
+		{0x003, label, len},            // CKA_LABEL
+	};
+	CK_RV rv = f->C_FindObjectsInit(session, template, 2);
+	if (rv != 0) {
+		return rv;
+	}
+	rv = f->C_FindObjects(session, key, 1, found);
+	f->C_FindObjectsFinal(session);
+	return rv;
+}
+
+static CK_RV ts_gcm(CK_FUNCTION_LIST *f, CK_SESSION_HANDLE session, CK_OBJECT_HANDLE key, int encrypt,
+                    CK_BYTE *iv, CK_ULONG ivLen, CK_BYTE *aad, CK_ULONG aadLen,
+                    CK_BYTE *in, CK_ULONG inLen, CK_BYTE *out, CK_ULONG *outLen) {
+	CK_GCM_PARAMS params = {iv, ivLen, ivLen * 8, aad, aadLen, 128};
+	CK_MECHANISM mechanism = {0x1087, &params, sizeof(params)}; // CKM_AES_GCM
+	CK_RV rv;
+	if (encrypt) {
+		rv = f->C_EncryptInit(session, &mechanism, key);
+		if (rv == 0) {
+			rv = f->C_Encrypt(session, in, inLen, out, outLen);
+		}
+	} else {
+		rv = f->C_DecryptInit(session, &mechanism, key);
+		if (rv == 0) {
+			rv = f->C_Decrypt(session, in, inLen, out, outLen);
+		}
+	}
+	return rv;
+}
+*/
+import "C"
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"unsafe"
+)
+
+const (
+	ckrOK                   = 0x000
+	ckrSessionHandleInvalid = 0x0B3
+	ckrUserAlreadyLoggedIn  = 0x100
+	ckrCryptokiAlreadyInit  = 0x191
+	ckrDeviceRemoved        = 0x032
+	gcmIVSize               = 12
+	gcmTagSize              = 16
+)
+
+// hsmSealer wraps KEKs with AES-GCM inside the HSM; the HSM key never
+// leaves the token. PKCS#11 sessions are not safe for concurrent use, so
+// calls are serialised on one logged-in session.
+type hsmSealer struct {
+	cfg     PKCS11Config
+	fl      *C.CK_FUNCTION_LIST
+	slot    C.CK_SLOT_ID
+	session C.CK_SESSION_HANDLE
+	key     C.CK_OBJECT_HANDLE
+	mu      sync.Mutex
+}
+
+// NewPKCS11 loads the module, logs in to the token and finds the sealing key
+func NewPKCS11(cfg PKCS11Config) (Sealer, error) {
+	h := &hsmSealer{cfg: cfg}
+	if err := h.load(); err != nil {
+		return nil, err
+	}
+	if err := h.open(); err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+func (h *hsmSealer) Name() string { return "pkcs11" }
+
+func (h *hsmSealer) load() error {
+	path := C.CString(h.cfg.Module)
+	defer C.free(unsafe.Pointer(path))
+	if msg := C.ts_load(path, &h.fl); msg != nil {
+		return fmt.Errorf("loading PKCS#11 module %s: %s", h.cfg.Module, C.GoString(msg))
+	}
+	if rv := C.ts_initialize(h.fl); rv != ckrOK && rv != ckrCryptokiAlreadyInit {
+		return &pkcs11Error{"C_Initialize", uint64(rv)}
+	}
+
+	slots, labels, err := h.tokens()
+	if err != nil {
+		return err
+	}
+	if len(slots) == 0 {
+		return fmt.Errorf("PKCS#11 module %s reports no slots with a token", h.cfg.Module)
+	}
+	for i, slot := range slots {
+		switch {
+		case h.cfg.TokenLabel != "" && labels[i] == h.cfg.TokenLabel,
+			h.cfg.TokenLabel == "" && h.cfg.Slot >= 0 && int(slot) == h.cfg.Slot,
+			h.cfg.TokenLabel == "" && h.cfg.Slot < 0:
+			h.slot = slot
+			return nil
+		}
+	}
+
+	available := make([]string, len(slots))
+	for i, slot := range slots {
+		available[i] = fmt.Sprintf("slot %d %q", slot, labels[i])
+	}
+	want := fmt.Sprintf("token %q", h.cfg.TokenLabel)
+	if h.cfg.TokenLabel == "" {
+		want = fmt.Sprintf("slot %d", h.cfg.Slot)
+	}
+	return fmt.Errorf("%s not found; available: %s", want, strings.Join(available, ", "))
+}
+
+// tokens lists the slots holding a token and the tokens' labels
+func (h *hsmSealer) tokens() ([]C.CK_SLOT_ID, []string, error) {
+	var count C.CK_ULONG
+	if rv := C.ts_slots(h.fl, nil, &count); rv != ckrOK {
+		return nil, nil, &pkcs11Error{"C_GetSlotList", uint64(rv)}
+	}
+	if count == 0 {
+		return nil, nil, nil
+	}
+	slots := make([]C.CK_SLOT_ID, count)
+	if rv := C.ts_slots(h.fl, &slots[0], &count); rv != ckrOK {
+		return nil, nil, &pkcs11Error{"C_GetSlotList", uint64(rv)}
+	}
+	slots = slots[:count]
+
+	labels := make([]string, len(slots))
+	for i, slot := range slots {
+		var label [32]C.CK_BYTE
+		if rv := C.ts_token_label(h.fl, slot, &label[0]); rv != ckrOK {
+			return nil, nil, &pkcs11Error{"C_GetTokenInfo", uint64(rv)}
+		}
+		labels[i] = strings.TrimRight(C.GoStringN((*C.char)(unsafe.Pointer(&label[0])), 32), " \x00")
+	}
+	return slots, labels, nil
+}
+
+// open starts a session, logs in and looks up the key by label
+func (h *hsmSealer) open() error {
+	if rv := C.ts_open(h.fl, h.slot, &h.session); rv != ckrOK {
+		return &pkcs11Error{"C_OpenSession", uint64(rv)}
+	}
+	pin := []byte(h.cfg.PIN)
+	if rv := C.ts_login(h.fl, h.session, bytePtr(pin), C.CK_ULONG(len(pin))); rv != ckrOK && rv != ckrUserAlreadyLoggedIn {
+		C.ts_close(h.fl, h.session)
+		return &pkcs11Error{"C_Login", uint64(rv)}
+	}
+
+	label := []byte(h.cfg.KeyLabel)
+	var found C.CK_ULONG
+	if rv := C.ts_find_key(h.fl, h.session, bytePtr(label), C.CK_ULONG(len(label)), &h.key, &found); rv != ckrOK {
+		C.ts_close(h.fl, h.session)
+		return &pkcs11Error{"C_FindObjects", uint64(rv)}
+	}
+	if found == 0 {
+		C.ts_close(h.fl, h.session)
+		return fmt.Errorf("no secret key labelled %q on the token; create an AES-256 key with CKA_ENCRYPT and CKA_DECRYPT", h.cfg.KeyLabel)
+	}
+	return nil
+}
+
+// Seal returns nonce || ciphertext || tag
+func (h *hsmSealer) Seal(kek, aad []byte) ([]byte, error) {
+	iv := make([]byte, gcmIVSize)
+	if _, err := io.ReadFull(rand.Reader, iv); err != nil {
+		return nil, err
+	}
+	out, err := h.gcm(true, iv, aad, kek, len(kek)+gcmTagSize)
+	if err != nil {
+		return nil, err
+	}
+	return append(iv, out...), nil
+}
+
+func (h *hsmSealer) Unseal(sealed, aad []byte) ([]byte, error) {
+	if len(sealed) < gcmIVSize+gcmTagSize {
+		return nil, errors.New("sealed key too short")
+	}
+	return h.gcm(false, sealed[:gcmIVSize], aad, sealed[gcmIVSize:], len(sealed))
+}
+
+// gcm runs one operation, reopening the session once if the HSM dropped it
+func (h *hsmSealer) gcm(encrypt bool, iv, aad, in []byte, outSize int) ([]byte, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	out, rv := h.gcmOnce(encrypt, iv, aad, in, outSize)
+	if rv == ckrSessionHandleInvalid || rv == ckrDeviceRemoved {
+		if err := h.open(); err != nil {
+			return nil, fmt.Errorf("reopening PKCS#11 session: %v", err)
+		}
+		out, rv = h.gcmOnce(encrypt, iv, aad, in, outSize)
+	}
+	if rv != ckrOK {
+		call := "C_Decrypt"
+		if encrypt {
+			call = "C_Encrypt"
+		}
+		return nil, &pkcs11Error{call, uint64(rv)}
+	}
+	return out, nil
+}
+
+func (h *hsmSealer) gcmOnce(encrypt bool, iv, aad, in []byte, outSize int) ([]byte, C.CK_RV) {
+	out := make([]byte, outSize)
+	outLen := C.CK_ULONG(len(out))
+	mode := C.int(0)
+	if encrypt {
+		mode = 1
+	}
+	rv := C.ts_gcm(h.fl, h.session, h.key, mode,
+		bytePtr(iv), C.CK_ULONG(len(iv)), bytePtr(aad), C.CK_ULONG(len(aad)),
+		bytePtr(in), C.CK_ULONG(len(in)), bytePtr(out), &outLen)
+	return out[:outLen], rv
+}
+
+// CheckPKCS11 reports each step of connecting to the HSM and seals a test
+// value, for `unified-tokenizer pkcs11-check`
+func CheckPKCS11(cfg PKCS11Config, w io.Writer) error {
+	h := &hsmSealer{cfg: cfg}
+	if err := h.load(); err != nil {
+		return err
+	}
+	slots, labels, _ := h.tokens()
+	for i, slot := range slots {
+		marker := " "
+		if slot == h.slot {
+			marker = "*"
+		}
+		fmt.Fprintf(w, "%s slot %d: token %q\n", marker, slot, labels[i])
+	}
+	if err := h.open(); err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "Logged in, found key %q\n", cfg.KeyLabel)
+
+	probe := make([]byte, 32)
+	io.ReadFull(rand.Reader, probe)
+	sealed, err := h.Seal(probe, []byte("pkcs11-check"))
+	if err != nil {
+		return err
+	}
+	unsealed, err := h.Unseal(sealed, []byte("pkcs11-check"))
+	if err != nil {
+		return err
+	}
+	if string(unsealed) != string(probe) {
+		return errors.New("AES-GCM round trip returned different data")
+	}
+	fmt.Fprintln(w, "AES-GCM seal/unseal round trip OK")
+	return nil
+}
+
+func bytePtr(b []byte) *C.CK_BYTE {
+	if len(b) == 0 {
+		return nil
+	}
+	return (*C.CK_BYTE)(unsafe.Pointer(&b[0]))
+}
@@ -0,0 +1,20 @@
+//go:build !pkcs11 || !cgo
+
+package keyseal
+
+import (
+	"errors"
+	"io"
+)
+
+// The default build is static (CGO_ENABLED=0); HSM support loads the vendor
+// module with dlopen and needs a cgo build with -tags pkcs11
+var errNoPKCS11 = errors.New("this build has no PKCS#11 support; rebuild with CGO_ENABLED=1 and -tags pkcs11")
+
+func NewPKCS11(cfg PKCS11Config) (Sealer, error) {
+	return nil, errNoPKCS11
+}
+
+func CheckPKCS11(cfg PKCS11Config, w io.Writer) error {
+	return errNoPKCS11
+}
@@ -0,0 +1,334 @@
+package loadgen
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"tokenshield-unified/internal/icap"
+)
+
+// Config controls a load run
+type Config struct {
+	Concurrency int           // Parallel workers
+	Duration    time.Duration // How long to run when Requests is 0
+	Requests    int           // Total requests; 0 runs for Duration
+	PayloadSize int           // Approximate JSON body size in bytes
+	// TokenHitRatio is the fraction of ICAP and API requests that use a
+	// token known to the vault; the rest use random tokens that miss
+	TokenHitRatio float64
+}
+
+// Op sends one request. rng is private to the calling worker.
+type Op func(ctx context.Context, rng *rand.Rand) error
+
+// Result summarises a load run
+type Result struct {
+	Requests  int
+	Errors    int
+	FirstErr  error
+	Elapsed   time.Duration
+	latencies []time.Duration // Sorted
+}
+
+// Run drives op from cfg.Concurrency workers until cfg.Requests have been
+// sent, cfg.Duration has passed, or ctx is cancelled
+func Run(ctx context.Context, cfg Config, op Op) *Result {
+	if cfg.Concurrency < 1 {
+		cfg.Concurrency = 1
+	}
+	if cfg.Requests == 0 && cfg.Duration > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, cfg.Duration)
+		defer cancel()
+	}
+
+	var (
+		mu        sync.Mutex
+		wg        sync.WaitGroup
+		remaining = cfg.Requests
+		result    = &Result{}
+	)
+	take := func() bool {
+		if cfg.Requests == 0 {
+			return ctx.Err() == nil
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		if remaining == 0 || ctx.Err() != nil {
+			return false
+		}
+		remaining--
+		return true
+	}
+
+	start := time.Now()
+	for w := 0; w < cfg.Concurrency; w++ {
+		wg.Add(1)
+		go func(seed int64) {
+			defer wg.Done()
+			rng := rand.New(rand.NewSource(seed))
+			var latencies []time.Duration
+			var errors int
+			var firstErr error
+			for take() {
+				began := time.Now()
+				err := op(ctx, rng)
+				if err != nil {
+					// Requests cut off by the end of the run are not failures
+					if ctx.Err() != nil && cfg.Requests == 0 {
+						break
+					}
+					errors++
+					if firstErr == nil {
+						firstErr = err
+					}
+				}
+				latencies = append(latencies, time.Since(began))
+			}
+			mu.Lock()
+			result.latencies = append(result.latencies, latencies...)
+			result.Errors += errors
+			if result.FirstErr == nil {
+				result.FirstErr = firstErr
+			}
+			mu.Unlock()
+		}(time.Now().UnixNano() + int64(w))
+	}
+	wg.Wait()
+
+	result.Elapsed = time.Since(start)
+	result.Requests = len(result.latencies)
+	sort.Slice(result.latencies, func(i, j int) bool { return result.latencies[i] < result.latencies[j] })
+	return result
+}
+
+// Percentile returns the latency below which p percent of requests completed
+func (r *Result) Percentile(p float64) time.Duration {
+	if len(r.latencies) == 0 {
+		return 0
+	}
+	idx := int(float64(len(r.latencies))*p/100+0.5) - 1
+	if idx < 0 {
+		idx = 0
+	}
+	if idx >= len(r.latencies) {
+		idx = len(r.latencies) - 1
+	}
+	return r.latencies[idx]
+}
+
+// Throughput returns requests per second
+func (r *Result) Throughput() float64 {
+	if r.Elapsed <= 0 {
+		return 0
+	}
+	return float64(r.Requests) / r.Elapsed.Seconds()
+}
+
+// Report prints the result in a fixed layout
+func (r *Result) Report(w io.Writer, name string) {
+	fmt.Fprintf(w, "%s: %d requests, %d errors in %s (%.1f req/s)\n",
+		name, r.Requests, r.Errors, r.Elapsed.Round(time.Millisecond), r.Throughput())
+	fmt.Fprintf(w, "  p50 %s  p95 %s  p99 %s  max %s\n",
+		r.Percentile(50), r.Percentile(95), r.Percentile(99), r.Percentile(100))
+	if r.FirstErr != nil {
+		fmt.Fprintf(w, "  first error: %v\n", r.FirstErr)
+	}
+}
+
+// CardNumber returns a random Luhn-valid 16-digit Visa test number
+func CardNumber(rng *rand.Rand) string {
+	digits := make([]byte, 16)
+	digits[0] = '4'
+	for i := 1; i < 15; i++ {
+		digits[i] = byte('0' + rng.Intn(10))
+	}
+	sum := 0
+	for i := 14; i >= 0; i-- {
+		d := int(digits[i] - '0')
+		if (14-i)%2 == 0 {
+			d *= 2
+			if d > 9 {
+				d -= 9
+			}
+		}
+		sum += d
+	}
+	digits[15] = byte('0' + (10-sum%10)%10)
+	return string(digits)
+}
+
+// Payload returns a JSON order carrying value in its card_number field,
+// padded with line items to about size bytes
+func Payload(value string, size int) []byte {
+	order := map[string]interface{}{
+		"order_id":    "load-test",
+		"card_number": value,
+		"amount":      "19.99",
+	}
+	body, _ := json.Marshal(order)
+	// Each item adds 64 characters, two quotes and a comma
+	if n := (size - len(body)) / 67; n > 0 {
+		items := make([]string, n)
+		for i := range items {
+			items[i] = strings.Repeat("x", 64)
+		}
+		order["items"] = items
+		body, _ = json.Marshal(order)
+	}
+	return body
+}
+
+// pickToken returns a known token with probability hitRatio, otherwise a
+// random one the vault does not have
+func pickToken(rng *rand.Rand, tokens []string, hitRatio float64) string {
+	if len(tokens) > 0 && rng.Float64() < hitRatio {
+		return tokens[rng.Intn(len(tokens))]
+	}
+	b := make([]byte, 32)
+	rng.Read(b)
+	return "tok_" + base64.URLEncoding.EncodeToString(b)
+}
+
+// Proxy posts orders with fresh card numbers through the HTTP tokenizing
+// proxy at url
+func Proxy(client *http.Client, url string, cfg Config) Op {
+	return func(ctx context.Context, rng *rand.Rand) error {
+		req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewReader(Payload(CardNumber(rng), cfg.PayloadSize)))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		return do(client, req)
+	}
+}
+
+// ICAP sends orders carrying tokens through REQMOD detokenization
+func ICAP(client *icap.Client, tokens []string, cfg Config) Op {
+	return func(ctx context.Context, rng *rand.Rand) error {
+		body := Payload(pickToken(rng, tokens, cfg.TokenHitRatio), cfg.PayloadSize)
+		req, err := http.NewRequestWithContext(ctx, "POST", "http://gateway.example/charge", nil)
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		_, _, err = client.Reqmod(req, body)
+		return err
+	}
+}
+
+// API looks tokens up through GET /api/v1/tokens/{token}. Misses return
+// 404, which is the expected answer and not counted as an error.
+func API(client *http.Client, baseURL string, auth Auth, tokens []string, cfg Config) Op {
+	return func(ctx context.Context, rng *rand.Rand) error {
+		token := pickToken(rng, tokens, cfg.TokenHitRatio)
+		req, err := http.NewRequestWithContext(ctx, "GET", strings.TrimRight(baseURL, "/")+"/api/v1/tokens/"+token, nil)
+		if err != nil {
+			return err
+		}
+		auth.apply(req)
+		resp, err := client.Do(req)
+		if err != nil {
+			return err
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusNotFound {
+			return fmt.Errorf("GET token: %s", resp.Status)
+		}
+		return nil
+	}
+}
+
+// Auth holds API credentials: an API key or a session ID
+type Auth struct {
+	APIKey    string
+	SessionID string
+}
+
+func (a Auth) apply(req *http.Request) {
+	if a.APIKey != "" {
+		req.Header.Set("X-API-Key", a.APIKey)
+	}
+	if a.SessionID != "" {
+		req.Header.Set("Authorization", "Bearer "+a.SessionID)
+	}
+}
+
+// SeedTokens imports n synthetic cards through /api/v1/cards/import, which
+// needs system.admin, and returns their tokens for ICAP and API hits
+func SeedTokens(client *http.Client, baseURL string, auth Auth, n int, rng *rand.Rand) ([]string, error) {
+	type record struct {
+		CardNumber  string `json:"card_number"`
+		ExpiryMonth int    `json:"expiry_month"`
+		ExpiryYear  int    `json:"expiry_year"`
+	}
+	records := make([]record, n)
+	year := time.Now().Year() + 2
+	for i := range records {
+		records[i] = record{CardNumber: CardNumber(rng), ExpiryMonth: 12, ExpiryYear: year}
+	}
+	data, _ := json.Marshal(records)
+	body, _ := json.Marshal(map[string]interface{}{
+		"format":             "json",
+		"duplicate_handling": "skip",
+		"batch_size":         100,
+		"data":               base64.StdEncoding.EncodeToString(data),
+	})
+
+	req, err := http.NewRequest("POST", strings.TrimRight(baseURL, "/")+"/api/v1/cards/import", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	auth.apply(req)
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return nil, fmt.Errorf("card import: %s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+
+	var result struct {
+		TokensGenerated []struct {
+			Token string `json:"token"`
+		} `json:"tokens_generated"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, fmt.Errorf("card import: %v", err)
+	}
+	tokens := make([]string, 0, len(result.TokensGenerated))
+	for _, t := range result.TokensGenerated {
+		tokens = append(tokens, t.Token)
+	}
+	if len(tokens) == 0 {
+		return nil, fmt.Errorf("card import returned no tokens")
+	}
+	return tokens, nil
+}
+
+func do(client *http.Client, req *http.Request) error {
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode >= 500 {
+		return fmt.Errorf("%s %s: %s", req.Method, req.URL.Path, resp.Status)
+	}
+	return nil
+}
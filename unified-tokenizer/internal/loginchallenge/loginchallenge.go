@@ -0,0 +1,141 @@
+// Package loginchallenge implements the challenges a login must pass after
+// repeated failures: a proof-of-work puzzle the client solves by hashing, or
+// a CAPTCHA from hCaptcha or Cloudflare Turnstile whose answer the provider
+// confirms. Either makes each guess of a slow, distributed brute-force
+// attack cost the attacker more than a request.
+package loginchallenge
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/bits"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// Kind is the challenge asked for
+type Kind string
+
+const (
+	Off       Kind = "off"       // Logins are never challenged
+	Work      Kind = "pow"       // A proof-of-work puzzle
+	HCaptcha  Kind = "hcaptcha"  // An hCaptcha CAPTCHA
+	Turnstile Kind = "turnstile" // A Cloudflare Turnstile CAPTCHA
+)
+
+// Provider endpoints that confirm CAPTCHA answers
+const (
+	HCaptchaVerifyURL  = "https://api.hcaptcha.com/siteverify"
+	TurnstileVerifyURL = "https://challenges.cloudflare.com/turnstile/v0/siteverify"
+)
+
+// ParseKind parses a LOGIN_CHALLENGE value
+func ParseKind(s string) (Kind, error) {
+	switch kind := Kind(strings.ToLower(strings.TrimSpace(s))); kind {
+	case Off, Work, HCaptcha, Turnstile:
+		return kind, nil
+	case "":
+		return Off, nil
+	}
+	return "", fmt.Errorf("unknown login challenge %q: use off, pow, hcaptcha or turnstile", s)
+}
+
+// Captcha reports whether the kind is answered through a CAPTCHA provider
+func (k Kind) Captcha() bool {
+	return k == HCaptcha || k == Turnstile
+}
+
+// Solved reports whether solution solves the proof-of-work puzzle
+// challenge: the SHA-256 of "challenge:solution" must start with difficulty
+// zero bits
+func Solved(challenge, solution string, difficulty int) bool {
+	if solution == "" || len(solution) > 64 {
+		return false
+	}
+	sum := sha256.Sum256([]byte(challenge + ":" + solution))
+	return leadingZeros(sum[:]) >= difficulty
+}
+
+// Solve finds a solution to challenge by counting up from 0. Each more
+// bit of difficulty doubles the work, which on average is 2^difficulty
+// hashes.
+func Solve(challenge string, difficulty int) string {
+	for n := uint64(0); ; n++ {
+		solution := strconv.FormatUint(n, 10)
+		if Solved(challenge, solution, difficulty) {
+			return solution
+		}
+	}
+}
+
+func leadingZeros(sum []byte) int {
+	zeros := 0
+	for _, b := range sum {
+		if b != 0 {
+			return zeros + bits.LeadingZeros8(b)
+		}
+		zeros += 8
+	}
+	return zeros
+}
+
+// Verifier confirms CAPTCHA answers with the provider
+type Verifier struct {
+	Secret string
+	URL    string       // The provider's endpoint when empty
+	Client *http.Client // nil uses http.DefaultClient
+}
+
+// Verify asks the provider of kind whether response is a solved CAPTCHA,
+// solved from remoteIP. An error means the provider could not be asked.
+func (v *Verifier) Verify(ctx context.Context, kind Kind, response, remoteIP string) (bool, error) {
+	endpoint := v.URL
+	if endpoint == "" {
+		endpoint = HCaptchaVerifyURL
+		if kind == Turnstile {
+			endpoint = TurnstileVerifyURL
+		}
+	}
+	client := v.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	form := url.Values{"secret": {v.Secret}, "response": {response}}
+	if remoteIP != "" {
+		form.Set("remoteip", remoteIP)
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", endpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := client.Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return false, fmt.Errorf("%s answered %s", kind, resp.Status)
+	}
+
+	var result struct {
+		Success    bool     `json:"success"`
+		ErrorCodes []string `json:"error-codes"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 64<<10)).Decode(&result); err != nil {
+		return false, fmt.Errorf("%s answered unreadably: %v", kind, err)
+	}
+	// A bad secret is the server's fault, not the user's
+	for _, code := range result.ErrorCodes {
+		if code == "invalid-input-secret" || code == "missing-input-secret" {
+			return false, fmt.Errorf("%s rejected LOGIN_CHALLENGE_SECRET", kind)
+		}
+	}
+	return result.Success, nil
+}
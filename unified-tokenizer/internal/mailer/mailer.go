@@ -0,0 +1,162 @@
+// Package mailer sends the emails of user accounts, such as address
+// verification and password reset links. Sender is what the service calls;
+// SMTP delivers through a mail server, and tests or other transports can
+// supply their own.
+package mailer
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"mime"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"strings"
+	"time"
+
+	"tokenshield-unified/internal/securerand"
+)
+
+// Message is a plain-text email to one recipient
+type Message struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// Sender delivers messages
+type Sender interface {
+	Send(msg Message) error
+}
+
+// SMTP sends messages through a mail server. The connection is upgraded
+// with STARTTLS when the server offers it; a username and password are only
+// sent over an encrypted connection, or to localhost.
+type SMTP struct {
+	Addr      string // host:port
+	From      string // Address the messages are from
+	Username  string // For AUTH PLAIN; empty sends without authenticating
+	Password  string
+	Hostname  string        // Sent in EHLO
+	TLSConfig *tls.Config   // For STARTTLS; nil verifies the server's certificate against the system roots
+	Timeout   time.Duration // For the whole transaction
+}
+
+// Validate checks the server address and sender
+func (s *SMTP) Validate() error {
+	if _, _, err := net.SplitHostPort(s.Addr); err != nil {
+		return fmt.Errorf("invalid mail server address %q: want host:port", s.Addr)
+	}
+	if _, err := mail.ParseAddress(s.From); err != nil {
+		return fmt.Errorf("invalid from address %q", s.From)
+	}
+	return nil
+}
+
+// Send delivers msg
+func (s *SMTP) Send(msg Message) error {
+	data, err := s.Format(msg, time.Now())
+	if err != nil {
+		return err
+	}
+	from, _ := mail.ParseAddress(s.From)
+	to, _ := mail.ParseAddress(msg.To)
+
+	conn, err := net.DialTimeout("tcp", s.Addr, s.Timeout)
+	if err != nil {
+		return err
+	}
+	if s.Timeout > 0 {
+		conn.SetDeadline(time.Now().Add(s.Timeout))
+	}
+	host, _, _ := net.SplitHostPort(s.Addr)
+	c, err := smtp.NewClient(conn, host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer c.Close()
+	if s.Hostname != "" {
+		if err := c.Hello(s.Hostname); err != nil {
+			return err
+		}
+	}
+	if ok, _ := c.Extension("STARTTLS"); ok {
+		config := &tls.Config{ServerName: host}
+		if s.TLSConfig != nil {
+			config = s.TLSConfig.Clone()
+			if config.ServerName == "" {
+				config.ServerName = host
+			}
+		}
+		if err := c.StartTLS(config); err != nil {
+			return err
+		}
+	}
+	if s.Username != "" {
+		if err := c.Auth(smtp.PlainAuth("", s.Username, s.Password, host)); err != nil {
+			return err
+		}
+	}
+	if err := c.Mail(from.Address); err != nil {
+		return err
+	}
+	if err := c.Rcpt(to.Address); err != nil {
+		return err
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(data); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return c.Quit()
+}
+
+// Format returns msg as an RFC 5322 message
+func (s *SMTP) Format(msg Message, now time.Time) ([]byte, error) {
+	from, err := mail.ParseAddress(s.From)
+	if err != nil {
+		return nil, fmt.Errorf("invalid from address %q", s.From)
+	}
+	to, err := mail.ParseAddress(msg.To)
+	if err != nil {
+		return nil, fmt.Errorf("invalid recipient %q", msg.To)
+	}
+	if strings.ContainsAny(msg.Subject, "\r\n") {
+		return nil, errors.New("subject must be a single line")
+	}
+	domain := from.Address[strings.LastIndex(from.Address, "@")+1:]
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "From: %s\r\n", from.String())
+	fmt.Fprintf(&b, "To: %s\r\n", to.String())
+	fmt.Fprintf(&b, "Subject: %s\r\n", mimeHeader(msg.Subject))
+	fmt.Fprintf(&b, "Date: %s\r\n", now.Format(time.RFC1123Z))
+	fmt.Fprintf(&b, "Message-ID: <%x@%s>\r\n", securerand.Bytes(12), domain)
+	b.WriteString("MIME-Version: 1.0\r\n")
+	b.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	b.WriteString("Content-Transfer-Encoding: 8bit\r\n")
+	b.WriteString("\r\n")
+	body := strings.ReplaceAll(strings.ReplaceAll(msg.Body, "\r\n", "\n"), "\n", "\r\n")
+	b.WriteString(body)
+	if !strings.HasSuffix(body, "\r\n") {
+		b.WriteString("\r\n")
+	}
+	return []byte(b.String()), nil
+}
+
+// mimeHeader encodes a header value that is not plain ASCII
+func mimeHeader(value string) string {
+	for _, c := range value {
+		if c > 0x7e {
+			return mime.QEncoding.Encode("utf-8", value)
+		}
+	}
+	return value
+}
@@ -0,0 +1,372 @@
+// Package mailscan finds card numbers in email messages: in the Subject,
+// in text parts and in attachments that hold text. Transfer encodings and
+// character sets are decoded to look, and a part with replacements is
+// encoded again the way it came. Everything else in the message, including
+// parts with nothing to replace, is kept byte for byte. Binary attachments
+// cannot be scanned and are counted so they can be reported.
+package mailscan
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"io"
+	"mime"
+	"mime/quotedprintable"
+	"path"
+	"strings"
+	"unicode/utf8"
+
+	"tokenshield-unified/internal/charset"
+)
+
+// ErrMalformed is returned for a message whose MIME structure cannot be
+// followed, so parts of it could not be scanned
+var ErrMalformed = errors.New("malformed MIME message")
+
+// maxDepth bounds the nesting of multiparts and attached messages
+const maxDepth = 16
+
+// Replacer replaces the card numbers in text, returning the new text and
+// how many it replaced
+type Replacer func(text string) (string, int)
+
+// Result describes what a message held
+type Result struct {
+	MessageID string // The Message-ID header, if any
+	Replaced  int    // Card numbers replaced
+	Scanned   int    // Parts scanned, counting the Subject
+	Skipped   int    // Parts that could not be scanned: binary, or in an unknown charset or encoding
+}
+
+// Rewrite returns msg with replace applied to its Subject and to the text
+// of every part that holds text
+func Rewrite(msg []byte, replace Replacer) ([]byte, Result, error) {
+	w := &walker{replace: replace}
+	header, _ := splitHeader(msg)
+	if f, ok := findField(header, "Message-ID"); ok {
+		w.result.MessageID = strings.TrimSpace(f.value)
+	}
+	out, err := w.entity(msg, 0, true)
+	if err != nil {
+		return nil, w.result, err
+	}
+	return out, w.result, nil
+}
+
+type walker struct {
+	replace Replacer
+	result  Result
+}
+
+// entity rewrites one MIME entity, headers and body. message is set for a
+// whole message, whose Subject is scanned too.
+func (w *walker) entity(raw []byte, depth int, message bool) ([]byte, error) {
+	if depth > maxDepth {
+		return nil, ErrMalformed
+	}
+	header, body := splitHeader(raw)
+	if message {
+		header = w.subject(header)
+	}
+
+	contentType := "text/plain"
+	if f, ok := findField(header, "Content-Type"); ok {
+		contentType = f.value
+	}
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		// An unreadable Content-Type means text/plain (RFC 2045)
+		mediaType, params = "text/plain", nil
+	}
+
+	var newBody []byte
+	switch {
+	case strings.HasPrefix(mediaType, "multipart/"):
+		if params["boundary"] == "" {
+			return nil, ErrMalformed
+		}
+		newBody, err = w.multipart(body, params["boundary"], depth)
+	case mediaType == "message/rfc822":
+		newBody, err = w.entity(body, depth+1, true)
+	default:
+		newBody = w.leaf(header, body, mediaType, contentType, params)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return append(append(make([]byte, 0, len(header)+len(newBody)), header...), newBody...), nil
+}
+
+// multipart rewrites each part of a multipart body, keeping the preamble,
+// delimiters and epilogue as they are
+func (w *walker) multipart(body []byte, boundary string, depth int) ([]byte, error) {
+	delimiter := []byte("--" + boundary)
+	var out bytes.Buffer
+	copied, partStart := 0, -1
+	for from := 0; ; {
+		at := findDelimiter(body, delimiter, from)
+		if at < 0 {
+			return nil, ErrMalformed // No closing delimiter
+		}
+		if partStart >= 0 {
+			// The line break before a delimiter belongs to the delimiter
+			end := at
+			if end > partStart && body[end-1] == '\n' {
+				end--
+				if end > partStart && body[end-1] == '\r' {
+					end--
+				}
+			}
+			part, err := w.entity(body[partStart:end], depth+1, false)
+			if err != nil {
+				return nil, err
+			}
+			out.Write(part)
+			copied = end
+		}
+		lineEnd := len(body)
+		if i := bytes.IndexByte(body[at:], '\n'); i >= 0 {
+			lineEnd = at + i + 1
+		}
+		out.Write(body[copied:lineEnd])
+		copied = lineEnd
+		if bytes.HasPrefix(body[at+len(delimiter):], []byte("--")) {
+			out.Write(body[copied:])
+			return out.Bytes(), nil
+		}
+		partStart, from = lineEnd, lineEnd
+	}
+}
+
+// findDelimiter returns where the next delimiter line starts, at or after
+// from, or -1
+func findDelimiter(body, delimiter []byte, from int) int {
+	for from <= len(body) {
+		i := bytes.Index(body[from:], delimiter)
+		if i < 0 {
+			return -1
+		}
+		at := from + i
+		rest := body[at+len(delimiter):]
+		rest = bytes.TrimPrefix(rest, []byte("--"))
+		rest = bytes.TrimLeft(rest, " \t")
+		if (at == 0 || body[at-1] == '\n') && (len(rest) == 0 || rest[0] == '\r' || rest[0] == '\n') {
+			return at
+		}
+		from = at + 1
+	}
+	return -1
+}
+
+// leaf rewrites the body of a single part if it holds text
+func (w *walker) leaf(header, body []byte, mediaType, contentType string, params map[string]string) []byte {
+	filename := params["name"]
+	if f, ok := findField(header, "Content-Disposition"); ok {
+		if _, dparams, err := mime.ParseMediaType(f.value); err == nil && dparams["filename"] != "" {
+			filename = dparams["filename"]
+		}
+	}
+	if !textual(mediaType, filename) {
+		w.result.Skipped++
+		return body
+	}
+
+	transfer := ""
+	if f, ok := findField(header, "Content-Transfer-Encoding"); ok {
+		transfer = strings.ToLower(strings.TrimSpace(f.value))
+	}
+	decoded, err := decodeTransfer(transfer, body)
+	if err != nil {
+		w.result.Skipped++
+		return body
+	}
+	enc, err := charset.Detect(contentType, decoded)
+	if err != nil {
+		w.result.Skipped++
+		return body
+	}
+	text := string(decoded)
+	if !enc.Native() {
+		if text, err = enc.Decode(decoded); err != nil {
+			w.result.Skipped++
+			return body
+		}
+	}
+
+	w.result.Scanned++
+	replaced, n := w.replace(text)
+	if n == 0 {
+		return body
+	}
+	out := []byte(replaced)
+	if !enc.Native() {
+		if out, err = enc.Encode(replaced); err != nil {
+			return body // Replacements are ASCII, so this cannot happen
+		}
+	}
+	w.result.Replaced += n
+	return encodeTransfer(transfer, out, lineBreak(body), bytes.HasSuffix(body, []byte("\n")))
+}
+
+// subject replaces card numbers in the Subject header, decoding RFC 2047
+// encoded words first
+func (w *walker) subject(header []byte) []byte {
+	f, ok := findField(header, "Subject")
+	if !ok {
+		return header
+	}
+	text, err := new(mime.WordDecoder).DecodeHeader(f.value)
+	if err != nil {
+		text = f.value
+	}
+	w.result.Scanned++
+	replaced, n := w.replace(text)
+	if n == 0 {
+		return header
+	}
+	w.result.Replaced += n
+	value := strings.TrimSpace(replaced)
+	if !isASCII(value) {
+		value = mime.QEncoding.Encode("utf-8", value)
+	}
+	line := f.name + ": " + value + string(lineBreak(header))
+	return append(append(append([]byte(nil), header[:f.start]...), line...), header[f.end:]...)
+}
+
+// textual reports whether a part holds text that can be scanned
+func textual(mediaType, filename string) bool {
+	switch {
+	case strings.HasPrefix(mediaType, "text/"),
+		strings.HasSuffix(mediaType, "+json"), strings.HasSuffix(mediaType, "+xml"):
+		return true
+	}
+	switch mediaType {
+	case "application/json", "application/xml", "application/csv", "application/x-ndjson", "message/delivery-status":
+		return true
+	}
+	switch strings.ToLower(path.Ext(filename)) {
+	case ".txt", ".csv", ".tsv", ".json", ".xml", ".log", ".htm", ".html", ".eml":
+		return true
+	}
+	return false
+}
+
+func decodeTransfer(transfer string, body []byte) ([]byte, error) {
+	switch transfer {
+	case "base64":
+		clean := bytes.Map(func(r rune) rune {
+			if r == ' ' || r == '\t' || r == '\r' || r == '\n' {
+				return -1
+			}
+			return r
+		}, body)
+		return base64.StdEncoding.DecodeString(string(clean))
+	case "quoted-printable":
+		return io.ReadAll(quotedprintable.NewReader(bytes.NewReader(body)))
+	case "", "7bit", "8bit", "binary":
+		return body, nil
+	}
+	return nil, errors.New("unknown transfer encoding " + transfer)
+}
+
+// encodeTransfer encodes body with the transfer encoding, using eol for
+// line breaks and ending with one when trailing is set
+func encodeTransfer(transfer string, body []byte, eol []byte, trailing bool) []byte {
+	var out bytes.Buffer
+	switch transfer {
+	case "base64":
+		encoded := base64.StdEncoding.EncodeToString(body)
+		for len(encoded) > 76 {
+			out.WriteString(encoded[:76])
+			out.Write(eol)
+			encoded = encoded[76:]
+		}
+		out.WriteString(encoded)
+		if trailing {
+			out.Write(eol)
+		}
+	case "quoted-printable":
+		qp := quotedprintable.NewWriter(&out)
+		qp.Write(body)
+		qp.Close()
+		if string(eol) == "\n" {
+			return bytes.ReplaceAll(out.Bytes(), []byte("\r\n"), []byte("\n"))
+		}
+	default:
+		return body
+	}
+	return out.Bytes()
+}
+
+// lineBreak returns the line break raw uses
+func lineBreak(raw []byte) []byte {
+	if i := bytes.IndexByte(raw, '\n'); i > 0 && raw[i-1] == '\r' {
+		return []byte("\r\n")
+	} else if i >= 0 {
+		return []byte("\n")
+	}
+	return []byte("\r\n")
+}
+
+// splitHeader splits an entity after the blank line ending its header. An
+// entity without one is all header.
+func splitHeader(raw []byte) (header, body []byte) {
+	for i := 0; i < len(raw); {
+		j := bytes.IndexByte(raw[i:], '\n')
+		if j < 0 {
+			break
+		}
+		if len(bytes.TrimRight(raw[i:i+j+1], "\r\n")) == 0 {
+			return raw[:i+j+1], raw[i+j+1:]
+		}
+		i += j + 1
+	}
+	return raw, nil
+}
+
+// field is a header field, with folded lines joined, at header[start:end]
+type field struct {
+	name, value string
+	start, end  int
+}
+
+// findField returns the first field named name
+func findField(header []byte, name string) (field, bool) {
+	var f field
+	found := false
+	for i := 0; i < len(header); {
+		end := len(header)
+		if j := bytes.IndexByte(header[i:], '\n'); j >= 0 {
+			end = i + j + 1
+		}
+		line := strings.TrimRight(string(header[i:end]), "\r\n")
+		switch {
+		case line == "":
+		case line[0] == ' ' || line[0] == '\t':
+			if found {
+				f.value += " " + strings.TrimSpace(line)
+				f.end = end
+			}
+		case found:
+			return f, true
+		default:
+			fieldName, value, ok := strings.Cut(line, ":")
+			if ok && strings.EqualFold(strings.TrimSpace(fieldName), name) {
+				f = field{name: strings.TrimSpace(fieldName), value: strings.TrimSpace(value), start: i, end: end}
+				found = true
+			}
+		}
+		i = end
+	}
+	return f, found
+}
+
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= utf8.RuneSelf {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,95 @@
+// Package maintenance renders the page the proxy answers with while
+// maintenance mode is on. The embedded page can be replaced with a
+// template of the site's own, which gets the same data.
+package maintenance
+
+import (
+	"bytes"
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//go:embed maintenance.html
+var defaultPage string
+
+// DefaultMessage is shown when maintenance mode is turned on without one
+const DefaultMessage = "We are carrying out scheduled maintenance and will be back shortly."
+
+// Data is what a page template is executed with
+type Data struct {
+	Message           string
+	RetryAfterSeconds int
+	RetryAfterMinutes int
+}
+
+// Page is a parsed maintenance page template
+type Page struct {
+	tmpl *template.Template
+}
+
+// Default returns the embedded page
+func Default() *Page {
+	return &Page{tmpl: template.Must(template.New("maintenance").Parse(defaultPage))}
+}
+
+// Load parses the template in file, failing if it cannot be read, parsed
+// or executed with sample data
+func Load(file string) (*Page, error) {
+	text, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	tmpl, err := template.New("maintenance").Parse(string(text))
+	if err != nil {
+		return nil, err
+	}
+	p := &Page{tmpl: tmpl}
+	if _, err := p.render(DefaultMessage, time.Minute); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+func (p *Page) render(message string, retryAfter time.Duration) ([]byte, error) {
+	seconds := int(retryAfter / time.Second)
+	data := Data{Message: message, RetryAfterSeconds: seconds, RetryAfterMinutes: (seconds + 59) / 60}
+	var b bytes.Buffer
+	if err := p.tmpl.Execute(&b, data); err != nil {
+		return nil, fmt.Errorf("maintenance page: %v", err)
+	}
+	return b.Bytes(), nil
+}
+
+// Serve answers 503 with Retry-After: the page for browsers, and a JSON
+// body for clients that ask for JSON rather than HTML
+func (p *Page) Serve(w http.ResponseWriter, r *http.Request, message string, retryAfter time.Duration) {
+	if message == "" {
+		message = DefaultMessage
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(int(retryAfter/time.Second)))
+	w.Header().Set("Cache-Control", "no-store")
+
+	accept := r.Header.Get("Accept")
+	if strings.Contains(accept, "application/json") && !strings.Contains(accept, "text/html") {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusServiceUnavailable)
+		json.NewEncoder(w).Encode(map[string]string{"error": "maintenance", "message": message})
+		return
+	}
+	body, err := p.render(message, retryAfter)
+	if err != nil {
+		body = []byte(template.HTMLEscapeString(message))
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(http.StatusServiceUnavailable)
+	if r.Method != "HEAD" {
+		w.Write(body)
+	}
+}
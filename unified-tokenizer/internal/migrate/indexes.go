@@ -0,0 +1,93 @@
+package migrate
+
+import (
+	"context"
+	"database/sql"
+	"strings"
+)
+
+// Index is an index the service's queries rely on. Any index whose leading
+// columns are Columns, in order, serves.
+type Index struct {
+	Table   string   `json:"table"`
+	Columns []string `json:"columns"`
+	UsedBy  string   `json:"used_by"`
+}
+
+// ExpectedIndexes are the indexes the migrations create for queries over
+// the large tables. A database missing one still works, but the queries
+// scan the table.
+var ExpectedIndexes = []Index{
+	{Table: "credit_cards", Columns: []string{"token"}, UsedBy: "token lookups"},
+	{Table: "credit_cards", Columns: []string{"card_number_index"}, UsedBy: "finding a card's token"},
+	{Table: "credit_cards", Columns: []string{"card_holder_name_index"}, UsedBy: "search by cardholder name"},
+	{Table: "credit_cards", Columns: []string{"external_id_index"}, UsedBy: "search by external ID"},
+	{Table: "credit_cards", Columns: []string{"created_at"}, UsedBy: "token list sorted by creation"},
+	{Table: "credit_cards", Columns: []string{"is_active", "created_at"}, UsedBy: "active token list"},
+	{Table: "credit_cards", Columns: []string{"last_four_digits", "created_at"}, UsedBy: "search by last four digits"},
+	{Table: "credit_cards", Columns: []string{"card_type", "created_at"}, UsedBy: "search by card type"},
+	{Table: "credit_cards", Columns: []string{"tenant", "created_at"}, UsedBy: "search by tenant"},
+	{Table: "credit_cards", Columns: []string{"created_by", "created_at"}, UsedBy: "token list of a card owner"},
+	{Table: "credit_cards", Columns: []string{"encryption_key_id"}, UsedBy: "key rotation and re-encryption"},
+	{Table: "credit_cards", Columns: []string{"purge_after"}, UsedBy: "purging revoked tokens"},
+	{Table: "token_requests", Columns: []string{"token", "request_timestamp"}, UsedBy: "token usage history"},
+	{Table: "token_requests", Columns: []string{"request_timestamp"}, UsedBy: "activity feed and request time series"},
+	{Table: "token_requests", Columns: []string{"request_type", "request_timestamp"}, UsedBy: "activity feed filtered by type"},
+}
+
+// MissingIndexes returns the expected indexes the database lacks
+func MissingIndexes(ctx context.Context, db *sql.DB) ([]Index, error) {
+	rows, err := db.QueryContext(ctx, `
+		SELECT TABLE_NAME, INDEX_NAME, COLUMN_NAME FROM information_schema.STATISTICS
+		WHERE TABLE_SCHEMA = DATABASE()
+		ORDER BY TABLE_NAME, INDEX_NAME, SEQ_IN_INDEX`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	// Columns of each index, keyed by table
+	indexes := make(map[string]map[string][]string)
+	for rows.Next() {
+		var table, index, column string
+		if err := rows.Scan(&table, &index, &column); err != nil {
+			return nil, err
+		}
+		if indexes[table] == nil {
+			indexes[table] = make(map[string][]string)
+		}
+		indexes[table][index] = append(indexes[table][index], strings.ToLower(column))
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return missing(ExpectedIndexes, indexes), nil
+}
+
+// missing returns the expected indexes that no index in indexes starts
+// with
+func missing(expected []Index, indexes map[string]map[string][]string) []Index {
+	var out []Index
+	for _, want := range expected {
+		found := false
+		for _, columns := range indexes[want.Table] {
+			found = found || hasPrefix(columns, want.Columns)
+		}
+		if !found {
+			out = append(out, want)
+		}
+	}
+	return out
+}
+
+func hasPrefix(columns, prefix []string) bool {
+	if len(columns) < len(prefix) {
+		return false
+	}
+	for i, column := range prefix {
+		if columns[i] != column {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,3 @@
+-- Baseline: the tables in database/schema.sql.
+-- Databases created from schema.sql are recorded at this version; later
+-- migrations alter the schema from here and are mirrored in schema.sql.
@@ -0,0 +1,10 @@
+-- Key share configuration for sealed-boot mode (SEAL_MODE=shamir).
+-- Written once by `unified-tokenizer unseal-init`; the shares themselves
+-- are never stored.
+CREATE TABLE IF NOT EXISTS seal_config (
+    id TINYINT PRIMARY KEY,
+    shares INT NOT NULL,
+    threshold INT NOT NULL,
+    check_value VARBINARY(128) NOT NULL COMMENT 'Known value sealed with the master key, to verify a reconstructed key',
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
@@ -0,0 +1,14 @@
+-- Scheduled key rotation: rotate the active KEK or DEK once it is
+-- interval_days old (see /api/v1/keys/policies).
+CREATE TABLE IF NOT EXISTS key_rotation_policies (
+    key_type ENUM('KEK', 'DEK') PRIMARY KEY,
+    enabled BOOLEAN NOT NULL DEFAULT TRUE,
+    interval_days INT NOT NULL,
+    reencrypt BOOLEAN NOT NULL DEFAULT TRUE COMMENT 'Re-encrypt cards after a scheduled DEK rotation',
+    last_run_at TIMESTAMP NULL,
+    last_status VARCHAR(20) COMMENT 'running, completed, failed, or skipped when a pre-rotation check failed',
+    last_rotation_id VARCHAR(64),
+    last_error TEXT,
+    updated_by VARCHAR(100),
+    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
@@ -0,0 +1,7 @@
+-- Blind index for cardholder name search. The HMAC key is stored as an
+-- INDEX row in encryption_keys, wrapped by the KEK like a DEK.
+ALTER TABLE encryption_keys MODIFY key_type ENUM('KEK', 'DEK', 'INDEX') NOT NULL;
+
+ALTER TABLE credit_cards
+    ADD COLUMN card_holder_name_index VARBINARY(32) NULL COMMENT 'HMAC-SHA256 blind index of the normalized cardholder name' AFTER card_holder_name_encrypted,
+    ADD INDEX idx_card_holder_name_index (card_holder_name_index);
@@ -0,0 +1,5 @@
+-- Blind index over the full card number, replacing the decrypt-and-compare
+-- scan over cards sharing the same last four digits
+ALTER TABLE credit_cards
+    ADD COLUMN card_number_index VARBINARY(32) NULL COMMENT 'HMAC-SHA256 blind index of the card number' AFTER card_number_encrypted,
+    ADD INDEX idx_card_number_index (card_number_index);
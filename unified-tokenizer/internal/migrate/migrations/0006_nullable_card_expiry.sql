@@ -0,0 +1,12 @@
+-- Proxied cards were stored with a placeholder expiry of 12/2025. Expiry is
+-- now taken from the request when present and left NULL when unknown.
+ALTER TABLE credit_cards
+    MODIFY expiry_month TINYINT NULL,
+    MODIFY expiry_year SMALLINT NULL;
+
+-- Clear the placeholder on cards first stored through the proxy, which are
+-- the ones with a tokenize request logged; imported cards never log one
+UPDATE credit_cards
+SET expiry_month = NULL, expiry_year = NULL
+WHERE expiry_month = 12 AND expiry_year = 2025
+  AND token IN (SELECT token FROM token_requests WHERE request_type = 'tokenize');
@@ -0,0 +1,19 @@
+-- Vault integrity check runs and their reconciliation reports (see
+-- `unified-tokenizer verify` and /api/v1/integrity/checks)
+CREATE TABLE IF NOT EXISTS integrity_checks (
+    id BIGINT AUTO_INCREMENT PRIMARY KEY,
+    check_id VARCHAR(64) UNIQUE NOT NULL,
+    schedule_slot BIGINT NULL UNIQUE COMMENT 'Interval claimed by a scheduled run, so one replica runs each',
+    status ENUM('running', 'completed', 'failed') NOT NULL DEFAULT 'running',
+    started_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    completed_at TIMESTAMP NULL,
+    cards_checked INT NOT NULL DEFAULT 0,
+    decrypt_failures INT NOT NULL DEFAULT 0,
+    digit_mismatches INT NOT NULL DEFAULT 0,
+    luhn_failures INT NOT NULL DEFAULT 0,
+    orphaned_requests INT NOT NULL DEFAULT 0,
+    issues JSON COMMENT 'Up to 1000 findings naming the token and check, never card data',
+    error_message TEXT,
+    initiated_by VARCHAR(100),
+    INDEX idx_integrity_completed (status, completed_at)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
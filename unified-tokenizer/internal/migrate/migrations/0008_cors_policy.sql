@@ -0,0 +1,8 @@
+-- CORS policy set through /api/v1/cors; without a row the CORS_* settings
+-- apply
+CREATE TABLE IF NOT EXISTS cors_policy (
+    id TINYINT PRIMARY KEY COMMENT 'Always 1',
+    policy JSON NOT NULL,
+    updated_by VARCHAR(100),
+    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
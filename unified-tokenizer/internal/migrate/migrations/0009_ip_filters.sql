@@ -0,0 +1,8 @@
+-- Client address filters for the API and ICAP ports set through
+-- /api/v1/ip-filters; without a row a port uses the *_CIDRS settings
+CREATE TABLE IF NOT EXISTS ip_filters (
+    scope VARCHAR(16) PRIMARY KEY COMMENT 'api or icap',
+    rules JSON NOT NULL,
+    updated_by VARCHAR(100),
+    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
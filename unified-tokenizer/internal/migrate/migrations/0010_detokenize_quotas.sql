@@ -0,0 +1,22 @@
+-- Detokenization quota overrides per user or API key; without a row the
+-- DETOKENIZE_QUOTA_* settings apply
+CREATE TABLE IF NOT EXISTS detokenize_quotas (
+    subject_type VARCHAR(16) NOT NULL COMMENT 'user or api_key',
+    subject_id VARCHAR(64) NOT NULL COMMENT 'user_id or api_key',
+    hourly_limit INT NULL COMMENT 'NULL for the default, 0 for unlimited',
+    daily_limit INT NULL COMMENT 'NULL for the default, 0 for unlimited',
+    updated_by VARCHAR(100),
+    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP,
+    PRIMARY KEY (subject_type, subject_id)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+
+-- Detokenizations counted per user or API key and UTC hour or day
+CREATE TABLE IF NOT EXISTS detokenize_usage (
+    subject_type VARCHAR(16) NOT NULL,
+    subject_id VARCHAR(64) NOT NULL,
+    period VARCHAR(8) NOT NULL COMMENT 'hour or day',
+    period_start DATETIME NOT NULL,
+    used INT NOT NULL DEFAULT 0,
+    PRIMARY KEY (subject_type, subject_id, period, period_start),
+    INDEX idx_detokenize_usage_start (period_start)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
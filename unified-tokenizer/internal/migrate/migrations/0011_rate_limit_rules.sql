@@ -0,0 +1,18 @@
+-- Rate-limit rules set through /api/v1/rate-limits; without a row the
+-- RATE_LIMIT_RULES setting applies
+CREATE TABLE IF NOT EXISTS rate_limit_rules (
+    id TINYINT PRIMARY KEY COMMENT 'Always 1',
+    rules JSON NOT NULL,
+    updated_by VARCHAR(100),
+    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+
+-- Request counters shared by all replicas with RATE_LIMIT_BACKEND=database
+CREATE TABLE IF NOT EXISTS rate_limit_counters (
+    bucket VARCHAR(128) PRIMARY KEY COMMENT 'Rule and hashed client',
+    window_start DATETIME(6) NOT NULL,
+    window_end DATETIME(6) NOT NULL,
+    hits INT NOT NULL DEFAULT 0,
+    blocked_until DATETIME(6) NULL,
+    INDEX idx_rate_limit_window_end (window_end)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
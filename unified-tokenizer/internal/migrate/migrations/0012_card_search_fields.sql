@@ -0,0 +1,7 @@
+-- The client's reference ID and tenant of imported cards, so tokens can be
+-- searched by them. Both stay NULL for cards tokenized through the proxy.
+ALTER TABLE credit_cards
+    ADD COLUMN external_id VARCHAR(64) NULL COMMENT 'Client reference ID given at import' AFTER expiry_year,
+    ADD COLUMN tenant VARCHAR(64) NULL COMMENT 'Tenant the card was imported for' AFTER external_id,
+    ADD INDEX idx_external_id (external_id),
+    ADD INDEX idx_tenant_created (tenant, created_at);
@@ -0,0 +1,10 @@
+-- Users created through the API had full_name HTML-escaped before it was
+-- stored ("O'Brien" became "O&#39;Brien"). Values are now stored as given
+-- and encoded on output, so undo the escaping. &amp; goes last so that an
+-- escaped "&lt;" typed by the user comes back as "&lt;". Names only ever
+-- set through PUT /api/v1/users/{id} were not escaped; one that happens to
+-- contain an entity is decoded too.
+UPDATE users
+SET full_name = REPLACE(REPLACE(REPLACE(REPLACE(REPLACE(full_name,
+        '&lt;', '<'), '&gt;', '>'), '&#34;', '"'), '&#39;', ''''), '&amp;', '&')
+WHERE full_name LIKE '%&%;%';
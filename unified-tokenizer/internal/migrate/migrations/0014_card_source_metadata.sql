@@ -0,0 +1,6 @@
+-- Where a card was tokenized and the metadata given at import, so the token
+-- detail endpoint can answer support questions without database access.
+-- Cards stored before this migration have no source.
+ALTER TABLE credit_cards
+    ADD COLUMN source VARCHAR(16) NULL COMMENT 'How the card was tokenized: proxy or import' AFTER tenant,
+    ADD COLUMN metadata JSON NULL COMMENT 'Client metadata given at import' AFTER source;
@@ -0,0 +1,7 @@
+-- Revoked tokens can be restored until purge_after, when the card is
+-- deleted. Tokens revoked before this migration have no purge date and are
+-- kept until restored.
+ALTER TABLE credit_cards
+    ADD COLUMN revoked_at TIMESTAMP NULL AFTER is_active,
+    ADD COLUMN purge_after TIMESTAMP NULL COMMENT 'When a revoked card is deleted; NULL keeps it' AFTER revoked_at,
+    ADD INDEX idx_purge_after (purge_after);
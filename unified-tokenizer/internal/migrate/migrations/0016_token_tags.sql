@@ -0,0 +1,10 @@
+-- Key/value tags on tokens, deleted with the card
+CREATE TABLE IF NOT EXISTS token_tags (
+    token VARCHAR(64) NOT NULL,
+    tag_key VARCHAR(64) NOT NULL,
+    tag_value VARCHAR(255) NOT NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (token, tag_key),
+    INDEX idx_token_tags_key_value (tag_key, tag_value),
+    CONSTRAINT fk_token_tags_token FOREIGN KEY (token) REFERENCES credit_cards(token) ON DELETE CASCADE
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
@@ -0,0 +1,19 @@
+-- Settlement files picked up from the batch inbox. A file is claimed by
+-- inserting its row, so each is processed by one replica and only once.
+CREATE TABLE IF NOT EXISTS batch_files (
+    id BIGINT AUTO_INCREMENT PRIMARY KEY,
+    file_id VARCHAR(64) UNIQUE NOT NULL,
+    file_name VARCHAR(255) NOT NULL,
+    file_sha256 CHAR(64) NOT NULL,
+    status ENUM('processing', 'completed', 'failed') NOT NULL DEFAULT 'processing',
+    started_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    completed_at TIMESTAMP NULL,
+    rows_processed INT NOT NULL DEFAULT 0,
+    cards_tokenized INT NOT NULL DEFAULT 0,
+    cards_masked INT NOT NULL DEFAULT 0,
+    row_errors INT NOT NULL DEFAULT 0,
+    archive_name VARCHAR(255) NULL COMMENT 'Encrypted original in BATCH_ARCHIVE_DIR',
+    error_message TEXT,
+    UNIQUE KEY uq_batch_file (file_name, file_sha256),
+    INDEX idx_batch_files_started (started_at)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
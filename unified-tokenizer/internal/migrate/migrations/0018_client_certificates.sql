@@ -0,0 +1,17 @@
+-- Client certificate identities for mTLS on the API port. A verified
+-- certificate whose URI, DNS or email SAN or subject CN matches identity
+-- acts as user_id, limited to permissions.
+CREATE TABLE IF NOT EXISTS client_certificates (
+    id INT AUTO_INCREMENT PRIMARY KEY,
+    cert_id VARCHAR(64) UNIQUE NOT NULL,
+    identity VARCHAR(255) UNIQUE NOT NULL COMMENT 'URI:..., DNS:..., EMAIL:... or CN=...',
+    client_name VARCHAR(100) NOT NULL,
+    user_id VARCHAR(64) NOT NULL COMMENT 'User whose permissions the identity is limited to',
+    permissions JSON NOT NULL,
+    is_active BOOLEAN DEFAULT TRUE,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    last_used_at TIMESTAMP NULL,
+    created_by VARCHAR(64) COMMENT 'user_id of creator',
+    INDEX idx_client_certificates_user (user_id),
+    CONSTRAINT fk_client_certificate_user FOREIGN KEY (user_id) REFERENCES users(user_id) ON DELETE CASCADE
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
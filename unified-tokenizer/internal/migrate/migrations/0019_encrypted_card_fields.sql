@@ -0,0 +1,18 @@
+-- Encrypted copies of the external ID, import metadata and audit details.
+-- Card fields use the card's DEK (encryption_key_id); audit rows record
+-- their own. The tokenizer encrypts existing plaintext values into these
+-- columns at startup and then clears the plaintext ones, which are kept
+-- only until that has run.
+ALTER TABLE credit_cards
+    ADD COLUMN external_id_encrypted VARBINARY(255) NULL AFTER external_id,
+    ADD COLUMN external_id_index VARBINARY(32) NULL COMMENT 'HMAC-SHA256 blind index of the external ID' AFTER external_id_encrypted,
+    ADD COLUMN metadata_encrypted BLOB NULL AFTER metadata,
+    ADD INDEX idx_external_id_index (external_id_index);
+
+ALTER TABLE user_audit_log
+    ADD COLUMN details_encrypted MEDIUMBLOB NULL AFTER details,
+    ADD COLUMN details_key_id VARCHAR(64) NULL COMMENT 'DEK of details_encrypted; NULL for the legacy key' AFTER details_encrypted;
+
+ALTER TABLE security_audit_log
+    ADD COLUMN details_encrypted MEDIUMBLOB NULL AFTER details,
+    ADD COLUMN details_key_id VARCHAR(64) NULL COMMENT 'DEK of details_encrypted; NULL for the legacy key' AFTER details_encrypted;
@@ -0,0 +1,8 @@
+-- Card field rules for proxied JSON set through /api/v1/config/field-rules;
+-- without a row CARD_FIELD_MAPPINGS and DEEP_SCAN_FIELDS apply
+CREATE TABLE IF NOT EXISTS field_rules (
+    id TINYINT PRIMARY KEY COMMENT 'Always 1',
+    rules JSON NOT NULL,
+    updated_by VARCHAR(100),
+    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
@@ -0,0 +1,8 @@
+-- Maintenance mode and the config freeze set through /api/v1/maintenance;
+-- without a row both are off
+CREATE TABLE IF NOT EXISTS maintenance_mode (
+    id TINYINT PRIMARY KEY COMMENT 'Always 1',
+    state JSON NOT NULL,
+    updated_by VARCHAR(100),
+    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
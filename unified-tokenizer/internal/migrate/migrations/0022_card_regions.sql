@@ -0,0 +1,4 @@
+-- The region that tokenized each card in a replicated deployment (REGION).
+-- Cards stored before this migration, or without REGION, have none.
+ALTER TABLE credit_cards
+    ADD COLUMN region VARCHAR(8) NULL COMMENT 'REGION of the site that tokenized the card' AFTER source;
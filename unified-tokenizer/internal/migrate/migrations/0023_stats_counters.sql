@@ -0,0 +1,34 @@
+-- Running totals behind /api/v1/stats, the status page and /metrics, kept
+-- up to date by the application so they are not counted over credit_cards
+-- and token_requests on each call. Each region writes rows of its own and
+-- readers add them up, so replicated sites never update the same row.
+CREATE TABLE IF NOT EXISTS stats_counters (
+    name VARCHAR(64) NOT NULL COMMENT 'active_tokens, or requests:<request_type>',
+    region VARCHAR(8) NOT NULL DEFAULT '',
+    value BIGINT NOT NULL DEFAULT 0,
+    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP,
+    PRIMARY KEY (name, region)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+
+-- Token requests per minute, kept for two days for the 24 hour figures
+CREATE TABLE IF NOT EXISTS token_request_minutes (
+    minute BIGINT NOT NULL COMMENT 'Unix time divided by 60',
+    region VARCHAR(8) NOT NULL DEFAULT '',
+    request_type VARCHAR(20) NOT NULL,
+    requests BIGINT NOT NULL DEFAULT 0,
+    errors BIGINT NOT NULL DEFAULT 0,
+    PRIMARY KEY (minute, region, request_type)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+
+-- Start from the counts of the rows already stored
+INSERT IGNORE INTO stats_counters (name, region, value)
+SELECT 'active_tokens', '', COUNT(*) FROM credit_cards WHERE is_active = TRUE;
+
+INSERT IGNORE INTO stats_counters (name, region, value)
+SELECT CONCAT('requests:', request_type), '', COUNT(*) FROM token_requests GROUP BY request_type;
+
+INSERT IGNORE INTO token_request_minutes (minute, region, request_type, requests, errors)
+SELECT FLOOR(UNIX_TIMESTAMP(request_timestamp) / 60), '', request_type, COUNT(*), COALESCE(SUM(response_status >= 400), 0)
+FROM token_requests
+WHERE request_timestamp >= DATE_SUB(NOW(), INTERVAL 1 DAY)
+GROUP BY 1, 3;
@@ -0,0 +1,15 @@
+-- Indexes for the token list and search, which filter on is_active,
+-- card_type or last_four_digits and sort by created_at, and for the
+-- activity feed and request time series, which filter and sort on
+-- request_timestamp. The composites replace idx_last_four and
+-- idx_request_type, which lead with the same column.
+ALTER TABLE credit_cards
+    ADD INDEX idx_active_created (is_active, created_at),
+    ADD INDEX idx_card_type_created (card_type, created_at),
+    ADD INDEX idx_last_four_created (last_four_digits, created_at),
+    DROP INDEX idx_last_four;
+
+ALTER TABLE token_requests
+    ADD INDEX idx_request_timestamp (request_timestamp),
+    ADD INDEX idx_type_timestamp (request_type, request_timestamp),
+    DROP INDEX idx_request_type;
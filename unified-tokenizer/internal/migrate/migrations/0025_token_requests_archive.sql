@@ -0,0 +1,19 @@
+-- token_requests rows older than TOKEN_REQUEST_RETENTION_DAYS, moved here
+-- with TOKEN_REQUEST_ARCHIVE=table. There is no foreign key to
+-- credit_cards, so rows are kept until TOKEN_REQUEST_ARCHIVE_RETENTION_DAYS
+-- or until the token's card is purged.
+CREATE TABLE IF NOT EXISTS token_requests_archive (
+    id BIGINT PRIMARY KEY COMMENT 'token_requests.id',
+    token VARCHAR(64) NOT NULL,
+    user_id VARCHAR(64),
+    api_key_used VARCHAR(64),
+    request_type ENUM('tokenize', 'detokenize', 'forward') NOT NULL,
+    source_ip VARCHAR(45),
+    destination_url TEXT,
+    request_timestamp TIMESTAMP NULL,
+    response_status INT,
+    response_time_ms INT,
+    archived_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    INDEX idx_archive_token (token),
+    INDEX idx_archive_timestamp (request_timestamp)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
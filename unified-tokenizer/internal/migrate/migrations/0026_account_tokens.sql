@@ -0,0 +1,16 @@
+-- One-time links mailed to users: email address verification and password
+-- reset. Only a SHA-256 hash of each token is stored, so the table cannot
+-- be used to take over an account. email is the address a verification
+-- link was sent to; the link stops working if the user changes it.
+CREATE TABLE IF NOT EXISTS account_tokens (
+    token_hash CHAR(64) PRIMARY KEY COMMENT 'Hex SHA-256 of the token',
+    user_id VARCHAR(64) NOT NULL,
+    purpose ENUM('verify_email', 'reset_password') NOT NULL,
+    email VARCHAR(255) NOT NULL,
+    expires_at TIMESTAMP NOT NULL,
+    used_at TIMESTAMP NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    INDEX idx_account_tokens_user (user_id, purpose),
+    INDEX idx_account_tokens_expires (expires_at),
+    CONSTRAINT fk_account_tokens_user FOREIGN KEY (user_id) REFERENCES users(user_id) ON DELETE CASCADE
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
@@ -0,0 +1,29 @@
+-- Roles are rows instead of a fixed ENUM, so custom roles can be composed
+-- of the existing permissions. A user has the permissions of their role
+-- plus any granted to them individually in users.permissions. The three
+-- built-in roles keep what they granted before.
+CREATE TABLE IF NOT EXISTS roles (
+    name VARCHAR(32) PRIMARY KEY,
+    description VARCHAR(255) NOT NULL DEFAULT '',
+    permissions JSON NOT NULL,
+    built_in BOOLEAN NOT NULL DEFAULT FALSE COMMENT 'Cannot be deleted; admin cannot be changed',
+    created_by VARCHAR(64),
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+
+INSERT IGNORE INTO roles (name, description, permissions, built_in) VALUES
+    ('admin', 'Full access', JSON_ARRAY('system.admin'), TRUE),
+    ('operator', 'Create, search and revoke tokens', JSON_ARRAY('tokens.read', 'tokens.write', 'tokens.delete', 'tokens.read_pii', 'activity.read', 'stats.read'), TRUE),
+    ('viewer', 'Read-only access to tokens and activity', JSON_ARRAY('tokens.read', 'activity.read', 'stats.read'), TRUE);
+
+ALTER TABLE users
+    MODIFY role VARCHAR(32) NOT NULL DEFAULT 'viewer',
+    ADD CONSTRAINT fk_users_role FOREIGN KEY (role) REFERENCES roles(name);
+
+-- Operators and viewers were created with a copy of their role's
+-- permissions. Those copies are dropped so that changing the role changes
+-- what its users can do; permissions granted beyond the copy are kept.
+UPDATE users SET permissions = JSON_ARRAY()
+WHERE (role = 'operator' AND permissions = CAST('["tokens.read", "tokens.write", "tokens.delete", "activity.read", "stats.read"]' AS JSON))
+   OR (role = 'viewer' AND permissions = CAST('["tokens.read", "activity.read", "stats.read"]' AS JSON));
@@ -0,0 +1,5 @@
+-- The user imported cards belong to, so users with tokens.own can list and
+-- revoke theirs. API keys already record their owner in user_id.
+ALTER TABLE credit_cards
+    ADD COLUMN created_by VARCHAR(64) NULL COMMENT 'user_id of the user an imported card belongs to' AFTER region,
+    ADD INDEX idx_created_by_created (created_by, created_at);
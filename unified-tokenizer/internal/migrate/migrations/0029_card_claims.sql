@@ -0,0 +1,11 @@
+-- One row per card number being tokenized with DETERMINISTIC_TOKENS or
+-- imported with duplicate detection, keyed by its blind index. The first
+-- request to insert a card's row stores it under token; concurrent ones
+-- wait for that token instead of issuing another. A row whose token was
+-- revoked or purged is replaced by the next request for the card.
+CREATE TABLE IF NOT EXISTS card_claims (
+    card_number_index VARBINARY(32) PRIMARY KEY COMMENT 'Blind index of the card number',
+    token VARCHAR(64) NOT NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    INDEX idx_card_claims_token (token)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
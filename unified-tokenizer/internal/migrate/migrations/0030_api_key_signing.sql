@@ -0,0 +1,16 @@
+-- API keys created with "signed": true authenticate only requests signed
+-- with an HMAC under their signing secret, which is kept encrypted under a
+-- DEK like the card fields. Nonces of signed requests are kept until their
+-- timestamp falls out of the allowed clock skew, so none is accepted twice.
+ALTER TABLE api_keys
+    ADD COLUMN signing_secret_encrypted VARBINARY(255) NULL COMMENT 'HMAC secret of a key that only accepts signed requests' AFTER api_secret_hash,
+    ADD COLUMN signing_secret_key_id VARCHAR(64) NULL COMMENT 'DEK of signing_secret_encrypted; NULL for the legacy key' AFTER signing_secret_encrypted;
+
+CREATE TABLE IF NOT EXISTS api_key_nonces (
+    api_key VARCHAR(64) NOT NULL,
+    nonce VARCHAR(64) NOT NULL,
+    expires_at TIMESTAMP NOT NULL,
+    PRIMARY KEY (api_key, nonce),
+    INDEX idx_api_key_nonces_expires (expires_at),
+    CONSTRAINT fk_api_key_nonces_key FOREIGN KEY (api_key) REFERENCES api_keys(api_key) ON DELETE CASCADE
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
@@ -0,0 +1,13 @@
+-- Service accounts are users with account_type 'service': machine identities
+-- for integrations, which cannot log in and authenticate only with API keys.
+-- Their keys expire; expiry_reminded_at records when the api_key_expiring
+-- reminder was raised, so it is raised once per key.
+ALTER TABLE users
+    ADD COLUMN account_type ENUM('human', 'service') NOT NULL DEFAULT 'human' COMMENT 'service accounts cannot log in' AFTER user_id,
+    ADD COLUMN description VARCHAR(255) NULL COMMENT 'What a service account is for' AFTER full_name,
+    ADD INDEX idx_account_type (account_type);
+
+ALTER TABLE api_keys
+    ADD COLUMN expires_at TIMESTAMP NULL COMMENT 'NULL never expires; service account keys always do' AFTER last_used_at,
+    ADD COLUMN expiry_reminded_at TIMESTAMP NULL COMMENT 'When the api_key_expiring reminder was raised' AFTER expires_at,
+    ADD INDEX idx_api_keys_expires (expires_at);
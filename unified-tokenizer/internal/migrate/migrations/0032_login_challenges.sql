@@ -0,0 +1,21 @@
+-- Failed logins are counted per client address and per username, so that
+-- after LOGIN_CHALLENGE_AFTER failures within LOGIN_CHALLENGE_WINDOW a
+-- login must first pass a challenge. subject is a hex SHA-256 of the
+-- address or lowercased username, which need not belong to an account.
+CREATE TABLE IF NOT EXISTS login_failures (
+    scope ENUM('ip', 'username') NOT NULL,
+    subject CHAR(64) NOT NULL COMMENT 'Hex SHA-256 of the address or lowercased username',
+    failures INT NOT NULL DEFAULT 0,
+    first_failed_at TIMESTAMP NOT NULL COMMENT 'Start of the window the failures are counted in',
+    PRIMARY KEY (scope, subject),
+    INDEX idx_login_failures_first (first_failed_at)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+
+-- Proof-of-work puzzles handed to challenged logins. A row is deleted when
+-- its solution is accepted, so each puzzle solves one login.
+CREATE TABLE IF NOT EXISTS login_challenges (
+    challenge_id VARCHAR(64) PRIMARY KEY,
+    difficulty TINYINT UNSIGNED NOT NULL COMMENT 'Leading zero bits the solution hash needs',
+    expires_at TIMESTAMP NOT NULL,
+    INDEX idx_login_challenges_expires (expires_at)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
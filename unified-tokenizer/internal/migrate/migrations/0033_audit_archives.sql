@@ -0,0 +1,21 @@
+-- Audit log rows past AUDIT_LOG_RETENTION_DAYS are exported to object
+-- storage as gzipped JSON lines before they are deleted. Each export is
+-- recorded here with its row range, digest and signature, which the query
+-- endpoint checks the fetched object against.
+CREATE TABLE IF NOT EXISTS audit_archives (
+    archive_id BIGINT AUTO_INCREMENT PRIMARY KEY,
+    source_table ENUM('user_audit_log', 'security_audit_log') NOT NULL,
+    store VARCHAR(16) NOT NULL COMMENT 's3, gcs or file',
+    object_key VARCHAR(512) NOT NULL,
+    first_id BIGINT NOT NULL,
+    last_id BIGINT NOT NULL,
+    first_at TIMESTAMP NOT NULL,
+    last_at TIMESTAMP NOT NULL,
+    row_count INT NOT NULL,
+    size_bytes BIGINT NOT NULL,
+    sha256 CHAR(64) NOT NULL COMMENT 'Hex SHA-256 of the object',
+    signature CHAR(64) NOT NULL COMMENT 'Hex HMAC of sha256 under the blind index key',
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    UNIQUE KEY uk_audit_archives_range (source_table, first_id),
+    INDEX idx_audit_archives_time (source_table, first_at, last_at)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
@@ -0,0 +1,36 @@
+-- Access reviews: campaigns in which admins confirm or revoke each active
+-- account and API key by a deadline. The items keep every decision, and
+-- those still pending when a review closes are marked expired, and by
+-- default disabled.
+CREATE TABLE IF NOT EXISTS access_reviews (
+    review_id VARCHAR(64) PRIMARY KEY,
+    name VARCHAR(100) NOT NULL,
+    status ENUM('open', 'closed') NOT NULL DEFAULT 'open',
+    due_at TIMESTAMP NOT NULL,
+    reminded_at TIMESTAMP NULL COMMENT 'When the access_review_due reminder was raised',
+    created_by VARCHAR(100) NOT NULL COMMENT 'user_id, or system for scheduled reviews',
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    closed_at TIMESTAMP NULL,
+    closed_by VARCHAR(100) NULL COMMENT 'user_id, or system at the deadline',
+    INDEX idx_access_reviews_status (status, due_at)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+
+CREATE TABLE IF NOT EXISTS access_review_items (
+    id BIGINT AUTO_INCREMENT PRIMARY KEY,
+    review_id VARCHAR(64) NOT NULL,
+    subject_type ENUM('user', 'api_key') NOT NULL,
+    subject_id VARCHAR(64) NOT NULL COMMENT 'user_id or api_key',
+    user_id VARCHAR(64) NOT NULL DEFAULT '' COMMENT 'The account, or the owner of the key',
+    username VARCHAR(50) NOT NULL DEFAULT '',
+    label VARCHAR(100) NULL COMMENT 'Client name of a key',
+    role VARCHAR(32) NULL,
+    permissions JSON NULL COMMENT 'Granted beyond the role, or the key''s permissions',
+    last_used_at TIMESTAMP NULL COMMENT 'Last login, or when the key was last used, when the review started',
+    decision ENUM('pending', 'confirmed', 'revoked', 'expired') NOT NULL DEFAULT 'pending',
+    decided_by VARCHAR(100) NULL,
+    decided_at TIMESTAMP NULL,
+    comment VARCHAR(500) NULL,
+    UNIQUE KEY uniq_access_review_subject (review_id, subject_type, subject_id),
+    INDEX idx_access_review_decision (review_id, decision),
+    CONSTRAINT fk_access_review_items FOREIGN KEY (review_id) REFERENCES access_reviews(review_id) ON DELETE CASCADE
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
@@ -0,0 +1,18 @@
+-- Accounts not logged in to and API keys not used for a number of days are
+-- disabled, after a warning. A role can set its own number of days; NULL
+-- follows INACTIVE_USER_DAYS and STALE_API_KEY_DAYS, and 0 never disables.
+-- inactivity_warned_at records the warning, and inactive_disabled_at marks
+-- what was disabled for inactivity. reactivated_at restarts an account's
+-- inactivity when an admin enables it again.
+ALTER TABLE roles
+    ADD COLUMN inactive_user_days INT NULL COMMENT 'NULL follows INACTIVE_USER_DAYS; 0 never disables' AFTER built_in,
+    ADD COLUMN stale_api_key_days INT NULL COMMENT 'NULL follows STALE_API_KEY_DAYS; 0 never disables' AFTER inactive_user_days;
+
+ALTER TABLE users
+    ADD COLUMN reactivated_at TIMESTAMP NULL COMMENT 'When an admin last enabled the account' AFTER last_login_at,
+    ADD COLUMN inactivity_warned_at TIMESTAMP NULL COMMENT 'When the user_inactive warning was raised' AFTER reactivated_at,
+    ADD COLUMN inactive_disabled_at TIMESTAMP NULL COMMENT 'When the account was disabled for inactivity' AFTER inactivity_warned_at;
+
+ALTER TABLE api_keys
+    ADD COLUMN inactivity_warned_at TIMESTAMP NULL COMMENT 'When the api_key_stale warning was raised' AFTER expiry_reminded_at,
+    ADD COLUMN inactive_disabled_at TIMESTAMP NULL COMMENT 'When the key was deactivated for going unused' AFTER inactivity_warned_at;
@@ -0,0 +1,23 @@
+-- Network tokens: the card scheme's token for a vault card, requested
+-- through NETWORK_TOKEN_CONNECTORS and used with a cryptogram per
+-- transaction. The network token number is encrypted like the card's
+-- fields. A row whose card has been purged is deleted at the scheme and
+-- here by the cleanup job.
+CREATE TABLE IF NOT EXISTS network_tokens (
+    id INT AUTO_INCREMENT PRIMARY KEY,
+    token VARCHAR(64) UNIQUE NOT NULL COMMENT 'The vault token of the card',
+    scheme VARCHAR(16) NOT NULL COMMENT 'visa, mastercard, amex or discover',
+    token_reference_id VARCHAR(128) NOT NULL COMMENT 'The token service''s ID for the network token',
+    network_token_encrypted VARBINARY(255) NOT NULL,
+    encryption_key_id VARCHAR(64) NULL,
+    last_four CHAR(4) NOT NULL,
+    expiry_month TINYINT NULL,
+    expiry_year SMALLINT NULL,
+    status ENUM('active', 'suspended') NOT NULL DEFAULT 'active',
+    cryptograms_issued INT NOT NULL DEFAULT 0,
+    last_cryptogram_at TIMESTAMP NULL,
+    created_by VARCHAR(100) NULL COMMENT 'user_id',
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP,
+    INDEX idx_network_tokens_scheme (scheme)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
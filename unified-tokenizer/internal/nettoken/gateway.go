@@ -0,0 +1,230 @@
+package nettoken
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"tokenshield-unified/internal/tlsreload"
+)
+
+// maxResponse bounds a response body from a gateway
+const maxResponse = 64 << 10
+
+// Config is one NETWORK_TOKEN_CONNECTORS entry: the token service gateway
+// a scheme's requests go through
+type Config struct {
+	URL              string `json:"url"`                 // https:// base of the gateway's API
+	TokenRequestorID string `json:"token_requestor_id"`  // The ID the scheme assigned us as a token requestor
+	APIKey           string `json:"api_key,omitempty"`   // Sent as a Bearer token
+	CAFile           string `json:"ca_file,omitempty"`   // CAs the gateway's certificate must chain to instead of the system roots
+	CertFile         string `json:"cert_file,omitempty"` // Client certificate, reloaded from disk when renewed
+	KeyFile          string `json:"key_file,omitempty"`
+	Timeout          string `json:"timeout,omitempty"` // Per call; default 10s, as provisioning waits on the issuer
+}
+
+// gateway is a Connector for a token service gateway's JSON API:
+//
+//	POST   {url}/tokens                    provision a network token
+//	POST   {url}/tokens/{ref}/cryptograms  request a cryptogram
+//	DELETE {url}/tokens/{ref}              delete a network token
+//
+// Refusals come back as 4xx with {"error": {"code", "message"}}.
+type gateway struct {
+	scheme      string
+	base        string
+	requestorID string
+	apiKey      string
+	timeout     time.Duration
+	client      *http.Client
+}
+
+func newGateway(scheme string, cfg Config) (*gateway, error) {
+	base, err := url.Parse(strings.TrimSpace(cfg.URL))
+	if err != nil || base.Scheme != "https" || base.Host == "" {
+		return nil, errors.New("url must be https://; card numbers are only sent over TLS")
+	}
+	if cfg.TokenRequestorID == "" {
+		return nil, errors.New("token_requestor_id is required")
+	}
+	g := &gateway{
+		scheme:      scheme,
+		base:        strings.TrimRight(base.String(), "/"),
+		requestorID: cfg.TokenRequestorID,
+		apiKey:      cfg.APIKey,
+		timeout:     10 * time.Second,
+	}
+	if cfg.Timeout != "" {
+		if g.timeout, err = time.ParseDuration(cfg.Timeout); err != nil || g.timeout < 100*time.Millisecond || g.timeout > time.Minute {
+			return nil, fmt.Errorf("invalid timeout %q: want a duration from 100ms to 1m", cfg.Timeout)
+		}
+	}
+
+	config := &tls.Config{MinVersion: tls.VersionTLS12}
+	if cfg.CAFile != "" {
+		caPEM, err := os.ReadFile(cfg.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read ca_file: %v", err)
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(caPEM) {
+			return nil, errors.New("ca_file contains no PEM certificates")
+		}
+	}
+	if cfg.CertFile != "" || cfg.KeyFile != "" {
+		if cfg.CertFile == "" || cfg.KeyFile == "" {
+			return nil, errors.New("cert_file and key_file must be set together")
+		}
+		reloader, err := tlsreload.New(cfg.CertFile, cfg.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load the client certificate: %v", err)
+		}
+		config.GetClientCertificate = reloader.GetClientCertificate
+	}
+	g.client = &http.Client{
+		Transport: &http.Transport{TLSClientConfig: config, IdleConnTimeout: 90 * time.Second},
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	return g, nil
+}
+
+// gatewayToken is a network token as the gateway returns it
+type gatewayToken struct {
+	ReferenceID string `json:"token_reference_id"`
+	Number      string `json:"network_token"`
+	ExpiryMonth int    `json:"expiry_month"`
+	ExpiryYear  int    `json:"expiry_year"`
+	Status      string `json:"status"`
+}
+
+func (t gatewayToken) token() Token {
+	status := t.Status
+	if status != StatusSuspended {
+		status = StatusActive
+	}
+	return Token{ReferenceID: t.ReferenceID, Number: t.Number, ExpiryMonth: t.ExpiryMonth, ExpiryYear: t.ExpiryYear, Status: status}
+}
+
+func (g *gateway) Provision(ctx context.Context, card Card) (Token, error) {
+	var resp gatewayToken
+	err := g.do(ctx, http.MethodPost, "/tokens", map[string]interface{}{
+		"token_requestor_id": g.requestorID,
+		"card_number":        card.Number,
+		"expiry_month":       card.ExpiryMonth,
+		"expiry_year":        card.ExpiryYear,
+		"card_holder":        card.Holder,
+	}, &resp)
+	if err != nil {
+		return Token{}, err
+	}
+	return resp.token(), nil
+}
+
+func (g *gateway) Cryptogram(ctx context.Context, referenceID string, tx Transaction) (Cryptogram, error) {
+	var resp struct {
+		Cryptogram string `json:"cryptogram"`
+		ECI        string `json:"eci"`
+		gatewayToken
+	}
+	err := g.do(ctx, http.MethodPost, "/tokens/"+url.PathEscape(referenceID)+"/cryptograms", map[string]interface{}{
+		"token_requestor_id": g.requestorID,
+		"transaction_type":   tx.Type,
+		"amount":             tx.Amount,
+		"currency":           tx.Currency,
+	}, &resp)
+	if err != nil {
+		return Cryptogram{}, err
+	}
+	cryptogram := Cryptogram{Cryptogram: resp.Cryptogram, ECI: resp.ECI}
+	if resp.Number != "" {
+		if resp.ReferenceID == "" {
+			resp.ReferenceID = referenceID
+		}
+		token := resp.gatewayToken.token()
+		cryptogram.Token = &token
+	}
+	return cryptogram, nil
+}
+
+func (g *gateway) Delete(ctx context.Context, referenceID string) error {
+	err := g.do(ctx, http.MethodDelete, "/tokens/"+url.PathEscape(referenceID), nil, nil)
+	if errors.Is(err, ErrNotFound) {
+		return nil
+	}
+	return err
+}
+
+// do sends body as JSON and decodes a 2xx answer into out
+func (g *gateway) do(ctx context.Context, method, path string, body, out interface{}) error {
+	ctx, cancel := context.WithTimeout(ctx, g.timeout)
+	defer cancel()
+
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(data)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, g.base+path, reader)
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("User-Agent", "tokenshield-nettoken-client")
+	if g.apiKey != "" {
+		req.Header.Set("Authorization", "Bearer "+g.apiKey)
+	}
+
+	resp, err := g.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("%s token service: %v", g.scheme, err)
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxResponse))
+	if err != nil {
+		return fmt.Errorf("%s token service: %v", g.scheme, err)
+	}
+
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		return ErrNotFound
+	case resp.StatusCode >= 400 && resp.StatusCode < 500:
+		var refusal struct {
+			Error struct {
+				Code    string `json:"code"`
+				Message string `json:"message"`
+			} `json:"error"`
+		}
+		_ = json.Unmarshal(data, &refusal)
+		if refusal.Error.Message == "" {
+			refusal.Error.Message = "request refused with " + resp.Status
+		}
+		return &Error{Scheme: g.scheme, Code: refusal.Error.Code, Message: refusal.Error.Message}
+	case resp.StatusCode < 200 || resp.StatusCode > 299:
+		return fmt.Errorf("%s token service answered %s", g.scheme, resp.Status)
+	}
+	if out == nil {
+		return nil
+	}
+	if err := json.Unmarshal(data, out); err != nil {
+		return fmt.Errorf("%s token service sent an invalid response: %v", g.scheme, err)
+	}
+	return nil
+}
@@ -0,0 +1,257 @@
+// Package nettoken requests card scheme network tokens for vault cards,
+// such as from the Visa Token Service or Mastercard MDES, and the
+// cryptogram each transaction made with one needs. A Connector talks to
+// one scheme's token service; the connectors here reach it through a
+// token service gateway (see gateway.go), which holds the scheme
+// onboarding, keys and payload encryption a direct integration needs.
+package nettoken
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync/atomic"
+)
+
+// Schemes with a token service
+const (
+	Visa       = "visa"       // Visa Token Service
+	Mastercard = "mastercard" // Mastercard Digital Enablement Service
+	Amex       = "amex"       // American Express Token Service
+	Discover   = "discover"   // Discover Digital Exchange
+)
+
+// Statuses of a network token
+const (
+	StatusActive    = "active"
+	StatusSuspended = "suspended"
+)
+
+// Transaction types a cryptogram is requested for
+var TransactionTypes = []string{"ecommerce", "recurring", "card_on_file"}
+
+// ErrNotFound is returned when the token service does not know a network
+// token, for example after the scheme deleted it
+var ErrNotFound = errors.New("network token not found by the token service")
+
+// SchemeOf returns the scheme of a card type as utils.DetectCardType
+// names it, or "" for cards without a token service
+func SchemeOf(cardType string) string {
+	switch cardType {
+	case "Visa":
+		return Visa
+	case "Mastercard":
+		return Mastercard
+	case "Amex":
+		return Amex
+	case "Discover":
+		return Discover
+	}
+	return ""
+}
+
+// Card is a vault card to request a network token for
+type Card struct {
+	Number      string
+	ExpiryMonth int
+	ExpiryYear  int
+	Holder      string
+}
+
+// Token is a network token issued for a card
+type Token struct {
+	ReferenceID string // The token service's ID for the token, used in later calls
+	Number      string
+	ExpiryMonth int
+	ExpiryYear  int
+	Status      string
+}
+
+// Transaction describes the payment a cryptogram is for
+type Transaction struct {
+	Type     string // One of TransactionTypes
+	Amount   string // Decimal, like 10.00; empty when not known yet
+	Currency string // ISO 4217, like EUR
+}
+
+// Cryptogram is the one-time value authorizing a transaction made with a
+// network token
+type Cryptogram struct {
+	Cryptogram string
+	ECI        string // Electronic commerce indicator to send with it
+	Token      *Token // The network token as it is now, when the scheme has replaced it
+}
+
+// Connector talks to one scheme's token service
+type Connector interface {
+	Provision(ctx context.Context, card Card) (Token, error)
+	Cryptogram(ctx context.Context, referenceID string, tx Transaction) (Cryptogram, error)
+	// Delete deletes the network token, succeeding if it is already gone
+	Delete(ctx context.Context, referenceID string) error
+}
+
+// Error is a request the token service refused, such as for a card not
+// eligible for network tokens
+type Error struct {
+	Scheme  string
+	Code    string
+	Message string
+}
+
+func (e *Error) Error() string {
+	if e.Code == "" {
+		return fmt.Sprintf("%s token service: %s", e.Scheme, e.Message)
+	}
+	return fmt.Sprintf("%s token service: %s (%s)", e.Scheme, e.Message, e.Code)
+}
+
+// Stats count the calls made to one scheme's token service
+type Stats struct {
+	Scheme      string
+	Provisioned int64
+	Cryptograms int64
+	Deleted     int64
+	Errors      int64
+}
+
+// Connectors are the token services configured, by scheme
+type Connectors struct {
+	connectors map[string]Connector
+	stats      map[string]*Stats
+}
+
+// Parse parses NETWORK_TOKEN_CONNECTORS, a JSON object from scheme to its
+// gateway's Config
+func Parse(spec string) (map[string]Config, error) {
+	if strings.TrimSpace(spec) == "" {
+		return nil, nil
+	}
+	dec := json.NewDecoder(strings.NewReader(spec))
+	dec.DisallowUnknownFields()
+	var configs map[string]Config
+	if err := dec.Decode(&configs); err != nil {
+		return nil, err
+	}
+	return configs, nil
+}
+
+// New returns a gateway connector for each configured scheme
+func New(configs map[string]Config) (*Connectors, error) {
+	c := &Connectors{connectors: make(map[string]Connector), stats: make(map[string]*Stats)}
+	for scheme, cfg := range configs {
+		switch scheme {
+		case Visa, Mastercard, Amex, Discover:
+		default:
+			return nil, fmt.Errorf("unknown scheme %q (use visa, mastercard, amex or discover)", scheme)
+		}
+		gateway, err := newGateway(scheme, cfg)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", scheme, err)
+		}
+		c.connectors[scheme] = gateway
+		c.stats[scheme] = &Stats{Scheme: scheme}
+	}
+	return c, nil
+}
+
+// Has reports whether scheme has a connector
+func (c *Connectors) Has(scheme string) bool {
+	if c == nil {
+		return false
+	}
+	_, ok := c.connectors[scheme]
+	return ok
+}
+
+// Schemes returns the schemes with a connector, sorted
+func (c *Connectors) Schemes() []string {
+	if c == nil {
+		return nil
+	}
+	schemes := make([]string, 0, len(c.connectors))
+	for scheme := range c.connectors {
+		schemes = append(schemes, scheme)
+	}
+	sort.Strings(schemes)
+	return schemes
+}
+
+func (c *Connectors) lookup(scheme string) (Connector, *Stats, error) {
+	if !c.Has(scheme) {
+		return nil, nil, fmt.Errorf("no network token connector for %q", scheme)
+	}
+	return c.connectors[scheme], c.stats[scheme], nil
+}
+
+// Provision requests a network token for card from scheme's token service
+func (c *Connectors) Provision(ctx context.Context, scheme string, card Card) (Token, error) {
+	connector, stats, err := c.lookup(scheme)
+	if err != nil {
+		return Token{}, err
+	}
+	token, err := connector.Provision(ctx, card)
+	if err == nil && (token.ReferenceID == "" || token.Number == "" || token.Number == card.Number) {
+		err = fmt.Errorf("%s token service returned no usable network token", scheme)
+	}
+	if err != nil {
+		atomic.AddInt64(&stats.Errors, 1)
+		return Token{}, err
+	}
+	if token.Status == "" {
+		token.Status = StatusActive
+	}
+	atomic.AddInt64(&stats.Provisioned, 1)
+	return token, nil
+}
+
+// Cryptogram requests a cryptogram for a transaction with the network
+// token referenceID of scheme
+func (c *Connectors) Cryptogram(ctx context.Context, scheme, referenceID string, tx Transaction) (Cryptogram, error) {
+	connector, stats, err := c.lookup(scheme)
+	if err != nil {
+		return Cryptogram{}, err
+	}
+	cryptogram, err := connector.Cryptogram(ctx, referenceID, tx)
+	if err == nil && cryptogram.Cryptogram == "" {
+		err = fmt.Errorf("%s token service returned no cryptogram", scheme)
+	}
+	if err != nil {
+		atomic.AddInt64(&stats.Errors, 1)
+		return Cryptogram{}, err
+	}
+	atomic.AddInt64(&stats.Cryptograms, 1)
+	return cryptogram, nil
+}
+
+// Delete deletes the network token referenceID of scheme
+func (c *Connectors) Delete(ctx context.Context, scheme, referenceID string) error {
+	connector, stats, err := c.lookup(scheme)
+	if err != nil {
+		return err
+	}
+	if err := connector.Delete(ctx, referenceID); err != nil {
+		atomic.AddInt64(&stats.Errors, 1)
+		return err
+	}
+	atomic.AddInt64(&stats.Deleted, 1)
+	return nil
+}
+
+// Stats returns the call counts of each scheme, ordered by scheme
+func (c *Connectors) Stats() []Stats {
+	var out []Stats
+	for _, scheme := range c.Schemes() {
+		s := c.stats[scheme]
+		out = append(out, Stats{
+			Scheme:      s.Scheme,
+			Provisioned: atomic.LoadInt64(&s.Provisioned),
+			Cryptograms: atomic.LoadInt64(&s.Cryptograms),
+			Deleted:     atomic.LoadInt64(&s.Deleted),
+			Errors:      atomic.LoadInt64(&s.Errors),
+		})
+	}
+	return out
+}
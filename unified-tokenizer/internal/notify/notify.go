@@ -0,0 +1,583 @@
+// Package notify sends security events to on-call staff by email, Slack and
+// PagerDuty. A Notifier routes each event to the channels whose event types
+// and minimum severity it matches, and throttles repeats: a channel hears
+// about events of one type on one endpoint at most once per throttle window,
+// with a count of those it missed in the next notification.
+//
+// Notifications carry the event type, severity, time, user, client IP and
+// endpoint. Event details can hold personal data, so they stay in the
+// encrypted audit log.
+package notify
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/mail"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"tokenshield-unified/internal/mailer"
+)
+
+// Channel types
+const (
+	TypeEmail     = "email"
+	TypeSlack     = "slack"
+	TypePagerDuty = "pagerduty"
+)
+
+// PagerDutyEventsURL is the PagerDuty Events API v2 endpoint
+const PagerDutyEventsURL = "https://events.pagerduty.com/v2/enqueue"
+
+// DefaultThrottle is how long a channel stays quiet about repeats of an
+// event when its config does not say
+const DefaultThrottle = 15 * time.Minute
+
+// sendTimeout bounds one delivery
+const sendTimeout = 10 * time.Second
+
+// severities orders the security event severities
+var severities = map[string]int{"low": 1, "medium": 2, "high": 3, "critical": 4}
+
+var namePattern = regexp.MustCompile(`^[a-z0-9_-]{1,64}$`)
+
+// Event is a security event to notify about
+type Event struct {
+	Type       string
+	Severity   string // low, medium, high or critical
+	Time       time.Time
+	Username   string
+	IPAddress  string
+	Endpoint   string
+	Instance   string // Host name of the replica that saw it
+	Suppressed int    // Earlier events of the same type and endpoint held back by the throttle
+	Test       bool   // Sent through the test endpoint, not by an incident
+}
+
+// Channel delivers notifications. Email, Slack and PagerDuty are provided;
+// anything else can be plugged in with Notifier.Add.
+type Channel interface {
+	Send(ctx context.Context, e Event) error
+}
+
+// Config is a channel and its routing, as given in NOTIFICATION_CHANNELS
+type Config struct {
+	Name        string   `json:"name"`
+	Type        string   `json:"type"`                   // email, slack or pagerduty
+	Events      []string `json:"events,omitempty"`       // Event types, or prefixes ending in *; every type when empty
+	MinSeverity string   `json:"min_severity,omitempty"` // high when no events are listed, otherwise low
+	Throttle    string   `json:"throttle,omitempty"`     // Like 15m (the default); 0 sends every event
+	To          []string `json:"to,omitempty"`           // email: recipients
+	WebhookURL  string   `json:"webhook_url,omitempty"`  // slack: incoming webhook
+	RoutingKey  string   `json:"routing_key,omitempty"`  // pagerduty: integration key
+	URL         string   `json:"url,omitempty"`          // pagerduty: Events API, PagerDutyEventsURL by default
+}
+
+// ParseConfigs parses and checks a JSON array of channel configs
+func ParseConfigs(data []byte) ([]Config, error) {
+	var configs []Config
+	if err := json.Unmarshal(data, &configs); err != nil {
+		return nil, err
+	}
+	names := make(map[string]bool)
+	for i := range configs {
+		c := &configs[i]
+		if !namePattern.MatchString(c.Name) {
+			return nil, fmt.Errorf("channel name %q: use 1-64 lowercase letters, digits, _ and -", c.Name)
+		}
+		if names[c.Name] {
+			return nil, fmt.Errorf("channel %s is given twice", c.Name)
+		}
+		names[c.Name] = true
+		if err := c.check(); err != nil {
+			return nil, fmt.Errorf("channel %s: %v", c.Name, err)
+		}
+	}
+	return configs, nil
+}
+
+func (c *Config) check() error {
+	if c.MinSeverity != "" && severities[c.MinSeverity] == 0 {
+		return fmt.Errorf("unknown min_severity %q: use low, medium, high or critical", c.MinSeverity)
+	}
+	for _, pattern := range c.Events {
+		if pattern == "" || strings.Contains(strings.TrimSuffix(pattern, "*"), "*") {
+			return fmt.Errorf("invalid event type %q: give a type, or a prefix ending in *", pattern)
+		}
+	}
+	if _, err := c.throttle(); err != nil {
+		return err
+	}
+	switch c.Type {
+	case TypeEmail:
+		if len(c.To) == 0 {
+			return fmt.Errorf("an email channel needs to")
+		}
+		for _, to := range c.To {
+			if _, err := mail.ParseAddress(to); err != nil {
+				return fmt.Errorf("invalid address %q", to)
+			}
+		}
+	case TypeSlack:
+		if err := checkURL(c.WebhookURL); err != nil {
+			return fmt.Errorf("webhook_url: %v", err)
+		}
+	case TypePagerDuty:
+		if c.RoutingKey == "" {
+			return fmt.Errorf("a pagerduty channel needs routing_key")
+		}
+		if c.URL != "" {
+			if err := checkURL(c.URL); err != nil {
+				return fmt.Errorf("url: %v", err)
+			}
+		}
+	default:
+		return fmt.Errorf("unknown type %q: use email, slack or pagerduty", c.Type)
+	}
+	return nil
+}
+
+func (c *Config) throttle() (time.Duration, error) {
+	if c.Throttle == "" {
+		return DefaultThrottle, nil
+	}
+	d, err := time.ParseDuration(c.Throttle)
+	if err != nil || d < 0 {
+		return 0, fmt.Errorf("invalid throttle %q: want a duration like 15m", c.Throttle)
+	}
+	return d, nil
+}
+
+func checkURL(raw string) error {
+	u, err := url.Parse(raw)
+	if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+		return fmt.Errorf("want an http or https URL")
+	}
+	return nil
+}
+
+// matches reports whether the channel routes e
+func (c *Config) matches(e Event) bool {
+	min := c.MinSeverity
+	if min == "" {
+		min = "high"
+		if len(c.Events) > 0 {
+			min = "low"
+		}
+	}
+	if severities[e.Severity] < severities[min] {
+		return false
+	}
+	if len(c.Events) == 0 {
+		return true
+	}
+	for _, pattern := range c.Events {
+		if prefix, ok := strings.CutSuffix(pattern, "*"); ok && strings.HasPrefix(e.Type, prefix) || pattern == e.Type {
+			return true
+		}
+	}
+	return false
+}
+
+// target describes where the channel sends, without its secrets
+func (c *Config) target() string {
+	switch c.Type {
+	case TypeEmail:
+		return strings.Join(c.To, ", ")
+	case TypeSlack:
+		if u, err := url.Parse(c.WebhookURL); err == nil {
+			return u.Scheme + "://" + u.Host + "/…"
+		}
+	case TypePagerDuty:
+		if len(c.RoutingKey) > 4 {
+			return "routing key …" + c.RoutingKey[len(c.RoutingKey)-4:]
+		}
+		return "routing key …"
+	}
+	return ""
+}
+
+// route is a channel with its routing and counters
+type route struct {
+	config   Config
+	channel  Channel
+	throttle time.Duration
+
+	mu          sync.Mutex
+	last        map[string]time.Time // Last notification by event type and endpoint
+	held        map[string]int       // Events held back since then
+	lastError   string
+	lastErrorAt time.Time
+
+	sent, failed, throttled int64 // Updated atomically
+}
+
+// ChannelStatus is a channel's routing and delivery counts
+type ChannelStatus struct {
+	Name        string     `json:"name"`
+	Type        string     `json:"type"`
+	Target      string     `json:"target"` // Recipients, webhook host or the end of the routing key
+	Events      []string   `json:"events"`
+	MinSeverity string     `json:"min_severity,omitempty"`
+	Throttle    string     `json:"throttle"`
+	Sent        int64      `json:"sent"`
+	Failed      int64      `json:"failed"`
+	Throttled   int64      `json:"throttled"`
+	LastError   string     `json:"last_error,omitempty"`
+	LastErrorAt *time.Time `json:"last_error_at,omitempty"`
+}
+
+// TestResult is the outcome of a test notification on one channel
+type TestResult struct {
+	Channel   string `json:"channel"`
+	Delivered bool   `json:"delivered"`
+	Error     string `json:"error,omitempty"`
+}
+
+// Notifier routes events to channels. Notify queues events for Run, so
+// callers never wait on a mail server or webhook. A nil Notifier drops
+// everything.
+type Notifier struct {
+	routes  []*route
+	queue   chan Event
+	dropped int64 // Events discarded because the queue was full, updated atomically
+	now     func() time.Time
+}
+
+// New creates a Notifier with the channels of configs. Email channels send
+// through sender, and the others post with client.
+func New(configs []Config, sender mailer.Sender, client *http.Client) (*Notifier, error) {
+	n := &Notifier{queue: make(chan Event, 256), now: time.Now}
+	for _, c := range configs {
+		var channel Channel
+		switch c.Type {
+		case TypeEmail:
+			if sender == nil {
+				return nil, fmt.Errorf("channel %s: email channels need a mail server", c.Name)
+			}
+			channel = &Email{Sender: sender, To: c.To}
+		case TypeSlack:
+			channel = &Slack{WebhookURL: c.WebhookURL, Client: client}
+		case TypePagerDuty:
+			channel = &PagerDuty{RoutingKey: c.RoutingKey, URL: c.URL, Client: client}
+		}
+		if err := n.Add(c, channel); err != nil {
+			return nil, err
+		}
+	}
+	return n, nil
+}
+
+// Add adds a channel routed by c; c.Type only names it in the status
+func (n *Notifier) Add(c Config, channel Channel) error {
+	throttle, err := c.throttle()
+	if err != nil {
+		return fmt.Errorf("channel %s: %v", c.Name, err)
+	}
+	for _, r := range n.routes {
+		if r.config.Name == c.Name {
+			return fmt.Errorf("channel %s is given twice", c.Name)
+		}
+	}
+	n.routes = append(n.routes, &route{
+		config:   c,
+		channel:  channel,
+		throttle: throttle,
+		last:     make(map[string]time.Time),
+		held:     make(map[string]int),
+	})
+	return nil
+}
+
+// Notify queues e for delivery. It never blocks: when the queue is full
+// the event is counted as dropped.
+func (n *Notifier) Notify(e Event) {
+	if n == nil || len(n.routes) == 0 {
+		return
+	}
+	select {
+	case n.queue <- e:
+	default:
+		atomic.AddInt64(&n.dropped, 1)
+	}
+}
+
+// Run delivers queued events until the process exits
+func (n *Notifier) Run() {
+	for e := range n.queue {
+		n.Deliver(e)
+	}
+}
+
+// Deliver sends e to every channel that routes it and is not throttling
+// its type and endpoint, waiting for the sends
+func (n *Notifier) Deliver(e Event) {
+	if n == nil {
+		return
+	}
+	now := n.now()
+	if e.Time.IsZero() {
+		e.Time = now
+	}
+	key := e.Type + " " + e.Endpoint
+	var wg sync.WaitGroup
+	for _, r := range n.routes {
+		if !r.config.matches(e) {
+			continue
+		}
+		r.mu.Lock()
+		if last, ok := r.last[key]; ok && now.Sub(last) < r.throttle {
+			r.held[key]++
+			r.mu.Unlock()
+			atomic.AddInt64(&r.throttled, 1)
+			continue
+		}
+		// Forget what the throttle no longer applies to
+		if len(r.last) >= 1024 {
+			for k, last := range r.last {
+				if now.Sub(last) >= r.throttle {
+					delete(r.last, k)
+				}
+			}
+		}
+		r.last[key] = now
+		routed := e
+		routed.Suppressed = r.held[key]
+		delete(r.held, key)
+		r.mu.Unlock()
+
+		wg.Add(1)
+		go func(r *route) {
+			defer wg.Done()
+			r.send(routed, now)
+		}(r)
+	}
+	wg.Wait()
+}
+
+func (r *route) send(e Event, now time.Time) error {
+	ctx, cancel := context.WithTimeout(context.Background(), sendTimeout)
+	defer cancel()
+	err := r.channel.Send(ctx, e)
+	if err != nil {
+		atomic.AddInt64(&r.failed, 1)
+		r.mu.Lock()
+		r.lastError, r.lastErrorAt = err.Error(), now
+		r.mu.Unlock()
+		return err
+	}
+	atomic.AddInt64(&r.sent, 1)
+	return nil
+}
+
+// Test sends e, marked as a test, to the named channel or to every channel
+// when name is empty, regardless of routing and throttling. It reports
+// false when no channel has that name.
+func (n *Notifier) Test(name string, e Event) ([]TestResult, bool) {
+	if n == nil {
+		return nil, false
+	}
+	e.Test = true
+	if e.Time.IsZero() {
+		e.Time = n.now()
+	}
+	var results []TestResult
+	for _, r := range n.routes {
+		if name != "" && r.config.Name != name {
+			continue
+		}
+		result := TestResult{Channel: r.config.Name, Delivered: true}
+		if err := r.send(e, n.now()); err != nil {
+			result.Delivered, result.Error = false, err.Error()
+		}
+		results = append(results, result)
+	}
+	return results, len(results) > 0
+}
+
+// Status returns the channels' routing and counts
+func (n *Notifier) Status() []ChannelStatus {
+	statuses := []ChannelStatus{}
+	if n == nil {
+		return statuses
+	}
+	for _, r := range n.routes {
+		s := ChannelStatus{
+			Name:        r.config.Name,
+			Type:        r.config.Type,
+			Target:      r.config.target(),
+			Events:      r.config.Events,
+			MinSeverity: r.config.MinSeverity,
+			Throttle:    r.throttle.String(),
+			Sent:        atomic.LoadInt64(&r.sent),
+			Failed:      atomic.LoadInt64(&r.failed),
+			Throttled:   atomic.LoadInt64(&r.throttled),
+		}
+		if s.Events == nil {
+			s.Events = []string{}
+		}
+		r.mu.Lock()
+		if r.lastError != "" {
+			at := r.lastErrorAt
+			s.LastError, s.LastErrorAt = r.lastError, &at
+		}
+		r.mu.Unlock()
+		statuses = append(statuses, s)
+	}
+	return statuses
+}
+
+// Dropped returns how many events were discarded because the queue was full
+func (n *Notifier) Dropped() int64 {
+	if n == nil {
+		return 0
+	}
+	return atomic.LoadInt64(&n.dropped)
+}
+
+// Subject is the one-line summary of e
+func Subject(e Event) string {
+	subject := fmt.Sprintf("[%s] %s", strings.ToUpper(e.Severity), e.Type)
+	if e.Endpoint != "" {
+		subject += " on " + e.Endpoint
+	}
+	if e.Test {
+		subject = "Test: " + subject
+	}
+	return subject
+}
+
+// Text is the plain-text body of a notification about e
+func Text(e Event) string {
+	var b strings.Builder
+	if e.Test {
+		b.WriteString("This is a test notification; nothing has happened.\n\n")
+	}
+	fmt.Fprintf(&b, "Event: %s\nSeverity: %s\nTime: %s\n", e.Type, e.Severity, e.Time.UTC().Format(time.RFC3339))
+	for _, field := range []struct{ name, value string }{
+		{"Endpoint", e.Endpoint}, {"User", e.Username}, {"Client IP", e.IPAddress}, {"Instance", e.Instance},
+	} {
+		if field.value != "" {
+			fmt.Fprintf(&b, "%s: %s\n", field.name, field.value)
+		}
+	}
+	if e.Suppressed > 0 {
+		fmt.Fprintf(&b, "\n%d more like it were held back since the last notification.\n", e.Suppressed)
+	}
+	b.WriteString("\nDetails are in the security audit log.\n")
+	return b.String()
+}
+
+// Email mails notifications to each recipient
+type Email struct {
+	Sender mailer.Sender
+	To     []string
+}
+
+// Send mails e
+func (c *Email) Send(ctx context.Context, e Event) error {
+	for _, to := range c.To {
+		if err := c.Sender.Send(mailer.Message{To: to, Subject: "TokenShield " + Subject(e), Body: Text(e)}); err != nil {
+			return fmt.Errorf("%s: %v", to, err)
+		}
+	}
+	return nil
+}
+
+// Slack posts notifications to an incoming webhook
+type Slack struct {
+	WebhookURL string
+	Client     *http.Client // nil uses http.DefaultClient
+}
+
+// Send posts e
+func (c *Slack) Send(ctx context.Context, e Event) error {
+	body, _ := json.Marshal(map[string]string{"text": "*" + Subject(e) + "*\n" + Text(e)})
+	return post(ctx, c.Client, c.WebhookURL, body)
+}
+
+// PagerDuty triggers incidents through the Events API v2. Repeats of an
+// event type on an endpoint share a dedup key, so they join one incident.
+type PagerDuty struct {
+	RoutingKey string
+	URL        string       // PagerDutyEventsURL when empty
+	Client     *http.Client // nil uses http.DefaultClient
+}
+
+// pagerDutySeverities maps security event severities to PagerDuty's
+var pagerDutySeverities = map[string]string{"low": "info", "medium": "warning", "high": "error", "critical": "critical"}
+
+// Send triggers an incident for e
+func (c *PagerDuty) Send(ctx context.Context, e Event) error {
+	endpoint := c.URL
+	if endpoint == "" {
+		endpoint = PagerDutyEventsURL
+	}
+	severity := pagerDutySeverities[e.Severity]
+	if severity == "" {
+		severity = "error"
+	}
+	source := e.Instance
+	if source == "" {
+		source = "tokenshield"
+	}
+	summary := Subject(e)
+	if e.Suppressed > 0 {
+		summary += fmt.Sprintf(" (%d more held back)", e.Suppressed)
+	}
+	details := map[string]interface{}{"event_type": e.Type, "test": e.Test}
+	for name, value := range map[string]string{"endpoint": e.Endpoint, "username": e.Username, "ip_address": e.IPAddress} {
+		if value != "" {
+			details[name] = value
+		}
+	}
+	body, _ := json.Marshal(map[string]interface{}{
+		"routing_key":  c.RoutingKey,
+		"event_action": "trigger",
+		"dedup_key":    "tokenshield:" + e.Type + ":" + e.Endpoint,
+		"payload": map[string]interface{}{
+			"summary":        summary,
+			"source":         source,
+			"severity":       severity,
+			"timestamp":      e.Time.UTC().Format(time.RFC3339),
+			"component":      "tokenshield",
+			"class":          e.Type,
+			"custom_details": details,
+		},
+	})
+	return post(ctx, c.Client, endpoint, body)
+}
+
+// post sends a JSON body and expects a 2xx answer
+func post(ctx context.Context, client *http.Client, target string, body []byte) error {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", target, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := client.Do(req)
+	if err != nil {
+		// The error names the URL, which for webhooks is the secret
+		if uerr, ok := err.(*url.Error); ok {
+			return uerr.Err
+		}
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		text, _ := io.ReadAll(io.LimitReader(resp.Body, 200))
+		return fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(text)))
+	}
+	return nil
+}
@@ -0,0 +1,289 @@
+// Package objstore writes and reads whole objects in an object store: an
+// S3 bucket, a Google Cloud Storage bucket through its S3-compatible XML
+// API, or a local directory. Like the KMS sealers it talks to the
+// providers' REST APIs directly, signing S3 requests with AWS Signature
+// Version 4, so the tokenizer does not pull in their SDKs.
+package objstore
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Kinds of store
+const (
+	S3   = "s3"
+	GCS  = "gcs"
+	File = "file"
+)
+
+// ErrNotFound is returned by Get for a key with no object
+var ErrNotFound = errors.New("object not found")
+
+// Store keeps objects by key
+type Store interface {
+	Put(ctx context.Context, key string, data []byte) error
+	Get(ctx context.Context, key string) ([]byte, error)
+	// Name describes where objects go, like s3://bucket/prefix
+	Name() string
+}
+
+// Config is where a store keeps its objects. For File, Bucket is a
+// directory.
+type Config struct {
+	Kind            string
+	Bucket          string
+	Prefix          string // Prepended to every key, with a slash
+	Endpoint        string // S3-compatible endpoint; empty for AWS or Google's
+	Region          string // AWS region; "auto" for GCS
+	AccessKeyID     string // For GCS, an HMAC key of a service account
+	SecretAccessKey string
+	SessionToken    string
+	Client          *http.Client // nil uses a client with a 60 second timeout
+}
+
+// New returns the store cfg describes
+func New(cfg Config) (Store, error) {
+	if cfg.Bucket == "" {
+		return nil, errors.New("no bucket or directory given")
+	}
+	cfg.Prefix = strings.Trim(cfg.Prefix, "/")
+
+	switch cfg.Kind {
+	case File:
+		if info, err := os.Stat(cfg.Bucket); err != nil || !info.IsDir() {
+			return nil, fmt.Errorf("%s is not a directory", cfg.Bucket)
+		}
+		return &fileStore{dir: cfg.Bucket, prefix: cfg.Prefix}, nil
+	case S3, GCS:
+		if cfg.AccessKeyID == "" || cfg.SecretAccessKey == "" {
+			return nil, errors.New("an access key ID and secret access key are required")
+		}
+		if cfg.Kind == GCS {
+			if cfg.Endpoint == "" {
+				cfg.Endpoint = "https://storage.googleapis.com"
+			}
+			if cfg.Region == "" {
+				cfg.Region = "auto"
+			}
+		}
+		if cfg.Region == "" {
+			return nil, errors.New("a region is required for S3")
+		}
+		if cfg.Client == nil {
+			cfg.Client = &http.Client{Timeout: 60 * time.Second}
+		}
+		return &s3Store{cfg: cfg}, nil
+	}
+	return nil, fmt.Errorf("unknown object store %q (use s3, gcs or file)", cfg.Kind)
+}
+
+func joinKey(prefix, key string) string {
+	if prefix == "" {
+		return key
+	}
+	return prefix + "/" + key
+}
+
+// fileStore keeps objects as files under a directory
+
+type fileStore struct {
+	dir    string
+	prefix string
+}
+
+func (f *fileStore) Name() string {
+	return "file://" + filepath.Join(f.dir, f.prefix)
+}
+
+func (f *fileStore) path(key string) (string, error) {
+	clean := path.Clean("/" + joinKey(f.prefix, key))
+	if clean != "/"+joinKey(f.prefix, key) {
+		return "", fmt.Errorf("invalid object key %q", key)
+	}
+	return filepath.Join(f.dir, filepath.FromSlash(clean)), nil
+}
+
+// Put writes the object through a temporary file, so a reader never sees
+// part of it
+func (f *fileStore) Put(ctx context.Context, key string, data []byte) error {
+	name, err := f.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(name), 0o750); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(name), ".objstore_*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+	if _, err := tmp.Write(data); err != nil {
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), name)
+}
+
+func (f *fileStore) Get(ctx context.Context, key string) ([]byte, error) {
+	name, err := f.path(key)
+	if err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(name)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, ErrNotFound
+	}
+	return data, err
+}
+
+// s3Store keeps objects in an S3 or S3-compatible bucket. Objects on AWS
+// are addressed by virtual host; on other endpoints by path.
+
+type s3Store struct {
+	cfg Config
+}
+
+func (s *s3Store) Name() string {
+	scheme := "s3://"
+	if s.cfg.Kind == GCS {
+		scheme = "gs://"
+	}
+	return scheme + path.Join(s.cfg.Bucket, s.cfg.Prefix)
+}
+
+func (s *s3Store) objectURL(key string) string {
+	escaped := escapePath(joinKey(s.cfg.Prefix, key))
+	if s.cfg.Endpoint == "" {
+		return "https://" + s.cfg.Bucket + ".s3." + s.cfg.Region + ".amazonaws.com/" + escaped
+	}
+	return strings.TrimRight(s.cfg.Endpoint, "/") + "/" + escapePath(s.cfg.Bucket) + "/" + escaped
+}
+
+func (s *s3Store) Put(ctx context.Context, key string, data []byte) error {
+	resp, err := s.do(ctx, http.MethodPut, key, data)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func (s *s3Store) Get(ctx context.Context, key string) ([]byte, error) {
+	resp, err := s.do(ctx, http.MethodGet, key, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	return io.ReadAll(resp.Body)
+}
+
+// do sends a signed request for the object at key, treating any non-2xx
+// answer as an error
+func (s *s3Store) do(ctx context.Context, method, key string, body []byte) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, s.objectURL(key), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/octet-stream")
+	}
+	signV4(req, body, s.cfg, time.Now().UTC())
+	resp, err := s.cfg.Client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		resp.Body.Close()
+		return nil, ErrNotFound
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		text, _ := io.ReadAll(io.LimitReader(resp.Body, 300))
+		resp.Body.Close()
+		return nil, fmt.Errorf("%s %s: %s: %s", method, s.Name(), resp.Status, strings.TrimSpace(string(text)))
+	}
+	return resp, nil
+}
+
+// escapePath URI-encodes each segment of p the way Signature Version 4
+// expects, keeping the slashes
+func escapePath(p string) string {
+	segments := strings.Split(p, "/")
+	for i, segment := range segments {
+		segments[i] = strings.ReplaceAll(url.PathEscape(segment), "+", "%2B")
+	}
+	return strings.Join(segments, "/")
+}
+
+// signV4 adds AWS Signature Version 4 headers to a request without a query
+// string
+func signV4(req *http.Request, payload []byte, cfg Config, now time.Time) {
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	payloadHash := sha256.Sum256(payload)
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", hex.EncodeToString(payloadHash[:]))
+	if cfg.SessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", cfg.SessionToken)
+	}
+
+	headers := map[string]string{"host": req.URL.Host}
+	for name := range req.Header {
+		headers[strings.ToLower(name)] = strings.TrimSpace(req.Header.Get(name))
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonical := strings.Join([]string{
+		req.Method, req.URL.EscapedPath(), "", canonicalHeaders.String(), signedHeaders, hex.EncodeToString(payloadHash[:]),
+	}, "\n")
+	canonicalHash := sha256.Sum256([]byte(canonical))
+
+	scope := date + "/" + cfg.Region + "/s3/aws4_request"
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(canonicalHash[:])
+
+	key := hmacSHA256([]byte("AWS4"+cfg.SecretAccessKey), date)
+	key = hmacSHA256(key, cfg.Region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		cfg.AccessKeyID, scope, signedHeaders, signature))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
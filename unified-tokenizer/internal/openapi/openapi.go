@@ -0,0 +1,385 @@
+// Package openapi builds an OpenAPI 3 description of the management API from
+// a table of routes, taking request and response schemas from the Go types
+// the handlers encode and decode.
+package openapi
+
+import (
+	_ "embed"
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Route describes one method on one path of the API
+type Route struct {
+	Method      string
+	Path        string // Path parameters are written {name}
+	Tag         string
+	Summary     string
+	Description string
+	Public      bool   // Needs no authentication
+	Permission  string // Needed besides authentication, if any
+	Query       []Param
+	Request     interface{} // Zero value of the JSON request body, if any
+	Response    interface{} // Zero value of the JSON response body, if any
+	Status      int         // Success status; 200 when zero
+	Deprecated  bool
+}
+
+// Param is a query parameter
+type Param struct {
+	Name        string
+	Type        string // string, integer or boolean
+	Description string
+	Required    bool
+	Repeated    bool
+}
+
+// Info names the API in the document
+type Info struct {
+	Title       string
+	Version     string
+	Description string
+}
+
+// Document is an OpenAPI 3.0 document
+type Document struct {
+	OpenAPI    string                `json:"openapi"`
+	Info       map[string]string     `json:"info"`
+	Tags       []map[string]string   `json:"tags,omitempty"`
+	Paths      map[string]PathItem   `json:"paths"`
+	Components Components            `json:"components"`
+	Security   []map[string][]string `json:"security,omitempty"`
+}
+
+// PathItem holds the operations on one path, by lower-case method
+type PathItem map[string]*Operation
+
+// Operation is one method on a path
+type Operation struct {
+	OperationID string                `json:"operationId"`
+	Tags        []string              `json:"tags,omitempty"`
+	Summary     string                `json:"summary,omitempty"`
+	Description string                `json:"description,omitempty"`
+	Parameters  []Parameter           `json:"parameters,omitempty"`
+	RequestBody *RequestBody          `json:"requestBody,omitempty"`
+	Responses   map[string]Response   `json:"responses"`
+	Security    []map[string][]string `json:"security"`
+	Permission  string                `json:"x-required-permission,omitempty"`
+	Deprecated  bool                  `json:"deprecated,omitempty"`
+}
+
+// Parameter is a path or query parameter
+type Parameter struct {
+	Name        string  `json:"name"`
+	In          string  `json:"in"`
+	Description string  `json:"description,omitempty"`
+	Required    bool    `json:"required"`
+	Schema      *Schema `json:"schema"`
+	Explode     *bool   `json:"explode,omitempty"`
+}
+
+// RequestBody is a JSON request body
+type RequestBody struct {
+	Required bool                 `json:"required"`
+	Content  map[string]MediaType `json:"content"`
+}
+
+// Response is one response of an operation
+type Response struct {
+	Description string               `json:"description"`
+	Content     map[string]MediaType `json:"content,omitempty"`
+}
+
+// MediaType gives the schema of a body
+type MediaType struct {
+	Schema *Schema `json:"schema"`
+}
+
+// Components holds the schemas and security schemes operations refer to
+type Components struct {
+	Schemas         map[string]*Schema        `json:"schemas"`
+	SecuritySchemes map[string]SecurityScheme `json:"securitySchemes"`
+}
+
+// SecurityScheme is a way of authenticating
+type SecurityScheme struct {
+	Type        string `json:"type"`
+	Scheme      string `json:"scheme,omitempty"`
+	In          string `json:"in,omitempty"`
+	Name        string `json:"name,omitempty"`
+	Description string `json:"description,omitempty"`
+}
+
+// Schema is the subset of JSON Schema OpenAPI 3.0 uses
+type Schema struct {
+	Ref                  string             `json:"$ref,omitempty"`
+	Type                 string             `json:"type,omitempty"`
+	Format               string             `json:"format,omitempty"`
+	Nullable             bool               `json:"nullable,omitempty"`
+	Properties           map[string]*Schema `json:"properties,omitempty"`
+	Items                *Schema            `json:"items,omitempty"`
+	AdditionalProperties *Schema            `json:"additionalProperties,omitempty"`
+	Required             []string           `json:"required,omitempty"`
+	Description          string             `json:"description,omitempty"`
+}
+
+// Security schemes every authenticated operation accepts
+var authSchemes = []map[string][]string{
+	{"session": {}},
+	{"apiKey": {}},
+	{"sessionCookie": {}},
+}
+
+// errorSchema is the body of every error response
+var errorSchema = &Schema{
+	Type: "object",
+	Properties: map[string]*Schema{
+		"code":       {Type: "string", Description: "Stable, machine-readable error code"},
+		"message":    {Type: "string"},
+		"details":    {Type: "object", AdditionalProperties: &Schema{}},
+		"request_id": {Type: "string", Description: "Also returned in the X-Request-ID header"},
+		"error":      {Type: "string", Description: "Same as message; kept for older clients"},
+	},
+	Required: []string{"code", "error", "message"},
+}
+
+var pathParamPattern = regexp.MustCompile(`\{([a-z_]+)\}`)
+
+// Build returns the document describing routes
+func Build(info Info, routes []Route) *Document {
+	doc := &Document{
+		OpenAPI: "3.0.3",
+		Info:    map[string]string{"title": info.Title, "version": info.Version, "description": info.Description},
+		Paths:   make(map[string]PathItem),
+		Components: Components{
+			Schemas: map[string]*Schema{"Error": errorSchema},
+			SecuritySchemes: map[string]SecurityScheme{
+				"session":       {Type: "http", Scheme: "bearer", Description: "Session ID from POST /api/v1/auth/login"},
+				"apiKey":        {Type: "apiKey", In: "header", Name: "X-API-Key"},
+				"sessionCookie": {Type: "apiKey", In: "cookie", Name: "session_id", Description: "Set by login; state-changing requests also need X-CSRF-Token"},
+			},
+		},
+		Security: authSchemes,
+	}
+	gen := &generator{schemas: doc.Components.Schemas}
+
+	tags := make(map[string]bool)
+	for _, route := range routes {
+		if doc.Paths[route.Path] == nil {
+			doc.Paths[route.Path] = make(PathItem)
+		}
+		doc.Paths[route.Path][strings.ToLower(route.Method)] = gen.operation(route)
+		if route.Tag != "" && !tags[route.Tag] {
+			tags[route.Tag] = true
+			doc.Tags = append(doc.Tags, map[string]string{"name": route.Tag})
+		}
+	}
+	return doc
+}
+
+// Handler serves doc as JSON
+func Handler(doc *Document) http.Handler {
+	body, err := json.Marshal(doc)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" && r.Method != "HEAD" {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(body)
+	})
+}
+
+type generator struct {
+	schemas map[string]*Schema
+}
+
+func (g *generator) operation(route Route) *Operation {
+	op := &Operation{
+		OperationID: operationID(route.Method, route.Path),
+		Summary:     route.Summary,
+		Description: route.Description,
+		Responses:   make(map[string]Response),
+		Security:    authSchemes,
+		Permission:  route.Permission,
+		Deprecated:  route.Deprecated,
+	}
+	if route.Tag != "" {
+		op.Tags = []string{route.Tag}
+	}
+	if route.Public {
+		op.Security = []map[string][]string{}
+	}
+
+	for _, match := range pathParamPattern.FindAllStringSubmatch(route.Path, -1) {
+		op.Parameters = append(op.Parameters, Parameter{Name: match[1], In: "path", Required: true, Schema: &Schema{Type: "string"}})
+	}
+	for _, param := range route.Query {
+		schema := &Schema{Type: param.Type}
+		var explode *bool
+		if param.Repeated {
+			schema = &Schema{Type: "array", Items: schema}
+			explode = new(bool)
+			*explode = true
+		}
+		op.Parameters = append(op.Parameters, Parameter{
+			Name: param.Name, In: "query", Description: param.Description,
+			Required: param.Required, Schema: schema, Explode: explode,
+		})
+	}
+
+	if route.Request != nil {
+		op.RequestBody = &RequestBody{
+			Required: true,
+			Content:  map[string]MediaType{"application/json": {Schema: g.schema(reflect.TypeOf(route.Request))}},
+		}
+	}
+
+	status := route.Status
+	if status == 0 {
+		status = http.StatusOK
+	}
+	success := Response{Description: http.StatusText(status)}
+	if route.Response != nil {
+		success.Content = map[string]MediaType{"application/json": {Schema: g.schema(reflect.TypeOf(route.Response))}}
+	}
+	op.Responses[strconv.Itoa(status)] = success
+
+	errorResponse := func(status int) {
+		op.Responses[strconv.Itoa(status)] = Response{
+			Description: http.StatusText(status),
+			Content:     map[string]MediaType{"application/json": {Schema: &Schema{Ref: "#/components/schemas/Error"}}},
+		}
+	}
+	if route.Request != nil || len(route.Query) > 0 {
+		errorResponse(http.StatusBadRequest)
+	}
+	if !route.Public {
+		errorResponse(http.StatusUnauthorized)
+	}
+	if route.Permission != "" {
+		errorResponse(http.StatusForbidden)
+	}
+	return op
+}
+
+// operationID names an operation after its method and path, like
+// getApiV1TokensTokenActivity
+func operationID(method, path string) string {
+	id := strings.ToLower(method)
+	for _, part := range strings.FieldsFunc(path, func(r rune) bool {
+		return r == '/' || r == '{' || r == '}' || r == '-' || r == '_'
+	}) {
+		id += strings.ToUpper(part[:1]) + part[1:]
+	}
+	return id
+}
+
+var timeType = reflect.TypeOf(time.Time{})
+var rawMessageType = reflect.TypeOf(json.RawMessage{})
+
+// schema returns the schema of t. Named struct types are added to the
+// components and referred to.
+func (g *generator) schema(t reflect.Type) *Schema {
+	switch t {
+	case timeType:
+		return &Schema{Type: "string", Format: "date-time"}
+	case rawMessageType:
+		return &Schema{}
+	}
+
+	switch t.Kind() {
+	case reflect.Ptr:
+		s := g.schema(t.Elem())
+		if s.Ref != "" {
+			return s
+		}
+		s.Nullable = true
+		return s
+	case reflect.String:
+		return &Schema{Type: "string"}
+	case reflect.Bool:
+		return &Schema{Type: "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return &Schema{Type: "integer"}
+	case reflect.Float32, reflect.Float64:
+		return &Schema{Type: "number"}
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return &Schema{Type: "string", Format: "byte"}
+		}
+		return &Schema{Type: "array", Items: g.schema(t.Elem())}
+	case reflect.Map:
+		return &Schema{Type: "object", AdditionalProperties: g.schema(t.Elem())}
+	case reflect.Struct:
+		if t.Name() == "" {
+			return g.object(t)
+		}
+		name := t.Name()
+		if _, ok := g.schemas[name]; !ok {
+			g.schemas[name] = &Schema{} // Placeholder for recursive types
+			g.schemas[name] = g.object(t)
+		}
+		return &Schema{Ref: "#/components/schemas/" + name}
+	}
+	return &Schema{}
+}
+
+// object returns the schema of a struct from its json tags. Fields without
+// omitempty are listed as required.
+func (g *generator) object(t reflect.Type) *Schema {
+	s := &Schema{Type: "object", Properties: make(map[string]*Schema)}
+	g.fields(t, s)
+	sort.Strings(s.Required)
+	return s
+}
+
+func (g *generator) fields(t reflect.Type, s *Schema) {
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		tag := field.Tag.Get("json")
+		if tag == "-" || (!field.IsExported() && !field.Anonymous) {
+			continue
+		}
+		name, options, _ := strings.Cut(tag, ",")
+		if field.Anonymous && name == "" && field.Type.Kind() == reflect.Struct {
+			g.fields(field.Type, s)
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+		s.Properties[name] = g.schema(field.Type)
+		if !strings.Contains(options, "omitempty") && field.Type.Kind() != reflect.Ptr {
+			s.Required = append(s.Required, name)
+		}
+	}
+}
+
+//go:embed swagger.html
+var swaggerPage []byte
+
+// UIHandler serves Swagger UI for the document at /api/v1/openapi.json. The
+// UI's scripts are loaded from a CDN.
+func UIHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" && r.Method != "HEAD" {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Header().Set("Cache-Control", "no-store")
+		w.Write(swaggerPage)
+	})
+}
@@ -0,0 +1,214 @@
+package ratelimit
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Classes are the endpoint classes a rule can apply to; "proxy" covers
+// every request through the tokenizing proxy port
+var Classes = []string{"auth", "detokenize", "import", "write", "read", "proxy"}
+
+// Scopes are what a rule counts requests by: the client IP, or the API key
+// or session the request is authenticated with
+var Scopes = []string{"ip", "key"}
+
+// Rule allows Limit requests of one endpoint class per client in each
+// fixed window. A client over the limit is refused until the window ends,
+// or for Block when that is longer.
+type Rule struct {
+	Class  string `json:"class"`
+	Scope  string `json:"scope"`
+	Limit  int    `json:"limit"`
+	Window string `json:"window"`          // Duration like "1m" or "15m"
+	Block  string `json:"block,omitempty"` // Duration; empty for the rest of the window
+
+	window time.Duration
+	block  time.Duration
+}
+
+// Normalize checks the rule and parses its durations. It must be called
+// before the rule is used.
+func (r *Rule) Normalize() error {
+	if !contains(Classes, r.Class) {
+		return fmt.Errorf("unknown class %q (use one of %v)", r.Class, Classes)
+	}
+	if !contains(Scopes, r.Scope) {
+		return fmt.Errorf("unknown scope %q (use ip or key)", r.Scope)
+	}
+	if r.Limit < 1 {
+		return fmt.Errorf("limit must be at least 1")
+	}
+	var err error
+	if r.window, err = time.ParseDuration(r.Window); err != nil || r.window < time.Second || r.window > 24*time.Hour {
+		return fmt.Errorf("window must be a duration between 1s and 24h")
+	}
+	r.block = 0
+	if r.Block != "" {
+		if r.block, err = time.ParseDuration(r.Block); err != nil || r.block < 0 || r.block > 24*time.Hour {
+			return fmt.Errorf("block must be a duration up to 24h")
+		}
+	}
+	return nil
+}
+
+// NormalizeRules normalizes each rule and rejects two rules for the same
+// class and scope
+func NormalizeRules(rules []Rule) error {
+	seen := make(map[string]bool)
+	for i := range rules {
+		if err := rules[i].Normalize(); err != nil {
+			return fmt.Errorf("rule %d: %v", i+1, err)
+		}
+		key := rules[i].Class + "/" + rules[i].Scope
+		if seen[key] {
+			return fmt.Errorf("rule %d: more than one rule for class %s and scope %s", i+1, rules[i].Class, rules[i].Scope)
+		}
+		seen[key] = true
+	}
+	return nil
+}
+
+func contains(values []string, v string) bool {
+	for _, value := range values {
+		if value == v {
+			return true
+		}
+	}
+	return false
+}
+
+// bucket names the counter for a client under a rule. The rule's limit and
+// window are part of it so a changed rule starts counting afresh, and the
+// client is hashed since it may be an API key or session ID.
+func (r *Rule) bucket(client string) string {
+	sum := sha256.Sum256([]byte(client))
+	return fmt.Sprintf("%s:%s:%d:%s:%s", r.Class, r.Scope, r.Limit, r.window, hex.EncodeToString(sum[:16]))
+}
+
+// Store counts requests per client and rule
+type Store interface {
+	// Take counts a request by client under rule. It reports whether the
+	// request is allowed and, if not, how long until the client may retry.
+	Take(rule *Rule, client string, now time.Time) (allowed bool, retryAfter time.Duration, err error)
+	// Cleanup drops counters that can no longer refuse a request
+	Cleanup(now time.Time) error
+}
+
+// decide applies rule to a counter that already includes this request
+func (r *Rule) decide(windowStart time.Time, hits int, blockedUntil, now time.Time) (allowed bool, newBlock time.Time, retryAfter time.Duration) {
+	if now.Before(blockedUntil) {
+		return false, blockedUntil, blockedUntil.Sub(now)
+	}
+	if hits <= r.Limit {
+		return true, time.Time{}, 0
+	}
+	until := windowStart.Add(r.window)
+	if b := now.Add(r.block); b.After(until) {
+		until = b
+	}
+	return false, until, until.Sub(now)
+}
+
+// MemoryStore keeps counters in this process, so each replica limits on
+// its own
+type MemoryStore struct {
+	mu      sync.Mutex
+	entries map[string]*memoryEntry
+}
+
+type memoryEntry struct {
+	windowStart  time.Time
+	windowEnd    time.Time
+	hits         int
+	blockedUntil time.Time
+}
+
+// NewMemoryStore creates an empty in-process store
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{entries: make(map[string]*memoryEntry)}
+}
+
+func (s *MemoryStore) Take(rule *Rule, client string, now time.Time) (bool, time.Duration, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := rule.bucket(client)
+	start := now.Truncate(rule.window)
+	e := s.entries[key]
+	if e == nil {
+		e = &memoryEntry{}
+		s.entries[key] = e
+	}
+	if !e.windowStart.Equal(start) {
+		e.windowStart, e.windowEnd, e.hits = start, start.Add(rule.window), 0
+	}
+	e.hits++
+	allowed, blockedUntil, retryAfter := rule.decide(start, e.hits, e.blockedUntil, now)
+	if !allowed {
+		e.blockedUntil = blockedUntil
+	}
+	return allowed, retryAfter, nil
+}
+
+func (s *MemoryStore) Cleanup(now time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for key, e := range s.entries {
+		if !now.Before(e.windowEnd) && !now.Before(e.blockedUntil) {
+			delete(s.entries, key)
+		}
+	}
+	return nil
+}
+
+// SQLStore keeps counters in the rate_limit_counters table, so the limits
+// hold across replicas. Each request costs one upsert and one read.
+type SQLStore struct {
+	db *sql.DB
+}
+
+// NewSQLStore creates a store on db
+func NewSQLStore(db *sql.DB) *SQLStore {
+	return &SQLStore{db: db}
+}
+
+func (s *SQLStore) Take(rule *Rule, client string, now time.Time) (bool, time.Duration, error) {
+	key := rule.bucket(client)
+	start := now.UTC().Truncate(rule.window)
+	// Assignments run left to right, so hits compares the old window_start
+	_, err := s.db.Exec(`
+		INSERT INTO rate_limit_counters (bucket, window_start, window_end, hits) VALUES (?, ?, ?, 1)
+		ON DUPLICATE KEY UPDATE
+			hits = IF(window_start = VALUES(window_start), hits + 1, 1),
+			window_start = VALUES(window_start),
+			window_end = VALUES(window_end)
+	`, key, start, start.Add(rule.window))
+	if err != nil {
+		return true, 0, err
+	}
+	var hits int
+	var blockedUntil sql.NullTime
+	err = s.db.QueryRow("SELECT hits, blocked_until FROM rate_limit_counters WHERE bucket = ?", key).Scan(&hits, &blockedUntil)
+	if err != nil {
+		return true, 0, err
+	}
+	allowed, until, retryAfter := rule.decide(start, hits, blockedUntil.Time, now.UTC())
+	if !allowed && (!blockedUntil.Valid || !until.Equal(blockedUntil.Time)) {
+		if _, err := s.db.Exec("UPDATE rate_limit_counters SET blocked_until = ? WHERE bucket = ?", until, key); err != nil {
+			return false, retryAfter, err
+		}
+	}
+	return allowed, retryAfter, nil
+}
+
+func (s *SQLStore) Cleanup(now time.Time) error {
+	_, err := s.db.Exec(`
+		DELETE FROM rate_limit_counters
+		WHERE window_end <= ? AND (blocked_until IS NULL OR blocked_until <= ?)
+	`, now.UTC(), now.UTC())
+	return err
+}
@@ -0,0 +1,189 @@
+// Package region supports running a vault in several sites whose databases
+// replicate to each other. Each site issues tokens in a namespace of its
+// own, so two sites never generate the same token, and a site can ask the
+// site that issued a token for its card while replication has not yet
+// brought the row over.
+package region
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync/atomic"
+)
+
+// MaxNameLength bounds region names, which are part of every token issued
+const MaxNameLength = 8
+
+// prefixTokenBody is the length of the random part of a prefix token, 32
+// bytes in padded base64
+const prefixTokenBody = 44
+
+// ValidName checks that name is 1 to MaxNameLength lowercase letters and
+// digits
+func ValidName(name string) error {
+	if name == "" || len(name) > MaxNameLength || strings.Trim(name, "abcdefghijklmnopqrstuvwxyz0123456789") != "" {
+		return fmt.Errorf("invalid region %q: want 1 to %d lowercase letters and digits", name, MaxNameLength)
+	}
+	return nil
+}
+
+// PrefixToken returns the prefix token issued in region with the given
+// random body: tok_<region>_<body>, or tok_<body> without a region
+func PrefixToken(region, body string) string {
+	if region == "" {
+		return "tok_" + body
+	}
+	return "tok_" + region + "_" + body
+}
+
+// OfPrefixToken returns the region a prefix token was issued in, or "" for
+// tokens issued without one
+func OfPrefixToken(token string) string {
+	body := strings.TrimPrefix(token, "tok_")
+	if len(body) == len(token) || len(body) <= prefixTokenBody+1 {
+		return ""
+	}
+	name := body[:len(body)-prefixTokenBody-1]
+	if body[len(name)] != '_' || ValidName(name) != nil {
+		return ""
+	}
+	return name
+}
+
+// ParsePeers parses a comma-separated list of region=URL entries naming the
+// management API of each other site
+func ParsePeers(spec string) (map[string]*url.URL, error) {
+	peers := make(map[string]*url.URL)
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		name, rawURL, ok := strings.Cut(entry, "=")
+		name = strings.TrimSpace(name)
+		if !ok {
+			return nil, fmt.Errorf("invalid peer %q: want region=https://host:port", entry)
+		}
+		if err := ValidName(name); err != nil {
+			return nil, err
+		}
+		if _, dup := peers[name]; dup {
+			return nil, fmt.Errorf("region %s is listed twice", name)
+		}
+		u, err := url.Parse(strings.TrimSpace(rawURL))
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return nil, fmt.Errorf("invalid URL for region %s: want http(s)://host:port", name)
+		}
+		u.Path = strings.TrimSuffix(u.Path, "/")
+		peers[name] = u
+	}
+	return peers, nil
+}
+
+// ErrNotFound is returned when the peer does not have the token either
+var ErrNotFound = errors.New("token not found on peer")
+
+// Stats count the lookups made of one peer
+type Stats struct {
+	Region  string
+	Found   int64
+	Missing int64
+	Errors  int64
+}
+
+// Client looks up cards on the other sites
+type Client struct {
+	self   string
+	apiKey string
+	client *http.Client
+	peers  map[string]*url.URL
+	stats  map[string]*Stats
+}
+
+// NewClient returns a client for the peers, identifying itself as region
+// self and authenticating with apiKey. The client's timeout bounds each
+// lookup.
+func NewClient(self string, peers map[string]*url.URL, apiKey string, client *http.Client) (*Client, error) {
+	if _, ok := peers[self]; ok {
+		return nil, fmt.Errorf("region %s cannot be its own peer", self)
+	}
+	if len(peers) > 0 && apiKey == "" {
+		return nil, errors.New("an API key is needed to call peers")
+	}
+	c := &Client{self: self, apiKey: apiKey, client: client, peers: peers, stats: make(map[string]*Stats)}
+	for name := range peers {
+		c.stats[name] = &Stats{Region: name}
+	}
+	return c, nil
+}
+
+// Has reports whether region is a peer
+func (c *Client) Has(region string) bool {
+	_, ok := c.peers[region]
+	return ok
+}
+
+// Reveal asks the peer region for the card behind token, through its
+// reveal endpoint so the lookup is authorized, counted against the key's
+// quota and audited there
+func (c *Client) Reveal(ctx context.Context, region, token string) (string, error) {
+	base, ok := c.peers[region]
+	if !ok {
+		return "", fmt.Errorf("unknown region %s", region)
+	}
+	stats := c.stats[region]
+	body, _ := json.Marshal(map[string]string{"reason": "replication fallback from region " + c.self})
+	req, err := http.NewRequestWithContext(ctx, "POST", base.String()+"/api/v1/tokens/"+url.PathEscape(token)+"/reveal", bytes.NewReader(body))
+	if err != nil {
+		atomic.AddInt64(&stats.Errors, 1)
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-API-Key", c.apiKey)
+	resp, err := c.client.Do(req)
+	if err != nil {
+		atomic.AddInt64(&stats.Errors, 1)
+		return "", err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		atomic.AddInt64(&stats.Missing, 1)
+		return "", ErrNotFound
+	default:
+		atomic.AddInt64(&stats.Errors, 1)
+		return "", fmt.Errorf("peer %s answered %s", region, resp.Status)
+	}
+	var result struct {
+		CardNumber string `json:"card_number"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil || result.CardNumber == "" {
+		atomic.AddInt64(&stats.Errors, 1)
+		return "", fmt.Errorf("peer %s gave no card number", region)
+	}
+	atomic.AddInt64(&stats.Found, 1)
+	return result.CardNumber, nil
+}
+
+// Stats returns the lookup counts of each peer, ordered by region
+func (c *Client) Stats() []Stats {
+	out := make([]Stats, 0, len(c.stats))
+	for _, s := range c.stats {
+		out = append(out, Stats{
+			Region:  s.Region,
+			Found:   atomic.LoadInt64(&s.Found),
+			Missing: atomic.LoadInt64(&s.Missing),
+			Errors:  atomic.LoadInt64(&s.Errors),
+		})
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Region < out[j].Region })
+	return out
+}
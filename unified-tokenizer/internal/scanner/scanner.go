@@ -0,0 +1,289 @@
+package scanner
+
+import "strings"
+
+// Kind identifies what a Match found
+type Kind int
+
+const (
+	Token Kind = iota
+	PAN
+)
+
+// Match is a token or card number at text[Start:End]
+type Match struct {
+	Kind       Kind
+	Start, End int
+}
+
+// TokenPattern describes a token format: a literal prefix followed by a
+// body of bodyChar bytes and optional trailing padding
+type TokenPattern struct {
+	Prefix   string
+	BodyChar func(c byte) bool
+	MinBody  int
+	MaxBody  int  // 0 means unlimited
+	Padding  byte // accepted any number of times after the body; 0 for none
+	// WordBoundary requires the token not to touch letters, digits or '_'
+	// on either side, like \b in a regexp
+	WordBoundary bool
+}
+
+// PrefixTokens matches "tok_" tokens, like tok_[a-zA-Z0-9_\-]+=*
+func PrefixTokens() TokenPattern {
+	return TokenPattern{
+		Prefix: "tok_",
+		BodyChar: func(c byte) bool {
+			return isWordChar(c) || c == '-'
+		},
+		MinBody: 1,
+		Padding: '=',
+	}
+}
+
+// LuhnTokens matches 16-digit Luhn-format tokens issued from bin, like
+// \b9999[0-9]{12}\b for bin 9999
+func LuhnTokens(bin string) TokenPattern {
+	return TokenPattern{
+		Prefix:       bin,
+		BodyChar:     isDigit,
+		MinBody:      16 - len(bin),
+		MaxBody:      16 - len(bin),
+		WordBoundary: true,
+	}
+}
+
+// Scanner finds tokens and card numbers in a single pass over the text.
+// Token prefixes are matched together with an Aho-Corasick automaton, and
+// card numbers are found by checking each run of digits for a known issuer
+// prefix, a valid length and the Luhn checksum, instead of running one
+// regular expression per pattern and rescanning the text per match.
+type Scanner struct {
+	patterns []TokenPattern
+	pans     bool
+
+	// Aho-Corasick automaton as a full transition table over bytes
+	next   [][256]int32
+	output [][]int // pattern indexes whose prefix ends at each state
+}
+
+// New creates a scanner for the given token patterns; with pans it also
+// reports card numbers
+func New(patterns []TokenPattern, pans bool) *Scanner {
+	s := &Scanner{patterns: patterns, pans: pans}
+	s.build()
+	return s
+}
+
+func (s *Scanner) build() {
+	s.next = [][256]int32{{}}
+	s.output = [][]int{nil}
+
+	// Trie of the prefixes
+	for i, p := range s.patterns {
+		state := int32(0)
+		for j := 0; j < len(p.Prefix); j++ {
+			c := p.Prefix[j]
+			if s.next[state][c] == 0 {
+				s.next = append(s.next, [256]int32{})
+				s.output = append(s.output, nil)
+				s.next[state][c] = int32(len(s.next) - 1)
+			}
+			state = s.next[state][c]
+		}
+		s.output[state] = append(s.output[state], i)
+	}
+
+	// Breadth-first failure links, folded into the transition table so
+	// scanning never follows them at run time
+	fail := make([]int32, len(s.next))
+	var queue []int32
+	for c := 0; c < 256; c++ {
+		if child := s.next[0][c]; child != 0 {
+			queue = append(queue, child)
+		}
+	}
+	for len(queue) > 0 {
+		state := queue[0]
+		queue = queue[1:]
+		s.output[state] = append(s.output[state], s.output[fail[state]]...)
+		for c := 0; c < 256; c++ {
+			child := s.next[state][c]
+			if child == 0 {
+				s.next[state][c] = s.next[fail[state]][c]
+				continue
+			}
+			fail[child] = s.next[fail[state]][c]
+			queue = append(queue, child)
+		}
+	}
+}
+
+// Scan calls fn for each non-overlapping match, in order
+func (s *Scanner) Scan(text string, fn func(Match)) {
+	state := int32(0)
+	runEnd := 0 // digits before runEnd belong to a run already checked
+
+	for i := 0; i < len(text); i++ {
+		c := text[i]
+
+		if s.pans && i >= runEnd && isDigit(c) && (i == 0 || !isWordChar(text[i-1])) {
+			end := i
+			for end < len(text) && isDigit(text[end]) {
+				end++
+			}
+			runEnd = end
+			if (end == len(text) || !isWordChar(text[end])) && IsPAN(text[i:end]) {
+				fn(Match{Kind: PAN, Start: i, End: end})
+				i = end - 1
+				state = 0
+				continue
+			}
+		}
+
+		state = s.next[state][c]
+		for _, idx := range s.output[state] {
+			start := i + 1 - len(s.patterns[idx].Prefix)
+			if end, ok := s.matchToken(text, start, i+1, &s.patterns[idx]); ok {
+				fn(Match{Kind: Token, Start: start, End: end})
+				i = end - 1
+				state = 0
+				runEnd = end
+				break
+			}
+		}
+	}
+}
+
+// matchToken extends a prefix found at text[start:bodyStart] over the body
+// and padding, returning the end of the token
+func (s *Scanner) matchToken(text string, start, bodyStart int, p *TokenPattern) (int, bool) {
+	if p.WordBoundary && start > 0 && isWordChar(text[start-1]) {
+		return 0, false
+	}
+	end := bodyStart
+	for end < len(text) && p.BodyChar(text[end]) && (p.MaxBody == 0 || end-bodyStart < p.MaxBody) {
+		end++
+	}
+	if end-bodyStart < p.MinBody {
+		return 0, false
+	}
+	if p.Padding != 0 {
+		for end < len(text) && text[end] == p.Padding {
+			end++
+		}
+	}
+	if p.WordBoundary && end < len(text) && isWordChar(text[end]) {
+		return 0, false
+	}
+	return end, true
+}
+
+// Find returns all matches of kind in text
+func (s *Scanner) Find(text string, kind Kind) []string {
+	var found []string
+	s.Scan(text, func(m Match) {
+		if m.Kind == kind {
+			found = append(found, text[m.Start:m.End])
+		}
+	})
+	return found
+}
+
+// Contains reports whether text has a match of kind
+func (s *Scanner) Contains(text string, kind Kind) bool {
+	found := false
+	s.Scan(text, func(m Match) {
+		if m.Kind == kind {
+			found = true
+		}
+	})
+	return found
+}
+
+// Replace rewrites each match for which replace returns ok, building the
+// result in one pass. Text without replacements is returned as is.
+func (s *Scanner) Replace(text string, replace func(m Match, value string) (string, bool)) (string, bool) {
+	var b strings.Builder
+	last, replaced := 0, false
+	s.Scan(text, func(m Match) {
+		replacement, ok := replace(m, text[m.Start:m.End])
+		if !ok {
+			return
+		}
+		if !replaced {
+			b.Grow(len(text))
+			replaced = true
+		}
+		b.WriteString(text[last:m.Start])
+		b.WriteString(replacement)
+		last = m.End
+	})
+	if !replaced {
+		return text, false
+	}
+	b.WriteString(text[last:])
+	return b.String(), true
+}
+
+// IsPAN reports whether digits has a known issuer prefix and length and
+// passes the Luhn check
+func IsPAN(digits string) bool {
+	n := len(digits)
+	if n < 13 || n > 19 {
+		return false
+	}
+	if !issuerMatches(digits) {
+		return false
+	}
+	return Luhn(digits)
+}
+
+// issuerMatches applies the issuer ranges the tokenizer's card regexp uses
+func issuerMatches(d string) bool {
+	n := len(d)
+	switch {
+	case d[0] == '4':
+		return n == 13 || n == 16
+	case d[0] == '5' && d[1] >= '1' && d[1] <= '5':
+		return n == 16
+	case d[0] == '3' && (d[1] == '4' || d[1] == '7'):
+		return n == 15
+	case d[0] == '3' && d[1] == '0' && d[2] >= '0' && d[2] <= '5',
+		d[0] == '3' && (d[1] == '6' || d[1] == '8'):
+		return n == 14
+	case strings.HasPrefix(d, "6011"), d[0] == '6' && d[1] == '5':
+		return n == 16
+	case strings.HasPrefix(d, "2131"), strings.HasPrefix(d, "1800"):
+		return n == 15
+	case strings.HasPrefix(d, "35"):
+		return n == 16
+	}
+	return false
+}
+
+// Luhn reports whether a string of digits has a valid check digit
+func Luhn(digits string) bool {
+	sum := 0
+	double := false
+	for i := len(digits) - 1; i >= 0; i-- {
+		d := int(digits[i] - '0')
+		if double {
+			d *= 2
+			if d > 9 {
+				d -= 9
+			}
+		}
+		sum += d
+		double = !double
+	}
+	return sum%10 == 0
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+func isWordChar(c byte) bool {
+	return isDigit(c) || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c == '_'
+}
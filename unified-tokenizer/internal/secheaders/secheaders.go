@@ -0,0 +1,121 @@
+// Package secheaders sets the response headers telling browsers how to
+// treat the API server's responses: HSTS, no MIME sniffing, no framing, the
+// referrer to send, and a Content Security Policy. JSON responses get a
+// policy that allows nothing; the HTML pages the API server serves itself,
+// the status page and Swagger UI, get one allowing what they load.
+package secheaders
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// Off disables a header in the SECURITY_* settings
+const Off = "off"
+
+// Defaults of the headers
+const (
+	DefaultFrameOptions   = "DENY"
+	DefaultReferrerPolicy = "no-referrer"
+	DefaultCSP            = "default-src 'none'; frame-ancestors 'none'"
+	// DefaultPageCSP allows the inline scripts and styles of the status
+	// page and Swagger UI, and Swagger UI's bundle from jsDelivr
+	DefaultPageCSP = "default-src 'self'; script-src 'self' 'unsafe-inline' https://cdn.jsdelivr.net; " +
+		"style-src 'self' 'unsafe-inline' https://cdn.jsdelivr.net; img-src 'self' data:; connect-src 'self'; " +
+		"frame-ancestors 'none'; base-uri 'none'; form-action 'self'"
+)
+
+// Pages are the paths of the HTML pages the API server serves
+var Pages = []string{"/status", "/api/v1/docs"}
+
+// referrerPolicies are the values Referrer-Policy accepts
+var referrerPolicies = map[string]bool{
+	"no-referrer": true, "no-referrer-when-downgrade": true, "origin": true,
+	"origin-when-cross-origin": true, "same-origin": true, "strict-origin": true,
+	"strict-origin-when-cross-origin": true, "unsafe-url": true,
+}
+
+// Headers are the header values to send; an empty value is not sent
+type Headers struct {
+	HSTS           string // Strict-Transport-Security
+	FrameOptions   string // X-Frame-Options
+	ReferrerPolicy string
+	CSP            string // Content-Security-Policy of every response but Pages
+	PageCSP        string // Content-Security-Policy of Pages
+}
+
+// HSTS returns a Strict-Transport-Security value, or "" for a maxAge of 0
+func HSTS(maxAge int, includeSubdomains, preload bool) string {
+	if maxAge <= 0 {
+		return ""
+	}
+	value := fmt.Sprintf("max-age=%d", maxAge)
+	if includeSubdomains {
+		value += "; includeSubDomains"
+	}
+	if preload {
+		value += "; preload"
+	}
+	return value
+}
+
+// Normalize checks the headers, turning values of "off" into "" and
+// canonicalizing X-Frame-Options and Referrer-Policy
+func (h *Headers) Normalize() error {
+	for _, v := range []*string{&h.HSTS, &h.FrameOptions, &h.ReferrerPolicy, &h.CSP, &h.PageCSP} {
+		*v = strings.TrimSpace(*v)
+		if strings.EqualFold(*v, Off) {
+			*v = ""
+		}
+		if strings.ContainsAny(*v, "\r\n\x00") {
+			return fmt.Errorf("header value %q contains a line break", *v)
+		}
+	}
+	h.FrameOptions = strings.ToUpper(h.FrameOptions)
+	if h.FrameOptions != "" && h.FrameOptions != "DENY" && h.FrameOptions != "SAMEORIGIN" {
+		return fmt.Errorf("invalid frame options %q (use DENY, SAMEORIGIN or off)", h.FrameOptions)
+	}
+	h.ReferrerPolicy = strings.ToLower(h.ReferrerPolicy)
+	if h.ReferrerPolicy != "" {
+		for _, policy := range strings.Split(h.ReferrerPolicy, ",") {
+			if !referrerPolicies[strings.TrimSpace(policy)] {
+				return fmt.Errorf("invalid referrer policy %q", strings.TrimSpace(policy))
+			}
+		}
+	}
+	return nil
+}
+
+// Middleware sets the headers on every response of next. Handlers may
+// still replace them, as they are set before next runs.
+func (h Headers) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		header := w.Header()
+		header.Set("X-Content-Type-Options", "nosniff")
+		set := func(name, value string) {
+			if value != "" {
+				header.Set(name, value)
+			}
+		}
+		set("Strict-Transport-Security", h.HSTS)
+		set("X-Frame-Options", h.FrameOptions)
+		set("Referrer-Policy", h.ReferrerPolicy)
+		if isPage(r.URL.Path) {
+			set("Content-Security-Policy", h.PageCSP)
+		} else {
+			set("Content-Security-Policy", h.CSP)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func isPage(path string) bool {
+	path = strings.TrimSuffix(path, "/")
+	for _, page := range Pages {
+		if path == page {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,59 @@
+package securerand
+
+import (
+	cryptorand "crypto/rand"
+	"encoding/binary"
+	"fmt"
+)
+
+// The helpers here draw from crypto/rand, for tokens, passwords, IDs and
+// anything else an attacker must not be able to predict. crypto/rand only
+// fails when the system has no entropy source, and there is no safe
+// fallback then, so they panic rather than return an error.
+
+// Bytes returns n random bytes
+func Bytes(n int) []byte {
+	b := make([]byte, n)
+	if _, err := cryptorand.Read(b); err != nil {
+		panic(fmt.Sprintf("securerand: crypto/rand failed: %v", err))
+	}
+	return b
+}
+
+// Int returns a uniform random number in [0, n). It panics if n <= 0.
+func Int(n int) int {
+	if n <= 0 {
+		panic("securerand: Int called with n <= 0")
+	}
+	// Reject draws from the incomplete last block so every value is
+	// equally likely
+	max := uint64(n)
+	limit := ^uint64(0) - (^uint64(0)%max+1)%max
+	for {
+		v := binary.BigEndian.Uint64(Bytes(8))
+		if v <= limit {
+			return int(v % max)
+		}
+	}
+}
+
+// Digits returns n random decimal digits
+func Digits(n int) string {
+	digits := make([]byte, n)
+	for i := range digits {
+		digits[i] = byte('0' + Int(10))
+	}
+	return string(digits)
+}
+
+// Choice returns a random byte of s. It panics if s is empty.
+func Choice(s string) byte {
+	return s[Int(len(s))]
+}
+
+// Shuffle puts n elements in random order, calling swap to exchange two
+func Shuffle(n int, swap func(i, j int)) {
+	for i := n - 1; i > 0; i-- {
+		swap(i, Int(i+1))
+	}
+}
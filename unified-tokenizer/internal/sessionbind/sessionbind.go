@@ -0,0 +1,131 @@
+// Package sessionbind decides whether a session is being used from the
+// network and browser it was created from, so that a stolen session ID
+// does not work from anywhere.
+package sessionbind
+
+import (
+	"fmt"
+	"net/netip"
+	"strings"
+)
+
+// Mode is what happens when a session is used from elsewhere
+type Mode string
+
+const (
+	Off    Mode = "off"     // Sessions are not bound
+	Log    Mode = "log"     // The mismatch is logged and the request goes on
+	StepUp Mode = "step_up" // The user must enter their password again before the session is used there
+	Strict Mode = "strict"  // The session is ended
+)
+
+// ParseMode parses a SESSION_BINDING value
+func ParseMode(s string) (Mode, error) {
+	switch mode := Mode(strings.ToLower(strings.TrimSpace(s))); mode {
+	case Off, Log, StepUp, Strict:
+		return mode, nil
+	case "":
+		return Off, nil
+	}
+	return "", fmt.Errorf("unknown session binding %q: use off, log, step_up or strict", s)
+}
+
+// Policy is what sessions are bound to, and what a mismatch leads to
+type Policy struct {
+	Mode       Mode
+	IPv4Prefix int  // Leading bits of an IPv4 address that must match; 0 ignores IPv4 addresses
+	IPv6Prefix int  // Leading bits of an IPv6 address that must match; 0 ignores IPv6 addresses
+	UserAgent  bool // Whether the browser family and operating system must match
+}
+
+// Enabled reports whether sessions are bound at all
+func (p Policy) Enabled() bool {
+	return p.Mode != "" && p.Mode != Off
+}
+
+// Mismatch returns what differs between the client a session is bound to
+// and the one using it: "network", "user_agent", both or neither
+func (p Policy) Mismatch(boundIP, boundUserAgent, ip, userAgent string) []string {
+	var reasons []string
+	if !p.sameNetwork(boundIP, ip) {
+		reasons = append(reasons, "network")
+	}
+	if p.UserAgent && Family(boundUserAgent) != Family(userAgent) {
+		reasons = append(reasons, "user_agent")
+	}
+	return reasons
+}
+
+// sameNetwork reports whether a and b are in the same IPv4 or IPv6
+// network of the policy's prefix length. Unparsable addresses must be
+// equal.
+func (p Policy) sameNetwork(a, b string) bool {
+	x, errX := netip.ParseAddr(a)
+	y, errY := netip.ParseAddr(b)
+	if errX != nil || errY != nil {
+		return a == b
+	}
+	x, y = x.Unmap(), y.Unmap()
+	if x.Is4() != y.Is4() {
+		return false
+	}
+	bits := p.IPv6Prefix
+	if x.Is4() {
+		bits = p.IPv4Prefix
+	}
+	if bits == 0 {
+		return true
+	}
+	px, errX := x.Prefix(bits)
+	py, errY := y.Prefix(bits)
+	return errX == nil && errY == nil && px == py
+}
+
+// browsers are User-Agent tokens and the browser they identify, most
+// specific first, as Edge and Opera also claim to be Chrome and Safari
+var browsers = []struct{ token, name string }{
+	{"Edg/", "Edge"},
+	{"Edge/", "Edge"},
+	{"OPR/", "Opera"},
+	{"Firefox/", "Firefox"},
+	{"FxiOS/", "Firefox"},
+	{"CriOS/", "Chrome"},
+	{"Chrome/", "Chrome"},
+	{"Safari/", "Safari"},
+}
+
+// systems are User-Agent tokens and the operating system they identify;
+// iPads and Android claim to be Mac OS X and Linux
+var systems = []struct{ token, name string }{
+	{"Windows", "Windows"},
+	{"iPhone", "iOS"},
+	{"iPad", "iOS"},
+	{"Android", "Android"},
+	{"CrOS", "ChromeOS"},
+	{"Mac OS X", "macOS"},
+	{"Linux", "Linux"},
+}
+
+// Family reduces a User-Agent to its browser and operating system, like
+// "Chrome on Windows", or for other clients to their product name, like
+// "curl", so that updating the browser does not count as a change
+func Family(userAgent string) string {
+	client := ""
+	for _, b := range browsers {
+		if strings.Contains(userAgent, b.token) {
+			client = b.name
+			break
+		}
+	}
+	if client == "" {
+		// The product token, without its version
+		client, _, _ = strings.Cut(strings.TrimSpace(userAgent), " ")
+		client, _, _ = strings.Cut(client, "/")
+	}
+	for _, s := range systems {
+		if strings.Contains(userAgent, s.token) {
+			return client + " on " + s.name
+		}
+	}
+	return client
+}
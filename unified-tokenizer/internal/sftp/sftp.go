@@ -0,0 +1,405 @@
+// Package sftp is a minimal SFTP version 3 client (draft-ietf-secsh-filexfer-02),
+// enough to list a drop folder, download its files and remove them. Requests
+// are sent one at a time.
+package sftp
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Packet types
+const (
+	fxpInit     = 1
+	fxpVersion  = 2
+	fxpOpen     = 3
+	fxpClose    = 4
+	fxpRead     = 5
+	fxpOpendir  = 11
+	fxpReaddir  = 12
+	fxpRemove   = 13
+	fxpStatus   = 101
+	fxpHandle   = 102
+	fxpData     = 103
+	fxpName     = 104
+	openRead    = 0x1
+	readSize    = 32 << 10
+	maxPacket   = 256 << 10
+	protocolVer = 3
+)
+
+// Status codes
+const (
+	statusOK         = 0
+	statusEOF        = 1
+	statusNoSuchFile = 2
+)
+
+// Attribute flags
+const (
+	attrSize        = 0x1
+	attrUIDGID      = 0x2
+	attrPermissions = 0x4
+	attrACModTime   = 0x8
+	attrExtended    = 0x80000000
+)
+
+// StatusError is a failure reported by the server
+type StatusError struct {
+	Code    uint32
+	Message string
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("sftp: %s (status %d)", e.Message, e.Code)
+}
+
+// Is lets errors.Is(err, os.ErrNotExist) match a missing file
+func (e *StatusError) Is(target error) bool {
+	return target == os.ErrNotExist && e.Code == statusNoSuchFile
+}
+
+// FileInfo describes a directory entry
+type FileInfo struct {
+	Name    string
+	Size    int64
+	ModTime time.Time
+	IsDir   bool
+}
+
+// Client is an SFTP session
+type Client struct {
+	mu     sync.Mutex
+	r      io.Reader
+	w      io.WriteCloser
+	nextID uint32
+	closer func() error
+}
+
+// Dial connects to addr over SSH and starts the sftp subsystem
+func Dial(addr string, config *ssh.ClientConfig) (*Client, error) {
+	conn, err := ssh.Dial("tcp", addr, config)
+	if err != nil {
+		return nil, err
+	}
+	session, err := conn.NewSession()
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	w, err := session.StdinPipe()
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	r, err := session.StdoutPipe()
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if err := session.RequestSubsystem("sftp"); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	c, err := NewClient(r, w)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	c.closer = func() error {
+		session.Close()
+		return conn.Close()
+	}
+	return c, nil
+}
+
+// NewClient starts an SFTP session over an established channel
+func NewClient(r io.Reader, w io.WriteCloser) (*Client, error) {
+	c := &Client{r: r, w: w}
+	var init []byte
+	init = appendUint32(init, protocolVer)
+	if err := c.send(fxpInit, init); err != nil {
+		return nil, err
+	}
+	typ, payload, err := c.receive()
+	if err != nil {
+		return nil, err
+	}
+	if typ != fxpVersion || len(payload) < 4 {
+		return nil, errors.New("sftp: server did not send its version")
+	}
+	if v := binary.BigEndian.Uint32(payload); v < protocolVer {
+		return nil, fmt.Errorf("sftp: server speaks version %d, need %d", v, protocolVer)
+	}
+	return c, nil
+}
+
+// Close ends the session
+func (c *Client) Close() error {
+	c.w.Close()
+	if c.closer != nil {
+		return c.closer()
+	}
+	return nil
+}
+
+// ReadDir lists a directory, without "." and ".."
+func (c *Client) ReadDir(path string) ([]FileInfo, error) {
+	handle, err := c.handle(fxpOpendir, appendString(nil, path))
+	if err != nil {
+		return nil, err
+	}
+	defer c.closeHandle(handle)
+
+	var entries []FileInfo
+	for {
+		typ, payload, err := c.request(fxpReaddir, appendString(nil, handle))
+		if err != nil {
+			return nil, err
+		}
+		if typ == fxpStatus {
+			if err := statusError(payload); err != nil && !isEOF(err) {
+				return nil, err
+			}
+			return entries, nil
+		}
+		if typ != fxpName {
+			return nil, fmt.Errorf("sftp: unexpected packet %d listing %s", typ, path)
+		}
+		d := decoder{buf: payload}
+		count := d.uint32()
+		for i := uint32(0); i < count && d.err == nil; i++ {
+			name := string(d.string())
+			d.string() // longname
+			info := d.attrs()
+			if name == "." || name == ".." {
+				continue
+			}
+			info.Name = name
+			entries = append(entries, info)
+		}
+		if d.err != nil {
+			return nil, d.err
+		}
+	}
+}
+
+// ReadFile downloads a file, failing if it is larger than limit bytes
+func (c *Client) ReadFile(path string, limit int64) ([]byte, error) {
+	var open []byte
+	open = appendString(open, path)
+	open = appendUint32(open, openRead)
+	open = appendUint32(open, 0) // No attributes
+	handle, err := c.handle(fxpOpen, open)
+	if err != nil {
+		return nil, err
+	}
+	defer c.closeHandle(handle)
+
+	var data []byte
+	for {
+		var read []byte
+		read = appendString(read, handle)
+		read = appendUint64(read, uint64(len(data)))
+		read = appendUint32(read, readSize)
+		typ, payload, err := c.request(fxpRead, read)
+		if err != nil {
+			return nil, err
+		}
+		if typ == fxpStatus {
+			if err := statusError(payload); err != nil && !isEOF(err) {
+				return nil, err
+			}
+			return data, nil
+		}
+		if typ != fxpData {
+			return nil, fmt.Errorf("sftp: unexpected packet %d reading %s", typ, path)
+		}
+		d := decoder{buf: payload}
+		chunk := d.string()
+		if d.err != nil {
+			return nil, d.err
+		}
+		if int64(len(data)+len(chunk)) > limit {
+			return nil, fmt.Errorf("sftp: %s is larger than %d bytes", path, limit)
+		}
+		data = append(data, chunk...)
+	}
+}
+
+// Remove deletes a file
+func (c *Client) Remove(path string) error {
+	typ, payload, err := c.request(fxpRemove, appendString(nil, path))
+	if err != nil {
+		return err
+	}
+	if typ != fxpStatus {
+		return fmt.Errorf("sftp: unexpected packet %d removing %s", typ, path)
+	}
+	return statusError(payload)
+}
+
+// handle sends a request answered with a handle
+func (c *Client) handle(typ byte, payload []byte) (string, error) {
+	rtyp, resp, err := c.request(typ, payload)
+	if err != nil {
+		return "", err
+	}
+	switch rtyp {
+	case fxpHandle:
+		d := decoder{buf: resp}
+		h := d.string()
+		return string(h), d.err
+	case fxpStatus:
+		if err := statusError(resp); err != nil {
+			return "", err
+		}
+	}
+	return "", fmt.Errorf("sftp: unexpected packet %d", rtyp)
+}
+
+func (c *Client) closeHandle(handle string) {
+	c.request(fxpClose, appendString(nil, handle))
+}
+
+// request sends a request and returns the response's type and payload,
+// after its request ID
+func (c *Client) request(typ byte, payload []byte) (byte, []byte, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.nextID++
+	id := c.nextID
+	if err := c.send(typ, append(appendUint32(nil, id), payload...)); err != nil {
+		return 0, nil, err
+	}
+	rtyp, resp, err := c.receive()
+	if err != nil {
+		return 0, nil, err
+	}
+	if len(resp) < 4 || binary.BigEndian.Uint32(resp) != id {
+		return 0, nil, errors.New("sftp: response does not match request")
+	}
+	return rtyp, resp[4:], nil
+}
+
+func (c *Client) send(typ byte, payload []byte) error {
+	packet := appendUint32(nil, uint32(len(payload)+1))
+	packet = append(packet, typ)
+	_, err := c.w.Write(append(packet, payload...))
+	return err
+}
+
+func (c *Client) receive() (byte, []byte, error) {
+	var header [5]byte
+	if _, err := io.ReadFull(c.r, header[:]); err != nil {
+		return 0, nil, err
+	}
+	length := binary.BigEndian.Uint32(header[:4])
+	if length < 1 || length > maxPacket {
+		return 0, nil, fmt.Errorf("sftp: packet of %d bytes", length)
+	}
+	payload := make([]byte, length-1)
+	if _, err := io.ReadFull(c.r, payload); err != nil {
+		return 0, nil, err
+	}
+	return header[4], payload, nil
+}
+
+// statusError returns the error in a status payload, nil for OK
+func statusError(payload []byte) error {
+	d := decoder{buf: payload}
+	code := d.uint32()
+	message := d.string()
+	if d.err != nil {
+		return d.err
+	}
+	if code == statusOK {
+		return nil
+	}
+	return &StatusError{Code: code, Message: string(message)}
+}
+
+func isEOF(err error) bool {
+	var status *StatusError
+	return errors.As(err, &status) && status.Code == statusEOF
+}
+
+func appendUint32(b []byte, v uint32) []byte {
+	return binary.BigEndian.AppendUint32(b, v)
+}
+
+func appendUint64(b []byte, v uint64) []byte {
+	return binary.BigEndian.AppendUint64(b, v)
+}
+
+func appendString(b []byte, s string) []byte {
+	return append(appendUint32(b, uint32(len(s))), s...)
+}
+
+// decoder reads fields from a packet, remembering the first error
+type decoder struct {
+	buf []byte
+	err error
+}
+
+var errShort = errors.New("sftp: packet too short")
+
+func (d *decoder) uint32() uint32 {
+	if len(d.buf) < 4 {
+		d.err = errShort
+		d.buf = nil
+		return 0
+	}
+	v := binary.BigEndian.Uint32(d.buf)
+	d.buf = d.buf[4:]
+	return v
+}
+
+func (d *decoder) uint64() uint64 {
+	return uint64(d.uint32())<<32 | uint64(d.uint32())
+}
+
+func (d *decoder) string() []byte {
+	n := d.uint32()
+	if uint64(n) > uint64(len(d.buf)) {
+		d.err = errShort
+		d.buf = nil
+		return nil
+	}
+	s := d.buf[:n]
+	d.buf = d.buf[n:]
+	return s
+}
+
+func (d *decoder) attrs() FileInfo {
+	var info FileInfo
+	flags := d.uint32()
+	if flags&attrSize != 0 {
+		info.Size = int64(d.uint64())
+	}
+	if flags&attrUIDGID != 0 {
+		d.uint32()
+		d.uint32()
+	}
+	if flags&attrPermissions != 0 {
+		info.IsDir = d.uint32()&0o170000 == 0o040000
+	}
+	if flags&attrACModTime != 0 {
+		d.uint32() // atime
+		info.ModTime = time.Unix(int64(d.uint32()), 0)
+	}
+	if flags&attrExtended != 0 {
+		for n := d.uint32(); n > 0 && d.err == nil; n-- {
+			d.string()
+			d.string()
+		}
+	}
+	return info
+}
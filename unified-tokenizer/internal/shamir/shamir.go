@@ -0,0 +1,129 @@
+package shamir
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+)
+
+// Split divides secret into n shares, any threshold of which recover it.
+// Each byte of the secret is the constant term of a random polynomial of
+// degree threshold-1 over GF(2^8); a share is the polynomial values at a
+// distinct non-zero x, followed by x itself.
+func Split(secret []byte, n, threshold int) ([][]byte, error) {
+	if len(secret) == 0 {
+		return nil, errors.New("cannot split an empty secret")
+	}
+	if threshold < 2 || threshold > n || n > 255 {
+		return nil, fmt.Errorf("invalid threshold %d of %d shares (need 2 <= threshold <= shares <= 255)", threshold, n)
+	}
+
+	// Random distinct x coordinates, so share order reveals nothing
+	xs := make([]byte, 0, n)
+	seen := make(map[byte]bool)
+	for len(xs) < n {
+		var b [1]byte
+		if _, err := rand.Read(b[:]); err != nil {
+			return nil, err
+		}
+		if b[0] != 0 && !seen[b[0]] {
+			seen[b[0]] = true
+			xs = append(xs, b[0])
+		}
+	}
+
+	shares := make([][]byte, n)
+	for i := range shares {
+		shares[i] = make([]byte, len(secret)+1)
+		shares[i][len(secret)] = xs[i]
+	}
+
+	coefficients := make([]byte, threshold)
+	for idx, s := range secret {
+		coefficients[0] = s
+		if _, err := rand.Read(coefficients[1:]); err != nil {
+			return nil, err
+		}
+		for i, x := range xs {
+			shares[i][idx] = evaluate(coefficients, x)
+		}
+	}
+	return shares, nil
+}
+
+// Combine recovers the secret from threshold or more shares. It cannot
+// tell a wrong result from a right one; callers verify the secret.
+func Combine(shares [][]byte) ([]byte, error) {
+	if len(shares) < 2 {
+		return nil, errors.New("at least two shares are required")
+	}
+	size := len(shares[0])
+	if size < 2 {
+		return nil, errors.New("share too short")
+	}
+	xs := make([]byte, len(shares))
+	for i, share := range shares {
+		if len(share) != size {
+			return nil, errors.New("shares have different lengths")
+		}
+		xs[i] = share[size-1]
+		if xs[i] == 0 {
+			return nil, errors.New("invalid share")
+		}
+		for j := 0; j < i; j++ {
+			if xs[j] == xs[i] {
+				return nil, errors.New("duplicate share")
+			}
+		}
+	}
+
+	// Lagrange interpolation at x = 0
+	secret := make([]byte, size-1)
+	for idx := range secret {
+		var value byte
+		for i := range shares {
+			basis := byte(1)
+			for j := range shares {
+				if i != j {
+					// x_j / (x_j - x_i); subtraction is XOR in GF(2^8)
+					basis = mul(basis, div(xs[j], xs[i]^xs[j]))
+				}
+			}
+			value ^= mul(shares[i][idx], basis)
+		}
+		secret[idx] = value
+	}
+	return secret, nil
+}
+
+// evaluate computes the polynomial at x with Horner's method
+func evaluate(coefficients []byte, x byte) byte {
+	var result byte
+	for i := len(coefficients) - 1; i >= 0; i-- {
+		result = mul(result, x) ^ coefficients[i]
+	}
+	return result
+}
+
+// mul multiplies in GF(2^8) with the AES polynomial x^8+x^4+x^3+x+1,
+// without data-dependent branches
+func mul(a, b byte) byte {
+	var product byte
+	for i := 0; i < 8; i++ {
+		product ^= -(b & 1) & a
+		carry := -(a >> 7) & 0x1b
+		a = a<<1 ^ carry
+		b >>= 1
+	}
+	return product
+}
+
+// div computes a / b as a * b^254 (b^-1, since b^255 = 1)
+func div(a, b byte) byte {
+	inverse := b
+	for i := 0; i < 6; i++ {
+		inverse = mul(mul(inverse, inverse), b)
+	}
+	inverse = mul(inverse, inverse)
+	return mul(a, inverse)
+}
@@ -0,0 +1,308 @@
+// Package smtprelay is a small SMTP server for a mail server's content
+// filter hook (Postfix content_filter, Exchange or Sendmail smart host):
+// it takes each message, passes it through a filter and relays the result
+// to the next hop, so the client only gets 250 once the next hop has the
+// message (RFC 5321).
+package smtprelay
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/smtp"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Envelope is the sender and recipients of a message
+type Envelope struct {
+	RemoteAddr string
+	Helo       string
+	From       string
+	To         []string
+}
+
+// Reply is an SMTP reply to send instead of accepting a message
+type Reply struct {
+	Code    int
+	Message string // Starting with an enhanced status code, like "5.7.1 ..."
+}
+
+func (r *Reply) Error() string {
+	return fmt.Sprintf("%d %s", r.Code, r.Message)
+}
+
+// Server accepts messages over SMTP
+type Server struct {
+	Hostname string // Named in the greeting
+
+	// Filter returns the message to relay. Returning a *Reply answers the
+	// client with it; any other error is a temporary failure.
+	Filter func(env *Envelope, msg []byte) ([]byte, error)
+	// Relay passes the filtered message on
+	Relay func(env *Envelope, msg []byte) error
+
+	MaxSize       int64         // Largest message accepted
+	MaxRecipients int           // Most recipients per message
+	Timeout       time.Duration // For each command and for the message data
+	TLSConfig     *tls.Config   // Offers STARTTLS when set
+}
+
+// session is one client connection
+type session struct {
+	s    *Server
+	conn net.Conn
+	text *textproto.Conn
+	tls  bool
+	env  *Envelope
+	helo string
+}
+
+// Serve handles a client connection until it quits or times out
+func (s *Server) Serve(conn net.Conn) {
+	defer conn.Close()
+	ss := &session{s: s, conn: conn, text: textproto.NewConn(conn)}
+	ss.reply(220, s.Hostname+" ESMTP TokenShield")
+	for {
+		if s.Timeout > 0 {
+			ss.conn.SetDeadline(time.Now().Add(s.Timeout))
+		}
+		line, err := ss.text.ReadLine()
+		if err != nil {
+			return
+		}
+		verb, arg, _ := strings.Cut(line, " ")
+		if !ss.command(strings.ToUpper(verb), strings.TrimSpace(arg)) {
+			return
+		}
+	}
+}
+
+// command runs one command, returning false when the connection is done
+func (ss *session) command(verb, arg string) bool {
+	switch verb {
+	case "HELO", "EHLO":
+		if arg == "" {
+			ss.reply(501, "5.5.4 Syntax: "+verb+" hostname")
+			return true
+		}
+		ss.helo, ss.env = arg, nil
+		if verb == "HELO" {
+			ss.reply(250, ss.s.Hostname)
+			return true
+		}
+		lines := []string{ss.s.Hostname, "8BITMIME", "ENHANCEDSTATUSCODES"}
+		if ss.s.MaxSize > 0 {
+			lines = append(lines, "SIZE "+strconv.FormatInt(ss.s.MaxSize, 10))
+		}
+		if ss.s.TLSConfig != nil && !ss.tls {
+			lines = append(lines, "STARTTLS")
+		}
+		ss.replyLines(250, lines)
+	case "STARTTLS":
+		if ss.s.TLSConfig == nil || ss.tls {
+			ss.reply(502, "5.5.1 STARTTLS not available")
+			return true
+		}
+		ss.reply(220, "2.0.0 Ready to start TLS")
+		tlsConn := tls.Server(ss.conn, ss.s.TLSConfig)
+		if err := tlsConn.Handshake(); err != nil {
+			return false
+		}
+		ss.conn, ss.text, ss.tls = tlsConn, textproto.NewConn(tlsConn), true
+		ss.helo, ss.env = "", nil // The client starts over (RFC 3207)
+	case "MAIL":
+		if ss.helo == "" {
+			ss.reply(503, "5.5.1 Send EHLO first")
+			return true
+		}
+		from, params, ok := path(arg, "FROM:")
+		if !ok {
+			ss.reply(501, "5.5.4 Syntax: MAIL FROM:<address>")
+			return true
+		}
+		for _, p := range params {
+			name, value, _ := strings.Cut(p, "=")
+			if strings.EqualFold(name, "SIZE") && ss.s.MaxSize > 0 {
+				if size, err := strconv.ParseInt(value, 10, 64); err == nil && size > ss.s.MaxSize {
+					ss.reply(552, "5.3.4 Message too big")
+					return true
+				}
+			}
+		}
+		ss.env = &Envelope{RemoteAddr: ss.conn.RemoteAddr().String(), Helo: ss.helo, From: from}
+		ss.reply(250, "2.1.0 OK")
+	case "RCPT":
+		if ss.env == nil {
+			ss.reply(503, "5.5.1 Send MAIL first")
+			return true
+		}
+		to, _, ok := path(arg, "TO:")
+		if !ok || to == "" {
+			ss.reply(501, "5.5.4 Syntax: RCPT TO:<address>")
+			return true
+		}
+		if ss.s.MaxRecipients > 0 && len(ss.env.To) >= ss.s.MaxRecipients {
+			ss.reply(452, "4.5.3 Too many recipients")
+			return true
+		}
+		ss.env.To = append(ss.env.To, to)
+		ss.reply(250, "2.1.5 OK")
+	case "DATA":
+		if ss.env == nil || len(ss.env.To) == 0 {
+			ss.reply(503, "5.5.1 Send RCPT first")
+			return true
+		}
+		ss.reply(354, "End data with <CR><LF>.<CR><LF>")
+		return ss.data()
+	case "RSET":
+		ss.env = nil
+		ss.reply(250, "2.0.0 OK")
+	case "NOOP":
+		ss.reply(250, "2.0.0 OK")
+	case "VRFY":
+		ss.reply(252, "2.5.0 Cannot verify, but will relay")
+	case "QUIT":
+		ss.reply(221, "2.0.0 Bye")
+		return false
+	default:
+		ss.reply(500, "5.5.2 Command not recognized")
+	}
+	return true
+}
+
+// data reads a message, filters and relays it, and answers for it
+func (ss *session) data() bool {
+	env := ss.env
+	ss.env = nil
+	if ss.s.Timeout > 0 {
+		ss.conn.SetDeadline(time.Now().Add(ss.s.Timeout))
+	}
+	r := ss.text.DotReader()
+	limit := ss.s.MaxSize
+	if limit <= 0 {
+		limit = 1<<63 - 1
+	}
+	msg, err := io.ReadAll(io.LimitReader(r, limit))
+	if err != nil {
+		return false
+	}
+	if n, _ := io.Copy(io.Discard, r); n > 0 {
+		ss.reply(552, "5.3.4 Message too big")
+		return true
+	}
+
+	out, err := ss.s.Filter(env, msg)
+	if err == nil {
+		err = ss.s.Relay(env, out)
+	}
+	var reply *Reply
+	var relayErr *textproto.Error
+	switch {
+	case err == nil:
+		ss.reply(250, "2.0.0 OK")
+	case errors.As(err, &reply):
+		ss.reply(reply.Code, reply.Message)
+	case errors.As(err, &relayErr) && relayErr.Code >= 500:
+		// The next hop refused it for good; so do we
+		ss.reply(relayErr.Code, relayErr.Msg)
+	default:
+		log.Printf("SMTP message from %s not relayed: %v", env.RemoteAddr, err)
+		ss.reply(451, "4.3.0 Temporary failure, try again later")
+	}
+	return true
+}
+
+func (ss *session) reply(code int, message string) {
+	ss.replyLines(code, []string{message})
+}
+
+func (ss *session) replyLines(code int, lines []string) {
+	w := ss.text.Writer.W
+	for i, line := range lines {
+		sep := "-"
+		if i == len(lines)-1 {
+			sep = " "
+		}
+		fmt.Fprintf(w, "%d%s%s\r\n", code, sep, line)
+	}
+	w.Flush()
+}
+
+// path parses "FROM:<address> PARAM=value ..." after the verb
+func path(arg, prefix string) (address string, params []string, ok bool) {
+	if len(arg) < len(prefix) || !strings.EqualFold(arg[:len(prefix)], prefix) {
+		return "", nil, false
+	}
+	fields := strings.Fields(strings.TrimSpace(arg[len(prefix):]))
+	if len(fields) == 0 {
+		return "", nil, false
+	}
+	address = fields[0]
+	if !strings.HasPrefix(address, "<") || !strings.HasSuffix(address, ">") {
+		return "", nil, false
+	}
+	return address[1 : len(address)-1], fields[1:], true
+}
+
+// Sender relays messages to one next hop
+type Sender struct {
+	Addr      string        // host:port
+	Hostname  string        // Sent in EHLO
+	TLSConfig *tls.Config   // Used for STARTTLS when the next hop offers it
+	Timeout   time.Duration // For the whole transaction
+}
+
+// Send relays msg to the next hop
+func (snd *Sender) Send(env *Envelope, msg []byte) error {
+	conn, err := net.DialTimeout("tcp", snd.Addr, snd.Timeout)
+	if err != nil {
+		return err
+	}
+	if snd.Timeout > 0 {
+		conn.SetDeadline(time.Now().Add(snd.Timeout))
+	}
+	host, _, _ := net.SplitHostPort(snd.Addr)
+	c, err := smtp.NewClient(conn, host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer c.Close()
+	if err := c.Hello(snd.Hostname); err != nil {
+		return err
+	}
+	if ok, _ := c.Extension("STARTTLS"); ok && snd.TLSConfig != nil {
+		config := snd.TLSConfig.Clone()
+		if config.ServerName == "" {
+			config.ServerName = host
+		}
+		if err := c.StartTLS(config); err != nil {
+			return err
+		}
+	}
+	if err := c.Mail(env.From); err != nil {
+		return err
+	}
+	for _, to := range env.To {
+		if err := c.Rcpt(to); err != nil {
+			return err
+		}
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(msg); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return c.Quit()
+}
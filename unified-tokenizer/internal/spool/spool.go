@@ -0,0 +1,125 @@
+package spool
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"io"
+	"os"
+)
+
+// Buffer holds a request body in memory up to a threshold and spills the
+// rest to a temporary file. Proxied bodies carry card numbers before they
+// are tokenized, so the file is encrypted with a key that only ever lives
+// in memory, and it is unlinked as soon as it is created so nothing is
+// left behind if the process dies.
+type Buffer struct {
+	dir       string
+	threshold int64
+
+	mem  bytes.Buffer
+	file *os.File
+	key  []byte
+	iv   []byte
+	w    io.Writer // Encrypting writer into file
+	size int64
+}
+
+// New creates a buffer that spills to a file in dir (the system temporary
+// directory when empty) once more than threshold bytes are written
+func New(dir string, threshold int64) *Buffer {
+	return &Buffer{dir: dir, threshold: threshold}
+}
+
+// Write appends p, spilling to disk when the threshold is crossed
+func (b *Buffer) Write(p []byte) (int, error) {
+	if b.file == nil && int64(b.mem.Len()+len(p)) > b.threshold {
+		if err := b.spill(); err != nil {
+			return 0, err
+		}
+	}
+	var n int
+	var err error
+	if b.file != nil {
+		n, err = b.w.Write(p)
+	} else {
+		n, err = b.mem.Write(p)
+	}
+	b.size += int64(n)
+	return n, err
+}
+
+// spill moves what is buffered in memory to a new encrypted file
+func (b *Buffer) spill() error {
+	b.key = make([]byte, 32)
+	b.iv = make([]byte, aes.BlockSize)
+	if _, err := rand.Read(b.key); err != nil {
+		return err
+	}
+	if _, err := rand.Read(b.iv); err != nil {
+		return err
+	}
+	block, err := aes.NewCipher(b.key)
+	if err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(b.dir, "tokenshield-body-*")
+	if err != nil {
+		return err
+	}
+	os.Remove(f.Name())
+	b.file = f
+	b.w = cipher.StreamWriter{S: cipher.NewCTR(block, b.iv), W: f}
+	if _, err := b.w.Write(b.mem.Bytes()); err != nil {
+		return err
+	}
+	b.mem = bytes.Buffer{}
+	return nil
+}
+
+// Len is the number of bytes written
+func (b *Buffer) Len() int64 {
+	return b.size
+}
+
+// Spilled reports whether the body went to disk
+func (b *Buffer) Spilled() bool {
+	return b.file != nil
+}
+
+// Bytes returns the body while it is held in memory, or nil once spilled
+func (b *Buffer) Bytes() []byte {
+	if b.file != nil {
+		return nil
+	}
+	return b.mem.Bytes()
+}
+
+// Reader returns a new reader over the whole body. It can be called any
+// number of times, e.g. as a request's GetBody, until the buffer is closed.
+func (b *Buffer) Reader() (io.ReadCloser, error) {
+	if b.file == nil {
+		return io.NopCloser(bytes.NewReader(b.mem.Bytes())), nil
+	}
+	block, err := aes.NewCipher(b.key)
+	if err != nil {
+		return nil, err
+	}
+	return io.NopCloser(cipher.StreamReader{
+		S: cipher.NewCTR(block, b.iv),
+		R: io.NewSectionReader(b.file, 0, b.size),
+	}), nil
+}
+
+// Close releases the file, if any. Readers must not be used afterwards.
+func (b *Buffer) Close() error {
+	b.mem = bytes.Buffer{}
+	if b.file == nil {
+		return nil
+	}
+	for i := range b.key {
+		b.key[i] = 0
+	}
+	return b.file.Close()
+}
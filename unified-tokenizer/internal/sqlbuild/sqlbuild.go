@@ -0,0 +1,175 @@
+package sqlbuild
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Columns maps the names a query may filter, sort or update by to the SQL
+// they stand for: a column, or an expression over columns. It is the
+// allow-list for a query: other names are refused, and values only ever
+// reach the database as placeholder arguments. The SQL must be constant.
+type Columns map[string]string
+
+// operators are the comparisons a condition may use
+var operators = map[string]bool{"=": true, "!=": true, "<": true, "<=": true, ">": true, ">=": true}
+
+// Select collects the conditions and ordering of a SELECT. The first
+// invalid call is remembered and returned by Where and OrderBy.
+type Select struct {
+	columns Columns
+	conds   []string
+	args    []interface{}
+	order   []string
+	err     error
+}
+
+// Select starts a query restricted to c
+func (c Columns) Select() *Select {
+	return &Select{columns: c}
+}
+
+func (c Columns) lookup(name string) (string, error) {
+	expr, ok := c[name]
+	if !ok {
+		return "", fmt.Errorf("unknown field %q", name)
+	}
+	return expr, nil
+}
+
+// Where adds the condition "name op value"
+func (s *Select) Where(name, op string, value interface{}) *Select {
+	if s.err != nil {
+		return s
+	}
+	expr, err := s.columns.lookup(name)
+	if err != nil {
+		s.err = err
+		return s
+	}
+	if !operators[op] {
+		s.err = fmt.Errorf("unknown operator %q", op)
+		return s
+	}
+	s.conds = append(s.conds, expr+" "+op+" ?")
+	s.args = append(s.args, value)
+	return s
+}
+
+// Cond adds the condition name stands for, which must be a complete
+// condition with one placeholder per value, like an EXISTS subquery
+func (s *Select) Cond(name string, values ...interface{}) *Select {
+	if s.err != nil {
+		return s
+	}
+	expr, err := s.columns.lookup(name)
+	if err != nil {
+		s.err = err
+		return s
+	}
+	if strings.Count(expr, "?") != len(values) {
+		s.err = fmt.Errorf("condition %q takes %d values, got %d", name, strings.Count(expr, "?"), len(values))
+		return s
+	}
+	s.conds = append(s.conds, expr)
+	s.args = append(s.args, values...)
+	return s
+}
+
+// Eq adds the condition "name = value"
+func (s *Select) Eq(name string, value interface{}) *Select {
+	return s.Where(name, "=", value)
+}
+
+// Sort orders results by name, after any earlier sort keys
+func (s *Select) Sort(name string, desc bool) *Select {
+	if s.err != nil {
+		return s
+	}
+	expr, err := s.columns.lookup(name)
+	if err != nil {
+		s.err = err
+		return s
+	}
+	if desc {
+		expr += " DESC"
+	}
+	s.order = append(s.order, expr)
+	return s
+}
+
+// WhereClause returns " WHERE ..." with its arguments, or "" when there
+// are no conditions
+func (s *Select) WhereClause() (string, []interface{}, error) {
+	if s.err != nil {
+		return "", nil, s.err
+	}
+	if len(s.conds) == 0 {
+		return "", nil, nil
+	}
+	return " WHERE " + strings.Join(s.conds, " AND "), append([]interface{}{}, s.args...), nil
+}
+
+// OrderClause returns " ORDER BY ...", or "" when no sort was added
+func (s *Select) OrderClause() (string, error) {
+	if s.err != nil {
+		return "", s.err
+	}
+	if len(s.order) == 0 {
+		return "", nil
+	}
+	return " ORDER BY " + strings.Join(s.order, ", "), nil
+}
+
+// Update collects the assignments of an UPDATE
+type Update struct {
+	columns Columns
+	sets    []string
+	args    []interface{}
+	err     error
+}
+
+// Update starts an update restricted to c
+func (c Columns) Update() *Update {
+	return &Update{columns: c}
+}
+
+// Set assigns value to name
+func (u *Update) Set(name string, value interface{}) *Update {
+	if u.err != nil {
+		return u
+	}
+	expr, err := u.columns.lookup(name)
+	if err != nil {
+		u.err = err
+		return u
+	}
+	u.sets = append(u.sets, expr+" = ?")
+	u.args = append(u.args, value)
+	return u
+}
+
+// Len returns the number of assignments
+func (u *Update) Len() int {
+	return len(u.sets)
+}
+
+// SetClause returns "a = ?, b = ?" with its arguments
+func (u *Update) SetClause() (string, []interface{}, error) {
+	if u.err != nil {
+		return "", nil, u.err
+	}
+	if len(u.sets) == 0 {
+		return "", nil, fmt.Errorf("no fields to update")
+	}
+	return strings.Join(u.sets, ", "), append([]interface{}{}, u.args...), nil
+}
+
+// Placeholders returns "?, ?, ..." with n placeholders, for an IN list of
+// n arguments
+func Placeholders(n int) string {
+	if n <= 0 {
+		return ""
+	}
+	return strings.Repeat("?, ", n-1) + "?"
+}
@@ -0,0 +1,175 @@
+package stats
+
+import (
+	"fmt"
+	"sort"
+	"time"
+)
+
+// MaxBuckets caps the number of buckets a single query may produce
+const MaxBuckets = 1000
+
+// Interval describes a supported bucket width
+type Interval struct {
+	Name        string
+	Duration    time.Duration
+	MySQLFormat string // DATE_FORMAT pattern that truncates a timestamp to the bucket start
+	layout      string // Go layout matching MySQLFormat output
+}
+
+// Supported intervals, keyed by the value accepted in the "interval" query parameter
+var intervals = map[string]Interval{
+	"minute": {Name: "minute", Duration: time.Minute, MySQLFormat: "%Y-%m-%d %H:%i:00", layout: "2006-01-02 15:04:05"},
+	"hour":   {Name: "hour", Duration: time.Hour, MySQLFormat: "%Y-%m-%d %H:00:00", layout: "2006-01-02 15:04:05"},
+	"day":    {Name: "day", Duration: 24 * time.Hour, MySQLFormat: "%Y-%m-%d 00:00:00", layout: "2006-01-02 15:04:05"},
+}
+
+// Window is a validated time range split into fixed-width buckets
+type Window struct {
+	Start    time.Time
+	End      time.Time
+	Interval Interval
+}
+
+// Point is a single bucket value in a series
+type Point struct {
+	Timestamp time.Time `json:"timestamp"`
+	Count     int64     `json:"count"`
+}
+
+// Series is a named sequence of points covering the whole window
+type Series struct {
+	Key    string  `json:"key"`
+	Total  int64   `json:"total"`
+	Points []Point `json:"points"`
+}
+
+// ParseWindow validates start/end/interval query values. Empty values default
+// to the last 24 hours bucketed per hour. Start and end accept RFC3339 timestamps
+// or YYYY-MM-DD dates and are interpreted in UTC.
+func ParseWindow(startStr, endStr, intervalStr string, now time.Time) (Window, error) {
+	if intervalStr == "" {
+		intervalStr = "hour"
+	}
+	interval, ok := intervals[intervalStr]
+	if !ok {
+		return Window{}, fmt.Errorf("invalid interval %q (use minute, hour or day)", intervalStr)
+	}
+
+	end := now.UTC()
+	if endStr != "" {
+		parsed, err := parseTimestamp(endStr)
+		if err != nil {
+			return Window{}, fmt.Errorf("invalid end: %v", err)
+		}
+		end = parsed
+	}
+
+	start := end.Add(-24 * time.Hour)
+	if startStr != "" {
+		parsed, err := parseTimestamp(startStr)
+		if err != nil {
+			return Window{}, fmt.Errorf("invalid start: %v", err)
+		}
+		start = parsed
+	}
+
+	if !start.Before(end) {
+		return Window{}, fmt.Errorf("start must be before end")
+	}
+
+	w := Window{
+		Start:    truncate(start, interval),
+		End:      end,
+		Interval: interval,
+	}
+
+	if n := len(w.Buckets()); n > MaxBuckets {
+		return Window{}, fmt.Errorf("window produces %d buckets, maximum is %d; use a wider interval", n, MaxBuckets)
+	}
+
+	return w, nil
+}
+
+// Buckets returns the start time of every bucket in the window
+func (w Window) Buckets() []time.Time {
+	var buckets []time.Time
+	for t := w.Start; t.Before(w.End); t = t.Add(w.Interval.Duration) {
+		buckets = append(buckets, t)
+		if len(buckets) > MaxBuckets {
+			break
+		}
+	}
+	return buckets
+}
+
+// ParseBucket converts a DATE_FORMAT bucket label back into a time. Labels
+// are read as UTC, so the MySQL session must run in UTC.
+func (w Window) ParseBucket(label string) (time.Time, error) {
+	return time.ParseInLocation(w.Interval.layout, label, time.UTC)
+}
+
+// Accumulator collects (bucket, key, count) rows and turns them into
+// zero-filled series covering the whole window
+type Accumulator struct {
+	window Window
+	counts map[string]map[time.Time]int64
+}
+
+// NewAccumulator creates an accumulator for the given window
+func NewAccumulator(w Window) *Accumulator {
+	return &Accumulator{
+		window: w,
+		counts: make(map[string]map[time.Time]int64),
+	}
+}
+
+// Add records a count for a bucket label and series key
+func (a *Accumulator) Add(bucketLabel, key string, count int64) error {
+	bucket, err := a.window.ParseBucket(bucketLabel)
+	if err != nil {
+		return err
+	}
+	if _, ok := a.counts[key]; !ok {
+		a.counts[key] = make(map[time.Time]int64)
+	}
+	a.counts[key][bucket] += count
+	return nil
+}
+
+// Series returns one zero-filled series per key, sorted by key
+func (a *Accumulator) Series() []Series {
+	keys := make([]string, 0, len(a.counts))
+	for k := range a.counts {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	buckets := a.window.Buckets()
+	result := make([]Series, 0, len(keys))
+	for _, key := range keys {
+		s := Series{Key: key, Points: make([]Point, 0, len(buckets))}
+		for _, b := range buckets {
+			c := a.counts[key][b]
+			s.Points = append(s.Points, Point{Timestamp: b, Count: c})
+			s.Total += c
+		}
+		result = append(result, s)
+	}
+	return result
+}
+
+func parseTimestamp(value string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t.UTC(), nil
+	}
+	return time.ParseInLocation("2006-01-02", value, time.UTC)
+}
+
+func truncate(t time.Time, interval Interval) time.Time {
+	t = t.UTC()
+	if interval.Name == "day" {
+		return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+	}
+	return t.Truncate(interval.Duration)
+}
@@ -0,0 +1,23 @@
+package statuspage
+
+import (
+	_ "embed"
+	"net/http"
+)
+
+//go:embed status.html
+var page []byte
+
+// Handler serves the embedded status page. The page itself contains no data;
+// it polls the authenticated summary endpoint from the browser.
+func Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" && r.Method != "HEAD" {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Header().Set("Cache-Control", "no-store")
+		w.Write(page)
+	})
+}
@@ -0,0 +1,113 @@
+package stmtcache
+
+import (
+	"database/sql"
+	"fmt"
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+// Cache holds named prepared statements for queries run on every request,
+// so MySQL parses each one once per connection instead of once per call.
+// Statements are prepared on first use rather than up front, because the
+// service may start before pending migrations have added the columns they
+// reference; a failed prepare is retried on the next call.
+type Cache struct {
+	db      *sql.DB
+	queries map[string]string
+	stmts   map[string]*sql.Stmt
+	counts  map[string]*counters
+	mu      sync.RWMutex
+}
+
+type counters struct {
+	executions    int64
+	prepareErrors int64
+}
+
+// StatementStats reports how often a statement was used
+type StatementStats struct {
+	Name          string
+	Prepared      bool
+	Executions    int64
+	PrepareErrors int64
+}
+
+// New creates a cache of the given name -> query statements
+func New(db *sql.DB, queries map[string]string) *Cache {
+	c := &Cache{
+		db:      db,
+		queries: queries,
+		stmts:   make(map[string]*sql.Stmt),
+		counts:  make(map[string]*counters),
+	}
+	for name := range queries {
+		c.counts[name] = &counters{}
+	}
+	return c
+}
+
+// Get returns the prepared statement registered under name, preparing it
+// if needed. Each call is counted as one execution.
+func (c *Cache) Get(name string) (*sql.Stmt, error) {
+	count, ok := c.counts[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown statement %q", name)
+	}
+
+	c.mu.RLock()
+	stmt := c.stmts[name]
+	c.mu.RUnlock()
+
+	if stmt == nil {
+		c.mu.Lock()
+		if stmt = c.stmts[name]; stmt == nil {
+			var err error
+			stmt, err = c.db.Prepare(c.queries[name])
+			if err != nil {
+				c.mu.Unlock()
+				atomic.AddInt64(&count.prepareErrors, 1)
+				return nil, fmt.Errorf("failed to prepare %s: %v", name, err)
+			}
+			c.stmts[name] = stmt
+		}
+		c.mu.Unlock()
+	}
+
+	atomic.AddInt64(&count.executions, 1)
+	return stmt, nil
+}
+
+// Stats returns per-statement counters sorted by name
+func (c *Cache) Stats() []StatementStats {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	stats := make([]StatementStats, 0, len(c.counts))
+	for name, count := range c.counts {
+		stats = append(stats, StatementStats{
+			Name:          name,
+			Prepared:      c.stmts[name] != nil,
+			Executions:    atomic.LoadInt64(&count.executions),
+			PrepareErrors: atomic.LoadInt64(&count.prepareErrors),
+		})
+	}
+	sort.Slice(stats, func(i, j int) bool { return stats[i].Name < stats[j].Name })
+	return stats
+}
+
+// Close releases all prepared statements
+func (c *Cache) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var firstErr error
+	for name, stmt := range c.stmts {
+		if err := stmt.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+		delete(c.stmts, name)
+	}
+	return firstErr
+}
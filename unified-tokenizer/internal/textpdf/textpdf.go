@@ -0,0 +1,266 @@
+// Package textpdf writes plain PDF documents of headings, paragraphs and
+// fixed-width tables on US Letter pages. It uses the standard Helvetica and
+// Courier fonts, which every PDF reader has, so reports can be handed out
+// as PDF without a PDF library.
+package textpdf
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+)
+
+// Page geometry in points
+const (
+	pageWidth  = 612
+	pageHeight = 792
+	margin     = 54
+	textWidth  = pageWidth - 2*margin
+)
+
+// Fonts, named as in each page's resources
+const (
+	body    = "F1" // Helvetica
+	bold    = "F2" // Helvetica-Bold
+	fixed   = "F3" // Courier
+	bodyPt  = 10
+	fixedPt = 8
+)
+
+// Widths used to lay out text: Courier's glyphs are 0.6 em wide, and 0.55
+// em is a little over Helvetica's average, so wrapped lines never overrun
+const (
+	fixedChars = textWidth * 10 / (fixedPt * 6)
+	bodyChars  = textWidth * 100 / (bodyPt * 55)
+)
+
+// Document is a PDF being written, one page at a time
+type Document struct {
+	title string
+	pages []*bytes.Buffer
+	y     float64 // Baseline of the next line on the last page
+
+	// Table headers repeated at the top of a page a table continues on
+	header []string
+	widths []int
+}
+
+// New starts a document, whose pages carry title and their number in the
+// footer
+func New(title string) *Document {
+	d := &Document{title: title}
+	d.newPage()
+	return d
+}
+
+func (d *Document) newPage() {
+	d.pages = append(d.pages, &bytes.Buffer{})
+	d.y = pageHeight - margin
+}
+
+// space moves down by height, starting a new page when it does not fit
+func (d *Document) space(height float64) {
+	if d.y-height < margin+20 {
+		d.newPage()
+		if d.header != nil {
+			d.row(d.header)
+			d.rule()
+		}
+	}
+	d.y -= height
+}
+
+func (d *Document) show(font string, size, x float64, text string) {
+	fmt.Fprintf(d.pages[len(d.pages)-1], "BT /%s %g Tf %g %.2f Td (%s) Tj ET\n", font, size, x, d.y, escape(text))
+}
+
+// Title writes the document's title in large type
+func (d *Document) Title(text string) {
+	d.space(22)
+	d.show(bold, 18, margin, text)
+	d.y -= 8
+}
+
+// Heading writes a section heading, on a new page when less than a few
+// lines would fit under it
+func (d *Document) Heading(text string) {
+	if d.y-60 < margin+20 {
+		d.newPage()
+	}
+	d.space(24)
+	d.show(bold, 13, margin, text)
+	d.y -= 4
+}
+
+// Text writes a paragraph, wrapped at the page width. Line breaks in text
+// start new lines.
+func (d *Document) Text(text string) {
+	for _, line := range strings.Split(text, "\n") {
+		for _, wrapped := range wrap(line, bodyChars) {
+			d.space(13)
+			d.show(body, bodyPt, margin, wrapped)
+		}
+	}
+	d.y -= 4
+}
+
+// Table writes rows under headers in Courier, in columns as wide as their
+// longest cell. When the columns do not fit the page, the widest are
+// narrowed and their cells cut short.
+func (d *Document) Table(headers []string, rows [][]string) {
+	d.widths = columnWidths(headers, rows)
+	d.header = headers
+	d.space(4)
+	d.row(headers)
+	d.rule()
+	for _, row := range rows {
+		d.row(row)
+	}
+	d.header = nil
+	d.y -= 6
+}
+
+// row writes a line of a table. Headers are in Courier too, to keep the
+// columns aligned, and underlined instead of set in bold.
+func (d *Document) row(cells []string) {
+	var line strings.Builder
+	for i, width := range d.widths {
+		cell := ""
+		if i < len(cells) {
+			cell = cut(cells[i], width)
+		}
+		line.WriteString(cell + strings.Repeat(" ", width-len([]rune(cell))))
+		if i < len(d.widths)-1 {
+			line.WriteString("  ")
+		}
+	}
+	d.space(10)
+	d.show(fixed, fixedPt, margin, strings.TrimRight(line.String(), " "))
+}
+
+func (d *Document) rule() {
+	fmt.Fprintf(d.pages[len(d.pages)-1], "0.5 w %d %.2f m %d %.2f l S\n", margin, d.y-3, pageWidth-margin, d.y-3)
+	d.y -= 3
+}
+
+// columnWidths fits the columns of a table in the page width, two spaces
+// apart
+func columnWidths(headers []string, rows [][]string) []int {
+	widths := make([]int, len(headers))
+	for i, header := range headers {
+		widths[i] = len([]rune(header))
+	}
+	for _, row := range rows {
+		for i := range widths {
+			if i < len(row) && len([]rune(row[i])) > widths[i] {
+				widths[i] = len([]rune(row[i]))
+			}
+		}
+	}
+	available := fixedChars - 2*(len(widths)-1)
+	for {
+		total, widest := 0, 0
+		for i, width := range widths {
+			total += width
+			if width > widths[widest] {
+				widest = i
+			}
+		}
+		if total <= available || widths[widest] <= 4 {
+			return widths
+		}
+		widths[widest]--
+	}
+}
+
+// cut shortens s to width characters, marking the cut with "..."
+func cut(s string, width int) string {
+	runes := []rune(s)
+	if len(runes) <= width {
+		return s
+	}
+	if width <= 3 {
+		return string(runes[:width])
+	}
+	return string(runes[:width-3]) + "..."
+}
+
+// wrap breaks s into lines of at most width characters, at spaces where it
+// can
+func wrap(s string, width int) []string {
+	var lines []string
+	for len([]rune(s)) > width {
+		runes := []rune(s)
+		at := strings.LastIndex(string(runes[:width+1]), " ")
+		if at <= 0 {
+			lines = append(lines, string(runes[:width]))
+			s = string(runes[width:])
+			continue
+		}
+		lines = append(lines, s[:at])
+		s = strings.TrimLeft(s[at:], " ")
+	}
+	return append(lines, s)
+}
+
+// escape writes s as the body of a PDF string in WinAnsiEncoding. It
+// matches Latin-1 for the characters reports use; others become "?".
+func escape(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		switch {
+		case r == '\\' || r == '(' || r == ')':
+			b.WriteByte('\\')
+			b.WriteRune(r)
+		case r < 0x20:
+			b.WriteByte(' ')
+		case r < 0x7f:
+			b.WriteRune(r)
+		case r >= 0xa0 && r <= 0xff:
+			fmt.Fprintf(&b, "\\%03o", r)
+		default:
+			b.WriteByte('?')
+		}
+	}
+	return b.String()
+}
+
+// Bytes returns the finished document
+func (d *Document) Bytes() []byte {
+	var out bytes.Buffer
+	var offsets []int
+	object := func(dict string) {
+		offsets = append(offsets, out.Len())
+		fmt.Fprintf(&out, "%d 0 obj\n%s\nendobj\n", len(offsets), dict)
+	}
+
+	// Objects 1 to 6 are the catalog, page tree, fonts and document
+	// information; each page then takes two, itself and its content
+	out.WriteString("%PDF-1.4\n%\xe2\xe3\xcf\xd3\n")
+	kids := make([]string, len(d.pages))
+	for i := range d.pages {
+		kids[i] = fmt.Sprintf("%d 0 R", 7+2*i)
+	}
+	object("<< /Type /Catalog /Pages 2 0 R >>")
+	object(fmt.Sprintf("<< /Type /Pages /Kids [%s] /Count %d >>", strings.Join(kids, " "), len(d.pages)))
+	object("<< /Type /Font /Subtype /Type1 /BaseFont /Helvetica /Encoding /WinAnsiEncoding >>")
+	object("<< /Type /Font /Subtype /Type1 /BaseFont /Helvetica-Bold /Encoding /WinAnsiEncoding >>")
+	object("<< /Type /Font /Subtype /Type1 /BaseFont /Courier /Encoding /WinAnsiEncoding >>")
+	object(fmt.Sprintf("<< /Title (%s) /Producer (TokenShield) >>", escape(d.title)))
+	for i, page := range d.pages {
+		content := page.String() + fmt.Sprintf("BT /%s 8 Tf %d %d Td (%s) Tj ET\n", body, margin, margin-20,
+			escape(fmt.Sprintf("%s - page %d of %d", d.title, i+1, len(d.pages))))
+		object(fmt.Sprintf("<< /Type /Page /Parent 2 0 R /MediaBox [0 0 %d %d] /Contents %d 0 R "+
+			"/Resources << /Font << /%s 3 0 R /%s 4 0 R /%s 5 0 R >> >> >>",
+			pageWidth, pageHeight, 8+2*i, body, bold, fixed))
+		object(fmt.Sprintf("<< /Length %d >>\nstream\n%sendstream", len(content), content))
+	}
+
+	xref := out.Len()
+	fmt.Fprintf(&out, "xref\n0 %d\n0000000000 65535 f \n", len(offsets)+1)
+	for _, offset := range offsets {
+		fmt.Fprintf(&out, "%010d 00000 n \n", offset)
+	}
+	fmt.Fprintf(&out, "trailer\n<< /Size %d /Root 1 0 R /Info 6 0 R >>\nstartxref\n%d\n%%%%EOF\n", len(offsets)+1, xref)
+	return out.Bytes()
+}
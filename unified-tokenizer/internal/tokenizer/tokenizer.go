@@ -5,14 +5,13 @@ import (
 	"encoding/json"
 	"fmt"
 	"log"
-	"math/rand"
-	cryptorand "crypto/rand"
 	"regexp"
 	"sort"
 	"strconv"
 	"strings"
 
 	"github.com/fernet/fernet-go"
+	"tokenshield-unified/internal/securerand"
 	"tokenshield-unified/internal/utils"
 )
 
@@ -245,9 +244,7 @@ func (t *Tokenizer) generateToken() string {
 	}
 	
 	// Default prefix format - restore original logic
-	b := make([]byte, 32)
-	cryptorand.Read(b)
-	return "tok_" + base64.URLEncoding.EncodeToString(b)
+	return "tok_" + base64.URLEncoding.EncodeToString(securerand.Bytes(32))
 }
 
 // generateLuhnToken creates a Luhn-valid 16-digit token starting with 9999
@@ -256,11 +253,7 @@ func (t *Tokenizer) generateLuhnToken() string {
 	prefix := "9999"
 	
 	// Generate 11 random digits (restore original logic)
-	randomPart := make([]byte, 11)
-	for i := 0; i < 11; i++ {
-		randomPart[i] = byte(rand.Intn(10)) + '0'
-	}
-	partial := prefix + string(randomPart)
+	partial := prefix + securerand.Digits(11)
 	
 	// Calculate Luhn check digit
 	checkDigit := t.calculateLuhnCheckDigit(partial)
@@ -272,7 +265,8 @@ func (t *Tokenizer) generateLuhnToken() string {
 // calculateLuhnCheckDigit calculates the Luhn algorithm check digit (correct version)
 func (t *Tokenizer) calculateLuhnCheckDigit(number string) int {
 	sum := 0
-	alternate := false
+	// The check digit will be appended, so the last digit here is doubled
+	alternate := true
 	
 	// Process from right to left
 	for i := len(number) - 1; i >= 0; i-- {
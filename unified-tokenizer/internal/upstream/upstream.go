@@ -0,0 +1,404 @@
+package upstream
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// State is the circuit breaker state
+type State int
+
+const (
+	Closed   State = iota // Requests flow normally
+	Open                  // Requests fail fast until the open timeout passes
+	HalfOpen              // One trial request decides whether to close again
+)
+
+func (s State) String() string {
+	switch s {
+	case Open:
+		return "open"
+	case HalfOpen:
+		return "half_open"
+	}
+	return "closed"
+}
+
+// Config controls the breaker, the concurrency limit and retries
+type Config struct {
+	// FailureThreshold consecutive failures open the circuit; 0 disables
+	// the breaker
+	FailureThreshold int
+	// OpenTimeout is how long the circuit stays open before a trial request
+	OpenTimeout time.Duration
+	// MaxConcurrent requests may be in flight at once; 0 means no limit
+	MaxConcurrent int
+	// MaxRetries is how often a failed request is retried. Only idempotent
+	// methods are retried after the request was sent; any request is
+	// retried when the connection could not be made.
+	MaxRetries int
+	// RetryBudget caps retries at this fraction of requests, so retries
+	// cannot multiply the load on an upstream that is already failing
+	RetryBudget float64
+	// RetryBackoff is the delay before the first retry, doubled for each
+	// further retry and jittered
+	RetryBackoff time.Duration
+	// RetryMethods may be retried after the request was sent; nil means
+	// DefaultRetryMethods. Only idempotent methods belong here.
+	RetryMethods []string
+	// Routes override MaxRetries and RetryBudget by path prefix, the
+	// longest matching prefix winning. Each route has a budget of its own,
+	// so retries on one route cannot spend another's.
+	Routes []Route
+}
+
+// DefaultRetryMethods are retried after the request was sent unless
+// Config.RetryMethods says otherwise
+var DefaultRetryMethods = []string{"GET", "HEAD", "OPTIONS", "PUT", "DELETE"}
+
+// Idempotent reports whether sending a request with method twice has the
+// same effect as sending it once, so it may be retried
+func Idempotent(method string) bool {
+	switch method {
+	case "GET", "HEAD", "OPTIONS", "TRACE", "PUT", "DELETE":
+		return true
+	}
+	return false
+}
+
+// Route is the retry policy for request paths starting with Prefix
+type Route struct {
+	Prefix      string
+	MaxRetries  int
+	RetryBudget float64
+}
+
+// RouteStats counts the retries of one route
+type RouteStats struct {
+	Prefix        string
+	Retries       int64
+	RetriesDenied int64
+}
+
+// UnavailableError is returned without contacting the upstream when the
+// circuit is open or too many requests are in flight
+type UnavailableError struct {
+	Upstream   string
+	Reason     string // "circuit_open" or "saturated"
+	RetryAfter time.Duration
+}
+
+func (e *UnavailableError) Error() string {
+	return fmt.Sprintf("upstream %s unavailable: %s", e.Upstream, e.Reason)
+}
+
+// RetryAfterSeconds is the Retry-After header value, at least 1
+func (e *UnavailableError) RetryAfterSeconds() int {
+	seconds := int((e.RetryAfter + time.Second - 1) / time.Second)
+	if seconds < 1 {
+		seconds = 1
+	}
+	return seconds
+}
+
+// Stats is a snapshot of an upstream's health
+type Stats struct {
+	Upstream            string
+	State               State
+	ConsecutiveFailures int
+	InFlight            int
+	Requests            int64 // Attempts sent, including retries
+	Failures            int64 // Attempts that failed or returned 5xx
+	Retries             int64
+	RetriesDenied       int64        // Retries skipped because the budget was spent
+	RejectedOpen        int64        // Requests refused while the circuit was open
+	RejectedSaturated   int64        // Requests refused at the concurrency limit
+	Opens               int64        // Times the circuit opened
+	Routes              []RouteStats // Retries of each route in Config.Routes
+}
+
+// budgetCap bounds the retries saved up while the upstream was healthy
+const budgetCap = 10
+
+// Client forwards requests to one upstream through an HTTP client. It
+// fails fast while the upstream is failing or saturated instead of letting
+// requests queue behind the client timeout.
+type Client struct {
+	name   string
+	client *http.Client
+	cfg    Config
+
+	routes  []*route // The default policy first, then Config.Routes
+	methods map[string]bool
+
+	mu       sync.Mutex
+	state    State
+	failures int // Consecutive
+	openedAt time.Time
+	probing  bool // Half-open trial request in flight
+	inFlight int
+	stats    Stats
+}
+
+// route is a retry policy with its budget, guarded by Client.mu
+type route struct {
+	Route
+	budget float64
+	stats  RouteStats
+}
+
+// New wraps client for the upstream called name
+func New(name string, client *http.Client, cfg Config) *Client {
+	c := &Client{name: name, client: client, cfg: cfg, methods: make(map[string]bool)}
+	c.routes = append(c.routes, &route{Route: Route{MaxRetries: cfg.MaxRetries, RetryBudget: cfg.RetryBudget}, budget: budgetCap})
+	for _, r := range cfg.Routes {
+		c.routes = append(c.routes, &route{Route: r, budget: budgetCap, stats: RouteStats{Prefix: r.Prefix}})
+	}
+	methods := cfg.RetryMethods
+	if methods == nil {
+		methods = DefaultRetryMethods
+	}
+	for _, method := range methods {
+		c.methods[method] = true
+	}
+	return c
+}
+
+// routeFor returns the policy of the longest route prefix matching path,
+// or the default
+func (c *Client) routeFor(path string) *route {
+	match := c.routes[0]
+	for _, r := range c.routes[1:] {
+		if strings.HasPrefix(path, r.Prefix) && len(r.Prefix) > len(match.Prefix) {
+			match = r
+		}
+	}
+	return match
+}
+
+// Do sends req, retrying as configured. Retries need the body to be
+// replayable through GetBody, as it is for requests made with
+// http.NewRequest from a bytes.Reader; other requests with a body are sent
+// once. A response is returned for any status; 5xx responses count as
+// failures for the breaker.
+func (c *Client) Do(req *http.Request) (*http.Response, error) {
+	route := c.routeFor(req.URL.Path)
+	probe, err := c.acquire(route)
+	if err != nil {
+		return nil, err
+	}
+	defer c.release(probe)
+
+	maxRetries := route.MaxRetries
+	if req.Body != nil && req.Body != http.NoBody && req.GetBody == nil {
+		maxRetries = 0
+	}
+
+	for attempt := 0; ; attempt++ {
+		if attempt > 0 {
+			if err := c.wait(req.Context(), attempt); err != nil {
+				return nil, err
+			}
+		}
+		try, err := replay(req)
+		if err != nil {
+			return nil, err
+		}
+
+		resp, err := c.client.Do(try)
+		if err != nil && req.Context().Err() != nil {
+			return nil, err // The caller gave up; not the upstream's fault
+		}
+		failed := err != nil || resp.StatusCode >= 500
+		c.record(failed)
+
+		if !failed || attempt >= maxRetries || !c.retryable(req.Method, resp, err) || c.isOpen() || !c.takeRetry(route) {
+			return resp, err
+		}
+		if resp != nil {
+			io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+			resp.Body.Close()
+		}
+	}
+}
+
+// Stats returns the current health counters
+func (c *Client) Stats() Stats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	s := c.stats
+	s.Upstream = c.name
+	s.State = c.currentState(time.Now())
+	s.ConsecutiveFailures = c.failures
+	s.InFlight = c.inFlight
+	for _, r := range c.routes[1:] {
+		s.Routes = append(s.Routes, r.stats)
+	}
+	return s
+}
+
+// currentState reports an open circuit whose timeout has passed as half-open
+func (c *Client) currentState(now time.Time) State {
+	if c.state == Open && now.Sub(c.openedAt) >= c.cfg.OpenTimeout {
+		return HalfOpen
+	}
+	return c.state
+}
+
+// acquire admits a request on route or refuses it with an
+// UnavailableError. probe is true for the half-open trial request.
+func (c *Client) acquire(route *route) (probe bool, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+
+	if c.cfg.FailureThreshold > 0 {
+		switch c.currentState(now) {
+		case Open:
+			c.stats.RejectedOpen++
+			return false, &UnavailableError{Upstream: c.name, Reason: "circuit_open", RetryAfter: c.cfg.OpenTimeout - now.Sub(c.openedAt)}
+		case HalfOpen:
+			if c.probing {
+				c.stats.RejectedOpen++
+				return false, &UnavailableError{Upstream: c.name, Reason: "circuit_open", RetryAfter: time.Second}
+			}
+			c.state = HalfOpen
+			c.probing = true
+			probe = true
+		}
+	}
+	if c.cfg.MaxConcurrent > 0 && c.inFlight >= c.cfg.MaxConcurrent {
+		if probe {
+			c.probing = false
+		}
+		c.stats.RejectedSaturated++
+		return false, &UnavailableError{Upstream: c.name, Reason: "saturated", RetryAfter: time.Second}
+	}
+	c.inFlight++
+	route.budget += route.RetryBudget
+	if route.budget > budgetCap {
+		route.budget = budgetCap
+	}
+	return probe, nil
+}
+
+// release ends a request. A trial request that ended without an outcome,
+// such as one cancelled by its caller, lets the next request try instead.
+func (c *Client) release(probe bool) {
+	c.mu.Lock()
+	c.inFlight--
+	if probe && c.state == HalfOpen {
+		c.probing = false
+	}
+	c.mu.Unlock()
+}
+
+// record updates the breaker with the outcome of one attempt
+func (c *Client) record(failed bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.stats.Requests++
+	if !failed {
+		c.failures = 0
+		if c.state == HalfOpen {
+			c.state = Closed
+			c.probing = false
+		}
+		return
+	}
+
+	c.stats.Failures++
+	c.failures++
+	if c.cfg.FailureThreshold > 0 && (c.state == HalfOpen || (c.state == Closed && c.failures >= c.cfg.FailureThreshold)) {
+		c.state = Open
+		c.openedAt = time.Now()
+		c.probing = false
+		c.stats.Opens++
+	}
+}
+
+func (c *Client) isOpen() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.state == Open
+}
+
+// takeRetry spends one retry from the route's budget
+func (c *Client) takeRetry(route *route) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if route.budget < 1 {
+		c.stats.RetriesDenied++
+		route.stats.RetriesDenied++
+		return false
+	}
+	route.budget--
+	c.stats.Retries++
+	route.stats.Retries++
+	return true
+}
+
+// wait sleeps before a retry with exponential backoff, jittered by up to
+// half the backoff either way
+func (c *Client) wait(ctx context.Context, attempt int) error {
+	if c.cfg.RetryBackoff <= 0 {
+		return ctx.Err()
+	}
+	backoff := c.cfg.RetryBackoff << (attempt - 1)
+	timer := time.NewTimer(time.Duration(rand.Int63n(int64(backoff))) + backoff/2)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// replay returns req with a fresh body for another attempt
+func replay(req *http.Request) (*http.Request, error) {
+	if req.Body == nil || req.GetBody == nil {
+		return req, nil
+	}
+	body, err := req.GetBody()
+	if err != nil {
+		return nil, err
+	}
+	try := req.Clone(req.Context())
+	try.Body = body
+	return try, nil
+}
+
+// retryable reports whether a failed attempt may be sent again: when the
+// connection was never made, or for the retry methods on a transport
+// error or a 502, 503 or 504. Timeouts are not retried, since a slow
+// upstream would only keep the caller waiting longer.
+func (c *Client) retryable(method string, resp *http.Response, err error) bool {
+	var opErr *net.OpError
+	var netErr net.Error
+	if err != nil && errors.As(err, &netErr) && netErr.Timeout() {
+		return false
+	}
+	if err != nil && errors.As(err, &opErr) && opErr.Op == "dial" {
+		return true
+	}
+	if !c.methods[method] {
+		return false
+	}
+	if err != nil {
+		return true
+	}
+	switch resp.StatusCode {
+	case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
@@ -1,7 +1,7 @@
 package utils
 
 import (
-	"html"
+	"fmt"
 	"os"
 	"regexp"
 	"strconv"
@@ -9,26 +9,6 @@ import (
 	"time"
 )
 
-// Compiled regex patterns for security validation
-var (
-	// SQL injection patterns
-	sqlInjectionPatterns = []*regexp.Regexp{
-		regexp.MustCompile(`(?i)(union\s+select|insert\s+into|delete\s+from|update\s+set|drop\s+table|create\s+table)`),
-		regexp.MustCompile(`(?i)(exec\s*\(|execute\s*\(|sp_executesql)`),
-		regexp.MustCompile(`(?i)(script\s*>|javascript:|vbscript:|onload\s*=|onerror\s*=)`),
-		regexp.MustCompile(`(?i)(union.*select|select.*from.*where|1\s*=\s*1|1\s*or\s*1)`),
-	}
-	
-	// XSS patterns
-	xssPatterns = []*regexp.Regexp{
-		regexp.MustCompile(`(?i)<script[^>]*>.*?</script>`),
-		regexp.MustCompile(`(?i)javascript:`),
-		regexp.MustCompile(`(?i)vbscript:`),
-		regexp.MustCompile(`(?i)on\w+\s*=`),
-		regexp.MustCompile(`(?i)<iframe[^>]*>`),
-	}
-)
-
 // Environment variable helpers
 
 // GetEnv gets an environment variable with a default fallback
@@ -64,48 +44,90 @@ func ParseIntEnv(key string, defaultValue int) int {
 	return intValue
 }
 
-// Math helpers
-
-// Min returns the minimum of two integers
-func Min(a, b int) int {
-	if a < b {
-		return a
+// DurationSetting reads a duration like ParseTimeEnv, but reports values
+// that do not parse or fall outside [min, max] instead of silently using
+// the default. A zero max means no upper bound.
+func DurationSetting(key string, defaultValue, min, max time.Duration) (time.Duration, error) {
+	value := os.Getenv(key)
+	if value == "" {
+		return defaultValue, nil
 	}
-	return b
+	duration, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, fmt.Errorf("%s: invalid duration %q", key, value)
+	}
+	if duration < min || (max > 0 && duration > max) {
+		if max > 0 {
+			return 0, fmt.Errorf("%s: %s is outside %s-%s", key, duration, min, max)
+		}
+		return 0, fmt.Errorf("%s: %s is below the minimum of %s", key, duration, min)
+	}
+	return duration, nil
 }
 
-// String validation and sanitization helpers
+// IntSetting reads an integer like ParseIntEnv, but reports values that do
+// not parse or fall outside [min, max]
+func IntSetting(key string, defaultValue, min, max int) (int, error) {
+	value := os.Getenv(key)
+	if value == "" {
+		return defaultValue, nil
+	}
+	intValue, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, fmt.Errorf("%s: invalid integer %q", key, value)
+	}
+	if intValue < min || intValue > max {
+		return 0, fmt.Errorf("%s: %d is outside %d-%d", key, intValue, min, max)
+	}
+	return intValue, nil
+}
 
-// SanitizeString removes dangerous characters and escapes HTML
-func SanitizeString(input string) string {
-	// Remove null bytes and control characters
-	cleaned := strings.Map(func(r rune) rune {
-		if r == 0 || (r < 32 && r != 9 && r != 10 && r != 13) {
-			return -1
+// ParseByteSize parses a size in bytes, with an optional KB, MB or GB
+// suffix for binary multiples, e.g. "512", "64KB" or "10MB"
+func ParseByteSize(value string) (int64, error) {
+	s := strings.ToUpper(strings.TrimSpace(value))
+	multiplier := int64(1)
+	for _, unit := range []struct {
+		suffix string
+		size   int64
+	}{{"GB", 1 << 30}, {"MB", 1 << 20}, {"KB", 1 << 10}, {"B", 1}} {
+		if strings.HasSuffix(s, unit.suffix) {
+			s, multiplier = strings.TrimSpace(strings.TrimSuffix(s, unit.suffix)), unit.size
+			break
 		}
-		return r
-	}, input)
-	
-	// HTML escape the string
-	cleaned = html.EscapeString(cleaned)
-	
-	// Remove any remaining dangerous patterns
-	for _, pattern := range xssPatterns {
-		cleaned = pattern.ReplaceAllString(cleaned, "")
 	}
-	
-	return strings.TrimSpace(cleaned)
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || n < 0 || n > (1<<62)/multiplier {
+		return 0, fmt.Errorf("invalid size %q", value)
+	}
+	return n * multiplier, nil
 }
 
-// DetectSQLInjection checks for SQL injection patterns
-func DetectSQLInjection(input string) bool {
-	lowercaseInput := strings.ToLower(input)
-	for _, pattern := range sqlInjectionPatterns {
-		if pattern.MatchString(lowercaseInput) {
-			return true
-		}
+// ByteSizeSetting reads a size like ParseByteSize, reporting values that
+// do not parse or fall outside [min, max]
+func ByteSizeSetting(key string, defaultValue, min, max int64) (int64, error) {
+	value := os.Getenv(key)
+	if value == "" {
+		return defaultValue, nil
+	}
+	size, err := ParseByteSize(value)
+	if err != nil {
+		return 0, fmt.Errorf("%s: %v", key, err)
 	}
-	return false
+	if size < min || size > max {
+		return 0, fmt.Errorf("%s: %d bytes is outside %d-%d", key, size, min, max)
+	}
+	return size, nil
+}
+
+// Math helpers
+
+// Min returns the minimum of two integers
+func Min(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
 }
 
 // Card validation helpers
@@ -0,0 +1,110 @@
+package waf
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+)
+
+// Rule names a pattern of input that looks like an attack. Matches are
+// only reported, never blocked or rewritten: values reach the database as
+// query parameters and are encoded where they are displayed, so a name
+// like "Selectric Ltd" or "O'Brien" is stored as given.
+type Rule struct {
+	Name    string `json:"name"`
+	Pattern string `json:"pattern"` // Go regular expression
+
+	re *regexp.Regexp
+}
+
+// DefaultRules are used unless other rules are configured
+var DefaultRules = []Rule{
+	{Name: "sql_union", Pattern: `(?i)\bunion\s+(all\s+)?select\b`},
+	{Name: "sql_statement", Pattern: `(?i)(;|'|\))\s*(select|insert|update|delete|drop|create|alter)\b`},
+	{Name: "sql_tautology", Pattern: `(?i)'\s*or\s+'?[\w]+'?\s*=\s*'?[\w]+|\bor\s+1\s*=\s*1\b`},
+	{Name: "sql_comment", Pattern: `'\s*(--|#|/\*)`},
+	{Name: "sql_exec", Pattern: `(?i)\b(exec(ute)?\s*\(|sp_executesql|xp_cmdshell)`},
+	{Name: "script_tag", Pattern: `(?i)<\s*(script|iframe|object|embed)\b`},
+	{Name: "script_url", Pattern: `(?i)\b(javascript|vbscript)\s*:`},
+	{Name: "event_handler", Pattern: `(?i)<[^>]*\bon[a-z]+\s*=`},
+}
+
+// Detector reports which rules input matches. A nil Detector matches
+// nothing, so detection can be turned off.
+type Detector struct {
+	rules []Rule
+}
+
+// New compiles rules into a detector
+func New(rules []Rule) (*Detector, error) {
+	d := &Detector{}
+	seen := make(map[string]bool)
+	for i, rule := range rules {
+		if rule.Name == "" || seen[rule.Name] {
+			return nil, fmt.Errorf("rule %d: name is missing or repeated", i+1)
+		}
+		seen[rule.Name] = true
+		re, err := regexp.Compile(rule.Pattern)
+		if err != nil || rule.Pattern == "" {
+			return nil, fmt.Errorf("rule %s: invalid pattern", rule.Name)
+		}
+		rule.re = re
+		d.rules = append(d.rules, rule)
+	}
+	return d, nil
+}
+
+// Match returns the names of the rules value matches
+func (d *Detector) Match(value string) []string {
+	if d == nil {
+		return nil
+	}
+	var names []string
+	for _, rule := range d.rules {
+		if rule.re.MatchString(value) {
+			names = append(names, rule.Name)
+		}
+	}
+	return names
+}
+
+// Scan matches every string in a decoded JSON value, including object keys,
+// and returns the rules matched per field path, like "user.name" or
+// "cards[2].card_holder"
+func (d *Detector) Scan(value interface{}) map[string][]string {
+	found := make(map[string][]string)
+	if d != nil {
+		d.scan("", value, found)
+	}
+	return found
+}
+
+func (d *Detector) scan(path string, value interface{}, found map[string][]string) {
+	switch v := value.(type) {
+	case string:
+		if names := d.Match(v); len(names) > 0 {
+			found[path] = names
+		}
+	case map[string]interface{}:
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			field := key
+			if path != "" {
+				field = path + "." + key
+			}
+			if names := d.Match(key); len(names) > 0 {
+				found[field+" (key)"] = names
+			}
+			d.scan(field, v[key], found)
+		}
+	case []interface{}:
+		for i, item := range v {
+			d.scan(path+"["+strconv.Itoa(i)+"]", item, found)
+		}
+	}
+}
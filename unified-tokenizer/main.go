@@ -1,226 +1,241 @@
 package main
 
 import (
+    _ "embed"
     "bytes"
+    "compress/gzip"
+    "context"
+    "crypto/tls"
     "crypto/aes"
     "crypto/cipher"
+    "crypto/ed25519"
+    "crypto/hmac"
     cryptorand "crypto/rand"
+    "crypto/sha256"
+    "crypto/x509"
     "database/sql"
     "encoding/base64"
+    "encoding/hex"
     "encoding/json"
+    "encoding/pem"
     "errors"
+    "flag"
     "fmt"
-    "html"
     "io"
     "log"
+    "math/big"
     "math/rand"
     "net"
     "net/http"
+    "net/url"
     "os"
+    "path/filepath"
     "regexp"
+    "slices"
+    "sort"
     "strconv"
     "strings"
     "sync"
+    "sync/atomic"
     "time"
+    "unicode/utf8"
 
     "github.com/fernet/fernet-go"
-    _ "github.com/go-sql-driver/mysql"
+    "github.com/go-sql-driver/mysql"
     "golang.org/x/crypto/bcrypt"
     
+    "tokenshield-unified/internal/jsonschema"
+    "tokenshield-unified/internal/cardformat"
     "tokenshield-unified/internal/utils"
     "tokenshield-unified/internal/ratelimit"
     "tokenshield-unified/internal/icap"
+    "tokenshield-unified/internal/loginchallenge"
+    "tokenshield-unified/internal/maintenance"
+    "tokenshield-unified/internal/region"
+    "tokenshield-unified/internal/engine"
+    "tokenshield-unified/internal/nettoken"
+    "tokenshield-unified/internal/counters"
+    "tokenshield-unified/internal/cors"
+    "tokenshield-unified/internal/secheaders"
+    "tokenshield-unified/internal/clientip"
+    "tokenshield-unified/internal/ipfilter"
+    "tokenshield-unified/internal/egress"
+    "tokenshield-unified/internal/events"
+    "tokenshield-unified/internal/forward"
+    "tokenshield-unified/internal/apiversion"
+    "tokenshield-unified/internal/apierror"
+    "tokenshield-unified/internal/charset"
+    "tokenshield-unified/internal/deepscan"
+    "tokenshield-unified/internal/mailscan"
+    "tokenshield-unified/internal/mailer"
+    "tokenshield-unified/internal/notify"
+    "tokenshield-unified/internal/objstore"
+    "tokenshield-unified/internal/smtprelay"
+    "tokenshield-unified/internal/batchfile"
+    "tokenshield-unified/internal/dropfolder"
+    "tokenshield-unified/internal/kafka"
+    "tokenshield-unified/internal/avro"
+    "tokenshield-unified/internal/compression"
+    "tokenshield-unified/internal/migrate"
+    "tokenshield-unified/internal/stats"
+    "tokenshield-unified/internal/scanner"
+    "tokenshield-unified/internal/securerand"
+    "tokenshield-unified/internal/sessionbind"
+    "tokenshield-unified/internal/statuspage"
+    "tokenshield-unified/internal/stmtcache"
     "tokenshield-unified/internal/tokenizer"
+    "tokenshield-unified/internal/keyseal"
+    "tokenshield-unified/internal/shamir"
+    "tokenshield-unified/internal/openapi"
+    "tokenshield-unified/internal/sqlbuild"
+    "tokenshield-unified/internal/textpdf"
+    "tokenshield-unified/internal/tlsreload"
+    "tokenshield-unified/internal/spool"
+    "tokenshield-unified/internal/upstream"
+    "tokenshield-unified/internal/waf"
 )
 
 // Rate limiting moved to internal/ratelimit package
 
-// Input validation and sanitization functions
-var (
-    // Common regex patterns for validation
-    usernameRegex = regexp.MustCompile(`^[a-zA-Z0-9_.-]{3,50}$`)
-    emailRegex    = regexp.MustCompile(`^[a-zA-Z0-9._%+-]+@[a-zA-Z0-9.-]+\.[a-zA-Z]{2,}$`)
-    alphanumericRegex = regexp.MustCompile(`^[a-zA-Z0-9]+$`)
-    tokenRegex    = regexp.MustCompile(`^(tok_[a-zA-Z0-9+/=]+|[0-9]{13,19})$`)
-    uuidRegex     = regexp.MustCompile(`^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}$`)
-    
-    // SQL injection patterns
-    sqlInjectionPatterns = []*regexp.Regexp{
-        regexp.MustCompile(`(?i)(union\s+select|insert\s+into|delete\s+from|update\s+set|drop\s+table|create\s+table)`),
-        regexp.MustCompile(`(?i)(exec\s*\(|execute\s*\(|sp_executesql)`),
-        regexp.MustCompile(`(?i)(script\s*>|javascript:|vbscript:|onload\s*=|onerror\s*=)`),
-        regexp.MustCompile(`(?i)(union.*select|select.*from.*where|1\s*=\s*1|1\s*or\s*1)`),
-    }
-    
-    // XSS patterns
-    xssPatterns = []*regexp.Regexp{
-        regexp.MustCompile(`(?i)<script[^>]*>.*?</script>`),
-        regexp.MustCompile(`(?i)javascript:`),
-        regexp.MustCompile(`(?i)vbscript:`),
-        regexp.MustCompile(`(?i)on\w+\s*=`),
-        regexp.MustCompile(`(?i)<iframe[^>]*>`),
-    }
-)
+// builtinRequestSchemas are the JSON Schemas of request bodies, by endpoint
+//
+//go:embed request_schemas.json
+var builtinRequestSchemas []byte
 
-// sanitizeString removes dangerous characters and escapes HTML
-func SanitizeString(input string) string {
-    // Remove null bytes and control characters
-    cleaned := strings.Map(func(r rune) rune {
-        if r == 0 || (r < 32 && r != 9 && r != 10 && r != 13) {
-            return -1
+// loadRequestSchemas compiles the built-in request schemas, with the entries
+// of the file at path, if any, in place of theirs. The file has the same
+// shape: schemas by endpoint, and $defs shared by all of them that add to
+// or replace the built-in definitions.
+func loadRequestSchemas(path string) (map[string]*jsonschema.Schema, error) {
+    var docs map[string]interface{}
+    if err := json.Unmarshal(builtinRequestSchemas, &docs); err != nil {
+        return nil, fmt.Errorf("built-in request schemas: %v", err)
+    }
+    defs, _ := docs["$defs"].(map[string]interface{})
+    if defs == nil {
+        defs = make(map[string]interface{})
+    }
+    if path != "" {
+        data, err := os.ReadFile(path)
+        if err != nil {
+            return nil, err
+        }
+        var overrides map[string]interface{}
+        if err := json.Unmarshal(data, &overrides); err != nil {
+            return nil, fmt.Errorf("%s: %v", path, err)
+        }
+        for key, doc := range overrides {
+            switch {
+            case key == "$defs":
+                extra, ok := doc.(map[string]interface{})
+                if !ok {
+                    return nil, fmt.Errorf("%s: $defs must be an object", path)
+                }
+                for name, def := range extra {
+                    defs[name] = def
+                }
+            case strings.HasPrefix(key, "$"):
+            case docs[key] == nil:
+                return nil, fmt.Errorf("%s: no endpoint is validated as %q", path, key)
+            default:
+                docs[key] = doc
+            }
         }
-        return r
-    }, input)
-    
-    // HTML escape the string
-    cleaned = html.EscapeString(cleaned)
-    
-    // Remove any remaining dangerous patterns
-    for _, pattern := range xssPatterns {
-        cleaned = pattern.ReplaceAllString(cleaned, "")
     }
     
-    return strings.TrimSpace(cleaned)
-}
-
-// detectSQLInjection checks for SQL injection patterns
-func DetectSQLInjection(input string) bool {
-    lowercaseInput := strings.ToLower(input)
-    for _, pattern := range sqlInjectionPatterns {
-        if pattern.MatchString(lowercaseInput) {
-            return true
+    schemas := make(map[string]*jsonschema.Schema)
+    for key, doc := range docs {
+        if strings.HasPrefix(key, "$") {
+            continue
+        }
+        // The shared definitions go under the schema's own, which win
+        if obj, ok := doc.(map[string]interface{}); ok {
+            if own, ok := obj["$defs"].(map[string]interface{}); ok || obj["$defs"] == nil {
+                merged := make(map[string]interface{}, len(obj)+1)
+                for k, v := range obj {
+                    merged[k] = v
+                }
+                all := make(map[string]interface{}, len(defs)+len(own))
+                for name, def := range defs {
+                    all[name] = def
+                }
+                for name, def := range own {
+                    all[name] = def
+                }
+                merged["$defs"] = all
+                doc = merged
+            }
         }
+        schema, err := jsonschema.CompileValue(doc)
+        if err != nil {
+            return nil, fmt.Errorf("request schema %s: %v", key, err)
+        }
+        schemas[key] = schema
     }
-    return false
+    return schemas, nil
 }
 
-// validateField validates a single field against its rules
-func validateField(fieldName string, value interface{}, rule ValidationRule) []ValidationError {
-    var errors []ValidationError
-    
-    // Convert value to string for most validations
-    strValue := fmt.Sprintf("%v", value)
-    
-    // Check if field is required
-    if rule.Required && (value == nil || strValue == "") {
-        errors = append(errors, ValidationError{
-            Field:   fieldName,
-            Message: "field is required",
-            Value:   strValue,
-        })
-        return errors
-    }
-    
-    // Skip validation for empty optional fields
-    if !rule.Required && strValue == "" {
-        return errors
-    }
-    
-    // Length validation
-    if rule.MinLength > 0 && len(strValue) < rule.MinLength {
-        errors = append(errors, ValidationError{
-            Field:   fieldName,
-            Message: fmt.Sprintf("minimum length is %d characters", rule.MinLength),
-            Value:   strValue,
-        })
-    }
-    
-    if rule.MaxLength > 0 && len(strValue) > rule.MaxLength {
-        errors = append(errors, ValidationError{
-            Field:   fieldName,
-            Message: fmt.Sprintf("maximum length is %d characters", rule.MaxLength),
-            Value:   strValue,
-        })
-    }
-    
-    // Pattern validation
-    if rule.Pattern != nil && !rule.Pattern.MatchString(strValue) {
-        errors = append(errors, ValidationError{
-            Field:   fieldName,
-            Message: "field format is invalid",
-            Value:   strValue,
-        })
+// validateRequest validates a decoded request body against the endpoint's
+// schema. Values are checked, never rewritten: queries take them as
+// parameters, and they are encoded where they are output.
+func (ut *UnifiedTokenizer) validateRequest(endpoint string, data interface{}) ValidationResult {
+    result := ValidationResult{Valid: true}
+    schema := ut.validationConfigs[endpoint].Schema
+    if schema == nil {
+        return result
     }
     
-    // Character validation
-    if rule.AllowedChars != "" {
-        allowedRegex := regexp.MustCompile(fmt.Sprintf("^[%s]*$", regexp.QuoteMeta(rule.AllowedChars)))
-        if !allowedRegex.MatchString(strValue) {
-            errors = append(errors, ValidationError{
-                Field:   fieldName,
-                Message: fmt.Sprintf("field contains invalid characters. Allowed: %s", rule.AllowedChars),
-                Value:   strValue,
-            })
+    for _, e := range schema.Validate(data) {
+        shown := ""
+        if e.Value != nil {
+            shown = fmt.Sprintf("%v", e.Value)
         }
-    }
-    
-    // SQL injection detection
-    if utils.DetectSQLInjection(strValue) {
-        errors = append(errors, ValidationError{
-            Field:   fieldName,
-            Message: "field contains potentially dangerous content",
-            Value:   "[REDACTED]",
-        })
-    }
-    
-    // Custom validation
-    if rule.CustomValidator != nil {
-        if err := rule.CustomValidator(value); err != nil {
-            errors = append(errors, ValidationError{
-                Field:   fieldName,
-                Message: err.Error(),
-                Value:   strValue,
-            })
+        if e.WriteOnly && shown != "" {
+            shown = "[REDACTED]"
         }
+        result.Errors = append(result.Errors, ValidationError{
+            Field:   e.Path,
+            Message: e.Message,
+            Value:   shown,
+        })
     }
+    result.Errors = append(result.Errors, controlCharacterErrors(data, "")...)
     
-    return errors
+    result.Valid = len(result.Errors) == 0
+    return result
 }
 
-// validateRequest validates an entire request against validation configuration
-func (ut *UnifiedTokenizer) validateRequest(endpoint string, data map[string]interface{}) ValidationResult {
-    result := ValidationResult{
-        Valid: true,
-        Data:  make(map[string]interface{}),
-    }
-    
-    // Get validation config for this endpoint
-    config, exists := ut.validationConfigs[endpoint]
-    if !exists {
-        // No specific validation config, apply basic sanitization
-        for key, value := range data {
-            if strValue, ok := value.(string); ok {
-                result.Data[key] = utils.SanitizeString(strValue)
-            } else {
-                result.Data[key] = value
-            }
+// controlCharacterErrors reports the strings in v, a decoded JSON value,
+// with control characters other than tabs and line breaks, which never
+// belong in a field
+func controlCharacterErrors(v interface{}, path string) []ValidationError {
+    var errors []ValidationError
+    switch val := v.(type) {
+    case string:
+        if strings.IndexFunc(val, func(r rune) bool {
+            return r < 32 && r != '\t' && r != '\n' && r != '\r' || r == 0x7f
+        }) >= 0 {
+            errors = append(errors, ValidationError{Field: path, Message: "field contains control characters", Value: "[REDACTED]"})
         }
-        return result
-    }
-    
-    // Validate each field according to rules
-    for fieldName, rule := range config.Rules {
-        value, exists := data[fieldName]
-        
-        fieldErrors := validateField(fieldName, value, rule)
-        if len(fieldErrors) > 0 {
-            result.Valid = false
-            result.Errors = append(result.Errors, fieldErrors...)
+    case []interface{}:
+        for i, item := range val {
+            errors = append(errors, controlCharacterErrors(item, fmt.Sprintf("%s[%d]", path, i))...)
         }
-        
-        // Sanitize if required and validation passed
-        if rule.Sanitize && exists && len(fieldErrors) == 0 {
-            if strValue, ok := value.(string); ok {
-                result.Data[fieldName] = utils.SanitizeString(strValue)
-            } else {
-                result.Data[fieldName] = value
+    case map[string]interface{}:
+        names := make([]string, 0, len(val))
+        for name := range val {
+            names = append(names, name)
+        }
+        sort.Strings(names)
+        for _, name := range names {
+            field := name
+            if path != "" {
+                field = path + "." + name
             }
-        } else if exists {
-            result.Data[fieldName] = value
+            errors = append(errors, controlCharacterErrors(val[name], field)...)
         }
     }
-    
-    return result
+    return errors
 }
 
 // Audit logging structures
@@ -245,23 +260,12 @@ type SecurityEvent struct {
     Details   map[string]interface{} `json:"details,omitempty"`
 }
 
-// Input validation structures
-type ValidationRule struct {
-    FieldName    string                 `json:"field_name"`
-    Required     bool                   `json:"required"`
-    MinLength    int                    `json:"min_length,omitempty"`
-    MaxLength    int                    `json:"max_length,omitempty"`
-    Pattern      *regexp.Regexp         `json:"-"`
-    AllowedChars string                 `json:"allowed_chars,omitempty"`
-    Sanitize     bool                   `json:"sanitize"`
-    CustomValidator func(interface{}) error `json:"-"`
-}
-
+// ValidationConfig is how validationMiddleware checks requests to an endpoint
 type ValidationConfig struct {
-    MaxRequestSize int64                    `json:"max_request_size"`
-    AllowedMethods []string                 `json:"allowed_methods"`
-    RequiredHeaders []string                `json:"required_headers,omitempty"`
-    Rules          map[string]ValidationRule `json:"rules"`
+    MaxRequestSize int64              `json:"max_request_size"`
+    AllowedMethods []string           `json:"allowed_methods"`
+    RequiredHeaders []string          `json:"required_headers,omitempty"`
+    Schema         *jsonschema.Schema `json:"-"` // Of the JSON body; from request_schemas.json or REQUEST_SCHEMAS_FILE
 }
 
 type ValidationError struct {
@@ -273,25 +277,28 @@ type ValidationError struct {
 type ValidationResult struct {
     Valid  bool              `json:"valid"`
     Errors []ValidationError `json:"errors,omitempty"`
-    Data   map[string]interface{} `json:"data,omitempty"`
 }
 
 // Card import structures
 type CardImportRequest struct {
-    Format            string `json:"format"`             // "json" or "csv"
-    DuplicateHandling string `json:"duplicate_handling"` // "skip", "overwrite", "error"
+    Format            string `json:"format"`             // A cardformat name: "json", "csv" or "fixed"
+    DuplicateHandling string `json:"duplicate_handling"` // "skip", "overwrite", "error", "reuse"
     BatchSize         int    `json:"batch_size"`         // Number of cards to process per batch
+    Tenant            string `json:"tenant,omitempty"`   // Stored with every imported card, for search
+    Owner             string `json:"owner,omitempty"`    // Username or user ID the cards belong to; the importer by default
+    Tags              map[string]string `json:"tags,omitempty"` // Set on every imported card, under the record's own tags
+    ValidateOnly      bool   `json:"validate_only,omitempty"` // Check the records and find duplicates, but store nothing
+    Compression       string `json:"compression,omitempty"` // "gzip" when data is compressed
+    Encoding          string `json:"encoding,omitempty"` // Character set of data; UTF-8 or the byte order mark by default
+    cardformat.Options                                  // Options of the format: csv, fixed_width
     Data              string `json:"data"`               // Base64 encoded card data
 }
 
-type CardImportRecord struct {
-    CardNumber     string `json:"card_number" csv:"card_number"`
-    CardHolder     string `json:"card_holder,omitempty" csv:"card_holder"`
-    ExpiryMonth    int    `json:"expiry_month" csv:"expiry_month"`
-    ExpiryYear     int    `json:"expiry_year" csv:"expiry_year"`
-    ExternalID     string `json:"external_id,omitempty" csv:"external_id"`     // Client's reference ID
-    Metadata       string `json:"metadata,omitempty" csv:"metadata"`           // Additional metadata as JSON string
-}
+// CardImportRecord is a card read from import data, in any format
+type CardImportRecord = cardformat.Record
+
+// maxCardMetadataSize bounds the metadata stored with an imported card
+const maxCardMetadataSize = 4096
 
 type CardImportResult struct {
     TotalRecords    int                     `json:"total_records"`
@@ -301,6 +308,7 @@ type CardImportResult struct {
     Duplicates      int                     `json:"duplicates"`
     ImportID        string                  `json:"import_id"`
     Status          string                  `json:"status"` // "completed", "partial", "failed"
+    ValidateOnly    bool                    `json:"validate_only,omitempty"` // Nothing was stored: the counts are what an import would do
     Errors          []CardImportError       `json:"errors,omitempty"`
     ProcessingTime  string                  `json:"processing_time"`
     TokensGenerated []CardImportSuccess     `json:"tokens_generated,omitempty"`
@@ -308,6 +316,7 @@ type CardImportResult struct {
 
 type CardImportError struct {
     RecordIndex int    `json:"record_index"`
+    Line        int    `json:"line,omitempty"` // Line the record starts on, in text formats
     ExternalID  string `json:"external_id,omitempty"`
     CardNumber  string `json:"card_number_masked,omitempty"` // Only last 4 digits
     Error       string `json:"error"`
@@ -317,33 +326,144 @@ type CardImportError struct {
 type CardImportSuccess struct {
     RecordIndex int    `json:"record_index"`
     ExternalID  string `json:"external_id,omitempty"`
-    Token       string `json:"token"`
+    Token       string `json:"token,omitempty"` // None when validating only, unless the card already has one
     CardType    string `json:"card_type"`
     LastFour    string `json:"last_four"`
+    Existing    bool   `json:"existing,omitempty"` // The card already had this token (duplicate_handling "reuse")
 }
 
 type UnifiedTokenizer struct {
     db              *sql.DB
+    stmts           *stmtcache.Cache // Prepared statements for hot-path queries
     encryptionKey   *fernet.Key  // Legacy, kept for migration
     keyManager      *KeyManager
     appEndpoint     string
     tokenRegex      *regexp.Regexp
     cardRegex       *regexp.Regexp
+    scanner         *scanner.Scanner // Single-pass token and card number scanner
     httpPort        string
     icapPort        string
     apiPort         string
     debug           bool
     tokenFormat     string // "prefix" for tok_ format, "luhn" for Luhn-valid format
+    luhnBINs        []string // Prefixes Luhn-format tokens are issued from
+    region          string         // REGION: this site's name, part of every token it issues
+    peerBINs        []peerTokenBIN // LUHN_PEER_TOKEN_BINS: Luhn-format token prefixes of the other regions
+    peers           *region.Client // PEER_REGIONS: asked for cards of their tokens not replicated here yet
+    engines         *engine.Set    // TOKENIZATION_ENGINES: external services field rules can hand card numbers to
+    networkTokens   *nettoken.Connectors // NETWORK_TOKEN_CONNECTORS: scheme token services vault cards get network tokens from
+    counters        *counters.Counters // Active token and request count changes not yet written to stats_counters
+    luhnTokenSpace  *big.Int // Distinct Luhn-format tokens the BINs can issue
+    fieldRulesConfig FieldRules                 // From CARD_FIELD_MAPPINGS and DEEP_SCAN_FIELDS
+    fieldRules       atomic.Pointer[fieldRules] // In force: set through the API, or fieldRulesConfig
+    passthrough     passthroughRules // Proxied traffic streamed without scanning
+    passthroughRequests  int64 // Proxied requests streamed as received, updated atomically
+    passthroughResponses int64 // Proxied responses streamed as received, updated atomically
+    bodyLimits      bodyLimits // Largest proxied request body accepted per path
+    proxyResponses  [5]int64   // Proxied requests answered 1xx to 5xx, updated atomically
+    upstreamInsecure bool      // UPSTREAM_TLS_INSECURE_SKIP_VERIFY: the application's certificate is not verified
+    proxyDurationMicros int64  // Total time spent answering proxied requests, updated atomically
+    cardPolicies    cardPolicies // Whether proxied card numbers are tokenized, refused or alerted on, per path
+    cardPolicyRejected int64     // Proxied requests refused for carrying a card number, updated atomically
+    cardPolicyAlerted  int64     // Proxied requests with a card number on an alert path, updated atomically
+    spoolDir        string     // Where proxied bodies over spoolThreshold are buffered
+    spoolThreshold  int64      // Proxied bodies are held in memory up to this size
+    bodiesRejected  int64      // Proxied requests refused with 413, updated atomically
+    bodiesSpooled   int64      // Proxied request bodies buffered on disk, updated atomically
+    bodiesDecoded   int64      // Compressed proxied request bodies decoded to be tokenized, updated atomically
+    responsesDecoded int64     // Compressed proxied responses decoded to be detokenized, updated atomically
+    bodiesTranscoded int64     // Proxied request bodies converted from another charset to be tokenized, updated atomically
+    deepScanJSON    int64      // JSON text fields whose nested card data was replaced, updated atomically
+    deepScanBase64  int64      // Base64 fields whose nested card data was replaced, updated atomically
+    responsesTranscoded int64  // Proxied responses converted from another charset to be detokenized, updated atomically
+    corsConfig      cors.Policy                 // From the CORS_* settings
+    corsPolicy      atomic.Pointer[cors.Policy] // In force: set through the API, or corsConfig
+    securityHeaders secheaders.Headers          // Sent on every API server response, from the SECURITY_* settings
+    maintenance     atomic.Pointer[Maintenance] // Maintenance mode and config freeze, set through the API
+    schemaCheck     atomic.Pointer[SchemaCheck] // Pending migrations and missing indexes found at startup
+    maintenancePage *maintenance.Page           // Served by the proxy during maintenance, from MAINTENANCE_PAGE
+    maintenanceDestinations []string            // MAINTENANCE_CRITICAL_DESTINATIONS: still detokenized for during maintenance
+    maintenanceRefused [4]int64                 // Requests refused or passed through by maintenance mode, by maintenanceRefusals, updated atomically
+    csrfProtection  bool // Require X-CSRF-Token on state-changing requests authenticated by the session cookie
+    proxies         *clientip.Resolver // From TRUSTED_PROXIES: whose X-Forwarded-For and X-Forwarded-Proto are believed
+    forwarding      forward.Config     // Forwarded and Via headers the proxy adds for the application
+    cookies         cookieConfig // Attributes of the session and CSRF cookies
+    ipFilterConfig  map[string]ipfilter.Filter                   // Per listener, from the *_CIDRS settings
+    ipFilters       atomic.Pointer[map[string]*ipfilter.Filter] // In force per listener: set through the API, or ipFilterConfig
+    ipBlockMu       sync.Mutex
+    ipBlockLogged   map[string]time.Time // When an ip_blocked, icap_auth_failed, session_binding_violation or login_challenged event was last logged per listener or session and address
+    ipBlockedAPI    int64 // API requests refused by the IP filter, updated atomically
+    ipBlockedICAP   int64 // ICAP connections refused by the IP filter, updated atomically
+    detokenizeQuota quotaLimits // Default detokenization limits per user and per API key
+    quotaRejections int64       // Detokenizations refused over quota, updated atomically
+    tokenCollisions int64    // Generated tokens that were already taken, updated atomically
+    deterministicTokens bool // Reuse the active token of a card seen before
+    tokenPurgeDays  int      // Days a revoked token can be restored before its card is deleted; 0 keeps revoked cards
+    requestArchive  requestArchive // How token_requests rows past their retention are moved out
+    auditRetention  auditRetention // How audit log rows past their retention are exported and deleted
+    reportKey       ed25519.PrivateKey // REPORT_SIGNING_KEY_FILE; nil signs compliance reports with a key derived from the blind index key
+    reviewPolicy    accessReviewPolicy // When access reviews start and what happens to unreviewed access at their deadline
+    inactivity      inactivityPolicy   // When idle accounts and unused API keys are disabled, unless their role says otherwise
+    accountMail     accountMail    // Email verification and password reset links
+    signatureSkew   time.Duration  // SIGNED_REQUEST_MAX_SKEW: how far a signed request's timestamp may be from the server clock
+    serviceKeyDays  int            // SERVICE_ACCOUNT_KEY_DAYS: the default and longest lifetime of a service account's API keys
+    serviceKeyReminderDays int     // SERVICE_ACCOUNT_KEY_REMINDER_DAYS: how long before expiry api_key_expiring is raised; 0 disables
+    notifier        *notify.Notifier // Sends security events to on-call channels; nil when NOTIFICATION_CHANNELS is not set
+    rolePermissions atomic.Pointer[map[string][]string] // Permissions of each role, from the roles table
+    requestsArchived int64         // token_requests rows moved out by this replica, updated atomically
+    swaggerUI       bool     // Serve Swagger UI at /api/v1/docs
+    apiCompression  bool     // Gzip API responses for clients that accept it
+    apiV1Sunset     time.Time // When deprecated v1 endpoints stop being served; zero keeps them
+    deprecatedRequests int64  // Requests served by a deprecated endpoint, updated atomically
     useKEKDEK       bool   // Whether to use KEK/DEK encryption
-    authRateLimiter *ratelimit.RateLimiter // Rate limiter for authentication endpoints
+    rateLimitConfig []ratelimit.Rule                   // From RATE_LIMIT_RULES
+    rateLimitRules  atomic.Pointer[[]ratelimit.Rule]   // In force: set through the API, or rateLimitConfig
+    rateLimitStore  ratelimit.Store                    // Request counters, per process or shared through the database
+    rateLimited     int64 // API and proxy requests refused by a rate-limit rule, updated atomically
+    waf             *waf.Detector // Reports input that looks like an attack; nil when WAF_DETECTION=false
+    suspiciousInputs int64        // Requests reported by waf, updated atomically
     icapServer      *icap.Server           // ICAP protocol server
+    icapPool        *icap.Pool             // Bounds concurrent ICAP connections
+    smtpPort        string                 // SMTP content filter port; empty when the filter is off
+    smtpServer      *smtprelay.Server      // Scans mail from the mail server and relays it on
+    smtpAllowed     ipfilter.Filter        // Mail servers that may connect to the SMTP filter
+    smtpCardAction  string                 // "tokenize" or "mask" card numbers found in mail
+    smtpClean       int64                  // Messages relayed with no card numbers, updated atomically
+    smtpReplaced    int64                  // Messages relayed with card numbers replaced, updated atomically
+    smtpRejected    int64                  // Messages refused because they could not be scanned, updated atomically
+    smtpCards       int64                  // Card numbers replaced in mail, updated atomically
+    smtpUnscanned   int64                  // Mail parts that could not be scanned, updated atomically
+    batchWatcher    *batchWatcher          // Tokenizes settlement files dropped in BATCH_INBOX; nil when off
+    batchCompleted  int64                  // Batch files processed, updated atomically
+    batchFailed     int64                  // Batch files that did not match the layout, updated atomically
+    batchTokenized  int64                  // Card numbers tokenized in batch files, updated atomically
+    batchMasked     int64                  // Card numbers masked outside the card columns, updated atomically
+    kafkaBridge     *kafkaBridge           // Tokenizes card fields between Kafka topics; nil when off
+    kafkaActive     int32                  // 1 while this replica runs the Kafka bridge, updated atomically
+    kafkaUnchanged  int64                  // Messages republished as they were, updated atomically
+    kafkaReplaced   int64                  // Messages republished with card data replaced, updated atomically
+    kafkaDeadLetters int64                 // Messages sent to KAFKA_DLQ_TOPIC, updated atomically
+    kafkaMasked     int64                  // Card numbers masked outside card fields, updated atomically
+    kafkaRetries    int64                  // Times the bridge stopped on an error and started again, updated atomically
+    egressHelperListen string              // EGRESS_HELPER_LISTEN: loopback host:port or unix:path
+    egressHelper    *egress.Proxy          // Detokenizes outbound payment requests from local applications; nil when off
+    upstreamClient  *http.Client           // Forwards proxied requests to the application
+    upstream        *upstream.Client       // Circuit breaker, concurrency limit and retries around upstreamClient
     tokenizer       *tokenizer.Tokenizer   // Core tokenization engine
     // Session security configuration
     sessionTimeout       time.Duration // Absolute session timeout
     sessionIdleTimeout   time.Duration // Idle session timeout 
     maxConcurrentSessions int           // Maximum concurrent sessions per user
+    sessionBinding       sessionbind.Policy // SESSION_BINDING*: the network and browser a session must be used from
+    loginChallenge       loginChallengeConfig // LOGIN_CHALLENGE*: when logins must pass a challenge
     // Input validation configuration
     validationConfigs    map[string]ValidationConfig // Endpoint-specific validation rules
+    reencryptJob    string // Rotation ID of the running re-encryption job, if any
+    integrityCheck  string // ID of the integrity check started through the API, if running
+    eventBroker     *events.Broker // Real-time activity and security event stream
+    tlsConfig       *tls.Config    // Server TLS for the HTTP, API and ICAP ports; nil serves plaintext
+    apiTLSConfig    *tls.Config    // tlsConfig, verifying client certificates when MTLS_CLIENT_CA is set
+    unsealer        *unsealState   // Share collection for sealed-boot mode; nil when SEAL_MODE is unset
     mu              sync.RWMutex
 }
 
@@ -354,21 +474,32 @@ type KeyManager struct {
     dekCache     map[string][]byte
     currentKEKID string
     currentDEKID string
+    sealer       keyseal.Sealer // Wraps KEKs at rest; nil stores them unsealed (legacy)
+    dekSealer    keyseal.Sealer // Wraps DEKs directly in the HSM instead of with the KEK (PKCS11_WRAP_DEKS)
+    sealed       bool           // Sealed-boot mode: no keys are loaded until Unseal
+    indexKey     []byte         // HMAC key for blind indexes, wrapped like a DEK
     mu           sync.RWMutex
 }
 
+// errVaultSealed is returned by every KeyManager operation until a quorum of
+// key shares has been supplied to /api/v1/unseal
+var errVaultSealed = errors.New("vault is sealed")
+
 // User represents a system user
 type User struct {
     UserID       string    `json:"user_id"`
     Username     string    `json:"username"`
     Email        string    `json:"email"`
+    EmailVerified bool     `json:"email_verified"`
     FullName     string    `json:"full_name"`
     Role         string    `json:"role"`
-    Permissions  []string  `json:"permissions"`
+    Permissions  []string  `json:"permissions"` // Granted beyond those of the role
+    EffectivePermissions []string `json:"effective_permissions,omitempty"` // Role and own permissions, in GET /api/v1/auth/me
     IsActive     bool      `json:"is_active"`
     CreatedAt    time.Time `json:"created_at"`
     LastLoginAt  *time.Time `json:"last_login_at,omitempty"`
     PasswordChangedAt *time.Time `json:"-"` // Don't expose in JSON
+    RequirePasswordChange bool `json:"require_password_change,omitempty"` // The password is temporary; in GET /api/v1/auth/me
 }
 
 // UserSession represents an active user session
@@ -387,6 +518,10 @@ type UserSession struct {
 type AuthRequest struct {
     Username string `json:"username"`
     Password string `json:"password"`
+    // Only needed once logins are challenged: the proof-of-work puzzle and
+    // its solution, or the CAPTCHA answer
+    ChallengeID       string `json:"challenge_id,omitempty"`
+    ChallengeResponse string `json:"challenge_response,omitempty"`
 }
 
 // AuthResponse represents a successful authentication
@@ -395,6 +530,7 @@ type AuthResponse struct {
     User                 User      `json:"user"`
     ExpiresAt            time.Time `json:"expires_at"`
     RequirePasswordChange bool     `json:"require_password_change"`
+    CSRFToken            string    `json:"csrf_token,omitempty"` // Send as X-CSRF-Token when authenticating with the session cookie
 }
 
 // Permission constants
@@ -402,9 +538,13 @@ const (
     PermTokensRead    = "tokens.read"
     PermTokensWrite   = "tokens.write"
     PermTokensDelete  = "tokens.delete"
+    PermTokensDetokenize = "tokens.detokenize" // Reveal full card numbers through the API
+    PermTokensReadPII = "tokens.read_pii"  // See and search cardholder names
     PermAPIKeysRead   = "api_keys.read"
     PermAPIKeysWrite  = "api_keys.write"
     PermAPIKeysDelete = "api_keys.delete"
+    PermAPIKeysOwn    = "api_keys.own"  // Create, list and revoke one's own API keys
+    PermTokensOwn     = "tokens.own"    // List, search, read and revoke the tokens imported for oneself
     PermUsersRead     = "users.read"
     PermUsersWrite    = "users.write"
     PermUsersDelete   = "users.delete"
@@ -420,198 +560,190 @@ const (
     RoleViewer   = "viewer"
 )
 
-// initializeValidationConfigs sets up validation rules for all API endpoints
-func (ut *UnifiedTokenizer) initializeValidationConfigs() {
-    // Login endpoint validation
-    ut.validationConfigs["/api/v1/auth/login"] = ValidationConfig{
-        MaxRequestSize: 1024, // 1KB max
-        AllowedMethods: []string{"POST"},
-        Rules: map[string]ValidationRule{
-            "username": {
-                FieldName:    "username",
-                Required:     true,
-                MinLength:    3,
-                MaxLength:    50,
-                Pattern:      usernameRegex,
-                Sanitize:     true,
-            },
-            "password": {
-                FieldName:    "password",
-                Required:     true,
-                MinLength:    12,
-                MaxLength:    128,
-                Sanitize:     false, // Don't sanitize passwords as it might break them
-            },
-        },
+// initializeValidationConfigs sets the size limits, methods and body
+// schemas of the validated API endpoints
+func (ut *UnifiedTokenizer) initializeValidationConfigs(schemas map[string]*jsonschema.Schema) {
+    for _, endpoint := range []struct {
+        path    string
+        maxSize int64
+        method  string
+    }{
+        {"/api/v1/auth/login", 10240, "POST"}, // CAPTCHA answers run to a few KB
+        {"/api/v1/auth/me", 1024, "PUT"},
+        {"/api/v1/auth/change-password", 512, "POST"},
+        {"/api/v1/auth/reauthenticate", 512, "POST"},
+        {"/api/v1/auth/verify-email", 512, "POST"},
+        {"/api/v1/auth/forgot-password", 512, "POST"},
+        {"/api/v1/auth/reset-password", 512, "POST"},
+        {"/api/v1/users", 2048, "POST"},
+        {"/api/v1/roles", 4096, "POST"},
+        {"/api/v1/roles/", 4096, "PUT"}, // PUT /api/v1/roles/{name}
+        {"/api/v1/api-keys", 1024, "POST"},
+        {"/api/v1/service-accounts", 2048, "POST"},
+        {"/api/v1/service-accounts/{name}/keys", 1024, "POST"},
+        {"/api/v1/service-accounts/{name}/keys/{api_key}/rotate", 256, "POST"},
+        {"/api/v1/access-reviews", 1024, "POST"},
+        {"/api/v1/access-reviews/{review_id}/items/{item_id}", 2048, "POST"},
+        {"/api/v1/client-certs", 2048, "POST"},
+        {"/api/v1/tokens/search", 8 * 1024, "POST"}, // Room for a filter on 20 tags
+        {"/api/v1/tokens/bulk", 1024 * 1024, "POST"}, // Room for 10000 tokens
+        {"/api/v1/cards/import", 50 * 1024 * 1024, "POST"},
+        {"token_id", 0, ""}, // Token IDs in URL paths
+    } {
+        config := ValidationConfig{
+            MaxRequestSize: endpoint.maxSize,
+            Schema:         schemas[endpoint.path],
+        }
+        if endpoint.method != "" {
+            config.AllowedMethods = []string{endpoint.method}
+        }
+        ut.validationConfigs[endpoint.path] = config
     }
-    
-    // User creation endpoint validation
-    ut.validationConfigs["/api/v1/users"] = ValidationConfig{
-        MaxRequestSize: 2048, // 2KB max
-        AllowedMethods: []string{"POST"},
-        Rules: map[string]ValidationRule{
-            "username": {
-                FieldName:    "username",
-                Required:     true,
-                MinLength:    3,
-                MaxLength:    50,
-                Pattern:      usernameRegex,
-                Sanitize:     true,
-            },
-            "email": {
-                FieldName:    "email",
-                Required:     true,
-                MinLength:    5,
-                MaxLength:    255,
-                Pattern:      emailRegex,
-                Sanitize:     true,
-            },
-            "password": {
-                FieldName:    "password",
-                Required:     true,
-                MinLength:    12,
-                MaxLength:    128,
-                Sanitize:     false,
-            },
-            "full_name": {
-                FieldName:    "full_name",
-                Required:     false,
-                MinLength:    1,
-                MaxLength:    100,
-                Sanitize:     true,
-            },
-            "role": {
-                FieldName:    "role",
-                Required:     true,
-                Pattern:      regexp.MustCompile(`^(admin|operator|viewer)$`),
-                Sanitize:     true,
-            },
-        },
+}
+
+// connectionSettings are the pool sizes and timeouts for the database,
+// upstream applications and ICAP clients
+type connectionSettings struct {
+    dbMaxOpenConns      int
+    dbMaxIdleConns      int
+    dbConnMaxLifetime   time.Duration
+    dbConnMaxIdleTime   time.Duration
+    dbDialTimeout       time.Duration
+    dbReadTimeout       time.Duration // 0 disables
+    dbWriteTimeout      time.Duration // 0 disables
+    upstreamTimeout     time.Duration
+    upstreamDialTimeout time.Duration
+    upstream            upstream.Config
+    icapReadTimeout     time.Duration
+    icapWriteTimeout    time.Duration
+    icapMaxConnections  int
+    icapQueueSize       int
+    icapQueueTimeout    time.Duration // 0 disables
+}
+
+// loadConnectionSettings reads connectionSettings from the environment.
+// Unlike most settings, invalid values fail startup rather than falling
+// back to the default, since they are tuned against latency SLOs.
+func loadConnectionSettings() (connectionSettings, error) {
+    var errs []string
+    duration := func(key string, defaultValue, min, max time.Duration) time.Duration {
+        d, err := utils.DurationSetting(key, defaultValue, min, max)
+        if err != nil {
+            errs = append(errs, err.Error())
+        }
+        return d
     }
-    
-    // Password change endpoint validation
-    ut.validationConfigs["/api/v1/auth/change-password"] = ValidationConfig{
-        MaxRequestSize: 512, // 512 bytes max
-        AllowedMethods: []string{"POST"},
-        Rules: map[string]ValidationRule{
-            "current_password": {
-                FieldName:    "current_password",
-                Required:     true,
-                MinLength:    1,
-                MaxLength:    128,
-                Sanitize:     false,
-            },
-            "new_password": {
-                FieldName:    "new_password",
-                Required:     true,
-                MinLength:    12,
-                MaxLength:    128,
-                Sanitize:     false,
-            },
-        },
+    integer := func(key string, defaultValue, min, max int) int {
+        n, err := utils.IntSetting(key, defaultValue, min, max)
+        if err != nil {
+            errs = append(errs, err.Error())
+        }
+        return n
+    }
+    
+    s := connectionSettings{
+        dbMaxOpenConns:      integer("DB_MAX_OPEN_CONNS", 25, 1, 1000),
+        dbMaxIdleConns:      integer("DB_MAX_IDLE_CONNS", 5, 0, 1000),
+        dbConnMaxLifetime:   duration("DB_CONN_MAX_LIFETIME", 5*time.Minute, time.Second, 24*time.Hour),
+        dbConnMaxIdleTime:   duration("DB_CONN_MAX_IDLE_TIME", 0, 0, 24*time.Hour),
+        dbDialTimeout:       duration("DB_DIAL_TIMEOUT", 10*time.Second, 100*time.Millisecond, 5*time.Minute),
+        dbReadTimeout:       duration("DB_READ_TIMEOUT", 0, 0, time.Hour),
+        dbWriteTimeout:      duration("DB_WRITE_TIMEOUT", 0, 0, time.Hour),
+        upstreamTimeout:     duration("UPSTREAM_TIMEOUT", 30*time.Second, 100*time.Millisecond, 10*time.Minute),
+        upstreamDialTimeout: duration("UPSTREAM_DIAL_TIMEOUT", 10*time.Second, 100*time.Millisecond, 5*time.Minute),
+        icapReadTimeout:     duration("ICAP_READ_TIMEOUT", 30*time.Second, 100*time.Millisecond, 10*time.Minute),
+        icapWriteTimeout:    duration("ICAP_WRITE_TIMEOUT", 30*time.Second, 100*time.Millisecond, 10*time.Minute),
+        icapMaxConnections:  integer("ICAP_MAX_CONNECTIONS", 100, 1, 10000),
+        icapQueueSize:       integer("ICAP_QUEUE_SIZE", 200, 0, 100000),
+        icapQueueTimeout:    duration("ICAP_QUEUE_TIMEOUT", 5*time.Second, 0, 10*time.Minute),
+    }
+    s.upstream = upstream.Config{
+        FailureThreshold: integer("UPSTREAM_BREAKER_FAILURES", 5, 0, 1000),
+        OpenTimeout:      duration("UPSTREAM_BREAKER_OPEN_TIMEOUT", 30*time.Second, time.Second, time.Hour),
+        MaxConcurrent:    integer("UPSTREAM_MAX_CONCURRENT", 256, 0, 100000),
+        MaxRetries:       integer("UPSTREAM_MAX_RETRIES", 2, 0, 10),
+        RetryBudget:      float64(integer("UPSTREAM_RETRY_BUDGET_PERCENT", 10, 0, 100)) / 100,
+        RetryBackoff:     duration("UPSTREAM_RETRY_BACKOFF", 100*time.Millisecond, 0, 10*time.Second),
+    }
+    if methods, err := parseRetryMethods(utils.GetEnv("UPSTREAM_RETRY_METHODS", "")); err != nil {
+        errs = append(errs, err.Error())
+    } else {
+        s.upstream.RetryMethods = methods
     }
-    
-    // API key creation endpoint validation
-    ut.validationConfigs["/api/v1/api-keys"] = ValidationConfig{
-        MaxRequestSize: 1024, // 1KB max
-        AllowedMethods: []string{"POST"},
-        Rules: map[string]ValidationRule{
-            "client_name": {
-                FieldName:    "client_name",
-                Required:     true,
-                MinLength:    1,
-                MaxLength:    100,
-                Pattern:      regexp.MustCompile(`^[a-zA-Z0-9\s_.-]+$`),
-                Sanitize:     true,
-            },
-        },
+    if routes, err := parseRetryRoutes(utils.GetEnv("UPSTREAM_RETRY_ROUTES", ""), s.upstream.RetryBudget); err != nil {
+        errs = append(errs, err.Error())
+    } else {
+        s.upstream.Routes = routes
     }
-    
-    // Token search endpoint validation
-    ut.validationConfigs["/api/v1/tokens/search"] = ValidationConfig{
-        MaxRequestSize: 512, // 512 bytes max
-        AllowedMethods: []string{"POST"},
-        Rules: map[string]ValidationRule{
-            "query": {
-                FieldName:    "query",
-                Required:     false,
-                MinLength:    1,
-                MaxLength:    50,
-                Sanitize:     true,
-            },
-            "limit": {
-                FieldName:    "limit",
-                Required:     false,
-                MinLength:    1,
-                MaxLength:    4,
-                Pattern:      regexp.MustCompile(`^[0-9]+$`),
-                CustomValidator: func(value interface{}) error {
-                    if strVal, ok := value.(string); ok {
-                        if intVal, err := strconv.Atoi(strVal); err == nil {
-                            if intVal < 1 || intVal > 1000 {
-                                return fmt.Errorf("limit must be between 1 and 1000")
-                            }
-                        }
-                    }
-                    return nil
-                },
-            },
-        },
+    if len(errs) == 0 {
+        if s.dbMaxIdleConns > s.dbMaxOpenConns {
+            errs = append(errs, fmt.Sprintf("DB_MAX_IDLE_CONNS (%d) exceeds DB_MAX_OPEN_CONNS (%d)", s.dbMaxIdleConns, s.dbMaxOpenConns))
+        }
+        if s.upstreamDialTimeout > s.upstreamTimeout {
+            errs = append(errs, fmt.Sprintf("UPSTREAM_DIAL_TIMEOUT (%s) exceeds UPSTREAM_TIMEOUT (%s)", s.upstreamDialTimeout, s.upstreamTimeout))
+        }
     }
-    
-    // Generic token endpoint validation (for token IDs in URL paths)
-    ut.validationConfigs["token_id"] = ValidationConfig{
-        Rules: map[string]ValidationRule{
-            "token": {
-                FieldName:    "token",
-                Required:     true,
-                MinLength:    10,
-                MaxLength:    100,
-                Pattern:      tokenRegex,
-                Sanitize:     true,
-            },
-        },
+    if len(errs) > 0 {
+        return s, fmt.Errorf("invalid connection settings: %s", strings.Join(errs, "; "))
     }
-    
-    // Card import endpoint validation
-    ut.validationConfigs["/api/v1/cards/import"] = ValidationConfig{
-        MaxRequestSize: 50 * 1024 * 1024, // 50MB max for bulk imports
-        AllowedMethods: []string{"POST"},
-        Rules: map[string]ValidationRule{
-            "format": {
-                FieldName:    "format",
-                Required:     true,
-                Pattern:      regexp.MustCompile(`^(json|csv)$`),
-                Sanitize:     true,
-            },
-            "duplicate_handling": {
-                FieldName:    "duplicate_handling",
-                Required:     false,
-                Pattern:      regexp.MustCompile(`^(skip|overwrite|error)$`),
-                Sanitize:     true,
-            },
-            "batch_size": {
-                FieldName:    "batch_size",
-                Required:     false,
-                MinLength:    1,
-                MaxLength:    4,
-                Pattern:      regexp.MustCompile(`^[0-9]+$`),
-                CustomValidator: func(value interface{}) error {
-                    if strVal, ok := value.(string); ok {
-                        if intVal, err := strconv.Atoi(strVal); err == nil {
-                            if intVal < 1 || intVal > 1000 {
-                                return fmt.Errorf("batch_size must be between 1 and 1000")
-                            }
-                        }
-                    }
-                    return nil
-                },
-            },
-        },
+    return s, nil
+}
+
+// parseRetryMethods parses UPSTREAM_RETRY_METHODS, the comma-separated
+// methods retried after a request was sent; empty keeps the defaults
+func parseRetryMethods(value string) ([]string, error) {
+    if strings.TrimSpace(value) == "" {
+        return nil, nil
+    }
+    methods := []string{}
+    for _, method := range strings.Split(value, ",") {
+        method = strings.ToUpper(strings.TrimSpace(method))
+        if method == "NONE" {
+            continue
+        }
+        if !upstream.Idempotent(method) {
+            return nil, fmt.Errorf("UPSTREAM_RETRY_METHODS: %q is not idempotent and cannot be retried", method)
+        }
+        methods = append(methods, method)
     }
+    return methods, nil
 }
 
-func NewUnifiedTokenizer() (*UnifiedTokenizer, error) {
+// parseRetryRoutes parses UPSTREAM_RETRY_ROUTES, per path prefix retry
+// counts with an optional budget: /api/payments=0,/api/catalog=3:25%.
+// Routes without a budget get defaultBudget, in a bucket of their own.
+func parseRetryRoutes(value string, defaultBudget float64) ([]upstream.Route, error) {
+    var routes []upstream.Route
+    for _, entry := range strings.Split(value, ",") {
+        if strings.TrimSpace(entry) == "" {
+            continue
+        }
+        invalid := fmt.Errorf("invalid UPSTREAM_RETRY_ROUTES entry %q: use /path=retries or /path=retries:percent%%", entry)
+        prefix, policy, ok := strings.Cut(entry, "=")
+        prefix = strings.TrimSpace(prefix)
+        if !ok || !strings.HasPrefix(prefix, "/") {
+            return nil, invalid
+        }
+        retries, budget, hasBudget := strings.Cut(strings.TrimSpace(policy), ":")
+        route := upstream.Route{Prefix: prefix, RetryBudget: defaultBudget}
+        var err error
+        if route.MaxRetries, err = strconv.Atoi(retries); err != nil || route.MaxRetries < 0 || route.MaxRetries > 10 {
+            return nil, invalid
+        }
+        if hasBudget {
+            percent, err := strconv.Atoi(strings.TrimSuffix(budget, "%"))
+            if err != nil || percent < 0 || percent > 100 {
+                return nil, invalid
+            }
+            route.RetryBudget = float64(percent) / 100
+        }
+        routes = append(routes, route)
+    }
+    return routes, nil
+}
+
+// openDatabase connects to MySQL using the DB_* environment variables
+func openDatabase(settings connectionSettings) (*sql.DB, error) {
     // Database connection
     dbHost := utils.GetEnv("DB_HOST", "mysql")
     dbPort := utils.GetEnv("DB_PORT", "3306")
@@ -619,7 +751,41 @@ func NewUnifiedTokenizer() (*UnifiedTokenizer, error) {
     dbPassword := utils.GetEnv("DB_PASSWORD", "pciproxy123")
     dbName := utils.GetEnv("DB_NAME", "tokenshield")
     
-    dsn := fmt.Sprintf("%s:%s@tcp(%s:%s)/%s?parseTime=true", dbUser, dbPassword, dbHost, dbPort, dbName)
+    dsn := fmt.Sprintf("%s:%s@tcp(%s:%s)/%s?parseTime=true&timeout=%s", dbUser, dbPassword, dbHost, dbPort, dbName, settings.dbDialTimeout)
+    // Sessions run in UTC like the driver's times (loc), so NOW() and
+    // DATE_FORMAT of TIMESTAMP columns agree with Go whatever the server's
+    // time zone
+    dsn += "&time_zone=%27%2B00%3A00%27"
+    if settings.dbReadTimeout > 0 {
+        dsn += "&readTimeout=" + settings.dbReadTimeout.String()
+    }
+    if settings.dbWriteTimeout > 0 {
+        dsn += "&writeTimeout=" + settings.dbWriteTimeout.String()
+    }
+    
+    // TLS to the database (managed services such as RDS or Cloud SQL).
+    // DB_TLS takes the driver's values: true, skip-verify or preferred.
+    // DB_TLS_CA verifies the server against a custom CA bundle instead.
+    if caFile := utils.GetEnv("DB_TLS_CA", ""); caFile != "" {
+        caPEM, err := os.ReadFile(caFile)
+        if err != nil {
+            return nil, fmt.Errorf("failed to read DB_TLS_CA: %v", err)
+        }
+        rootCAs := x509.NewCertPool()
+        if !rootCAs.AppendCertsFromPEM(caPEM) {
+            return nil, fmt.Errorf("DB_TLS_CA contains no PEM certificates")
+        }
+        if err := mysql.RegisterTLSConfig("tokenshield", &tls.Config{
+            RootCAs:    rootCAs,
+            ServerName: dbHost,
+            MinVersion: tls.VersionTLS12,
+        }); err != nil {
+            return nil, fmt.Errorf("failed to configure database TLS: %v", err)
+        }
+        dsn += "&tls=tokenshield"
+    } else if dbTLS := utils.GetEnv("DB_TLS", ""); dbTLS != "" {
+        dsn += "&tls=" + dbTLS
+    }
     db, err := sql.Open("mysql", dsn)
     if err != nil {
         return nil, fmt.Errorf("failed to connect to database: %v", err)
@@ -631,9 +797,23 @@ func NewUnifiedTokenizer() (*UnifiedTokenizer, error) {
     }
     
     // Set connection pool settings
-    db.SetMaxOpenConns(25)
-    db.SetMaxIdleConns(5)
-    db.SetConnMaxLifetime(5 * time.Minute)
+    db.SetMaxOpenConns(settings.dbMaxOpenConns)
+    db.SetMaxIdleConns(settings.dbMaxIdleConns)
+    db.SetConnMaxLifetime(settings.dbConnMaxLifetime)
+    db.SetConnMaxIdleTime(settings.dbConnMaxIdleTime)
+    
+    return db, nil
+}
+
+func NewUnifiedTokenizer() (*UnifiedTokenizer, error) {
+    settings, err := loadConnectionSettings()
+    if err != nil {
+        return nil, err
+    }
+    db, err := openDatabase(settings)
+    if err != nil {
+        return nil, err
+    }
     
     // Encryption key
     encKeyStr := utils.GetEnv("ENCRYPTION_KEY", "")
@@ -662,3193 +842,17858 @@ func NewUnifiedTokenizer() (*UnifiedTokenizer, error) {
         tokenFormat = "prefix"
     }
     
-    // Adjust token regex based on format
-    var tokenRegex *regexp.Regexp
-    if tokenFormat == "luhn" {
-        // Match 16-digit numbers starting with our special prefix (9999)
-        tokenRegex = regexp.MustCompile(`\b9999[0-9]{12}\b`)
-    } else {
-        tokenRegex = regexp.MustCompile(`tok_[a-zA-Z0-9_\-]+=*`)
+    // Tokens issued here are namespaced by region in a replicated deployment
+    siteRegion := utils.GetEnv("REGION", "")
+    if siteRegion != "" {
+        if err := region.ValidName(siteRegion); err != nil {
+            return nil, fmt.Errorf("invalid REGION: %v", err)
+        }
+    }
+    peerRegions, err := region.ParsePeers(utils.GetEnv("PEER_REGIONS", ""))
+    if err != nil {
+        return nil, fmt.Errorf("invalid PEER_REGIONS: %v", err)
+    }
+    if len(peerRegions) > 0 && siteRegion == "" {
+        return nil, fmt.Errorf("PEER_REGIONS needs REGION to be set")
+    }
+    peerTimeout, err := utils.DurationSetting("PEER_TIMEOUT", 2*time.Second, 100*time.Millisecond, time.Minute)
+    if err != nil {
+        return nil, err
+    }
+    peers, err := region.NewClient(siteRegion, peerRegions, utils.GetEnv("PEER_API_KEY", ""), &http.Client{Timeout: peerTimeout})
+    if err != nil {
+        return nil, fmt.Errorf("invalid PEER_REGIONS: %v", err)
     }
     
-    // Check if KEK/DEK is enabled
-    useKEKDEK := utils.GetEnv("USE_KEK_DEK", "false") == "true"
-    
-    ut := &UnifiedTokenizer{
-        db:            db,
-        encryptionKey: encKey,
-        appEndpoint:   utils.GetEnv("APP_ENDPOINT", "http://dummy-app:8000"),
-        tokenRegex:    tokenRegex,
-        cardRegex:     regexp.MustCompile(`\b(?:4[0-9]{12}(?:[0-9]{3})?|5[1-5][0-9]{14}|3[47][0-9]{13}|3(?:0[0-5]|[68][0-9])[0-9]{11}|6(?:011|5[0-9]{2})[0-9]{12}|(?:2131|1800|35\d{3})\d{11})\b`),
-        httpPort:      utils.GetEnv("HTTP_PORT", "8080"),
-        icapPort:      utils.GetEnv("ICAP_PORT", "1344"),
-        apiPort:       utils.GetEnv("API_PORT", "8090"),
-        debug:         utils.GetEnv("DEBUG_MODE", "0") == "1",
-        tokenFormat:   tokenFormat,
-        useKEKDEK:     useKEKDEK,
-        authRateLimiter: ratelimit.NewRateLimiter(5, 15*time.Minute, 15*time.Minute), // 5 attempts per 15 minutes, 15 minute block
-        // Session security configuration with environment variable support
-        sessionTimeout:       utils.ParseTimeEnv("SESSION_TIMEOUT", "24h"),           // Default 24 hours
-        sessionIdleTimeout:   utils.ParseTimeEnv("SESSION_IDLE_TIMEOUT", "4h"),       // Default 4 hours
-        maxConcurrentSessions: utils.ParseIntEnv("MAX_CONCURRENT_SESSIONS", 5),       // Default 5 sessions per user
-        validationConfigs:    make(map[string]ValidationConfig),                // Initialize validation configs
+    // Field rules may hand card numbers to an external tokenization engine
+    engineConfigs, err := engine.Parse(utils.GetEnv("TOKENIZATION_ENGINES", ""))
+    if err != nil {
+        return nil, fmt.Errorf("invalid TOKENIZATION_ENGINES: %v", err)
+    }
+    engines, err := engine.New(engineConfigs)
+    if err != nil {
+        return nil, fmt.Errorf("invalid TOKENIZATION_ENGINES: %v", err)
     }
     
-    // Initialize validation configurations for endpoints
-    ut.initializeValidationConfigs()
+    // Vault cards may get a network token from their scheme's token service
+    connectorConfigs, err := nettoken.Parse(utils.GetEnv("NETWORK_TOKEN_CONNECTORS", ""))
+    if err != nil {
+        return nil, fmt.Errorf("invalid NETWORK_TOKEN_CONNECTORS: %v", err)
+    }
+    networkTokens, err := nettoken.New(connectorConfigs)
+    if err != nil {
+        return nil, fmt.Errorf("invalid NETWORK_TOKEN_CONNECTORS: %v", err)
+    }
     
-    // Initialize KeyManager if KEK/DEK is enabled
-    if useKEKDEK {
-        km, err := NewKeyManager(db)
+    // Adjust token regex based on format
+    var tokenRegex *regexp.Regexp
+    var luhnBINs []string
+    var peerBINs []peerTokenBIN
+    if tokenFormat == "luhn" {
+        luhnBINs, err = parseTokenBINs(utils.GetEnv("LUHN_TOKEN_BINS", "9999"))
         if err != nil {
-            log.Printf("Warning: Failed to initialize KeyManager: %v. Falling back to legacy encryption.", err)
-            ut.useKEKDEK = false
-        } else {
-            ut.keyManager = km
+            return nil, err
+        }
+        peerBINs, err = parsePeerTokenBINs(utils.GetEnv("LUHN_PEER_TOKEN_BINS", ""), luhnBINs)
+        if err != nil {
+            return nil, err
+        }
+        // Match 16-digit numbers starting with one of the token BINs,
+        // this site's or a peer's
+        var alternatives []string
+        for _, bin := range luhnBINs {
+            alternatives = append(alternatives, fmt.Sprintf("%s[0-9]{%d}", bin, 16-len(bin)))
         }
+        for _, peer := range peerBINs {
+            alternatives = append(alternatives, fmt.Sprintf("%s[0-9]{%d}", peer.bin, 16-len(peer.bin)))
+        }
+        tokenRegex = regexp.MustCompile(`\b(?:` + strings.Join(alternatives, "|") + `)\b`)
+    } else {
+        tokenRegex = regexp.MustCompile(`tok_[a-zA-Z0-9_\-]+=*`)
     }
     
-    // Initialize ICAP server
-    ut.icapServer = icap.NewServer(ut, ut.debug)
-    
-    // Initialize tokenizer
-    tokenizerConfig := tokenizer.TokenizerConfig{
-        TokenFormat: tokenFormat,
-        UseKEKDEK:   useKEKDEK,
-        DebugMode:   ut.debug,
-        TokenRegex:  tokenRegex,
-        CardRegex:   ut.cardRegex,
+    fieldRulesConfig, err := loadFieldRulesConfig()
+    if err != nil {
+        return nil, err
     }
-    ut.tokenizer = tokenizer.NewTokenizer(tokenizerConfig, encKey, ut.keyManager, ut)
-    
-    // Start rate limiter cleanup goroutine
-    go func() {
-        ticker := time.NewTicker(5 * time.Minute)
-        defer ticker.Stop()
-        for range ticker.C {
-            ut.authRateLimiter.Cleanup()
-        }
-    }()
-    
-    return ut, nil
-}
-
-func getEnv(key, defaultValue string) string {
-    if value := os.Getenv(key); value != "" {
-        return value
+    initialFieldRules, err := fieldRulesConfig.compile()
+    if err != nil {
+        return nil, err
     }
-    return defaultValue
-}
-
-func ParseTimeEnv(key, defaultValue string) time.Duration {
-    value := utils.GetEnv(key, defaultValue)
-    duration, err := time.ParseDuration(value)
+    if err := fieldRulesConfig.checkEngines(engines); err != nil {
+        return nil, fmt.Errorf("invalid CARD_FIELD_MAPPINGS: %v", err)
+    }
+    
+    passthrough, err := parsePassthroughRules(
+        utils.GetEnv("PROXY_PASSTHROUGH_CONTENT_TYPES", defaultPassthroughContentTypes),
+        utils.GetEnv("PROXY_PASSTHROUGH_PATHS", ""))
     if err != nil {
-        log.Printf("Warning: Invalid duration for %s: %s, using default: %s", key, value, defaultValue)
-        duration, _ = time.ParseDuration(defaultValue)
+        return nil, err
     }
-    return duration
-}
-
-func ParseIntEnv(key string, defaultValue int) int {
-    value := utils.GetEnv(key, fmt.Sprintf("%d", defaultValue))
-    result, err := strconv.Atoi(value)
+    maxBodySize, err := utils.ByteSizeSetting("PROXY_MAX_BODY_SIZE", 10<<20, 1<<10, 1<<40)
     if err != nil {
-        log.Printf("Warning: Invalid integer for %s: %s, using default: %d", key, value, defaultValue)
-        return defaultValue
+        return nil, err
     }
-    return result
-}
-
-func Min(a, b int) int {
-    if a < b {
-        return a
+    limits, err := parseBodyLimits(maxBodySize, utils.GetEnv("PROXY_MAX_BODY_SIZES", ""))
+    if err != nil {
+        return nil, err
     }
-    return b
-}
-
-// HTTP Tokenization Handler
-func (ut *UnifiedTokenizer) handleTokenize(w http.ResponseWriter, r *http.Request) {
-    start := time.Now()
-    path := r.URL.Path
-    
-    if ut.debug {
-        log.Printf("=== INCOMING REQUEST: %s %s ===", r.Method, path)
-        log.Printf("Headers: %v", r.Header)
+    policies, err := parseCardPolicies(utils.GetEnv("PROXY_CARD_POLICY", cardPolicyTokenize), utils.GetEnv("PROXY_CARD_POLICIES", ""))
+    if err != nil {
+        return nil, err
     }
-    
-    // Read body
-    body, err := io.ReadAll(r.Body)
+    spoolThreshold, err := utils.ByteSizeSetting("PROXY_SPOOL_THRESHOLD", 1<<20, 4<<10, 1<<30)
     if err != nil {
-        log.Printf("Error reading body: %v", err)
-        http.Error(w, "Error reading request", http.StatusBadRequest)
-        return
+        return nil, err
     }
-    r.Body.Close()
-    
-    // Process body for tokenization
-    var processedBody []byte
-    contentType := r.Header.Get("Content-Type")
-    
-    if strings.Contains(contentType, "application/json") && len(body) > 0 {
-        tokenized, modified, err := ut.tokenizeJSON(string(body))
-        if err != nil {
-            log.Printf("Error tokenizing JSON: %v", err)
-            processedBody = body
-        } else {
-            processedBody = []byte(tokenized)
-            if modified && ut.debug {
-                log.Printf("Tokenized request body")
-            }
+    corsConfig, err := loadCORSConfig()
+    if err != nil {
+        return nil, err
+    }
+    securityHeaders, err := loadSecurityHeaders()
+    if err != nil {
+        return nil, err
+    }
+    maintenancePage, err := loadMaintenancePage()
+    if err != nil {
+        return nil, err
+    }
+    var maintenanceDestinations []string
+    for _, h := range strings.Split(utils.GetEnv("MAINTENANCE_CRITICAL_DESTINATIONS", ""), ",") {
+        if h = strings.ToLower(strings.TrimSpace(h)); h != "" {
+            maintenanceDestinations = append(maintenanceDestinations, h)
         }
-    } else {
-        processedBody = body
     }
-    
-    // Build forward URL
-    forwardURL := ut.appEndpoint
-    if path != "" && path != "/" {
-        forwardURL = strings.TrimRight(ut.appEndpoint, "/") + path
+    proxies, err := clientip.New(strings.Split(utils.GetEnv("TRUSTED_PROXIES", ""), ","))
+    if err != nil {
+        return nil, fmt.Errorf("invalid TRUSTED_PROXIES: %v", err)
     }
-    
-    if r.URL.RawQuery != "" {
-        forwardURL += "?" + r.URL.RawQuery
+    cookies, err := loadCookieConfig(proxies)
+    if err != nil {
+        return nil, err
     }
-    
-    // Create new request
-    req, err := http.NewRequest(r.Method, forwardURL, bytes.NewReader(processedBody))
+    forwarding := forward.Config{
+        Mode:    strings.ToLower(utils.GetEnv("PROXY_FORWARDED_HEADERS", forward.XForwarded)),
+        Via:     utils.GetEnv("PROXY_VIA", "tokenshield"),
+        Proxies: proxies,
+    }
+    if forwarding.Via == "off" {
+        forwarding.Via = ""
+    }
+    if err := forwarding.Validate(); err != nil {
+        return nil, fmt.Errorf("invalid PROXY_FORWARDED_HEADERS or PROXY_VIA: %v", err)
+    }
+    ipFilterConfig, err := loadIPFilterConfig()
     if err != nil {
-        log.Printf("Error creating forward request: %v", err)
-        http.Error(w, "Error creating request", http.StatusInternalServerError)
-        return
+        return nil, err
     }
-    
-    // Copy headers
-    for key, values := range r.Header {
-        for _, value := range values {
-            req.Header.Add(key, value)
-        }
+    hourlyQuota, err := utils.IntSetting("DETOKENIZE_QUOTA_HOURLY", 20, 0, 1000000)
+    if err != nil {
+        return nil, err
     }
-    
-    // Update Content-Length
-    req.ContentLength = int64(len(processedBody))
-    req.Header.Set("Content-Length", strconv.Itoa(len(processedBody)))
-    
-    // Forward request
-    client := &http.Client{
-        Timeout: 30 * time.Second,
-        CheckRedirect: func(req *http.Request, via []*http.Request) error {
-            return http.ErrUseLastResponse
-        },
+    dailyQuota, err := utils.IntSetting("DETOKENIZE_QUOTA_DAILY", 100, 0, 1000000)
+    if err != nil {
+        return nil, err
     }
-    
-    resp, err := client.Do(req)
+    tokenPurgeDays, err := utils.IntSetting("TOKEN_PURGE_DAYS", 30, 0, 3650)
     if err != nil {
-        log.Printf("Error forwarding request: %v", err)
-        http.Error(w, "Error forwarding request", http.StatusBadGateway)
-        return
+        return nil, err
     }
-    defer resp.Body.Close()
-    
-    // Read response body
-    respBody, err := io.ReadAll(resp.Body)
+    requestArchive, err := loadRequestArchive()
     if err != nil {
-        log.Printf("Error reading response body: %v", err)
-        http.Error(w, "Error reading response", http.StatusInternalServerError)
-        return
+        return nil, err
     }
-    
-    // Check if this is an endpoint that needs response detokenization
-    processedRespBody := respBody
-    needsDetokenization := (path == "/api/cards" || path == "/my-cards") && resp.StatusCode == 200
-    
-    if needsDetokenization {
-        respContentType := resp.Header.Get("Content-Type")
-        if ut.debug {
-            log.Printf("DEBUG: Response content type: %s", respContentType)
-            log.Printf("DEBUG: Response body preview: %s", string(respBody[:utils.Min(200, len(respBody))]))
-        }
-        
-        // Handle JSON responses (API)
-        if strings.Contains(respContentType, "application/json") {
-            detokenized, modified, err := ut.detokenizeJSON(string(respBody))
-            if err != nil {
-                log.Printf("Error detokenizing JSON response: %v", err)
-            } else if modified {
-                processedRespBody = []byte(detokenized)
-                log.Printf("Detokenized JSON response body for %s", path)
-            } else if ut.debug {
-                log.Printf("DEBUG: No tokens found to detokenize in JSON response")
-            }
-        } else if strings.Contains(respContentType, "text/html") {
-            // Handle HTML responses (web pages)
-            detokenized, modified, err := ut.detokenizeHTML(string(respBody))
-            if err != nil {
-                log.Printf("Error detokenizing HTML response: %v", err)
-            } else if modified {
-                processedRespBody = []byte(detokenized)
-                log.Printf("Detokenized HTML response body for %s", path)
-            } else if ut.debug {
-                log.Printf("DEBUG: No tokens found to detokenize in HTML response")
-            }
-        }
+    auditRetention, err := loadAuditRetention()
+    if err != nil {
+        return nil, err
+    }
+    reportKey, err := loadReportSigningKey()
+    if err != nil {
+        return nil, err
+    }
+    reviewPolicy, err := loadAccessReviewPolicy()
+    if err != nil {
+        return nil, err
+    }
+    inactivity, err := loadInactivityPolicy()
+    if err != nil {
+        return nil, err
+    }
+    accountMail, err := loadAccountMail()
+    if err != nil {
+        return nil, err
+    }
+    signatureSkew, err := utils.DurationSetting("SIGNED_REQUEST_MAX_SKEW", 5*time.Minute, 30*time.Second, time.Hour)
+    if err != nil {
+        return nil, err
+    }
+    sessionBinding, err := loadSessionBinding()
+    if err != nil {
+        return nil, err
+    }
+    loginChallenge, err := loadLoginChallenge()
+    if err != nil {
+        return nil, err
+    }
+    serviceKeyDays, err := utils.IntSetting("SERVICE_ACCOUNT_KEY_DAYS", 90, 1, 365)
+    if err != nil {
+        return nil, err
+    }
+    serviceKeyReminderDays, err := utils.IntSetting("SERVICE_ACCOUNT_KEY_REMINDER_DAYS", 14, 0, 90)
+    if err != nil {
+        return nil, err
+    }
+    notifier, err := loadNotifier(accountMail.sender)
+    if err != nil {
+        return nil, err
+    }
+    rateLimitConfig, err := loadRateLimitConfig()
+    if err != nil {
+        return nil, err
+    }
+    var rateLimitStore ratelimit.Store
+    switch backend := utils.GetEnv("RATE_LIMIT_BACKEND", "memory"); backend {
+    case "memory":
+        rateLimitStore = ratelimit.NewMemoryStore()
+    case "database":
+        rateLimitStore = ratelimit.NewSQLStore(db)
+    default:
+        return nil, fmt.Errorf("unknown RATE_LIMIT_BACKEND %q (supported: memory, database)", backend)
+    }
+    detector, err := loadWAFDetector()
+    if err != nil {
+        return nil, err
+    }
+    requestSchemas, err := loadRequestSchemas(utils.GetEnv("REQUEST_SCHEMAS_FILE", ""))
+    if err != nil {
+        return nil, fmt.Errorf("invalid REQUEST_SCHEMAS_FILE: %v", err)
     }
     
-    // Copy response headers
-    for key, values := range resp.Header {
-        if key != "Content-Length" {
-            for _, value := range values {
-                w.Header().Add(key, value)
+    // Deprecated v1 endpoints answer 410 Gone from API_V1_SUNSET on
+    var apiV1Sunset time.Time
+    if sunset := utils.GetEnv("API_V1_SUNSET", ""); sunset != "" {
+        apiV1Sunset, err = time.Parse(time.RFC3339, sunset)
+        if err != nil {
+            if apiV1Sunset, err = time.Parse("2006-01-02", sunset); err != nil {
+                return nil, fmt.Errorf("invalid API_V1_SUNSET %q: want a date like 2027-06-30 or an RFC 3339 time", sunset)
             }
         }
     }
     
-    // Set correct content length
-    w.Header().Set("Content-Length", strconv.Itoa(len(processedRespBody)))
-    
-    // Set status code
-    w.WriteHeader(resp.StatusCode)
-    
-    // Write response body
-    w.Write(processedRespBody)
-    
-    duration := time.Since(start)
-    log.Printf("Request %s %s completed in %v with status %d", r.Method, path, duration, resp.StatusCode)
-}
-
-
-
-
-
-
-
-
-
-
-
-
-
-// calculateLuhnCheckDigit calculates the Luhn check digit for a given number
-func calculateLuhnCheckDigit(number string) int {
-    sum := 0
-    alternate := false
+    // Check if KEK/DEK is enabled
+    useKEKDEK := utils.GetEnv("USE_KEK_DEK", "false") == "true"
     
-    // Process from right to left
-    for i := len(number) - 1; i >= 0; i-- {
-        digit := int(number[i] - '0')
-        
-        if alternate {
-            digit *= 2
-            if digit > 9 {
-                digit = (digit % 10) + 1
+    // Sealed-boot mode: no key is usable until a quorum of key shares is
+    // supplied, so ENCRYPTION_KEY is replaced and never decrypts anything
+    sealMode := utils.GetEnv("SEAL_MODE", "")
+    switch sealMode {
+    case "":
+    case "shamir":
+        if !useKEKDEK {
+            return nil, fmt.Errorf("SEAL_MODE=shamir requires USE_KEK_DEK=true")
+        }
+        for _, name := range []string{"KEK_PASSPHRASE", "KEK_PASSPHRASE_FILE", "KMS_PROVIDER", "PKCS11_MODULE"} {
+            if utils.GetEnv(name, "") != "" {
+                return nil, fmt.Errorf("SEAL_MODE=shamir cannot be combined with %s", name)
             }
         }
-        
-        sum += digit
-        alternate = !alternate
+        encKey.Generate()
+    default:
+        return nil, fmt.Errorf("unknown SEAL_MODE %q (supported: shamir)", sealMode)
     }
     
-    return (10 - (sum % 10)) % 10
-}
-
-
-// Detect card type based on card number
-func DetectCardType(cardNumber string) string {
-    if len(cardNumber) < 4 {
-        return "Unknown"
+    ut := &UnifiedTokenizer{
+        db:            db,
+        stmts:         stmtcache.New(db, hotPathQueries),
+        encryptionKey: encKey,
+        appEndpoint:   utils.GetEnv("APP_ENDPOINT", "http://dummy-app:8000"),
+        tokenRegex:    tokenRegex,
+        cardRegex:     regexp.MustCompile(`\b(?:4[0-9]{12}(?:[0-9]{3})?|5[1-5][0-9]{14}|3[47][0-9]{13}|3(?:0[0-5]|[68][0-9])[0-9]{11}|6(?:011|5[0-9]{2})[0-9]{12}|(?:2131|1800|35\d{3})\d{11})\b`),
+        httpPort:      utils.GetEnv("HTTP_PORT", "8080"),
+        icapPort:      utils.GetEnv("ICAP_PORT", "1344"),
+        apiPort:       utils.GetEnv("API_PORT", "8090"),
+        debug:         utils.GetEnv("DEBUG_MODE", "0") == "1",
+        tokenFormat:   tokenFormat,
+        luhnBINs:      luhnBINs,
+        region:        siteRegion,
+        peerBINs:      peerBINs,
+        peers:         peers,
+        engines:       engines,
+        networkTokens: networkTokens,
+        counters:      counters.New(siteRegion),
+        luhnTokenSpace: luhnTokenSpace(luhnBINs),
+        fieldRulesConfig: fieldRulesConfig,
+        passthrough:   passthrough,
+        bodyLimits:    limits,
+        cardPolicies:  policies,
+        spoolDir:      utils.GetEnv("PROXY_SPOOL_DIR", ""),
+        spoolThreshold: spoolThreshold,
+        corsConfig:    corsConfig,
+        securityHeaders: securityHeaders,
+        csrfProtection: utils.GetEnv("CSRF_PROTECTION", "true") != "false",
+        proxies:       proxies,
+        forwarding:    forwarding,
+        cookies:       cookies,
+        ipFilterConfig: ipFilterConfig,
+        maintenancePage: maintenancePage,
+        maintenanceDestinations: maintenanceDestinations,
+        detokenizeQuota: quotaLimits{Hourly: hourlyQuota, Daily: dailyQuota},
+        deterministicTokens: utils.GetEnv("DETERMINISTIC_TOKENS", "false") == "true",
+        tokenPurgeDays:  tokenPurgeDays,
+        requestArchive:  requestArchive,
+        auditRetention:  auditRetention,
+        reportKey:       reportKey,
+        reviewPolicy:    reviewPolicy,
+        inactivity:      inactivity,
+        accountMail:     accountMail,
+        signatureSkew:   signatureSkew,
+        serviceKeyDays:  serviceKeyDays,
+        serviceKeyReminderDays: serviceKeyReminderDays,
+        notifier:        notifier,
+        swaggerUI:       utils.GetEnv("SWAGGER_UI_ENABLED", "false") == "true",
+        apiCompression:  utils.GetEnv("API_COMPRESSION", "false") == "true",
+        apiV1Sunset:     apiV1Sunset,
+        useKEKDEK:     useKEKDEK,
+        rateLimitConfig: rateLimitConfig,
+        waf:             detector,
+        rateLimitStore:  rateLimitStore,
+        // Session security configuration with environment variable support
+        sessionTimeout:       utils.ParseTimeEnv("SESSION_TIMEOUT", "24h"),           // Default 24 hours
+        sessionIdleTimeout:   utils.ParseTimeEnv("SESSION_IDLE_TIMEOUT", "4h"),       // Default 4 hours
+        maxConcurrentSessions: utils.ParseIntEnv("MAX_CONCURRENT_SESSIONS", 5),       // Default 5 sessions per user
+        sessionBinding:       sessionBinding,
+        loginChallenge:       loginChallenge,
+        validationConfigs:    make(map[string]ValidationConfig),                // Initialize validation configs
+        eventBroker:          events.NewBroker(256),                            // Per-subscriber event buffer
+    }
+    ut.corsPolicy.Store(&ut.corsConfig)
+    ut.maintenance.Store(&Maintenance{})
+    ut.fieldRules.Store(initialFieldRules)
+    initialFilters := make(map[string]*ipfilter.Filter)
+    for scope := range ipFilterConfig {
+        filter := ipFilterConfig[scope]
+        initialFilters[scope] = &filter
     }
+    ut.ipFilters.Store(&initialFilters)
+    ut.rateLimitRules.Store(&ut.rateLimitConfig)
     
-    // Remove any spaces or dashes
-    cardNumber = strings.ReplaceAll(strings.ReplaceAll(cardNumber, " ", ""), "-", "")
+    // Scan for tokens of the configured format and Luhn-valid card numbers
+    tokenPatterns := []scanner.TokenPattern{scanner.PrefixTokens()}
+    if tokenFormat == "luhn" {
+        tokenPatterns = nil
+        for _, bin := range luhnBINs {
+            tokenPatterns = append(tokenPatterns, scanner.LuhnTokens(bin))
+        }
+        for _, peer := range peerBINs {
+            tokenPatterns = append(tokenPatterns, scanner.LuhnTokens(peer.bin))
+        }
+    }
+    ut.scanner = scanner.New(tokenPatterns, true)
     
-    // Visa: starts with 4
-    if strings.HasPrefix(cardNumber, "4") && (len(cardNumber) == 13 || len(cardNumber) == 16 || len(cardNumber) == 19) {
-        return "Visa"
+    // Initialize validation configurations for endpoints
+    ut.initializeValidationConfigs(requestSchemas)
+    
+    // Until roles load, users only have the permissions granted to them
+    if err := ut.refreshRoles(); err != nil {
+        log.Printf("Warning: Failed to load roles: %v", err)
     }
     
-    // Mastercard: starts with 5 (51-55) or 2 (2221-2720)
-    if len(cardNumber) >= 2 {
-        prefix2 := cardNumber[:2]
-        if (prefix2 >= "51" && prefix2 <= "55") || (prefix2 >= "22" && prefix2 <= "27") {
-            if len(cardNumber) == 16 {
-                return "Mastercard"
-            }
+    // Optional TLS; certificates are reloaded from disk when renewed
+    if certFile, keyFile := utils.GetEnv("TLS_CERT_FILE", ""), utils.GetEnv("TLS_KEY_FILE", ""); certFile != "" || keyFile != "" {
+        if certFile == "" || keyFile == "" {
+            return nil, fmt.Errorf("TLS_CERT_FILE and TLS_KEY_FILE must be set together")
+        }
+        reloader, err := tlsreload.New(certFile, keyFile)
+        if err != nil {
+            return nil, err
         }
+        ut.tlsConfig = reloader.TLSConfig()
     }
     
-    // American Express: starts with 34 or 37
-    if len(cardNumber) >= 2 {
-        prefix2 := cardNumber[:2]
-        if (prefix2 == "34" || prefix2 == "37") && len(cardNumber) == 15 {
-            return "Amex"
+    // Optional client certificates on the API port, mapped to identities in
+    // client_certificates. Clients without one still use keys or sessions.
+    ut.apiTLSConfig = ut.tlsConfig
+    if caFile := utils.GetEnv("MTLS_CLIENT_CA", ""); caFile != "" {
+        if ut.tlsConfig == nil {
+            return nil, fmt.Errorf("MTLS_CLIENT_CA requires TLS_CERT_FILE and TLS_KEY_FILE")
+        }
+        caPEM, err := os.ReadFile(caFile)
+        if err != nil {
+            return nil, fmt.Errorf("reading MTLS_CLIENT_CA: %v", err)
+        }
+        clientCAs := x509.NewCertPool()
+        if !clientCAs.AppendCertsFromPEM(caPEM) {
+            return nil, fmt.Errorf("MTLS_CLIENT_CA contains no PEM certificates")
         }
+        ut.apiTLSConfig = ut.tlsConfig.Clone()
+        ut.apiTLSConfig.ClientCAs = clientCAs
+        ut.apiTLSConfig.ClientAuth = tls.VerifyClientCertIfGiven
     }
     
-    // Discover: starts with 6011, 622126-622925, 644-649, or 65
-    if len(cardNumber) >= 4 {
-        prefix4 := cardNumber[:4]
-        prefix2 := cardNumber[:2]
-        prefix3 := cardNumber[:3]
-        
-        if prefix4 == "6011" || prefix2 == "65" {
-            if len(cardNumber) == 16 {
-                return "Discover"
-            }
+    // Initialize KeyManager if KEK/DEK is enabled
+    if sealMode == "shamir" {
+        threshold, err := loadSealThreshold(db)
+        if err != nil {
+            return nil, err
         }
-        
-        if len(cardNumber) >= 6 {
-            prefix6 := cardNumber[:6]
-            if prefix6 >= "622126" && prefix6 <= "622925" {
-                return "Discover"
-            }
+        km, err := NewSealedKeyManager(db)
+        if err != nil {
+            return nil, err
         }
-        
-        if prefix3 >= "644" && prefix3 <= "649" {
-            if len(cardNumber) == 16 {
-                return "Discover"
-            }
+        ut.keyManager = km
+        ut.unsealer = &unsealState{threshold: threshold}
+        log.Printf("Vault is sealed: submit %d key shares to /api/v1/unseal", threshold)
+    } else if useKEKDEK {
+        // KEKs are wrapped by a passphrase-derived key or a cloud KMS
+        sealer, err := keyseal.FromEnv()
+        if err != nil {
+            return nil, err
+        }
+        km, err := NewKeyManager(db, sealer)
+        if err != nil {
+            log.Printf("Warning: Failed to initialize KeyManager: %v. Falling back to legacy encryption.", err)
+            ut.useKEKDEK = false
+        } else {
+            ut.keyManager = km
         }
     }
     
-    return "Unknown"
-}
-
-// isValidLuhn validates a card number using the Luhn algorithm
-func IsValidLuhn(cardNumber string) bool {
-    // Remove spaces and dashes
-    cardNumber = strings.ReplaceAll(strings.ReplaceAll(cardNumber, " ", ""), "-", "")
+    // Initialize ICAP server
+    ut.icapServer = icap.NewServer(ut, ut.debug)
+    ut.icapServer.ReadTimeout = settings.icapReadTimeout
+    ut.icapServer.WriteTimeout = settings.icapWriteTimeout
+    ut.icapServer.Secret = utils.GetEnv("ICAP_SHARED_SECRET", "")
+    ut.icapServer.Unauthorized = ut.icapUnauthorized
+    ut.icapServer.Detokenizes = ut.detokenizesFor
+    ut.updateICAPISTag()
+    ut.icapPool = icap.NewPool(ut.icapServer, settings.icapMaxConnections, settings.icapQueueSize, settings.icapQueueTimeout)
+    
+    if err := ut.loadSMTPFilter(); err != nil {
+        return nil, err
+    }
+    if err := ut.loadBatchWatcher(); err != nil {
+        return nil, err
+    }
+    if err := ut.loadKafkaBridge(); err != nil {
+        return nil, err
+    }
+    if err := ut.loadEgressHelper(); err != nil {
+        return nil, err
+    }
     
-    if len(cardNumber) == 0 {
-        return false
+    upstreamTLS, err := loadUpstreamTLS()
+    if err != nil {
+        return nil, err
     }
+    ut.upstreamInsecure = upstreamTLS.InsecureSkipVerify
+    
+    // Shared so connections to the application are reused across requests
+    ut.upstreamClient = &http.Client{
+        Timeout: settings.upstreamTimeout,
+        Transport: &http.Transport{
+            Proxy:               http.ProxyFromEnvironment,
+            DialContext:         (&net.Dialer{Timeout: settings.upstreamDialTimeout, KeepAlive: 30 * time.Second}).DialContext,
+            TLSClientConfig:     upstreamTLS,
+            TLSHandshakeTimeout: settings.upstreamDialTimeout,
+            MaxIdleConnsPerHost: 32,
+            IdleConnTimeout:     90 * time.Second,
+        },
+        CheckRedirect: func(req *http.Request, via []*http.Request) error {
+            return http.ErrUseLastResponse
+        },
+    }
+    upstreamName := ut.appEndpoint
+    if u, err := url.Parse(ut.appEndpoint); err == nil && u.Host != "" {
+        upstreamName = u.Host
+    }
+    ut.upstream = upstream.New(upstreamName, ut.upstreamClient, settings.upstream)
     
-    sum := 0
-    alternate := false
+    // Initialize tokenizer
+    tokenizerConfig := tokenizer.TokenizerConfig{
+        TokenFormat: tokenFormat,
+        UseKEKDEK:   useKEKDEK,
+        DebugMode:   ut.debug,
+        TokenRegex:  tokenRegex,
+        CardRegex:   ut.cardRegex,
+    }
+    ut.tokenizer = tokenizer.NewTokenizer(tokenizerConfig, encKey, ut.keyManager, ut)
     
-    // Process from right to left
-    for i := len(cardNumber) - 1; i >= 0; i-- {
-        digit := int(cardNumber[i] - '0')
-        if digit < 0 || digit > 9 {
-            return false
-        }
-        
-        if alternate {
-            digit *= 2
-            if digit > 9 {
-                digit = digit%10 + digit/10
+    // Start rate limiter cleanup goroutine
+    go func() {
+        ticker := time.NewTicker(5 * time.Minute)
+        defer ticker.Stop()
+        for range ticker.C {
+            if err := ut.rateLimitStore.Cleanup(time.Now()); err != nil {
+                log.Printf("Error cleaning up rate-limit counters: %v", err)
             }
         }
-        
-        sum += digit
-        alternate = !alternate
-    }
+    }()
     
-    return sum%10 == 0
-}
-
-
-
-// StorageInterface implementation for tokenizer package
-func (ut *UnifiedTokenizer) StoreCard(token, cardNumber string) error {
-    return ut.storeCard(token, cardNumber)
+    return ut, nil
 }
 
-func (ut *UnifiedTokenizer) RetrieveCard(token string) string {
-    return ut.retrieveCard(token)
+func getEnv(key, defaultValue string) string {
+    if value := os.Getenv(key); value != "" {
+        return value
+    }
+    return defaultValue
 }
 
-// ICAP Handler interface implementation - delegate to tokenizer package
-func (ut *UnifiedTokenizer) TokenizeJSON(jsonStr string) (string, bool, error) {
-    return ut.tokenizeJSON(jsonStr)
+func ParseTimeEnv(key, defaultValue string) time.Duration {
+    value := utils.GetEnv(key, defaultValue)
+    duration, err := time.ParseDuration(value)
+    if err != nil {
+        log.Printf("Warning: Invalid duration for %s: %s, using default: %s", key, value, defaultValue)
+        duration, _ = time.ParseDuration(defaultValue)
+    }
+    return duration
 }
 
-// Original working tokenizeJSON implementation
-func (ut *UnifiedTokenizer) tokenizeJSON(jsonStr string) (string, bool, error) {
-    var data interface{}
-    if err := json.Unmarshal([]byte(jsonStr), &data); err != nil {
-        return jsonStr, false, err
-    }
-    
-    modified := false
-    ut.processValue(&data, &modified, true) // true for tokenization
-    
-    result, err := json.Marshal(data)
+func ParseIntEnv(key string, defaultValue int) int {
+    value := utils.GetEnv(key, fmt.Sprintf("%d", defaultValue))
+    result, err := strconv.Atoi(value)
     if err != nil {
-        return jsonStr, false, err
+        log.Printf("Warning: Invalid integer for %s: %s, using default: %d", key, value, defaultValue)
+        return defaultValue
     }
-    
-    return string(result), modified, nil
+    return result
 }
 
-func (ut *UnifiedTokenizer) DetokenizeJSON(jsonStr string) (string, bool, error) {
-    return ut.detokenizeJSON(jsonStr)
+func Min(a, b int) int {
+    if a < b {
+        return a
+    }
+    return b
 }
 
-// Original working detokenizeJSON implementation
-func (ut *UnifiedTokenizer) detokenizeJSON(jsonStr string) (string, bool, error) {
-    if ut.debug {
-        log.Printf("DEBUG: detokenizeJSON called with: %s", jsonStr[:utils.Min(200, len(jsonStr))])
-    }
-    
-    var data interface{}
-    if err := json.Unmarshal([]byte(jsonStr), &data); err != nil {
-        return jsonStr, false, err
-    }
-    
-    if ut.debug {
-        log.Printf("DEBUG: Unmarshaled data type: %T", data)
-    }
-    
-    modified := false
-    ut.processValue(&data, &modified, false) // false for detokenization
-    
-    if ut.debug {
-        log.Printf("DEBUG: detokenizeJSON modified=%v", modified)
-    }
-    
-    result, err := json.Marshal(data)
-    if err != nil {
-        return jsonStr, false, err
-    }
-    
-    return string(result), modified, nil
+// HTTP Tokenization Handler
+// defaultPassthroughContentTypes are static assets and binary downloads.
+// The proxy only tokenizes JSON, so streaming them changes nothing but
+// latency and memory use.
+const defaultPassthroughContentTypes = "image/,font/,audio/,video/,text/css,text/javascript,application/javascript,application/wasm,application/pdf,application/zip,application/octet-stream"
+
+// passthroughRules select proxied traffic that is streamed between client
+// and application without being buffered or scanned
+type passthroughRules struct {
+    contentTypes []string // Media types; an entry ending in "/" matches the whole type
+    paths        []string // Path prefixes
 }
 
-// Original working processValue implementation
-func (ut *UnifiedTokenizer) processValue(v interface{}, modified *bool, tokenize bool) {
-    switch val := v.(type) {
-    case *interface{}:
-        if ut.debug && !tokenize {
-            log.Printf("DEBUG: Processing pointer to interface{}")
-        }
-        ut.processValue(*val, modified, tokenize)
-    case map[string]interface{}:
-        if ut.debug && !tokenize {
-            log.Printf("DEBUG: Processing map with keys: %v", ut.getMapKeys(val))
-        }
-        for k, v := range val {
-            if ut.debug && !tokenize {
-                log.Printf("DEBUG: Processing map key '%s' with value type %T", k, v)
+// parsePassthroughRules parses PROXY_PASSTHROUGH_CONTENT_TYPES, where
+// "none" turns content type matching off, and PROXY_PASSTHROUGH_PATHS.
+// Both are comma-separated.
+func parsePassthroughRules(contentTypes, paths string) (passthroughRules, error) {
+    var rules passthroughRules
+    if strings.TrimSpace(contentTypes) != "none" {
+        for _, t := range strings.Split(contentTypes, ",") {
+            t = strings.ToLower(strings.TrimSpace(t))
+            if t == "" {
+                continue
             }
-            if tokenize && ut.isCreditCardField(k) {
-                if str, ok := v.(string); ok && ut.cardRegex.MatchString(str) {
-                    // Don't tokenize if it's already one of our tokens
-                    if ut.tokenFormat == "luhn" && strings.HasPrefix(str, "9999") {
-                        // This is already a token, skip it
-                        continue
-                    }
-                    token := ut.generateToken()
-                    if err := ut.storeCard(token, str); err == nil {
-                        val[k] = token
-                        *modified = true
-                        log.Printf("Tokenized card ending in %s", str[len(str)-4:])
-                    }
-                }
-            } else if !tokenize && ut.isCreditCardField(k) {
-                if str, ok := v.(string); ok {
-                    if ut.debug {
-                        log.Printf("DEBUG: Checking field '%s' with value '%s' for detokenization", k, str)
-                    }
-                    if ut.tokenRegex.MatchString(str) {
-                        if card := ut.retrieveCard(str); card != "" {
-                            val[k] = card
-                            *modified = true
-                            log.Printf("Detokenized token %s in field %s", str, k)
-                        } else if ut.debug {
-                            log.Printf("DEBUG: Failed to retrieve card for token %s", str)
-                        }
-                    } else if ut.debug {
-                        log.Printf("DEBUG: Value '%s' doesn't match token regex", str)
-                    }
-                }
-            } else {
-                if ut.debug && !tokenize {
-                    log.Printf("DEBUG: Recursively processing non-card field '%s' with value type %T", k, v)
-                }
-                ut.processValue(v, modified, tokenize)
+            if !strings.Contains(t, "/") {
+                return rules, fmt.Errorf("invalid PROXY_PASSTHROUGH_CONTENT_TYPES entry %q: use a media type like text/css or a type like image/", t)
             }
+            rules.contentTypes = append(rules.contentTypes, t)
         }
-    case []interface{}:
-        if ut.debug && !tokenize {
-            log.Printf("DEBUG: Processing array with %d elements", len(val))
-        }
-        for i := range val {
-            if ut.debug && !tokenize && i == 0 {
-                log.Printf("DEBUG: First array element type: %T", val[i])
-            }
-            ut.processValue(&val[i], modified, tokenize)
+    }
+    for _, prefix := range strings.Split(paths, ",") {
+        prefix = strings.TrimSpace(prefix)
+        if prefix == "" {
+            continue
         }
-    case string:
-        // Handle string values that might contain tokens or card numbers
-        if tokenize && ut.cardRegex.MatchString(val) {
-            // This case is handled by the parent map processor
-        } else if !tokenize && ut.tokenRegex.MatchString(val) {
-            // This case is handled by the parent map processor  
+        if !strings.HasPrefix(prefix, "/") {
+            return rules, fmt.Errorf("invalid PROXY_PASSTHROUGH_PATHS entry %q: must start with /", prefix)
         }
+        rules.paths = append(rules.paths, prefix)
     }
+    return rules, nil
 }
 
-func (ut *UnifiedTokenizer) getMapKeys(m map[string]interface{}) []string {
-    keys := make([]string, 0, len(m))
-    for k := range m {
-        keys = append(keys, k)
-    }
-    return keys
-}
-
-// Original helper methods
-func (ut *UnifiedTokenizer) isCreditCardField(fieldName string) bool {
-    lowerField := strings.ToLower(fieldName)
-    // Exact matches to avoid false positives like "cards" matching "card"
-    exactMatches := []string{"card", "pan"}
-    for _, field := range exactMatches {
-        if lowerField == field {
+// matches reports whether a request or response with this path and
+// Content-Type is passed through
+func (p passthroughRules) matches(path, contentType string) bool {
+    for _, prefix := range p.paths {
+        if strings.HasPrefix(path, prefix) {
             return true
         }
     }
-    
-    // Partial matches for compound names
-    cardFields := []string{"card_number", "cardnumber", "creditcard", "credit_card", "account_number"}
-    for _, field := range cardFields {
-        if strings.Contains(lowerField, field) {
+    mediaType := strings.ToLower(strings.TrimSpace(strings.SplitN(contentType, ";", 2)[0]))
+    if mediaType == "" {
+        return false
+    }
+    for _, t := range p.contentTypes {
+        if mediaType == t || strings.HasSuffix(t, "/") && strings.HasPrefix(mediaType, t) {
             return true
         }
     }
     return false
 }
 
-func (ut *UnifiedTokenizer) generateToken() string {
-    if ut.tokenFormat == "luhn" {
-        return ut.generateLuhnToken()
+// bodyLimits cap proxied request bodies: PROXY_MAX_BODY_SIZE, overridden
+// per path prefix by PROXY_MAX_BODY_SIZES
+type bodyLimits struct {
+    defaultMax int64
+    routes     map[string]int64
+}
+
+// parseBodyLimits parses PROXY_MAX_BODY_SIZES, comma-separated entries
+// like /api/upload=100MB
+func parseBodyLimits(defaultMax int64, routes string) (bodyLimits, error) {
+    limits := bodyLimits{defaultMax: defaultMax, routes: make(map[string]int64)}
+    for _, entry := range strings.Split(routes, ",") {
+        if strings.TrimSpace(entry) == "" {
+            continue
+        }
+        prefix, size, ok := strings.Cut(entry, "=")
+        prefix = strings.TrimSpace(prefix)
+        if !ok || !strings.HasPrefix(prefix, "/") {
+            return limits, fmt.Errorf("invalid PROXY_MAX_BODY_SIZES entry %q: use /path=size", entry)
+        }
+        max, err := utils.ParseByteSize(size)
+        if err != nil || max == 0 {
+            return limits, fmt.Errorf("invalid PROXY_MAX_BODY_SIZES entry %q: size must be positive, like 512KB or 100MB", entry)
+        }
+        limits.routes[prefix] = max
     }
-    
-    // Default prefix format
-    b := make([]byte, 32)
-    cryptorand.Read(b)
-    return "tok_" + base64.URLEncoding.EncodeToString(b)
+    return limits, nil
 }
 
-// generateLuhnToken generates a token that looks like a valid credit card number
-func (ut *UnifiedTokenizer) generateLuhnToken() string {
-    // Use prefix 9999 to distinguish tokens from real cards
-    // This prefix is not used by any real card issuer
-    prefix := "9999"
-    
-    // Generate 11 random digits
-    randomPart := make([]byte, 11)
-    for i := 0; i < 11; i++ {
-        randomPart[i] = byte(rand.Intn(10)) + '0'
+// maxFor returns the limit of the longest matching prefix, or the default
+func (l bodyLimits) maxFor(path string) int64 {
+    max, longest := l.defaultMax, -1
+    for prefix, size := range l.routes {
+        if strings.HasPrefix(path, prefix) && len(prefix) > longest {
+            max, longest = size, len(prefix)
+        }
     }
-    
-    // Combine prefix and random part (15 digits total)
-    partial := prefix + string(randomPart)
-    
-    // Calculate and append Luhn check digit
-    checkDigit := ut.calculateLuhnCheckDigit(partial)
-    
-    return partial + strconv.Itoa(checkDigit)
+    return max
 }
 
-// calculateLuhnCheckDigit calculates the Luhn check digit for a given number
-func (ut *UnifiedTokenizer) calculateLuhnCheckDigit(number string) int {
-    sum := 0
-    alternate := false
-    
-    // Process from right to left
-    for i := len(number) - 1; i >= 0; i-- {
-        digit := int(number[i] - '0')
-        
-        if alternate {
-            digit *= 2
-            if digit > 9 {
-                digit = (digit % 10) + 1
-            }
+// Card policies say what the proxy does with a request body carrying a
+// card number
+const (
+    cardPolicyTokenize = "tokenize" // Replace card fields with tokens
+    cardPolicyReject   = "reject"   // Refuse the request with 422
+    cardPolicyAlert    = "alert"    // Tokenize and record a security event
+)
+
+// cardPolicies choose the card policy for proxied requests:
+// PROXY_CARD_POLICY, overridden per path prefix by PROXY_CARD_POLICIES
+type cardPolicies struct {
+    defaultPolicy string
+    routes        map[string]string
+}
+
+// parseCardPolicies parses PROXY_CARD_POLICIES, comma-separated entries
+// like /api/logs=reject
+func parseCardPolicies(defaultPolicy, routes string) (cardPolicies, error) {
+    policies := cardPolicies{defaultPolicy: strings.ToLower(strings.TrimSpace(defaultPolicy)), routes: make(map[string]string)}
+    if !validCardPolicy(policies.defaultPolicy) {
+        return policies, fmt.Errorf("invalid PROXY_CARD_POLICY %q: use tokenize, reject or alert", defaultPolicy)
+    }
+    for _, entry := range strings.Split(routes, ",") {
+        if strings.TrimSpace(entry) == "" {
+            continue
         }
-        
-        sum += digit
-        alternate = !alternate
+        prefix, policy, ok := strings.Cut(entry, "=")
+        prefix = strings.TrimSpace(prefix)
+        policy = strings.ToLower(strings.TrimSpace(policy))
+        if !ok || !strings.HasPrefix(prefix, "/") || !validCardPolicy(policy) {
+            return policies, fmt.Errorf("invalid PROXY_CARD_POLICIES entry %q: use /path=tokenize, /path=reject or /path=alert", entry)
+        }
+        policies.routes[prefix] = policy
     }
-    
-    return (10 - (sum % 10)) % 10
+    return policies, nil
 }
 
-// encryptCardNumber encrypts card data using the appropriate method
-func (ut *UnifiedTokenizer) encryptCardNumber(data string) ([]byte, error) {
-    if ut.useKEKDEK && ut.keyManager != nil {
-        // Use KEK/DEK encryption
-        encrypted, _, err := ut.keyManager.EncryptData([]byte(data))
-        return encrypted, err
-    } else {
-        // Use legacy Fernet encryption
-        return fernet.EncryptAndSign([]byte(data), ut.encryptionKey)
-    }
+func validCardPolicy(policy string) bool {
+    return policy == cardPolicyTokenize || policy == cardPolicyReject || policy == cardPolicyAlert
 }
 
-// decryptCardNumber decrypts card data using the appropriate method
-func (ut *UnifiedTokenizer) decryptCardNumber(encryptedData []byte) (string, error) {
-    if ut.useKEKDEK && ut.keyManager != nil {
-        // Try KEK/DEK decryption first
-        decrypted, err := ut.keyManager.DecryptData(encryptedData, "")
-        if err == nil {
-            return string(decrypted), nil
+// policyFor returns the policy of the longest matching prefix, or the default
+func (p cardPolicies) policyFor(path string) string {
+    policy, longest := p.defaultPolicy, -1
+    for prefix, routePolicy := range p.routes {
+        if strings.HasPrefix(path, prefix) && len(prefix) > longest {
+            policy, longest = routePolicy, len(prefix)
         }
-        // Fall back to legacy if KEK/DEK fails
     }
-    
-    // Use legacy Fernet decryption
-    decrypted := fernet.VerifyAndDecrypt(encryptedData, 0, []*fernet.Key{ut.encryptionKey})
-    if decrypted == nil {
-        return "", fmt.Errorf("fernet decryption failed")
-    }
-    return string(decrypted), nil
+    return policy
 }
 
-// detokenizeHTML detokenizes tokens in HTML content
-func (ut *UnifiedTokenizer) detokenizeHTML(htmlStr string) (string, bool, error) {
-    if ut.debug {
-        log.Printf("DEBUG: detokenizeHTML called, length: %d", len(htmlStr))
+// cardScanOverlap is how much of one chunk of a spooled body is scanned
+// again with the next, enough for a card number split between them
+const cardScanOverlap = 64
+
+// bodyHasCard reports whether a buffered request body in bodyEncoding
+// contains a card number anywhere, whatever its content type
+func (ut *UnifiedTokenizer) bodyHasCard(buffer *spool.Buffer, bodyEncoding charset.Encoding) (bool, error) {
+    if !buffer.Spilled() {
+        text, err := bodyEncoding.Decode(buffer.Bytes())
+        if err != nil {
+            return false, err
+        }
+        return ut.scanner.Contains(text, scanner.PAN), nil
     }
-    
-    modified := false
-    result := htmlStr
-    
-    // Find all tokens in the HTML content
-    matches := ut.tokenRegex.FindAllString(htmlStr, -1)
-    if ut.debug {
-        log.Printf("DEBUG: Found %d potential tokens in HTML", len(matches))
+    r, err := buffer.Reader()
+    if err != nil {
+        return false, err
     }
-    
-    for _, token := range matches {
-        if ut.debug {
-            log.Printf("DEBUG: Attempting to detokenize token: %s", token)
+    defer r.Close()
+    reader := bodyEncoding.NewReader(r)
+    chunk := make([]byte, 64<<10)
+    var carry []byte
+    for {
+        n, err := io.ReadFull(reader, chunk)
+        text := append(carry, chunk[:n]...)
+        if ut.scanner.Contains(string(text), scanner.PAN) {
+            return true, nil
         }
-        if card := ut.retrieveCard(token); card != "" {
-            result = strings.ReplaceAll(result, token, card)
-            modified = true
-            log.Printf("Detokenized token %s in HTML content", token)
-        } else if ut.debug {
-            log.Printf("DEBUG: Failed to retrieve card for token: %s", token)
+        if err == io.EOF || err == io.ErrUnexpectedEOF {
+            return false, nil
+        }
+        if err != nil {
+            return false, err
         }
+        // Carry the tail over from the start of a word, so the digits of a
+        // longer number cut short are not taken for a card number. A tail
+        // inside one word keeps its last byte, so nothing can match at the
+        // start of the next chunk.
+        start := len(text) - cardScanOverlap
+        for start < len(text)-1 && isWordByte(text[start-1]) {
+            start++
+        }
+        carry = append([]byte(nil), text[start:]...)
     }
-    
-    return result, modified, nil
 }
 
-func (ut *UnifiedTokenizer) DetokenizeHTML(htmlStr string) (string, bool, error) {
-    return ut.detokenizeHTML(htmlStr)
+func isWordByte(c byte) bool {
+    return c >= '0' && c <= '9' || c >= 'A' && c <= 'Z' || c >= 'a' && c <= 'z' || c == '_'
 }
 
-func (ut *UnifiedTokenizer) storeCard(token, cardNumber string) error {
-    var encrypted []byte
-    var keyID string
-    var err error
-    
-    // Detect card type
-    cardType := utils.DetectCardType(cardNumber)
-    
-    if ut.useKEKDEK && ut.keyManager != nil {
-        // Use KEK/DEK encryption
-        encrypted, keyID, err = ut.keyManager.EncryptData([]byte(cardNumber))
-        if err != nil {
-            return fmt.Errorf("KEK/DEK encryption failed: %v", err)
-        }
-    } else {
-        // Use legacy Fernet encryption
-        encrypted, err = fernet.EncryptAndSign([]byte(cardNumber), ut.encryptionKey)
-        if err != nil {
-            return fmt.Errorf("encryption failed: %v", err)
+// applyCardPolicy enforces the card policy of a proxied request's path
+// before its body is tokenized. It reports false when the request was
+// refused and answered.
+func (ut *UnifiedTokenizer) applyCardPolicy(w http.ResponseWriter, r *http.Request, buffer *spool.Buffer, bodyEncoding charset.Encoding) bool {
+    policy := ut.cardPolicies.policyFor(r.URL.Path)
+    if policy != cardPolicyReject && policy != cardPolicyAlert {
+        return true
+    }
+    hasCard, err := ut.bodyHasCard(buffer, bodyEncoding)
+    if err != nil {
+        // Refusing is safer than letting a card through unseen
+        log.Printf("Error scanning %s %s for card numbers: %v", r.Method, r.URL.Path, err)
+        if policy == cardPolicyReject {
+            http.Error(w, "Error reading request", http.StatusBadRequest)
+            return false
         }
+        return true
     }
-    
-    if ut.useKEKDEK && keyID != "" {
-        _, err = ut.db.Exec(`
-            INSERT INTO credit_cards (token, card_number_encrypted, card_type, last_four_digits, first_six_digits, 
-                                     expiry_month, expiry_year, created_at, is_active, encryption_key_id)
-            VALUES (?, ?, ?, ?, ?, 12, 2025, NOW(), TRUE, ?)
-        `, token, encrypted, cardType, cardNumber[len(cardNumber)-4:], cardNumber[:6], keyID)
-    } else {
-        _, err = ut.db.Exec(`
-            INSERT INTO credit_cards (token, card_number_encrypted, card_type, last_four_digits, first_six_digits, 
-                                     expiry_month, expiry_year, created_at, is_active)
-            VALUES (?, ?, ?, ?, ?, 12, 2025, NOW(), TRUE)
-        `, token, encrypted, cardType, cardNumber[len(cardNumber)-4:], cardNumber[:6])
+    if !hasCard {
+        return true
     }
     
-    if err == nil {
-        _, _ = ut.db.Exec(`
-            INSERT INTO token_requests (token, request_type, source_ip, destination_url, response_status)
-            VALUES (?, 'tokenize', '127.0.0.1', '', 200)
-        `, token)
+    ipAddress, userAgent := ut.getClientInfo(r)
+    event := SecurityEvent{
+        EventType: "card_data_detected",
+        Severity:  "medium",
+        IPAddress: ipAddress,
+        UserAgent: userAgent,
+        Endpoint:  r.URL.Path,
+        Details:   map[string]interface{}{"method": r.Method, "policy": policy},
+    }
+    if policy == cardPolicyAlert {
+        atomic.AddInt64(&ut.cardPolicyAlerted, 1)
+        ut.logSecurityEvent(event)
+        return true
     }
     
-    return err
+    atomic.AddInt64(&ut.cardPolicyRejected, 1)
+    event.EventType, event.Severity = "card_data_rejected", "high"
+    ut.logSecurityEvent(event)
+    log.Printf("Rejected %s %s: card number on a path whose card policy is reject", r.Method, r.URL.Path)
+    http.Error(w, "Card data is not accepted on this endpoint", http.StatusUnprocessableEntity)
+    return false
 }
 
-func (ut *UnifiedTokenizer) retrieveCard(token string) string {
-    if ut.debug {
-        log.Printf("DEBUG: retrieveCard called with token: %s", token)
-    }
-    
-    var encryptedCard []byte
-    var keyID sql.NullString
-    
-    err := ut.db.QueryRow(`
-        SELECT card_number_encrypted, encryption_key_id FROM credit_cards 
-        WHERE token = ? AND is_active = TRUE
-    `, token).Scan(&encryptedCard, &keyID)
-    
-    if err != nil {
-        if err == sql.ErrNoRows {
-            if ut.debug {
-                log.Printf("DEBUG: Token not found in database: %s", token)
+// detokenizesResponses reports whether responses proxied for path are
+// scanned for tokens to replace with card numbers
+func detokenizesResponses(path string) bool {
+    return path == "/api/cards" || path == "/my-cards"
+}
+
+// maxDecodedResponse bounds a compressed proxied response decoded to be
+// detokenized
+const maxDecodedResponse = 64 << 20
+
+// encodeBody encodes a body held in memory, or in spooled when that is
+// set, with contentEncoding
+func (ut *UnifiedTokenizer) encodeBody(contentEncoding string, body []byte, spooled *spool.Buffer) (*spool.Buffer, error) {
+    out := spool.New(ut.spoolDir, ut.spoolThreshold)
+    w, err := compression.NewWriter(contentEncoding, out)
+    if err == nil {
+        if spooled != nil {
+            var reader io.ReadCloser
+            if reader, err = spooled.Reader(); err == nil {
+                _, err = io.Copy(w, reader)
+                reader.Close()
             }
         } else {
-            log.Printf("Database error: %v", err)
-        }
-        return ""
-    }
-    
-    var cardBytes []byte
-    
-    if ut.useKEKDEK && ut.keyManager != nil && keyID.Valid && keyID.String != "" {
-        // Use KEK/DEK decryption
-        cardBytes, err = ut.keyManager.DecryptData(encryptedCard, keyID.String)
-        if err != nil {
-            log.Printf("Failed to decrypt card with KEK/DEK for token %s: %v", token, err)
-            return ""
+            _, err = w.Write(body)
         }
-    } else {
-        // Use legacy Fernet decryption
-        cardBytes = fernet.VerifyAndDecrypt(encryptedCard, 0, []*fernet.Key{ut.encryptionKey})
-        if cardBytes == nil {
-            log.Printf("Failed to decrypt card for token %s", token)
-            return ""
+        if closeErr := w.Close(); err == nil {
+            err = closeErr
         }
     }
-    
-    _, _ = ut.db.Exec(`
-        INSERT INTO token_requests (token, request_type, source_ip, destination_url, response_status)
-        VALUES (?, 'detokenize', '127.0.0.1', '', 200)
-    `, token)
-    
-    return string(cardBytes)
-}
-
-// API Handlers
-func (ut *UnifiedTokenizer) handleAPIHealth(w http.ResponseWriter, r *http.Request) {
-    w.Header().Set("Content-Type", "application/json")
-    json.NewEncoder(w).Encode(map[string]string{"status": "healthy"})
+    if err != nil {
+        out.Close()
+        return nil, err
+    }
+    return out, nil
 }
 
-func (ut *UnifiedTokenizer) authenticateAPIRequest(r *http.Request) bool {
-    apiKey := r.Header.Get("X-API-Key")
-    if apiKey == "" {
-        return false
+// bodyCharset returns the character set of a buffered body, from its
+// Content-Type or its first bytes
+func bodyCharset(contentType string, buffer *spool.Buffer) (charset.Encoding, error) {
+    head := make([]byte, 4)
+    reader, err := buffer.Reader()
+    if err != nil {
+        return charset.Encoding{}, err
     }
-    
-    var count int
-    err := ut.db.QueryRow(`
-        SELECT COUNT(*) FROM api_keys 
-        WHERE api_key = ? AND is_active = TRUE
-    `, apiKey).Scan(&count)
-    
-    return err == nil && count > 0
+    n, _ := io.ReadFull(reader, head)
+    reader.Close()
+    return charset.Detect(contentType, head[:n])
 }
 
-func (ut *UnifiedTokenizer) handleAPIListTokens(w http.ResponseWriter, r *http.Request) {
-    // Permission check is handled by requirePermission middleware
-    
-    // Parse query parameters
-    limitStr := r.URL.Query().Get("limit")
-    offsetStr := r.URL.Query().Get("offset")
-    
-    limit := 100 // default
-    if limitStr != "" {
-        if l, err := strconv.Atoi(limitStr); err == nil && l > 0 && l <= 1000 {
-            limit = l
+// copyResponseHeaders copies the application's response headers to the
+// client, except those for the upstream connection only, keeping the
+// request ID the proxy already set
+func (ut *UnifiedTokenizer) copyResponseHeaders(w http.ResponseWriter, resp *http.Response) {
+    forward.RemoveHopHeaders(resp.Header)
+    ut.forwarding.Response(resp.Header, resp.ProtoMajor, resp.ProtoMinor)
+    for key, values := range resp.Header {
+        if http.CanonicalHeaderKey(key) == http.CanonicalHeaderKey(apierror.RequestIDHeader) && w.Header().Get(key) != "" {
+            continue
         }
-    }
-    
-    offset := 0 // default
-    if offsetStr != "" {
-        if o, err := strconv.Atoi(offsetStr); err == nil && o >= 0 {
-            offset = o
+        for _, value := range values {
+            w.Header().Add(key, value)
         }
     }
+}
+
+// rejectBody answers 413 for a proxied request body over its limit
+func (ut *UnifiedTokenizer) rejectBody(w http.ResponseWriter, r *http.Request, limit int64) {
+    atomic.AddInt64(&ut.bodiesRejected, 1)
+    log.Printf("Rejected %s %s: request body exceeds %d bytes", r.Method, r.URL.Path, limit)
+    http.Error(w, "Request body too large", http.StatusRequestEntityTooLarge)
+}
+
+// handleTokenize forwards a request to the application with card numbers
+// in its body tokenized, and detokenizes the response for the pages that
+// show cards. It runs behind proxyHandler's middleware, which enforces the
+// body limit.
+func (ut *UnifiedTokenizer) handleTokenize(w http.ResponseWriter, r *http.Request) {
+    path := r.URL.Path
     
-    // Get total count
-    var total int
-    err := ut.db.QueryRow("SELECT COUNT(*) FROM credit_cards").Scan(&total)
-    if err != nil {
-        w.WriteHeader(http.StatusInternalServerError)
-        json.NewEncoder(w).Encode(map[string]string{"error": "Database error"})
-        return
-    }
-    
-    // Get tokens with pagination
-    rows, err := ut.db.Query(`
-        SELECT token, card_type, last_four_digits, first_six_digits, 
-               created_at, is_active
-        FROM credit_cards
-        ORDER BY created_at DESC
-        LIMIT ? OFFSET ?
-    `, limit, offset)
-    if err != nil {
-        w.WriteHeader(http.StatusInternalServerError)
-        json.NewEncoder(w).Encode(map[string]string{"error": "Internal server error"})
-        return
+    if ut.debug {
+        log.Printf("=== INCOMING REQUEST: %s %s ===", r.Method, path)
+        log.Printf("Headers: %v", r.Header)
     }
-    defer rows.Close()
+    maxBody := ut.bodyLimits.maxFor(path)
     
-    tokens := []map[string]interface{}{}
-    for rows.Next() {
-        var token, cardType, lastFour, firstSix string
-        var createdAt sql.NullTime
-        var isActive bool
-        
-        var cardTypeNull sql.NullString
-        if err := rows.Scan(&token, &cardTypeNull, &lastFour, &firstSix, &createdAt, &isActive); err != nil {
-            log.Printf("Error scanning row: %v", err)
-            continue
+    // Passthrough requests are forwarded as they arrive, without being
+    // buffered or scanned for card numbers
+    var processedBody []byte
+    var spooled *spool.Buffer // Set instead of processedBody for bodies spilled to disk
+    contentType := r.Header.Get("Content-Type")
+    streamRequest := ut.passthrough.matches(path, contentType)
+    
+    if !streamRequest {
+        // Read body, spilling large ones to disk
+        buffer := spool.New(ut.spoolDir, ut.spoolThreshold)
+        defer buffer.Close()
+        _, err := io.Copy(buffer, r.Body)
+        var tooLarge *http.MaxBytesError
+        if errors.As(err, &tooLarge) {
+            ut.rejectBody(w, r, maxBody)
+            return
         }
+        if err != nil {
+            log.Printf("Error reading body: %v", err)
+            http.Error(w, "Error reading request", http.StatusBadRequest)
+            return
+        }
+        r.Body.Close()
         
-        if cardTypeNull.Valid {
-            cardType = cardTypeNull.String
+        // A compressed JSON body is decoded to be tokenized and encoded
+        // again afterwards. One that cannot be decoded is refused rather
+        // than forwarded with card numbers nobody could see.
+        raw := buffer
+        contentEncoding := r.Header.Get("Content-Encoding")
+        compressed := strings.Contains(contentType, "application/json") && compression.Encoded(contentEncoding)
+        if compressed {
+            decoded := spool.New(ut.spoolDir, ut.spoolThreshold)
+            defer decoded.Close()
+            reader, err := raw.Reader()
+            if err == nil {
+                err = compression.Copy(decoded, contentEncoding, reader, maxBody)
+                reader.Close()
+            }
+            var unsupported *compression.UnsupportedError
+            switch {
+            case errors.As(err, &unsupported):
+                log.Printf("Rejected %s %s: %v", r.Method, path, err)
+                http.Error(w, "Unsupported Content-Encoding", http.StatusUnsupportedMediaType)
+                return
+            case errors.Is(err, compression.ErrTooLarge):
+                ut.rejectBody(w, r, maxBody)
+                return
+            case err != nil:
+                log.Printf("Error decoding %s request body: %v", contentEncoding, err)
+                http.Error(w, "Error reading request", http.StatusBadRequest)
+                return
+            }
+            atomic.AddInt64(&ut.bodiesDecoded, 1)
+            buffer = decoded
         }
+        body := buffer.Bytes()
+        bodyModified := false
         
-        tokenData := map[string]interface{}{
-            "token":      token,
-            "card_type":  cardType,
-            "last_four":  lastFour,
-            "first_six":  firstSix,
-            "is_active":  isActive,
+        // A JSON body in another character set is converted to UTF-8 to be
+        // tokenized and back afterwards. One in a charset we cannot convert
+        // is refused for the same reason as an unknown coding.
+        bodyEncoding := charset.Encoding{Name: charset.UTF8}
+        if strings.Contains(contentType, "application/json") {
+            bodyEncoding, err = bodyCharset(contentType, buffer)
+            var unsupported *charset.UnsupportedError
+            if errors.As(err, &unsupported) {
+                log.Printf("Rejected %s %s: %v", r.Method, path, err)
+                http.Error(w, "Unsupported charset", http.StatusUnsupportedMediaType)
+                return
+            } else if err != nil {
+                log.Printf("Error reading buffered body: %v", err)
+                http.Error(w, "Error reading request", http.StatusInternalServerError)
+                return
+            }
+            if !bodyEncoding.Native() {
+                atomic.AddInt64(&ut.bodiesTranscoded, 1)
+            }
         }
         
-        if createdAt.Valid {
-            tokenData["created_at"] = createdAt.Time.Format(time.RFC3339)
+        // Paths that should never see card numbers refuse or flag them
+        // before anything is tokenized
+        if !ut.applyCardPolicy(w, r, buffer, bodyEncoding) {
+            return
         }
         
-        tokens = append(tokens, tokenData)
-    }
-    
-    w.Header().Set("Content-Type", "application/json")
-    json.NewEncoder(w).Encode(map[string]interface{}{
-        "tokens": tokens,
-        "total":  total,
-    })
-}
-
-func (ut *UnifiedTokenizer) handleAPIGetToken(w http.ResponseWriter, r *http.Request) {
-    // Permission check is handled by requirePermission middleware
-    
-    // Extract token from URL path
-    token := strings.TrimPrefix(r.URL.Path, "/api/v1/tokens/")
-    if token == "" {
-        w.WriteHeader(http.StatusBadRequest)
-        json.NewEncoder(w).Encode(map[string]string{"error": "Token required"})
-        return
-    }
-    
-    var cardType, lastFour, firstSix string
-    var createdAt sql.NullTime
-    var isActive bool
-    var cardTypeNull sql.NullString
-    
-    err := ut.db.QueryRow(`
-        SELECT card_type, last_four_digits, first_six_digits, 
-               created_at, is_active
-        FROM credit_cards
-        WHERE token = ?
-    `, token).Scan(&cardTypeNull, &lastFour, &firstSix, &createdAt, &isActive)
-    
-    if err == sql.ErrNoRows {
-        w.WriteHeader(http.StatusNotFound)
-        json.NewEncoder(w).Encode(map[string]string{"error": "Token not found"})
-        return
-    } else if err != nil {
-        w.WriteHeader(http.StatusInternalServerError)
-        json.NewEncoder(w).Encode(map[string]string{"error": "Internal server error"})
-        return
+        // Process body for tokenization
+        if buffer.Spilled() {
+            atomic.AddInt64(&ut.bodiesSpooled, 1)
+            spooled = buffer
+            if strings.Contains(contentType, "application/json") {
+                tokenized := spool.New(ut.spoolDir, ut.spoolThreshold)
+                defer tokenized.Close()
+                modified, err := ut.tokenizeSpooledJSON(tokenized, buffer, bodyEncoding, ut.cardFieldsFor(path))
+                if err != nil {
+                    log.Printf("Error tokenizing JSON: %v", err)
+                } else {
+                    spooled = tokenized
+                    bodyModified = modified
+                    if modified && ut.debug {
+                        log.Printf("Tokenized request body of %d bytes", buffer.Len())
+                    }
+                }
+            }
+        } else if strings.Contains(contentType, "application/json") && len(body) > 0 && !bodyEncoding.Native() {
+            processedBody = body
+            text, err := bodyEncoding.Decode(body)
+            if err == nil {
+                var modified bool
+                if text, modified, err = ut.tokenizeJSON(text, ut.cardFieldsFor(path)); err == nil && modified {
+                    var encoded []byte
+                    if encoded, err = bodyEncoding.Encode(text); err == nil {
+                        processedBody, bodyModified = encoded, true
+                    }
+                }
+            }
+            if err != nil {
+                log.Printf("Error tokenizing %s JSON: %v", bodyEncoding.Name, err)
+            } else if bodyModified && ut.debug {
+                log.Printf("Tokenized %s request body", bodyEncoding.Name)
+            }
+        } else if strings.Contains(contentType, "application/json") && len(body) > 0 {
+            tokenized, modified, err := ut.tokenizeJSON(string(body), ut.cardFieldsFor(path))
+            if err != nil {
+                log.Printf("Error tokenizing JSON: %v", err)
+                processedBody = body
+            } else {
+                processedBody = []byte(tokenized)
+                bodyModified = modified
+                if modified && ut.debug {
+                    log.Printf("Tokenized request body")
+                }
+            }
+        } else {
+            processedBody = body
+        }
+        
+        // Encode a tokenized body as it came; an unchanged one is sent as
+        // received
+        if compressed {
+            out := raw
+            if bodyModified {
+                encoded, err := ut.encodeBody(contentEncoding, processedBody, spooled)
+                if err != nil {
+                    log.Printf("Error encoding %s request body: %v", contentEncoding, err)
+                    http.Error(w, "Error reading request", http.StatusInternalServerError)
+                    return
+                }
+                defer encoded.Close()
+                out = encoded
+            }
+            processedBody, spooled = nil, nil
+            if out.Spilled() {
+                spooled = out
+            } else {
+                processedBody = out.Bytes()
+            }
+        }
     }
     
-    if cardTypeNull.Valid {
-        cardType = cardTypeNull.String
+    // Build forward URL
+    forwardURL := ut.appEndpoint
+    if path != "" && path != "/" {
+        forwardURL = strings.TrimRight(ut.appEndpoint, "/") + path
     }
     
-    result := map[string]interface{}{
-        "token":      token,
-        "card_type":  cardType,
-        "last_four":  lastFour,
-        "first_six":  firstSix,
-        "is_active":  isActive,
+    if r.URL.RawQuery != "" {
+        forwardURL += "?" + r.URL.RawQuery
     }
     
-    if createdAt.Valid {
-        result["created_at"] = createdAt.Time.Format(time.RFC3339)
+    // Create new request; a buffered body can be replayed for retries, a
+    // streamed one is sent once
+    var forwardBody io.Reader = bytes.NewReader(processedBody)
+    bodyLength := int64(len(processedBody))
+    if streamRequest {
+        forwardBody = r.Body
+        atomic.AddInt64(&ut.passthroughRequests, 1)
+    } else if spooled != nil {
+        reader, err := spooled.Reader()
+        if err != nil {
+            log.Printf("Error reading buffered body: %v", err)
+            http.Error(w, "Error reading request", http.StatusInternalServerError)
+            return
+        }
+        forwardBody, bodyLength = reader, spooled.Len()
     }
-    
-    w.Header().Set("Content-Type", "application/json")
-    json.NewEncoder(w).Encode(result)
-}
-
-func (ut *UnifiedTokenizer) handleAPIRevokeToken(w http.ResponseWriter, r *http.Request) {
-    // Permission check is handled by requirePermission middleware
-    
-    token := strings.TrimPrefix(r.URL.Path, "/api/v1/tokens/")
-    
-    result, err := ut.db.Exec(`
-        UPDATE credit_cards 
-        SET is_active = FALSE 
-        WHERE token = ?
-    `, token)
-    
+    req, err := http.NewRequestWithContext(r.Context(), r.Method, forwardURL, forwardBody)
     if err != nil {
-        w.WriteHeader(http.StatusInternalServerError)
-        json.NewEncoder(w).Encode(map[string]string{"error": "Internal server error"})
+        log.Printf("Error creating forward request: %v", err)
+        http.Error(w, "Error creating request", http.StatusInternalServerError)
         return
     }
-    
-    rowsAffected, _ := result.RowsAffected()
-    if rowsAffected == 0 {
-        w.WriteHeader(http.StatusNotFound)
-        json.NewEncoder(w).Encode(map[string]string{"error": "Token not found"})
-        return
+    if spooled != nil {
+        req.GetBody = spooled.Reader
     }
     
-    w.Header().Set("Content-Type", "application/json")
-    json.NewEncoder(w).Encode(map[string]string{"message": "Token revoked successfully"})
-}
-
-func (ut *UnifiedTokenizer) handleAPIStats(w http.ResponseWriter, r *http.Request) {
-    // Permission check is handled by requirePermission middleware
-    
-    // Get active token count
-    var activeTokens int
-    ut.db.QueryRow("SELECT COUNT(*) FROM credit_cards WHERE is_active = TRUE").Scan(&activeTokens)
-    
-    // Get request stats
-    rows, err := ut.db.Query(`
-        SELECT request_type, COUNT(*) as count
-        FROM token_requests
-        WHERE request_timestamp >= DATE_SUB(NOW(), INTERVAL 24 HOUR)
-        GROUP BY request_type
-    `)
-    
-    requestStats := make(map[string]int)
-    if err == nil {
-        defer rows.Close()
-        for rows.Next() {
-            var reqType string
-            var count int
-            if err := rows.Scan(&reqType, &count); err == nil {
-                requestStats[reqType] = count
-            }
+    // Copy headers, except those for this connection only, and tell the
+    // application who the client is
+    for key, values := range r.Header {
+        for _, value := range values {
+            req.Header.Add(key, value)
         }
     }
+    forward.RemoveHopHeaders(req.Header)
+    ut.forwarding.Request(req.Header, r)
     
-    w.Header().Set("Content-Type", "application/json")
-    json.NewEncoder(w).Encode(map[string]interface{}{
-        "active_tokens": activeTokens,
-        "requests_24h":  requestStats,
-    })
-}
-
-// Additional API endpoints for GUI/CLI
-
-func (ut *UnifiedTokenizer) handleCreateAPIKey(w http.ResponseWriter, r *http.Request) {
-    // Get user ID from request context (set by requirePermission middleware)
-    userID := r.Header.Get("X-User-ID")
-    if userID == "" {
-        w.WriteHeader(http.StatusInternalServerError)
-        json.NewEncoder(w).Encode(map[string]string{"error": "User context not found"})
-        return
+    // Responses that will be detokenized must come in a coding we can
+    // decode
+    if detokenizesResponses(path) && req.Header.Get("Accept-Encoding") != "" {
+        if accept := compression.AcceptEncoding(req.Header.Get("Accept-Encoding")); accept != "" {
+            req.Header.Set("Accept-Encoding", accept)
+        } else {
+            req.Header.Del("Accept-Encoding")
+        }
     }
     
-    var req struct {
-        ClientName  string   `json:"client_name"`
-        Permissions []string `json:"permissions,omitempty"`
+    // Update Content-Length
+    if streamRequest {
+        req.ContentLength = r.ContentLength
+    } else {
+        req.ContentLength = bodyLength
+        req.Header.Set("Content-Length", strconv.FormatInt(bodyLength, 10))
     }
     
-    if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-        w.WriteHeader(http.StatusBadRequest)
-        json.NewEncoder(w).Encode(map[string]string{"error": "Invalid request body"})
+    // Forward request. While the application is failing or saturated the
+    // request is refused at once rather than waiting for UPSTREAM_TIMEOUT.
+    resp, err := ut.upstream.Do(req)
+    var unavailable *upstream.UnavailableError
+    if errors.As(err, &unavailable) {
+        if ut.debug {
+            log.Printf("DEBUG: %v", err)
+        }
+        w.Header().Set("Retry-After", strconv.Itoa(unavailable.RetryAfterSeconds()))
+        http.Error(w, "Upstream unavailable", http.StatusServiceUnavailable)
         return
     }
-    
-    if req.ClientName == "" {
-        w.WriteHeader(http.StatusBadRequest)
-        json.NewEncoder(w).Encode(map[string]string{"error": "client_name is required"})
+    var tooLarge *http.MaxBytesError
+    if errors.As(err, &tooLarge) {
+        ut.rejectBody(w, r, maxBody)
         return
     }
-    
-    // Generate API key
-    apiKey := "ts_" + generateRandomID()
-    secretHash := "hash_" + generateRandomID() // In production, use proper hashing
-    
-    permissions, _ := json.Marshal(req.Permissions)
-    
-    _, err := ut.db.Exec(`
-        INSERT INTO api_keys (api_key, api_secret_hash, client_name, permissions, is_active, user_id, created_by)
-        VALUES (?, ?, ?, ?, TRUE, ?, ?)
-    `, apiKey, secretHash, req.ClientName, permissions, userID, userID)
-    
     if err != nil {
-        w.WriteHeader(http.StatusInternalServerError)
-        json.NewEncoder(w).Encode(map[string]string{"error": "Failed to create API key"})
+        log.Printf("Error forwarding request: %v", err)
+        http.Error(w, "Error forwarding request", http.StatusBadGateway)
         return
     }
+    defer resp.Body.Close()
     
-    w.Header().Set("Content-Type", "application/json")
-    json.NewEncoder(w).Encode(map[string]interface{}{
-        "api_key":     apiKey,
-        "client_name": req.ClientName,
-        "permissions": req.Permissions,
-        "created_at":  time.Now().Format(time.RFC3339),
-    })
-}
-
-func (ut *UnifiedTokenizer) handleListAPIKeys(w http.ResponseWriter, r *http.Request) {
-    // Permission check is handled by requirePermission middleware
-    
-    rows, err := ut.db.Query(`
-        SELECT api_key, client_name, permissions, is_active, created_at, last_used_at
-        FROM api_keys
-        ORDER BY created_at DESC
-    `)
+    // Check if this is an endpoint that needs response detokenization.
+    // Everything else is streamed to the client as it arrives.
+    respContentType := resp.Header.Get("Content-Type")
+    needsDetokenization := detokenizesResponses(path) && resp.StatusCode == 200 &&
+        (strings.Contains(respContentType, "application/json") || strings.Contains(respContentType, "text/html")) &&
+        !ut.passthrough.matches(path, respContentType)
+    
+    if !needsDetokenization {
+        ut.copyResponseHeaders(w, resp)
+        w.WriteHeader(resp.StatusCode)
+        if _, err := io.Copy(w, resp.Body); err != nil && ut.debug {
+            log.Printf("DEBUG: Streaming response for %s stopped: %v", path, err)
+        }
+        atomic.AddInt64(&ut.passthroughResponses, 1)
+        return
+    }
     
+    // Read response body
+    respBody, err := io.ReadAll(resp.Body)
     if err != nil {
-        w.WriteHeader(http.StatusInternalServerError)
-        json.NewEncoder(w).Encode(map[string]string{"error": "Database error"})
+        log.Printf("Error reading response body: %v", err)
+        http.Error(w, "Error reading response", http.StatusInternalServerError)
         return
     }
-    defer rows.Close()
     
-    var apiKeys []map[string]interface{}
-    
-    for rows.Next() {
-        var apiKey, clientName string
-        var permissions sql.NullString
-        var isActive bool
-        var createdAt time.Time
-        var lastUsedAt sql.NullTime
-        
-        err := rows.Scan(&apiKey, &clientName, &permissions, &isActive, &createdAt, &lastUsedAt)
+    // A compressed response is decoded to be detokenized and encoded again
+    // afterwards. One in a coding we cannot decode is passed on as it is.
+    encodedRespBody := respBody
+    respEncoding := resp.Header.Get("Content-Encoding")
+    if compression.Encoded(respEncoding) {
+        decoded, err := compression.Decode(respEncoding, respBody, maxDecodedResponse)
         if err != nil {
-            continue
-        }
-        
-        keyInfo := map[string]interface{}{
-            "api_key":     apiKey,
-            "client_name": clientName,
-            "is_active":   isActive,
-            "created_at":  createdAt.Format(time.RFC3339),
-        }
-        
-        if permissions.Valid {
-            var perms []string
-            json.Unmarshal([]byte(permissions.String), &perms)
-            keyInfo["permissions"] = perms
-        }
-        
-        if lastUsedAt.Valid {
-            keyInfo["last_used_at"] = lastUsedAt.Time.Format(time.RFC3339)
+            log.Printf("Response for %s not detokenized: %v", path, err)
+            ut.copyResponseHeaders(w, resp)
+            w.WriteHeader(resp.StatusCode)
+            w.Write(respBody)
+            return
         }
-        
-        apiKeys = append(apiKeys, keyInfo)
+        atomic.AddInt64(&ut.responsesDecoded, 1)
+        respBody = decoded
     }
     
-    w.Header().Set("Content-Type", "application/json")
-    json.NewEncoder(w).Encode(map[string]interface{}{
-        "api_keys": apiKeys,
-        "total":    len(apiKeys),
-    })
-}
-
-func (ut *UnifiedTokenizer) handleRevokeAPIKey(w http.ResponseWriter, r *http.Request) {
-    // Permission check is handled by requirePermission middleware
-    
-    apiKey := strings.TrimPrefix(r.URL.Path, "/api/v1/api-keys/")
+    // A response in another character set is converted to UTF-8 to be
+    // detokenized. One in a charset we cannot convert is passed on as it is.
+    respText := string(respBody)
+    respCharset, err := charset.Detect(respContentType, respBody)
+    if err == nil && !respCharset.Native() {
+        if respText, err = respCharset.Decode(respBody); err == nil {
+            atomic.AddInt64(&ut.responsesTranscoded, 1)
+        }
+    }
     
-    result, err := ut.db.Exec(`
-        UPDATE api_keys SET is_active = FALSE WHERE api_key = ?
-    `, apiKey)
+    processedRespBody := respBody
+    if ut.debug {
+        log.Printf("DEBUG: Response content type: %s", respContentType)
+        log.Printf("DEBUG: Response body preview: %s", respText[:utils.Min(200, len(respText))])
+    }
     
+    var detokenized string
+    modified := false
     if err != nil {
-        w.WriteHeader(http.StatusInternalServerError)
-        json.NewEncoder(w).Encode(map[string]string{"error": "Database error"})
-        return
+        log.Printf("Response for %s not detokenized: %v", path, err)
+    } else if strings.Contains(respContentType, "application/json") {
+        // Handle JSON responses (API)
+        detokenized, modified, err = ut.detokenizeJSON(respText)
+        if err != nil {
+            log.Printf("Error detokenizing JSON response: %v", err)
+        } else if modified {
+            log.Printf("Detokenized JSON response body for %s", path)
+        } else if ut.debug {
+            log.Printf("DEBUG: No tokens found to detokenize in JSON response")
+        }
+    } else if strings.Contains(respContentType, "text/html") {
+        // Handle HTML responses (web pages)
+        detokenized, modified, err = ut.detokenizeHTML(respText)
+        if err != nil {
+            log.Printf("Error detokenizing HTML response: %v", err)
+        } else if modified {
+            log.Printf("Detokenized HTML response body for %s", path)
+        } else if ut.debug {
+            log.Printf("DEBUG: No tokens found to detokenize in HTML response")
+        }
     }
-    
-    rowsAffected, _ := result.RowsAffected()
-    if rowsAffected == 0 {
-        w.WriteHeader(http.StatusNotFound)
-        json.NewEncoder(w).Encode(map[string]string{"error": "API key not found"})
-        return
+    if modified {
+        processedRespBody = []byte(detokenized)
+        if !respCharset.Native() {
+            encoded, err := respCharset.Encode(detokenized)
+            if err != nil {
+                log.Printf("Error encoding %s response for %s: %v", respCharset.Name, path, err)
+                http.Error(w, "Error reading response", http.StatusInternalServerError)
+                return
+            }
+            processedRespBody = encoded
+        }
     }
     
-    w.Header().Set("Content-Type", "application/json")
-    json.NewEncoder(w).Encode(map[string]string{"message": "API key revoked successfully"})
-}
-
-func (ut *UnifiedTokenizer) handleGetActivity(w http.ResponseWriter, r *http.Request) {
-    // Permission check is handled by requirePermission middleware
-    
-    // Get query parameters
-    limit := 50
-    if l := r.URL.Query().Get("limit"); l != "" {
-        if parsed, err := strconv.Atoi(l); err == nil && parsed > 0 && parsed <= 1000 {
-            limit = parsed
+    if compression.Encoded(respEncoding) {
+        if !bytes.Equal(processedRespBody, respBody) {
+            encoded, err := compression.Encode(respEncoding, processedRespBody)
+            if err != nil {
+                log.Printf("Error encoding %s response for %s: %v", respEncoding, path, err)
+                http.Error(w, "Error reading response", http.StatusInternalServerError)
+                return
+            }
+            processedRespBody = encoded
+        } else {
+            processedRespBody = encodedRespBody
         }
     }
     
-    rows, err := ut.db.Query(`
-        SELECT tr.id, tr.token, tr.request_type, tr.source_ip, tr.destination_url, 
-               tr.request_timestamp, tr.response_status, cc.last_four_digits
-        FROM token_requests tr
-        LEFT JOIN credit_cards cc ON tr.token = cc.token
-        ORDER BY tr.request_timestamp DESC
-        LIMIT ?
-    `, limit)
+    // Copy response headers
+    ut.copyResponseHeaders(w, resp)
     
-    if err != nil {
-        w.WriteHeader(http.StatusInternalServerError)
-        json.NewEncoder(w).Encode(map[string]string{"error": "Database error"})
-        return
-    }
-    defer rows.Close()
+    // Set correct content length
+    w.Header().Set("Content-Length", strconv.Itoa(len(processedRespBody)))
     
-    var activities []map[string]interface{}
+    // Set status code
+    w.WriteHeader(resp.StatusCode)
     
-    for rows.Next() {
-        var id int
-        var token, requestType, sourceIP, destinationURL string
-        var requestTimestamp time.Time
-        var responseStatus sql.NullInt64
-        var lastFour sql.NullString
+    // Write response body
+    w.Write(processedRespBody)
+}
+
+
+
+
+
+
+
+
+
+
+
+
+
+// calculateLuhnCheckDigit calculates the Luhn check digit for a given number
+func calculateLuhnCheckDigit(number string) int {
+    sum := 0
+    // The check digit will be appended, so the last digit here is doubled
+    alternate := true
+    
+    // Process from right to left
+    for i := len(number) - 1; i >= 0; i-- {
+        digit := int(number[i] - '0')
         
-        err := rows.Scan(&id, &token, &requestType, &sourceIP, &destinationURL, 
-                        &requestTimestamp, &responseStatus, &lastFour)
-        if err != nil {
-            continue
+        if alternate {
+            digit *= 2
+            if digit > 9 {
+                digit = (digit % 10) + 1
+            }
         }
         
-        activity := map[string]interface{}{
-            "id":          id,
-            "token":       token,
-            "type":        requestType,
-            "source_ip":   sourceIP,
-            "destination": destinationURL,
-            "timestamp":   requestTimestamp.Format(time.RFC3339),
+        sum += digit
+        alternate = !alternate
+    }
+    
+    return (10 - (sum % 10)) % 10
+}
+
+
+// Detect card type based on card number
+func DetectCardType(cardNumber string) string {
+    if len(cardNumber) < 4 {
+        return "Unknown"
+    }
+    
+    // Remove any spaces or dashes
+    cardNumber = strings.ReplaceAll(strings.ReplaceAll(cardNumber, " ", ""), "-", "")
+    
+    // Visa: starts with 4
+    if strings.HasPrefix(cardNumber, "4") && (len(cardNumber) == 13 || len(cardNumber) == 16 || len(cardNumber) == 19) {
+        return "Visa"
+    }
+    
+    // Mastercard: starts with 5 (51-55) or 2 (2221-2720)
+    if len(cardNumber) >= 2 {
+        prefix2 := cardNumber[:2]
+        if (prefix2 >= "51" && prefix2 <= "55") || (prefix2 >= "22" && prefix2 <= "27") {
+            if len(cardNumber) == 16 {
+                return "Mastercard"
+            }
+        }
+    }
+    
+    // American Express: starts with 34 or 37
+    if len(cardNumber) >= 2 {
+        prefix2 := cardNumber[:2]
+        if (prefix2 == "34" || prefix2 == "37") && len(cardNumber) == 15 {
+            return "Amex"
         }
+    }
+    
+    // Discover: starts with 6011, 622126-622925, 644-649, or 65
+    if len(cardNumber) >= 4 {
+        prefix4 := cardNumber[:4]
+        prefix2 := cardNumber[:2]
+        prefix3 := cardNumber[:3]
         
-        if responseStatus.Valid {
-            activity["status"] = responseStatus.Int64
+        if prefix4 == "6011" || prefix2 == "65" {
+            if len(cardNumber) == 16 {
+                return "Discover"
+            }
         }
         
-        if lastFour.Valid {
-            activity["card_last_four"] = lastFour.String
+        if len(cardNumber) >= 6 {
+            prefix6 := cardNumber[:6]
+            if prefix6 >= "622126" && prefix6 <= "622925" {
+                return "Discover"
+            }
         }
         
-        activities = append(activities, activity)
+        if prefix3 >= "644" && prefix3 <= "649" {
+            if len(cardNumber) == 16 {
+                return "Discover"
+            }
+        }
     }
     
-    w.Header().Set("Content-Type", "application/json")
-    json.NewEncoder(w).Encode(map[string]interface{}{
-        "activities": activities,
-        "total":      len(activities),
-    })
+    return "Unknown"
 }
 
-func (ut *UnifiedTokenizer) handleSearchTokens(w http.ResponseWriter, r *http.Request) {
-    // Permission check is handled by requirePermission middleware
+// isValidLuhn validates a card number using the Luhn algorithm
+func IsValidLuhn(cardNumber string) bool {
+    // Remove spaces and dashes
+    cardNumber = strings.ReplaceAll(strings.ReplaceAll(cardNumber, " ", ""), "-", "")
     
-    var req struct {
-        LastFour  string `json:"lastFour,omitempty"`
-        CardType  string `json:"cardType,omitempty"`
-        DateFrom  string `json:"date_from,omitempty"`
-        DateTo    string `json:"date_to,omitempty"`
-        IsActive  *bool  `json:"active,omitempty"`
-        Limit     int    `json:"limit,omitempty"`
+    if len(cardNumber) == 0 {
+        return false
     }
     
-    if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-        w.WriteHeader(http.StatusBadRequest)
-        json.NewEncoder(w).Encode(map[string]string{"error": "Invalid request body"})
-        return
+    sum := 0
+    alternate := false
+    
+    // Process from right to left
+    for i := len(cardNumber) - 1; i >= 0; i-- {
+        digit := int(cardNumber[i] - '0')
+        if digit < 0 || digit > 9 {
+            return false
+        }
+        
+        if alternate {
+            digit *= 2
+            if digit > 9 {
+                digit = digit%10 + digit/10
+            }
+        }
+        
+        sum += digit
+        alternate = !alternate
     }
     
-    if req.Limit <= 0 || req.Limit > 1000 {
-        req.Limit = 100
+    return sum%10 == 0
+}
+
+
+
+// StorageInterface implementation for tokenizer package
+func (ut *UnifiedTokenizer) StoreCard(token, cardNumber string) error {
+    return ut.storeCard(token, cardNumber, cardDetails{})
+}
+
+func (ut *UnifiedTokenizer) RetrieveCard(token string) string {
+    return ut.retrieveCard(token)
+}
+
+// ICAP Handler interface implementation - delegate to tokenizer package.
+// ICAP messages carry no proxy path, so the default field names apply.
+func (ut *UnifiedTokenizer) TokenizeJSON(jsonStr string) (string, bool, error) {
+    return ut.tokenizeJSON(jsonStr, &defaultCardFields)
+}
+
+// tokenizeJSON tokenizes card numbers in jsonStr, storing the expiry and
+// cardholder values that fields finds next to each one
+func (ut *UnifiedTokenizer) tokenizeJSON(jsonStr string, fields *cardFields) (string, bool, error) {
+    var data interface{}
+    if err := json.Unmarshal([]byte(jsonStr), &data); err != nil {
+        return jsonStr, false, err
     }
     
-    // Build dynamic query conditions
-    whereClause := "WHERE 1=1"
-    args := []interface{}{}
+    modified := false
+    ut.processValue(&data, &modified, true, fields) // true for tokenization
     
-    if req.LastFour != "" {
-        whereClause += " AND last_four_digits = ?"
-        args = append(args, req.LastFour)
+    result, err := json.Marshal(data)
+    if err != nil {
+        return jsonStr, false, err
     }
     
-    if req.CardType != "" {
-        whereClause += " AND card_type = ?"
-        args = append(args, req.CardType)
+    return string(result), modified, nil
+}
+
+// tokenizeSpooledJSON tokenizes a JSON body too large to keep in memory
+// as text, writing the result to dst in the body's character set
+func (ut *UnifiedTokenizer) tokenizeSpooledJSON(dst io.Writer, src *spool.Buffer, bodyEncoding charset.Encoding, fields *cardFields) (bool, error) {
+    r, err := src.Reader()
+    if err != nil {
+        return false, err
     }
+    defer r.Close()
     
-    if req.DateFrom != "" {
-        whereClause += " AND created_at >= ?"
-        args = append(args, req.DateFrom)
+    var data interface{}
+    dec := json.NewDecoder(bodyEncoding.NewReader(r))
+    if err := dec.Decode(&data); err != nil {
+        return false, err
+    }
+    if _, err := dec.Token(); err != io.EOF {
+        return false, fmt.Errorf("invalid data after top-level JSON value")
     }
     
-    if req.DateTo != "" {
-        whereClause += " AND created_at <= ?"
-        args = append(args, req.DateTo)
+    modified := false
+    ut.processValue(&data, &modified, true, fields) // true for tokenization
+    w := bodyEncoding.NewWriter(dst)
+    if err := json.NewEncoder(w).Encode(data); err != nil {
+        return false, err
+    }
+    return modified, w.Close()
+}
+
+func (ut *UnifiedTokenizer) DetokenizeJSON(jsonStr string) (string, bool, error) {
+    return ut.detokenizeJSON(jsonStr)
+}
+
+// Original working detokenizeJSON implementation
+func (ut *UnifiedTokenizer) detokenizeJSON(jsonStr string) (string, bool, error) {
+    if ut.debug {
+        log.Printf("DEBUG: detokenizeJSON called with: %s", jsonStr[:utils.Min(200, len(jsonStr))])
     }
     
-    if req.IsActive != nil {
-        whereClause += " AND is_active = ?"
-        args = append(args, *req.IsActive)
+    var data interface{}
+    if err := json.Unmarshal([]byte(jsonStr), &data); err != nil {
+        return jsonStr, false, err
     }
     
-    // Get total count first
-    var total int
-    countQuery := "SELECT COUNT(*) FROM credit_cards " + whereClause
-    err := ut.db.QueryRow(countQuery, args...).Scan(&total)
-    if err != nil {
-        w.WriteHeader(http.StatusInternalServerError)
-        json.NewEncoder(w).Encode(map[string]string{"error": "Database error"})
-        return
+    if ut.debug {
+        log.Printf("DEBUG: Unmarshaled data type: %T", data)
     }
     
-    // Build main query with pagination (create new args slice)
-    query := `SELECT token, card_type, last_four_digits, first_six_digits, 
-                     created_at, is_active FROM credit_cards ` + whereClause + 
-                     " ORDER BY created_at DESC LIMIT ?"
-    queryArgs := append(args, req.Limit)
+    modified := false
+    ut.processValue(&data, &modified, false, nil) // false for detokenization
     
-    rows, err := ut.db.Query(query, queryArgs...)
-    if err != nil {
-        w.WriteHeader(http.StatusInternalServerError)
-        json.NewEncoder(w).Encode(map[string]string{"error": "Database error"})
-        return
+    if ut.debug {
+        log.Printf("DEBUG: detokenizeJSON modified=%v", modified)
     }
-    defer rows.Close()
     
-    var tokens []map[string]interface{}
-    
-    for rows.Next() {
-        var token, lastFour, firstSix string
-        var cardType sql.NullString
-        var createdAt time.Time
-        var isActive bool
-        
-        err := rows.Scan(&token, &cardType, &lastFour, &firstSix, &createdAt, &isActive)
-        if err != nil {
-            continue
-        }
-        
-        tokenInfo := map[string]interface{}{
-            "token":      token,
-            "last_four":  lastFour,
-            "first_six":  firstSix,
-            "created_at": createdAt.Format(time.RFC3339),
-            "is_active":  isActive,
-        }
-        
-        if cardType.Valid {
-            tokenInfo["card_type"] = cardType.String
-        }
-        
-        tokens = append(tokens, tokenInfo)
+    result, err := json.Marshal(data)
+    if err != nil {
+        return jsonStr, false, err
     }
     
-    w.Header().Set("Content-Type", "application/json")
-    json.NewEncoder(w).Encode(map[string]interface{}{
-        "tokens": tokens,
-        "total":  total,
-    })
+    return string(result), modified, nil
 }
 
-func (ut *UnifiedTokenizer) handleGetVersion(w http.ResponseWriter, r *http.Request) {
-    w.Header().Set("Content-Type", "application/json")
-    json.NewEncoder(w).Encode(map[string]interface{}{
-        "version":     "1.0.0-prototype",
-        "build_time":  time.Now().Format(time.RFC3339),
-        "token_format": ut.tokenFormat,
-        "kek_dek_enabled": ut.useKEKDEK,
-        "features": []string{"tokenization", "detokenization", "api", "icap"},
-    })
-}
-
-func (ut *UnifiedTokenizer) startHTTPServer() {
-    http.HandleFunc("/", ut.handleTokenize)
-    
-    log.Printf("Starting HTTP tokenization server on port %s", ut.httpPort)
-    if err := http.ListenAndServe(":"+ut.httpPort, nil); err != nil {
-        log.Fatalf("HTTP server failed: %v", err)
-    }
-}
+// maxDeepScanDepth bounds how many levels of JSON nested in strings are
+// decoded
+const maxDeepScanDepth = 8
 
-// CORS middleware
-func (ut *UnifiedTokenizer) corsMiddleware(next http.Handler) http.Handler {
-    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-        // Set CORS headers
-        w.Header().Set("Access-Control-Allow-Origin", "*")
-        w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
-        w.Header().Set("Access-Control-Allow-Headers", "Content-Type, X-API-Key, X-Admin-Secret, Authorization")
-        w.Header().Set("Access-Control-Max-Age", "3600")
-        
-        // Handle preflight OPTIONS requests
-        if r.Method == "OPTIONS" {
-            w.WriteHeader(http.StatusOK)
-            return
-        }
-        
-        next.ServeHTTP(w, r)
-    })
+// processValue tokenizes or detokenizes card fields in v in place. When
+// tokenizing, fields names the expiry and cardholder siblings to store.
+func (ut *UnifiedTokenizer) processValue(v interface{}, modified *bool, tokenize bool, fields *cardFields) {
+    ut.processNested(v, modified, tokenize, fields, 0)
 }
 
-// Rate limiting middleware for authentication endpoints
-func (ut *UnifiedTokenizer) rateLimitMiddleware(next http.HandlerFunc) http.HandlerFunc {
-    return func(w http.ResponseWriter, r *http.Request) {
-        // Skip rate limiting in test mode
-        if testMode := utils.GetEnv("TEST_MODE", "false"); testMode == "true" {
-            next(w, r)
-            return
-        }
-        
-        // Get client IP
-        clientIP := r.RemoteAddr
-        if forwarded := r.Header.Get("X-Forwarded-For"); forwarded != "" {
-            clientIP = strings.TrimSpace(strings.Split(forwarded, ",")[0])
-        }
-        
-        // Remove port from IP if present
-        if host, _, err := net.SplitHostPort(clientIP); err == nil {
-            clientIP = host
+// processNested is processValue for a value inside depth levels of JSON
+// nested in strings
+func (ut *UnifiedTokenizer) processNested(v interface{}, modified *bool, tokenize bool, fields *cardFields, depth int) {
+    switch val := v.(type) {
+    case *interface{}:
+        if ut.debug && !tokenize {
+            log.Printf("DEBUG: Processing pointer to interface{}")
         }
-        
-        // Check rate limit
-        if !ut.authRateLimiter.IsAllowed(clientIP) {
-            // Log security event for rate limiting
-            ut.logSecurityEvent(SecurityEvent{
-                EventType: "rate_limit_exceeded",
-                Severity:  "medium",
-                IPAddress: clientIP,
-                UserAgent: r.UserAgent(),
-                Endpoint:  r.URL.Path,
-                Details: map[string]interface{}{
-                    "method": r.Method,
-                    "limit": "5 attempts per 15 minutes",
-                },
-            })
-            
-            log.Printf("Rate limit exceeded for IP: %s on endpoint: %s", clientIP, r.URL.Path)
-            w.WriteHeader(http.StatusTooManyRequests)
-            json.NewEncoder(w).Encode(map[string]interface{}{
-                "error": "Rate limit exceeded. Too many authentication attempts. Please try again later.",
-                "retry_after": "15 minutes",
-            })
-            return
+        ut.processNested(*val, modified, tokenize, fields, depth)
+    case map[string]interface{}:
+        if ut.debug && !tokenize {
+            log.Printf("DEBUG: Processing map with keys: %v", ut.getMapKeys(val))
         }
-        
-        next(w, r)
-    }
-}
-
-// Input validation middleware
-func (ut *UnifiedTokenizer) validationMiddleware(endpoint string) func(http.HandlerFunc) http.HandlerFunc {
-    return func(next http.HandlerFunc) http.HandlerFunc {
-        return func(w http.ResponseWriter, r *http.Request) {
-            // Get client IP for logging
-            clientIP := r.RemoteAddr
-            if forwarded := r.Header.Get("X-Forwarded-For"); forwarded != "" {
-                clientIP = strings.TrimSpace(strings.Split(forwarded, ",")[0])
-            }
-            if host, _, err := net.SplitHostPort(clientIP); err == nil {
-                clientIP = host
-            }
-            
-            // Check if we have validation config for this endpoint
-            config, hasConfig := ut.validationConfigs[endpoint]
-            
-            // Check request size limit
-            maxSize := int64(10 * 1024 * 1024) // Default 10MB max
-            if hasConfig && config.MaxRequestSize > 0 {
-                maxSize = config.MaxRequestSize
+        for k, v := range val {
+            if ut.debug && !tokenize {
+                log.Printf("DEBUG: Processing map key '%s' with value type %T", k, v)
             }
-            
-            // Limit request body size
-            r.Body = http.MaxBytesReader(w, r.Body, maxSize)
-            
-            // Check allowed methods
-            if hasConfig && len(config.AllowedMethods) > 0 {
-                allowed := false
-                for _, method := range config.AllowedMethods {
-                    if r.Method == method {
-                        allowed = true
-                        break
+            if tokenize && ut.isCreditCardField(k) {
+                if str, ok := v.(string); ok && ut.scanner.Contains(str, scanner.PAN) {
+                    // Don't tokenize if it's already one of our tokens
+                    if ut.isOwnToken(str) || ut.engines.Owner(str) != "" {
+                        // This is already a token, skip it
+                        continue
+                    }
+                    if token, err := ut.tokenizeField(str, fields, val); err == nil {
+                        val[k] = token
+                        *modified = true
+                        log.Printf("Tokenized card ending in %s", str[len(str)-4:])
                     }
                 }
-                if !allowed {
-                    ut.logSecurityEvent(SecurityEvent{
-                        EventType: "invalid_http_method",
-                        Severity:  "medium",
-                        IPAddress: clientIP,
-                        UserAgent: r.UserAgent(),
-                        Endpoint:  r.URL.Path,
-                        Details: map[string]interface{}{
-                            "method": r.Method,
-                            "allowed_methods": config.AllowedMethods,
-                        },
-                    })
-                    w.WriteHeader(http.StatusMethodNotAllowed)
-                    json.NewEncoder(w).Encode(map[string]string{"error": "Method not allowed"})
-                    return
-                }
-            }
-            
-            // Check Content-Type for requests with body
-            if r.Method == "POST" || r.Method == "PUT" || r.Method == "PATCH" {
-                contentType := r.Header.Get("Content-Type")
-                if !strings.Contains(contentType, "application/json") {
-                    ut.logSecurityEvent(SecurityEvent{
-                        EventType: "invalid_content_type",
-                        Severity:  "low",
-                        IPAddress: clientIP,
-                        UserAgent: r.UserAgent(),
-                        Endpoint:  r.URL.Path,
-                        Details: map[string]interface{}{
-                            "content_type": contentType,
-                            "expected": "application/json",
-                        },
-                    })
-                    w.WriteHeader(http.StatusUnsupportedMediaType)
-                    json.NewEncoder(w).Encode(map[string]string{"error": "Content-Type must be application/json"})
-                    return
-                }
-                
-                // Parse and validate JSON body
-                if hasConfig && len(config.Rules) > 0 {
-                    var requestData map[string]interface{}
-                    
-                    // Read and parse request body
-                    bodyBytes, err := io.ReadAll(r.Body)
-                    if err != nil {
-                        ut.logSecurityEvent(SecurityEvent{
-                            EventType: "request_body_read_error",
-                            Severity:  "medium",
-                            IPAddress: clientIP,
-                            UserAgent: r.UserAgent(),
-                            Endpoint:  r.URL.Path,
-                            Details: map[string]interface{}{
-                                "error": err.Error(),
-                            },
-                        })
-                        w.WriteHeader(http.StatusBadRequest)
-                        json.NewEncoder(w).Encode(map[string]string{"error": "Failed to read request body"})
-                        return
+            } else if !tokenize && ut.isCreditCardField(k) {
+                if str, ok := v.(string); ok {
+                    if ut.debug {
+                        log.Printf("DEBUG: Checking field '%s' with value '%s' for detokenization", k, str)
                     }
-                    
-                    // Restore body for next handler
-                    r.Body = io.NopCloser(bytes.NewBuffer(bodyBytes))
-                    
-                    // Parse JSON
-                    if len(bodyBytes) > 0 {
-                        if err := json.Unmarshal(bodyBytes, &requestData); err != nil {
-                            ut.logSecurityEvent(SecurityEvent{
-                                EventType: "invalid_json",
-                                Severity:  "medium",
-                                IPAddress: clientIP,
-                                UserAgent: r.UserAgent(),
-                                Endpoint:  r.URL.Path,
-                                Details: map[string]interface{}{
-                                    "error": err.Error(),
-                                },
-                            })
-                            w.WriteHeader(http.StatusBadRequest)
-                            json.NewEncoder(w).Encode(map[string]string{"error": "Invalid JSON format"})
-                            return
+                    if ut.tokenRegex.MatchString(str) {
+                        if card := ut.retrieveCard(str); card != "" {
+                            val[k] = card
+                            *modified = true
+                            log.Printf("Detokenized token %s in field %s", str, k)
+                        } else if ut.debug {
+                            log.Printf("DEBUG: Failed to retrieve card for token %s", str)
                         }
-                        
-                        // Validate request data
-                        validationResult := ut.validateRequest(endpoint, requestData)
-                        if !validationResult.Valid {
-                            ut.logSecurityEvent(SecurityEvent{
-                                EventType: "validation_failed",
-                                Severity:  "medium",
-                                IPAddress: clientIP,
-                                UserAgent: r.UserAgent(),
-                                Endpoint:  r.URL.Path,
-                                Details: map[string]interface{}{
-                                    "validation_errors": validationResult.Errors,
-                                    "field_count": len(validationResult.Errors),
-                                },
-                            })
-                            w.WriteHeader(http.StatusBadRequest)
-                            json.NewEncoder(w).Encode(map[string]interface{}{
-                                "error": "Validation failed",
-                                "validation_errors": validationResult.Errors,
-                            })
-                            return
+                    } else if name := ut.engines.Owner(str); name != "" {
+                        if card := ut.engineCard(name, str); card != "" {
+                            val[k] = card
+                            *modified = true
+                            log.Printf("Detokenized token %s of engine %s in field %s", str, name, k)
                         }
-                        
-                        // Store sanitized data in request context for handler use
-                        validatedDataBytes, _ := json.Marshal(validationResult.Data)
-                        r.Body = io.NopCloser(bytes.NewBuffer(validatedDataBytes))
+                    } else if ut.debug {
+                        log.Printf("DEBUG: Value '%s' doesn't match token regex", str)
                     }
                 }
-            }
-            
-            // Validate URL parameters for token endpoints
-            if strings.Contains(r.URL.Path, "/tokens/") && !strings.HasSuffix(r.URL.Path, "/tokens") {
-                pathParts := strings.Split(r.URL.Path, "/")
-                for i, part := range pathParts {
-                    if part == "tokens" && i+1 < len(pathParts) {
-                        tokenID := pathParts[i+1]
-                        if tokenID != "search" { // Skip search endpoint
-                            tokenData := map[string]interface{}{"token": tokenID}
-                            if _, exists := ut.validationConfigs["token_id"]; exists {
-                                validationResult := ut.validateRequest("token_id", tokenData)
-                                if !validationResult.Valid {
-                                    ut.logSecurityEvent(SecurityEvent{
-                                        EventType: "invalid_token_format",
-                                        Severity:  "medium",
-                                        IPAddress: clientIP,
-                                        UserAgent: r.UserAgent(),
-                                        Endpoint:  r.URL.Path,
-                                        Details: map[string]interface{}{
-                                            "token_id": tokenID,
-                                            "validation_errors": validationResult.Errors,
-                                        },
-                                    })
-                                    w.WriteHeader(http.StatusBadRequest)
-                                    json.NewEncoder(w).Encode(map[string]interface{}{
-                                        "error": "Invalid token format",
-                                        "validation_errors": validationResult.Errors,
-                                    })
-                                    return
-                                }
-                            }
-                        }
-                        break
-                    }
+            } else if str, ok := v.(string); ok && len(ut.activeFieldRules().deepScan) > 0 {
+                if scanned, changed := ut.deepScanString(k, str, tokenize, fields, depth); changed {
+                    val[k] = scanned
+                    *modified = true
+                }
+            } else {
+                if ut.debug && !tokenize {
+                    log.Printf("DEBUG: Recursively processing non-card field '%s' with value type %T", k, v)
                 }
+                ut.processNested(v, modified, tokenize, fields, depth)
             }
-            
-            // Continue to next handler
-            next(w, r)
+        }
+    case []interface{}:
+        if ut.debug && !tokenize {
+            log.Printf("DEBUG: Processing array with %d elements", len(val))
+        }
+        for i := range val {
+            if ut.debug && !tokenize && i == 0 {
+                log.Printf("DEBUG: First array element type: %T", val[i])
+            }
+            ut.processNested(&val[i], modified, tokenize, fields, depth)
+        }
+    case string:
+        // Handle string values that might contain tokens or card numbers
+        if tokenize && ut.cardRegex.MatchString(val) {
+            // This case is handled by the parent map processor
+        } else if !tokenize && ut.tokenRegex.MatchString(val) {
+            // This case is handled by the parent map processor  
         }
     }
 }
 
-// Audit logging methods
-func (ut *UnifiedTokenizer) logAuditEvent(event AuditEvent) {
-    detailsJSON, _ := json.Marshal(event.Details)
-    
-    _, err := ut.db.Exec(`
-        INSERT INTO user_audit_log (user_id, action, resource_type, resource_id, details, ip_address, user_agent)
-        VALUES (?, ?, ?, ?, ?, ?, ?)
-    `, event.UserID, event.Action, event.ResourceType, event.ResourceID, string(detailsJSON), event.IPAddress, event.UserAgent)
-    
+// deepScanString processes the JSON held in field's string value when a
+// DEEP_SCAN_FIELDS rule names the field, returning the value encoded again
+// if anything in it changed
+func (ut *UnifiedTokenizer) deepScanString(field, str string, tokenize bool, fields *cardFields, depth int) (string, bool) {
+    asJSON, asBase64 := ut.activeFieldRules().deepScan.Match(field)
+    if depth >= maxDeepScanDepth || (!asJSON && !asBase64) {
+        return str, false
+    }
+    nested, wrapping, ok := deepscan.Decode(str, asJSON, asBase64)
+    if !ok {
+        return str, false
+    }
+    modified := false
+    ut.processNested(&nested, &modified, tokenize, fields, depth+1)
+    if !modified {
+        return str, false
+    }
+    encoded, err := wrapping.Encode(nested)
     if err != nil {
-        log.Printf("Failed to log audit event: %v", err)
+        log.Printf("Error encoding nested JSON in field %s: %v", field, err)
+        return str, false
+    }
+    if wrapping.Mode() == deepscan.Base64 {
+        atomic.AddInt64(&ut.deepScanBase64, 1)
+    } else {
+        atomic.AddInt64(&ut.deepScanJSON, 1)
+    }
+    if ut.debug {
+        log.Printf("DEBUG: Replaced card data in %s nested in field %s", wrapping.Mode(), field)
     }
+    return encoded, true
 }
 
-func (ut *UnifiedTokenizer) logSecurityEvent(event SecurityEvent) {
-    detailsJSON, _ := json.Marshal(event.Details)
+// FieldRuleMatch is a field a field rule test found a card number in, with
+// the values that would be stored alongside it
+type FieldRuleMatch struct {
+    Path        string            `json:"path"` // Like $.payment.card_number; (json) or (base64) marks a decoded string
+    CardType    string            `json:"card_type"`
+    LastFour    string            `json:"last_four"`
+    ExpiryMonth int               `json:"expiry_month,omitempty"`
+    ExpiryYear  int               `json:"expiry_year,omitempty"`
+    CardHolder  bool              `json:"card_holder"` // Whether a cardholder name would be stored
+    Tags        map[string]string `json:"tags,omitempty"`
+    Engine      string            `json:"engine,omitempty"` // Tokenization engine the card would be sent to instead of the vault
+}
+
+// FieldRuleSkip is a card number field a field rule test left alone
+type FieldRuleSkip struct {
+    Path   string `json:"path"`
+    Reason string `json:"reason"`
+}
+
+// isOwnToken reports whether a value that looks like a card number is a
+// Luhn-format token this site or a peer region issued
+func (ut *UnifiedTokenizer) isOwnToken(value string) bool {
+    return ut.tokenFormat == "luhn" && ut.tokenRegex.MatchString(value)
+}
+
+// testFieldRules walks v as processNested does when tokenizing, recording
+// the fields it would tokenize instead of storing anything
+func (ut *UnifiedTokenizer) testFieldRules(test *FieldRuleTestResult, v interface{}, path string, rules *fieldRules, fields *cardFields, depth int) {
+    switch val := v.(type) {
+    case map[string]interface{}:
+        keys := make([]string, 0, len(val))
+        for k := range val {
+            keys = append(keys, k)
+        }
+        sort.Strings(keys)
+        for _, k := range keys {
+            fieldPath := path + jsonPathKey(k)
+            str, isString := val[k].(string)
+            switch {
+            case ut.isCreditCardField(k):
+                switch {
+                case !isString:
+                    test.Skipped = append(test.Skipped, FieldRuleSkip{fieldPath, "not a string"})
+                case !ut.scanner.Contains(str, scanner.PAN):
+                    test.Skipped = append(test.Skipped, FieldRuleSkip{fieldPath, "not a card number"})
+                case ut.isOwnToken(str) || ut.engines.Owner(str) != "":
+                    test.Skipped = append(test.Skipped, FieldRuleSkip{fieldPath, "already a token"})
+                default:
+                    card := normalizeCardNumber(str)
+                    details := fields.details(val)
+                    test.Fields = append(test.Fields, FieldRuleMatch{
+                        Path:        fieldPath,
+                        CardType:    utils.DetectCardType(card),
+                        LastFour:    card[len(card)-4:],
+                        ExpiryMonth: details.ExpiryMonth,
+                        ExpiryYear:  details.ExpiryYear,
+                        CardHolder:  details.CardHolder != "",
+                        Tags:        details.Tags,
+                        Engine:      fields.Engine,
+                    })
+                }
+            case isString:
+                asJSON, asBase64 := rules.deepScan.Match(k)
+                if depth >= maxDeepScanDepth || (!asJSON && !asBase64) {
+                    continue
+                }
+                if nested, wrapping, ok := deepscan.Decode(str, asJSON, asBase64); ok {
+                    ut.testFieldRules(test, nested, fmt.Sprintf("%s(%s)", fieldPath, wrapping.Mode()), rules, fields, depth+1)
+                }
+            default:
+                ut.testFieldRules(test, val[k], fieldPath, rules, fields, depth)
+            }
+        }
+    case []interface{}:
+        for i := range val {
+            ut.testFieldRules(test, val[i], fmt.Sprintf("%s[%d]", path, i), rules, fields, depth)
+        }
+    }
+}
+
+// jsonPathKey is the path step for an object key: .key, or ["key"] when the
+// key is not a plain name
+func jsonPathKey(key string) string {
+    if jsonPathName.MatchString(key) {
+        return "." + key
+    }
+    quoted, _ := json.Marshal(key)
+    return "[" + string(quoted) + "]"
+}
+
+var jsonPathName = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_-]*$`)
+
+func (ut *UnifiedTokenizer) getMapKeys(m map[string]interface{}) []string {
+    keys := make([]string, 0, len(m))
+    for k := range m {
+        keys = append(keys, k)
+    }
+    return keys
+}
+
+// Original helper methods
+func (ut *UnifiedTokenizer) isCreditCardField(fieldName string) bool {
+    lowerField := strings.ToLower(fieldName)
+    // Exact matches to avoid false positives like "cards" matching "card"
+    exactMatches := []string{"card", "pan"}
+    for _, field := range exactMatches {
+        if lowerField == field {
+            return true
+        }
+    }
     
-    _, err := ut.db.Exec(`
-        INSERT INTO security_audit_log (event_type, severity, user_id, username, ip_address, user_agent, endpoint, details)
-        VALUES (?, ?, ?, ?, ?, ?, ?, ?)
-    `, event.EventType, event.Severity, event.UserID, event.Username, event.IPAddress, event.UserAgent, event.Endpoint, string(detailsJSON))
+    // Partial matches for compound names
+    cardFields := []string{"card_number", "cardnumber", "creditcard", "credit_card", "account_number"}
+    for _, field := range cardFields {
+        if strings.Contains(lowerField, field) {
+            return true
+        }
+    }
+    return false
+}
+
+// cardFields names the JSON fields that carry a card's expiry date and
+// cardholder name, looked for in the same object as the card number.
+// Names are lowercase and match field names case-insensitively.
+type cardFields struct {
+    ExpiryMonth []string
+    ExpiryYear  []string
+    Expiry      []string // Combined MM/YY, MM/YYYY, MM-YY or MMYY
+    CardHolder  []string
+    Tags        map[string]string // Set on the tokens of new cards
+    Engine      string            // TOKENIZATION_ENGINES entry tokenizing the cards instead of the vault
+}
+
+// defaultCardFields apply to paths without a CARD_FIELD_MAPPINGS entry and
+// to ICAP messages
+var defaultCardFields = cardFields{
+    ExpiryMonth: []string{"expiry_month", "exp_month", "expiration_month", "expirymonth", "expmonth", "expirationmonth"},
+    ExpiryYear:  []string{"expiry_year", "exp_year", "expiration_year", "expiryyear", "expyear", "expirationyear"},
+    Expiry:      []string{"expiry", "exp", "expiration", "expiry_date", "exp_date", "expiration_date", "expirydate", "expdate", "expirationdate"},
+    CardHolder:  []string{"card_holder", "cardholder", "card_holder_name", "cardholder_name", "cardholdername", "holder_name", "holdername", "name_on_card", "nameoncard"},
+}
+
+// CardFieldMapping is one CARD_FIELD_MAPPINGS entry. Each field set
+// replaces the default names for that value.
+type CardFieldMapping struct {
+    ExpiryMonth string            `json:"expiry_month,omitempty"`
+    ExpiryYear  string            `json:"expiry_year,omitempty"`
+    Expiry      string            `json:"expiry,omitempty"`
+    CardHolder  string            `json:"card_holder,omitempty"`
+    Tags        map[string]string `json:"tags,omitempty"`
+    Engine      string            `json:"engine,omitempty"` // TOKENIZATION_ENGINES entry to tokenize with instead of the vault
+}
+
+// FieldRules are the rules for finding card data in proxied JSON: the
+// field names used per proxy path prefix, as in CARD_FIELD_MAPPINGS, and
+// the string fields decoded to look inside, as in DEEP_SCAN_FIELDS
+type FieldRules struct {
+    CardFieldMappings map[string]CardFieldMapping `json:"card_field_mappings,omitempty"`
+    DeepScanFields    string                      `json:"deep_scan_fields,omitempty"`
+}
+
+// fieldRules are FieldRules ready to apply
+type fieldRules struct {
+    source   FieldRules
+    mappings map[string]*cardFields
+    deepScan deepscan.Rules
+}
+
+// parseCardFieldMappings parses CARD_FIELD_MAPPINGS, a JSON object from
+// proxy path prefix to the field names used on that endpoint, e.g.
+// {"/api/checkout": {"expiry": "card_exp", "card_holder": "name"}}
+func parseCardFieldMappings(value string) (map[string]CardFieldMapping, error) {
+    if strings.TrimSpace(value) == "" {
+        return nil, nil
+    }
+    dec := json.NewDecoder(strings.NewReader(value))
+    dec.DisallowUnknownFields()
+    var entries map[string]CardFieldMapping
+    if err := dec.Decode(&entries); err != nil {
+        return nil, fmt.Errorf("invalid CARD_FIELD_MAPPINGS: %v", err)
+    }
+    if _, err := compileCardFieldMappings(entries); err != nil {
+        return nil, fmt.Errorf("invalid CARD_FIELD_MAPPINGS: %v", err)
+    }
+    return entries, nil
+}
+
+// loadFieldRulesConfig reads CARD_FIELD_MAPPINGS and DEEP_SCAN_FIELDS,
+// which apply until field rules are set through the API
+func loadFieldRulesConfig() (FieldRules, error) {
+    mappings, err := parseCardFieldMappings(utils.GetEnv("CARD_FIELD_MAPPINGS", ""))
+    if err != nil {
+        return FieldRules{}, err
+    }
+    rules := FieldRules{CardFieldMappings: mappings, DeepScanFields: strings.TrimSpace(utils.GetEnv("DEEP_SCAN_FIELDS", ""))}
+    if _, err := deepscan.Parse(rules.DeepScanFields); err != nil {
+        return FieldRules{}, fmt.Errorf("invalid DEEP_SCAN_FIELDS: %v", err)
+    }
+    return rules, nil
+}
+
+// compileCardFieldMappings returns the field names to use under each path
+// prefix, lowercased, with the defaults for values an entry does not name
+func compileCardFieldMappings(entries map[string]CardFieldMapping) (map[string]*cardFields, error) {
+    mappings := make(map[string]*cardFields, len(entries))
+    for prefix, entry := range entries {
+        if !strings.HasPrefix(prefix, "/") {
+            return nil, fmt.Errorf("path %q must start with /", prefix)
+        }
+        fields := defaultCardFields
+        override := func(names *[]string, name string) {
+            if name = strings.ToLower(strings.TrimSpace(name)); name != "" {
+                *names = []string{name}
+            }
+        }
+        override(&fields.ExpiryMonth, entry.ExpiryMonth)
+        override(&fields.ExpiryYear, entry.ExpiryYear)
+        override(&fields.Expiry, entry.Expiry)
+        override(&fields.CardHolder, entry.CardHolder)
+        if err := validateTags(entry.Tags); err != nil {
+            return nil, fmt.Errorf("tags for %s: %v", prefix, err)
+        }
+        fields.Tags = entry.Tags
+        if entry.Engine != "" {
+            if err := engine.ValidName(entry.Engine); err != nil {
+                return nil, fmt.Errorf("engine for %s: %v", prefix, err)
+            }
+            fields.Engine = entry.Engine
+        }
+        mappings[prefix] = &fields
+    }
+    return mappings, nil
+}
+
+// compile validates the rules and prepares them for use
+func (r FieldRules) compile() (*fieldRules, error) {
+    mappings, err := compileCardFieldMappings(r.CardFieldMappings)
+    if err != nil {
+        return nil, fmt.Errorf("invalid card_field_mappings: %v", err)
+    }
+    deepScan, err := deepscan.Parse(r.DeepScanFields)
+    if err != nil {
+        return nil, fmt.Errorf("invalid deep_scan_fields: %v", err)
+    }
+    return &fieldRules{source: r, mappings: mappings, deepScan: deepScan}, nil
+}
+
+// checkEngines checks that the tokenization engines the rules name are
+// configured. Rules naming one that is not, set through the API on another
+// replica, leave its cards untokenized here.
+func (r FieldRules) checkEngines(engines *engine.Set) error {
+    for prefix, mapping := range r.CardFieldMappings {
+        if mapping.Engine != "" && !engines.Has(mapping.Engine) {
+            return fmt.Errorf("engine %q for %s is not in TOKENIZATION_ENGINES", mapping.Engine, prefix)
+        }
+    }
+    return nil
+}
+
+// fieldsFor returns the field names for a proxied request path: the
+// mapping with the longest matching prefix, or the defaults, for which
+// prefix is empty
+func (r *fieldRules) fieldsFor(path string) (fields *cardFields, prefix string) {
+    fields, longest := &defaultCardFields, -1
+    for p, f := range r.mappings {
+        if strings.HasPrefix(path, p) && len(p) > longest {
+            fields, prefix, longest = f, p, len(p)
+        }
+    }
+    return fields, prefix
+}
+
+// activeFieldRules returns the field rules in force
+func (ut *UnifiedTokenizer) activeFieldRules() *fieldRules {
+    if rules := ut.fieldRules.Load(); rules != nil {
+        return rules
+    }
+    return &fieldRules{}
+}
+
+// cardFieldsFor returns the field names for a proxied request path under
+// the field rules in force
+func (ut *UnifiedTokenizer) cardFieldsFor(path string) *cardFields {
+    fields, _ := ut.activeFieldRules().fieldsFor(path)
+    return fields
+}
+
+// cardDetails are the expiry and cardholder values sent with a card
+// number. Zero values mean the request did not carry them.
+type cardDetails struct {
+    ExpiryMonth int
+    ExpiryYear  int
+    CardHolder  string
+    Tags        map[string]string // From CARD_FIELD_MAPPINGS, not the request
+}
+
+// hasExpiry reports whether both the expiry month and year are known
+func (d cardDetails) hasExpiry() bool {
+    return d.ExpiryMonth != 0 && d.ExpiryYear != 0
+}
+
+// details collects the expiry and cardholder values from obj, the JSON
+// object holding a card number. Separate month and year fields take
+// precedence over a combined expiry; values that do not parse are ignored.
+func (f *cardFields) details(obj map[string]interface{}) cardDetails {
+    d := cardDetails{Tags: f.Tags}
+    var combinedMonth, combinedYear int
+    for k, v := range obj {
+        name := strings.ToLower(k)
+        switch {
+        case containsString(f.ExpiryMonth, name):
+            if month, ok := jsonInt(v); ok && month >= 1 && month <= 12 {
+                d.ExpiryMonth = month
+            }
+        case containsString(f.ExpiryYear, name):
+            if year, ok := jsonInt(v); ok {
+                d.ExpiryYear = expandExpiryYear(year)
+            }
+        case containsString(f.Expiry, name):
+            if str, ok := v.(string); ok {
+                combinedMonth, combinedYear, _ = parseExpiry(str)
+            }
+        case containsString(f.CardHolder, name):
+            if str, ok := v.(string); ok {
+                d.CardHolder = strings.TrimSpace(str)
+            }
+        }
+    }
+    if !d.hasExpiry() {
+        d.ExpiryMonth, d.ExpiryYear = combinedMonth, combinedYear
+    }
+    return d
+}
+
+// parseExpiry parses a combined expiry date: MM/YY, MM/YYYY, MM-YY,
+// MM-YYYY or MMYY
+func parseExpiry(value string) (month, year int, ok bool) {
+    value = strings.TrimSpace(value)
+    var monthStr, yearStr string
+    if i := strings.IndexAny(value, "/-"); i >= 0 {
+        monthStr, yearStr = strings.TrimSpace(value[:i]), strings.TrimSpace(value[i+1:])
+    } else if len(value) == 4 {
+        monthStr, yearStr = value[:2], value[2:]
+    }
+    if len(monthStr) < 1 || len(monthStr) > 2 || (len(yearStr) != 2 && len(yearStr) != 4) {
+        return 0, 0, false
+    }
+    month, err := strconv.Atoi(monthStr)
+    if err != nil || month < 1 || month > 12 {
+        return 0, 0, false
+    }
+    y, err := strconv.Atoi(yearStr)
+    if err != nil {
+        return 0, 0, false
+    }
+    if year = expandExpiryYear(y); year == 0 {
+        return 0, 0, false
+    }
+    return month, year, true
+}
+
+// expandExpiryYear turns a two-digit year into 20YY and returns 0 for a
+// year outside 2000-2099
+func expandExpiryYear(year int) int {
+    if year >= 0 && year < 100 {
+        return 2000 + year
+    }
+    if year >= 2000 && year <= 2099 {
+        return year
+    }
+    return 0
+}
+
+// jsonInt reads an integer sent as a JSON number or a numeric string
+func jsonInt(v interface{}) (int, bool) {
+    switch n := v.(type) {
+    case float64:
+        if n != float64(int(n)) {
+            return 0, false
+        }
+        return int(n), true
+    case string:
+        i, err := strconv.Atoi(strings.TrimSpace(n))
+        return i, err == nil
+    }
+    return 0, false
+}
+
+func containsString(list []string, s string) bool {
+    for _, item := range list {
+        if item == s {
+            return true
+        }
+    }
+    return false
+}
+
+func (ut *UnifiedTokenizer) generateToken() (string, error) {
+    if ut.tokenFormat == "luhn" {
+        return ut.generateLuhnToken()
+    }
     
+    // Default prefix format
+    b := make([]byte, 32)
+    if _, err := io.ReadFull(cryptorand.Reader, b); err != nil {
+        return "", fmt.Errorf("failed to generate token: %v", err)
+    }
+    return region.PrefixToken(ut.region, base64.URLEncoding.EncodeToString(b)), nil
+}
+
+// generateLuhnToken generates a token that looks like a valid credit card number
+func (ut *UnifiedTokenizer) generateLuhnToken() (string, error) {
+    // Draw one number from the combined range of all BINs, so every token
+    // the pool can issue is equally likely
+    n, err := cryptorand.Int(cryptorand.Reader, ut.luhnTokenSpace)
     if err != nil {
-        log.Printf("Failed to log security event: %v", err)
+        return "", fmt.Errorf("failed to generate token: %v", err)
+    }
+    for _, bin := range ut.luhnBINs {
+        size := luhnBINSize(bin)
+        if n.Cmp(size) >= 0 {
+            n.Sub(n, size)
+            continue
+        }
+        digits := n.String()
+        partial := bin + strings.Repeat("0", 15-len(bin)-len(digits)) + digits
+        return partial + strconv.Itoa(ut.calculateLuhnCheckDigit(partial)), nil
+    }
+    return "", errors.New("failed to generate token: no token BINs configured")
+}
+
+// parseTokenBINs parses LUHN_TOKEN_BINS, the comma-separated prefixes that
+// Luhn-format tokens are issued from. BINs must start with 9, which card
+// networks do not issue from, so a token is never mistaken for a real card.
+// Remove a BIN only once no active token uses it: tokens from BINs not in
+// the list are no longer recognized.
+func parseTokenBINs(value string) ([]string, error) {
+    var bins []string
+    for _, bin := range strings.Split(value, ",") {
+        bin = strings.TrimSpace(bin)
+        if bin == "" {
+            continue
+        }
+        if len(bin) < 2 || len(bin) > 8 || strings.Trim(bin, "0123456789") != "" || bin[0] != '9' {
+            return nil, fmt.Errorf("invalid LUHN_TOKEN_BINS entry %q: want 2 to 8 digits starting with 9", bin)
+        }
+        for _, other := range bins {
+            if strings.HasPrefix(bin, other) || strings.HasPrefix(other, bin) {
+                return nil, fmt.Errorf("LUHN_TOKEN_BINS entries %s and %s overlap", other, bin)
+            }
+        }
+        bins = append(bins, bin)
+    }
+    if len(bins) == 0 {
+        return nil, errors.New("LUHN_TOKEN_BINS must list at least one BIN")
+    }
+    return bins, nil
+}
+
+// peerTokenBIN is a BIN another region issues Luhn-format tokens from
+type peerTokenBIN struct {
+    bin    string
+    region string
+}
+
+// parsePeerTokenBINs parses LUHN_PEER_TOKEN_BINS, comma-separated
+// region=BIN entries for the BINs the other regions issue tokens from.
+// Their tokens are recognized here but never issued, and their cards are
+// asked of the region when replication has not brought them yet. No BIN
+// may overlap another region's or one of own.
+func parsePeerTokenBINs(value string, own []string) ([]peerTokenBIN, error) {
+    var peers []peerTokenBIN
+    all := append([]string(nil), own...)
+    for _, entry := range strings.Split(value, ",") {
+        entry = strings.TrimSpace(entry)
+        if entry == "" {
+            continue
+        }
+        name, bin, ok := strings.Cut(entry, "=")
+        name, bin = strings.TrimSpace(name), strings.TrimSpace(bin)
+        if !ok {
+            return nil, fmt.Errorf("invalid LUHN_PEER_TOKEN_BINS entry %q: want region=BIN", entry)
+        }
+        if err := region.ValidName(name); err != nil {
+            return nil, fmt.Errorf("invalid LUHN_PEER_TOKEN_BINS entry %q: %v", entry, err)
+        }
+        all = append(all, bin)
+        if _, err := parseTokenBINs(strings.Join(all, ",")); err != nil {
+            return nil, fmt.Errorf("invalid LUHN_PEER_TOKEN_BINS entry %q: %v", entry, err)
+        }
+        peers = append(peers, peerTokenBIN{bin: bin, region: name})
+    }
+    return peers, nil
+}
+
+// luhnBINSize is the number of tokens a BIN can issue: every value of the
+// digits between the BIN and the check digit of a 16-digit token
+func luhnBINSize(bin string) *big.Int {
+    return new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(15-len(bin))), nil)
+}
+
+// luhnTokenSpace is the number of tokens all bins can issue together
+func luhnTokenSpace(bins []string) *big.Int {
+    total := new(big.Int)
+    for _, bin := range bins {
+        total.Add(total, luhnBINSize(bin))
+    }
+    return total
+}
+
+// maxTokenAttempts bounds how often a token is regenerated after colliding
+// with an existing one. While the token space is far from full one retry
+// practically always succeeds, so running out means it needs more BINs.
+const maxTokenAttempts = 5
+
+// withUniqueToken calls store with newly generated tokens until one is not
+// already taken. The UNIQUE key on credit_cards.token does the checking, so
+// two concurrent requests cannot both claim a token as they could by
+// looking it up before inserting.
+func (ut *UnifiedTokenizer) withUniqueToken(store func(token string) error) (string, error) {
+    for attempt := 1; attempt <= maxTokenAttempts; attempt++ {
+        token, err := ut.generateToken()
+        if err != nil {
+            return "", err
+        }
+        err = store(token)
+        if !isDuplicateKey(err) {
+            if err != nil {
+                return "", err
+            }
+            return token, nil
+        }
+        atomic.AddInt64(&ut.tokenCollisions, 1)
+        log.Printf("Warning: generated token collided with an existing one (attempt %d of %d)", attempt, maxTokenAttempts)
+    }
+    return "", fmt.Errorf("failed to generate a unique token after %d attempts", maxTokenAttempts)
+}
+
+// isDuplicateKey reports whether err is a MySQL unique key violation
+func isDuplicateKey(err error) bool {
+    var mysqlErr *mysql.MySQLError
+    return errors.As(err, &mysqlErr) && mysqlErr.Number == 1062
+}
+
+// How long a request waits for the token of a card another request is
+// storing, and how old a claim whose token was never stored gets before it
+// is taken over from a request that failed without releasing it
+const (
+    cardClaimWait       = 10 * time.Second
+    cardClaimRetryDelay = 20 * time.Millisecond
+    cardClaimStale      = 5 * time.Minute
+)
+
+var (
+    // errCardClaimed is returned by a store function in storeClaimedCard
+    // when another request holds the card's claim
+    errCardClaimed = errors.New("card is claimed by another request")
+    // errCardClaimWait is returned when a card's claim is held for
+    // cardClaimWait without its token being stored
+    errCardClaimWait = errors.New("timed out waiting for a concurrent tokenization of the same card")
+)
+
+// storeClaimedCard stores a card the vault does not hold yet under a new
+// token, after claiming the card's blind index in card_claims. Its PRIMARY
+// KEY lets one of several concurrent requests for the card store it; the
+// others wait for that token and return it with existing set, rather than
+// each issuing their own. The claim is released when store fails.
+func (ut *UnifiedTokenizer) storeClaimedCard(cardIndex []byte, store func(token string) error) (token string, existing bool, err error) {
+    deadline := time.Now().Add(cardClaimWait)
+    for {
+        token, err := ut.withUniqueToken(func(token string) error {
+            result, err := ut.db.Exec("INSERT IGNORE INTO card_claims (card_number_index, token) VALUES (?, ?)", cardIndex, token)
+            if err != nil {
+                return err
+            }
+            if n, err := result.RowsAffected(); err != nil || n == 0 {
+                if err != nil {
+                    return err
+                }
+                return errCardClaimed
+            }
+            if err := store(token); err != nil {
+                ut.releaseCardClaims([]interface{}{token})
+                return err
+            }
+            return nil
+        })
+        if err != errCardClaimed {
+            return token, false, err
+        }
+        
+        // Another request holds the claim: use its token once stored
+        token, err = ut.claimedToken(cardIndex)
+        if err != nil || token != "" {
+            return token, token != "", err
+        }
+        if time.Now().After(deadline) {
+            return "", false, errCardClaimWait
+        }
+        time.Sleep(cardClaimRetryDelay)
+    }
+}
+
+// claimedToken returns the token of the card claimed under cardIndex once
+// it is stored and active, and "" while the claiming request is still
+// storing it. A claim whose token was revoked, or was not stored within
+// cardClaimStale, is released so that the card can be claimed again.
+func (ut *UnifiedTokenizer) claimedToken(cardIndex []byte) (string, error) {
+    var token string
+    var active sql.NullBool
+    var stale bool
+    err := ut.db.QueryRow(`
+        SELECT c.token, cc.is_active, c.created_at < NOW() - INTERVAL ? SECOND
+        FROM card_claims c LEFT JOIN credit_cards cc ON cc.token = c.token
+        WHERE c.card_number_index = ?`, int(cardClaimStale.Seconds()), cardIndex).Scan(&token, &active, &stale)
+    if err == sql.ErrNoRows {
+        return "", nil
+    }
+    if err != nil {
+        return "", err
+    }
+    if active.Valid && active.Bool {
+        return token, nil
+    }
+    if active.Valid || stale {
+        _, err = ut.db.Exec("DELETE FROM card_claims WHERE card_number_index = ? AND token = ?", cardIndex, token)
+    }
+    return "", err
+}
+
+// releaseCardClaims deletes the claims held for tokens that were not
+// stored after all
+func (ut *UnifiedTokenizer) releaseCardClaims(tokens []interface{}) {
+    if len(tokens) == 0 {
+        return
+    }
+    if _, err := ut.db.Exec("DELETE FROM card_claims WHERE token IN ("+sqlbuild.Placeholders(len(tokens))+")", tokens...); err != nil {
+        log.Printf("Failed to release card claims: %v", err)
+    }
+}
+
+// calculateLuhnCheckDigit calculates the Luhn check digit for a given number
+func (ut *UnifiedTokenizer) calculateLuhnCheckDigit(number string) int {
+    sum := 0
+    // The check digit will be appended, so the last digit here is doubled
+    alternate := true
+    
+    // Process from right to left
+    for i := len(number) - 1; i >= 0; i-- {
+        digit := int(number[i] - '0')
+        
+        if alternate {
+            digit *= 2
+            if digit > 9 {
+                digit = (digit % 10) + 1
+            }
+        }
+        
+        sum += digit
+        alternate = !alternate
+    }
+    
+    return (10 - (sum % 10)) % 10
+}
+
+// encryptCardNumber encrypts card data using the appropriate method
+func (ut *UnifiedTokenizer) encryptCardNumber(data string) ([]byte, error) {
+    if ut.useKEKDEK && ut.keyManager != nil {
+        // Use KEK/DEK encryption
+        encrypted, _, err := ut.keyManager.EncryptData([]byte(data))
+        return encrypted, err
+    } else {
+        // Use legacy Fernet encryption
+        return fernet.EncryptAndSign([]byte(data), ut.encryptionKey)
+    }
+}
+
+// decryptStoredField decrypts a column encrypted alongside the card number,
+// such as the cardholder name, with the card's DEK (or legacy Fernet when the
+// card has none)
+func (ut *UnifiedTokenizer) decryptStoredField(data []byte, keyID sql.NullString) (string, error) {
+    if ut.useKEKDEK && ut.keyManager != nil && keyID.Valid && keyID.String != "" {
+        plaintext, err := ut.keyManager.DecryptData(data, keyID.String)
+        if err != nil {
+            return "", err
+        }
+        return string(plaintext), nil
+    }
+    plaintext := fernet.VerifyAndDecrypt(data, 0, []*fernet.Key{ut.encryptionKey})
+    if plaintext == nil {
+        return "", fmt.Errorf("fernet decryption failed")
+    }
+    return string(plaintext), nil
+}
+
+// encryptFields encrypts values stored together, such as the fields of one
+// card, under a single key: the current DEK, whose ID is returned, or the
+// legacy Fernet key. Empty values are left nil. It fails if the DEK rotates
+// partway, since the row records only one key.
+func (ut *UnifiedTokenizer) encryptFields(values ...string) ([][]byte, sql.NullString, error) {
+    sealed := make([][]byte, len(values))
+    var keyID sql.NullString
+    for i, value := range values {
+        if value == "" {
+            continue
+        }
+        if ut.useKEKDEK && ut.keyManager != nil {
+            ciphertext, dekID, err := ut.keyManager.EncryptData([]byte(value))
+            if err != nil {
+                return nil, sql.NullString{}, err
+            }
+            if keyID.Valid && keyID.String != dekID {
+                return nil, sql.NullString{}, fmt.Errorf("DEK rotated while encrypting")
+            }
+            sealed[i], keyID = ciphertext, sql.NullString{String: dekID, Valid: true}
+        } else {
+            ciphertext, err := fernet.EncryptAndSign([]byte(value), ut.encryptionKey)
+            if err != nil {
+                return nil, sql.NullString{}, err
+            }
+            sealed[i] = ciphertext
+        }
+    }
+    return sealed, keyID, nil
+}
+
+// decryptFields decrypts fields stored under keyID with decryptStoredField;
+// nil fields come back empty
+func (ut *UnifiedTokenizer) decryptFields(keyID sql.NullString, fields ...[]byte) ([]string, error) {
+    values := make([]string, len(fields))
+    for i, data := range fields {
+        if len(data) == 0 {
+            continue
+        }
+        value, err := ut.decryptStoredField(data, keyID)
+        if err != nil {
+            return nil, err
+        }
+        values[i] = value
+    }
+    return values, nil
+}
+
+// Blind index purposes; each is mixed into the HMAC so indexes of different
+// fields cannot be matched against each other
+const (
+    blindIndexHolderName = "card_holder_name"
+    blindIndexCardNumber = "card_number"
+    blindIndexExternalID = "external_id"
+)
+
+// computeBlindIndex is HMAC-SHA256 over purpose and value
+func computeBlindIndex(key []byte, purpose string, value []byte) []byte {
+    mac := hmac.New(sha256.New, key)
+    mac.Write([]byte(purpose))
+    mac.Write([]byte{0})
+    mac.Write(value)
+    return mac.Sum(nil)
+}
+
+// blindIndex returns the lookup index for value. With KEK/DEK the key is the
+// KeyManager's index key; otherwise one derived from ENCRYPTION_KEY.
+func (ut *UnifiedTokenizer) blindIndex(purpose, value string) ([]byte, error) {
+    if ut.useKEKDEK && ut.keyManager != nil {
+        return ut.keyManager.BlindIndex(purpose, []byte(value))
+    }
+    legacyKey := computeBlindIndex(ut.encryptionKey[:], "blind_index_key", nil)
+    return computeBlindIndex(legacyKey, purpose, []byte(value)), nil
+}
+
+// normalizeHolderName folds case and whitespace so "JANE  Doe" and
+// "jane doe" share a blind index
+func normalizeHolderName(name string) string {
+    return strings.ToLower(strings.Join(strings.Fields(name), " "))
+}
+
+// normalizeExternalID trims the whitespace around an external ID; the rest
+// must match exactly
+func normalizeExternalID(id string) string {
+    return strings.TrimSpace(id)
+}
+
+// normalizeCardNumber strips the spaces and dashes cards are written with
+func normalizeCardNumber(cardNumber string) string {
+    return strings.ReplaceAll(strings.ReplaceAll(cardNumber, " ", ""), "-", "")
+}
+
+// detokenizeHTML detokenizes tokens in HTML content in a single pass,
+// looking each distinct token up once
+func (ut *UnifiedTokenizer) detokenizeHTML(htmlStr string) (string, bool, error) {
+    if ut.debug {
+        log.Printf("DEBUG: detokenizeHTML called, length: %d", len(htmlStr))
+    }
+    
+    cards := make(map[string]string)
+    result, modified := ut.scanner.Replace(htmlStr, func(m scanner.Match, token string) (string, bool) {
+        if m.Kind != scanner.Token {
+            return "", false
+        }
+        card, seen := cards[token]
+        if !seen {
+            if ut.debug {
+                log.Printf("DEBUG: Attempting to detokenize token: %s", token)
+            }
+            card = ut.retrieveCard(token)
+            cards[token] = card
+            if card != "" {
+                log.Printf("Detokenized token %s in HTML content", token)
+            } else if ut.debug {
+                log.Printf("DEBUG: Failed to retrieve card for token: %s", token)
+            }
+        }
+        return card, card != ""
+    })
+    
+    return result, modified, nil
+}
+
+func (ut *UnifiedTokenizer) DetokenizeHTML(htmlStr string) (string, bool, error) {
+    return ut.detokenizeHTML(htmlStr)
+}
+
+// tokenizeField tokenizes a card number found in obj, in the vault or with
+// the tokenization engine the field rule names
+func (ut *UnifiedTokenizer) tokenizeField(cardNumber string, fields *cardFields, obj map[string]interface{}) (string, error) {
+    details := fields.details(obj)
+    if fields.Engine == "" {
+        return ut.tokenizeCard(cardNumber, details)
+    }
+    lastFour := cardNumber[len(cardNumber)-4:]
+    token, err := ut.engines.Tokenize(context.Background(), fields.Engine, engine.Card{
+        Number:      normalizeCardNumber(cardNumber),
+        ExpiryMonth: details.ExpiryMonth,
+        ExpiryYear:  details.ExpiryYear,
+        Holder:      details.CardHolder,
+    })
+    if err != nil {
+        log.Printf("Failed to tokenize card ending in %s: %v", lastFour, err)
+        return "", err
+    }
+    ut.logTokenRequest(token, "tokenize", lastFour)
+    return token, nil
+}
+
+// engineCard asks tokenization engine name for the card behind one of its
+// tokens, returning "" when it has none
+func (ut *UnifiedTokenizer) engineCard(name, token string) string {
+    card, err := ut.engines.Detokenize(context.Background(), name, token)
+    if err != nil {
+        if err != engine.ErrNotFound {
+            log.Printf("Failed to detokenize: %v", err)
+        }
+        return ""
+    }
+    if len(card) >= 4 {
+        ut.logTokenRequest(token, "detokenize", card[len(card)-4:])
+    }
+    return card
+}
+
+// tokenizeCard returns a new token for cardNumber, or with
+// DETERMINISTIC_TOKENS the active token already issued for it. A reused
+// token takes the expiry from details when the request carries one, so a
+// reissued card's new expiry replaces the old. Concurrent requests for a
+// new card agree on one token through the card's claim.
+func (ut *UnifiedTokenizer) tokenizeCard(cardNumber string, details cardDetails) (string, error) {
+    if ut.deterministicTokens {
+        exists, token, err := ut.checkCardExists(cardNumber)
+        if err != nil {
+            return "", err
+        }
+        if !exists {
+            cardIndex, err := ut.blindIndex(blindIndexCardNumber, normalizeCardNumber(cardNumber))
+            if err != nil {
+                return "", fmt.Errorf("failed to index card: %v", err)
+            }
+            token, exists, err = ut.storeClaimedCard(cardIndex, func(token string) error {
+                return ut.storeCard(token, cardNumber, details)
+            })
+            if err != nil || !exists {
+                return token, err
+            }
+        }
+        if details.hasExpiry() {
+            if _, err := ut.db.Exec(`
+                UPDATE credit_cards SET expiry_month = ?, expiry_year = ?
+                WHERE token = ?`, details.ExpiryMonth, details.ExpiryYear, token); err != nil {
+                log.Printf("Failed to update expiry for token %s: %v", token, err)
+            }
+        }
+        return token, nil
+    }
+    return ut.withUniqueToken(func(token string) error {
+        return ut.storeCard(token, cardNumber, details)
+    })
+}
+
+// storeCard saves a proxied card under token. Expiry and cardholder are
+// stored when details has them; an unknown expiry is left NULL.
+func (ut *UnifiedTokenizer) storeCard(token, cardNumber string, details cardDetails) error {
+    var encrypted []byte
+    var keyID string
+    var err error
+    
+    // Detect card type
+    cardType := utils.DetectCardType(cardNumber)
+    
+    cardIndex, err := ut.blindIndex(blindIndexCardNumber, normalizeCardNumber(cardNumber))
+    if err != nil {
+        return fmt.Errorf("failed to index card: %v", err)
+    }
+    
+    if ut.useKEKDEK && ut.keyManager != nil {
+        // Use KEK/DEK encryption
+        encrypted, keyID, err = ut.keyManager.EncryptData([]byte(cardNumber))
+        if err != nil {
+            return fmt.Errorf("KEK/DEK encryption failed: %v", err)
+        }
+    } else {
+        // Use legacy Fernet encryption
+        encrypted, err = fernet.EncryptAndSign([]byte(cardNumber), ut.encryptionKey)
+        if err != nil {
+            return fmt.Errorf("encryption failed: %v", err)
+        }
+    }
+    
+    var storedKeyID *string
+    if ut.useKEKDEK && keyID != "" {
+        storedKeyID = &keyID
+    }
+    
+    var encryptedHolder, holderIndex []byte
+    if details.CardHolder != "" {
+        encryptedHolder, err = ut.encryptCardNumber(details.CardHolder)
+        if err != nil {
+            return fmt.Errorf("failed to encrypt card holder: %v", err)
+        }
+        holderIndex, err = ut.blindIndex(blindIndexHolderName, normalizeHolderName(details.CardHolder))
+        if err != nil {
+            return fmt.Errorf("failed to index card holder: %v", err)
+        }
+    }
+    
+    var expiryMonth, expiryYear sql.NullInt64
+    if details.hasExpiry() {
+        expiryMonth = sql.NullInt64{Int64: int64(details.ExpiryMonth), Valid: true}
+        expiryYear = sql.NullInt64{Int64: int64(details.ExpiryYear), Valid: true}
+    }
+    
+    stmt, err := ut.stmts.Get(stmtStoreCard)
+    if err != nil {
+        return err
+    }
+    _, err = stmt.Exec(token, encrypted, cardIndex, encryptedHolder, holderIndex, expiryMonth, expiryYear,
+        cardType, cardNumber[len(cardNumber)-4:], cardNumber[:6], storedKeyID, ut.region)
+    
+    if err == nil {
+        ut.counters.AddActive(1)
+        ut.logTokenRequest(token, "tokenize", cardNumber[len(cardNumber)-4:])
+        if err := setTokenTags(ut.db, []interface{}{token}, tagUpdates(details.Tags)); err != nil {
+            log.Printf("Failed to tag token %s: %v", token, err)
+        }
+    }
+    
+    return err
+}
+
+// tokenRegion returns the region that issued token, or "" when it was
+// issued here or without a region
+func (ut *UnifiedTokenizer) tokenRegion(token string) string {
+    if ut.tokenFormat != "luhn" {
+        if name := region.OfPrefixToken(token); name != ut.region {
+            return name
+        }
+        return ""
+    }
+    for _, peer := range ut.peerBINs {
+        if strings.HasPrefix(token, peer.bin) {
+            return peer.region
+        }
+    }
+    return ""
+}
+
+// retrieveFromPeer asks the region that issued token for its card, for
+// tokens issued elsewhere that replication has not brought here yet. The
+// card is not stored: the row arrives with replication.
+func (ut *UnifiedTokenizer) retrieveFromPeer(token string) string {
+    name := ut.tokenRegion(token)
+    if name == "" || ut.peers == nil || !ut.peers.Has(name) {
+        return ""
+    }
+    card, err := ut.peers.Reveal(context.Background(), name, token)
+    if err != nil {
+        if err != region.ErrNotFound {
+            log.Printf("Failed to look up a token of region %s on the peer: %v", name, err)
+        }
+        return ""
+    }
+    if ut.debug {
+        log.Printf("DEBUG: Token %s of region %s found on the peer", token, name)
+    }
+    return card
+}
+
+// Names of the hot-path statements in ut.stmts
+const (
+    stmtStoreCard       = "store_card"
+    stmtRetrieveCard    = "retrieve_card"
+    stmtFindCardByIndex = "find_card_by_index"
+    stmtLogTokenRequest = "log_token_request"
+    stmtCheckAPIKey     = "check_api_key"
+)
+
+// hotPathQueries are run for every tokenized or detokenized card and every
+// API call, so they are prepared once rather than parsed on each call
+var hotPathQueries = map[string]string{
+    stmtStoreCard: `
+        INSERT INTO credit_cards (token, card_number_encrypted, card_number_index, card_holder_name_encrypted, card_holder_name_index,
+                                 expiry_month, expiry_year, card_type, last_four_digits, first_six_digits,
+                                 created_at, is_active, encryption_key_id, source, region)
+        VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, NOW(), TRUE, ?, 'proxy', NULLIF(?, ''))`,
+    stmtRetrieveCard: `
+        SELECT card_number_encrypted, encryption_key_id FROM credit_cards 
+        WHERE token = ? AND is_active = TRUE`,
+    stmtFindCardByIndex: `
+        SELECT token FROM credit_cards
+        WHERE card_number_index = ? AND is_active = TRUE
+        ORDER BY id LIMIT 1`,
+    stmtLogTokenRequest: `
+        INSERT INTO token_requests (token, request_type, source_ip, destination_url, response_status)
+        VALUES (?, ?, '127.0.0.1', '', 200)`,
+    stmtCheckAPIKey: `
+        SELECT COUNT(*) FROM api_keys 
+        WHERE api_key = ? AND is_active = TRUE AND (expires_at IS NULL OR expires_at > NOW())`,
+}
+
+// logTokenRequest records a proxy tokenize or detokenize in token_requests
+// and publishes it to event stream subscribers
+func (ut *UnifiedTokenizer) logTokenRequest(token, requestType, lastFour string) {
+    stmt, err := ut.stmts.Get(stmtLogTokenRequest)
+    if err != nil {
+        return
+    }
+    if res, err := stmt.Exec(token, requestType); err == nil {
+        ut.counters.Request(requestType, http.StatusOK, time.Now())
+        ut.publishActivity(res, token, requestType, lastFour)
+    }
+}
+
+func (ut *UnifiedTokenizer) retrieveCard(token string) string {
+    if ut.debug {
+        log.Printf("DEBUG: retrieveCard called with token: %s", token)
+    }
+    
+    var encryptedCard []byte
+    var keyID sql.NullString
+    
+    stmt, err := ut.stmts.Get(stmtRetrieveCard)
+    if err == nil {
+        err = stmt.QueryRow(token).Scan(&encryptedCard, &keyID)
+    }
+    
+    if err != nil {
+        if err == sql.ErrNoRows {
+            if ut.debug {
+                log.Printf("DEBUG: Token not found in database: %s", token)
+            }
+            return ut.retrieveFromPeer(token)
+        } else {
+            log.Printf("Database error: %v", err)
+        }
+        return ""
+    }
+    
+    var cardBytes []byte
+    
+    if ut.useKEKDEK && ut.keyManager != nil && keyID.Valid && keyID.String != "" {
+        // Use KEK/DEK decryption
+        cardBytes, err = ut.keyManager.DecryptData(encryptedCard, keyID.String)
+        if err != nil {
+            log.Printf("Failed to decrypt card with KEK/DEK for token %s: %v", token, err)
+            return ""
+        }
+    } else {
+        // Use legacy Fernet decryption
+        cardBytes = fernet.VerifyAndDecrypt(encryptedCard, 0, []*fernet.Key{ut.encryptionKey})
+        if cardBytes == nil {
+            log.Printf("Failed to decrypt card for token %s", token)
+            return ""
+        }
+    }
+    
+    if len(cardBytes) >= 4 {
+        ut.logTokenRequest(token, "detokenize", string(cardBytes[len(cardBytes)-4:]))
+    }
+    
+    return string(cardBytes)
+}
+
+// publishActivity pushes a token_requests row to event stream subscribers,
+// using the same fields as the /api/v1/activity endpoint
+func (ut *UnifiedTokenizer) publishActivity(res sql.Result, token, requestType, lastFour string) {
+    if ut.eventBroker.Subscribers() == 0 {
+        return
+    }
+    
+    activity := map[string]interface{}{
+        "token":          token,
+        "type":           requestType,
+        "source_ip":      "127.0.0.1",
+        "destination":    "",
+        "timestamp":      time.Now().UTC().Format(time.RFC3339),
+        "status":         200,
+        "card_last_four": lastFour,
+    }
+    if id, err := res.LastInsertId(); err == nil {
+        activity["id"] = id
+    }
+    ut.eventBroker.Publish(events.TypeActivity, activity)
+}
+
+// API Handlers
+func (ut *UnifiedTokenizer) handleAPIHealth(w http.ResponseWriter, r *http.Request) {
+    w.Header().Set("Content-Type", "application/json")
+    health := map[string]interface{}{"status": "healthy"}
+    if ut.unsealer != nil {
+        health["sealed"] = ut.keyManager.IsSealed()
+    }
+    if m := ut.currentMaintenance(); m.Enabled || m.ConfigFreeze {
+        health["maintenance"] = m.Enabled
+        health["config_freeze"] = m.ConfigFreeze
+    }
+    json.NewEncoder(w).Encode(health)
+}
+
+// SchemaCheck is what the startup check found wrong with the database
+// schema, shown by /readyz
+type SchemaCheck struct {
+    PendingMigrations int             `json:"pending_migrations"`
+    MissingIndexes    []migrate.Index `json:"missing_indexes"`
+    Error             string          `json:"error,omitempty"`
+}
+
+// checkSchema warns about pending migrations and about indexes the
+// queries over the large tables rely on that the database lacks
+func (ut *UnifiedTokenizer) checkSchema() {
+    ctx := context.Background()
+    check := &SchemaCheck{MissingIndexes: []migrate.Index{}}
+    if pending, err := migrate.Pending(ctx, ut.db); err != nil {
+        log.Printf("Warning: Failed to check schema migrations: %v", err)
+        check.Error = err.Error()
+    } else if len(pending) > 0 {
+        log.Printf("Warning: %d schema migrations pending, run 'unified-tokenizer migrate'", len(pending))
+        check.PendingMigrations = len(pending)
+    }
+    if missing, err := migrate.MissingIndexes(ctx, ut.db); err != nil {
+        log.Printf("Warning: Failed to check indexes: %v", err)
+        check.Error = err.Error()
+    } else {
+        for _, index := range missing {
+            log.Printf("Warning: No index on %s (%s), used by %s; queries will scan the table",
+                index.Table, strings.Join(index.Columns, ", "), index.UsedBy)
+        }
+        check.MissingIndexes = missing
+    }
+    ut.schemaCheck.Store(check)
+}
+
+// handleReadyz reports whether this replica can serve requests: 503 while
+// the database is unreachable or the vault is sealed. Schema problems
+// found at startup are warnings, shown with their details.
+func (ut *UnifiedTokenizer) handleReadyz(w http.ResponseWriter, r *http.Request) {
+    w.Header().Set("Content-Type", "application/json")
+    ready := true
+    checks := map[string]interface{}{}
+    
+    if err := ut.db.PingContext(r.Context()); err != nil {
+        ready = false
+        checks["database"] = "unreachable"
+    } else {
+        checks["database"] = "ok"
+    }
+    if ut.unsealer != nil && ut.keyManager.IsSealed() {
+        ready = false
+        checks["sealed"] = true
+    }
+    
+    warnings := []string{}
+    if check := ut.schemaCheck.Load(); check != nil {
+        checks["schema"] = check
+        if check.PendingMigrations > 0 {
+            warnings = append(warnings, fmt.Sprintf("%d schema migrations pending", check.PendingMigrations))
+        }
+        for _, index := range check.MissingIndexes {
+            warnings = append(warnings, fmt.Sprintf("no index on %s (%s)", index.Table, strings.Join(index.Columns, ", ")))
+        }
+        if check.Error != "" {
+            warnings = append(warnings, "schema check failed")
+        }
+    }
+    
+    status := "ready"
+    if !ready {
+        status = "not_ready"
+        w.WriteHeader(http.StatusServiceUnavailable)
+    }
+    json.NewEncoder(w).Encode(map[string]interface{}{
+        "status":   status,
+        "checks":   checks,
+        "warnings": warnings,
+    })
+}
+
+// handleMetrics exposes counters in the Prometheus text format for
+// ServiceMonitor/PodMonitor scraping. Only counts are exported, never token
+// or card data, so like /health it needs no authentication.
+func (ut *UnifiedTokenizer) handleMetrics(w http.ResponseWriter, r *http.Request) {
+    var b strings.Builder
+    
+    dbUp := 1
+    if err := ut.db.Ping(); err != nil {
+        dbUp = 0
+    }
+    fmt.Fprintf(&b, "# HELP tokenshield_database_up Whether the database is reachable.\n")
+    fmt.Fprintf(&b, "# TYPE tokenshield_database_up gauge\n")
+    fmt.Fprintf(&b, "tokenshield_database_up %d\n", dbUp)
+    
+    if dbUp == 1 {
+        activeTokens, _ := counters.ActiveTokens(ut.db)
+        fmt.Fprintf(&b, "# HELP tokenshield_active_tokens Active tokens in the vault.\n")
+        fmt.Fprintf(&b, "# TYPE tokenshield_active_tokens gauge\n")
+        fmt.Fprintf(&b, "tokenshield_active_tokens %d\n", activeTokens)
+        
+        if totals, err := counters.RequestTotals(ut.db); err == nil {
+            reqTypes := make([]string, 0, len(totals))
+            for reqType := range totals {
+                reqTypes = append(reqTypes, reqType)
+            }
+            sort.Strings(reqTypes)
+            fmt.Fprintf(&b, "# HELP tokenshield_requests_total Tokenization requests by type.\n")
+            fmt.Fprintf(&b, "# TYPE tokenshield_requests_total counter\n")
+            for _, reqType := range reqTypes {
+                fmt.Fprintf(&b, "tokenshield_requests_total{type=%q} %d\n", reqType, totals[reqType])
+            }
+        }
+        
+        var checkedAt time.Time
+        var cardsChecked, decryptFailures, digitMismatches, luhnFailures, orphanedRequests int64
+        if err := ut.db.QueryRow(`
+            SELECT completed_at, cards_checked, decrypt_failures, digit_mismatches, luhn_failures, orphaned_requests
+            FROM integrity_checks
+            WHERE status = 'completed'
+            ORDER BY completed_at DESC
+            LIMIT 1
+        `).Scan(&checkedAt, &cardsChecked, &decryptFailures, &digitMismatches, &luhnFailures, &orphanedRequests); err == nil {
+            fmt.Fprintf(&b, "# HELP tokenshield_integrity_last_check_timestamp_seconds When the last completed vault integrity check finished.\n")
+            fmt.Fprintf(&b, "# TYPE tokenshield_integrity_last_check_timestamp_seconds gauge\n")
+            fmt.Fprintf(&b, "tokenshield_integrity_last_check_timestamp_seconds %d\n", checkedAt.Unix())
+            fmt.Fprintf(&b, "# HELP tokenshield_integrity_cards_checked Cards verified by the last integrity check.\n")
+            fmt.Fprintf(&b, "# TYPE tokenshield_integrity_cards_checked gauge\n")
+            fmt.Fprintf(&b, "tokenshield_integrity_cards_checked %d\n", cardsChecked)
+            fmt.Fprintf(&b, "# HELP tokenshield_integrity_issues Problems found by the last integrity check, by check.\n")
+            fmt.Fprintf(&b, "# TYPE tokenshield_integrity_issues gauge\n")
+            fmt.Fprintf(&b, "tokenshield_integrity_issues{check=%q} %d\n", integrityDecrypt, decryptFailures)
+            fmt.Fprintf(&b, "tokenshield_integrity_issues{check=%q} %d\n", integrityDigits, digitMismatches)
+            fmt.Fprintf(&b, "tokenshield_integrity_issues{check=%q} %d\n", integrityLuhn, luhnFailures)
+            fmt.Fprintf(&b, "tokenshield_integrity_issues{check=%q} %d\n", integrityOrphan, orphanedRequests)
+        }
+        
+        // Estimates MySQL keeps in information_schema, refreshed as
+        // information_schema_stats_expiry allows
+        if rows, err := ut.db.Query(`
+            SELECT TABLE_NAME, COALESCE(TABLE_ROWS, 0), COALESCE(DATA_LENGTH + INDEX_LENGTH, 0)
+            FROM information_schema.TABLES
+            WHERE TABLE_SCHEMA = DATABASE() AND TABLE_NAME IN ('credit_cards', 'token_requests', 'token_requests_archive')
+            ORDER BY TABLE_NAME`); err == nil {
+            var sizes []string
+            fmt.Fprintf(&b, "# HELP tokenshield_table_rows Estimated rows in the largest tables.\n")
+            fmt.Fprintf(&b, "# TYPE tokenshield_table_rows gauge\n")
+            for rows.Next() {
+                var table string
+                var tableRows, tableBytes int64
+                if err := rows.Scan(&table, &tableRows, &tableBytes); err == nil {
+                    fmt.Fprintf(&b, "tokenshield_table_rows{table=%q} %d\n", table, tableRows)
+                    sizes = append(sizes, fmt.Sprintf("tokenshield_table_bytes{table=%q} %d\n", table, tableBytes))
+                }
+            }
+            rows.Close()
+            fmt.Fprintf(&b, "# HELP tokenshield_table_bytes Estimated size of the largest tables, data and indexes.\n")
+            fmt.Fprintf(&b, "# TYPE tokenshield_table_bytes gauge\n")
+            b.WriteString(strings.Join(sizes, ""))
+        }
+        var oldestRequest sql.NullTime
+        if err := ut.db.QueryRow("SELECT MIN(request_timestamp) FROM token_requests").Scan(&oldestRequest); err == nil && oldestRequest.Valid {
+            fmt.Fprintf(&b, "# HELP tokenshield_token_requests_oldest_timestamp_seconds When the oldest row in token_requests was recorded.\n")
+            fmt.Fprintf(&b, "# TYPE tokenshield_token_requests_oldest_timestamp_seconds gauge\n")
+            fmt.Fprintf(&b, "tokenshield_token_requests_oldest_timestamp_seconds %d\n", oldestRequest.Time.Unix())
+        }
+        
+        if version, err := migrate.Current(r.Context(), ut.db); err == nil {
+            fmt.Fprintf(&b, "# HELP tokenshield_schema_version Applied schema migration version.\n")
+            fmt.Fprintf(&b, "# TYPE tokenshield_schema_version gauge\n")
+            fmt.Fprintf(&b, "tokenshield_schema_version %d\n", version)
+        }
+    }
+    
+    fmt.Fprintf(&b, "# HELP tokenshield_token_requests_archived_total token_requests rows moved out past TOKEN_REQUEST_RETENTION_DAYS by this replica.\n")
+    fmt.Fprintf(&b, "# TYPE tokenshield_token_requests_archived_total counter\n")
+    fmt.Fprintf(&b, "tokenshield_token_requests_archived_total %d\n", atomic.LoadInt64(&ut.requestsArchived))
+    
+    pool := ut.db.Stats()
+    fmt.Fprintf(&b, "# HELP tokenshield_db_connections Database connections by state.\n")
+    fmt.Fprintf(&b, "# TYPE tokenshield_db_connections gauge\n")
+    fmt.Fprintf(&b, "tokenshield_db_connections{state=\"in_use\"} %d\n", pool.InUse)
+    fmt.Fprintf(&b, "tokenshield_db_connections{state=\"idle\"} %d\n", pool.Idle)
+    fmt.Fprintf(&b, "# HELP tokenshield_db_max_open_connections Configured connection pool limit.\n")
+    fmt.Fprintf(&b, "# TYPE tokenshield_db_max_open_connections gauge\n")
+    fmt.Fprintf(&b, "tokenshield_db_max_open_connections %d\n", pool.MaxOpenConnections)
+    fmt.Fprintf(&b, "# HELP tokenshield_db_wait_total Connections that had to wait for a free slot.\n")
+    fmt.Fprintf(&b, "# TYPE tokenshield_db_wait_total counter\n")
+    fmt.Fprintf(&b, "tokenshield_db_wait_total %d\n", pool.WaitCount)
+    fmt.Fprintf(&b, "# HELP tokenshield_db_wait_seconds_total Time spent waiting for a connection.\n")
+    fmt.Fprintf(&b, "# TYPE tokenshield_db_wait_seconds_total counter\n")
+    fmt.Fprintf(&b, "tokenshield_db_wait_seconds_total %.3f\n", pool.WaitDuration.Seconds())
+    fmt.Fprintf(&b, "# HELP tokenshield_db_closed_total Connections closed by the pool, by reason.\n")
+    fmt.Fprintf(&b, "# TYPE tokenshield_db_closed_total counter\n")
+    fmt.Fprintf(&b, "tokenshield_db_closed_total{reason=\"max_idle\"} %d\n", pool.MaxIdleClosed)
+    fmt.Fprintf(&b, "tokenshield_db_closed_total{reason=\"max_idle_time\"} %d\n", pool.MaxIdleTimeClosed)
+    fmt.Fprintf(&b, "tokenshield_db_closed_total{reason=\"max_lifetime\"} %d\n", pool.MaxLifetimeClosed)
+    
+    icapStats := ut.icapPool.Stats()
+    fmt.Fprintf(&b, "# HELP tokenshield_icap_workers ICAP connections handled concurrently at most.\n")
+    fmt.Fprintf(&b, "# TYPE tokenshield_icap_workers gauge\n")
+    fmt.Fprintf(&b, "tokenshield_icap_workers %d\n", icapStats.Workers)
+    fmt.Fprintf(&b, "# HELP tokenshield_icap_active ICAP connections being handled.\n")
+    fmt.Fprintf(&b, "# TYPE tokenshield_icap_active gauge\n")
+    fmt.Fprintf(&b, "tokenshield_icap_active %d\n", icapStats.Active)
+    fmt.Fprintf(&b, "# HELP tokenshield_icap_queue_capacity ICAP connections that can wait for a worker.\n")
+    fmt.Fprintf(&b, "# TYPE tokenshield_icap_queue_capacity gauge\n")
+    fmt.Fprintf(&b, "tokenshield_icap_queue_capacity %d\n", icapStats.QueueCapacity)
+    fmt.Fprintf(&b, "# HELP tokenshield_icap_queued ICAP connections waiting for a worker.\n")
+    fmt.Fprintf(&b, "# TYPE tokenshield_icap_queued gauge\n")
+    fmt.Fprintf(&b, "tokenshield_icap_queued %d\n", icapStats.Queued)
+    fmt.Fprintf(&b, "# HELP tokenshield_icap_handled_total ICAP connections handled by a worker.\n")
+    fmt.Fprintf(&b, "# TYPE tokenshield_icap_handled_total counter\n")
+    fmt.Fprintf(&b, "tokenshield_icap_handled_total %d\n", icapStats.Handled)
+    fmt.Fprintf(&b, "# HELP tokenshield_icap_rejected_total ICAP connections answered 503 because the service was saturated.\n")
+    fmt.Fprintf(&b, "# TYPE tokenshield_icap_rejected_total counter\n")
+    fmt.Fprintf(&b, "tokenshield_icap_rejected_total{reason=\"queue_full\"} %d\n", icapStats.RejectedFull)
+    fmt.Fprintf(&b, "tokenshield_icap_rejected_total{reason=\"queue_timeout\"} %d\n", icapStats.RejectedStale)
+    fmt.Fprintf(&b, "# HELP tokenshield_icap_auth_failures_total ICAP requests refused for a missing or wrong ICAP_SHARED_SECRET.\n")
+    fmt.Fprintf(&b, "# TYPE tokenshield_icap_auth_failures_total counter\n")
+    fmt.Fprintf(&b, "tokenshield_icap_auth_failures_total %d\n", ut.icapServer.AuthFailures())
+    
+    statements := ut.stmts.Stats()
+    fmt.Fprintf(&b, "# HELP tokenshield_db_statement_executions_total Uses of each prepared hot-path statement.\n")
+    fmt.Fprintf(&b, "# TYPE tokenshield_db_statement_executions_total counter\n")
+    for _, st := range statements {
+        fmt.Fprintf(&b, "tokenshield_db_statement_executions_total{statement=%q} %d\n", st.Name, st.Executions)
+    }
+    fmt.Fprintf(&b, "# HELP tokenshield_db_statement_prepare_errors_total Failed attempts to prepare each statement.\n")
+    fmt.Fprintf(&b, "# TYPE tokenshield_db_statement_prepare_errors_total counter\n")
+    for _, st := range statements {
+        fmt.Fprintf(&b, "tokenshield_db_statement_prepare_errors_total{statement=%q} %d\n", st.Name, st.PrepareErrors)
+    }
+    
+    up := ut.upstream.Stats()
+    fmt.Fprintf(&b, "# HELP tokenshield_upstream_circuit_state Upstream circuit breaker state: 0 closed, 1 open, 2 half-open.\n")
+    fmt.Fprintf(&b, "# TYPE tokenshield_upstream_circuit_state gauge\n")
+    fmt.Fprintf(&b, "tokenshield_upstream_circuit_state{upstream=%q} %d\n", up.Upstream, up.State)
+    fmt.Fprintf(&b, "# HELP tokenshield_upstream_consecutive_failures Failed upstream requests since the last success.\n")
+    fmt.Fprintf(&b, "# TYPE tokenshield_upstream_consecutive_failures gauge\n")
+    fmt.Fprintf(&b, "tokenshield_upstream_consecutive_failures{upstream=%q} %d\n", up.Upstream, up.ConsecutiveFailures)
+    fmt.Fprintf(&b, "# HELP tokenshield_upstream_in_flight Requests being forwarded to the upstream.\n")
+    fmt.Fprintf(&b, "# TYPE tokenshield_upstream_in_flight gauge\n")
+    fmt.Fprintf(&b, "tokenshield_upstream_in_flight{upstream=%q} %d\n", up.Upstream, up.InFlight)
+    fmt.Fprintf(&b, "# HELP tokenshield_upstream_requests_total Requests sent to the upstream, including retries.\n")
+    fmt.Fprintf(&b, "# TYPE tokenshield_upstream_requests_total counter\n")
+    fmt.Fprintf(&b, "tokenshield_upstream_requests_total{upstream=%q} %d\n", up.Upstream, up.Requests)
+    fmt.Fprintf(&b, "# HELP tokenshield_upstream_failures_total Upstream requests that failed or returned 5xx.\n")
+    fmt.Fprintf(&b, "# TYPE tokenshield_upstream_failures_total counter\n")
+    fmt.Fprintf(&b, "tokenshield_upstream_failures_total{upstream=%q} %d\n", up.Upstream, up.Failures)
+    fmt.Fprintf(&b, "# HELP tokenshield_upstream_retries_total Upstream requests retried, and retries skipped because the retry budget was spent.\n")
+    fmt.Fprintf(&b, "# TYPE tokenshield_upstream_retries_total counter\n")
+    fmt.Fprintf(&b, "tokenshield_upstream_retries_total{upstream=%q,result=\"sent\"} %d\n", up.Upstream, up.Retries)
+    fmt.Fprintf(&b, "tokenshield_upstream_retries_total{upstream=%q,result=\"denied\"} %d\n", up.Upstream, up.RetriesDenied)
+    if len(up.Routes) > 0 {
+        fmt.Fprintf(&b, "# HELP tokenshield_upstream_route_retries_total Retries on each UPSTREAM_RETRY_ROUTES route, and retries skipped because its budget was spent.\n")
+        fmt.Fprintf(&b, "# TYPE tokenshield_upstream_route_retries_total counter\n")
+        for _, route := range up.Routes {
+            fmt.Fprintf(&b, "tokenshield_upstream_route_retries_total{upstream=%q,route=%q,result=\"sent\"} %d\n", up.Upstream, route.Prefix, route.Retries)
+            fmt.Fprintf(&b, "tokenshield_upstream_route_retries_total{upstream=%q,route=%q,result=\"denied\"} %d\n", up.Upstream, route.Prefix, route.RetriesDenied)
+        }
+    }
+    fmt.Fprintf(&b, "# HELP tokenshield_upstream_rejected_total Requests answered 503 without contacting the upstream.\n")
+    fmt.Fprintf(&b, "# TYPE tokenshield_upstream_rejected_total counter\n")
+    fmt.Fprintf(&b, "tokenshield_upstream_rejected_total{upstream=%q,reason=\"circuit_open\"} %d\n", up.Upstream, up.RejectedOpen)
+    fmt.Fprintf(&b, "tokenshield_upstream_rejected_total{upstream=%q,reason=\"saturated\"} %d\n", up.Upstream, up.RejectedSaturated)
+    fmt.Fprintf(&b, "# HELP tokenshield_upstream_circuit_opens_total Times the upstream circuit breaker opened.\n")
+    fmt.Fprintf(&b, "# TYPE tokenshield_upstream_circuit_opens_total counter\n")
+    fmt.Fprintf(&b, "tokenshield_upstream_circuit_opens_total{upstream=%q} %d\n", up.Upstream, up.Opens)
+    insecure := 0
+    if ut.upstreamInsecure {
+        insecure = 1
+    }
+    fmt.Fprintf(&b, "# HELP tokenshield_upstream_tls_insecure 1 when the upstream certificate is not verified (UPSTREAM_TLS_INSECURE_SKIP_VERIFY).\n")
+    fmt.Fprintf(&b, "# TYPE tokenshield_upstream_tls_insecure gauge\n")
+    fmt.Fprintf(&b, "tokenshield_upstream_tls_insecure{upstream=%q} %d\n", up.Upstream, insecure)
+    
+    fmt.Fprintf(&b, "# HELP tokenshield_proxy_passthrough_total Proxied requests and responses streamed without buffering or scanning.\n")
+    fmt.Fprintf(&b, "# TYPE tokenshield_proxy_passthrough_total counter\n")
+    fmt.Fprintf(&b, "tokenshield_proxy_passthrough_total{direction=\"request\"} %d\n", atomic.LoadInt64(&ut.passthroughRequests))
+    fmt.Fprintf(&b, "tokenshield_proxy_passthrough_total{direction=\"response\"} %d\n", atomic.LoadInt64(&ut.passthroughResponses))
+    
+    fmt.Fprintf(&b, "# HELP tokenshield_proxy_body_rejected_total Proxied requests refused because the body exceeded its limit.\n")
+    fmt.Fprintf(&b, "# TYPE tokenshield_proxy_body_rejected_total counter\n")
+    fmt.Fprintf(&b, "tokenshield_proxy_body_rejected_total %d\n", atomic.LoadInt64(&ut.bodiesRejected))
+    fmt.Fprintf(&b, "# HELP tokenshield_proxy_requests_total Requests answered on the proxy port, by status class.\n")
+    fmt.Fprintf(&b, "# TYPE tokenshield_proxy_requests_total counter\n")
+    for i := range ut.proxyResponses {
+        fmt.Fprintf(&b, "tokenshield_proxy_requests_total{code=\"%dxx\"} %d\n", i+1, atomic.LoadInt64(&ut.proxyResponses[i]))
+    }
+    fmt.Fprintf(&b, "# HELP tokenshield_proxy_request_seconds_total Time spent answering requests on the proxy port.\n")
+    fmt.Fprintf(&b, "# TYPE tokenshield_proxy_request_seconds_total counter\n")
+    fmt.Fprintf(&b, "tokenshield_proxy_request_seconds_total %.6f\n", float64(atomic.LoadInt64(&ut.proxyDurationMicros))/1e6)
+    inMaintenance, configFrozen := 0, 0
+    maintenanceState := ut.currentMaintenance()
+    if maintenanceState.Enabled {
+        inMaintenance = 1
+    }
+    if maintenanceState.ConfigFreeze {
+        configFrozen = 1
+    }
+    fmt.Fprintf(&b, "# HELP tokenshield_maintenance_mode 1 while maintenance mode is on.\n")
+    fmt.Fprintf(&b, "# TYPE tokenshield_maintenance_mode gauge\n")
+    fmt.Fprintf(&b, "tokenshield_maintenance_mode %d\n", inMaintenance)
+    fmt.Fprintf(&b, "# HELP tokenshield_config_frozen 1 while configuration changes through the API are frozen.\n")
+    fmt.Fprintf(&b, "# TYPE tokenshield_config_frozen gauge\n")
+    fmt.Fprintf(&b, "tokenshield_config_frozen %d\n", configFrozen)
+    fmt.Fprintf(&b, "# HELP tokenshield_maintenance_refused_total Requests refused, or passed on without detokenization, because of maintenance mode or the config freeze.\n")
+    fmt.Fprintf(&b, "# TYPE tokenshield_maintenance_refused_total counter\n")
+    for i, what := range maintenanceRefusals {
+        fmt.Fprintf(&b, "tokenshield_maintenance_refused_total{what=\"%s\"} %d\n", what, atomic.LoadInt64(&ut.maintenanceRefused[i]))
+    }
+    fmt.Fprintf(&b, "# HELP tokenshield_proxy_card_policy_total Proxied requests carrying a card number on a path whose card policy is reject or alert.\n")
+    fmt.Fprintf(&b, "# TYPE tokenshield_proxy_card_policy_total counter\n")
+    fmt.Fprintf(&b, "tokenshield_proxy_card_policy_total{policy=\"reject\"} %d\n", atomic.LoadInt64(&ut.cardPolicyRejected))
+    fmt.Fprintf(&b, "tokenshield_proxy_card_policy_total{policy=\"alert\"} %d\n", atomic.LoadInt64(&ut.cardPolicyAlerted))
+    fmt.Fprintf(&b, "# HELP tokenshield_notifications_total Security event notifications by channel: sent, failed, or held back by the channel's throttle.\n")
+    fmt.Fprintf(&b, "# TYPE tokenshield_notifications_total counter\n")
+    for _, channel := range ut.notifier.Status() {
+        fmt.Fprintf(&b, "tokenshield_notifications_total{channel=\"%s\",result=\"sent\"} %d\n", channel.Name, channel.Sent)
+        fmt.Fprintf(&b, "tokenshield_notifications_total{channel=\"%s\",result=\"failed\"} %d\n", channel.Name, channel.Failed)
+        fmt.Fprintf(&b, "tokenshield_notifications_total{channel=\"%s\",result=\"throttled\"} %d\n", channel.Name, channel.Throttled)
+    }
+    fmt.Fprintf(&b, "# HELP tokenshield_notifications_dropped_total Security events not notified because the notification queue was full.\n")
+    fmt.Fprintf(&b, "# TYPE tokenshield_notifications_dropped_total counter\n")
+    fmt.Fprintf(&b, "tokenshield_notifications_dropped_total %d\n", ut.notifier.Dropped())
+    fmt.Fprintf(&b, "# HELP tokenshield_proxy_body_spooled_total Proxied request bodies too large to buffer in memory, held in encrypted temporary files.\n")
+    fmt.Fprintf(&b, "# TYPE tokenshield_proxy_body_spooled_total counter\n")
+    fmt.Fprintf(&b, "tokenshield_proxy_body_spooled_total %d\n", atomic.LoadInt64(&ut.bodiesSpooled))
+    fmt.Fprintf(&b, "# HELP tokenshield_proxy_body_decoded_total Proxied gzip or deflate bodies decoded for inspection.\n")
+    fmt.Fprintf(&b, "# TYPE tokenshield_proxy_body_decoded_total counter\n")
+    fmt.Fprintf(&b, "tokenshield_proxy_body_decoded_total{direction=\"request\"} %d\n", atomic.LoadInt64(&ut.bodiesDecoded))
+    fmt.Fprintf(&b, "tokenshield_proxy_body_decoded_total{direction=\"response\"} %d\n", atomic.LoadInt64(&ut.responsesDecoded))
+    fmt.Fprintf(&b, "# HELP tokenshield_proxy_body_transcoded_total Proxied bodies converted from ISO-8859-1, Windows-1252 or UTF-16 for inspection.\n")
+    fmt.Fprintf(&b, "# TYPE tokenshield_proxy_body_transcoded_total counter\n")
+    fmt.Fprintf(&b, "tokenshield_proxy_body_transcoded_total{direction=\"request\"} %d\n", atomic.LoadInt64(&ut.bodiesTranscoded))
+    fmt.Fprintf(&b, "tokenshield_proxy_body_transcoded_total{direction=\"response\"} %d\n", atomic.LoadInt64(&ut.responsesTranscoded))
+    fmt.Fprintf(&b, "# HELP tokenshield_deep_scan_replaced_total String fields named by DEEP_SCAN_FIELDS whose nested JSON had card numbers or tokens replaced.\n")
+    fmt.Fprintf(&b, "# TYPE tokenshield_deep_scan_replaced_total counter\n")
+    fmt.Fprintf(&b, "tokenshield_deep_scan_replaced_total{encoding=\"json\"} %d\n", atomic.LoadInt64(&ut.deepScanJSON))
+    fmt.Fprintf(&b, "tokenshield_deep_scan_replaced_total{encoding=\"base64\"} %d\n", atomic.LoadInt64(&ut.deepScanBase64))
+    
+    if ut.smtpServer != nil {
+        fmt.Fprintf(&b, "# HELP tokenshield_smtp_messages_total Emails handled by the SMTP filter, by outcome.\n")
+        fmt.Fprintf(&b, "# TYPE tokenshield_smtp_messages_total counter\n")
+        fmt.Fprintf(&b, "tokenshield_smtp_messages_total{result=\"clean\"} %d\n", atomic.LoadInt64(&ut.smtpClean))
+        fmt.Fprintf(&b, "tokenshield_smtp_messages_total{result=\"replaced\"} %d\n", atomic.LoadInt64(&ut.smtpReplaced))
+        fmt.Fprintf(&b, "tokenshield_smtp_messages_total{result=\"rejected\"} %d\n", atomic.LoadInt64(&ut.smtpRejected))
+        fmt.Fprintf(&b, "# HELP tokenshield_smtp_card_numbers_total Card numbers replaced in email.\n")
+        fmt.Fprintf(&b, "# TYPE tokenshield_smtp_card_numbers_total counter\n")
+        fmt.Fprintf(&b, "tokenshield_smtp_card_numbers_total %d\n", atomic.LoadInt64(&ut.smtpCards))
+        fmt.Fprintf(&b, "# HELP tokenshield_smtp_unscanned_parts_total Email parts that could not be scanned: binary attachments and unknown charsets or encodings.\n")
+        fmt.Fprintf(&b, "# TYPE tokenshield_smtp_unscanned_parts_total counter\n")
+        fmt.Fprintf(&b, "tokenshield_smtp_unscanned_parts_total %d\n", atomic.LoadInt64(&ut.smtpUnscanned))
+    }
+    
+    if ut.batchWatcher != nil {
+        fmt.Fprintf(&b, "# HELP tokenshield_batch_files_total Batch files taken from the inbox, by outcome.\n")
+        fmt.Fprintf(&b, "# TYPE tokenshield_batch_files_total counter\n")
+        fmt.Fprintf(&b, "tokenshield_batch_files_total{result=\"completed\"} %d\n", atomic.LoadInt64(&ut.batchCompleted))
+        fmt.Fprintf(&b, "tokenshield_batch_files_total{result=\"failed\"} %d\n", atomic.LoadInt64(&ut.batchFailed))
+        fmt.Fprintf(&b, "# HELP tokenshield_batch_card_numbers_total Card numbers in batch files, tokenized in card columns or masked elsewhere.\n")
+        fmt.Fprintf(&b, "# TYPE tokenshield_batch_card_numbers_total counter\n")
+        fmt.Fprintf(&b, "tokenshield_batch_card_numbers_total{action=\"tokenized\"} %d\n", atomic.LoadInt64(&ut.batchTokenized))
+        fmt.Fprintf(&b, "tokenshield_batch_card_numbers_total{action=\"masked\"} %d\n", atomic.LoadInt64(&ut.batchMasked))
+    }
+    
+    if ut.kafkaBridge != nil {
+        fmt.Fprintf(&b, "# HELP tokenshield_kafka_bridge_active Whether this replica holds the lock and runs the Kafka bridge.\n")
+        fmt.Fprintf(&b, "# TYPE tokenshield_kafka_bridge_active gauge\n")
+        fmt.Fprintf(&b, "tokenshield_kafka_bridge_active %d\n", atomic.LoadInt32(&ut.kafkaActive))
+        fmt.Fprintf(&b, "# HELP tokenshield_kafka_messages_total Kafka messages handled by the bridge, by outcome.\n")
+        fmt.Fprintf(&b, "# TYPE tokenshield_kafka_messages_total counter\n")
+        fmt.Fprintf(&b, "tokenshield_kafka_messages_total{result=\"unchanged\"} %d\n", atomic.LoadInt64(&ut.kafkaUnchanged))
+        fmt.Fprintf(&b, "tokenshield_kafka_messages_total{result=\"replaced\"} %d\n", atomic.LoadInt64(&ut.kafkaReplaced))
+        fmt.Fprintf(&b, "tokenshield_kafka_messages_total{result=\"dead_lettered\"} %d\n", atomic.LoadInt64(&ut.kafkaDeadLetters))
+        fmt.Fprintf(&b, "# HELP tokenshield_kafka_card_numbers_masked_total Card numbers masked in Kafka messages outside card fields.\n")
+        fmt.Fprintf(&b, "# TYPE tokenshield_kafka_card_numbers_masked_total counter\n")
+        fmt.Fprintf(&b, "tokenshield_kafka_card_numbers_masked_total %d\n", atomic.LoadInt64(&ut.kafkaMasked))
+        fmt.Fprintf(&b, "# HELP tokenshield_kafka_bridge_retries_total Times the Kafka bridge stopped on an error and resumed from the committed offsets.\n")
+        fmt.Fprintf(&b, "# TYPE tokenshield_kafka_bridge_retries_total counter\n")
+        fmt.Fprintf(&b, "tokenshield_kafka_bridge_retries_total %d\n", atomic.LoadInt64(&ut.kafkaRetries))
+    }
+    
+    fmt.Fprintf(&b, "# HELP tokenshield_ip_blocked_total Requests and connections refused by a listener's IP filter.\n")
+    fmt.Fprintf(&b, "# TYPE tokenshield_ip_blocked_total counter\n")
+    fmt.Fprintf(&b, "tokenshield_ip_blocked_total{listener=\"api\"} %d\n", atomic.LoadInt64(&ut.ipBlockedAPI))
+    fmt.Fprintf(&b, "tokenshield_ip_blocked_total{listener=\"icap\"} %d\n", atomic.LoadInt64(&ut.ipBlockedICAP))
+    
+    fmt.Fprintf(&b, "# HELP tokenshield_detokenize_quota_exceeded_total Card reveals refused because a user or API key quota was used up.\n")
+    fmt.Fprintf(&b, "# TYPE tokenshield_detokenize_quota_exceeded_total counter\n")
+    fmt.Fprintf(&b, "tokenshield_detokenize_quota_exceeded_total %d\n", atomic.LoadInt64(&ut.quotaRejections))
+    
+    fmt.Fprintf(&b, "# HELP tokenshield_rate_limited_total API and proxy requests refused by a rate-limit rule.\n")
+    fmt.Fprintf(&b, "# TYPE tokenshield_rate_limited_total counter\n")
+    fmt.Fprintf(&b, "tokenshield_rate_limited_total %d\n", atomic.LoadInt64(&ut.rateLimited))
+    
+    fmt.Fprintf(&b, "# HELP tokenshield_api_deprecated_requests_total API requests served by a deprecated endpoint.\n")
+    fmt.Fprintf(&b, "# TYPE tokenshield_api_deprecated_requests_total counter\n")
+    fmt.Fprintf(&b, "tokenshield_api_deprecated_requests_total %d\n", atomic.LoadInt64(&ut.deprecatedRequests))
+    
+    fmt.Fprintf(&b, "# HELP tokenshield_suspicious_input_total API requests with input matching a WAF detection rule (logged, not blocked).\n")
+    fmt.Fprintf(&b, "# TYPE tokenshield_suspicious_input_total counter\n")
+    fmt.Fprintf(&b, "tokenshield_suspicious_input_total %d\n", atomic.LoadInt64(&ut.suspiciousInputs))
+    
+    fmt.Fprintf(&b, "# HELP tokenshield_token_collisions_total Generated tokens that were already taken and regenerated.\n")
+    fmt.Fprintf(&b, "# TYPE tokenshield_token_collisions_total counter\n")
+    fmt.Fprintf(&b, "tokenshield_token_collisions_total %d\n", atomic.LoadInt64(&ut.tokenCollisions))
+    if ut.tokenFormat == "luhn" {
+        space, _ := new(big.Float).SetInt(ut.luhnTokenSpace).Float64()
+        fmt.Fprintf(&b, "# HELP tokenshield_luhn_token_space Distinct Luhn-format tokens the configured BINs can issue.\n")
+        fmt.Fprintf(&b, "# TYPE tokenshield_luhn_token_space gauge\n")
+        fmt.Fprintf(&b, "tokenshield_luhn_token_space %g\n", space)
+    }
+    if ut.peers != nil {
+        if peerStats := ut.peers.Stats(); len(peerStats) > 0 {
+            fmt.Fprintf(&b, "# HELP tokenshield_peer_lookups_total Tokens of another region missing here, looked up on that region: found, missing there too, or failed.\n")
+            fmt.Fprintf(&b, "# TYPE tokenshield_peer_lookups_total counter\n")
+            for _, p := range peerStats {
+                fmt.Fprintf(&b, "tokenshield_peer_lookups_total{region=%q,result=\"found\"} %d\n", p.Region, p.Found)
+                fmt.Fprintf(&b, "tokenshield_peer_lookups_total{region=%q,result=\"missing\"} %d\n", p.Region, p.Missing)
+                fmt.Fprintf(&b, "tokenshield_peer_lookups_total{region=%q,result=\"error\"} %d\n", p.Region, p.Errors)
+            }
+        }
+    }
+    if engineStats := ut.engines.Stats(); len(engineStats) > 0 {
+        fmt.Fprintf(&b, "# HELP tokenshield_engine_calls_total Calls to external tokenization engines: cards tokenized, tokens detokenized, tokens the engine did not know, or failed.\n")
+        fmt.Fprintf(&b, "# TYPE tokenshield_engine_calls_total counter\n")
+        for _, e := range engineStats {
+            fmt.Fprintf(&b, "tokenshield_engine_calls_total{engine=%q,result=\"tokenized\"} %d\n", e.Engine, e.Tokenized)
+            fmt.Fprintf(&b, "tokenshield_engine_calls_total{engine=%q,result=\"detokenized\"} %d\n", e.Engine, e.Detokenized)
+            fmt.Fprintf(&b, "tokenshield_engine_calls_total{engine=%q,result=\"not_found\"} %d\n", e.Engine, e.NotFound)
+            fmt.Fprintf(&b, "tokenshield_engine_calls_total{engine=%q,result=\"error\"} %d\n", e.Engine, e.Errors)
+        }
+    }
+    if connectorStats := ut.networkTokens.Stats(); len(connectorStats) > 0 {
+        fmt.Fprintf(&b, "# HELP tokenshield_network_token_calls_total Calls to scheme token services: network tokens provisioned, cryptograms issued, network tokens deleted, or failed.\n")
+        fmt.Fprintf(&b, "# TYPE tokenshield_network_token_calls_total counter\n")
+        for _, c := range connectorStats {
+            fmt.Fprintf(&b, "tokenshield_network_token_calls_total{scheme=%q,result=\"provisioned\"} %d\n", c.Scheme, c.Provisioned)
+            fmt.Fprintf(&b, "tokenshield_network_token_calls_total{scheme=%q,result=\"cryptogram\"} %d\n", c.Scheme, c.Cryptograms)
+            fmt.Fprintf(&b, "tokenshield_network_token_calls_total{scheme=%q,result=\"deleted\"} %d\n", c.Scheme, c.Deleted)
+            fmt.Fprintf(&b, "tokenshield_network_token_calls_total{scheme=%q,result=\"error\"} %d\n", c.Scheme, c.Errors)
+        }
+    }
+    
+    fmt.Fprintf(&b, "# HELP tokenshield_event_stream_subscribers Connected event stream clients.\n")
+    fmt.Fprintf(&b, "# TYPE tokenshield_event_stream_subscribers gauge\n")
+    fmt.Fprintf(&b, "tokenshield_event_stream_subscribers %d\n", ut.eventBroker.Subscribers())
+    
+    if ut.unsealer != nil {
+        sealed := 0
+        if ut.keyManager.IsSealed() {
+            sealed = 1
+        }
+        fmt.Fprintf(&b, "# HELP tokenshield_sealed Whether the vault is waiting for key shares.\n")
+        fmt.Fprintf(&b, "# TYPE tokenshield_sealed gauge\n")
+        fmt.Fprintf(&b, "tokenshield_sealed %d\n", sealed)
+    }
+    
+    w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+    io.WriteString(w, b.String())
+}
+
+func (ut *UnifiedTokenizer) authenticateAPIRequest(r *http.Request) bool {
+    apiKey := r.Header.Get("X-API-Key")
+    if apiKey == "" {
+        return false
+    }
+    
+    var count int
+    stmt, err := ut.stmts.Get(stmtCheckAPIKey)
+    if err == nil {
+        err = stmt.QueryRow(apiKey).Scan(&count)
+    }
+    
+    return err == nil && count > 0
+}
+
+// tokenPage is one page of the token list
+type tokenPage struct {
+    Tokens []map[string]interface{}
+    Total  int
+    Limit  int
+    Offset int
+}
+
+func (ut *UnifiedTokenizer) handleAPIListTokens(w http.ResponseWriter, r *http.Request) {
+    // Permission check is handled by requirePermission middleware
+    page, ok := ut.listTokens(w, r)
+    if !ok {
+        return
+    }
+    
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(map[string]interface{}{
+        "tokens": page.Tokens,
+        "total":  page.Total,
+    })
+}
+
+// handleAPIListTokensV2 is the v2 token list, with the items under "data"
+// and the paging under "meta" like every v2 list
+func (ut *UnifiedTokenizer) handleAPIListTokensV2(w http.ResponseWriter, r *http.Request) {
+    page, ok := ut.listTokens(w, r)
+    if !ok {
+        return
+    }
+    
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(listEnvelope{
+        Data: page.Tokens,
+        Meta: listMeta{Total: page.Total, Limit: page.Limit, Offset: page.Offset},
+    })
+}
+
+// listEnvelope is the body of every v2 list response
+type listEnvelope struct {
+    Data interface{} `json:"data"`
+    Meta listMeta    `json:"meta"`
+}
+
+type listMeta struct {
+    Total  int `json:"total"`
+    Limit  int `json:"limit"`
+    Offset int `json:"offset"`
+}
+
+// listTokens reads the page of tokens r asks for. On failure it writes the
+// error response and returns false.
+func (ut *UnifiedTokenizer) listTokens(w http.ResponseWriter, r *http.Request) (*tokenPage, bool) {
+    // Parse query parameters
+    limitStr := r.URL.Query().Get("limit")
+    offsetStr := r.URL.Query().Get("offset")
+    
+    limit := 100 // default
+    if limitStr != "" {
+        if l, err := strconv.Atoi(limitStr); err == nil && l > 0 && l <= 1000 {
+            limit = l
+        }
+    }
+    
+    offset := 0 // default
+    if offsetStr != "" {
+        if o, err := strconv.Atoi(offsetStr); err == nil && o >= 0 {
+            offset = o
+        }
+    }
+    
+    // Repeated tag=key=value parameters narrow the list to tokens with all
+    // of those tags
+    tags := make(map[string]string)
+    for _, param := range r.URL.Query()["tag"] {
+        key, value, err := parseTag(param)
+        if err != nil {
+            apierror.Write(w, r, http.StatusBadRequest, apierror.InvalidRequest, err.Error())
+            return nil, false
+        }
+        tags[key] = value
+    }
+    query := tokenSearchColumns.Select()
+    if err := addTagConds(query, tags); err != nil {
+        apierror.Write(w, r, http.StatusBadRequest, apierror.InvalidRequest, err.Error())
+        return nil, false
+    }
+    // Callers with tokens.own instead of tokens.read see only the cards
+    // imported for them
+    if owner := ownerScope(r, PermTokensRead); owner != "" {
+        query.Eq("created_by", owner)
+    }
+    whereClause, args, err := query.WhereClause()
+    if err != nil {
+        log.Printf("Token list query: %v", err)
+        apierror.Write(w, r, http.StatusInternalServerError, apierror.InternalError, "Database error")
+        return nil, false
+    }
+    
+    // Get total count
+    var total int
+    err = ut.db.QueryRow("SELECT COUNT(*) FROM credit_cards"+whereClause, args...).Scan(&total)
+    if err != nil {
+        apierror.Write(w, r, http.StatusInternalServerError, apierror.InternalError, "Database error")
+        return nil, false
+    }
+    
+    // Get tokens with pagination
+    rows, err := ut.db.Query(`
+        SELECT token, card_type, last_four_digits, first_six_digits, 
+               created_at, is_active
+        FROM credit_cards`+whereClause+`
+        ORDER BY created_at DESC
+        LIMIT ? OFFSET ?
+    `, append(args, limit, offset)...)
+    if err != nil {
+        apierror.Write(w, r, http.StatusInternalServerError, apierror.InternalError, "Internal server error")
+        return nil, false
+    }
+    defer rows.Close()
+    
+    tokens := []map[string]interface{}{}
+    for rows.Next() {
+        var token, cardType, lastFour, firstSix string
+        var createdAt sql.NullTime
+        var isActive bool
+        
+        var cardTypeNull sql.NullString
+        if err := rows.Scan(&token, &cardTypeNull, &lastFour, &firstSix, &createdAt, &isActive); err != nil {
+            log.Printf("Error scanning row: %v", err)
+            continue
+        }
+        
+        if cardTypeNull.Valid {
+            cardType = cardTypeNull.String
+        }
+        
+        tokenData := map[string]interface{}{
+            "token":      token,
+            "card_type":  cardType,
+            "last_four":  lastFour,
+            "first_six":  firstSix,
+            "is_active":  isActive,
+        }
+        
+        if createdAt.Valid {
+            tokenData["created_at"] = createdAt.Time.Format(time.RFC3339)
+        }
+        
+        tokens = append(tokens, tokenData)
+    }
+    
+    if err := ut.addTokenTags(tokens); err != nil {
+        log.Printf("Token list tags: %v", err)
+    }
+    return &tokenPage{Tokens: tokens, Total: total, Limit: limit, Offset: offset}, true
+}
+
+func (ut *UnifiedTokenizer) handleAPIGetToken(w http.ResponseWriter, r *http.Request) {
+    // Permission check is handled by requirePermission middleware
+    
+    // Extract token from URL path
+    token := strings.TrimPrefix(r.URL.Path, "/api/v1/tokens/")
+    if token == "" {
+        apierror.Write(w, r, http.StatusBadRequest, apierror.InvalidRequest, "Token required")
+        return
+    }
+    
+    var cardType, lastFour, firstSix string
+    var createdAt, updatedAt, revokedAt, purgeAfter sql.NullTime
+    var isActive bool
+    var cardTypeNull, keyID, tenant, source, cardRegion, keyStatus sql.NullString
+    var expiryMonth, expiryYear, encryptionVersion, keyVersion sql.NullInt64
+    var encryptedHolder, encryptedExternalID, encryptedMetadata []byte
+    
+    // Callers with tokens.own instead of tokens.read only see the cards
+    // imported for them; others' are not found
+    owner := ownerScope(r, PermTokensRead)
+    
+    // The key is joined for its version and status; legacy Fernet cards
+    // have no key ID
+    err := ut.db.QueryRow(`
+        SELECT c.card_type, c.last_four_digits, c.first_six_digits, 
+               c.created_at, c.updated_at, c.is_active, c.revoked_at, c.purge_after, c.card_holder_name_encrypted,
+               c.expiry_month, c.expiry_year, c.external_id_encrypted, c.tenant, c.source, c.region, c.metadata_encrypted,
+               c.encryption_key_id, c.encryption_version, k.key_version, k.key_status
+        FROM credit_cards c
+        LEFT JOIN encryption_keys k ON k.key_id = c.encryption_key_id
+        WHERE c.token = ? AND (? = '' OR c.created_by = ?)
+    `, token, owner, owner).Scan(&cardTypeNull, &lastFour, &firstSix, &createdAt, &updatedAt, &isActive, &revokedAt, &purgeAfter, &encryptedHolder,
+        &expiryMonth, &expiryYear, &encryptedExternalID, &tenant, &source, &cardRegion, &encryptedMetadata,
+        &keyID, &encryptionVersion, &keyVersion, &keyStatus)
+    
+    if err == sql.ErrNoRows {
+        apierror.Write(w, r, http.StatusNotFound, apierror.TokenNotFound, "Token not found")
+        return
+    } else if err != nil {
+        apierror.Write(w, r, http.StatusInternalServerError, apierror.InternalError, "Internal server error")
+        return
+    }
+    
+    if cardTypeNull.Valid {
+        cardType = cardTypeNull.String
+    }
+    
+    result := map[string]interface{}{
+        "token":      token,
+        "card_type":  cardType,
+        "last_four":  lastFour,
+        "first_six":  firstSix,
+        "is_active":  isActive,
+    }
+    
+    if expiryMonth.Valid && expiryYear.Valid {
+        result["expiry_month"] = expiryMonth.Int64
+        result["expiry_year"] = expiryYear.Int64
+    }
+    if tenant.Valid {
+        result["tenant"] = tenant.String
+    }
+    if source.Valid {
+        result["source"] = source.String
+    }
+    if cardRegion.Valid {
+        result["region"] = cardRegion.String
+    }
+    if fields, err := ut.decryptFields(keyID, encryptedExternalID, encryptedMetadata); err != nil {
+        log.Printf("Failed to decrypt external ID and metadata for token %s: %v", token, err)
+    } else {
+        if fields[0] != "" {
+            result["external_id"] = fields[0]
+        }
+        if fields[1] != "" {
+            result["metadata"] = json.RawMessage(fields[1])
+        }
+    }
+    if keyID.Valid && keyID.String != "" {
+        result["encryption_key_id"] = keyID.String
+        if keyVersion.Valid {
+            result["encryption_key_version"] = keyVersion.Int64
+        }
+        if keyStatus.Valid {
+            result["encryption_key_status"] = keyStatus.String
+        }
+    }
+    if encryptionVersion.Valid {
+        result["encryption_version"] = encryptionVersion.Int64
+    }
+    if updatedAt.Valid {
+        result["updated_at"] = updatedAt.Time.Format(time.RFC3339)
+    }
+    if revokedAt.Valid {
+        result["revoked_at"] = revokedAt.Time.Format(time.RFC3339)
+    }
+    if purgeAfter.Valid {
+        result["purge_after"] = purgeAfter.Time.Format(time.RFC3339)
+    }
+    
+    if createdAt.Valid {
+        result["created_at"] = createdAt.Time.Format(time.RFC3339)
+    }
+    
+    // The cardholder name is only decrypted for users allowed to see PII
+    if len(encryptedHolder) > 0 && ut.requestHasPermission(r, PermTokensReadPII) {
+        if name, err := ut.decryptStoredField(encryptedHolder, keyID); err != nil {
+            log.Printf("Failed to decrypt card holder for token %s: %v", token, err)
+        } else {
+            result["card_holder_name"] = name
+            ipAddress, userAgent := ut.getClientInfo(r)
+            ut.logAuditEvent(AuditEvent{
+                UserID:       r.Header.Get("X-User-ID"),
+                Action:       "card_holder_viewed",
+                ResourceType: "token",
+                ResourceID:   token,
+                IPAddress:    ipAddress,
+                UserAgent:    userAgent,
+            })
+        }
+    }
+
+    if tags, err := ut.tokenTags(token); err == nil {
+        result["tags"] = tags
+    } else {
+        log.Printf("Error loading tags for token: %v", err)
+    }
+
+    // Usage counters (detokenizations count as uses, tokenization is creation)
+    var useCount int
+    var lastUsedAt sql.NullTime
+    err = ut.db.QueryRow(`
+        SELECT COUNT(*), MAX(request_timestamp)
+        FROM token_requests
+        WHERE token = ? AND request_type = 'detokenize'
+    `, token).Scan(&useCount, &lastUsedAt)
+    if err == nil {
+        result["use_count"] = useCount
+        if lastUsedAt.Valid {
+            result["last_used_at"] = lastUsedAt.Time.Format(time.RFC3339)
+        }
+    } else {
+        log.Printf("Error loading usage counters for token: %v", err)
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(result)
+}
+
+// handleAPITokenActivity returns the request history for a single token
+func (ut *UnifiedTokenizer) handleAPITokenActivity(w http.ResponseWriter, r *http.Request) {
+    // Permission check is handled by requirePermission middleware
+
+    token := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/api/v1/tokens/"), "/activity")
+    if token == "" {
+        apierror.Write(w, r, http.StatusBadRequest, apierror.InvalidRequest, "Token required")
+        return
+    }
+
+    limit := 50
+    if l := r.URL.Query().Get("limit"); l != "" {
+        if parsed, err := strconv.Atoi(l); err == nil && parsed > 0 && parsed <= 1000 {
+            limit = parsed
+        }
+    }
+
+    offset := 0
+    if o := r.URL.Query().Get("offset"); o != "" {
+        if parsed, err := strconv.Atoi(o); err == nil && parsed >= 0 {
+            offset = parsed
+        }
+    }
+
+    // Make sure the token exists so unknown tokens return 404 instead of an empty history
+    var exists int
+    err := ut.db.QueryRow("SELECT COUNT(*) FROM credit_cards WHERE token = ?", token).Scan(&exists)
+    if err != nil {
+        apierror.Write(w, r, http.StatusInternalServerError, apierror.InternalError, "Database error")
+        return
+    }
+    if exists == 0 {
+        apierror.Write(w, r, http.StatusNotFound, apierror.TokenNotFound, "Token not found")
+        return
+    }
+
+    // Aggregate counters across the full history
+    summary := map[string]interface{}{
+        "tokenize_count":   0,
+        "detokenize_count": 0,
+        "forward_count":    0,
+    }
+    var total int
+    var firstSeen, lastSeen, lastUsed sql.NullTime
+    err = ut.db.QueryRow(`
+        SELECT COUNT(*), MIN(request_timestamp), MAX(request_timestamp),
+               MAX(CASE WHEN request_type = 'detokenize' THEN request_timestamp END)
+        FROM token_requests
+        WHERE token = ?
+    `, token).Scan(&total, &firstSeen, &lastSeen, &lastUsed)
+    if err != nil {
+        apierror.Write(w, r, http.StatusInternalServerError, apierror.InternalError, "Database error")
+        return
+    }
+    if firstSeen.Valid {
+        summary["first_seen_at"] = firstSeen.Time.Format(time.RFC3339)
+    }
+    if lastSeen.Valid {
+        summary["last_seen_at"] = lastSeen.Time.Format(time.RFC3339)
+    }
+    if lastUsed.Valid {
+        summary["last_used_at"] = lastUsed.Time.Format(time.RFC3339)
+    }
+
+    countRows, err := ut.db.Query(`
+        SELECT request_type, COUNT(*)
+        FROM token_requests
+        WHERE token = ?
+        GROUP BY request_type
+    `, token)
+    if err == nil {
+        for countRows.Next() {
+            var reqType string
+            var count int
+            if err := countRows.Scan(&reqType, &count); err == nil {
+                summary[reqType+"_count"] = count
+            }
+        }
+        countRows.Close()
+    }
+    summary["use_count"] = summary["detokenize_count"]
+
+    rows, err := ut.db.Query(`
+        SELECT tr.id, tr.request_type, tr.source_ip, tr.destination_url, tr.request_timestamp,
+               tr.response_status, tr.response_time_ms, tr.user_id, tr.api_key_used, k.client_name
+        FROM token_requests tr
+        LEFT JOIN api_keys k ON k.api_key = tr.api_key_used
+        WHERE tr.token = ?
+        ORDER BY tr.request_timestamp DESC
+        LIMIT ? OFFSET ?
+    `, token, limit, offset)
+    if err != nil {
+        apierror.Write(w, r, http.StatusInternalServerError, apierror.InternalError, "Database error")
+        return
+    }
+    defer rows.Close()
+
+    activities := []map[string]interface{}{}
+    for rows.Next() {
+        var id int64
+        var requestType string
+        var sourceIP, destinationURL, userID, apiKeyUsed, clientName sql.NullString
+        var requestTimestamp time.Time
+        var responseStatus, responseTime sql.NullInt64
+
+        err := rows.Scan(&id, &requestType, &sourceIP, &destinationURL, &requestTimestamp,
+                        &responseStatus, &responseTime, &userID, &apiKeyUsed, &clientName)
+        if err != nil {
+            continue
+        }
+
+        activity := map[string]interface{}{
+            "id":          id,
+            "type":        requestType,
+            "source_ip":   sourceIP.String,
+            "destination": destinationURL.String,
+            "timestamp":   requestTimestamp.Format(time.RFC3339),
+        }
+
+        if responseStatus.Valid {
+            activity["status"] = responseStatus.Int64
+        }
+        if responseTime.Valid {
+            activity["response_time_ms"] = responseTime.Int64
+        }
+        if userID.Valid && userID.String != "" {
+            activity["user_id"] = userID.String
+        }
+        // Keys are credentials, so only their last characters and name are shown
+        if apiKeyUsed.Valid && apiKeyUsed.String != "" {
+            activity["api_key"] = maskAPIKey(apiKeyUsed.String)
+            if clientName.Valid {
+                activity["api_key_name"] = clientName.String
+            }
+        }
+
+        activities = append(activities, activity)
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(map[string]interface{}{
+        "token":      token,
+        "summary":    summary,
+        "activities": activities,
+        "total":      total,
+        "limit":      limit,
+        "offset":     offset,
+    })
+}
+
+// RevealRequest is the body of POST /api/v1/tokens/{token}/reveal
+type RevealRequest struct {
+    Reason string `json:"reason"`
+}
+
+// handleAPIRevealToken resolves a single token for incident response.
+// GET returns the masked card (BIN and last four only) without decrypting;
+// POST decrypts and returns the full card number and requires a reason.
+func (ut *UnifiedTokenizer) handleAPIRevealToken(w http.ResponseWriter, r *http.Request) {
+    // Permission check is handled by requirePermission middleware
+
+    token := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/api/v1/tokens/"), "/reveal")
+    if token == "" {
+        apierror.Write(w, r, http.StatusBadRequest, apierror.InvalidRequest, "Token required")
+        return
+    }
+
+    var cardType sql.NullString
+    var lastFour, firstSix string
+    var expiryMonth, expiryYear sql.NullInt64
+    var isActive bool
+    err := ut.db.QueryRow(`
+        SELECT card_type, last_four_digits, first_six_digits, expiry_month, expiry_year, is_active
+        FROM credit_cards
+        WHERE token = ?
+    `, token).Scan(&cardType, &lastFour, &firstSix, &expiryMonth, &expiryYear, &isActive)
+    if err == sql.ErrNoRows {
+        apierror.Write(w, r, http.StatusNotFound, apierror.TokenNotFound, "Token not found")
+        return
+    } else if err != nil {
+        apierror.Write(w, r, http.StatusInternalServerError, apierror.InternalError, "Internal server error")
+        return
+    }
+
+    result := map[string]interface{}{
+        "token":       token,
+        "card_type":   cardType.String,
+        "masked_card": firstSix + "******" + lastFour,
+        "is_active":   isActive,
+    }
+    if expiryMonth.Valid && expiryYear.Valid {
+        result["expiry"] = fmt.Sprintf("%02d/%d", expiryMonth.Int64, expiryYear.Int64)
+    }
+
+    if r.Method == "GET" {
+        w.Header().Set("Content-Type", "application/json")
+        json.NewEncoder(w).Encode(result)
+        return
+    }
+
+    var req RevealRequest
+    if err := json.NewDecoder(r.Body).Decode(&req); err != nil || strings.TrimSpace(req.Reason) == "" {
+        apierror.Write(w, r, http.StatusBadRequest, apierror.InvalidRequest, "A reason is required to reveal a full card number")
+        return
+    }
+
+    if !isActive {
+        apierror.Write(w, r, http.StatusConflict, apierror.TokenRevoked, "Token has been revoked")
+        return
+    }
+
+    if m := ut.currentMaintenance(); m.Enabled {
+        atomic.AddInt64(&ut.maintenanceRefused[maintenanceReveal], 1)
+        w.Header().Set("Retry-After", strconv.Itoa(m.RetryAfter))
+        apierror.Write(w, r, http.StatusServiceUnavailable, apierror.MaintenanceMode, "Card numbers cannot be revealed during maintenance")
+        return
+    }
+
+    ipAddress, userAgent := ut.getClientInfo(r)
+    userID := r.Header.Get("X-User-ID")
+
+    if exceeded, err := ut.chargeDetokenizeQuota(quotaSubjects(r)); err != nil {
+        apierror.Write(w, r, http.StatusInternalServerError, apierror.InternalError, "Internal server error")
+        return
+    } else if exceeded != nil {
+        atomic.AddInt64(&ut.quotaRejections, 1)
+        ut.logSecurityEvent(SecurityEvent{
+            EventType: "detokenize_quota_exceeded",
+            Severity:  "high",
+            UserID:    userID,
+            Username:  r.Header.Get("X-Username"),
+            IPAddress: ipAddress,
+            UserAgent: userAgent,
+            Endpoint:  r.URL.Path,
+            Details: map[string]interface{}{
+                "quota":  exceeded.Subject.Type,
+                "period": exceeded.Period,
+                "limit":  exceeded.Limit,
+            },
+        })
+        w.Header().Set("Retry-After", strconv.Itoa(int(time.Until(exceeded.ResetsAt).Seconds())+1))
+        apierror.WriteDetails(w, r, http.StatusTooManyRequests, apierror.QuotaExceeded, "Detokenization quota exceeded", map[string]interface{}{
+            "quota":     exceeded.Subject.Type,
+            "period":    exceeded.Period,
+            "limit":     exceeded.Limit,
+            "resets_at": exceeded.ResetsAt.Format(time.RFC3339),
+        })
+        return
+    }
+
+    cardNumber := ut.retrieveCard(token)
+    if cardNumber == "" {
+        apierror.Write(w, r, http.StatusInternalServerError, apierror.InternalError, "Failed to decrypt card")
+        return
+    }
+
+    // Full reveals are rare and sensitive, so they go to both audit trails
+    ut.logAuditEvent(AuditEvent{
+        UserID:       userID,
+        Action:       "token_revealed",
+        ResourceType: "token",
+        ResourceID:   token,
+        IPAddress:    ipAddress,
+        UserAgent:    userAgent,
+        Details: map[string]interface{}{
+            "reason":    req.Reason,
+            "last_four": lastFour,
+        },
+    })
+    ut.logSecurityEvent(SecurityEvent{
+        EventType: "token_revealed",
+        Severity:  "high",
+        UserID:    userID,
+        Username:  r.Header.Get("X-Username"),
+        IPAddress: ipAddress,
+        UserAgent: userAgent,
+        Endpoint:  r.URL.Path,
+        Details: map[string]interface{}{
+            "token":  token,
+            "reason": req.Reason,
+        },
+    })
+
+    result["card_number"] = cardNumber
+    w.Header().Set("Cache-Control", "no-store")
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(result)
+}
+
+// quotaLimits are detokenizations allowed per UTC hour and day; 0 means
+// unlimited
+type quotaLimits struct {
+    Hourly int `json:"hourly_limit"`
+    Daily  int `json:"daily_limit"`
+}
+
+// quotaSubject is who a detokenization is charged to: a user, or the API
+// key or client certificate identity used. A request made with one is
+// charged to it and to its user.
+type quotaSubject struct {
+    Type string `json:"subject_type"` // "user", "api_key" or "client_cert"
+    ID   string `json:"subject_id"`
+}
+
+// QuotaUsage is one period of a subject's quota
+type QuotaUsage struct {
+    Limit    int       `json:"limit"` // 0 means unlimited
+    Used     int       `json:"used"`
+    ResetsAt time.Time `json:"resets_at"`
+}
+
+// QuotaStatus is a subject's detokenization quota and current usage
+type QuotaStatus struct {
+    quotaSubject
+    Source string     `json:"source"` // "default" for the DETOKENIZE_QUOTA_* settings, "override" once set through the API
+    Hourly QuotaUsage `json:"hourly"`
+    Daily  QuotaUsage `json:"daily"`
+}
+
+// quotaExceeded describes the quota that refused a detokenization
+type quotaExceeded struct {
+    Subject  quotaSubject
+    Period   string
+    Limit    int
+    ResetsAt time.Time
+}
+
+// quotaPeriods returns the start of the current UTC hour and day, and when
+// each ends
+func quotaPeriods(now time.Time) map[string][2]time.Time {
+    now = now.UTC()
+    hour := now.Truncate(time.Hour)
+    day := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+    return map[string][2]time.Time{
+        "hour": {hour, hour.Add(time.Hour)},
+        "day":  {day, day.AddDate(0, 0, 1)},
+    }
+}
+
+// quotaSubjects returns who a request authenticated by requirePermission
+// is charged to
+func quotaSubjects(r *http.Request) []quotaSubject {
+    var subjects []quotaSubject
+    if apiKey := r.Header.Get("X-Authenticated-API-Key"); apiKey != "" {
+        subjects = append(subjects, quotaSubject{Type: "api_key", ID: apiKey})
+    }
+    if certID := r.Header.Get("X-Authenticated-Client-Cert"); certID != "" {
+        subjects = append(subjects, quotaSubject{Type: "client_cert", ID: certID})
+    }
+    if userID := r.Header.Get("X-User-ID"); userID != "" && !strings.HasPrefix(userID, "api_key_") {
+        subjects = append(subjects, quotaSubject{Type: "user", ID: userID})
+    }
+    return subjects
+}
+
+// quotaLimitsFor returns a subject's limits: its override, or the defaults
+func (ut *UnifiedTokenizer) quotaLimitsFor(q interface {
+    QueryRow(query string, args ...interface{}) *sql.Row
+}, subject quotaSubject) (quotaLimits, bool, error) {
+    var hourly, daily sql.NullInt64
+    err := q.QueryRow(`
+        SELECT hourly_limit, daily_limit FROM detokenize_quotas
+        WHERE subject_type = ? AND subject_id = ?
+    `, subject.Type, subject.ID).Scan(&hourly, &daily)
+    if err == sql.ErrNoRows {
+        return ut.detokenizeQuota, false, nil
+    }
+    if err != nil {
+        return quotaLimits{}, false, err
+    }
+    limits := ut.detokenizeQuota
+    if hourly.Valid {
+        limits.Hourly = int(hourly.Int64)
+    }
+    if daily.Valid {
+        limits.Daily = int(daily.Int64)
+    }
+    return limits, true, nil
+}
+
+// chargeDetokenizeQuota counts one detokenization against each subject's
+// hourly and daily quota. If any quota is used up nothing is counted, and
+// the first one exceeded is returned. Counting happens in the database, so
+// the quotas hold across replicas.
+func (ut *UnifiedTokenizer) chargeDetokenizeQuota(subjects []quotaSubject) (*quotaExceeded, error) {
+    tx, err := ut.db.Begin()
+    if err != nil {
+        return nil, err
+    }
+    defer tx.Rollback()
+    
+    periods := quotaPeriods(time.Now())
+    for _, subject := range subjects {
+        limits, _, err := ut.quotaLimitsFor(tx, subject)
+        if err != nil {
+            return nil, err
+        }
+        for _, p := range []struct {
+            name  string
+            limit int
+        }{{"hour", limits.Hourly}, {"day", limits.Daily}} {
+            if p.limit == 0 {
+                continue
+            }
+            start := periods[p.name][0]
+            // The upsert locks the row, so concurrent requests are counted one at a time
+            if _, err := tx.Exec(`
+                INSERT INTO detokenize_usage (subject_type, subject_id, period, period_start, used) VALUES (?, ?, ?, ?, 1)
+                ON DUPLICATE KEY UPDATE used = used + 1
+            `, subject.Type, subject.ID, p.name, start); err != nil {
+                return nil, err
+            }
+            var used int
+            if err := tx.QueryRow(`
+                SELECT used FROM detokenize_usage
+                WHERE subject_type = ? AND subject_id = ? AND period = ? AND period_start = ?
+            `, subject.Type, subject.ID, p.name, start).Scan(&used); err != nil {
+                return nil, err
+            }
+            if used > p.limit {
+                return &quotaExceeded{Subject: subject, Period: p.name, Limit: p.limit, ResetsAt: periods[p.name][1]}, nil
+            }
+        }
+    }
+    return nil, tx.Commit()
+}
+
+// quotaStatus reports a subject's limits and what it has used this hour
+// and day
+func (ut *UnifiedTokenizer) quotaStatus(subject quotaSubject) (*QuotaStatus, error) {
+    limits, override, err := ut.quotaLimitsFor(ut.db, subject)
+    if err != nil {
+        return nil, err
+    }
+    status := &QuotaStatus{quotaSubject: subject, Source: "default"}
+    if override {
+        status.Source = "override"
+    }
+    periods := quotaPeriods(time.Now())
+    for _, p := range []struct {
+        name  string
+        limit int
+        usage *QuotaUsage
+    }{{"hour", limits.Hourly, &status.Hourly}, {"day", limits.Daily, &status.Daily}} {
+        *p.usage = QuotaUsage{Limit: p.limit, ResetsAt: periods[p.name][1]}
+        err := ut.db.QueryRow(`
+            SELECT used FROM detokenize_usage
+            WHERE subject_type = ? AND subject_id = ? AND period = ? AND period_start = ?
+        `, subject.Type, subject.ID, p.name, periods[p.name][0]).Scan(&p.usage.Used)
+        if err != nil && err != sql.ErrNoRows {
+            return nil, err
+        }
+    }
+    return status, nil
+}
+
+// pruneDetokenizeUsage removes usage counts for periods that have ended
+func (ut *UnifiedTokenizer) pruneDetokenizeUsage() {
+    if _, err := ut.db.Exec("DELETE FROM detokenize_usage WHERE period_start < ?", time.Now().UTC().AddDate(0, 0, -2)); err != nil {
+        log.Printf("Error pruning detokenization usage: %v", err)
+    }
+}
+
+// handleQuotas lists the default detokenization quotas and the overrides
+// at /api/v1/quotas
+func (ut *UnifiedTokenizer) handleQuotas(w http.ResponseWriter, r *http.Request) {
+    // Permission check is handled by requirePermission middleware
+    
+    rows, err := ut.db.Query(`
+        SELECT subject_type, subject_id, hourly_limit, daily_limit, updated_by, updated_at
+        FROM detokenize_quotas
+        ORDER BY subject_type, subject_id
+    `)
+    if err != nil {
+        apierror.Write(w, r, http.StatusInternalServerError, apierror.InternalError, "Database error")
+        return
+    }
+    defer rows.Close()
+    
+    overrides := []map[string]interface{}{}
+    for rows.Next() {
+        var subjectType, subjectID string
+        var hourly, daily sql.NullInt64
+        var updatedBy sql.NullString
+        var updatedAt time.Time
+        if err := rows.Scan(&subjectType, &subjectID, &hourly, &daily, &updatedBy, &updatedAt); err != nil {
+            continue
+        }
+        override := map[string]interface{}{
+            "subject_type": subjectType,
+            "subject_id":   subjectID,
+            "hourly_limit": nil,
+            "daily_limit":  nil,
+            "updated_by":   updatedBy.String,
+            "updated_at":   updatedAt.Format(time.RFC3339),
+        }
+        if hourly.Valid {
+            override["hourly_limit"] = hourly.Int64
+        }
+        if daily.Valid {
+            override["daily_limit"] = daily.Int64
+        }
+        overrides = append(overrides, override)
+    }
+    
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(map[string]interface{}{
+        "defaults":  ut.detokenizeQuota,
+        "overrides": overrides,
+    })
+}
+
+// handleMyQuota reports the caller's own detokenization quotas at
+// /api/v1/quotas/me
+func (ut *UnifiedTokenizer) handleMyQuota(w http.ResponseWriter, r *http.Request) {
+    // Permission check is handled by requirePermission middleware
+    
+    quotas := []*QuotaStatus{}
+    for _, subject := range quotaSubjects(r) {
+        status, err := ut.quotaStatus(subject)
+        if err != nil {
+            apierror.Write(w, r, http.StatusInternalServerError, apierror.InternalError, "Database error")
+            return
+        }
+        quotas = append(quotas, status)
+    }
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(map[string]interface{}{"quotas": quotas})
+}
+
+// QuotaLimits is the body of PUT /api/v1/quotas/...; a null or omitted
+// limit uses the default
+type QuotaLimits struct {
+    HourlyLimit *int `json:"hourly_limit"`
+    DailyLimit  *int `json:"daily_limit"`
+}
+
+// handleQuota shows (GET) or overrides (PUT) the detokenization quota of a
+// user, API key or client certificate identity at
+// /api/v1/quotas/users/{user_id}, /api/v1/quotas/api-keys/{api_key} and
+// /api/v1/quotas/client-certs/{cert_id}; DELETE goes back to the defaults
+func (ut *UnifiedTokenizer) handleQuota(w http.ResponseWriter, r *http.Request) {
+    // Permission check is handled by requirePermission middleware
+    
+    var subject quotaSubject
+    kind, id, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/api/v1/quotas/"), "/")
+    switch kind {
+    case "users":
+        subject = quotaSubject{Type: "user", ID: id}
+        err := ut.db.QueryRow("SELECT user_id FROM users WHERE user_id = ?", id).Scan(&id)
+        if err == sql.ErrNoRows || id == "" {
+            apierror.Write(w, r, http.StatusNotFound, apierror.UserNotFound, "User not found")
+            return
+        } else if err != nil {
+            apierror.Write(w, r, http.StatusInternalServerError, apierror.InternalError, "Database error")
+            return
+        }
+    case "api-keys":
+        subject = quotaSubject{Type: "api_key", ID: id}
+        err := ut.db.QueryRow("SELECT api_key FROM api_keys WHERE api_key = ?", id).Scan(&id)
+        if err == sql.ErrNoRows || id == "" {
+            apierror.Write(w, r, http.StatusNotFound, apierror.APIKeyNotFound, "API key not found")
+            return
+        } else if err != nil {
+            apierror.Write(w, r, http.StatusInternalServerError, apierror.InternalError, "Database error")
+            return
+        }
+    case "client-certs":
+        subject = quotaSubject{Type: "client_cert", ID: id}
+        err := ut.db.QueryRow("SELECT cert_id FROM client_certificates WHERE cert_id = ?", id).Scan(&id)
+        if err == sql.ErrNoRows || id == "" {
+            apierror.Write(w, r, http.StatusNotFound, apierror.ClientCertNotFound, "Client certificate identity not found")
+            return
+        } else if err != nil {
+            apierror.Write(w, r, http.StatusInternalServerError, apierror.InternalError, "Database error")
+            return
+        }
+    default:
+        apierror.Write(w, r, http.StatusNotFound, apierror.NotFound, "Not found")
+        return
+    }
+    
+    ipAddress, userAgent := ut.getClientInfo(r)
+    switch r.Method {
+    case "PUT":
+        var req QuotaLimits
+        dec := json.NewDecoder(r.Body)
+        dec.DisallowUnknownFields()
+        if err := dec.Decode(&req); err != nil {
+            apierror.Write(w, r, http.StatusBadRequest, apierror.InvalidBody, "Invalid request body")
+            return
+        }
+        if (req.HourlyLimit != nil && *req.HourlyLimit < 0) || (req.DailyLimit != nil && *req.DailyLimit < 0) {
+            apierror.Write(w, r, http.StatusBadRequest, apierror.InvalidRequest, "Limits must be 0 (unlimited) or more")
+            return
+        }
+        _, err := ut.db.Exec(`
+            INSERT INTO detokenize_quotas (subject_type, subject_id, hourly_limit, daily_limit, updated_by) VALUES (?, ?, ?, ?, ?)
+            ON DUPLICATE KEY UPDATE hourly_limit = VALUES(hourly_limit), daily_limit = VALUES(daily_limit), updated_by = VALUES(updated_by)
+        `, subject.Type, subject.ID, req.HourlyLimit, req.DailyLimit, r.Header.Get("X-Username"))
+        if err != nil {
+            apierror.Write(w, r, http.StatusInternalServerError, apierror.InternalError, "Database error")
+            return
+        }
+        ut.logAuditEvent(AuditEvent{
+            UserID:       r.Header.Get("X-User-ID"),
+            Action:       "detokenize_quota_updated",
+            ResourceType: subject.Type,
+            ResourceID:   subject.ID,
+            IPAddress:    ipAddress,
+            UserAgent:    userAgent,
+            Details: map[string]interface{}{
+                "hourly_limit": req.HourlyLimit,
+                "daily_limit":  req.DailyLimit,
+            },
+        })
+    case "DELETE":
+        if _, err := ut.db.Exec("DELETE FROM detokenize_quotas WHERE subject_type = ? AND subject_id = ?", subject.Type, subject.ID); err != nil {
+            apierror.Write(w, r, http.StatusInternalServerError, apierror.InternalError, "Database error")
+            return
+        }
+        ut.logAuditEvent(AuditEvent{
+            UserID:       r.Header.Get("X-User-ID"),
+            Action:       "detokenize_quota_reset",
+            ResourceType: subject.Type,
+            ResourceID:   subject.ID,
+            IPAddress:    ipAddress,
+            UserAgent:    userAgent,
+        })
+    }
+    
+    status, err := ut.quotaStatus(subject)
+    if err != nil {
+        apierror.Write(w, r, http.StatusInternalServerError, apierror.InternalError, "Database error")
+        return
+    }
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(status)
+}
+
+// handleAPIRevokeToken deactivates a token. The card is kept, and the token
+// can be restored, until it is purged TOKEN_PURGE_DAYS later.
+func (ut *UnifiedTokenizer) handleAPIRevokeToken(w http.ResponseWriter, r *http.Request) {
+    // Callers with tokens.own instead of tokens.delete can only revoke the
+    // cards imported for them; others' are not found
+    owner := ownerScope(r, PermTokensDelete)
+    
+    token := strings.TrimPrefix(r.URL.Path, "/api/v1/tokens/")
+    
+    // Revoking a revoked token again leaves its purge date alone
+    result, err := ut.db.Exec(`
+        UPDATE credit_cards 
+        SET is_active = FALSE, revoked_at = NOW(),
+            purge_after = IF(? > 0, DATE_ADD(NOW(), INTERVAL ? DAY), NULL)
+        WHERE token = ? AND is_active = TRUE AND (? = '' OR created_by = ?)
+    `, ut.tokenPurgeDays, ut.tokenPurgeDays, token, owner, owner)
+    
+    if err != nil {
+        apierror.Write(w, r, http.StatusInternalServerError, apierror.InternalError, "Internal server error")
+        return
+    }
+    
+    var purgeAfter sql.NullTime
+    err = ut.db.QueryRow("SELECT purge_after FROM credit_cards WHERE token = ? AND (? = '' OR created_by = ?)", token, owner, owner).Scan(&purgeAfter)
+    if err == sql.ErrNoRows {
+        apierror.Write(w, r, http.StatusNotFound, apierror.TokenNotFound, "Token not found")
+        return
+    } else if err != nil {
+        apierror.Write(w, r, http.StatusInternalServerError, apierror.InternalError, "Internal server error")
+        return
+    }
+    
+    response := map[string]interface{}{"message": "Token revoked successfully"}
+    if purgeAfter.Valid {
+        response["purge_after"] = purgeAfter.Time.Format(time.RFC3339)
+    }
+    
+    if rowsAffected, _ := result.RowsAffected(); rowsAffected > 0 {
+        ut.counters.AddActive(-rowsAffected)
+        ipAddress, userAgent := ut.getClientInfo(r)
+        ut.logAuditEvent(AuditEvent{
+            UserID:       r.Header.Get("X-User-ID"),
+            Action:       "token_revoked",
+            ResourceType: "token",
+            ResourceID:   token,
+            IPAddress:    ipAddress,
+            UserAgent:    userAgent,
+            Details:      map[string]interface{}{"purge_after": response["purge_after"]},
+        })
+    }
+    
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(response)
+}
+
+// handleAPIRestoreToken reactivates a revoked token whose card has not been
+// purged yet
+func (ut *UnifiedTokenizer) handleAPIRestoreToken(w http.ResponseWriter, r *http.Request) {
+    // Permission check is handled by requirePermission middleware
+    
+    token := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/api/v1/tokens/"), "/restore")
+    
+    var isActive bool
+    var cardIndex []byte
+    err := ut.db.QueryRow("SELECT is_active, card_number_index FROM credit_cards WHERE token = ?", token).Scan(&isActive, &cardIndex)
+    if err == sql.ErrNoRows {
+        apierror.Write(w, r, http.StatusNotFound, apierror.TokenNotFound, "Token not found")
+        return
+    } else if err != nil {
+        apierror.Write(w, r, http.StatusInternalServerError, apierror.InternalError, "Internal server error")
+        return
+    }
+    if isActive {
+        apierror.Write(w, r, http.StatusConflict, apierror.Conflict, "Token is not revoked")
+        return
+    }
+    
+    // With DETERMINISTIC_TOKENS a card has at most one active token, and it
+    // may have been given a new one since this one was revoked
+    if ut.deterministicTokens && len(cardIndex) > 0 {
+        var other string
+        err := ut.db.QueryRow(`
+            SELECT token FROM credit_cards
+            WHERE card_number_index = ? AND is_active = TRUE
+            LIMIT 1`, cardIndex).Scan(&other)
+        if err == nil {
+            apierror.WriteDetails(w, r, http.StatusConflict, apierror.Conflict, "Card has another active token", map[string]interface{}{"active_token": other})
+            return
+        } else if err != sql.ErrNoRows {
+            apierror.Write(w, r, http.StatusInternalServerError, apierror.InternalError, "Internal server error")
+            return
+        }
+    }
+    
+    result, err := ut.db.Exec(`
+        UPDATE credit_cards
+        SET is_active = TRUE, revoked_at = NULL, purge_after = NULL
+        WHERE token = ? AND is_active = FALSE
+    `, token)
+    if err != nil {
+        apierror.Write(w, r, http.StatusInternalServerError, apierror.InternalError, "Internal server error")
+        return
+    }
+    // Purged or restored since it was looked up
+    if rowsAffected, _ := result.RowsAffected(); rowsAffected == 0 {
+        apierror.Write(w, r, http.StatusConflict, apierror.Conflict, "Token changed while being restored")
+        return
+    }
+    ut.counters.AddActive(1)
+    
+    ipAddress, userAgent := ut.getClientInfo(r)
+    ut.logAuditEvent(AuditEvent{
+        UserID:       r.Header.Get("X-User-ID"),
+        Action:       "token_restored",
+        ResourceType: "token",
+        ResourceID:   token,
+        IPAddress:    ipAddress,
+        UserAgent:    userAgent,
+    })
+    
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(map[string]string{"message": "Token restored successfully"})
+}
+
+// TokenTagsRequest is the body of PUT /api/v1/tokens/{token}/tags
+type TokenTagsRequest struct {
+    Tags map[string]string `json:"tags"`
+}
+
+// handleAPITokenTags returns a token's tags on GET and replaces them all
+// on PUT
+func (ut *UnifiedTokenizer) handleAPITokenTags(w http.ResponseWriter, r *http.Request) {
+    // Permission check is handled by requirePermission middleware
+    
+    token := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/api/v1/tokens/"), "/tags")
+    
+    var exists int
+    err := ut.db.QueryRow("SELECT 1 FROM credit_cards WHERE token = ?", token).Scan(&exists)
+    if err == sql.ErrNoRows {
+        apierror.Write(w, r, http.StatusNotFound, apierror.TokenNotFound, "Token not found")
+        return
+    } else if err != nil {
+        apierror.Write(w, r, http.StatusInternalServerError, apierror.InternalError, "Internal server error")
+        return
+    }
+    
+    if r.Method == "PUT" {
+        var req TokenTagsRequest
+        if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+            apierror.Write(w, r, http.StatusBadRequest, apierror.InvalidBody, "Invalid request body")
+            return
+        }
+        if err := validateTags(req.Tags); err != nil {
+            apierror.Write(w, r, http.StatusBadRequest, apierror.InvalidRequest, err.Error())
+            return
+        }
+        
+        tx, err := ut.db.Begin()
+        if err != nil {
+            apierror.Write(w, r, http.StatusInternalServerError, apierror.InternalError, "Internal server error")
+            return
+        }
+        defer tx.Rollback()
+        if _, err := tx.Exec("DELETE FROM token_tags WHERE token = ?", token); err != nil {
+            apierror.Write(w, r, http.StatusInternalServerError, apierror.InternalError, "Internal server error")
+            return
+        }
+        if err := setTokenTags(tx, []interface{}{token}, tagUpdates(req.Tags)); err != nil {
+            apierror.Write(w, r, http.StatusInternalServerError, apierror.InternalError, "Internal server error")
+            return
+        }
+        if err := tx.Commit(); err != nil {
+            apierror.Write(w, r, http.StatusInternalServerError, apierror.InternalError, "Internal server error")
+            return
+        }
+        
+        keys := make([]string, 0, len(req.Tags))
+        for key := range req.Tags {
+            keys = append(keys, key)
+        }
+        sort.Strings(keys)
+        ipAddress, userAgent := ut.getClientInfo(r)
+        ut.logAuditEvent(AuditEvent{
+            UserID:       r.Header.Get("X-User-ID"),
+            Action:       "token_tags_updated",
+            ResourceType: "token",
+            ResourceID:   token,
+            IPAddress:    ipAddress,
+            UserAgent:    userAgent,
+            Details:      map[string]interface{}{"tag_keys": keys},
+        })
+    }
+    
+    tags, err := ut.tokenTags(token)
+    if err != nil {
+        apierror.Write(w, r, http.StatusInternalServerError, apierror.InternalError, "Internal server error")
+        return
+    }
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(map[string]interface{}{"token": token, "tags": tags})
+}
+
+// NetworkToken is a vault card's scheme network token; the token number
+// itself is only returned with a cryptogram
+type NetworkToken struct {
+    Token             string     `json:"token"`
+    Scheme            string     `json:"scheme"`
+    TokenReferenceID  string     `json:"token_reference_id"`
+    LastFour          string     `json:"last_four"`
+    ExpiryMonth       int        `json:"expiry_month,omitempty"`
+    ExpiryYear        int        `json:"expiry_year,omitempty"`
+    Status            string     `json:"status"` // active or suspended
+    CryptogramsIssued int        `json:"cryptograms_issued"`
+    LastCryptogramAt  *time.Time `json:"last_cryptogram_at,omitempty"`
+    CreatedBy         string     `json:"created_by,omitempty"`
+    CreatedAt         time.Time  `json:"created_at"`
+    UpdatedAt         time.Time  `json:"updated_at"`
+}
+
+// CryptogramRequest is the body of POST
+// /api/v1/tokens/{token}/network-token/cryptogram
+type CryptogramRequest struct {
+    TransactionType string `json:"transaction_type"`   // ecommerce, recurring or card_on_file
+    Amount          string `json:"amount,omitempty"`   // Decimal, like 10.00
+    Currency        string `json:"currency,omitempty"` // ISO 4217, like EUR
+}
+
+// CryptogramResponse is a network token with the cryptogram for one
+// transaction, which the payment processor is sent in place of the card
+type CryptogramResponse struct {
+    Token        string `json:"token"`
+    Scheme       string `json:"scheme"`
+    NetworkToken string `json:"network_token"`
+    ExpiryMonth  int    `json:"expiry_month,omitempty"`
+    ExpiryYear   int    `json:"expiry_year,omitempty"`
+    Cryptogram   string `json:"cryptogram"`
+    ECI          string `json:"eci,omitempty"`
+}
+
+var (
+    cryptogramAmount   = regexp.MustCompile(`^[0-9]{1,12}(\.[0-9]{1,3})?$`)
+    cryptogramCurrency = regexp.MustCompile(`^[A-Z]{3}$`)
+)
+
+// loadNetworkToken returns the network token of a vault token with its
+// encrypted number, or sql.ErrNoRows
+func (ut *UnifiedTokenizer) loadNetworkToken(token string) (*NetworkToken, []byte, sql.NullString, error) {
+    var n NetworkToken
+    var encrypted []byte
+    var keyID, createdBy sql.NullString
+    var expiryMonth, expiryYear sql.NullInt64
+    var lastCryptogramAt sql.NullTime
+    err := ut.db.QueryRow(`
+        SELECT token, scheme, token_reference_id, network_token_encrypted, encryption_key_id, last_four,
+               expiry_month, expiry_year, status, cryptograms_issued, last_cryptogram_at, created_by, created_at, updated_at
+        FROM network_tokens WHERE token = ?`, token).Scan(&n.Token, &n.Scheme, &n.TokenReferenceID, &encrypted, &keyID, &n.LastFour,
+        &expiryMonth, &expiryYear, &n.Status, &n.CryptogramsIssued, &lastCryptogramAt, &createdBy, &n.CreatedAt, &n.UpdatedAt)
+    if err != nil {
+        return nil, nil, sql.NullString{}, err
+    }
+    n.ExpiryMonth, n.ExpiryYear = int(expiryMonth.Int64), int(expiryYear.Int64)
+    if lastCryptogramAt.Valid {
+        n.LastCryptogramAt = &lastCryptogramAt.Time
+    }
+    n.CreatedBy = createdBy.String
+    return &n, encrypted, keyID, nil
+}
+
+// writeNetworkTokenError answers a failed call to a token service: 422
+// when it refused the request, 502 when it could not be reached or failed
+func writeNetworkTokenError(w http.ResponseWriter, r *http.Request, scheme string, err error) {
+    details := map[string]interface{}{"scheme": scheme}
+    var refusal *nettoken.Error
+    if errors.As(err, &refusal) {
+        if refusal.Code != "" {
+            details["scheme_code"] = refusal.Code
+        }
+        apierror.WriteDetails(w, r, http.StatusUnprocessableEntity, apierror.NetworkTokenFailed, refusal.Error(), details)
+        return
+    }
+    log.Printf("Network token request failed: %v", err)
+    apierror.WriteDetails(w, r, http.StatusBadGateway, apierror.NetworkTokenFailed, "The "+scheme+" token service could not be reached", details)
+}
+
+// handleAPINetworkToken returns a token's network token on GET, requests
+// one from the card's scheme on POST and deletes it on DELETE
+func (ut *UnifiedTokenizer) handleAPINetworkToken(w http.ResponseWriter, r *http.Request) {
+    // Permission check is handled by requirePermission middleware
+    
+    token := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/api/v1/tokens/"), "/network-token")
+    if r.Method == "POST" {
+        ut.provisionNetworkToken(w, r, token)
+        return
+    }
+    
+    n, _, _, err := ut.loadNetworkToken(token)
+    if err == sql.ErrNoRows {
+        apierror.Write(w, r, http.StatusNotFound, apierror.NetworkTokenNotFound, "Token has no network token")
+        return
+    } else if err != nil {
+        apierror.Write(w, r, http.StatusInternalServerError, apierror.InternalError, "Internal server error")
+        return
+    }
+    
+    if r.Method == "DELETE" {
+        if !ut.networkTokens.Has(n.Scheme) {
+            apierror.WriteDetails(w, r, http.StatusServiceUnavailable, apierror.SchemeNotConfigured, "No network token connector is configured for the card's scheme", map[string]interface{}{"scheme": n.Scheme})
+            return
+        }
+        if err := ut.networkTokens.Delete(r.Context(), n.Scheme, n.TokenReferenceID); err != nil {
+            writeNetworkTokenError(w, r, n.Scheme, err)
+            return
+        }
+        if _, err := ut.db.Exec("DELETE FROM network_tokens WHERE token = ?", token); err != nil {
+            apierror.Write(w, r, http.StatusInternalServerError, apierror.InternalError, "Internal server error")
+            return
+        }
+        ipAddress, userAgent := ut.getClientInfo(r)
+        ut.logAuditEvent(AuditEvent{
+            UserID:       r.Header.Get("X-User-ID"),
+            Action:       "network_token_deleted",
+            ResourceType: "token",
+            ResourceID:   token,
+            IPAddress:    ipAddress,
+            UserAgent:    userAgent,
+            Details:      map[string]interface{}{"scheme": n.Scheme, "last_four": n.LastFour},
+        })
+        w.Header().Set("Content-Type", "application/json")
+        json.NewEncoder(w).Encode(map[string]string{"message": "Network token deleted"})
+        return
+    }
+    
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(n)
+}
+
+// provisionNetworkToken requests a network token for an active vault card
+// from its scheme's token service and stores it beside the card
+func (ut *UnifiedTokenizer) provisionNetworkToken(w http.ResponseWriter, r *http.Request, token string) {
+    var cardType, keyID sql.NullString
+    var expiryMonth, expiryYear sql.NullInt64
+    var encryptedHolder []byte
+    var isActive bool
+    err := ut.db.QueryRow(`
+        SELECT card_type, expiry_month, expiry_year, card_holder_name_encrypted, encryption_key_id, is_active
+        FROM credit_cards WHERE token = ?`, token).Scan(&cardType, &expiryMonth, &expiryYear, &encryptedHolder, &keyID, &isActive)
+    if err == sql.ErrNoRows {
+        apierror.Write(w, r, http.StatusNotFound, apierror.TokenNotFound, "Token not found")
+        return
+    } else if err != nil {
+        apierror.Write(w, r, http.StatusInternalServerError, apierror.InternalError, "Internal server error")
+        return
+    }
+    if !isActive {
+        apierror.Write(w, r, http.StatusConflict, apierror.TokenRevoked, "Token has been revoked")
+        return
+    }
+    scheme := nettoken.SchemeOf(cardType.String)
+    if scheme == "" {
+        apierror.Write(w, r, http.StatusBadRequest, apierror.InvalidRequest, "The card's scheme has no token service")
+        return
+    }
+    if !ut.networkTokens.Has(scheme) {
+        apierror.WriteDetails(w, r, http.StatusServiceUnavailable, apierror.SchemeNotConfigured, "No network token connector is configured for the card's scheme", map[string]interface{}{"scheme": scheme})
+        return
+    }
+    var exists int
+    err = ut.db.QueryRow("SELECT 1 FROM network_tokens WHERE token = ?", token).Scan(&exists)
+    if err == nil {
+        apierror.Write(w, r, http.StatusConflict, apierror.AlreadyExists, "Token already has a network token")
+        return
+    } else if err != sql.ErrNoRows {
+        apierror.Write(w, r, http.StatusInternalServerError, apierror.InternalError, "Internal server error")
+        return
+    }
+    
+    var holder string
+    if len(encryptedHolder) > 0 {
+        if holder, err = ut.decryptStoredField(encryptedHolder, keyID); err != nil {
+            log.Printf("Failed to decrypt card holder for token %s: %v", token, err)
+        }
+    }
+    cardNumber := ut.retrieveCard(token)
+    if cardNumber == "" {
+        apierror.Write(w, r, http.StatusInternalServerError, apierror.InternalError, "Failed to decrypt card")
+        return
+    }
+    
+    issued, err := ut.networkTokens.Provision(r.Context(), scheme, nettoken.Card{
+        Number:      cardNumber,
+        ExpiryMonth: int(expiryMonth.Int64),
+        ExpiryYear:  int(expiryYear.Int64),
+        Holder:      holder,
+    })
+    if err != nil {
+        writeNetworkTokenError(w, r, scheme, err)
+        return
+    }
+    
+    userID := r.Header.Get("X-User-ID")
+    sealed, sealedKeyID, err := ut.encryptFields(issued.Number)
+    if err == nil {
+        _, err = ut.db.Exec(`
+            INSERT INTO network_tokens (token, scheme, token_reference_id, network_token_encrypted, encryption_key_id, last_four, expiry_month, expiry_year, status, created_by)
+            VALUES (?, ?, ?, ?, ?, ?, NULLIF(?, 0), NULLIF(?, 0), ?, ?)`,
+            token, scheme, issued.ReferenceID, sealed[0], sealedKeyID, lastFourOf(issued.Number), issued.ExpiryMonth, issued.ExpiryYear, issued.Status, userID)
+    }
+    if err != nil {
+        // Not stored, so nothing could use or delete it later
+        if derr := ut.networkTokens.Delete(context.Background(), scheme, issued.ReferenceID); derr != nil {
+            log.Printf("Failed to delete unstored %s network token %s: %v", scheme, issued.ReferenceID, derr)
+        }
+        if isDuplicateKey(err) {
+            apierror.Write(w, r, http.StatusConflict, apierror.AlreadyExists, "Token already has a network token")
+            return
+        }
+        apierror.Write(w, r, http.StatusInternalServerError, apierror.InternalError, "Internal server error")
+        return
+    }
+    
+    ipAddress, userAgent := ut.getClientInfo(r)
+    ut.logAuditEvent(AuditEvent{
+        UserID:       userID,
+        Action:       "network_token_provisioned",
+        ResourceType: "token",
+        ResourceID:   token,
+        IPAddress:    ipAddress,
+        UserAgent:    userAgent,
+        Details:      map[string]interface{}{"scheme": scheme, "last_four": lastFourOf(issued.Number)},
+    })
+    
+    n, _, _, err := ut.loadNetworkToken(token)
+    if err != nil {
+        apierror.Write(w, r, http.StatusInternalServerError, apierror.InternalError, "Internal server error")
+        return
+    }
+    w.Header().Set("Content-Type", "application/json")
+    w.WriteHeader(http.StatusCreated)
+    json.NewEncoder(w).Encode(n)
+}
+
+// handleAPINetworkTokenCryptogram returns a token's network token with a
+// cryptogram for one transaction. A network token the scheme has replaced,
+// such as after the card was reissued, is updated from the answer.
+func (ut *UnifiedTokenizer) handleAPINetworkTokenCryptogram(w http.ResponseWriter, r *http.Request) {
+    // Permission check is handled by requirePermission middleware
+    
+    token := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/api/v1/tokens/"), "/network-token/cryptogram")
+    
+    var req CryptogramRequest
+    if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+        apierror.Write(w, r, http.StatusBadRequest, apierror.InvalidBody, "Invalid request body")
+        return
+    }
+    validType := false
+    for _, t := range nettoken.TransactionTypes {
+        validType = validType || req.TransactionType == t
+    }
+    if !validType {
+        apierror.Write(w, r, http.StatusBadRequest, apierror.InvalidRequest, "transaction_type must be one of "+strings.Join(nettoken.TransactionTypes, ", "))
+        return
+    }
+    if req.Amount != "" && !cryptogramAmount.MatchString(req.Amount) {
+        apierror.Write(w, r, http.StatusBadRequest, apierror.InvalidRequest, "amount must be a decimal number, like 10.00")
+        return
+    }
+    if req.Currency != "" && !cryptogramCurrency.MatchString(req.Currency) {
+        apierror.Write(w, r, http.StatusBadRequest, apierror.InvalidRequest, "currency must be an ISO 4217 code, like EUR")
+        return
+    }
+    
+    n, encrypted, keyID, err := ut.loadNetworkToken(token)
+    if err == sql.ErrNoRows {
+        apierror.Write(w, r, http.StatusNotFound, apierror.NetworkTokenNotFound, "Token has no network token")
+        return
+    } else if err != nil {
+        apierror.Write(w, r, http.StatusInternalServerError, apierror.InternalError, "Internal server error")
+        return
+    }
+    var isActive bool
+    err = ut.db.QueryRow("SELECT is_active FROM credit_cards WHERE token = ?", token).Scan(&isActive)
+    if err != nil && err != sql.ErrNoRows {
+        apierror.Write(w, r, http.StatusInternalServerError, apierror.InternalError, "Internal server error")
+        return
+    }
+    if !isActive {
+        apierror.Write(w, r, http.StatusConflict, apierror.TokenRevoked, "Token has been revoked")
+        return
+    }
+    if n.Status != nettoken.StatusActive {
+        apierror.Write(w, r, http.StatusConflict, apierror.Conflict, "Network token is "+n.Status)
+        return
+    }
+    if !ut.networkTokens.Has(n.Scheme) {
+        apierror.WriteDetails(w, r, http.StatusServiceUnavailable, apierror.SchemeNotConfigured, "No network token connector is configured for the card's scheme", map[string]interface{}{"scheme": n.Scheme})
+        return
+    }
+    
+    cryptogram, err := ut.networkTokens.Cryptogram(r.Context(), n.Scheme, n.TokenReferenceID, nettoken.Transaction{
+        Type:     req.TransactionType,
+        Amount:   req.Amount,
+        Currency: req.Currency,
+    })
+    if err == nettoken.ErrNotFound {
+        // Deleted by the scheme, such as when the card was closed
+        ut.db.Exec("DELETE FROM network_tokens WHERE token = ?", token)
+        apierror.Write(w, r, http.StatusNotFound, apierror.NetworkTokenNotFound, "The scheme no longer has this network token; request a new one")
+        return
+    } else if err != nil {
+        writeNetworkTokenError(w, r, n.Scheme, err)
+        return
+    }
+    
+    resp := CryptogramResponse{
+        Token:       token,
+        Scheme:      n.Scheme,
+        ExpiryMonth: n.ExpiryMonth,
+        ExpiryYear:  n.ExpiryYear,
+        Cryptogram:  cryptogram.Cryptogram,
+        ECI:         cryptogram.ECI,
+    }
+    if updated := cryptogram.Token; updated != nil {
+        sealed, sealedKeyID, err := ut.encryptFields(updated.Number)
+        if err == nil {
+            _, err = ut.db.Exec(`
+                UPDATE network_tokens
+                SET token_reference_id = ?, network_token_encrypted = ?, encryption_key_id = ?, last_four = ?,
+                    expiry_month = NULLIF(?, 0), expiry_year = NULLIF(?, 0), status = ?
+                WHERE token = ?`,
+                updated.ReferenceID, sealed[0], sealedKeyID, lastFourOf(updated.Number), updated.ExpiryMonth, updated.ExpiryYear, updated.Status, token)
+        }
+        if err != nil {
+            log.Printf("Failed to store the replaced network token of token %s: %v", token, err)
+        }
+        resp.NetworkToken, resp.ExpiryMonth, resp.ExpiryYear = updated.Number, updated.ExpiryMonth, updated.ExpiryYear
+    } else {
+        resp.NetworkToken, err = ut.decryptStoredField(encrypted, keyID)
+        if err != nil {
+            log.Printf("Failed to decrypt the network token of token %s: %v", token, err)
+            apierror.Write(w, r, http.StatusInternalServerError, apierror.InternalError, "Failed to decrypt network token")
+            return
+        }
+    }
+    ut.db.Exec("UPDATE network_tokens SET cryptograms_issued = cryptograms_issued + 1, last_cryptogram_at = NOW() WHERE token = ?", token)
+    
+    details := map[string]interface{}{"scheme": n.Scheme, "transaction_type": req.TransactionType}
+    if req.Amount != "" {
+        details["amount"] = req.Amount
+    }
+    if req.Currency != "" {
+        details["currency"] = req.Currency
+    }
+    ipAddress, userAgent := ut.getClientInfo(r)
+    ut.logAuditEvent(AuditEvent{
+        UserID:       r.Header.Get("X-User-ID"),
+        Action:       "network_token_cryptogram",
+        ResourceType: "token",
+        ResourceID:   token,
+        IPAddress:    ipAddress,
+        UserAgent:    userAgent,
+        Details:      details,
+    })
+    
+    w.Header().Set("Cache-Control", "no-store")
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(resp)
+}
+
+// lastFourOf returns the last four digits of a card or network token number
+func lastFourOf(number string) string {
+    if len(number) < 4 {
+        return number
+    }
+    return number[len(number)-4:]
+}
+
+// deleteOrphanNetworkTokens deletes, at the scheme and here, the network
+// tokens of cards that have been purged. Revoked cards keep theirs while
+// they can be restored, but are refused cryptograms.
+func (ut *UnifiedTokenizer) deleteOrphanNetworkTokens() {
+    if len(ut.networkTokens.Schemes()) == 0 {
+        return
+    }
+    rows, err := ut.db.Query(`
+        SELECT n.token, n.scheme, n.token_reference_id
+        FROM network_tokens n LEFT JOIN credit_cards c ON c.token = n.token
+        WHERE c.token IS NULL
+        LIMIT 500`)
+    if err != nil {
+        log.Printf("Failed to find network tokens of purged cards: %v", err)
+        return
+    }
+    type orphan struct{ token, scheme, referenceID string }
+    var orphans []orphan
+    for rows.Next() {
+        var o orphan
+        if err := rows.Scan(&o.token, &o.scheme, &o.referenceID); err == nil {
+            orphans = append(orphans, o)
+        }
+    }
+    rows.Close()
+    
+    deleted := 0
+    for _, o := range orphans {
+        // Left for a replica with the connector, or for when it is configured
+        if !ut.networkTokens.Has(o.scheme) {
+            continue
+        }
+        if err := ut.networkTokens.Delete(context.Background(), o.scheme, o.referenceID); err != nil {
+            log.Printf("Failed to delete the %s network token of purged token %s: %v", o.scheme, o.token, err)
+            continue
+        }
+        if _, err := ut.db.Exec("DELETE FROM network_tokens WHERE token = ?", o.token); err == nil {
+            deleted++
+        }
+    }
+    if deleted > 0 {
+        log.Printf("Deleted %d network tokens of purged cards", deleted)
+    }
+}
+
+// tokenPurgeBatch is the number of cards deleted per transaction
+const tokenPurgeBatch = 500
+
+// purgeRevokedTokens deletes the cards of revoked tokens whose restore
+// window has passed, along with their request history
+func (ut *UnifiedTokenizer) purgeRevokedTokens() {
+    purged := 0
+    for {
+        n, err := ut.purgeRevokedBatch()
+        if err != nil {
+            log.Printf("Error purging revoked tokens: %v", err)
+            break
+        }
+        purged += n
+        if n < tokenPurgeBatch {
+            break
+        }
+    }
+    
+    if purged > 0 {
+        log.Printf("Purged %d revoked tokens", purged)
+        ut.logSecurityEvent(SecurityEvent{
+            EventType: "tokens_purged",
+            Severity:  "info",
+            IPAddress: "system",
+            Details: map[string]interface{}{
+                "tokens_purged": purged,
+                "purge_days":    ut.tokenPurgeDays,
+            },
+        })
+    }
+}
+
+// purgeRevokedBatch deletes up to tokenPurgeBatch cards. The cards are
+// locked so none can be restored while its history is being deleted.
+func (ut *UnifiedTokenizer) purgeRevokedBatch() (int, error) {
+    tx, err := ut.db.Begin()
+    if err != nil {
+        return 0, err
+    }
+    defer tx.Rollback()
+    
+    rows, err := tx.Query(`
+        SELECT token FROM credit_cards
+        WHERE is_active = FALSE AND purge_after <= NOW()
+        LIMIT ? FOR UPDATE`, tokenPurgeBatch)
+    if err != nil {
+        return 0, err
+    }
+    var tokens []interface{}
+    for rows.Next() {
+        var token string
+        if err := rows.Scan(&token); err != nil {
+            rows.Close()
+            return 0, err
+        }
+        tokens = append(tokens, token)
+    }
+    rows.Close()
+    if err := rows.Err(); err != nil {
+        return 0, err
+    }
+    if len(tokens) == 0 {
+        return 0, nil
+    }
+    
+    placeholders := sqlbuild.Placeholders(len(tokens))
+    if _, err := tx.Exec("DELETE FROM token_requests WHERE token IN ("+placeholders+")", tokens...); err != nil {
+        return 0, err
+    }
+    if _, err := tx.Exec("DELETE FROM token_requests_archive WHERE token IN ("+placeholders+")", tokens...); err != nil {
+        return 0, err
+    }
+    if _, err := tx.Exec("DELETE FROM credit_cards WHERE token IN ("+placeholders+")", tokens...); err != nil {
+        return 0, err
+    }
+    if _, err := tx.Exec("DELETE FROM card_claims WHERE token IN ("+placeholders+")", tokens...); err != nil {
+        return 0, err
+    }
+    if err := tx.Commit(); err != nil {
+        return 0, err
+    }
+    return len(tokens), nil
+}
+
+// Where token_requests rows past TOKEN_REQUEST_RETENTION_DAYS go
+const (
+    archiveTable  = "table"  // token_requests_archive
+    archiveFile   = "file"   // Gzipped JSON lines in TOKEN_REQUEST_ARCHIVE_DIR
+    archiveDelete = "delete" // Nowhere
+)
+
+// requestArchive is how token_requests is kept from growing without bound
+type requestArchive struct {
+    days        int    // TOKEN_REQUEST_RETENTION_DAYS: rows older are moved out; 0 keeps every row
+    mode        string // TOKEN_REQUEST_ARCHIVE: archiveTable, archiveFile or archiveDelete
+    dir         string // TOKEN_REQUEST_ARCHIVE_DIR, for archiveFile
+    archiveDays int    // TOKEN_REQUEST_ARCHIVE_RETENTION_DAYS: archived rows older are deleted; 0 keeps them
+}
+
+// loadRequestArchive reads the TOKEN_REQUEST_* retention settings
+func loadRequestArchive() (requestArchive, error) {
+    var a requestArchive
+    var err error
+    if a.days, err = utils.IntSetting("TOKEN_REQUEST_RETENTION_DAYS", 0, 0, 3650); err != nil {
+        return a, err
+    }
+    if a.archiveDays, err = utils.IntSetting("TOKEN_REQUEST_ARCHIVE_RETENTION_DAYS", 0, 0, 3650); err != nil {
+        return a, err
+    }
+    a.mode = utils.GetEnv("TOKEN_REQUEST_ARCHIVE", archiveTable)
+    a.dir = utils.GetEnv("TOKEN_REQUEST_ARCHIVE_DIR", "")
+    switch a.mode {
+    case archiveTable, archiveDelete:
+    case archiveFile:
+        if a.dir == "" {
+            return a, fmt.Errorf("TOKEN_REQUEST_ARCHIVE=file needs TOKEN_REQUEST_ARCHIVE_DIR")
+        }
+        if info, err := os.Stat(a.dir); err != nil || !info.IsDir() {
+            return a, fmt.Errorf("TOKEN_REQUEST_ARCHIVE_DIR %s is not a directory", a.dir)
+        }
+    default:
+        return a, fmt.Errorf("unknown TOKEN_REQUEST_ARCHIVE %q (supported: table, file, delete)", a.mode)
+    }
+    return a, nil
+}
+
+// requestArchiveBatch is the range of token_requests IDs moved per
+// transaction
+const requestArchiveBatch = 5000
+
+// archivedRequest is a token_requests row as written to archive files
+type archivedRequest struct {
+    ID             int64     `json:"id"`
+    Token          string    `json:"token"`
+    UserID         string    `json:"user_id,omitempty"`
+    APIKeyUsed     string    `json:"api_key_used,omitempty"`
+    RequestType    string    `json:"request_type"`
+    SourceIP       string    `json:"source_ip,omitempty"`
+    DestinationURL string    `json:"destination_url,omitempty"`
+    Timestamp      time.Time `json:"request_timestamp"`
+    ResponseStatus *int64    `json:"response_status,omitempty"`
+    ResponseTimeMs *int64    `json:"response_time_ms,omitempty"`
+}
+
+// archiveTokenRequests moves token_requests rows older than
+// TOKEN_REQUEST_RETENTION_DAYS out of the table, and deletes archived rows
+// older than TOKEN_REQUEST_ARCHIVE_RETENTION_DAYS. Rows are taken by ID up
+// to the newest one past the retention, so the table is read through its
+// primary key.
+func (ut *UnifiedTokenizer) archiveTokenRequests() {
+    a := ut.requestArchive
+    if a.days == 0 {
+        return
+    }
+    
+    var lastID, firstID int64
+    err := ut.db.QueryRow(`
+        SELECT id FROM token_requests
+        WHERE request_timestamp < DATE_SUB(NOW(), INTERVAL ? DAY)
+        ORDER BY request_timestamp DESC LIMIT 1`, a.days).Scan(&lastID)
+    if err == nil {
+        err = ut.db.QueryRow("SELECT MIN(id) FROM token_requests").Scan(&firstID)
+    }
+    if err != nil && err != sql.ErrNoRows {
+        log.Printf("Error archiving token requests: %v", err)
+        return
+    }
+    
+    archived := 0
+    for lo := firstID; err == nil && lastID > 0 && lo <= lastID; lo += requestArchiveBatch {
+        var n int
+        n, err = ut.archiveRequestBatch(lo, min(lo+requestArchiveBatch-1, lastID))
+        archived += n
+    }
+    if err != nil && err != sql.ErrNoRows {
+        log.Printf("Error archiving token requests: %v", err)
+    }
+    
+    if a.mode == archiveTable && a.archiveDays > 0 {
+        for {
+            res, err := ut.db.Exec(`
+                DELETE FROM token_requests_archive
+                WHERE request_timestamp < DATE_SUB(NOW(), INTERVAL ? DAY)
+                LIMIT ?`, a.archiveDays, requestArchiveBatch)
+            if err != nil {
+                log.Printf("Error pruning archived token requests: %v", err)
+                break
+            }
+            if n, _ := res.RowsAffected(); n < requestArchiveBatch {
+                break
+            }
+        }
+    }
+    
+    if archived > 0 {
+        log.Printf("Moved %d token requests older than %d days out of token_requests (%s)", archived, a.days, a.mode)
+        ut.logSecurityEvent(SecurityEvent{
+            EventType: "token_requests_archived",
+            Severity:  "info",
+            IPAddress: "system",
+            Details: map[string]interface{}{
+                "requests_archived": archived,
+                "retention_days":    a.days,
+                "archive":           a.mode,
+            },
+        })
+    }
+}
+
+// archiveRequestBatch moves the token_requests rows with IDs lo to hi. The
+// rows are locked first, so replicas running at once do not archive the
+// same rows twice.
+func (ut *UnifiedTokenizer) archiveRequestBatch(lo, hi int64) (int, error) {
+    tx, err := ut.db.Begin()
+    if err != nil {
+        return 0, err
+    }
+    defer tx.Rollback()
+    
+    rows, err := tx.Query(`
+        SELECT id, token, user_id, api_key_used, request_type, source_ip, destination_url,
+               request_timestamp, response_status, response_time_ms
+        FROM token_requests WHERE id BETWEEN ? AND ? ORDER BY id FOR UPDATE`, lo, hi)
+    if err != nil {
+        return 0, err
+    }
+    var requests []archivedRequest
+    for rows.Next() {
+        var req archivedRequest
+        var userID, apiKey, sourceIP, destination sql.NullString
+        var timestamp sql.NullTime
+        var status, elapsed sql.NullInt64
+        if err := rows.Scan(&req.ID, &req.Token, &userID, &apiKey, &req.RequestType, &sourceIP, &destination,
+            &timestamp, &status, &elapsed); err != nil {
+            rows.Close()
+            return 0, err
+        }
+        req.UserID, req.APIKeyUsed, req.SourceIP, req.DestinationURL = userID.String, apiKey.String, sourceIP.String, destination.String
+        req.Timestamp = timestamp.Time
+        if status.Valid {
+            req.ResponseStatus = &status.Int64
+        }
+        if elapsed.Valid {
+            req.ResponseTimeMs = &elapsed.Int64
+        }
+        requests = append(requests, req)
+    }
+    rows.Close()
+    if err := rows.Err(); err != nil {
+        return 0, err
+    }
+    if len(requests) == 0 {
+        return 0, nil
+    }
+    
+    switch ut.requestArchive.mode {
+    case archiveTable:
+        _, err = tx.Exec(`
+            INSERT IGNORE INTO token_requests_archive
+                (id, token, user_id, api_key_used, request_type, source_ip, destination_url,
+                 request_timestamp, response_status, response_time_ms)
+            SELECT id, token, user_id, api_key_used, request_type, source_ip, destination_url,
+                   request_timestamp, response_status, response_time_ms
+            FROM token_requests WHERE id BETWEEN ? AND ?`, lo, hi)
+    case archiveFile:
+        err = writeRequestArchive(ut.requestArchive.dir, requests)
+    }
+    if err != nil {
+        return 0, err
+    }
+    if _, err := tx.Exec("DELETE FROM token_requests WHERE id BETWEEN ? AND ?", lo, hi); err != nil {
+        return 0, err
+    }
+    if err := tx.Commit(); err != nil {
+        return 0, err
+    }
+    atomic.AddInt64(&ut.requestsArchived, int64(len(requests)))
+    return len(requests), nil
+}
+
+// writeRequestArchive writes requests to dir as gzipped JSON lines, named
+// by their first and last ID so a batch written again replaces its file.
+// The file is synced before the rows are deleted.
+func writeRequestArchive(dir string, requests []archivedRequest) error {
+    name := filepath.Join(dir, fmt.Sprintf("token_requests_%d-%d.jsonl.gz", requests[0].ID, requests[len(requests)-1].ID))
+    f, err := os.CreateTemp(dir, ".token_requests_*.tmp")
+    if err != nil {
+        return err
+    }
+    defer os.Remove(f.Name())
+    defer f.Close()
+    
+    zw := gzip.NewWriter(f)
+    enc := json.NewEncoder(zw)
+    for _, req := range requests {
+        if err := enc.Encode(req); err != nil {
+            return err
+        }
+    }
+    if err := zw.Close(); err != nil {
+        return err
+    }
+    if err := f.Sync(); err != nil {
+        return err
+    }
+    if err := f.Close(); err != nil {
+        return err
+    }
+    return os.Rename(f.Name(), name)
+}
+
+// auditRetention is how the audit log tables are kept from growing without
+// bound: rows past the retention are exported to object storage, then
+// deleted
+type auditRetention struct {
+    days  int            // AUDIT_LOG_RETENTION_DAYS: rows older are archived and deleted; 0 keeps every row
+    mode  string         // AUDIT_LOG_ARCHIVE: an objstore kind, or archiveDelete
+    store objstore.Store // Where archives go; nil for archiveDelete
+}
+
+// loadAuditRetention reads the AUDIT_LOG_* retention settings. A retention
+// without AUDIT_LOG_ARCHIVE is refused, so audit rows are never deleted
+// unless that was asked for.
+func loadAuditRetention() (auditRetention, error) {
+    var a auditRetention
+    var err error
+    if a.days, err = utils.IntSetting("AUDIT_LOG_RETENTION_DAYS", 0, 0, 3650); err != nil {
+        return a, err
+    }
+    a.mode = utils.GetEnv("AUDIT_LOG_ARCHIVE", "")
+    switch a.mode {
+    case "":
+        if a.days > 0 {
+            return a, fmt.Errorf("AUDIT_LOG_RETENTION_DAYS needs AUDIT_LOG_ARCHIVE (s3, gcs, file, or delete to drop rows unexported)")
+        }
+        return a, nil
+    case archiveDelete:
+        return a, nil
+    }
+    
+    // The archive credentials, or for S3 the standard AWS ones
+    cfg := objstore.Config{
+        Kind:            a.mode,
+        Bucket:          utils.GetEnv("AUDIT_LOG_ARCHIVE_BUCKET", ""),
+        Prefix:          utils.GetEnv("AUDIT_LOG_ARCHIVE_PREFIX", "tokenshield-audit"),
+        Endpoint:        utils.GetEnv("AUDIT_LOG_ARCHIVE_ENDPOINT", ""),
+        Region:          utils.GetEnv("AUDIT_LOG_ARCHIVE_REGION", os.Getenv("AWS_REGION")),
+        AccessKeyID:     utils.GetEnv("AUDIT_LOG_ARCHIVE_ACCESS_KEY_ID", ""),
+        SecretAccessKey: utils.GetEnv("AUDIT_LOG_ARCHIVE_SECRET_ACCESS_KEY", ""),
+    }
+    if cfg.AccessKeyID == "" && a.mode == objstore.S3 {
+        cfg.AccessKeyID, cfg.SecretAccessKey, cfg.SessionToken = os.Getenv("AWS_ACCESS_KEY_ID"), os.Getenv("AWS_SECRET_ACCESS_KEY"), os.Getenv("AWS_SESSION_TOKEN")
+    }
+    if a.store, err = objstore.New(cfg); err != nil {
+        return a, fmt.Errorf("AUDIT_LOG_ARCHIVE=%s: %v", a.mode, err)
+    }
+    return a, nil
+}
+
+// auditArchiveTables are the tables archived, and their columns in the
+// order archive records are written
+var auditArchiveTables = map[string][]string{
+    "user_audit_log": {"id", "user_id", "action", "resource_type", "resource_id",
+        "details", "details_encrypted", "details_key_id", "ip_address", "user_agent", "created_at"},
+    "security_audit_log": {"id", "event_type", "severity", "user_id", "username", "ip_address",
+        "user_agent", "endpoint", "details", "details_encrypted", "details_key_id", "created_at"},
+}
+
+// Archiving limits: rows per archive, and archives per table per run, so
+// a backlog is worked off over several runs
+const (
+    auditArchiveBatch   = 10000
+    auditArchiveMaxRuns = 20
+)
+
+// auditArchiveLock keeps replicas from archiving the same rows at once
+const auditArchiveLock = "tokenshield_audit_archive"
+
+// blindIndexAuditArchive is the purpose archives are signed under with the
+// blind index key, so a signature cannot pass for a card's index
+const blindIndexAuditArchive = "audit_archive"
+
+// AuditArchive is an export of audit rows to object storage
+type AuditArchive struct {
+    ArchiveID   int64     `json:"archive_id"`
+    SourceTable string    `json:"source_table"`
+    Store       string    `json:"store"`
+    ObjectKey   string    `json:"object_key"`
+    FirstID     int64     `json:"first_id"`
+    LastID      int64     `json:"last_id"`
+    FirstAt     time.Time `json:"first_at"`
+    LastAt      time.Time `json:"last_at"`
+    Rows        int       `json:"rows"`
+    SizeBytes   int64     `json:"size_bytes"`
+    SHA256      string    `json:"sha256"`
+    Signature   string    `json:"signature"` // HMAC of SHA256 under the blind index key
+    CreatedAt   time.Time `json:"created_at"`
+}
+
+// archiveAuditLogs exports the audit rows older than
+// AUDIT_LOG_RETENTION_DAYS to object storage and deletes them. Each archive
+// is written and recorded in audit_archives before its rows are deleted, so
+// a failure leaves the rows in place for the next run. Only one replica
+// archives at a time.
+func (ut *UnifiedTokenizer) archiveAuditLogs() {
+    a := ut.auditRetention
+    if a.days == 0 || (ut.keyManager != nil && ut.keyManager.IsSealed()) {
+        return
+    }
+    
+    ctx := context.Background()
+    conn, err := ut.db.Conn(ctx)
+    if err != nil {
+        log.Printf("Error archiving audit logs: %v", err)
+        return
+    }
+    defer conn.Close()
+    var locked sql.NullInt64
+    if err := conn.QueryRowContext(ctx, "SELECT GET_LOCK(?, 0)", auditArchiveLock).Scan(&locked); err != nil || locked.Int64 != 1 {
+        return // Another replica is archiving
+    }
+    defer conn.ExecContext(context.Background(), "DO RELEASE_LOCK(?)", auditArchiveLock)
+    
+    // One cutoff for the whole run, so the rows deleted are the rows read
+    cutoff := time.Now().AddDate(0, 0, -a.days)
+    for table := range auditArchiveTables {
+        archived := 0
+        for run := 0; run < auditArchiveMaxRuns; run++ {
+            n, err := ut.archiveAuditBatch(ctx, table, cutoff)
+            if err != nil {
+                log.Printf("Error archiving %s: %v", table, err)
+                break
+            }
+            archived += n
+            if n < auditArchiveBatch {
+                break
+            }
+        }
+        if archived > 0 {
+            log.Printf("Audit log retention: archived and deleted %d %s rows older than %d days", archived, table, a.days)
+        }
+    }
+}
+
+// archiveAuditBatch exports the oldest rows of table before cutoff, up to
+// auditArchiveBatch, and deletes them. Returns the number of rows.
+func (ut *UnifiedTokenizer) archiveAuditBatch(ctx context.Context, table string, cutoff time.Time) (int, error) {
+    columns := auditArchiveTables[table]
+    rows, err := ut.db.QueryContext(ctx, fmt.Sprintf(
+        "SELECT %s FROM %s WHERE created_at < ? ORDER BY id LIMIT ?", strings.Join(columns, ", "), table),
+        cutoff, auditArchiveBatch)
+    if err != nil {
+        return 0, err
+    }
+    var records []map[string]interface{}
+    for rows.Next() {
+        record, err := scanAuditRecord(rows, columns)
+        if err != nil {
+            rows.Close()
+            return 0, err
+        }
+        records = append(records, record)
+    }
+    rows.Close()
+    if err := rows.Err(); err != nil {
+        return 0, err
+    }
+    if len(records) == 0 {
+        return 0, nil
+    }
+    
+    archive := AuditArchive{
+        SourceTable: table,
+        Store:       ut.auditRetention.mode,
+        FirstID:     records[0]["id"].(int64),
+        LastID:      records[len(records)-1]["id"].(int64),
+        FirstAt:     records[0]["created_at"].(time.Time),
+        LastAt:      records[len(records)-1]["created_at"].(time.Time),
+        Rows:        len(records),
+        CreatedAt:   time.Now().UTC(),
+    }
+    if ut.auditRetention.store != nil {
+        if err := ut.writeAuditArchive(ctx, &archive, records); err != nil {
+            return 0, err
+        }
+    }
+    
+    // Same predicate as the select, so rows newer than the cutoff with IDs
+    // in the range stay
+    _, err = ut.db.ExecContext(ctx, fmt.Sprintf("DELETE FROM %s WHERE id BETWEEN ? AND ? AND created_at < ?", table),
+        archive.FirstID, archive.LastID, cutoff)
+    if err != nil {
+        return 0, err
+    }
+    return len(records), nil
+}
+
+// scanAuditRecord reads an audit row as an archive record: times as
+// time.Time, details_encrypted as bytes, and NULL columns left out
+func scanAuditRecord(rows *sql.Rows, columns []string) (map[string]interface{}, error) {
+    var id int64
+    var createdAt time.Time
+    var encrypted []byte
+    values := make([]sql.NullString, len(columns))
+    dest := make([]interface{}, len(columns))
+    for i, column := range columns {
+        switch column {
+        case "id":
+            dest[i] = &id
+        case "created_at":
+            dest[i] = &createdAt
+        case "details_encrypted":
+            dest[i] = &encrypted
+        default:
+            dest[i] = &values[i]
+        }
+    }
+    if err := rows.Scan(dest...); err != nil {
+        return nil, err
+    }
+    
+    record := map[string]interface{}{"id": id, "created_at": createdAt.UTC()}
+    if len(encrypted) > 0 {
+        record["details_encrypted"] = encrypted
+    }
+    for i, column := range columns {
+        if !values[i].Valid {
+            continue
+        }
+        if column == "details" {
+            record[column] = json.RawMessage(values[i].String)
+        } else {
+            record[column] = values[i].String
+        }
+    }
+    return record, nil
+}
+
+// writeAuditArchive stores records as gzipped JSON lines, with a manifest
+// beside them, and records the archive in audit_archives. The manifest
+// carries the digest and signature, so an archive can be checked even
+// without the database.
+func (ut *UnifiedTokenizer) writeAuditArchive(ctx context.Context, archive *AuditArchive, records []map[string]interface{}) error {
+    var buf bytes.Buffer
+    zw := gzip.NewWriter(&buf)
+    enc := json.NewEncoder(zw)
+    for _, record := range records {
+        if err := enc.Encode(record); err != nil {
+            return err
+        }
+    }
+    if err := zw.Close(); err != nil {
+        return err
+    }
+    
+    sum := sha256.Sum256(buf.Bytes())
+    archive.SHA256 = hex.EncodeToString(sum[:])
+    signature, err := ut.blindIndex(blindIndexAuditArchive, archive.SHA256)
+    if err != nil {
+        return err
+    }
+    archive.Signature = hex.EncodeToString(signature)
+    archive.SizeBytes = int64(buf.Len())
+    archive.ObjectKey = fmt.Sprintf("%s/%s/%s_%d-%d.jsonl.gz",
+        archive.SourceTable, archive.FirstAt.Format("2006/01"), archive.SourceTable, archive.FirstID, archive.LastID)
+    
+    store := ut.auditRetention.store
+    if err := store.Put(ctx, archive.ObjectKey, buf.Bytes()); err != nil {
+        return err
+    }
+    manifest, _ := json.MarshalIndent(archive, "", "  ")
+    if err := store.Put(ctx, archive.ObjectKey+".manifest.json", manifest); err != nil {
+        return err
+    }
+    
+    result, err := ut.db.ExecContext(ctx, `
+        INSERT INTO audit_archives (source_table, store, object_key, first_id, last_id, first_at, last_at,
+                                    row_count, size_bytes, sha256, signature)
+        VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+    `, archive.SourceTable, archive.Store, archive.ObjectKey, archive.FirstID, archive.LastID, archive.FirstAt, archive.LastAt,
+        archive.Rows, archive.SizeBytes, archive.SHA256, archive.Signature)
+    if err != nil {
+        return err
+    }
+    archive.ArchiveID, _ = result.LastInsertId()
+    return nil
+}
+
+// errAuditArchiveTampered is returned for an archive whose content does not
+// match its recorded digest or signature
+var errAuditArchiveTampered = errors.New("the archive does not match its digest or signature")
+
+// readAuditArchive fetches an archive, checks it against its digest and
+// signature, and returns its records
+func (ut *UnifiedTokenizer) readAuditArchive(ctx context.Context, archive AuditArchive) ([]map[string]interface{}, error) {
+    store := ut.auditRetention.store
+    if store == nil || archive.Store != ut.auditRetention.mode {
+        return nil, fmt.Errorf("archive is in %s storage, but AUDIT_LOG_ARCHIVE is %q", archive.Store, ut.auditRetention.mode)
+    }
+    data, err := store.Get(ctx, archive.ObjectKey)
+    if err != nil {
+        return nil, err
+    }
+    
+    sum := sha256.Sum256(data)
+    signature, err := ut.blindIndex(blindIndexAuditArchive, archive.SHA256)
+    if err != nil {
+        return nil, err
+    }
+    if hex.EncodeToString(sum[:]) != archive.SHA256 || !hmac.Equal([]byte(hex.EncodeToString(signature)), []byte(archive.Signature)) {
+        return nil, errAuditArchiveTampered
+    }
+    
+    zr, err := gzip.NewReader(bytes.NewReader(data))
+    if err != nil {
+        return nil, err
+    }
+    var records []map[string]interface{}
+    dec := json.NewDecoder(zr)
+    dec.UseNumber()
+    for {
+        var record map[string]interface{}
+        if err := dec.Decode(&record); err == io.EOF {
+            break
+        } else if err != nil {
+            return nil, err
+        }
+        records = append(records, record)
+    }
+    return records, nil
+}
+
+// openAuditRecord replaces an archive record's encrypted details with the
+// decrypted ones, as the live tables would be read
+func (ut *UnifiedTokenizer) openAuditRecord(record map[string]interface{}) {
+    encoded, _ := record["details_encrypted"].(string)
+    keyID, _ := record["details_key_id"].(string)
+    delete(record, "details_encrypted")
+    delete(record, "details_key_id")
+    if encoded == "" {
+        return
+    }
+    sealed, err := base64.StdEncoding.DecodeString(encoded)
+    if err != nil {
+        return
+    }
+    values, err := ut.decryptFields(sql.NullString{String: keyID, Valid: keyID != ""}, sealed)
+    if err != nil {
+        record["details_error"] = "details could not be decrypted"
+        return
+    }
+    var details interface{}
+    if json.Unmarshal([]byte(values[0]), &details) == nil {
+        record["details"] = details
+    }
+}
+
+// auditArchiveColumns lists audit_archives columns in AuditArchive order
+const auditArchiveColumns = `archive_id, source_table, store, object_key, first_id, last_id, first_at, last_at,
+           row_count, size_bytes, sha256, signature, created_at`
+
+func scanAuditArchive(row interface{ Scan(...interface{}) error }) (AuditArchive, error) {
+    var a AuditArchive
+    err := row.Scan(&a.ArchiveID, &a.SourceTable, &a.Store, &a.ObjectKey, &a.FirstID, &a.LastID, &a.FirstAt, &a.LastAt,
+        &a.Rows, &a.SizeBytes, &a.SHA256, &a.Signature, &a.CreatedAt)
+    return a, err
+}
+
+// handleListAuditArchives lists the archives of audit rows, newest first,
+// optionally of one table and overlapping start to end
+func (ut *UnifiedTokenizer) handleListAuditArchives(w http.ResponseWriter, r *http.Request) {
+    query := r.URL.Query()
+    where, args := []string{"1 = 1"}, []interface{}{}
+    if table := query.Get("table"); table != "" {
+        if _, ok := auditArchiveTables[table]; !ok {
+            apierror.Write(w, r, http.StatusBadRequest, apierror.InvalidRequest, "table must be user_audit_log or security_audit_log")
+            return
+        }
+        where, args = append(where, "source_table = ?"), append(args, table)
+    }
+    for _, bound := range []struct{ param, condition string }{{"start", "last_at >= ?"}, {"end", "first_at <= ?"}} {
+        value := query.Get(bound.param)
+        if value == "" {
+            continue
+        }
+        at, err := time.Parse(time.RFC3339, value)
+        if err != nil {
+            apierror.Write(w, r, http.StatusBadRequest, apierror.InvalidRequest, bound.param+" must be an RFC 3339 time")
+            return
+        }
+        where, args = append(where, bound.condition), append(args, at)
+    }
+    
+    rows, err := ut.db.Query("SELECT "+auditArchiveColumns+" FROM audit_archives WHERE "+strings.Join(where, " AND ")+
+        " ORDER BY first_at DESC LIMIT 1000", args...)
+    if err != nil {
+        apierror.Write(w, r, http.StatusInternalServerError, apierror.InternalError, "Database error")
+        return
+    }
+    defer rows.Close()
+    archives := []AuditArchive{}
+    for rows.Next() {
+        archive, err := scanAuditArchive(rows)
+        if err != nil {
+            apierror.Write(w, r, http.StatusInternalServerError, apierror.InternalError, "Database error")
+            return
+        }
+        archives = append(archives, archive)
+    }
+    
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(map[string]interface{}{
+        "archives":       archives,
+        "retention_days": ut.auditRetention.days,
+        "store":          ut.auditRetention.mode,
+    })
+}
+
+// auditRecordFilters are the query parameters GET
+// /api/v1/audit-archives/{id}/events matches record fields against
+var auditRecordFilters = []string{"event_type", "severity", "user_id", "username", "ip_address", "action", "resource_type", "resource_id"}
+
+// handleQueryAuditArchive returns the rows of an archive, checked against
+// its signature and with their details decrypted, optionally filtered by
+// field and time. Reading archived audit rows is itself audited.
+func (ut *UnifiedTokenizer) handleQueryAuditArchive(w http.ResponseWriter, r *http.Request) {
+    idText := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/api/v1/audit-archives/"), "/events")
+    archiveID, err := strconv.ParseInt(idText, 10, 64)
+    if err != nil {
+        apierror.Write(w, r, http.StatusNotFound, apierror.NotFound, "Archive not found")
+        return
+    }
+    
+    query := r.URL.Query()
+    var start, end time.Time
+    for _, bound := range []struct {
+        param string
+        at    *time.Time
+    }{{"start", &start}, {"end", &end}} {
+        if value := query.Get(bound.param); value != "" {
+            if *bound.at, err = time.Parse(time.RFC3339, value); err != nil {
+                apierror.Write(w, r, http.StatusBadRequest, apierror.InvalidRequest, bound.param+" must be an RFC 3339 time")
+                return
+            }
+        }
+    }
+    limit := 1000
+    if value := query.Get("limit"); value != "" {
+        if limit, err = strconv.Atoi(value); err != nil || limit < 1 || limit > auditArchiveBatch {
+            apierror.Write(w, r, http.StatusBadRequest, apierror.InvalidRequest, fmt.Sprintf("limit must be 1 to %d", auditArchiveBatch))
+            return
+        }
+    }
+    
+    archive, err := scanAuditArchive(ut.db.QueryRow("SELECT "+auditArchiveColumns+" FROM audit_archives WHERE archive_id = ?", archiveID))
+    if err == sql.ErrNoRows {
+        apierror.Write(w, r, http.StatusNotFound, apierror.NotFound, "Archive not found")
+        return
+    } else if err != nil {
+        apierror.Write(w, r, http.StatusInternalServerError, apierror.InternalError, "Database error")
+        return
+    }
+    
+    ipAddress, userAgent := ut.getClientInfo(r)
+    records, err := ut.readAuditArchive(r.Context(), archive)
+    if err == errAuditArchiveTampered {
+        ut.logSecurityEvent(SecurityEvent{
+            EventType: "audit_archive_tampered",
+            Severity:  "critical",
+            UserID:    r.Header.Get("X-User-ID"),
+            IPAddress: ipAddress,
+            UserAgent: userAgent,
+            Endpoint:  r.URL.Path,
+            Details: map[string]interface{}{
+                "archive_id": archive.ArchiveID,
+                "object_key": archive.ObjectKey,
+            },
+        })
+    }
+    if err != nil {
+        apierror.Write(w, r, http.StatusBadGateway, apierror.InternalError, "Archive could not be read: "+err.Error())
+        return
+    }
+    
+    events := []map[string]interface{}{}
+    truncated := false
+    for _, record := range records {
+        if !auditRecordMatches(record, query, start, end) {
+            continue
+        }
+        if len(events) == limit {
+            truncated = true
+            break
+        }
+        ut.openAuditRecord(record)
+        events = append(events, record)
+    }
+    
+    ut.logAuditEvent(AuditEvent{
+        UserID:       r.Header.Get("X-User-ID"),
+        Action:       "audit_archive_read",
+        ResourceType: "audit_archive",
+        ResourceID:   strconv.FormatInt(archive.ArchiveID, 10),
+        IPAddress:    ipAddress,
+        UserAgent:    userAgent,
+        Details: map[string]interface{}{
+            "source_table": archive.SourceTable,
+            "filters":      query.Encode(),
+            "returned":     len(events),
+        },
+    })
+    
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(map[string]interface{}{
+        "archive":   archive,
+        "verified":  true,
+        "events":    events,
+        "count":     len(events),
+        "truncated": truncated,
+    })
+}
+
+// auditRecordMatches reports whether an archive record has the field
+// values asked for in query and was created between start and end, either
+// of which may be zero
+func auditRecordMatches(record map[string]interface{}, query url.Values, start, end time.Time) bool {
+    for _, field := range auditRecordFilters {
+        if want := query.Get(field); want != "" && record[field] != want {
+            return false
+        }
+    }
+    if start.IsZero() && end.IsZero() {
+        return true
+    }
+    createdText, _ := record["created_at"].(string)
+    created, err := time.Parse(time.RFC3339Nano, createdText)
+    if err != nil {
+        return false
+    }
+    return (start.IsZero() || !created.Before(start)) && (end.IsZero() || !created.After(end))
+}
+
+// blindIndexReportSigning derives the key compliance reports are signed
+// with from the blind index key, when REPORT_SIGNING_KEY_FILE is not set,
+// so every replica signs with the same key
+const blindIndexReportSigning = "report_signing"
+
+// maxReportDays bounds the period of a compliance report
+const maxReportDays = 366
+
+// loadReportSigningKey reads the Ed25519 private key in
+// REPORT_SIGNING_KEY_FILE, a PKCS #8 PEM file like the one `openssl genpkey
+// -algorithm ed25519` writes. Without the setting it returns nil.
+func loadReportSigningKey() (ed25519.PrivateKey, error) {
+    file := utils.GetEnv("REPORT_SIGNING_KEY_FILE", "")
+    if file == "" {
+        return nil, nil
+    }
+    data, err := os.ReadFile(file)
+    if err != nil {
+        return nil, fmt.Errorf("REPORT_SIGNING_KEY_FILE: %v", err)
+    }
+    block, _ := pem.Decode(data)
+    if block == nil {
+        return nil, fmt.Errorf("REPORT_SIGNING_KEY_FILE: %s holds no PEM key", file)
+    }
+    key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+    if err != nil {
+        return nil, fmt.Errorf("REPORT_SIGNING_KEY_FILE: %v", err)
+    }
+    signer, ok := key.(ed25519.PrivateKey)
+    if !ok {
+        return nil, fmt.Errorf("REPORT_SIGNING_KEY_FILE: %s is not an Ed25519 key", file)
+    }
+    return signer, nil
+}
+
+// reportSigningKey returns the key compliance reports are signed with: the
+// one in REPORT_SIGNING_KEY_FILE, or one derived from the blind index key
+func (ut *UnifiedTokenizer) reportSigningKey() (ed25519.PrivateKey, error) {
+    if ut.reportKey != nil {
+        return ut.reportKey, nil
+    }
+    seed, err := ut.blindIndex(blindIndexReportSigning, "ed25519")
+    if err != nil {
+        return nil, err
+    }
+    return ed25519.NewKeyFromSeed(seed), nil
+}
+
+// reportKeyID names a signing key by the start of its public key's SHA-256
+func reportKeyID(key ed25519.PublicKey) string {
+    sum := sha256.Sum256(key)
+    return hex.EncodeToString(sum[:8])
+}
+
+// parseReportPeriod reads the period of a compliance report: quarter, like
+// 2024-Q1, or start and end as RFC 3339 times or as dates, an end date
+// including its whole day. Without them it is the 90 days up to now.
+func parseReportPeriod(query url.Values, now time.Time) (time.Time, time.Time, error) {
+    if quarter := query.Get("quarter"); quarter != "" {
+        yearText, qText, ok := strings.Cut(strings.ToUpper(quarter), "-Q")
+        year, errYear := strconv.Atoi(yearText)
+        q, errQ := strconv.Atoi(qText)
+        if !ok || errYear != nil || errQ != nil || q < 1 || q > 4 || year < 2000 {
+            return time.Time{}, time.Time{}, fmt.Errorf("quarter must look like 2024-Q1")
+        }
+        start := time.Date(year, time.Month(3*q-2), 1, 0, 0, 0, 0, time.UTC)
+        return start, start.AddDate(0, 3, 0), nil
+    }
+    
+    end, start := now, now.AddDate(0, 0, -90)
+    for _, bound := range []struct {
+        param string
+        at    *time.Time
+    }{{"start", &start}, {"end", &end}} {
+        value := query.Get(bound.param)
+        if value == "" {
+            continue
+        }
+        if at, err := time.Parse(time.RFC3339, value); err == nil {
+            *bound.at = at
+        } else if day, err := time.Parse("2006-01-02", value); err == nil {
+            if bound.param == "end" {
+                day = day.AddDate(0, 0, 1)
+            }
+            *bound.at = day
+        } else {
+            return time.Time{}, time.Time{}, fmt.Errorf("%s must be an RFC 3339 time or a date", bound.param)
+        }
+    }
+    if query.Get("start") == "" && query.Get("end") != "" {
+        start = end.AddDate(0, 0, -90)
+    }
+    switch {
+    case !start.Before(end):
+        return time.Time{}, time.Time{}, fmt.Errorf("start must be before end")
+    case end.Sub(start) > maxReportDays*24*time.Hour:
+        return time.Time{}, time.Time{}, fmt.Errorf("the period can be at most %d days", maxReportDays)
+    case start.After(now):
+        return time.Time{}, time.Time{}, fmt.Errorf("start is in the future")
+    }
+    return start, end, nil
+}
+
+// ComplianceReport is the evidence auditors ask for over a period: key
+// ages and rotations, who has access, how many tokens were issued and
+// who revealed cards
+type ComplianceReport struct {
+    GeneratedAt     time.Time                 `json:"generated_at"`
+    GeneratedBy     string                    `json:"generated_by"`
+    Start           time.Time                 `json:"start"`
+    End             time.Time                 `json:"end"`
+    SigningKeyID    string                    `json:"signing_key_id"`
+    Keys            ComplianceKeys            `json:"keys"`
+    AccessReview    ComplianceAccessReview    `json:"access_review"`
+    Tokens          ComplianceTokens          `json:"tokens"`
+    Detokenizations ComplianceDetokenizations `json:"detokenizations"`
+    Notes           []string                  `json:"notes"` // What the figures may be missing
+}
+
+// ComplianceKeys are the encryption keys, with the rotations started in
+// the period and the rotation policies
+type ComplianceKeys struct {
+    KEKDEK    bool                       `json:"kek_dek"` // False with the single legacy key, which is never rotated
+    Keys      []ComplianceKey            `json:"keys"`
+    Rotations []ComplianceRotation       `json:"rotations"`
+    Policies  []ComplianceRotationPolicy `json:"policies"`
+}
+
+type ComplianceKey struct {
+    KeyID       string     `json:"key_id"`
+    KeyType     string     `json:"key_type"`
+    Version     int        `json:"version"`
+    Status      string     `json:"status"`
+    CreatedAt   time.Time  `json:"created_at"`
+    ActivatedAt *time.Time `json:"activated_at,omitempty"`
+    RetiredAt   *time.Time `json:"retired_at,omitempty"`
+    AgeDays     int        `json:"age_days"` // Since activation, or until retirement
+}
+
+type ComplianceRotation struct {
+    RotationID  string     `json:"rotation_id"`
+    KeyType     string     `json:"key_type"`
+    OldKeyID    string     `json:"old_key_id,omitempty"`
+    NewKeyID    string     `json:"new_key_id,omitempty"`
+    StartedAt   time.Time  `json:"started_at"`
+    CompletedAt *time.Time `json:"completed_at,omitempty"`
+    Status      string     `json:"status"`
+    InitiatedBy string     `json:"initiated_by,omitempty"`
+}
+
+type ComplianceRotationPolicy struct {
+    KeyType      string     `json:"key_type"`
+    Enabled      bool       `json:"enabled"`
+    IntervalDays int        `json:"interval_days"`
+    LastRunAt    *time.Time `json:"last_run_at,omitempty"`
+    LastStatus   string     `json:"last_status,omitempty"`
+    Overdue      bool       `json:"overdue"` // The active key is older than the interval
+}
+
+// ComplianceAccessReview lists every account with its access, for
+// reviewers to confirm each is still needed
+type ComplianceAccessReview struct {
+    Users           []ComplianceUser `json:"users"`
+    Active          int              `json:"active"`
+    Inactive        int              `json:"inactive"`
+    ServiceAccounts int              `json:"service_accounts"`
+    NeverLoggedIn   int              `json:"never_logged_in"` // Active people who have never logged in
+    Dormant         int              `json:"dormant"`         // Active people with no login in the last 90 days
+}
+
+type ComplianceUser struct {
+    UserID            string     `json:"user_id"`
+    Username          string     `json:"username"`
+    AccountType       string     `json:"account_type"`
+    Role              string     `json:"role"`
+    Permissions       []string   `json:"permissions"` // Granted beyond the role
+    Active            bool       `json:"active"`
+    Locked            bool       `json:"locked"`
+    CreatedAt         time.Time  `json:"created_at"`
+    LastLoginAt       *time.Time `json:"last_login_at,omitempty"`
+    PasswordChangedAt *time.Time `json:"password_changed_at,omitempty"`
+    ActiveAPIKeys     int        `json:"active_api_keys"`
+}
+
+// ComplianceTokens counts the tokens issued and revoked in the period
+type ComplianceTokens struct {
+    Created  int64            `json:"created"`
+    Revoked  int64            `json:"revoked"`
+    Active   int64            `json:"active"` // When the report was made
+    BySource map[string]int64 `json:"created_by_source"`
+}
+
+// ComplianceDetokenizations summarizes card reveals in the period: those
+// through the API by who made them, and those by the proxy
+type ComplianceDetokenizations struct {
+    APIReveals    int64                `json:"api_reveals"`
+    ProxyReveals  int64                `json:"proxy_detokenizations"`
+    QuotaRefusals int64                `json:"quota_refusals"`
+    ByIdentity    []ComplianceRevealer `json:"by_identity"`
+}
+
+type ComplianceRevealer struct {
+    Identity string    `json:"identity"` // user_id, or api_key_ and the key's first characters
+    Username string    `json:"username,omitempty"`
+    Reveals  int64     `json:"reveals"`
+    Tokens   int64     `json:"tokens"` // Distinct tokens revealed
+    FirstAt  time.Time `json:"first_at"`
+    LastAt   time.Time `json:"last_at"`
+}
+
+// buildComplianceReport gathers a compliance report from the database
+func (ut *UnifiedTokenizer) buildComplianceReport(start, end, now time.Time) (*ComplianceReport, error) {
+    report := &ComplianceReport{
+        GeneratedAt: now,
+        Start:       start,
+        End:         end,
+        Keys: ComplianceKeys{
+            KEKDEK:    ut.useKEKDEK,
+            Keys:      []ComplianceKey{},
+            Rotations: []ComplianceRotation{},
+            Policies:  []ComplianceRotationPolicy{},
+        },
+        AccessReview:    ComplianceAccessReview{Users: []ComplianceUser{}},
+        Tokens:          ComplianceTokens{BySource: map[string]int64{}},
+        Detokenizations: ComplianceDetokenizations{ByIdentity: []ComplianceRevealer{}},
+        Notes:           []string{},
+    }
+    for _, gather := range []func(*ComplianceReport) error{
+        ut.reportKeys, ut.reportAccessReview, ut.reportTokens, ut.reportDetokenizations,
+    } {
+        if err := gather(report); err != nil {
+            return nil, err
+        }
+    }
+    
+    if !ut.useKEKDEK {
+        report.Notes = append(report.Notes, "USE_KEK_DEK is off: cards are encrypted under the single legacy key, which is not rotated.")
+    }
+    if days := ut.auditRetention.days; days > 0 && start.Before(now.AddDate(0, 0, -days)) {
+        report.Notes = append(report.Notes, fmt.Sprintf(
+            "API reveals cover only the last %d days (AUDIT_LOG_RETENTION_DAYS); earlier ones are in the audit archives.", days))
+    }
+    if a := ut.requestArchive; a.days > 0 {
+        // Rows moved to token_requests_archive are still counted until
+        // they are deleted from there
+        kept := a.days
+        if a.mode == archiveTable {
+            kept = 0
+            if a.archiveDays > 0 {
+                kept = a.days + a.archiveDays
+            }
+        }
+        if kept > 0 && start.Before(now.AddDate(0, 0, -kept)) {
+            report.Notes = append(report.Notes, fmt.Sprintf(
+                "Proxy detokenizations cover only the last %d days of token requests kept in the database.", kept))
+        }
+    }
+    if ut.tokenPurgeDays > 0 {
+        report.Notes = append(report.Notes, fmt.Sprintf(
+            "Tokens revoked more than %d days ago are purged (TOKEN_PURGE_DAYS) and missing from the token counts.", ut.tokenPurgeDays))
+    }
+    return report, nil
+}
+
+func (ut *UnifiedTokenizer) reportKeys(report *ComplianceReport) error {
+    rows, err := ut.db.Query(`
+        SELECT key_id, key_type, key_version, key_status, created_at, activated_at, retired_at
+        FROM encryption_keys ORDER BY key_type, key_version DESC`)
+    if err != nil {
+        return err
+    }
+    defer rows.Close()
+    activeSince := map[string]time.Time{}
+    for rows.Next() {
+        var k ComplianceKey
+        var activatedAt, retiredAt sql.NullTime
+        if err := rows.Scan(&k.KeyID, &k.KeyType, &k.Version, &k.Status, &k.CreatedAt, &activatedAt, &retiredAt); err != nil {
+            return err
+        }
+        since, until := k.CreatedAt, report.GeneratedAt
+        if activatedAt.Valid {
+            k.ActivatedAt, since = &activatedAt.Time, activatedAt.Time
+        }
+        if retiredAt.Valid {
+            k.RetiredAt, until = &retiredAt.Time, retiredAt.Time
+        }
+        k.AgeDays = int(until.Sub(since).Hours() / 24)
+        if k.Status == "active" {
+            if _, seen := activeSince[k.KeyType]; !seen {
+                activeSince[k.KeyType] = since
+            }
+        }
+        report.Keys.Keys = append(report.Keys.Keys, k)
+    }
+    if err := rows.Err(); err != nil {
+        return err
+    }
+    
+    rows, err = ut.db.Query(`
+        SELECT rotation_id, COALESCE(key_type, ''), COALESCE(old_key_id, ''), COALESCE(new_key_id, ''),
+               started_at, completed_at, status, COALESCE(initiated_by, '')
+        FROM key_rotation_log WHERE started_at >= ? AND started_at < ? ORDER BY started_at`,
+        report.Start, report.End)
+    if err != nil {
+        return err
+    }
+    defer rows.Close()
+    for rows.Next() {
+        var rot ComplianceRotation
+        var completedAt sql.NullTime
+        if err := rows.Scan(&rot.RotationID, &rot.KeyType, &rot.OldKeyID, &rot.NewKeyID,
+            &rot.StartedAt, &completedAt, &rot.Status, &rot.InitiatedBy); err != nil {
+            return err
+        }
+        if completedAt.Valid {
+            rot.CompletedAt = &completedAt.Time
+        }
+        report.Keys.Rotations = append(report.Keys.Rotations, rot)
+    }
+    if err := rows.Err(); err != nil {
+        return err
+    }
+    
+    rows, err = ut.db.Query("SELECT key_type, enabled, interval_days, last_run_at, COALESCE(last_status, '') FROM key_rotation_policies ORDER BY key_type")
+    if err != nil {
+        return err
+    }
+    defer rows.Close()
+    for rows.Next() {
+        var p ComplianceRotationPolicy
+        var lastRunAt sql.NullTime
+        if err := rows.Scan(&p.KeyType, &p.Enabled, &p.IntervalDays, &lastRunAt, &p.LastStatus); err != nil {
+            return err
+        }
+        if lastRunAt.Valid {
+            p.LastRunAt = &lastRunAt.Time
+        }
+        if since, ok := activeSince[p.KeyType]; ok && p.Enabled {
+            p.Overdue = report.GeneratedAt.Sub(since) > time.Duration(p.IntervalDays)*24*time.Hour
+        }
+        report.Keys.Policies = append(report.Keys.Policies, p)
+    }
+    return rows.Err()
+}
+
+func (ut *UnifiedTokenizer) reportAccessReview(report *ComplianceReport) error {
+    rows, err := ut.db.Query(`
+        SELECT u.user_id, u.username, u.account_type, u.role, u.permissions, u.is_active,
+               COALESCE(u.locked_until > NOW(), FALSE), u.created_at, u.last_login_at, u.password_changed_at,
+               (SELECT COUNT(*) FROM api_keys k WHERE k.user_id = u.user_id AND k.is_active = TRUE
+                    AND (k.expires_at IS NULL OR k.expires_at > NOW()))
+        FROM users u ORDER BY u.username`)
+    if err != nil {
+        return err
+    }
+    defer rows.Close()
+    review := &report.AccessReview
+    dormantBefore := report.GeneratedAt.AddDate(0, 0, -90)
+    for rows.Next() {
+        var u ComplianceUser
+        var permissions []byte
+        var lastLogin, passwordChanged sql.NullTime
+        if err := rows.Scan(&u.UserID, &u.Username, &u.AccountType, &u.Role, &permissions, &u.Active,
+            &u.Locked, &u.CreatedAt, &lastLogin, &passwordChanged, &u.ActiveAPIKeys); err != nil {
+            return err
+        }
+        u.Permissions = []string{}
+        json.Unmarshal(permissions, &u.Permissions)
+        if lastLogin.Valid {
+            u.LastLoginAt = &lastLogin.Time
+        }
+        if passwordChanged.Valid {
+            u.PasswordChangedAt = &passwordChanged.Time
+        }
+        
+        switch {
+        case !u.Active:
+            review.Inactive++
+        case u.AccountType == "service":
+            review.Active++
+            review.ServiceAccounts++
+        default:
+            review.Active++
+            if !lastLogin.Valid {
+                review.NeverLoggedIn++
+            } else if lastLogin.Time.Before(dormantBefore) {
+                review.Dormant++
+            }
+        }
+        review.Users = append(review.Users, u)
+    }
+    return rows.Err()
+}
+
+func (ut *UnifiedTokenizer) reportTokens(report *ComplianceReport) error {
+    tokens := &report.Tokens
+    err := ut.db.QueryRow(`
+        SELECT (SELECT COUNT(*) FROM credit_cards WHERE revoked_at >= ? AND revoked_at < ?),
+               (SELECT COUNT(*) FROM credit_cards WHERE is_active = TRUE)`,
+        report.Start, report.End).Scan(&tokens.Revoked, &tokens.Active)
+    if err != nil {
+        return err
+    }
+    rows, err := ut.db.Query(`
+        SELECT COALESCE(source, 'proxy'), COUNT(*) FROM credit_cards
+        WHERE created_at >= ? AND created_at < ? GROUP BY 1`, report.Start, report.End)
+    if err != nil {
+        return err
+    }
+    defer rows.Close()
+    for rows.Next() {
+        var source string
+        var count int64
+        if err := rows.Scan(&source, &count); err != nil {
+            return err
+        }
+        tokens.BySource[source] += count
+        tokens.Created += count
+    }
+    return rows.Err()
+}
+
+func (ut *UnifiedTokenizer) reportDetokenizations(report *ComplianceReport) error {
+    detok := &report.Detokenizations
+    err := ut.db.QueryRow(`
+        SELECT (SELECT COUNT(*) FROM token_requests
+                WHERE request_type = 'detokenize' AND request_timestamp >= ? AND request_timestamp < ?)
+             + (SELECT COUNT(*) FROM token_requests_archive
+                WHERE request_type = 'detokenize' AND request_timestamp >= ? AND request_timestamp < ?),
+               (SELECT COUNT(*) FROM security_audit_log
+                WHERE event_type = 'detokenize_quota_exceeded' AND created_at >= ? AND created_at < ?)`,
+        report.Start, report.End, report.Start, report.End, report.Start, report.End,
+    ).Scan(&detok.ProxyReveals, &detok.QuotaRefusals)
+    if err != nil {
+        return err
+    }
+    
+    rows, err := ut.db.Query(`
+        SELECT COALESCE(a.user_id, ''), COALESCE(MAX(u.username), ''), COUNT(*), COUNT(DISTINCT a.resource_id),
+               MIN(a.created_at), MAX(a.created_at)
+        FROM user_audit_log a LEFT JOIN users u ON u.user_id = a.user_id
+        WHERE a.action = 'token_revealed' AND a.created_at >= ? AND a.created_at < ?
+        GROUP BY a.user_id ORDER BY COUNT(*) DESC`, report.Start, report.End)
+    if err != nil {
+        return err
+    }
+    defer rows.Close()
+    for rows.Next() {
+        var r ComplianceRevealer
+        if err := rows.Scan(&r.Identity, &r.Username, &r.Reveals, &r.Tokens, &r.FirstAt, &r.LastAt); err != nil {
+            return err
+        }
+        detok.APIReveals += r.Reveals
+        detok.ByIdentity = append(detok.ByIdentity, r)
+    }
+    return rows.Err()
+}
+
+// reportTime formats a time in a PDF report, "-" for none
+func reportTime(t *time.Time) string {
+    if t == nil || t.IsZero() {
+        return "-"
+    }
+    return t.UTC().Format("2006-01-02 15:04")
+}
+
+// complianceReportPDF lays out a report as a PDF document
+func complianceReportPDF(report *ComplianceReport) []byte {
+    period := report.Start.UTC().Format("2006-01-02") + " to " + report.End.UTC().Format("2006-01-02")
+    doc := textpdf.New("TokenShield compliance report, " + period)
+    doc.Title("TokenShield compliance report")
+    doc.Text(fmt.Sprintf("Period: %s to %s (UTC)\nGenerated: %s by %s\nSigning key: %s (Ed25519; the signature is delivered beside this file)",
+        reportTime(&report.Start), reportTime(&report.End), reportTime(&report.GeneratedAt), report.GeneratedBy, report.SigningKeyID))
+    
+    doc.Heading("1. Encryption keys")
+    if !report.Keys.KEKDEK {
+        doc.Text("Cards are encrypted under the single legacy key (USE_KEK_DEK is off).")
+    }
+    var rows [][]string
+    for _, k := range report.Keys.Keys {
+        rows = append(rows, []string{k.KeyID, k.KeyType, strconv.Itoa(k.Version), k.Status,
+            reportTime(k.ActivatedAt), reportTime(k.RetiredAt), strconv.Itoa(k.AgeDays)})
+    }
+    doc.Table([]string{"KEY", "TYPE", "VERSION", "STATUS", "ACTIVATED", "RETIRED", "AGE (DAYS)"}, rows)
+    rows = nil
+    for _, p := range report.Keys.Policies {
+        rows = append(rows, []string{p.KeyType, strconv.FormatBool(p.Enabled), strconv.Itoa(p.IntervalDays),
+            reportTime(p.LastRunAt), p.LastStatus, strconv.FormatBool(p.Overdue)})
+    }
+    doc.Text("Rotation policies:")
+    doc.Table([]string{"KEY TYPE", "ENABLED", "INTERVAL (DAYS)", "LAST RUN", "LAST STATUS", "OVERDUE"}, rows)
+    rows = nil
+    for _, rot := range report.Keys.Rotations {
+        rows = append(rows, []string{rot.RotationID, rot.KeyType, reportTime(&rot.StartedAt), reportTime(rot.CompletedAt),
+            rot.Status, rot.InitiatedBy})
+    }
+    doc.Text(fmt.Sprintf("Rotations started in the period: %d", len(report.Keys.Rotations)))
+    doc.Table([]string{"ROTATION", "TYPE", "STARTED", "COMPLETED", "STATUS", "BY"}, rows)
+    
+    review := report.AccessReview
+    doc.Heading("2. User access review")
+    doc.Text(fmt.Sprintf("%d active accounts (%d service accounts), %d inactive. %d active people have never logged in and %d have not logged in for 90 days.",
+        review.Active, review.ServiceAccounts, review.Inactive, review.NeverLoggedIn, review.Dormant))
+    rows = nil
+    for _, u := range review.Users {
+        status := "active"
+        if !u.Active {
+            status = "inactive"
+        } else if u.Locked {
+            status = "locked"
+        }
+        role := u.Role
+        if len(u.Permissions) > 0 {
+            role += " +" + strings.Join(u.Permissions, ",")
+        }
+        rows = append(rows, []string{u.Username, u.AccountType, role, status, reportTime(u.LastLoginAt), strconv.Itoa(u.ActiveAPIKeys)})
+    }
+    doc.Table([]string{"USERNAME", "TYPE", "ROLE", "STATUS", "LAST LOGIN", "API KEYS"}, rows)
+    
+    doc.Heading("3. Token volumes")
+    sources := make([]string, 0, len(report.Tokens.BySource))
+    for source, count := range report.Tokens.BySource {
+        sources = append(sources, fmt.Sprintf("%s %d", source, count))
+    }
+    sort.Strings(sources)
+    doc.Text(fmt.Sprintf("Tokens created in the period: %d (%s)\nTokens revoked in the period: %d\nActive tokens when the report was made: %d",
+        report.Tokens.Created, strings.Join(sources, ", "), report.Tokens.Revoked, report.Tokens.Active))
+    
+    detok := report.Detokenizations
+    doc.Heading("4. Detokenization access")
+    doc.Text(fmt.Sprintf("Full card reveals through the API: %d\nDetokenizations by the proxy: %d\nReveals refused over quota: %d",
+        detok.APIReveals, detok.ProxyReveals, detok.QuotaRefusals))
+    rows = nil
+    for _, r := range detok.ByIdentity {
+        rows = append(rows, []string{r.Identity, r.Username, strconv.FormatInt(r.Reveals, 10), strconv.FormatInt(r.Tokens, 10),
+            reportTime(&r.FirstAt), reportTime(&r.LastAt)})
+    }
+    doc.Table([]string{"IDENTITY", "USERNAME", "REVEALS", "TOKENS", "FIRST", "LAST"}, rows)
+    
+    if len(report.Notes) > 0 {
+        doc.Heading("Notes")
+        doc.Text("- " + strings.Join(report.Notes, "\n- "))
+    }
+    return doc.Bytes()
+}
+
+// handleComplianceReport makes a signed compliance report over a period,
+// as JSON or as a PDF. The Ed25519 signature of the body is returned in
+// X-Report-Signature, to keep beside the file.
+func (ut *UnifiedTokenizer) handleComplianceReport(w http.ResponseWriter, r *http.Request) {
+    query := r.URL.Query()
+    format := query.Get("format")
+    if format == "" {
+        format = "json"
+    }
+    if format != "json" && format != "pdf" {
+        apierror.Write(w, r, http.StatusBadRequest, apierror.InvalidRequest, "format must be json or pdf")
+        return
+    }
+    now := time.Now().UTC()
+    start, end, err := parseReportPeriod(query, now)
+    if err != nil {
+        apierror.Write(w, r, http.StatusBadRequest, apierror.InvalidRequest, err.Error())
+        return
+    }
+    if ut.reportKey == nil && ut.keyManager != nil && ut.keyManager.IsSealed() {
+        apierror.Write(w, r, http.StatusServiceUnavailable, apierror.VaultSealed, "Vault is sealed")
+        return
+    }
+    key, err := ut.reportSigningKey()
+    if err != nil {
+        log.Printf("Error deriving the report signing key: %v", err)
+        apierror.Write(w, r, http.StatusInternalServerError, apierror.InternalError, "Failed to sign the report")
+        return
+    }
+    
+    report, err := ut.buildComplianceReport(start, end, now)
+    if err != nil {
+        log.Printf("Error building compliance report: %v", err)
+        apierror.Write(w, r, http.StatusInternalServerError, apierror.InternalError, "Database error")
+        return
+    }
+    report.GeneratedBy = r.Header.Get("X-Username")
+    if report.GeneratedBy == "" {
+        report.GeneratedBy = r.Header.Get("X-User-ID")
+    }
+    keyID := reportKeyID(key.Public().(ed25519.PublicKey))
+    report.SigningKeyID = keyID
+    
+    var body []byte
+    contentType := "application/pdf"
+    if format == "json" {
+        body, _ = json.MarshalIndent(report, "", "  ")
+        body = append(body, '\n')
+        contentType = "application/json"
+    } else {
+        body = complianceReportPDF(report)
+    }
+    signature := ed25519.Sign(key, body)
+    sum := sha256.Sum256(body)
+    
+    ipAddress, userAgent := ut.getClientInfo(r)
+    ut.logAuditEvent(AuditEvent{
+        UserID:       r.Header.Get("X-User-ID"),
+        Action:       "compliance_report_generated",
+        ResourceType: "report",
+        IPAddress:    ipAddress,
+        UserAgent:    userAgent,
+        Details: map[string]interface{}{
+            "start":          start.Format(time.RFC3339),
+            "end":            end.Format(time.RFC3339),
+            "format":         format,
+            "sha256":         hex.EncodeToString(sum[:]),
+            "signing_key_id": keyID,
+        },
+    })
+    
+    filename := fmt.Sprintf("tokenshield-compliance_%s_%s.%s", start.Format("20060102"), end.Format("20060102"), format)
+    w.Header().Set("Content-Type", contentType)
+    w.Header().Set("Content-Disposition", `attachment; filename="`+filename+`"`)
+    w.Header().Set("X-Report-Signature", base64.StdEncoding.EncodeToString(signature))
+    w.Header().Set("X-Report-Signing-Key", keyID)
+    w.Write(body)
+}
+
+// handleReportSigningKey returns the public key compliance reports are
+// signed with, for auditors to check them
+func (ut *UnifiedTokenizer) handleReportSigningKey(w http.ResponseWriter, r *http.Request) {
+    if ut.reportKey == nil && ut.keyManager != nil && ut.keyManager.IsSealed() {
+        apierror.Write(w, r, http.StatusServiceUnavailable, apierror.VaultSealed, "Vault is sealed")
+        return
+    }
+    key, err := ut.reportSigningKey()
+    if err != nil {
+        apierror.Write(w, r, http.StatusInternalServerError, apierror.InternalError, "Failed to load the signing key")
+        return
+    }
+    public := key.Public().(ed25519.PublicKey)
+    der, _ := x509.MarshalPKIXPublicKey(public)
+    source := "file"
+    if ut.reportKey == nil {
+        source = "derived"
+    }
+    
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(map[string]interface{}{
+        "key_id":     reportKeyID(public),
+        "algorithm":  "Ed25519",
+        "public_key": string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})),
+        "source":     source,
+    })
+}
+
+// Operations of POST /api/v1/tokens/bulk
+const (
+    bulkRevoke    = "revoke"
+    bulkRestore   = "restore"
+    bulkSetExpiry = "set-expiry"
+    bulkTag       = "tag"
+)
+
+// bulkPermissions is the permission each bulk operation needs, the same as
+// for changing a single token
+var bulkPermissions = map[string]string{
+    bulkRevoke:    PermTokensDelete,
+    bulkRestore:   PermTokensDelete,
+    bulkSetExpiry: PermTokensWrite,
+    bulkTag:       PermTokensWrite,
+}
+
+const (
+    maxBulkTokens    = 10000 // Tokens one bulk request may change
+    defaultBulkBatch = 500   // Tokens changed per transaction
+    maxTagsPerToken  = 20
+    maxTagValueLength = 255
+)
+
+// tagKeyPattern matches tag keys such as "merchant" or "env"
+var tagKeyPattern = regexp.MustCompile(`^[A-Za-z0-9_.:-]{1,64}$`)
+
+// validateTag checks one tag key and value
+func validateTag(key, value string) error {
+    if !tagKeyPattern.MatchString(key) {
+        return fmt.Errorf("invalid tag key %q", key)
+    }
+    if value == "" || utf8.RuneCountInString(value) > maxTagValueLength {
+        return fmt.Errorf("tag %s: value must be 1 to %d characters", key, maxTagValueLength)
+    }
+    return nil
+}
+
+// validateTags checks the tags set on a token; none is fine
+func validateTags(tags map[string]string) error {
+    if len(tags) > maxTagsPerToken {
+        return fmt.Errorf("at most %d tags per token", maxTagsPerToken)
+    }
+    for key, value := range tags {
+        if err := validateTag(key, value); err != nil {
+            return err
+        }
+    }
+    return nil
+}
+
+// parseTag splits a "key=value" tag
+func parseTag(s string) (string, string, error) {
+    key, value, ok := strings.Cut(s, "=")
+    if !ok {
+        return "", "", fmt.Errorf("tag %q must be key=value", s)
+    }
+    key, value = strings.TrimSpace(key), strings.TrimSpace(value)
+    if err := validateTag(key, value); err != nil {
+        return "", "", err
+    }
+    return key, value, nil
+}
+
+// mergeTags returns base with override's tags added over it
+func mergeTags(base, override map[string]string) map[string]string {
+    if len(base) == 0 {
+        return override
+    }
+    merged := make(map[string]string, len(base)+len(override))
+    for key, value := range base {
+        merged[key] = value
+    }
+    for key, value := range override {
+        merged[key] = value
+    }
+    return merged
+}
+
+// tagUpdates turns tags into the form setTokenTags takes
+func tagUpdates(tags map[string]string) map[string]*string {
+    updates := make(map[string]*string, len(tags))
+    for key, value := range tags {
+        value := value
+        updates[key] = &value
+    }
+    return updates
+}
+
+// BulkTokenRequest is the body of POST /api/v1/tokens/bulk. The tokens are
+// listed, or selected with the same filter as search.
+type BulkTokenRequest struct {
+    Operation   string             `json:"operation"`
+    Tokens      []string           `json:"tokens,omitempty"`
+    Filter      *tokenFilter       `json:"filter,omitempty"`
+    ExpiryMonth int                `json:"expiry_month,omitempty"` // For set-expiry
+    ExpiryYear  int                `json:"expiry_year,omitempty"`  // For set-expiry
+    Tags        map[string]*string `json:"tags,omitempty"`         // For tag; a null value removes the tag
+    BatchSize   int                `json:"batch_size,omitempty"`
+}
+
+// BulkTokenResult is what a bulk operation did to one token
+type BulkTokenResult struct {
+    Token  string `json:"token"`
+    Status string `json:"status"` // updated, skipped, not_found or failed
+    Reason string `json:"reason,omitempty"`
+}
+
+// validate checks the parts of req that do not need the database
+func (req *BulkTokenRequest) validate() error {
+    if (len(req.Tokens) > 0) == (req.Filter != nil) {
+        return fmt.Errorf("give either tokens or filter")
+    }
+    if len(req.Tokens) > maxBulkTokens {
+        return fmt.Errorf("at most %d tokens per request", maxBulkTokens)
+    }
+    switch req.Operation {
+    case bulkSetExpiry:
+        currentYear := time.Now().Year()
+        if req.ExpiryMonth < 1 || req.ExpiryMonth > 12 {
+            return fmt.Errorf("expiry_month must be between 1 and 12")
+        }
+        if req.ExpiryYear < 2000 || req.ExpiryYear > currentYear+50 {
+            return fmt.Errorf("expiry_year must be between 2000 and %d", currentYear+50)
+        }
+    case bulkTag:
+        if len(req.Tags) == 0 || len(req.Tags) > maxTagsPerToken {
+            return fmt.Errorf("tags must have between 1 and %d entries", maxTagsPerToken)
+        }
+        for key, value := range req.Tags {
+            if value == nil {
+                if !tagKeyPattern.MatchString(key) {
+                    return fmt.Errorf("invalid tag key %q", key)
+                }
+            } else if err := validateTag(key, *value); err != nil {
+                return err
+            }
+        }
+    }
+    return nil
+}
+
+// handleBulkTokens applies one operation to many tokens, in transactions of
+// batch_size tokens, and reports the outcome for each token
+func (ut *UnifiedTokenizer) handleBulkTokens(w http.ResponseWriter, r *http.Request) {
+    // tokens.write is checked by requirePermission middleware; revoke and
+    // restore also need tokens.delete
+    
+    var req BulkTokenRequest
+    if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+        apierror.Write(w, r, http.StatusBadRequest, apierror.InvalidBody, "Invalid request body")
+        return
+    }
+    permission, ok := bulkPermissions[req.Operation]
+    if !ok {
+        apierror.Write(w, r, http.StatusBadRequest, apierror.InvalidRequest, "operation must be revoke, restore, set-expiry or tag")
+        return
+    }
+    if !ut.requestHasPermission(r, permission) {
+        apierror.Write(w, r, http.StatusForbidden, apierror.PermissionDenied, "Insufficient permissions")
+        return
+    }
+    if err := req.validate(); err != nil {
+        apierror.Write(w, r, http.StatusBadRequest, apierror.InvalidRequest, err.Error())
+        return
+    }
+    if req.BatchSize <= 0 {
+        req.BatchSize = defaultBulkBatch
+    }
+    
+    tokens, status, err := ut.bulkTargets(r, req)
+    if err != nil {
+        apierror.Write(w, r, status, apierror.CodeForStatus(status), err.Error())
+        return
+    }
+    
+    results := make([]BulkTokenResult, 0, len(tokens))
+    for start := 0; start < len(tokens); start += req.BatchSize {
+        batch := tokens[start:utils.Min(start+req.BatchSize, len(tokens))]
+        batchResults, err := ut.bulkBatch(req, batch)
+        if err != nil {
+            // The batch was rolled back, so none of its tokens changed
+            log.Printf("Bulk %s batch failed: %v", req.Operation, err)
+            batchResults = make([]BulkTokenResult, len(batch))
+            for i, token := range batch {
+                batchResults[i] = BulkTokenResult{Token: token, Status: "failed", Reason: "database error"}
+            }
+        }
+        results = append(results, batchResults...)
+    }
+    
+    counts := map[string]int{"updated": 0, "skipped": 0, "not_found": 0, "failed": 0}
+    var updated []string
+    for _, result := range results {
+        counts[result.Status]++
+        if result.Status == "updated" {
+            updated = append(updated, result.Token)
+        }
+    }
+    
+    details := map[string]interface{}{
+        "operation": req.Operation,
+        "matched":   len(tokens),
+        "counts":    counts,
+        "tokens":    updated,
+    }
+    if req.Filter != nil {
+        filter := *req.Filter
+        if filter.CardHolder != "" {
+            filter.CardHolder = "[REDACTED]"
+        }
+        details["filter"] = filter
+    }
+    ipAddress, userAgent := ut.getClientInfo(r)
+    ut.logAuditEvent(AuditEvent{
+        UserID:       r.Header.Get("X-User-ID"),
+        Action:       "tokens_bulk_" + strings.ReplaceAll(req.Operation, "-", "_"),
+        ResourceType: "token",
+        IPAddress:    ipAddress,
+        UserAgent:    userAgent,
+        Details:      details,
+    })
+    
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(map[string]interface{}{
+        "operation": req.Operation,
+        "matched":   len(tokens),
+        "updated":   counts["updated"],
+        "skipped":   counts["skipped"],
+        "not_found": counts["not_found"],
+        "failed":    counts["failed"],
+        "results":   results,
+    })
+}
+
+// bulkTargets returns the tokens a bulk request applies to: the listed
+// tokens without repeats, or those matching its filter. A refused request
+// is returned as an error for the client with its HTTP status.
+func (ut *UnifiedTokenizer) bulkTargets(r *http.Request, req BulkTokenRequest) ([]string, int, error) {
+    if req.Filter == nil {
+        seen := make(map[string]bool, len(req.Tokens))
+        tokens := make([]string, 0, len(req.Tokens))
+        for _, token := range req.Tokens {
+            if !seen[token] {
+                seen[token] = true
+                tokens = append(tokens, token)
+            }
+        }
+        return tokens, http.StatusOK, nil
+    }
+    
+    query, status, err := ut.selectTokens(r, *req.Filter)
+    if err != nil {
+        return nil, status, err
+    }
+    whereClause, args, err := query.WhereClause()
+    if err != nil {
+        log.Printf("Bulk token query: %v", err)
+        return nil, http.StatusInternalServerError, fmt.Errorf("Database error")
+    }
+    // An empty filter would select the whole vault
+    if whereClause == "" {
+        return nil, http.StatusBadRequest, fmt.Errorf("filter must have at least one condition")
+    }
+    
+    rows, err := ut.db.Query("SELECT token FROM credit_cards"+whereClause+" ORDER BY id LIMIT ?", append(args, maxBulkTokens+1)...)
+    if err != nil {
+        return nil, http.StatusInternalServerError, fmt.Errorf("Database error")
+    }
+    defer rows.Close()
+    var tokens []string
+    for rows.Next() {
+        var token string
+        if err := rows.Scan(&token); err != nil {
+            return nil, http.StatusInternalServerError, fmt.Errorf("Database error")
+        }
+        tokens = append(tokens, token)
+    }
+    if err := rows.Err(); err != nil {
+        return nil, http.StatusInternalServerError, fmt.Errorf("Database error")
+    }
+    if len(tokens) > maxBulkTokens {
+        return nil, http.StatusBadRequest, fmt.Errorf("filter matches more than %d tokens, narrow it", maxBulkTokens)
+    }
+    return tokens, http.StatusOK, nil
+}
+
+// bulkBatch applies req to tokens in one transaction. The cards are locked
+// first, so each token's result reflects the state it was changed from.
+func (ut *UnifiedTokenizer) bulkBatch(req BulkTokenRequest, tokens []string) ([]BulkTokenResult, error) {
+    tx, err := ut.db.Begin()
+    if err != nil {
+        return nil, err
+    }
+    defer tx.Rollback()
+    
+    args := make([]interface{}, len(tokens))
+    for i, token := range tokens {
+        args[i] = token
+    }
+    rows, err := tx.Query(`
+        SELECT token, is_active, card_number_index FROM credit_cards
+        WHERE token IN (`+sqlbuild.Placeholders(len(tokens))+`) FOR UPDATE`, args...)
+    if err != nil {
+        return nil, err
+    }
+    type card struct {
+        active bool
+        index  []byte
+    }
+    cards := make(map[string]card, len(tokens))
+    for rows.Next() {
+        var token string
+        var c card
+        if err := rows.Scan(&token, &c.active, &c.index); err != nil {
+            rows.Close()
+            return nil, err
+        }
+        cards[token] = c
+    }
+    rows.Close()
+    if err := rows.Err(); err != nil {
+        return nil, err
+    }
+    
+    results := make([]BulkTokenResult, len(tokens))
+    var change []interface{}
+    restored := make(map[string]bool) // Blind indexes of cards restored in this batch
+    for i, token := range tokens {
+        results[i] = BulkTokenResult{Token: token, Status: "updated"}
+        c, ok := cards[token]
+        if !ok {
+            results[i].Status = "not_found"
+            continue
+        }
+        if req.Operation == bulkRevoke && !c.active {
+            results[i].Status, results[i].Reason = "skipped", "already revoked"
+            continue
+        }
+        if req.Operation == bulkRestore {
+            if c.active {
+                results[i].Status, results[i].Reason = "skipped", "not revoked"
+                continue
+            }
+            // As for a single restore, a card keeps at most one active
+            // token with DETERMINISTIC_TOKENS
+            if ut.deterministicTokens && len(c.index) > 0 {
+                var other string
+                err := tx.QueryRow(`
+                    SELECT token FROM credit_cards
+                    WHERE card_number_index = ? AND is_active = TRUE
+                    LIMIT 1`, c.index).Scan(&other)
+                if err != nil && err != sql.ErrNoRows {
+                    return nil, err
+                }
+                if err == nil || restored[string(c.index)] {
+                    results[i].Status, results[i].Reason = "skipped", "card has another active token"
+                    continue
+                }
+                restored[string(c.index)] = true
+            }
+        }
+        change = append(change, token)
+    }
+    if len(change) == 0 {
+        return results, nil
+    }
+    
+    placeholders := sqlbuild.Placeholders(len(change))
+    switch req.Operation {
+    case bulkRevoke:
+        _, err = tx.Exec(`
+            UPDATE credit_cards
+            SET is_active = FALSE, revoked_at = NOW(),
+                purge_after = IF(? > 0, DATE_ADD(NOW(), INTERVAL ? DAY), NULL)
+            WHERE token IN (`+placeholders+`)`,
+            append([]interface{}{ut.tokenPurgeDays, ut.tokenPurgeDays}, change...)...)
+    case bulkRestore:
+        _, err = tx.Exec(`
+            UPDATE credit_cards
+            SET is_active = TRUE, revoked_at = NULL, purge_after = NULL
+            WHERE token IN (`+placeholders+`)`, change...)
+    case bulkSetExpiry:
+        _, err = tx.Exec(`
+            UPDATE credit_cards SET expiry_month = ?, expiry_year = ?
+            WHERE token IN (`+placeholders+`)`,
+            append([]interface{}{req.ExpiryMonth, req.ExpiryYear}, change...)...)
+    case bulkTag:
+        err = setTokenTags(tx, change, req.Tags)
+    }
+    if err != nil {
+        return nil, err
+    }
+    if err := tx.Commit(); err != nil {
+        return nil, err
+    }
+    // The rows were locked above, so each token in change was switched
+    switch req.Operation {
+    case bulkRevoke:
+        ut.counters.AddActive(-int64(len(change)))
+    case bulkRestore:
+        ut.counters.AddActive(int64(len(change)))
+    }
+    return results, nil
+}
+
+// tokenTags returns the tags of token
+func (ut *UnifiedTokenizer) tokenTags(token string) (map[string]string, error) {
+    tags, err := ut.tagsForTokens([]string{token})
+    if err != nil {
+        return nil, err
+    }
+    if tags[token] == nil {
+        return map[string]string{}, nil
+    }
+    return tags[token], nil
+}
+
+// tagsForTokens returns the tags of each of tokens that has any
+func (ut *UnifiedTokenizer) tagsForTokens(tokens []string) (map[string]map[string]string, error) {
+    tags := make(map[string]map[string]string)
+    if len(tokens) == 0 {
+        return tags, nil
+    }
+    args := make([]interface{}, len(tokens))
+    for i, token := range tokens {
+        args[i] = token
+    }
+    rows, err := ut.db.Query("SELECT token, tag_key, tag_value FROM token_tags WHERE token IN ("+
+        sqlbuild.Placeholders(len(tokens))+")", args...)
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+    for rows.Next() {
+        var token, key, value string
+        if err := rows.Scan(&token, &key, &value); err != nil {
+            return nil, err
+        }
+        if tags[token] == nil {
+            tags[token] = make(map[string]string)
+        }
+        tags[token][key] = value
+    }
+    return tags, rows.Err()
+}
+
+// addTokenTags adds a "tags" entry to each token result that has tags
+func (ut *UnifiedTokenizer) addTokenTags(results []map[string]interface{}) error {
+    tokens := make([]string, 0, len(results))
+    for _, result := range results {
+        tokens = append(tokens, result["token"].(string))
+    }
+    tags, err := ut.tagsForTokens(tokens)
+    if err != nil {
+        return err
+    }
+    for _, result := range results {
+        if t := tags[result["token"].(string)]; t != nil {
+            result["tags"] = t
+        }
+    }
+    return nil
+}
+
+// execer is what setTokenTags writes through: the database or a transaction
+type execer interface {
+    Exec(query string, args ...interface{}) (sql.Result, error)
+}
+
+// setTokenTags sets tags on tokens; a nil value removes the tag
+func setTokenTags(tx execer, tokens []interface{}, tags map[string]*string) error {
+    placeholders := sqlbuild.Placeholders(len(tokens))
+    for key, value := range tags {
+        if value == nil {
+            if _, err := tx.Exec("DELETE FROM token_tags WHERE tag_key = ? AND token IN ("+placeholders+")",
+                append([]interface{}{key}, tokens...)...); err != nil {
+                return err
+            }
+            continue
+        }
+        values := make([]string, len(tokens))
+        args := make([]interface{}, 0, 3*len(tokens))
+        for i, token := range tokens {
+            values[i] = "(?, ?, ?)"
+            args = append(args, token, key, *value)
+        }
+        if _, err := tx.Exec(`
+            INSERT INTO token_tags (token, tag_key, tag_value) VALUES `+strings.Join(values, ", ")+`
+            ON DUPLICATE KEY UPDATE tag_value = VALUES(tag_value)`, args...); err != nil {
+            return err
+        }
+    }
+    return nil
+}
+
+func (ut *UnifiedTokenizer) handleAPIStats(w http.ResponseWriter, r *http.Request) {
+    // Permission check is handled by requirePermission middleware
+    
+    // Both come from the summary rows kept by ut.counters, not from
+    // counting credit_cards and token_requests
+    activeTokens, _ := counters.ActiveTokens(ut.db)
+    
+    requestStats := make(map[string]int64)
+    if byType, err := counters.RequestsSince(ut.db, time.Now().Add(-24*time.Hour)); err == nil {
+        for reqType, count := range byType {
+            requestStats[reqType] = count.Requests
+        }
+    }
+    
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(map[string]interface{}{
+        "active_tokens": activeTokens,
+        "requests_24h":  requestStats,
+        "inactivity":    ut.inactivityStats(),
+    })
+}
+
+// statsFlushInterval is how often count changes are written to
+// stats_counters, and so how far behind other replicas the figures can be
+const statsFlushInterval = 5 * time.Second
+
+// startStatsFlusher writes the counts of tokens stored and revoked and
+// requests made, and drops per-minute counts past counters.Retention
+func (ut *UnifiedTokenizer) startStatsFlusher() {
+    lastPrune := time.Time{}
+    for {
+        time.Sleep(statsFlushInterval)
+        if err := ut.counters.Flush(ut.db); err != nil {
+            log.Printf("Failed to write stats counters, will retry: %v", err)
+        }
+        if time.Since(lastPrune) >= time.Hour {
+            if err := ut.counters.Prune(ut.db, time.Now()); err != nil {
+                log.Printf("Failed to prune request counts: %v", err)
+            }
+            lastPrune = time.Now()
+        }
+    }
+}
+
+// handleStatsRecount sets the active token count from credit_cards, for
+// when it has drifted: a replica stopped before writing its changes, or
+// cards were changed directly in the database
+func (ut *UnifiedTokenizer) handleStatsRecount(w http.ResponseWriter, r *http.Request) {
+    // Permission check is handled by requirePermission middleware
+    
+    activeTokens, err := ut.counters.Recount(ut.db)
+    if err != nil {
+        apierror.Write(w, r, http.StatusInternalServerError, apierror.InternalError, "Database error")
+        return
+    }
+    
+    ipAddress, userAgent := ut.getClientInfo(r)
+    ut.logAuditEvent(AuditEvent{
+        UserID:       r.Header.Get("X-User-ID"),
+        Action:       "stats_recounted",
+        ResourceType: "stats",
+        Details:      map[string]interface{}{"active_tokens": activeTokens},
+        IPAddress:    ipAddress,
+        UserAgent:    userAgent,
+    })
+    
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(map[string]interface{}{
+        "active_tokens": activeTokens,
+    })
+}
+
+// Allowed group_by dimensions for time-series stats, mapped to their SQL
+// expression. API keys are credentials, so they are named by client and the
+// last characters of the key, like maskAPIKey.
+var timeSeriesDimensions = map[string]string{
+    "request_type": "tr.request_type",
+    "card_type":    "COALESCE(cc.card_type, 'Unknown')",
+    "api_key": `CASE WHEN tr.api_key_used IS NULL OR tr.api_key_used = '' THEN 'none'
+        WHEN CHAR_LENGTH(tr.api_key_used) < 12 THEN '****'
+        WHEN k.client_name IS NULL THEN CONCAT('****', RIGHT(tr.api_key_used, 4))
+        ELSE CONCAT(k.client_name, ' (****', RIGHT(tr.api_key_used, 4), ')') END`,
+    "outcome":      "CASE WHEN tr.response_status IS NULL THEN 'unknown' WHEN tr.response_status < 400 THEN 'success' ELSE 'error' END",
+    "none":         "'all'",
+}
+
+// handleAPIStatsTimeSeries returns bucketed request counts for dashboard charts
+func (ut *UnifiedTokenizer) handleAPIStatsTimeSeries(w http.ResponseWriter, r *http.Request) {
+    // Permission check is handled by requirePermission middleware
+
+    query := r.URL.Query()
+    window, err := stats.ParseWindow(query.Get("start"), query.Get("end"), query.Get("interval"), time.Now())
+    if err != nil {
+        apierror.Write(w, r, http.StatusBadRequest, apierror.InvalidRequest, err.Error())
+        return
+    }
+
+    groupBy := query.Get("group_by")
+    if groupBy == "" {
+        groupBy = "request_type"
+    }
+    groupExpr, ok := timeSeriesDimensions[groupBy]
+    if !ok {
+        apierror.Write(w, r, http.StatusBadRequest, apierror.InvalidRequest, "Invalid group_by. Use request_type, card_type, api_key, outcome or none")
+        return
+    }
+
+    // Optional filter on request type
+    where := "tr.request_timestamp >= ? AND tr.request_timestamp < ?"
+    args := []interface{}{window.Start, window.End}
+    if reqType := query.Get("request_type"); reqType != "" {
+        where += " AND tr.request_type = ?"
+        args = append(args, reqType)
+    }
+
+    // groupExpr and the bucket format come from fixed whitelists, never from user input
+    sqlQuery := fmt.Sprintf(`
+        SELECT DATE_FORMAT(tr.request_timestamp, '%s') AS bucket, %s AS dimension, COUNT(*)
+        FROM token_requests tr
+        LEFT JOIN credit_cards cc ON tr.token = cc.token
+        LEFT JOIN api_keys k ON k.api_key = tr.api_key_used
+        WHERE %s
+        GROUP BY bucket, dimension
+    `, window.Interval.MySQLFormat, groupExpr, where)
+
+    rows, err := ut.db.Query(sqlQuery, args...)
+    if err != nil {
+        log.Printf("Error querying time-series stats: %v", err)
+        apierror.Write(w, r, http.StatusInternalServerError, apierror.InternalError, "Database error")
+        return
+    }
+    defer rows.Close()
+
+    acc := stats.NewAccumulator(window)
+    var total int64
+    for rows.Next() {
+        var bucket, dimension string
+        var count int64
+        if err := rows.Scan(&bucket, &dimension, &count); err != nil {
+            continue
+        }
+        if err := acc.Add(bucket, dimension, count); err != nil {
+            log.Printf("Skipping unparseable stats bucket %q: %v", bucket, err)
+            continue
+        }
+        total += count
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(map[string]interface{}{
+        "start":    window.Start.Format(time.RFC3339),
+        "end":      window.End.Format(time.RFC3339),
+        "interval": window.Interval.Name,
+        "group_by": groupBy,
+        "total":    total,
+        "series":   acc.Series(),
+    })
+}
+
+// handleAPIStatusSummary returns the live figures shown on the embedded status page
+func (ut *UnifiedTokenizer) handleAPIStatusSummary(w http.ResponseWriter, r *http.Request) {
+    // Permission check is handled by requirePermission middleware
+
+    activeTokens, _ := counters.ActiveTokens(ut.db)
+
+    // Throughput and error rate over the last hour, plus the last 5 minutes for a live rate
+    now := time.Now()
+    var lastHour, last5Min, errorsLastHour int64
+    byType := make(map[string]int64)
+    if counts, err := counters.RequestsSince(ut.db, now.Add(-time.Hour)); err == nil {
+        for reqType, count := range counts {
+            byType[reqType] = count.Requests
+            lastHour += count.Requests
+            errorsLastHour += count.Errors
+        }
+    }
+    if counts, err := counters.RequestsSince(ut.db, now.Add(-5*time.Minute)); err == nil {
+        for _, count := range counts {
+            last5Min += count.Requests
+        }
+    }
+
+    errorRate := 0.0
+    if lastHour > 0 {
+        errorRate = float64(errorsLastHour) / float64(lastHour)
+    }
+
+    // Active key versions, when KEK/DEK is enabled
+    keys := map[string]interface{}{
+        "kek_dek_enabled": ut.useKEKDEK,
+    }
+    if ut.useKEKDEK {
+        for _, keyType := range []string{"KEK", "DEK"} {
+            var keyID string
+            var version int
+            var createdAt time.Time
+            err := ut.db.QueryRow(`
+                SELECT key_id, key_version, created_at
+                FROM encryption_keys
+                WHERE key_type = ? AND key_status = 'active'
+                ORDER BY key_version DESC LIMIT 1
+            `, keyType).Scan(&keyID, &version, &createdAt)
+            if err != nil {
+                keys[strings.ToLower(keyType)] = nil
+                continue
+            }
+            keys[strings.ToLower(keyType)] = map[string]interface{}{
+                "key_id":     keyID,
+                "version":    version,
+                "created_at": createdAt.Format(time.RFC3339),
+                "age_days":   int(time.Since(createdAt).Hours() / 24),
+            }
+        }
+    }
+
+    // Most recent security events
+    events := []map[string]interface{}{}
+    eventRows, err := ut.db.Query(`
+        SELECT event_type, severity, user_id, username, ip_address, endpoint, created_at
+        FROM security_audit_log
+        ORDER BY created_at DESC
+        LIMIT 20
+    `)
+    if err == nil {
+        defer eventRows.Close()
+        for eventRows.Next() {
+            var eventType, severity, ipAddress string
+            var userID, username, endpoint sql.NullString
+            var createdAt time.Time
+            if err := eventRows.Scan(&eventType, &severity, &userID, &username, &ipAddress, &endpoint, &createdAt); err != nil {
+                continue
+            }
+            event := map[string]interface{}{
+                "event_type": eventType,
+                "severity":   severity,
+                "ip_address": ipAddress,
+                "created_at": createdAt.Format(time.RFC3339),
+            }
+            if userID.Valid {
+                event["user_id"] = userID.String
+            }
+            if username.Valid {
+                event["username"] = username.String
+            }
+            if endpoint.Valid {
+                event["endpoint"] = endpoint.String
+            }
+            events = append(events, event)
+        }
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(map[string]interface{}{
+        "generated_at":  time.Now().UTC().Format(time.RFC3339),
+        "active_tokens": activeTokens,
+        "throughput": map[string]interface{}{
+            "requests_last_hour":  lastHour,
+            "requests_last_5_min": last5Min,
+            "requests_per_minute": float64(last5Min) / 5,
+            "by_type":             byType,
+        },
+        "errors": map[string]interface{}{
+            "errors_last_hour": errorsLastHour,
+            "error_rate":       errorRate,
+        },
+        "keys":            keys,
+        "security_events": events,
+    })
+}
+
+// Additional API endpoints for GUI/CLI
+
+// APIKeyRequest is the body of POST /api/v1/api-keys
+type APIKeyRequest struct {
+    ClientName  string   `json:"client_name"`
+    Permissions []string `json:"permissions,omitempty"`
+    Signed      bool     `json:"signed,omitempty"` // Only accept requests signed with the signing secret returned
+}
+
+func (ut *UnifiedTokenizer) handleCreateAPIKey(w http.ResponseWriter, r *http.Request) {
+    // Get user ID from request context (set by requirePermission middleware)
+    userID := r.Header.Get("X-User-ID")
+    if userID == "" {
+        apierror.Write(w, r, http.StatusInternalServerError, apierror.InternalError, "User context not found")
+        return
+    }
+    
+    var req APIKeyRequest
+    
+    if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+        apierror.Write(w, r, http.StatusBadRequest, apierror.InvalidBody, "Invalid request body")
+        return
+    }
+    
+    if req.ClientName == "" {
+        apierror.Write(w, r, http.StatusBadRequest, apierror.InvalidRequest, "client_name is required")
+        return
+    }
+    
+    // A service account could otherwise give itself a key that never expires
+    if service, err := ut.isServiceAccount(userID); err != nil {
+        apierror.Write(w, r, http.StatusInternalServerError, apierror.InternalError, "Database error")
+        return
+    } else if service {
+        apierror.Write(w, r, http.StatusForbidden, apierror.PermissionDenied, "Service accounts get API keys through /api/v1/service-accounts")
+        return
+    }
+    
+    apiKey, signingSecret, err := ut.issueAPIKey(userID, userID, req.ClientName, req.Permissions, req.Signed, 0)
+    if err != nil {
+        log.Printf("Failed to create API key: %v", err)
+        apierror.Write(w, r, http.StatusInternalServerError, apierror.InternalError, "Failed to create API key")
+        return
+    }
+    
+    response := map[string]interface{}{
+        "api_key":     apiKey,
+        "client_name": req.ClientName,
+        "permissions": req.Permissions,
+        "created_at":  time.Now().Format(time.RFC3339),
+    }
+    if req.Signed {
+        response["signed"] = true
+        response["signing_secret"] = signingSecret
+    }
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(response)
+}
+
+// issueAPIKey creates an API key of userID and returns it with, for a
+// signed key, its signing secret. With expiresInDays 0 it never expires.
+func (ut *UnifiedTokenizer) issueAPIKey(userID, createdBy, clientName string, permissions []string, signed bool, expiresInDays int) (apiKey, signingSecret string, err error) {
+    apiKey = "ts_" + generateRandomID()
+    secretHash := "hash_" + generateRandomID() // In production, use proper hashing
+    
+    permissionsJSON, _ := json.Marshal(permissions)
+    
+    // A signed key's secret is returned once and kept encrypted, as the
+    // server needs it to check signatures
+    var sealedSecret []byte
+    var secretKeyID sql.NullString
+    if signed {
+        secret := make([]byte, 32)
+        if _, err := cryptorand.Read(secret); err != nil {
+            return "", "", err
+        }
+        signingSecret = hex.EncodeToString(secret)
+        sealed, keyID, err := ut.encryptFields(signingSecret)
+        if err != nil {
+            return "", "", fmt.Errorf("failed to encrypt signing secret: %v", err)
+        }
+        sealedSecret, secretKeyID = sealed[0], keyID
+    }
+    
+    _, err = ut.db.Exec(`
+        INSERT INTO api_keys (api_key, api_secret_hash, signing_secret_encrypted, signing_secret_key_id, client_name, permissions, is_active, user_id, created_by, expires_at)
+        VALUES (?, ?, ?, ?, ?, ?, TRUE, ?, ?, IF(? > 0, DATE_ADD(NOW(), INTERVAL ? DAY), NULL))
+    `, apiKey, secretHash, sealedSecret, secretKeyID, clientName, permissionsJSON, userID, createdBy, expiresInDays, expiresInDays)
+    if err != nil {
+        return "", "", err
+    }
+    return apiKey, signingSecret, nil
+}
+
+// isServiceAccount reports whether userID is a service account
+func (ut *UnifiedTokenizer) isServiceAccount(userID string) (bool, error) {
+    var accountType string
+    err := ut.db.QueryRow("SELECT account_type FROM users WHERE user_id = ?", userID).Scan(&accountType)
+    if err == sql.ErrNoRows {
+        return false, nil
+    }
+    return accountType == "service", err
+}
+
+func (ut *UnifiedTokenizer) handleListAPIKeys(w http.ResponseWriter, r *http.Request) {
+    // Callers with api_keys.own instead of api_keys.read see only their keys
+    owner := ownerScope(r, PermAPIKeysRead)
+    
+    rows, err := ut.db.Query(`
+        SELECT api_key, user_id, client_name, permissions, is_active, signing_secret_encrypted IS NOT NULL, created_at, last_used_at, expires_at
+        FROM api_keys
+        WHERE ? = '' OR user_id = ?
+        ORDER BY created_at DESC
+    `, owner, owner)
+    
+    if err != nil {
+        apierror.Write(w, r, http.StatusInternalServerError, apierror.InternalError, "Database error")
+        return
+    }
+    defer rows.Close()
+    
+    var apiKeys []map[string]interface{}
+    
+    for rows.Next() {
+        var apiKey, clientName string
+        var userID, permissions sql.NullString
+        var isActive, signed bool
+        var createdAt time.Time
+        var lastUsedAt, expiresAt sql.NullTime
+        
+        err := rows.Scan(&apiKey, &userID, &clientName, &permissions, &isActive, &signed, &createdAt, &lastUsedAt, &expiresAt)
+        if err != nil {
+            continue
+        }
+        
+        keyInfo := map[string]interface{}{
+            "api_key":     apiKey,
+            "client_name": clientName,
+            "is_active":   isActive,
+            "signed":      signed,
+            "created_at":  createdAt.Format(time.RFC3339),
+        }
+        
+        if userID.Valid {
+            keyInfo["user_id"] = userID.String
+        }
+        
+        if permissions.Valid {
+            var perms []string
+            json.Unmarshal([]byte(permissions.String), &perms)
+            keyInfo["permissions"] = perms
+        }
+        
+        if lastUsedAt.Valid {
+            keyInfo["last_used_at"] = lastUsedAt.Time.Format(time.RFC3339)
+        }
+        
+        if expiresAt.Valid {
+            keyInfo["expires_at"] = expiresAt.Time.Format(time.RFC3339)
+        }
+        
+        apiKeys = append(apiKeys, keyInfo)
+    }
+    
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(map[string]interface{}{
+        "api_keys": apiKeys,
+        "total":    len(apiKeys),
+    })
+}
+
+func (ut *UnifiedTokenizer) handleRevokeAPIKey(w http.ResponseWriter, r *http.Request) {
+    // Callers with api_keys.own instead of api_keys.delete can only revoke
+    // their keys; others' are not found
+    owner := ownerScope(r, PermAPIKeysDelete)
+    
+    apiKey := strings.TrimPrefix(r.URL.Path, "/api/v1/api-keys/")
+    
+    result, err := ut.db.Exec(`
+        UPDATE api_keys SET is_active = FALSE WHERE api_key = ? AND (? = '' OR user_id = ?)
+    `, apiKey, owner, owner)
+    
+    if err != nil {
+        apierror.Write(w, r, http.StatusInternalServerError, apierror.InternalError, "Database error")
+        return
+    }
+    
+    rowsAffected, _ := result.RowsAffected()
+    if rowsAffected == 0 {
+        apierror.Write(w, r, http.StatusNotFound, apierror.APIKeyNotFound, "API key not found")
+        return
+    }
+    
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(map[string]string{"message": "API key revoked successfully"})
+}
+
+// allPermissions are the permissions a client certificate identity can be
+// limited to
+var allPermissions = []string{
+    PermTokensRead, PermTokensWrite, PermTokensDelete, PermTokensDetokenize, PermTokensReadPII,
+    PermAPIKeysRead, PermAPIKeysWrite, PermAPIKeysDelete, PermAPIKeysOwn, PermTokensOwn,
+    PermUsersRead, PermUsersWrite, PermUsersDelete,
+    PermSystemAdmin, PermActivityRead, PermStatsRead,
+}
+
+// ClientCertRequest is the body of POST /api/v1/client-certs
+type ClientCertRequest struct {
+    Identity    string   `json:"identity"` // URI:..., DNS:..., EMAIL:... or CN=...
+    ClientName  string   `json:"client_name"`
+    Permissions []string `json:"permissions"`
+}
+
+// clientCertificate is a client_certificates row a request authenticated as
+type clientCertificate struct {
+    CertID      string
+    Identity    string
+    UserID      string
+    Permissions []string
+}
+
+// allows reports whether the identity was granted permission. Its owner
+// must have it too.
+func (c *clientCertificate) allows(permission string) bool {
+    for _, p := range c.Permissions {
+        if p == permission {
+            return true
+        }
+    }
+    return false
+}
+
+// clientCertIdentities returns the identities a client certificate can be
+// mapped by, most specific first: its URI, DNS and email SANs, then its
+// subject common name
+func clientCertIdentities(cert *x509.Certificate) []string {
+    var identities []string
+    for _, u := range cert.URIs {
+        identities = append(identities, "URI:"+u.String())
+    }
+    for _, name := range cert.DNSNames {
+        identities = append(identities, "DNS:"+strings.ToLower(name))
+    }
+    for _, addr := range cert.EmailAddresses {
+        identities = append(identities, "EMAIL:"+strings.ToLower(addr))
+    }
+    if cert.Subject.CommonName != "" {
+        identities = append(identities, "CN="+cert.Subject.CommonName)
+    }
+    return identities
+}
+
+// normalizeCertIdentity checks an identity given through the API and puts
+// it in the form clientCertIdentities produces
+func normalizeCertIdentity(identity string) (string, error) {
+    identity = strings.TrimSpace(identity)
+    kind, value, ok := strings.Cut(identity, ":")
+    if strings.HasPrefix(identity, "CN=") {
+        kind, value, ok = "CN", identity[3:], true
+    }
+    if !ok || value == "" {
+        return "", fmt.Errorf("identity must be URI:<uri>, DNS:<name>, EMAIL:<address> or CN=<common name>")
+    }
+    switch strings.ToUpper(kind) {
+    case "URI":
+        if _, err := url.Parse(value); err != nil {
+            return "", fmt.Errorf("invalid URI in identity: %v", err)
+        }
+        return "URI:" + value, nil
+    case "DNS":
+        return "DNS:" + strings.ToLower(value), nil
+    case "EMAIL":
+        return "EMAIL:" + strings.ToLower(value), nil
+    case "CN":
+        return "CN=" + value, nil
+    }
+    return "", fmt.Errorf("identity must be URI:<uri>, DNS:<name>, EMAIL:<address> or CN=<common name>")
+}
+
+// verifiedClientCert returns the certificate a request was made with, if
+// MTLS_CLIENT_CA verified one. Browsers present their certificate to any
+// page that calls the API, so requests with an Origin header are treated
+// as having none.
+func verifiedClientCert(r *http.Request) *x509.Certificate {
+    if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 || r.Header.Get("Origin") != "" {
+        return nil
+    }
+    return r.TLS.VerifiedChains[0][0]
+}
+
+// clientCertFor returns the active client_certificates identity a
+// request's certificate maps to, preferring the most specific match, or
+// nil if it has none
+func (ut *UnifiedTokenizer) clientCertFor(r *http.Request) (*clientCertificate, error) {
+    cert := verifiedClientCert(r)
+    if cert == nil {
+        return nil, nil
+    }
+    identities := clientCertIdentities(cert)
+    if len(identities) == 0 {
+        return nil, nil
+    }
+    args := make([]interface{}, len(identities))
+    for i, identity := range identities {
+        args[i] = identity
+    }
+    rows, err := ut.db.Query(`
+        SELECT cert_id, identity, user_id, permissions FROM client_certificates
+        WHERE is_active = TRUE AND identity IN (?`+strings.Repeat(", ?", len(identities)-1)+`)
+    `, args...)
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+    found := map[string]*clientCertificate{}
+    for rows.Next() {
+        var c clientCertificate
+        var permissionsJSON []byte
+        if err := rows.Scan(&c.CertID, &c.Identity, &c.UserID, &permissionsJSON); err != nil {
+            return nil, err
+        }
+        json.Unmarshal(permissionsJSON, &c.Permissions)
+        found[c.Identity] = &c
+    }
+    if err := rows.Err(); err != nil {
+        return nil, err
+    }
+    for _, identity := range identities {
+        if c, ok := found[identity]; ok {
+            return c, nil
+        }
+    }
+    return nil, nil
+}
+
+// clientCertAllows reports whether the client certificate identity a
+// request authenticated as was granted permission. Requests authenticated
+// otherwise are not limited.
+func (ut *UnifiedTokenizer) clientCertAllows(r *http.Request, permission string) bool {
+    certID := r.Header.Get("X-Authenticated-Client-Cert")
+    if certID == "" {
+        return true
+    }
+    var permissionsJSON []byte
+    if err := ut.db.QueryRow("SELECT permissions FROM client_certificates WHERE cert_id = ? AND is_active = TRUE", certID).Scan(&permissionsJSON); err != nil {
+        return false
+    }
+    c := clientCertificate{CertID: certID}
+    json.Unmarshal(permissionsJSON, &c.Permissions)
+    return c.allows(permission)
+}
+
+func (ut *UnifiedTokenizer) handleCreateClientCert(w http.ResponseWriter, r *http.Request) {
+    // Get user ID from request context (set by requirePermission middleware)
+    userID := r.Header.Get("X-User-ID")
+    if userID == "" {
+        apierror.Write(w, r, http.StatusInternalServerError, apierror.InternalError, "User context not found")
+        return
+    }
+    
+    var req ClientCertRequest
+    if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+        apierror.Write(w, r, http.StatusBadRequest, apierror.InvalidBody, "Invalid request body")
+        return
+    }
+    identity, err := normalizeCertIdentity(req.Identity)
+    if err != nil {
+        apierror.Write(w, r, http.StatusBadRequest, apierror.InvalidRequest, err.Error())
+        return
+    }
+    if req.ClientName == "" {
+        apierror.Write(w, r, http.StatusBadRequest, apierror.InvalidRequest, "client_name is required")
+        return
+    }
+    if len(req.Permissions) == 0 {
+        apierror.Write(w, r, http.StatusBadRequest, apierror.InvalidRequest, "permissions must list what the identity may do")
+        return
+    }
+    for _, p := range req.Permissions {
+        known := false
+        for _, q := range allPermissions {
+            known = known || p == q
+        }
+        if !known {
+            apierror.Write(w, r, http.StatusBadRequest, apierror.InvalidRequest, fmt.Sprintf("unknown permission %q", p))
+            return
+        }
+    }
+    
+    certID := "cert_" + generateRandomID()
+    permissions, _ := json.Marshal(req.Permissions)
+    _, err = ut.db.Exec(`
+        INSERT INTO client_certificates (cert_id, identity, client_name, user_id, permissions, is_active, created_by)
+        VALUES (?, ?, ?, ?, ?, TRUE, ?)
+    `, certID, identity, req.ClientName, userID, permissions, userID)
+    if isDuplicateKey(err) {
+        apierror.Write(w, r, http.StatusConflict, apierror.AlreadyExists, "A client certificate with that identity exists")
+        return
+    } else if err != nil {
+        apierror.Write(w, r, http.StatusInternalServerError, apierror.InternalError, "Failed to create client certificate identity")
+        return
+    }
+    
+    ipAddress, userAgent := ut.getClientInfo(r)
+    ut.logAuditEvent(AuditEvent{
+        UserID:       userID,
+        Action:       "client_cert_created",
+        ResourceType: "client_certificate",
+        ResourceID:   certID,
+        Details:      map[string]interface{}{"identity": identity, "permissions": req.Permissions},
+        IPAddress:    ipAddress,
+        UserAgent:    userAgent,
+    })
+    
+    w.Header().Set("Content-Type", "application/json")
+    w.WriteHeader(http.StatusCreated)
+    json.NewEncoder(w).Encode(map[string]interface{}{
+        "cert_id":     certID,
+        "identity":    identity,
+        "client_name": req.ClientName,
+        "permissions": req.Permissions,
+        "created_at":  time.Now().Format(time.RFC3339),
+    })
+}
+
+func (ut *UnifiedTokenizer) handleListClientCerts(w http.ResponseWriter, r *http.Request) {
+    // Permission check is handled by requirePermission middleware
+    
+    rows, err := ut.db.Query(`
+        SELECT cert_id, identity, client_name, user_id, permissions, is_active, created_at, last_used_at
+        FROM client_certificates
+        ORDER BY created_at DESC
+    `)
+    if err != nil {
+        apierror.Write(w, r, http.StatusInternalServerError, apierror.InternalError, "Database error")
+        return
+    }
+    defer rows.Close()
+    
+    certs := []map[string]interface{}{}
+    for rows.Next() {
+        var certID, identity, clientName, userID string
+        var permissionsJSON []byte
+        var isActive bool
+        var createdAt time.Time
+        var lastUsedAt sql.NullTime
+        if err := rows.Scan(&certID, &identity, &clientName, &userID, &permissionsJSON, &isActive, &createdAt, &lastUsedAt); err != nil {
+            continue
+        }
+        var permissions []string
+        json.Unmarshal(permissionsJSON, &permissions)
+        cert := map[string]interface{}{
+            "cert_id":     certID,
+            "identity":    identity,
+            "client_name": clientName,
+            "user_id":     userID,
+            "permissions": permissions,
+            "is_active":   isActive,
+            "created_at":  createdAt.Format(time.RFC3339),
+        }
+        if lastUsedAt.Valid {
+            cert["last_used_at"] = lastUsedAt.Time.Format(time.RFC3339)
+        }
+        certs = append(certs, cert)
+    }
+    
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(map[string]interface{}{
+        "client_certs": certs,
+        "total":        len(certs),
+    })
+}
+
+func (ut *UnifiedTokenizer) handleRevokeClientCert(w http.ResponseWriter, r *http.Request) {
+    // Permission check is handled by requirePermission middleware
+    
+    certID := strings.TrimPrefix(r.URL.Path, "/api/v1/client-certs/")
+    result, err := ut.db.Exec("UPDATE client_certificates SET is_active = FALSE WHERE cert_id = ?", certID)
+    if err != nil {
+        apierror.Write(w, r, http.StatusInternalServerError, apierror.InternalError, "Database error")
+        return
+    }
+    if rowsAffected, _ := result.RowsAffected(); rowsAffected == 0 {
+        apierror.Write(w, r, http.StatusNotFound, apierror.ClientCertNotFound, "Client certificate identity not found")
+        return
+    }
+    
+    ipAddress, userAgent := ut.getClientInfo(r)
+    ut.logAuditEvent(AuditEvent{
+        UserID:       r.Header.Get("X-User-ID"),
+        Action:       "client_cert_revoked",
+        ResourceType: "client_certificate",
+        ResourceID:   certID,
+        IPAddress:    ipAddress,
+        UserAgent:    userAgent,
+    })
+    
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(map[string]string{"message": "Client certificate identity revoked successfully"})
+}
+
+// activityColumns are the token_requests fields the activity feed filters
+// and sorts by
+var activityColumns = sqlbuild.Columns{
+    "id":        "tr.id",
+    "type":      "tr.request_type",
+    "source_ip": "tr.source_ip",
+    "token":     "tr.token",
+    "timestamp": "tr.request_timestamp",
+}
+
+func (ut *UnifiedTokenizer) handleGetActivity(w http.ResponseWriter, r *http.Request) {
+    // Permission check is handled by requirePermission middleware
+    
+    // Get query parameters
+    limit := 50
+    if l := r.URL.Query().Get("limit"); l != "" {
+        if parsed, err := strconv.Atoi(l); err == nil && parsed > 0 && parsed <= 1000 {
+            limit = parsed
+        }
+    }
+    
+    // Optional filters; since_id returns only newer entries, oldest first,
+    // so clients can poll without missing or repeating events
+    query := activityColumns.Select()
+    
+    if t := r.URL.Query().Get("type"); t != "" {
+        query.Eq("type", t)
+    }
+    
+    if ip := r.URL.Query().Get("source_ip"); ip != "" {
+        query.Eq("source_ip", ip)
+    }
+    
+    if token := r.URL.Query().Get("token"); token != "" {
+        query.Eq("token", token)
+    }
+    
+    if s := r.URL.Query().Get("since_id"); s != "" {
+        sinceID, err := strconv.ParseInt(s, 10, 64)
+        if err != nil || sinceID < 0 {
+            apierror.Write(w, r, http.StatusBadRequest, apierror.InvalidRequest, "since_id must be a non-negative integer")
+            return
+        }
+        query.Where("id", ">", sinceID).Sort("id", false)
+    } else {
+        query.Sort("timestamp", true)
+    }
+    
+    whereClause, args, err := query.WhereClause()
+    if err != nil {
+        apierror.Write(w, r, http.StatusInternalServerError, apierror.InternalError, "Database error")
+        return
+    }
+    orderBy, _ := query.OrderClause()
+    
+    rows, err := ut.db.Query(`
+        SELECT tr.id, tr.token, tr.request_type, tr.source_ip, tr.destination_url, 
+               tr.request_timestamp, tr.response_status, cc.last_four_digits
+        FROM token_requests tr
+        LEFT JOIN credit_cards cc ON tr.token = cc.token
+        `+whereClause+orderBy+`
+        LIMIT ?
+    `, append(args, limit)...)
+    
+    if err != nil {
+        apierror.Write(w, r, http.StatusInternalServerError, apierror.InternalError, "Database error")
+        return
+    }
+    defer rows.Close()
+    
+    var activities []map[string]interface{}
+    
+    for rows.Next() {
+        var id int
+        var token, requestType, sourceIP, destinationURL string
+        var requestTimestamp time.Time
+        var responseStatus sql.NullInt64
+        var lastFour sql.NullString
+        
+        err := rows.Scan(&id, &token, &requestType, &sourceIP, &destinationURL, 
+                        &requestTimestamp, &responseStatus, &lastFour)
+        if err != nil {
+            continue
+        }
+        
+        activity := map[string]interface{}{
+            "id":          id,
+            "token":       token,
+            "type":        requestType,
+            "source_ip":   sourceIP,
+            "destination": destinationURL,
+            "timestamp":   requestTimestamp.Format(time.RFC3339),
+        }
+        
+        if responseStatus.Valid {
+            activity["status"] = responseStatus.Int64
+        }
+        
+        if lastFour.Valid {
+            activity["card_last_four"] = lastFour.String
+        }
+        
+        activities = append(activities, activity)
+    }
+    
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(map[string]interface{}{
+        "activities": activities,
+        "total":      len(activities),
+    })
+}
+
+// streamEventTypes returns the event types requested with ?types=, defaulting to activity
+func streamEventTypes(r *http.Request) map[string]bool {
+    types := map[string]bool{}
+    for _, t := range strings.Split(r.URL.Query().Get("types"), ",") {
+        if t = strings.TrimSpace(t); t != "" {
+            types[t] = true
+        }
+    }
+    if len(types) == 0 {
+        types[events.TypeActivity] = true
+    }
+    return types
+}
+
+func (ut *UnifiedTokenizer) handleEventStream(w http.ResponseWriter, r *http.Request) {
+    // Permission check is handled by requirePermission middleware
+    
+    types := streamEventTypes(r)
+    for t := range types {
+        if t != events.TypeActivity && t != events.TypeSecurity {
+            apierror.Write(w, r, http.StatusBadRequest, apierror.InvalidRequest, "types must be activity and/or security")
+            return
+        }
+    }
+    
+    flusher, ok := w.(http.Flusher)
+    if !ok {
+        apierror.Write(w, r, http.StatusInternalServerError, apierror.InternalError, "Streaming not supported")
+        return
+    }
+    
+    // Activity filters use the same names as /api/v1/activity
+    requestType := r.URL.Query().Get("type")
+    sourceIP := r.URL.Query().Get("source_ip")
+    token := r.URL.Query().Get("token")
+    
+    sub := ut.eventBroker.Subscribe()
+    defer ut.eventBroker.Unsubscribe(sub)
+    
+    w.Header().Set("Content-Type", "text/event-stream")
+    w.Header().Set("Cache-Control", "no-cache")
+    w.Header().Set("Connection", "keep-alive")
+    w.Header().Set("X-Accel-Buffering", "no") // Disable proxy buffering (nginx)
+    w.WriteHeader(http.StatusOK)
+    fmt.Fprintf(w, "retry: 3000\n\n")
+    flusher.Flush()
+    
+    heartbeat := time.NewTicker(15 * time.Second)
+    defer heartbeat.Stop()
+    
+    for {
+        select {
+        case <-r.Context().Done():
+            return
+        case <-heartbeat.C:
+            // Comment lines keep idle connections open through proxies
+            fmt.Fprintf(w, ": heartbeat\n\n")
+            flusher.Flush()
+        case event, ok := <-sub.C:
+            if !ok {
+                return
+            }
+            if !types[event.Type] {
+                continue
+            }
+            if activity, isActivity := event.Data.(map[string]interface{}); isActivity && event.Type == events.TypeActivity {
+                if (requestType != "" && activity["type"] != requestType) ||
+                    (sourceIP != "" && activity["source_ip"] != sourceIP) ||
+                    (token != "" && activity["token"] != token) {
+                    continue
+                }
+            }
+            
+            data, err := json.Marshal(event.Data)
+            if err != nil {
+                continue
+            }
+            fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", event.ID, event.Type, data)
+            flusher.Flush()
+        }
+    }
+}
+
+// tokenSearchColumns are the credit_cards fields token search filters and
+// sorts by. Search requests only choose among these names; their values go
+// to the database as arguments.
+var tokenSearchColumns = sqlbuild.Columns{
+    "last_four":         "last_four_digits",
+    "card_type":         "card_type",
+    "card_holder_index": "card_holder_name_index",
+    "external_id":       "external_id_index",
+    "tenant":            "tenant",
+    "created_by":        "created_by",
+    "created_at":        "created_at",
+    "expiry":            "expiry_year * 100 + expiry_month",
+    "is_active":         "is_active",
+    "tag":               "EXISTS (SELECT 1 FROM token_tags tt WHERE tt.token = credit_cards.token AND tt.tag_key = ? AND tt.tag_value = ?)",
+}
+
+// tokenSearchSorts are the search fields results can be ordered by
+var tokenSearchSorts = []string{"created_at", "expiry"}
+
+// tenantPattern matches the tenant names cards can be imported under
+var tenantPattern = regexp.MustCompile(`^[A-Za-z0-9_.-]{1,64}$`)
+
+// parseExpiryMonth parses a YYYY-MM expiry bound into the YYYYMM number the
+// "expiry" search field compares against
+func parseExpiryMonth(value string) (int, error) {
+    t, err := time.Parse("2006-01", value)
+    if err != nil {
+        return 0, fmt.Errorf("expiry must be YYYY-MM")
+    }
+    return t.Year()*100 + int(t.Month()), nil
+}
+
+// tokenFilter selects tokens by their stored fields, for search and bulk
+// operations. Empty fields are not filtered on.
+type tokenFilter struct {
+    LastFour   string `json:"lastFour,omitempty"`
+    CardType   string `json:"cardType,omitempty"`
+    CardHolder string `json:"cardHolder,omitempty"`
+    ExternalID string `json:"external_id,omitempty"`
+    Tenant     string `json:"tenant,omitempty"`
+    DateFrom   string `json:"date_from,omitempty"`
+    DateTo     string `json:"date_to,omitempty"`
+    ExpiryFrom string `json:"expiry_from,omitempty"` // YYYY-MM, inclusive
+    ExpiryTo   string `json:"expiry_to,omitempty"`   // YYYY-MM, inclusive
+    IsActive   *bool  `json:"active,omitempty"`
+    Tags       map[string]string `json:"tags,omitempty"` // All must match
+}
+
+// addTagConds restricts query to tokens carrying all of tags
+func addTagConds(query *sqlbuild.Select, tags map[string]string) error {
+    if err := validateTags(tags); err != nil {
+        return err
+    }
+    keys := make([]string, 0, len(tags))
+    for key := range tags {
+        keys = append(keys, key)
+    }
+    sort.Strings(keys)
+    for _, key := range keys {
+        query.Cond("tag", key, tags[key])
+    }
+    return nil
+}
+
+// selectTokens starts a credit_cards query with f's conditions. A refused
+// filter is returned as an error for the client with its HTTP status.
+func (ut *UnifiedTokenizer) selectTokens(r *http.Request, f tokenFilter) (*sqlbuild.Select, int, error) {
+    query := tokenSearchColumns.Select()
+    
+    if f.LastFour != "" {
+        query.Eq("last_four", f.LastFour)
+    }
+    
+    if f.CardType != "" {
+        query.Eq("card_type", f.CardType)
+    }
+    
+    // External IDs are stored encrypted, so they are matched by blind index
+    if f.ExternalID != "" {
+        index, err := ut.blindIndex(blindIndexExternalID, normalizeExternalID(f.ExternalID))
+        if err != nil {
+            return nil, http.StatusServiceUnavailable, fmt.Errorf("External ID search unavailable")
+        }
+        query.Eq("external_id", index)
+    }
+    
+    if f.Tenant != "" {
+        query.Eq("tenant", f.Tenant)
+    }
+    
+    // Exact (case and whitespace insensitive) name match via the blind index
+    if f.CardHolder != "" {
+        if !ut.requestHasPermission(r, PermTokensReadPII) {
+            return nil, http.StatusForbidden, fmt.Errorf("Insufficient permissions to search by cardholder name")
+        }
+        index, err := ut.blindIndex(blindIndexHolderName, normalizeHolderName(f.CardHolder))
+        if err != nil {
+            return nil, http.StatusServiceUnavailable, fmt.Errorf("Cardholder search unavailable")
+        }
+        query.Eq("card_holder_index", index)
+        
+        ipAddress, userAgent := ut.getClientInfo(r)
+        ut.logAuditEvent(AuditEvent{
+            UserID:       r.Header.Get("X-User-ID"),
+            Action:       "card_holder_searched",
+            ResourceType: "token",
+            IPAddress:    ipAddress,
+            UserAgent:    userAgent,
+        })
+    }
+    
+    if f.DateFrom != "" {
+        query.Where("created_at", ">=", f.DateFrom)
+    }
+    
+    if f.DateTo != "" {
+        query.Where("created_at", "<=", f.DateTo)
+    }
+    
+    // Cards without an expiry never match an expiry range
+    for _, bound := range []struct {
+        value, op string
+    }{{f.ExpiryFrom, ">="}, {f.ExpiryTo, "<="}} {
+        if bound.value == "" {
+            continue
+        }
+        month, err := parseExpiryMonth(bound.value)
+        if err != nil {
+            return nil, http.StatusBadRequest, fmt.Errorf("expiry_from and expiry_to must be YYYY-MM")
+        }
+        query.Where("expiry", bound.op, month)
+    }
+    
+    if f.IsActive != nil {
+        query.Eq("is_active", *f.IsActive)
+    }
+    
+    if err := addTagConds(query, f.Tags); err != nil {
+        return nil, http.StatusBadRequest, err
+    }
+    
+    return query, http.StatusOK, nil
+}
+
+// TokenSearchRequest is the body of POST /api/v1/tokens/search
+type TokenSearchRequest struct {
+    tokenFilter
+    Sort      string `json:"sort,omitempty"`  // created_at (default) or expiry
+    Order     string `json:"order,omitempty"` // desc (default) or asc
+    Limit     int    `json:"limit,omitempty"`
+}
+
+func (ut *UnifiedTokenizer) handleSearchTokens(w http.ResponseWriter, r *http.Request) {
+    // Permission check is handled by requirePermission middleware
+    
+    var req TokenSearchRequest
+    
+    if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+        apierror.Write(w, r, http.StatusBadRequest, apierror.InvalidBody, "Invalid request body")
+        return
+    }
+    
+    if req.Limit <= 0 || req.Limit > 1000 {
+        req.Limit = 100
+    }
+    if req.Sort == "" {
+        req.Sort = "created_at"
+    }
+    validSort := false
+    for _, field := range tokenSearchSorts {
+        validSort = validSort || req.Sort == field
+    }
+    if !validSort || (req.Order != "" && req.Order != "asc" && req.Order != "desc") {
+        apierror.Write(w, r, http.StatusBadRequest, apierror.InvalidRequest, "Invalid sort. Use created_at or expiry, with order asc or desc")
+        return
+    }
+    
+    query, status, err := ut.selectTokens(r, req.tokenFilter)
+    if err != nil {
+        apierror.Write(w, r, status, apierror.CodeForStatus(status), err.Error())
+        return
+    }
+    // Callers with tokens.own instead of tokens.read find only the cards
+    // imported for them
+    if owner := ownerScope(r, PermTokensRead); owner != "" {
+        query.Eq("created_by", owner)
+    }
+    
+    query.Sort(req.Sort, req.Order != "asc")
+    whereClause, args, err := query.WhereClause()
+    if err != nil {
+        log.Printf("Token search query: %v", err)
+        apierror.Write(w, r, http.StatusInternalServerError, apierror.InternalError, "Database error")
+        return
+    }
+    orderBy, _ := query.OrderClause()
+    
+    // Get total count first
+    var total int
+    err = ut.db.QueryRow("SELECT COUNT(*) FROM credit_cards"+whereClause, args...).Scan(&total)
+    if err != nil {
+        apierror.Write(w, r, http.StatusInternalServerError, apierror.InternalError, "Database error")
+        return
+    }
+    
+    rows, err := ut.db.Query(`SELECT token, card_type, last_four_digits, first_six_digits, 
+                     expiry_month, expiry_year, external_id_encrypted, tenant,
+                     created_at, is_active, encryption_key_id FROM credit_cards`+whereClause+orderBy+" LIMIT ?",
+                     append(args, req.Limit)...)
+    if err != nil {
+        apierror.Write(w, r, http.StatusInternalServerError, apierror.InternalError, "Database error")
+        return
+    }
+    defer rows.Close()
+    
+    var tokens []map[string]interface{}
+    
+    for rows.Next() {
+        var token, lastFour, firstSix string
+        var cardType, tenant, keyID sql.NullString
+        var expiryMonth, expiryYear sql.NullInt64
+        var encryptedExternalID []byte
+        var createdAt time.Time
+        var isActive bool
+        
+        err := rows.Scan(&token, &cardType, &lastFour, &firstSix, &expiryMonth, &expiryYear,
+            &encryptedExternalID, &tenant, &createdAt, &isActive, &keyID)
+        if err != nil {
+            continue
+        }
+        
+        tokenInfo := map[string]interface{}{
+            "token":      token,
+            "last_four":  lastFour,
+            "first_six":  firstSix,
+            "created_at": createdAt.Format(time.RFC3339),
+            "is_active":  isActive,
+        }
+        
+        if cardType.Valid {
+            tokenInfo["card_type"] = cardType.String
+        }
+        if expiryMonth.Valid && expiryYear.Valid {
+            tokenInfo["expiry"] = fmt.Sprintf("%04d-%02d", expiryYear.Int64, expiryMonth.Int64)
+        }
+        if len(encryptedExternalID) > 0 {
+            if externalID, err := ut.decryptStoredField(encryptedExternalID, keyID); err == nil {
+                tokenInfo["external_id"] = externalID
+            } else {
+                log.Printf("Failed to decrypt external ID for token %s: %v", token, err)
+            }
+        }
+        if tenant.Valid {
+            tokenInfo["tenant"] = tenant.String
+        }
+        
+        tokens = append(tokens, tokenInfo)
+    }
+    
+    if err := ut.addTokenTags(tokens); err != nil {
+        log.Printf("Token search tags: %v", err)
+    }
+    
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(map[string]interface{}{
+        "tokens": tokens,
+        "total":  total,
+    })
+}
+
+func (ut *UnifiedTokenizer) handleGetVersion(w http.ResponseWriter, r *http.Request) {
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(map[string]interface{}{
+        "version":     apiVersion,
+        "build_time":  time.Now().Format(time.RFC3339),
+        "token_format": ut.tokenFormat,
+        "kek_dek_enabled": ut.useKEKDEK,
+        "features": []string{"tokenization", "detokenization", "api", "icap"},
+    })
+}
+
+// loadUpstreamTLS builds the TLS settings for connections to APP_ENDPOINT:
+// UPSTREAM_CA_BUNDLE pins the CAs its certificate must chain to instead of
+// the system roots, UPSTREAM_CLIENT_CERT and UPSTREAM_CLIENT_KEY present a
+// client certificate (reloaded from disk when renewed), and
+// UPSTREAM_TLS_INSECURE_SKIP_VERIFY turns verification off entirely.
+func loadUpstreamTLS() (*tls.Config, error) {
+    config := &tls.Config{MinVersion: tls.VersionTLS12}
+    if caFile := utils.GetEnv("UPSTREAM_CA_BUNDLE", ""); caFile != "" {
+        caPEM, err := os.ReadFile(caFile)
+        if err != nil {
+            return nil, fmt.Errorf("failed to read UPSTREAM_CA_BUNDLE: %v", err)
+        }
+        config.RootCAs = x509.NewCertPool()
+        if !config.RootCAs.AppendCertsFromPEM(caPEM) {
+            return nil, fmt.Errorf("UPSTREAM_CA_BUNDLE contains no PEM certificates")
+        }
+    }
+    if certFile, keyFile := utils.GetEnv("UPSTREAM_CLIENT_CERT", ""), utils.GetEnv("UPSTREAM_CLIENT_KEY", ""); certFile != "" || keyFile != "" {
+        if certFile == "" || keyFile == "" {
+            return nil, fmt.Errorf("UPSTREAM_CLIENT_CERT and UPSTREAM_CLIENT_KEY must be set together")
+        }
+        reloader, err := tlsreload.New(certFile, keyFile)
+        if err != nil {
+            return nil, fmt.Errorf("failed to load the upstream client certificate: %v", err)
+        }
+        config.GetClientCertificate = reloader.GetClientCertificate
+    }
+    switch insecure := utils.GetEnv("UPSTREAM_TLS_INSECURE_SKIP_VERIFY", "false"); insecure {
+    case "false":
+    case "true":
+        if config.RootCAs != nil {
+            return nil, fmt.Errorf("UPSTREAM_TLS_INSECURE_SKIP_VERIFY cannot be combined with UPSTREAM_CA_BUNDLE")
+        }
+        // Anyone on the path to the application could read the card
+        // numbers detokenized into its responses
+        log.Printf("WARNING: UPSTREAM_TLS_INSECURE_SKIP_VERIFY=true, the certificate of APP_ENDPOINT is not verified. Do not use this outside development.")
+        config.InsecureSkipVerify = true
+    default:
+        return nil, fmt.Errorf("invalid UPSTREAM_TLS_INSECURE_SKIP_VERIFY %q: use true or false", insecure)
+    }
+    return config, nil
+}
+
+// middleware wraps a handler with behaviour shared by its requests
+type middleware func(http.Handler) http.Handler
+
+// chain wraps h in middleware, the first outermost
+func chain(h http.Handler, middleware ...middleware) http.Handler {
+    for i := len(middleware) - 1; i >= 0; i-- {
+        h = middleware[i](h)
+    }
+    return h
+}
+
+// proxyHandler serves the tokenizing proxy port. It has a mux of its own,
+// so nothing registered on http.DefaultServeMux is reachable through it.
+func (ut *UnifiedTokenizer) proxyHandler() http.Handler {
+    mux := http.NewServeMux()
+    mux.HandleFunc("/", ut.handleTokenize)
+    return chain(mux,
+        apierror.RequestIDs,
+        forwardRequestID,
+        ut.proxyLogMiddleware,
+        ut.proxyMetricsMiddleware,
+        ut.proxyMaintenanceMiddleware,
+        ut.proxyRateLimitMiddleware,
+        ut.proxyBodyLimitMiddleware,
+    )
+}
+
+// forwardRequestID passes the request ID on to the application, so its
+// logs can be matched with the proxy's
+func forwardRequestID(next http.Handler) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        r.Header.Set(apierror.RequestIDHeader, apierror.RequestID(r))
+        next.ServeHTTP(w, r)
+    })
+}
+
+// statusRecorder remembers the status a handler answered with
+type statusRecorder struct {
+    http.ResponseWriter
+    status int
+}
+
+func (rec *statusRecorder) WriteHeader(status int) {
+    if rec.status == 0 {
+        rec.status = status
+    }
+    rec.ResponseWriter.WriteHeader(status)
+}
+
+func (rec *statusRecorder) Write(p []byte) (int, error) {
+    if rec.status == 0 {
+        rec.status = http.StatusOK
+    }
+    return rec.ResponseWriter.Write(p)
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer
+func (rec *statusRecorder) Unwrap() http.ResponseWriter {
+    return rec.ResponseWriter
+}
+
+// recordStatus serves r through next and returns the status it answered with
+func recordStatus(next http.Handler, w http.ResponseWriter, r *http.Request) int {
+    if rec, ok := w.(*statusRecorder); ok {
+        next.ServeHTTP(rec, r)
+        return rec.status
+    }
+    rec := &statusRecorder{ResponseWriter: w}
+    next.ServeHTTP(rec, r)
+    if rec.status == 0 {
+        return http.StatusOK
+    }
+    return rec.status
+}
+
+// proxyLogMiddleware logs each proxied request with its outcome
+func (ut *UnifiedTokenizer) proxyLogMiddleware(next http.Handler) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        start := time.Now()
+        status := recordStatus(next, w, r)
+        log.Printf("Request %s %s completed in %v with status %d (%s)", r.Method, r.URL.Path, time.Since(start), status, apierror.RequestID(r))
+    })
+}
+
+// proxyMetricsMiddleware counts proxied requests by status class and
+// their time to answer
+func (ut *UnifiedTokenizer) proxyMetricsMiddleware(next http.Handler) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        start := time.Now()
+        status := recordStatus(next, w, r)
+        if class := status/100 - 1; class >= 0 && class < len(ut.proxyResponses) {
+            atomic.AddInt64(&ut.proxyResponses[class], 1)
+        }
+        atomic.AddInt64(&ut.proxyDurationMicros, time.Since(start).Microseconds())
+    })
+}
+
+// proxyRateLimitMiddleware applies the rate-limit rules of the proxy class
+func (ut *UnifiedTokenizer) proxyRateLimitMiddleware(next http.Handler) http.Handler {
+    return ut.rateLimitByClass(func(*http.Request) string { return "proxy" }, next)
+}
+
+// proxyBodyLimitMiddleware refuses bodies over the path's limit, up front
+// when the client declared the length and otherwise once the limit is
+// reached while the handler reads it
+func (ut *UnifiedTokenizer) proxyBodyLimitMiddleware(next http.Handler) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        maxBody := ut.bodyLimits.maxFor(r.URL.Path)
+        if r.ContentLength > maxBody {
+            ut.rejectBody(w, r, maxBody)
+            return
+        }
+        if r.Body != http.NoBody {
+            r.Body = http.MaxBytesReader(w, r.Body, maxBody)
+        }
+        next.ServeHTTP(w, r)
+    })
+}
+
+func (ut *UnifiedTokenizer) startHTTPServer() {
+    log.Printf("Starting HTTP tokenization server on port %s", ut.httpPort)
+    if err := ut.listenAndServe(ut.httpPort, ut.proxyHandler(), ut.tlsConfig); err != nil {
+        log.Fatalf("HTTP server failed: %v", err)
+    }
+}
+
+// jsonResponseMiddleware declares /api/ responses as JSON unless the handler
+// says otherwise, and stops browsers sniffing them as HTML. Many error paths
+// write a body without setting Content-Type, which Go would otherwise guess.
+// Values in responses are encoded by encoding/json, which also escapes <, >
+// and &; data is stored as given, not HTML-escaped.
+func jsonResponseMiddleware(next http.Handler) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        if strings.HasPrefix(r.URL.Path, "/api/") {
+            w.Header().Set("Content-Type", "application/json")
+            w.Header().Set("X-Content-Type-Options", "nosniff")
+        }
+        next.ServeHTTP(w, r)
+    })
+}
+
+// CORS middleware. Preflight requests are answered here, before
+// authentication; other requests get the allow headers only when their
+// origin is allowed.
+func (ut *UnifiedTokenizer) corsMiddleware(next http.Handler) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        if ut.corsPolicy.Load().Apply(w, r) {
+            return
+        }
+        next.ServeHTTP(w, r)
+    })
+}
+
+// csrfToken is the token a session authenticated by its cookie must send
+// in X-CSRF-Token. It is derived from the session ID, which another site
+// can neither read nor set, so nothing is stored and every replica can
+// check it.
+func csrfToken(sessionID string) string {
+    mac := hmac.New(sha256.New, []byte(sessionID))
+    mac.Write([]byte("tokenshield-csrf"))
+    return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// Cookie names. When a cookie is Secure and host-only it is set with the
+// __Host- prefix, so browsers refuse a copy planted over plain HTTP or by
+// a sibling subdomain.
+const (
+    sessionCookieName = "session_id"
+    csrfCookieName    = "csrf_token"
+    hostCookiePrefix  = "__Host-"
+)
+
+// cookieConfig holds the attributes of the session and CSRF cookies
+type cookieConfig struct {
+    secure   string        // "auto", "true" or "false"; auto follows how the request arrived
+    domain   string        // Empty for host-only cookies
+    sameSite http.SameSite
+    proxies  *clientip.Resolver // Trusted to report HTTPS in X-Forwarded-Proto
+}
+
+// loadCookieConfig reads COOKIE_SECURE, COOKIE_DOMAIN and COOKIE_SAMESITE
+func loadCookieConfig(proxies *clientip.Resolver) (cookieConfig, error) {
+    cfg := cookieConfig{
+        proxies: proxies,
+        secure: strings.ToLower(utils.GetEnv("COOKIE_SECURE", "auto")),
+        domain: strings.TrimPrefix(strings.TrimSpace(utils.GetEnv("COOKIE_DOMAIN", "")), "."),
+    }
+    switch cfg.secure {
+    case "auto", "true", "false":
+    default:
+        return cfg, fmt.Errorf("invalid COOKIE_SECURE %q (use auto, true or false)", cfg.secure)
+    }
+    if strings.ContainsAny(cfg.domain, "/:; ") {
+        return cfg, fmt.Errorf("invalid COOKIE_DOMAIN %q", cfg.domain)
+    }
+    switch sameSite := strings.ToLower(utils.GetEnv("COOKIE_SAMESITE", "strict")); sameSite {
+    case "strict":
+        cfg.sameSite = http.SameSiteStrictMode
+    case "lax":
+        cfg.sameSite = http.SameSiteLaxMode
+    case "none":
+        // Browsers drop SameSite=None cookies that are not Secure
+        if cfg.secure == "false" {
+            return cfg, fmt.Errorf("COOKIE_SAMESITE=none requires COOKIE_SECURE=true or auto")
+        }
+        cfg.sameSite = http.SameSiteNoneMode
+    default:
+        return cfg, fmt.Errorf("invalid COOKIE_SAMESITE %q (use strict, lax or none)", sameSite)
+    }
+    return cfg, nil
+}
+
+// secureFor reports whether cookies set in response to r are Secure. In
+// auto mode they are when r came over TLS, directly or through a trusted
+// proxy that sets X-Forwarded-Proto.
+func (c cookieConfig) secureFor(r *http.Request) bool {
+    switch {
+    case c.secure == "true", c.sameSite == http.SameSiteNoneMode:
+        return true
+    case c.secure == "false":
+        return false
+    }
+    return c.proxies.HTTPS(r)
+}
+
+// name is the cookie name used for r
+func (c cookieConfig) name(r *http.Request, base string) string {
+    if c.domain == "" && c.secureFor(r) {
+        return hostCookiePrefix + base
+    }
+    return base
+}
+
+// cookie builds a cookie for the response to r
+func (c cookieConfig) cookie(r *http.Request, base, value string, expires time.Time, httpOnly bool) *http.Cookie {
+    return &http.Cookie{
+        Name:     c.name(r, base),
+        Value:    value,
+        Path:     "/",
+        Domain:   c.domain,
+        Expires:  expires,
+        HttpOnly: httpOnly,
+        Secure:   c.secureFor(r),
+        SameSite: c.sameSite,
+    }
+}
+
+// clear expires the session and CSRF cookies, under either name
+func (c cookieConfig) clear(w http.ResponseWriter, r *http.Request) {
+    for _, base := range []string{sessionCookieName, csrfCookieName} {
+        cookie := c.cookie(r, base, "", time.Time{}, base == sessionCookieName)
+        cookie.MaxAge = -1
+        http.SetCookie(w, cookie)
+        if cookie.Name != base {
+            plain := *cookie
+            plain.Name = base
+            http.SetCookie(w, &plain)
+        }
+    }
+}
+
+// sessionID returns the session ID from the session cookie. Only the name
+// the cookie would be set under is read, so when the __Host- prefix is in
+// use an unprefixed cookie planted by another host is ignored.
+func (c cookieConfig) sessionID(r *http.Request) string {
+    cookie, err := r.Cookie(c.name(r, sessionCookieName))
+    if err != nil {
+        return ""
+    }
+    return cookie.Value
+}
+
+// accountTokenPaths are the endpoints authenticated by a token mailed to the
+// user rather than by a session
+var accountTokenPaths = map[string]bool{
+    "/api/v1/auth/verify-email":    true,
+    "/api/v1/auth/forgot-password": true,
+    "/api/v1/auth/reset-password":  true,
+}
+
+// maxSignedRequestBody bounds the body of a signed request, which is read
+// whole to check its hash before the handler runs
+const maxSignedRequestBody = 200 * 1024 * 1024
+
+// signedRequestNonce is what X-Nonce may hold
+var signedRequestNonce = regexp.MustCompile(`^[A-Za-z0-9_-]{16,64}$`)
+
+// requestSignature is the signature of a request under secret: the hex
+// HMAC-SHA256 of its method, request URI as sent, X-Timestamp, X-Nonce and
+// the hex SHA-256 of its body, each followed by a newline
+func requestSignature(secret, method, requestURI, timestamp, nonce string, body []byte) string {
+    bodyHash := sha256.Sum256(body)
+    mac := hmac.New(sha256.New, []byte(secret))
+    fmt.Fprintf(mac, "%s\n%s\n%s\n%s\n%s\n", method, requestURI, timestamp, nonce, hex.EncodeToString(bodyHash[:]))
+    return hex.EncodeToString(mac.Sum(nil))
+}
+
+// signatureTime parses X-Timestamp, Unix seconds, and checks that it is
+// within skew of now either way
+func signatureTime(timestamp string, now time.Time, skew time.Duration) (time.Time, error) {
+    seconds, err := strconv.ParseInt(timestamp, 10, 64)
+    if err != nil {
+        return time.Time{}, errors.New("X-Timestamp must be Unix time in seconds")
+    }
+    t := time.Unix(seconds, 0)
+    if t.Before(now.Add(-skew)) || t.After(now.Add(skew)) {
+        return time.Time{}, fmt.Errorf("X-Timestamp is more than %s from the server time", skew)
+    }
+    return t, nil
+}
+
+// signatureMiddleware checks requests signed with an API key's signing
+// secret, those with X-Signature, and refuses them when the signature,
+// timestamp or nonce is wrong. A good one has its key passed on in
+// X-Verified-Signature, which requireAnyPermission asks of signed keys.
+func (ut *UnifiedTokenizer) signatureMiddleware(next http.Handler) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        // Set below only once the signature is verified
+        r.Header.Del("X-Verified-Signature")
+        if r.Header.Get("X-Signature") == "" {
+            next.ServeHTTP(w, r)
+            return
+        }
+        
+        reason, err := ut.verifySignedRequest(r)
+        if err != nil {
+            log.Printf("Failed to verify signed request: %v", err)
+            apierror.Write(w, r, http.StatusInternalServerError, apierror.InternalError, "Failed to verify signature")
+            return
+        }
+        if reason != "" {
+            ipAddress, userAgent := ut.getClientInfo(r)
+            ut.logSecurityEvent(SecurityEvent{
+                EventType: "invalid_signature",
+                Severity:  "medium",
+                IPAddress: ipAddress,
+                UserAgent: userAgent,
+                Endpoint:  r.URL.Path,
+                Details: map[string]interface{}{
+                    "api_key": r.Header.Get("X-API-Key"),
+                    "reason":  reason,
+                },
+            })
+            apierror.Write(w, r, http.StatusUnauthorized, apierror.InvalidSignature, reason)
+            return
+        }
+        r.Header.Set("X-Verified-Signature", r.Header.Get("X-API-Key"))
+        next.ServeHTTP(w, r)
+    })
+}
+
+// verifySignedRequest checks r's signature and records its nonce. It
+// returns why the request is refused, or "" when it is good; err is set
+// when the check itself failed.
+func (ut *UnifiedTokenizer) verifySignedRequest(r *http.Request) (reason string, err error) {
+    apiKey, timestamp, nonce := r.Header.Get("X-API-Key"), r.Header.Get("X-Timestamp"), r.Header.Get("X-Nonce")
+    if apiKey == "" || timestamp == "" || nonce == "" {
+        return "Signed requests need X-API-Key, X-Timestamp, X-Nonce and X-Signature", nil
+    }
+    if !signedRequestNonce.MatchString(nonce) {
+        return "X-Nonce must be 16 to 64 letters, digits, '_' or '-'", nil
+    }
+    signedAt, err := signatureTime(timestamp, time.Now(), ut.signatureSkew)
+    if err != nil {
+        return err.Error(), nil
+    }
+    
+    var sealed []byte
+    var keyID sql.NullString
+    err = ut.db.QueryRow(`
+        SELECT signing_secret_encrypted, signing_secret_key_id FROM api_keys
+        WHERE api_key = ? AND is_active = TRUE AND (expires_at IS NULL OR expires_at > NOW())`, apiKey).Scan(&sealed, &keyID)
+    if err == sql.ErrNoRows || (err == nil && sealed == nil) {
+        return "Invalid signature", nil
+    }
+    if err != nil {
+        return "", err
+    }
+    secret, err := ut.decryptFields(keyID, sealed)
+    if err != nil {
+        return "", err
+    }
+    
+    body, err := io.ReadAll(io.LimitReader(r.Body, maxSignedRequestBody+1))
+    if err != nil {
+        return "Failed to read request body", nil
+    }
+    if len(body) > maxSignedRequestBody {
+        return fmt.Sprintf("Signed request bodies are limited to %d MB", maxSignedRequestBody/(1024*1024)), nil
+    }
+    r.Body = io.NopCloser(bytes.NewReader(body))
+    want := requestSignature(secret[0], r.Method, r.RequestURI, timestamp, nonce, body)
+    if !hmac.Equal([]byte(want), []byte(strings.ToLower(r.Header.Get("X-Signature")))) {
+        return "Invalid signature", nil
+    }
+    
+    // Only nonces of good signatures are recorded, so nobody else can use
+    // up a client's nonces
+    _, err = ut.db.Exec("INSERT INTO api_key_nonces (api_key, nonce, expires_at) VALUES (?, ?, ?)",
+        apiKey, nonce, signedAt.Add(ut.signatureSkew))
+    if isDuplicateKey(err) {
+        return "X-Nonce was already used", nil
+    }
+    return "", err
+}
+
+// pruneRequestNonces deletes the nonces of signed requests whose timestamp
+// is too old to be accepted again
+func (ut *UnifiedTokenizer) pruneRequestNonces() {
+    if _, err := ut.db.Exec("DELETE FROM api_key_nonces WHERE expires_at < NOW()"); err != nil {
+        log.Printf("Failed to prune request nonces: %v", err)
+    }
+}
+
+// csrfMiddleware rejects state-changing requests authenticated only by
+// the session cookie unless they carry the session's X-CSRF-Token. A page
+// on another site cannot add headers without passing CORS, so requests
+// with an API key or a Bearer session are exempt, as are login, which has
+// no session yet, and the endpoints taking a mailed token, which is itself
+// the credential. CSRF_PROTECTION=false turns the check off.
+func (ut *UnifiedTokenizer) csrfMiddleware(next http.Handler) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        switch r.Method {
+        case "GET", "HEAD", "OPTIONS":
+            next.ServeHTTP(w, r)
+            return
+        }
+        sessionID := ut.cookies.sessionID(r)
+        if !ut.csrfProtection || sessionID == "" || r.URL.Path == "/api/v1/auth/login" || accountTokenPaths[r.URL.Path] ||
+            r.Header.Get("X-API-Key") != "" || strings.HasPrefix(r.Header.Get("Authorization"), "Bearer ") ||
+            hmac.Equal([]byte(r.Header.Get("X-CSRF-Token")), []byte(csrfToken(sessionID))) {
+            next.ServeHTTP(w, r)
+            return
+        }
+        
+        ipAddress, userAgent := ut.getClientInfo(r)
+        ut.logSecurityEvent(SecurityEvent{
+            EventType: "csrf_rejected",
+            Severity:  "medium",
+            IPAddress: ipAddress,
+            UserAgent: userAgent,
+            Endpoint:  r.URL.Path,
+            Details: map[string]interface{}{
+                "method": r.Method,
+                "origin": r.Header.Get("Origin"),
+            },
+        })
+        w.Header().Set("Content-Type", "application/json")
+        apierror.Write(w, r, http.StatusForbidden, apierror.CSRFRejected, "Missing or invalid CSRF token")
+    })
+}
+
+// corsRefreshInterval is how soon a policy changed through the API on one
+// replica takes effect on the others
+const corsRefreshInterval = 30 * time.Second
+
+// CORSPolicyState is the CORS policy in force and where it came from
+type CORSPolicyState struct {
+    Policy    cors.Policy `json:"policy"`
+    Source    string      `json:"source"` // "config" for the CORS_* settings, "api" once set through /api/v1/cors
+    UpdatedBy string      `json:"updated_by,omitempty"`
+    UpdatedAt *time.Time  `json:"updated_at,omitempty"`
+}
+
+// loadCORSConfig reads the CORS_* settings, which apply until a policy is
+// set through the API. Without CORS_ALLOWED_ORIGINS no origin is allowed.
+func loadCORSConfig() (cors.Policy, error) {
+    list := func(key string) []string {
+        var values []string
+        for _, v := range strings.Split(utils.GetEnv(key, ""), ",") {
+            if v = strings.TrimSpace(v); v != "" {
+                values = append(values, v)
+            }
+        }
+        return values
+    }
+    maxAge, err := utils.IntSetting("CORS_MAX_AGE", 3600, 0, 86400)
+    if err != nil {
+        return cors.Policy{}, err
+    }
+    policy := cors.Policy{
+        AllowedOrigins:   list("CORS_ALLOWED_ORIGINS"),
+        AllowedMethods:   list("CORS_ALLOWED_METHODS"),
+        AllowedHeaders:   list("CORS_ALLOWED_HEADERS"),
+        ExposedHeaders:   list("CORS_EXPOSED_HEADERS"),
+        AllowCredentials: utils.GetEnv("CORS_ALLOW_CREDENTIALS", "false") == "true",
+        MaxAge:           maxAge,
+    }
+    if err := policy.Normalize(); err != nil {
+        return policy, fmt.Errorf("invalid CORS settings: %v", err)
+    }
+    return policy, nil
+}
+
+// loadSecurityHeaders reads the SECURITY_* settings: HSTS, X-Frame-Options,
+// Referrer-Policy and the Content Security Policies of API responses and of
+// the status page and Swagger UI. "off" leaves a header out.
+func loadSecurityHeaders() (secheaders.Headers, error) {
+    maxAge, err := utils.IntSetting("SECURITY_HSTS_MAX_AGE", 31536000, 0, 63072000)
+    if err != nil {
+        return secheaders.Headers{}, err
+    }
+    headers := secheaders.Headers{
+        HSTS:           secheaders.HSTS(maxAge, utils.GetEnv("SECURITY_HSTS_INCLUDE_SUBDOMAINS", "true") == "true", utils.GetEnv("SECURITY_HSTS_PRELOAD", "false") == "true"),
+        FrameOptions:   utils.GetEnv("SECURITY_FRAME_OPTIONS", secheaders.DefaultFrameOptions),
+        ReferrerPolicy: utils.GetEnv("SECURITY_REFERRER_POLICY", secheaders.DefaultReferrerPolicy),
+        CSP:            utils.GetEnv("SECURITY_CSP", secheaders.DefaultCSP),
+        PageCSP:        utils.GetEnv("SECURITY_CSP_PAGES", secheaders.DefaultPageCSP),
+    }
+    if err := headers.Normalize(); err != nil {
+        return headers, fmt.Errorf("invalid SECURITY_* settings: %v", err)
+    }
+    return headers, nil
+}
+
+// loadCORSPolicy returns the policy set through the API, or the CORS_*
+// settings when there is none
+func (ut *UnifiedTokenizer) loadCORSPolicy() (*CORSPolicyState, error) {
+    var data []byte
+    var updatedBy sql.NullString
+    var updatedAt time.Time
+    err := ut.db.QueryRow("SELECT policy, updated_by, updated_at FROM cors_policy WHERE id = 1").Scan(&data, &updatedBy, &updatedAt)
+    if err == sql.ErrNoRows {
+        return &CORSPolicyState{Policy: ut.corsConfig, Source: "config"}, nil
+    }
+    if err != nil {
+        return nil, err
+    }
+    state := &CORSPolicyState{Source: "api", UpdatedBy: updatedBy.String, UpdatedAt: &updatedAt}
+    if err := json.Unmarshal(data, &state.Policy); err != nil {
+        return nil, err
+    }
+    if err := state.Policy.Normalize(); err != nil {
+        return nil, err
+    }
+    return state, nil
+}
+
+// startCORSRefresher picks up policy changes made on other replicas
+func (ut *UnifiedTokenizer) startCORSRefresher() {
+    for {
+        if state, err := ut.loadCORSPolicy(); err != nil {
+            log.Printf("Failed to load CORS policy, keeping the current one: %v", err)
+        } else {
+            ut.corsPolicy.Store(&state.Policy)
+        }
+        time.Sleep(corsRefreshInterval)
+    }
+}
+
+// handleCORSPolicy shows (GET) or replaces (PUT) the CORS policy at
+// /api/v1/cors; DELETE goes back to the CORS_* settings
+func (ut *UnifiedTokenizer) handleCORSPolicy(w http.ResponseWriter, r *http.Request) {
+    // Permission check is handled by requirePermission middleware
+    
+    username := r.Header.Get("X-Username")
+    ipAddress, userAgent := ut.getClientInfo(r)
+    
+    switch r.Method {
+    case "PUT":
+        var policy cors.Policy
+        dec := json.NewDecoder(r.Body)
+        dec.DisallowUnknownFields()
+        if err := dec.Decode(&policy); err != nil {
+            apierror.Write(w, r, http.StatusBadRequest, apierror.InvalidBody, "Invalid request body")
+            return
+        }
+        if err := policy.Normalize(); err != nil {
+            apierror.Write(w, r, http.StatusBadRequest, apierror.InvalidRequest, err.Error())
+            return
+        }
+        data, _ := json.Marshal(policy)
+        _, err := ut.db.Exec(`
+            INSERT INTO cors_policy (id, policy, updated_by) VALUES (1, ?, ?)
+            ON DUPLICATE KEY UPDATE policy = VALUES(policy), updated_by = VALUES(updated_by)
+        `, string(data), username)
+        if err != nil {
+            apierror.Write(w, r, http.StatusInternalServerError, apierror.InternalError, "Database error")
+            return
+        }
+        ut.logAuditEvent(AuditEvent{
+            UserID:       r.Header.Get("X-User-ID"),
+            Action:       "cors_policy_updated",
+            ResourceType: "cors_policy",
+            IPAddress:    ipAddress,
+            UserAgent:    userAgent,
+            Details: map[string]interface{}{
+                "allowed_origins":   policy.AllowedOrigins,
+                "allow_credentials": policy.AllowCredentials,
+            },
+        })
+    case "DELETE":
+        if _, err := ut.db.Exec("DELETE FROM cors_policy WHERE id = 1"); err != nil {
+            apierror.Write(w, r, http.StatusInternalServerError, apierror.InternalError, "Database error")
+            return
+        }
+        ut.logAuditEvent(AuditEvent{
+            UserID:       r.Header.Get("X-User-ID"),
+            Action:       "cors_policy_reset",
+            ResourceType: "cors_policy",
+            IPAddress:    ipAddress,
+            UserAgent:    userAgent,
+        })
+    }
+    
+    state, err := ut.loadCORSPolicy()
+    if err != nil {
+        apierror.Write(w, r, http.StatusInternalServerError, apierror.InternalError, "Database error")
+        return
+    }
+    ut.corsPolicy.Store(&state.Policy)
+    
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(state)
+}
+
+// maintenanceRefreshInterval is how soon maintenance mode turned on or off
+// through the API on one replica takes effect on the others
+const maintenanceRefreshInterval = 30 * time.Second
+
+// maxMaintenanceRetryAfter bounds the Retry-After a maintenance window
+// announces
+const maxMaintenanceRetryAfter = 86400
+
+// Maintenance is the maintenance state set through /api/v1/maintenance.
+// While Enabled the proxy answers 503 with the maintenance page, full card
+// numbers are not revealed, and ICAP and egress requests are passed on
+// without detokenization unless bound for a critical destination.
+// ConfigFreeze blocks configuration changes through the API and can be
+// set on its own, for instance during a key ceremony.
+type Maintenance struct {
+    Enabled              bool     `json:"enabled"`
+    ConfigFreeze         bool     `json:"config_freeze"`
+    Message              string   `json:"message,omitempty"`
+    RetryAfter           int      `json:"retry_after,omitempty"` // Seconds, announced in Retry-After
+    CriticalDestinations []string `json:"critical_destinations,omitempty"` // Hosts still detokenized for during maintenance
+    Reason               string   `json:"reason,omitempty"` // Recorded in the audit log, e.g. "database failover"
+}
+
+// MaintenanceState is the maintenance state and who last changed it
+type MaintenanceState struct {
+    Maintenance
+    UpdatedBy string     `json:"updated_by,omitempty"`
+    UpdatedAt *time.Time `json:"updated_at,omitempty"`
+}
+
+// normalize checks m and fills in its defaults
+func (m *Maintenance) normalize() error {
+    if m.RetryAfter == 0 {
+        m.RetryAfter = 300
+    }
+    if m.RetryAfter < 0 || m.RetryAfter > maxMaintenanceRetryAfter {
+        return fmt.Errorf("retry_after must be between 1 and %d seconds", maxMaintenanceRetryAfter)
+    }
+    if len(m.Message) > 1024 {
+        return fmt.Errorf("message must be at most 1024 characters")
+    }
+    hosts := make([]string, 0, len(m.CriticalDestinations))
+    for _, h := range m.CriticalDestinations {
+        h = strings.ToLower(strings.TrimSpace(h))
+        if h == "" {
+            continue
+        }
+        if strings.ContainsAny(h, "/ ") {
+            return fmt.Errorf("invalid critical destination %q: use a host name", h)
+        }
+        hosts = append(hosts, h)
+    }
+    m.CriticalDestinations = hosts
+    return nil
+}
+
+// critical reports whether host, with or without a port, is one of m's
+// critical destinations
+func (m *Maintenance) critical(host string) bool {
+    if h, _, err := net.SplitHostPort(host); err == nil {
+        host = h
+    }
+    host = strings.ToLower(strings.TrimSuffix(host, "."))
+    for _, d := range m.CriticalDestinations {
+        if host == d {
+            return true
+        }
+    }
+    return false
+}
+
+// currentMaintenance returns the maintenance state in force
+func (ut *UnifiedTokenizer) currentMaintenance() *Maintenance {
+    if m := ut.maintenance.Load(); m != nil {
+        return m
+    }
+    return &Maintenance{}
+}
+
+// loadMaintenancePage reads MAINTENANCE_PAGE, a template replacing the
+// built-in maintenance page
+func loadMaintenancePage() (*maintenance.Page, error) {
+    file := utils.GetEnv("MAINTENANCE_PAGE", "")
+    if file == "" {
+        return maintenance.Default(), nil
+    }
+    page, err := maintenance.Load(file)
+    if err != nil {
+        return nil, fmt.Errorf("invalid MAINTENANCE_PAGE: %v", err)
+    }
+    return page, nil
+}
+
+// loadMaintenance returns the maintenance state set through the API; with
+// none, maintenance mode is off
+func (ut *UnifiedTokenizer) loadMaintenance() (*MaintenanceState, error) {
+    var data []byte
+    var updatedBy sql.NullString
+    var updatedAt time.Time
+    err := ut.db.QueryRow("SELECT state, updated_by, updated_at FROM maintenance_mode WHERE id = 1").Scan(&data, &updatedBy, &updatedAt)
+    if err == sql.ErrNoRows {
+        return &MaintenanceState{}, nil
+    }
+    if err != nil {
+        return nil, err
+    }
+    state := &MaintenanceState{UpdatedBy: updatedBy.String, UpdatedAt: &updatedAt}
+    if err := json.Unmarshal(data, &state.Maintenance); err != nil {
+        return nil, err
+    }
+    if err := state.Maintenance.normalize(); err != nil {
+        return nil, err
+    }
+    return state, nil
+}
+
+// startMaintenanceRefresher picks up maintenance mode changes made on
+// other replicas
+func (ut *UnifiedTokenizer) startMaintenanceRefresher() {
+    for {
+        if state, err := ut.loadMaintenance(); err != nil {
+            log.Printf("Failed to load maintenance state, keeping the current one: %v", err)
+        } else {
+            ut.maintenance.Store(&state.Maintenance)
+        }
+        time.Sleep(maintenanceRefreshInterval)
+    }
+}
+
+// handleMaintenance shows (GET) or sets (PUT) maintenance mode and the
+// config freeze at /api/v1/maintenance; DELETE ends both
+func (ut *UnifiedTokenizer) handleMaintenance(w http.ResponseWriter, r *http.Request) {
+    // Permission check is handled by requirePermission middleware
+    
+    username := r.Header.Get("X-Username")
+    ipAddress, userAgent := ut.getClientInfo(r)
+    
+    switch r.Method {
+    case "PUT":
+        var m Maintenance
+        dec := json.NewDecoder(r.Body)
+        dec.DisallowUnknownFields()
+        if err := dec.Decode(&m); err != nil {
+            apierror.Write(w, r, http.StatusBadRequest, apierror.InvalidBody, "Invalid request body")
+            return
+        }
+        if m.CriticalDestinations == nil {
+            m.CriticalDestinations = ut.maintenanceDestinations
+        }
+        if err := m.normalize(); err != nil {
+            apierror.Write(w, r, http.StatusBadRequest, apierror.InvalidRequest, err.Error())
+            return
+        }
+        data, _ := json.Marshal(m)
+        _, err := ut.db.Exec(`
+            INSERT INTO maintenance_mode (id, state, updated_by) VALUES (1, ?, ?)
+            ON DUPLICATE KEY UPDATE state = VALUES(state), updated_by = VALUES(updated_by)
+        `, string(data), username)
+        if err != nil {
+            apierror.Write(w, r, http.StatusInternalServerError, apierror.InternalError, "Database error")
+            return
+        }
+        ut.logAuditEvent(AuditEvent{
+            UserID:       r.Header.Get("X-User-ID"),
+            Action:       "maintenance_mode_updated",
+            ResourceType: "maintenance_mode",
+            IPAddress:    ipAddress,
+            UserAgent:    userAgent,
+            Details: map[string]interface{}{
+                "enabled":               m.Enabled,
+                "config_freeze":         m.ConfigFreeze,
+                "critical_destinations": m.CriticalDestinations,
+                "reason":                m.Reason,
+            },
+        })
+    case "DELETE":
+        if _, err := ut.db.Exec("DELETE FROM maintenance_mode WHERE id = 1"); err != nil {
+            apierror.Write(w, r, http.StatusInternalServerError, apierror.InternalError, "Database error")
+            return
+        }
+        ut.logAuditEvent(AuditEvent{
+            UserID:       r.Header.Get("X-User-ID"),
+            Action:       "maintenance_mode_ended",
+            ResourceType: "maintenance_mode",
+            IPAddress:    ipAddress,
+            UserAgent:    userAgent,
+        })
+    }
+    
+    state, err := ut.loadMaintenance()
+    if err != nil {
+        apierror.Write(w, r, http.StatusInternalServerError, apierror.InternalError, "Database error")
+        return
+    }
+    ut.maintenance.Store(&state.Maintenance)
+    
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(state)
+}
+
+// proxyMaintenanceMiddleware answers every proxied request with the
+// maintenance page while maintenance mode is on
+func (ut *UnifiedTokenizer) proxyMaintenanceMiddleware(next http.Handler) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        if m := ut.currentMaintenance(); m.Enabled {
+            atomic.AddInt64(&ut.maintenanceRefused[maintenanceProxy], 1)
+            ut.maintenancePage.Serve(w, r, m.Message, time.Duration(m.RetryAfter)*time.Second)
+            return
+        }
+        next.ServeHTTP(w, r)
+    })
+}
+
+// What maintenance mode refused, indexing maintenanceRefused
+const (
+    maintenanceProxy = iota
+    maintenanceReveal
+    maintenanceDetokenize
+    maintenanceConfig
+)
+
+// maintenanceRefusals names the maintenanceRefused counters in metrics
+var maintenanceRefusals = [...]string{"proxy", "reveal", "detokenize", "config"}
+
+// detokenizesFor reports whether ICAP and egress requests bound for host
+// are detokenized: always, except to non-critical destinations during
+// maintenance
+func (ut *UnifiedTokenizer) detokenizesFor(host string) bool {
+    m := ut.currentMaintenance()
+    if !m.Enabled || m.critical(host) {
+        return true
+    }
+    atomic.AddInt64(&ut.maintenanceRefused[maintenanceDetokenize], 1)
+    return false
+}
+
+// frozenConfigPaths are the API paths whose changes the config freeze
+// blocks. Key rotation, unsealing and token operations stay available, as
+// do the test endpoints, which change nothing.
+var frozenConfigPaths = []string{
+    "/api/v1/rate-limits", "/api/v1/cors", "/api/v1/config/", "/api/v1/ip-filters",
+    "/api/v1/quotas", "/api/v1/keys/policies", "/api/v1/users", "/api/v1/api-keys",
+    "/api/v1/client-certs", "/api/v1/roles",
+}
+
+// frozen reports whether a request to change path is blocked by the
+// config freeze
+func frozen(method, path string) bool {
+    if method == "GET" || method == "HEAD" || method == "OPTIONS" || strings.HasSuffix(path, "/test") {
+        return false
+    }
+    for _, prefix := range frozenConfigPaths {
+        if path == prefix || strings.HasPrefix(path, strings.TrimSuffix(prefix, "/")+"/") {
+            return true
+        }
+    }
+    return false
+}
+
+// configFreezeMiddleware refuses configuration changes with 423 while the
+// config freeze is on
+func (ut *UnifiedTokenizer) configFreezeMiddleware(next http.Handler) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        if ut.currentMaintenance().ConfigFreeze && frozen(r.Method, r.URL.Path) {
+            atomic.AddInt64(&ut.maintenanceRefused[maintenanceConfig], 1)
+            apierror.Write(w, r, http.StatusLocked, apierror.ConfigFrozen, "Configuration changes are frozen; end the freeze at /api/v1/maintenance first")
+            return
+        }
+        next.ServeHTTP(w, r)
+    })
+}
+
+// fieldRulesRefreshInterval is how soon field rules changed through the API
+// on one replica take effect on the others
+const fieldRulesRefreshInterval = 30 * time.Second
+
+// maxFieldRuleTestSize bounds the body of a field rule test
+const maxFieldRuleTestSize = 1 << 20
+
+// FieldRulesState is the field rules in force and where they came from
+type FieldRulesState struct {
+    Rules     FieldRules `json:"rules"`
+    Source    string     `json:"source"` // "config" for CARD_FIELD_MAPPINGS and DEEP_SCAN_FIELDS, "api" once set through /api/v1/config/field-rules
+    UpdatedBy string     `json:"updated_by,omitempty"`
+    UpdatedAt *time.Time `json:"updated_at,omitempty"`
+}
+
+// FieldRuleTestRequest is the body of POST /api/v1/config/field-rules/test
+type FieldRuleTestRequest struct {
+    Path    string          `json:"path,omitempty"`  // Proxy path the sample is sent to; default /
+    Payload json.RawMessage `json:"payload"`         // Sample JSON request body
+    Rules   *FieldRules     `json:"rules,omitempty"` // Rules to test instead of those in force
+}
+
+// FieldRuleTestResult is what the proxy would tokenize in a sample body
+type FieldRuleTestResult struct {
+    Path    string           `json:"path"`
+    Mapping string           `json:"mapping,omitempty"` // card_field_mappings prefix applied; empty for the default names
+    Source  string           `json:"source"`            // "request" for rules given with the test, otherwise as for GET
+    Fields  []FieldRuleMatch `json:"fields"`
+    Skipped []FieldRuleSkip  `json:"skipped"`
+}
+
+// loadFieldRules returns the field rules set through the API, or the
+// CARD_FIELD_MAPPINGS and DEEP_SCAN_FIELDS settings when there are none
+func (ut *UnifiedTokenizer) loadFieldRules() (*FieldRulesState, *fieldRules, error) {
+    var data []byte
+    var updatedBy sql.NullString
+    var updatedAt time.Time
+    state := &FieldRulesState{Rules: ut.fieldRulesConfig, Source: "config"}
+    err := ut.db.QueryRow("SELECT rules, updated_by, updated_at FROM field_rules WHERE id = 1").Scan(&data, &updatedBy, &updatedAt)
+    if err != nil && err != sql.ErrNoRows {
+        return nil, nil, err
+    }
+    if err == nil {
+        state = &FieldRulesState{Source: "api", UpdatedBy: updatedBy.String, UpdatedAt: &updatedAt}
+        if err := json.Unmarshal(data, &state.Rules); err != nil {
+            return nil, nil, err
+        }
+    }
+    rules, err := state.Rules.compile()
+    if err != nil {
+        return nil, nil, err
+    }
+    return state, rules, nil
+}
+
+// startFieldRulesRefresher picks up field rule changes made on other replicas
+func (ut *UnifiedTokenizer) startFieldRulesRefresher() {
+    for {
+        if _, rules, err := ut.loadFieldRules(); err != nil {
+            log.Printf("Failed to load field rules, keeping the current ones: %v", err)
+        } else {
+            ut.fieldRules.Store(rules)
+        }
+        time.Sleep(fieldRulesRefreshInterval)
+    }
+}
+
+// handleFieldRules shows (GET) or replaces (PUT) the field rules at
+// /api/v1/config/field-rules; DELETE goes back to the settings
+func (ut *UnifiedTokenizer) handleFieldRules(w http.ResponseWriter, r *http.Request) {
+    // Permission check is handled by requirePermission middleware
+    
+    username := r.Header.Get("X-Username")
+    ipAddress, userAgent := ut.getClientInfo(r)
+    
+    switch r.Method {
+    case "PUT":
+        var rules FieldRules
+        dec := json.NewDecoder(r.Body)
+        dec.DisallowUnknownFields()
+        if err := dec.Decode(&rules); err != nil {
+            apierror.Write(w, r, http.StatusBadRequest, apierror.InvalidBody, "Invalid request body")
+            return
+        }
+        if _, err := rules.compile(); err != nil {
+            apierror.Write(w, r, http.StatusBadRequest, apierror.InvalidRequest, err.Error())
+            return
+        }
+        if err := rules.checkEngines(ut.engines); err != nil {
+            apierror.Write(w, r, http.StatusBadRequest, apierror.InvalidRequest, err.Error())
+            return
+        }
+        data, _ := json.Marshal(rules)
+        _, err := ut.db.Exec(`
+            INSERT INTO field_rules (id, rules, updated_by) VALUES (1, ?, ?)
+            ON DUPLICATE KEY UPDATE rules = VALUES(rules), updated_by = VALUES(updated_by)
+        `, string(data), username)
+        if err != nil {
+            apierror.Write(w, r, http.StatusInternalServerError, apierror.InternalError, "Database error")
+            return
+        }
+        paths := make([]string, 0, len(rules.CardFieldMappings))
+        engines := make(map[string]string)
+        for prefix, mapping := range rules.CardFieldMappings {
+            paths = append(paths, prefix)
+            if mapping.Engine != "" {
+                engines[prefix] = mapping.Engine
+            }
+        }
+        sort.Strings(paths)
+        ut.logAuditEvent(AuditEvent{
+            UserID:       r.Header.Get("X-User-ID"),
+            Action:       "field_rules_updated",
+            ResourceType: "field_rules",
+            IPAddress:    ipAddress,
+            UserAgent:    userAgent,
+            Details: map[string]interface{}{
+                "mapped_paths":     paths,
+                "deep_scan_fields": rules.DeepScanFields,
+                "engines":          engines,
+            },
+        })
+    case "DELETE":
+        if _, err := ut.db.Exec("DELETE FROM field_rules WHERE id = 1"); err != nil {
+            apierror.Write(w, r, http.StatusInternalServerError, apierror.InternalError, "Database error")
+            return
+        }
+        ut.logAuditEvent(AuditEvent{
+            UserID:       r.Header.Get("X-User-ID"),
+            Action:       "field_rules_reset",
+            ResourceType: "field_rules",
+            IPAddress:    ipAddress,
+            UserAgent:    userAgent,
+        })
+    }
+    
+    state, rules, err := ut.loadFieldRules()
+    if err != nil {
+        apierror.Write(w, r, http.StatusInternalServerError, apierror.InternalError, "Database error")
+        return
+    }
+    ut.fieldRules.Store(rules)
+    ut.updateICAPISTag()
+    
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(state)
+}
+
+// handleTestFieldRules reports which fields of a sample body the proxy would
+// tokenize, under the rules in force or rules given with the request. No
+// card is stored, and the response only shows their last four digits.
+func (ut *UnifiedTokenizer) handleTestFieldRules(w http.ResponseWriter, r *http.Request) {
+    // Permission check is handled by requirePermission middleware
+    
+    var req FieldRuleTestRequest
+    dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxFieldRuleTestSize))
+    dec.DisallowUnknownFields()
+    if err := dec.Decode(&req); err != nil {
+        apierror.Write(w, r, http.StatusBadRequest, apierror.InvalidBody, "Invalid request body")
+        return
+    }
+    if len(req.Payload) == 0 {
+        apierror.Write(w, r, http.StatusBadRequest, apierror.InvalidRequest, "payload is required")
+        return
+    }
+    if req.Path == "" {
+        req.Path = "/"
+    }
+    if !strings.HasPrefix(req.Path, "/") {
+        apierror.Write(w, r, http.StatusBadRequest, apierror.InvalidRequest, "path must start with /")
+        return
+    }
+    
+    result := &FieldRuleTestResult{Path: req.Path, Fields: []FieldRuleMatch{}, Skipped: []FieldRuleSkip{}}
+    var rules *fieldRules
+    if req.Rules != nil {
+        var err error
+        if rules, err = req.Rules.compile(); err != nil {
+            apierror.Write(w, r, http.StatusBadRequest, apierror.InvalidRequest, err.Error())
+            return
+        }
+        if err = req.Rules.checkEngines(ut.engines); err != nil {
+            apierror.Write(w, r, http.StatusBadRequest, apierror.InvalidRequest, err.Error())
+            return
+        }
+        result.Source = "request"
+    } else {
+        state, active, err := ut.loadFieldRules()
+        if err != nil {
+            apierror.Write(w, r, http.StatusInternalServerError, apierror.InternalError, "Database error")
+            return
+        }
+        rules, result.Source = active, state.Source
+    }
+    
+    var payload interface{}
+    if err := json.Unmarshal(req.Payload, &payload); err != nil {
+        apierror.Write(w, r, http.StatusBadRequest, apierror.InvalidRequest, "payload must be JSON")
+        return
+    }
+    fields, prefix := rules.fieldsFor(req.Path)
+    result.Mapping = prefix
+    ut.testFieldRules(result, payload, "$", rules, fields, 0)
+    
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(result)
+}
+
+// ipFilterScopes are the listeners IP filters apply to: the management
+// API port and the ICAP port
+var ipFilterScopes = []string{"api", "icap"}
+
+// ipFilterRefreshInterval is how soon a filter changed through the API on
+// one replica takes effect on the others
+const ipFilterRefreshInterval = 30 * time.Second
+
+// ipBlockLogInterval limits ip_blocked security events to one per listener
+// and address per interval, so a scan cannot flood the audit log
+const ipBlockLogInterval = time.Minute
+
+// IPFilterState is the IP filter in force for a listener and where it came from
+type IPFilterState struct {
+    Scope     string          `json:"scope"`
+    Filter    ipfilter.Filter `json:"filter"`
+    Source    string          `json:"source"` // "config" for the *_CIDRS settings, "api" once set through /api/v1/ip-filters
+    UpdatedBy string          `json:"updated_by,omitempty"`
+    UpdatedAt *time.Time      `json:"updated_at,omitempty"`
+}
+
+// loadIPFilterConfig reads API_ALLOWED_CIDRS, API_DENIED_CIDRS,
+// ICAP_ALLOWED_CIDRS and ICAP_DENIED_CIDRS, which apply until a filter is
+// set through the API. Without them every address may connect.
+func loadIPFilterConfig() (map[string]ipfilter.Filter, error) {
+    filters := make(map[string]ipfilter.Filter)
+    for _, scope := range ipFilterScopes {
+        prefix := strings.ToUpper(scope)
+        filter := ipfilter.Filter{
+            Allow: strings.Split(utils.GetEnv(prefix+"_ALLOWED_CIDRS", ""), ","),
+            Deny:  strings.Split(utils.GetEnv(prefix+"_DENIED_CIDRS", ""), ","),
+        }
+        if err := filter.Normalize(); err != nil {
+            return nil, fmt.Errorf("invalid %s_ALLOWED_CIDRS or %s_DENIED_CIDRS: %v", prefix, prefix, err)
+        }
+        filters[scope] = filter
+    }
+    return filters, nil
+}
+
+// loadIPFilters returns each listener's filter: the one set through the
+// API, or the settings when there is none
+func (ut *UnifiedTokenizer) loadIPFilters() (map[string]*IPFilterState, error) {
+    states := make(map[string]*IPFilterState)
+    for _, scope := range ipFilterScopes {
+        states[scope] = &IPFilterState{Scope: scope, Filter: ut.ipFilterConfig[scope], Source: "config"}
+    }
+    
+    rows, err := ut.db.Query("SELECT scope, rules, updated_by, updated_at FROM ip_filters")
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+    for rows.Next() {
+        var scope string
+        var data []byte
+        var updatedBy sql.NullString
+        var updatedAt time.Time
+        if err := rows.Scan(&scope, &data, &updatedBy, &updatedAt); err != nil {
+            return nil, err
+        }
+        if states[scope] == nil {
+            continue
+        }
+        state := &IPFilterState{Scope: scope, Source: "api", UpdatedBy: updatedBy.String, UpdatedAt: &updatedAt}
+        if err := json.Unmarshal(data, &state.Filter); err != nil {
+            return nil, err
+        }
+        if err := state.Filter.Normalize(); err != nil {
+            return nil, err
+        }
+        states[scope] = state
+    }
+    return states, rows.Err()
+}
+
+// storeIPFilters puts loaded filters in force
+func (ut *UnifiedTokenizer) storeIPFilters(states map[string]*IPFilterState) {
+    filters := make(map[string]*ipfilter.Filter, len(states))
+    for scope, state := range states {
+        filters[scope] = &state.Filter
+    }
+    ut.ipFilters.Store(&filters)
+}
+
+// ipFilter returns the filter in force for a listener; a nil filter allows
+// every address
+func (ut *UnifiedTokenizer) ipFilter(scope string) *ipfilter.Filter {
+    if filters := ut.ipFilters.Load(); filters != nil {
+        return (*filters)[scope]
+    }
+    return nil
+}
+
+// startIPFilterRefresher picks up filter changes made on other replicas
+func (ut *UnifiedTokenizer) startIPFilterRefresher() {
+    for {
+        if states, err := ut.loadIPFilters(); err != nil {
+            log.Printf("Failed to load IP filters, keeping the current ones: %v", err)
+        } else {
+            ut.storeIPFilters(states)
+        }
+        time.Sleep(ipFilterRefreshInterval)
+    }
+}
+
+// ipFilterMiddleware refuses API requests from addresses the API port's
+// filter does not allow. The address is the client's as getClientInfo
+// finds it, so X-Forwarded-For only counts when it comes from a trusted
+// proxy. /health and /readyz stay open so load balancers and orchestrators
+// can still check the service.
+func (ut *UnifiedTokenizer) ipFilterMiddleware(next http.Handler) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        ipAddress, userAgent := ut.getClientInfo(r)
+        if r.URL.Path == "/health" || r.URL.Path == "/readyz" || ut.ipFilter("api").AllowsRemote(ipAddress) {
+            next.ServeHTTP(w, r)
+            return
+        }
+        ut.ipBlocked("api", ipAddress, r.URL.Path, userAgent)
+        w.Header().Set("Content-Type", "application/json")
+        apierror.Write(w, r, http.StatusForbidden, apierror.IPBlocked, "Access denied")
+    })
+}
+
+// ipBlocked counts a request or connection refused by a listener's filter
+// and logs an ip_blocked security event, unless one was logged for the
+// same address within ipBlockLogInterval
+func (ut *UnifiedTokenizer) ipBlocked(scope, remote, endpoint, userAgent string) {
+    if scope == "icap" {
+        atomic.AddInt64(&ut.ipBlockedICAP, 1)
+    } else {
+        atomic.AddInt64(&ut.ipBlockedAPI, 1)
+    }
+    ipAddress := remote
+    if host, _, err := net.SplitHostPort(remote); err == nil {
+        ipAddress = host
+    }
+    
+    if !ut.blockEventDue(scope + " " + ipAddress) {
+        return
+    }
+    
+    ut.logSecurityEvent(SecurityEvent{
+        EventType: "ip_blocked",
+        Severity:  "medium",
+        IPAddress: ipAddress,
+        UserAgent: userAgent,
+        Endpoint:  endpoint,
+        Details: map[string]interface{}{
+            "listener": scope,
+        },
+    })
+}
+
+// blockEventDue reports whether a refusal keyed by listener and address
+// should be logged, that is none was within ipBlockLogInterval, and if so
+// records it
+func (ut *UnifiedTokenizer) blockEventDue(key string) bool {
+    now := time.Now()
+    ut.ipBlockMu.Lock()
+    defer ut.ipBlockMu.Unlock()
+    if ut.ipBlockLogged == nil || len(ut.ipBlockLogged) >= 10000 {
+        ut.ipBlockLogged = make(map[string]time.Time)
+    }
+    if last, seen := ut.ipBlockLogged[key]; seen && now.Sub(last) < ipBlockLogInterval {
+        return false
+    }
+    ut.ipBlockLogged[key] = now
+    return true
+}
+
+// icapUnauthorized logs an icap_auth_failed security event for an ICAP
+// request without the shared secret, at most once per address per
+// ipBlockLogInterval
+func (ut *UnifiedTokenizer) icapUnauthorized(remote string) {
+    ipAddress := remote
+    if host, _, err := net.SplitHostPort(remote); err == nil {
+        ipAddress = host
+    }
+    if !ut.blockEventDue("icap_auth " + ipAddress) {
+        return
+    }
+    ut.logSecurityEvent(SecurityEvent{
+        EventType: "icap_auth_failed",
+        Severity:  "high",
+        IPAddress: ipAddress,
+        Endpoint:  "icap",
+    })
+}
+
+// icapISTagRefreshInterval is how soon the ICAP ISTag follows field rule
+// and key changes made on other replicas
+const icapISTagRefreshInterval = 30 * time.Second
+
+// icapISTag derives the ICAP service tag from what decides how the service
+// rewrites messages: the token format, the field rules and the active keys.
+// A change to any of them gives a new tag, so Squid drops cached responses.
+func (ut *UnifiedTokenizer) icapISTag() string {
+    h := sha256.New()
+    fmt.Fprintf(h, "format=%s bins=%s peer_bins=%v\n", ut.tokenFormat, strings.Join(ut.luhnBINs, ","), ut.peerBINs)
+    rules, _ := json.Marshal(ut.activeFieldRules().source)
+    fmt.Fprintf(h, "rules=%s\n", rules)
+    if ut.useKEKDEK && ut.keyManager != nil {
+        kek, dek := ut.keyManager.currentKeyIDs()
+        fmt.Fprintf(h, "kek=%s dek=%s\n", kek, dek)
+    }
+    return "TS-" + hex.EncodeToString(h.Sum(nil))[:16]
+}
+
+// updateICAPISTag sets the ICAP service tag for the current configuration
+func (ut *UnifiedTokenizer) updateICAPISTag() {
+    tag := ut.icapISTag()
+    if ut.icapServer.ISTag() != tag {
+        ut.icapServer.SetISTag(tag)
+        log.Printf("ICAP ISTag is now %s", tag)
+    }
+}
+
+// startICAPISTagRefresher keeps the ICAP service tag in step with changes
+// made on other replicas
+func (ut *UnifiedTokenizer) startICAPISTagRefresher() {
+    for {
+        time.Sleep(icapISTagRefreshInterval)
+        ut.updateICAPISTag()
+    }
+}
+
+// handleIPFilters lists the filter in force for each listener at
+// /api/v1/ip-filters
+func (ut *UnifiedTokenizer) handleIPFilters(w http.ResponseWriter, r *http.Request) {
+    // Permission check is handled by requirePermission middleware
+    
+    states, err := ut.loadIPFilters()
+    if err != nil {
+        apierror.Write(w, r, http.StatusInternalServerError, apierror.InternalError, "Database error")
+        return
+    }
+    ut.storeIPFilters(states)
+    
+    filters := make([]*IPFilterState, 0, len(ipFilterScopes))
+    for _, scope := range ipFilterScopes {
+        filters = append(filters, states[scope])
+    }
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(map[string]interface{}{"filters": filters})
+}
+
+// handleIPFilter shows (GET) or replaces (PUT) one listener's filter at
+// /api/v1/ip-filters/{api|icap}; DELETE goes back to the settings. A change
+// that would lock the caller's own address out of the API is refused.
+func (ut *UnifiedTokenizer) handleIPFilter(w http.ResponseWriter, r *http.Request) {
+    // Permission check is handled by requirePermission middleware
+    
+    scope := strings.TrimPrefix(r.URL.Path, "/api/v1/ip-filters/")
+    if _, ok := ut.ipFilterConfig[scope]; !ok {
+        apierror.Write(w, r, http.StatusNotFound, apierror.NotFound, "Unknown listener; use api or icap")
+        return
+    }
+    username := r.Header.Get("X-Username")
+    ipAddress, userAgent := ut.getClientInfo(r)
+    lockout := func(filter ipfilter.Filter) bool {
+        if scope != "api" || filter.AllowsRemote(ipAddress) {
+            return false
+        }
+        apierror.Write(w, r, http.StatusConflict, apierror.Conflict, "The filter would block your own address from the API")
+        return true
+    }
+    
+    switch r.Method {
+    case "PUT":
+        var filter ipfilter.Filter
+        dec := json.NewDecoder(r.Body)
+        dec.DisallowUnknownFields()
+        if err := dec.Decode(&filter); err != nil {
+            apierror.Write(w, r, http.StatusBadRequest, apierror.InvalidBody, "Invalid request body")
+            return
+        }
+        if err := filter.Normalize(); err != nil {
+            apierror.Write(w, r, http.StatusBadRequest, apierror.InvalidRequest, err.Error())
+            return
+        }
+        if lockout(filter) {
+            return
+        }
+        data, _ := json.Marshal(filter)
+        _, err := ut.db.Exec(`
+            INSERT INTO ip_filters (scope, rules, updated_by) VALUES (?, ?, ?)
+            ON DUPLICATE KEY UPDATE rules = VALUES(rules), updated_by = VALUES(updated_by)
+        `, scope, string(data), username)
+        if err != nil {
+            apierror.Write(w, r, http.StatusInternalServerError, apierror.InternalError, "Database error")
+            return
+        }
+        ut.logAuditEvent(AuditEvent{
+            UserID:       r.Header.Get("X-User-ID"),
+            Action:       "ip_filter_updated",
+            ResourceType: "ip_filter",
+            ResourceID:   scope,
+            IPAddress:    ipAddress,
+            UserAgent:    userAgent,
+            Details: map[string]interface{}{
+                "allow": filter.Allow,
+                "deny":  filter.Deny,
+            },
+        })
+    case "DELETE":
+        if lockout(ut.ipFilterConfig[scope]) {
+            return
+        }
+        if _, err := ut.db.Exec("DELETE FROM ip_filters WHERE scope = ?", scope); err != nil {
+            apierror.Write(w, r, http.StatusInternalServerError, apierror.InternalError, "Database error")
+            return
+        }
+        ut.logAuditEvent(AuditEvent{
+            UserID:       r.Header.Get("X-User-ID"),
+            Action:       "ip_filter_reset",
+            ResourceType: "ip_filter",
+            ResourceID:   scope,
+            IPAddress:    ipAddress,
+            UserAgent:    userAgent,
+        })
+    }
+    
+    states, err := ut.loadIPFilters()
+    if err != nil {
+        apierror.Write(w, r, http.StatusInternalServerError, apierror.InternalError, "Database error")
+        return
+    }
+    ut.storeIPFilters(states)
+    
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(states[scope])
+}
+
+// defaultRateLimitRules keeps the limit on authentication attempts that
+// applies when RATE_LIMIT_RULES is not set
+const defaultRateLimitRules = `[{"class":"auth","scope":"ip","limit":5,"window":"15m","block":"15m"}]`
+
+// rateLimitRefreshInterval is how soon rules changed through the API on one
+// replica take effect on the others
+const rateLimitRefreshInterval = 30 * time.Second
+
+// RateLimitState is the rate-limit rules in force and where they came from
+type RateLimitState struct {
+    Rules     []ratelimit.Rule `json:"rules"`
+    Source    string           `json:"source"` // "config" for RATE_LIMIT_RULES, "api" once set through /api/v1/rate-limits
+    UpdatedBy string           `json:"updated_by,omitempty"`
+    UpdatedAt *time.Time       `json:"updated_at,omitempty"`
+}
+
+// loadRateLimitConfig reads RATE_LIMIT_RULES, a JSON array of rules that
+// applies until rules are set through the API
+func loadRateLimitConfig() ([]ratelimit.Rule, error) {
+    rules := []ratelimit.Rule{}
+    if err := json.Unmarshal([]byte(utils.GetEnv("RATE_LIMIT_RULES", defaultRateLimitRules)), &rules); err != nil {
+        return nil, fmt.Errorf("invalid RATE_LIMIT_RULES: %v", err)
+    }
+    if err := ratelimit.NormalizeRules(rules); err != nil {
+        return nil, fmt.Errorf("invalid RATE_LIMIT_RULES: %v", err)
+    }
+    return rules, nil
+}
+
+// loadRateLimitRules returns the rules set through the API, or the
+// RATE_LIMIT_RULES setting when there are none
+func (ut *UnifiedTokenizer) loadRateLimitRules() (*RateLimitState, error) {
+    var data []byte
+    var updatedBy sql.NullString
+    var updatedAt time.Time
+    err := ut.db.QueryRow("SELECT rules, updated_by, updated_at FROM rate_limit_rules WHERE id = 1").Scan(&data, &updatedBy, &updatedAt)
+    if err == sql.ErrNoRows {
+        return &RateLimitState{Rules: ut.rateLimitConfig, Source: "config"}, nil
+    }
+    if err != nil {
+        return nil, err
+    }
+    state := &RateLimitState{Rules: []ratelimit.Rule{}, Source: "api", UpdatedBy: updatedBy.String, UpdatedAt: &updatedAt}
+    if err := json.Unmarshal(data, &state.Rules); err != nil {
+        return nil, err
+    }
+    if err := ratelimit.NormalizeRules(state.Rules); err != nil {
+        return nil, err
+    }
+    return state, nil
+}
+
+// startRateLimitRefresher picks up rule changes made on other replicas
+func (ut *UnifiedTokenizer) startRateLimitRefresher() {
+    for {
+        if state, err := ut.loadRateLimitRules(); err != nil {
+            log.Printf("Failed to load rate-limit rules, keeping the current ones: %v", err)
+        } else {
+            ut.rateLimitRules.Store(&state.Rules)
+        }
+        time.Sleep(rateLimitRefreshInterval)
+    }
+}
+
+// endpointClass sorts an API request into the class rate-limit rules apply
+// to; "" for requests that are never limited
+func endpointClass(r *http.Request) string {
+    switch {
+    case r.URL.Path == "/health" || r.URL.Path == "/readyz" || r.Method == "OPTIONS":
+        return ""
+    case r.Method == "POST" && (r.URL.Path == "/api/v1/auth/login" || r.URL.Path == "/api/v1/auth/change-password" || r.URL.Path == "/api/v1/auth/reauthenticate" || r.URL.Path == "/api/v1/unseal"):
+        return "auth"
+    case r.Method == "POST" && (r.URL.Path == "/api/v1/auth/forgot-password" || r.URL.Path == "/api/v1/auth/reset-password" || strings.HasPrefix(r.URL.Path, "/api/v1/auth/verify-email")):
+        return "auth"
+    case r.Method == "POST" && strings.HasPrefix(r.URL.Path, "/api/v1/tokens/") && strings.HasSuffix(r.URL.Path, "/reveal"):
+        return "detokenize"
+    case strings.HasPrefix(r.URL.Path, "/api/v1/cards/import"):
+        return "import"
+    case r.Method == "GET" || r.Method == "HEAD":
+        return "read"
+    }
+    return "write"
+}
+
+// rateLimitClient returns who a request is counted as under a rule's
+// scope: the client IP, or the API key or session it carries. A request
+// without credentials has no key and is not limited by "key" rules.
+func (ut *UnifiedTokenizer) rateLimitClient(r *http.Request, scope string) string {
+    if scope == "ip" {
+        ipAddress, _ := ut.getClientInfo(r)
+        return ipAddress
+    }
+    if apiKey := r.Header.Get("X-API-Key"); apiKey != "" {
+        return "api_key:" + apiKey
+    }
+    if cert := verifiedClientCert(r); cert != nil {
+        sum := sha256.Sum256(cert.Raw)
+        return "client_cert:" + hex.EncodeToString(sum[:])
+    }
+    if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+        return "session:" + strings.TrimPrefix(auth, "Bearer ")
+    }
+    if sessionID := ut.cookies.sessionID(r); sessionID != "" {
+        return "session:" + sessionID
+    }
+    return ""
+}
+
+// rateLimitMiddleware applies the rate-limit rules for the request's
+// endpoint class. A counter that cannot be updated lets the request
+// through rather than taking the API down with the database.
+func (ut *UnifiedTokenizer) rateLimitMiddleware(next http.Handler) http.Handler {
+    return ut.rateLimitByClass(endpointClass, next)
+}
+
+// rateLimitByClass applies the rate-limit rules of the class classify
+// gives each request; "" exempts it
+func (ut *UnifiedTokenizer) rateLimitByClass(classify func(*http.Request) string, next http.Handler) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        // Skip requests no rule can apply to, and test mode
+        class := classify(r)
+        if class == "" || utils.GetEnv("TEST_MODE", "false") == "true" {
+            next.ServeHTTP(w, r)
+            return
+        }
+        
+        rules := ut.rateLimitRules.Load()
+        if rules == nil {
+            next.ServeHTTP(w, r)
+            return
+        }
+        now := time.Now()
+        for i := range *rules {
+            rule := &(*rules)[i]
+            if rule.Class != class {
+                continue
+            }
+            client := ut.rateLimitClient(r, rule.Scope)
+            if client == "" {
+                continue
+            }
+            allowed, retryAfter, err := ut.rateLimitStore.Take(rule, client, now)
+            if err != nil {
+                log.Printf("Rate limit check failed, allowing the request: %v", err)
+                continue
+            }
+            if allowed {
+                continue
+            }
+            
+            atomic.AddInt64(&ut.rateLimited, 1)
+            ipAddress, userAgent := ut.getClientInfo(r)
+            ut.logSecurityEvent(SecurityEvent{
+                EventType: "rate_limit_exceeded",
+                Severity:  "medium",
+                IPAddress: ipAddress,
+                UserAgent: userAgent,
+                Endpoint:  r.URL.Path,
+                Details: map[string]interface{}{
+                    "method": r.Method,
+                    "class":  rule.Class,
+                    "scope":  rule.Scope,
+                    "limit":  fmt.Sprintf("%d per %s", rule.Limit, rule.Window),
+                },
+            })
+            
+            log.Printf("Rate limit exceeded for %s requests from IP %s on endpoint %s", rule.Class, ipAddress, r.URL.Path)
+            seconds := int((retryAfter + time.Second - 1) / time.Second)
+            w.Header().Set("Retry-After", strconv.Itoa(seconds))
+            apierror.WriteDetails(w, r, http.StatusTooManyRequests, apierror.RateLimited, "Rate limit exceeded. Please try again later.", map[string]interface{}{
+                "retry_after": seconds,
+            })
+            return
+        }
+        
+        next.ServeHTTP(w, r)
+    })
+}
+
+// RateLimitRulesRequest is the body of PUT /api/v1/rate-limits
+type RateLimitRulesRequest struct {
+    Rules []ratelimit.Rule `json:"rules"`
+}
+
+// handleRateLimitRules shows (GET) or replaces (PUT) the rate-limit rules
+// at /api/v1/rate-limits; DELETE goes back to RATE_LIMIT_RULES
+func (ut *UnifiedTokenizer) handleRateLimitRules(w http.ResponseWriter, r *http.Request) {
+    // Permission check is handled by requirePermission middleware
+    
+    ipAddress, userAgent := ut.getClientInfo(r)
+    switch r.Method {
+    case "PUT":
+        var req RateLimitRulesRequest
+        dec := json.NewDecoder(r.Body)
+        dec.DisallowUnknownFields()
+        if err := dec.Decode(&req); err != nil || req.Rules == nil {
+            apierror.Write(w, r, http.StatusBadRequest, apierror.InvalidBody, "Invalid request body")
+            return
+        }
+        if err := ratelimit.NormalizeRules(req.Rules); err != nil {
+            apierror.Write(w, r, http.StatusBadRequest, apierror.InvalidRequest, err.Error())
+            return
+        }
+        data, _ := json.Marshal(req.Rules)
+        _, err := ut.db.Exec(`
+            INSERT INTO rate_limit_rules (id, rules, updated_by) VALUES (1, ?, ?)
+            ON DUPLICATE KEY UPDATE rules = VALUES(rules), updated_by = VALUES(updated_by)
+        `, string(data), r.Header.Get("X-Username"))
+        if err != nil {
+            apierror.Write(w, r, http.StatusInternalServerError, apierror.InternalError, "Database error")
+            return
+        }
+        ut.logAuditEvent(AuditEvent{
+            UserID:       r.Header.Get("X-User-ID"),
+            Action:       "rate_limit_rules_updated",
+            ResourceType: "rate_limit_rules",
+            IPAddress:    ipAddress,
+            UserAgent:    userAgent,
+            Details: map[string]interface{}{
+                "rules": req.Rules,
+            },
+        })
+    case "DELETE":
+        if _, err := ut.db.Exec("DELETE FROM rate_limit_rules WHERE id = 1"); err != nil {
+            apierror.Write(w, r, http.StatusInternalServerError, apierror.InternalError, "Database error")
+            return
+        }
+        ut.logAuditEvent(AuditEvent{
+            UserID:       r.Header.Get("X-User-ID"),
+            Action:       "rate_limit_rules_reset",
+            ResourceType: "rate_limit_rules",
+            IPAddress:    ipAddress,
+            UserAgent:    userAgent,
+        })
+    }
+    
+    state, err := ut.loadRateLimitRules()
+    if err != nil {
+        apierror.Write(w, r, http.StatusInternalServerError, apierror.InternalError, "Database error")
+        return
+    }
+    ut.rateLimitRules.Store(&state.Rules)
+    
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(state)
+}
+
+// loadWAFDetector reads WAF_DETECTION and WAF_RULES, a JSON array of
+// {"name", "pattern"} rules replacing waf.DefaultRules
+func loadWAFDetector() (*waf.Detector, error) {
+    if utils.GetEnv("WAF_DETECTION", "true") == "false" {
+        return nil, nil
+    }
+    rules := waf.DefaultRules
+    if value := utils.GetEnv("WAF_RULES", ""); value != "" {
+        rules = nil
+        if err := json.Unmarshal([]byte(value), &rules); err != nil {
+            return nil, fmt.Errorf("invalid WAF_RULES: %v", err)
+        }
+    }
+    detector, err := waf.New(rules)
+    if err != nil {
+        return nil, fmt.Errorf("invalid WAF_RULES: %v", err)
+    }
+    return detector, nil
+}
+
+// reportSuspiciousInput logs a suspicious_input security event when the
+// query string or decoded body of r matches a WAF rule. The request goes
+// ahead either way, and the event names the fields and rules, not values.
+func (ut *UnifiedTokenizer) reportSuspiciousInput(r *http.Request, clientIP string, body interface{}) {
+    if ut.waf == nil {
+        return
+    }
+    found := ut.waf.Scan(body)
+    for key, values := range r.URL.Query() {
+        for _, value := range values {
+            if rules := ut.waf.Match(value); len(rules) > 0 {
+                found["query."+key] = rules
+            }
+        }
+    }
+    if len(found) == 0 {
+        return
+    }
+    atomic.AddInt64(&ut.suspiciousInputs, 1)
+    ut.logSecurityEvent(SecurityEvent{
+        EventType: "suspicious_input",
+        Severity:  "low",
+        IPAddress: clientIP,
+        UserAgent: r.UserAgent(),
+        Endpoint:  r.URL.Path,
+        Details: map[string]interface{}{
+            "fields": found,
+        },
+    })
+}
+
+// Input validation middleware
+func (ut *UnifiedTokenizer) validationMiddleware(endpoint string) func(http.HandlerFunc) http.HandlerFunc {
+    return func(next http.HandlerFunc) http.HandlerFunc {
+        return func(w http.ResponseWriter, r *http.Request) {
+            // Get client IP for logging
+            clientIP, _ := ut.getClientInfo(r)
+            
+            // Check if we have validation config for this endpoint
+            config, hasConfig := ut.validationConfigs[endpoint]
+            
+            // Check request size limit
+            maxSize := int64(10 * 1024 * 1024) // Default 10MB max
+            if hasConfig && config.MaxRequestSize > 0 {
+                maxSize = config.MaxRequestSize
+            }
+            
+            // Limit request body size
+            r.Body = http.MaxBytesReader(w, r.Body, maxSize)
+            
+            // Check allowed methods
+            if hasConfig && len(config.AllowedMethods) > 0 {
+                allowed := false
+                for _, method := range config.AllowedMethods {
+                    if r.Method == method {
+                        allowed = true
+                        break
+                    }
+                }
+                if !allowed {
+                    ut.logSecurityEvent(SecurityEvent{
+                        EventType: "invalid_http_method",
+                        Severity:  "medium",
+                        IPAddress: clientIP,
+                        UserAgent: r.UserAgent(),
+                        Endpoint:  r.URL.Path,
+                        Details: map[string]interface{}{
+                            "method": r.Method,
+                            "allowed_methods": config.AllowedMethods,
+                        },
+                    })
+                    apierror.Write(w, r, http.StatusMethodNotAllowed, apierror.MethodNotAllowed, "Method not allowed")
+                    return
+                }
+            }
+            
+            // Check Content-Type for requests with body
+            if r.Method == "POST" || r.Method == "PUT" || r.Method == "PATCH" {
+                contentType := r.Header.Get("Content-Type")
+                if !strings.Contains(contentType, "application/json") {
+                    ut.logSecurityEvent(SecurityEvent{
+                        EventType: "invalid_content_type",
+                        Severity:  "low",
+                        IPAddress: clientIP,
+                        UserAgent: r.UserAgent(),
+                        Endpoint:  r.URL.Path,
+                        Details: map[string]interface{}{
+                            "content_type": contentType,
+                            "expected": "application/json",
+                        },
+                    })
+                    apierror.Write(w, r, http.StatusUnsupportedMediaType, apierror.UnsupportedMediaType, "Content-Type must be application/json")
+                    return
+                }
+                
+                // Parse and validate JSON body
+                if hasConfig && config.Schema != nil {
+                    var requestData interface{}
+                    
+                    // Read and parse request body
+                    bodyBytes, err := io.ReadAll(r.Body)
+                    if err != nil {
+                        ut.logSecurityEvent(SecurityEvent{
+                            EventType: "request_body_read_error",
+                            Severity:  "medium",
+                            IPAddress: clientIP,
+                            UserAgent: r.UserAgent(),
+                            Endpoint:  r.URL.Path,
+                            Details: map[string]interface{}{
+                                "error": err.Error(),
+                            },
+                        })
+                        apierror.Write(w, r, http.StatusBadRequest, apierror.InvalidBody, "Failed to read request body")
+                        return
+                    }
+                    
+                    // Restore body for next handler
+                    r.Body = io.NopCloser(bytes.NewBuffer(bodyBytes))
+                    
+                    // Parse JSON
+                    if len(bodyBytes) > 0 {
+                        if err := json.Unmarshal(bodyBytes, &requestData); err != nil {
+                            ut.logSecurityEvent(SecurityEvent{
+                                EventType: "invalid_json",
+                                Severity:  "medium",
+                                IPAddress: clientIP,
+                                UserAgent: r.UserAgent(),
+                                Endpoint:  r.URL.Path,
+                                Details: map[string]interface{}{
+                                    "error": err.Error(),
+                                },
+                            })
+                            apierror.Write(w, r, http.StatusBadRequest, apierror.InvalidBody, "Invalid JSON format")
+                            return
+                        }
+                        ut.reportSuspiciousInput(r, clientIP, requestData)
+                        
+                        // Validate request data
+                        validationResult := ut.validateRequest(endpoint, requestData)
+                        if !validationResult.Valid {
+                            ut.logSecurityEvent(SecurityEvent{
+                                EventType: "validation_failed",
+                                Severity:  "medium",
+                                IPAddress: clientIP,
+                                UserAgent: r.UserAgent(),
+                                Endpoint:  r.URL.Path,
+                                Details: map[string]interface{}{
+                                    "validation_errors": validationResult.Errors,
+                                    "field_count": len(validationResult.Errors),
+                                },
+                            })
+                            apierror.WriteDetails(w, r, http.StatusBadRequest, apierror.ValidationFailed, "Validation failed", map[string]interface{}{
+                                "validation_errors": validationResult.Errors,
+                            })
+                            return
+                        }
+                        
+                    }
+                }
+            }
+            
+            // Validate URL parameters for token endpoints
+            if strings.Contains(r.URL.Path, "/tokens/") && !strings.HasSuffix(r.URL.Path, "/tokens") {
+                pathParts := strings.Split(r.URL.Path, "/")
+                for i, part := range pathParts {
+                    if part == "tokens" && i+1 < len(pathParts) {
+                        tokenID := pathParts[i+1]
+                        if tokenID != "search" { // Skip search endpoint
+                            if _, exists := ut.validationConfigs["token_id"]; exists {
+                                validationResult := ut.validateRequest("token_id", tokenID)
+                                for i := range validationResult.Errors {
+                                    validationResult.Errors[i].Field = "token"
+                                }
+                                if !validationResult.Valid {
+                                    ut.logSecurityEvent(SecurityEvent{
+                                        EventType: "invalid_token_format",
+                                        Severity:  "medium",
+                                        IPAddress: clientIP,
+                                        UserAgent: r.UserAgent(),
+                                        Endpoint:  r.URL.Path,
+                                        Details: map[string]interface{}{
+                                            "token_id": tokenID,
+                                            "validation_errors": validationResult.Errors,
+                                        },
+                                    })
+                                    apierror.WriteDetails(w, r, http.StatusBadRequest, apierror.ValidationFailed, "Invalid token format", map[string]interface{}{
+                                        "validation_errors": validationResult.Errors,
+                                    })
+                                    return
+                                }
+                            }
+                        }
+                        break
+                    }
+                }
+            }
+            
+            // Continue to next handler
+            next(w, r)
+        }
+    }
+}
+
+// sealAuditDetails encrypts audit event details for the details_encrypted
+// column. Events are still recorded when the vault cannot encrypt, such as
+// while it is sealed, but without their details.
+func (ut *UnifiedTokenizer) sealAuditDetails(details map[string]interface{}) ([]byte, sql.NullString) {
+    if len(details) == 0 {
+        return nil, sql.NullString{}
+    }
+    detailsJSON, _ := json.Marshal(details)
+    sealed, keyID, err := ut.encryptFields(string(detailsJSON))
+    if err != nil {
+        log.Printf("Failed to encrypt audit details, recording event without them: %v", err)
+        return nil, sql.NullString{}
+    }
+    return sealed[0], keyID
+}
+
+// Audit logging methods
+func (ut *UnifiedTokenizer) logAuditEvent(event AuditEvent) {
+    details, keyID := ut.sealAuditDetails(event.Details)
+    
+    _, err := ut.db.Exec(`
+        INSERT INTO user_audit_log (user_id, action, resource_type, resource_id, details_encrypted, details_key_id, ip_address, user_agent)
+        VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+    `, event.UserID, event.Action, event.ResourceType, event.ResourceID, details, keyID, event.IPAddress, event.UserAgent)
+    
+    if err != nil {
+        log.Printf("Failed to log audit event: %v", err)
+    }
+}
+
+func (ut *UnifiedTokenizer) logSecurityEvent(event SecurityEvent) {
+    details, keyID := ut.sealAuditDetails(event.Details)
+    
+    _, err := ut.db.Exec(`
+        INSERT INTO security_audit_log (event_type, severity, user_id, username, ip_address, user_agent, endpoint, details_encrypted, details_key_id)
+        VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
+    `, event.EventType, event.Severity, event.UserID, event.Username, event.IPAddress, event.UserAgent, event.Endpoint, details, keyID)
+    
+    
+    if err != nil {
+        log.Printf("Failed to log security event: %v", err)
+    }
+    
+    ut.eventBroker.Publish(events.TypeSecurity, event)
+    if ut.notifier != nil {
+        ut.notifier.Notify(notify.Event{
+            Type:      event.EventType,
+            Severity:  event.Severity,
+            Time:      time.Now(),
+            Username:  event.Username,
+            IPAddress: event.IPAddress,
+            Endpoint:  event.Endpoint,
+            Instance:  ut.instanceName(),
+        })
+    }
+    
+    // Also log to application logs for immediate visibility
+    if event.Severity == "high" || event.Severity == "critical" {
+        log.Printf("SECURITY ALERT [%s]: %s from IP %s - %s", 
+            strings.ToUpper(event.Severity), event.EventType, event.IPAddress, event.Endpoint)
+    }
+}
+
+// loadNotifier reads NOTIFICATION_CHANNELS, a JSON array of channels that
+// security events are sent to. Email channels send through the MAIL_*
+// server.
+func loadNotifier(sender mailer.Sender) (*notify.Notifier, error) {
+    value := utils.GetEnv("NOTIFICATION_CHANNELS", "")
+    if value == "" {
+        return nil, nil
+    }
+    configs, err := notify.ParseConfigs([]byte(value))
+    if err != nil {
+        return nil, fmt.Errorf("invalid NOTIFICATION_CHANNELS: %v", err)
+    }
+    notifier, err := notify.New(configs, sender, &http.Client{})
+    if err != nil {
+        return nil, fmt.Errorf("invalid NOTIFICATION_CHANNELS: %v (email channels need MAIL_SMTP_ADDR)", err)
+    }
+    return notifier, nil
+}
+
+// instanceName names this replica in notifications
+func (ut *UnifiedTokenizer) instanceName() string {
+    hostname, _ := os.Hostname()
+    return hostname
+}
+
+// NotificationTestRequest is the body of POST /api/v1/notifications/test
+type NotificationTestRequest struct {
+    Channel string `json:"channel,omitempty"` // Every channel when empty
+}
+
+// handleNotifications lists the notification channels with their delivery counts
+func (ut *UnifiedTokenizer) handleNotifications(w http.ResponseWriter, r *http.Request) {
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(map[string]interface{}{
+        "channels": ut.notifier.Status(),
+        "dropped":  ut.notifier.Dropped(),
+    })
+}
+
+// handleNotificationTest sends a test notification, so on-call can check a
+// channel reaches them before an incident does
+func (ut *UnifiedTokenizer) handleNotificationTest(w http.ResponseWriter, r *http.Request) {
+    var req NotificationTestRequest
+    if r.ContentLength != 0 {
+        if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+            apierror.Write(w, r, http.StatusBadRequest, apierror.InvalidBody, "Invalid request body")
+            return
+        }
+    }
+    
+    ipAddress, userAgent := ut.getClientInfo(r)
+    results, ok := ut.notifier.Test(req.Channel, notify.Event{
+        Type:      "notification_test",
+        Severity:  "critical",
+        Username:  r.Header.Get("X-Username"),
+        IPAddress: ipAddress,
+        Endpoint:  r.URL.Path,
+        Instance:  ut.instanceName(),
+    })
+    if !ok {
+        if req.Channel == "" {
+            apierror.Write(w, r, http.StatusNotFound, apierror.NotFound, "No notification channels are configured; set NOTIFICATION_CHANNELS")
+        } else {
+            apierror.Write(w, r, http.StatusNotFound, apierror.NotFound, "Unknown notification channel")
+        }
+        return
+    }
+    
+    ut.logAuditEvent(AuditEvent{
+        UserID:       r.Header.Get("X-User-ID"),
+        Action:       "notification_test_sent",
+        ResourceType: "notification_channel",
+        ResourceID:   req.Channel,
+        Details:      map[string]interface{}{"results": results},
+        IPAddress:    ipAddress,
+        UserAgent:    userAgent,
+    })
+    
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(map[string]interface{}{"results": results})
+}
+
+// Helper to extract client info from request. The IP is the connection's
+// peer unless that is a trusted proxy, in which case it is the rightmost
+// X-Forwarded-For entry that is not a trusted proxy; entries left of it
+// are whatever the client sent.
+func (ut *UnifiedTokenizer) getClientInfo(r *http.Request) (string, string) {
+    ipAddress := ut.proxies.ClientIP(r)
+    userAgent := r.UserAgent()
+    return ipAddress, userAgent
+}
+
+// Authentication handlers
+
+// loginChallengeTTL is how long a proof-of-work puzzle can be solved for
+const loginChallengeTTL = 5 * time.Minute
+
+// loginChallengeConfig is when logins must pass a challenge, and which
+type loginChallengeConfig struct {
+    kind       loginchallenge.Kind     // LOGIN_CHALLENGE
+    after      int                     // LOGIN_CHALLENGE_AFTER: failures per address or username before logins are challenged
+    window     time.Duration           // LOGIN_CHALLENGE_WINDOW: how long failures are counted
+    difficulty int                     // LOGIN_CHALLENGE_DIFFICULTY: leading zero bits of a proof-of-work solution
+    siteKey    string                  // LOGIN_CHALLENGE_SITE_KEY: the CAPTCHA widget's public key
+    verifier   *loginchallenge.Verifier // Confirms CAPTCHA answers; nil for proof of work
+}
+
+// loadLoginChallenge reads the LOGIN_CHALLENGE_* settings
+func loadLoginChallenge() (loginChallengeConfig, error) {
+    var c loginChallengeConfig
+    var err error
+    if c.kind, err = loginchallenge.ParseKind(utils.GetEnv("LOGIN_CHALLENGE", "off")); err != nil {
+        return c, err
+    }
+    if c.after, err = utils.IntSetting("LOGIN_CHALLENGE_AFTER", 5, 1, 1000); err != nil {
+        return c, err
+    }
+    if c.window, err = utils.DurationSetting("LOGIN_CHALLENGE_WINDOW", time.Hour, time.Minute, 7*24*time.Hour); err != nil {
+        return c, err
+    }
+    if c.difficulty, err = utils.IntSetting("LOGIN_CHALLENGE_DIFFICULTY", 20, 8, 30); err != nil {
+        return c, err
+    }
+    if c.kind.Captcha() {
+        c.siteKey = utils.GetEnv("LOGIN_CHALLENGE_SITE_KEY", "")
+        secret := utils.GetEnv("LOGIN_CHALLENGE_SECRET", "")
+        if c.siteKey == "" || secret == "" {
+            return c, fmt.Errorf("LOGIN_CHALLENGE=%s needs LOGIN_CHALLENGE_SITE_KEY and LOGIN_CHALLENGE_SECRET", c.kind)
+        }
+        c.verifier = &loginchallenge.Verifier{
+            Secret: secret,
+            URL:    utils.GetEnv("LOGIN_CHALLENGE_VERIFY_URL", ""),
+            Client: &http.Client{Timeout: 10 * time.Second},
+        }
+    }
+    return c, nil
+}
+
+// loginFailureSubject is what login_failures stores for an address or
+// username: its hex SHA-256, so the table holds no usernames
+func loginFailureSubject(s string) string {
+    sum := sha256.Sum256([]byte(strings.ToLower(strings.TrimSpace(s))))
+    return hex.EncodeToString(sum[:])
+}
+
+// loginChallengeRequired reports whether a login from ipAddress as
+// username must pass a challenge: whether either has failed
+// LOGIN_CHALLENGE_AFTER times within LOGIN_CHALLENGE_WINDOW. Counting per
+// username catches attacks spread over many addresses.
+func (ut *UnifiedTokenizer) loginChallengeRequired(ipAddress, username string) (bool, error) {
+    var failures int
+    err := ut.db.QueryRow(`
+        SELECT COALESCE(MAX(failures), 0) FROM login_failures
+        WHERE ((scope = 'ip' AND subject = ?) OR (scope = 'username' AND subject = ?))
+          AND first_failed_at > NOW() - INTERVAL ? SECOND
+    `, loginFailureSubject(ipAddress), loginFailureSubject(username), int(ut.loginChallenge.window.Seconds())).Scan(&failures)
+    if err != nil {
+        return false, err
+    }
+    return failures >= ut.loginChallenge.after, nil
+}
+
+// recordLoginFailure counts a failed login against ipAddress and username,
+// starting the count over when the window has passed
+func (ut *UnifiedTokenizer) recordLoginFailure(ipAddress, username string) {
+    window := int(ut.loginChallenge.window.Seconds())
+    _, err := ut.db.Exec(`
+        INSERT INTO login_failures (scope, subject, failures, first_failed_at)
+        VALUES ('ip', ?, 1, NOW()), ('username', ?, 1, NOW())
+        ON DUPLICATE KEY UPDATE
+            failures = IF(first_failed_at <= NOW() - INTERVAL ? SECOND, 1, failures + 1),
+            first_failed_at = IF(first_failed_at <= NOW() - INTERVAL ? SECOND, NOW(), first_failed_at)
+    `, loginFailureSubject(ipAddress), loginFailureSubject(username), window, window)
+    if err != nil {
+        log.Printf("Failed to record failed login: %v", err)
+    }
+}
+
+// clearLoginFailures forgets the failures of usernames after a good login.
+// Those of the address stay, so one known password does not lift the
+// challenge for guesses at other accounts.
+func (ut *UnifiedTokenizer) clearLoginFailures(usernames ...string) {
+    for _, username := range usernames {
+        if _, err := ut.db.Exec("DELETE FROM login_failures WHERE scope = 'username' AND subject = ?", loginFailureSubject(username)); err != nil {
+            log.Printf("Failed to clear failed logins: %v", err)
+        }
+    }
+}
+
+// pruneLoginChallenges deletes failure counts past their window and
+// puzzles past their expiry
+func (ut *UnifiedTokenizer) pruneLoginChallenges() {
+    if _, err := ut.db.Exec("DELETE FROM login_failures WHERE first_failed_at < NOW() - INTERVAL ? SECOND", int(ut.loginChallenge.window.Seconds())); err != nil {
+        log.Printf("Failed to prune failed logins: %v", err)
+    }
+    if _, err := ut.db.Exec("DELETE FROM login_challenges WHERE expires_at < NOW()"); err != nil {
+        log.Printf("Failed to prune login challenges: %v", err)
+    }
+}
+
+// passLoginChallenge reports whether authReq carries an answer to the
+// login challenge. A proof-of-work puzzle is used up by a good solution. An
+// error means a CAPTCHA answer could not be checked.
+func (ut *UnifiedTokenizer) passLoginChallenge(r *http.Request, authReq AuthRequest, ipAddress string) (bool, error) {
+    if ut.loginChallenge.kind.Captcha() {
+        if authReq.ChallengeResponse == "" {
+            return false, nil
+        }
+        return ut.loginChallenge.verifier.Verify(r.Context(), ut.loginChallenge.kind, authReq.ChallengeResponse, ipAddress)
+    }
+    
+    if authReq.ChallengeID == "" || authReq.ChallengeResponse == "" {
+        return false, nil
+    }
+    var difficulty int
+    err := ut.db.QueryRow("SELECT difficulty FROM login_challenges WHERE challenge_id = ? AND expires_at > NOW()", authReq.ChallengeID).Scan(&difficulty)
+    if err == sql.ErrNoRows {
+        return false, nil
+    } else if err != nil {
+        return false, err
+    }
+    if !loginchallenge.Solved(authReq.ChallengeID, authReq.ChallengeResponse, difficulty) {
+        return false, nil
+    }
+    // Whoever deletes the row used the puzzle, so it cannot be replayed
+    // even concurrently
+    result, err := ut.db.Exec("DELETE FROM login_challenges WHERE challenge_id = ?", authReq.ChallengeID)
+    if err != nil {
+        return false, err
+    }
+    used, _ := result.RowsAffected()
+    return used == 1, nil
+}
+
+// writeLoginChallenge refuses a login that must pass a challenge first,
+// with what the client needs to pass it in details: a fresh proof-of-work
+// puzzle, or the CAPTCHA site key
+func (ut *UnifiedTokenizer) writeLoginChallenge(w http.ResponseWriter, r *http.Request, authReq AuthRequest, ipAddress, userAgent string) {
+    answered := authReq.ChallengeID != "" || authReq.ChallengeResponse != ""
+    if ut.blockEventDue("login|" + ipAddress) {
+        ut.logSecurityEvent(SecurityEvent{
+            EventType: "login_challenged",
+            Severity:  "medium",
+            Username:  authReq.Username,
+            IPAddress: ipAddress,
+            UserAgent: userAgent,
+            Endpoint:  r.URL.Path,
+            Details: map[string]interface{}{
+                "challenge": string(ut.loginChallenge.kind),
+                "answered":  answered,
+            },
+        })
+    }
+    
+    details := map[string]interface{}{"type": string(ut.loginChallenge.kind)}
+    if ut.loginChallenge.kind.Captcha() {
+        details["site_key"] = ut.loginChallenge.siteKey
+    } else {
+        challengeID := "lch_" + hex.EncodeToString(securerand.Bytes(16))
+        expiresAt := time.Now().Add(loginChallengeTTL)
+        _, err := ut.db.Exec("INSERT INTO login_challenges (challenge_id, difficulty, expires_at) VALUES (?, ?, ?)",
+            challengeID, ut.loginChallenge.difficulty, expiresAt)
+        if err != nil {
+            apierror.Write(w, r, http.StatusInternalServerError, apierror.InternalError, "Database error")
+            return
+        }
+        details["challenge_id"] = challengeID
+        details["difficulty"] = ut.loginChallenge.difficulty
+        details["expires_at"] = expiresAt.UTC().Format(time.RFC3339)
+    }
+    message := "Too many failed logins; pass the challenge and log in again"
+    if answered {
+        message = "The challenge was not passed; try the new one"
+    }
+    apierror.WriteDetails(w, r, http.StatusUnauthorized, apierror.ChallengeRequired, message, details)
+}
+
+func (ut *UnifiedTokenizer) handleLogin(w http.ResponseWriter, r *http.Request) {
+    if r.Method != "POST" {
+        apierror.Write(w, r, http.StatusMethodNotAllowed, apierror.MethodNotAllowed, "Method not allowed")
+        return
+    }
+    
+    var authReq AuthRequest
+    if err := json.NewDecoder(r.Body).Decode(&authReq); err != nil {
+        apierror.Write(w, r, http.StatusBadRequest, apierror.InvalidBody, "Invalid request body")
+        return
+    }
+    
+    // Get client info
+    ipAddress, userAgent := ut.getClientInfo(r)
+    
+    // Checked before the password, so a challenged client learns nothing
+    // about it
+    challenged := ut.loginChallenge.kind != loginchallenge.Off
+    if challenged {
+        required, err := ut.loginChallengeRequired(ipAddress, authReq.Username)
+        if err != nil {
+            apierror.Write(w, r, http.StatusInternalServerError, apierror.InternalError, "Database error")
+            return
+        }
+        if required {
+            passed, err := ut.passLoginChallenge(r, authReq, ipAddress)
+            if err != nil {
+                log.Printf("Login challenge could not be checked: %v", err)
+                apierror.Write(w, r, http.StatusServiceUnavailable, apierror.InternalError, "The login challenge could not be checked; try again later")
+                return
+            }
+            if !passed {
+                ut.writeLoginChallenge(w, r, authReq, ipAddress, userAgent)
+                return
+            }
+        }
+    }
+    
+    // Authenticate user
+    user, err := ut.authenticateUser(authReq.Username, authReq.Password)
+    if err != nil {
+        if challenged {
+            ut.recordLoginFailure(ipAddress, authReq.Username)
+        }
+        // Log failed login attempt
+        ut.logSecurityEvent(SecurityEvent{
+            EventType: "login_failed",
+            Severity:  "medium",
+            Username:  authReq.Username,
+            IPAddress: ipAddress,
+            UserAgent: userAgent,
+            Endpoint:  r.URL.Path,
+            Details: map[string]interface{}{
+                "reason": err.Error(),
+                "method": r.Method,
+            },
+        })
+        
+        apierror.Write(w, r, http.StatusUnauthorized, apierror.InvalidCredentials, err.Error())
+        return
+    }
+    
+    if challenged {
+        ut.clearLoginFailures(authReq.Username, user.Username)
+    }
+    
+    // Create session
+    session, err := ut.createSession(user, ipAddress, userAgent)
+    if err != nil {
+        apierror.Write(w, r, http.StatusInternalServerError, apierror.InternalError, "Failed to create session")
+        return
+    }
+    
+    // Log successful login
+    ut.logAuditEvent(AuditEvent{
+        UserID:       user.UserID,
+        Action:       "login_success",
+        ResourceType: "session",
+        ResourceID:   session.SessionID,
+        IPAddress:    ipAddress,
+        UserAgent:    userAgent,
+        Details: map[string]interface{}{
+            "session_duration": "24 hours",
+            "method": r.Method,
+        },
+    })
+    
+    ut.logSecurityEvent(SecurityEvent{
+        EventType: "login_success",
+        Severity:  "info",
+        UserID:    user.UserID,
+        Username:  user.Username,
+        IPAddress: ipAddress,
+        UserAgent: userAgent,
+        Endpoint:  r.URL.Path,
+        Details: map[string]interface{}{
+            "session_id": session.SessionID,
+            "role": user.Role,
+        },
+    })
+    
+    // Set session cookie
+    http.SetCookie(w, ut.cookies.cookie(r, sessionCookieName, session.SessionID, session.ExpiresAt, true))
+    // Readable by the GUI's own pages so they can echo it in X-CSRF-Token
+    http.SetCookie(w, ut.cookies.cookie(r, csrfCookieName, csrfToken(session.SessionID), session.ExpiresAt, false))
+    
+    // Check if password change is required (password_changed_at is zero)
+    requirePasswordChange := user.PasswordChangedAt == nil || user.PasswordChangedAt.IsZero()
+    
+    // Return auth response
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(AuthResponse{
+        SessionID:            session.SessionID,
+        User:                 *user,
+        ExpiresAt:            session.ExpiresAt,
+        RequirePasswordChange: requirePasswordChange,
+        CSRFToken:            csrfToken(session.SessionID),
+    })
+}
+
+func (ut *UnifiedTokenizer) handleLogout(w http.ResponseWriter, r *http.Request) {
+    if r.Method != "POST" {
+        apierror.Write(w, r, http.StatusMethodNotAllowed, apierror.MethodNotAllowed, "Method not allowed")
+        return
+    }
+    
+    // Get session ID
+    sessionID := ut.cookies.sessionID(r)
+    if sessionID == "" {
+        auth := r.Header.Get("Authorization")
+        if strings.HasPrefix(auth, "Bearer ") {
+            sessionID = strings.TrimPrefix(auth, "Bearer ")
+        }
+    }
+    
+    if sessionID != "" {
+        // Invalidate session
+        ut.db.Exec(`
+            UPDATE user_sessions 
+            SET is_active = FALSE 
+            WHERE session_id = ?
+        `, sessionID)
+    }
+    
+    // Clear cookies
+    ut.cookies.clear(w, r)
+    
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(map[string]string{"message": "Logged out successfully"})
+}
+
+func (ut *UnifiedTokenizer) handleGetCurrentUser(w http.ResponseWriter, r *http.Request) {
+    if r.Method != "GET" {
+        apierror.Write(w, r, http.StatusMethodNotAllowed, apierror.MethodNotAllowed, "Method not allowed")
+        return
+    }
+    
+    // Get session ID
+    sessionID := ut.cookies.sessionID(r)
+    if sessionID == "" {
+        auth := r.Header.Get("Authorization")
+        if strings.HasPrefix(auth, "Bearer ") {
+            sessionID = strings.TrimPrefix(auth, "Bearer ")
+        }
+    }
+    
+    if sessionID == "" {
+        apierror.Write(w, r, http.StatusUnauthorized, apierror.AuthenticationRequired, "Authentication required")
+        return
+    }
+    
+    // Validate session
+    session, err := ut.validateSession(r, sessionID)
+    if err != nil {
+        writeSessionError(w, r, err)
+        return
+    }
+    session.User.EffectivePermissions = ut.effectivePermissions(session.User)
+    
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(session.User)
+}
+
+// ChangePasswordRequest is the body of POST /api/v1/auth/change-password
+type ChangePasswordRequest struct {
+    CurrentPassword string `json:"current_password"`
+    NewPassword     string `json:"new_password"`
+}
+
+func (ut *UnifiedTokenizer) handleChangePassword(w http.ResponseWriter, r *http.Request) {
+    if r.Method != "POST" {
+        apierror.Write(w, r, http.StatusMethodNotAllowed, apierror.MethodNotAllowed, "Method not allowed")
+        return
+    }
+
+    // Get session ID from cookie or Authorization header
+    sessionID := ut.cookies.sessionID(r)
+    if auth := r.Header.Get("Authorization"); sessionID == "" && strings.HasPrefix(auth, "Bearer ") {
+        sessionID = strings.TrimPrefix(auth, "Bearer ")
+    }
+
+    if sessionID == "" {
+        apierror.Write(w, r, http.StatusUnauthorized, apierror.AuthenticationRequired, "Authentication required")
+        return
+    }
+
+    // Validate session
+    session, err := ut.validateSession(r, sessionID)
+    if err != nil {
+        writeSessionError(w, r, err)
+        return
+    }
+
+    // Parse request body
+    var req ChangePasswordRequest
+    if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+        apierror.Write(w, r, http.StatusBadRequest, apierror.InvalidBody, "Invalid request body")
+        return
+    }
+
+    // Validate input
+    if req.CurrentPassword == "" || req.NewPassword == "" {
+        apierror.Write(w, r, http.StatusBadRequest, apierror.InvalidRequest, "Current password and new password are required")
+        return
+    }
+
+    // Validate password strength
+    if err := ut.validatePasswordStrength(req.NewPassword); err != nil {
+        apierror.Write(w, r, http.StatusBadRequest, apierror.InvalidRequest, err.Error())
+        return
+    }
+
+    // Get current user's password hash from database
+    var currentPasswordHash string
+    err = ut.db.QueryRow("SELECT password_hash FROM users WHERE user_id = ?", session.User.UserID).Scan(&currentPasswordHash)
+    if err != nil {
+        apierror.Write(w, r, http.StatusInternalServerError, apierror.InternalError, "Database error")
+        return
+    }
+
+    // Verify current password
+    if err := bcrypt.CompareHashAndPassword([]byte(currentPasswordHash), []byte(req.CurrentPassword)); err != nil {
+        // Log failed password change attempt
+        ipAddress, userAgent := ut.getClientInfo(r)
+        ut.logSecurityEvent(SecurityEvent{
+            EventType: "password_change_failed",
+            Severity:  "medium",
+            UserID:    session.User.UserID,
+            Username:  session.User.Username,
+            IPAddress: ipAddress,
+            UserAgent: userAgent,
+            Endpoint:  r.URL.Path,
+            Details: map[string]interface{}{
+                "reason": "incorrect_current_password",
+                "method": r.Method,
+            },
+        })
+        
+        apierror.Write(w, r, http.StatusBadRequest, apierror.InvalidCredentials, "Current password is incorrect")
+        return
+    }
+
+    // Hash new password
+    hashedPassword, err := bcrypt.GenerateFromPassword([]byte(req.NewPassword), bcrypt.DefaultCost)
+    if err != nil {
+        apierror.Write(w, r, http.StatusInternalServerError, apierror.InternalError, "Password hashing failed")
+        return
+    }
+
+    // Update password in database
+    _, err = ut.db.Exec(`
+        UPDATE users 
+        SET password_hash = ?, password_changed_at = CURRENT_TIMESTAMP 
+        WHERE user_id = ?`,
+        string(hashedPassword), session.User.UserID)
+    if err != nil {
+        apierror.Write(w, r, http.StatusInternalServerError, apierror.InternalError, "Failed to update password")
+        return
+    }
+
+    // Log successful password change
+    ipAddress, userAgent := ut.getClientInfo(r)
+    ut.logAuditEvent(AuditEvent{
+        UserID:       session.User.UserID,
+        Action:       "password_change_success",
+        ResourceType: "user",
+        ResourceID:   session.User.UserID,
+        IPAddress:    ipAddress,
+        UserAgent:    userAgent,
+        Details: map[string]interface{}{
+            "method": r.Method,
+        },
+    })
+    
+    ut.logSecurityEvent(SecurityEvent{
+        EventType: "password_change_success",
+        Severity:  "info",
+        UserID:    session.User.UserID,
+        Username:  session.User.Username,
+        IPAddress: ipAddress,
+        UserAgent: userAgent,
+        Endpoint:  r.URL.Path,
+        Details: map[string]interface{}{
+            "initiated_by": "user",
+            "method": r.Method,
+        },
+    })
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(map[string]string{"message": "Password changed successfully"})
+}
+
+// Account emails: address verification and self-service password reset
+
+// Purposes of account_tokens rows
+const (
+    purposeVerifyEmail   = "verify_email"
+    purposeResetPassword = "reset_password"
+)
+
+// accountMail is how the service mails users links to verify their address
+// and reset their password
+type accountMail struct {
+    sender    mailer.Sender // nil when MAIL_SMTP_ADDR is not set, which turns the emails off
+    baseURL   string        // ACCOUNT_URL: links are <baseURL>/verify-email?token=...; empty mails the bare token
+    verifyTTL time.Duration // EMAIL_VERIFY_TTL: how long a verification link works
+    resetTTL  time.Duration // PASSWORD_RESET_TTL: how long a password reset link works
+}
+
+// loadSessionBinding reads SESSION_BINDING and what sessions are bound to:
+// by default the /24 or /64 network and the browser they were created from
+func loadSessionBinding() (sessionbind.Policy, error) {
+    mode, err := sessionbind.ParseMode(utils.GetEnv("SESSION_BINDING", "off"))
+    if err != nil {
+        return sessionbind.Policy{}, err
+    }
+    ipv4Prefix, err := utils.IntSetting("SESSION_BINDING_IPV4_PREFIX", 24, 0, 32)
+    if err != nil {
+        return sessionbind.Policy{}, err
+    }
+    ipv6Prefix, err := utils.IntSetting("SESSION_BINDING_IPV6_PREFIX", 64, 0, 128)
+    if err != nil {
+        return sessionbind.Policy{}, err
+    }
+    return sessionbind.Policy{
+        Mode:       mode,
+        IPv4Prefix: ipv4Prefix,
+        IPv6Prefix: ipv6Prefix,
+        UserAgent:  utils.GetEnv("SESSION_BINDING_USER_AGENT", "true") != "false",
+    }, nil
+}
+
+// loadAccountMail reads the MAIL_* settings and link lifetimes
+func loadAccountMail() (accountMail, error) {
+    var m accountMail
+    var err error
+    if m.verifyTTL, err = utils.DurationSetting("EMAIL_VERIFY_TTL", 24*time.Hour, 5*time.Minute, 7*24*time.Hour); err != nil {
+        return m, err
+    }
+    if m.resetTTL, err = utils.DurationSetting("PASSWORD_RESET_TTL", 30*time.Minute, 5*time.Minute, 24*time.Hour); err != nil {
+        return m, err
+    }
+    m.baseURL = strings.TrimSuffix(utils.GetEnv("ACCOUNT_URL", ""), "/")
+    if m.baseURL != "" {
+        if u, err := url.Parse(m.baseURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+            return m, fmt.Errorf("invalid ACCOUNT_URL %q: want http(s)://host/path", m.baseURL)
+        }
+    }
+    addr := utils.GetEnv("MAIL_SMTP_ADDR", "")
+    if addr == "" {
+        return m, nil
+    }
+    timeout, err := utils.DurationSetting("MAIL_SMTP_TIMEOUT", 30*time.Second, time.Second, 5*time.Minute)
+    if err != nil {
+        return m, err
+    }
+    hostname, _ := os.Hostname()
+    sender := &mailer.SMTP{
+        Addr:     addr,
+        From:     utils.GetEnv("MAIL_FROM", ""),
+        Username: utils.GetEnv("MAIL_SMTP_USERNAME", ""),
+        Password: utils.GetEnv("MAIL_SMTP_PASSWORD", ""),
+        Hostname: utils.GetEnv("SMTP_HOSTNAME", hostname),
+        Timeout:  timeout,
+    }
+    if err := sender.Validate(); err != nil {
+        return m, fmt.Errorf("MAIL_SMTP_ADDR or MAIL_FROM: %v", err)
+    }
+    m.sender = sender
+    return m, nil
+}
+
+// link returns what an email gives the user to act on: a link under
+// ACCOUNT_URL, or the token itself to submit to the API
+func (m accountMail) link(path, token string) string {
+    if m.baseURL == "" {
+        return token
+    }
+    return m.baseURL + path + "?token=" + url.QueryEscape(token)
+}
+
+// errAccountTokenInvalid is returned for a token that is unknown, already
+// used, expired, or for another purpose
+var errAccountTokenInvalid = errors.New("the link is invalid or has expired")
+
+// hashAccountToken returns the hex SHA-256 of token, which is what
+// account_tokens stores
+func hashAccountToken(token string) string {
+    sum := sha256.Sum256([]byte(token))
+    return hex.EncodeToString(sum[:])
+}
+
+// issueAccountToken stores a new token of purpose for the user, replacing
+// any earlier one not yet used, and returns it
+func (ut *UnifiedTokenizer) issueAccountToken(userID, purpose, email string, ttl time.Duration) (string, error) {
+    token := base64.RawURLEncoding.EncodeToString(securerand.Bytes(32))
+    tx, err := ut.db.Begin()
+    if err != nil {
+        return "", err
+    }
+    defer tx.Rollback()
+    if _, err := tx.Exec("DELETE FROM account_tokens WHERE user_id = ? AND purpose = ? AND used_at IS NULL", userID, purpose); err != nil {
+        return "", err
+    }
+    if _, err := tx.Exec(`
+        INSERT INTO account_tokens (token_hash, user_id, purpose, email, expires_at)
+        VALUES (?, ?, ?, ?, NOW() + INTERVAL ? SECOND)`,
+        hashAccountToken(token), userID, purpose, email, int64(ttl/time.Second)); err != nil {
+        return "", err
+    }
+    return token, tx.Commit()
+}
+
+// redeemAccountToken marks token used in tx and returns the user and email
+// it was issued for
+func redeemAccountToken(tx *sql.Tx, token, purpose string) (userID, email string, err error) {
+    var usable bool
+    err = tx.QueryRow(`
+        SELECT user_id, email, used_at IS NULL AND expires_at > NOW() FROM account_tokens
+        WHERE token_hash = ? AND purpose = ? FOR UPDATE`,
+        hashAccountToken(token), purpose).Scan(&userID, &email, &usable)
+    if err == sql.ErrNoRows || (err == nil && !usable) {
+        // The user of a used or expired token is kept for the security event
+        return userID, "", errAccountTokenInvalid
+    } else if err != nil {
+        return "", "", err
+    }
+    if _, err := tx.Exec("UPDATE account_tokens SET used_at = NOW() WHERE token_hash = ?", hashAccountToken(token)); err != nil {
+        return "", "", err
+    }
+    return userID, email, nil
+}
+
+// pruneAccountTokens deletes account tokens a day past their expiry
+func (ut *UnifiedTokenizer) pruneAccountTokens() {
+    if _, err := ut.db.Exec("DELETE FROM account_tokens WHERE expires_at < NOW() - INTERVAL 1 DAY"); err != nil {
+        log.Printf("Failed to prune account tokens: %v", err)
+    }
+}
+
+// sendVerificationEmail mails user a link confirming they own email
+func (ut *UnifiedTokenizer) sendVerificationEmail(user *User, email string) error {
+    if ut.accountMail.sender == nil {
+        return errors.New("account emails are not configured")
+    }
+    token, err := ut.issueAccountToken(user.UserID, purposeVerifyEmail, email, ut.accountMail.verifyTTL)
+    if err != nil {
+        return err
+    }
+    return ut.accountMail.sender.Send(mailer.Message{
+        To:      email,
+        Subject: "Verify your TokenShield email address",
+        Body: fmt.Sprintf("Hello %s,\n\n"+
+            "Confirm that this is your email address for the TokenShield account %s:\n\n"+
+            "    %s\n\n"+
+            "This expires in %s. If you did not ask for this, you can ignore this email.\n",
+            user.FullName, user.Username, ut.accountMail.link("/verify-email", token), ut.accountMail.verifyTTL),
+    })
+}
+
+// sendPasswordResetEmail mails user a link to choose a new password
+func (ut *UnifiedTokenizer) sendPasswordResetEmail(user *User) error {
+    token, err := ut.issueAccountToken(user.UserID, purposeResetPassword, user.Email, ut.accountMail.resetTTL)
+    if err != nil {
+        return err
+    }
+    return ut.accountMail.sender.Send(mailer.Message{
+        To:      user.Email,
+        Subject: "Reset your TokenShield password",
+        Body: fmt.Sprintf("Hello %s,\n\n"+
+            "Someone asked to reset the password of the TokenShield account %s. To choose a new one:\n\n"+
+            "    %s\n\n"+
+            "This expires in %s and can be used once. If you did not ask for this, ignore this email; "+
+            "your password has not been changed.\n",
+            user.FullName, user.Username, ut.accountMail.link("/reset-password", token), ut.accountMail.resetTTL),
+    })
+}
+
+// UpdateProfileRequest is the body of PUT /api/v1/auth/me; omitted fields
+// are left unchanged. Changing the email needs the current password.
+type UpdateProfileRequest struct {
+    FullName        *string `json:"full_name"`
+    Email           *string `json:"email"`
+    CurrentPassword string  `json:"current_password,omitempty"`
+}
+
+// handleUpdateProfile lets the logged-in user change their name and email.
+// A new email is unverified until the user follows the link mailed to it.
+func (ut *UnifiedTokenizer) handleUpdateProfile(w http.ResponseWriter, r *http.Request) {
+    sessionID := ut.cookies.sessionID(r)
+    if auth := r.Header.Get("Authorization"); sessionID == "" && strings.HasPrefix(auth, "Bearer ") {
+        sessionID = strings.TrimPrefix(auth, "Bearer ")
+    }
+    if sessionID == "" {
+        apierror.Write(w, r, http.StatusUnauthorized, apierror.AuthenticationRequired, "Authentication required")
+        return
+    }
+    session, err := ut.validateSession(r, sessionID)
+    if err != nil {
+        writeSessionError(w, r, err)
+        return
+    }
+    user := session.User
+
+    var req UpdateProfileRequest
+    if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+        apierror.Write(w, r, http.StatusBadRequest, apierror.InvalidBody, "Invalid request body")
+        return
+    }
+    if req.Email != nil && *req.Email == "" {
+        apierror.Write(w, r, http.StatusBadRequest, apierror.InvalidRequest, "Email cannot be empty")
+        return
+    }
+    emailChanged := req.Email != nil && !strings.EqualFold(*req.Email, user.Email)
+    if req.FullName == nil && !emailChanged {
+        apierror.Write(w, r, http.StatusBadRequest, apierror.InvalidRequest, "No fields to update")
+        return
+    }
+
+    ipAddress, userAgent := ut.getClientInfo(r)
+    if emailChanged {
+        // A stolen session must not be enough to move the account's
+        // password resets to another mailbox
+        var passwordHash string
+        if err := ut.db.QueryRow("SELECT password_hash FROM users WHERE user_id = ?", user.UserID).Scan(&passwordHash); err != nil {
+            apierror.Write(w, r, http.StatusInternalServerError, apierror.InternalError, "Database error")
+            return
+        }
+        if bcrypt.CompareHashAndPassword([]byte(passwordHash), []byte(req.CurrentPassword)) != nil {
+            ut.logSecurityEvent(SecurityEvent{
+                EventType: "email_change_failed",
+                Severity:  "medium",
+                UserID:    user.UserID,
+                Username:  user.Username,
+                IPAddress: ipAddress,
+                UserAgent: userAgent,
+                Endpoint:  r.URL.Path,
+                Details: map[string]interface{}{
+                    "reason": "incorrect_current_password",
+                },
+            })
+            apierror.Write(w, r, http.StatusBadRequest, apierror.InvalidCredentials, "Current password is incorrect")
+            return
+        }
+    }
+
+    update := userUpdateColumns.Update()
+    changes := map[string]interface{}{}
+    if req.FullName != nil {
+        update.Set("full_name", *req.FullName)
+        changes["full_name"] = *req.FullName
+    }
+    if emailChanged {
+        update.Set("email", *req.Email)
+        update.Set("is_email_verified", false)
+        changes["email"] = *req.Email
+    }
+    setClause, params, err := update.SetClause()
+    if err == nil {
+        _, err = ut.db.Exec("UPDATE users SET "+setClause+", updated_at = NOW() WHERE user_id = ?", append(params, user.UserID)...)
+    }
+    if isDuplicateKey(err) {
+        apierror.Write(w, r, http.StatusConflict, apierror.AlreadyExists, "Email address is already in use")
+        return
+    } else if err != nil {
+        apierror.Write(w, r, http.StatusInternalServerError, apierror.InternalError, "Failed to update profile")
+        return
+    }
+
+    ut.logAuditEvent(AuditEvent{
+        UserID:       user.UserID,
+        Action:       "profile_updated",
+        ResourceType: "user",
+        ResourceID:   user.UserID,
+        IPAddress:    ipAddress,
+        UserAgent:    userAgent,
+        Details:      changes,
+    })
+
+    response := map[string]interface{}{"message": "Profile updated successfully"}
+    if emailChanged {
+        ut.db.Exec("DELETE FROM account_tokens WHERE user_id = ? AND used_at IS NULL", user.UserID)
+        ut.logSecurityEvent(SecurityEvent{
+            EventType: "email_changed",
+            Severity:  "medium",
+            UserID:    user.UserID,
+            Username:  user.Username,
+            IPAddress: ipAddress,
+            UserAgent: userAgent,
+            Endpoint:  r.URL.Path,
+            Details: map[string]interface{}{
+                "old_email": user.Email,
+                "new_email": *req.Email,
+            },
+        })
+        if req.FullName != nil {
+            user.FullName = *req.FullName
+        }
+        sent := false
+        if ut.accountMail.sender != nil {
+            if err := ut.sendVerificationEmail(user, *req.Email); err != nil {
+                log.Printf("Failed to send verification email to user %s: %v", user.UserID, err)
+            } else {
+                sent = true
+            }
+        }
+        response["email_verified"] = false
+        response["verification_sent"] = sent
+    }
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(response)
+}
+
+// handleSendVerificationEmail mails the logged-in user a new link to verify
+// their address
+func (ut *UnifiedTokenizer) handleSendVerificationEmail(w http.ResponseWriter, r *http.Request) {
+    if r.Method != "POST" {
+        apierror.Write(w, r, http.StatusMethodNotAllowed, apierror.MethodNotAllowed, "Method not allowed")
+        return
+    }
+    if ut.accountMail.sender == nil {
+        apierror.Write(w, r, http.StatusServiceUnavailable, apierror.MailNotConfigured, "Account emails are not configured")
+        return
+    }
+    sessionID := ut.cookies.sessionID(r)
+    if auth := r.Header.Get("Authorization"); sessionID == "" && strings.HasPrefix(auth, "Bearer ") {
+        sessionID = strings.TrimPrefix(auth, "Bearer ")
+    }
+    if sessionID == "" {
+        apierror.Write(w, r, http.StatusUnauthorized, apierror.AuthenticationRequired, "Authentication required")
+        return
+    }
+    session, err := ut.validateSession(r, sessionID)
+    if err != nil {
+        writeSessionError(w, r, err)
+        return
+    }
+    if session.User.EmailVerified {
+        apierror.Write(w, r, http.StatusConflict, apierror.Conflict, "Email address is already verified")
+        return
+    }
+    if err := ut.sendVerificationEmail(session.User, session.User.Email); err != nil {
+        log.Printf("Failed to send verification email to user %s: %v", session.User.UserID, err)
+        apierror.Write(w, r, http.StatusBadGateway, apierror.InternalError, "Failed to send verification email")
+        return
+    }
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(map[string]string{"message": "Verification email sent to " + session.User.Email})
+}
+
+// AccountTokenRequest is the body of POST /api/v1/auth/verify-email
+type AccountTokenRequest struct {
+    Token string `json:"token"`
+}
+
+// handleVerifyEmail marks the user's email verified from the token mailed
+// to it. The token only works while the address is still the user's.
+func (ut *UnifiedTokenizer) handleVerifyEmail(w http.ResponseWriter, r *http.Request) {
+    var req AccountTokenRequest
+    if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+        apierror.Write(w, r, http.StatusBadRequest, apierror.InvalidBody, "Invalid request body")
+        return
+    }
+    ipAddress, userAgent := ut.getClientInfo(r)
+
+    tx, err := ut.db.Begin()
+    if err != nil {
+        apierror.Write(w, r, http.StatusInternalServerError, apierror.InternalError, "Database error")
+        return
+    }
+    defer tx.Rollback()
+    userID, email, err := redeemAccountToken(tx, req.Token, purposeVerifyEmail)
+    var result sql.Result
+    if err == nil {
+        result, err = tx.Exec("UPDATE users SET is_email_verified = TRUE, updated_at = NOW() WHERE user_id = ? AND email = ?", userID, email)
+    }
+    if err == nil {
+        if n, _ := result.RowsAffected(); n == 0 {
+            err = errAccountTokenInvalid
+        }
+    }
+    if err == nil {
+        err = tx.Commit()
+    }
+    if err == errAccountTokenInvalid {
+        ut.logSecurityEvent(SecurityEvent{
+            EventType: "email_verification_failed",
+            Severity:  "low",
+            UserID:    userID,
+            IPAddress: ipAddress,
+            UserAgent: userAgent,
+            Endpoint:  r.URL.Path,
+            Details: map[string]interface{}{
+                "reason": "invalid_or_expired_token",
+            },
+        })
+        apierror.Write(w, r, http.StatusBadRequest, apierror.AccountTokenInvalid, "Verification link is invalid or has expired")
+        return
+    } else if err != nil {
+        apierror.Write(w, r, http.StatusInternalServerError, apierror.InternalError, "Failed to verify email")
+        return
+    }
+
+    ut.logSecurityEvent(SecurityEvent{
+        EventType: "email_verified",
+        Severity:  "info",
+        UserID:    userID,
+        IPAddress: ipAddress,
+        UserAgent: userAgent,
+        Endpoint:  r.URL.Path,
+        Details: map[string]interface{}{
+            "email": email,
+        },
+    })
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(map[string]interface{}{"message": "Email address verified", "email": email})
+}
+
+// ForgotPasswordRequest is the body of POST /api/v1/auth/forgot-password
+type ForgotPasswordRequest struct {
+    Username string `json:"username"` // Username or email
+}
+
+// forgotPasswordMessage is the answer to every forgot-password request, so
+// it does not tell which accounts exist
+const forgotPasswordMessage = "If the account exists and has a verified email address, a password reset link has been sent to it"
+
+// handleForgotPassword mails a password reset link to the verified address
+// of an active account. The answer is the same whether or not an email was
+// sent, and the email is sent after answering so the timing does not tell
+// either.
+func (ut *UnifiedTokenizer) handleForgotPassword(w http.ResponseWriter, r *http.Request) {
+    if ut.accountMail.sender == nil {
+        apierror.Write(w, r, http.StatusServiceUnavailable, apierror.MailNotConfigured, "Account emails are not configured")
+        return
+    }
+    var req ForgotPasswordRequest
+    if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+        apierror.Write(w, r, http.StatusBadRequest, apierror.InvalidBody, "Invalid request body")
+        return
+    }
+    ipAddress, userAgent := ut.getClientInfo(r)
+
+    var user User
+    err := ut.db.QueryRow(`
+        SELECT user_id, username, email, is_email_verified, full_name, is_active
+        FROM users WHERE (username = ? OR email = ?) AND account_type = 'human'`,
+        req.Username, req.Username).Scan(&user.UserID, &user.Username, &user.Email, &user.EmailVerified, &user.FullName, &user.IsActive)
+    reason := ""
+    switch {
+    case err == sql.ErrNoRows:
+        reason = "unknown_account"
+    case err != nil:
+        apierror.Write(w, r, http.StatusInternalServerError, apierror.InternalError, "Database error")
+        return
+    case !user.IsActive:
+        reason = "account_disabled"
+    case !user.EmailVerified:
+        reason = "email_not_verified"
+    }
+
+    event := SecurityEvent{
+        EventType: "password_reset_requested",
+        Severity:  "info",
+        UserID:    user.UserID,
+        Username:  req.Username,
+        IPAddress: ipAddress,
+        UserAgent: userAgent,
+        Endpoint:  r.URL.Path,
+        Details: map[string]interface{}{
+            "email_sent": reason == "",
+        },
+    }
+    if reason != "" {
+        event.Severity = "low"
+        event.Details["reason"] = reason
+    } else {
+        go func() {
+            if err := ut.sendPasswordResetEmail(&user); err != nil {
+                log.Printf("Failed to send password reset email to user %s: %v", user.UserID, err)
+            }
+        }()
+    }
+    ut.logSecurityEvent(event)
+
+    w.Header().Set("Content-Type", "application/json")
+    w.WriteHeader(http.StatusAccepted)
+    json.NewEncoder(w).Encode(map[string]string{"message": forgotPasswordMessage})
+}
+
+// ResetPasswordRequest is the body of POST /api/v1/auth/reset-password
+type ResetPasswordRequest struct {
+    Token       string `json:"token"`
+    NewPassword string `json:"new_password"`
+}
+
+// handleResetPassword sets a new password from a reset token. The account
+// is unlocked and all of its sessions end.
+func (ut *UnifiedTokenizer) handleResetPassword(w http.ResponseWriter, r *http.Request) {
+    var req ResetPasswordRequest
+    if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+        apierror.Write(w, r, http.StatusBadRequest, apierror.InvalidBody, "Invalid request body")
+        return
+    }
+    // Checked first so a weak password does not use up the token
+    if err := ut.validatePasswordStrength(req.NewPassword); err != nil {
+        apierror.Write(w, r, http.StatusBadRequest, apierror.InvalidRequest, err.Error())
+        return
+    }
+    passwordHash, err := bcrypt.GenerateFromPassword([]byte(req.NewPassword), bcrypt.DefaultCost)
+    if err != nil {
+        apierror.Write(w, r, http.StatusInternalServerError, apierror.InternalError, "Password hashing failed")
+        return
+    }
+    ipAddress, userAgent := ut.getClientInfo(r)
+
+    tx, err := ut.db.Begin()
+    if err != nil {
+        apierror.Write(w, r, http.StatusInternalServerError, apierror.InternalError, "Database error")
+        return
+    }
+    defer tx.Rollback()
+    userID, _, err := redeemAccountToken(tx, req.Token, purposeResetPassword)
+    var result sql.Result
+    if err == nil {
+        result, err = tx.Exec(`
+            UPDATE users
+            SET password_hash = ?, password_changed_at = CURRENT_TIMESTAMP,
+                failed_login_attempts = 0, locked_until = NULL, updated_at = NOW()
+            WHERE user_id = ? AND is_active = TRUE`,
+            string(passwordHash), userID)
+    }
+    if err == nil {
+        if n, _ := result.RowsAffected(); n == 0 {
+            err = errAccountTokenInvalid
+        }
+    }
+    if err == nil {
+        _, err = tx.Exec("UPDATE account_tokens SET used_at = NOW() WHERE user_id = ? AND purpose = ? AND used_at IS NULL", userID, purposeResetPassword)
+    }
+    if err == nil {
+        err = tx.Commit()
+    }
+    if err == errAccountTokenInvalid {
+        ut.logSecurityEvent(SecurityEvent{
+            EventType: "password_reset_failed",
+            Severity:  "medium",
+            UserID:    userID,
+            IPAddress: ipAddress,
+            UserAgent: userAgent,
+            Endpoint:  r.URL.Path,
+            Details: map[string]interface{}{
+                "reason": "invalid_or_expired_token",
+            },
+        })
+        apierror.Write(w, r, http.StatusBadRequest, apierror.AccountTokenInvalid, "Password reset link is invalid or has expired")
+        return
+    } else if err != nil {
+        apierror.Write(w, r, http.StatusInternalServerError, apierror.InternalError, "Failed to reset password")
+        return
+    }
+
+    if err := ut.invalidateUserSessions(userID, "password_reset"); err != nil {
+        log.Printf("Failed to invalidate sessions after password reset: %v", err)
+    }
+    ut.logAuditEvent(AuditEvent{
+        UserID:       userID,
+        Action:       "password_reset_completed",
+        ResourceType: "user",
+        ResourceID:   userID,
+        IPAddress:    ipAddress,
+        UserAgent:    userAgent,
+    })
+    ut.logSecurityEvent(SecurityEvent{
+        EventType: "password_reset_completed",
+        Severity:  "medium",
+        UserID:    userID,
+        IPAddress: ipAddress,
+        UserAgent: userAgent,
+        Endpoint:  r.URL.Path,
+        Details: map[string]interface{}{
+            "initiated_by": "user",
+        },
+    })
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(map[string]string{"message": "Password has been reset. Log in with the new password"})
+}
+
+func (ut *UnifiedTokenizer) validatePasswordStrength(password string) error {
+    if len(password) < 12 {
+        return fmt.Errorf("password must be at least 12 characters long")
+    }
+    
+    var hasUpper, hasLower, hasDigit, hasSpecial bool
+    for _, char := range password {
+        switch {
+        case 'A' <= char && char <= 'Z':
+            hasUpper = true
+        case 'a' <= char && char <= 'z':
+            hasLower = true
+        case '0' <= char && char <= '9':
+            hasDigit = true
+        case strings.ContainsRune("!@#$%^&*()_+-=[]{}|;':\",./<>?", char):
+            hasSpecial = true
+        }
+    }
+    
+    var missing []string
+    if !hasUpper {
+        missing = append(missing, "uppercase letter")
+    }
+    if !hasLower {
+        missing = append(missing, "lowercase letter")
+    }
+    if !hasDigit {
+        missing = append(missing, "number")
+    }
+    if !hasSpecial {
+        missing = append(missing, "special character")
+    }
+    
+    if len(missing) > 0 {
+        return fmt.Errorf("password must contain at least one %s", strings.Join(missing, ", "))
+    }
+    
+    return nil
+}
+
+// User management handlers
+
+func (ut *UnifiedTokenizer) handleListUsers(w http.ResponseWriter, r *http.Request) {
+    rows, err := ut.db.Query(`
+        SELECT user_id, username, email, is_email_verified, full_name, role, permissions, 
+               is_active, created_at, last_login_at
+        FROM users
+        WHERE account_type = 'human'
+        ORDER BY created_at DESC
+    `)
+    if err != nil {
+        apierror.Write(w, r, http.StatusInternalServerError, apierror.InternalError, "Database error")
+        return
+    }
+    defer rows.Close()
+    
+    var users []User
+    for rows.Next() {
+        var user User
+        var permissionsJSON []byte
+        var lastLoginAt sql.NullTime
+        
+        err := rows.Scan(&user.UserID, &user.Username, &user.Email, &user.EmailVerified, &user.FullName,
+            &user.Role, &permissionsJSON, &user.IsActive, &user.CreatedAt, &lastLoginAt)
+        if err != nil {
+            continue
+        }
+        
+        json.Unmarshal(permissionsJSON, &user.Permissions)
+        if lastLoginAt.Valid {
+            user.LastLoginAt = &lastLoginAt.Time
+        }
+        
+        users = append(users, user)
+    }
+    
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(map[string]interface{}{
+        "users": users,
+        "total": len(users),
+    })
+}
+
+// CreateUserRequest is the body of POST /api/v1/users
+type CreateUserRequest struct {
+    Username    string   `json:"username"`
+    Email       string   `json:"email"`
+    Password    string   `json:"password"`
+    FullName    string   `json:"full_name"`
+    Role        string   `json:"role"`
+    Permissions []string `json:"permissions"`
+}
+
+func (ut *UnifiedTokenizer) handleCreateUser(w http.ResponseWriter, r *http.Request) {
+    var req CreateUserRequest
+    
+    if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+        apierror.Write(w, r, http.StatusBadRequest, apierror.InvalidBody, "Invalid request body")
+        return
+    }
+    
+    // Validate required fields
+    if req.Username == "" || req.Email == "" || req.Password == "" {
+        apierror.Write(w, r, http.StatusBadRequest, apierror.InvalidRequest, "username, email, and password are required")
+        return
+    }
+    
+    // Validate role
+    if req.Role == "" {
+        req.Role = RoleViewer
+    }
+    if ok, err := ut.roleExists(req.Role); err != nil {
+        apierror.Write(w, r, http.StatusInternalServerError, apierror.InternalError, "Database error")
+        return
+    } else if !ok {
+        apierror.Write(w, r, http.StatusBadRequest, apierror.InvalidRequest, "Unknown role "+req.Role)
+        return
+    }
+    if err := validPermissions(req.Permissions); err != nil {
+        apierror.Write(w, r, http.StatusBadRequest, apierror.InvalidRequest, err.Error())
+        return
+    }
+    if !ut.canManageUser(r, &User{Role: req.Role, Permissions: req.Permissions}) {
+        apierror.Write(w, r, http.StatusForbidden, apierror.PermissionDenied, "Cannot grant permissions you do not have")
+        return
+    }
+    
+    // Hash password
+    passwordHash, err := bcrypt.GenerateFromPassword([]byte(req.Password), bcrypt.DefaultCost)
+    if err != nil {
+        apierror.Write(w, r, http.StatusInternalServerError, apierror.InternalError, "Failed to hash password")
+        return
+    }
+    
+    // The role grants the user its permissions; these are any beyond them
+    if req.Permissions == nil {
+        req.Permissions = []string{}
+    }
+    
+    userID := "usr_" + generateRandomID()
+    permissionsJSON, _ := json.Marshal(req.Permissions)
+    createdBy := r.Header.Get("X-User-ID")
+    
+    _, err = ut.db.Exec(`
+        INSERT INTO users (
+            user_id, username, email, password_hash, full_name,
+            role, permissions, is_active, is_email_verified, created_by
+        ) VALUES (?, ?, ?, ?, ?, ?, ?, TRUE, FALSE, ?)
+    `, userID, req.Username, req.Email, string(passwordHash), req.FullName,
+       req.Role, permissionsJSON, createdBy)
+    
+    if err != nil {
+        if strings.Contains(err.Error(), "Duplicate") {
+            apierror.Write(w, r, http.StatusConflict, apierror.AlreadyExists, "Username or email already exists")
+        } else {
+            apierror.Write(w, r, http.StatusInternalServerError, apierror.InternalError, "Failed to create user")
+        }
+        return
+    }
+    
+    // Return created user
+    user := User{
+        UserID:      userID,
+        Username:    req.Username,
+        Email:       req.Email,
+        FullName:    req.FullName,
+        Role:        req.Role,
+        Permissions: req.Permissions,
+        IsActive:    true,
+        CreatedAt:   time.Now(),
+    }
+    
+    w.WriteHeader(http.StatusCreated)
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(user)
+}
+
+// Card import handler
+func (ut *UnifiedTokenizer) handleCardImport(w http.ResponseWriter, r *http.Request) {
+    startTime := time.Now()
+    ipAddress, userAgent := ut.getClientInfo(r)
+    
+    // Get user ID from request context
+    userID := r.Header.Get("X-User-ID")
+    if userID == "" {
+        apierror.Write(w, r, http.StatusUnauthorized, apierror.AuthenticationRequired, "Authentication required")
+        return
+    }
+    
+    // Parse request
+    var req CardImportRequest
+    if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+        apierror.Write(w, r, http.StatusBadRequest, apierror.InvalidBody, "Invalid request format")
+        return
+    }
+    
+    // Set defaults
+    if req.DuplicateHandling == "" {
+        req.DuplicateHandling = "skip"
+    }
+    if req.BatchSize == 0 {
+        req.BatchSize = 100
+    }
+    if req.Tenant != "" && !tenantPattern.MatchString(req.Tenant) {
+        apierror.Write(w, r, http.StatusBadRequest, apierror.InvalidRequest, "Invalid tenant: use up to 64 letters, digits, '.', '_' or '-'")
+        return
+    }
+    // The owner can list, search, read and revoke the cards with tokens.own
+    if req.Owner == "" {
+        req.Owner = userID
+    } else {
+        err := ut.db.QueryRow("SELECT user_id FROM users WHERE username = ? OR user_id = ?", req.Owner, req.Owner).Scan(&req.Owner)
+        if err == sql.ErrNoRows {
+            apierror.Write(w, r, http.StatusBadRequest, apierror.InvalidRequest, "Unknown owner")
+            return
+        } else if err != nil {
+            apierror.Write(w, r, http.StatusInternalServerError, apierror.InternalError, "Database error")
+            return
+        }
+    }
+    if err := validateTags(req.Tags); err != nil {
+        apierror.Write(w, r, http.StatusBadRequest, apierror.InvalidRequest, err.Error())
+        return
+    }
+    
+    // Generate import ID
+    importID := "imp_" + generateRandomID()
+    
+    // Decode data
+    dataBytes, err := base64.StdEncoding.DecodeString(req.Data)
+    if err != nil {
+        ut.logSecurityEvent(SecurityEvent{
+            EventType: "invalid_import_data",
+            Severity:  "medium",
+            UserID:    userID,
+            IPAddress: ipAddress,
+            UserAgent: userAgent,
+            Endpoint:  r.URL.Path,
+            Details: map[string]interface{}{
+                "error": "invalid base64 encoding",
+                "import_id": importID,
+            },
+        })
+        apierror.Write(w, r, http.StatusBadRequest, apierror.InvalidBody, "Invalid data encoding")
+        return
+    }
+    dataBytes, err = decodeImportData(dataBytes, req)
+    if err != nil {
+        apierror.Write(w, r, http.StatusBadRequest, apierror.InvalidBody, fmt.Sprintf("Invalid import data: %v", err))
+        return
+    }
+    
+    // Parse cards based on format
+    format, err := cardformat.New(req.Format, req.Options)
+    if err != nil {
+        apierror.Write(w, r, http.StatusBadRequest, apierror.InvalidRequest, fmt.Sprintf("Invalid import format: %v", err))
+        return
+    }
+    cards, err := format.Parse(dataBytes)
+    var rowErrors *cardformat.RowErrors
+    if errors.As(err, &rowErrors) {
+        apierror.WriteDetails(w, r, http.StatusBadRequest, apierror.InvalidRequest, fmt.Sprintf("Invalid %s import data: %v", req.Format, err), map[string]interface{}{
+            "rows": rowErrors.Rows,
+        })
+        return
+    } else if err != nil {
+        apierror.Write(w, r, http.StatusBadRequest, apierror.InvalidRequest, fmt.Sprintf("Invalid %s import data: %v", req.Format, err))
+        return
+    }
+    
+    // Validate we have cards
+    if len(cards) == 0 {
+        apierror.Write(w, r, http.StatusBadRequest, apierror.InvalidRequest, "No cards found in import data")
+        return
+    }
+    
+    // Limit the number of cards per import
+    maxCards := 10000
+    if len(cards) > maxCards {
+        apierror.WriteDetails(w, r, http.StatusBadRequest, apierror.InvalidRequest, fmt.Sprintf("Too many cards. Maximum %d cards per import", maxCards), map[string]interface{}{
+            "provided": len(cards),
+            "maximum": maxCards,
+        })
+        return
+    }
+    
+    // Process the import
+    result := ut.processCardImport(importID, userID, cards, req)
+    result.ProcessingTime = time.Since(startTime).String()
+    
+    // Log import completion
+    action := "cards_import"
+    if req.ValidateOnly {
+        action = "cards_import_validated"
+    }
+    ut.logAuditEvent(AuditEvent{
+        UserID:       userID,
+        Action:       action,
+        ResourceType: "cards",
+        ResourceID:   importID,
+        IPAddress:    ipAddress,
+        UserAgent:    userAgent,
+        Details: map[string]interface{}{
+            "total_records": result.TotalRecords,
+            "successful_imports": result.SuccessfulImports,
+            "failed_imports": result.FailedImports,
+            "duplicates": result.Duplicates,
+            "processing_time": result.ProcessingTime,
+            "format": req.Format,
+            "duplicate_handling": req.DuplicateHandling,
+            "owner": req.Owner,
+        },
+    })
+    
+    // Return result
+    if result.FailedImports > 0 && result.SuccessfulImports == 0 {
+        w.WriteHeader(http.StatusBadRequest)
+    } else if result.FailedImports > 0 {
+        w.WriteHeader(http.StatusPartialContent)
+    } else {
+        w.WriteHeader(http.StatusOK)
+    }
+    
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(result)
+}
+
+// maxImportDataSize bounds import data once uncompressed, so a small gzip
+// upload cannot expand without limit
+const maxImportDataSize = 100 * 1024 * 1024
+
+// decodeImportData uncompresses import data sent with compression "gzip"
+// and converts it to UTF-8 from the encoding given, or its byte order mark
+func decodeImportData(data []byte, req CardImportRequest) ([]byte, error) {
+    switch req.Compression {
+    case "":
+    case "gzip":
+        zr, err := gzip.NewReader(bytes.NewReader(data))
+        if err != nil {
+            return nil, fmt.Errorf("invalid gzip data: %v", err)
+        }
+        data, err = io.ReadAll(io.LimitReader(zr, maxImportDataSize+1))
+        if err != nil {
+            return nil, fmt.Errorf("invalid gzip data: %v", err)
+        }
+        if len(data) > maxImportDataSize {
+            return nil, fmt.Errorf("data exceeds %d MB uncompressed", maxImportDataSize/(1024*1024))
+        }
+    default:
+        return nil, fmt.Errorf("unsupported compression %q, use \"gzip\"", req.Compression)
+    }
+    
+    contentType := "text/csv"
+    if req.Format == "json" {
+        contentType = "application/json"
+    }
+    if req.Encoding != "" {
+        contentType += "; charset=" + req.Encoding
+    }
+    encoding, err := charset.Detect(contentType, data)
+    if err != nil {
+        return nil, err
+    }
+    if encoding.Native() {
+        return data, nil
+    }
+    text, err := encoding.Decode(data)
+    if err != nil {
+        return nil, fmt.Errorf("invalid %s data: %v", encoding.Name, err)
+    }
+    return []byte(text), nil
+}
+
+// processCardImport processes a batch of cards for import
+func (ut *UnifiedTokenizer) processCardImport(importID, userID string, cards []CardImportRecord, req CardImportRequest) CardImportResult {
+    result := CardImportResult{
+        TotalRecords:    len(cards),
+        ImportID:        importID,
+        Status:          "completed",
+        ValidateOnly:    req.ValidateOnly,
+        TokensGenerated: make([]CardImportSuccess, 0),
+        Errors:          make([]CardImportError, 0),
+    }
+    
+    // Tokens of the cards earlier in the import, by card number, so a card
+    // given twice is a duplicate the second time ("" when validating only)
+    seen := make(map[string]string)
+    
+    // Process in batches
+    batchSize := req.BatchSize
+    if batchSize > 1000 {
+        batchSize = 1000
+    }
+    
+    for i := 0; i < len(cards); i += batchSize {
+        end := i + batchSize
+        if end > len(cards) {
+            end = len(cards)
+        }
+        
+        batch := cards[i:end]
+        ut.processBatch(batch, i, &result, req, seen)
+    }
+    
+    // Point errors in text formats at the line of the record
+    for i := range result.Errors {
+        if index := result.Errors[i].RecordIndex; index >= 0 && index < len(cards) {
+            result.Errors[i].Line = cards[index].Line
+        }
+    }
+    
+    // Update final status
+    if result.FailedImports > 0 && result.SuccessfulImports == 0 {
+        result.Status = "failed"
+    } else if result.FailedImports > 0 {
+        result.Status = "partial"
+    }
+    
+    return result
+}
+
+// processBatch processes a single batch of cards in one transaction. Each
+// card is stored under a savepoint, so a card that fails is undone without
+// the rest of the batch. When validating only, the cards are checked the
+// same way but nothing is written.
+func (ut *UnifiedTokenizer) processBatch(batch []CardImportRecord, startIndex int, result *CardImportResult, req CardImportRequest, seen map[string]string) {
+    result.ProcessedRecords += len(batch)
+    
+    // Start transaction for batch
+    var tx *sql.Tx
+    var err error
+    if !req.ValidateOnly {
+        tx, err = ut.db.Begin()
+    }
+    if err != nil {
+        for j, card := range batch {
+            result.Errors = append(result.Errors, importError(startIndex+j, card, "Database transaction error", err.Error()))
+            result.FailedImports++
+        }
+        return
+    }
+    
+    b := &importBatch{startIndex: startIndex, records: batch, added: make(map[string]string)}
+    var txErr error // Set when the transaction can no longer be used
+    
+    for j, card := range batch {
+        recordIndex := startIndex + j
+        var err error
+        if txErr != nil {
+            result.Errors = append(result.Errors, importError(recordIndex, card, "Database transaction error", txErr.Error()))
+            result.FailedImports++
+            continue
+        }
+        
+        // Validate card
+        if err := ut.validateCardRecord(card); err != nil {
+            result.Errors = append(result.Errors, importError(recordIndex, card, "Validation failed", err.Error()))
+            result.FailedImports++
+            continue
+        }
+        
+        // Check for duplicates, in the vault and earlier in the import
+        cleanCard := normalizeCardNumber(card.CardNumber)
+        existingToken, exists := seen[cleanCard]
+        if !exists {
+            existingToken, exists = b.added[cleanCard]
+        }
+        if !exists {
+            exists, existingToken, err = ut.checkCardExists(card.CardNumber)
+        }
+        if err != nil {
+            result.Errors = append(result.Errors, importError(recordIndex, card, "Duplicate check failed", err.Error()))
+            result.FailedImports++
+            continue
+        }
+        
+        if exists && !b.duplicate(result, req, recordIndex, card, existingToken) {
+            continue
+        }
+        
+        // Tokenize card. Unless overwriting, the card is claimed first, and
+        // a card another request stored since the check is a duplicate too.
+        token, cardType, existing := "", utils.DetectCardType(cleanCard), false
+        if !req.ValidateOnly {
+            if _, err = tx.Exec("SAVEPOINT import_record"); err != nil {
+                txErr = err
+            } else {
+                token, cardType, existing, err = ut.tokenizeCardForImport(card, req.Tenant, req.Owner, mergeTags(req.Tags, card.Tags), tx, req.DuplicateHandling != "overwrite")
+                if err != nil {
+                    if _, rbErr := tx.Exec("ROLLBACK TO SAVEPOINT import_record"); rbErr != nil {
+                        txErr = rbErr
+                    }
+                }
+            }
+        }
+        if txErr != nil {
+            result.Errors = append(result.Errors, importError(recordIndex, card, "Database transaction error", txErr.Error()))
+            result.FailedImports++
+            continue
+        }
+        if err == nil && existing {
+            b.duplicate(result, req, recordIndex, card, token)
+            continue
+        }
+        if err != nil {
+            result.Errors = append(result.Errors, importError(recordIndex, card, "Tokenization failed", err.Error()))
+            result.FailedImports++
+            continue
+        }
+        
+        b.added[cleanCard] = token
+        b.generated = append(b.generated, CardImportSuccess{
+            RecordIndex: recordIndex,
+            ExternalID:  card.ExternalID,
+            Token:       token,
+            CardType:    cardType,
+            LastFour:    card.CardNumber[len(card.CardNumber)-4:],
+        })
+    }
+    
+    // Commit or rollback transaction
+    if req.ValidateOnly {
+        b.commit(result, seen)
+        return
+    }
+    if txErr != nil {
+        tx.Rollback()
+        b.fail(result, "Database transaction error", txErr.Error())
+    } else if err := tx.Commit(); err != nil {
+        b.fail(result, "Transaction commit failed", err.Error())
+    } else {
+        ut.counters.AddActive(int64(b.commit(result, seen)))
+        return
+    }
+    
+    // Release the claims on the cards that were not stored after all
+    tokens := make([]interface{}, 0, len(b.added))
+    for _, token := range b.added {
+        tokens = append(tokens, token)
+    }
+    ut.releaseCardClaims(tokens)
+}
+
+// importError is the error reported for the import's record at
+// recordIndex
+func importError(recordIndex int, card CardImportRecord, message, reason string) CardImportError {
+    return CardImportError{
+        RecordIndex: recordIndex,
+        ExternalID:  card.ExternalID,
+        CardNumber:  maskCardNumber(card.CardNumber),
+        Error:       message,
+        Reason:      reason,
+    }
+}
+
+// importBatch holds the cards of a batch that are reported in
+// tokens_generated until its transaction ends, so that only cards the
+// batch actually stored are counted as imported
+type importBatch struct {
+    startIndex int
+    records    []CardImportRecord
+    generated  []CardImportSuccess // Cards stored, and existing tokens reused
+    added      map[string]string   // Tokens of the cards stored, by card number
+}
+
+// commit reports the batch's cards as imported and adds them to seen,
+// returning how many were stored
+func (b *importBatch) commit(result *CardImportResult, seen map[string]string) int {
+    stored := 0
+    for _, success := range b.generated {
+        if !success.Existing {
+            stored++
+        }
+    }
+    result.SuccessfulImports += stored
+    result.TokensGenerated = append(result.TokensGenerated, b.generated...)
+    for card, token := range b.added {
+        seen[card] = token
+    }
+    return stored
+}
+
+// fail reports the cards the batch stored as failed when its transaction
+// was rolled back. Existing tokens reused stand, as they were not stored
+// by the batch.
+func (b *importBatch) fail(result *CardImportResult, message, reason string) {
+    for _, success := range b.generated {
+        if success.Existing {
+            result.TokensGenerated = append(result.TokensGenerated, success)
+            continue
+        }
+        result.Errors = append(result.Errors, importError(success.RecordIndex, b.records[success.RecordIndex-b.startIndex], message, reason))
+        result.FailedImports++
+    }
+}
+
+// duplicate applies the import's duplicate handling to a card the vault
+// holds under existingToken, or that is given earlier in the import when
+// existingToken is "". It reports whether the card is to be tokenized
+// again.
+func (b *importBatch) duplicate(result *CardImportResult, req CardImportRequest, recordIndex int, card CardImportRecord, existingToken string) bool {
+    result.Duplicates++
+    switch req.DuplicateHandling {
+    case "error":
+        reason := fmt.Sprintf("Card already exists with token: %s", existingToken)
+        if existingToken == "" {
+            reason = "Card is given earlier in the import"
+        }
+        result.Errors = append(result.Errors, importError(recordIndex, card, "Duplicate card", reason))
+        result.FailedImports++
+        return false
+    case "reuse":
+        // Report the card's token instead of issuing another, so
+        // importing the same file in each region of a replicated
+        // deployment gives the same tokens once rows have replicated
+        b.generated = append(b.generated, CardImportSuccess{
+            RecordIndex: recordIndex,
+            ExternalID:  card.ExternalID,
+            Token:       existingToken,
+            CardType:    utils.DetectCardType(normalizeCardNumber(card.CardNumber)),
+            LastFour:    card.CardNumber[len(card.CardNumber)-4:],
+            Existing:    true,
+        })
+        return false
+    case "overwrite":
+        // Continue with processing, will update existing record
+        return true
+    }
+    // Skip this card
+    return false
+}
+
+// Helper functions for card import
+
+// maskCardNumber masks a credit card number for logging (shows only last 4 digits)
+func maskCardNumber(cardNumber string) string {
+    if len(cardNumber) < 4 {
+        return "****"
+    }
+    return "****" + cardNumber[len(cardNumber)-4:]
+}
+
+// maskAPIKey masks an API key for display to users who may not manage keys
+// (shows only the last 4 characters)
+func maskAPIKey(apiKey string) string {
+    if len(apiKey) < 12 {
+        return "****"
+    }
+    return "****" + apiKey[len(apiKey)-4:]
+}
+
+// validateCardRecord validates a single card record
+func (ut *UnifiedTokenizer) validateCardRecord(card CardImportRecord) error {
+    // Validate card number
+    if card.CardNumber == "" {
+        return fmt.Errorf("card number is required")
+    }
+    
+    // Remove spaces and dashes
+    cleanCard := strings.ReplaceAll(strings.ReplaceAll(card.CardNumber, " ", ""), "-", "")
+    if len(cleanCard) < 13 || len(cleanCard) > 19 {
+        return fmt.Errorf("card number must be between 13 and 19 digits")
+    }
+    
+    // Check if all characters are digits
+    for _, char := range cleanCard {
+        if char < '0' || char > '9' {
+            return fmt.Errorf("card number must contain only digits")
+        }
+    }
+    
+    // Validate using Luhn algorithm
+    if !utils.IsValidLuhn(cleanCard) {
+        return fmt.Errorf("card number fails Luhn algorithm validation")
+    }
+    
+    // Validate expiry
+    if card.ExpiryMonth < 1 || card.ExpiryMonth > 12 {
+        return fmt.Errorf("expiry month must be between 1 and 12")
+    }
+    
+    currentYear := time.Now().Year()
+    if card.ExpiryYear < currentYear || card.ExpiryYear > currentYear+50 {
+        return fmt.Errorf("expiry year must be between %d and %d", currentYear, currentYear+50)
+    }
+    
+    // Check if card is expired
+    currentTime := time.Now()
+    expiryTime := time.Date(card.ExpiryYear, time.Month(card.ExpiryMonth+1), 1, 0, 0, 0, 0, time.UTC).Add(-time.Second)
+    if currentTime.After(expiryTime) {
+        return fmt.Errorf("card is expired")
+    }
+    
+    // Validate card holder name if provided
+    if card.CardHolder != "" && len(card.CardHolder) > 100 {
+        return fmt.Errorf("card holder name too long (max 100 characters)")
+    }
+    
+    // Validate external ID if provided
+    if card.ExternalID != "" && len(card.ExternalID) > 64 {
+        return fmt.Errorf("external ID too long (max 64 characters)")
+    }
+    
+    if err := validateTags(card.Tags); err != nil {
+        return err
+    }
+    
+    // Metadata is stored in a JSON column and must be an object
+    if card.Metadata != "" {
+        if len(card.Metadata) > maxCardMetadataSize {
+            return fmt.Errorf("metadata too long (max %d bytes)", maxCardMetadataSize)
+        }
+        var obj map[string]interface{}
+        if err := json.Unmarshal([]byte(card.Metadata), &obj); err != nil || obj == nil {
+            return fmt.Errorf("metadata must be a JSON object")
+        }
+    }
+    
+    return nil
+}
+
+// checkCardExists checks if a card already exists in the database. Cards
+// are matched on their blind index; only cards stored before the index
+// existed and not yet backfilled are decrypted and compared.
+func (ut *UnifiedTokenizer) checkCardExists(cardNumber string) (bool, string, error) {
+    // Clean card number
+    cleanCard := normalizeCardNumber(cardNumber)
+    
+    cardIndex, err := ut.blindIndex(blindIndexCardNumber, cleanCard)
+    if err != nil {
+        return false, "", err
+    }
+    
+    var token string
+    stmt, err := ut.stmts.Get(stmtFindCardByIndex)
+    if err != nil {
+        return false, "", err
+    }
+    err = stmt.QueryRow(cardIndex).Scan(&token)
+    if err == nil {
+        return true, token, nil
+    } else if err != sql.ErrNoRows {
+        return false, "", err
+    }
+    
+    // Get last 4 digits for lookup
+    lastFour := cleanCard[len(cleanCard)-4:]
+    
+    rows, err := ut.db.Query(`
+        SELECT token, card_number_encrypted, encryption_key_id
+        FROM credit_cards 
+        WHERE last_four_digits = ? AND is_active = TRUE AND card_number_index IS NULL
+    `, lastFour)
+    
+    if err != nil {
+        return false, "", err
+    }
+    defer rows.Close()
+    
+    // Check each unindexed card with matching last 4 digits
+    for rows.Next() {
+        var encryptedCard []byte
+        var keyID sql.NullString
+        if err := rows.Scan(&token, &encryptedCard, &keyID); err != nil {
+            continue
+        }
+        
+        // Decrypt and compare
+        decryptedCard, err := ut.decryptStoredField(encryptedCard, keyID)
+        if err != nil {
+            continue
+        }
+        
+        if decryptedCard == cleanCard {
+            return true, token, nil
+        }
+    }
+    
+    return false, "", nil
+}
+
+// tokenizeCardForImport tokenizes a card during import process. With claim
+// the card is claimed first, and when another request has claimed it the
+// token it stored the card under is returned with existing set.
+func (ut *UnifiedTokenizer) tokenizeCardForImport(card CardImportRecord, tenant, owner string, tags map[string]string, tx *sql.Tx, claim bool) (string, string, bool, error) {
+    // Clean card number
+    cleanCard := normalizeCardNumber(card.CardNumber)
+    
+    // Detect card type
+    cardType := utils.DetectCardType(cleanCard)
+    
+    // Encrypt card number
+    encryptedCard, err := ut.encryptCardNumber(cleanCard)
+    if err != nil {
+        return "", "", false, fmt.Errorf("failed to encrypt card: %v", err)
+    }
+    cardIndex, err := ut.blindIndex(blindIndexCardNumber, cleanCard)
+    if err != nil {
+        return "", "", false, fmt.Errorf("failed to index card: %v", err)
+    }
+    
+    // Encrypt card holder name if provided, with a blind index for search
+    var encryptedHolder, holderIndex []byte
+    if card.CardHolder != "" {
+        encryptedHolder, err = ut.encryptCardNumber(card.CardHolder)
+        if err != nil {
+            return "", "", false, fmt.Errorf("failed to encrypt card holder: %v", err)
+        }
+        holderIndex, err = ut.blindIndex(blindIndexHolderName, normalizeHolderName(card.CardHolder))
+        if err != nil {
+            return "", "", false, fmt.Errorf("failed to index card holder: %v", err)
+        }
+    }
+    
+    // The external ID and metadata are encrypted the same way
+    var encryptedExternalID, externalIDIndex, encryptedMetadata []byte
+    if externalID := normalizeExternalID(card.ExternalID); externalID != "" {
+        encryptedExternalID, err = ut.encryptCardNumber(externalID)
+        if err != nil {
+            return "", "", false, fmt.Errorf("failed to encrypt external ID: %v", err)
+        }
+        externalIDIndex, err = ut.blindIndex(blindIndexExternalID, externalID)
+        if err != nil {
+            return "", "", false, fmt.Errorf("failed to index external ID: %v", err)
+        }
+    }
+    if card.Metadata != "" {
+        encryptedMetadata, err = ut.encryptCardNumber(card.Metadata)
+        if err != nil {
+            return "", "", false, fmt.Errorf("failed to encrypt metadata: %v", err)
+        }
+    }
+    
+    // Get first 6 and last 4 digits
+    firstSix := cleanCard[:6]
+    lastFour := cleanCard[len(cleanCard)-4:]
+    
+    // Get encryption key ID if using KEK/DEK
+    var keyID *string
+    if ut.useKEKDEK && ut.keyManager != nil {
+        if currentKeyID := ut.keyManager.getCurrentDEKID(); currentKeyID != "" {
+            keyID = &currentKeyID
+        }
+    }
+    
+    // Insert into database using transaction. A token collision is retried
+    // with a new token rather than overwriting the card that holds it.
+    store := func(token string) error {
+        _, err := tx.Exec(`
+            INSERT INTO credit_cards (
+                token, card_number_encrypted, card_number_index, card_holder_name_encrypted, card_holder_name_index,
+                expiry_month, expiry_year, external_id_encrypted, external_id_index, tenant, card_type, last_four_digits, first_six_digits,
+                encryption_key_id, created_at, is_active, source, metadata_encrypted, region, created_by
+            ) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, NULLIF(?, ''), ?, ?, ?, ?, NOW(), TRUE, 'import', ?, NULLIF(?, ''), NULLIF(?, ''))
+        `, token, encryptedCard, cardIndex, encryptedHolder, holderIndex, card.ExpiryMonth, card.ExpiryYear, 
+           encryptedExternalID, externalIDIndex, tenant, cardType, lastFour, firstSix, keyID, encryptedMetadata, ut.region, owner)
+        return err
+    }
+    var token string
+    var existing bool
+    if claim {
+        token, existing, err = ut.storeClaimedCard(cardIndex, store)
+    } else {
+        token, err = ut.withUniqueToken(store)
+    }
+    if err != nil {
+        return "", "", false, fmt.Errorf("failed to store card: %v", err)
+    }
+    if existing {
+        return token, cardType, true, nil
+    }
+    if err := setTokenTags(tx, []interface{}{token}, tagUpdates(tags)); err != nil {
+        if claim {
+            ut.releaseCardClaims([]interface{}{token})
+        }
+        return "", "", false, fmt.Errorf("failed to tag card: %v", err)
+    }
+    
+    return token, cardType, false, nil
+}
+
+func (ut *UnifiedTokenizer) handleGetUser(w http.ResponseWriter, r *http.Request) {
+    username := strings.TrimPrefix(r.URL.Path, "/api/v1/users/")
+    
+    var user User
+    var permissionsJSON []byte
+    var lastLoginAt sql.NullTime
+    
+    err := ut.db.QueryRow(`
+        SELECT user_id, username, email, is_email_verified, full_name, role, permissions,
+               is_active, created_at, last_login_at
+        FROM users
+        WHERE (username = ? OR user_id = ?) AND account_type = 'human'
+    `, username, username).Scan(
+        &user.UserID, &user.Username, &user.Email, &user.EmailVerified, &user.FullName,
+        &user.Role, &permissionsJSON, &user.IsActive, &user.CreatedAt, &lastLoginAt,
+    )
+    
+    if err == sql.ErrNoRows {
+        apierror.Write(w, r, http.StatusNotFound, apierror.UserNotFound, "User not found")
+        return
+    } else if err != nil {
+        apierror.Write(w, r, http.StatusInternalServerError, apierror.InternalError, "Database error")
+        return
+    }
+    
+    json.Unmarshal(permissionsJSON, &user.Permissions)
+    if lastLoginAt.Valid {
+        user.LastLoginAt = &lastLoginAt.Time
+    }
+    
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(user)
+}
+
+// userUpdateColumns are the users fields that may be changed through the API
+var userUpdateColumns = sqlbuild.Columns{
+    "email":       "email",
+    "is_email_verified": "is_email_verified",
+    "full_name":   "full_name",
+    "role":        "role",
+    "permissions": "permissions",
+    "is_active":   "is_active",
+}
+
+// UpdateUserRequest is the body of PUT /api/v1/users/{username}; omitted
+// fields are left unchanged
+type UpdateUserRequest struct {
+    Email       *string   `json:"email"`
+    FullName    *string   `json:"full_name"`
+    Role        *string   `json:"role"`
+    Permissions *[]string `json:"permissions"`
+    IsActive    *bool     `json:"is_active"`
+}
+
+func (ut *UnifiedTokenizer) handleUpdateUser(w http.ResponseWriter, r *http.Request) {
+    username := strings.TrimPrefix(r.URL.Path, "/api/v1/users/")
+    
+    var req UpdateUserRequest
+    
+    if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+        apierror.Write(w, r, http.StatusBadRequest, apierror.InvalidBody, "Invalid request body")
+        return
+    }
+    
+    var userID, currentEmail string
+    var current User
+    var permissionsJSON []byte
+    err := ut.db.QueryRow("SELECT user_id, email, role, permissions FROM users WHERE (username = ? OR user_id = ?) AND account_type = 'human'", username, username).Scan(&userID, &currentEmail, &current.Role, &permissionsJSON)
+    if err == sql.ErrNoRows {
+        apierror.Write(w, r, http.StatusNotFound, apierror.UserNotFound, "User not found")
+        return
+    } else if err != nil {
+        apierror.Write(w, r, http.StatusInternalServerError, apierror.InternalError, "Database error")
+        return
+    }
+    
+    if req.Role != nil {
+        if ok, err := ut.roleExists(*req.Role); err != nil {
+            apierror.Write(w, r, http.StatusInternalServerError, apierror.InternalError, "Database error")
+            return
+        } else if !ok {
+            apierror.Write(w, r, http.StatusBadRequest, apierror.InvalidRequest, "Unknown role "+*req.Role)
+            return
+        }
+    }
+    if req.Permissions != nil {
+        if err := validPermissions(*req.Permissions); err != nil {
+            apierror.Write(w, r, http.StatusBadRequest, apierror.InvalidRequest, err.Error())
+            return
+        }
+    }
+    
+    // Don't allow locking out or demoting the default admin
+    if userID == "usr_admin_default" && ((req.IsActive != nil && !*req.IsActive) || (req.Role != nil && *req.Role != RoleAdmin)) {
+        apierror.Write(w, r, http.StatusForbidden, apierror.PermissionDenied, "Cannot disable or demote default admin user")
+        return
+    }
+    
+    // A role change without explicit permissions drops those granted
+    // beyond the old role, so a demoted user keeps nothing of it
+    if req.Role != nil && req.Permissions == nil {
+        req.Permissions = &[]string{}
+    }
+    
+    // The caller must hold everything the user has, and will have
+    json.Unmarshal(permissionsJSON, &current.Permissions)
+    updated := current
+    if req.Role != nil {
+        updated.Role = *req.Role
+    }
+    if req.Permissions != nil {
+        updated.Permissions = *req.Permissions
+    }
+    if !ut.canManageUser(r, &current) || !ut.canManageUser(r, &updated) {
+        apierror.Write(w, r, http.StatusForbidden, apierror.PermissionDenied, "Cannot change a user with permissions you do not have")
+        return
+    }
+    
+    // Build update query from the fields present
+    update := userUpdateColumns.Update()
+    if req.Email != nil {
+        update.Set("email", *req.Email)
+        // The new address is unverified until its owner follows the link
+        // mailed to it
+        if !strings.EqualFold(*req.Email, currentEmail) {
+            update.Set("is_email_verified", false)
+        }
+    }
+    if req.FullName != nil {
+        update.Set("full_name", *req.FullName)
+    }
+    if req.Role != nil {
+        update.Set("role", *req.Role)
+    }
+    if req.Permissions != nil {
+        permissionsJSON, _ := json.Marshal(*req.Permissions)
+        update.Set("permissions", permissionsJSON)
+    }
+    if req.IsActive != nil {
+        update.Set("is_active", *req.IsActive)
+        // An account enabled again starts a new period of inactivity
+        if *req.IsActive {
+            if _, err := ut.db.Exec(`
+                UPDATE users SET reactivated_at = NOW(), inactivity_warned_at = NULL, inactive_disabled_at = NULL
+                WHERE user_id = ? AND is_active = FALSE`, userID); err != nil {
+                log.Printf("Failed to restart inactivity of %s: %v", userID, err)
+            }
+        }
+    }
+    
+    if update.Len() == 0 {
+        apierror.Write(w, r, http.StatusBadRequest, apierror.InvalidRequest, "No fields to update")
+        return
+    }
+    
+    setClause, params, err := update.SetClause()
+    if err == nil {
+        _, err = ut.db.Exec("UPDATE users SET "+setClause+", updated_at = NOW() WHERE user_id = ?", append(params, userID)...)
+    }
+    if err != nil {
+        apierror.Write(w, r, http.StatusInternalServerError, apierror.InternalError, "Failed to update user")
+        return
+    }
+    
+    // Disabled users and changed privileges take effect immediately
+    if (req.IsActive != nil && !*req.IsActive) || req.Role != nil || req.Permissions != nil {
+        if err := ut.invalidateUserSessions(userID, "user_updated"); err != nil {
+            log.Printf("Failed to invalidate sessions after user update: %v", err)
+        }
+    }
+    
+    changes := map[string]interface{}{}
+    if req.Email != nil {
+        changes["email"] = *req.Email
+    }
+    if req.FullName != nil {
+        changes["full_name"] = *req.FullName
+    }
+    if req.Role != nil {
+        changes["role"] = *req.Role
+    }
+    if req.Permissions != nil {
+        changes["permissions"] = *req.Permissions
+    }
+    if req.IsActive != nil {
+        changes["is_active"] = *req.IsActive
+    }
+    ipAddress, userAgent := ut.getClientInfo(r)
+    ut.logAuditEvent(AuditEvent{
+        UserID:       r.Header.Get("X-User-ID"),
+        Action:       "user_updated",
+        ResourceType: "user",
+        ResourceID:   userID,
+        IPAddress:    ipAddress,
+        UserAgent:    userAgent,
+        Details:      changes,
+    })
+    
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(map[string]string{"message": "User updated successfully"})
+}
+
+// handleResetUserPassword replaces a user's password with a generated temporary
+// one. password_changed_at is cleared so the user must change it at next login,
+// and all of the user's sessions are invalidated.
+func (ut *UnifiedTokenizer) handleResetUserPassword(w http.ResponseWriter, r *http.Request) {
+    // Permission check is handled by requirePermission middleware
+
+    username := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/api/v1/users/"), "/reset-password")
+
+    var userID, resolvedUsername string
+    var user User
+    var permissionsJSON []byte
+    err := ut.db.QueryRow("SELECT user_id, username, role, permissions FROM users WHERE (username = ? OR user_id = ?) AND account_type = 'human'", username, username).Scan(&userID, &resolvedUsername, &user.Role, &permissionsJSON)
+    if err == sql.ErrNoRows {
+        apierror.Write(w, r, http.StatusNotFound, apierror.UserNotFound, "User not found")
+        return
+    } else if err != nil {
+        apierror.Write(w, r, http.StatusInternalServerError, apierror.InternalError, "Database error")
+        return
+    }
+    // The temporary password gives the caller the account, so it must not
+    // have permissions the caller lacks
+    json.Unmarshal(permissionsJSON, &user.Permissions)
+    if !ut.canManageUser(r, &user) {
+        apierror.Write(w, r, http.StatusForbidden, apierror.PermissionDenied, "Cannot reset the password of a user with permissions you do not have")
+        return
+    }
+
+    tempPassword := generateSecurePassword(16)
+    passwordHash, err := bcrypt.GenerateFromPassword([]byte(tempPassword), bcrypt.DefaultCost)
+    if err != nil {
+        apierror.Write(w, r, http.StatusInternalServerError, apierror.InternalError, "Failed to hash password")
+        return
+    }
+
+    _, err = ut.db.Exec(`
+        UPDATE users
+        SET password_hash = ?, password_changed_at = NULL,
+            failed_login_attempts = 0, locked_until = NULL, updated_at = NOW()
+        WHERE user_id = ?
+    `, string(passwordHash), userID)
+    if err != nil {
+        apierror.Write(w, r, http.StatusInternalServerError, apierror.InternalError, "Failed to reset password")
+        return
+    }
+
+    if err := ut.invalidateUserSessions(userID, "password_reset"); err != nil {
+        log.Printf("Failed to invalidate sessions after password reset: %v", err)
+    }
+
+    ipAddress, userAgent := ut.getClientInfo(r)
+    ut.logAuditEvent(AuditEvent{
+        UserID:       r.Header.Get("X-User-ID"),
+        Action:       "password_reset",
+        ResourceType: "user",
+        ResourceID:   userID,
+        IPAddress:    ipAddress,
+        UserAgent:    userAgent,
+        Details: map[string]interface{}{
+            "username": resolvedUsername,
+        },
+    })
+
+    ut.logSecurityEvent(SecurityEvent{
+        EventType: "password_reset",
+        Severity:  "medium",
+        UserID:    userID,
+        Username:  resolvedUsername,
+        IPAddress: ipAddress,
+        UserAgent: userAgent,
+        Endpoint:  r.URL.Path,
+        Details: map[string]interface{}{
+            "initiated_by": r.Header.Get("X-Username"),
+        },
+    })
+
+    w.Header().Set("Cache-Control", "no-store")
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(map[string]interface{}{
+        "username":                resolvedUsername,
+        "temporary_password":      tempPassword,
+        "require_password_change": true,
+    })
+}
+
+// PermissionInfo describes a permission for GET /api/v1/permissions
+type PermissionInfo struct {
+    Name        string `json:"name"`
+    Description string `json:"description"`
+}
+
+// permissionCatalog is every permission a role or user can be granted
+var permissionCatalog = []PermissionInfo{
+    {PermTokensRead, "List tokens and see their masked details"},
+    {PermTokensWrite, "Create tokens and change their tags"},
+    {PermTokensDelete, "Revoke and restore tokens"},
+    {PermTokensDetokenize, "Reveal full card numbers"},
+    {PermTokensReadPII, "See and search cardholder names"},
+    {PermAPIKeysRead, "List API keys and client certificate identities"},
+    {PermAPIKeysWrite, "Create API keys and client certificate identities"},
+    {PermAPIKeysDelete, "Revoke API keys and client certificate identities"},
+    {PermAPIKeysOwn, "Create, list and revoke one's own API keys"},
+    {PermTokensOwn, "List, search, read and revoke the tokens imported for oneself"},
+    {PermUsersRead, "List users and roles"},
+    {PermUsersWrite, "Create and change users"},
+    {PermUsersDelete, "Delete users"},
+    {PermActivityRead, "See the activity feed"},
+    {PermStatsRead, "See statistics"},
+    {PermSystemAdmin, "Everything, including keys, roles and service configuration"},
+}
+
+// validPermissions checks that every permission is in permissionCatalog
+func validPermissions(permissions []string) error {
+    for _, p := range permissions {
+        known := false
+        for _, info := range permissionCatalog {
+            known = known || info.Name == p
+        }
+        if !known {
+            return fmt.Errorf("unknown permission %q", p)
+        }
+    }
+    return nil
+}
+
+// roleNamePattern is what custom role names look like
+var roleNamePattern = regexp.MustCompile(`^[a-z][a-z0-9_-]{1,31}$`)
+
+// Role is a named set of permissions users are given. The built-in admin,
+// operator and viewer roles cannot be deleted, and admin's permissions
+// cannot be changed.
+type Role struct {
+    Name        string    `json:"name"`
+    Description string    `json:"description"`
+    Permissions []string  `json:"permissions"`
+    BuiltIn     bool      `json:"built_in"`
+    InactiveUserDays *int `json:"inactive_user_days"` // Days without a login before a user is disabled; null follows INACTIVE_USER_DAYS, 0 never
+    StaleAPIKeyDays  *int `json:"stale_api_key_days"` // Days unused before a key of the role's users is deactivated; null follows STALE_API_KEY_DAYS, 0 never
+    Users       int       `json:"users"` // Users with the role
+    CreatedBy   string    `json:"created_by,omitempty"`
+    CreatedAt   time.Time `json:"created_at"`
+    UpdatedAt   time.Time `json:"updated_at"`
+}
+
+// roleRefreshInterval is how soon role changes made through the API on one
+// replica take effect on the others
+const roleRefreshInterval = 30 * time.Second
+
+// loadRoles reads the roles table, with the number of users of each role
+func (ut *UnifiedTokenizer) loadRoles() ([]Role, error) {
+    rows, err := ut.db.Query(`
+        SELECT r.name, r.description, r.permissions, r.built_in, r.inactive_user_days, r.stale_api_key_days,
+               r.created_by, r.created_at, r.updated_at,
+               (SELECT COUNT(*) FROM users u WHERE u.role = r.name)
+        FROM roles r ORDER BY r.built_in DESC, r.name`)
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+    roles := []Role{}
+    for rows.Next() {
+        var role Role
+        var permissionsJSON []byte
+        var createdBy sql.NullString
+        var userDays, keyDays sql.NullInt64
+        if err := rows.Scan(&role.Name, &role.Description, &permissionsJSON, &role.BuiltIn, &userDays, &keyDays, &createdBy,
+            &role.CreatedAt, &role.UpdatedAt, &role.Users); err != nil {
+            return nil, err
+        }
+        if userDays.Valid {
+            days := int(userDays.Int64)
+            role.InactiveUserDays = &days
+        }
+        if keyDays.Valid {
+            days := int(keyDays.Int64)
+            role.StaleAPIKeyDays = &days
+        }
+        if err := json.Unmarshal(permissionsJSON, &role.Permissions); err != nil {
+            return nil, fmt.Errorf("permissions of role %s: %v", role.Name, err)
+        }
+        role.CreatedBy = createdBy.String
+        roles = append(roles, role)
+    }
+    return roles, rows.Err()
+}
+
+// refreshRoles loads the permissions of each role for hasPermission
+func (ut *UnifiedTokenizer) refreshRoles() error {
+    roles, err := ut.loadRoles()
+    if err != nil {
+        return err
+    }
+    permissions := make(map[string][]string, len(roles))
+    for _, role := range roles {
+        permissions[role.Name] = role.Permissions
+    }
+    ut.rolePermissions.Store(&permissions)
+    return nil
+}
+
+// startRoleRefresher picks up role changes made on other replicas
+func (ut *UnifiedTokenizer) startRoleRefresher() {
+    for {
+        time.Sleep(roleRefreshInterval)
+        if err := ut.refreshRoles(); err != nil {
+            log.Printf("Failed to load roles, keeping the current ones: %v", err)
+        }
+    }
+}
+
+// roleExists reports whether users can be given role
+func (ut *UnifiedTokenizer) roleExists(role string) (bool, error) {
+    var n int
+    err := ut.db.QueryRow("SELECT COUNT(*) FROM roles WHERE name = ?", role).Scan(&n)
+    return n > 0, err
+}
+
+// RoleRequest is the body of POST /api/v1/roles and PUT
+// /api/v1/roles/{name}; on PUT, omitted fields are left unchanged and the
+// name cannot be changed
+type RoleRequest struct {
+    Name        string    `json:"name,omitempty"`
+    Description *string   `json:"description"`
+    Permissions *[]string `json:"permissions"`
+    InactiveUserDays *int `json:"inactive_user_days"` // -1 follows INACTIVE_USER_DAYS again
+    StaleAPIKeyDays  *int `json:"stale_api_key_days"` // -1 follows STALE_API_KEY_DAYS again
+}
+
+// roleDays is how an inactivity policy in a RoleRequest is stored: nil and
+// -1 follow the server's setting
+func roleDays(days *int) sql.NullInt64 {
+    if days == nil || *days < 0 {
+        return sql.NullInt64{}
+    }
+    return sql.NullInt64{Int64: int64(*days), Valid: true}
+}
+
+func (ut *UnifiedTokenizer) handleListRoles(w http.ResponseWriter, r *http.Request) {
+    roles, err := ut.loadRoles()
+    if err != nil {
+        apierror.Write(w, r, http.StatusInternalServerError, apierror.InternalError, "Database error")
+        return
+    }
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(map[string]interface{}{"roles": roles, "total": len(roles)})
+}
+
+func (ut *UnifiedTokenizer) handleListPermissions(w http.ResponseWriter, r *http.Request) {
+    if r.Method != "GET" {
+        apierror.Write(w, r, http.StatusMethodNotAllowed, apierror.MethodNotAllowed, "Method not allowed")
+        return
+    }
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(map[string]interface{}{"permissions": permissionCatalog})
+}
+
+// findRole returns the role named name, or nil
+func (ut *UnifiedTokenizer) findRole(name string) (*Role, error) {
+    roles, err := ut.loadRoles()
+    if err != nil {
+        return nil, err
+    }
+    for i := range roles {
+        if roles[i].Name == name {
+            return &roles[i], nil
+        }
+    }
+    return nil, nil
+}
+
+func (ut *UnifiedTokenizer) handleGetRole(w http.ResponseWriter, r *http.Request) {
+    role, err := ut.findRole(strings.TrimPrefix(r.URL.Path, "/api/v1/roles/"))
+    if err != nil {
+        apierror.Write(w, r, http.StatusInternalServerError, apierror.InternalError, "Database error")
+        return
+    }
+    if role == nil {
+        apierror.Write(w, r, http.StatusNotFound, apierror.RoleNotFound, "Role not found")
+        return
+    }
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(role)
+}
+
+func (ut *UnifiedTokenizer) handleCreateRole(w http.ResponseWriter, r *http.Request) {
+    var req RoleRequest
+    if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+        apierror.Write(w, r, http.StatusBadRequest, apierror.InvalidBody, "Invalid request body")
+        return
+    }
+    if !roleNamePattern.MatchString(req.Name) {
+        apierror.Write(w, r, http.StatusBadRequest, apierror.InvalidRequest, "Role name must be 2 to 32 lowercase letters, digits, - or _, starting with a letter")
+        return
+    }
+    if req.Permissions == nil || len(*req.Permissions) == 0 {
+        apierror.Write(w, r, http.StatusBadRequest, apierror.InvalidRequest, "A role needs at least one permission")
+        return
+    }
+    if err := validPermissions(*req.Permissions); err != nil {
+        apierror.Write(w, r, http.StatusBadRequest, apierror.InvalidRequest, err.Error())
+        return
+    }
+    description := ""
+    if req.Description != nil {
+        description = *req.Description
+    }
+    permissionsJSON, _ := json.Marshal(*req.Permissions)
+    _, err := ut.db.Exec(`
+        INSERT INTO roles (name, description, permissions, built_in, inactive_user_days, stale_api_key_days, created_by)
+        VALUES (?, ?, ?, FALSE, ?, ?, ?)`,
+        req.Name, description, permissionsJSON, roleDays(req.InactiveUserDays), roleDays(req.StaleAPIKeyDays), r.Header.Get("X-User-ID"))
+    if isDuplicateKey(err) {
+        apierror.Write(w, r, http.StatusConflict, apierror.AlreadyExists, "A role with that name exists")
+        return
+    } else if err != nil {
+        apierror.Write(w, r, http.StatusInternalServerError, apierror.InternalError, "Failed to create role")
+        return
+    }
+    if err := ut.refreshRoles(); err != nil {
+        log.Printf("Failed to reload roles: %v", err)
+    }
+
+    ipAddress, userAgent := ut.getClientInfo(r)
+    ut.logAuditEvent(AuditEvent{
+        UserID:       r.Header.Get("X-User-ID"),
+        Action:       "role_created",
+        ResourceType: "role",
+        ResourceID:   req.Name,
+        IPAddress:    ipAddress,
+        UserAgent:    userAgent,
+        Details: map[string]interface{}{
+            "permissions": *req.Permissions,
+        },
+    })
+
+    role, err := ut.findRole(req.Name)
+    if err != nil || role == nil {
+        apierror.Write(w, r, http.StatusInternalServerError, apierror.InternalError, "Database error")
+        return
+    }
+    w.Header().Set("Content-Type", "application/json")
+    w.WriteHeader(http.StatusCreated)
+    json.NewEncoder(w).Encode(role)
+}
+
+func (ut *UnifiedTokenizer) handleUpdateRole(w http.ResponseWriter, r *http.Request) {
+    name := strings.TrimPrefix(r.URL.Path, "/api/v1/roles/")
+    var req RoleRequest
+    if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+        apierror.Write(w, r, http.StatusBadRequest, apierror.InvalidBody, "Invalid request body")
+        return
+    }
+    role, err := ut.findRole(name)
+    if err != nil {
+        apierror.Write(w, r, http.StatusInternalServerError, apierror.InternalError, "Database error")
+        return
+    }
+    if role == nil {
+        apierror.Write(w, r, http.StatusNotFound, apierror.RoleNotFound, "Role not found")
+        return
+    }
+    // Changing admin could leave nobody able to undo it; only its
+    // inactivity policy can be set
+    if role.Name == RoleAdmin && (req.Description != nil || req.Permissions != nil) {
+        apierror.Write(w, r, http.StatusForbidden, apierror.PermissionDenied, "The admin role cannot be changed")
+        return
+    }
+    if req.Name != "" && req.Name != role.Name {
+        apierror.Write(w, r, http.StatusBadRequest, apierror.InvalidRequest, "Roles cannot be renamed")
+        return
+    }
+    if req.Description == nil && req.Permissions == nil && req.InactiveUserDays == nil && req.StaleAPIKeyDays == nil {
+        apierror.Write(w, r, http.StatusBadRequest, apierror.InvalidRequest, "No fields to update")
+        return
+    }
+    if req.Permissions != nil {
+        if len(*req.Permissions) == 0 {
+            apierror.Write(w, r, http.StatusBadRequest, apierror.InvalidRequest, "A role needs at least one permission")
+            return
+        }
+        if err := validPermissions(*req.Permissions); err != nil {
+            apierror.Write(w, r, http.StatusBadRequest, apierror.InvalidRequest, err.Error())
+            return
+        }
+    }
+
+    changes := map[string]interface{}{}
+    if req.Description != nil {
+        role.Description = *req.Description
+        changes["description"] = *req.Description
+    }
+    if req.Permissions != nil {
+        changes["old_permissions"] = role.Permissions
+        changes["permissions"] = *req.Permissions
+        role.Permissions = *req.Permissions
+    }
+    userDays, keyDays := roleDays(role.InactiveUserDays), roleDays(role.StaleAPIKeyDays)
+    if req.InactiveUserDays != nil {
+        userDays = roleDays(req.InactiveUserDays)
+        role.InactiveUserDays = nil
+        if userDays.Valid {
+            role.InactiveUserDays = req.InactiveUserDays
+        }
+        changes["inactive_user_days"] = *req.InactiveUserDays
+    }
+    if req.StaleAPIKeyDays != nil {
+        keyDays = roleDays(req.StaleAPIKeyDays)
+        role.StaleAPIKeyDays = nil
+        if keyDays.Valid {
+            role.StaleAPIKeyDays = req.StaleAPIKeyDays
+        }
+        changes["stale_api_key_days"] = *req.StaleAPIKeyDays
+    }
+    permissionsJSON, _ := json.Marshal(role.Permissions)
+    if _, err := ut.db.Exec("UPDATE roles SET description = ?, permissions = ?, inactive_user_days = ?, stale_api_key_days = ? WHERE name = ?",
+        role.Description, permissionsJSON, userDays, keyDays, role.Name); err != nil {
+        apierror.Write(w, r, http.StatusInternalServerError, apierror.InternalError, "Failed to update role")
+        return
+    }
+    if err := ut.refreshRoles(); err != nil {
+        log.Printf("Failed to reload roles: %v", err)
+    }
+
+    ipAddress, userAgent := ut.getClientInfo(r)
+    ut.logAuditEvent(AuditEvent{
+        UserID:       r.Header.Get("X-User-ID"),
+        Action:       "role_updated",
+        ResourceType: "role",
+        ResourceID:   role.Name,
+        IPAddress:    ipAddress,
+        UserAgent:    userAgent,
+        Details:      changes,
+    })
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(role)
+}
+
+func (ut *UnifiedTokenizer) handleDeleteRole(w http.ResponseWriter, r *http.Request) {
+    role, err := ut.findRole(strings.TrimPrefix(r.URL.Path, "/api/v1/roles/"))
+    if err != nil {
+        apierror.Write(w, r, http.StatusInternalServerError, apierror.InternalError, "Database error")
+        return
+    }
+    if role == nil {
+        apierror.Write(w, r, http.StatusNotFound, apierror.RoleNotFound, "Role not found")
+        return
+    }
+    if role.BuiltIn {
+        apierror.Write(w, r, http.StatusForbidden, apierror.PermissionDenied, "Built-in roles cannot be deleted")
+        return
+    }
+    if role.Users > 0 {
+        apierror.WriteDetails(w, r, http.StatusConflict, apierror.Conflict, "Role is given to users; move them to another role first",
+            map[string]interface{}{"users": role.Users})
+        return
+    }
+    // The foreign key from users refuses the delete if a user was given
+    // the role since it was counted
+    if _, err := ut.db.Exec("DELETE FROM roles WHERE name = ? AND built_in = FALSE", role.Name); err != nil {
+        apierror.Write(w, r, http.StatusConflict, apierror.Conflict, "Role is given to users; move them to another role first")
+        return
+    }
+    if err := ut.refreshRoles(); err != nil {
+        log.Printf("Failed to reload roles: %v", err)
+    }
+
+    ipAddress, userAgent := ut.getClientInfo(r)
+    ut.logAuditEvent(AuditEvent{
+        UserID:       r.Header.Get("X-User-ID"),
+        Action:       "role_deleted",
+        ResourceType: "role",
+        ResourceID:   role.Name,
+        IPAddress:    ipAddress,
+        UserAgent:    userAgent,
+        Details: map[string]interface{}{
+            "permissions": role.Permissions,
+        },
+    })
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(map[string]string{"message": "Role deleted successfully"})
+}
+
+func (ut *UnifiedTokenizer) handleDeleteUser(w http.ResponseWriter, r *http.Request) {
+    username := strings.TrimPrefix(r.URL.Path, "/api/v1/users/")
+    
+    // Don't allow deleting the default admin
+    if username == "admin" || username == "usr_admin_default" {
+        apierror.Write(w, r, http.StatusForbidden, apierror.PermissionDenied, "Cannot delete default admin user")
+        return
+    }
+    
+    // Check if user exists
+    var userID string
+    err := ut.db.QueryRow("SELECT user_id FROM users WHERE (username = ? OR user_id = ?) AND account_type = 'human'", username, username).Scan(&userID)
+    if err == sql.ErrNoRows {
+        apierror.Write(w, r, http.StatusNotFound, apierror.UserNotFound, "User not found")
+        return
+    }
+    
+    // Delete user (cascades to sessions and api_keys)
+    _, err = ut.db.Exec("DELETE FROM users WHERE user_id = ?", userID)
+    if err != nil {
+        apierror.Write(w, r, http.StatusInternalServerError, apierror.InternalError, "Failed to delete user")
+        return
+    }
+    
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(map[string]string{"message": "User deleted successfully"})
+}
+
+// Service accounts are users with account_type 'service': machine
+// identities for integrations. They have a role and permissions like any
+// user, but cannot log in, and authenticate only with API keys that expire
+// at most SERVICE_ACCOUNT_KEY_DAYS after they are issued.
+
+// ServiceAccount is a service account as the API returns it
+type ServiceAccount struct {
+    UserID      string              `json:"user_id"`
+    Name        string              `json:"name"`
+    Description string              `json:"description,omitempty"`
+    Role        string              `json:"role"`
+    Permissions []string            `json:"permissions"`
+    IsActive    bool                `json:"is_active"`
+    CreatedAt   time.Time           `json:"created_at"`
+    Keys        []ServiceAccountKey `json:"keys"`
+}
+
+// ServiceAccountKey is an API key of a service account
+type ServiceAccountKey struct {
+    APIKey        string     `json:"api_key"`
+    ClientName    string     `json:"client_name"`
+    IsActive      bool       `json:"is_active"`
+    Signed        bool       `json:"signed"`
+    Expired       bool       `json:"expired"`
+    CreatedAt     time.Time  `json:"created_at"`
+    ExpiresAt     time.Time  `json:"expires_at"`
+    LastUsedAt    *time.Time `json:"last_used_at,omitempty"`
+    SigningSecret string     `json:"signing_secret,omitempty"` // Only when the key is issued
+}
+
+// CreateServiceAccountRequest is the body of POST /api/v1/service-accounts
+type CreateServiceAccountRequest struct {
+    Name        string   `json:"name"`
+    Description string   `json:"description"`
+    Role        string   `json:"role"`
+    Permissions []string `json:"permissions"`
+}
+
+// ServiceAccountKeyRequest is the body of POST
+// /api/v1/service-accounts/{name}/keys
+type ServiceAccountKeyRequest struct {
+    ClientName    string `json:"client_name"`     // The account name when empty
+    ExpiresInDays int    `json:"expires_in_days"` // SERVICE_ACCOUNT_KEY_DAYS, also the longest allowed, when 0
+    Signed        bool   `json:"signed"`
+}
+
+// RotateServiceAccountKeyRequest is the body of POST
+// /api/v1/service-accounts/{name}/keys/{api_key}/rotate
+type RotateServiceAccountKeyRequest struct {
+    OverlapHours *int `json:"overlap_hours"` // How long the old key keeps working; 24 when omitted
+}
+
+// RotatedServiceAccountKey is the new key of a rotation, with when the one
+// it replaces stops working
+type RotatedServiceAccountKey struct {
+    ServiceAccountKey
+    Replaces          string    `json:"replaces"`
+    ReplacedExpiresAt time.Time `json:"replaced_expires_at"`
+}
+
+// serviceAccountEmail is the address a service account is stored with, as
+// users.email is required. Nothing is ever mailed to the .invalid domain.
+func serviceAccountEmail(name string) string {
+    return name + "@service-accounts.invalid"
+}
+
+// serviceAccountPath splits a path under /api/v1/service-accounts/ into
+// the account name and, for the key routes, the key and action: "" for
+// {name}, "keys" for {name}/keys and "rotate" for
+// {name}/keys/{api_key}/rotate. ok is false for any other path.
+func serviceAccountPath(path string) (name, apiKey, action string, ok bool) {
+    parts := strings.Split(strings.TrimPrefix(path, "/api/v1/service-accounts/"), "/")
+    if parts[0] == "" {
+        return "", "", "", false
+    }
+    switch {
+    case len(parts) == 1:
+        return parts[0], "", "", true
+    case len(parts) == 2 && parts[1] == "keys":
+        return parts[0], "", "keys", true
+    case len(parts) == 4 && parts[1] == "keys" && parts[2] != "" && parts[3] == "rotate":
+        return parts[0], parts[2], "rotate", true
+    }
+    return "", "", "", false
+}
+
+// serviceAccountColumns are the users columns scanServiceAccount reads
+const serviceAccountColumns = "user_id, username, description, role, permissions, is_active, created_at"
+
+func scanServiceAccount(row interface{ Scan(...interface{}) error }) (*ServiceAccount, error) {
+    var account ServiceAccount
+    var description sql.NullString
+    var permissionsJSON []byte
+    if err := row.Scan(&account.UserID, &account.Name, &description, &account.Role, &permissionsJSON, &account.IsActive, &account.CreatedAt); err != nil {
+        return nil, err
+    }
+    account.Description = description.String
+    json.Unmarshal(permissionsJSON, &account.Permissions)
+    if account.Permissions == nil {
+        account.Permissions = []string{}
+    }
+    account.Keys = []ServiceAccountKey{}
+    return &account, nil
+}
+
+// serviceAccount returns the service account with that name or user ID,
+// with its keys, or nil if there is none
+func (ut *UnifiedTokenizer) serviceAccount(name string) (*ServiceAccount, error) {
+    account, err := scanServiceAccount(ut.db.QueryRow(`
+        SELECT `+serviceAccountColumns+` FROM users
+        WHERE (username = ? OR user_id = ?) AND account_type = 'service'`, name, name))
+    if err == sql.ErrNoRows {
+        return nil, nil
+    } else if err != nil {
+        return nil, err
+    }
+    keys, err := ut.serviceAccountKeys(account.UserID)
+    if err != nil {
+        return nil, err
+    }
+    account.Keys = append(account.Keys, keys[account.UserID]...)
+    return account, nil
+}
+
+// serviceAccountKeys returns the API keys of the service account userID,
+// or of every service account when userID is empty, by account
+func (ut *UnifiedTokenizer) serviceAccountKeys(userID string) (map[string][]ServiceAccountKey, error) {
+    rows, err := ut.db.Query(`
+        SELECT k.user_id, k.api_key, k.client_name, k.is_active, k.signing_secret_encrypted IS NOT NULL,
+               k.expires_at <= NOW(), k.created_at, k.expires_at, k.last_used_at
+        FROM api_keys k JOIN users u ON u.user_id = k.user_id
+        WHERE u.account_type = 'service' AND (? = '' OR k.user_id = ?)
+        ORDER BY k.created_at DESC`, userID, userID)
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+
+    keys := make(map[string][]ServiceAccountKey)
+    for rows.Next() {
+        var owner string
+        var key ServiceAccountKey
+        var expired sql.NullBool
+        var expiresAt, lastUsedAt sql.NullTime
+        if err := rows.Scan(&owner, &key.APIKey, &key.ClientName, &key.IsActive, &key.Signed,
+            &expired, &key.CreatedAt, &expiresAt, &lastUsedAt); err != nil {
+            return nil, err
+        }
+        key.Expired = expired.Bool
+        key.ExpiresAt = expiresAt.Time
+        if lastUsedAt.Valid {
+            key.LastUsedAt = &lastUsedAt.Time
+        }
+        keys[owner] = append(keys[owner], key)
+    }
+    return keys, rows.Err()
+}
+
+func (ut *UnifiedTokenizer) handleListServiceAccounts(w http.ResponseWriter, r *http.Request) {
+    rows, err := ut.db.Query(`
+        SELECT ` + serviceAccountColumns + ` FROM users
+        WHERE account_type = 'service'
+        ORDER BY username`)
+    if err != nil {
+        apierror.Write(w, r, http.StatusInternalServerError, apierror.InternalError, "Database error")
+        return
+    }
+    defer rows.Close()
+
+    accounts := []*ServiceAccount{}
+    for rows.Next() {
+        account, err := scanServiceAccount(rows)
+        if err != nil {
+            continue
+        }
+        accounts = append(accounts, account)
+    }
+
+    keys, err := ut.serviceAccountKeys("")
+    if err != nil {
+        apierror.Write(w, r, http.StatusInternalServerError, apierror.InternalError, "Database error")
+        return
+    }
+    for _, account := range accounts {
+        account.Keys = append(account.Keys, keys[account.UserID]...)
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(map[string]interface{}{
+        "service_accounts": accounts,
+        "total":            len(accounts),
+    })
+}
+
+func (ut *UnifiedTokenizer) handleCreateServiceAccount(w http.ResponseWriter, r *http.Request) {
+    var req CreateServiceAccountRequest
+    if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+        apierror.Write(w, r, http.StatusBadRequest, apierror.InvalidBody, "Invalid request body")
+        return
+    }
+    if req.Name == "" {
+        apierror.Write(w, r, http.StatusBadRequest, apierror.InvalidRequest, "name is required")
+        return
+    }
+
+    if req.Role == "" {
+        req.Role = RoleViewer
+    }
+    if ok, err := ut.roleExists(req.Role); err != nil {
+        apierror.Write(w, r, http.StatusInternalServerError, apierror.InternalError, "Database error")
+        return
+    } else if !ok {
+        apierror.Write(w, r, http.StatusBadRequest, apierror.InvalidRequest, "Unknown role "+req.Role)
+        return
+    }
+    if err := validPermissions(req.Permissions); err != nil {
+        apierror.Write(w, r, http.StatusBadRequest, apierror.InvalidRequest, err.Error())
+        return
+    }
+    if req.Permissions == nil {
+        req.Permissions = []string{}
+    }
+    // Its keys act with these permissions, so the caller must hold them
+    if !ut.canManageUser(r, &User{Role: req.Role, Permissions: req.Permissions}) {
+        apierror.Write(w, r, http.StatusForbidden, apierror.PermissionDenied, "Cannot grant permissions you do not have")
+        return
+    }
+
+    // No password hash matches "!", and login skips service accounts anyway
+    userID := "svc_" + generateRandomID()
+    permissionsJSON, _ := json.Marshal(req.Permissions)
+    _, err := ut.db.Exec(`
+        INSERT INTO users (
+            user_id, account_type, username, email, password_hash, description,
+            role, permissions, is_active, is_email_verified, created_by
+        ) VALUES (?, 'service', ?, ?, '!', ?, ?, ?, TRUE, FALSE, ?)
+    `, userID, req.Name, serviceAccountEmail(req.Name), sql.NullString{String: req.Description, Valid: req.Description != ""},
+       req.Role, permissionsJSON, r.Header.Get("X-User-ID"))
+    if err != nil {
+        if strings.Contains(err.Error(), "Duplicate") {
+            apierror.Write(w, r, http.StatusConflict, apierror.AlreadyExists, "A user or service account with that name already exists")
+        } else {
+            apierror.Write(w, r, http.StatusInternalServerError, apierror.InternalError, "Failed to create service account")
+        }
+        return
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    w.WriteHeader(http.StatusCreated)
+    json.NewEncoder(w).Encode(ServiceAccount{
+        UserID:      userID,
+        Name:        req.Name,
+        Description: req.Description,
+        Role:        req.Role,
+        Permissions: req.Permissions,
+        IsActive:    true,
+        CreatedAt:   time.Now(),
+        Keys:        []ServiceAccountKey{},
+    })
+}
+
+func (ut *UnifiedTokenizer) handleGetServiceAccount(w http.ResponseWriter, r *http.Request) {
+    name, _, _, _ := serviceAccountPath(r.URL.Path)
+    account, err := ut.serviceAccount(name)
+    if err != nil {
+        apierror.Write(w, r, http.StatusInternalServerError, apierror.InternalError, "Database error")
+        return
+    }
+    if account == nil {
+        apierror.Write(w, r, http.StatusNotFound, apierror.ServiceAccountNotFound, "Service account not found")
+        return
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(account)
+}
+
+func (ut *UnifiedTokenizer) handleDeleteServiceAccount(w http.ResponseWriter, r *http.Request) {
+    name, _, _, _ := serviceAccountPath(r.URL.Path)
+
+    // Its API keys go with it
+    result, err := ut.db.Exec("DELETE FROM users WHERE (username = ? OR user_id = ?) AND account_type = 'service'", name, name)
+    if err != nil {
+        apierror.Write(w, r, http.StatusInternalServerError, apierror.InternalError, "Failed to delete service account")
+        return
+    }
+    if n, _ := result.RowsAffected(); n == 0 {
+        apierror.Write(w, r, http.StatusNotFound, apierror.ServiceAccountNotFound, "Service account not found")
+        return
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(map[string]string{"message": "Service account deleted successfully"})
+}
+
+// handleCreateServiceAccountKey issues an API key of a service account,
+// which expires after expires_in_days
+func (ut *UnifiedTokenizer) handleCreateServiceAccountKey(w http.ResponseWriter, r *http.Request) {
+    name, _, _, _ := serviceAccountPath(r.URL.Path)
+
+    var req ServiceAccountKeyRequest
+    if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+        apierror.Write(w, r, http.StatusBadRequest, apierror.InvalidBody, "Invalid request body")
+        return
+    }
+    if req.ExpiresInDays == 0 {
+        req.ExpiresInDays = ut.serviceKeyDays
+    }
+    if req.ExpiresInDays < 1 || req.ExpiresInDays > ut.serviceKeyDays {
+        apierror.Write(w, r, http.StatusBadRequest, apierror.InvalidRequest,
+            fmt.Sprintf("expires_in_days must be 1 to %d (SERVICE_ACCOUNT_KEY_DAYS)", ut.serviceKeyDays))
+        return
+    }
+
+    account, err := ut.serviceAccount(name)
+    if err != nil {
+        apierror.Write(w, r, http.StatusInternalServerError, apierror.InternalError, "Database error")
+        return
+    }
+    if account == nil {
+        apierror.Write(w, r, http.StatusNotFound, apierror.ServiceAccountNotFound, "Service account not found")
+        return
+    }
+    if !ut.canManageServiceAccount(r, account) {
+        apierror.Write(w, r, http.StatusForbidden, apierror.PermissionDenied, "Cannot issue keys of a service account with permissions you do not have")
+        return
+    }
+    if req.ClientName == "" {
+        req.ClientName = account.Name
+    }
+
+    key, err := ut.issueServiceAccountKey(account, r.Header.Get("X-User-ID"), req.ClientName, req.Signed, req.ExpiresInDays)
+    if err != nil {
+        log.Printf("Failed to create service account key: %v", err)
+        apierror.Write(w, r, http.StatusInternalServerError, apierror.InternalError, "Failed to create API key")
+        return
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    w.WriteHeader(http.StatusCreated)
+    json.NewEncoder(w).Encode(key)
+}
+
+// canManageServiceAccount reports whether the caller of r may issue keys
+// of account: a key acts with the account's permissions, so the caller
+// must hold them all, as for canManageUser
+func (ut *UnifiedTokenizer) canManageServiceAccount(r *http.Request, account *ServiceAccount) bool {
+    return ut.canManageUser(r, &User{Role: account.Role, Permissions: account.Permissions})
+}
+
+// issueServiceAccountKey creates an API key of account expiring in days
+func (ut *UnifiedTokenizer) issueServiceAccountKey(account *ServiceAccount, createdBy, clientName string, signed bool, days int) (*ServiceAccountKey, error) {
+    apiKey, signingSecret, err := ut.issueAPIKey(account.UserID, createdBy, clientName, nil, signed, days)
+    if err != nil {
+        return nil, err
+    }
+    now := time.Now()
+    return &ServiceAccountKey{
+        APIKey:        apiKey,
+        ClientName:    clientName,
+        IsActive:      true,
+        Signed:        signed,
+        CreatedAt:     now,
+        ExpiresAt:     now.AddDate(0, 0, days),
+        SigningSecret: signingSecret,
+    }, nil
+}
+
+// handleRotateServiceAccountKey issues a key replacing one of a service
+// account's keys, with the same client name and signing mode, and has the
+// old key expire once overlap_hours have passed, so the integration can
+// switch over without downtime
+func (ut *UnifiedTokenizer) handleRotateServiceAccountKey(w http.ResponseWriter, r *http.Request) {
+    name, apiKey, _, _ := serviceAccountPath(r.URL.Path)
+
+    var req RotateServiceAccountKeyRequest
+    if r.ContentLength != 0 {
+        if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+            apierror.Write(w, r, http.StatusBadRequest, apierror.InvalidBody, "Invalid request body")
+            return
+        }
+    }
+    overlap := 24
+    if req.OverlapHours != nil {
+        overlap = *req.OverlapHours
+    }
+    if overlap < 0 || overlap > 168 {
+        apierror.Write(w, r, http.StatusBadRequest, apierror.InvalidRequest, "overlap_hours must be 0 to 168")
+        return
+    }
+
+    account, err := ut.serviceAccount(name)
+    if err != nil {
+        apierror.Write(w, r, http.StatusInternalServerError, apierror.InternalError, "Database error")
+        return
+    }
+    if account == nil {
+        apierror.Write(w, r, http.StatusNotFound, apierror.ServiceAccountNotFound, "Service account not found")
+        return
+    }
+    if !ut.canManageServiceAccount(r, account) {
+        apierror.Write(w, r, http.StatusForbidden, apierror.PermissionDenied, "Cannot issue keys of a service account with permissions you do not have")
+        return
+    }
+    var old *ServiceAccountKey
+    for i := range account.Keys {
+        if key := &account.Keys[i]; key.APIKey == apiKey && key.IsActive && !key.Expired {
+            old = key
+        }
+    }
+    if old == nil {
+        apierror.Write(w, r, http.StatusNotFound, apierror.APIKeyNotFound, "No active, unexpired key "+apiKey+" of this service account")
+        return
+    }
+
+    key, err := ut.issueServiceAccountKey(account, r.Header.Get("X-User-ID"), old.ClientName, old.Signed, ut.serviceKeyDays)
+    if err != nil {
+        log.Printf("Failed to create service account key: %v", err)
+        apierror.Write(w, r, http.StatusInternalServerError, apierror.InternalError, "Failed to create API key")
+        return
+    }
+
+    // The old key keeps working for the overlap, but no longer than it
+    // would have, and is not reminded about again
+    _, err = ut.db.Exec(`
+        UPDATE api_keys
+        SET expires_at = LEAST(expires_at, DATE_ADD(NOW(), INTERVAL ? HOUR)),
+            expiry_reminded_at = COALESCE(expiry_reminded_at, NOW())
+        WHERE api_key = ?`, overlap, apiKey)
+    if err == nil {
+        err = ut.db.QueryRow("SELECT expires_at FROM api_keys WHERE api_key = ?", apiKey).Scan(&old.ExpiresAt)
+    }
+    if err != nil {
+        log.Printf("Failed to expire rotated key of service account %s: %v", account.Name, err)
+        apierror.Write(w, r, http.StatusInternalServerError, apierror.InternalError, "Created "+key.APIKey+" but failed to expire the old key; revoke it")
+        return
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    w.WriteHeader(http.StatusCreated)
+    json.NewEncoder(w).Encode(RotatedServiceAccountKey{
+        ServiceAccountKey: *key,
+        Replaces:          apiKey,
+        ReplacedExpiresAt: old.ExpiresAt,
+    })
+}
+
+// remindExpiringKeys raises an api_key_expiring event, once per key, for
+// each active service account key that expires within
+// SERVICE_ACCOUNT_KEY_REMINDER_DAYS, so it can be rotated in time
+func (ut *UnifiedTokenizer) remindExpiringKeys() {
+    if ut.serviceKeyReminderDays == 0 {
+        return
+    }
+    rows, err := ut.db.Query(`
+        SELECT k.api_key, k.client_name, k.expires_at, u.user_id, u.username
+        FROM api_keys k JOIN users u ON u.user_id = k.user_id
+        WHERE u.account_type = 'service' AND k.is_active = TRUE AND k.expiry_reminded_at IS NULL
+            AND k.expires_at > NOW() AND k.expires_at <= DATE_ADD(NOW(), INTERVAL ? DAY)`, ut.serviceKeyReminderDays)
+    if err != nil {
+        log.Printf("Failed to find expiring service account keys: %v", err)
+        return
+    }
+    type expiringKey struct {
+        apiKey, clientName, userID, username string
+        expiresAt                            time.Time
+    }
+    var expiring []expiringKey
+    for rows.Next() {
+        var k expiringKey
+        if err := rows.Scan(&k.apiKey, &k.clientName, &k.expiresAt, &k.userID, &k.username); err == nil {
+            expiring = append(expiring, k)
+        }
+    }
+    rows.Close()
+
+    for _, k := range expiring {
+        // Only the replica that marks the key raises the event
+        result, err := ut.db.Exec("UPDATE api_keys SET expiry_reminded_at = NOW() WHERE api_key = ? AND expiry_reminded_at IS NULL", k.apiKey)
+        if err != nil {
+            log.Printf("Failed to mark service account key reminded: %v", err)
+            continue
+        }
+        if n, _ := result.RowsAffected(); n == 0 {
+            continue
+        }
+        ut.logSecurityEvent(SecurityEvent{
+            EventType: "api_key_expiring",
+            Severity:  "medium",
+            UserID:    k.userID,
+            Username:  k.username,
+            IPAddress: "system",
+            Endpoint:  "/api/v1/service-accounts/" + k.username,
+            Details: map[string]interface{}{
+                "api_key":     k.apiKey,
+                "client_name": k.clientName,
+                "expires_at":  k.expiresAt.UTC().Format(time.RFC3339),
+            },
+        })
+    }
+}
+
+// accessReviewPolicy is how access reviews are scheduled and enforced
+type accessReviewPolicy struct {
+    intervalDays      int  // ACCESS_REVIEW_INTERVAL_DAYS: a review starts this long after the last one; 0 starts none
+    days              int  // ACCESS_REVIEW_DAYS: how long a review is open
+    reminderDays      int  // ACCESS_REVIEW_REMINDER_DAYS: how long before the deadline access_review_due is raised; 0 disables
+    disableUnreviewed bool // ACCESS_REVIEW_DISABLE_UNREVIEWED: disable accounts and keys still pending at the deadline
+}
+
+func loadAccessReviewPolicy() (accessReviewPolicy, error) {
+    var c accessReviewPolicy
+    var err error
+    if c.intervalDays, err = utils.IntSetting("ACCESS_REVIEW_INTERVAL_DAYS", 0, 0, 366); err != nil {
+        return c, err
+    }
+    if c.days, err = utils.IntSetting("ACCESS_REVIEW_DAYS", 14, 1, 90); err != nil {
+        return c, err
+    }
+    if c.reminderDays, err = utils.IntSetting("ACCESS_REVIEW_REMINDER_DAYS", 3, 0, 90); err != nil {
+        return c, err
+    }
+    c.disableUnreviewed = utils.GetEnv("ACCESS_REVIEW_DISABLE_UNREVIEWED", "true") == "true"
+    return c, nil
+}
+
+// accessReviewLock keeps replicas from starting or closing a review twice
+const accessReviewLock = "tokenshield_access_reviews"
+
+// Decisions on an access review item
+const (
+    reviewPending   = "pending"
+    reviewConfirmed = "confirmed"
+    reviewRevoked   = "revoked"
+    reviewExpired   = "expired" // Still pending when the review closed
+)
+
+// AccessReview is a campaign to confirm or revoke every active account and
+// API key by a deadline
+type AccessReview struct {
+    ReviewID  string             `json:"review_id"`
+    Name      string             `json:"name"`
+    Status    string             `json:"status"` // open or closed
+    DueAt     time.Time          `json:"due_at"`
+    CreatedBy string             `json:"created_by"`
+    CreatedAt time.Time          `json:"created_at"`
+    ClosedAt  *time.Time         `json:"closed_at,omitempty"`
+    ClosedBy  string             `json:"closed_by,omitempty"`
+    Counts    map[string]int     `json:"counts"` // Items by decision
+    Items     []AccessReviewItem `json:"items,omitempty"`
+}
+
+// AccessReviewItem is an account or API key as it was when the review
+// started, and what was decided about it
+type AccessReviewItem struct {
+    ItemID      int64      `json:"item_id"`
+    SubjectType string     `json:"subject_type"` // user or api_key
+    SubjectID   string     `json:"subject_id"`
+    UserID      string     `json:"user_id"`
+    Username    string     `json:"username"`
+    Label       string     `json:"label,omitempty"` // A key's client name
+    Role        string     `json:"role,omitempty"`
+    Permissions []string   `json:"permissions"`
+    LastUsedAt  *time.Time `json:"last_used_at,omitempty"`
+    Decision    string     `json:"decision"`
+    DecidedBy   string     `json:"decided_by,omitempty"`
+    DecidedAt   *time.Time `json:"decided_at,omitempty"`
+    Comment     string     `json:"comment,omitempty"`
+}
+
+// CreateAccessReviewRequest is the body of POST /api/v1/access-reviews
+type CreateAccessReviewRequest struct {
+    Name      string `json:"name"`        // The quarter it starts in when empty
+    DueInDays int    `json:"due_in_days"` // ACCESS_REVIEW_DAYS when 0
+}
+
+// AccessReviewDecisionRequest is the body of POST
+// /api/v1/access-reviews/{review_id}/items/{item_id}
+type AccessReviewDecisionRequest struct {
+    Decision string `json:"decision"` // confirm or revoke
+    Comment  string `json:"comment"`
+}
+
+// accessReviewPath splits a path under /api/v1/access-reviews/ into the
+// review ID and, for the item and close routes, the item ID and action:
+// "" for {review_id}, "item" for {review_id}/items/{item_id} and "close"
+// for {review_id}/close. ok is false for any other path.
+func accessReviewPath(path string) (reviewID string, itemID int64, action string, ok bool) {
+    parts := strings.Split(strings.TrimPrefix(path, "/api/v1/access-reviews/"), "/")
+    if parts[0] == "" {
+        return "", 0, "", false
+    }
+    switch {
+    case len(parts) == 1:
+        return parts[0], 0, "", true
+    case len(parts) == 2 && parts[1] == "close":
+        return parts[0], 0, "close", true
+    case len(parts) == 3 && parts[1] == "items":
+        if id, err := strconv.ParseInt(parts[2], 10, 64); err == nil && id > 0 {
+            return parts[0], id, "item", true
+        }
+    }
+    return "", 0, "", false
+}
+
+// defaultReviewName names a review after the quarter it starts in
+func defaultReviewName(now time.Time) string {
+    return fmt.Sprintf("%d-Q%d access review", now.Year(), (int(now.Month())+2)/3)
+}
+
+// startAccessReview opens a review of every active account and unexpired
+// API key. It fails with errReviewOpen while another review is open.
+func (ut *UnifiedTokenizer) startAccessReview(name string, dueAt time.Time, createdBy string) (*AccessReview, error) {
+    tx, err := ut.db.Begin()
+    if err != nil {
+        return nil, err
+    }
+    defer tx.Rollback()
+    
+    var open int
+    if err := tx.QueryRow("SELECT COUNT(*) FROM access_reviews WHERE status = 'open' FOR UPDATE").Scan(&open); err != nil {
+        return nil, err
+    }
+    if open > 0 {
+        return nil, errReviewOpen
+    }
+    reviewID := "rev_" + generateRandomID()
+    if _, err := tx.Exec("INSERT INTO access_reviews (review_id, name, due_at, created_by) VALUES (?, ?, ?, ?)",
+        reviewID, name, dueAt, createdBy); err != nil {
+        return nil, err
+    }
+    if _, err := tx.Exec(`
+        INSERT INTO access_review_items (review_id, subject_type, subject_id, user_id, username, role, permissions, last_used_at)
+        SELECT ?, 'user', user_id, user_id, username, role, permissions, last_login_at
+        FROM users WHERE is_active = TRUE`, reviewID); err != nil {
+        return nil, err
+    }
+    if _, err := tx.Exec(`
+        INSERT INTO access_review_items (review_id, subject_type, subject_id, user_id, username, label, permissions, last_used_at)
+        SELECT ?, 'api_key', k.api_key, COALESCE(k.user_id, ''), COALESCE(u.username, ''), k.client_name, k.permissions, k.last_used_at
+        FROM api_keys k LEFT JOIN users u ON u.user_id = k.user_id
+        WHERE k.is_active = TRUE AND (k.expires_at IS NULL OR k.expires_at > NOW())`, reviewID); err != nil {
+        return nil, err
+    }
+    if err := tx.Commit(); err != nil {
+        return nil, err
+    }
+    return ut.accessReview(reviewID, "")
+}
+
+// errReviewOpen is returned by startAccessReview while a review is open
+var errReviewOpen = errors.New("an access review is already open")
+
+// accessReview returns a review with its items, of one decision when
+// decision is not empty, or nil if there is none
+func (ut *UnifiedTokenizer) accessReview(reviewID, decision string) (*AccessReview, error) {
+    reviews, err := ut.accessReviews("WHERE review_id = ?", reviewID)
+    if err != nil || len(reviews) == 0 {
+        return nil, err
+    }
+    review := &reviews[0]
+    
+    rows, err := ut.db.Query(`
+        SELECT id, subject_type, subject_id, user_id, username, COALESCE(label, ''), COALESCE(role, ''), permissions,
+               last_used_at, decision, COALESCE(decided_by, ''), decided_at, COALESCE(comment, '')
+        FROM access_review_items WHERE review_id = ? AND (? = '' OR decision = ?)
+        ORDER BY username, subject_type DESC, id`, reviewID, decision, decision)
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+    review.Items = []AccessReviewItem{}
+    for rows.Next() {
+        var item AccessReviewItem
+        var permissions []byte
+        var lastUsed, decidedAt sql.NullTime
+        if err := rows.Scan(&item.ItemID, &item.SubjectType, &item.SubjectID, &item.UserID, &item.Username, &item.Label, &item.Role,
+            &permissions, &lastUsed, &item.Decision, &item.DecidedBy, &decidedAt, &item.Comment); err != nil {
+            return nil, err
+        }
+        item.Permissions = []string{}
+        json.Unmarshal(permissions, &item.Permissions)
+        if lastUsed.Valid {
+            item.LastUsedAt = &lastUsed.Time
+        }
+        if decidedAt.Valid {
+            item.DecidedAt = &decidedAt.Time
+        }
+        review.Items = append(review.Items, item)
+    }
+    return review, rows.Err()
+}
+
+// accessReviews returns the reviews a WHERE clause selects, newest first,
+// with their items counted by decision
+func (ut *UnifiedTokenizer) accessReviews(where string, args ...interface{}) ([]AccessReview, error) {
+    rows, err := ut.db.Query(`
+        SELECT review_id, name, status, due_at, created_by, created_at, closed_at, COALESCE(closed_by, '')
+        FROM access_reviews `+where+` ORDER BY created_at DESC LIMIT 100`, args...)
+    if err != nil {
+        return nil, err
+    }
+    reviews := []AccessReview{}
+    for rows.Next() {
+        var review AccessReview
+        var closedAt sql.NullTime
+        if err := rows.Scan(&review.ReviewID, &review.Name, &review.Status, &review.DueAt, &review.CreatedBy,
+            &review.CreatedAt, &closedAt, &review.ClosedBy); err != nil {
+            rows.Close()
+            return nil, err
+        }
+        if closedAt.Valid {
+            review.ClosedAt = &closedAt.Time
+        }
+        review.Counts = map[string]int{reviewPending: 0, reviewConfirmed: 0, reviewRevoked: 0, reviewExpired: 0}
+        reviews = append(reviews, review)
+    }
+    rows.Close()
+    if err := rows.Err(); err != nil {
+        return nil, err
+    }
+    
+    for i := range reviews {
+        counts, err := ut.db.Query("SELECT decision, COUNT(*) FROM access_review_items WHERE review_id = ? GROUP BY decision", reviews[i].ReviewID)
+        if err != nil {
+            return nil, err
+        }
+        for counts.Next() {
+            var decision string
+            var n int
+            if err := counts.Scan(&decision, &n); err == nil {
+                reviews[i].Counts[decision] = n
+            }
+        }
+        counts.Close()
+    }
+    return reviews, nil
+}
+
+// revokeReviewedAccess disables an account, ending its sessions, or
+// deactivates an API key, as an access review decided
+func (ut *UnifiedTokenizer) revokeReviewedAccess(item AccessReviewItem) error {
+    if item.SubjectType == "api_key" {
+        _, err := ut.db.Exec("UPDATE api_keys SET is_active = FALSE WHERE api_key = ?", item.SubjectID)
+        return err
+    }
+    if _, err := ut.db.Exec("UPDATE users SET is_active = FALSE, updated_at = NOW() WHERE user_id = ?", item.SubjectID); err != nil {
+        return err
+    }
+    return ut.invalidateUserSessions(item.SubjectID, "access_review")
+}
+
+// closeAccessReview marks the items of an open review still pending as
+// expired and, with ACCESS_REVIEW_DISABLE_UNREVIEWED, disables them. The
+// default admin is never disabled. It reports false if the review was not
+// open.
+func (ut *UnifiedTokenizer) closeAccessReview(reviewID, closedBy string) (bool, error) {
+    result, err := ut.db.Exec("UPDATE access_reviews SET status = 'closed', closed_at = NOW(), closed_by = ? WHERE review_id = ? AND status = 'open'",
+        closedBy, reviewID)
+    if err != nil {
+        return false, err
+    }
+    if n, _ := result.RowsAffected(); n == 0 {
+        return false, nil
+    }
+    
+    review, err := ut.accessReview(reviewID, reviewPending)
+    if err != nil {
+        return true, err
+    }
+    var disabled []string
+    for _, item := range review.Items {
+        if _, err := ut.db.Exec("UPDATE access_review_items SET decision = ?, decided_by = ?, decided_at = NOW() WHERE id = ?",
+            reviewExpired, closedBy, item.ItemID); err != nil {
+            return true, err
+        }
+        if !ut.reviewPolicy.disableUnreviewed || item.SubjectID == "usr_admin_default" {
+            continue
+        }
+        if err := ut.revokeReviewedAccess(item); err != nil {
+            return true, err
+        }
+        if item.SubjectType == "api_key" {
+            disabled = append(disabled, "key "+item.Label+" of "+item.Username)
+        } else {
+            disabled = append(disabled, item.Username)
+        }
+    }
+    
+    severity := "low"
+    if len(disabled) > 0 {
+        severity = "medium"
+    }
+    ut.logSecurityEvent(SecurityEvent{
+        EventType: "access_review_closed",
+        Severity:  severity,
+        UserID:    closedBy,
+        IPAddress: "system",
+        Endpoint:  "/api/v1/access-reviews/" + reviewID,
+        Details: map[string]interface{}{
+            "review_id":  reviewID,
+            "name":       review.Name,
+            "unreviewed": len(review.Items),
+            "disabled":   disabled,
+        },
+    })
+    return true, nil
+}
+
+// runAccessReviews starts a review ACCESS_REVIEW_INTERVAL_DAYS after the
+// last one, raises access_review_due once a review is within
+// ACCESS_REVIEW_REMINDER_DAYS of its deadline, and closes reviews past it.
+// Only one replica does so at a time.
+func (ut *UnifiedTokenizer) runAccessReviews() {
+    ctx := context.Background()
+    conn, err := ut.db.Conn(ctx)
+    if err != nil {
+        log.Printf("Error running access reviews: %v", err)
+        return
+    }
+    defer conn.Close()
+    var locked sql.NullInt64
+    if err := conn.QueryRowContext(ctx, "SELECT GET_LOCK(?, 0)", accessReviewLock).Scan(&locked); err != nil || locked.Int64 != 1 {
+        return // Another replica is at it
+    }
+    defer conn.ExecContext(context.Background(), "DO RELEASE_LOCK(?)", accessReviewLock)
+    
+    c := ut.reviewPolicy
+    now := time.Now()
+    if c.intervalDays > 0 {
+        var last sql.NullTime
+        if err := ut.db.QueryRow("SELECT MAX(created_at) FROM access_reviews").Scan(&last); err != nil {
+            log.Printf("Error running access reviews: %v", err)
+            return
+        }
+        if !last.Valid || last.Time.Before(now.AddDate(0, 0, -c.intervalDays)) {
+            review, err := ut.startAccessReview(defaultReviewName(now), now.AddDate(0, 0, c.days), "system")
+            if err != nil && err != errReviewOpen {
+                log.Printf("Error starting access review: %v", err)
+            } else if err == nil {
+                log.Printf("Started access review %s of %d accounts and keys", review.ReviewID, review.Counts[reviewPending])
+            }
+        }
+    }
+    
+    reviews, err := ut.accessReviews("WHERE status = 'open'")
+    if err != nil {
+        log.Printf("Error running access reviews: %v", err)
+        return
+    }
+    for _, review := range reviews {
+        if !review.DueAt.After(now) {
+            if _, err := ut.closeAccessReview(review.ReviewID, "system"); err != nil {
+                log.Printf("Error closing access review %s: %v", review.ReviewID, err)
+            }
+            continue
+        }
+        if c.reminderDays == 0 || review.DueAt.After(now.AddDate(0, 0, c.reminderDays)) || review.Counts[reviewPending] == 0 {
+            continue
+        }
+        result, err := ut.db.Exec("UPDATE access_reviews SET reminded_at = NOW() WHERE review_id = ? AND reminded_at IS NULL", review.ReviewID)
+        if err != nil {
+            continue
+        }
+        if n, _ := result.RowsAffected(); n == 0 {
+            continue
+        }
+        ut.logSecurityEvent(SecurityEvent{
+            EventType: "access_review_due",
+            Severity:  "medium",
+            IPAddress: "system",
+            Endpoint:  "/api/v1/access-reviews/" + review.ReviewID,
+            Details: map[string]interface{}{
+                "review_id":          review.ReviewID,
+                "name":               review.Name,
+                "due_at":             review.DueAt.UTC().Format(time.RFC3339),
+                "pending":            review.Counts[reviewPending],
+                "disable_unreviewed": c.disableUnreviewed,
+            },
+        })
+    }
+}
+
+// handleListAccessReviews lists access reviews, newest first
+func (ut *UnifiedTokenizer) handleListAccessReviews(w http.ResponseWriter, r *http.Request) {
+    reviews, err := ut.accessReviews("")
+    if err != nil {
+        apierror.Write(w, r, http.StatusInternalServerError, apierror.InternalError, "Database error")
+        return
+    }
+    c := ut.reviewPolicy
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(map[string]interface{}{
+        "reviews":            reviews,
+        "interval_days":      c.intervalDays,
+        "review_days":        c.days,
+        "disable_unreviewed": c.disableUnreviewed,
+    })
+}
+
+func (ut *UnifiedTokenizer) handleCreateAccessReview(w http.ResponseWriter, r *http.Request) {
+    var req CreateAccessReviewRequest
+    if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+        apierror.Write(w, r, http.StatusBadRequest, apierror.InvalidBody, "Invalid request body")
+        return
+    }
+    now := time.Now()
+    if req.Name == "" {
+        req.Name = defaultReviewName(now)
+    }
+    if req.DueInDays == 0 {
+        req.DueInDays = ut.reviewPolicy.days
+    }
+    
+    userID := r.Header.Get("X-User-ID")
+    review, err := ut.startAccessReview(req.Name, now.AddDate(0, 0, req.DueInDays), userID)
+    if err == errReviewOpen {
+        apierror.Write(w, r, http.StatusConflict, apierror.Conflict, "An access review is already open; close it first")
+        return
+    } else if err != nil {
+        log.Printf("Error starting access review: %v", err)
+        apierror.Write(w, r, http.StatusInternalServerError, apierror.InternalError, "Database error")
+        return
+    }
+    
+    ipAddress, userAgent := ut.getClientInfo(r)
+    ut.logAuditEvent(AuditEvent{
+        UserID:       userID,
+        Action:       "access_review_started",
+        ResourceType: "access_review",
+        ResourceID:   review.ReviewID,
+        IPAddress:    ipAddress,
+        UserAgent:    userAgent,
+        Details: map[string]interface{}{
+            "name":   review.Name,
+            "due_at": review.DueAt.UTC().Format(time.RFC3339),
+            "items":  review.Counts[reviewPending],
+        },
+    })
+    
+    w.Header().Set("Content-Type", "application/json")
+    w.WriteHeader(http.StatusCreated)
+    json.NewEncoder(w).Encode(review)
+}
+
+// handleGetAccessReview returns a review and its items, optionally of one
+// decision
+func (ut *UnifiedTokenizer) handleGetAccessReview(w http.ResponseWriter, r *http.Request) {
+    reviewID, _, _, _ := accessReviewPath(r.URL.Path)
+    decision := r.URL.Query().Get("decision")
+    switch decision {
+    case "", reviewPending, reviewConfirmed, reviewRevoked, reviewExpired:
+    default:
+        apierror.Write(w, r, http.StatusBadRequest, apierror.InvalidRequest, "decision must be pending, confirmed, revoked or expired")
+        return
+    }
+    review, err := ut.accessReview(reviewID, decision)
+    if err != nil {
+        apierror.Write(w, r, http.StatusInternalServerError, apierror.InternalError, "Database error")
+        return
+    }
+    if review == nil {
+        apierror.Write(w, r, http.StatusNotFound, apierror.NotFound, "Access review not found")
+        return
+    }
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(review)
+}
+
+// handleDecideAccessReviewItem confirms or revokes an account or key of an
+// open review. Revoking takes effect at once, and nobody reviews their own
+// access.
+func (ut *UnifiedTokenizer) handleDecideAccessReviewItem(w http.ResponseWriter, r *http.Request) {
+    reviewID, itemID, _, _ := accessReviewPath(r.URL.Path)
+    var req AccessReviewDecisionRequest
+    if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+        apierror.Write(w, r, http.StatusBadRequest, apierror.InvalidBody, "Invalid request body")
+        return
+    }
+    decision := map[string]string{"confirm": reviewConfirmed, "revoke": reviewRevoked}[req.Decision]
+    if decision == "" {
+        apierror.Write(w, r, http.StatusBadRequest, apierror.InvalidRequest, "decision must be confirm or revoke")
+        return
+    }
+    
+    var item AccessReviewItem
+    var status string
+    err := ut.db.QueryRow(`
+        SELECT i.id, i.subject_type, i.subject_id, i.user_id, i.username, COALESCE(i.label, ''), i.decision, r.status
+        FROM access_review_items i JOIN access_reviews r ON r.review_id = i.review_id
+        WHERE i.review_id = ? AND i.id = ?`, reviewID, itemID).Scan(
+        &item.ItemID, &item.SubjectType, &item.SubjectID, &item.UserID, &item.Username, &item.Label, &item.Decision, &status)
+    if err == sql.ErrNoRows {
+        apierror.Write(w, r, http.StatusNotFound, apierror.NotFound, "Access review item not found")
+        return
+    } else if err != nil {
+        apierror.Write(w, r, http.StatusInternalServerError, apierror.InternalError, "Database error")
+        return
+    }
+    reviewer := r.Header.Get("X-User-ID")
+    switch {
+    case status != "open":
+        apierror.Write(w, r, http.StatusConflict, apierror.Conflict, "The access review is closed")
+        return
+    case item.Decision != reviewPending:
+        apierror.Write(w, r, http.StatusConflict, apierror.Conflict, "Already "+item.Decision)
+        return
+    case item.UserID != "" && item.UserID == reviewer:
+        apierror.Write(w, r, http.StatusForbidden, apierror.PermissionDenied, "You cannot review your own access")
+        return
+    case decision == reviewRevoked && item.SubjectID == "usr_admin_default":
+        apierror.Write(w, r, http.StatusForbidden, apierror.PermissionDenied, "Cannot disable or demote default admin user")
+        return
+    }
+    
+    // Only the request that moves the item off pending acts on it
+    result, err := ut.db.Exec(`
+        UPDATE access_review_items SET decision = ?, decided_by = ?, decided_at = NOW(), comment = ?
+        WHERE id = ? AND decision = 'pending'`,
+        decision, reviewer, sql.NullString{String: req.Comment, Valid: req.Comment != ""}, item.ItemID)
+    if err != nil {
+        apierror.Write(w, r, http.StatusInternalServerError, apierror.InternalError, "Database error")
+        return
+    }
+    if n, _ := result.RowsAffected(); n == 0 {
+        apierror.Write(w, r, http.StatusConflict, apierror.Conflict, "Already decided")
+        return
+    }
+    if decision == reviewRevoked {
+        if err := ut.revokeReviewedAccess(item); err != nil {
+            log.Printf("Error revoking access after review: %v", err)
+            apierror.Write(w, r, http.StatusInternalServerError, apierror.InternalError, "Failed to revoke access")
+            return
+        }
+    }
+    
+    ipAddress, userAgent := ut.getClientInfo(r)
+    ut.logAuditEvent(AuditEvent{
+        UserID:       reviewer,
+        Action:       "access_review_" + decision,
+        ResourceType: item.SubjectType,
+        ResourceID:   item.SubjectID,
+        IPAddress:    ipAddress,
+        UserAgent:    userAgent,
+        Details: map[string]interface{}{
+            "review_id": reviewID,
+            "username":  item.Username,
+            "comment":   req.Comment,
+        },
+    })
+    
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(map[string]interface{}{
+        "item_id":  item.ItemID,
+        "decision": decision,
+    })
+}
+
+// handleCloseAccessReview closes an open review before its deadline, with
+// the same effect on pending items as the deadline
+func (ut *UnifiedTokenizer) handleCloseAccessReview(w http.ResponseWriter, r *http.Request) {
+    reviewID, _, _, _ := accessReviewPath(r.URL.Path)
+    closed, err := ut.closeAccessReview(reviewID, r.Header.Get("X-User-ID"))
+    if err != nil {
+        log.Printf("Error closing access review %s: %v", reviewID, err)
+        apierror.Write(w, r, http.StatusInternalServerError, apierror.InternalError, "Database error")
+        return
+    }
+    if !closed {
+        apierror.Write(w, r, http.StatusConflict, apierror.Conflict, "No open access review "+reviewID)
+        return
+    }
+    review, err := ut.accessReview(reviewID, reviewExpired)
+    if err != nil {
+        apierror.Write(w, r, http.StatusInternalServerError, apierror.InternalError, "Database error")
+        return
+    }
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(review)
+}
+
+// inactivityPolicy is when accounts nobody logs in to and API keys nobody
+// uses are disabled. Roles can set their own numbers of days.
+type inactivityPolicy struct {
+    userDays    int // INACTIVE_USER_DAYS: days without a login before an account is disabled; 0 never
+    keyDays     int // STALE_API_KEY_DAYS: days unused before an API key is deactivated; 0 never
+    warningDays int // INACTIVITY_WARNING_DAYS: how long before that the user_inactive or api_key_stale warning is raised; 0 disables without warning
+}
+
+func loadInactivityPolicy() (inactivityPolicy, error) {
+    var p inactivityPolicy
+    var err error
+    if p.userDays, err = utils.IntSetting("INACTIVE_USER_DAYS", 0, 0, 3650); err != nil {
+        return p, err
+    }
+    if p.keyDays, err = utils.IntSetting("STALE_API_KEY_DAYS", 0, 0, 3650); err != nil {
+        return p, err
+    }
+    if p.warningDays, err = utils.IntSetting("INACTIVITY_WARNING_DAYS", 7, 0, 90); err != nil {
+        return p, err
+    }
+    return p, nil
+}
+
+// Outcomes of inactivityAction
+const (
+    inactivityWarn    = "warn"
+    inactivityDisable = "disable"
+)
+
+// inactivityAction says what to do about an account or key last active at
+// lastActive, under a policy of days (0 never disables) with warnings
+// warnDays ahead. Unless warnings are off, nothing is disabled before a
+// warning raised since lastActive is warnDays old, so turning a policy on
+// warns about long idle accounts before disabling them.
+func inactivityAction(lastActive time.Time, warnedAt sql.NullTime, days, warnDays int, now time.Time) string {
+    if days <= 0 {
+        return ""
+    }
+    deadline := lastActive.AddDate(0, 0, days)
+    if warnDays == 0 {
+        if !now.Before(deadline) {
+            return inactivityDisable
+        }
+        return ""
+    }
+    if warnedAt.Valid && !warnedAt.Time.Before(lastActive) {
+        if !now.Before(deadline) && !now.Before(warnedAt.Time.AddDate(0, 0, warnDays)) {
+            return inactivityDisable
+        }
+        return ""
+    }
+    if !now.Before(deadline.AddDate(0, 0, -warnDays)) {
+        return inactivityWarn
+    }
+    return ""
+}
+
+// inactivityDays returns the days of inactivity each role allows its users
+// and their API keys, by role name, with the server's settings under ""
+func (ut *UnifiedTokenizer) inactivityDays() (users, keys map[string]int, err error) {
+    roles, err := ut.loadRoles()
+    if err != nil {
+        return nil, nil, err
+    }
+    users = map[string]int{"": ut.inactivity.userDays}
+    keys = map[string]int{"": ut.inactivity.keyDays}
+    for _, role := range roles {
+        users[role.Name], keys[role.Name] = ut.inactivity.userDays, ut.inactivity.keyDays
+        if role.InactiveUserDays != nil {
+            users[role.Name] = *role.InactiveUserDays
+        }
+        if role.StaleAPIKeyDays != nil {
+            keys[role.Name] = *role.StaleAPIKeyDays
+        }
+    }
+    return users, keys, nil
+}
+
+// disableInactive warns about, then disables, accounts nobody has logged in
+// to and API keys nobody has used for as long as their role allows. Service
+// accounts cannot log in, so only their keys are checked, and the default
+// admin is never disabled. Each change is made by a conditional update, so
+// when several replicas run this only one raises each event.
+func (ut *UnifiedTokenizer) disableInactive() {
+    userDays, keyDays, err := ut.inactivityDays()
+    if err != nil {
+        log.Printf("Failed to load inactivity policies: %v", err)
+        return
+    }
+    now := time.Now()
+    warnDays := ut.inactivity.warningDays
+    
+    type idle struct {
+        id, name, userID, username, role string
+        lastActive                       time.Time
+        warnedAt                         sql.NullTime
+    }
+    var users, keys []idle
+    rows, err := ut.db.Query(`
+        SELECT user_id, username, role,
+               GREATEST(created_at, COALESCE(last_login_at, created_at), COALESCE(reactivated_at, created_at)),
+               inactivity_warned_at
+        FROM users WHERE is_active = TRUE AND account_type = 'human' AND user_id != 'usr_admin_default'`)
+    if err != nil {
+        log.Printf("Failed to find inactive users: %v", err)
+        return
+    }
+    for rows.Next() {
+        var u idle
+        if err := rows.Scan(&u.userID, &u.username, &u.role, &u.lastActive, &u.warnedAt); err == nil {
+            u.id, u.name = u.userID, u.username
+            users = append(users, u)
+        }
+    }
+    rows.Close()
+    rows, err = ut.db.Query(`
+        SELECT k.api_key, k.client_name, COALESCE(k.user_id, ''), COALESCE(u.username, ''), COALESCE(u.role, ''),
+               COALESCE(k.last_used_at, k.created_at), k.inactivity_warned_at
+        FROM api_keys k LEFT JOIN users u ON u.user_id = k.user_id
+        WHERE k.is_active = TRUE AND (k.expires_at IS NULL OR k.expires_at > NOW())`)
+    if err != nil {
+        log.Printf("Failed to find stale API keys: %v", err)
+        return
+    }
+    for rows.Next() {
+        var k idle
+        if err := rows.Scan(&k.id, &k.name, &k.userID, &k.username, &k.role, &k.lastActive, &k.warnedAt); err == nil {
+            keys = append(keys, k)
+        }
+    }
+    rows.Close()
+    
+    event := func(eventType string, subject idle, endpoint string, days int, details map[string]interface{}) {
+        details["last_active_at"] = subject.lastActive.UTC().Format(time.RFC3339)
+        details["days"] = days
+        ut.logSecurityEvent(SecurityEvent{
+            EventType: eventType,
+            Severity:  "medium",
+            UserID:    subject.userID,
+            Username:  subject.username,
+            IPAddress: "system",
+            Endpoint:  endpoint,
+            Details:   details,
+        })
+    }
+    
+    for _, u := range users {
+        days, ok := userDays[u.role]
+        if !ok {
+            days = userDays[""]
+        }
+        endpoint := "/api/v1/users/" + u.username
+        switch inactivityAction(u.lastActive, u.warnedAt, days, warnDays, now) {
+        case inactivityWarn:
+            result, err := ut.db.Exec(`UPDATE users SET inactivity_warned_at = NOW()
+                WHERE user_id = ? AND is_active = TRUE AND (inactivity_warned_at IS NULL OR inactivity_warned_at < ?)`, u.userID, u.lastActive)
+            if err != nil {
+                continue
+            }
+            if n, _ := result.RowsAffected(); n > 0 {
+                event("user_inactive", u, endpoint, days, map[string]interface{}{
+                    "disable_after": now.AddDate(0, 0, warnDays).UTC().Format(time.RFC3339),
+                })
+            }
+        case inactivityDisable:
+            result, err := ut.db.Exec("UPDATE users SET is_active = FALSE, inactive_disabled_at = NOW(), updated_at = NOW() WHERE user_id = ? AND is_active = TRUE", u.userID)
+            if err != nil {
+                log.Printf("Failed to disable inactive user %s: %v", u.username, err)
+                continue
+            }
+            if n, _ := result.RowsAffected(); n == 0 {
+                continue
+            }
+            if err := ut.invalidateUserSessions(u.userID, "inactive"); err != nil {
+                log.Printf("Failed to end sessions of inactive user %s: %v", u.username, err)
+            }
+            event("user_disabled_inactive", u, endpoint, days, map[string]interface{}{})
+        }
+    }
+    
+    for _, k := range keys {
+        days, ok := keyDays[k.role]
+        if !ok {
+            days = keyDays[""]
+        }
+        endpoint := "/api/v1/api-keys/" + k.id
+        details := map[string]interface{}{"api_key": k.id, "client_name": k.name}
+        switch inactivityAction(k.lastActive, k.warnedAt, days, warnDays, now) {
+        case inactivityWarn:
+            result, err := ut.db.Exec(`UPDATE api_keys SET inactivity_warned_at = NOW()
+                WHERE api_key = ? AND is_active = TRUE AND (inactivity_warned_at IS NULL OR inactivity_warned_at < ?)`, k.id, k.lastActive)
+            if err != nil {
+                continue
+            }
+            if n, _ := result.RowsAffected(); n > 0 {
+                details["disable_after"] = now.AddDate(0, 0, warnDays).UTC().Format(time.RFC3339)
+                event("api_key_stale", k, endpoint, days, details)
+            }
+        case inactivityDisable:
+            result, err := ut.db.Exec("UPDATE api_keys SET is_active = FALSE, inactive_disabled_at = NOW() WHERE api_key = ? AND is_active = TRUE", k.id)
+            if err != nil {
+                log.Printf("Failed to deactivate stale API key %s: %v", k.name, err)
+                continue
+            }
+            if n, _ := result.RowsAffected(); n > 0 {
+                event("api_key_disabled_stale", k, endpoint, days, details)
+            }
+        }
+    }
+}
+
+// inactivityStats counts what the inactivity policies have disabled, and
+// what they have warned about and will disable unless it is used
+func (ut *UnifiedTokenizer) inactivityStats() map[string]interface{} {
+    stats := map[string]interface{}{
+        "inactive_user_days": ut.inactivity.userDays,
+        "stale_api_key_days": ut.inactivity.keyDays,
+        "warning_days":       ut.inactivity.warningDays,
+    }
+    for name, query := range map[string]string{
+        "users_disabled": "SELECT COUNT(*) FROM users WHERE is_active = FALSE AND inactive_disabled_at IS NOT NULL",
+        "users_warned": `SELECT COUNT(*) FROM users WHERE is_active = TRUE AND inactivity_warned_at IS NOT NULL
+            AND inactivity_warned_at >= GREATEST(created_at, COALESCE(last_login_at, created_at), COALESCE(reactivated_at, created_at))`,
+        "api_keys_disabled": "SELECT COUNT(*) FROM api_keys WHERE is_active = FALSE AND inactive_disabled_at IS NOT NULL",
+        "api_keys_warned": `SELECT COUNT(*) FROM api_keys WHERE is_active = TRUE AND inactivity_warned_at IS NOT NULL
+            AND inactivity_warned_at >= COALESCE(last_used_at, created_at)`,
+    } {
+        var n int64
+        if err := ut.db.QueryRow(query).Scan(&n); err == nil {
+            stats[name] = n
+        }
+    }
+    return stats
+}
+
+// apiVersion is reported by /api/v1/version and the OpenAPI document
+const apiVersion = "1.0.0-prototype"
+
+// v1TokensDeprecated is when GET /api/v1/tokens gave way to /api/v2/tokens
+var v1TokensDeprecated = time.Date(2026, 10, 16, 0, 0, 0, 0, time.UTC)
+
+// jsonObject stands for response bodies the handlers build as maps
+var jsonObject = map[string]interface{}{}
+
+// Query parameters shared by several routes
+var (
+    limitParam  = openapi.Param{Name: "limit", Type: "integer", Description: "Maximum number of results"}
+    offsetParam = openapi.Param{Name: "offset", Type: "integer", Description: "Number of results to skip"}
+)
+
+// tokenListParams are the query parameters of the token lists
+var tokenListParams = []openapi.Param{
+    limitParam, offsetParam,
+    {Name: "tag", Type: "string", Description: "Only tokens with this tag, as key=value", Repeated: true},
+}
+
+// apiRoutes describes the management API for its OpenAPI document. Every
+// route apiHandler serves is listed here under the version that registers
+// it, with the request type its handler decodes.
+func (ut *UnifiedTokenizer) apiRoutes() []openapi.Route {
+    routes := []openapi.Route{
+        {Method: "GET", Path: "/health", Tag: "System", Summary: "Service and database health", Public: true, Response: jsonObject},
+        {Method: "GET", Path: "/api/v1/version", Tag: "System", Summary: "Version and enabled features", Public: true, Response: jsonObject},
+        {Method: "GET", Path: "/api/v1/openapi.json", Tag: "System", Summary: "This OpenAPI document", Public: true, Response: jsonObject},
+        {Method: "GET", Path: "/api/v1/unseal", Tag: "System", Summary: "Seal status", Public: true, Response: jsonObject},
+        {Method: "POST", Path: "/api/v1/unseal", Tag: "System", Summary: "Submit a key share", Public: true, Request: UnsealShareRequest{}, Response: jsonObject},
+
+        {Method: "POST", Path: "/api/v1/auth/login", Tag: "Authentication", Summary: "Log in and start a session", Public: true, Request: AuthRequest{}, Response: AuthResponse{}},
+        {Method: "POST", Path: "/api/v1/auth/logout", Tag: "Authentication", Summary: "End the current session, if any", Public: true, Response: jsonObject},
+        {Method: "GET", Path: "/api/v1/auth/me", Tag: "Authentication", Summary: "The logged-in user", Response: User{}},
+        {Method: "PUT", Path: "/api/v1/auth/me", Tag: "Authentication", Summary: "Update your name or email", Request: UpdateProfileRequest{}, Response: jsonObject,
+            Description: "Changing the email needs current_password and marks the address unverified; a verification link is mailed to the new address."},
+        {Method: "POST", Path: "/api/v1/auth/change-password", Tag: "Authentication", Summary: "Change your password", Request: ChangePasswordRequest{}, Response: jsonObject},
+        {Method: "POST", Path: "/api/v1/auth/reauthenticate", Tag: "Authentication", Summary: "Confirm your password to use the session from a new network or browser", Request: ReauthenticateRequest{}, Response: jsonObject,
+            Description: "Lifts a reauthentication_required refusal under SESSION_BINDING=step_up. A wrong password ends the session."},
+        {Method: "POST", Path: "/api/v1/auth/verify-email/send", Tag: "Authentication", Summary: "Mail yourself a new email verification link", Response: jsonObject},
+        {Method: "POST", Path: "/api/v1/auth/verify-email", Tag: "Authentication", Summary: "Verify an email address with a mailed token", Public: true, Request: AccountTokenRequest{}, Response: jsonObject},
+        {Method: "POST", Path: "/api/v1/auth/forgot-password", Tag: "Authentication", Summary: "Mail a password reset link", Public: true, Request: ForgotPasswordRequest{}, Response: jsonObject, Status: http.StatusAccepted,
+            Description: "Answers 202 with the same message whether or not the account exists. The link goes only to the verified email of an active account."},
+        {Method: "POST", Path: "/api/v1/auth/reset-password", Tag: "Authentication", Summary: "Set a new password with a mailed reset token", Public: true, Request: ResetPasswordRequest{}, Response: jsonObject},
+
+        {Method: "GET", Path: "/api/v1/users", Tag: "Users", Summary: "List users", Permission: PermUsersRead, Response: jsonObject},
+        {Method: "POST", Path: "/api/v1/users", Tag: "Users", Summary: "Create a user", Permission: PermUsersWrite, Request: CreateUserRequest{}, Response: User{}, Status: http.StatusCreated},
+        {Method: "GET", Path: "/api/v1/users/{username}", Tag: "Users", Summary: "Get a user", Permission: PermUsersRead, Response: User{}},
+        {Method: "PUT", Path: "/api/v1/users/{username}", Tag: "Users", Summary: "Update a user", Permission: PermUsersWrite, Request: UpdateUserRequest{}, Response: jsonObject},
+        {Method: "DELETE", Path: "/api/v1/users/{username}", Tag: "Users", Summary: "Delete a user", Permission: PermUsersDelete, Response: jsonObject},
+        {Method: "POST", Path: "/api/v1/users/{username}/reset-password", Tag: "Users", Summary: "Reset a user's password", Permission: PermUsersWrite, Response: jsonObject},
+        {Method: "GET", Path: "/api/v1/roles", Tag: "Users", Summary: "List roles and their permissions", Permission: PermUsersRead, Response: jsonObject},
+        {Method: "POST", Path: "/api/v1/roles", Tag: "Users", Summary: "Create a custom role", Permission: PermSystemAdmin, Request: RoleRequest{}, Response: Role{}, Status: http.StatusCreated},
+        {Method: "GET", Path: "/api/v1/roles/{name}", Tag: "Users", Summary: "Get a role", Permission: PermUsersRead, Response: Role{}},
+        {Method: "PUT", Path: "/api/v1/roles/{name}", Tag: "Users", Summary: "Change a role's description, permissions or inactivity policy", Permission: PermSystemAdmin, Request: RoleRequest{}, Response: Role{},
+            Description: "Takes effect for every user with the role. Only the inactivity policy of the admin role can be changed."},
+        {Method: "DELETE", Path: "/api/v1/roles/{name}", Tag: "Users", Summary: "Delete a custom role no user has", Permission: PermSystemAdmin, Response: jsonObject},
+        {Method: "GET", Path: "/api/v1/permissions", Tag: "Users", Summary: "Permissions roles and users can be granted", Permission: PermUsersRead, Response: jsonObject},
+
+        {Method: "GET", Path: "/api/v1/api-keys", Tag: "API Keys", Summary: "List API keys", Permission: PermAPIKeysRead, Response: jsonObject,
+            Description: "Callers with api_keys.own instead see only their own keys."},
+        {Method: "POST", Path: "/api/v1/api-keys", Tag: "API Keys", Summary: "Create an API key", Permission: PermAPIKeysWrite, Request: APIKeyRequest{}, Response: jsonObject,
+            Description: "Also allowed with api_keys.own. The key belongs to the caller."},
+        {Method: "DELETE", Path: "/api/v1/api-keys/{api_key}", Tag: "API Keys", Summary: "Revoke an API key", Permission: PermAPIKeysDelete, Response: jsonObject,
+            Description: "Callers with api_keys.own instead can only revoke their own keys."},
+        {Method: "GET", Path: "/api/v1/client-certs", Tag: "API Keys", Summary: "List client certificate identities", Permission: PermAPIKeysRead, Response: jsonObject},
+        {Method: "POST", Path: "/api/v1/client-certs", Tag: "API Keys", Summary: "Map a client certificate to an identity", Permission: PermAPIKeysWrite, Request: ClientCertRequest{}, Response: jsonObject, Status: http.StatusCreated},
+        {Method: "DELETE", Path: "/api/v1/client-certs/{cert_id}", Tag: "API Keys", Summary: "Revoke a client certificate identity", Permission: PermAPIKeysDelete, Response: jsonObject},
+
+        {Method: "GET", Path: "/api/v1/service-accounts", Tag: "Service Accounts", Summary: "List service accounts and their keys", Permission: PermUsersRead, Response: jsonObject},
+        {Method: "POST", Path: "/api/v1/service-accounts", Tag: "Service Accounts", Summary: "Create a service account", Permission: PermUsersWrite, Request: CreateServiceAccountRequest{}, Response: ServiceAccount{}, Status: http.StatusCreated,
+            Description: "Service accounts cannot log in; they authenticate with API keys that expire."},
+        {Method: "GET", Path: "/api/v1/service-accounts/{name}", Tag: "Service Accounts", Summary: "Get a service account and its keys", Permission: PermUsersRead, Response: ServiceAccount{}},
+        {Method: "DELETE", Path: "/api/v1/service-accounts/{name}", Tag: "Service Accounts", Summary: "Delete a service account and its keys", Permission: PermUsersDelete, Response: jsonObject},
+        {Method: "POST", Path: "/api/v1/service-accounts/{name}/keys", Tag: "Service Accounts", Summary: "Issue an expiring API key", Permission: PermUsersWrite, Request: ServiceAccountKeyRequest{}, Response: ServiceAccountKey{}, Status: http.StatusCreated,
+            Description: "expires_in_days defaults to, and may not exceed, SERVICE_ACCOUNT_KEY_DAYS."},
+        {Method: "POST", Path: "/api/v1/service-accounts/{name}/keys/{api_key}/rotate", Tag: "Service Accounts", Summary: "Replace a key, keeping the old one for an overlap", Permission: PermUsersWrite, Request: RotateServiceAccountKeyRequest{}, Response: RotatedServiceAccountKey{}, Status: http.StatusCreated},
+
+        {Method: "GET", Path: "/api/v1/tokens", Tag: "Tokens", Summary: "List tokens", Permission: PermTokensRead, Response: jsonObject, Query: tokenListParams,
+            Deprecated: true, Description: "Use GET /api/v2/tokens"},
+        {Method: "GET", Path: "/api/v2/tokens", Tag: "Tokens", Summary: "List tokens", Permission: PermTokensRead, Response: listEnvelope{}, Query: tokenListParams,
+            Description: "Callers with tokens.own instead see only the cards imported for them."},
+        {Method: "POST", Path: "/api/v1/tokens/search", Tag: "Tokens", Summary: "Search tokens", Permission: PermTokensRead, Request: TokenSearchRequest{}, Response: jsonObject,
+            Description: "Callers with tokens.own instead find only the cards imported for them."},
+        {Method: "POST", Path: "/api/v1/tokens/bulk", Tag: "Tokens", Summary: "Apply an operation to many tokens", Permission: PermTokensWrite, Request: BulkTokenRequest{}, Response: jsonObject,
+            Description: "revoke and restore also need tokens.delete"},
+        {Method: "GET", Path: "/api/v1/tokens/{token}", Tag: "Tokens", Summary: "Get a token's details", Permission: PermTokensRead, Response: jsonObject,
+            Description: "Callers with tokens.own instead only see the cards imported for them; others' are not found."},
+        {Method: "DELETE", Path: "/api/v1/tokens/{token}", Tag: "Tokens", Summary: "Revoke a token", Permission: PermTokensDelete, Response: jsonObject,
+            Description: "Callers with tokens.own instead can only revoke the cards imported for them."},
+        {Method: "POST", Path: "/api/v1/tokens/{token}/restore", Tag: "Tokens", Summary: "Restore a revoked token", Permission: PermTokensDelete, Response: jsonObject},
+        {Method: "GET", Path: "/api/v1/tokens/{token}/tags", Tag: "Tokens", Summary: "Get a token's tags", Permission: PermTokensRead, Response: jsonObject},
+        {Method: "PUT", Path: "/api/v1/tokens/{token}/tags", Tag: "Tokens", Summary: "Replace a token's tags", Permission: PermTokensWrite, Request: TokenTagsRequest{}, Response: jsonObject},
+        {Method: "GET", Path: "/api/v1/tokens/{token}/activity", Tag: "Tokens", Summary: "A token's request history", Permission: PermActivityRead, Response: jsonObject, Query: []openapi.Param{limitParam, offsetParam}},
+        {Method: "GET", Path: "/api/v1/tokens/{token}/reveal", Tag: "Tokens", Summary: "Reveal a masked card", Permission: PermTokensRead, Response: jsonObject},
+        {Method: "POST", Path: "/api/v1/tokens/{token}/reveal", Tag: "Tokens", Summary: "Reveal the full card number", Permission: PermTokensDetokenize, Request: RevealRequest{}, Response: jsonObject},
+        {Method: "GET", Path: "/api/v1/tokens/{token}/network-token", Tag: "Tokens", Summary: "Get a token's network token", Permission: PermTokensRead, Response: NetworkToken{}},
+        {Method: "POST", Path: "/api/v1/tokens/{token}/network-token", Tag: "Tokens", Summary: "Request a network token from the card's scheme", Permission: PermTokensWrite, Response: NetworkToken{}, Status: http.StatusCreated,
+            Description: "The card's scheme needs a NETWORK_TOKEN_CONNECTORS entry. The card number is sent to the scheme's token service."},
+        {Method: "POST", Path: "/api/v1/tokens/{token}/network-token/cryptogram", Tag: "Tokens", Summary: "Get the network token with a cryptogram for a transaction", Permission: PermTokensDetokenize, Request: CryptogramRequest{}, Response: CryptogramResponse{}},
+        {Method: "DELETE", Path: "/api/v1/tokens/{token}/network-token", Tag: "Tokens", Summary: "Delete a token's network token at the scheme", Permission: PermTokensDelete, Response: jsonObject},
+        {Method: "POST", Path: "/api/v1/cards/import", Tag: "Tokens", Summary: "Import cards", Permission: PermSystemAdmin, Request: CardImportRequest{}, Response: CardImportResult{},
+            Description: "data is a base64 encoded JSON array of CardImportRecord, CSV with the same columns, or fixed-width records laid out by fixed_width. The cards belong to owner, who can list, search, read and revoke them with tokens.own."},
+
+        {Method: "GET", Path: "/api/v1/quotas", Tag: "Quotas", Summary: "List detokenization quotas", Permission: PermSystemAdmin, Response: jsonObject},
+        {Method: "GET", Path: "/api/v1/quotas/me", Tag: "Quotas", Summary: "Your detokenization quota", Permission: PermTokensDetokenize, Response: jsonObject},
+    }
+    for _, subject := range []string{"/api/v1/quotas/users/{user_id}", "/api/v1/quotas/api-keys/{api_key}", "/api/v1/quotas/client-certs/{cert_id}"} {
+        routes = append(routes,
+            openapi.Route{Method: "GET", Path: subject, Tag: "Quotas", Summary: "Get a quota", Permission: PermSystemAdmin, Response: QuotaStatus{}},
+            openapi.Route{Method: "PUT", Path: subject, Tag: "Quotas", Summary: "Override a quota", Permission: PermSystemAdmin, Request: QuotaLimits{}, Response: QuotaStatus{}},
+            openapi.Route{Method: "DELETE", Path: subject, Tag: "Quotas", Summary: "Go back to the default quota", Permission: PermSystemAdmin, Response: QuotaStatus{}},
+        )
+    }
+    
+    routes = append(routes, []openapi.Route{
+        {Method: "GET", Path: "/api/v1/activity", Tag: "Monitoring", Summary: "Recent token activity", Permission: PermActivityRead, Response: jsonObject, Query: []openapi.Param{
+            limitParam,
+            {Name: "type", Type: "string", Description: "tokenize or detokenize"},
+            {Name: "source_ip", Type: "string"},
+            {Name: "token", Type: "string"},
+            {Name: "since_id", Type: "integer", Description: "Only activity after this ID"},
+        }},
+        {Method: "GET", Path: "/api/v1/events/stream", Tag: "Monitoring", Summary: "Server-Sent Events stream of activity and security events", Permission: PermActivityRead,
+            Description: "Security events need system.admin", Query: []openapi.Param{
+                {Name: "types", Type: "string", Description: "Comma-separated event types (default: activity)"},
+                {Name: "type", Type: "string"},
+                {Name: "source_ip", Type: "string"},
+                {Name: "token", Type: "string"},
+            }},
+        {Method: "GET", Path: "/api/v1/stats", Tag: "Monitoring", Summary: "Token and request statistics", Permission: PermStatsRead, Response: jsonObject},
+        {Method: "POST", Path: "/api/v1/stats/recount", Tag: "Monitoring", Summary: "Recount the active tokens", Permission: PermSystemAdmin, Response: jsonObject,
+            Description: "Sets the cached active token count from a count of credit_cards"},
+        {Method: "GET", Path: "/api/v1/stats/timeseries", Tag: "Monitoring", Summary: "Request counts over time", Permission: PermStatsRead, Response: jsonObject, Query: []openapi.Param{
+            {Name: "start", Type: "string", Description: "RFC 3339 time"},
+            {Name: "end", Type: "string", Description: "RFC 3339 time"},
+            {Name: "interval", Type: "string", Description: "Bucket size, like 1h"},
+            {Name: "group_by", Type: "string"},
+            {Name: "request_type", Type: "string"},
+        }},
+        {Method: "GET", Path: "/api/v1/status/summary", Tag: "Monitoring", Summary: "Data for the status page", Permission: PermStatsRead, Response: jsonObject},
+        {Method: "GET", Path: "/api/v1/audit-archives", Tag: "Audit Archives", Summary: "Archives of audit log rows past their retention", Permission: PermSystemAdmin, Response: jsonObject, Query: []openapi.Param{
+            {Name: "table", Type: "string", Description: "user_audit_log or security_audit_log"},
+            {Name: "start", Type: "string", Description: "RFC 3339 time; archives with rows after it"},
+            {Name: "end", Type: "string", Description: "RFC 3339 time; archives with rows before it"},
+        }},
+        {Method: "GET", Path: "/api/v1/audit-archives/{archive_id}/events", Tag: "Audit Archives", Summary: "Rows of an archive, checked against its signature", Permission: PermSystemAdmin, Response: jsonObject, Query: []openapi.Param{
+            {Name: "start", Type: "string", Description: "RFC 3339 time"},
+            {Name: "end", Type: "string", Description: "RFC 3339 time"},
+            {Name: "event_type", Type: "string"},
+            {Name: "severity", Type: "string"},
+            {Name: "user_id", Type: "string"},
+            {Name: "username", Type: "string"},
+            {Name: "ip_address", Type: "string"},
+            {Name: "action", Type: "string"},
+            {Name: "resource_type", Type: "string"},
+            {Name: "resource_id", Type: "string"},
+            {Name: "limit", Type: "integer", Description: "At most 10000 (default 1000)"},
+        }, Description: "The archive is fetched from AUDIT_LOG_ARCHIVE storage and refused, with an audit_archive_tampered security event, if it does not match its digest and signature. Details are decrypted. Reading an archive is recorded in the audit log."},
+        {Method: "GET", Path: "/api/v1/reports/compliance", Tag: "Reports", Summary: "Signed compliance report", Permission: PermSystemAdmin, Response: ComplianceReport{}, Query: []openapi.Param{
+            {Name: "quarter", Type: "string", Description: "Calendar quarter, like 2024-Q1; replaces start and end"},
+            {Name: "start", Type: "string", Description: "RFC 3339 time or date (default 90 days before end)"},
+            {Name: "end", Type: "string", Description: "RFC 3339 time, or date including its whole day (default now)"},
+            {Name: "format", Type: "string", Description: "json (default) or pdf"},
+        }, Description: "Key ages and rotations, user access review, token volumes and detokenization access over a period of at most 366 days. The Ed25519 signature of the body is returned in X-Report-Signature, base64, and the signing key's ID in X-Report-Signing-Key. Each report is recorded in the audit log."},
+        {Method: "GET", Path: "/api/v1/reports/signing-key", Tag: "Reports", Summary: "Public key compliance reports are signed with", Permission: PermSystemAdmin, Response: jsonObject},
+        {Method: "GET", Path: "/api/v1/access-reviews", Tag: "Access Reviews", Summary: "List access reviews", Permission: PermSystemAdmin, Response: jsonObject},
+        {Method: "POST", Path: "/api/v1/access-reviews", Tag: "Access Reviews", Summary: "Start an access review of every active account and API key", Permission: PermSystemAdmin, Request: CreateAccessReviewRequest{}, Response: AccessReview{}, Status: http.StatusCreated,
+            Description: "Fails with 409 while another review is open. Accounts and keys still pending at the deadline are disabled unless ACCESS_REVIEW_DISABLE_UNREVIEWED is false."},
+        {Method: "GET", Path: "/api/v1/access-reviews/{review_id}", Tag: "Access Reviews", Summary: "Get an access review and its items", Permission: PermSystemAdmin, Response: AccessReview{}, Query: []openapi.Param{
+            {Name: "decision", Description: "Only items with this decision: pending, confirmed, revoked or expired"},
+        }},
+        {Method: "POST", Path: "/api/v1/access-reviews/{review_id}/items/{item_id}", Tag: "Access Reviews", Summary: "Confirm or revoke an account or API key", Permission: PermSystemAdmin, Request: AccessReviewDecisionRequest{}, Response: jsonObject,
+            Description: "Revoking disables the account and ends its sessions, or deactivates the key, at once. Nobody can decide on their own account or keys."},
+        {Method: "POST", Path: "/api/v1/access-reviews/{review_id}/close", Tag: "Access Reviews", Summary: "Close an access review before its deadline", Permission: PermSystemAdmin, Response: AccessReview{}},
+        {Method: "GET", Path: "/api/v1/notifications", Tag: "Monitoring", Summary: "Notification channels and their delivery counts", Permission: PermSystemAdmin, Response: jsonObject},
+        {Method: "POST", Path: "/api/v1/notifications/test", Tag: "Monitoring", Summary: "Send a test notification", Permission: PermSystemAdmin, Request: NotificationTestRequest{}, Response: jsonObject,
+            Description: "Sent to the named channel, or to every channel, whatever its routing and throttle"},
+
+        {Method: "GET", Path: "/api/v1/integrity/checks", Tag: "Integrity", Summary: "List integrity checks", Permission: PermSystemAdmin, Response: jsonObject, Query: []openapi.Param{limitParam}},
+        {Method: "POST", Path: "/api/v1/integrity/checks", Tag: "Integrity", Summary: "Start an integrity check", Permission: PermSystemAdmin, Response: jsonObject, Status: http.StatusAccepted},
+        {Method: "GET", Path: "/api/v1/integrity/checks/{check_id}", Tag: "Integrity", Summary: "An integrity check's report", Permission: PermSystemAdmin, Response: IntegrityReport{}},
+
+        {Method: "GET", Path: "/api/v1/rate-limits", Tag: "Security Policy", Summary: "Rate-limit rules", Permission: PermSystemAdmin, Response: RateLimitState{}},
+        {Method: "PUT", Path: "/api/v1/rate-limits", Tag: "Security Policy", Summary: "Replace the rate-limit rules", Permission: PermSystemAdmin, Request: RateLimitRulesRequest{}, Response: RateLimitState{}},
+        {Method: "DELETE", Path: "/api/v1/rate-limits", Tag: "Security Policy", Summary: "Go back to RATE_LIMIT_RULES", Permission: PermSystemAdmin, Response: RateLimitState{}},
+        {Method: "GET", Path: "/api/v1/cors", Tag: "Security Policy", Summary: "CORS policy", Permission: PermSystemAdmin, Response: CORSPolicyState{}},
+        {Method: "PUT", Path: "/api/v1/cors", Tag: "Security Policy", Summary: "Replace the CORS policy", Permission: PermSystemAdmin, Request: cors.Policy{}, Response: CORSPolicyState{}},
+        {Method: "DELETE", Path: "/api/v1/cors", Tag: "Security Policy", Summary: "Go back to CORS_ALLOWED_ORIGINS", Permission: PermSystemAdmin, Response: CORSPolicyState{}},
+        {Method: "GET", Path: "/api/v1/maintenance", Tag: "Security Policy", Summary: "Maintenance mode and config freeze", Permission: PermSystemAdmin, Response: MaintenanceState{}},
+        {Method: "PUT", Path: "/api/v1/maintenance", Tag: "Security Policy", Summary: "Set maintenance mode and the config freeze", Permission: PermSystemAdmin, Request: Maintenance{}, Response: MaintenanceState{}},
+        {Method: "DELETE", Path: "/api/v1/maintenance", Tag: "Security Policy", Summary: "End maintenance mode and the config freeze", Permission: PermSystemAdmin, Response: MaintenanceState{}},
+        {Method: "GET", Path: "/api/v1/config/field-rules", Tag: "Security Policy", Summary: "Card field rules for proxied JSON", Permission: PermSystemAdmin, Response: FieldRulesState{}},
+        {Method: "PUT", Path: "/api/v1/config/field-rules", Tag: "Security Policy", Summary: "Replace the card field rules", Permission: PermSystemAdmin, Request: FieldRules{}, Response: FieldRulesState{}},
+        {Method: "DELETE", Path: "/api/v1/config/field-rules", Tag: "Security Policy", Summary: "Go back to CARD_FIELD_MAPPINGS and DEEP_SCAN_FIELDS", Permission: PermSystemAdmin, Response: FieldRulesState{}},
+        {Method: "POST", Path: "/api/v1/config/field-rules/test", Tag: "Security Policy", Summary: "Show what the proxy would tokenize in a sample body", Permission: PermSystemAdmin, Request: FieldRuleTestRequest{}, Response: FieldRuleTestResult{},
+            Description: "Nothing is stored; rules given in the request are tested instead of those in force"},
+        {Method: "GET", Path: "/api/v1/ip-filters", Tag: "Security Policy", Summary: "IP filters of both listeners", Permission: PermSystemAdmin, Response: jsonObject},
+        {Method: "GET", Path: "/api/v1/ip-filters/{listener}", Tag: "Security Policy", Summary: "IP filter of the api or icap listener", Permission: PermSystemAdmin, Response: IPFilterState{}},
+        {Method: "PUT", Path: "/api/v1/ip-filters/{listener}", Tag: "Security Policy", Summary: "Replace an IP filter", Permission: PermSystemAdmin, Request: ipfilter.Filter{}, Response: IPFilterState{}},
+        {Method: "DELETE", Path: "/api/v1/ip-filters/{listener}", Tag: "Security Policy", Summary: "Go back to the configured IP filter", Permission: PermSystemAdmin, Response: IPFilterState{}},
+    }...)
+    
+    // Mirrors apiHandler, which only serves key management with KEK/DEK
+    if ut.useKEKDEK {
+        routes = append(routes, []openapi.Route{
+            {Method: "GET", Path: "/api/v1/keys/status", Tag: "Keys", Summary: "KEK and DEK status", Permission: PermSystemAdmin, Response: jsonObject},
+            {Method: "POST", Path: "/api/v1/keys/rotate", Tag: "Keys", Summary: "Rotate keys", Permission: PermSystemAdmin, Request: KeyRotationRequest{}, Response: jsonObject},
+            {Method: "GET", Path: "/api/v1/keys/rotations", Tag: "Keys", Summary: "Key rotation history", Permission: PermSystemAdmin, Response: jsonObject, Query: []openapi.Param{limitParam}},
+            {Method: "GET", Path: "/api/v1/keys/rotations/{rotation_id}", Tag: "Keys", Summary: "A key rotation", Permission: PermSystemAdmin, Response: jsonObject},
+            {Method: "POST", Path: "/api/v1/keys/reencrypt", Tag: "Keys", Summary: "Re-encrypt cards off retired DEKs", Permission: PermSystemAdmin, Response: jsonObject, Status: http.StatusAccepted},
+            {Method: "GET", Path: "/api/v1/keys/policies", Tag: "Keys", Summary: "Rotation policies", Permission: PermSystemAdmin, Response: jsonObject},
+            {Method: "PUT", Path: "/api/v1/keys/policies/{key_type}", Tag: "Keys", Summary: "Set the rotation policy of KEK or DEK", Permission: PermSystemAdmin, Request: RotationPolicyRequest{}, Response: RotationPolicy{}},
+            {Method: "DELETE", Path: "/api/v1/keys/policies/{key_type}", Tag: "Keys", Summary: "Delete a rotation policy", Permission: PermSystemAdmin, Response: jsonObject},
+        }...)
+    }
+    return routes
+}
+
+// apiCompressionMinSize is the smallest API response gzipped; smaller ones
+// gain little
+const apiCompressionMinSize = 1024
+
+// apiHandler routes the management API
+func (ut *UnifiedTokenizer) apiHandler() http.Handler {
+    // Version 1 holds every endpoint; later versions register only what
+    // they change and fall back to v1 for the rest
+    router := apiversion.New(2)
+    router.OnDeprecated = func(r *http.Request, version int, pattern string) {
+        atomic.AddInt64(&ut.deprecatedRequests, 1)
+    }
+    mux := router.Mux(1)
+    
+    // Health check and version (no auth required)
+    mux.HandleFunc("/health", ut.handleAPIHealth)
+    mux.HandleFunc("/readyz", ut.handleReadyz)
+    mux.HandleFunc("/api/v1/version", ut.handleGetVersion)
+    mux.Handle("/api/v1/openapi.json", openapi.Handler(openapi.Build(openapi.Info{
+        Title:       "TokenShield Management API",
+        Version:     apiVersion,
+        Description: "Token, user, key and policy management for TokenShield",
+    }, ut.apiRoutes())))
+    if ut.swaggerUI {
+        mux.Handle("/api/v1/docs", openapi.UIHandler())
+    }
+    mux.HandleFunc("/metrics", ut.handleMetrics)
+    
+    // Key shares for sealed-boot mode (no auth: a key share is itself the credential)
+    mux.HandleFunc("/api/v1/unseal", ut.handleUnseal)
+    
+    // Authentication endpoints (no auth required, but rate limited and validated)
+    mux.HandleFunc("/api/v1/auth/login", ut.validationMiddleware("/api/v1/auth/login")(ut.handleLogin))
+    mux.HandleFunc("/api/v1/auth/logout", ut.handleLogout)
+    mux.HandleFunc("/api/v1/auth/me", func(w http.ResponseWriter, r *http.Request) {
+        switch r.Method {
+        case "GET":
+            ut.handleGetCurrentUser(w, r)
+        case "PUT":
+            ut.validationMiddleware("/api/v1/auth/me")(ut.handleUpdateProfile)(w, r)
+        default:
+            apierror.Write(w, r, http.StatusMethodNotAllowed, apierror.MethodNotAllowed, "Method not allowed")
+        }
+    })
+    mux.HandleFunc("/api/v1/auth/change-password", ut.validationMiddleware("/api/v1/auth/change-password")(ut.handleChangePassword))
+    mux.HandleFunc("/api/v1/auth/reauthenticate", ut.validationMiddleware("/api/v1/auth/reauthenticate")(ut.handleReauthenticate))
+    mux.HandleFunc("/api/v1/auth/verify-email/send", ut.handleSendVerificationEmail)
+    mux.HandleFunc("/api/v1/auth/verify-email", ut.validationMiddleware("/api/v1/auth/verify-email")(ut.handleVerifyEmail))
+    mux.HandleFunc("/api/v1/auth/forgot-password", ut.validationMiddleware("/api/v1/auth/forgot-password")(ut.handleForgotPassword))
+    mux.HandleFunc("/api/v1/auth/reset-password", ut.validationMiddleware("/api/v1/auth/reset-password")(ut.handleResetPassword))
+    
+    // API Key management (requires permissions and validation)
+    mux.HandleFunc("/api/v1/api-keys", func(w http.ResponseWriter, r *http.Request) {
+        switch r.Method {
+        case "GET":
+            ut.requireAnyPermission(ut.handleListAPIKeys, PermAPIKeysRead, PermAPIKeysOwn)(w, r)
+        case "POST":
+            ut.validationMiddleware("/api/v1/api-keys")(ut.requireAnyPermission(ut.handleCreateAPIKey, PermAPIKeysWrite, PermAPIKeysOwn))(w, r)
+        default:
+            apierror.Write(w, r, http.StatusMethodNotAllowed, apierror.MethodNotAllowed, "Method not allowed")
+        }
+    })
+    
+    mux.HandleFunc("/api/v1/api-keys/", func(w http.ResponseWriter, r *http.Request) {
+        switch r.Method {
+        case "DELETE":
+            ut.requireAnyPermission(ut.handleRevokeAPIKey, PermAPIKeysDelete, PermAPIKeysOwn)(w, r)
+        default:
+            apierror.Write(w, r, http.StatusMethodNotAllowed, apierror.MethodNotAllowed, "Method not allowed")
+        }
+    })
+    
+    // Service accounts: identities for integrations, with expiring keys
+    mux.HandleFunc("/api/v1/service-accounts", func(w http.ResponseWriter, r *http.Request) {
+        switch r.Method {
+        case "GET":
+            ut.requirePermission(ut.handleListServiceAccounts, PermUsersRead)(w, r)
+        case "POST":
+            ut.validationMiddleware("/api/v1/service-accounts")(ut.requirePermission(ut.handleCreateServiceAccount, PermUsersWrite))(w, r)
+        default:
+            apierror.Write(w, r, http.StatusMethodNotAllowed, apierror.MethodNotAllowed, "Method not allowed")
+        }
+    })
+    
+    mux.HandleFunc("/api/v1/service-accounts/", func(w http.ResponseWriter, r *http.Request) {
+        _, _, action, ok := serviceAccountPath(r.URL.Path)
+        switch {
+        case !ok:
+            apierror.Write(w, r, http.StatusNotFound, apierror.NotFound, "Not found")
+        case action == "" && r.Method == "GET":
+            ut.requirePermission(ut.handleGetServiceAccount, PermUsersRead)(w, r)
+        case action == "" && r.Method == "DELETE":
+            ut.requirePermission(ut.handleDeleteServiceAccount, PermUsersDelete)(w, r)
+        case action == "keys" && r.Method == "POST":
+            ut.validationMiddleware("/api/v1/service-accounts/{name}/keys")(ut.requirePermission(ut.handleCreateServiceAccountKey, PermUsersWrite))(w, r)
+        case action == "rotate" && r.Method == "POST":
+            ut.validationMiddleware("/api/v1/service-accounts/{name}/keys/{api_key}/rotate")(ut.requirePermission(ut.handleRotateServiceAccountKey, PermUsersWrite))(w, r)
+        default:
+            apierror.Write(w, r, http.StatusMethodNotAllowed, apierror.MethodNotAllowed, "Method not allowed")
+        }
+    })
+    
+    // Audit log rows exported past their retention
+    mux.HandleFunc("/api/v1/audit-archives", func(w http.ResponseWriter, r *http.Request) {
+        if r.Method != "GET" {
+            apierror.Write(w, r, http.StatusMethodNotAllowed, apierror.MethodNotAllowed, "Method not allowed")
+            return
+        }
+        ut.requirePermission(ut.handleListAuditArchives, PermSystemAdmin)(w, r)
+    })
+    mux.HandleFunc("/api/v1/audit-archives/", func(w http.ResponseWriter, r *http.Request) {
+        switch {
+        case !strings.HasSuffix(r.URL.Path, "/events"):
+            apierror.Write(w, r, http.StatusNotFound, apierror.NotFound, "Not found")
+        case r.Method != "GET":
+            apierror.Write(w, r, http.StatusMethodNotAllowed, apierror.MethodNotAllowed, "Method not allowed")
+        default:
+            ut.requirePermission(ut.handleQueryAuditArchive, PermSystemAdmin)(w, r)
+        }
+    })
+    
+    // Compliance reports for auditors
+    mux.HandleFunc("/api/v1/reports/compliance", func(w http.ResponseWriter, r *http.Request) {
+        if r.Method != "GET" {
+            apierror.Write(w, r, http.StatusMethodNotAllowed, apierror.MethodNotAllowed, "Method not allowed")
+            return
+        }
+        ut.requirePermission(ut.handleComplianceReport, PermSystemAdmin)(w, r)
+    })
+    mux.HandleFunc("/api/v1/reports/signing-key", func(w http.ResponseWriter, r *http.Request) {
+        if r.Method != "GET" {
+            apierror.Write(w, r, http.StatusMethodNotAllowed, apierror.MethodNotAllowed, "Method not allowed")
+            return
+        }
+        ut.requirePermission(ut.handleReportSigningKey, PermSystemAdmin)(w, r)
+    })
+    
+    // Access reviews: confirm or revoke every account and API key
+    mux.HandleFunc("/api/v1/access-reviews", func(w http.ResponseWriter, r *http.Request) {
+        switch r.Method {
+        case "GET":
+            ut.requirePermission(ut.handleListAccessReviews, PermSystemAdmin)(w, r)
+        case "POST":
+            ut.validationMiddleware("/api/v1/access-reviews")(ut.requirePermission(ut.handleCreateAccessReview, PermSystemAdmin))(w, r)
+        default:
+            apierror.Write(w, r, http.StatusMethodNotAllowed, apierror.MethodNotAllowed, "Method not allowed")
+        }
+    })
+    mux.HandleFunc("/api/v1/access-reviews/", func(w http.ResponseWriter, r *http.Request) {
+        _, _, action, ok := accessReviewPath(r.URL.Path)
+        switch {
+        case !ok:
+            apierror.Write(w, r, http.StatusNotFound, apierror.NotFound, "Not found")
+        case action == "" && r.Method == "GET":
+            ut.requirePermission(ut.handleGetAccessReview, PermSystemAdmin)(w, r)
+        case action == "item" && r.Method == "POST":
+            ut.validationMiddleware("/api/v1/access-reviews/{review_id}/items/{item_id}")(ut.requirePermission(ut.handleDecideAccessReviewItem, PermSystemAdmin))(w, r)
+        case action == "close" && r.Method == "POST":
+            ut.requirePermission(ut.handleCloseAccessReview, PermSystemAdmin)(w, r)
+        default:
+            apierror.Write(w, r, http.StatusMethodNotAllowed, apierror.MethodNotAllowed, "Method not allowed")
+        }
+    })
+    
+    // Client certificate identities, managed like API keys
+    mux.HandleFunc("/api/v1/client-certs", func(w http.ResponseWriter, r *http.Request) {
+        switch r.Method {
+        case "GET":
+            ut.requirePermission(ut.handleListClientCerts, PermAPIKeysRead)(w, r)
+        case "POST":
+            ut.validationMiddleware("/api/v1/client-certs")(ut.requirePermission(ut.handleCreateClientCert, PermAPIKeysWrite))(w, r)
+        default:
+            apierror.Write(w, r, http.StatusMethodNotAllowed, apierror.MethodNotAllowed, "Method not allowed")
+        }
+    })
+    
+    mux.HandleFunc("/api/v1/client-certs/", func(w http.ResponseWriter, r *http.Request) {
+        switch r.Method {
+        case "DELETE":
+            ut.requirePermission(ut.handleRevokeClientCert, PermAPIKeysDelete)(w, r)
+        default:
+            apierror.Write(w, r, http.StatusMethodNotAllowed, apierror.MethodNotAllowed, "Method not allowed")
+        }
+    })
+    
+    // Token management (requires permissions)
+    mux.HandleFunc("/api/v1/tokens", func(w http.ResponseWriter, r *http.Request) {
+        switch r.Method {
+        case "GET":
+            ut.requireAnyPermission(ut.handleAPIListTokens, PermTokensRead, PermTokensOwn)(w, r)
+        default:
+            apierror.Write(w, r, http.StatusMethodNotAllowed, apierror.MethodNotAllowed, "Method not allowed")
+        }
+    })
+    router.Deprecate(1, "/api/v1/tokens", apiversion.Deprecation{
+        Method: "GET", Since: v1TokensDeprecated, Sunset: ut.apiV1Sunset, Successor: "/api/v2/tokens",
+    })
+    router.Mux(2).HandleFunc("/api/v2/tokens", func(w http.ResponseWriter, r *http.Request) {
+        switch r.Method {
+        case "GET":
+            ut.requireAnyPermission(ut.handleAPIListTokensV2, PermTokensRead, PermTokensOwn)(w, r)
+        default:
+            apierror.Write(w, r, http.StatusMethodNotAllowed, apierror.MethodNotAllowed, "Method not allowed")
+        }
+    })
+    
+    mux.HandleFunc("/api/v1/tokens/bulk", func(w http.ResponseWriter, r *http.Request) {
+        if r.Method == "POST" {
+            ut.validationMiddleware("/api/v1/tokens/bulk")(ut.requirePermission(ut.handleBulkTokens, PermTokensWrite))(w, r)
+        } else {
+            apierror.Write(w, r, http.StatusMethodNotAllowed, apierror.MethodNotAllowed, "Method not allowed")
+        }
+    })
+    
+    mux.HandleFunc("/api/v1/tokens/search", func(w http.ResponseWriter, r *http.Request) {
+        if r.Method == "POST" {
+            ut.validationMiddleware("/api/v1/tokens/search")(ut.requireAnyPermission(ut.handleSearchTokens, PermTokensRead, PermTokensOwn))(w, r)
+        } else {
+            apierror.Write(w, r, http.StatusMethodNotAllowed, apierror.MethodNotAllowed, "Method not allowed")
+        }
+    })
+    
+    // Individual token operations
+    mux.HandleFunc("/api/v1/tokens/", func(w http.ResponseWriter, r *http.Request) {
+        switch r.Method {
+        case "GET":
+            if strings.HasSuffix(r.URL.Path, "/activity") {
+                ut.requirePermission(ut.handleAPITokenActivity, PermActivityRead)(w, r)
+                return
+            }
+            if strings.HasSuffix(r.URL.Path, "/reveal") {
+                ut.requirePermission(ut.handleAPIRevealToken, PermTokensRead)(w, r)
+                return
+            }
+            if strings.HasSuffix(r.URL.Path, "/tags") {
+                ut.requirePermission(ut.handleAPITokenTags, PermTokensRead)(w, r)
+                return
+            }
+            if strings.HasSuffix(r.URL.Path, "/network-token") {
+                ut.requirePermission(ut.handleAPINetworkToken, PermTokensRead)(w, r)
+                return
+            }
+            ut.requireAnyPermission(ut.handleAPIGetToken, PermTokensRead, PermTokensOwn)(w, r)
+        case "POST":
+            if strings.HasSuffix(r.URL.Path, "/reveal") {
+                ut.requirePermission(ut.handleAPIRevealToken, PermTokensDetokenize)(w, r)
+                return
+            }
+            if strings.HasSuffix(r.URL.Path, "/restore") {
+                ut.requirePermission(ut.handleAPIRestoreToken, PermTokensDelete)(w, r)
+                return
+            }
+            if strings.HasSuffix(r.URL.Path, "/network-token") {
+                ut.requirePermission(ut.handleAPINetworkToken, PermTokensWrite)(w, r)
+                return
+            }
+            if strings.HasSuffix(r.URL.Path, "/network-token/cryptogram") {
+                ut.requirePermission(ut.handleAPINetworkTokenCryptogram, PermTokensDetokenize)(w, r)
+                return
+            }
+            apierror.Write(w, r, http.StatusMethodNotAllowed, apierror.MethodNotAllowed, "Method not allowed")
+        case "PUT":
+            if strings.HasSuffix(r.URL.Path, "/tags") {
+                ut.requirePermission(ut.handleAPITokenTags, PermTokensWrite)(w, r)
+                return
+            }
+            apierror.Write(w, r, http.StatusMethodNotAllowed, apierror.MethodNotAllowed, "Method not allowed")
+        case "DELETE":
+            if strings.HasSuffix(r.URL.Path, "/network-token") {
+                ut.requirePermission(ut.handleAPINetworkToken, PermTokensDelete)(w, r)
+                return
+            }
+            ut.requireAnyPermission(ut.handleAPIRevokeToken, PermTokensDelete, PermTokensOwn)(w, r)
+        default:
+            apierror.Write(w, r, http.StatusMethodNotAllowed, apierror.MethodNotAllowed, "Method not allowed")
+        }
+    })
+    
+    // Detokenization quotas per user and API key
+    mux.HandleFunc("/api/v1/quotas", func(w http.ResponseWriter, r *http.Request) {
+        if r.Method == "GET" {
+            ut.requirePermission(ut.handleQuotas, PermSystemAdmin)(w, r)
+        } else {
+            apierror.Write(w, r, http.StatusMethodNotAllowed, apierror.MethodNotAllowed, "Method not allowed")
+        }
+    })
+    mux.HandleFunc("/api/v1/quotas/", func(w http.ResponseWriter, r *http.Request) {
+        switch {
+        case r.URL.Path == "/api/v1/quotas/me" && r.Method == "GET":
+            ut.requirePermission(ut.handleMyQuota, PermTokensDetokenize)(w, r)
+        case r.URL.Path != "/api/v1/quotas/me" && (r.Method == "GET" || r.Method == "PUT" || r.Method == "DELETE"):
+            ut.requirePermission(ut.handleQuota, PermSystemAdmin)(w, r)
+        default:
+            apierror.Write(w, r, http.StatusMethodNotAllowed, apierror.MethodNotAllowed, "Method not allowed")
+        }
+    })
+    
+    // Activity monitoring
+    mux.HandleFunc("/api/v1/activity", func(w http.ResponseWriter, r *http.Request) {
+        if r.Method == "GET" {
+            ut.requirePermission(ut.handleGetActivity, PermActivityRead)(w, r)
+        } else {
+            apierror.Write(w, r, http.StatusMethodNotAllowed, apierror.MethodNotAllowed, "Method not allowed")
+        }
+    })
+    
+    // Real-time event stream (Server-Sent Events); security events are admin only
+    mux.HandleFunc("/api/v1/events/stream", func(w http.ResponseWriter, r *http.Request) {
+        if r.Method != "GET" {
+            apierror.Write(w, r, http.StatusMethodNotAllowed, apierror.MethodNotAllowed, "Method not allowed")
+            return
+        }
+        permission := PermActivityRead
+        if streamEventTypes(r)[events.TypeSecurity] {
+            permission = PermSystemAdmin
+        }
+        ut.requirePermission(ut.handleEventStream, permission)(w, r)
+    })
+    
+    // Stats
+    mux.HandleFunc("/api/v1/stats", ut.requirePermission(ut.handleAPIStats, PermStatsRead))
+    mux.HandleFunc("/api/v1/stats/recount", func(w http.ResponseWriter, r *http.Request) {
+        if r.Method == "POST" {
+            ut.requirePermission(ut.handleStatsRecount, PermSystemAdmin)(w, r)
+        } else {
+            apierror.Write(w, r, http.StatusMethodNotAllowed, apierror.MethodNotAllowed, "Method not allowed")
+        }
+    })
+    mux.HandleFunc("/api/v1/stats/timeseries", func(w http.ResponseWriter, r *http.Request) {
+        if r.Method == "GET" {
+            ut.requirePermission(ut.handleAPIStatsTimeSeries, PermStatsRead)(w, r)
+        } else {
+            apierror.Write(w, r, http.StatusMethodNotAllowed, apierror.MethodNotAllowed, "Method not allowed")
+        }
+    })
+    
+    // Embedded status page for deployments without the GUI container.
+    // The page is static; its data comes from the authenticated summary endpoint.
+    mux.Handle("/status", statuspage.Handler())
+    mux.HandleFunc("/api/v1/status/summary", func(w http.ResponseWriter, r *http.Request) {
+        if r.Method == "GET" {
+            ut.requirePermission(ut.handleAPIStatusSummary, PermStatsRead)(w, r)
+        } else {
+            apierror.Write(w, r, http.StatusMethodNotAllowed, apierror.MethodNotAllowed, "Method not allowed")
+        }
+    })
+    
+    // Notification channels for security events
+    mux.HandleFunc("/api/v1/notifications", func(w http.ResponseWriter, r *http.Request) {
+        if r.Method == "GET" {
+            ut.requirePermission(ut.handleNotifications, PermSystemAdmin)(w, r)
+        } else {
+            apierror.Write(w, r, http.StatusMethodNotAllowed, apierror.MethodNotAllowed, "Method not allowed")
+        }
+    })
+    mux.HandleFunc("/api/v1/notifications/test", func(w http.ResponseWriter, r *http.Request) {
+        if r.Method == "POST" {
+            ut.requirePermission(ut.handleNotificationTest, PermSystemAdmin)(w, r)
+        } else {
+            apierror.Write(w, r, http.StatusMethodNotAllowed, apierror.MethodNotAllowed, "Method not allowed")
+        }
+    })
+    
+    // Card import endpoint (requires admin permissions and validation)
+    mux.HandleFunc("/api/v1/cards/import", func(w http.ResponseWriter, r *http.Request) {
+        if r.Method == "POST" {
+            ut.validationMiddleware("/api/v1/cards/import")(ut.requirePermission(ut.handleCardImport, PermSystemAdmin))(w, r)
+        } else {
+            apierror.Write(w, r, http.StatusMethodNotAllowed, apierror.MethodNotAllowed, "Method not allowed")
+        }
+    })
+    
+    // Vault integrity checks and their reconciliation reports
+    mux.HandleFunc("/api/v1/integrity/checks", func(w http.ResponseWriter, r *http.Request) {
+        if r.Method == "GET" || r.Method == "POST" {
+            ut.requirePermission(ut.handleIntegrityChecks, PermSystemAdmin)(w, r)
+        } else {
+            apierror.Write(w, r, http.StatusMethodNotAllowed, apierror.MethodNotAllowed, "Method not allowed")
+        }
+    })
+    
+    mux.HandleFunc("/api/v1/integrity/checks/", func(w http.ResponseWriter, r *http.Request) {
+        if r.Method == "GET" {
+            ut.requirePermission(ut.handleIntegrityCheckDetail, PermSystemAdmin)(w, r)
+        } else {
+            apierror.Write(w, r, http.StatusMethodNotAllowed, apierror.MethodNotAllowed, "Method not allowed")
+        }
+    })
+    
+    // Rate-limit rules per endpoint class
+    mux.HandleFunc("/api/v1/rate-limits", func(w http.ResponseWriter, r *http.Request) {
+        if r.Method == "GET" || r.Method == "PUT" || r.Method == "DELETE" {
+            ut.requirePermission(ut.handleRateLimitRules, PermSystemAdmin)(w, r)
+        } else {
+            apierror.Write(w, r, http.StatusMethodNotAllowed, apierror.MethodNotAllowed, "Method not allowed")
+        }
+    })
+    
+    // Cross-origin policy for browser clients
+    mux.HandleFunc("/api/v1/cors", func(w http.ResponseWriter, r *http.Request) {
+        if r.Method == "GET" || r.Method == "PUT" || r.Method == "DELETE" {
+            ut.requirePermission(ut.handleCORSPolicy, PermSystemAdmin)(w, r)
+        } else {
+            apierror.Write(w, r, http.StatusMethodNotAllowed, apierror.MethodNotAllowed, "Method not allowed")
+        }
+    })
+    
+    // Maintenance mode and the config freeze
+    mux.HandleFunc("/api/v1/maintenance", func(w http.ResponseWriter, r *http.Request) {
+        if r.Method == "GET" || r.Method == "PUT" || r.Method == "DELETE" {
+            ut.requirePermission(ut.handleMaintenance, PermSystemAdmin)(w, r)
+        } else {
+            apierror.Write(w, r, http.StatusMethodNotAllowed, apierror.MethodNotAllowed, "Method not allowed")
+        }
+    })
+    
+    // Card field rules for proxied JSON, and a dry run of them on a sample body
+    mux.HandleFunc("/api/v1/config/field-rules", func(w http.ResponseWriter, r *http.Request) {
+        if r.Method == "GET" || r.Method == "PUT" || r.Method == "DELETE" {
+            ut.requirePermission(ut.handleFieldRules, PermSystemAdmin)(w, r)
+        } else {
+            apierror.Write(w, r, http.StatusMethodNotAllowed, apierror.MethodNotAllowed, "Method not allowed")
+        }
+    })
+    mux.HandleFunc("/api/v1/config/field-rules/test", func(w http.ResponseWriter, r *http.Request) {
+        if r.Method == "POST" {
+            ut.requirePermission(ut.handleTestFieldRules, PermSystemAdmin)(w, r)
+        } else {
+            apierror.Write(w, r, http.StatusMethodNotAllowed, apierror.MethodNotAllowed, "Method not allowed")
+        }
+    })
+    
+    // Client address filters for the API and ICAP ports
+    mux.HandleFunc("/api/v1/ip-filters", func(w http.ResponseWriter, r *http.Request) {
+        if r.Method == "GET" {
+            ut.requirePermission(ut.handleIPFilters, PermSystemAdmin)(w, r)
+        } else {
+            apierror.Write(w, r, http.StatusMethodNotAllowed, apierror.MethodNotAllowed, "Method not allowed")
+        }
+    })
+    mux.HandleFunc("/api/v1/ip-filters/", func(w http.ResponseWriter, r *http.Request) {
+        if r.Method == "GET" || r.Method == "PUT" || r.Method == "DELETE" {
+            ut.requirePermission(ut.handleIPFilter, PermSystemAdmin)(w, r)
+        } else {
+            apierror.Write(w, r, http.StatusMethodNotAllowed, apierror.MethodNotAllowed, "Method not allowed")
+        }
+    })
+    
+    // User management endpoints (with validation)
+    mux.HandleFunc("/api/v1/users", func(w http.ResponseWriter, r *http.Request) {
+        switch r.Method {
+        case "GET":
+            ut.requirePermission(ut.handleListUsers, PermUsersRead)(w, r)
+        case "POST":
+            ut.validationMiddleware("/api/v1/users")(ut.requirePermission(ut.handleCreateUser, PermUsersWrite))(w, r)
+        default:
+            apierror.Write(w, r, http.StatusMethodNotAllowed, apierror.MethodNotAllowed, "Method not allowed")
+        }
+    })
+    
+    mux.HandleFunc("/api/v1/roles", func(w http.ResponseWriter, r *http.Request) {
+        switch r.Method {
+        case "GET":
+            ut.requirePermission(ut.handleListRoles, PermUsersRead)(w, r)
+        case "POST":
+            ut.validationMiddleware("/api/v1/roles")(ut.requirePermission(ut.handleCreateRole, PermSystemAdmin))(w, r)
+        default:
+            apierror.Write(w, r, http.StatusMethodNotAllowed, apierror.MethodNotAllowed, "Method not allowed")
+        }
+    })
+    
+    mux.HandleFunc("/api/v1/roles/", func(w http.ResponseWriter, r *http.Request) {
+        switch r.Method {
+        case "GET":
+            ut.requirePermission(ut.handleGetRole, PermUsersRead)(w, r)
+        case "PUT":
+            ut.validationMiddleware("/api/v1/roles/")(ut.requirePermission(ut.handleUpdateRole, PermSystemAdmin))(w, r)
+        case "DELETE":
+            ut.requirePermission(ut.handleDeleteRole, PermSystemAdmin)(w, r)
+        default:
+            apierror.Write(w, r, http.StatusMethodNotAllowed, apierror.MethodNotAllowed, "Method not allowed")
+        }
+    })
+    
+    mux.HandleFunc("/api/v1/permissions", ut.requirePermission(ut.handleListPermissions, PermUsersRead))
+    
+    mux.HandleFunc("/api/v1/users/", func(w http.ResponseWriter, r *http.Request) {
+        switch r.Method {
+        case "GET":
+            ut.requirePermission(ut.handleGetUser, PermUsersRead)(w, r)
+        case "POST":
+            if strings.HasSuffix(r.URL.Path, "/reset-password") {
+                ut.requirePermission(ut.handleResetUserPassword, PermUsersWrite)(w, r)
+                return
+            }
+            apierror.Write(w, r, http.StatusMethodNotAllowed, apierror.MethodNotAllowed, "Method not allowed")
+        case "PUT":
+            ut.requirePermission(ut.handleUpdateUser, PermUsersWrite)(w, r)
+        case "DELETE":
+            ut.requirePermission(ut.handleDeleteUser, PermUsersDelete)(w, r)
+        default:
+            apierror.Write(w, r, http.StatusMethodNotAllowed, apierror.MethodNotAllowed, "Method not allowed")
+        }
+    })
+    
+    // Key management endpoints (if KEK/DEK is enabled)
+    if ut.useKEKDEK {
+        mux.HandleFunc("/api/v1/keys/status", func(w http.ResponseWriter, r *http.Request) {
+            if r.Method == "GET" {
+                ut.requirePermission(ut.handleKeyStatus, PermSystemAdmin)(w, r)
+            } else {
+                apierror.Write(w, r, http.StatusMethodNotAllowed, apierror.MethodNotAllowed, "Method not allowed")
+            }
+        })
+        
+        mux.HandleFunc("/api/v1/keys/rotate", func(w http.ResponseWriter, r *http.Request) {
+            if r.Method == "POST" {
+                ut.requirePermission(ut.handleKeyRotation, PermSystemAdmin)(w, r)
+            } else {
+                apierror.Write(w, r, http.StatusMethodNotAllowed, apierror.MethodNotAllowed, "Method not allowed")
+            }
+        })
+        
+        mux.HandleFunc("/api/v1/keys/rotations", func(w http.ResponseWriter, r *http.Request) {
+            if r.Method == "GET" {
+                ut.requirePermission(ut.handleKeyRotationHistory, PermSystemAdmin)(w, r)
+            } else {
+                apierror.Write(w, r, http.StatusMethodNotAllowed, apierror.MethodNotAllowed, "Method not allowed")
+            }
+        })
+        
+        mux.HandleFunc("/api/v1/keys/rotations/", func(w http.ResponseWriter, r *http.Request) {
+            if r.Method == "GET" {
+                ut.requirePermission(ut.handleKeyRotationDetail, PermSystemAdmin)(w, r)
+            } else {
+                apierror.Write(w, r, http.StatusMethodNotAllowed, apierror.MethodNotAllowed, "Method not allowed")
+            }
+        })
+        
+        mux.HandleFunc("/api/v1/keys/reencrypt", func(w http.ResponseWriter, r *http.Request) {
+            if r.Method == "POST" {
+                ut.requirePermission(ut.handleKeyReencrypt, PermSystemAdmin)(w, r)
+            } else {
+                apierror.Write(w, r, http.StatusMethodNotAllowed, apierror.MethodNotAllowed, "Method not allowed")
+            }
+        })
+        
+        mux.HandleFunc("/api/v1/keys/policies", func(w http.ResponseWriter, r *http.Request) {
+            if r.Method == "GET" {
+                ut.requirePermission(ut.handleRotationPolicies, PermSystemAdmin)(w, r)
+            } else {
+                apierror.Write(w, r, http.StatusMethodNotAllowed, apierror.MethodNotAllowed, "Method not allowed")
+            }
+        })
+        
+        mux.HandleFunc("/api/v1/keys/policies/", func(w http.ResponseWriter, r *http.Request) {
+            if r.Method == "PUT" || r.Method == "DELETE" {
+                ut.requirePermission(ut.handleRotationPolicy, PermSystemAdmin)(w, r)
+            } else {
+                apierror.Write(w, r, http.StatusMethodNotAllowed, apierror.MethodNotAllowed, "Method not allowed")
+            }
+        })
+    }
+    
+    return router.Handler(func(h http.Handler) http.Handler {
+        h = ut.ipFilterMiddleware(ut.signatureMiddleware(ut.rateLimitMiddleware(ut.corsMiddleware(ut.csrfMiddleware(ut.configFreezeMiddleware(jsonResponseMiddleware(h)))))))
+        if ut.apiCompression {
+            h = compression.Gzip(h, apiCompressionMinSize)
+        }
+        // Outermost, so refusals by the filters above carry the headers too
+        return apierror.RequestIDs(ut.securityHeaders.Middleware(h))
+    })
+}
+
+func (ut *UnifiedTokenizer) startAPIServer() {
+    log.Printf("Starting API server on port %s (CORS origins: %v)", ut.apiPort, ut.corsPolicy.Load().AllowedOrigins)
+    if err := ut.listenAndServe(ut.apiPort, ut.apiHandler(), ut.apiTLSConfig); err != nil {
+        log.Fatalf("API server failed: %v", err)
+    }
+}
+
+// listenAndServe serves HTTP on port, using TLS when tlsConfig is set
+func (ut *UnifiedTokenizer) listenAndServe(port string, handler http.Handler, tlsConfig *tls.Config) error {
+    if tlsConfig == nil {
+        return http.ListenAndServe(":"+port, handler)
+    }
+    server := &http.Server{
+        Addr:      ":" + port,
+        Handler:   handler,
+        TLSConfig: tlsConfig,
+    }
+    return server.ListenAndServeTLS("", "")
+}
+
+// Key management API handlers
+
+func (ut *UnifiedTokenizer) handleKeyStatus(w http.ResponseWriter, r *http.Request) {
+    // Permission check is handled by requirePermission middleware
+    
+    type KeyInfo struct {
+        KeyID      string     `json:"key_id"`
+        Version    int        `json:"version"`
+        Status     string     `json:"status"`
+        CreatedAt  time.Time  `json:"created_at"`
+        RetiredAt  *time.Time `json:"retired_at,omitempty"`
+        CardsCount int        `json:"cards_encrypted,omitempty"`
+        // Cards still to be re-encrypted off a retired DEK
+        CardsRemaining int `json:"cards_remaining,omitempty"`
+    }
+    
+    response := struct {
+        KEK         *KeyInfo  `json:"kek,omitempty"`
+        DEK         *KeyInfo  `json:"dek,omitempty"`
+        RetiredDEKs []KeyInfo `json:"retired_deks"`
+        LegacyCards int       `json:"legacy_cards"`
+        Reencrypted bool      `json:"reencryption_complete"`
+    }{RetiredDEKs: []KeyInfo{}}
+    
+    // Get KEK info
+    var kekInfo KeyInfo
+    err := ut.db.QueryRow(`
+        SELECT key_id, key_version, key_status, created_at
+        FROM encryption_keys
+        WHERE key_type = 'KEK' AND key_status = 'active'
+        ORDER BY key_version DESC LIMIT 1
+    `).Scan(&kekInfo.KeyID, &kekInfo.Version, &kekInfo.Status, &kekInfo.CreatedAt)
+    
+    if err == nil {
+        response.KEK = &kekInfo
+    }
+    
+    // Get DEK info
+    var dekInfo KeyInfo
+    err = ut.db.QueryRow(`
+        SELECT key_id, key_version, key_status, created_at
+        FROM encryption_keys
+        WHERE key_type = 'DEK' AND key_status = 'active'
+        ORDER BY key_version DESC LIMIT 1
+    `).Scan(&dekInfo.KeyID, &dekInfo.Version, &dekInfo.Status, &dekInfo.CreatedAt)
+    
+    if err == nil {
+        response.DEK = &dekInfo
+        
+        // Count cards encrypted with this DEK
+        ut.db.QueryRow(`
+            SELECT COUNT(*) FROM credit_cards 
+            WHERE encryption_key_id = ?
+        `, dekInfo.KeyID).Scan(&dekInfo.CardsCount)
+    }
+    
+    // Retired DEKs stay decryptable while any card still uses them
+    rows, err := ut.db.Query(`
+        SELECT k.key_id, k.key_version, k.key_status, k.created_at, k.retired_at, COUNT(c.id)
+        FROM encryption_keys k
+        JOIN credit_cards c ON c.encryption_key_id = k.key_id
+        WHERE k.key_type = 'DEK' AND k.key_status <> 'active'
+        GROUP BY k.key_id, k.key_version, k.key_status, k.created_at, k.retired_at
+        ORDER BY k.key_version DESC
+    `)
+    if err == nil {
+        for rows.Next() {
+            var info KeyInfo
+            var retiredAt sql.NullTime
+            if err := rows.Scan(&info.KeyID, &info.Version, &info.Status, &info.CreatedAt, &retiredAt, &info.CardsRemaining); err != nil {
+                continue
+            }
+            if retiredAt.Valid {
+                info.RetiredAt = &retiredAt.Time
+            }
+            response.RetiredDEKs = append(response.RetiredDEKs, info)
+        }
+        rows.Close()
+    }
+    ut.db.QueryRow("SELECT COUNT(*) FROM credit_cards WHERE encryption_key_id IS NULL OR encryption_key_id = ''").Scan(&response.LegacyCards)
+    response.Reencrypted = len(response.RetiredDEKs) == 0 && response.LegacyCards == 0
+    
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(response)
+}
+
+// sealCheckAAD binds the seal_config check value, which is sealed with the
+// master key so a wrong combination of shares is detected before use
+const sealCheckAAD = "seal_config"
+
+// unsealState collects key shares in sealed-boot mode. Shares are held in
+// memory only and zeroed after each unseal attempt.
+type unsealState struct {
+    threshold int
+    shares    [][]byte
+    mu        sync.Mutex
+}
+
+// status must be called with u.mu held
+func (u *unsealState) status(km *KeyManager) map[string]interface{} {
+    return map[string]interface{}{
+        "sealed":    km.IsSealed(),
+        "threshold": u.threshold,
+        "progress":  len(u.shares),
+    }
+}
+
+// clear must be called with u.mu held
+func (u *unsealState) clear() {
+    for _, share := range u.shares {
+        for i := range share {
+            share[i] = 0
+        }
+    }
+    u.shares = nil
+}
+
+// loadSealThreshold reads the share threshold written by unseal-init
+func loadSealThreshold(db *sql.DB) (int, error) {
+    var threshold int
+    err := db.QueryRow("SELECT threshold FROM seal_config WHERE id = 1").Scan(&threshold)
+    if err == sql.ErrNoRows {
+        return 0, errors.New("SEAL_MODE=shamir but no key shares exist, run 'unified-tokenizer unseal-init'")
     }
-    
-    // Also log to application logs for immediate visibility
-    if event.Severity == "high" || event.Severity == "critical" {
-        log.Printf("SECURITY ALERT [%s]: %s from IP %s - %s", 
-            strings.ToUpper(event.Severity), event.EventType, event.IPAddress, event.Endpoint)
+    if err != nil {
+        return 0, fmt.Errorf("failed to read seal_config: %v", err)
     }
+    return threshold, nil
 }
 
-// Helper to extract client info from request
-func (ut *UnifiedTokenizer) getClientInfo(r *http.Request) (string, string) {
-    // Get client IP
-    ipAddress := r.RemoteAddr
-    if forwarded := r.Header.Get("X-Forwarded-For"); forwarded != "" {
-        ipAddress = strings.TrimSpace(strings.Split(forwarded, ",")[0])
+// handleUnseal reports the seal status (GET) or accepts one key share
+// (POST). Share submissions are rate limited like logins.
+func (ut *UnifiedTokenizer) handleUnseal(w http.ResponseWriter, r *http.Request) {
+    w.Header().Set("Content-Type", "application/json")
+    if ut.unsealer == nil {
+        apierror.Write(w, r, http.StatusNotFound, apierror.NotFound, "Sealed-boot mode is not enabled")
+        return
     }
     
-    // Remove port from IP if present
-    if host, _, err := net.SplitHostPort(ipAddress); err == nil {
-        ipAddress = host
+    switch r.Method {
+    case "GET":
+        ut.unsealer.mu.Lock()
+        status := ut.unsealer.status(ut.keyManager)
+        ut.unsealer.mu.Unlock()
+        json.NewEncoder(w).Encode(status)
+    case "POST":
+        ut.handleUnsealShare(w, r)
+    default:
+        apierror.Write(w, r, http.StatusMethodNotAllowed, apierror.MethodNotAllowed, "Method not allowed")
     }
-    
-    userAgent := r.UserAgent()
-    return ipAddress, userAgent
 }
 
-// Authentication handlers
+// UnsealShareRequest is the body of POST /api/v1/unseal
+type UnsealShareRequest struct {
+    Share string `json:"share"`
+    Reset bool   `json:"reset"`
+}
 
-func (ut *UnifiedTokenizer) handleLogin(w http.ResponseWriter, r *http.Request) {
-    if r.Method != "POST" {
-        w.WriteHeader(http.StatusMethodNotAllowed)
+// handleUnsealShare adds a key share; once the threshold is reached the
+// shares are combined and verified, and the KEK and DEK are loaded
+func (ut *UnifiedTokenizer) handleUnsealShare(w http.ResponseWriter, r *http.Request) {
+    var req UnsealShareRequest
+    if err := json.NewDecoder(io.LimitReader(r.Body, 4096)).Decode(&req); err != nil {
+        apierror.Write(w, r, http.StatusBadRequest, apierror.InvalidBody, "Invalid request body")
         return
     }
     
-    var authReq AuthRequest
-    if err := json.NewDecoder(r.Body).Decode(&authReq); err != nil {
-        w.WriteHeader(http.StatusBadRequest)
-        json.NewEncoder(w).Encode(map[string]string{"error": "Invalid request body"})
+    u := ut.unsealer
+    u.mu.Lock()
+    defer u.mu.Unlock()
+    
+    if req.Reset || !ut.keyManager.IsSealed() {
+        u.clear()
+        json.NewEncoder(w).Encode(u.status(ut.keyManager))
         return
     }
     
-    // Get client info
-    ipAddress, userAgent := ut.getClientInfo(r)
+    share, err := base64.StdEncoding.DecodeString(req.Share)
+    if err != nil || len(share) != 33 {
+        apierror.Write(w, r, http.StatusBadRequest, apierror.InvalidRequest, "Invalid key share")
+        return
+    }
+    for _, s := range u.shares {
+        if s[len(s)-1] == share[len(share)-1] {
+            apierror.Write(w, r, http.StatusBadRequest, apierror.InvalidRequest, "Key share already submitted")
+            return
+        }
+    }
+    u.shares = append(u.shares, share)
+    if len(u.shares) < u.threshold {
+        json.NewEncoder(w).Encode(u.status(ut.keyManager))
+        return
+    }
     
-    // Authenticate user
-    user, err := ut.authenticateUser(authReq.Username, authReq.Password)
+    err = ut.unsealWithShares(u.shares)
+    u.clear()
     if err != nil {
-        // Log failed login attempt
+        log.Printf("Unseal failed: %v", err)
+        ipAddress, userAgent := ut.getClientInfo(r)
         ut.logSecurityEvent(SecurityEvent{
-            EventType: "login_failed",
-            Severity:  "medium",
-            Username:  authReq.Username,
+            EventType: "unseal_failed",
+            Severity:  "high",
             IPAddress: ipAddress,
             UserAgent: userAgent,
             Endpoint:  r.URL.Path,
             Details: map[string]interface{}{
-                "reason": err.Error(),
-                "method": r.Method,
+                "threshold": u.threshold,
             },
         })
-        
-        w.WriteHeader(http.StatusUnauthorized)
-        json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+        apierror.Write(w, r, http.StatusBadRequest, apierror.InvalidRequest, "Unseal failed, key shares have been discarded: " + err.Error())
         return
     }
     
-    // Create session
-    session, err := ut.createSession(user, ipAddress, userAgent)
+    log.Printf("Vault unsealed")
+    json.NewEncoder(w).Encode(u.status(ut.keyManager))
+}
+
+// unsealWithShares reconstructs the master key and unseals the KeyManager
+// with it, after checking it against seal_config
+func (ut *UnifiedTokenizer) unsealWithShares(shares [][]byte) error {
+    masterKey, err := shamir.Combine(shares)
     if err != nil {
+        return err
+    }
+    defer func() {
+        for i := range masterKey {
+            masterKey[i] = 0
+        }
+    }()
+    
+    var check []byte
+    if err := ut.db.QueryRow("SELECT check_value FROM seal_config WHERE id = 1").Scan(&check); err != nil {
+        return fmt.Errorf("failed to read seal_config: %v", err)
+    }
+    sealer, err := keyseal.NewMasterKey(masterKey)
+    if err != nil {
+        return err
+    }
+    if _, err := sealer.Unseal(check, []byte(sealCheckAAD)); err != nil {
+        return err
+    }
+    return ut.keyManager.Unseal(sealer)
+}
+
+// KeyRotationRequest is the body of POST /api/v1/keys/rotate
+type KeyRotationRequest struct {
+    KeyType string `json:"key_type"` // "KEK", "DEK", or "both"
+}
+
+func (ut *UnifiedTokenizer) handleKeyRotation(w http.ResponseWriter, r *http.Request) {
+    // Permission check is handled by requirePermission middleware
+    
+    // Check if KEK/DEK is enabled
+    if !ut.useKEKDEK || ut.keyManager == nil {
+        apierror.Write(w, r, http.StatusBadRequest, apierror.KEKDEKDisabled, "KEK/DEK encryption is not enabled")
+        return
+    }
+    if ut.keyManager.IsSealed() {
+        apierror.Write(w, r, http.StatusServiceUnavailable, apierror.VaultSealed, "Vault is sealed")
+        return
+    }
+    
+    // Parse request body for rotation type
+    var request KeyRotationRequest
+    
+    if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+        request.KeyType = "DEK" // Default to DEK rotation
+    }
+    
+    rotationID, status, rotatedKeys, errors := ut.rotateKeys(request.KeyType, r.Header.Get("X-Username"))
+    
+    // Prepare response
+    response := map[string]interface{}{
+        "rotation_id":   rotationID,
+        "status":        status,
+        "rotated_keys":  rotatedKeys,
+        "requested_type": request.KeyType,
+    }
+    
+    if len(errors) > 0 {
+        response["errors"] = errors
         w.WriteHeader(http.StatusInternalServerError)
-        json.NewEncoder(w).Encode(map[string]string{"error": "Failed to create session"})
+    } else {
+        response["message"] = "Key rotation completed successfully"
+    }
+    
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(response)
+}
+
+// rotateKeys rotates the KEK, the DEK or both ("KEK", "DEK" or "both") and
+// records the rotation in key_rotation_log
+func (ut *UnifiedTokenizer) rotateKeys(keyType, initiatedBy string) (string, string, []string, []string) {
+    rotationID := "rot_" + generateRandomID()
+    
+    // Log rotation attempt
+    _, err := ut.db.Exec(`
+        INSERT INTO key_rotation_log (rotation_id, key_type, status, started_at, initiated_by)
+        VALUES (?, ?, 'in_progress', NOW(), ?)
+    `, rotationID, keyType, initiatedBy)
+    
+    if err != nil {
+        log.Printf("Failed to log rotation start: %v", err)
+    }
+    
+    var rotatedKeys []string
+    var errors []string
+    
+    // Perform rotation based on type
+    switch keyType {
+    case "KEK":
+        if err := ut.keyManager.RotateKEK(); err != nil {
+            errors = append(errors, fmt.Sprintf("KEK rotation failed: %v", err))
+        } else {
+            rotatedKeys = append(rotatedKeys, "KEK")
+        }
+    case "both":
+        if err := ut.keyManager.RotateKEK(); err != nil {
+            errors = append(errors, fmt.Sprintf("KEK rotation failed: %v", err))
+        } else {
+            rotatedKeys = append(rotatedKeys, "KEK")
+        }
+        if err := ut.keyManager.RotateDEK(); err != nil {
+            errors = append(errors, fmt.Sprintf("DEK rotation failed: %v", err))
+        } else {
+            rotatedKeys = append(rotatedKeys, "DEK")
+        }
+    default: // "DEK" or any other value
+        if err := ut.keyManager.RotateDEK(); err != nil {
+            errors = append(errors, fmt.Sprintf("DEK rotation failed: %v", err))
+        } else {
+            rotatedKeys = append(rotatedKeys, "DEK")
+        }
+    }
+    
+    if len(rotatedKeys) > 0 {
+        ut.updateICAPISTag()
+    }
+    
+    // Update rotation log
+    status := "completed"
+    if len(errors) > 0 {
+        status = "failed"
+    }
+    
+    _, err = ut.db.Exec(`
+        UPDATE key_rotation_log 
+        SET status = ?, completed_at = NOW(), error_message = ?
+        WHERE rotation_id = ?
+    `, status, strings.Join(errors, "; "), rotationID)
+    
+    if err != nil {
+        log.Printf("Failed to update rotation log: %v", err)
+    }
+    
+    return rotationID, status, rotatedKeys, errors
+}
+
+func (ut *UnifiedTokenizer) handleKeyRotationHistory(w http.ResponseWriter, r *http.Request) {
+    // Permission check is handled by requirePermission middleware
+    
+    // Get query parameters
+    limit := 50
+    if l := r.URL.Query().Get("limit"); l != "" {
+        if parsed, err := strconv.Atoi(l); err == nil && parsed > 0 && parsed <= 100 {
+            limit = parsed
+        }
+    }
+    
+    rows, err := ut.db.Query(`
+        SELECT rotation_id, key_type, status, started_at, completed_at, error_message,
+               cards_rotated, cards_total
+        FROM key_rotation_log
+        ORDER BY started_at DESC
+        LIMIT ?
+    `, limit)
+    
+    if err != nil {
+        apierror.Write(w, r, http.StatusInternalServerError, apierror.InternalError, "Database error")
         return
     }
+    defer rows.Close()
     
-    // Log successful login
-    ut.logAuditEvent(AuditEvent{
-        UserID:       user.UserID,
-        Action:       "login_success",
-        ResourceType: "session",
-        ResourceID:   session.SessionID,
-        IPAddress:    ipAddress,
-        UserAgent:    userAgent,
-        Details: map[string]interface{}{
-            "session_duration": "24 hours",
-            "method": r.Method,
-        },
-    })
+    var rotations []map[string]interface{}
     
-    ut.logSecurityEvent(SecurityEvent{
-        EventType: "login_success",
-        Severity:  "info",
-        UserID:    user.UserID,
-        Username:  user.Username,
-        IPAddress: ipAddress,
-        UserAgent: userAgent,
-        Endpoint:  r.URL.Path,
-        Details: map[string]interface{}{
-            "session_id": session.SessionID,
-            "role": user.Role,
-        },
-    })
+    for rows.Next() {
+        var rotationID, keyType, status string
+        var errorMessage sql.NullString
+        var startedAt time.Time
+        var completedAt sql.NullTime
+        var cardsRotated, cardsTotal sql.NullInt64
+        
+        err := rows.Scan(&rotationID, &keyType, &status, &startedAt, &completedAt, &errorMessage,
+            &cardsRotated, &cardsTotal)
+        if err != nil {
+            continue
+        }
+        
+        rotation := map[string]interface{}{
+            "rotation_id": rotationID,
+            "key_type":    keyType,
+            "status":      status,
+            "started_at":  startedAt.Format(time.RFC3339),
+        }
+        
+        if completedAt.Valid {
+            rotation["completed_at"] = completedAt.Time.Format(time.RFC3339)
+            rotation["duration_ms"] = completedAt.Time.Sub(startedAt).Milliseconds()
+        }
+        
+        if errorMessage.Valid && errorMessage.String != "" {
+            rotation["error_message"] = errorMessage.String
+        }
+        
+        if cardsTotal.Valid && cardsTotal.Int64 > 0 {
+            rotation["cards_rotated"] = cardsRotated.Int64
+            rotation["cards_total"] = cardsTotal.Int64
+        }
+        
+        rotations = append(rotations, rotation)
+    }
     
-    // Set session cookie
-    http.SetCookie(w, &http.Cookie{
-        Name:     "session_id",
-        Value:    session.SessionID,
-        Path:     "/",
-        HttpOnly: true,
-        Secure:   false, // Set to true in production with HTTPS
-        SameSite: http.SameSiteLaxMode,
-        Expires:  session.ExpiresAt,
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(map[string]interface{}{
+        "rotations": rotations,
+        "total":     len(rotations),
     })
+}
+
+// RotationPolicy rotates the active KEK or DEK once it is IntervalDays old
+type RotationPolicy struct {
+    KeyType      string     `json:"key_type"`
+    Enabled      bool       `json:"enabled"`
+    IntervalDays int        `json:"interval_days"`
+    Reencrypt    bool       `json:"reencrypt"`
+    LastRunAt    *time.Time `json:"last_run_at,omitempty"`
+    LastStatus   string     `json:"last_status,omitempty"`
+    LastError    string     `json:"last_error,omitempty"`
+    UpdatedBy    string     `json:"updated_by,omitempty"`
+    // Derived from the active key
+    CurrentKeyID   string     `json:"current_key_id,omitempty"`
+    NextRotationAt *time.Time `json:"next_rotation_at,omitempty"`
+}
+
+// loadRotationPolicies returns the configured policies with the active key
+// and the time each is due
+func (ut *UnifiedTokenizer) loadRotationPolicies() ([]RotationPolicy, error) {
+    rows, err := ut.db.Query(`
+        SELECT p.key_type, p.enabled, p.interval_days, p.reencrypt, p.last_run_at,
+               p.last_status, p.last_error, p.updated_by, k.key_id, k.created_at
+        FROM key_rotation_policies p
+        LEFT JOIN encryption_keys k ON k.key_id = (
+            SELECT key_id FROM encryption_keys
+            WHERE key_type = p.key_type AND key_status = 'active'
+            ORDER BY key_version DESC LIMIT 1
+        )
+        ORDER BY p.key_type
+    `)
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+    
+    var policies []RotationPolicy
+    for rows.Next() {
+        var p RotationPolicy
+        var lastRunAt, keyCreatedAt sql.NullTime
+        var lastStatus, lastError, updatedBy, keyID sql.NullString
+        if err := rows.Scan(&p.KeyType, &p.Enabled, &p.IntervalDays, &p.Reencrypt, &lastRunAt,
+            &lastStatus, &lastError, &updatedBy, &keyID, &keyCreatedAt); err != nil {
+            return nil, err
+        }
+        if lastRunAt.Valid {
+            p.LastRunAt = &lastRunAt.Time
+        }
+        p.LastStatus = lastStatus.String
+        p.LastError = lastError.String
+        p.UpdatedBy = updatedBy.String
+        p.CurrentKeyID = keyID.String
+        if keyCreatedAt.Valid {
+            next := keyCreatedAt.Time.AddDate(0, 0, p.IntervalDays)
+            p.NextRotationAt = &next
+        }
+        policies = append(policies, p)
+    }
+    return policies, rows.Err()
+}
+
+// handleRotationPolicies lists the rotation policies (GET /api/v1/keys/policies)
+func (ut *UnifiedTokenizer) handleRotationPolicies(w http.ResponseWriter, r *http.Request) {
+    // Permission check is handled by requirePermission middleware
     
-    // Check if password change is required (password_changed_at is zero)
-    requirePasswordChange := user.PasswordChangedAt == nil || user.PasswordChangedAt.IsZero()
+    policies, err := ut.loadRotationPolicies()
+    if err != nil {
+        apierror.Write(w, r, http.StatusInternalServerError, apierror.InternalError, "Database error")
+        return
+    }
+    if policies == nil {
+        policies = []RotationPolicy{}
+    }
     
-    // Return auth response
     w.Header().Set("Content-Type", "application/json")
-    json.NewEncoder(w).Encode(AuthResponse{
-        SessionID:            session.SessionID,
-        User:                 *user,
-        ExpiresAt:            session.ExpiresAt,
-        RequirePasswordChange: requirePasswordChange,
+    json.NewEncoder(w).Encode(map[string]interface{}{
+        "policies":       policies,
+        "check_interval": ut.rotationCheckInterval().String(),
     })
 }
 
-func (ut *UnifiedTokenizer) handleLogout(w http.ResponseWriter, r *http.Request) {
-    if r.Method != "POST" {
-        w.WriteHeader(http.StatusMethodNotAllowed)
-        return
-    }
+// RotationPolicyRequest is the body of PUT /api/v1/keys/policies/{key_type}
+type RotationPolicyRequest struct {
+    IntervalDays int   `json:"interval_days"`
+    Enabled      *bool `json:"enabled"`
+    Reencrypt    *bool `json:"reencrypt"`
+}
+
+// handleRotationPolicy creates or replaces (PUT) or removes (DELETE) the
+// policy for /api/v1/keys/policies/{KEK|DEK}
+func (ut *UnifiedTokenizer) handleRotationPolicy(w http.ResponseWriter, r *http.Request) {
+    // Permission check is handled by requirePermission middleware
     
-    // Get session ID
-    var sessionID string
-    cookie, err := r.Cookie("session_id")
-    if err == nil {
-        sessionID = cookie.Value
+    keyType := strings.ToUpper(strings.TrimPrefix(r.URL.Path, "/api/v1/keys/policies/"))
+    if keyType != "KEK" && keyType != "DEK" {
+        apierror.Write(w, r, http.StatusBadRequest, apierror.InvalidRequest, "Key type must be KEK or DEK")
+        return
     }
+    username := r.Header.Get("X-Username")
+    ipAddress, userAgent := ut.getClientInfo(r)
     
-    if sessionID == "" {
-        auth := r.Header.Get("Authorization")
-        if strings.HasPrefix(auth, "Bearer ") {
-            sessionID = strings.TrimPrefix(auth, "Bearer ")
+    if r.Method == "DELETE" {
+        res, err := ut.db.Exec("DELETE FROM key_rotation_policies WHERE key_type = ?", keyType)
+        if err != nil {
+            apierror.Write(w, r, http.StatusInternalServerError, apierror.InternalError, "Database error")
+            return
+        }
+        if n, _ := res.RowsAffected(); n == 0 {
+            apierror.Write(w, r, http.StatusNotFound, apierror.NotFound, "Policy not found")
+            return
         }
+        ut.logAuditEvent(AuditEvent{
+            UserID:       r.Header.Get("X-User-ID"),
+            Action:       "rotation_policy_deleted",
+            ResourceType: "rotation_policy",
+            ResourceID:   keyType,
+            IPAddress:    ipAddress,
+            UserAgent:    userAgent,
+        })
+        w.Header().Set("Content-Type", "application/json")
+        json.NewEncoder(w).Encode(map[string]string{"message": "Rotation policy deleted"})
+        return
     }
     
-    if sessionID != "" {
-        // Invalidate session
-        ut.db.Exec(`
-            UPDATE user_sessions 
-            SET is_active = FALSE 
-            WHERE session_id = ?
-        `, sessionID)
+    var request RotationPolicyRequest
+    if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+        apierror.Write(w, r, http.StatusBadRequest, apierror.InvalidBody, "Invalid request body")
+        return
     }
-    
-    // Clear cookie
-    http.SetCookie(w, &http.Cookie{
-        Name:     "session_id",
-        Value:    "",
-        Path:     "/",
-        HttpOnly: true,
-        MaxAge:   -1,
-    })
-    
-    w.Header().Set("Content-Type", "application/json")
-    json.NewEncoder(w).Encode(map[string]string{"message": "Logged out successfully"})
-}
-
-func (ut *UnifiedTokenizer) handleGetCurrentUser(w http.ResponseWriter, r *http.Request) {
-    if r.Method != "GET" {
-        w.WriteHeader(http.StatusMethodNotAllowed)
+    if request.IntervalDays < 1 || request.IntervalDays > 3650 {
+        apierror.Write(w, r, http.StatusBadRequest, apierror.InvalidRequest, "interval_days must be between 1 and 3650")
         return
     }
-    
-    // Get session ID
-    var sessionID string
-    cookie, err := r.Cookie("session_id")
-    if err == nil {
-        sessionID = cookie.Value
+    enabled, reencrypt := true, true
+    if request.Enabled != nil {
+        enabled = *request.Enabled
     }
-    
-    if sessionID == "" {
-        auth := r.Header.Get("Authorization")
-        if strings.HasPrefix(auth, "Bearer ") {
-            sessionID = strings.TrimPrefix(auth, "Bearer ")
-        }
+    if request.Reencrypt != nil {
+        reencrypt = *request.Reencrypt
     }
     
-    if sessionID == "" {
-        w.WriteHeader(http.StatusUnauthorized)
-        json.NewEncoder(w).Encode(map[string]string{"error": "Authentication required"})
+    _, err := ut.db.Exec(`
+        INSERT INTO key_rotation_policies (key_type, enabled, interval_days, reencrypt, updated_by)
+        VALUES (?, ?, ?, ?, ?)
+        ON DUPLICATE KEY UPDATE enabled = VALUES(enabled), interval_days = VALUES(interval_days),
+            reencrypt = VALUES(reencrypt), updated_by = VALUES(updated_by)
+    `, keyType, enabled, request.IntervalDays, reencrypt, username)
+    if err != nil {
+        apierror.Write(w, r, http.StatusInternalServerError, apierror.InternalError, "Database error")
         return
     }
     
-    // Validate session
-    session, err := ut.validateSession(sessionID)
+    ut.logAuditEvent(AuditEvent{
+        UserID:       r.Header.Get("X-User-ID"),
+        Action:       "rotation_policy_updated",
+        ResourceType: "rotation_policy",
+        ResourceID:   keyType,
+        IPAddress:    ipAddress,
+        UserAgent:    userAgent,
+        Details: map[string]interface{}{
+            "enabled":       enabled,
+            "interval_days": request.IntervalDays,
+            "reencrypt":     reencrypt,
+        },
+    })
+    
+    policies, err := ut.loadRotationPolicies()
     if err != nil {
-        w.WriteHeader(http.StatusUnauthorized)
-        json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+        apierror.Write(w, r, http.StatusInternalServerError, apierror.InternalError, "Database error")
         return
     }
-    
     w.Header().Set("Content-Type", "application/json")
-    json.NewEncoder(w).Encode(session.User)
+    for _, p := range policies {
+        if p.KeyType == keyType {
+            json.NewEncoder(w).Encode(p)
+            return
+        }
+    }
+    json.NewEncoder(w).Encode(map[string]string{"message": "Rotation policy saved"})
 }
 
-func (ut *UnifiedTokenizer) handleChangePassword(w http.ResponseWriter, r *http.Request) {
-    if r.Method != "POST" {
-        w.WriteHeader(http.StatusMethodNotAllowed)
-        return
+// keySyncInterval is how often each replica checks for keys rotated by
+// another replica
+func keySyncInterval() time.Duration {
+    interval := utils.ParseTimeEnv("KEY_SYNC_INTERVAL", "10s")
+    if interval < time.Second {
+        interval = time.Second
+    }
+    return interval
+}
+
+// startKeySyncService keeps this replica's active KEK and DEK in step with
+// the database, so a rotation on one replica reaches all of them within
+// KEY_SYNC_INTERVAL
+func (ut *UnifiedTokenizer) startKeySyncService() {
+    ticker := time.NewTicker(keySyncInterval())
+    defer ticker.Stop()
+    
+    for range ticker.C {
+        if err := ut.keyManager.SyncActiveKeys(); err != nil {
+            log.Printf("Warning: Failed to sync active keys: %v", err)
+        }
     }
+}
 
-    // Get session ID from cookie or Authorization header
-    sessionID := ""
-    if cookie, err := r.Cookie("session_id"); err == nil {
-        sessionID = cookie.Value
-    } else if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
-        sessionID = strings.TrimPrefix(auth, "Bearer ")
+// rotationCheckInterval is how often the scheduler looks for due policies
+func (ut *UnifiedTokenizer) rotationCheckInterval() time.Duration {
+    interval := utils.ParseTimeEnv("KEY_ROTATION_CHECK_INTERVAL", "1h")
+    if interval < time.Minute {
+        interval = time.Minute
     }
+    return interval
+}
 
-    if sessionID == "" {
-        w.WriteHeader(http.StatusUnauthorized)
-        json.NewEncoder(w).Encode(map[string]string{"error": "Authentication required"})
-        return
+// startKeyRotationScheduler applies the rotation policies. Every replica
+// runs it; a due rotation is claimed with a conditional UPDATE so only one
+// replica performs it. Checks are jittered by up to 10% so replicas started
+// together do not all query at once.
+func (ut *UnifiedTokenizer) startKeyRotationScheduler() {
+    interval := ut.rotationCheckInterval()
+    log.Printf("Key rotation scheduler started (checks every %v)", interval)
+    
+    for {
+        jitter := time.Duration(rand.Int63n(int64(interval) / 10))
+        time.Sleep(interval + jitter)
+        
+        policies, err := ut.loadRotationPolicies()
+        if err != nil {
+            log.Printf("Key rotation scheduler: failed to load policies: %v", err)
+            continue
+        }
+        for _, p := range policies {
+            if p.Enabled && p.NextRotationAt != nil && time.Now().After(*p.NextRotationAt) {
+                ut.runScheduledRotation(p)
+            }
+        }
     }
+}
 
-    // Validate session
-    session, err := ut.validateSession(sessionID)
+// runScheduledRotation claims and performs one due rotation. The claim
+// succeeds once per key generation, or again an hour after a failed or
+// skipped attempt.
+func (ut *UnifiedTokenizer) runScheduledRotation(p RotationPolicy) {
+    keyCreatedAt := p.NextRotationAt.AddDate(0, 0, -p.IntervalDays)
+    res, err := ut.db.Exec(`
+        UPDATE key_rotation_policies
+        SET last_run_at = NOW(), last_status = 'running', last_error = NULL
+        WHERE key_type = ? AND enabled = TRUE
+          AND (last_run_at IS NULL OR last_run_at <= ? OR last_run_at < NOW() - INTERVAL 1 HOUR)
+    `, p.KeyType, keyCreatedAt)
     if err != nil {
-        w.WriteHeader(http.StatusUnauthorized)
-        json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+        log.Printf("Key rotation scheduler: failed to claim %s rotation: %v", p.KeyType, err)
         return
     }
-
-    // Parse request body
-    var req struct {
-        CurrentPassword string `json:"current_password"`
-        NewPassword     string `json:"new_password"`
-    }
-    if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-        w.WriteHeader(http.StatusBadRequest)
-        json.NewEncoder(w).Encode(map[string]string{"error": "Invalid request body"})
-        return
+    if n, _ := res.RowsAffected(); n == 0 {
+        return // Another replica has it, or it failed recently
     }
-
-    // Validate input
-    if req.CurrentPassword == "" || req.NewPassword == "" {
-        w.WriteHeader(http.StatusBadRequest)
-        json.NewEncoder(w).Encode(map[string]string{"error": "Current password and new password are required"})
-        return
+    
+    finish := func(status, rotationID, errMsg string) {
+        ut.db.Exec(`
+            UPDATE key_rotation_policies SET last_status = ?, last_rotation_id = ?, last_error = ?
+            WHERE key_type = ?
+        `, status, rotationID, errMsg, p.KeyType)
     }
-
-    // Validate password strength
-    if err := ut.validatePasswordStrength(req.NewPassword); err != nil {
-        w.WriteHeader(http.StatusBadRequest)
-        json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+    
+    // Pre-rotation health checks
+    if err := ut.preRotationCheck(p.KeyType); err != nil {
+        log.Printf("Scheduled %s rotation skipped: %v", p.KeyType, err)
+        finish("skipped", "", err.Error())
+        ut.logSecurityEvent(SecurityEvent{
+            EventType: "key_rotation_skipped",
+            Severity:  "high",
+            IPAddress: "127.0.0.1",
+            Endpoint:  "scheduler",
+            Details: map[string]interface{}{
+                "key_type": p.KeyType,
+                "key_id":   p.CurrentKeyID,
+                "reason":   err.Error(),
+            },
+        })
         return
     }
-
-    // Get current user's password hash from database
-    var currentPasswordHash string
-    err = ut.db.QueryRow("SELECT password_hash FROM users WHERE user_id = ?", session.User.UserID).Scan(&currentPasswordHash)
-    if err != nil {
-        w.WriteHeader(http.StatusInternalServerError)
-        json.NewEncoder(w).Encode(map[string]string{"error": "Database error"})
-        return
+    
+    log.Printf("Scheduled %s rotation: %s is older than %d days", p.KeyType, p.CurrentKeyID, p.IntervalDays)
+    rotationID, status, _, errs := ut.rotateKeys(p.KeyType, "scheduler")
+    finish(status, rotationID, strings.Join(errs, "; "))
+    
+    details := map[string]interface{}{
+        "key_type":    p.KeyType,
+        "old_key_id":  p.CurrentKeyID,
+        "rotation_id": rotationID,
     }
-
-    // Verify current password
-    if err := bcrypt.CompareHashAndPassword([]byte(currentPasswordHash), []byte(req.CurrentPassword)); err != nil {
-        // Log failed password change attempt
-        ipAddress, userAgent := ut.getClientInfo(r)
+    if status != "completed" {
+        details["errors"] = errs
         ut.logSecurityEvent(SecurityEvent{
-            EventType: "password_change_failed",
-            Severity:  "medium",
-            UserID:    session.User.UserID,
-            Username:  session.User.Username,
-            IPAddress: ipAddress,
-            UserAgent: userAgent,
-            Endpoint:  r.URL.Path,
-            Details: map[string]interface{}{
-                "reason": "incorrect_current_password",
-                "method": r.Method,
-            },
+            EventType: "key_rotation_failed",
+            Severity:  "high",
+            IPAddress: "127.0.0.1",
+            Endpoint:  "scheduler",
+            Details:   details,
         })
-        
-        w.WriteHeader(http.StatusBadRequest)
-        json.NewEncoder(w).Encode(map[string]string{"error": "Current password is incorrect"})
         return
     }
+    
+    if p.KeyType == "DEK" && p.Reencrypt {
+        if jobID, _, total, err := ut.startReencryption("scheduler"); err != nil {
+            log.Printf("Scheduled DEK rotation: re-encryption not started: %v", err)
+        } else {
+            details["reencrypt_rotation_id"] = jobID
+            details["cards_total"] = total
+        }
+    }
+    ut.logSecurityEvent(SecurityEvent{
+        EventType: "key_rotation_scheduled",
+        Severity:  "info",
+        IPAddress: "127.0.0.1",
+        Endpoint:  "scheduler",
+        Details:   details,
+    })
+}
 
-    // Hash new password
-    hashedPassword, err := bcrypt.GenerateFromPassword([]byte(req.NewPassword), bcrypt.DefaultCost)
-    if err != nil {
-        w.WriteHeader(http.StatusInternalServerError)
-        json.NewEncoder(w).Encode(map[string]string{"error": "Password hashing failed"})
+// preRotationCheck verifies the vault can rotate safely: unsealed, database
+// reachable, no re-encryption running anywhere, and the current keys work
+func (ut *UnifiedTokenizer) preRotationCheck(keyType string) error {
+    if ut.keyManager.IsSealed() {
+        return errVaultSealed
+    }
+    if err := ut.db.Ping(); err != nil {
+        return fmt.Errorf("database unreachable: %v", err)
+    }
+    var running int
+    if err := ut.db.QueryRow(`
+        SELECT COUNT(*) FROM key_rotation_log
+        WHERE key_type = 'REENCRYPT' AND status = 'in_progress' AND started_at > NOW() - INTERVAL 1 DAY
+    `).Scan(&running); err != nil {
+        return fmt.Errorf("failed to check re-encryption jobs: %v", err)
+    }
+    if running > 0 {
+        return errReencryptRunning
+    }
+    return ut.keyManager.HealthCheck()
+}
+
+// Number of cards re-encrypted per transaction by a re-encryption job
+const reencryptBatchSize = 500
+
+// handleKeyReencrypt starts a background job that re-encrypts every card still
+// protected by a retired DEK (or legacy Fernet encryption) with the current DEK.
+// Progress is recorded in key_rotation_log with key_type REENCRYPT.
+func (ut *UnifiedTokenizer) handleKeyReencrypt(w http.ResponseWriter, r *http.Request) {
+    // Permission check is handled by requirePermission middleware
+
+    if !ut.useKEKDEK || ut.keyManager == nil {
+        apierror.Write(w, r, http.StatusBadRequest, apierror.KEKDEKDisabled, "KEK/DEK encryption is not enabled")
+        return
+    }
+    if ut.keyManager.IsSealed() {
+        apierror.Write(w, r, http.StatusServiceUnavailable, apierror.VaultSealed, "Vault is sealed")
         return
     }
 
-    // Update password in database
-    _, err = ut.db.Exec(`
-        UPDATE users 
-        SET password_hash = ?, password_changed_at = CURRENT_TIMESTAMP 
-        WHERE user_id = ?`,
-        string(hashedPassword), session.User.UserID)
-    if err != nil {
-        w.WriteHeader(http.StatusInternalServerError)
-        json.NewEncoder(w).Encode(map[string]string{"error": "Failed to update password"})
+    rotationID, dekID, total, err := ut.startReencryption(r.Header.Get("X-Username"))
+    if err == errReencryptRunning {
+        apierror.WriteDetails(w, r, http.StatusConflict, apierror.JobRunning, "A re-encryption job is already running", map[string]interface{}{
+            "rotation_id": rotationID,
+        })
+        return
+    } else if err != nil {
+        apierror.Write(w, r, http.StatusInternalServerError, apierror.InternalError, "Database error")
         return
     }
 
-    // Log successful password change
     ipAddress, userAgent := ut.getClientInfo(r)
     ut.logAuditEvent(AuditEvent{
-        UserID:       session.User.UserID,
-        Action:       "password_change_success",
-        ResourceType: "user",
-        ResourceID:   session.User.UserID,
+        UserID:       r.Header.Get("X-User-ID"),
+        Action:       "cards_reencrypt_started",
+        ResourceType: "encryption_key",
+        ResourceID:   dekID,
         IPAddress:    ipAddress,
         UserAgent:    userAgent,
         Details: map[string]interface{}{
-            "method": r.Method,
+            "rotation_id": rotationID,
+            "cards_total": total,
         },
     })
-    
-    ut.logSecurityEvent(SecurityEvent{
-        EventType: "password_change_success",
-        Severity:  "info",
-        UserID:    session.User.UserID,
-        Username:  session.User.Username,
-        IPAddress: ipAddress,
-        UserAgent: userAgent,
-        Endpoint:  r.URL.Path,
-        Details: map[string]interface{}{
-            "initiated_by": "user",
-            "method": r.Method,
-        },
+
+    w.Header().Set("Content-Type", "application/json")
+    w.WriteHeader(http.StatusAccepted)
+    json.NewEncoder(w).Encode(map[string]interface{}{
+        "rotation_id": rotationID,
+        "status":      "in_progress",
+        "target_key":  dekID,
+        "cards_total": total,
     })
+}
+
+// runReencryption walks credit_cards in id order and re-encrypts each card not
+// yet using dekID. Cards that fail to decrypt are skipped and counted.
+// errReencryptRunning is returned by startReencryption, with the running
+// job's rotation ID, when a job is already in progress
+var errReencryptRunning = errors.New("a re-encryption job is already running")
+
+// startReencryption starts a background job re-encrypting every card not on
+// the current DEK and returns its rotation ID, target DEK and card count
+func (ut *UnifiedTokenizer) startReencryption(initiatedBy string) (string, string, int, error) {
+    ut.mu.Lock()
+    if ut.reencryptJob != "" {
+        running := ut.reencryptJob
+        ut.mu.Unlock()
+        return running, "", 0, errReencryptRunning
+    }
+    rotationID := "rot_" + generateRandomID()
+    ut.reencryptJob = rotationID
+    ut.mu.Unlock()
+
+    dekID := ut.keyManager.getCurrentDEKID()
+
+    var total int
+    err := ut.db.QueryRow(`
+        SELECT COUNT(*) FROM credit_cards
+        WHERE encryption_key_id IS NULL OR encryption_key_id <> ?
+    `, dekID).Scan(&total)
+    if err != nil {
+        ut.mu.Lock()
+        ut.reencryptJob = ""
+        ut.mu.Unlock()
+        return "", "", 0, err
+    }
+
+    _, err = ut.db.Exec(`
+        INSERT INTO key_rotation_log (rotation_id, key_type, new_key_id, status, started_at, cards_total, initiated_by)
+        VALUES (?, 'REENCRYPT', ?, 'in_progress', NOW(), ?, ?)
+    `, rotationID, dekID, total, initiatedBy)
+    if err != nil {
+        log.Printf("Failed to log re-encryption start: %v", err)
+    }
+
+    go ut.runReencryption(rotationID, dekID)
+    return rotationID, dekID, total, nil
+}
+
+func (ut *UnifiedTokenizer) runReencryption(rotationID, dekID string) {
+    defer func() {
+        ut.mu.Lock()
+        ut.reencryptJob = ""
+        ut.mu.Unlock()
+    }()
+
+    // Replicas that have not synced a fresh rotation yet still encrypt new
+    // cards with the old DEK; wait until they have switched so the sweep
+    // does not miss their writes
+    var age int
+    if err := ut.db.QueryRow(`
+        SELECT TIMESTAMPDIFF(SECOND, activated_at, NOW()) FROM encryption_keys WHERE key_id = ?
+    `, dekID).Scan(&age); err == nil {
+        if wait := 2*keySyncInterval() - time.Duration(age)*time.Second; wait > 0 {
+            log.Printf("Re-encryption %s: waiting %v for replicas to switch to %s", rotationID, wait, dekID)
+            time.Sleep(wait)
+        }
+    }
+
+    type pendingCard struct {
+        id         int
+        token      string
+        encrypted  []byte
+        holder     []byte
+        externalID []byte
+        metadata   []byte
+        keyID      sql.NullString
+    }
+
+    lastID := 0
+    rotated, failed := 0, 0
+    for {
+        rows, err := ut.db.Query(`
+            SELECT id, token, card_number_encrypted, card_holder_name_encrypted,
+                   external_id_encrypted, metadata_encrypted, encryption_key_id
+            FROM credit_cards
+            WHERE id > ? AND (encryption_key_id IS NULL OR encryption_key_id <> ?)
+            ORDER BY id
+            LIMIT ?
+        `, lastID, dekID, reencryptBatchSize)
+        if err != nil {
+            ut.finishReencryption(rotationID, rotated, fmt.Sprintf("query failed: %v", err))
+            return
+        }
+
+        var batch []pendingCard
+        for rows.Next() {
+            var c pendingCard
+            if err := rows.Scan(&c.id, &c.token, &c.encrypted, &c.holder, &c.externalID, &c.metadata, &c.keyID); err == nil {
+                batch = append(batch, c)
+            }
+        }
+        rows.Close()
+
+        if len(batch) == 0 {
+            break
+        }
+
+        for _, c := range batch {
+            lastID = c.id
+
+            // The cardholder name, external ID and metadata share the
+            // card's DEK, so they move too
+            fields, err := ut.decryptFields(c.keyID, c.encrypted, c.holder, c.externalID, c.metadata)
+            if err != nil {
+                log.Printf("Re-encryption %s: skipping token %s: %v", rotationID, c.token, err)
+                failed++
+                continue
+            }
+            sealed, newKeyID, err := ut.encryptFields(fields...)
+            if err != nil {
+                failed++
+                continue
+            }
+
+            // Only replace the ciphertext we read, in case the card changed meanwhile
+            res, err := ut.db.Exec(`
+                UPDATE credit_cards
+                SET card_number_encrypted = ?, card_holder_name_encrypted = ?,
+                    external_id_encrypted = ?, metadata_encrypted = ?, encryption_key_id = ?
+                WHERE id = ? AND card_number_encrypted = ?
+            `, sealed[0], sealed[1], sealed[2], sealed[3], newKeyID, c.id, c.encrypted)
+            if err != nil {
+                failed++
+                continue
+            }
+            if n, _ := res.RowsAffected(); n > 0 {
+                rotated++
+            }
+        }
 
-    w.Header().Set("Content-Type", "application/json")
-    json.NewEncoder(w).Encode(map[string]string{"message": "Password changed successfully"})
+        ut.db.Exec(`
+            UPDATE key_rotation_log SET cards_rotated = ? WHERE rotation_id = ?
+        `, rotated, rotationID)
+    }
+
+    errMsg := ""
+    if failed > 0 {
+        errMsg = fmt.Sprintf("%d cards could not be re-encrypted", failed)
+    }
+    ut.finishReencryption(rotationID, rotated, errMsg)
 }
 
-func (ut *UnifiedTokenizer) validatePasswordStrength(password string) error {
-    if len(password) < 12 {
-        return fmt.Errorf("password must be at least 12 characters long")
+// backfillBlindIndexes computes blind indexes missing from cards stored
+// before the index existed or after the index key changed. It waits for the
+// vault to be unsealed, and is safe to run on every replica at once.
+func (ut *UnifiedTokenizer) backfillBlindIndexes() {
+    for ut.keyManager != nil && ut.keyManager.IsSealed() {
+        time.Sleep(10 * time.Second)
     }
     
-    var hasUpper, hasLower, hasDigit, hasSpecial bool
-    for _, char := range password {
-        switch {
-        case 'A' <= char && char <= 'Z':
-            hasUpper = true
-        case 'a' <= char && char <= 'z':
-            hasLower = true
-        case '0' <= char && char <= '9':
-            hasDigit = true
-        case strings.ContainsRune("!@#$%^&*()_+-=[]{}|;':\",./<>?", char):
-            hasSpecial = true
-        }
+    if filled := ut.backfillBlindIndex("card_number_encrypted", "card_number_index", blindIndexCardNumber, normalizeCardNumber); filled > 0 {
+        log.Printf("Blind index backfill: indexed %d card numbers", filled)
     }
-    
-    var missing []string
-    if !hasUpper {
-        missing = append(missing, "uppercase letter")
+    if filled := ut.backfillBlindIndex("card_holder_name_encrypted", "card_holder_name_index", blindIndexHolderName, normalizeHolderName); filled > 0 {
+        log.Printf("Blind index backfill: indexed %d cardholder names", filled)
     }
-    if !hasLower {
-        missing = append(missing, "lowercase letter")
+    if filled := ut.backfillBlindIndex("external_id_encrypted", "external_id_index", blindIndexExternalID, normalizeExternalID); filled > 0 {
+        log.Printf("Blind index backfill: indexed %d external IDs", filled)
     }
-    if !hasDigit {
-        missing = append(missing, "number")
+}
+
+// backfillBlindIndex fills indexColumn from the encrypted column for every
+// card missing it and returns the number of cards indexed
+func (ut *UnifiedTokenizer) backfillBlindIndex(encryptedColumn, indexColumn, purpose string, normalize func(string) string) int {
+    lastID, filled := 0, 0
+    for {
+        rows, err := ut.db.Query(fmt.Sprintf(`
+            SELECT id, %s, encryption_key_id
+            FROM credit_cards
+            WHERE id > ? AND %s IS NOT NULL AND %s IS NULL
+            ORDER BY id
+            LIMIT ?
+        `, encryptedColumn, encryptedColumn, indexColumn), lastID, reencryptBatchSize)
+        if err != nil {
+            log.Printf("Blind index backfill of %s failed: %v", indexColumn, err)
+            return filled
+        }
+        
+        type pendingCard struct {
+            id    int
+            data  []byte
+            keyID sql.NullString
+        }
+        var batch []pendingCard
+        for rows.Next() {
+            var c pendingCard
+            if err := rows.Scan(&c.id, &c.data, &c.keyID); err == nil {
+                batch = append(batch, c)
+            }
+        }
+        rows.Close()
+        if len(batch) == 0 {
+            return filled
+        }
+        
+        for _, c := range batch {
+            lastID = c.id
+            value, err := ut.decryptStoredField(c.data, c.keyID)
+            if err != nil {
+                continue
+            }
+            index, err := ut.blindIndex(purpose, normalize(value))
+            if err != nil {
+                continue
+            }
+            if _, err := ut.db.Exec(fmt.Sprintf(`
+                UPDATE credit_cards SET %s = ?
+                WHERE id = ? AND %s IS NULL
+            `, indexColumn, indexColumn), index, c.id); err == nil {
+                filled++
+            }
+        }
     }
-    if !hasSpecial {
-        missing = append(missing, "special character")
+}
+
+// encryptPlaintextColumns moves external IDs, metadata and audit details
+// stored in plaintext before they were encrypted into their encrypted
+// columns, clearing the plaintext. It waits for the vault to be unsealed,
+// and is safe to run on every replica at once.
+func (ut *UnifiedTokenizer) encryptPlaintextColumns() {
+    for ut.keyManager != nil && ut.keyManager.IsSealed() {
+        time.Sleep(10 * time.Second)
     }
     
-    if len(missing) > 0 {
-        return fmt.Errorf("password must contain at least one %s", strings.Join(missing, ", "))
+    if encrypted := ut.encryptPlaintextCardFields(); encrypted > 0 {
+        log.Printf("Column encryption: encrypted the external ID and metadata of %d cards", encrypted)
+    }
+    for _, table := range []string{"user_audit_log", "security_audit_log"} {
+        if encrypted := ut.encryptPlaintextAuditDetails(table); encrypted > 0 {
+            log.Printf("Column encryption: encrypted the details of %d %s rows", encrypted, table)
+        }
     }
-    
-    return nil
 }
 
-// User management handlers
-
-func (ut *UnifiedTokenizer) handleListUsers(w http.ResponseWriter, r *http.Request) {
-    rows, err := ut.db.Query(`
-        SELECT user_id, username, email, full_name, role, permissions, 
-               is_active, created_at, last_login_at
-        FROM users
-        ORDER BY created_at DESC
-    `)
-    if err != nil {
-        w.WriteHeader(http.StatusInternalServerError)
-        json.NewEncoder(w).Encode(map[string]string{"error": "Database error"})
-        return
-    }
-    defer rows.Close()
-    
-    var users []User
-    for rows.Next() {
-        var user User
-        var permissionsJSON []byte
-        var lastLoginAt sql.NullTime
+// encryptPlaintextCardFields encrypts the plaintext external ID and metadata
+// of every card that has them. A card's fields share one key, so the card
+// is re-encrypted under the current DEK along with them. Returns the number
+// of cards encrypted.
+func (ut *UnifiedTokenizer) encryptPlaintextCardFields() int {
+    lastID, encrypted := 0, 0
+    for {
+        rows, err := ut.db.Query(`
+            SELECT id, token, card_number_encrypted, card_holder_name_encrypted, external_id, metadata, encryption_key_id
+            FROM credit_cards
+            WHERE id > ? AND (external_id IS NOT NULL OR metadata IS NOT NULL)
+            ORDER BY id
+            LIMIT ?
+        `, lastID, reencryptBatchSize)
+        if err != nil {
+            log.Printf("Column encryption of credit_cards failed: %v", err)
+            return encrypted
+        }
         
-        err := rows.Scan(&user.UserID, &user.Username, &user.Email, &user.FullName,
-            &user.Role, &permissionsJSON, &user.IsActive, &user.CreatedAt, &lastLoginAt)
+        type pendingCard struct {
+            id         int
+            token      string
+            card       []byte
+            holder     []byte
+            externalID sql.NullString
+            metadata   sql.NullString
+            keyID      sql.NullString
+        }
+        var batch []pendingCard
+        for rows.Next() {
+            var c pendingCard
+            if err := rows.Scan(&c.id, &c.token, &c.card, &c.holder, &c.externalID, &c.metadata, &c.keyID); err == nil {
+                batch = append(batch, c)
+            }
+        }
+        rows.Close()
+        if len(batch) == 0 {
+            return encrypted
+        }
+        
+        for _, c := range batch {
+            lastID = c.id
+            fields, err := ut.decryptFields(c.keyID, c.card, c.holder)
+            if err != nil {
+                log.Printf("Column encryption: skipping token %s: %v", c.token, err)
+                continue
+            }
+            externalID := normalizeExternalID(c.externalID.String)
+            sealed, keyID, err := ut.encryptFields(fields[0], fields[1], externalID, c.metadata.String)
+            if err != nil {
+                log.Printf("Column encryption: skipping token %s: %v", c.token, err)
+                continue
+            }
+            var externalIDIndex []byte
+            if externalID != "" {
+                if externalIDIndex, err = ut.blindIndex(blindIndexExternalID, externalID); err != nil {
+                    continue
+                }
+            }
+            
+            // Only replace the ciphertext we read, in case the card changed meanwhile
+            res, err := ut.db.Exec(`
+                UPDATE credit_cards
+                SET card_number_encrypted = ?, card_holder_name_encrypted = ?,
+                    external_id_encrypted = ?, external_id_index = ?, metadata_encrypted = ?,
+                    encryption_key_id = ?, external_id = NULL, metadata = NULL
+                WHERE id = ? AND card_number_encrypted = ?
+            `, sealed[0], sealed[1], sealed[2], externalIDIndex, sealed[3], keyID, c.id, c.card)
+            if err != nil {
+                log.Printf("Column encryption: failed to update token %s: %v", c.token, err)
+                continue
+            }
+            if n, _ := res.RowsAffected(); n > 0 {
+                encrypted++
+            }
+        }
+    }
+}
+
+// encryptPlaintextAuditDetails encrypts the plaintext details of every row
+// of an audit log table and returns the number of rows encrypted
+func (ut *UnifiedTokenizer) encryptPlaintextAuditDetails(table string) int {
+    lastID, encrypted := int64(0), 0
+    for {
+        rows, err := ut.db.Query(fmt.Sprintf(`
+            SELECT id, details FROM %s
+            WHERE id > ? AND details IS NOT NULL
+            ORDER BY id
+            LIMIT ?
+        `, table), lastID, reencryptBatchSize)
         if err != nil {
-            continue
+            log.Printf("Column encryption of %s failed: %v", table, err)
+            return encrypted
         }
         
-        json.Unmarshal(permissionsJSON, &user.Permissions)
-        if lastLoginAt.Valid {
-            user.LastLoginAt = &lastLoginAt.Time
+        type pendingRow struct {
+            id      int64
+            details string
+        }
+        var batch []pendingRow
+        for rows.Next() {
+            var row pendingRow
+            if err := rows.Scan(&row.id, &row.details); err == nil {
+                batch = append(batch, row)
+            }
+        }
+        rows.Close()
+        if len(batch) == 0 {
+            return encrypted
         }
         
-        users = append(users, user)
+        for _, row := range batch {
+            lastID = row.id
+            var sealed []byte
+            var keyID sql.NullString
+            // Events logged without details stored JSON null
+            if row.details != "null" {
+                fields, dekID, err := ut.encryptFields(row.details)
+                if err != nil {
+                    log.Printf("Column encryption of %s stopped: %v", table, err)
+                    return encrypted
+                }
+                sealed, keyID = fields[0], dekID
+            }
+            if _, err := ut.db.Exec(fmt.Sprintf(`
+                UPDATE %s SET details_encrypted = ?, details_key_id = ?, details = NULL
+                WHERE id = ? AND details IS NOT NULL
+            `, table), sealed, keyID, row.id); err == nil {
+                encrypted++
+            }
+        }
     }
-    
-    w.Header().Set("Content-Type", "application/json")
-    json.NewEncoder(w).Encode(map[string]interface{}{
-        "users": users,
-        "total": len(users),
-    })
 }
 
-func (ut *UnifiedTokenizer) handleCreateUser(w http.ResponseWriter, r *http.Request) {
-    var req struct {
-        Username    string   `json:"username"`
-        Email       string   `json:"email"`
-        Password    string   `json:"password"`
-        FullName    string   `json:"full_name"`
-        Role        string   `json:"role"`
-        Permissions []string `json:"permissions"`
+// Integrity check findings
+const (
+    integrityDecrypt = "decrypt"          // Ciphertext does not decrypt under its recorded key
+    integrityDigits  = "digits"           // first_six_digits or last_four_digits differ from the card number
+    integrityLuhn    = "luhn"             // Decrypted card number fails the Luhn check
+    integrityOrphan  = "orphaned_request" // token_requests rows for a token not in the vault
+)
+
+// maxIntegrityIssues caps the findings kept in a report; the counts cover all
+const maxIntegrityIssues = 1000
+
+// IntegrityIssue is one finding of an integrity check. It names the token
+// and never includes card data.
+type IntegrityIssue struct {
+    Token  string `json:"token"`
+    Check  string `json:"check"`
+    Detail string `json:"detail,omitempty"`
+}
+
+// IntegrityReport is the reconciliation report of a vault integrity check
+type IntegrityReport struct {
+    CheckID          string           `json:"check_id"`
+    Status           string           `json:"status"` // running, completed or failed
+    StartedAt        time.Time        `json:"started_at"`
+    CompletedAt      *time.Time       `json:"completed_at,omitempty"`
+    CardsChecked     int              `json:"cards_checked"`
+    DecryptFailures  int              `json:"decrypt_failures"`
+    DigitMismatches  int              `json:"digit_mismatches"`
+    LuhnFailures     int              `json:"luhn_failures"`
+    OrphanedRequests int              `json:"orphaned_requests"`
+    Issues           []IntegrityIssue `json:"issues"`
+    Error            string           `json:"error,omitempty"`
+    InitiatedBy      string           `json:"initiated_by,omitempty"`
+}
+
+// IssueCount is the number of problems found, including those beyond the
+// issues kept in the report
+func (r *IntegrityReport) IssueCount() int {
+    return r.DecryptFailures + r.DigitMismatches + r.LuhnFailures + r.OrphanedRequests
+}
+
+func (r *IntegrityReport) addIssue(token, check, detail string) {
+    switch check {
+    case integrityDecrypt:
+        r.DecryptFailures++
+    case integrityDigits:
+        r.DigitMismatches++
+    case integrityLuhn:
+        r.LuhnFailures++
+    }
+    if len(r.Issues) < maxIntegrityIssues {
+        r.Issues = append(r.Issues, IntegrityIssue{Token: token, Check: check, Detail: detail})
     }
-    
-    if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-        w.WriteHeader(http.StatusBadRequest)
-        json.NewEncoder(w).Encode(map[string]string{"error": "Invalid request body"})
+}
+
+// WriteText prints the report for the verify command
+func (r *IntegrityReport) WriteText(w io.Writer) {
+    duration := ""
+    if r.CompletedAt != nil {
+        duration = " in " + r.CompletedAt.Sub(r.StartedAt).Round(time.Millisecond).String()
+    }
+    fmt.Fprintf(w, "Integrity check %s %s%s\n", r.CheckID, r.Status, duration)
+    fmt.Fprintf(w, "  Cards checked:      %d\n", r.CardsChecked)
+    fmt.Fprintf(w, "  Decrypt failures:   %d\n", r.DecryptFailures)
+    fmt.Fprintf(w, "  Digit mismatches:   %d\n", r.DigitMismatches)
+    fmt.Fprintf(w, "  Luhn failures:      %d\n", r.LuhnFailures)
+    fmt.Fprintf(w, "  Orphaned requests:  %d\n", r.OrphanedRequests)
+    if r.Error != "" {
+        fmt.Fprintf(w, "  Error: %s\n", r.Error)
+    }
+    for _, issue := range r.Issues {
+        fmt.Fprintf(w, "  %-17s %s  %s\n", issue.Check, issue.Token, issue.Detail)
+    }
+    if n := r.IssueCount(); n > len(r.Issues) {
+        fmt.Fprintf(w, "  ... %d more issues not listed\n", n-len(r.Issues))
+    }
+}
+
+// integrityCard is a vault row as read by the integrity check
+type integrityCard struct {
+    id        int
+    token     string
+    encrypted []byte
+    holder    []byte
+    keyID     sql.NullString
+    firstSix  string
+    lastFour  string
+}
+
+// verifyCard checks that a card decrypts under its recorded key and that
+// the stored first six and last four digits and the Luhn check digit agree
+// with the card number
+func (ut *UnifiedTokenizer) verifyCard(report *IntegrityReport, c integrityCard) {
+    keyName := "legacy key"
+    if c.keyID.Valid && c.keyID.String != "" {
+        keyName = "key " + c.keyID.String
+        if !ut.useKEKDEK || ut.keyManager == nil {
+            report.addIssue(c.token, integrityDecrypt, fmt.Sprintf("card number under %s: KEK/DEK encryption is not enabled", keyName))
+            return
+        }
+    }
+    plaintext, err := ut.decryptStoredField(c.encrypted, c.keyID)
+    if err != nil {
+        report.addIssue(c.token, integrityDecrypt, fmt.Sprintf("card number under %s: %v", keyName, err))
         return
     }
+    if len(c.holder) > 0 {
+        if _, err := ut.decryptStoredField(c.holder, c.keyID); err != nil {
+            report.addIssue(c.token, integrityDecrypt, fmt.Sprintf("card holder under %s: %v", keyName, err))
+        }
+    }
     
-    // Validate required fields
-    if req.Username == "" || req.Email == "" || req.Password == "" {
-        w.WriteHeader(http.StatusBadRequest)
-        json.NewEncoder(w).Encode(map[string]string{"error": "username, email, and password are required"})
+    card := normalizeCardNumber(plaintext)
+    if len(card) < 10 {
+        report.addIssue(c.token, integrityLuhn, fmt.Sprintf("card number has %d characters", len(card)))
         return
     }
-    
-    // Validate role
-    if req.Role == "" {
-        req.Role = RoleViewer
+    if card[:6] != c.firstSix {
+        report.addIssue(c.token, integrityDigits, "first_six_digits does not match the card number")
     }
-    if req.Role != RoleAdmin && req.Role != RoleOperator && req.Role != RoleViewer {
-        w.WriteHeader(http.StatusBadRequest)
-        json.NewEncoder(w).Encode(map[string]string{"error": "Invalid role"})
-        return
+    if card[len(card)-4:] != c.lastFour {
+        report.addIssue(c.token, integrityDigits, "last_four_digits does not match the card number")
     }
-    
-    // Hash password
-    passwordHash, err := bcrypt.GenerateFromPassword([]byte(req.Password), bcrypt.DefaultCost)
-    if err != nil {
-        w.WriteHeader(http.StatusInternalServerError)
-        json.NewEncoder(w).Encode(map[string]string{"error": "Failed to hash password"})
-        return
+    if !IsValidLuhn(card) {
+        report.addIssue(c.token, integrityLuhn, "card number fails the Luhn check")
     }
-    
-    // Set default permissions based on role if not provided
-    if len(req.Permissions) == 0 {
-        switch req.Role {
-        case RoleAdmin:
-            req.Permissions = []string{PermSystemAdmin}
-        case RoleOperator:
-            req.Permissions = []string{
-                PermTokensRead, PermTokensWrite, PermTokensDelete,
-                PermActivityRead, PermStatsRead,
-            }
-        case RoleViewer:
-            req.Permissions = []string{
-                PermTokensRead, PermActivityRead, PermStatsRead,
+}
+
+// verifyVault walks credit_cards in id order verifying each card, then
+// counts token_requests rows whose token is not in the vault. Progress is
+// written to the check's row after each batch.
+func (ut *UnifiedTokenizer) verifyVault(report *IntegrityReport) error {
+    lastID := 0
+    for {
+        rows, err := ut.db.Query(`
+            SELECT id, token, card_number_encrypted, card_holder_name_encrypted, encryption_key_id,
+                   first_six_digits, last_four_digits
+            FROM credit_cards
+            WHERE id > ?
+            ORDER BY id
+            LIMIT ?
+        `, lastID, reencryptBatchSize)
+        if err != nil {
+            return fmt.Errorf("query failed: %v", err)
+        }
+        
+        var batch []integrityCard
+        for rows.Next() {
+            var c integrityCard
+            if err := rows.Scan(&c.id, &c.token, &c.encrypted, &c.holder, &c.keyID, &c.firstSix, &c.lastFour); err != nil {
+                rows.Close()
+                return fmt.Errorf("scan failed: %v", err)
             }
+            batch = append(batch, c)
+        }
+        rows.Close()
+        if len(batch) == 0 {
+            break
+        }
+        
+        for _, c := range batch {
+            lastID = c.id
+            ut.verifyCard(report, c)
+            report.CardsChecked++
         }
+        ut.db.Exec(`UPDATE integrity_checks SET cards_checked = ? WHERE check_id = ?`, report.CardsChecked, report.CheckID)
     }
     
-    userID := "usr_" + generateRandomID()
-    permissionsJSON, _ := json.Marshal(req.Permissions)
-    createdBy := r.Header.Get("X-User-ID")
-    
-    _, err = ut.db.Exec(`
-        INSERT INTO users (
-            user_id, username, email, password_hash, full_name,
-            role, permissions, is_active, is_email_verified, created_by
-        ) VALUES (?, ?, ?, ?, ?, ?, ?, TRUE, FALSE, ?)
-    `, userID, req.Username, req.Email, string(passwordHash), req.FullName,
-       req.Role, permissionsJSON, createdBy)
-    
+    // The foreign key normally prevents these; they appear when rows were
+    // deleted or restored with FOREIGN_KEY_CHECKS disabled
+    rows, err := ut.db.Query(`
+        SELECT r.token, COUNT(*)
+        FROM token_requests r
+        LEFT JOIN credit_cards c ON c.token = r.token
+        WHERE c.id IS NULL
+        GROUP BY r.token
+    `)
     if err != nil {
-        if strings.Contains(err.Error(), "Duplicate") {
-            w.WriteHeader(http.StatusConflict)
-            json.NewEncoder(w).Encode(map[string]string{"error": "Username or email already exists"})
-        } else {
-            w.WriteHeader(http.StatusInternalServerError)
-            json.NewEncoder(w).Encode(map[string]string{"error": "Failed to create user"})
-        }
-        return
+        return fmt.Errorf("orphan query failed: %v", err)
     }
-    
-    // Return created user
-    user := User{
-        UserID:      userID,
-        Username:    req.Username,
-        Email:       req.Email,
-        FullName:    req.FullName,
-        Role:        req.Role,
-        Permissions: req.Permissions,
-        IsActive:    true,
-        CreatedAt:   time.Now(),
+    defer rows.Close()
+    for rows.Next() {
+        var token string
+        var count int
+        if err := rows.Scan(&token, &count); err != nil {
+            return fmt.Errorf("scan failed: %v", err)
+        }
+        report.OrphanedRequests += count
+        report.addIssue(token, integrityOrphan, fmt.Sprintf("%d token_requests rows", count))
     }
-    
-    w.WriteHeader(http.StatusCreated)
-    w.Header().Set("Content-Type", "application/json")
-    json.NewEncoder(w).Encode(user)
+    return rows.Err()
 }
 
-// Card import handler
-func (ut *UnifiedTokenizer) handleCardImport(w http.ResponseWriter, r *http.Request) {
-    startTime := time.Now()
-    
-    // Get user ID from request context
-    userID := r.Header.Get("X-User-ID")
-    if userID == "" {
-        w.WriteHeader(http.StatusUnauthorized)
-        json.NewEncoder(w).Encode(map[string]string{"error": "Authentication required"})
-        return
+// errIntegrityCheckRunning is returned by startIntegrityCheck, with the
+// running check's ID, when this instance is already running one
+var errIntegrityCheckRunning = errors.New("an integrity check is already running")
+
+func newIntegrityReport(initiatedBy string) *IntegrityReport {
+    return &IntegrityReport{
+        CheckID:     "chk_" + generateRandomID(),
+        Status:      "running",
+        StartedAt:   time.Now(),
+        InitiatedBy: initiatedBy,
     }
+}
+
+// recordIntegrityCheck stores a check as running. A scheduled check passes
+// the interval slot it is for; the slot is unique, so when replicas race
+// for it only one insert succeeds and the others get a duplicate key error.
+func (ut *UnifiedTokenizer) recordIntegrityCheck(report *IntegrityReport, slot *int64) error {
+    _, err := ut.db.Exec(`
+        INSERT INTO integrity_checks (check_id, schedule_slot, status, started_at, initiated_by)
+        VALUES (?, ?, 'running', ?, ?)
+    `, report.CheckID, slot, report.StartedAt, report.InitiatedBy)
+    return err
+}
+
+// startIntegrityCheck starts an integrity check in the background and
+// returns its ID
+func (ut *UnifiedTokenizer) startIntegrityCheck(initiatedBy string) (string, error) {
+    report := newIntegrityReport(initiatedBy)
+    ut.mu.Lock()
+    if ut.integrityCheck != "" {
+        running := ut.integrityCheck
+        ut.mu.Unlock()
+        return running, errIntegrityCheckRunning
+    }
+    ut.integrityCheck = report.CheckID
+    ut.mu.Unlock()
+    
+    if err := ut.recordIntegrityCheck(report, nil); err != nil {
+        ut.mu.Lock()
+        ut.integrityCheck = ""
+        ut.mu.Unlock()
+        return "", err
+    }
+    go ut.runIntegrityCheck(report)
+    return report.CheckID, nil
+}
+
+// runIntegrityCheck verifies the vault, stores the report on the check's
+// row and raises a security event when anything is wrong
+func (ut *UnifiedTokenizer) runIntegrityCheck(report *IntegrityReport) {
+    defer func() {
+        ut.mu.Lock()
+        if ut.integrityCheck == report.CheckID {
+            ut.integrityCheck = ""
+        }
+        ut.mu.Unlock()
+    }()
     
-    // Parse request
-    var req CardImportRequest
-    if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-        w.WriteHeader(http.StatusBadRequest)
-        json.NewEncoder(w).Encode(map[string]string{"error": "Invalid request format"})
-        return
+    report.Status = "completed"
+    if err := ut.verifyVault(report); err != nil {
+        report.Status = "failed"
+        report.Error = err.Error()
     }
+    completedAt := time.Now()
+    report.CompletedAt = &completedAt
     
-    // Set defaults
-    if req.DuplicateHandling == "" {
-        req.DuplicateHandling = "skip"
+    issues, _ := json.Marshal(report.Issues)
+    var errMsg sql.NullString
+    if report.Error != "" {
+        errMsg = sql.NullString{String: report.Error, Valid: true}
     }
-    if req.BatchSize == 0 {
-        req.BatchSize = 100
+    if _, err := ut.db.Exec(`
+        UPDATE integrity_checks
+        SET status = ?, completed_at = ?, cards_checked = ?, decrypt_failures = ?, digit_mismatches = ?,
+            luhn_failures = ?, orphaned_requests = ?, issues = ?, error_message = ?
+        WHERE check_id = ?
+    `, report.Status, completedAt, report.CardsChecked, report.DecryptFailures, report.DigitMismatches,
+        report.LuhnFailures, report.OrphanedRequests, string(issues), errMsg, report.CheckID); err != nil {
+        log.Printf("Failed to store integrity check %s: %v", report.CheckID, err)
     }
     
-    // Generate import ID
-    importID := "imp_" + generateRandomID()
-    
-    // Decode data
-    dataBytes, err := base64.StdEncoding.DecodeString(req.Data)
-    if err != nil {
-        ut.logSecurityEvent(SecurityEvent{
-            EventType: "invalid_import_data",
-            Severity:  "medium",
-            UserID:    userID,
-            IPAddress: r.RemoteAddr,
-            UserAgent: r.UserAgent(),
-            Endpoint:  r.URL.Path,
+    log.Printf("Integrity check %s %s: %d cards checked, %d issues %s",
+        report.CheckID, report.Status, report.CardsChecked, report.IssueCount(), report.Error)
+    if report.IssueCount() > 0 {
+        ut.logSecurityEvent(SecurityEvent{
+            EventType: "vault_integrity_issues",
+            Severity:  "high",
+            IPAddress: "127.0.0.1",
+            Endpoint:  "integrity_check",
             Details: map[string]interface{}{
-                "error": "invalid base64 encoding",
-                "import_id": importID,
+                "check_id":          report.CheckID,
+                "decrypt_failures":  report.DecryptFailures,
+                "digit_mismatches":  report.DigitMismatches,
+                "luhn_failures":     report.LuhnFailures,
+                "orphaned_requests": report.OrphanedRequests,
             },
         })
-        w.WriteHeader(http.StatusBadRequest)
-        json.NewEncoder(w).Encode(map[string]string{"error": "Invalid data encoding"})
-        return
     }
+}
+
+// integrityCheckInterval reads INTEGRITY_CHECK_INTERVAL; 0 disables the
+// scheduled check
+func integrityCheckInterval() (time.Duration, error) {
+    interval, err := utils.DurationSetting("INTEGRITY_CHECK_INTERVAL", 24*time.Hour, 0, 0)
+    if err == nil && interval > 0 && interval < time.Minute {
+        err = fmt.Errorf("INTEGRITY_CHECK_INTERVAL: %s is below the minimum of 1m0s", interval)
+    }
+    return interval, err
+}
+
+// startIntegrityScheduler runs the integrity check once per interval,
+// aligned to the Unix epoch (daily checks start shortly after midnight
+// UTC). Every replica runs it; each interval is claimed through the check's
+// schedule_slot so only one replica performs it.
+func (ut *UnifiedTokenizer) startIntegrityScheduler(interval time.Duration) {
+    log.Printf("Integrity check scheduler started (runs every %v)", interval)
     
-    // Parse cards based on format
-    var cards []CardImportRecord
-    switch req.Format {
-    case "json":
-        if err := json.Unmarshal(dataBytes, &cards); err != nil {
-            w.WriteHeader(http.StatusBadRequest)
-            json.NewEncoder(w).Encode(map[string]string{"error": "Invalid JSON format"})
+    for {
+        slot := time.Now().Unix()/int64(interval/time.Second) + 1
+        next := time.Unix(slot*int64(interval/time.Second), 0)
+        jitter := time.Duration(rand.Int63n(int64(interval) / 100))
+        time.Sleep(time.Until(next) + jitter)
+        
+        if ut.keyManager != nil && ut.keyManager.IsSealed() {
+            log.Printf("Integrity check scheduler: vault is sealed, skipping this run")
+            continue
+        }
+        report := newIntegrityReport("scheduler")
+        if err := ut.recordIntegrityCheck(report, &slot); isDuplicateKey(err) {
+            continue // Another replica has it
+        } else if err != nil {
+            log.Printf("Integrity check scheduler: failed to start check: %v", err)
+            continue
+        }
+        ut.runIntegrityCheck(report)
+    }
+}
+
+// loadIntegrityReport reads a check's report, with its issues
+func (ut *UnifiedTokenizer) loadIntegrityReport(checkID string) (*IntegrityReport, error) {
+    report := &IntegrityReport{CheckID: checkID}
+    var completedAt sql.NullTime
+    var issues, errMsg, initiatedBy sql.NullString
+    err := ut.db.QueryRow(`
+        SELECT status, started_at, completed_at, cards_checked, decrypt_failures, digit_mismatches,
+               luhn_failures, orphaned_requests, issues, error_message, initiated_by
+        FROM integrity_checks
+        WHERE check_id = ?
+    `, checkID).Scan(&report.Status, &report.StartedAt, &completedAt, &report.CardsChecked,
+        &report.DecryptFailures, &report.DigitMismatches, &report.LuhnFailures, &report.OrphanedRequests,
+        &issues, &errMsg, &initiatedBy)
+    if err != nil {
+        return nil, err
+    }
+    if completedAt.Valid {
+        report.CompletedAt = &completedAt.Time
+    }
+    if issues.Valid {
+        json.Unmarshal([]byte(issues.String), &report.Issues)
+    }
+    report.Error = errMsg.String
+    report.InitiatedBy = initiatedBy.String
+    return report, nil
+}
+
+// handleIntegrityChecks lists recent integrity checks (GET) or starts one
+// in the background (POST)
+func (ut *UnifiedTokenizer) handleIntegrityChecks(w http.ResponseWriter, r *http.Request) {
+    // Permission check is handled by requirePermission middleware
+    w.Header().Set("Content-Type", "application/json")
+    
+    if r.Method == "POST" {
+        if ut.keyManager != nil && ut.keyManager.IsSealed() {
+            apierror.Write(w, r, http.StatusServiceUnavailable, apierror.VaultSealed, "Vault is sealed")
             return
         }
-    case "csv":
-        cards, err = ut.parseCSVCards(dataBytes)
-        if err != nil {
-            w.WriteHeader(http.StatusBadRequest)
-            json.NewEncoder(w).Encode(map[string]string{"error": fmt.Sprintf("CSV parse error: %v", err)})
+        checkID, err := ut.startIntegrityCheck(r.Header.Get("X-Username"))
+        if err == errIntegrityCheckRunning {
+            apierror.WriteDetails(w, r, http.StatusConflict, apierror.JobRunning, "An integrity check is already running", map[string]interface{}{
+                "check_id": checkID,
+            })
+            return
+        } else if err != nil {
+            apierror.Write(w, r, http.StatusInternalServerError, apierror.InternalError, "Database error")
             return
         }
-    default:
-        w.WriteHeader(http.StatusBadRequest)
-        json.NewEncoder(w).Encode(map[string]string{"error": "Unsupported format. Use 'json' or 'csv'"})
+        
+        ipAddress, userAgent := ut.getClientInfo(r)
+        ut.logAuditEvent(AuditEvent{
+            UserID:       r.Header.Get("X-User-ID"),
+            Action:       "integrity_check_started",
+            ResourceType: "integrity_check",
+            ResourceID:   checkID,
+            IPAddress:    ipAddress,
+            UserAgent:    userAgent,
+        })
+        
+        w.WriteHeader(http.StatusAccepted)
+        json.NewEncoder(w).Encode(map[string]string{
+            "check_id": checkID,
+            "status":   "running",
+        })
         return
     }
     
-    // Validate we have cards
-    if len(cards) == 0 {
-        w.WriteHeader(http.StatusBadRequest)
-        json.NewEncoder(w).Encode(map[string]string{"error": "No cards found in import data"})
-        return
+    limit := 20
+    if l := r.URL.Query().Get("limit"); l != "" {
+        if parsed, err := strconv.Atoi(l); err == nil && parsed > 0 && parsed <= 100 {
+            limit = parsed
+        }
     }
-    
-    // Limit the number of cards per import
-    maxCards := 10000
-    if len(cards) > maxCards {
-        w.WriteHeader(http.StatusBadRequest)
-        json.NewEncoder(w).Encode(map[string]interface{}{
-            "error": fmt.Sprintf("Too many cards. Maximum %d cards per import", maxCards),
-            "provided": len(cards),
-            "maximum": maxCards,
-        })
+    rows, err := ut.db.Query(`
+        SELECT check_id, status, started_at, completed_at, cards_checked, decrypt_failures,
+               digit_mismatches, luhn_failures, orphaned_requests, error_message, initiated_by
+        FROM integrity_checks
+        ORDER BY started_at DESC, id DESC
+        LIMIT ?
+    `, limit)
+    if err != nil {
+        apierror.Write(w, r, http.StatusInternalServerError, apierror.InternalError, "Database error")
         return
     }
+    defer rows.Close()
     
-    // Process the import
-    result := ut.processCardImport(importID, userID, cards, req)
-    result.ProcessingTime = time.Since(startTime).String()
-    
-    // Log import completion
-    ut.logAuditEvent(AuditEvent{
-        UserID:       userID,
-        Action:       "cards_import",
-        ResourceType: "cards",
-        ResourceID:   importID,
-        IPAddress:    r.RemoteAddr,
-        UserAgent:    r.UserAgent(),
-        Details: map[string]interface{}{
-            "total_records": result.TotalRecords,
-            "successful_imports": result.SuccessfulImports,
-            "failed_imports": result.FailedImports,
-            "duplicates": result.Duplicates,
-            "processing_time": result.ProcessingTime,
-            "format": req.Format,
-            "duplicate_handling": req.DuplicateHandling,
-        },
+    checks := []IntegrityReport{}
+    for rows.Next() {
+        var c IntegrityReport
+        var completedAt sql.NullTime
+        var errMsg, initiatedBy sql.NullString
+        if err := rows.Scan(&c.CheckID, &c.Status, &c.StartedAt, &completedAt, &c.CardsChecked, &c.DecryptFailures,
+            &c.DigitMismatches, &c.LuhnFailures, &c.OrphanedRequests, &errMsg, &initiatedBy); err != nil {
+            continue
+        }
+        if completedAt.Valid {
+            c.CompletedAt = &completedAt.Time
+        }
+        c.Error = errMsg.String
+        c.InitiatedBy = initiatedBy.String
+        checks = append(checks, c)
+    }
+    json.NewEncoder(w).Encode(map[string]interface{}{
+        "checks": checks,
+        "total":  len(checks),
     })
+}
+
+// handleIntegrityCheckDetail returns one check's reconciliation report
+func (ut *UnifiedTokenizer) handleIntegrityCheckDetail(w http.ResponseWriter, r *http.Request) {
+    // Permission check is handled by requirePermission middleware
+    w.Header().Set("Content-Type", "application/json")
     
-    // Return result
-    if result.FailedImports > 0 && result.SuccessfulImports == 0 {
-        w.WriteHeader(http.StatusBadRequest)
-    } else if result.FailedImports > 0 {
-        w.WriteHeader(http.StatusPartialContent)
-    } else {
-        w.WriteHeader(http.StatusOK)
+    checkID := strings.TrimPrefix(r.URL.Path, "/api/v1/integrity/checks/")
+    report, err := ut.loadIntegrityReport(checkID)
+    if err == sql.ErrNoRows {
+        apierror.Write(w, r, http.StatusNotFound, apierror.NotFound, "Integrity check not found")
+        return
+    } else if err != nil {
+        apierror.Write(w, r, http.StatusInternalServerError, apierror.InternalError, "Database error")
+        return
     }
-    
+    json.NewEncoder(w).Encode(report)
+}
+
+func (ut *UnifiedTokenizer) finishReencryption(rotationID string, rotated int, errMsg string) {
+    status := "completed"
+    if errMsg != "" {
+        status = "failed"
+    }
+
+    _, err := ut.db.Exec(`
+        UPDATE key_rotation_log
+        SET status = ?, completed_at = NOW(), cards_rotated = ?, error_message = ?
+        WHERE rotation_id = ?
+    `, status, rotated, errMsg, rotationID)
+    if err != nil {
+        log.Printf("Failed to update re-encryption log: %v", err)
+    }
+
+    log.Printf("Re-encryption %s %s: %d cards re-encrypted %s", rotationID, status, rotated, errMsg)
+}
+
+// handleKeyRotationDetail returns a single key_rotation_log entry, used to
+// poll the progress of re-encryption jobs
+func (ut *UnifiedTokenizer) handleKeyRotationDetail(w http.ResponseWriter, r *http.Request) {
+    // Permission check is handled by requirePermission middleware
+
+    rotationID := strings.TrimPrefix(r.URL.Path, "/api/v1/keys/rotations/")
+    if rotationID == "" {
+        apierror.Write(w, r, http.StatusBadRequest, apierror.InvalidRequest, "Rotation ID required")
+        return
+    }
+
+    var keyType, status string
+    var newKeyID, errorMessage, initiatedBy sql.NullString
+    var startedAt time.Time
+    var completedAt sql.NullTime
+    var cardsRotated, cardsTotal int
+    err := ut.db.QueryRow(`
+        SELECT key_type, new_key_id, status, started_at, completed_at,
+               cards_rotated, cards_total, error_message, initiated_by
+        FROM key_rotation_log
+        WHERE rotation_id = ?
+    `, rotationID).Scan(&keyType, &newKeyID, &status, &startedAt, &completedAt,
+        &cardsRotated, &cardsTotal, &errorMessage, &initiatedBy)
+    if err == sql.ErrNoRows {
+        apierror.Write(w, r, http.StatusNotFound, apierror.NotFound, "Rotation not found")
+        return
+    } else if err != nil {
+        apierror.Write(w, r, http.StatusInternalServerError, apierror.InternalError, "Database error")
+        return
+    }
+
+    rotation := map[string]interface{}{
+        "rotation_id":   rotationID,
+        "key_type":      keyType,
+        "status":        status,
+        "started_at":    startedAt.Format(time.RFC3339),
+        "cards_rotated": cardsRotated,
+        "cards_total":   cardsTotal,
+    }
+    if newKeyID.Valid {
+        rotation["new_key_id"] = newKeyID.String
+    }
+    if completedAt.Valid {
+        rotation["completed_at"] = completedAt.Time.Format(time.RFC3339)
+        rotation["duration_ms"] = completedAt.Time.Sub(startedAt).Milliseconds()
+    }
+    if errorMessage.Valid && errorMessage.String != "" {
+        rotation["error_message"] = errorMessage.String
+    }
+    if initiatedBy.Valid {
+        rotation["initiated_by"] = initiatedBy.String
+    }
+
     w.Header().Set("Content-Type", "application/json")
-    json.NewEncoder(w).Encode(result)
+    json.NewEncoder(w).Encode(rotation)
 }
 
-// parseCSVCards parses CSV data into CardImportRecord slice
-func (ut *UnifiedTokenizer) parseCSVCards(data []byte) ([]CardImportRecord, error) {
-    lines := strings.Split(string(data), "\n")
-    if len(lines) < 2 {
-        return nil, fmt.Errorf("CSV must have at least a header and one data row")
+func (ut *UnifiedTokenizer) startICAPServer() {
+    listener, err := net.Listen("tcp", ":"+ut.icapPort)
+    if err != nil {
+        log.Fatalf("Failed to start ICAP server: %v", err)
     }
-    
-    // Parse header
-    header := strings.Split(strings.TrimSpace(lines[0]), ",")
-    headerMap := make(map[string]int)
-    for i, col := range header {
-        headerMap[strings.TrimSpace(strings.Trim(col, "\""))] = i
+    if ut.tlsConfig != nil {
+        listener = tls.NewListener(listener, ut.tlsConfig)
     }
+    defer listener.Close()
     
-    // Required columns
-    required := []string{"card_number", "expiry_month", "expiry_year"}
-    for _, req := range required {
-        if _, exists := headerMap[req]; !exists {
-            return nil, fmt.Errorf("missing required column: %s", req)
-        }
-    }
+    log.Printf("Starting ICAP detokenization server on port %s", ut.icapPort)
     
-    var cards []CardImportRecord
-    for i, line := range lines[1:] {
-        line = strings.TrimSpace(line)
-        if line == "" {
+    for {
+        conn, err := listener.Accept()
+        if err != nil {
+            log.Printf("Failed to accept connection: %v", err)
             continue
         }
         
-        cols := strings.Split(line, ",")
-        if len(cols) < len(required) {
-            return nil, fmt.Errorf("row %d: insufficient columns", i+2)
-        }
-        
-        // Clean and parse columns
-        for j := range cols {
-            cols[j] = strings.TrimSpace(strings.Trim(cols[j], "\""))
-        }
-        
-        card := CardImportRecord{}
-        
-        // Required fields
-        card.CardNumber = cols[headerMap["card_number"]]
-        
-        if monthStr := cols[headerMap["expiry_month"]]; monthStr != "" {
-            if month, err := strconv.Atoi(monthStr); err == nil {
-                card.ExpiryMonth = month
-            } else {
-                return nil, fmt.Errorf("row %d: invalid expiry_month: %s", i+2, monthStr)
-            }
-        }
-        
-        if yearStr := cols[headerMap["expiry_year"]]; yearStr != "" {
-            if year, err := strconv.Atoi(yearStr); err == nil {
-                card.ExpiryYear = year
-            } else {
-                return nil, fmt.Errorf("row %d: invalid expiry_year: %s", i+2, yearStr)
-            }
-        }
-        
-        // Optional fields
-        if idx, exists := headerMap["card_holder"]; exists && idx < len(cols) {
-            card.CardHolder = cols[idx]
-        }
-        if idx, exists := headerMap["external_id"]; exists && idx < len(cols) {
-            card.ExternalID = cols[idx]
-        }
-        if idx, exists := headerMap["metadata"]; exists && idx < len(cols) {
-            card.Metadata = cols[idx]
+        if remote := conn.RemoteAddr().String(); !ut.ipFilter("icap").AllowsRemote(remote) {
+            conn.Close()
+            go ut.ipBlocked("icap", remote, "icap", "")
+            continue
         }
-        
-        cards = append(cards, card)
+        ut.icapPool.Serve(conn)
     }
-    
-    return cards, nil
 }
 
-// processCardImport processes a batch of cards for import
-func (ut *UnifiedTokenizer) processCardImport(importID, userID string, cards []CardImportRecord, req CardImportRequest) CardImportResult {
-    result := CardImportResult{
-        TotalRecords:    len(cards),
-        ImportID:        importID,
-        Status:          "completed",
-        TokensGenerated: make([]CardImportSuccess, 0),
-        Errors:          make([]CardImportError, 0),
+// smtpDefaultAllowedCIDRs are the clients the SMTP filter accepts unless
+// SMTP_ALLOWED_CIDRS says otherwise: mail servers on the same host or a
+// private network
+const smtpDefaultAllowedCIDRs = "127.0.0.0/8,::1,10.0.0.0/8,172.16.0.0/12,192.168.0.0/16"
+
+// loadSMTPFilter sets up the SMTP content filter from the SMTP_* settings.
+// The filter is off when SMTP_PORT is not set.
+func (ut *UnifiedTokenizer) loadSMTPFilter() error {
+    ut.smtpPort = utils.GetEnv("SMTP_PORT", "")
+    if ut.smtpPort == "" {
+        return nil
+    }
+    relayAddr := utils.GetEnv("SMTP_RELAY_ADDR", "")
+    if _, _, err := net.SplitHostPort(relayAddr); err != nil {
+        return fmt.Errorf("SMTP_RELAY_ADDR must be the next hop's host:port when SMTP_PORT is set")
+    }
+    ut.smtpCardAction = utils.GetEnv("SMTP_PAN_ACTION", "tokenize")
+    if ut.smtpCardAction != "tokenize" && ut.smtpCardAction != "mask" {
+        return fmt.Errorf("invalid SMTP_PAN_ACTION %q: use tokenize or mask", ut.smtpCardAction)
+    }
+    maxSize, err := utils.ByteSizeSetting("SMTP_MAX_MESSAGE_SIZE", 25<<20, 1<<10, 1<<30)
+    if err != nil {
+        return err
     }
-    
-    // Process in batches
-    batchSize := req.BatchSize
-    if batchSize > 1000 {
-        batchSize = 1000
+    timeout, err := utils.DurationSetting("SMTP_TIMEOUT", 5*time.Minute, time.Second, time.Hour)
+    if err != nil {
+        return err
     }
-    
-    for i := 0; i < len(cards); i += batchSize {
-        end := i + batchSize
-        if end > len(cards) {
-            end = len(cards)
-        }
-        
-        batch := cards[i:end]
-        ut.processBatch(batch, i, &result, req)
+    ut.smtpAllowed = ipfilter.Filter{Allow: strings.Split(utils.GetEnv("SMTP_ALLOWED_CIDRS", smtpDefaultAllowedCIDRs), ",")}
+    if err := ut.smtpAllowed.Normalize(); err != nil {
+        return fmt.Errorf("invalid SMTP_ALLOWED_CIDRS: %v", err)
     }
     
-    // Update final status
-    if result.FailedImports > 0 && result.SuccessfulImports == 0 {
-        result.Status = "failed"
-    } else if result.FailedImports > 0 {
-        result.Status = "partial"
+    hostname, _ := os.Hostname()
+    hostname = utils.GetEnv("SMTP_HOSTNAME", hostname)
+    sender := &smtprelay.Sender{Addr: relayAddr, Hostname: hostname, Timeout: timeout}
+    if utils.GetEnv("SMTP_RELAY_STARTTLS", "true") == "true" {
+        sender.TLSConfig = &tls.Config{MinVersion: tls.VersionTLS12}
     }
-    
-    return result
+    ut.smtpServer = &smtprelay.Server{
+        Hostname:      hostname,
+        Filter:        ut.filterMail,
+        Relay:         sender.Send,
+        MaxSize:       maxSize,
+        MaxRecipients: 1000,
+        Timeout:       timeout,
+        TLSConfig:     ut.tlsConfig,
+    }
+    return nil
 }
 
-// processBatch processes a single batch of cards
-func (ut *UnifiedTokenizer) processBatch(batch []CardImportRecord, startIndex int, result *CardImportResult, req CardImportRequest) {
-    // Start transaction for batch
-    tx, err := ut.db.Begin()
+// filterMail replaces the card numbers in an email with tokens or masks,
+// recording an incident for each message that had any. A message whose
+// structure cannot be followed is refused rather than relayed unscanned.
+func (ut *UnifiedTokenizer) filterMail(env *smtprelay.Envelope, msg []byte) ([]byte, error) {
+    out, result, err := mailscan.Rewrite(msg, ut.replaceMailCards)
+    atomic.AddInt64(&ut.smtpUnscanned, int64(result.Skipped))
     if err != nil {
-        for j, card := range batch {
-            result.Errors = append(result.Errors, CardImportError{
-                RecordIndex: startIndex + j,
-                ExternalID:  card.ExternalID,
-                CardNumber:  maskCardNumber(card.CardNumber),
-                Error:       "Database transaction error",
-                Reason:      err.Error(),
-            })
-            result.FailedImports++
-        }
-        return
+        atomic.AddInt64(&ut.smtpRejected, 1)
+        log.Printf("Rejected email from %s: %v", env.RemoteAddr, err)
+        return nil, &smtprelay.Reply{Code: 554, Message: "5.6.0 Message could not be scanned for card numbers"}
+    }
+    if result.Replaced == 0 {
+        atomic.AddInt64(&ut.smtpClean, 1)
+        return msg, nil
     }
     
-    batchSuccess := true
-    
-    for j, card := range batch {
-        recordIndex := startIndex + j
-        result.ProcessedRecords++
-        
-        // Validate card
-        if err := ut.validateCardRecord(card); err != nil {
-            result.Errors = append(result.Errors, CardImportError{
-                RecordIndex: recordIndex,
-                ExternalID:  card.ExternalID,
-                CardNumber:  maskCardNumber(card.CardNumber),
-                Error:       "Validation failed",
-                Reason:      err.Error(),
-            })
-            result.FailedImports++
-            batchSuccess = false
-            continue
+    atomic.AddInt64(&ut.smtpReplaced, 1)
+    atomic.AddInt64(&ut.smtpCards, int64(result.Replaced))
+    ipAddress := env.RemoteAddr
+    if host, _, err := net.SplitHostPort(env.RemoteAddr); err == nil {
+        ipAddress = host
+    }
+    log.Printf("Replaced %d card numbers in email %s from %s", result.Replaced, result.MessageID, env.From)
+    ut.logSecurityEvent(SecurityEvent{
+        EventType: "email_card_numbers_replaced",
+        Severity:  "medium",
+        IPAddress: ipAddress,
+        Endpoint:  "smtp",
+        Details: map[string]interface{}{
+            "from":            env.From,
+            "recipients":      env.To,
+            "message_id":      result.MessageID,
+            "card_numbers":    result.Replaced,
+            "action":          ut.smtpCardAction,
+            "unscanned_parts": result.Skipped,
+        },
+    })
+    return out, nil
+}
+
+// cardGroupRegex matches card numbers written in groups, like
+// 4111 1111 1111 1111 or 3782-822463-10005, as people type them in mail
+var cardGroupRegex = regexp.MustCompile(`\b[0-9]{4}(?:[ -][0-9]{2,6}){2,4}\b`)
+
+// replaceMailCards replaces the card numbers in the text of an email,
+// written as one run of digits or in groups
+func (ut *UnifiedTokenizer) replaceMailCards(text string) (string, int) {
+    count := 0
+    text, _ = ut.scanner.Replace(text, func(m scanner.Match, value string) (string, bool) {
+        if m.Kind != scanner.PAN {
+            return "", false
         }
-        
-        // Check for duplicates
-        exists, existingToken, err := ut.checkCardExists(card.CardNumber)
-        if err != nil {
-            result.Errors = append(result.Errors, CardImportError{
-                RecordIndex: recordIndex,
-                ExternalID:  card.ExternalID,
-                CardNumber:  maskCardNumber(card.CardNumber),
-                Error:       "Duplicate check failed",
-                Reason:      err.Error(),
-            })
-            result.FailedImports++
-            batchSuccess = false
-            continue
+        count++
+        return ut.mailCardReplacement(value), true
+    })
+    text = cardGroupRegex.ReplaceAllStringFunc(text, func(group string) string {
+        digits := normalizeCardNumber(group)
+        if !scanner.IsPAN(digits) {
+            return group
         }
-        
-        if exists {
-            result.Duplicates++
-            switch req.DuplicateHandling {
-            case "skip":
-                // Skip this card
-                continue
-            case "error":
-                result.Errors = append(result.Errors, CardImportError{
-                    RecordIndex: recordIndex,
-                    ExternalID:  card.ExternalID,
-                    CardNumber:  maskCardNumber(card.CardNumber),
-                    Error:       "Duplicate card",
-                    Reason:      fmt.Sprintf("Card already exists with token: %s", existingToken),
-                })
-                result.FailedImports++
-                batchSuccess = false
-                continue
-            case "overwrite":
-                // Continue with processing, will update existing record
-            }
+        count++
+        return ut.mailCardReplacement(digits)
+    })
+    return text, count
+}
+
+// mailCardReplacement is what a card number in mail becomes. A card that
+// cannot be tokenized is masked, so it never goes out in the clear.
+func (ut *UnifiedTokenizer) mailCardReplacement(cardNumber string) string {
+    if ut.smtpCardAction == "tokenize" {
+        token, err := ut.tokenizeCard(cardNumber, cardDetails{})
+        if err == nil {
+            return token
         }
-        
-        // Tokenize card
-        token, cardType, err := ut.tokenizeCardForImport(card, tx)
+        log.Printf("Error tokenizing card in email, masking it instead: %v", err)
+    }
+    return maskCardNumber(cardNumber)
+}
+
+// startSMTPServer accepts mail from the mail server's content filter hook
+func (ut *UnifiedTokenizer) startSMTPServer() {
+    listener, err := net.Listen("tcp", ":"+ut.smtpPort)
+    if err != nil {
+        log.Fatalf("Failed to start SMTP filter: %v", err)
+    }
+    defer listener.Close()
+    
+    log.Printf("Starting SMTP filter on port %s", ut.smtpPort)
+    
+    for {
+        conn, err := listener.Accept()
         if err != nil {
-            result.Errors = append(result.Errors, CardImportError{
-                RecordIndex: recordIndex,
-                ExternalID:  card.ExternalID,
-                CardNumber:  maskCardNumber(card.CardNumber),
-                Error:       "Tokenization failed",
-                Reason:      err.Error(),
-            })
-            result.FailedImports++
-            batchSuccess = false
+            log.Printf("Failed to accept connection: %v", err)
             continue
         }
-        
-        result.SuccessfulImports++
-        result.TokensGenerated = append(result.TokensGenerated, CardImportSuccess{
-            RecordIndex: recordIndex,
-            ExternalID:  card.ExternalID,
-            Token:       token,
-            CardType:    cardType,
-            LastFour:    card.CardNumber[len(card.CardNumber)-4:],
-        })
-    }
-    
-    // Commit or rollback transaction
-    if batchSuccess {
-        if err := tx.Commit(); err != nil {
-            // If commit fails, mark all cards in this batch as failed
-            for j, card := range batch {
-                result.Errors = append(result.Errors, CardImportError{
-                    RecordIndex: startIndex + j,
-                    ExternalID:  card.ExternalID,
-                    CardNumber:  maskCardNumber(card.CardNumber),
-                    Error:       "Transaction commit failed",
-                    Reason:      err.Error(),
-                })
-                result.FailedImports++
+        if remote := conn.RemoteAddr().String(); !ut.smtpAllowed.AllowsRemote(remote) {
+            conn.Close()
+            if ut.debug {
+                log.Printf("DEBUG: SMTP connection from %s refused by SMTP_ALLOWED_CIDRS", remote)
             }
-            // Remove successful imports from this batch
-            result.SuccessfulImports -= len(batch)
-            result.TokensGenerated = result.TokensGenerated[:len(result.TokensGenerated)-len(batch)]
+            continue
         }
-    } else {
-        tx.Rollback()
+        go ut.smtpServer.Serve(conn)
     }
 }
 
-// Helper functions for card import
+// batchWatcher picks up settlement files from the batch inbox
+type batchWatcher struct {
+    source     dropfolder.Source
+    processor  *batchfile.Processor
+    outputDir  string
+    archiveDir string
+    interval   time.Duration
+    maxSize    int64
+    stable     dropfolder.Stable
+    oversized  map[string]int64 // Files too large to process, logged once per size
+}
 
-// maskCardNumber masks a credit card number for logging (shows only last 4 digits)
-func maskCardNumber(cardNumber string) string {
-    if len(cardNumber) < 4 {
-        return "****"
-    }
-    return "****" + cardNumber[len(cardNumber)-4:]
+// BatchFileReport is the processing report written next to a batch file's
+// output as <name>.report.json. It holds counts and row numbers, never card
+// data.
+type BatchFileReport struct {
+    FileID      string    `json:"file_id"`
+    File        string    `json:"file"`
+    Source      string    `json:"source"`
+    SHA256      string    `json:"sha256"`
+    Status      string    `json:"status"`
+    Error       string    `json:"error,omitempty"`
+    Output      string    `json:"output,omitempty"`
+    Archive     string    `json:"archive"`
+    StartedAt   time.Time `json:"started_at"`
+    CompletedAt time.Time `json:"completed_at"`
+    *batchfile.Report
 }
 
-// validateCardRecord validates a single card record
-func (ut *UnifiedTokenizer) validateCardRecord(card CardImportRecord) error {
-    // Validate card number
-    if card.CardNumber == "" {
-        return fmt.Errorf("card number is required")
+// batchClaimTimeout is how long a replica may hold a file before another
+// takes it over, assuming the first stopped mid-file
+const batchClaimTimeout = time.Hour
+
+// loadBatchWatcher sets up the batch file watcher from the BATCH_* settings.
+// The watcher is off when BATCH_INBOX is not set.
+func (ut *UnifiedTokenizer) loadBatchWatcher() error {
+    inbox := utils.GetEnv("BATCH_INBOX", "")
+    if inbox == "" {
+        return nil
     }
-    
-    // Remove spaces and dashes
-    cleanCard := strings.ReplaceAll(strings.ReplaceAll(card.CardNumber, " ", ""), "-", "")
-    if len(cleanCard) < 13 || len(cleanCard) > 19 {
-        return fmt.Errorf("card number must be between 13 and 19 digits")
+    bw := &batchWatcher{
+        outputDir:  utils.GetEnv("BATCH_OUTPUT_DIR", ""),
+        archiveDir: utils.GetEnv("BATCH_ARCHIVE_DIR", ""),
+        oversized:  make(map[string]int64),
     }
-    
-    // Check if all characters are digits
-    for _, char := range cleanCard {
-        if char < '0' || char > '9' {
-            return fmt.Errorf("card number must contain only digits")
-        }
+    if bw.outputDir == "" || bw.archiveDir == "" {
+        return fmt.Errorf("BATCH_OUTPUT_DIR and BATCH_ARCHIVE_DIR are required when BATCH_INBOX is set")
     }
     
-    // Validate using Luhn algorithm
-    if !utils.IsValidLuhn(cleanCard) {
-        return fmt.Errorf("card number fails Luhn algorithm validation")
+    layout := batchfile.Layout{
+        Format:       utils.GetEnv("BATCH_FORMAT", batchfile.CSV),
+        Header:       utils.GetEnv("BATCH_CSV_HEADER", "true") == "true",
+        RecordPrefix: utils.GetEnv("BATCH_RECORD_PREFIX", ""),
     }
-    
-    // Validate expiry
-    if card.ExpiryMonth < 1 || card.ExpiryMonth > 12 {
-        return fmt.Errorf("expiry month must be between 1 and 12")
+    var err error
+    if layout.Columns, err = batchfile.ParseColumns(layout.Format, utils.GetEnv("BATCH_COLUMNS", "")); err != nil {
+        return fmt.Errorf("invalid BATCH_COLUMNS: %v", err)
+    }
+    delimiter := utils.GetEnv("BATCH_CSV_DELIMITER", ",")
+    if delimiter == "tab" {
+        delimiter = "\t"
+    }
+    r, size := utf8.DecodeRuneInString(delimiter)
+    if size == 0 || size != len(delimiter) || r == '"' || r == '\r' || r == '\n' || r == utf8.RuneError {
+        return fmt.Errorf("invalid BATCH_CSV_DELIMITER %q: want one character", delimiter)
+    }
+    layout.Delimiter = r
+    if layout.Format == batchfile.Fixed {
+        // Prefix tokens are "tok_" and 44 base64 characters; Luhn tokens are 16 digits
+        tokenLength := 48
+        if ut.tokenFormat == "luhn" {
+            tokenLength = 16
+        }
+        for _, c := range layout.Columns {
+            if width := c.End - c.Start + 1; width < tokenLength {
+                return fmt.Errorf("BATCH_COLUMNS: column %s is %d characters wide, too narrow for %d-character tokens (use TOKEN_FORMAT=luhn)", c, width, tokenLength)
+            }
+        }
     }
-    
-    currentYear := time.Now().Year()
-    if card.ExpiryYear < currentYear || card.ExpiryYear > currentYear+50 {
-        return fmt.Errorf("expiry year must be between %d and %d", currentYear, currentYear+50)
+    bw.processor = &batchfile.Processor{
+        Layout:   layout,
+        Tokenize: func(cardNumber string) (string, error) { return ut.tokenizeCard(cardNumber, cardDetails{}) },
+        Mask:     ut.maskCardDigits,
     }
     
-    // Check if card is expired
-    currentTime := time.Now()
-    expiryTime := time.Date(card.ExpiryYear, time.Month(card.ExpiryMonth+1), 1, 0, 0, 0, 0, time.UTC).Add(-time.Second)
-    if currentTime.After(expiryTime) {
-        return fmt.Errorf("card is expired")
+    if bw.interval, err = utils.DurationSetting("BATCH_POLL_INTERVAL", 30*time.Second, time.Second, 24*time.Hour); err != nil {
+        return err
     }
-    
-    // Validate card holder name if provided
-    if card.CardHolder != "" && len(card.CardHolder) > 100 {
-        return fmt.Errorf("card holder name too long (max 100 characters)")
+    if bw.maxSize, err = utils.ByteSizeSetting("BATCH_MAX_FILE_SIZE", 100<<20, 1<<10, 2<<30); err != nil {
+        return err
     }
-    
-    // Validate external ID if provided
-    if card.ExternalID != "" && len(card.ExternalID) > 64 {
-        return fmt.Errorf("external ID too long (max 64 characters)")
+    if addr := utils.GetEnv("BATCH_SFTP_ADDR", ""); addr != "" {
+        bw.source, err = dropfolder.NewSFTP(addr, inbox,
+            utils.GetEnv("BATCH_SFTP_USER", ""), utils.GetEnv("BATCH_SFTP_PASSWORD", ""),
+            utils.GetEnv("BATCH_SFTP_KEY_FILE", ""), utils.GetEnv("BATCH_SFTP_KNOWN_HOSTS", ""), 30*time.Second)
+        if err != nil {
+            return fmt.Errorf("invalid BATCH_SFTP_* settings: %v", err)
+        }
+    } else {
+        bw.source = dropfolder.Dir(inbox)
     }
-    
+    for _, dir := range []string{bw.outputDir, bw.archiveDir} {
+        if err := os.MkdirAll(dir, 0700); err != nil {
+            return fmt.Errorf("failed to create batch directory: %v", err)
+        }
+    }
+    ut.batchWatcher = bw
     return nil
 }
 
-// checkCardExists checks if a card already exists in the database
-func (ut *UnifiedTokenizer) checkCardExists(cardNumber string) (bool, string, error) {
-    // Clean card number
-    cleanCard := strings.ReplaceAll(strings.ReplaceAll(cardNumber, " ", ""), "-", "")
-    
-    // Get last 4 digits for lookup
-    lastFour := cleanCard[len(cleanCard)-4:]
-    
-    var token string
-    var encryptedCard []byte
-    
-    rows, err := ut.db.Query(`
-        SELECT token, card_number_encrypted 
-        FROM credit_cards 
-        WHERE last_four_digits = ? AND is_active = TRUE
-    `, lastFour)
+// maskCardDigits masks the card numbers in text, keeping its length so
+// fixed-width records and binary messages line up
+func (ut *UnifiedTokenizer) maskCardDigits(text string) (string, int) {
+    count := 0
+    text, _ = ut.scanner.Replace(text, func(m scanner.Match, value string) (string, bool) {
+        if m.Kind != scanner.PAN {
+            return "", false
+        }
+        count++
+        return batchfile.MaskDigits(value), true
+    })
+    return text, count
+}
+
+// startBatchWatcher polls the batch inbox until the process exits
+func (ut *UnifiedTokenizer) startBatchWatcher() {
+    bw := ut.batchWatcher
+    log.Printf("Batch watcher started on %s (polls every %v)", bw.source, bw.interval)
     
+    for {
+        ut.pollBatchInbox()
+        time.Sleep(bw.interval)
+    }
+}
+
+// pollBatchInbox processes the files in the inbox that have not changed
+// since the previous poll. A file that fails for a reason that may pass,
+// like the database being down, is left in the inbox for the next poll.
+func (ut *UnifiedTokenizer) pollBatchInbox() {
+    bw := ut.batchWatcher
+    if ut.keyManager != nil && ut.keyManager.IsSealed() {
+        return
+    }
+    conn, err := bw.source.Open()
     if err != nil {
-        return false, "", err
+        log.Printf("Batch watcher: failed to open %s: %v", bw.source, err)
+        return
+    }
+    defer conn.Close()
+    files, err := conn.List()
+    if err != nil {
+        log.Printf("Batch watcher: failed to list %s: %v", bw.source, err)
+        return
     }
-    defer rows.Close()
     
-    // Check each card with matching last 4 digits
-    for rows.Next() {
-        if err := rows.Scan(&token, &encryptedCard); err != nil {
-            continue
-        }
-        
-        // Decrypt and compare
-        decryptedCard, err := ut.decryptCardNumber(encryptedCard)
-        if err != nil {
+    for _, f := range bw.stable.Ready(files) {
+        if f.Size > bw.maxSize {
+            if bw.oversized[f.Name] != f.Size {
+                bw.oversized[f.Name] = f.Size
+                log.Printf("Batch watcher: %s is larger than BATCH_MAX_FILE_SIZE, leaving it in the inbox", f.Name)
+            }
             continue
         }
-        
-        if decryptedCard == cleanCard {
-            return true, token, nil
+        if err := ut.processBatchFile(conn, f.Name); err != nil {
+            log.Printf("Batch watcher: %s not processed, will retry: %v", f.Name, err)
         }
     }
-    
-    return false, "", nil
 }
 
-// tokenizeCardForImport tokenizes a card during import process
-func (ut *UnifiedTokenizer) tokenizeCardForImport(card CardImportRecord, tx *sql.Tx) (string, string, error) {
-    // Clean card number
-    cleanCard := strings.ReplaceAll(strings.ReplaceAll(card.CardNumber, " ", ""), "-", "")
-    
-    // Generate token
-    token := ut.generateToken()
-    
-    // Detect card type
-    cardType := utils.DetectCardType(cleanCard)
-    
-    // Encrypt card number
-    encryptedCard, err := ut.encryptCardNumber(cleanCard)
+// processBatchFile tokenizes one file, writes its output and report,
+// archives the original encrypted and removes it from the inbox. A file
+// that does not match the layout is archived and reported as failed, with
+// no output.
+func (ut *UnifiedTokenizer) processBatchFile(conn dropfolder.Conn, name string) error {
+    bw := ut.batchWatcher
+    data, err := conn.Read(name, bw.maxSize)
     if err != nil {
-        return "", "", fmt.Errorf("failed to encrypt card: %v", err)
+        return err
     }
-    
-    // Encrypt card holder name if provided
-    var encryptedHolder []byte
-    if card.CardHolder != "" {
-        encryptedHolder, err = ut.encryptCardNumber(card.CardHolder)
-        if err != nil {
-            return "", "", fmt.Errorf("failed to encrypt card holder: %v", err)
+    sum := sha256.Sum256(data)
+    report := &BatchFileReport{
+        FileID:    "bat_" + generateRandomID(),
+        File:      name,
+        Source:    bw.source.String(),
+        SHA256:    hex.EncodeToString(sum[:]),
+        StartedAt: time.Now().UTC(),
+    }
+    claimed, status, err := ut.claimBatchFile(report)
+    if err != nil {
+        return fmt.Errorf("failed to claim file: %v", err)
+    }
+    if !claimed {
+        if status == "processing" {
+            return nil // Another replica has it
         }
+        // Processed before: dropped again, or left behind by a replica that stopped before removing it
+        log.Printf("Batch watcher: %s was already processed (%s), removing it from the inbox", name, status)
+        return conn.Remove(name)
     }
     
-    // Get first 6 and last 4 digits
-    firstSix := cleanCard[:6]
-    lastFour := cleanCard[len(cleanCard)-4:]
+    out, fileReport, err := bw.processor.Process(data)
+    var formatErr *batchfile.FormatError
+    if errors.As(err, &formatErr) {
+        report.Status, report.Error = "failed", formatErr.Error()
+    } else if err != nil {
+        ut.releaseBatchFile(report.FileID)
+        return err
+    } else {
+        report.Status, report.Report = "completed", fileReport
+    }
     
-    // Get encryption key ID if using KEK/DEK
-    var keyID *string
-    if ut.useKEKDEK && ut.keyManager != nil {
-        if currentKeyID := ut.keyManager.getCurrentDEKID(); currentKeyID != "" {
-            keyID = &currentKeyID
+    if report.Archive, err = ut.archiveBatchFile(name, data, report.StartedAt); err != nil {
+        ut.releaseBatchFile(report.FileID)
+        return fmt.Errorf("failed to archive: %v", err)
+    }
+    if report.Status == "completed" {
+        report.Output = name
+        if err := writeFileAtomic(filepath.Join(bw.outputDir, name), out); err != nil {
+            ut.releaseBatchFile(report.FileID)
+            return fmt.Errorf("failed to write output: %v", err)
         }
     }
+    report.CompletedAt = time.Now().UTC()
+    reportJSON, _ := json.MarshalIndent(report, "", "  ")
+    if err := writeFileAtomic(filepath.Join(bw.outputDir, name+".report.json"), append(reportJSON, '\n')); err != nil {
+        log.Printf("Batch watcher: failed to write report for %s: %v", name, err)
+    }
+    if err := ut.finishBatchFile(report); err != nil {
+        log.Printf("Batch watcher: failed to record %s: %v", name, err)
+    }
     
-    // Insert into database using transaction
-    _, err = tx.Exec(`
-        INSERT INTO credit_cards (
-            token, card_number_encrypted, card_holder_name_encrypted,
-            expiry_month, expiry_year, card_type, last_four_digits, first_six_digits,
-            encryption_key_id, created_at, is_active
-        ) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, NOW(), TRUE)
-        ON DUPLICATE KEY UPDATE
-            card_number_encrypted = VALUES(card_number_encrypted),
-            card_holder_name_encrypted = VALUES(card_holder_name_encrypted),
-            expiry_month = VALUES(expiry_month),
-            expiry_year = VALUES(expiry_year),
-            card_type = VALUES(card_type),
-            encryption_key_id = VALUES(encryption_key_id),
-            updated_at = NOW()
-    `, token, encryptedCard, encryptedHolder, card.ExpiryMonth, card.ExpiryYear, 
-       cardType, lastFour, firstSix, keyID)
+    if report.Status == "failed" {
+        atomic.AddInt64(&ut.batchFailed, 1)
+        log.Printf("Batch file %s failed: %s", name, report.Error)
+    } else {
+        atomic.AddInt64(&ut.batchCompleted, 1)
+        atomic.AddInt64(&ut.batchTokenized, int64(fileReport.Tokenized))
+        atomic.AddInt64(&ut.batchMasked, int64(fileReport.Masked))
+        log.Printf("Batch file %s processed: %d rows, %d cards tokenized, %d masked, %d row errors",
+            name, fileReport.Rows, fileReport.Tokenized, fileReport.Masked, fileReport.ErrorCount)
+        if fileReport.Masked > 0 {
+            ut.logSecurityEvent(SecurityEvent{
+                EventType: "batch_card_numbers_masked",
+                Severity:  "medium",
+                Endpoint:  "batch",
+                Details: map[string]interface{}{
+                    "file":         name,
+                    "file_id":      report.FileID,
+                    "card_numbers": fileReport.Masked,
+                },
+            })
+        }
+    }
+    return conn.Remove(name)
+}
+
+// claimBatchFile records that this replica is processing a file. claimed is
+// false, with the file's status, when it has been processed already or
+// another replica is processing it.
+func (ut *UnifiedTokenizer) claimBatchFile(report *BatchFileReport) (claimed bool, status string, err error) {
+    _, err = ut.db.Exec(`
+        INSERT INTO batch_files (file_id, file_name, file_sha256, status, started_at)
+        VALUES (?, ?, ?, 'processing', ?)
+    `, report.FileID, report.File, report.SHA256, report.StartedAt)
+    if err == nil {
+        return true, "processing", nil
+    }
+    if !isDuplicateKey(err) {
+        return false, "", err
+    }
     
+    // Take over a claim its replica has held too long
+    result, err := ut.db.Exec(`
+        UPDATE batch_files SET file_id = ?, started_at = ?
+        WHERE file_name = ? AND file_sha256 = ? AND status = 'processing' AND started_at < ?
+    `, report.FileID, report.StartedAt, report.File, report.SHA256, report.StartedAt.Add(-batchClaimTimeout))
     if err != nil {
-        return "", "", fmt.Errorf("failed to store card: %v", err)
+        return false, "", err
     }
-    
-    return token, cardType, nil
+    if n, _ := result.RowsAffected(); n == 1 {
+        return true, "processing", nil
+    }
+    err = ut.db.QueryRow(`SELECT status FROM batch_files WHERE file_name = ? AND file_sha256 = ?`,
+        report.File, report.SHA256).Scan(&status)
+    return false, status, err
 }
 
-func (ut *UnifiedTokenizer) handleGetUser(w http.ResponseWriter, r *http.Request) {
-    username := strings.TrimPrefix(r.URL.Path, "/api/v1/users/")
-    
-    var user User
-    var permissionsJSON []byte
-    var lastLoginAt sql.NullTime
-    
-    err := ut.db.QueryRow(`
-        SELECT user_id, username, email, full_name, role, permissions,
-               is_active, created_at, last_login_at
-        FROM users
-        WHERE username = ? OR user_id = ?
-    `, username, username).Scan(
-        &user.UserID, &user.Username, &user.Email, &user.FullName,
-        &user.Role, &permissionsJSON, &user.IsActive, &user.CreatedAt, &lastLoginAt,
-    )
-    
-    if err == sql.ErrNoRows {
-        w.WriteHeader(http.StatusNotFound)
-        json.NewEncoder(w).Encode(map[string]string{"error": "User not found"})
-        return
-    } else if err != nil {
-        w.WriteHeader(http.StatusInternalServerError)
-        json.NewEncoder(w).Encode(map[string]string{"error": "Database error"})
-        return
+// releaseBatchFile drops a claim so the file is tried again
+func (ut *UnifiedTokenizer) releaseBatchFile(fileID string) {
+    if _, err := ut.db.Exec("DELETE FROM batch_files WHERE file_id = ? AND status = 'processing'", fileID); err != nil {
+        log.Printf("Batch watcher: failed to release claim %s: %v", fileID, err)
     }
-    
-    json.Unmarshal(permissionsJSON, &user.Permissions)
-    if lastLoginAt.Valid {
-        user.LastLoginAt = &lastLoginAt.Time
+}
+
+// finishBatchFile records a file's outcome
+func (ut *UnifiedTokenizer) finishBatchFile(report *BatchFileReport) error {
+    counts := report.Report
+    if counts == nil {
+        counts = &batchfile.Report{}
     }
-    
-    w.Header().Set("Content-Type", "application/json")
-    json.NewEncoder(w).Encode(user)
+    _, err := ut.db.Exec(`
+        UPDATE batch_files
+        SET status = ?, completed_at = ?, rows_processed = ?, cards_tokenized = ?, cards_masked = ?,
+            row_errors = ?, archive_name = ?, error_message = NULLIF(?, '')
+        WHERE file_id = ?
+    `, report.Status, report.CompletedAt, counts.Rows, counts.Tokenized, counts.Masked,
+        counts.ErrorCount, report.Archive, report.Error, report.FileID)
+    return err
 }
 
-func (ut *UnifiedTokenizer) handleUpdateUser(w http.ResponseWriter, r *http.Request) {
-    username := strings.TrimPrefix(r.URL.Path, "/api/v1/users/")
-    
-    var req struct {
-        Email       *string   `json:"email"`
-        FullName    *string   `json:"full_name"`
-        Role        *string   `json:"role"`
-        Permissions *[]string `json:"permissions"`
-        IsActive    *bool     `json:"is_active"`
+// batchArchiveMagic starts an archived batch file. It is followed by the ID
+// of the DEK that encrypted the file ("fernet" for ENCRYPTION_KEY), a
+// newline and the ciphertext.
+const batchArchiveMagic = "TOKENSHIELD-ARCHIVE-1 "
+
+// archiveBatchFile writes the original file, encrypted, to the archive
+// directory and returns the archive's name
+func (ut *UnifiedTokenizer) archiveBatchFile(name string, data []byte, at time.Time) (string, error) {
+    sealed, err := ut.sealBatchArchive(data)
+    if err != nil {
+        return "", err
     }
-    
-    if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-        w.WriteHeader(http.StatusBadRequest)
-        json.NewEncoder(w).Encode(map[string]string{"error": "Invalid request body"})
-        return
+    archive := name + "." + at.Format("20060102T150405Z") + ".enc"
+    return archive, writeFileAtomic(filepath.Join(ut.batchWatcher.archiveDir, archive), sealed)
+}
+
+// sealBatchArchive encrypts a batch file with the current DEK, or the
+// legacy Fernet key without KEK/DEK
+func (ut *UnifiedTokenizer) sealBatchArchive(data []byte) ([]byte, error) {
+    keyID := "fernet"
+    var ciphertext []byte
+    var err error
+    if ut.useKEKDEK && ut.keyManager != nil {
+        ciphertext, keyID, err = ut.keyManager.EncryptData(data)
+    } else {
+        ciphertext, err = fernet.EncryptAndSign(data, ut.encryptionKey)
+    }
+    if err != nil {
+        return nil, err
+    }
+    return append([]byte(batchArchiveMagic+keyID+"\n"), ciphertext...), nil
+}
+
+// openBatchArchive decrypts a file written by sealBatchArchive
+func (ut *UnifiedTokenizer) openBatchArchive(archive []byte) ([]byte, error) {
+    header, ciphertext, ok := bytes.Cut(archive, []byte("\n"))
+    if !ok || !bytes.HasPrefix(header, []byte(batchArchiveMagic)) {
+        return nil, errors.New("not a TokenShield batch archive")
+    }
+    keyID := string(header[len(batchArchiveMagic):])
+    if keyID == "fernet" {
+        plaintext := fernet.VerifyAndDecrypt(ciphertext, 0, []*fernet.Key{ut.encryptionKey})
+        if plaintext == nil {
+            return nil, errors.New("fernet decryption failed")
+        }
+        return plaintext, nil
+    }
+    if ut.keyManager == nil {
+        return nil, fmt.Errorf("archive is encrypted with DEK %s, but USE_KEK_DEK is not enabled", keyID)
+    }
+    return ut.keyManager.DecryptData(ciphertext, keyID)
+}
+
+// writeFileAtomic writes a file readable only by the service, so readers
+// never see it half-written
+func writeFileAtomic(path string, data []byte) error {
+    tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*.tmp")
+    if err != nil {
+        return err
+    }
+    defer os.Remove(tmp.Name())
+    if _, err := tmp.Write(data); err != nil {
+        tmp.Close()
+        return err
+    }
+    if err := tmp.Close(); err != nil {
+        return err
+    }
+    return os.Rename(tmp.Name(), path)
+}
+
+// kafkaRoute is a topic the Kafka bridge consumes and the topic it
+// republishes each message to
+type kafkaRoute struct {
+    source      string
+    destination string
+    tokenize    bool // false to detokenize, for topics bound to the processor
+}
+
+// kafkaBridge republishes messages between Kafka topics with their card
+// fields tokenized or detokenized
+type kafkaBridge struct {
+    client      *kafka.Client
+    routes      []kafkaRoute
+    group       string
+    dlqTopic    string
+    startOffset int64          // kafka.Earliest or kafka.Latest, for partitions the group has no offset for
+    registry    *avro.Registry // Schemas of Avro messages; nil when messages are JSON only
+    maxBytes    int32          // Largest fetch response
+}
+
+// kafkaPartition is a source partition and the offset of the next message
+// to republish from it
+type kafkaPartition struct {
+    route  *kafkaRoute
+    id     int32
+    offset int64
+}
+
+const (
+    // kafkaBridgeLock is the database lock held by the replica running the
+    // bridge, so a message is republished by one replica
+    kafkaBridgeLock = "tokenshield_kafka_bridge"
+    // kafkaRetryDelay is how long the bridge waits after an error, and how
+    // often a standby replica checks whether the lock is free
+    kafkaRetryDelay = 5 * time.Second
+    // kafkaRestartInterval is how often the bridge reloads partitions and
+    // leaders when nothing has gone wrong
+    kafkaRestartInterval = 5 * time.Minute
+    // kafkaMaxProduceBytes bounds the records sent in one produce request
+    kafkaMaxProduceBytes = 512 << 10
+)
+
+// kafkaRejectError means a message cannot be processed as it is, so it goes
+// to the dead letter topic instead of being retried
+type kafkaRejectError struct {
+    reason string
+}
+
+func (e *kafkaRejectError) Error() string { return e.reason }
+
+// loadKafkaBridge sets up the Kafka bridge from the KAFKA_* settings. The
+// bridge is off when KAFKA_BROKERS is not set.
+func (ut *UnifiedTokenizer) loadKafkaBridge() error {
+    brokers := utils.GetEnv("KAFKA_BROKERS", "")
+    if brokers == "" {
+        return nil
+    }
+    kb := &kafkaBridge{
+        group:    utils.GetEnv("KAFKA_GROUP_ID", "tokenshield-bridge"),
+        dlqTopic: utils.GetEnv("KAFKA_DLQ_TOPIC", ""),
+    }
+    for _, setting := range []struct {
+        key      string
+        tokenize bool
+    }{{"KAFKA_TOKENIZE_ROUTES", true}, {"KAFKA_DETOKENIZE_ROUTES", false}} {
+        routes, err := parseKafkaRoutes(utils.GetEnv(setting.key, ""), setting.tokenize)
+        if err != nil {
+            return fmt.Errorf("invalid %s: %v", setting.key, err)
+        }
+        kb.routes = append(kb.routes, routes...)
     }
-    
-    // Build update query dynamically
-    updates := []string{}
-    params := []interface{}{}
-    
-    if req.Email != nil {
-        updates = append(updates, "email = ?")
-        params = append(params, *req.Email)
+    if len(kb.routes) == 0 {
+        return fmt.Errorf("KAFKA_TOKENIZE_ROUTES or KAFKA_DETOKENIZE_ROUTES is required when KAFKA_BROKERS is set")
     }
-    if req.FullName != nil {
-        updates = append(updates, "full_name = ?")
-        params = append(params, *req.FullName)
+    if kb.dlqTopic == "" {
+        return fmt.Errorf("KAFKA_DLQ_TOPIC is required when KAFKA_BROKERS is set")
     }
-    if req.Role != nil {
-        updates = append(updates, "role = ?")
-        params = append(params, *req.Role)
+    sources := make(map[string]bool)
+    for _, r := range kb.routes {
+        if sources[r.source] {
+            return fmt.Errorf("Kafka topic %s is consumed by more than one route", r.source)
+        }
+        sources[r.source] = true
     }
-    if req.Permissions != nil {
-        permissionsJSON, _ := json.Marshal(*req.Permissions)
-        updates = append(updates, "permissions = ?")
-        params = append(params, permissionsJSON)
+    if sources[kb.dlqTopic] {
+        return fmt.Errorf("KAFKA_DLQ_TOPIC %s is also a source topic", kb.dlqTopic)
     }
-    if req.IsActive != nil {
-        updates = append(updates, "is_active = ?")
-        params = append(params, *req.IsActive)
+    for _, r := range kb.routes {
+        if sources[r.destination] {
+            return fmt.Errorf("Kafka route %s:%s would consume what it publishes", r.source, r.destination)
+        }
     }
-    
-    if len(updates) == 0 {
-        w.WriteHeader(http.StatusBadRequest)
-        json.NewEncoder(w).Encode(map[string]string{"error": "No fields to update"})
-        return
+    switch utils.GetEnv("KAFKA_START_OFFSET", "earliest") {
+    case "earliest":
+        kb.startOffset = kafka.Earliest
+    case "latest":
+        kb.startOffset = kafka.Latest
+    default:
+        return fmt.Errorf("invalid KAFKA_START_OFFSET: use earliest or latest")
     }
-    
-    updates = append(updates, "updated_at = NOW()")
-    params = append(params, username, username) // for WHERE clause
-    
-    query := fmt.Sprintf("UPDATE users SET %s WHERE username = ? OR user_id = ?", strings.Join(updates, ", "))
-    result, err := ut.db.Exec(query, params...)
-    
+    maxBytes, err := utils.ByteSizeSetting("KAFKA_MAX_FETCH_BYTES", 1<<20, 64<<10, 64<<20)
     if err != nil {
-        w.WriteHeader(http.StatusInternalServerError)
-        json.NewEncoder(w).Encode(map[string]string{"error": "Failed to update user"})
-        return
-    }
-    
-    rowsAffected, _ := result.RowsAffected()
-    if rowsAffected == 0 {
-        w.WriteHeader(http.StatusNotFound)
-        json.NewEncoder(w).Encode(map[string]string{"error": "User not found"})
-        return
-    }
-    
-    w.Header().Set("Content-Type", "application/json")
-    json.NewEncoder(w).Encode(map[string]string{"message": "User updated successfully"})
-}
-
-func (ut *UnifiedTokenizer) handleDeleteUser(w http.ResponseWriter, r *http.Request) {
-    username := strings.TrimPrefix(r.URL.Path, "/api/v1/users/")
-    
-    // Don't allow deleting the default admin
-    if username == "admin" || username == "usr_admin_default" {
-        w.WriteHeader(http.StatusForbidden)
-        json.NewEncoder(w).Encode(map[string]string{"error": "Cannot delete default admin user"})
-        return
+        return err
     }
+    kb.maxBytes = int32(maxBytes)
     
-    // Check if user exists
-    var userID string
-    err := ut.db.QueryRow("SELECT user_id FROM users WHERE username = ? OR user_id = ?", username, username).Scan(&userID)
-    if err == sql.ErrNoRows {
-        w.WriteHeader(http.StatusNotFound)
-        json.NewEncoder(w).Encode(map[string]string{"error": "User not found"})
-        return
+    config := kafka.Config{ClientID: "tokenshield-bridge", Timeout: 30 * time.Second}
+    for _, addr := range strings.Split(brokers, ",") {
+        if addr = strings.TrimSpace(addr); addr != "" {
+            if _, _, err := net.SplitHostPort(addr); err != nil {
+                return fmt.Errorf("invalid KAFKA_BROKERS entry %q: want host:port", addr)
+            }
+            config.Brokers = append(config.Brokers, addr)
+        }
     }
-    
-    // Delete user (cascades to sessions and api_keys)
-    _, err = ut.db.Exec("DELETE FROM users WHERE user_id = ?", userID)
-    if err != nil {
-        w.WriteHeader(http.StatusInternalServerError)
-        json.NewEncoder(w).Encode(map[string]string{"error": "Failed to delete user"})
-        return
+    if utils.GetEnv("KAFKA_TLS", "false") == "true" {
+        config.TLS = &tls.Config{MinVersion: tls.VersionTLS12}
+        if caFile := utils.GetEnv("KAFKA_TLS_CA", ""); caFile != "" {
+            caPEM, err := os.ReadFile(caFile)
+            if err != nil {
+                return fmt.Errorf("failed to read KAFKA_TLS_CA: %v", err)
+            }
+            config.TLS.RootCAs = x509.NewCertPool()
+            if !config.TLS.RootCAs.AppendCertsFromPEM(caPEM) {
+                return fmt.Errorf("KAFKA_TLS_CA contains no PEM certificates")
+            }
+        }
     }
-    
-    w.Header().Set("Content-Type", "application/json")
-    json.NewEncoder(w).Encode(map[string]string{"message": "User deleted successfully"})
-}
-
-func (ut *UnifiedTokenizer) startAPIServer() {
-    mux := http.NewServeMux()
-    
-    // Health check and version (no auth required)
-    mux.HandleFunc("/health", ut.handleAPIHealth)
-    mux.HandleFunc("/api/v1/version", ut.handleGetVersion)
-    
-    // Authentication endpoints (no auth required, but rate limited and validated)
-    mux.HandleFunc("/api/v1/auth/login", ut.rateLimitMiddleware(ut.validationMiddleware("/api/v1/auth/login")(ut.handleLogin)))
-    mux.HandleFunc("/api/v1/auth/logout", ut.handleLogout)
-    mux.HandleFunc("/api/v1/auth/me", ut.handleGetCurrentUser)
-    mux.HandleFunc("/api/v1/auth/change-password", ut.rateLimitMiddleware(ut.validationMiddleware("/api/v1/auth/change-password")(ut.handleChangePassword)))
-    
-    // API Key management (requires permissions and validation)
-    mux.HandleFunc("/api/v1/api-keys", func(w http.ResponseWriter, r *http.Request) {
-        switch r.Method {
-        case "GET":
-            ut.requirePermission(ut.handleListAPIKeys, PermAPIKeysRead)(w, r)
-        case "POST":
-            ut.validationMiddleware("/api/v1/api-keys")(ut.requirePermission(ut.handleCreateAPIKey, PermAPIKeysWrite))(w, r)
-        default:
-            w.WriteHeader(http.StatusMethodNotAllowed)
+    if mechanism := utils.GetEnv("KAFKA_SASL_MECHANISM", ""); mechanism != "" {
+        config.SASL = &kafka.SASL{
+            Mechanism: mechanism,
+            Username:  utils.GetEnv("KAFKA_SASL_USERNAME", ""),
+            Password:  utils.GetEnv("KAFKA_SASL_PASSWORD", ""),
         }
-    })
-    
-    mux.HandleFunc("/api/v1/api-keys/", func(w http.ResponseWriter, r *http.Request) {
-        switch r.Method {
-        case "DELETE":
-            ut.requirePermission(ut.handleRevokeAPIKey, PermAPIKeysDelete)(w, r)
-        default:
-            w.WriteHeader(http.StatusMethodNotAllowed)
+        if err := config.SASL.Validate(); err != nil {
+            return fmt.Errorf("invalid KAFKA_SASL_* settings: %v", err)
         }
-    })
-    
-    // Token management (requires permissions)
-    mux.HandleFunc("/api/v1/tokens", func(w http.ResponseWriter, r *http.Request) {
-        switch r.Method {
-        case "GET":
-            ut.requirePermission(ut.handleAPIListTokens, PermTokensRead)(w, r)
-        default:
-            w.WriteHeader(http.StatusMethodNotAllowed)
+        if mechanism == kafka.PLAIN && config.TLS == nil {
+            log.Printf("WARNING: KAFKA_SASL_MECHANISM=PLAIN without KAFKA_TLS sends the Kafka password in the clear")
         }
-    })
+    }
+    kb.client = kafka.NewClient(config)
     
-    mux.HandleFunc("/api/v1/tokens/search", func(w http.ResponseWriter, r *http.Request) {
-        if r.Method == "POST" {
-            ut.validationMiddleware("/api/v1/tokens/search")(ut.requirePermission(ut.handleSearchTokens, PermTokensRead))(w, r)
-        } else {
-            w.WriteHeader(http.StatusMethodNotAllowed)
+    if registryURL := utils.GetEnv("KAFKA_SCHEMA_REGISTRY_URL", ""); registryURL != "" {
+        kb.registry = &avro.Registry{
+            URL:      registryURL,
+            Username: utils.GetEnv("KAFKA_SCHEMA_REGISTRY_USERNAME", ""),
+            Password: utils.GetEnv("KAFKA_SCHEMA_REGISTRY_PASSWORD", ""),
+            Client:   &http.Client{Timeout: 10 * time.Second},
         }
-    })
-    
-    // Individual token operations
-    mux.HandleFunc("/api/v1/tokens/", func(w http.ResponseWriter, r *http.Request) {
-        switch r.Method {
-        case "GET":
-            ut.requirePermission(ut.handleAPIGetToken, PermTokensRead)(w, r)
-        case "DELETE":
-            ut.requirePermission(ut.handleAPIRevokeToken, PermTokensDelete)(w, r)
-        default:
-            w.WriteHeader(http.StatusMethodNotAllowed)
+    }
+    ut.kafkaBridge = kb
+    return nil
+}
+
+// parseKafkaRoutes parses comma-separated source:destination topic pairs
+func parseKafkaRoutes(value string, tokenize bool) ([]kafkaRoute, error) {
+    var routes []kafkaRoute
+    for _, entry := range strings.Split(value, ",") {
+        entry = strings.TrimSpace(entry)
+        if entry == "" {
+            continue
         }
-    })
-    
-    // Activity monitoring
-    mux.HandleFunc("/api/v1/activity", func(w http.ResponseWriter, r *http.Request) {
-        if r.Method == "GET" {
-            ut.requirePermission(ut.handleGetActivity, PermActivityRead)(w, r)
-        } else {
-            w.WriteHeader(http.StatusMethodNotAllowed)
+        source, destination, ok := strings.Cut(entry, ":")
+        source, destination = strings.TrimSpace(source), strings.TrimSpace(destination)
+        if !ok || source == "" || destination == "" || source == destination {
+            return nil, fmt.Errorf("invalid route %q: want source-topic:destination-topic", entry)
         }
-    })
-    
-    // Stats
-    mux.HandleFunc("/api/v1/stats", ut.requirePermission(ut.handleAPIStats, PermStatsRead))
-    
-    // Card import endpoint (requires admin permissions and validation)
-    mux.HandleFunc("/api/v1/cards/import", func(w http.ResponseWriter, r *http.Request) {
-        if r.Method == "POST" {
-            ut.validationMiddleware("/api/v1/cards/import")(ut.requirePermission(ut.handleCardImport, PermSystemAdmin))(w, r)
-        } else {
-            w.WriteHeader(http.StatusMethodNotAllowed)
+        routes = append(routes, kafkaRoute{source: source, destination: destination, tokenize: tokenize})
+    }
+    return routes, nil
+}
+
+// startKafkaBridge runs the bridge on whichever replica holds its database
+// lock, so another takes over when that replica stops
+func (ut *UnifiedTokenizer) startKafkaBridge() {
+    kb := ut.kafkaBridge
+    for _, r := range kb.routes {
+        action := "tokenizing"
+        if !r.tokenize {
+            action = "detokenizing"
         }
-    })
+        log.Printf("Kafka bridge: %s -> %s, %s card fields", r.source, r.destination, action)
+    }
     
-    // User management endpoints (with validation)
-    mux.HandleFunc("/api/v1/users", func(w http.ResponseWriter, r *http.Request) {
-        switch r.Method {
-        case "GET":
-            ut.requirePermission(ut.handleListUsers, PermUsersRead)(w, r)
-        case "POST":
-            ut.validationMiddleware("/api/v1/users")(ut.requirePermission(ut.handleCreateUser, PermUsersWrite))(w, r)
-        default:
-            w.WriteHeader(http.StatusMethodNotAllowed)
+    for {
+        if err := ut.runKafkaBridgeLocked(); err != nil {
+            log.Printf("Kafka bridge: %v", err)
         }
-    })
+        time.Sleep(kafkaRetryDelay)
+    }
+}
+
+// runKafkaBridgeLocked runs the bridge for as long as this replica holds
+// the bridge lock, returning at once if another replica holds it. The lock
+// belongs to one database connection, so it is released if the replica
+// dies.
+func (ut *UnifiedTokenizer) runKafkaBridgeLocked() error {
+    ctx, cancel := context.WithCancel(context.Background())
+    defer cancel()
+    conn, err := ut.db.Conn(ctx)
+    if err != nil {
+        return err
+    }
+    defer conn.Close()
+    var locked sql.NullInt64
+    if err := conn.QueryRowContext(ctx, "SELECT GET_LOCK(?, 0)", kafkaBridgeLock).Scan(&locked); err != nil {
+        return fmt.Errorf("failed to take the bridge lock: %v", err)
+    }
+    if locked.Int64 != 1 {
+        return nil // Another replica runs the bridge
+    }
+    defer conn.ExecContext(context.Background(), "DO RELEASE_LOCK(?)", kafkaBridgeLock)
+    log.Printf("Kafka bridge: running on this replica")
+    atomic.StoreInt32(&ut.kafkaActive, 1)
+    defer atomic.StoreInt32(&ut.kafkaActive, 0)
     
-    mux.HandleFunc("/api/v1/users/", func(w http.ResponseWriter, r *http.Request) {
-        switch r.Method {
-        case "GET":
-            ut.requirePermission(ut.handleGetUser, PermUsersRead)(w, r)
-        case "PUT":
-            ut.requirePermission(ut.handleUpdateUser, PermUsersWrite)(w, r)
-        case "DELETE":
-            ut.requirePermission(ut.handleDeleteUser, PermUsersDelete)(w, r)
-        default:
-            w.WriteHeader(http.StatusMethodNotAllowed)
+    // Stop if the connection holding the lock is lost: another replica
+    // may already have taken over
+    go func() {
+        ticker := time.NewTicker(10 * time.Second)
+        defer ticker.Stop()
+        for {
+            select {
+            case <-ctx.Done():
+                return
+            case <-ticker.C:
+                if err := conn.PingContext(ctx); err != nil {
+                    log.Printf("Kafka bridge: lost the bridge lock: %v", err)
+                    cancel()
+                    return
+                }
+            }
         }
-    })
+    }()
     
-    // Key management endpoints (if KEK/DEK is enabled)
-    if ut.useKEKDEK {
-        mux.HandleFunc("/api/v1/keys/status", func(w http.ResponseWriter, r *http.Request) {
-            if r.Method == "GET" {
-                ut.handleKeyStatus(w, r)
-            } else {
-                w.WriteHeader(http.StatusMethodNotAllowed)
-            }
-        })
-        
-        mux.HandleFunc("/api/v1/keys/rotate", func(w http.ResponseWriter, r *http.Request) {
-            if r.Method == "POST" {
-                ut.handleKeyRotation(w, r)
-            } else {
-                w.WriteHeader(http.StatusMethodNotAllowed)
-            }
-        })
-        
-        mux.HandleFunc("/api/v1/keys/rotations", func(w http.ResponseWriter, r *http.Request) {
-            if r.Method == "GET" {
-                ut.handleKeyRotationHistory(w, r)
-            } else {
-                w.WriteHeader(http.StatusMethodNotAllowed)
+    for ctx.Err() == nil {
+        if err := ut.runKafkaBridge(ctx); err != nil {
+            atomic.AddInt64(&ut.kafkaRetries, 1)
+            log.Printf("Kafka bridge: %v; retrying in %v", err, kafkaRetryDelay)
+            select {
+            case <-ctx.Done():
+            case <-time.After(kafkaRetryDelay):
             }
-        })
-    }
-    
-    log.Printf("Starting API server on port %s with CORS enabled", ut.apiPort)
-    if err := http.ListenAndServe(":"+ut.apiPort, ut.corsMiddleware(mux)); err != nil {
-        log.Fatalf("API server failed: %v", err)
+        }
     }
+    return nil
 }
 
-// Key management API handlers
-
-func (ut *UnifiedTokenizer) handleKeyStatus(w http.ResponseWriter, r *http.Request) {
-    // Permission check is handled by requirePermission middleware
-    
-    type KeyInfo struct {
-        KeyID      string    `json:"key_id"`
-        Version    int       `json:"version"`
-        Status     string    `json:"status"`
-        CreatedAt  time.Time `json:"created_at"`
-        CardsCount int       `json:"cards_encrypted,omitempty"`
+// runKafkaBridge resumes every source partition from the group's committed
+// offset and republishes messages until ctx ends, kafkaRestartInterval
+// passes or something fails. Offsets are committed after the messages are
+// published, so a message may be published twice but never lost.
+func (ut *UnifiedTokenizer) runKafkaBridge(ctx context.Context) error {
+    kb := ut.kafkaBridge
+    topics := []string{kb.dlqTopic}
+    for _, r := range kb.routes {
+        topics = append(topics, r.source, r.destination)
+    }
+    if err := kb.client.RefreshMetadata(topics...); err != nil {
+        return err
     }
     
-    response := struct {
-        KEK *KeyInfo `json:"kek,omitempty"`
-        DEK *KeyInfo `json:"dek,omitempty"`
-    }{}
-    
-    // Get KEK info
-    var kekInfo KeyInfo
-    err := ut.db.QueryRow(`
-        SELECT key_id, key_version, key_status, created_at
-        FROM encryption_keys
-        WHERE key_type = 'KEK' AND key_status = 'active'
-        ORDER BY key_version DESC LIMIT 1
-    `).Scan(&kekInfo.KeyID, &kekInfo.Version, &kekInfo.Status, &kekInfo.CreatedAt)
-    
-    if err == nil {
-        response.KEK = &kekInfo
+    byLeader := make(map[int32][]*kafkaPartition)
+    for i := range kb.routes {
+        route := &kb.routes[i]
+        partitions, err := kb.client.Partitions(route.source)
+        if err != nil {
+            return err
+        }
+        ids := make([]int32, len(partitions))
+        for j, p := range partitions {
+            ids[j] = p.ID
+        }
+        committed, err := kb.client.CommittedOffsets(kb.group, route.source, ids)
+        if err != nil {
+            return err
+        }
+        for _, p := range partitions {
+            offset, ok := committed[p.ID]
+            if !ok {
+                if offset, err = kb.client.ListOffset(route.source, p.ID, kb.startOffset); err != nil {
+                    return err
+                }
+            }
+            byLeader[p.Leader] = append(byLeader[p.Leader], &kafkaPartition{route: route, id: p.ID, offset: offset})
+        }
     }
     
-    // Get DEK info
-    var dekInfo KeyInfo
-    err = ut.db.QueryRow(`
-        SELECT key_id, key_version, key_status, created_at
-        FROM encryption_keys
-        WHERE key_type = 'DEK' AND key_status = 'active'
-        ORDER BY key_version DESC LIMIT 1
-    `).Scan(&dekInfo.KeyID, &dekInfo.Version, &dekInfo.Status, &dekInfo.CreatedAt)
-    
-    if err == nil {
-        response.DEK = &dekInfo
-        
-        // Count cards encrypted with this DEK
-        ut.db.QueryRow(`
-            SELECT COUNT(*) FROM credit_cards 
-            WHERE encryption_key_id = ?
-        `, dekInfo.KeyID).Scan(&dekInfo.CardsCount)
+    ctx, cancel := context.WithTimeout(ctx, kafkaRestartInterval)
+    defer cancel()
+    errs := make(chan error, len(byLeader))
+    for leader, partitions := range byLeader {
+        addr, ok := kb.client.Broker(leader)
+        if !ok {
+            return fmt.Errorf("no leader for %s/%d", partitions[0].route.source, partitions[0].id)
+        }
+        go func(addr string, partitions []*kafkaPartition) {
+            errs <- ut.consumeKafkaPartitions(ctx, addr, partitions)
+        }(addr, partitions)
+    }
+    // The first to stop, with an error or because ctx ended, stops the rest
+    err := <-errs
+    cancel()
+    for i := 1; i < len(byLeader); i++ {
+        if e := <-errs; err == nil {
+            err = e
+        }
     }
-    
-    w.Header().Set("Content-Type", "application/json")
-    json.NewEncoder(w).Encode(response)
+    return err
 }
 
-func (ut *UnifiedTokenizer) handleKeyRotation(w http.ResponseWriter, r *http.Request) {
-    // Permission check is handled by requirePermission middleware
-    
-    // Check if KEK/DEK is enabled
-    if !ut.useKEKDEK || ut.keyManager == nil {
-        w.WriteHeader(http.StatusBadRequest)
-        json.NewEncoder(w).Encode(map[string]string{
-            "error": "KEK/DEK encryption is not enabled",
-        })
-        return
-    }
-    
-    // Parse request body for rotation type
-    var request struct {
-        KeyType string `json:"key_type"` // "KEK", "DEK", or "both"
+// consumeKafkaPartitions republishes the messages of partitions led by
+// one broker until ctx ends or something fails
+func (ut *UnifiedTokenizer) consumeKafkaPartitions(ctx context.Context, addr string, partitions []*kafkaPartition) error {
+    kb := ut.kafkaBridge
+    for ctx.Err() == nil {
+        if ut.keyManager != nil && ut.keyManager.IsSealed() {
+            select {
+            case <-ctx.Done():
+            case <-time.After(kafkaRetryDelay):
+            }
+            continue
+        }
+        fetch := make([]kafka.FetchPartition, len(partitions))
+        for i, p := range partitions {
+            fetch[i] = kafka.FetchPartition{Topic: p.route.source, Partition: p.id, Offset: p.offset}
+        }
+        results, err := kb.client.Fetch(addr, fetch, 500*time.Millisecond, kb.maxBytes)
+        if err != nil {
+            return err
+        }
+        for _, res := range results {
+            var p *kafkaPartition
+            for _, candidate := range partitions {
+                if candidate.route.source == res.Topic && candidate.id == res.Partition {
+                    p = candidate
+                }
+            }
+            if p == nil {
+                continue
+            }
+            if errors.Is(res.Err, kafka.ErrOffsetOutOfRange) {
+                // Retention removed messages the bridge had not republished
+                offset, err := kb.client.ListOffset(p.route.source, p.id, kafka.Earliest)
+                if err != nil {
+                    return err
+                }
+                log.Printf("Kafka bridge: WARNING: %s/%d offset %d no longer exists, skipping to %d", p.route.source, p.id, p.offset, offset)
+                p.offset = offset
+                continue
+            }
+            if res.Err != nil {
+                return fmt.Errorf("fetching %s/%d: %v", p.route.source, p.id, res.Err)
+            }
+            if err := ut.bridgeKafkaRecords(p, res.Records, res.Next); err != nil {
+                return err
+            }
+        }
     }
-    
-    if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
-        request.KeyType = "DEK" // Default to DEK rotation
+    return nil
+}
+
+// bridgeKafkaRecords republishes fetched messages, sends those that
+// cannot be processed to the dead letter topic, then commits the offset
+// after them. A failure publishes nothing and commits nothing, so the
+// messages are fetched again.
+func (ut *UnifiedTokenizer) bridgeKafkaRecords(p *kafkaPartition, records []kafka.Record, next int64) error {
+    kb := ut.kafkaBridge
+    destination, err := kb.client.Partitions(p.route.destination)
+    if err != nil {
+        return err
     }
-    
-    rotationID := "rot_" + generateRandomID()
-    
-    // Log rotation attempt
-    _, err := ut.db.Exec(`
-        INSERT INTO key_rotation_log (rotation_id, key_type, status, started_at)
-        VALUES (?, ?, 'in_progress', NOW())
-    `, rotationID, request.KeyType)
-    
+    dlq, err := kb.client.Partitions(kb.dlqTopic)
     if err != nil {
-        log.Printf("Failed to log rotation start: %v", err)
+        return err
     }
-    
-    var rotatedKeys []string
-    var errors []string
-    
-    // Perform rotation based on type
-    switch request.KeyType {
-    case "KEK":
-        if err := ut.keyManager.RotateKEK(); err != nil {
-            errors = append(errors, fmt.Sprintf("KEK rotation failed: %v", err))
-        } else {
-            rotatedKeys = append(rotatedKeys, "KEK")
+    out := make(map[int32][]kafka.Record)
+    dead := make(map[int32][]kafka.Record)
+    var replaced, unchanged, deadLettered, masked int64
+    for _, rec := range records {
+        value, changed, n, err := ut.bridgeKafkaMessage(p.route, rec.Value)
+        var reject *kafkaRejectError
+        if errors.As(err, &reject) {
+            deadLettered++
+            letter := ut.kafkaDeadLetter(p, rec, reject.reason)
+            partition := kafkaPartitionFor(rec.Key, p.id, len(dlq))
+            dead[partition] = append(dead[partition], letter)
+            log.Printf("Kafka bridge: %s/%d offset %d sent to %s: %s", p.route.source, p.id, rec.Offset, kb.dlqTopic, reject.reason)
+            continue
         }
-    case "both":
-        if err := ut.keyManager.RotateKEK(); err != nil {
-            errors = append(errors, fmt.Sprintf("KEK rotation failed: %v", err))
-        } else {
-            rotatedKeys = append(rotatedKeys, "KEK")
+        if err != nil {
+            return fmt.Errorf("%s/%d offset %d: %v", p.route.source, p.id, rec.Offset, err)
         }
-        if err := ut.keyManager.RotateDEK(); err != nil {
-            errors = append(errors, fmt.Sprintf("DEK rotation failed: %v", err))
+        masked += int64(n)
+        if changed {
+            replaced++
         } else {
-            rotatedKeys = append(rotatedKeys, "DEK")
+            unchanged++
         }
-    default: // "DEK" or any other value
-        if err := ut.keyManager.RotateDEK(); err != nil {
-            errors = append(errors, fmt.Sprintf("DEK rotation failed: %v", err))
-        } else {
-            rotatedKeys = append(rotatedKeys, "DEK")
+    
+        // Partitioned by the original key, so one card's messages stay in order
+        partition := kafkaPartitionFor(rec.Key, p.id, len(destination))
+        republished := kafka.Record{Key: rec.Key, Value: value, Headers: rec.Headers, Timestamp: rec.Timestamp}
+        if p.route.tokenize {
+            var n int
+            republished.Key, republished.Headers, n = ut.maskKafkaMetadata(rec.Key, rec.Headers)
+            masked += int64(n)
         }
+        out[partition] = append(out[partition], republished)
     }
     
-    // Update rotation log
-    status := "completed"
-    if len(errors) > 0 {
-        status = "failed"
+    for partition, batch := range out {
+        if err := produceKafkaRecords(kb.client, p.route.destination, partition, batch); err != nil {
+            return err
+        }
     }
-    
-    _, err = ut.db.Exec(`
-        UPDATE key_rotation_log 
-        SET status = ?, completed_at = NOW(), error_message = ?
-        WHERE rotation_id = ?
-    `, status, strings.Join(errors, "; "), rotationID)
-    
-    if err != nil {
-        log.Printf("Failed to update rotation log: %v", err)
+    for partition, batch := range dead {
+        if err := produceKafkaRecords(kb.client, kb.dlqTopic, partition, batch); err != nil {
+            return err
+        }
     }
-    
-    // Prepare response
-    response := map[string]interface{}{
-        "rotation_id":   rotationID,
-        "status":        status,
-        "rotated_keys":  rotatedKeys,
-        "requested_type": request.KeyType,
+    if next > p.offset {
+        if err := kb.client.CommitOffsets(kb.group, p.route.source, map[int32]int64{p.id: next}); err != nil {
+            return err
+        }
+        p.offset = next
     }
-    
-    if len(errors) > 0 {
-        response["errors"] = errors
-        w.WriteHeader(http.StatusInternalServerError)
-    } else {
-        response["message"] = "Key rotation completed successfully"
+    atomic.AddInt64(&ut.kafkaReplaced, replaced)
+    atomic.AddInt64(&ut.kafkaUnchanged, unchanged)
+    atomic.AddInt64(&ut.kafkaDeadLetters, deadLettered)
+    atomic.AddInt64(&ut.kafkaMasked, masked)
+    return nil
+}
+
+// kafkaPartitionFor picks the partition for a message the way Kafka's
+// default partitioner does, or by source partition when it has no key
+func kafkaPartitionFor(key []byte, source int32, partitions int) int32 {
+    if key == nil {
+        return source % int32(partitions)
     }
-    
-    w.Header().Set("Content-Type", "application/json")
-    json.NewEncoder(w).Encode(response)
+    return kafka.Partition(key, partitions)
 }
 
-func (ut *UnifiedTokenizer) handleKeyRotationHistory(w http.ResponseWriter, r *http.Request) {
-    // Permission check is handled by requirePermission middleware
-    
-    // Get query parameters
-    limit := 50
-    if l := r.URL.Query().Get("limit"); l != "" {
-        if parsed, err := strconv.Atoi(l); err == nil && parsed > 0 && parsed <= 100 {
-            limit = parsed
+// produceKafkaRecords publishes records in requests of bounded size
+func produceKafkaRecords(client *kafka.Client, topic string, partition int32, records []kafka.Record) error {
+    for len(records) > 0 {
+        n, size := 0, 0
+        for n < len(records) && (n == 0 || size+len(records[n].Key)+len(records[n].Value) <= kafkaMaxProduceBytes) {
+            size += len(records[n].Key) + len(records[n].Value)
+            n++
+        }
+        if err := client.Produce(topic, partition, records[:n]); err != nil {
+            return err
         }
+        records = records[n:]
     }
-    
-    rows, err := ut.db.Query(`
-        SELECT rotation_id, key_type, status, started_at, completed_at, error_message
-        FROM key_rotation_log
-        ORDER BY started_at DESC
-        LIMIT ?
-    `, limit)
-    
-    if err != nil {
-        w.WriteHeader(http.StatusInternalServerError)
-        json.NewEncoder(w).Encode(map[string]string{"error": "Database error"})
-        return
+    return nil
+}
+
+// bridgeKafkaMessage tokenizes or detokenizes the card fields of a JSON or
+// Avro message, returning the message unchanged when nothing changed, and
+// how many card numbers outside card fields were masked. A
+// *kafkaRejectError means the message cannot be processed as it is.
+func (ut *UnifiedTokenizer) bridgeKafkaMessage(route *kafkaRoute, value []byte) ([]byte, bool, int, error) {
+    if value == nil {
+        return nil, false, 0, nil // A tombstone deletes its key downstream too
+    }
+    kb := ut.kafkaBridge
+    var tree interface{}
+    var schemaID int32
+    var schema *avro.Schema
+    if kb.registry != nil && value[0] == 0 {
+        id, data, err := avro.SplitWireFormat(value)
+        if err != nil {
+            return nil, false, 0, &kafkaRejectError{reason: err.Error()}
+        }
+        if schema, err = kb.registry.Schema(id); errors.Is(err, avro.ErrUnknownSchema) {
+            return nil, false, 0, &kafkaRejectError{reason: err.Error()}
+        } else if err != nil {
+            return nil, false, 0, err
+        }
+        if tree, err = avro.Decode(schema, data); err != nil {
+            return nil, false, 0, &kafkaRejectError{reason: err.Error()}
+        }
+        schemaID = id
+    } else {
+        dec := json.NewDecoder(bytes.NewReader(value))
+        dec.UseNumber() // Large numbers like IDs pass through unrounded
+        if err := dec.Decode(&tree); err != nil {
+            return nil, false, 0, &kafkaRejectError{reason: "message is not JSON or schema registry Avro: " + err.Error()}
+        }
+        if _, err := dec.Token(); err != io.EOF {
+            return nil, false, 0, &kafkaRejectError{reason: "invalid data after the JSON message"}
+        }
     }
-    defer rows.Close()
     
-    var rotations []map[string]interface{}
+    modified, masked := false, 0
+    if route.tokenize {
+        ut.processValue(&tree, &modified, true, &defaultCardFields)
+        var err error
+        if masked, err = ut.sanitizeKafkaValue(&tree); err != nil {
+            return nil, false, 0, err
+        }
+        modified = modified || masked > 0
+    } else {
+        ut.processValue(&tree, &modified, false, nil)
+    }
+    if !modified {
+        return value, false, 0, nil
+    }
     
-    for rows.Next() {
-        var rotationID, keyType, status string
-        var errorMessage sql.NullString
-        var startedAt time.Time
-        var completedAt sql.NullTime
-        
-        err := rows.Scan(&rotationID, &keyType, &status, &startedAt, &completedAt, &errorMessage)
+    if schema != nil {
+        data, err := avro.Encode(schema, tree)
         if err != nil {
-            continue
+            return nil, false, 0, &kafkaRejectError{reason: err.Error()}
         }
-        
-        rotation := map[string]interface{}{
-            "rotation_id": rotationID,
-            "key_type":    keyType,
-            "status":      status,
-            "started_at":  startedAt.Format(time.RFC3339),
+        return avro.JoinWireFormat(schemaID, data), true, masked, nil
+    }
+    var buf bytes.Buffer
+    enc := json.NewEncoder(&buf)
+    enc.SetEscapeHTML(false)
+    if err := enc.Encode(tree); err != nil {
+        return nil, false, 0, &kafkaRejectError{reason: err.Error()}
+    }
+    return bytes.TrimSuffix(buf.Bytes(), []byte("\n")), true, masked, nil
+}
+
+// sanitizeKafkaValue checks that every card field of a tokenized message
+// holds a token and masks card numbers left in its other strings,
+// returning how many it masked. A card field still holding a card number
+// means tokenization failed, which may pass; a number in a card field
+// cannot be replaced by a token, so the message is rejected.
+func (ut *UnifiedTokenizer) sanitizeKafkaValue(v *interface{}) (int, error) {
+    switch val := (*v).(type) {
+    case map[string]interface{}:
+        total := 0
+        for k, x := range val {
+            if ut.isCreditCardField(k) {
+                switch x := x.(type) {
+                case string:
+                    if ut.scanner.Contains(x, scanner.PAN) {
+                        return 0, fmt.Errorf("failed to tokenize field %s", k)
+                    }
+                    continue
+                case json.Number, int64:
+                    if scanner.IsPAN(fmt.Sprint(x)) {
+                        return 0, &kafkaRejectError{reason: fmt.Sprintf("field %s holds a card number as a number, which cannot be replaced by a token", k)}
+                    }
+                    continue
+                }
+            }
+            n, err := ut.sanitizeKafkaValue(&x)
+            if err != nil {
+                return 0, err
+            }
+            if n > 0 {
+                val[k] = x
+                total += n
+            }
         }
-        
-        if completedAt.Valid {
-            rotation["completed_at"] = completedAt.Time.Format(time.RFC3339)
-            rotation["duration_ms"] = completedAt.Time.Sub(startedAt).Milliseconds()
+        return total, nil
+    case []interface{}:
+        total := 0
+        for i := range val {
+            n, err := ut.sanitizeKafkaValue(&val[i])
+            if err != nil {
+                return 0, err
+            }
+            total += n
         }
-        
-        if errorMessage.Valid && errorMessage.String != "" {
-            rotation["error_message"] = errorMessage.String
+        return total, nil
+    case string:
+        masked, n := ut.maskCardDigits(val)
+        if n > 0 {
+            *v = masked
         }
-        
-        rotations = append(rotations, rotation)
+        return n, nil
     }
-    
-    w.Header().Set("Content-Type", "application/json")
-    json.NewEncoder(w).Encode(map[string]interface{}{
-        "rotations": rotations,
-        "total":     len(rotations),
-    })
+    return 0, nil
 }
 
-func (ut *UnifiedTokenizer) startICAPServer() {
-    listener, err := net.Listen("tcp", ":"+ut.icapPort)
-    if err != nil {
-        log.Fatalf("Failed to start ICAP server: %v", err)
+// maskKafkaMetadata masks card numbers in a message's key and header
+// values, keeping their lengths
+func (ut *UnifiedTokenizer) maskKafkaMetadata(key []byte, headers []kafka.Header) ([]byte, []kafka.Header, int) {
+    total := 0
+    if key != nil {
+        masked, n := ut.maskCardDigits(string(key))
+        key, total = []byte(masked), n
+    }
+    if len(headers) > 0 {
+        headers = append([]kafka.Header(nil), headers...)
+        for i, h := range headers {
+            if h.Value != nil {
+                masked, n := ut.maskCardDigits(string(h.Value))
+                headers[i].Value = []byte(masked)
+                total += n
+            }
+        }
     }
-    defer listener.Close()
-    
-    log.Printf("Starting ICAP detokenization server on port %s", ut.icapPort)
-    
-    for {
-        conn, err := listener.Accept()
-        if err != nil {
-            log.Printf("Failed to accept connection: %v", err)
-            continue
+    return key, headers, total
+}
+
+// kafkaDeadLetter is a message for the dead letter topic: the original,
+// with headers saying where it came from and why it was not republished.
+// Card numbers in messages from tokenize routes are masked, so the dead
+// letter topic holds none in the clear.
+func (ut *UnifiedTokenizer) kafkaDeadLetter(p *kafkaPartition, rec kafka.Record, reason string) kafka.Record {
+    key, value, headers := rec.Key, rec.Value, rec.Headers
+    if p.route.tokenize {
+        key, headers, _ = ut.maskKafkaMetadata(key, headers)
+        if value != nil {
+            masked, _ := ut.maskCardDigits(string(value))
+            value = []byte(masked)
         }
-        
-        go ut.icapServer.HandleConnection(conn)
     }
+    headers = append(append([]kafka.Header(nil), headers...),
+        kafka.Header{Key: "tokenshield.error", Value: []byte(reason)},
+        kafka.Header{Key: "tokenshield.topic", Value: []byte(p.route.source)},
+        kafka.Header{Key: "tokenshield.partition", Value: []byte(strconv.Itoa(int(p.id)))},
+        kafka.Header{Key: "tokenshield.offset", Value: []byte(strconv.FormatInt(rec.Offset, 10))})
+    return kafka.Record{Key: key, Value: value, Headers: headers, Timestamp: rec.Timestamp}
 }
 
 // KeyManager Implementation
 
-func NewKeyManager(db *sql.DB) (*KeyManager, error) {
+func NewKeyManager(db *sql.DB, sealer keyseal.Sealer) (*KeyManager, error) {
     km := &KeyManager{
         db:       db,
         kekCache: make(map[string][]byte),
         dekCache: make(map[string][]byte),
+        sealer:   sealer,
+    }
+    
+    // With an HSM, DEKs can be wrapped by the HSM key itself so no KEK
+    // ever exists outside the token
+    if utils.GetEnv("PKCS11_WRAP_DEKS", "false") == "true" {
+        if sealer == nil || sealer.Name() != "pkcs11" {
+            return nil, errors.New("PKCS11_WRAP_DEKS requires PKCS11_MODULE")
+        }
+        km.dekSealer = sealer
     }
     
     // Load or generate KEK
@@ -3861,9 +18706,91 @@ func NewKeyManager(db *sql.DB) (*KeyManager, error) {
         return nil, fmt.Errorf("failed to initialize DEK: %v", err)
     }
     
+    if err := km.loadOrGenerateIndexKey(); err != nil {
+        return nil, fmt.Errorf("failed to initialize blind index key: %v", err)
+    }
+    
     return km, nil
 }
 
+// NewSealedKeyManager returns a KeyManager that holds no keys and refuses
+// to encrypt or decrypt until Unseal is called with the master key
+// reconstructed from the key shares
+func NewSealedKeyManager(db *sql.DB) (*KeyManager, error) {
+    if utils.GetEnv("PKCS11_WRAP_DEKS", "false") == "true" {
+        return nil, errors.New("PKCS11_WRAP_DEKS cannot be combined with SEAL_MODE")
+    }
+    return &KeyManager{
+        db:       db,
+        kekCache: make(map[string][]byte),
+        dekCache: make(map[string][]byte),
+        sealed:   true,
+    }, nil
+}
+
+// Unseal loads the KEK and DEK with sealer and starts serving requests
+func (km *KeyManager) Unseal(sealer keyseal.Sealer) error {
+    km.mu.Lock()
+    if !km.sealed {
+        km.mu.Unlock()
+        return nil
+    }
+    km.sealer = sealer
+    km.mu.Unlock()
+    
+    if err := km.loadOrGenerateKEK(); err != nil {
+        return fmt.Errorf("failed to initialize KEK: %v", err)
+    }
+    if err := km.loadOrGenerateDEK(); err != nil {
+        return fmt.Errorf("failed to initialize DEK: %v", err)
+    }
+    if err := km.loadOrGenerateIndexKey(); err != nil {
+        return fmt.Errorf("failed to initialize blind index key: %v", err)
+    }
+    
+    km.mu.Lock()
+    km.sealed = false
+    km.mu.Unlock()
+    return nil
+}
+
+// IsSealed reports whether the KeyManager is still waiting for key shares
+func (km *KeyManager) IsSealed() bool {
+    km.mu.RLock()
+    defer km.mu.RUnlock()
+    return km.sealed
+}
+
+// HealthCheck round-trips a probe through the current DEK and the KEK
+// sealer, so a scheduled rotation does not start on a broken key path
+func (km *KeyManager) HealthCheck() error {
+    probe := make([]byte, 16)
+    if _, err := io.ReadFull(cryptorand.Reader, probe); err != nil {
+        return err
+    }
+    ciphertext, dekID, err := km.EncryptData(probe)
+    if err != nil {
+        return fmt.Errorf("DEK encryption failed: %v", err)
+    }
+    if plaintext, err := km.DecryptData(ciphertext, dekID); err != nil || !bytes.Equal(plaintext, probe) {
+        return fmt.Errorf("DEK decryption failed: %v", err)
+    }
+    
+    km.mu.RLock()
+    sealer := km.sealer
+    km.mu.RUnlock()
+    if sealer != nil {
+        sealed, err := sealer.Seal(probe, []byte("health_check"))
+        if err != nil {
+            return fmt.Errorf("KEK sealer %s unavailable: %v", sealer.Name(), err)
+        }
+        if _, err := sealer.Unseal(sealed, []byte("health_check")); err != nil {
+            return fmt.Errorf("KEK sealer %s unavailable: %v", sealer.Name(), err)
+        }
+    }
+    return nil
+}
+
 // getCurrentDEKID returns the current active DEK ID
 func (km *KeyManager) getCurrentDEKID() string {
     km.mu.RLock()
@@ -3871,15 +18798,23 @@ func (km *KeyManager) getCurrentDEKID() string {
     return km.currentDEKID
 }
 
+// currentKeyIDs returns the active KEK and DEK IDs
+func (km *KeyManager) currentKeyIDs() (kek, dek string) {
+    km.mu.RLock()
+    defer km.mu.RUnlock()
+    return km.currentKEKID, km.currentDEKID
+}
+
 func (km *KeyManager) loadOrGenerateKEK() error {
     var keyID string
     var key []byte
+    var metadata []byte
     
     err := km.db.QueryRow(`
-        SELECT key_id, encrypted_key FROM encryption_keys
+        SELECT key_id, encrypted_key, metadata FROM encryption_keys
         WHERE key_type = 'KEK' AND key_status = 'active'
         ORDER BY key_version DESC LIMIT 1
-    `).Scan(&keyID, &key)
+    `).Scan(&keyID, &key, &metadata)
     
     if err == sql.ErrNoRows {
         // Generate new KEK
@@ -3890,11 +18825,16 @@ func (km *KeyManager) loadOrGenerateKEK() error {
         
         keyID = "kek_" + generateRandomID()
         
+        stored, metadataJSON, err := km.sealKEK(keyID, key)
+        if err != nil {
+            return err
+        }
+        
         _, err = km.db.Exec(`
             INSERT INTO encryption_keys 
-            (key_id, key_type, key_version, encrypted_key, key_status, activated_at)
-            VALUES (?, 'KEK', 1, ?, 'active', NOW())
-        `, keyID, key)
+            (key_id, key_type, key_version, encrypted_key, key_status, metadata, activated_at)
+            VALUES (?, 'KEK', 1, ?, 'active', ?, NOW())
+        `, keyID, stored, metadataJSON)
         
         if err != nil {
             return fmt.Errorf("failed to store KEK: %v", err)
@@ -3903,6 +18843,11 @@ func (km *KeyManager) loadOrGenerateKEK() error {
         log.Printf("Generated new KEK: %s", keyID)
     } else if err != nil {
         return err
+    } else {
+        key, err = km.unsealKEK(keyID, key, metadata)
+        if err != nil {
+            return err
+        }
     }
     
     km.mu.Lock()
@@ -3910,7 +18855,64 @@ func (km *KeyManager) loadOrGenerateKEK() error {
     km.currentKEKID = keyID
     km.mu.Unlock()
     
-    return nil
+    return nil
+}
+
+// sealKEK wraps a KEK for storage, returning the stored bytes and the
+// metadata recording how it was sealed
+func (km *KeyManager) sealKEK(keyID string, kek []byte) ([]byte, []byte, error) {
+    if km.sealer == nil {
+        log.Printf("WARNING: KEK %s is stored unsealed; set KEK_PASSPHRASE or KMS_PROVIDER to wrap it", keyID)
+        return kek, nil, nil
+    }
+    
+    sealed, err := km.sealer.Seal(kek, []byte(keyID))
+    if err != nil {
+        return nil, nil, fmt.Errorf("failed to seal KEK with %s: %v", km.sealer.Name(), err)
+    }
+    metadataJSON, _ := json.Marshal(map[string]string{"sealed_by": km.sealer.Name()})
+    return sealed, metadataJSON, nil
+}
+
+// unsealKEK unwraps a stored KEK. Rows written before sealing was
+// configured hold the raw key; they are sealed in place on first load.
+func (km *KeyManager) unsealKEK(keyID string, stored, metadata []byte) ([]byte, error) {
+    var meta map[string]string
+    if len(metadata) > 0 {
+        json.Unmarshal(metadata, &meta)
+    }
+    sealedBy := meta["sealed_by"]
+    
+    if sealedBy == "" {
+        if km.sealer == nil {
+            log.Printf("WARNING: KEK %s is stored unsealed; set KEK_PASSPHRASE or KMS_PROVIDER to wrap it", keyID)
+            return stored, nil
+        }
+        sealed, metadataJSON, err := km.sealKEK(keyID, stored)
+        if err != nil {
+            return nil, err
+        }
+        if _, err := km.db.Exec(`
+            UPDATE encryption_keys SET encrypted_key = ?, metadata = ?
+            WHERE key_id = ? AND key_type = 'KEK'
+        `, sealed, metadataJSON, keyID); err != nil {
+            return nil, fmt.Errorf("failed to seal existing KEK %s: %v", keyID, err)
+        }
+        log.Printf("Sealed existing plaintext KEK %s with %s", keyID, km.sealer.Name())
+        return stored, nil
+    }
+    
+    if km.sealer == nil {
+        return nil, fmt.Errorf("KEK %s is sealed with %s but no KEK passphrase or KMS is configured", keyID, sealedBy)
+    }
+    if km.sealer.Name() != sealedBy {
+        return nil, fmt.Errorf("KEK %s is sealed with %s but %s is configured", keyID, sealedBy, km.sealer.Name())
+    }
+    kek, err := km.sealer.Unseal(stored, []byte(keyID))
+    if err != nil {
+        return nil, fmt.Errorf("failed to unseal KEK %s: %v", keyID, err)
+    }
+    return kek, nil
 }
 
 func (km *KeyManager) loadOrGenerateDEK() error {
@@ -3931,17 +18933,7 @@ func (km *KeyManager) loadOrGenerateDEK() error {
         return err
     }
     
-    // Decrypt DEK with KEK
-    var kekID string
-    km.mu.RLock()
-    for kid := range km.kekCache {
-        kekID = kid
-        break
-    }
-    kek := km.kekCache[kekID]
-    km.mu.RUnlock()
-    
-    dek, err := km.decryptWithKEK(encryptedKey, kek)
+    dek, err := km.unwrapDEK(keyID, encryptedKey, metadata)
     if err != nil {
         return fmt.Errorf("failed to decrypt DEK: %v", err)
     }
@@ -3955,42 +18947,26 @@ func (km *KeyManager) loadOrGenerateDEK() error {
 }
 
 func (km *KeyManager) generateNewDEK() error {
-    // Get active KEK
-    var kekID string
-    var kek []byte
-    
-    km.mu.RLock()
-    for kid, k := range km.kekCache {
-        kekID = kid
-        kek = k
-        break
-    }
-    km.mu.RUnlock()
-    
-    if kek == nil {
-        return errors.New("no active KEK found")
-    }
-    
     // Generate new DEK
     dek := make([]byte, 32)
     if _, err := io.ReadFull(cryptorand.Reader, dek); err != nil {
         return fmt.Errorf("failed to generate DEK: %v", err)
     }
     
-    // Encrypt DEK with KEK
-    encryptedDEK, err := km.encryptWithKEK(dek, kek)
+    dekID := "dek_" + generateRandomID()
+    
+    // Encrypt DEK with KEK (or the HSM)
+    metadata := map[string]interface{}{}
+    encryptedDEK, err := km.wrapDEK(dekID, dek, metadata)
     if err != nil {
         return fmt.Errorf("failed to encrypt DEK: %v", err)
     }
     
-    dekID := "dek_" + generateRandomID()
-    
     // Get next version
     var maxVersion int
     km.db.QueryRow("SELECT COALESCE(MAX(key_version), 0) FROM encryption_keys WHERE key_type = 'DEK'").Scan(&maxVersion)
     
     // Store encrypted DEK
-    metadata := map[string]string{"kek_id": kekID}
     metadataJSON, _ := json.Marshal(metadata)
     
     _, err = km.db.Exec(`
@@ -4013,8 +18989,90 @@ func (km *KeyManager) generateNewDEK() error {
     return nil
 }
 
+// loadOrGenerateIndexKey loads the blind index key. Unlike DEKs it is never
+// rotated, since every stored index would have to be recomputed; it is
+// wrapped by the KEK (or HSM) that was active when it was created.
+func (km *KeyManager) loadOrGenerateIndexKey() error {
+    var keyID string
+    var encryptedKey []byte
+    var metadata json.RawMessage
+    
+    err := km.db.QueryRow(`
+        SELECT key_id, encrypted_key, metadata FROM encryption_keys
+        WHERE key_type = 'INDEX' AND key_status = 'active'
+        ORDER BY key_version DESC LIMIT 1
+    `).Scan(&keyID, &encryptedKey, &metadata)
+    
+    if err == nil {
+        key, err := km.unwrapDEK(keyID, encryptedKey, metadata)
+        if err != nil {
+            return fmt.Errorf("failed to decrypt index key: %v", err)
+        }
+        km.mu.Lock()
+        km.indexKey = key
+        km.mu.Unlock()
+        return nil
+    } else if err != sql.ErrNoRows {
+        return err
+    }
+    
+    key := make([]byte, 32)
+    if _, err := io.ReadFull(cryptorand.Reader, key); err != nil {
+        return fmt.Errorf("failed to generate index key: %v", err)
+    }
+    keyID = "idx_" + generateRandomID()
+    meta := map[string]interface{}{}
+    wrapped, err := km.wrapDEK(keyID, key, meta)
+    if err != nil {
+        return err
+    }
+    metadataJSON, _ := json.Marshal(meta)
+    if _, err := km.db.Exec(`
+        INSERT INTO encryption_keys
+        (key_id, key_type, key_version, encrypted_key, key_status, metadata, activated_at)
+        VALUES (?, 'INDEX', 1, ?, 'active', ?, NOW())
+    `, keyID, wrapped, metadataJSON); err != nil {
+        return fmt.Errorf("failed to store index key: %v", err)
+    }
+    
+    // Indexes computed before KEK/DEK was enabled used the legacy key;
+    // clear them so the backfill recomputes them with this one
+    if _, err := km.db.Exec("UPDATE credit_cards SET card_number_index = NULL, card_holder_name_index = NULL, external_id_index = NULL"); err != nil {
+        log.Printf("Warning: Failed to reset blind indexes: %v", err)
+    }
+    if _, err := km.db.Exec("DELETE FROM card_claims"); err != nil {
+        log.Printf("Warning: Failed to reset card claims: %v", err)
+    }
+    
+    km.mu.Lock()
+    km.indexKey = key
+    km.mu.Unlock()
+    log.Printf("Generated blind index key: %s", keyID)
+    return nil
+}
+
+// BlindIndex returns a keyed hash of value for equality lookups on
+// encrypted columns
+func (km *KeyManager) BlindIndex(purpose string, value []byte) ([]byte, error) {
+    km.mu.RLock()
+    sealed, key := km.sealed, km.indexKey
+    km.mu.RUnlock()
+    
+    if sealed {
+        return nil, errVaultSealed
+    }
+    if key == nil {
+        return nil, errors.New("no blind index key available")
+    }
+    return computeBlindIndex(key, purpose, value), nil
+}
+
 func (km *KeyManager) EncryptData(plaintext []byte) ([]byte, string, error) {
     km.mu.RLock()
+    if km.sealed {
+        km.mu.RUnlock()
+        return nil, "", errVaultSealed
+    }
     dekID := km.currentDEKID
     dek, exists := km.dekCache[dekID]
     km.mu.RUnlock()
@@ -4045,6 +19103,10 @@ func (km *KeyManager) EncryptData(plaintext []byte) ([]byte, string, error) {
 
 func (km *KeyManager) DecryptData(ciphertext []byte, dekID string) ([]byte, error) {
     km.mu.RLock()
+    if km.sealed {
+        km.mu.RUnlock()
+        return nil, errVaultSealed
+    }
     dek, exists := km.dekCache[dekID]
     km.mu.RUnlock()
     
@@ -4096,29 +19158,129 @@ func (km *KeyManager) loadDEK(dekID string) error {
         return err
     }
     
-    // Get KEK ID from metadata
-    var meta map[string]string
+    // Decrypt DEK with the KEK (or HSM) named in its metadata
+    dek, err := km.unwrapDEK(dekID, encryptedKey, metadata)
+    if err != nil {
+        return err
+    }
+    
+    km.mu.Lock()
+    km.dekCache[dekID] = dek
+    km.mu.Unlock()
+    
+    return nil
+}
+
+// wrapDEK encrypts a DEK for storage and records what wrapped it in the
+// metadata: the HSM key with PKCS11_WRAP_DEKS, otherwise the active KEK
+func (km *KeyManager) wrapDEK(dekID string, dek []byte, metadata map[string]interface{}) ([]byte, error) {
+    if km.dekSealer != nil {
+        metadata["sealed_by"] = km.dekSealer.Name()
+        return km.dekSealer.Seal(dek, []byte(dekID))
+    }
+    
+    km.mu.RLock()
+    kekID := km.currentKEKID
+    kek := km.kekCache[kekID]
+    km.mu.RUnlock()
+    
+    if kek == nil {
+        return nil, errors.New("no active KEK found")
+    }
+    metadata["kek_id"] = kekID
+    return km.encryptWithKEK(dek, kek)
+}
+
+// unwrapDEK decrypts a stored DEK according to its metadata
+func (km *KeyManager) unwrapDEK(dekID string, encryptedKey, metadata []byte) ([]byte, error) {
+    var meta map[string]interface{}
     json.Unmarshal(metadata, &meta)
-    kekID := meta["kek_id"]
     
+    if sealedBy, _ := meta["sealed_by"].(string); sealedBy != "" {
+        if km.dekSealer == nil || km.dekSealer.Name() != sealedBy {
+            return nil, fmt.Errorf("DEK %s is wrapped by %s; set PKCS11_WRAP_DEKS=true with the same HSM", dekID, sealedBy)
+        }
+        return km.dekSealer.Unseal(encryptedKey, []byte(dekID))
+    }
+    
+    kekID, _ := meta["kek_id"].(string)
     km.mu.RLock()
     kek, exists := km.kekCache[kekID]
     km.mu.RUnlock()
     
     if !exists {
-        return errors.New("KEK not found")
+        // Wrapped by a retired KEK, or by one another replica just rotated in
+        var err error
+        if kek, err = km.loadKEK(kekID); err != nil {
+            return nil, fmt.Errorf("KEK %s not found: %v", kekID, err)
+        }
     }
-    
-    // Decrypt DEK
-    dek, err := km.decryptWithKEK(encryptedKey, kek)
+    return km.decryptWithKEK(encryptedKey, kek)
+}
+
+// loadKEK unseals a KEK of any status into the cache
+func (km *KeyManager) loadKEK(kekID string) ([]byte, error) {
+    var stored, metadata []byte
+    err := km.db.QueryRow(`
+        SELECT encrypted_key, metadata FROM encryption_keys
+        WHERE key_id = ? AND key_type = 'KEK'
+    `, kekID).Scan(&stored, &metadata)
     if err != nil {
-        return err
+        return nil, err
+    }
+    kek, err := km.unsealKEK(kekID, stored, metadata)
+    if err != nil {
+        return nil, err
     }
     
     km.mu.Lock()
-    km.dekCache[dekID] = dek
+    km.kekCache[kekID] = kek
     km.mu.Unlock()
+    return kek, nil
+}
+
+// SyncActiveKeys picks up rotations made by other replicas. Retired keys stay
+// cached and loadable, so cards encrypted under them keep decrypting; only
+// the keys used for new data change.
+func (km *KeyManager) SyncActiveKeys() error {
+    if km.IsSealed() {
+        return nil
+    }
+    
+    var kekID, dekID sql.NullString
+    err := km.db.QueryRow(`
+        SELECT
+            (SELECT key_id FROM encryption_keys WHERE key_type = 'KEK' AND key_status = 'active'
+             ORDER BY key_version DESC LIMIT 1),
+            (SELECT key_id FROM encryption_keys WHERE key_type = 'DEK' AND key_status = 'active'
+             ORDER BY key_version DESC LIMIT 1)
+    `).Scan(&kekID, &dekID)
+    if err != nil {
+        return err
+    }
     
+    km.mu.RLock()
+    currentKEK, currentDEK := km.currentKEKID, km.currentDEKID
+    km.mu.RUnlock()
+    
+    if kekID.Valid && kekID.String != currentKEK {
+        if _, err := km.loadKEK(kekID.String); err != nil {
+            return fmt.Errorf("failed to load KEK %s: %v", kekID.String, err)
+        }
+        km.mu.Lock()
+        km.currentKEKID = kekID.String
+        km.mu.Unlock()
+        log.Printf("Switched to KEK %s (rotated by another replica)", kekID.String)
+    }
+    if dekID.Valid && dekID.String != currentDEK {
+        if err := km.loadDEK(dekID.String); err != nil {
+            return fmt.Errorf("failed to load DEK %s: %v", dekID.String, err)
+        }
+        km.mu.Lock()
+        km.currentDEKID = dekID.String
+        km.mu.Unlock()
+        log.Printf("Switched to DEK %s (rotated by another replica)", dekID.String)
+    }
     return nil
 }
 
@@ -4163,6 +19325,9 @@ func (km *KeyManager) decryptWithKEK(ciphertext, kek []byte) ([]byte, error) {
 
 // Key rotation methods
 func (km *KeyManager) RotateKEK() error {
+    if km.IsSealed() {
+        return errVaultSealed
+    }
     log.Printf("Starting KEK rotation...")
     
     // Generate new KEK
@@ -4173,9 +19338,14 @@ func (km *KeyManager) RotateKEK() error {
     
     newKEKID := "kek_" + generateRandomID()
     
+    storedKEK, metadataJSON, err := km.sealKEK(newKEKID, newKEK)
+    if err != nil {
+        return err
+    }
+    
     // Get current KEK version
     var currentVersion int
-    err := km.db.QueryRow(`
+    err = km.db.QueryRow(`
         SELECT COALESCE(MAX(key_version), 0) FROM encryption_keys 
         WHERE key_type = 'KEK'
     `).Scan(&currentVersion)
@@ -4206,9 +19376,9 @@ func (km *KeyManager) RotateKEK() error {
     // Insert new KEK
     _, err = tx.Exec(`
         INSERT INTO encryption_keys 
-        (key_id, key_type, key_version, encrypted_key, key_status, activated_at)
-        VALUES (?, 'KEK', ?, ?, 'active', NOW())
-    `, newKEKID, newVersion, newKEK)
+        (key_id, key_type, key_version, encrypted_key, key_status, metadata, activated_at)
+        VALUES (?, 'KEK', ?, ?, 'active', ?, NOW())
+    `, newKEKID, newVersion, storedKEK, metadataJSON)
     
     if err != nil {
         return fmt.Errorf("failed to store new KEK: %v", err)
@@ -4219,10 +19389,9 @@ func (km *KeyManager) RotateKEK() error {
         return fmt.Errorf("failed to commit KEK rotation: %v", err)
     }
     
-    // Update cache
+    // Update cache; retired KEKs stay cached since existing DEKs are still
+    // wrapped by them
     km.mu.Lock()
-    // Clear old KEKs from cache
-    km.kekCache = make(map[string][]byte)
     km.kekCache[newKEKID] = newKEK
     km.currentKEKID = newKEKID
     km.mu.Unlock()
@@ -4232,23 +19401,10 @@ func (km *KeyManager) RotateKEK() error {
 }
 
 func (km *KeyManager) RotateDEK() error {
-    log.Printf("Starting DEK rotation...")
-    
-    // Get current KEK for encrypting new DEK
-    var kekID string
-    var kek []byte
-    
-    km.mu.RLock()
-    for kid, k := range km.kekCache {
-        kekID = kid
-        kek = k
-        break
-    }
-    km.mu.RUnlock()
-    
-    if kek == nil {
-        return errors.New("no active KEK available for DEK rotation")
+    if km.IsSealed() {
+        return errVaultSealed
     }
+    log.Printf("Starting DEK rotation...")
     
     // Generate new DEK
     newDEK := make([]byte, 32)
@@ -4256,14 +19412,18 @@ func (km *KeyManager) RotateDEK() error {
         return fmt.Errorf("failed to generate new DEK: %v", err)
     }
     
-    // Encrypt new DEK with KEK
-    encryptedDEK, err := km.encryptWithKEK(newDEK, kek)
+    newDEKID := "dek_" + generateRandomID()
+    
+    // Encrypt new DEK with the current KEK (or the HSM)
+    metadata := map[string]interface{}{
+        "algorithm": "AES-256-GCM",
+        "rotated_at": time.Now().UTC(),
+    }
+    encryptedDEK, err := km.wrapDEK(newDEKID, newDEK, metadata)
     if err != nil {
         return fmt.Errorf("failed to encrypt new DEK: %v", err)
     }
     
-    newDEKID := "dek_" + generateRandomID()
-    
     // Get current DEK version
     var currentVersion int
     err = km.db.QueryRow(`
@@ -4277,12 +19437,6 @@ func (km *KeyManager) RotateDEK() error {
     
     newVersion := currentVersion + 1
     
-    // Prepare metadata
-    metadata := map[string]interface{}{
-        "kek_id": kekID,
-        "algorithm": "AES-256-GCM",
-        "rotated_at": time.Now().UTC(),
-    }
     metadataJSON, _ := json.Marshal(metadata)
     
     // Start transaction for atomic rotation
@@ -4318,9 +19472,9 @@ func (km *KeyManager) RotateDEK() error {
         return fmt.Errorf("failed to commit DEK rotation: %v", err)
     }
     
-    // Update cache
+    // Update cache; retired DEKs stay cached for decryption until their
+    // cards are re-encrypted
     km.mu.Lock()
-    // Clear old DEKs from cache (keep for decryption if needed)
     km.dekCache[newDEKID] = newDEK
     km.currentDEKID = newDEKID
     km.mu.Unlock()
@@ -4330,9 +19484,7 @@ func (km *KeyManager) RotateDEK() error {
 }
 
 func generateRandomID() string {
-    b := make([]byte, 16)
-    cryptorand.Read(b)
-    return base64.URLEncoding.EncodeToString(b)
+    return base64.URLEncoding.EncodeToString(securerand.Bytes(16))
 }
 
 // User authentication methods
@@ -4349,21 +19501,20 @@ func generateSecurePassword(length int) string {
     password := make([]byte, length)
     
     // Ensure at least one of each type
-    password[0] = uppercase[rand.Intn(len(uppercase))]
-    password[1] = lowercase[rand.Intn(len(lowercase))]
-    password[2] = digits[rand.Intn(len(digits))]
-    password[3] = special[rand.Intn(len(special))]
+    password[0] = securerand.Choice(uppercase)
+    password[1] = securerand.Choice(lowercase)
+    password[2] = securerand.Choice(digits)
+    password[3] = securerand.Choice(special)
     
     // Fill the rest
     for i := 4; i < length; i++ {
-        password[i] = allChars[rand.Intn(len(allChars))]
+        password[i] = securerand.Choice(allChars)
     }
     
     // Shuffle the password
-    for i := len(password) - 1; i > 0; i-- {
-        j := rand.Intn(i + 1)
+    securerand.Shuffle(len(password), func(i, j int) {
         password[i], password[j] = password[j], password[i]
-    }
+    })
     
     return string(password)
 }
@@ -4425,13 +19576,13 @@ func (ut *UnifiedTokenizer) authenticateUser(username, password string) (*User,
     var passwordChangedAt sql.NullTime
     
     err := ut.db.QueryRow(`
-        SELECT user_id, username, email, password_hash, full_name, 
+        SELECT user_id, username, email, is_email_verified, password_hash, full_name, 
                role, permissions, is_active, created_at, last_login_at,
                password_changed_at
         FROM users 
-        WHERE username = ? OR email = ?
+        WHERE (username = ? OR email = ?) AND account_type = 'human'
     `, username, username).Scan(
-        &user.UserID, &user.Username, &user.Email, &passwordHash,
+        &user.UserID, &user.Username, &user.Email, &user.EmailVerified, &passwordHash,
         &user.FullName, &user.Role, &permissionsJSON, &user.IsActive,
         &user.CreatedAt, &lastLoginAt, &passwordChangedAt,
     )
@@ -4686,7 +19837,27 @@ func (ut *UnifiedTokenizer) invalidateSession(sessionID string, reason string) e
     return nil
 }
 
-func (ut *UnifiedTokenizer) validateSession(sessionID string) (*UserSession, error) {
+// errReauthenticate is returned by validateSession in SESSION_BINDING=step_up
+// mode for a session used from another network or browser
+var errReauthenticate = errors.New("session used from another network or browser; confirm your password at /api/v1/auth/reauthenticate")
+
+// errPasswordChange is returned by validateSession for a session whose user
+// has a temporary password, on any path but passwordChangePaths
+var errPasswordChange = errors.New("the password must be changed first at /api/v1/auth/change-password")
+
+// passwordChangePaths are what a user with a temporary password can use:
+// the default admin's first password, or one set by an admin's reset
+var passwordChangePaths = map[string]bool{
+    "/api/v1/auth/change-password": true,
+    "/api/v1/auth/me":              true,
+}
+
+// validateSession returns the session of sessionID and refreshes its
+// activity. A session bound to another network or browser than r's is
+// refused as SESSION_BINDING says; with r nil it is not checked. Nor is
+// whether the user must change a temporary password first, which otherwise
+// limits the session to passwordChangePaths.
+func (ut *UnifiedTokenizer) validateSession(r *http.Request, sessionID string) (*UserSession, error) {
     var session UserSession
     var user User
     var permissionsJSON []byte
@@ -4696,8 +19867,8 @@ func (ut *UnifiedTokenizer) validateSession(sessionID string) (*UserSession, err
         SELECT 
             s.session_id, s.user_id, s.ip_address, s.user_agent,
             s.created_at, s.expires_at, s.last_activity_at,
-            u.username, u.email, u.full_name, u.role, u.permissions,
-            u.is_active, u.created_at, u.last_login_at
+            u.username, u.email, u.is_email_verified, u.full_name, u.role, u.permissions,
+            u.is_active, u.created_at, u.last_login_at, u.password_changed_at IS NULL
         FROM user_sessions s
         JOIN users u ON s.user_id = u.user_id
         WHERE s.session_id = ? 
@@ -4707,8 +19878,8 @@ func (ut *UnifiedTokenizer) validateSession(sessionID string) (*UserSession, err
     `, sessionID).Scan(
         &session.SessionID, &session.UserID, &session.IPAddress, &session.UserAgent,
         &session.CreatedAt, &session.ExpiresAt, &session.LastActivity,
-        &user.Username, &user.Email, &user.FullName, &user.Role, &permissionsJSON,
-        &user.IsActive, &user.CreatedAt, &lastLoginAt,
+        &user.Username, &user.Email, &user.EmailVerified, &user.FullName, &user.Role, &permissionsJSON,
+        &user.IsActive, &user.CreatedAt, &lastLoginAt, &user.RequirePasswordChange,
     )
     
     if err == sql.ErrNoRows {
@@ -4735,102 +19906,323 @@ func (ut *UnifiedTokenizer) validateSession(sessionID string) (*UserSession, err
             Username:  user.Username,
             IPAddress: session.IPAddress,
             Details: map[string]interface{}{
-                "session_id": sessionID,
-                "idle_duration": now.Sub(session.LastActivity).String(),
-                "idle_timeout": ut.sessionIdleTimeout.String(),
+                "session_id": sessionID,
+                "idle_duration": now.Sub(session.LastActivity).String(),
+                "idle_timeout": ut.sessionIdleTimeout.String(),
+            },
+        })
+        
+        return nil, errors.New("session expired due to inactivity")
+    }
+    
+    // Checked before the activity is refreshed, so a refused request does
+    // not keep the session alive
+    if r != nil && ut.sessionBinding.Enabled() {
+        ipAddress, userAgent := ut.getClientInfo(r)
+        if mismatch := ut.sessionBinding.Mismatch(session.IPAddress, session.UserAgent, ipAddress, userAgent); len(mismatch) > 0 {
+            if err := ut.sessionBindingViolated(r, &session, user.Username, mismatch); err != nil {
+                return nil, err
+            }
+        }
+    }
+    
+    // Until a temporary password is changed the session is good for
+    // nothing else, whichever endpoint it is sent to
+    if r != nil && user.RequirePasswordChange && !passwordChangePaths[r.URL.Path] {
+        return nil, errPasswordChange
+    }
+    
+    // Calculate new expiry time based on idle timeout and absolute timeout
+    absoluteExpiry := session.CreatedAt.Add(ut.sessionTimeout)
+    idleExpiry := now.Add(ut.sessionIdleTimeout)
+    
+    // Use the earlier of the two expiry times
+    newExpiresAt := idleExpiry
+    if absoluteExpiry.Before(idleExpiry) {
+        newExpiresAt = absoluteExpiry
+    }
+    
+    // Update last activity and potentially extend expiry
+    _, err = ut.db.Exec(`
+        UPDATE user_sessions 
+        SET last_activity_at = NOW(), expires_at = ?
+        WHERE session_id = ?
+    `, newExpiresAt, sessionID)
+    
+    if err != nil {
+        log.Printf("Error updating session activity for %s: %v", sessionID, err)
+    }
+    
+    // Parse user data
+    user.UserID = session.UserID
+    json.Unmarshal(permissionsJSON, &user.Permissions)
+    if lastLoginAt.Valid {
+        user.LastLoginAt = &lastLoginAt.Time
+    }
+    
+    // Update session object with new values
+    session.User = &user
+    session.LastActivity = now
+    session.ExpiresAt = newExpiresAt
+    
+    return &session, nil
+}
+
+// sessionBindingViolated records that session was used from another network
+// or browser than it is bound to, and returns the error to refuse the
+// request with when SESSION_BINDING refuses it. Short of ending the session,
+// the event is logged at most once a minute per session and address.
+func (ut *UnifiedTokenizer) sessionBindingViolated(r *http.Request, session *UserSession, username string, mismatch []string) error {
+    ipAddress, userAgent := ut.getClientInfo(r)
+    mode := ut.sessionBinding.Mode
+    if mode == sessionbind.Strict || ut.blockEventDue("session|"+session.SessionID+"|"+ipAddress) {
+        ut.logSecurityEvent(SecurityEvent{
+            EventType: "session_binding_violation",
+            Severity:  "medium",
+            UserID:    session.UserID,
+            Username:  username,
+            IPAddress: ipAddress,
+            UserAgent: userAgent,
+            Endpoint:  r.URL.Path,
+            Details: map[string]interface{}{
+                "mismatch":         mismatch,
+                "mode":             string(mode),
+                "bound_ip":         session.IPAddress,
+                "bound_user_agent": session.UserAgent,
+            },
+        })
+    }
+    
+    switch mode {
+    case sessionbind.StepUp:
+        return errReauthenticate
+    case sessionbind.Strict:
+        if err := ut.invalidateSession(session.SessionID, "session_binding_violation"); err != nil {
+            log.Printf("Failed to end session of user %s: %v", session.UserID, err)
+        }
+        return errors.New("session ended: used from another network or browser")
+    }
+    return nil
+}
+
+// writeSessionError answers a request whose session validateSession refused
+func writeSessionError(w http.ResponseWriter, r *http.Request, err error) {
+    if err == errReauthenticate {
+        apierror.Write(w, r, http.StatusUnauthorized, apierror.ReauthenticationRequired, err.Error())
+        return
+    }
+    if err == errPasswordChange {
+        apierror.Write(w, r, http.StatusForbidden, apierror.PasswordChangeRequired, err.Error())
+        return
+    }
+    apierror.Write(w, r, http.StatusUnauthorized, apierror.InvalidSession, err.Error())
+}
+
+// ReauthenticateRequest is the body of POST /api/v1/auth/reauthenticate
+type ReauthenticateRequest struct {
+    Password string `json:"password"`
+}
+
+// handleReauthenticate confirms the password of a session's user and binds
+// the session to the network and browser it is now used from, which lifts a
+// SESSION_BINDING=step_up refusal. A wrong password ends the session, so a
+// stolen session ID gets one guess.
+func (ut *UnifiedTokenizer) handleReauthenticate(w http.ResponseWriter, r *http.Request) {
+    if r.Method != "POST" {
+        apierror.Write(w, r, http.StatusMethodNotAllowed, apierror.MethodNotAllowed, "Method not allowed")
+        return
+    }
+    
+    sessionID := ut.cookies.sessionID(r)
+    if auth := r.Header.Get("Authorization"); sessionID == "" && strings.HasPrefix(auth, "Bearer ") {
+        sessionID = strings.TrimPrefix(auth, "Bearer ")
+    }
+    if sessionID == "" {
+        apierror.Write(w, r, http.StatusUnauthorized, apierror.AuthenticationRequired, "Authentication required")
+        return
+    }
+    
+    // Read first, so a request without a password does not keep the
+    // session alive
+    var req ReauthenticateRequest
+    if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Password == "" {
+        apierror.Write(w, r, http.StatusBadRequest, apierror.InvalidBody, "password is required")
+        return
+    }
+    
+    // Not checked against the binding, which is what this restores
+    session, err := ut.validateSession(nil, sessionID)
+    if err != nil {
+        writeSessionError(w, r, err)
+        return
+    }
+    
+    var passwordHash string
+    if err := ut.db.QueryRow("SELECT password_hash FROM users WHERE user_id = ?", session.UserID).Scan(&passwordHash); err != nil {
+        apierror.Write(w, r, http.StatusInternalServerError, apierror.InternalError, "Database error")
+        return
+    }
+    
+    ipAddress, userAgent := ut.getClientInfo(r)
+    if err := bcrypt.CompareHashAndPassword([]byte(passwordHash), []byte(req.Password)); err != nil {
+        ut.logSecurityEvent(SecurityEvent{
+            EventType: "session_reauth_failed",
+            Severity:  "high",
+            UserID:    session.UserID,
+            Username:  session.User.Username,
+            IPAddress: ipAddress,
+            UserAgent: userAgent,
+            Endpoint:  r.URL.Path,
+            Details: map[string]interface{}{
+                "bound_ip": session.IPAddress,
+                "action":   "session_ended",
             },
         })
-        
-        return nil, errors.New("session expired due to inactivity")
-    }
-    
-    // Calculate new expiry time based on idle timeout and absolute timeout
-    absoluteExpiry := session.CreatedAt.Add(ut.sessionTimeout)
-    idleExpiry := now.Add(ut.sessionIdleTimeout)
-    
-    // Use the earlier of the two expiry times
-    newExpiresAt := idleExpiry
-    if absoluteExpiry.Before(idleExpiry) {
-        newExpiresAt = absoluteExpiry
+        if err := ut.invalidateSession(sessionID, "session_reauth_failed"); err != nil {
+            log.Printf("Failed to end session of user %s: %v", session.UserID, err)
+        }
+        ut.cookies.clear(w, r)
+        apierror.Write(w, r, http.StatusUnauthorized, apierror.InvalidCredentials, "Incorrect password; the session has ended")
+        return
     }
     
-    // Update last activity and potentially extend expiry
-    _, err = ut.db.Exec(`
-        UPDATE user_sessions 
-        SET last_activity_at = NOW(), expires_at = ?
-        WHERE session_id = ?
-    `, newExpiresAt, sessionID)
-    
+    _, err = ut.db.Exec("UPDATE user_sessions SET ip_address = ?, user_agent = ? WHERE session_id = ?", ipAddress, userAgent, sessionID)
     if err != nil {
-        log.Printf("Error updating session activity for %s: %v", sessionID, err)
+        apierror.Write(w, r, http.StatusInternalServerError, apierror.InternalError, "Database error")
+        return
     }
+    ut.logAuditEvent(AuditEvent{
+        UserID:       session.UserID,
+        Action:       "session_rebound",
+        ResourceType: "session",
+        ResourceID:   sessionID,
+        IPAddress:    ipAddress,
+        UserAgent:    userAgent,
+        Details: map[string]interface{}{
+            "previous_ip":         session.IPAddress,
+            "previous_user_agent": session.UserAgent,
+        },
+    })
     
-    // Parse user data
-    user.UserID = session.UserID
-    json.Unmarshal(permissionsJSON, &user.Permissions)
-    if lastLoginAt.Valid {
-        user.LastLoginAt = &lastLoginAt.Time
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(map[string]string{"message": "Session confirmed for this network and browser"})
+}
+
+// effectivePermissions returns what user may do: the permissions of their
+// role and those granted to them
+func (ut *UnifiedTokenizer) effectivePermissions(user *User) []string {
+    permissions := append([]string{}, user.Permissions...)
+    if roles := ut.rolePermissions.Load(); roles != nil {
+        for _, p := range (*roles)[user.Role] {
+            if !slices.Contains(permissions, p) {
+                permissions = append(permissions, p)
+            }
+        }
     }
-    
-    // Update session object with new values
-    session.User = &user
-    session.LastActivity = now
-    session.ExpiresAt = newExpiresAt
-    
-    return &session, nil
+    return permissions
 }
 
+// hasPermission reports whether user has permission, through their role or
+// their own grants. system.admin has every permission.
 func (ut *UnifiedTokenizer) hasPermission(user *User, permission string) bool {
-    // System admin has all permissions
-    for _, p := range user.Permissions {
+    for _, p := range ut.effectivePermissions(user) {
         if p == PermSystemAdmin || p == permission {
             return true
         }
     }
-    
-    // Check role-based permissions
-    switch user.Role {
-    case RoleAdmin:
-        return true // Admin has all permissions
-    case RoleOperator:
-        // Operators can read/write/delete tokens and view activity
-        operatorPerms := []string{
-            PermTokensRead, PermTokensWrite, PermTokensDelete,
-            PermActivityRead, PermStatsRead,
-        }
-        for _, p := range operatorPerms {
-            if p == permission {
-                return true
-            }
-        }
-    case RoleViewer:
-        // Viewers have read-only access
-        viewerPerms := []string{
-            PermTokensRead, PermActivityRead, PermStatsRead,
-        }
-        for _, p := range viewerPerms {
-            if p == permission {
-                return true
-            }
+    return false
+}
+
+// requestHasPermission checks an additional permission for the user that
+// requirePermission has already authenticated. Legacy API keys without a
+// user only have their fixed set, and client certificate identities only
+// the permissions they were granted.
+func (ut *UnifiedTokenizer) requestHasPermission(r *http.Request, permission string) bool {
+    return ut.requestHasPermissions(r, []string{permission})
+}
+
+// requestHasPermissions is requestHasPermission for every one of permissions
+func (ut *UnifiedTokenizer) requestHasPermissions(r *http.Request, permissions []string) bool {
+    var user User
+    var permissionsJSON []byte
+    err := ut.db.QueryRow(`
+        SELECT role, permissions FROM users WHERE user_id = ? AND is_active = TRUE
+    `, r.Header.Get("X-User-ID")).Scan(&user.Role, &permissionsJSON)
+    if err != nil {
+        return false
+    }
+    json.Unmarshal(permissionsJSON, &user.Permissions)
+    for _, permission := range permissions {
+        if !ut.hasPermission(&user, permission) || !ut.clientCertAllows(r, permission) {
+            return false
         }
     }
-    
-    return false
+    return true
+}
+
+// canManageUser reports whether the caller of r holds every permission of
+// user, so users.write cannot take over or hand out more than the caller
+// has. Only holders of system.admin can manage users with system.admin.
+func (ut *UnifiedTokenizer) canManageUser(r *http.Request, user *User) bool {
+    return ut.requestHasPermissions(r, ut.effectivePermissions(user))
+}
+
+// ownerScope returns the user whose own resources r is limited to: none
+// when the caller was granted all, the permission over every resource, or
+// else the caller
+func ownerScope(r *http.Request, all string) string {
+    if r.Header.Get("X-Granted-Permission") == all {
+        return ""
+    }
+    return r.Header.Get("X-User-ID")
 }
 
 func (ut *UnifiedTokenizer) requirePermission(handler http.HandlerFunc, permission string) http.HandlerFunc {
+    return ut.requireAnyPermission(handler, permission)
+}
+
+// grantedPermission returns the first of permissions user has, and allowed
+// accepts if given, or "" if none
+func (ut *UnifiedTokenizer) grantedPermission(user *User, permissions []string, allowed func(string) bool) string {
+    for _, p := range permissions {
+        if ut.hasPermission(user, p) && (allowed == nil || allowed(p)) {
+            return p
+        }
+    }
+    return ""
+}
+
+// requireAnyPermission is requirePermission for routes that accept any of
+// several permissions, such as one over all resources and one over the
+// caller's own. The first the caller has is passed on in
+// X-Granted-Permission, so list them broadest first.
+func (ut *UnifiedTokenizer) requireAnyPermission(handler http.HandlerFunc, permissions ...string) http.HandlerFunc {
     return func(w http.ResponseWriter, r *http.Request) {
+        // Set below only once the API key or client certificate is verified
+        r.Header.Del("X-Authenticated-API-Key")
+        r.Header.Del("X-Authenticated-Client-Cert")
+        r.Header.Del("X-Granted-Permission")
+        
         // Check for API key first (backward compatibility)
         apiKey := r.Header.Get("X-API-Key")
         if apiKey != "" {
             // Validate API key
             var userID sql.NullString
-            var isActive bool
+            var isActive, signed, expired bool
             err := ut.db.QueryRow(`
-                SELECT user_id, is_active FROM api_keys 
+                SELECT user_id, is_active, signing_secret_encrypted IS NOT NULL, COALESCE(expires_at <= NOW(), FALSE) FROM api_keys 
                 WHERE api_key = ?
-            `, apiKey).Scan(&userID, &isActive)
+            `, apiKey).Scan(&userID, &isActive, &signed, &expired)
             
+            if err == nil && isActive && expired {
+                apierror.Write(w, r, http.StatusUnauthorized, apierror.APIKeyExpired, "API key expired")
+                return
+            }
+            // A signed key is no credential on its own
+            if err == nil && isActive && signed && r.Header.Get("X-Verified-Signature") != apiKey {
+                apierror.Write(w, r, http.StatusUnauthorized, apierror.InvalidSignature, "This API key only accepts signed requests")
+                return
+            }
             if err == nil && isActive {
                 // Update last used timestamp
                 ut.db.Exec("UPDATE api_keys SET last_used_at = NOW() WHERE api_key = ?", apiKey)
@@ -4849,9 +20241,11 @@ func (ut *UnifiedTokenizer) requirePermission(handler http.HandlerFunc, permissi
                     
                     if err == nil {
                         json.Unmarshal(permissionsJSON, &user.Permissions)
-                        if ut.hasPermission(&user, permission) {
+                        if granted := ut.grantedPermission(&user, permissions, nil); granted != "" {
+                            r.Header.Set("X-Granted-Permission", granted)
                             r.Header.Set("X-User-ID", user.UserID)
                             r.Header.Set("X-Username", user.Username)
+                            r.Header.Set("X-Authenticated-API-Key", apiKey)
                             handler(w, r)
                             return
                         }
@@ -4863,29 +20257,57 @@ func (ut *UnifiedTokenizer) requirePermission(handler http.HandlerFunc, permissi
                         PermTokensRead, PermTokensWrite, PermActivityRead, PermStatsRead,
                     }
                     for _, p := range legacyAllowedPerms {
-                        if p == permission {
+                        if slices.Contains(permissions, p) {
+                            r.Header.Set("X-Granted-Permission", p)
                             r.Header.Set("X-User-ID", "api_key_" + apiKey[:8])
                             r.Header.Set("X-Username", "API Key User")
+                            r.Header.Set("X-Authenticated-API-Key", apiKey)
                             handler(w, r)
                             return
                         }
                     }
                 }
                 
-                w.WriteHeader(http.StatusForbidden)
-                json.NewEncoder(w).Encode(map[string]string{"error": "Insufficient permissions"})
+                apierror.Write(w, r, http.StatusForbidden, apierror.PermissionDenied, "Insufficient permissions")
                 return
             }
         }
         
+        // Then a verified client certificate mapped to an identity, which
+        // has its owner's permissions limited to the ones it was granted
+        cert, err := ut.clientCertFor(r)
+        if err != nil {
+            log.Printf("Failed to look up client certificate identity: %v", err)
+            apierror.Write(w, r, http.StatusInternalServerError, apierror.InternalError, "Database error")
+            return
+        }
+        if cert != nil {
+            var user User
+            var permissionsJSON []byte
+            err := ut.db.QueryRow(`
+                SELECT user_id, username, role, permissions FROM users WHERE user_id = ? AND is_active = TRUE
+            `, cert.UserID).Scan(&user.UserID, &user.Username, &user.Role, &permissionsJSON)
+            if err == nil {
+                json.Unmarshal(permissionsJSON, &user.Permissions)
+                if granted := ut.grantedPermission(&user, permissions, cert.allows); granted != "" {
+                    ut.db.Exec("UPDATE client_certificates SET last_used_at = NOW() WHERE cert_id = ?", cert.CertID)
+                    r.Header.Set("X-Granted-Permission", granted)
+                    r.Header.Set("X-User-ID", user.UserID)
+                    r.Header.Set("X-Username", user.Username)
+                    r.Header.Set("X-Authenticated-Client-Cert", cert.CertID)
+                    handler(w, r)
+                    return
+                }
+            }
+            apierror.Write(w, r, http.StatusForbidden, apierror.PermissionDenied, "Insufficient permissions")
+            return
+        }
+        
         // Check for session cookie or Authorization header
         var sessionID string
         
         // Try cookie first
-        cookie, err := r.Cookie("session_id")
-        if err == nil {
-            sessionID = cookie.Value
-        }
+        sessionID = ut.cookies.sessionID(r)
         
         // Try Authorization header
         if sessionID == "" {
@@ -4896,27 +20318,26 @@ func (ut *UnifiedTokenizer) requirePermission(handler http.HandlerFunc, permissi
         }
         
         if sessionID == "" {
-            w.WriteHeader(http.StatusUnauthorized)
-            json.NewEncoder(w).Encode(map[string]string{"error": "Authentication required"})
+            apierror.Write(w, r, http.StatusUnauthorized, apierror.AuthenticationRequired, "Authentication required")
             return
         }
         
         // Validate session
-        session, err := ut.validateSession(sessionID)
+        session, err := ut.validateSession(r, sessionID)
         if err != nil {
-            w.WriteHeader(http.StatusUnauthorized)
-            json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+            writeSessionError(w, r, err)
             return
         }
         
         // Check permission
-        if !ut.hasPermission(session.User, permission) {
-            w.WriteHeader(http.StatusForbidden)
-            json.NewEncoder(w).Encode(map[string]string{"error": "Insufficient permissions"})
+        granted := ut.grantedPermission(session.User, permissions, nil)
+        if granted == "" {
+            apierror.Write(w, r, http.StatusForbidden, apierror.PermissionDenied, "Insufficient permissions")
             return
         }
         
         // Add user to request context
+        r.Header.Set("X-Granted-Permission", granted)
         r.Header.Set("X-User-ID", session.User.UserID)
         r.Header.Set("X-Username", session.User.Username)
         
@@ -4928,6 +20349,17 @@ func (ut *UnifiedTokenizer) requirePermission(handler http.HandlerFunc, permissi
 func (ut *UnifiedTokenizer) startSessionCleanupService() {
     // Run cleanup immediately on startup
     ut.cleanupExpiredSessions()
+    ut.pruneDetokenizeUsage()
+    ut.purgeRevokedTokens()
+    ut.archiveTokenRequests()
+    ut.archiveAuditLogs()
+    ut.pruneAccountTokens()
+    ut.pruneRequestNonces()
+    ut.pruneLoginChallenges()
+    ut.remindExpiringKeys()
+    ut.runAccessReviews()
+    ut.disableInactive()
+    ut.deleteOrphanNetworkTokens()
     
     // Set up periodic cleanup every 15 minutes
     ticker := time.NewTicker(15 * time.Minute)
@@ -4939,25 +20371,418 @@ func (ut *UnifiedTokenizer) startSessionCleanupService() {
         select {
         case <-ticker.C:
             ut.cleanupExpiredSessions()
+            ut.pruneDetokenizeUsage()
+            ut.purgeRevokedTokens()
+            ut.archiveTokenRequests()
+            ut.archiveAuditLogs()
+            ut.pruneAccountTokens()
+            ut.pruneRequestNonces()
+            ut.pruneLoginChallenges()
+            ut.remindExpiringKeys()
+            ut.runAccessReviews()
+            ut.disableInactive()
+            ut.deleteOrphanNetworkTokens()
+        }
+    }
+}
+
+// runMigrate implements the "migrate" mode: apply pending schema migrations
+// (or report them with --status) and exit. The operator runs it as a Job
+// before rolling out a new version.
+func runMigrate(args []string) {
+    fs := flag.NewFlagSet("migrate", flag.ExitOnError)
+    status := fs.Bool("status", false, "Show the schema version and pending migrations without applying them")
+    fs.Parse(args)
+    
+    settings, err := loadConnectionSettings()
+    if err != nil {
+        log.Fatalf("Migration failed: %v", err)
+    }
+    db, err := openDatabase(settings)
+    if err != nil {
+        log.Fatalf("Migration failed: %v", err)
+    }
+    defer db.Close()
+    
+    ctx := context.Background()
+    if *status {
+        current, err := migrate.Current(ctx, db)
+        if err != nil {
+            log.Fatalf("Failed to read schema version: %v", err)
+        }
+        pending, err := migrate.Pending(ctx, db)
+        if err != nil {
+            log.Fatalf("Failed to list migrations: %v", err)
+        }
+        fmt.Printf("Schema version: %d\n", current)
+        for _, m := range pending {
+            fmt.Printf("Pending: %04d_%s\n", m.Version, m.Name)
+        }
+        return
+    }
+    
+    applied, err := migrate.Run(ctx, db)
+    if err != nil {
+        log.Fatalf("Migration failed after %d applied: %v", applied, err)
+    }
+    current, _ := migrate.Current(ctx, db)
+    log.Printf("Schema is at version %d (%d migrations applied)", current, applied)
+}
+
+// runPKCS11Check connects to the HSM configured by the PKCS11_* variables
+// and reports each step, so a slot, PIN or key problem can be found without
+// starting the service
+func runPKCS11Check() {
+    cfg, err := keyseal.PKCS11ConfigFromEnv()
+    if err != nil {
+        log.Fatalf("PKCS#11 check failed: %v", err)
+    }
+    fmt.Printf("Module: %s\n", cfg.Module)
+    if err := keyseal.CheckPKCS11(cfg, os.Stdout); err != nil {
+        log.Fatalf("PKCS#11 check failed: %v", err)
+    }
+}
+
+// runUnsealInit implements "unseal-init": generate the master key for
+// sealed-boot mode (SEAL_MODE=shamir), print its key shares once and store
+// only a check value. The master key itself is never written anywhere.
+func runUnsealInit(args []string) {
+    fs := flag.NewFlagSet("unseal-init", flag.ExitOnError)
+    shares := fs.Int("shares", 5, "Number of key shares to generate")
+    threshold := fs.Int("threshold", 3, "Number of key shares required to unseal")
+    fs.Parse(args)
+    
+    settings, err := loadConnectionSettings()
+    if err != nil {
+        log.Fatalf("Unseal init failed: %v", err)
+    }
+    db, err := openDatabase(settings)
+    if err != nil {
+        log.Fatalf("Unseal init failed: %v", err)
+    }
+    defer db.Close()
+    
+    var existing int
+    if err := db.QueryRow("SELECT COUNT(*) FROM seal_config").Scan(&existing); err != nil {
+        log.Fatalf("Failed to read seal_config (run 'unified-tokenizer migrate' first): %v", err)
+    }
+    if existing > 0 {
+        log.Fatalf("Key shares have already been generated for this database")
+    }
+    
+    masterKey := make([]byte, 32)
+    if _, err := io.ReadFull(cryptorand.Reader, masterKey); err != nil {
+        log.Fatalf("Failed to generate master key: %v", err)
+    }
+    parts, err := shamir.Split(masterKey, *shares, *threshold)
+    if err != nil {
+        log.Fatalf("Unseal init failed: %v", err)
+    }
+    sealer, err := keyseal.NewMasterKey(masterKey)
+    if err != nil {
+        log.Fatalf("Unseal init failed: %v", err)
+    }
+    check, err := sealer.Seal([]byte("tokenshield"), []byte(sealCheckAAD))
+    if err != nil {
+        log.Fatalf("Unseal init failed: %v", err)
+    }
+    if _, err := db.Exec(
+        "INSERT INTO seal_config (id, shares, threshold, check_value) VALUES (1, ?, ?, ?)",
+        *shares, *threshold, check,
+    ); err != nil {
+        log.Fatalf("Failed to store seal_config: %v", err)
+    }
+    
+    fmt.Printf("Generated %d key shares, %d required to unseal.\n", *shares, *threshold)
+    fmt.Printf("Give each share to a different key holder; they are not shown again.\n\n")
+    for i, part := range parts {
+        fmt.Printf("Key share %d: %s\n", i+1, base64.StdEncoding.EncodeToString(part))
+    }
+}
+
+// runVerify implements "verify": check every card in the vault now, print
+// the reconciliation report and exit non-zero if anything is wrong
+func runVerify(args []string) {
+    fs := flag.NewFlagSet("verify", flag.ExitOnError)
+    jsonOutput := fs.Bool("json", false, "Print the report as JSON")
+    fs.Parse(args)
+    
+    ut, err := NewUnifiedTokenizer()
+    if err != nil {
+        log.Fatalf("Verify failed: %v", err)
+    }
+    defer ut.db.Close()
+    defer ut.stmts.Close()
+    if ut.unsealer != nil {
+        log.Fatalf("Verify cannot unseal the vault; start a check with POST /api/v1/integrity/checks instead")
+    }
+    
+    report := newIntegrityReport("verify")
+    if err := ut.recordIntegrityCheck(report, nil); err != nil {
+        log.Fatalf("Failed to record integrity check (run 'unified-tokenizer migrate' first): %v", err)
+    }
+    ut.runIntegrityCheck(report)
+    
+    if *jsonOutput {
+        enc := json.NewEncoder(os.Stdout)
+        enc.SetIndent("", "  ")
+        enc.Encode(report)
+    } else {
+        report.WriteText(os.Stdout)
+    }
+    if report.Status != "completed" || report.IssueCount() > 0 {
+        os.Exit(1)
+    }
+}
+
+// runBatch implements "batch": process settlement files from BATCH_INBOX
+// without serving traffic, continuously or, with -once, the files present
+// now, for a cron job
+func runBatch(args []string) {
+    fs := flag.NewFlagSet("batch", flag.ExitOnError)
+    once := fs.Bool("once", false, "Process the files in the inbox and exit")
+    settle := fs.Duration("settle", 5*time.Second, "With -once, how long a file must stay unchanged to count as uploaded")
+    fs.Parse(args)
+    
+    ut, err := NewUnifiedTokenizer()
+    if err != nil {
+        log.Fatalf("Batch failed: %v", err)
+    }
+    defer ut.db.Close()
+    defer ut.stmts.Close()
+    if ut.batchWatcher == nil {
+        log.Fatalf("Batch failed: BATCH_INBOX is not set")
+    }
+    if ut.unsealer != nil {
+        log.Fatalf("Batch cannot unseal the vault; run the watcher in the service instead")
+    }
+    if !*once {
+        ut.startBatchWatcher()
+    }
+    
+    // Files still being uploaded change between the two listings
+    ut.pollBatchInbox()
+    time.Sleep(*settle)
+    ut.pollBatchInbox()
+}
+
+// runBatchRestore implements "batch-restore": decrypt a batch file archived
+// from the inbox
+func runBatchRestore(args []string) {
+    fs := flag.NewFlagSet("batch-restore", flag.ExitOnError)
+    output := fs.String("o", "", "Write the original file here instead of to standard output")
+    fs.Parse(args)
+    if fs.NArg() != 1 {
+        log.Fatalf("Usage: unified-tokenizer batch-restore [-o file] <archive.enc>")
+    }
+    
+    archive, err := os.ReadFile(fs.Arg(0))
+    if err != nil {
+        log.Fatalf("Failed to read archive: %v", err)
+    }
+    ut, err := NewUnifiedTokenizer()
+    if err != nil {
+        log.Fatalf("Batch restore failed: %v", err)
+    }
+    defer ut.db.Close()
+    defer ut.stmts.Close()
+    if ut.unsealer != nil {
+        log.Fatalf("Batch restore cannot unseal the vault in sealed-boot mode")
+    }
+    
+    data, err := ut.openBatchArchive(archive)
+    if err != nil {
+        log.Fatalf("Failed to decrypt archive: %v", err)
+    }
+    if *output == "" {
+        os.Stdout.Write(data)
+        return
+    }
+    if err := os.WriteFile(*output, data, 0600); err != nil {
+        log.Fatalf("Failed to write %s: %v", *output, err)
+    }
+}
+
+// egressSettings reads the EGRESS_* settings shared by the egress sidecar
+// and the egress helper: the payment hosts detokenized, whether to send
+// their plain-HTTP requests upstream over HTTPS, and the dial timeout
+func egressSettings() (hosts []string, originateTLS bool, dialTimeout time.Duration, err error) {
+    dialTimeout, err = utils.DurationSetting("EGRESS_DIAL_TIMEOUT", 10*time.Second, 100*time.Millisecond, 5*time.Minute)
+    if err != nil {
+        return nil, false, 0, err
+    }
+    for _, h := range strings.Split(utils.GetEnv("EGRESS_HOSTS", ""), ",") {
+        if h = strings.TrimSpace(h); h != "" {
+            hosts = append(hosts, h)
+        }
+    }
+    if len(hosts) == 0 {
+        log.Printf("Warning: EGRESS_HOSTS is empty, no requests will be detokenized")
+    }
+    originateTLS = utils.GetEnv("EGRESS_ORIGINATE_TLS", "false") == "true"
+    return hosts, originateTLS, dialTimeout, nil
+}
+
+// loadEgressHelper sets up the egress helper from EGRESS_HELPER_LISTEN: the
+// egress sidecar's forward proxy run inside the service, detokenizing in
+// process rather than over ICAP. It takes no credentials, so it only
+// listens on a loopback address or a unix socket.
+func (ut *UnifiedTokenizer) loadEgressHelper() error {
+    listen := utils.GetEnv("EGRESS_HELPER_LISTEN", "")
+    if listen == "" {
+        return nil
+    }
+    if path, ok := strings.CutPrefix(listen, "unix:"); ok {
+        if path == "" {
+            return fmt.Errorf("EGRESS_HELPER_LISTEN must name a socket path after unix:")
+        }
+    } else {
+        host, _, err := net.SplitHostPort(listen)
+        if err != nil {
+            return fmt.Errorf("invalid EGRESS_HELPER_LISTEN %q: %v", listen, err)
+        }
+        if ip := net.ParseIP(host); host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+            return fmt.Errorf("EGRESS_HELPER_LISTEN must be a loopback address such as 127.0.0.1:15001 or unix:/path/to/socket")
+        }
+    }
+    hosts, originateTLS, dialTimeout, err := egressSettings()
+    if err != nil {
+        return err
+    }
+    ut.egressHelperListen = listen
+    ut.egressHelper = egress.New(ut.icapServer, hosts, originateTLS)
+    ut.egressHelper.DialTimeout = dialTimeout
+    // Clients on a unix socket send origin-form requests with the payment
+    // host in Host; over TCP that would let anything able to reach the
+    // port as a web server use it, so absolute form is required there
+    ut.egressHelper.OriginForm = strings.HasPrefix(listen, "unix:")
+    return nil
+}
+
+func (ut *UnifiedTokenizer) startEgressHelper() {
+    network, addr := "tcp", ut.egressHelperListen
+    if path, ok := strings.CutPrefix(addr, "unix:"); ok {
+        network, addr = "unix", path
+        // Remove the socket left by a previous run, but nothing else
+        if info, err := os.Lstat(path); err == nil && info.Mode()&os.ModeSocket != 0 {
+            os.Remove(path)
         }
     }
+    listener, err := net.Listen(network, addr)
+    if err != nil {
+        log.Fatalf("Failed to start egress helper: %v", err)
+    }
+    if network == "unix" {
+        if err := os.Chmod(addr, 0660); err != nil {
+            log.Fatalf("Failed to set egress helper socket permissions: %v", err)
+        }
+    }
+    defer listener.Close()
+    
+    log.Printf("Starting egress helper on %s", ut.egressHelperListen)
+    server := &http.Server{
+        Handler:           ut.egressHelper,
+        ReadHeaderTimeout: 10 * time.Second,
+    }
+    log.Printf("Egress helper stopped: %v", server.Serve(listener))
+}
+
+// runEgress implements the "egress" sidecar mode: a localhost forward proxy
+// that detokenizes outbound payment requests through the tokenizer's ICAP
+// service. It needs no database or encryption key, keeping the application
+// pod out of the cardholder-data environment.
+func runEgress() {
+    icapURL := utils.GetEnv("EGRESS_ICAP_URL", "")
+    if icapURL == "" {
+        log.Fatalf("EGRESS_ICAP_URL is required, e.g. icap://tokenshield-tokenizer:1344/reqmod")
+    }
+    
+    var tlsConfig *tls.Config
+    if caFile := utils.GetEnv("EGRESS_ICAP_CA", ""); caFile != "" {
+        caPEM, err := os.ReadFile(caFile)
+        if err != nil {
+            log.Fatalf("Failed to read EGRESS_ICAP_CA: %v", err)
+        }
+        rootCAs := x509.NewCertPool()
+        if !rootCAs.AppendCertsFromPEM(caPEM) {
+            log.Fatalf("EGRESS_ICAP_CA contains no PEM certificates")
+        }
+        tlsConfig = &tls.Config{RootCAs: rootCAs, MinVersion: tls.VersionTLS12}
+    }
+    
+    client, err := icap.NewClient(icapURL, tlsConfig)
+    if err != nil {
+        log.Fatalf("Invalid egress configuration: %v", err)
+    }
+    if client.Timeout, err = utils.DurationSetting("EGRESS_ICAP_TIMEOUT", 10*time.Second, 100*time.Millisecond, 10*time.Minute); err != nil {
+        log.Fatalf("Invalid egress configuration: %v", err)
+    }
+    client.Secret = utils.GetEnv("EGRESS_ICAP_SECRET", "")
+    hosts, originateTLS, dialTimeout, err := egressSettings()
+    if err != nil {
+        log.Fatalf("Invalid egress configuration: %v", err)
+    }
+    
+    // Loopback only: the application container shares the pod network namespace
+    listen := utils.GetEnv("EGRESS_LISTEN", "127.0.0.1:15001")
+    log.Printf("TokenShield egress sidecar listening on %s (ICAP %s, hosts %v, originate TLS %v)", listen, icapURL, hosts, originateTLS)
+    proxy := egress.New(client, hosts, originateTLS)
+    proxy.DialTimeout = dialTimeout
+    server := &http.Server{
+        Addr:              listen,
+        Handler:           proxy,
+        ReadHeaderTimeout: 10 * time.Second,
+    }
+    log.Fatal(server.ListenAndServe())
 }
 
 func main() {
     log.SetFlags(log.LstdFlags | log.Lshortfile)
     
+    if len(os.Args) > 1 {
+        switch os.Args[1] {
+        case "migrate":
+            runMigrate(os.Args[2:])
+            return
+        case "egress":
+            runEgress()
+            return
+        case "pkcs11-check":
+            runPKCS11Check()
+            return
+        case "unseal-init":
+            runUnsealInit(os.Args[2:])
+            return
+        case "verify":
+            runVerify(os.Args[2:])
+            return
+        case "batch":
+            runBatch(os.Args[2:])
+            return
+        case "batch-restore":
+            runBatchRestore(os.Args[2:])
+            return
+        }
+    }
+    
     ut, err := NewUnifiedTokenizer()
     if err != nil {
         log.Fatalf("Failed to initialize tokenizer: %v", err)
     }
     defer ut.db.Close()
+    defer ut.stmts.Close()
     
     log.Printf("TokenShield Unified Service starting...")
     log.Printf("HTTP Port: %s, ICAP Port: %s, API Port: %s", ut.httpPort, ut.icapPort, ut.apiPort)
     log.Printf("App Endpoint: %s", ut.appEndpoint)
     log.Printf("Token Format: %s", ut.tokenFormat)
+    if ut.region != "" {
+        log.Printf("Region: %s", ut.region)
+    }
     log.Printf("KEK/DEK Encryption: %v", ut.useKEKDEK)
     
+    ut.checkSchema()
+    
     // Create default admin user if needed
     if err := ut.createDefaultAdminUser(); err != nil {
         log.Printf("Warning: Failed to create default admin user: %v", err)
@@ -4966,8 +20791,56 @@ func main() {
     // Start background session cleanup goroutine
     go ut.startSessionCleanupService()
     
+    // Index card numbers and cardholder names stored before blind indexes existed
+    go ut.backfillBlindIndexes()
+    
+    // Encrypt external IDs, metadata and audit details stored in plaintext
+    go ut.encryptPlaintextColumns()
+    
+    // Follow CORS policy, maintenance mode, IP filter and rate-limit rule changes made through the API
+    go ut.startCORSRefresher()
+    go ut.startMaintenanceRefresher()
+    go ut.startFieldRulesRefresher()
+    go ut.startICAPISTagRefresher()
+    go ut.startIPFilterRefresher()
+    go ut.startRateLimitRefresher()
+    go ut.startRoleRefresher()
+    
+    // Keep the stats counters up to date
+    go ut.startStatsFlusher()
+    
+    // Send security events to the notification channels
+    if ut.notifier != nil {
+        go ut.notifier.Run()
+    }
+    
+    // Verify the vault on a schedule
+    if interval, err := integrityCheckInterval(); err != nil {
+        log.Fatalf("Invalid configuration: %v", err)
+    } else if interval > 0 {
+        go ut.startIntegrityScheduler(interval)
+    }
+    
+    // Follow rotations made by other replicas and apply rotation policies
+    if ut.useKEKDEK {
+        go ut.startKeySyncService()
+        go ut.startKeyRotationScheduler()
+    }
+    
     // Start all three servers
     go ut.startHTTPServer()
     go ut.startAPIServer()
+    if ut.smtpServer != nil {
+        go ut.startSMTPServer()
+    }
+    if ut.batchWatcher != nil {
+        go ut.startBatchWatcher()
+    }
+    if ut.kafkaBridge != nil {
+        go ut.startKafkaBridge()
+    }
+    if ut.egressHelper != nil {
+        go ut.startEgressHelper()
+    }
     ut.startICAPServer()
 }
\ No newline at end of file
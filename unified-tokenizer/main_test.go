@@ -1,12 +1,99 @@
 package main
 
 import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"context"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/hmac"
+	cryptorand "crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"database/sql"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log"
+	"math/big"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/smtp"
+	"net/textproto"
+	"net/url"
 	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 	
 	"tokenshield-unified/internal/utils"
+	"tokenshield-unified/internal/jsonschema"
+	"tokenshield-unified/internal/cardformat"
+	"tokenshield-unified/internal/notify"
+	"tokenshield-unified/internal/openapi"
+	"tokenshield-unified/internal/apiversion"
+	"tokenshield-unified/internal/apierror"
+	"tokenshield-unified/internal/compression"
+	"tokenshield-unified/internal/charset"
+	"tokenshield-unified/internal/spool"
+	"tokenshield-unified/internal/deepscan"
+	"tokenshield-unified/internal/mailscan"
+	"tokenshield-unified/internal/smtprelay"
+	"tokenshield-unified/internal/batchfile"
+	"tokenshield-unified/internal/dropfolder"
+	"tokenshield-unified/internal/sftp"
+	"tokenshield-unified/internal/kafka"
+	"tokenshield-unified/internal/avro"
 	"tokenshield-unified/internal/ratelimit"
+	"tokenshield-unified/internal/stats"
+	"tokenshield-unified/internal/events"
+	"tokenshield-unified/internal/forward"
+	"tokenshield-unified/internal/migrate"
+	"tokenshield-unified/internal/cors"
+	"tokenshield-unified/internal/secheaders"
+	"tokenshield-unified/internal/clientip"
+	"tokenshield-unified/internal/egress"
+	"tokenshield-unified/internal/icap"
+	"tokenshield-unified/internal/ipfilter"
+	"tokenshield-unified/internal/keyseal"
+	"tokenshield-unified/internal/loadgen"
+	"tokenshield-unified/internal/maintenance"
+	"tokenshield-unified/internal/region"
+	"tokenshield-unified/internal/engine"
+	"tokenshield-unified/internal/nettoken"
+	"tokenshield-unified/internal/counters"
+	"tokenshield-unified/internal/mailer"
+	"tokenshield-unified/internal/scanner"
+	"tokenshield-unified/internal/securerand"
+	"tokenshield-unified/internal/shamir"
+	"tokenshield-unified/internal/sqlbuild"
+	"tokenshield-unified/internal/stmtcache"
+	"tokenshield-unified/internal/upstream"
+	"tokenshield-unified/internal/waf"
+	"tokenshield-unified/internal/sessionbind"
+	"tokenshield-unified/internal/loginchallenge"
+	"tokenshield-unified/internal/objstore"
+
+	"github.com/fernet/fernet-go"
+	"github.com/go-sql-driver/mysql"
 )
 
 // TestConfig holds test configuration
@@ -139,4 +226,5375 @@ func TestCardTypeDetection(t *testing.T) {
 			}
 		})
 	}
-}
\ No newline at end of file
+}
+
+func TestMaskAPIKey(t *testing.T) {
+	tests := []struct {
+		apiKey string
+		want   string
+	}{
+		{"ts_1234567890abcdef", "****cdef"},
+		{"short", "****"},
+		{"", "****"},
+	}
+	
+	for _, tt := range tests {
+		if got := maskAPIKey(tt.apiKey); got != tt.want {
+			t.Errorf("maskAPIKey(%q) = %q, want %q", tt.apiKey, got, tt.want)
+		}
+	}
+}
+
+// TestTimeSeriesWindow tests time-series window parsing and zero-filled buckets
+func TestTimeSeriesWindow(t *testing.T) {
+	now := time.Date(2024, 1, 2, 10, 30, 0, 0, time.UTC)
+
+	w, err := stats.ParseWindow("", "", "", now)
+	if err != nil {
+		t.Fatalf("default window: unexpected error: %v", err)
+	}
+	if w.Interval.Name != "hour" || len(w.Buckets()) != 25 {
+		t.Errorf("default window = %s with %d buckets, want hour with 25", w.Interval.Name, len(w.Buckets()))
+	}
+
+	if _, err := stats.ParseWindow("2024-01-02", "2024-01-01", "day", now); err == nil {
+		t.Error("start after end should be rejected")
+	}
+	if _, err := stats.ParseWindow("", "", "week", now); err == nil {
+		t.Error("unknown interval should be rejected")
+	}
+	if _, err := stats.ParseWindow("2020-01-01", "2024-01-01", "hour", now); err == nil {
+		t.Error("window exceeding the bucket limit should be rejected")
+	}
+
+	w, err = stats.ParseWindow("2024-01-01", "2024-01-04", "day", now)
+	if err != nil {
+		t.Fatalf("day window: unexpected error: %v", err)
+	}
+	acc := stats.NewAccumulator(w)
+	acc.Add("2024-01-02 00:00:00", "tokenize", 3)
+	acc.Add("2024-01-03 00:00:00", "tokenize", 2)
+	if err := acc.Add("not-a-date", "tokenize", 1); err == nil {
+		t.Error("invalid bucket label should be rejected")
+	}
+
+	series := acc.Series()
+	if len(series) != 1 || len(series[0].Points) != 3 {
+		t.Fatalf("got %+v, want one series with 3 points", series)
+	}
+	if series[0].Total != 5 || series[0].Points[0].Count != 0 || series[0].Points[1].Count != 3 {
+		t.Errorf("unexpected series values: %+v", series[0])
+	}
+}
+
+// TestEventBroker tests event fan-out and non-blocking delivery to slow subscribers
+func TestEventBroker(t *testing.T) {
+	b := events.NewBroker(2)
+
+	// Publishing without subscribers must not block or fail
+	b.Publish(events.TypeActivity, "ignored")
+
+	fast := b.Subscribe()
+	slow := b.Subscribe()
+	if b.Subscribers() != 2 {
+		t.Fatalf("Subscribers() = %d, want 2", b.Subscribers())
+	}
+
+	b.Publish(events.TypeActivity, "first")
+	if got := <-fast.C; got.Type != events.TypeActivity || got.Data != "first" || got.ID != 1 {
+		t.Errorf("unexpected event %+v", got)
+	}
+
+	// slow never reads: its buffer holds two events and the third is dropped
+	b.Publish(events.TypeSecurity, "second")
+	b.Publish(events.TypeSecurity, "third")
+	if slow.Dropped() != 1 {
+		t.Errorf("slow.Dropped() = %d, want 1", slow.Dropped())
+	}
+	if fast.Dropped() != 0 {
+		t.Errorf("fast.Dropped() = %d, want 0", fast.Dropped())
+	}
+
+	b.Unsubscribe(slow)
+	if _, ok := <-slow.C; !ok {
+		t.Error("buffered events should still be readable after unsubscribe")
+	}
+	if b.Subscribers() != 1 {
+		t.Errorf("Subscribers() = %d after unsubscribe, want 1", b.Subscribers())
+	}
+	b.Unsubscribe(slow) // second call is a no-op
+}
+
+// TestMigrations tests embedded migration ordering and statement splitting
+func TestMigrations(t *testing.T) {
+	migrations, err := migrate.Migrations()
+	if err != nil {
+		t.Fatalf("Migrations() error: %v", err)
+	}
+	if len(migrations) == 0 || migrations[0].Version != 1 || migrations[0].Name != "baseline" {
+		t.Fatalf("first migration should be 0001_baseline, got %+v", migrations)
+	}
+	for i := 1; i < len(migrations); i++ {
+		if migrations[i].Version <= migrations[i-1].Version {
+			t.Errorf("migrations out of order: %d after %d", migrations[i].Version, migrations[i-1].Version)
+		}
+	}
+
+	script := "-- comment\nALTER TABLE a\n  ADD COLUMN b INT;\n\nCREATE INDEX idx_b ON a (b);\nSELECT 1"
+	stmts := migrate.Statements(script)
+	if len(stmts) != 3 {
+		t.Fatalf("Statements() returned %d statements, want 3: %q", len(stmts), stmts)
+	}
+	if stmts[0] != "ALTER TABLE a\n  ADD COLUMN b INT" {
+		t.Errorf("unexpected first statement %q", stmts[0])
+	}
+	if len(migrate.Statements(migrations[0].SQL)) != 0 {
+		t.Error("baseline migration should contain no statements")
+	}
+}
+
+// stubDetokenizer replaces a fixed token, standing in for the vault
+type stubDetokenizer struct{}
+
+func (stubDetokenizer) TokenizeJSON(s string) (string, bool, error) { return s, false, nil }
+func (stubDetokenizer) DetokenizeHTML(s string) (string, bool, error) { return s, false, nil }
+func (stubDetokenizer) DetokenizeJSON(s string) (string, bool, error) {
+	out := strings.ReplaceAll(s, "tok_test123", "4532015112830366")
+	return out, out != s, nil
+}
+
+// TestEgressProxy tests sidecar detokenization through a real ICAP round trip
+func TestEgressProxy(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	icapServer := icap.NewServer(stubDetokenizer{}, false)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go icapServer.HandleConnection(conn)
+		}
+	}()
+
+	var received string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		received = string(body)
+		w.Write([]byte("ok"))
+	}))
+	defer upstream.Close()
+	upstreamURL, _ := url.Parse(upstream.URL)
+
+	client, err := icap.NewClient("icap://"+ln.Addr().String()+"/reqmod", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy := httptest.NewServer(egress.New(client, []string{upstreamURL.Hostname()}, false))
+	defer proxy.Close()
+	proxyURL, _ := url.Parse(proxy.URL)
+	httpClient := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+
+	resp, err := httpClient.Post(upstream.URL+"/charge", "application/json", strings.NewReader(`{"card":"tok_test123"}`))
+	if err != nil {
+		t.Fatalf("request through egress proxy failed: %v", err)
+	}
+	resp.Body.Close()
+	if received != `{"card":"4532015112830366"}` {
+		t.Errorf("upstream received %q, want detokenized body", received)
+	}
+
+	// Bodies without tokens pass through unchanged (ICAP 204)
+	resp, err = httpClient.Post(upstream.URL+"/charge", "application/json", strings.NewReader(`{"amount":10}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if received != `{"amount":10}` {
+		t.Errorf("upstream received %q, want unchanged body", received)
+	}
+
+	p := egress.New(client, []string{".stripe.com", "payment-gateway"}, false)
+	for host, want := range map[string]bool{
+		"api.stripe.com": true, "stripe.com:443": true, "payment-gateway:5000": true,
+		"evilstripe.com": false, "example.com": false,
+	} {
+		if got := p.Matches(host); got != want {
+			t.Errorf("Matches(%q) = %v, want %v", host, got, want)
+		}
+	}
+}
+
+// TestICAPSharedSecret tests refusing ICAP requests without the shared
+// secret, and that the ISTag follows the field rules
+func TestICAPSharedSecret(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	ut := &UnifiedTokenizer{icapServer: icap.NewServer(stubDetokenizer{}, false)}
+	ut.icapServer.Secret = "s3cret"
+	var refused []string
+	var mu sync.Mutex
+	ut.icapServer.Unauthorized = func(remote string) {
+		mu.Lock()
+		refused = append(refused, remote)
+		mu.Unlock()
+	}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go ut.icapServer.HandleConnection(conn)
+		}
+	}()
+	exchange := func(request string) string {
+		conn, err := net.Dial("tcp", ln.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		conn.Write([]byte(request))
+		reply, _ := io.ReadAll(conn)
+		return string(reply)
+	}
+
+	client, err := icap.NewClient("icap://"+ln.Addr().String()+"/reqmod", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := httptest.NewRequest("POST", "http://gateway.example/charge", nil)
+	if _, _, err := client.Reqmod(req, []byte(`{"card":"tok_test123"}`)); err == nil {
+		t.Error("REQMOD without the secret should be refused")
+	}
+	client.Secret = "wrong"
+	if _, _, err := client.Reqmod(req, []byte(`{"card":"tok_test123"}`)); err == nil {
+		t.Error("REQMOD with a wrong secret should be refused")
+	}
+	mu.Lock()
+	if len(refused) != 2 || ut.icapServer.AuthFailures() != 2 {
+		t.Errorf("%d refusals reported, %d counted, want 2", len(refused), ut.icapServer.AuthFailures())
+	}
+	mu.Unlock()
+	client.Secret = "s3cret"
+	if body, modified, err := client.Reqmod(req, []byte(`{"card":"tok_test123"}`)); err != nil || !modified || string(body) != `{"card":"4532015112830366"}` {
+		t.Errorf("REQMOD with the secret = %q, %v, %v", body, modified, err)
+	}
+	if reply := exchange("OPTIONS icap://" + ln.Addr().String() + "/reqmod ICAP/1.0\r\n\r\n"); !strings.HasPrefix(reply, "ICAP/1.0 200 OK\r\n") {
+		t.Errorf("OPTIONS needs no secret, got %q", reply)
+	}
+
+	rules, _ := FieldRules{}.compile()
+	ut.fieldRules.Store(rules)
+	ut.updateICAPISTag()
+	before := ut.icapServer.ISTag()
+	if len(before) > 32 || !strings.HasPrefix(before, "TS-") {
+		t.Errorf("ISTag %q", before)
+	}
+	rules, _ = FieldRules{DeepScanFields: "payload:json"}.compile()
+	ut.fieldRules.Store(rules)
+	ut.updateICAPISTag()
+	after := ut.icapServer.ISTag()
+	if after == before {
+		t.Error("ISTag should change with the field rules")
+	}
+	if reply := exchange("OPTIONS icap://" + ln.Addr().String() + "/reqmod ICAP/1.0\r\n\r\n"); !strings.Contains(reply, "ISTag: \""+after+"\"\r\n") {
+		t.Errorf("OPTIONS should send ISTag %q, got %q", after, reply)
+	}
+}
+
+// TestEgressHelper tests in-process detokenization over a unix socket and
+// the loopback-only listen setting
+func TestEgressHelper(t *testing.T) {
+	var received string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		received = string(body)
+		w.Write([]byte("ok"))
+	}))
+	defer upstream.Close()
+	upstreamURL, _ := url.Parse(upstream.URL)
+
+	socket := filepath.Join(t.TempDir(), "egress.sock")
+	ln, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := egress.New(icap.NewServer(stubDetokenizer{}, false), []string{upstreamURL.Hostname()}, false)
+	p.OriginForm = true
+	server := &http.Server{Handler: p}
+	go server.Serve(ln)
+	defer server.Close()
+
+	// As with curl --unix-socket: origin-form, upstream in Host
+	httpClient := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", socket)
+		},
+	}}
+	var gz bytes.Buffer
+	zw := gzip.NewWriter(&gz)
+	zw.Write([]byte(`{"card":"tok_test123"}`))
+	zw.Close()
+	req, _ := http.NewRequest("POST", upstream.URL+"/charge", &gz)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Content-Encoding", "gzip")
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		t.Fatalf("request through egress helper failed: %v", err)
+	}
+	resp.Body.Close()
+	zr, err := gzip.NewReader(strings.NewReader(received))
+	if err != nil {
+		t.Fatalf("upstream body is not gzip: %v", err)
+	}
+	if body, _ := io.ReadAll(zr); string(body) != `{"card":"4532015112830366"}` {
+		t.Errorf("upstream received %q, want detokenized body", body)
+	}
+
+	for listen, ok := range map[string]bool{
+		"127.0.0.1:15001": true, "[::1]:15001": true, "localhost:15001": true, "unix:/run/egress.sock": true,
+		"0.0.0.0:15001": false, ":15001": false, "10.0.0.5:15001": false, "unix:": false, "15001": false,
+	} {
+		t.Setenv("EGRESS_HELPER_LISTEN", listen)
+		ut := &UnifiedTokenizer{icapServer: icap.NewServer(stubDetokenizer{}, false)}
+		if err := ut.loadEgressHelper(); (err == nil) != ok {
+			t.Errorf("EGRESS_HELPER_LISTEN=%q: error %v, want ok %v", listen, err, ok)
+		} else if ok && ut.egressHelper.OriginForm != strings.HasPrefix(listen, "unix:") {
+			t.Errorf("EGRESS_HELPER_LISTEN=%q: OriginForm %v", listen, ut.egressHelper.OriginForm)
+		}
+	}
+}
+
+// testCert is a certificate and key made for a test
+type testCert struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pem  []byte
+}
+
+// newTestCert issues a certificate from template, signed by parent or
+// self-signed when parent is nil
+func newTestCert(t *testing.T, template *x509.Certificate, parent *testCert) *testCert {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), cryptorand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template.SerialNumber = big.NewInt(time.Now().UnixNano())
+	template.NotBefore = time.Now().Add(-time.Hour)
+	template.NotAfter = time.Now().Add(time.Hour)
+	issuer, signer := template, key
+	if parent != nil {
+		issuer, signer = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(cryptorand.Reader, template, issuer, &key.PublicKey, signer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	return &testCert{cert: cert, key: key, pem: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})}
+}
+
+// tlsCertificate returns the certificate and key for a tls.Config
+func (c *testCert) tlsCertificate() tls.Certificate {
+	return tls.Certificate{Certificate: [][]byte{c.cert.Raw}, PrivateKey: c.key, Leaf: c.cert}
+}
+
+// TestClientCertIdentities tests how client certificates are named and
+// that only verified ones, outside browsers, are taken
+func TestClientCertIdentities(t *testing.T) {
+	ca := newTestCert(t, &x509.Certificate{Subject: pkix.Name{CommonName: "Test CA"}, IsCA: true, BasicConstraintsValid: true, KeyUsage: x509.KeyUsageCertSign}, nil)
+	spiffe, _ := url.Parse("spiffe://corp/payments")
+	client := newTestCert(t, &x509.Certificate{
+		Subject:        pkix.Name{CommonName: "payments"},
+		URIs:           []*url.URL{spiffe},
+		DNSNames:       []string{"Payments.Internal"},
+		EmailAddresses: []string{"Ops@Example.com"},
+		ExtKeyUsage:    []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}, ca)
+	want := []string{"URI:spiffe://corp/payments", "DNS:payments.internal", "EMAIL:ops@example.com", "CN=payments"}
+	if got := clientCertIdentities(client.cert); !reflect.DeepEqual(got, want) {
+		t.Errorf("clientCertIdentities() = %q, want %q", got, want)
+	}
+	for in, want := range map[string]string{
+		"DNS:Payments.Internal": "DNS:payments.internal", "CN=payments": "CN=payments", " uri:spiffe://corp/a ": "URI:spiffe://corp/a",
+		"EMAIL:Ops@Example.com": "EMAIL:ops@example.com", "payments": "", "CN=": "", "IP:10.0.0.1": "",
+	} {
+		got, err := normalizeCertIdentity(in)
+		if got != want || (err == nil) != (want != "") {
+			t.Errorf("normalizeCertIdentity(%q) = %q, %v; want %q", in, got, err, want)
+		}
+	}
+	c := &clientCertificate{Permissions: []string{PermTokensRead}}
+	if !c.allows(PermTokensRead) || c.allows(PermTokensDetokenize) {
+		t.Error("allows() should only grant the listed permissions")
+	}
+
+	server := newTestCert(t, &x509.Certificate{Subject: pkix.Name{CommonName: "127.0.0.1"}, IPAddresses: []net.IP{net.ParseIP("127.0.0.1")}}, ca)
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.cert)
+	var seen []string
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name := ""
+		if cert := verifiedClientCert(r); cert != nil {
+			name = cert.Subject.CommonName
+		}
+		seen = append(seen, name)
+	}))
+	srv.TLS = &tls.Config{Certificates: []tls.Certificate{server.tlsCertificate()}, ClientCAs: pool, ClientAuth: tls.VerifyClientCertIfGiven}
+	srv.StartTLS()
+	defer srv.Close()
+	get := func(certs []tls.Certificate, origin string) error {
+		httpClient := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool, Certificates: certs}}}
+		req, _ := http.NewRequest("GET", srv.URL, nil)
+		if origin != "" {
+			req.Header.Set("Origin", origin)
+		}
+		resp, err := httpClient.Do(req)
+		if err == nil {
+			resp.Body.Close()
+		}
+		return err
+	}
+	if err := get([]tls.Certificate{client.tlsCertificate()}, ""); err != nil {
+		t.Fatal(err)
+	}
+	get([]tls.Certificate{client.tlsCertificate()}, "https://evil.example")
+	get(nil, "")
+	// One from another CA is not presented, or would fail the handshake
+	rogueCA := newTestCert(t, &x509.Certificate{Subject: pkix.Name{CommonName: "Rogue CA"}, IsCA: true, BasicConstraintsValid: true, KeyUsage: x509.KeyUsageCertSign}, nil)
+	rogue := newTestCert(t, &x509.Certificate{Subject: pkix.Name{CommonName: "payments"}, ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}}, rogueCA)
+	get([]tls.Certificate{rogue.tlsCertificate()}, "")
+	if want := []string{"payments", "", "", ""}; !reflect.DeepEqual(seen, want) {
+		t.Errorf("verified client certificates = %q, want %q", seen, want)
+	}
+}
+
+// TestUpstreamTLS tests verifying the application against a pinned CA,
+// presenting a client certificate to it and the insecure switch
+func TestUpstreamTLS(t *testing.T) {
+	ca := newTestCert(t, &x509.Certificate{Subject: pkix.Name{CommonName: "Corp CA"}, IsCA: true, BasicConstraintsValid: true, KeyUsage: x509.KeyUsageCertSign}, nil)
+	server := newTestCert(t, &x509.Certificate{Subject: pkix.Name{CommonName: "127.0.0.1"}, IPAddresses: []net.IP{net.ParseIP("127.0.0.1")}}, ca)
+	client := newTestCert(t, &x509.Certificate{Subject: pkix.Name{CommonName: "tokenshield"}, ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}}, ca)
+	dir := t.TempDir()
+	caFile, certFile, keyFile := filepath.Join(dir, "ca.pem"), filepath.Join(dir, "client.pem"), filepath.Join(dir, "client.key")
+	keyDER, _ := x509.MarshalECPrivateKey(client.key)
+	os.WriteFile(caFile, ca.pem, 0600)
+	os.WriteFile(certFile, client.pem, 0600)
+	os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600)
+
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.cert)
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	srv.TLS = &tls.Config{Certificates: []tls.Certificate{server.tlsCertificate()}, ClientCAs: pool, ClientAuth: tls.RequireAndVerifyClientCert}
+	srv.StartTLS()
+	defer srv.Close()
+	get := func(env map[string]string) error {
+		for _, name := range []string{"UPSTREAM_CA_BUNDLE", "UPSTREAM_CLIENT_CERT", "UPSTREAM_CLIENT_KEY", "UPSTREAM_TLS_INSECURE_SKIP_VERIFY"} {
+			t.Setenv(name, env[name])
+		}
+		config, err := loadUpstreamTLS()
+		if err != nil {
+			return err
+		}
+		resp, err := (&http.Client{Transport: &http.Transport{TLSClientConfig: config}}).Get(srv.URL)
+		if err == nil {
+			resp.Body.Close()
+		}
+		return err
+	}
+
+	mtls := map[string]string{"UPSTREAM_CA_BUNDLE": caFile, "UPSTREAM_CLIENT_CERT": certFile, "UPSTREAM_CLIENT_KEY": keyFile}
+	if err := get(mtls); err != nil {
+		t.Errorf("pinned CA with a client certificate: %v", err)
+	}
+	if err := get(map[string]string{"UPSTREAM_CLIENT_CERT": certFile, "UPSTREAM_CLIENT_KEY": keyFile}); err == nil {
+		t.Error("a certificate from the corporate CA should not verify against the system roots")
+	}
+	if err := get(map[string]string{"UPSTREAM_CA_BUNDLE": caFile}); err == nil {
+		t.Error("the application requires a client certificate")
+	}
+	if err := get(map[string]string{"UPSTREAM_TLS_INSECURE_SKIP_VERIFY": "true", "UPSTREAM_CLIENT_CERT": certFile, "UPSTREAM_CLIENT_KEY": keyFile}); err != nil {
+		t.Errorf("insecure skip verify: %v", err)
+	}
+	for _, env := range []map[string]string{
+		{"UPSTREAM_CLIENT_CERT": certFile},
+		{"UPSTREAM_CA_BUNDLE": keyFile},
+		{"UPSTREAM_CA_BUNDLE": caFile, "UPSTREAM_TLS_INSECURE_SKIP_VERIFY": "true"},
+		{"UPSTREAM_TLS_INSECURE_SKIP_VERIFY": "yes"},
+	} {
+		if err := get(env); err == nil || !strings.Contains(err.Error(), "UPSTREAM_") {
+			t.Errorf("settings %v: error %v", env, err)
+		}
+	}
+}
+
+// TestKeySealing tests that KEKs round-trip through the passphrase and
+// Vault Transit sealers and are bound to their key ID
+func TestKeySealing(t *testing.T) {
+	if _, err := keyseal.NewPassphrase("too short"); err == nil {
+		t.Error("short passphrase should be rejected")
+	}
+
+	kek := []byte("0123456789abcdef0123456789abcdef")
+	sealer, err := keyseal.NewPassphrase("correct horse battery staple")
+	if err != nil {
+		t.Fatalf("NewPassphrase() error: %v", err)
+	}
+	sealed, err := sealer.Seal(kek, []byte("kek_1"))
+	if err != nil {
+		t.Fatalf("Seal() error: %v", err)
+	}
+	if strings.Contains(string(sealed), string(kek)) {
+		t.Fatal("sealed KEK contains the plaintext key")
+	}
+	if got, err := sealer.Unseal(sealed, []byte("kek_1")); err != nil || string(got) != string(kek) {
+		t.Errorf("Unseal() = %q, %v", got, err)
+	}
+	if _, err := sealer.Unseal(sealed, []byte("kek_2")); err == nil {
+		t.Error("sealed KEK should not unseal under another key ID")
+	}
+	other, _ := keyseal.NewPassphrase("a different passphrase entirely")
+	if _, err := other.Unseal(sealed, []byte("kek_1")); err == nil {
+		t.Error("sealed KEK should not unseal with the wrong passphrase")
+	}
+
+	// Vault Transit stub: "encrypts" by prefixing, checks token and AAD
+	vault := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body map[string]string
+		json.NewDecoder(r.Body).Decode(&body)
+		if r.Header.Get("X-Vault-Token") != "root" || body["associated_data"] == "" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		switch r.URL.Path {
+		case "/v1/transit/encrypt/tokenshield":
+			fmt.Fprintf(w, `{"data":{"ciphertext":"vault:v1:%s"}}`, body["plaintext"])
+		case "/v1/transit/decrypt/tokenshield":
+			fmt.Fprintf(w, `{"data":{"plaintext":"%s"}}`, strings.TrimPrefix(body["ciphertext"], "vault:v1:"))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer vault.Close()
+	os.Setenv("VAULT_ADDR", vault.URL)
+	os.Setenv("VAULT_TOKEN", "root")
+	defer os.Unsetenv("VAULT_ADDR")
+	defer os.Unsetenv("VAULT_TOKEN")
+
+	transit, err := keyseal.NewKMS("vault", "tokenshield", "")
+	if err != nil {
+		t.Fatalf("NewKMS() error: %v", err)
+	}
+	sealed, err = transit.Seal(kek, []byte("kek_1"))
+	if err != nil || !strings.HasPrefix(string(sealed), "vault:v1:") {
+		t.Fatalf("Transit Seal() = %q, %v", sealed, err)
+	}
+	if got, err := transit.Unseal(sealed, []byte("kek_1")); err != nil || string(got) != string(kek) {
+		t.Errorf("Transit Unseal() = %q, %v", got, err)
+	}
+	if _, err := keyseal.NewKMS("hsm", "x", ""); err == nil {
+		t.Error("unknown KMS provider should be rejected")
+	}
+}
+
+func TestShamir(t *testing.T) {
+	secret := []byte("0123456789abcdef0123456789abcdef")
+	shares, err := shamir.Split(secret, 5, 3)
+	if err != nil {
+		t.Fatalf("Split() error: %v", err)
+	}
+	if _, err := shamir.Split(secret, 3, 4); err == nil {
+		t.Error("threshold above the share count should be rejected")
+	}
+
+	// Every 3-share subset recovers the secret
+	for i := 0; i < len(shares); i++ {
+		for j := i + 1; j < len(shares); j++ {
+			for k := j + 1; k < len(shares); k++ {
+				got, err := shamir.Combine([][]byte{shares[i], shares[j], shares[k]})
+				if err != nil || string(got) != string(secret) {
+					t.Errorf("Combine(%d,%d,%d) = %q, %v", i, j, k, got, err)
+				}
+			}
+		}
+	}
+	if got, _ := shamir.Combine(shares[:2]); string(got) == string(secret) {
+		t.Error("two shares should not recover the secret")
+	}
+	if _, err := shamir.Combine([][]byte{shares[0], shares[0], shares[1]}); err == nil {
+		t.Error("duplicate shares should be rejected")
+	}
+
+	// The master key sealer detects a wrong reconstruction
+	key, _ := shamir.Combine(shares[1:4])
+	sealer, err := keyseal.NewMasterKey(key)
+	if err != nil {
+		t.Fatalf("NewMasterKey() error: %v", err)
+	}
+	check, _ := sealer.Seal([]byte("tokenshield"), []byte("seal_config"))
+	wrongKey, _ := shamir.Combine(shares[:2])
+	wrong, _ := keyseal.NewMasterKey(wrongKey)
+	if _, err := wrong.Unseal(check, []byte("seal_config")); err == nil {
+		t.Error("check value should not unseal with a wrong master key")
+	}
+}
+
+func TestBlindIndex(t *testing.T) {
+	ut := &UnifiedTokenizer{encryptionKey: &fernet.Key{}}
+	copy(ut.encryptionKey[:], "0123456789abcdef0123456789abcdef")
+
+	a, err := ut.blindIndex(blindIndexHolderName, normalizeHolderName("JANE  Doe "))
+	if err != nil {
+		t.Fatalf("blindIndex() error: %v", err)
+	}
+	b, _ := ut.blindIndex(blindIndexHolderName, normalizeHolderName("jane doe"))
+	if len(a) != 32 || string(a) != string(b) {
+		t.Errorf("normalized names should share a 32-byte index, got %x and %x", a, b)
+	}
+	if c, _ := ut.blindIndex("other_purpose", "jane doe"); string(c) == string(a) {
+		t.Error("index should depend on the purpose")
+	}
+
+	other := &UnifiedTokenizer{encryptionKey: &fernet.Key{}}
+	copy(other.encryptionKey[:], "fedcba9876543210fedcba9876543210")
+	if d, _ := other.blindIndex(blindIndexHolderName, "jane doe"); string(d) == string(a) {
+		t.Error("index should depend on the key")
+	}
+
+	pan, _ := ut.blindIndex(blindIndexCardNumber, normalizeCardNumber("4111-1111 1111-1111"))
+	if same, _ := ut.blindIndex(blindIndexCardNumber, "4111111111111111"); string(pan) != string(same) {
+		t.Error("formatted and plain card numbers should share an index")
+	}
+}
+
+func TestFieldEncryption(t *testing.T) {
+	ut := &UnifiedTokenizer{encryptionKey: &fernet.Key{}}
+	copy(ut.encryptionKey[:], "0123456789abcdef0123456789abcdef")
+
+	sealed, keyID, err := ut.encryptFields("ext-1", "", `{"plan":"gold"}`)
+	if err != nil {
+		t.Fatalf("encryptFields() error: %v", err)
+	}
+	if keyID.Valid {
+		t.Errorf("legacy encryption returned key ID %q", keyID.String)
+	}
+	if sealed[1] != nil {
+		t.Errorf("empty value encrypted to %q, want nil", sealed[1])
+	}
+	for _, data := range sealed {
+		if strings.Contains(string(data), "ext-1") || strings.Contains(string(data), "gold") {
+			t.Errorf("ciphertext %q contains the plaintext", data)
+		}
+	}
+
+	values, err := ut.decryptFields(keyID, sealed...)
+	if err != nil || !reflect.DeepEqual(values, []string{"ext-1", "", `{"plan":"gold"}`}) {
+		t.Errorf("decryptFields() = %q, %v", values, err)
+	}
+	other := &UnifiedTokenizer{encryptionKey: &fernet.Key{}}
+	copy(other.encryptionKey[:], "fedcba9876543210fedcba9876543210")
+	if _, err := other.decryptFields(keyID, sealed...); err == nil {
+		t.Error("decryptFields() should fail under another key")
+	}
+
+	a, _ := ut.blindIndex(blindIndexExternalID, normalizeExternalID(" ext-1 "))
+	b, _ := ut.blindIndex(blindIndexExternalID, "ext-1")
+	c, _ := ut.blindIndex(blindIndexExternalID, "EXT-1")
+	if string(a) != string(b) || string(a) == string(c) {
+		t.Error("external IDs should match exactly, ignoring surrounding whitespace")
+	}
+}
+
+func TestLuhnTokens(t *testing.T) {
+	for _, value := range []string{"", ",", "8999", "99a9", "9", "999999999", "9999,99", "99,9998"} {
+		if _, err := parseTokenBINs(value); err == nil {
+			t.Errorf("parseTokenBINs(%q) should fail", value)
+		}
+	}
+	bins, err := parseTokenBINs(" 9999, 9765432 ,98")
+	if err != nil || fmt.Sprint(bins) != "[9999 9765432 98]" {
+		t.Fatalf("parseTokenBINs() = %v, %v", bins, err)
+	}
+
+	ut := &UnifiedTokenizer{tokenFormat: "luhn", luhnBINs: bins, luhnTokenSpace: luhnTokenSpace(bins)}
+	if got := ut.luhnTokenSpace.String(); got != "10100100000000" {
+		t.Errorf("token space = %s, want 10^11 + 10^8 + 10^13", got)
+	}
+	seen := map[string]bool{}
+	for i := 0; i < 1000; i++ {
+		token, err := ut.generateLuhnToken()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(token) != 16 || !IsValidLuhn(token) || scanner.IsPAN(token) {
+			t.Fatalf("token %s should be a 16-digit Luhn-valid number outside card issuer ranges", token)
+		}
+		if !strings.HasPrefix(token, "9999") && !strings.HasPrefix(token, "9765432") && !strings.HasPrefix(token, "98") {
+			t.Fatalf("token %s is not from a configured BIN", token)
+		}
+		seen[token[:2]] = true
+	}
+	if !seen["98"] {
+		t.Error("tokens should be drawn in proportion to each BIN's range, mostly from 98")
+	}
+
+	// Collisions on the UNIQUE token key are regenerated, other errors are not
+	duplicate := &mysql.MySQLError{Number: 1062, Message: "Duplicate entry for key 'credit_cards.token'"}
+	var tried []string
+	token, err := ut.withUniqueToken(func(token string) error {
+		tried = append(tried, token)
+		if len(tried) < 3 {
+			return duplicate
+		}
+		return nil
+	})
+	if err != nil || token != tried[2] || ut.tokenCollisions != 2 {
+		t.Errorf("withUniqueToken() = %s, %v after %d collisions, want the third token", token, err, ut.tokenCollisions)
+	}
+	if _, err := ut.withUniqueToken(func(string) error { return duplicate }); err == nil {
+		t.Error("withUniqueToken() should give up when every token collides")
+	}
+	tried = nil
+	if _, err := ut.withUniqueToken(func(token string) error {
+		tried = append(tried, token)
+		return fmt.Errorf("connection refused")
+	}); err == nil || len(tried) != 1 {
+		t.Errorf("withUniqueToken() should not retry other errors, tried %d tokens", len(tried))
+	}
+}
+
+func TestRequestArchiveSettings(t *testing.T) {
+	dir := t.TempDir()
+	for _, tc := range []struct {
+		mode, dir string
+		ok        bool
+	}{
+		{"table", "", true},
+		{"delete", "", true},
+		{"file", dir, true},
+		{"file", "", false},
+		{"file", filepath.Join(dir, "missing"), false},
+		{"s3", "", false},
+	} {
+		t.Setenv("TOKEN_REQUEST_ARCHIVE", tc.mode)
+		t.Setenv("TOKEN_REQUEST_ARCHIVE_DIR", tc.dir)
+		if _, err := loadRequestArchive(); (err == nil) != tc.ok {
+			t.Errorf("TOKEN_REQUEST_ARCHIVE=%s with dir %q: error %v", tc.mode, tc.dir, err)
+		}
+	}
+
+	status := int64(200)
+	requests := []archivedRequest{
+		{ID: 7, Token: "tok_a", RequestType: "tokenize", Timestamp: time.Unix(1700000000, 0).UTC(), ResponseStatus: &status},
+		{ID: 9, Token: "tok_b", RequestType: "detokenize", Timestamp: time.Unix(1700000060, 0).UTC()},
+	}
+	if err := writeRequestArchive(dir, requests); err != nil {
+		t.Fatal(err)
+	}
+	entries, _ := os.ReadDir(dir)
+	if len(entries) != 1 || entries[0].Name() != "token_requests_7-9.jsonl.gz" {
+		t.Fatalf("archive directory holds %v, want one file named for IDs 7 to 9", entries)
+	}
+	f, err := os.Open(filepath.Join(dir, entries[0].Name()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	zr, err := gzip.NewReader(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var read []archivedRequest
+	dec := json.NewDecoder(zr)
+	for dec.More() {
+		var req archivedRequest
+		if err := dec.Decode(&req); err != nil {
+			t.Fatal(err)
+		}
+		read = append(read, req)
+	}
+	if len(read) != 2 || read[1].Token != "tok_b" || *read[0].ResponseStatus != 200 || read[1].ResponseStatus != nil {
+		t.Errorf("archive file holds %+v", read)
+	}
+}
+
+func TestAccountMailSettings(t *testing.T) {
+	// Without a mail server the emails are off
+	m, err := loadAccountMail()
+	if err != nil || m.sender != nil {
+		t.Fatalf("loadAccountMail() with no settings = %+v, %v", m, err)
+	}
+	if m.link("/verify-email", "abc") != "abc" {
+		t.Errorf("link without ACCOUNT_URL = %q, want the bare token", m.link("/verify-email", "abc"))
+	}
+
+	for _, tc := range []struct {
+		addr, from, url string
+		ok              bool
+	}{
+		{"mail.example.com:587", "TokenShield <noreply@example.com>", "https://vault.example.com/account/", true},
+		{"mail.example.com", "noreply@example.com", "", false},
+		{"mail.example.com:25", "not an address", "", false},
+		{"mail.example.com:25", "noreply@example.com", "vault.example.com", false},
+	} {
+		t.Setenv("MAIL_SMTP_ADDR", tc.addr)
+		t.Setenv("MAIL_FROM", tc.from)
+		t.Setenv("ACCOUNT_URL", tc.url)
+		m, err := loadAccountMail()
+		if (err == nil) != tc.ok {
+			t.Errorf("MAIL_SMTP_ADDR=%s MAIL_FROM=%q ACCOUNT_URL=%q: error %v", tc.addr, tc.from, tc.url, err)
+		}
+		if err == nil {
+			if link := m.link("/reset-password", "a+b"); link != "https://vault.example.com/account/reset-password?token=a%2Bb" {
+				t.Errorf("link = %q", link)
+			}
+		}
+	}
+
+	sender := &mailer.SMTP{Addr: "mail.example.com:25", From: "TokenShield <noreply@example.com>"}
+	data, err := sender.Format(mailer.Message{To: "alice@example.com", Subject: "Réinitialiser", Body: "line one\nline two"}, time.Unix(1700000000, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := string(data)
+	for _, want := range []string{
+		"From: \"TokenShield\" <noreply@example.com>\r\n",
+		"To: <alice@example.com>\r\n",
+		"Subject: =?utf-8?q?R=C3=A9initialiser?=\r\n",
+		"\r\n\r\nline one\r\nline two\r\n",
+	} {
+		if !strings.Contains(msg, want) {
+			t.Errorf("formatted message lacks %q:\n%s", want, msg)
+		}
+	}
+	if _, err := sender.Format(mailer.Message{To: "alice@example.com", Subject: "Hi\r\nBcc: eve@example.com"}, time.Now()); err == nil {
+		t.Error("Format() accepted a subject with a line break")
+	}
+
+	if h := hashAccountToken("token"); len(h) != 64 || h == hashAccountToken("token2") {
+		t.Errorf("hashAccountToken() = %q", h)
+	}
+}
+
+func TestRolePermissions(t *testing.T) {
+	ut := &UnifiedTokenizer{}
+	auditor := &User{Role: "auditor"}
+	// Before roles load, users only have their own permissions
+	if ut.hasPermission(auditor, PermActivityRead) {
+		t.Error("role granted a permission before roles were loaded")
+	}
+
+	roles := map[string][]string{
+		RoleAdmin: {PermSystemAdmin},
+		"auditor": {PermActivityRead, PermStatsRead, PermUsersRead},
+	}
+	ut.rolePermissions.Store(&roles)
+	for _, tc := range []struct {
+		user       *User
+		permission string
+		want       bool
+	}{
+		{auditor, PermActivityRead, true},
+		{auditor, PermUsersRead, true},
+		{auditor, PermTokensRead, false},
+		{&User{Role: "auditor", Permissions: []string{PermTokensRead}}, PermTokensRead, true},
+		{&User{Role: RoleAdmin}, PermTokensDetokenize, true},
+		{&User{Role: "removed"}, PermActivityRead, false},
+		{&User{Role: RoleViewer, Permissions: []string{PermSystemAdmin}}, PermUsersDelete, true},
+	} {
+		if got := ut.hasPermission(tc.user, tc.permission); got != tc.want {
+			t.Errorf("hasPermission(%s %v, %s) = %v, want %v", tc.user.Role, tc.user.Permissions, tc.permission, got, tc.want)
+		}
+	}
+	if got := ut.effectivePermissions(&User{Role: "auditor", Permissions: []string{PermStatsRead, PermTokensRead}}); len(got) != 4 {
+		t.Errorf("effectivePermissions() = %v, want the role's three and tokens.read", got)
+	}
+
+	if err := validPermissions([]string{PermTokensRead, PermSystemAdmin}); err != nil {
+		t.Errorf("validPermissions() = %v", err)
+	}
+	if err := validPermissions([]string{"users.manage"}); err == nil {
+		t.Error("validPermissions() accepted an unknown permission")
+	}
+	for name, ok := range map[string]bool{"auditor": true, "pci-reviewer_2": true, "a": false, "Auditor": false, "2fa": false} {
+		if roleNamePattern.MatchString(name) != ok {
+			t.Errorf("role name %q accepted = %v, want %v", name, !ok, ok)
+		}
+	}
+}
+
+func TestOwnerScope(t *testing.T) {
+	ut := &UnifiedTokenizer{}
+	roles := map[string][]string{"merchant": {PermAPIKeysOwn, PermTokensOwn}, RoleViewer: {PermTokensRead}}
+	ut.rolePermissions.Store(&roles)
+
+	listTokens := []string{PermTokensRead, PermTokensOwn}
+	if got := ut.grantedPermission(&User{Role: RoleViewer}, listTokens, nil); got != PermTokensRead {
+		t.Errorf("viewer granted %q, want tokens.read", got)
+	}
+	if got := ut.grantedPermission(&User{Role: "merchant"}, listTokens, nil); got != PermTokensOwn {
+		t.Errorf("merchant granted %q, want tokens.own", got)
+	}
+	notOwn := func(p string) bool { return p != PermTokensOwn }
+	if got := ut.grantedPermission(&User{Role: "merchant"}, listTokens, notOwn); got != "" {
+		t.Errorf("merchant limited by a client certificate granted %q", got)
+	}
+
+	for granted, want := range map[string]string{PermTokensRead: "", PermTokensOwn: "usr_1", "": "usr_1"} {
+		r := httptest.NewRequest("GET", "/api/v1/tokens", nil)
+		r.Header.Set("X-User-ID", "usr_1")
+		if granted != "" {
+			r.Header.Set("X-Granted-Permission", granted)
+		}
+		if got := ownerScope(r, PermTokensRead); got != want {
+			t.Errorf("ownerScope() with %q granted = %q, want %q", granted, got, want)
+		}
+	}
+}
+
+func TestStatsCountersWithoutDatabase(t *testing.T) {
+	// Tokenizers built without counters ignore count changes
+	var none *counters.Counters
+	none.AddActive(1)
+	none.Request("tokenize", http.StatusOK, time.Now())
+	if err := none.Flush(nil); err != nil {
+		t.Errorf("Flush() on nil counters = %v", err)
+	}
+
+	// Nothing to write does not touch the database
+	if err := counters.New("eu1").Flush(nil); err != nil {
+		t.Errorf("Flush() without changes = %v", err)
+	}
+	c := counters.New("eu1")
+	c.AddActive(1)
+	c.AddActive(-1)
+	if err := c.Flush(nil); err != nil {
+		t.Errorf("Flush() of changes adding up to nothing = %v", err)
+	}
+}
+
+func TestRegionTokens(t *testing.T) {
+	ut := &UnifiedTokenizer{tokenFormat: "prefix", region: "eu1"}
+	token, err := ut.generateToken()
+	if err != nil || !strings.HasPrefix(token, "tok_eu1_") || region.OfPrefixToken(token) != "eu1" || len(token) > 64 {
+		t.Fatalf("generateToken() = %s, %v, want a tok_eu1_ token", token, err)
+	}
+	schemas, err := loadRequestSchemas("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if found := scanner.New([]scanner.TokenPattern{scanner.PrefixTokens()}, true).Find(`{"card":"`+token+`"}`, scanner.Token); len(schemas["token_id"].Validate(token)) != 0 || len(found) != 1 || found[0] != token {
+		t.Errorf("region token %s should be recognized", token)
+	}
+	legacy := "tok_" + strings.Repeat("eu1_", 11)
+	if got := region.OfPrefixToken(legacy); got != "" {
+		t.Errorf("OfPrefixToken(%s) = %q, want no region", legacy, got)
+	}
+	if ut.tokenRegion(token) != "" || ut.tokenRegion(region.PrefixToken("us1", legacy[4:])) != "us1" {
+		t.Error("only tokens of other regions should be attributed to them")
+	}
+
+	for _, value := range []string{"9998", "eu1=8998", "EU=9998", "eu1=9999", "eu1=99", "eu1=9998,us1=99981"} {
+		if _, err := parsePeerTokenBINs(value, []string{"9999"}); err == nil {
+			t.Errorf("parsePeerTokenBINs(%q) should fail", value)
+		}
+	}
+	peerBINs, err := parsePeerTokenBINs("eu1=9998, us1=9997", []string{"9999"})
+	if err != nil || len(peerBINs) != 2 {
+		t.Fatalf("parsePeerTokenBINs() = %v, %v", peerBINs, err)
+	}
+	luhn := &UnifiedTokenizer{tokenFormat: "luhn", luhnBINs: []string{"9999"}, peerBINs: peerBINs}
+	if luhn.tokenRegion("9997123456789012") != "us1" || luhn.tokenRegion("9999123456789012") != "" {
+		t.Error("Luhn tokens should be attributed to the region owning their BIN")
+	}
+
+	for _, spec := range []string{"eu1", "eu1=ftp://peer", "eu1=https://a,eu1=https://b", "Europe=https://peer"} {
+		if _, err := region.ParsePeers(spec); err == nil {
+			t.Errorf("ParsePeers(%q) should fail", spec)
+		}
+	}
+
+	// Tokens missing here are looked up on the region that issued them
+	var reason string
+	peer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-API-Key") != "peer-key" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		var body map[string]string
+		json.NewDecoder(r.Body).Decode(&body)
+		reason = body["reason"]
+		if r.URL.Path != "/api/v1/tokens/"+token+"/reveal" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]string{"token": token, "card_number": "4532015112830366"})
+	}))
+	defer peer.Close()
+	peers, err := region.ParsePeers("eu1=" + peer.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := region.NewClient("eu1", peers, "peer-key", peer.Client()); err == nil {
+		t.Error("a region should not be its own peer")
+	}
+	if _, err := region.NewClient("us1", peers, "", peer.Client()); err == nil {
+		t.Error("peers should need an API key")
+	}
+	local := &UnifiedTokenizer{tokenFormat: "prefix", region: "us1"}
+	local.peers, _ = region.NewClient("us1", peers, "peer-key", peer.Client())
+	if card := local.retrieveFromPeer(token); card != "4532015112830366" || reason != "replication fallback from region us1" {
+		t.Errorf("retrieveFromPeer() = %q with reason %q", card, reason)
+	}
+	if card := local.retrieveFromPeer(region.PrefixToken("eu1", legacy[4:])); card != "" {
+		t.Errorf("a token the peer does not have either should stay missing, got %q", card)
+	}
+	if card := local.retrieveFromPeer(region.PrefixToken("ap1", legacy[4:])); card != "" {
+		t.Error("tokens of regions that are not peers should not be looked up")
+	}
+	if stats := local.peers.Stats(); len(stats) != 1 || stats[0].Found != 1 || stats[0].Missing != 1 || stats[0].Errors != 0 {
+		t.Errorf("peer stats = %+v", stats)
+	}
+}
+
+func TestCardFieldMappings(t *testing.T) {
+	for _, value := range []string{"[]", `{"checkout": {}}`, `{"/api": {"expiry_day": "d"}}`} {
+		if _, err := parseCardFieldMappings(value); err == nil {
+			t.Errorf("parseCardFieldMappings(%q) should fail", value)
+		}
+	}
+	mappings, err := parseCardFieldMappings(`{"/api": {"card_holder": "Name"}, "/api/subscribe": {"expiry": "valid_thru"}}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rules, err := FieldRules{CardFieldMappings: mappings}.compile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ut := &UnifiedTokenizer{}
+	ut.fieldRules.Store(rules)
+	if f := ut.cardFieldsFor("/checkout"); f != &defaultCardFields {
+		t.Errorf("unmapped path should use the default fields, got %v", f)
+	}
+	if f := ut.cardFieldsFor("/api/subscribe/monthly"); fmt.Sprint(f.Expiry) != "[valid_thru]" ||
+		fmt.Sprint(f.CardHolder) != fmt.Sprint(defaultCardFields.CardHolder) {
+		t.Errorf("longest prefix should win and keep defaults for unmapped values, got %+v", f)
+	}
+	if f := ut.cardFieldsFor("/api/orders"); fmt.Sprint(f.CardHolder) != "[name]" {
+		t.Errorf("/api mapping should apply, got %+v", f)
+	}
+
+	for _, tc := range []struct {
+		obj  string
+		want cardDetails
+	}{
+		{`{"card_number": "x", "expiry_month": 3, "expiry_year": 2031, "cardholder": " Jane Doe "}`, cardDetails{3, 2031, "Jane Doe", nil}},
+		{`{"ExpMonth": "07", "ExpYear": "29"}`, cardDetails{7, 2029, "", nil}},
+		{`{"expiry": "11/27"}`, cardDetails{11, 2027, "", nil}},
+		{`{"exp_date": "0130"}`, cardDetails{1, 2030, "", nil}},
+		{`{"expiration": "4-2032", "expiry_month": 5, "expiry_year": 2033}`, cardDetails{5, 2033, "", nil}},
+		{`{"expiry_month": 13, "expiry_year": 2030}`, cardDetails{}},
+		{`{"expiry_month": 6}`, cardDetails{}},
+		{`{"expiry": "2030-06"}`, cardDetails{}},
+		{`{"expiry_year": 1999, "expiry_month": 1}`, cardDetails{}},
+	} {
+		var obj map[string]interface{}
+		if err := json.Unmarshal([]byte(tc.obj), &obj); err != nil {
+			t.Fatal(err)
+		}
+		if got := defaultCardFields.details(obj); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("details(%s) = %+v, want %+v", tc.obj, got, tc.want)
+		}
+	}
+}
+
+func TestFieldRuleTest(t *testing.T) {
+	ut := &UnifiedTokenizer{
+		scanner:     scanner.New([]scanner.TokenPattern{scanner.LuhnTokens("9999")}, true),
+		tokenFormat: "luhn",
+		tokenRegex:  regexp.MustCompile(`\b9999[0-9]{12}\b`),
+	}
+	rules, err := FieldRules{
+		CardFieldMappings: map[string]CardFieldMapping{"/api/subscribe": {Expiry: "valid_thru", Tags: map[string]string{"channel": "subscription"}}},
+		DeepScanFields:    "payload:json",
+	}.compile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := (FieldRules{DeepScanFields: "payload:xml"}).compile(); err == nil {
+		t.Error("compile should reject an invalid deep scan rule")
+	}
+	if _, err := (FieldRules{CardFieldMappings: map[string]CardFieldMapping{"api": {}}}).compile(); err == nil {
+		t.Error("compile should reject a path without a leading /")
+	}
+
+	fields, prefix := rules.fieldsFor("/api/subscribe/monthly")
+	if prefix != "/api/subscribe" {
+		t.Fatalf("fieldsFor prefix = %q", prefix)
+	}
+	var payload interface{}
+	if err := json.Unmarshal([]byte(`{
+		"card_number": "4111111111111111", "valid_thru": "11/27", "name": "Jane Doe",
+		"items": [{"pan": 4111111111111111}, {"pan": "n/a"}],
+		"payload": "{\"credit_card\": \"5555555555554444\"}",
+		"other": "{\"credit_card\": \"5555555555554444\"}",
+		"odd key": {"card_number": "378282246310005"}
+	}`), &payload); err != nil {
+		t.Fatal(err)
+	}
+	result := &FieldRuleTestResult{}
+	ut.testFieldRules(result, payload, "$", rules, fields, 0)
+
+	wantFields := []FieldRuleMatch{
+		{Path: "$.card_number", CardType: utils.DetectCardType("4111111111111111"), LastFour: "1111", ExpiryMonth: 11, ExpiryYear: 2027, Tags: map[string]string{"channel": "subscription"}},
+		{Path: `$["odd key"].card_number`, CardType: utils.DetectCardType("378282246310005"), LastFour: "0005", Tags: map[string]string{"channel": "subscription"}},
+		{Path: "$.payload(json).credit_card", CardType: utils.DetectCardType("5555555555554444"), LastFour: "4444", Tags: map[string]string{"channel": "subscription"}},
+	}
+	if !reflect.DeepEqual(result.Fields, wantFields) {
+		t.Errorf("fields = %+v, want %+v", result.Fields, wantFields)
+	}
+	wantSkipped := []FieldRuleSkip{
+		{"$.items[0].pan", "not a string"},
+		{"$.items[1].pan", "not a card number"},
+	}
+	if !reflect.DeepEqual(result.Skipped, wantSkipped) {
+		t.Errorf("skipped = %+v, want %+v", result.Skipped, wantSkipped)
+	}
+}
+
+// fakeEngine is a tokenization engine speaking just enough gRPC for the
+// tests. It issues fpe_ tokens and detokenizes the ones it issued.
+type fakeEngine struct {
+	*httptest.Server
+	caFile string
+	mu     sync.Mutex
+	cards  map[string]string
+}
+
+func newFakeEngine(t *testing.T) *fakeEngine {
+	f := &fakeEngine{cards: make(map[string]string)}
+	f.Server = httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		w.Header().Set("Content-Type", "application/grpc")
+		// Both requests start with string field 1: tag 0x0a, length, value
+		if r.ProtoMajor != 2 || len(body) < 7 || body[5] != 0x0a || len(body) < 7+int(body[6]) {
+			w.Header().Set("Grpc-Status", "3")
+			return
+		}
+		value := string(body[7 : 7+int(body[6])])
+		var reply string
+		f.mu.Lock()
+		switch r.URL.Path {
+		case "/tokenshield.engine.v1.TokenizationEngine/Tokenize":
+			reply = fmt.Sprintf("fpe_%04d%s", len(f.cards), value[len(value)-4:])
+			f.cards[reply] = value
+		case "/tokenshield.engine.v1.TokenizationEngine/Detokenize":
+			reply = f.cards[value]
+		}
+		f.mu.Unlock()
+		if reply == "" {
+			w.Header().Set("Grpc-Status", "5")
+			w.Header().Set("Grpc-Message", "unknown token")
+			return
+		}
+		message := append([]byte{0x0a, byte(len(reply))}, reply...)
+		w.Write(append([]byte{0, 0, 0, 0, byte(len(message))}, message...))
+		w.Header().Set(http.TrailerPrefix+"Grpc-Status", "0")
+	}))
+	f.EnableHTTP2 = true
+	f.StartTLS()
+	t.Cleanup(f.Close)
+	f.caFile = filepath.Join(t.TempDir(), "engine-ca.pem")
+	if err := os.WriteFile(f.caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: f.Certificate().Raw}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return f
+}
+
+func TestTokenizationEngine(t *testing.T) {
+	for _, spec := range []string{
+		`{"FPE": {"url": "https://fpe.internal"}}`,
+		`{"fpe": {"url": "http://fpe.internal"}}`,
+		`{"fpe": {"url": "https://fpe.internal", "token_pattern": "("}}`,
+		`{"fpe": {"url": "https://fpe.internal", "cert_file": "client.pem"}}`,
+		`{"fpe": {"url": "https://fpe.internal", "timeout": "1h"}}`,
+		`{"fpe": {"address": "https://fpe.internal"}}`,
+	} {
+		configs, err := engine.Parse(spec)
+		if err == nil {
+			_, err = engine.New(configs)
+		}
+		if err == nil {
+			t.Errorf("TOKENIZATION_ENGINES=%s should be refused", spec)
+		}
+	}
+
+	fake := newFakeEngine(t)
+	engines, err := engine.New(map[string]engine.Config{
+		"fpe":       {URL: fake.URL, TokenPattern: "fpe_[0-9]{8}", CAFile: fake.caFile},
+		"strict":    {URL: fake.URL, TokenPattern: "[0-9]{16}", CAFile: fake.caFile},
+		"untrusted": {URL: fake.URL},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	token, err := engines.Tokenize(ctx, "fpe", engine.Card{Number: testCards[0], ExpiryMonth: 11, ExpiryYear: 2030})
+	if err != nil || token != "fpe_00000366" {
+		t.Fatalf("Tokenize() = %q, %v", token, err)
+	}
+	if engines.Owner(token) != "fpe" || engines.Owner("tok_abc") != "" || engines.Owner("x"+token) != "" {
+		t.Error("Owner should match whole tokens against the token patterns")
+	}
+	if card, err := engines.Detokenize(ctx, "fpe", token); err != nil || card != testCards[0] {
+		t.Errorf("Detokenize() = %q, %v", card, err)
+	}
+	if _, err := engines.Detokenize(ctx, "fpe", "fpe_99999999"); err != engine.ErrNotFound {
+		t.Errorf("Detokenize() of an unknown token: %v, want ErrNotFound", err)
+	}
+	if _, err := engines.Tokenize(ctx, "strict", engine.Card{Number: testCards[1]}); err == nil {
+		t.Error("a token not matching token_pattern should be refused")
+	}
+	if _, err := engines.Tokenize(ctx, "untrusted", engine.Card{Number: testCards[1]}); err == nil {
+		t.Error("an engine whose certificate does not verify should not be sent cards")
+	}
+	if _, err := engines.Tokenize(ctx, "missing", engine.Card{Number: testCards[1]}); err == nil {
+		t.Error("an unknown engine should fail")
+	}
+	want := []engine.Stats{
+		{Engine: "fpe", Tokenized: 1, Detokenized: 1, NotFound: 1},
+		{Engine: "strict", Errors: 1},
+		{Engine: "untrusted", Errors: 1},
+	}
+	if got := engines.Stats(); !reflect.DeepEqual(got, want) {
+		t.Errorf("Stats() = %+v, want %+v", got, want)
+	}
+
+	// Field rules name engines by path prefix
+	if _, err := (FieldRules{CardFieldMappings: map[string]CardFieldMapping{"/api": {Engine: "Not valid"}}}).compile(); err == nil {
+		t.Error("compile should reject an invalid engine name")
+	}
+	rules := FieldRules{CardFieldMappings: map[string]CardFieldMapping{"/api/wallet": {Engine: "fpe"}}}
+	if err := rules.checkEngines(engines); err != nil {
+		t.Error(err)
+	}
+	if err := rules.checkEngines(nil); err == nil {
+		t.Error("checkEngines should reject an engine that is not configured")
+	}
+	compiled, err := rules.compile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ut := &UnifiedTokenizer{
+		scanner:     scanner.New([]scanner.TokenPattern{scanner.LuhnTokens("9999")}, true),
+		tokenFormat: "luhn",
+		tokenRegex:  regexp.MustCompile(`\b9999[0-9]{12}\b`),
+		engines:     engines,
+	}
+	var payload interface{}
+	json.Unmarshal([]byte(`{"card_number": "`+testCards[2]+`", "saved": {"card_number": "`+token+`"}}`), &payload)
+	fields, _ := compiled.fieldsFor("/api/wallet/cards")
+	result := &FieldRuleTestResult{}
+	ut.testFieldRules(result, payload, "$", compiled, fields, 0)
+	if len(result.Fields) != 1 || result.Fields[0].Engine != "fpe" {
+		t.Errorf("fields = %+v, want the card sent to engine fpe", result.Fields)
+	}
+	if want := []FieldRuleSkip{{"$.saved.card_number", "not a card number"}}; !reflect.DeepEqual(result.Skipped, want) {
+		t.Errorf("skipped = %+v, want %+v", result.Skipped, want)
+	}
+}
+
+// fakeTokenService is a token service gateway for one scheme. Cards ending
+// in 0000 are refused as not eligible, and a network token is replaced
+// after its second cryptogram, as when the card is reissued.
+type fakeTokenService struct {
+	*httptest.Server
+	caFile  string
+	mu      sync.Mutex
+	tokens  map[string]string // Reference ID to network token
+	issued  map[string]int    // Cryptograms per reference ID
+	lastKey string            // Authorization of the last request
+}
+
+func newFakeTokenService(t *testing.T) *fakeTokenService {
+	f := &fakeTokenService{tokens: make(map[string]string), issued: make(map[string]int)}
+	f.Server = httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body map[string]interface{}
+		json.NewDecoder(r.Body).Decode(&body)
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		f.lastKey = r.Header.Get("Authorization")
+		w.Header().Set("Content-Type", "application/json")
+		ref := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/tokens/"), "/cryptograms")
+		switch {
+		case r.Method == "POST" && r.URL.Path == "/tokens":
+			card, _ := body["card_number"].(string)
+			if strings.HasSuffix(card, "0000") {
+				w.WriteHeader(http.StatusUnprocessableEntity)
+				w.Write([]byte(`{"error": {"code": "card_not_eligible", "message": "Card is not eligible"}}`))
+				return
+			}
+			ref = fmt.Sprintf("ref_%d", len(f.tokens))
+			f.tokens[ref] = "4895370012345" + card[len(card)-3:]
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"token_reference_id": ref, "network_token": f.tokens[ref], "expiry_month": 12, "expiry_year": 2031, "status": "ACTIVE",
+			})
+		case r.Method == "POST" && strings.HasSuffix(r.URL.Path, "/cryptograms") && f.tokens[ref] != "":
+			f.issued[ref]++
+			reply := map[string]interface{}{"cryptogram": fmt.Sprintf("AgAAAAAA%d", f.issued[ref]), "eci": "05"}
+			if f.issued[ref] == 2 {
+				f.tokens[ref] = "4895370099999999"
+				reply["network_token"], reply["expiry_month"], reply["expiry_year"] = f.tokens[ref], 6, 2033
+			}
+			json.NewEncoder(w).Encode(reply)
+		case r.Method == "DELETE" && f.tokens[ref] != "":
+			delete(f.tokens, ref)
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	t.Cleanup(f.Close)
+	f.caFile = filepath.Join(t.TempDir(), "gateway-ca.pem")
+	if err := os.WriteFile(f.caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: f.Certificate().Raw}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return f
+}
+
+func TestNetworkTokenConnectors(t *testing.T) {
+	for _, spec := range []string{
+		`{"jcb": {"url": "https://vts.internal", "token_requestor_id": "40010030273"}}`,
+		`{"visa": {"url": "http://vts.internal", "token_requestor_id": "40010030273"}}`,
+		`{"visa": {"url": "https://vts.internal"}}`,
+		`{"visa": {"url": "https://vts.internal", "token_requestor_id": "40010030273", "key_file": "client.key"}}`,
+		`{"visa": {"url": "https://vts.internal", "token_requestor_id": "40010030273", "timeout": "1ms"}}`,
+		`{"visa": {"endpoint": "https://vts.internal"}}`,
+	} {
+		configs, err := nettoken.Parse(spec)
+		if err == nil {
+			_, err = nettoken.New(configs)
+		}
+		if err == nil {
+			t.Errorf("NETWORK_TOKEN_CONNECTORS=%s should be refused", spec)
+		}
+	}
+	for cardType, want := range map[string]string{"Visa": "visa", "Mastercard": "mastercard", "Amex": "amex", "Unknown": ""} {
+		if got := nettoken.SchemeOf(cardType); got != want {
+			t.Errorf("SchemeOf(%q) = %q, want %q", cardType, got, want)
+		}
+	}
+
+	fake := newFakeTokenService(t)
+	connectors, err := nettoken.New(map[string]nettoken.Config{
+		"visa":       {URL: fake.URL, TokenRequestorID: "40010030273", APIKey: "secret", CAFile: fake.caFile},
+		"mastercard": {URL: fake.URL, TokenRequestorID: "50110030273"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := connectors.Schemes(); !reflect.DeepEqual(got, []string{"mastercard", "visa"}) {
+		t.Errorf("Schemes() = %v", got)
+	}
+	ctx := context.Background()
+	token, err := connectors.Provision(ctx, "visa", nettoken.Card{Number: testCards[0], ExpiryMonth: 11, ExpiryYear: 2030})
+	want := nettoken.Token{ReferenceID: "ref_0", Number: "4895370012345366", ExpiryMonth: 12, ExpiryYear: 2031, Status: nettoken.StatusActive}
+	if err != nil || token != want {
+		t.Fatalf("Provision() = %+v, %v, want %+v", token, err, want)
+	}
+	if fake.lastKey != "Bearer secret" {
+		t.Errorf("Authorization = %q, want the api_key", fake.lastKey)
+	}
+	var refusal *nettoken.Error
+	if _, err := connectors.Provision(ctx, "visa", nettoken.Card{Number: "4111111111110000"}); !errors.As(err, &refusal) || refusal.Code != "card_not_eligible" {
+		t.Errorf("Provision() of an ineligible card: %v, want the scheme's refusal", err)
+	}
+	if _, err := connectors.Provision(ctx, "mastercard", nettoken.Card{Number: testCards[1]}); err == nil {
+		t.Error("a gateway whose certificate does not verify should not be sent cards")
+	}
+
+	tx := nettoken.Transaction{Type: "ecommerce", Amount: "10.00", Currency: "EUR"}
+	cryptogram, err := connectors.Cryptogram(ctx, "visa", token.ReferenceID, tx)
+	if err != nil || cryptogram.Cryptogram != "AgAAAAAA1" || cryptogram.ECI != "05" || cryptogram.Token != nil {
+		t.Errorf("Cryptogram() = %+v, %v", cryptogram, err)
+	}
+	cryptogram, err = connectors.Cryptogram(ctx, "visa", token.ReferenceID, tx)
+	replaced := &nettoken.Token{ReferenceID: "ref_0", Number: "4895370099999999", ExpiryMonth: 6, ExpiryYear: 2033, Status: nettoken.StatusActive}
+	if err != nil || !reflect.DeepEqual(cryptogram.Token, replaced) {
+		t.Errorf("Cryptogram() = %+v, %v, want the replaced network token %+v", cryptogram, err, replaced)
+	}
+	if err := connectors.Delete(ctx, "visa", token.ReferenceID); err != nil {
+		t.Error(err)
+	}
+	if err := connectors.Delete(ctx, "visa", token.ReferenceID); err != nil {
+		t.Errorf("Delete() of a deleted network token: %v, want success", err)
+	}
+	if _, err := connectors.Cryptogram(ctx, "visa", token.ReferenceID, tx); err != nettoken.ErrNotFound {
+		t.Errorf("Cryptogram() of a deleted network token: %v, want ErrNotFound", err)
+	}
+	if _, err := connectors.Provision(ctx, "amex", nettoken.Card{Number: testCards[1]}); err == nil {
+		t.Error("a scheme without a connector should fail")
+	}
+	wantStats := []nettoken.Stats{
+		{Scheme: "mastercard", Errors: 1},
+		{Scheme: "visa", Provisioned: 1, Cryptograms: 2, Deleted: 2, Errors: 2},
+	}
+	if got := connectors.Stats(); !reflect.DeepEqual(got, wantStats) {
+		t.Errorf("Stats() = %+v, want %+v", got, wantStats)
+	}
+
+	// Cryptogram requests are checked before anything is looked up
+	ut := &UnifiedTokenizer{networkTokens: connectors}
+	for _, body := range []string{
+		`{"transaction_type": "in_store"}`,
+		`{"transaction_type": "ecommerce", "amount": "ten"}`,
+		`{"transaction_type": "ecommerce", "currency": "eur"}`,
+		`not json`,
+	} {
+		req := httptest.NewRequest("POST", "/api/v1/tokens/tok_abc/network-token/cryptogram", strings.NewReader(body))
+		rec := httptest.NewRecorder()
+		ut.handleAPINetworkTokenCryptogram(rec, req)
+		if rec.Code != http.StatusBadRequest {
+			t.Errorf("cryptogram request %s: status %d, want 400", body, rec.Code)
+		}
+	}
+}
+
+func TestIntegrityChecks(t *testing.T) {
+	ut := &UnifiedTokenizer{encryptionKey: &fernet.Key{}}
+	copy(ut.encryptionKey[:], "0123456789abcdef0123456789abcdef")
+	encrypt := func(s string) []byte {
+		b, err := ut.encryptCardNumber(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return b
+	}
+	other := &fernet.Key{}
+	copy(other[:], "fedcba9876543210fedcba9876543210")
+	foreign, _ := fernet.EncryptAndSign([]byte(testCards[0]), other)
+
+	report := &IntegrityReport{}
+	cards := []integrityCard{
+		{token: "tok_ok", encrypted: encrypt(testCards[0]), holder: encrypt("Jane Doe"), firstSix: "453201", lastFour: "0366"},
+		{token: "tok_wrong_key", encrypted: foreign, firstSix: "453201", lastFour: "0366"},
+		{token: "tok_dek", encrypted: encrypt(testCards[0]), keyID: sql.NullString{String: "dek_1", Valid: true}, firstSix: "453201", lastFour: "0366"},
+		{token: "tok_holder", encrypted: encrypt(testCards[1]), holder: foreign, firstSix: "542523", lastFour: "9903"},
+		{token: "tok_digits", encrypted: encrypt(testCards[1]), firstSix: "542523", lastFour: "0000"},
+		{token: "tok_luhn", encrypted: encrypt("4532015112830367"), firstSix: "453201", lastFour: "0367"},
+	}
+	for _, c := range cards {
+		ut.verifyCard(report, c)
+	}
+	// A card with a key ID decrypts under that key only, and KEK/DEK is off here
+	want := []string{
+		"tok_wrong_key decrypt", "tok_dek decrypt", "tok_holder decrypt", "tok_digits digits", "tok_luhn luhn",
+	}
+	var got []string
+	for _, issue := range report.Issues {
+		got = append(got, issue.Token+" "+issue.Check)
+		if strings.Contains(issue.Detail, "4532") || strings.Contains(issue.Detail, "5425") {
+			t.Errorf("issue detail should not include card data: %q", issue.Detail)
+		}
+	}
+	if strings.Join(got, ", ") != strings.Join(want, ", ") {
+		t.Errorf("issues = %v, want %v", got, want)
+	}
+	if report.DecryptFailures != 3 || report.DigitMismatches != 1 || report.LuhnFailures != 1 || report.IssueCount() != 5 {
+		t.Errorf("counts = %+v", report)
+	}
+
+	// Findings beyond the cap are counted but not listed
+	report = &IntegrityReport{}
+	for i := 0; i < maxIntegrityIssues+5; i++ {
+		report.addIssue("tok_x", integrityLuhn, "")
+	}
+	var out strings.Builder
+	report.WriteText(&out)
+	if len(report.Issues) != maxIntegrityIssues || report.LuhnFailures != maxIntegrityIssues+5 ||
+		!strings.Contains(out.String(), "5 more issues not listed") {
+		t.Errorf("capped report: %d issues listed, %d counted", len(report.Issues), report.LuhnFailures)
+	}
+
+	for value, ok := range map[string]bool{"": true, "0": true, "6h": true, "30s": false, "daily": false} {
+		t.Setenv("INTEGRITY_CHECK_INTERVAL", value)
+		if _, err := integrityCheckInterval(); (err == nil) != ok {
+			t.Errorf("INTEGRITY_CHECK_INTERVAL=%q: error %v", value, err)
+		}
+	}
+}
+
+func TestStatementCache(t *testing.T) {
+	// Nothing listens on port 1, so preparing fails without a database
+	db, err := sql.Open("mysql", "user:pass@tcp(127.0.0.1:1)/tokenshield?timeout=1s")
+	if err != nil {
+		t.Fatalf("sql.Open() error: %v", err)
+	}
+	defer db.Close()
+
+	cache := stmtcache.New(db, map[string]string{"lookup": "SELECT 1"})
+	if _, err := cache.Get("missing"); err == nil {
+		t.Error("unregistered statement should be rejected")
+	}
+	if _, err := cache.Get("lookup"); err == nil {
+		t.Error("prepare without a database should fail")
+	}
+
+	stats := cache.Stats()
+	if len(stats) != 1 || stats[0].Name != "lookup" || stats[0].Prepared || stats[0].PrepareErrors != 1 || stats[0].Executions != 0 {
+		t.Errorf("Stats() = %+v", stats)
+	}
+}
+
+func TestConnectionSettings(t *testing.T) {
+	settings, err := loadConnectionSettings()
+	if err != nil {
+		t.Fatalf("loadConnectionSettings() error: %v", err)
+	}
+	if settings.dbMaxOpenConns != 25 || settings.dbMaxIdleConns != 5 || settings.upstreamTimeout != 30*time.Second {
+		t.Errorf("unexpected defaults: %+v", settings)
+	}
+
+	t.Setenv("DB_MAX_OPEN_CONNS", "50")
+	t.Setenv("ICAP_READ_TIMEOUT", "2s")
+	if settings, err = loadConnectionSettings(); err != nil || settings.dbMaxOpenConns != 50 || settings.icapReadTimeout != 2*time.Second {
+		t.Errorf("overrides not applied: %+v, %v", settings, err)
+	}
+
+	for key, value := range map[string]string{
+		"UPSTREAM_TIMEOUT":  "soon",
+		"DB_MAX_IDLE_CONNS": "60",
+		"DB_DIAL_TIMEOUT":   "1ms",
+		"UPSTREAM_RETRY_BUDGET_PERCENT": "150",
+	} {
+		t.Run(key, func(t *testing.T) {
+			t.Setenv(key, value)
+			if _, err := loadConnectionSettings(); err == nil || !strings.Contains(err.Error(), key) {
+				t.Errorf("%s=%s should be rejected, got %v", key, value, err)
+			}
+		})
+	}
+}
+
+func TestUpstreamBreaker(t *testing.T) {
+	var hits int64
+	var status int64 = http.StatusServiceUnavailable
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&hits, 1)
+		if r.URL.Path == "/slow" {
+			<-release
+		}
+		body, _ := io.ReadAll(r.Body)
+		w.WriteHeader(int(atomic.LoadInt64(&status)))
+		w.Write(body)
+	}))
+	defer server.Close()
+
+	client := upstream.New("app", server.Client(), upstream.Config{
+		FailureThreshold: 4,
+		OpenTimeout:      100 * time.Millisecond,
+		MaxConcurrent:    1,
+		MaxRetries:       2,
+		RetryBudget:      0.1,
+	})
+	send := func(method, path, body string) (*http.Response, error) {
+		req, _ := http.NewRequest(method, server.URL+path, strings.NewReader(body))
+		resp, err := client.Do(req)
+		if err == nil {
+			io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+		}
+		return resp, err
+	}
+
+	// An idempotent request is retried with its body; a POST is not
+	if resp, err := send("PUT", "/", "x"); err != nil || resp.StatusCode != 503 || atomic.LoadInt64(&hits) != 3 {
+		t.Fatalf("PUT: %v, %v after %d attempts, want 503 after 3", resp, err, hits)
+	}
+	if _, err := send("POST", "/", "x"); err != nil || atomic.LoadInt64(&hits) != 4 {
+		t.Fatalf("POST should not be retried: %d attempts, %v", hits, err)
+	}
+
+	// Four consecutive failures opened the circuit
+	_, err := send("GET", "/", "")
+	var unavailable *upstream.UnavailableError
+	if !errors.As(err, &unavailable) || unavailable.Reason != "circuit_open" || unavailable.RetryAfterSeconds() != 1 {
+		t.Fatalf("open circuit: got %v", err)
+	}
+	if st := client.Stats(); st.State != upstream.Open || st.Opens != 1 || st.RejectedOpen != 1 || st.Retries != 2 {
+		t.Errorf("stats = %+v", st)
+	}
+
+	// After the open timeout one trial request closes it again
+	time.Sleep(120 * time.Millisecond)
+	atomic.StoreInt64(&status, http.StatusOK)
+	if resp, err := send("GET", "/", ""); err != nil || resp.StatusCode != 200 || client.Stats().State != upstream.Closed {
+		t.Fatalf("trial request: %v, %v, state %v", resp, err, client.Stats().State)
+	}
+
+	// At the concurrency limit requests are refused instead of queued
+	done := make(chan struct{})
+	go func() {
+		send("GET", "/slow", "")
+		close(done)
+	}()
+	for client.Stats().InFlight == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	if _, err := send("GET", "/", ""); !errors.As(err, &unavailable) || unavailable.Reason != "saturated" {
+		t.Errorf("saturated: got %v", err)
+	}
+	close(release)
+	<-done
+
+	// Failed connections are retried for any method until the budget is spent
+	closed := httptest.NewServer(http.NotFoundHandler())
+	closed.Close()
+	offline := upstream.New("offline", closed.Client(), upstream.Config{MaxRetries: 10})
+	for i := 0; i < 2; i++ {
+		req, _ := http.NewRequest("POST", closed.URL, strings.NewReader("x"))
+		if _, err := offline.Do(req); err == nil {
+			t.Fatal("request to a closed server should fail")
+		}
+	}
+	if st := offline.Stats(); st.Retries != 10 || st.RetriesDenied != 1 || st.Requests != 12 {
+		t.Errorf("retry budget: %+v, want 10 retries then the budget spent", st)
+	}
+}
+
+func TestUpstreamRetryRoutes(t *testing.T) {
+	for _, value := range []string{"POST", "GET,PATCH"} {
+		if _, err := parseRetryMethods(value); err == nil {
+			t.Errorf("parseRetryMethods(%q) should fail", value)
+		}
+	}
+	if methods, err := parseRetryMethods("get, head"); err != nil || !reflect.DeepEqual(methods, []string{"GET", "HEAD"}) {
+		t.Errorf("parseRetryMethods() = %v, %v", methods, err)
+	}
+	for _, value := range []string{"api=1", "/api", "/api=-1", "/api=11", "/api=2:150%", "/api=x"} {
+		if _, err := parseRetryRoutes(value, 0.1); err == nil {
+			t.Errorf("parseRetryRoutes(%q) should fail", value)
+		}
+	}
+	routes, err := parseRetryRoutes("/payments=0, /catalog=3:50%", 0.1)
+	if err != nil || !reflect.DeepEqual(routes, []upstream.Route{{Prefix: "/payments", MaxRetries: 0, RetryBudget: 0.1}, {Prefix: "/catalog", MaxRetries: 3, RetryBudget: 0.5}}) {
+		t.Fatalf("parseRetryRoutes() = %+v, %v", routes, err)
+	}
+
+	var hits int64
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&hits, 1)
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer server.Close()
+	client := upstream.New("app", server.Client(), upstream.Config{
+		MaxRetries:   1,
+		RetryMethods: []string{"GET", "HEAD"},
+		Routes:       []upstream.Route{{Prefix: "/catalog", MaxRetries: 3}, {Prefix: "/catalog/live", MaxRetries: 0}},
+	})
+	attempts := func(method, path string) int64 {
+		before := atomic.LoadInt64(&hits)
+		req, _ := http.NewRequest(method, server.URL+path, nil)
+		if resp, err := client.Do(req); err == nil {
+			resp.Body.Close()
+		}
+		return atomic.LoadInt64(&hits) - before
+	}
+
+	// The longest prefix sets the retries; PUT is not a retry method here
+	for _, tc := range []struct {
+		method, path string
+		want         int64
+	}{{"GET", "/orders", 2}, {"GET", "/catalog/shoes", 4}, {"GET", "/catalog/live", 1}, {"PUT", "/catalog/shoes", 1}} {
+		if got := attempts(tc.method, tc.path); got != tc.want {
+			t.Errorf("%s %s: %d attempts, want %d", tc.method, tc.path, got, tc.want)
+		}
+	}
+
+	// Each route spends its own budget, which RetryBudget 0 never refills
+	for i := 0; i < 3; i++ {
+		attempts("GET", "/catalog/shoes")
+	}
+	if got := attempts("GET", "/orders"); got != 2 {
+		t.Errorf("default route after /catalog spent its budget: %d attempts, want 2", got)
+	}
+	st := client.Stats()
+	if len(st.Routes) != 2 || st.Routes[0].Prefix != "/catalog" || st.Routes[0].Retries != 10 || st.Routes[0].RetriesDenied != 1 || st.Retries != 12 {
+		t.Errorf("stats = %+v", st)
+	}
+}
+
+func TestProxyPassthrough(t *testing.T) {
+	for _, tc := range []struct{ types, paths string }{{"png", ""}, {"", "static/"}} {
+		if _, err := parsePassthroughRules(tc.types, tc.paths); err == nil {
+			t.Errorf("parsePassthroughRules(%q, %q) should fail", tc.types, tc.paths)
+		}
+	}
+	rules, err := parsePassthroughRules(defaultPassthroughContentTypes, "/static/, /downloads")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		path, contentType string
+		want              bool
+	}{
+		{"/logo", "image/svg+xml", true},
+		{"/app.css", "Text/CSS; charset=utf-8", true},
+		{"/static/app.json", "application/json", true},
+		{"/downloads/report", "", true},
+		{"/api/checkout", "application/json", false},
+		{"/api/checkout", "", false},
+		{"/textbook", "text/cssx", false},
+	} {
+		if got := rules.matches(tc.path, tc.contentType); got != tc.want {
+			t.Errorf("matches(%q, %q) = %v, want %v", tc.path, tc.contentType, got, tc.want)
+		}
+	}
+	if none, _ := parsePassthroughRules("none", ""); none.matches("/logo", "image/png") {
+		t.Error("none should turn content type rules off")
+	}
+
+	var hits int64
+	app := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&hits, 1)
+		body, _ := io.ReadAll(r.Body)
+		w.Header().Set("Content-Type", "image/png")
+		if r.URL.Path == "/fail" {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		w.Write(body)
+	}))
+	defer app.Close()
+	ut := &UnifiedTokenizer{
+		appEndpoint:    app.URL,
+		passthrough:    rules,
+		bodyLimits:     bodyLimits{defaultMax: 1 << 20},
+		spoolThreshold: 1 << 20,
+		upstream:       upstream.New("app", app.Client(), upstream.Config{MaxRetries: 2, RetryBudget: 1}),
+	}
+
+	// An image upload and the response are streamed through unchanged
+	image := "\x89PNG 4532015112830366"
+	req := httptest.NewRequest("PUT", "/avatar", strings.NewReader(image))
+	req.Header.Set("Content-Type", "image/png")
+	rec := httptest.NewRecorder()
+	ut.handleTokenize(rec, req)
+	if rec.Code != 200 || rec.Body.String() != image || rec.Header().Get("Content-Type") != "image/png" {
+		t.Errorf("streamed upload: %d %q %v", rec.Code, rec.Body.String(), rec.Header())
+	}
+	if atomic.LoadInt64(&ut.passthroughRequests) != 1 || atomic.LoadInt64(&ut.passthroughResponses) != 1 {
+		t.Errorf("passthrough counters: %d requests, %d responses", ut.passthroughRequests, ut.passthroughResponses)
+	}
+
+	// A streamed body cannot be replayed, so even a PUT is sent once
+	req = httptest.NewRequest("PUT", "/fail", strings.NewReader(image))
+	req.Header.Set("Content-Type", "image/png")
+	rec = httptest.NewRecorder()
+	ut.handleTokenize(rec, req)
+	if rec.Code != http.StatusServiceUnavailable || atomic.LoadInt64(&hits) != 2 {
+		t.Errorf("streamed PUT: status %d after %d attempts, want 503 after 1", rec.Code, atomic.LoadInt64(&hits)-1)
+	}
+
+	// Images served on a detokenized path are not buffered either
+	req = httptest.NewRequest("GET", "/my-cards", nil)
+	rec = httptest.NewRecorder()
+	ut.handleTokenize(rec, req)
+	if rec.Code != 200 || atomic.LoadInt64(&ut.passthroughResponses) != 3 {
+		t.Errorf("image response: %d, %d streamed", rec.Code, ut.passthroughResponses)
+	}
+}
+
+func TestProxyBodyLimits(t *testing.T) {
+	for _, value := range []string{"api=1MB", "/api", "/api=big", "/api=0"} {
+		if _, err := parseBodyLimits(1<<20, value); err == nil {
+			t.Errorf("parseBodyLimits(%q) should fail", value)
+		}
+	}
+	limits, err := parseBodyLimits(64<<10, "/upload=1MB, /upload/avatar=2kb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if limits.maxFor("/checkout") != 64<<10 || limits.maxFor("/upload/doc") != 1<<20 || limits.maxFor("/upload/avatar") != 2<<10 {
+		t.Errorf("limits = %+v", limits)
+	}
+	for value, want := range map[string]int64{"512": 512, "64KB": 64 << 10, "10 mb": 10 << 20, "1GB": 1 << 30} {
+		if got, err := utils.ParseByteSize(value); err != nil || got != want {
+			t.Errorf("ParseByteSize(%q) = %d, %v, want %d", value, got, err, want)
+		}
+	}
+
+	var attempts int64
+	var received []string
+	app := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		received = append(received, string(body))
+		if atomic.AddInt64(&attempts, 1) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer app.Close()
+	dir := t.TempDir()
+	ut := &UnifiedTokenizer{
+		appEndpoint:    app.URL,
+		bodyLimits:     limits,
+		spoolDir:       dir,
+		spoolThreshold: 4 << 10,
+		cardRegex:      regexp.MustCompile(`\b4[0-9]{15}\b`),
+		upstream:       upstream.New("app", app.Client(), upstream.Config{MaxRetries: 1, RetryBudget: 1}),
+	}
+	send := func(path, contentType string, body io.Reader) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("PUT", path, body)
+		req.Header.Set("Content-Type", contentType)
+		rec := httptest.NewRecorder()
+		ut.proxyHandler().ServeHTTP(rec, req)
+		return rec
+	}
+
+	// A JSON body over the spool threshold is tokenized from disk and
+	// replayed from there when the first attempt fails
+	large := `{"note": "` + strings.Repeat("x", 20<<10) + `", "items": [{"sku": "a1", "quantity": 2}]}`
+	if rec := send("/upload/doc", "application/json", strings.NewReader(large)); rec.Code != 200 {
+		t.Fatalf("spooled JSON: status %d", rec.Code)
+	}
+	if len(received) != 2 || received[0] != received[1] || !json.Valid([]byte(received[1])) || len(received[1]) < 20<<10 {
+		t.Errorf("spooled JSON was not replayed intact: %d attempts", len(received))
+	}
+	if atomic.LoadInt64(&ut.bodiesSpooled) != 1 {
+		t.Errorf("bodiesSpooled = %d, want 1", ut.bodiesSpooled)
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 0 {
+		t.Errorf("spool files left behind: %v", entries)
+	}
+
+	// Over the limit, with or without a declared length
+	if rec := send("/checkout", "text/plain", strings.NewReader(strings.Repeat("x", 65<<10))); rec.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("declared length: status %d, want 413", rec.Code)
+	}
+	if rec := send("/upload/avatar", "text/plain", io.MultiReader(strings.NewReader(strings.Repeat("x", 3<<10)))); rec.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("unknown length: status %d, want 413", rec.Code)
+	}
+	if atomic.LoadInt64(&ut.bodiesRejected) != 2 || atomic.LoadInt64(&attempts) != 2 {
+		t.Errorf("%d rejected, %d forwarded; rejected bodies must not reach the application", ut.bodiesRejected, attempts)
+	}
+}
+
+func TestProxyHandler(t *testing.T) {
+	var forwarded string
+	app := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		forwarded = r.Header.Get(apierror.RequestIDHeader)
+		w.Header().Set(apierror.RequestIDHeader, "app-id")
+		if r.URL.Path == "/missing" {
+			w.WriteHeader(http.StatusNotFound)
+		}
+		w.Write([]byte("ok"))
+	}))
+	defer app.Close()
+	ut := &UnifiedTokenizer{
+		appEndpoint:    app.URL,
+		bodyLimits:     bodyLimits{defaultMax: 1 << 20},
+		spoolThreshold: 1 << 20,
+		upstream:       upstream.New("app", app.Client(), upstream.Config{}),
+	}
+	proxy := ut.proxyHandler()
+
+	// Handlers registered on the default mux are not served on the proxy
+	http.HandleFunc("/debug/proxy-handler-test", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("default mux"))
+	})
+	rec := httptest.NewRecorder()
+	proxy.ServeHTTP(rec, httptest.NewRequest("GET", "/debug/proxy-handler-test", nil))
+	if rec.Body.String() != "ok" {
+		t.Errorf("default mux handler reached through the proxy: %q", rec.Body.String())
+	}
+
+	// The request ID is forwarded to the application and answered once
+	req := httptest.NewRequest("GET", "/missing", nil)
+	req.Header.Set(apierror.RequestIDHeader, "client-id")
+	rec = httptest.NewRecorder()
+	proxy.ServeHTTP(rec, req)
+	if forwarded != "client-id" || len(rec.Header().Values(apierror.RequestIDHeader)) != 1 || rec.Header().Get(apierror.RequestIDHeader) != "client-id" {
+		t.Errorf("request ID: forwarded %q, answered %v", forwarded, rec.Header().Values(apierror.RequestIDHeader))
+	}
+	if ut.proxyResponses[1] != 1 || ut.proxyResponses[3] != 1 {
+		t.Errorf("proxy responses by class = %v", ut.proxyResponses)
+	}
+}
+
+func TestMaintenanceMode(t *testing.T) {
+	if _, err := maintenance.Load(filepath.Join(t.TempDir(), "missing.html")); err == nil {
+		t.Error("a missing maintenance page should be refused")
+	}
+	broken := filepath.Join(t.TempDir(), "broken.html")
+	os.WriteFile(broken, []byte("<p>{{.Missing}}</p>"), 0600)
+	if _, err := maintenance.Load(broken); err == nil {
+		t.Error("a page using fields it is not given should be refused")
+	}
+	for _, m := range []Maintenance{{RetryAfter: -1}, {RetryAfter: 90000}, {CriticalDestinations: []string{"https://api.example.com/"}}} {
+		if err := m.normalize(); err == nil {
+			t.Errorf("%+v should be invalid", m)
+		}
+	}
+
+	app := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	defer app.Close()
+	ut := &UnifiedTokenizer{
+		appEndpoint:     app.URL,
+		bodyLimits:      bodyLimits{defaultMax: 1 << 20},
+		spoolThreshold:  1 << 20,
+		upstream:        upstream.New("app", app.Client(), upstream.Config{}),
+		maintenancePage: maintenance.Default(),
+		icapServer:      icap.NewServer(stubDetokenizer{}, false),
+	}
+	ut.icapServer.Detokenizes = ut.detokenizesFor
+	proxy := ut.proxyHandler()
+	reqmod := func(host string) string {
+		req := httptest.NewRequest("POST", "https://"+host+"/v1/charges", nil)
+		req.Header.Set("Content-Type", "application/json")
+		body, _, err := ut.icapServer.Reqmod(req, []byte(`{"card":"tok_test123"}`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(body)
+	}
+
+	rec := httptest.NewRecorder()
+	proxy.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+	if rec.Code != http.StatusOK || !strings.Contains(reqmod("api.stripe.com"), "4532015112830366") {
+		t.Fatalf("outside maintenance: proxy status %d", rec.Code)
+	}
+
+	m := &Maintenance{Enabled: true, Message: "Key ceremony in progress", CriticalDestinations: []string{"payments.example.com"}}
+	m.normalize()
+	ut.maintenance.Store(m)
+	rec = httptest.NewRecorder()
+	proxy.ServeHTTP(rec, httptest.NewRequest("GET", "/checkout", nil))
+	if rec.Code != http.StatusServiceUnavailable || rec.Header().Get("Retry-After") != "300" ||
+		!strings.HasPrefix(rec.Header().Get("Content-Type"), "text/html") || !strings.Contains(rec.Body.String(), "Key ceremony in progress") {
+		t.Errorf("maintenance page: status %d, headers %v: %s", rec.Code, rec.Header(), rec.Body.String())
+	}
+	req := httptest.NewRequest("GET", "/api/orders", nil)
+	req.Header.Set("Accept", "application/json")
+	rec = httptest.NewRecorder()
+	proxy.ServeHTTP(rec, req)
+	var body map[string]string
+	json.Unmarshal(rec.Body.Bytes(), &body)
+	if rec.Code != http.StatusServiceUnavailable || body["error"] != "maintenance" || body["message"] != m.Message {
+		t.Errorf("maintenance JSON: status %d: %s", rec.Code, rec.Body.String())
+	}
+	if strings.Contains(reqmod("api.stripe.com"), "4532015112830366") || !strings.Contains(reqmod("Payments.example.com:443"), "4532015112830366") {
+		t.Error("only critical destinations should be detokenized for during maintenance")
+	}
+	if ut.maintenanceRefused[maintenanceProxy] != 2 || ut.maintenanceRefused[maintenanceDetokenize] != 1 {
+		t.Errorf("maintenance refusals = %v", ut.maintenanceRefused)
+	}
+
+	// The config freeze blocks changes to configuration, not reads, tests or key operations
+	ut.maintenance.Store(&Maintenance{ConfigFreeze: true})
+	frozenAPI := ut.configFreezeMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	for _, c := range []struct {
+		method, path string
+		want         int
+	}{
+		{"PUT", "/api/v1/cors", http.StatusLocked},
+		{"DELETE", "/api/v1/ip-filters/api", http.StatusLocked},
+		{"POST", "/api/v1/users", http.StatusLocked},
+		{"PUT", "/api/v1/config/field-rules", http.StatusLocked},
+		{"POST", "/api/v1/config/field-rules/test", http.StatusOK},
+		{"GET", "/api/v1/rate-limits", http.StatusOK},
+		{"POST", "/api/v1/keys/rotate", http.StatusOK},
+		{"PUT", "/api/v1/maintenance", http.StatusOK},
+		{"POST", "/api/v1/tokens/bulk", http.StatusOK},
+	} {
+		rec := httptest.NewRecorder()
+		frozenAPI.ServeHTTP(rec, httptest.NewRequest(c.method, c.path, nil))
+		if rec.Code != c.want {
+			t.Errorf("%s %s during the freeze: status %d, want %d", c.method, c.path, rec.Code, c.want)
+		}
+	}
+	rec = httptest.NewRecorder()
+	proxy.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+	if rec.Code != http.StatusOK {
+		t.Errorf("the config freeze alone should not stop the proxy: status %d", rec.Code)
+	}
+}
+
+func TestProxyForwardedHeaders(t *testing.T) {
+	for _, c := range []forward.Config{{Mode: "x-real-ip"}, {Mode: forward.Both, Via: "token shield"}} {
+		if err := c.Validate(); err == nil {
+			t.Errorf("%+v should be invalid", c)
+		}
+	}
+
+	var received http.Header
+	app := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received = r.Header.Clone()
+		w.Header().Set("Keep-Alive", "timeout=5")
+		w.Write([]byte("ok"))
+	}))
+	defer app.Close()
+	proxies, _ := clientip.New([]string{"192.0.2.10"})
+	ut := &UnifiedTokenizer{
+		appEndpoint:    app.URL,
+		forwarding:     forward.Config{Mode: forward.Both, Via: "tokenshield", Proxies: proxies},
+		bodyLimits:     bodyLimits{defaultMax: 1 << 20},
+		spoolThreshold: 1 << 20,
+		upstream:       upstream.New("app", app.Client(), upstream.Config{}),
+	}
+	send := func(remoteAddr string, header http.Header) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "http://shop.example.com/orders", nil)
+		req.RemoteAddr = remoteAddr
+		for key, values := range header {
+			req.Header[key] = values
+		}
+		rec := httptest.NewRecorder()
+		ut.proxyHandler().ServeHTTP(rec, req)
+		return rec
+	}
+
+	// A client's own forwarded headers are replaced, and hop-by-hop
+	// headers, including those it named in Connection, are dropped
+	rec := send("198.51.100.7:4711", http.Header{
+		"X-Forwarded-For": {"10.0.0.1"},
+		"Forwarded":       {"for=10.0.0.1"},
+		"Connection":      {"keep-alive, X-Session-Hint"},
+		"X-Session-Hint":  {"abc"},
+		"Keep-Alive":      {"timeout=5"},
+	})
+	for key, want := range map[string]string{
+		"X-Forwarded-For":   "198.51.100.7",
+		"X-Forwarded-Host":  "shop.example.com",
+		"X-Forwarded-Proto": "http",
+		"Forwarded":         "for=198.51.100.7;host=shop.example.com;proto=http",
+		"Via":               "1.1 tokenshield",
+		"X-Session-Hint":    "",
+		"Keep-Alive":        "",
+		"Connection":        "",
+	} {
+		if got := strings.Join(received.Values(key), ", "); got != want {
+			t.Errorf("forwarded %s = %q, want %q", key, got, want)
+		}
+	}
+	if rec.Header().Get("Via") != "1.1 tokenshield" || rec.Header().Get("Keep-Alive") != "" {
+		t.Errorf("response headers = %v", rec.Header())
+	}
+
+	// A trusted proxy's are extended
+	send("192.0.2.10:4711", http.Header{
+		"X-Forwarded-For":   {"203.0.113.9"},
+		"X-Forwarded-Proto": {"https"},
+		"Forwarded":         {`for=203.0.113.9;proto=https`},
+		"Via":               {"1.1 haproxy"},
+	})
+	for key, want := range map[string]string{
+		"X-Forwarded-For":   "203.0.113.9, 192.0.2.10",
+		"X-Forwarded-Proto": "https",
+		"Forwarded":         "for=203.0.113.9;proto=https, for=192.0.2.10;host=shop.example.com;proto=http",
+		"Via":               "1.1 haproxy, 1.1 tokenshield",
+	} {
+		if got := strings.Join(received.Values(key), ", "); got != want {
+			t.Errorf("through a trusted proxy, %s = %q, want %q", key, got, want)
+		}
+	}
+
+	// With forwarded headers off they pass as received
+	ut.forwarding = forward.Config{Mode: forward.None}
+	send("198.51.100.7:4711", http.Header{"X-Forwarded-For": {"10.0.0.1"}})
+	if received.Get("X-Forwarded-For") != "10.0.0.1" || received.Get("Via") != "" {
+		t.Errorf("mode none: %v", received)
+	}
+}
+
+func TestProxyCardPolicies(t *testing.T) {
+	if _, err := parseCardPolicies("block", ""); err == nil {
+		t.Error("parseCardPolicies should reject an unknown default policy")
+	}
+	for _, value := range []string{"api=reject", "/api", "/api=block"} {
+		if _, err := parseCardPolicies(cardPolicyTokenize, value); err == nil {
+			t.Errorf("parseCardPolicies(%q) should fail", value)
+		}
+	}
+	policies, err := parseCardPolicies("Tokenize", "/logs=reject, /logs/audit=Alert")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for path, want := range map[string]string{"/checkout": "tokenize", "/logs/app": "reject", "/logs/audit/2024": "alert"} {
+		if got := policies.policyFor(path); got != want {
+			t.Errorf("policyFor(%q) = %q, want %q", path, got, want)
+		}
+	}
+
+	ut := &UnifiedTokenizer{scanner: scanner.New([]scanner.TokenPattern{scanner.PrefixTokens()}, true)}
+	card := "4111111111111111"
+	latin1, err := charset.Detect("application/json; charset=iso-8859-1", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		name string
+		body string
+		want bool
+	}{
+		{"small", `{"note": "card ` + card + ` on file"}`, true},
+		{"none", `{"order": "12345678901234567890", "token": "tok_abc"}`, false},
+		{"spooled", strings.Repeat("x", (64<<10)-8) + " " + card + " " + strings.Repeat("y", 10<<10), true},
+		{"long number", strings.Repeat("x", (64<<10)-40) + " " + strings.Repeat("1", 30) + card + " " + strings.Repeat("y", 10<<10), false},
+		{"card after a word", strings.Repeat("x", (64<<10)-20) + card + " " + strings.Repeat("y", 10<<10), false},
+	} {
+		buffer := spool.New(t.TempDir(), 16<<10)
+		buffer.Write([]byte(tc.body))
+		got, err := ut.bodyHasCard(buffer, latin1)
+		buffer.Close()
+		if err != nil || got != tc.want {
+			t.Errorf("%s: bodyHasCard = %v, %v, want %v", tc.name, got, err, tc.want)
+		}
+	}
+}
+
+func TestCORSPolicy(t *testing.T) {
+	for _, p := range []cors.Policy{
+		{AllowedOrigins: []string{"admin.example.com"}},
+		{AllowedOrigins: []string{"https://admin.example.com/path"}},
+		{AllowedOrigins: []string{"https://*example.com"}},
+		{AllowedOrigins: []string{"*"}, AllowCredentials: true},
+		{AllowedHeaders: []string{"X-A, X-B"}},
+		{MaxAge: -1},
+	} {
+		if err := p.Normalize(); err == nil {
+			t.Errorf("Normalize(%+v) should fail", p)
+		}
+	}
+
+	// Without CORS settings no origin is allowed
+	deny, err := loadCORSConfig()
+	if err != nil || deny.AllowsOrigin("http://localhost:8081") {
+		t.Fatalf("default policy should deny every origin: %+v, %v", deny, err)
+	}
+	t.Setenv("CORS_ALLOWED_ORIGINS", "https://Admin.Example.com/, https://*.ops.example.com")
+	t.Setenv("CORS_ALLOW_CREDENTIALS", "true")
+	policy, err := loadCORSConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for origin, want := range map[string]bool{
+		"https://admin.example.com":       true,
+		"https://eu.ops.example.com":      true,
+		"https://a.b.ops.example.com":     true,
+		"https://ops.example.com":         false,
+		"http://admin.example.com":        false,
+		"https://evilops.example.com":     false,
+		"https://admin.example.com.evil":  false,
+		"https://eu.ops.example.com:8443": false,
+	} {
+		if got := policy.AllowsOrigin(origin); got != want {
+			t.Errorf("AllowsOrigin(%q) = %v, want %v", origin, got, want)
+		}
+	}
+
+	ut := &UnifiedTokenizer{}
+	ut.corsPolicy.Store(&policy)
+	handler := ut.corsMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTeapot)
+	}))
+	request := func(method, origin string, header map[string]string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, "/api/v1/users", nil)
+		req.Header.Set("Origin", origin)
+		for k, v := range header {
+			req.Header.Set(k, v)
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+
+	preflight := map[string]string{"Access-Control-Request-Method": "PUT", "Access-Control-Request-Headers": "authorization, content-type"}
+	rec := request("OPTIONS", "https://eu.ops.example.com", preflight)
+	if rec.Code != http.StatusNoContent || rec.Header().Get("Access-Control-Allow-Origin") != "https://eu.ops.example.com" ||
+		rec.Header().Get("Access-Control-Allow-Credentials") != "true" || !strings.Contains(rec.Header().Get("Access-Control-Allow-Methods"), "PUT") {
+		t.Errorf("allowed preflight: %d %v", rec.Code, rec.Header())
+	}
+	rec = request("OPTIONS", "https://evil.example.net", preflight)
+	if rec.Code != http.StatusNoContent || rec.Header().Get("Access-Control-Allow-Origin") != "" {
+		t.Errorf("preflight from another origin must not be allowed: %v", rec.Header())
+	}
+	rec = request("OPTIONS", "https://admin.example.com", map[string]string{"Access-Control-Request-Method": "PATCH"})
+	if rec.Header().Get("Access-Control-Allow-Methods") != "" {
+		t.Errorf("PATCH is not an allowed method: %v", rec.Header())
+	}
+	rec = request("GET", "https://evil.example.net", nil)
+	if rec.Code != http.StatusTeapot || rec.Header().Get("Access-Control-Allow-Origin") != "" || rec.Header().Get("Vary") != "Origin" {
+		t.Errorf("request from another origin: %d %v", rec.Code, rec.Header())
+	}
+	rec = request("GET", "https://admin.example.com", nil)
+	if rec.Code != http.StatusTeapot || rec.Header().Get("Access-Control-Allow-Origin") != "https://admin.example.com" {
+		t.Errorf("request from an allowed origin: %d %v", rec.Code, rec.Header())
+	}
+}
+
+func TestSecurityHeaders(t *testing.T) {
+	headers, err := loadSecurityHeaders()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ut := &UnifiedTokenizer{securityHeaders: headers}
+	handler := ut.securityHeaders.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTeapot)
+	}))
+	get := func(path string) http.Header {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest("GET", path, nil))
+		if rec.Code != http.StatusTeapot {
+			t.Fatalf("GET %s: status %d", path, rec.Code)
+		}
+		return rec.Header()
+	}
+
+	api := get("/api/v1/users")
+	for name, want := range map[string]string{
+		"Strict-Transport-Security": "max-age=31536000; includeSubDomains",
+		"X-Content-Type-Options":    "nosniff",
+		"X-Frame-Options":           "DENY",
+		"Referrer-Policy":           "no-referrer",
+		"Content-Security-Policy":   secheaders.DefaultCSP,
+	} {
+		if got := api.Get(name); got != want {
+			t.Errorf("API response %s = %q, want %q", name, got, want)
+		}
+	}
+	for _, page := range secheaders.Pages {
+		if got := get(page).Get("Content-Security-Policy"); got != secheaders.DefaultPageCSP {
+			t.Errorf("%s Content-Security-Policy = %q, want the page policy", page, got)
+		}
+	}
+
+	t.Setenv("SECURITY_HSTS_MAX_AGE", "0")
+	t.Setenv("SECURITY_FRAME_OPTIONS", "sameorigin")
+	t.Setenv("SECURITY_REFERRER_POLICY", "off")
+	t.Setenv("SECURITY_CSP", "default-src 'none'; report-uri /csp")
+	if headers, err = loadSecurityHeaders(); err != nil {
+		t.Fatal(err)
+	}
+	ut.securityHeaders = headers
+	handler = ut.securityHeaders.Middleware(http.NotFoundHandler())
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("GET", "/api/v1/users", nil))
+	if h := rec.Header(); h.Get("Strict-Transport-Security") != "" || h.Get("Referrer-Policy") != "" ||
+		h.Get("X-Frame-Options") != "SAMEORIGIN" || h.Get("Content-Security-Policy") != "default-src 'none'; report-uri /csp" {
+		t.Errorf("overridden headers: %v", h)
+	}
+
+	for key, value := range map[string]string{
+		"SECURITY_HSTS_MAX_AGE":    "-1",
+		"SECURITY_FRAME_OPTIONS":   "ALLOW-FROM https://example.com",
+		"SECURITY_REFERRER_POLICY": "everywhere",
+		"SECURITY_CSP":             "default-src 'none'\r\nSet-Cookie: a=b",
+	} {
+		t.Run(key, func(t *testing.T) {
+			t.Setenv(key, value)
+			if _, err := loadSecurityHeaders(); err == nil {
+				t.Errorf("%s=%q should be refused", key, value)
+			}
+		})
+	}
+}
+
+func TestCSRFExemptions(t *testing.T) {
+	if csrfToken("s1") != csrfToken("s1") || csrfToken("s1") == csrfToken("s2") {
+		t.Fatal("csrfToken should be stable per session and differ between sessions")
+	}
+	ut := &UnifiedTokenizer{csrfProtection: true}
+	handler := ut.csrfMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTeapot)
+	}))
+	for _, tc := range []struct {
+		name, method, path string
+		header             map[string]string
+	}{
+		{"safe method", "GET", "/api/v1/users", map[string]string{"Cookie": "session_id=s1"}},
+		{"matching token", "PUT", "/api/v1/users/u1", map[string]string{"Cookie": "session_id=s1", "X-CSRF-Token": csrfToken("s1")}},
+		{"bearer session", "DELETE", "/api/v1/users/u1", map[string]string{"Cookie": "session_id=s1", "Authorization": "Bearer s1"}},
+		{"api key", "POST", "/api/v1/cards/import", map[string]string{"Cookie": "session_id=s1", "X-API-Key": "ts_key"}},
+		{"no cookie", "POST", "/api/v1/users", nil},
+		{"login", "POST", "/api/v1/auth/login", map[string]string{"Cookie": "session_id=expired"}},
+	} {
+		req := httptest.NewRequest(tc.method, tc.path, nil)
+		for k, v := range tc.header {
+			req.Header.Set(k, v)
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		if rec.Code != http.StatusTeapot {
+			t.Errorf("%s: status %d, want the request passed on", tc.name, rec.Code)
+		}
+	}
+
+	ut.csrfProtection = false
+	req := httptest.NewRequest("POST", "/api/v1/users", nil)
+	req.Header.Set("Cookie", "session_id=s1")
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	if rec.Code != http.StatusTeapot {
+		t.Errorf("CSRF_PROTECTION=false: status %d", rec.Code)
+	}
+}
+
+func TestRequestSignature(t *testing.T) {
+	body := []byte(`{"cardType":"visa"}`)
+	bodyHash := sha256.Sum256(body)
+	mac := hmac.New(sha256.New, []byte("secret"))
+	mac.Write([]byte("POST\n/api/v1/tokens/search?limit=5\n1760600000\nnonce-0000000001\n" + hex.EncodeToString(bodyHash[:]) + "\n"))
+	want := hex.EncodeToString(mac.Sum(nil))
+	if got := requestSignature("secret", "POST", "/api/v1/tokens/search?limit=5", "1760600000", "nonce-0000000001", body); got != want {
+		t.Fatalf("signature %s, want %s", got, want)
+	}
+	for name, got := range map[string]string{
+		"secret":    requestSignature("other", "POST", "/api/v1/tokens/search?limit=5", "1760600000", "nonce-0000000001", body),
+		"method":    requestSignature("secret", "PUT", "/api/v1/tokens/search?limit=5", "1760600000", "nonce-0000000001", body),
+		"query":     requestSignature("secret", "POST", "/api/v1/tokens/search?limit=6", "1760600000", "nonce-0000000001", body),
+		"timestamp": requestSignature("secret", "POST", "/api/v1/tokens/search?limit=5", "1760600001", "nonce-0000000001", body),
+		"nonce":     requestSignature("secret", "POST", "/api/v1/tokens/search?limit=5", "1760600000", "nonce-0000000002", body),
+		"body":      requestSignature("secret", "POST", "/api/v1/tokens/search?limit=5", "1760600000", "nonce-0000000001", []byte(`{}`)),
+	} {
+		if got == want {
+			t.Errorf("changing the %s should change the signature", name)
+		}
+	}
+
+	now := time.Unix(1760600000, 0)
+	for _, tc := range []struct {
+		timestamp string
+		ok        bool
+	}{
+		{"1760600000", true},
+		{"1760599700", true},
+		{"1760600300", true},
+		{"1760599699", false},
+		{"1760600301", false},
+		{"1760600000000", false},
+		{"2025-10-16T07:33:20Z", false},
+	} {
+		at, err := signatureTime(tc.timestamp, now, 5*time.Minute)
+		if (err == nil) != tc.ok {
+			t.Errorf("timestamp %s: %v, %v", tc.timestamp, at, err)
+		}
+	}
+
+	// An unsigned request is passed on, without a verification it claims
+	ut := &UnifiedTokenizer{}
+	var verified string
+	handler := ut.signatureMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		verified = r.Header.Get("X-Verified-Signature")
+	}))
+	req := httptest.NewRequest("GET", "/api/v1/tokens", nil)
+	req.Header.Set("X-API-Key", "ts_key")
+	req.Header.Set("X-Verified-Signature", "ts_key")
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+	if verified != "" {
+		t.Errorf("forged X-Verified-Signature %q passed on", verified)
+	}
+}
+
+func TestServiceAccountPath(t *testing.T) {
+	for _, tc := range []struct {
+		path, name, apiKey, action string
+		ok                         bool
+	}{
+		{"/api/v1/service-accounts/billing-sync", "billing-sync", "", "", true},
+		{"/api/v1/service-accounts/billing-sync/keys", "billing-sync", "", "keys", true},
+		{"/api/v1/service-accounts/billing-sync/keys/ts_abc/rotate", "billing-sync", "ts_abc", "rotate", true},
+		{"/api/v1/service-accounts/", "", "", "", false},
+		{"/api/v1/service-accounts/billing-sync/", "", "", "", false},
+		{"/api/v1/service-accounts/billing-sync/keys/ts_abc", "", "", "", false},
+		{"/api/v1/service-accounts/billing-sync/keys//rotate", "", "", "", false},
+		{"/api/v1/service-accounts/billing-sync/tokens", "", "", "", false},
+	} {
+		name, apiKey, action, ok := serviceAccountPath(tc.path)
+		if name != tc.name || apiKey != tc.apiKey || action != tc.action || ok != tc.ok {
+			t.Errorf("%s: %q, %q, %q, %v", tc.path, name, apiKey, action, ok)
+		}
+	}
+
+	schemas, err := loadRequestSchemas("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		endpoint, body string
+		valid          bool
+	}{
+		{"/api/v1/service-accounts", `{"name": "billing-sync", "role": "operator"}`, true},
+		{"/api/v1/service-accounts", `{"name": "billing sync"}`, false},
+		{"/api/v1/service-accounts", `{"name": "billing-sync", "password": "Str0ng!Passw0rd"}`, false},
+		{"/api/v1/service-accounts/{name}/keys", `{"expires_in_days": 30, "signed": true}`, true},
+		{"/api/v1/service-accounts/{name}/keys", `{"expires_in_days": 0}`, false},
+		{"/api/v1/service-accounts/{name}/keys/{api_key}/rotate", `{"overlap_hours": 0}`, true},
+		{"/api/v1/service-accounts/{name}/keys/{api_key}/rotate", `{"overlap_hours": 169}`, false},
+	} {
+		var body interface{}
+		json.Unmarshal([]byte(tc.body), &body)
+		if errs := schemas[tc.endpoint].Validate(body); (len(errs) == 0) != tc.valid {
+			t.Errorf("%s %s: %v", tc.endpoint, tc.body, errs)
+		}
+	}
+}
+
+func TestCookieConfig(t *testing.T) {
+	proxies, err := clientip.New([]string{"192.0.2.0/24"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := loadCookieConfig(proxies)
+	if err != nil || cfg.secure != "auto" || cfg.sameSite != http.SameSiteStrictMode {
+		t.Fatalf("defaults: %+v, %v", cfg, err)
+	}
+
+	// Plain HTTP: no prefix, not Secure
+	plain := httptest.NewRequest("POST", "/api/v1/auth/login", nil)
+	c := cfg.cookie(plain, sessionCookieName, "s1", time.Time{}, true)
+	if c.Name != "session_id" || c.Secure || !c.HttpOnly {
+		t.Errorf("over HTTP: %+v", c)
+	}
+
+	// TLS, directly or behind a trusted proxy: Secure and __Host- prefixed
+	tlsReq := httptest.NewRequest("POST", "https://tokenshield/api/v1/auth/login", nil)
+	proxied := httptest.NewRequest("POST", "/api/v1/auth/login", nil)
+	proxied.Header.Set("X-Forwarded-Proto", "https")
+	for _, r := range []*http.Request{tlsReq, proxied} {
+		c := cfg.cookie(r, sessionCookieName, "s1", time.Time{}, true)
+		if c.Name != "__Host-session_id" || !c.Secure || c.Domain != "" || c.Path != "/" {
+			t.Errorf("over TLS: %+v", c)
+		}
+	}
+	// X-Forwarded-Proto from anyone else is ignored
+	spoofed := httptest.NewRequest("POST", "/api/v1/auth/login", nil)
+	spoofed.RemoteAddr = "198.51.100.7:1234"
+	spoofed.Header.Set("X-Forwarded-Proto", "https")
+	if c := cfg.cookie(spoofed, sessionCookieName, "s1", time.Time{}, true); c.Secure {
+		t.Errorf("untrusted X-Forwarded-Proto: %+v", c)
+	}
+
+	// Only the name in use is read, so an unprefixed cookie is ignored over TLS
+	tlsReq.Header.Set("Cookie", "session_id=planted; __Host-session_id=s1")
+	plain.Header.Set("Cookie", "session_id=s2")
+	if got := cfg.sessionID(tlsReq); got != "s1" {
+		t.Errorf("sessionID over TLS = %q", got)
+	}
+	if got := cfg.sessionID(plain); got != "s2" {
+		t.Errorf("sessionID over HTTP = %q", got)
+	}
+
+	// A domain rules out the prefix
+	t.Setenv("COOKIE_SECURE", "true")
+	t.Setenv("COOKIE_DOMAIN", ".example.com")
+	t.Setenv("COOKIE_SAMESITE", "lax")
+	cfg, err = loadCookieConfig(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c = cfg.cookie(plain, csrfCookieName, "t", time.Time{}, false)
+	if c.Name != "csrf_token" || !c.Secure || c.Domain != "example.com" || c.SameSite != http.SameSiteLaxMode || c.HttpOnly {
+		t.Errorf("with COOKIE_DOMAIN: %+v", c)
+	}
+
+	for _, env := range [][2]string{
+		{"COOKIE_SECURE", "yes"},
+		{"COOKIE_SAMESITE", "relaxed"},
+		{"COOKIE_DOMAIN", "example.com/path"},
+	} {
+		t.Run(env[0], func(t *testing.T) {
+			t.Setenv(env[0], env[1])
+			if _, err := loadCookieConfig(nil); err == nil {
+				t.Errorf("%s=%s accepted", env[0], env[1])
+			}
+		})
+	}
+	t.Setenv("COOKIE_SECURE", "false")
+	t.Setenv("COOKIE_SAMESITE", "none")
+	if _, err := loadCookieConfig(nil); err == nil {
+		t.Error("SameSite=None without Secure accepted")
+	}
+}
+
+func TestIPFilter(t *testing.T) {
+	filter := ipfilter.Filter{Allow: []string{"10.0.0.0/8", " 192.168.1.7 ", "::ffff:172.16.0.0/108"}, Deny: []string{"10.9.0.0/16"}}
+	if err := filter.Normalize(); err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Join(filter.Allow, ","); got != "10.0.0.0/8,192.168.1.7/32,172.16.0.0/12" {
+		t.Errorf("normalized allow list = %s", got)
+	}
+	for remote, want := range map[string]bool{
+		"10.1.2.3:5000":         true,
+		"10.9.0.1:5000":         false, // Denied inside an allowed range
+		"192.168.1.7:443":       true,
+		"192.168.1.8:443":       false,
+		"[::ffff:10.1.2.3]:80":  true,
+		"[::ffff:172.16.5.5]:1": true,
+		"[2001:db8::1]:80":      false,
+		"not-an-address":        false,
+	} {
+		if got := filter.AllowsRemote(remote); got != want {
+			t.Errorf("AllowsRemote(%s) = %v, want %v", remote, got, want)
+		}
+	}
+
+	// Deny-only filters allow everything else; an empty one allows all
+	denyOnly := ipfilter.Filter{Deny: []string{"203.0.113.0/24"}}
+	denyOnly.Normalize()
+	if denyOnly.AllowsRemote("203.0.113.9:1") || !denyOnly.AllowsRemote("198.51.100.1:1") {
+		t.Error("deny-only filter")
+	}
+	var none *ipfilter.Filter
+	if !none.AllowsRemote("garbage") {
+		t.Error("a nil filter should allow everything")
+	}
+	for _, entry := range []string{"10.0.0.0/33", "10.0.0", "example.com"} {
+		bad := ipfilter.Filter{Allow: []string{entry}}
+		if err := bad.Normalize(); err == nil {
+			t.Errorf("%q accepted", entry)
+		}
+	}
+
+	t.Setenv("API_ALLOWED_CIDRS", "10.0.0.0/8, 127.0.0.1")
+	t.Setenv("ICAP_DENIED_CIDRS", "192.0.2.0/24")
+	config, err := loadIPFilterConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(config["api"].Allow) != 2 || len(config["icap"].Deny) != 1 || !(&ipfilter.Filter{}).Empty() {
+		t.Errorf("loaded filters: %+v", config)
+	}
+	t.Setenv("ICAP_ALLOWED_CIDRS", "10.0.0.0/99")
+	if _, err := loadIPFilterConfig(); err == nil {
+		t.Error("invalid ICAP_ALLOWED_CIDRS accepted")
+	}
+
+	// Only the API listener's filter applies to the API, and /health is open
+	api := config["api"]
+	ut := &UnifiedTokenizer{ipBlockLogged: map[string]time.Time{"api 192.0.2.1": time.Now()}}
+	ut.ipFilters.Store(&map[string]*ipfilter.Filter{"api": &api})
+	handler := ut.ipFilterMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTeapot)
+	}))
+	for _, tc := range []struct {
+		remote, path, forwarded string
+		want                    int
+	}{
+		{"10.0.0.5:1234", "/api/v1/users", "", http.StatusTeapot},
+		{"192.0.2.1:1234", "/api/v1/users", "", http.StatusForbidden},
+		{"192.0.2.1:1234", "/api/v1/users", "10.0.0.5", http.StatusForbidden}, // X-Forwarded-For is not trusted
+		{"192.0.2.1:1234", "/health", "", http.StatusTeapot},
+	} {
+		req := httptest.NewRequest("GET", tc.path, nil)
+		req.RemoteAddr = tc.remote
+		if tc.forwarded != "" {
+			req.Header.Set("X-Forwarded-For", tc.forwarded)
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		if rec.Code != tc.want {
+			t.Errorf("%s %s: status %d, want %d", tc.remote, tc.path, rec.Code, tc.want)
+		}
+	}
+	if ut.ipBlockedAPI != 2 {
+		t.Errorf("ipBlockedAPI = %d, want 2", ut.ipBlockedAPI)
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	proxies, err := clientip.New([]string{"10.0.0.0/8", "192.0.2.10"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := clientip.New([]string{"10.0.0.0/40"}); err == nil {
+		t.Error("invalid CIDR accepted")
+	}
+	ut := &UnifiedTokenizer{proxies: proxies}
+	for _, tc := range []struct {
+		remote    string
+		forwarded []string
+		want      string
+	}{
+		{"198.51.100.7:1234", nil, "198.51.100.7"},
+		{"198.51.100.7:1234", []string{"203.0.113.1"}, "198.51.100.7"}, // Not from a trusted proxy
+		{"10.1.2.3:1234", nil, "10.1.2.3"},
+		{"10.1.2.3:1234", []string{"203.0.113.1"}, "203.0.113.1"},
+		{"10.1.2.3:1234", []string{"6.6.6.6, 203.0.113.1"}, "203.0.113.1"},                // Forged entry on the left
+		{"10.1.2.3:1234", []string{"6.6.6.6, 203.0.113.1, 192.0.2.10"}, "203.0.113.1"},    // Two trusted hops
+		{"10.1.2.3:1234", []string{"6.6.6.6", "203.0.113.1:5555"}, "203.0.113.1"},         // Split headers, with a port
+		{"10.1.2.3:1234", []string{"[2001:db8::1]:443"}, "2001:db8::1"},
+		{"10.1.2.3:1234", []string{"203.0.113.1, garbage"}, "10.1.2.3"},
+		{"10.1.2.3:1234", []string{"10.9.9.9"}, "10.9.9.9"}, // Only trusted hops: the furthest one
+		{"[::ffff:10.1.2.3]:1234", []string{"203.0.113.1"}, "203.0.113.1"},
+	} {
+		req := httptest.NewRequest("GET", "/api/v1/tokens", nil)
+		req.RemoteAddr = tc.remote
+		for _, v := range tc.forwarded {
+			req.Header.Add("X-Forwarded-For", v)
+		}
+		if got, _ := ut.getClientInfo(req); got != tc.want {
+			t.Errorf("%s %v: client %q, want %q", tc.remote, tc.forwarded, got, tc.want)
+		}
+	}
+
+	// Without trusted proxies X-Forwarded-For is never believed
+	req := httptest.NewRequest("GET", "/api/v1/tokens", nil)
+	req.RemoteAddr = "10.1.2.3:1234"
+	req.Header.Set("X-Forwarded-For", "203.0.113.1")
+	if got, _ := (&UnifiedTokenizer{}).getClientInfo(req); got != "10.1.2.3" {
+		t.Errorf("no trusted proxies: client %q", got)
+	}
+
+	// Behind a trusted proxy the IP filter sees the forwarded client
+	allow := ipfilter.Filter{Allow: []string{"203.0.113.0/24"}}
+	if err := allow.Normalize(); err != nil {
+		t.Fatal(err)
+	}
+	ut.ipFilters.Store(&map[string]*ipfilter.Filter{"api": &allow})
+	handler := ut.ipFilterMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTeapot)
+	}))
+	req = httptest.NewRequest("GET", "/api/v1/tokens", nil)
+	req.RemoteAddr = "10.1.2.3:1234"
+	req.Header.Set("X-Forwarded-For", "203.0.113.1")
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	if rec.Code != http.StatusTeapot {
+		t.Errorf("forwarded client allowed by filter: status %d", rec.Code)
+	}
+}
+
+func TestQuotaPeriodsAndSubjects(t *testing.T) {
+	periods := quotaPeriods(time.Date(2024, 3, 31, 23, 45, 10, 0, time.FixedZone("CET", 3600)))
+	if hour := periods["hour"]; !hour[0].Equal(time.Date(2024, 3, 31, 22, 0, 0, 0, time.UTC)) || hour[1].Sub(hour[0]) != time.Hour {
+		t.Errorf("hour = %v", hour)
+	}
+	if day := periods["day"]; !day[0].Equal(time.Date(2024, 3, 31, 0, 0, 0, 0, time.UTC)) || !day[1].Equal(time.Date(2024, 4, 1, 0, 0, 0, 0, time.UTC)) {
+		t.Errorf("day = %v", day)
+	}
+
+	r := httptest.NewRequest("POST", "/api/v1/tokens/tok_x/reveal", nil)
+	r.Header.Set("X-User-ID", "usr_alice")
+	if got := quotaSubjects(r); len(got) != 1 || got[0] != (quotaSubject{"user", "usr_alice"}) {
+		t.Errorf("session subjects = %v", got)
+	}
+	r.Header.Set("X-Authenticated-API-Key", "ts_key")
+	if got := quotaSubjects(r); len(got) != 2 || got[0] != (quotaSubject{"api_key", "ts_key"}) {
+		t.Errorf("API key subjects = %v", got)
+	}
+	r.Header.Set("X-User-ID", "api_key_ts_key12")
+	if got := quotaSubjects(r); len(got) != 1 || got[0].Type != "api_key" {
+		t.Errorf("legacy API key subjects = %v", got)
+	}
+}
+
+func TestRateLimitRules(t *testing.T) {
+	rules, err := loadRateLimitConfig()
+	if err != nil || len(rules) != 1 || rules[0].Class != "auth" || rules[0].Limit != 5 {
+		t.Fatalf("default rules: %+v, %v", rules, err)
+	}
+	for _, bad := range []string{
+		`[{"class":"everything","scope":"ip","limit":5,"window":"1m"}]`,
+		`[{"class":"read","scope":"user","limit":5,"window":"1m"}]`,
+		`[{"class":"read","scope":"ip","limit":0,"window":"1m"}]`,
+		`[{"class":"read","scope":"ip","limit":5,"window":"forever"}]`,
+		`[{"class":"read","scope":"ip","limit":5,"window":"1m"},{"class":"read","scope":"ip","limit":9,"window":"1h"}]`,
+		`{"class":"read"}`,
+	} {
+		t.Setenv("RATE_LIMIT_RULES", bad)
+		if _, err := loadRateLimitConfig(); err == nil {
+			t.Errorf("RATE_LIMIT_RULES=%s accepted", bad)
+		}
+	}
+
+	// Fixed windows: the limit resets when the window ends, but a block
+	// longer than the window holds
+	rule := ratelimit.Rule{Class: "auth", Scope: "ip", Limit: 2, Window: "1m", Block: "5m"}
+	if err := rule.Normalize(); err != nil {
+		t.Fatal(err)
+	}
+	store := ratelimit.NewMemoryStore()
+	start := time.Date(2024, 1, 1, 10, 0, 0, 0, time.UTC)
+	for i, want := range []bool{true, true, false} {
+		if allowed, _, _ := store.Take(&rule, "192.0.2.1", start.Add(time.Duration(i)*time.Second)); allowed != want {
+			t.Errorf("request %d: allowed = %v", i+1, allowed)
+		}
+	}
+	if allowed, _, _ := store.Take(&rule, "192.0.2.2", start); !allowed {
+		t.Error("another client should have its own counter")
+	}
+	if allowed, retryAfter, _ := store.Take(&rule, "192.0.2.1", start.Add(2*time.Minute)); allowed || retryAfter != 3*time.Minute+2*time.Second {
+		t.Errorf("blocked client in the next window: allowed %v, retry after %v", allowed, retryAfter)
+	}
+	if allowed, _, _ := store.Take(&rule, "192.0.2.1", start.Add(6*time.Minute)); !allowed {
+		t.Error("client should be allowed again once the block ends")
+	}
+	store.Cleanup(start.Add(time.Hour))
+
+	for _, tc := range []struct{ method, path, want string }{
+		{"POST", "/api/v1/auth/login", "auth"},
+		{"POST", "/api/v1/unseal", "auth"},
+		{"GET", "/api/v1/unseal", "read"},
+		{"POST", "/api/v1/tokens/tok_abc/reveal", "detokenize"},
+		{"POST", "/api/v1/cards/import", "import"},
+		{"GET", "/api/v1/tokens", "read"},
+		{"DELETE", "/api/v1/tokens/tok_abc", "write"},
+		{"OPTIONS", "/api/v1/tokens", ""},
+		{"GET", "/health", ""},
+	} {
+		if got := endpointClass(httptest.NewRequest(tc.method, tc.path, nil)); got != tc.want {
+			t.Errorf("%s %s: class %q, want %q", tc.method, tc.path, got, tc.want)
+		}
+	}
+
+	ut := &UnifiedTokenizer{}
+	r := httptest.NewRequest("GET", "/api/v1/tokens", nil)
+	if got := ut.rateLimitClient(r, "key"); got != "" {
+		t.Errorf("key of an unauthenticated request = %q", got)
+	}
+	r.Header.Set("Authorization", "Bearer sess_1")
+	if got := ut.rateLimitClient(r, "key"); got != "session:sess_1" {
+		t.Errorf("key of a Bearer request = %q", got)
+	}
+	r.Header.Set("X-API-Key", "ts_1")
+	if got := ut.rateLimitClient(r, "key"); got != "api_key:ts_1" {
+		t.Errorf("key of an API key request = %q", got)
+	}
+}
+
+func TestICAPPool(t *testing.T) {
+	pool := icap.NewPool(icap.NewServer(nil, false), 1, 1, time.Minute)
+
+	// The first connection holds the only worker until it is closed, and the
+	// second waits in the queue
+	busyClient, busyServer := net.Pipe()
+	queuedClient, queuedServer := net.Pipe()
+	pool.Serve(busyServer)
+	waitFor := func(cond func(icap.PoolStats) bool) {
+		deadline := time.Now().Add(2 * time.Second)
+		for !cond(pool.Stats()) {
+			if time.Now().After(deadline) {
+				t.Fatalf("pool never reached expected state: %+v", pool.Stats())
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+	}
+	waitFor(func(s icap.PoolStats) bool { return s.Active == 1 })
+	pool.Serve(queuedServer)
+
+	// The queue is full, so the third is answered 503
+	rejectedClient, rejectedServer := net.Pipe()
+	pool.Serve(rejectedServer)
+	rejectedClient.SetReadDeadline(time.Now().Add(2 * time.Second))
+	response, _ := io.ReadAll(rejectedClient)
+	if !strings.HasPrefix(string(response), "ICAP/1.0 503") {
+		t.Errorf("overloaded response = %q, want ICAP 503", response)
+	}
+
+	busyClient.Close()
+	queuedClient.Close()
+	waitFor(func(s icap.PoolStats) bool { return s.Handled == 2 && s.Active == 0 })
+	if stats := pool.Stats(); stats.RejectedFull != 1 || stats.Queued != 0 {
+		t.Errorf("Stats() = %+v", stats)
+	}
+}
+
+func TestScanner(t *testing.T) {
+	prefixRegex := regexp.MustCompile(`tok_[a-zA-Z0-9_\-]+=*`)
+	luhnRegex := regexp.MustCompile(`\b9999[0-9]{12}\b`)
+	texts := []string{
+		`<td>tok_AbC-12_x==</td><td>tok_</td>xtok_q9 tok_tok_z`,
+		`9999123456789012 99991234567890123 a9999123456789012 9999123456789012_ 9999123456789012`,
+		`<p>Card 4111111111111111, order 4111111111111112, ref x4111111111111111</p>`,
+		`378282246310005 6011111111111117 5555555555554444 1234567890123456`,
+	}
+	prefix := scanner.New([]scanner.TokenPattern{scanner.PrefixTokens()}, false)
+	luhn := scanner.New([]scanner.TokenPattern{scanner.LuhnTokens("9999")}, false)
+	for _, text := range texts {
+		if got, want := prefix.Find(text, scanner.Token), prefixRegex.FindAllString(text, -1); fmt.Sprint(got) != fmt.Sprint(want) {
+			t.Errorf("prefix tokens in %q = %v, regexp finds %v", text, got, want)
+		}
+		if got, want := luhn.Find(text, scanner.Token), luhnRegex.FindAllString(text, -1); fmt.Sprint(got) != fmt.Sprint(want) {
+			t.Errorf("Luhn tokens in %q = %v, regexp finds %v", text, got, want)
+		}
+	}
+
+	// Card numbers must pass the Luhn check and stand alone
+	both := scanner.New([]scanner.TokenPattern{scanner.PrefixTokens()}, true)
+	pans := both.Find(texts[2]+" "+texts[3], scanner.PAN)
+	want := []string{"4111111111111111", "378282246310005", "6011111111111117", "5555555555554444"}
+	if fmt.Sprint(pans) != fmt.Sprint(want) {
+		t.Errorf("PANs = %v, want %v", pans, want)
+	}
+
+	replaced, modified := both.Replace("a tok_x b tok_y c 4111111111111111", func(m scanner.Match, v string) (string, bool) {
+		if m.Kind == scanner.Token && v == "tok_x" {
+			return "4111111111111111", true
+		}
+		return "", false
+	})
+	if !modified || replaced != "a 4111111111111111 b tok_y c 4111111111111111" {
+		t.Errorf("Replace() = %q, %v", replaced, modified)
+	}
+}
+
+// benchmarkHTML is a large page with a few tokens among many numbers
+func benchmarkHTML() string {
+	var b strings.Builder
+	for i := 0; i < 2000; i++ {
+		fmt.Fprintf(&b, "<tr><td>Order %08d</td><td>tok_%032d</td><td>%d.99</td></tr>\n", i, i%5, i)
+	}
+	return b.String()
+}
+
+func BenchmarkDetokenizeScanRegexp(b *testing.B) {
+	html := benchmarkHTML()
+	tokenRegex := regexp.MustCompile(`tok_[a-zA-Z0-9_\-]+=*`)
+	b.SetBytes(int64(len(html)))
+	for i := 0; i < b.N; i++ {
+		result := html
+		for _, token := range tokenRegex.FindAllString(html, -1) {
+			result = strings.ReplaceAll(result, token, "4111111111111111")
+		}
+	}
+}
+
+func BenchmarkDetokenizeScanScanner(b *testing.B) {
+	html := benchmarkHTML()
+	s := scanner.New([]scanner.TokenPattern{scanner.PrefixTokens()}, false)
+	b.SetBytes(int64(len(html)))
+	for i := 0; i < b.N; i++ {
+		s.Replace(html, func(m scanner.Match, token string) (string, bool) {
+			return "4111111111111111", true
+		})
+	}
+}
+
+func BenchmarkPANScanRegexp(b *testing.B) {
+	html := benchmarkHTML()
+	cardRegex := regexp.MustCompile(`\b(?:4[0-9]{12}(?:[0-9]{3})?|5[1-5][0-9]{14}|3[47][0-9]{13}|3(?:0[0-5]|[68][0-9])[0-9]{11}|6(?:011|5[0-9]{2})[0-9]{12}|(?:2131|1800|35\d{3})\d{11})\b`)
+	b.SetBytes(int64(len(html)))
+	for i := 0; i < b.N; i++ {
+		cardRegex.FindAllString(html, -1)
+	}
+}
+
+func BenchmarkPANScanScanner(b *testing.B) {
+	html := benchmarkHTML()
+	s := scanner.New(nil, true)
+	b.SetBytes(int64(len(html)))
+	for i := 0; i < b.N; i++ {
+		s.Find(html, scanner.PAN)
+	}
+}
+
+// TestLoadgen tests the load generator's synthetic traffic and percentiles
+func TestValidation(t *testing.T) {
+	schemas, err := loadRequestSchemas("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ut := &UnifiedTokenizer{validationConfigs: make(map[string]ValidationConfig)}
+	ut.initializeValidationConfigs(schemas)
+	for endpoint, config := range ut.validationConfigs {
+		if config.Schema == nil {
+			t.Errorf("%s has no request schema", endpoint)
+		}
+	}
+
+	// Values are checked as typed, and never rewritten
+	for _, tc := range []struct {
+		endpoint string
+		body     string
+		valid    bool
+	}{
+		{"/api/v1/users", `{"username":"jdoe","email":"j@example.com","password":"Str0ng!Passw0rd","role":"viewer","full_name":"Selena O'Brien & <Co>"}`, true},
+		{"/api/v1/users", `{"username":"jdoe","email":"j@example.com","password":"Str0ng!Passw0rd","role":"viewer","full_name":"Union Select Ltd"}`, true},
+		{"/api/v1/users", `{"username":"jdoe","email":"j@example.com","password":"Str0ng!Passw0rd","role":"viewer","full_name":"bad\u0000name"}`, false},
+		{"/api/v1/users", `{"username":"jdoe","email":"j@example.com","password":"Str0ng!Passw0rd","role":"Super User"}`, false},
+		{"/api/v1/users", `{"username":42,"email":"j@example.com","password":"Str0ng!Passw0rd","role":"viewer"}`, false},
+		{"/api/v1/tokens/search", `{"limit":50,"tenant":"acme"}`, true},
+		{"/api/v1/tokens/search", `{"limit":0}`, false},
+		{"/api/v1/tokens/search", `{"limit":1001}`, false},
+		{"/api/v1/tokens/search", `{"limit":"50"}`, false},
+		{"/api/v1/tokens/search", `{"limit":2.5}`, false},
+		{"/api/v1/cards/import", `{"format":"csv","batch_size":500,"data":"Y2FyZA=="}`, true},
+		{"/api/v1/cards/import", `{"format":"xml","data":"Y2FyZA=="}`, false},
+		{"/api/v1/cards/import", `{"format":"json","validate_only":true,"data":"W10="}`, true},
+		{"/api/v1/cards/import", `{"format":"json","validate_only":"yes","data":"W10="}`, false},
+		{"/api/v1/cards/import", `{"format":"csv","compression":"gzip","csv":{"delimiter":";","header_aliases":{"PAN":"card_number"}},"data":"Y2FyZA=="}`, true},
+		{"/api/v1/cards/import", `{"format":"csv","csv":{"header_aliases":{"PAN":"cvv"}},"data":"Y2FyZA=="}`, false},
+		{"/api/v1/cards/import", `{"format":"csv","compression":"zip","data":"Y2FyZA=="}`, false},
+		{"/api/v1/cards/import", `{"format":"fixed","fixed_width":{"columns":{"card_number":"1-16","expiry":"17-20"},"expiry_format":"YYMM","record_prefix":"D"},"data":"Y2FyZA=="}`, true},
+		{"/api/v1/cards/import", `{"format":"fixed","fixed_width":{"columns":{"card_number":"1 to 16"}},"data":"Y2FyZA=="}`, false},
+		// Unknown fields are refused, in nested objects too
+		{"/api/v1/users", `{"username":"jdoe","email":"j@example.com","password":"Str0ng!Passw0rd","role":"viewer","is_admin":true}`, false},
+		{"/api/v1/tokens/search", `{"last_four":"1234"}`, false},
+		{"/api/v1/tokens/search", `{"lastFour":"1234","cardType":"Visa","active":true,"tags":{"env":"prod"},"sort":"expiry"}`, true},
+		{"/api/v1/tokens/bulk", `{"operation":"revoke","filter":{"tenant":"acme","active":"yes"}}`, false},
+		{"/api/v1/tokens/bulk", `{"operation":"tag","tokens":["tok_abc"],"tags":{"env":null}}`, true},
+		{"/api/v1/tokens/bulk", `{"operation":"set-expiry","tokens":["tok_abc"],"expiry_month":13,"expiry_year":2030}`, false},
+		{"/api/v1/api-keys", `{"client_name":"billing","permissions":null}`, true},
+		{"/api/v1/auth/me", `{"full_name":null,"email":"j@example.com"}`, true},
+		{"/api/v1/users", `["jdoe"]`, false},
+	} {
+		var data interface{}
+		if err := json.Unmarshal([]byte(tc.body), &data); err != nil {
+			t.Fatal(err)
+		}
+		result := ut.validateRequest(tc.endpoint, data)
+		if result.Valid != tc.valid {
+			t.Errorf("%s %s: valid = %v, want %v (%v)", tc.endpoint, tc.body, result.Valid, tc.valid, result.Errors)
+		}
+	}
+
+	// Password values are never echoed back
+	result := ut.validateRequest("/api/v1/auth/login", map[string]interface{}{"username": "jdoe", "password": "short"})
+	if result.Valid || len(result.Errors) != 1 || result.Errors[0].Value != "[REDACTED]" {
+		t.Errorf("short password: %+v", result)
+	}
+
+	// Errors name nested fields
+	result = ut.validateRequest("/api/v1/tokens/bulk", map[string]interface{}{"operation": "revoke", "filter": map[string]interface{}{"lastFour": "12\x00"}})
+	if len(result.Errors) != 2 || result.Errors[0].Field != "filter.lastFour" || result.Errors[1].Message != "field contains control characters" {
+		t.Errorf("nested errors: %+v", result.Errors)
+	}
+
+	// The middleware passes the body through unchanged
+	ut.waf, _ = waf.New(nil)
+	body := `{"username":"jdoe","email":"j@example.com","password":"Str0ng!Passw0rd","role":"viewer","full_name":"A <b> & 'c'","permissions":["tokens.read"]}`
+	var got string
+	handler := ut.validationMiddleware("/api/v1/users")(func(w http.ResponseWriter, r *http.Request) {
+		data, _ := io.ReadAll(r.Body)
+		got = string(data)
+	})
+	req := httptest.NewRequest("POST", "/api/v1/users", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	handler(httptest.NewRecorder(), req)
+	if got != body {
+		t.Errorf("handler got body %s, want %s", got, body)
+	}
+}
+
+func TestCardFormats(t *testing.T) {
+	parse := func(data string, options cardformat.CSVOptions) ([]CardImportRecord, error) {
+		format, err := cardformat.New("csv", cardformat.Options{CSV: &options})
+		if err != nil {
+			return nil, err
+		}
+		return format.Parse([]byte(data))
+	}
+
+	// Quoted fields keep their delimiters, quotes and line breaks; CRLF
+	// line endings and blank lines are accepted
+	cards, err := parse("card_number,card_holder,expiry_month,expiry_year,metadata\r\n"+
+		"4111111111111111,\"Doe, John\",12,2030,\"{\"\"note\"\": \"\"a\nb\"\"}\"\r\n"+
+		"\r\n"+
+		"5555555555554444, \"Smith, Jane\",6,2031\r\n", cardformat.CSVOptions{})
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	if len(cards) != 2 || cards[0].CardHolder != "Doe, John" || cards[0].Metadata != "{\"note\": \"a\nb\"}" ||
+		cards[1].CardHolder != "Smith, Jane" || cards[1].ExpiryYear != 2031 || cards[1].Metadata != "" {
+		t.Fatalf("parsed %+v", cards)
+	}
+	if cards[0].Line != 2 || cards[1].Line != 5 {
+		t.Errorf("records on lines %d and %d, want 2 and 5", cards[0].Line, cards[1].Line)
+	}
+
+	// Delimiter and header aliases, built in and given
+	cards, err = parse("PAN;Exp Month;EXP-YEAR;Customer\n4111111111111111;1;2030;c-1\n", cardformat.CSVOptions{
+		Delimiter:     ";",
+		HeaderAliases: map[string]string{"customer": "external_id"},
+	})
+	if err != nil || len(cards) != 1 || cards[0].CardNumber != "4111111111111111" || cards[0].ExpiryMonth != 1 || cards[0].ExternalID != "c-1" {
+		t.Fatalf("parse with aliases: %+v, %v", cards, err)
+	}
+	cards, err = parse("card_number\texpiry_month\texpiry_year\n4111111111111111\t1\t2030\n", cardformat.CSVOptions{Delimiter: "\t"})
+	if err != nil || len(cards) != 1 {
+		t.Errorf("parse TSV: %+v, %v", cards, err)
+	}
+
+	// Every row that cannot be read is reported with its line
+	_, err = parse("card_number,expiry_month,expiry_year,card_holder\n"+
+		"4111111111111111,1,2030,Doe, John\n"+
+		"4111111111111111,1,2030\n"+
+		"4111111111111111,x,2030\n"+
+		"4111111111111111\n", cardformat.CSVOptions{})
+	var rowErrors *cardformat.RowErrors
+	if !errors.As(err, &rowErrors) {
+		t.Fatalf("parse of bad rows: %v", err)
+	}
+	var lines []int
+	for _, row := range rowErrors.Rows {
+		lines = append(lines, row.Line)
+	}
+	if fmt.Sprint(lines) != "[2 4 5]" {
+		t.Errorf("errors on lines %v, want [2 4 5]: %v", lines, rowErrors.Rows)
+	}
+
+	_, err = parse("card_number,expiry_month,expiry_year\n4111111111111111,1,2030\n\"41111,1,2030\n", cardformat.CSVOptions{})
+	if !errors.As(err, &rowErrors) || len(rowErrors.Rows) != 1 || rowErrors.Rows[0].Line != 3 {
+		t.Errorf("parse of an unterminated quote: %v", err)
+	}
+	bareQuote := "card_number,expiry_month,expiry_year,card_holder\n4111111111111111,1,2030,Sean \"Jr\" O'Brien\n"
+	if _, err := parse(bareQuote, cardformat.CSVOptions{}); err == nil {
+		t.Error("a quote in an unquoted field was accepted")
+	}
+	if cards, err := parse(bareQuote, cardformat.CSVOptions{LazyQuotes: true}); err != nil || len(cards) != 1 || cards[0].CardHolder != "Sean \"Jr\" O'Brien" {
+		t.Errorf("parse with lazy quotes: %+v, %v", cards, err)
+	}
+
+	for name, tc := range map[string]struct {
+		data    string
+		options cardformat.CSVOptions
+	}{
+		"missing column":      {"card_number,expiry_month\n4111111111111111,1\n", cardformat.CSVOptions{}},
+		"column given twice":  {"card_number,pan,expiry_month,expiry_year\n4111111111111111,4111111111111111,1,2030\n", cardformat.CSVOptions{}},
+		"alias to no column":  {"pan,expiry_month,expiry_year\n4111111111111111,1,2030\n", cardformat.CSVOptions{HeaderAliases: map[string]string{"pan": "cvv"}}},
+		"quote as delimiter":  {"card_number,expiry_month,expiry_year\n", cardformat.CSVOptions{Delimiter: "\""}},
+		"longer delimiter":    {"card_number,expiry_month,expiry_year\n", cardformat.CSVOptions{Delimiter: ";;"}},
+		"header only":         {"card_number,expiry_month,expiry_year\n", cardformat.CSVOptions{}},
+	} {
+		if _, err := parse(tc.data, tc.options); err == nil {
+			t.Errorf("%s: parsed", name)
+		}
+	}
+
+	// Fixed width: only detail records are read, positions count characters
+	fixed, err := cardformat.New("fixed", cardformat.Options{FixedWidth: &cardformat.FixedWidthOptions{
+		Columns:      map[string]string{"card_number": "2-17", "expiry": "18-21", "card_holder": "22-31", "external_id": "32-37"},
+		ExpiryFormat: "yymm",
+		RecordPrefix: "D",
+	}})
+	if err != nil {
+		t.Fatalf("fixed-width layout: %v", err)
+	}
+	cards, err = fixed.Parse([]byte("H20300101ACQUIRER\r\n" +
+		"D41111111111111113012José Doe  ref001\r\n" +
+		"D55555555555544443106Ann\n" +
+		"T000002\n"))
+	if err != nil {
+		t.Fatalf("parse fixed width: %v", err)
+	}
+	if len(cards) != 2 || cards[0].CardNumber != "4111111111111111" || cards[0].ExpiryMonth != 12 || cards[0].ExpiryYear != 2030 ||
+		cards[0].CardHolder != "José Doe" || cards[0].ExternalID != "ref001" || cards[0].Line != 2 ||
+		cards[1].ExpiryMonth != 6 || cards[1].ExpiryYear != 2031 || cards[1].CardHolder != "Ann" || cards[1].ExternalID != "" {
+		t.Errorf("parsed %+v", cards)
+	}
+	_, err = fixed.Parse([]byte("D4111111111111111301\nD41111111111111113X12\nD4111111111111111\n"))
+	if !errors.As(err, &rowErrors) || len(rowErrors.Rows) != 3 || rowErrors.Rows[2].Line != 3 {
+		t.Errorf("parse of short and invalid fixed-width records: %v", err)
+	}
+	for name, layout := range map[string]cardformat.FixedWidthOptions{
+		"no columns":           {},
+		"no card number":       {Columns: map[string]string{"expiry": "1-4"}},
+		"no expiry":            {Columns: map[string]string{"card_number": "1-16", "expiry_month": "17-18"}},
+		"both expiries":        {Columns: map[string]string{"card_number": "1-16", "expiry": "17-20", "expiry_year": "21-24"}},
+		"bad position":         {Columns: map[string]string{"card_number": "16-1", "expiry": "17-20"}},
+		"unknown column":       {Columns: map[string]string{"card_number": "1-16", "expiry": "17-20", "cvv": "21-23"}},
+		"expiry width":         {Columns: map[string]string{"card_number": "1-16", "expiry": "17-22"}},
+		"unknown expiry order": {Columns: map[string]string{"card_number": "1-16", "expiry": "17-20"}, ExpiryFormat: "DDMM"},
+	} {
+		layout := layout
+		if _, err := cardformat.New("fixed", cardformat.Options{FixedWidth: &layout}); err == nil {
+			t.Errorf("%s: layout accepted", name)
+		}
+	}
+	if _, err := cardformat.New("xml", cardformat.Options{}); err == nil {
+		t.Error("an unknown format was accepted")
+	}
+
+	// Compressed data, byte order marks and other character sets become UTF-8
+	var gz bytes.Buffer
+	zw := gzip.NewWriter(&gz)
+	zw.Write([]byte("\xEF\xBB\xBFcard_number,expiry_month,expiry_year\n"))
+	zw.Close()
+	data, err := decodeImportData(gz.Bytes(), CardImportRequest{Format: "csv", Compression: "gzip"})
+	if err != nil || string(data) != "card_number,expiry_month,expiry_year\n" {
+		t.Errorf("gzip data with a byte order mark: %q, %v", data, err)
+	}
+	data, err = decodeImportData([]byte("card_holder\nJos\xe9\n"), CardImportRequest{Format: "csv", Encoding: "latin1"})
+	if err != nil || string(data) != "card_holder\nJosé\n" {
+		t.Errorf("Latin-1 data: %q, %v", data, err)
+	}
+	data, err = decodeImportData([]byte{0xFF, 0xFE, '[', 0, ']', 0}, CardImportRequest{Format: "json"})
+	if err != nil || string(data) != "[]" {
+		t.Errorf("UTF-16 data: %q, %v", data, err)
+	}
+	if _, err := decodeImportData([]byte("not gzip"), CardImportRequest{Compression: "gzip"}); err == nil {
+		t.Error("data that is not gzip was accepted")
+	}
+	if _, err := decodeImportData([]byte("x"), CardImportRequest{Encoding: "ebcdic"}); err == nil {
+		t.Error("an unknown encoding was accepted")
+	}
+}
+
+// TestImportBatchAccounting tests that a batch reports as imported only the
+// cards it stored, and that a rolled-back batch fails those alone
+func TestImportBatchAccounting(t *testing.T) {
+	records := []CardImportRecord{
+		{CardNumber: "4111111111111111", ExternalID: "a"},
+		{CardNumber: "5555555555554444", ExternalID: "b"},
+		{CardNumber: "378282246310005", ExternalID: "c"},
+		{CardNumber: "6011111111111117", ExternalID: "d"},
+	}
+	newBatch := func(result *CardImportResult) *importBatch {
+		b := &importBatch{startIndex: 10, records: records, added: make(map[string]string)}
+		b.added[records[0].CardNumber] = "tok_a"
+		b.generated = append(b.generated, CardImportSuccess{RecordIndex: 10, Token: "tok_a"})
+		// b is skipped as a duplicate, c reuses its token, d is stored
+		skip := CardImportRequest{DuplicateHandling: "skip"}
+		if b.duplicate(result, skip, 11, records[1], "tok_b") {
+			t.Error("a skipped duplicate should not be tokenized")
+		}
+		if b.duplicate(result, CardImportRequest{DuplicateHandling: "reuse"}, 12, records[2], "tok_c") {
+			t.Error("a reused duplicate should not be tokenized")
+		}
+		b.added[records[3].CardNumber] = "tok_d"
+		b.generated = append(b.generated, CardImportSuccess{RecordIndex: 13, Token: "tok_d"})
+		return b
+	}
+
+	var committed CardImportResult
+	seen := make(map[string]string)
+	if stored := newBatch(&committed).commit(&committed, seen); stored != 2 {
+		t.Errorf("commit stored %d cards, want 2", stored)
+	}
+	if committed.SuccessfulImports != 2 || committed.Duplicates != 2 || committed.FailedImports != 0 ||
+		len(committed.TokensGenerated) != 3 || !committed.TokensGenerated[1].Existing {
+		t.Errorf("committed batch: %+v", committed)
+	}
+	if seen[records[0].CardNumber] != "tok_a" || seen[records[3].CardNumber] != "tok_d" || len(seen) != 2 {
+		t.Errorf("seen after commit: %v", seen)
+	}
+
+	var failed CardImportResult
+	newBatch(&failed).fail(&failed, "Transaction commit failed", "connection lost")
+	if failed.SuccessfulImports != 0 || failed.FailedImports != 2 || failed.Duplicates != 2 ||
+		len(failed.TokensGenerated) != 1 || failed.TokensGenerated[0].Token != "tok_c" {
+		t.Errorf("rolled-back batch: %+v", failed)
+	}
+	if len(failed.Errors) != 2 || failed.Errors[0].RecordIndex != 10 || failed.Errors[0].ExternalID != "a" ||
+		failed.Errors[1].RecordIndex != 13 || failed.Errors[1].CardNumber != "****1117" {
+		t.Errorf("rolled-back batch errors: %+v", failed.Errors)
+	}
+
+	var errored CardImportResult
+	b := &importBatch{startIndex: 0, records: records, added: make(map[string]string)}
+	if b.duplicate(&errored, CardImportRequest{DuplicateHandling: "error"}, 0, records[0], "") ||
+		errored.FailedImports != 1 || errored.Errors[0].Reason != "Card is given earlier in the import" {
+		t.Errorf("duplicate as error: %+v", errored)
+	}
+	if !b.duplicate(&errored, CardImportRequest{DuplicateHandling: "overwrite"}, 1, records[1], "tok_b") {
+		t.Error("an overwritten duplicate should be tokenized")
+	}
+}
+
+func TestJSONSchema(t *testing.T) {
+	schema, err := jsonschema.Compile([]byte(`{
+		"$defs": {"count": {"type": "integer", "minimum": 1, "exclusiveMaximum": 10}},
+		"type": "object",
+		"properties": {
+			"name": {"type": "string", "minLength": 2, "maxLength": 3},
+			"count": {"$ref": "#/$defs/count"},
+			"secret": {"type": "string", "pattern": "^[a-z]+$", "writeOnly": true},
+			"kind": {"enum": ["a", "b"]},
+			"list": {"type": "array", "maxItems": 2, "items": {"type": ["string", "null"]}}
+		},
+		"required": ["name"],
+		"additionalProperties": false
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		body string
+		want []string
+	}{
+		{`{"name":"ééé","count":9,"kind":"b","list":["x",null]}`, nil},
+		{`{}`, []string{"name: field is required"}},
+		{`{"name":"abcd","count":10}`, []string{"count: must be less than 10", "name: maximum length is 3 characters"}},
+		{`{"name":"ab","count":1.5,"kind":"c"}`, []string{"count: must be an integer", `kind: must be one of "a", "b"`}},
+		{`{"name":"ab","list":[1,"x","y"]}`, []string{"list: must have at most 2 items", "list[0]: must be a string or null"}},
+		{`{"name":"ab","extra":1}`, []string{"extra: unknown field"}},
+		{`"ab"`, []string{"must be an object"}},
+	} {
+		var v interface{}
+		if err := json.Unmarshal([]byte(tc.body), &v); err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		for _, e := range schema.Validate(v) {
+			got = append(got, e.Error())
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("Validate(%s) = %q, want %q", tc.body, got, tc.want)
+		}
+	}
+	if errs := schema.Validate(map[string]interface{}{"name": "ab", "secret": "X"}); len(errs) != 1 || !errs[0].WriteOnly {
+		t.Errorf("writeOnly error = %+v", errs)
+	}
+
+	for _, doc := range []string{
+		`{"type":"strng"}`,
+		`{"minLength":"3"}`,
+		`{"format":"email"}`,
+		`{"$ref":"#/$defs/missing"}`,
+		`{"properties":{"a":{"$defs":{}}}}`,
+		`{"pattern":"("}`,
+	} {
+		if _, err := jsonschema.Compile([]byte(doc)); err == nil {
+			t.Errorf("Compile(%s) should fail", doc)
+		}
+	}
+}
+
+func TestRequestSchemasFile(t *testing.T) {
+	dir := t.TempDir()
+	write := func(content string) string {
+		path := filepath.Join(dir, "schemas.json")
+		if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+
+	// Entries replace the built-in ones, which can use the shared definitions
+	schemas, err := loadRequestSchemas(write(`{
+		"$defs": {"clientName": {"type": "string", "pattern": "^[a-z]+$"}},
+		"/api/v1/auth/forgot-password": {"type": "object", "properties": {"username": {"$ref": "#/$defs/username"}}, "additionalProperties": false}
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if errs := schemas["/api/v1/auth/forgot-password"].Validate(map[string]interface{}{"username": "a"}); len(errs) == 0 {
+		t.Errorf("overridden forgot-password schema: %v", errs)
+	}
+	if errs := schemas["/api/v1/api-keys"].Validate(map[string]interface{}{"client_name": "Billing App"}); len(errs) != 1 {
+		t.Errorf("overridden clientName definition: %v", errs)
+	}
+	if errs := schemas["/api/v1/auth/login"].Validate(map[string]interface{}{"username": "jdoe", "password": "Str0ng!Passw0rd"}); len(errs) != 0 {
+		t.Errorf("built-in login schema: %v", errs)
+	}
+
+	for _, content := range []string{
+		`{"/api/v1/unknown": {"type": "object"}}`,
+		`{"/api/v1/auth/login": {"type": "object", "minimum": "1"}}`,
+		`{"$defs": []}`,
+		`not json`,
+	} {
+		if _, err := loadRequestSchemas(write(content)); err == nil {
+			t.Errorf("REQUEST_SCHEMAS_FILE %s accepted", content)
+		}
+	}
+	if _, err := loadRequestSchemas(filepath.Join(dir, "missing.json")); err == nil {
+		t.Error("missing REQUEST_SCHEMAS_FILE accepted")
+	}
+}
+
+func TestNotifier(t *testing.T) {
+	var mu sync.Mutex
+	posts := map[string][]map[string]interface{}{}
+	failing := false
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body map[string]interface{}
+		json.NewDecoder(r.Body).Decode(&body)
+		mu.Lock()
+		defer mu.Unlock()
+		if failing {
+			http.Error(w, "invalid_payload", http.StatusBadRequest)
+			return
+		}
+		posts[r.URL.Path] = append(posts[r.URL.Path], body)
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer server.Close()
+	count := func(path string) int {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(posts[path])
+	}
+
+	configs, err := notify.ParseConfigs([]byte(`[
+		{"name": "oncall", "type": "pagerduty", "routing_key": "R0UTINGKEY1234", "url": "` + server.URL + `/pd", "min_severity": "critical"},
+		{"name": "security", "type": "slack", "webhook_url": "` + server.URL + `/slack"},
+		{"name": "leaks", "type": "email", "to": ["soc@example.com", "ciso@example.com"], "events": ["card_data_*", "key_rotation_failed"], "throttle": "0s"}
+	]`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	mail := &capturedMail{}
+	n, err := notify.New(configs, mail, server.Client())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Channels without events get high and critical events; listed events
+	// are sent whatever their severity
+	n.Deliver(notify.Event{Type: "card_data_detected", Severity: "medium", Endpoint: "/checkout", IPAddress: "10.0.0.9"})
+	n.Deliver(notify.Event{Type: "login_failed", Severity: "low"})
+	n.Deliver(notify.Event{Type: "key_rotation_failed", Severity: "high"})
+	n.Deliver(notify.Event{Type: "vault_sealed", Severity: "critical"})
+	if count("/pd") != 1 || count("/slack") != 2 || len(mail.messages) != 4 {
+		t.Fatalf("pagerduty %d, slack %d, email %d, want 1, 2 and 4", count("/pd"), count("/slack"), len(mail.messages))
+	}
+	if msg := mail.messages[0]; msg.To != "soc@example.com" || !strings.Contains(msg.Subject, "[MEDIUM] card_data_detected on /checkout") || !strings.Contains(msg.Body, "Client IP: 10.0.0.9") {
+		t.Errorf("email = %+v", msg)
+	}
+	payload, _ := posts["/pd"][0]["payload"].(map[string]interface{})
+	if posts["/pd"][0]["routing_key"] != "R0UTINGKEY1234" || posts["/pd"][0]["dedup_key"] != "tokenshield:vault_sealed:" || payload["severity"] != "critical" {
+		t.Errorf("pagerduty event = %v", posts["/pd"][0])
+	}
+
+	// Repeats within the throttle are held back, and counted in the next
+	// notification once it has passed
+	for i := 0; i < 3; i++ {
+		n.Deliver(notify.Event{Type: "key_rotation_failed", Severity: "high"})
+	}
+	if count("/slack") != 2 || len(mail.messages) != 10 {
+		t.Errorf("throttled repeats: slack %d, email %d, want 2 and 10", count("/slack"), len(mail.messages))
+	}
+	status := n.Status()
+	if len(status) != 3 || status[1].Throttled != 3 || status[1].Sent != 2 || status[0].Target != "routing key …1234" || strings.Contains(status[1].Target, "/slack") {
+		t.Errorf("Status() = %+v", status)
+	}
+
+	// Test notifications go to the named channel whatever its routing, and
+	// report failures
+	results, ok := n.Test("oncall", notify.Event{Type: "notification_test", Severity: "low"})
+	if !ok || len(results) != 1 || !results[0].Delivered || count("/pd") != 2 {
+		t.Errorf("Test(oncall) = %+v, %v", results, ok)
+	}
+	mu.Lock()
+	failing = true
+	mu.Unlock()
+	results, ok = n.Test("", notify.Event{Type: "notification_test", Severity: "critical"})
+	if !ok || len(results) != 3 || results[1].Delivered || !strings.Contains(results[1].Error, "invalid_payload") || !results[2].Delivered {
+		t.Errorf("Test() = %+v", results)
+	}
+	if _, ok := n.Test("nobody", notify.Event{}); ok {
+		t.Error("Test() of an unknown channel succeeded")
+	}
+	if status := n.Status(); status[1].Failed != 1 || status[1].LastError == "" {
+		t.Errorf("failed channel status = %+v", status[1])
+	}
+
+	for _, config := range []string{
+		`[{"name": "a", "type": "sms"}]`,
+		`[{"name": "a", "type": "email"}]`,
+		`[{"name": "a", "type": "slack", "webhook_url": "hooks.slack.com/x"}]`,
+		`[{"name": "a", "type": "pagerduty"}]`,
+		`[{"name": "a", "type": "pagerduty", "routing_key": "k", "min_severity": "urgent"}]`,
+		`[{"name": "a", "type": "pagerduty", "routing_key": "k", "events": ["key_*_failed"]}]`,
+		`[{"name": "a", "type": "pagerduty", "routing_key": "k", "throttle": "soon"}]`,
+		`[{"name": "a", "type": "pagerduty", "routing_key": "k"}, {"name": "a", "type": "pagerduty", "routing_key": "k"}]`,
+		`[{"name": "On Call", "type": "pagerduty", "routing_key": "k"}]`,
+	} {
+		if _, err := notify.ParseConfigs([]byte(config)); err == nil {
+			t.Errorf("ParseConfigs(%s) accepted", config)
+		}
+	}
+	t.Setenv("NOTIFICATION_CHANNELS", `[{"name": "soc", "type": "email", "to": ["soc@example.com"]}]`)
+	if _, err := loadNotifier(nil); err == nil {
+		t.Error("email channel without a mail server accepted")
+	}
+
+	// Without channels nothing is sent, and the status is empty
+	off := &UnifiedTokenizer{}
+	off.notifier.Notify(notify.Event{Type: "vault_sealed", Severity: "critical"})
+	rec := httptest.NewRecorder()
+	off.handleNotifications(rec, httptest.NewRequest("GET", "/api/v1/notifications", nil))
+	if rec.Body.String() != `{"channels":[],"dropped":0}`+"\n" {
+		t.Errorf("GET /api/v1/notifications without channels = %s", rec.Body)
+	}
+}
+
+func TestWAFDetector(t *testing.T) {
+	detector, err := waf.New(waf.DefaultRules)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, value := range []string{"1' OR '1'='1", "x UNION ALL SELECT password FROM users", "'; DROP TABLE users; --", "<script>alert(1)</script>", "<img src=x onerror=alert(1)>", "javascript:alert(1)"} {
+		if len(detector.Match(value)) == 0 {
+			t.Errorf("%q not detected", value)
+		}
+	}
+	for _, value := range []string{"Selena O'Brien", "Selectric Ltd", "Tom & Jerry", "drop-off point", "1 = 1"} {
+		if rules := detector.Match(value); len(rules) > 0 {
+			t.Errorf("%q matched %v", value, rules)
+		}
+	}
+
+	found := detector.Scan(map[string]interface{}{
+		"name":  "ok",
+		"cards": []interface{}{map[string]interface{}{"holder": "x' OR 'a'='a"}},
+	})
+	if len(found) != 1 || len(found["cards[0].holder"]) == 0 {
+		t.Errorf("Scan = %v", found)
+	}
+	var disabled *waf.Detector
+	if len(disabled.Scan(map[string]interface{}{"q": "<script>"})) != 0 {
+		t.Error("nil detector matched")
+	}
+
+	t.Setenv("WAF_RULES", `[{"name":"bad","pattern":"("}]`)
+	if _, err := loadWAFDetector(); err == nil {
+		t.Error("invalid WAF_RULES accepted")
+	}
+	t.Setenv("WAF_RULES", `[{"name":"foo","pattern":"(?i)foo"}]`)
+	if d, err := loadWAFDetector(); err != nil || len(d.Match("FOO")) != 1 || len(d.Match("<script>")) != 0 {
+		t.Errorf("custom WAF_RULES: %v", err)
+	}
+	t.Setenv("WAF_DETECTION", "false")
+	if d, err := loadWAFDetector(); err != nil || d != nil {
+		t.Errorf("WAF_DETECTION=false: %v, %v", d, err)
+	}
+}
+
+func TestSQLBuild(t *testing.T) {
+	columns := sqlbuild.Columns{"last_four": "last_four_digits", "expiry": "expiry_year * 100 + expiry_month"}
+
+	query := columns.Select().Eq("last_four", "1234").Where("expiry", ">=", 203001).Sort("expiry", true)
+	where, args, err := query.WhereClause()
+	if err != nil || where != " WHERE last_four_digits = ? AND expiry_year * 100 + expiry_month >= ?" || len(args) != 2 {
+		t.Errorf("WhereClause() = %q, %v, %v", where, args, err)
+	}
+	if order, err := query.OrderClause(); err != nil || order != " ORDER BY expiry_year * 100 + expiry_month DESC" {
+		t.Errorf("OrderClause() = %q, %v", order, err)
+	}
+	if where, args, err := columns.Select().WhereClause(); err != nil || where != "" || len(args) != 0 {
+		t.Errorf("empty WhereClause() = %q, %v, %v", where, args, err)
+	}
+
+	// Names and operators outside the allow-lists are refused
+	for _, q := range []*sqlbuild.Select{
+		columns.Select().Eq("card_number_encrypted", "x"),
+		columns.Select().Eq("last_four", "1").Sort("last_four; DROP TABLE users", false),
+		columns.Select().Where("last_four", "LIKE", "%"),
+	} {
+		if _, _, err := q.WhereClause(); err == nil {
+			t.Error("invalid query accepted")
+		}
+	}
+
+	// Conditions are full expressions with one placeholder per value
+	tagged := sqlbuild.Columns{"tag": "EXISTS (SELECT 1 FROM t WHERE k = ? AND v = ?)"}
+	if where, args, err := tagged.Select().Cond("tag", "env", "prod").WhereClause(); err != nil ||
+		where != " WHERE EXISTS (SELECT 1 FROM t WHERE k = ? AND v = ?)" || len(args) != 2 {
+		t.Errorf("Cond WhereClause() = %q, %v, %v", where, args, err)
+	}
+	if _, _, err := tagged.Select().Cond("tag", "env").WhereClause(); err == nil {
+		t.Error("Cond with too few values accepted")
+	}
+
+	if got := sqlbuild.Placeholders(3); got != "?, ?, ?" {
+		t.Errorf("Placeholders(3) = %q", got)
+	}
+
+	set, args, err := columns.Update().Set("last_four", "9999").SetClause()
+	if err != nil || set != "last_four_digits = ?" || len(args) != 1 {
+		t.Errorf("SetClause() = %q, %v, %v", set, args, err)
+	}
+	if _, _, err := columns.Update().Set("role", "admin").SetClause(); err == nil {
+		t.Error("update of a field outside the allow-list accepted")
+	}
+	if _, _, err := columns.Update().SetClause(); err == nil {
+		t.Error("empty update accepted")
+	}
+
+	if month, err := parseExpiryMonth("2031-04"); err != nil || month != 203104 {
+		t.Errorf("parseExpiryMonth(2031-04) = %d, %v", month, err)
+	}
+	if _, err := parseExpiryMonth("04/31"); err == nil {
+		t.Error("parseExpiryMonth accepted 04/31")
+	}
+}
+
+func TestSecureRand(t *testing.T) {
+	counts := make([]int, 3)
+	for i := 0; i < 3000; i++ {
+		counts[securerand.Int(3)]++
+	}
+	for v, c := range counts {
+		if c < 800 || c > 1200 {
+			t.Errorf("Int(3) returned %d %d times in 3000 draws", v, c)
+		}
+	}
+
+	digits := securerand.Digits(11)
+	if len(digits) != 11 || strings.Trim(digits, "0123456789") != "" {
+		t.Errorf("Digits(11) = %q", digits)
+	}
+	if securerand.Digits(32) == securerand.Digits(32) {
+		t.Error("Digits repeated")
+	}
+
+	values := []int{0, 1, 2, 3, 4, 5, 6, 7}
+	securerand.Shuffle(len(values), func(i, j int) { values[i], values[j] = values[j], values[i] })
+	seen := make(map[int]bool)
+	for _, v := range values {
+		seen[v] = true
+	}
+	if len(seen) != 8 {
+		t.Errorf("Shuffle lost elements: %v", values)
+	}
+
+	// Generated passwords have every character class and do not repeat
+	passwords := make(map[string]bool)
+	for i := 0; i < 50; i++ {
+		password := generateSecurePassword(16)
+		if len(password) != 16 || !strings.ContainsAny(password, "ABCDEFGHIJKLMNOPQRSTUVWXYZ") ||
+			!strings.ContainsAny(password, "abcdefghijklmnopqrstuvwxyz") ||
+			!strings.ContainsAny(password, "0123456789") || !strings.ContainsAny(password, "!@#$%^&*") {
+			t.Errorf("generateSecurePassword(16) = %q", password)
+		}
+		passwords[password] = true
+	}
+	if len(passwords) != 50 {
+		t.Error("generateSecurePassword repeated a password")
+	}
+}
+
+func TestBulkTokenRequest(t *testing.T) {
+	gold := "gold"
+	empty := ""
+	year := time.Now().Year() + 1
+	for _, tc := range []struct {
+		req   BulkTokenRequest
+		valid bool
+	}{
+		{BulkTokenRequest{Operation: bulkRevoke, Tokens: []string{"tok_a"}}, true},
+		{BulkTokenRequest{Operation: bulkRevoke, Filter: &tokenFilter{Tenant: "acme"}}, true},
+		{BulkTokenRequest{Operation: bulkRevoke}, false},
+		{BulkTokenRequest{Operation: bulkRevoke, Tokens: []string{"tok_a"}, Filter: &tokenFilter{}}, false},
+		{BulkTokenRequest{Operation: bulkRevoke, Tokens: make([]string, maxBulkTokens+1)}, false},
+		{BulkTokenRequest{Operation: bulkSetExpiry, Tokens: []string{"tok_a"}, ExpiryMonth: 12, ExpiryYear: year}, true},
+		{BulkTokenRequest{Operation: bulkSetExpiry, Tokens: []string{"tok_a"}, ExpiryMonth: 13, ExpiryYear: year}, false},
+		{BulkTokenRequest{Operation: bulkSetExpiry, Tokens: []string{"tok_a"}, ExpiryMonth: 1}, false},
+		{BulkTokenRequest{Operation: bulkTag, Tokens: []string{"tok_a"}, Tags: map[string]*string{"plan": &gold, "old": nil}}, true},
+		{BulkTokenRequest{Operation: bulkTag, Tokens: []string{"tok_a"}}, false},
+		{BulkTokenRequest{Operation: bulkTag, Tokens: []string{"tok_a"}, Tags: map[string]*string{"bad key": &gold}}, false},
+		{BulkTokenRequest{Operation: bulkTag, Tokens: []string{"tok_a"}, Tags: map[string]*string{"plan": &empty}}, false},
+	} {
+		if err := tc.req.validate(); (err == nil) != tc.valid {
+			t.Errorf("validate(%+v) = %v, want valid %v", tc.req, err, tc.valid)
+		}
+	}
+}
+
+func TestTags(t *testing.T) {
+	// Tags in an import's text formats are checked with the rest of the record
+	parseTagList := func(list string) (map[string]string, error) {
+		tags, err := cardformat.ParseTags(list)
+		if err != nil {
+			return nil, err
+		}
+		return tags, validateTags(tags)
+	}
+	tags, err := parseTagList(" env=prod ; merchant=acme:eu;")
+	if err != nil || len(tags) != 2 || tags["env"] != "prod" || tags["merchant"] != "acme:eu" {
+		t.Errorf("parseTagList = %v, %v", tags, err)
+	}
+	for _, list := range []string{"env", "=prod", "bad key=x", "env=", "k=" + strings.Repeat("x", maxTagValueLength+1)} {
+		if _, err := parseTagList(list); err == nil {
+			t.Errorf("parseTagList(%q) accepted", list)
+		}
+	}
+
+	many := make(map[string]string)
+	for i := 0; i <= maxTagsPerToken; i++ {
+		many[fmt.Sprintf("k%d", i)] = "v"
+	}
+	if validateTags(many) == nil {
+		t.Errorf("%d tags accepted", len(many))
+	}
+	if validateTags(nil) != nil {
+		t.Error("no tags refused")
+	}
+
+	// Record tags win over the import's
+	merged := mergeTags(map[string]string{"env": "prod", "batch": "1"}, map[string]string{"env": "test"})
+	if !reflect.DeepEqual(merged, map[string]string{"env": "test", "batch": "1"}) {
+		t.Errorf("mergeTags = %v", merged)
+	}
+
+	// Tag filters become one EXISTS condition per tag, in key order
+	query := tokenSearchColumns.Select()
+	if err := addTagConds(query, map[string]string{"merchant": "acme", "env": "prod"}); err != nil {
+		t.Fatal(err)
+	}
+	if where, args, err := query.WhereClause(); err != nil || strings.Count(where, "EXISTS") != 2 ||
+		!reflect.DeepEqual(args, []interface{}{"env", "prod", "merchant", "acme"}) {
+		t.Errorf("tag filter = %q, %v, %v", where, args, err)
+	}
+	if addTagConds(tokenSearchColumns.Select(), map[string]string{"env' OR '1'='1": "x"}) == nil {
+		t.Error("tag filter with an invalid key accepted")
+	}
+}
+
+func TestOpenAPI(t *testing.T) {
+	routes := (&UnifiedTokenizer{useKEKDEK: true}).apiRoutes()
+	doc := openapi.Build(openapi.Info{Title: "test", Version: apiVersion}, routes)
+	if _, err := json.Marshal(doc); err != nil {
+		t.Fatal(err)
+	}
+
+	ids := make(map[string]bool)
+	for path, item := range doc.Paths {
+		if path != "/health" && !strings.HasPrefix(path, "/api/v1/") && !strings.HasPrefix(path, "/api/v2/") {
+			t.Errorf("path %s is outside the API", path)
+		}
+		for method, op := range item {
+			if ids[op.OperationID] {
+				t.Errorf("%s %s: duplicate operationId %s", method, path, op.OperationID)
+			}
+			ids[op.OperationID] = true
+		}
+	}
+	if len(ids) != len(routes) {
+		t.Errorf("%d operations for %d routes; a route is listed twice", len(ids), len(routes))
+	}
+
+	login := doc.Paths["/api/v1/auth/login"]["post"]
+	if len(login.Security) != 0 || login.RequestBody == nil {
+		t.Errorf("login should be public with a body, got %+v", login)
+	}
+	reveal := doc.Paths["/api/v1/tokens/{token}/reveal"]["post"]
+	if reveal.Permission != PermTokensDetokenize || len(reveal.Parameters) != 1 || reveal.Parameters[0].In != "path" {
+		t.Errorf("reveal operation = %+v", reveal)
+	}
+	if _, ok := reveal.Responses["403"]; !ok {
+		t.Error("reveal has no 403 response")
+	}
+
+	// The embedded filter's fields are part of the search body, and only
+	// fields without omitempty are required
+	search := doc.Components.Schemas["TokenSearchRequest"]
+	if search == nil || search.Properties["lastFour"] == nil || search.Properties["tags"] == nil || search.Properties["sort"] == nil {
+		t.Fatalf("TokenSearchRequest schema = %+v", search)
+	}
+	if len(search.Required) != 0 {
+		t.Errorf("TokenSearchRequest requires %v", search.Required)
+	}
+	if tags := search.Properties["tags"]; tags.Type != "object" || tags.AdditionalProperties.Type != "string" {
+		t.Errorf("tags schema = %+v", tags)
+	}
+	if auth := doc.Components.Schemas["AuthRequest"]; auth == nil || !reflect.DeepEqual(auth.Required, []string{"password", "username"}) {
+		t.Errorf("AuthRequest schema = %+v", auth)
+	}
+	if bulk := doc.Components.Schemas["BulkTokenRequest"]; bulk == nil || bulk.Properties["filter"].Ref != "#/components/schemas/tokenFilter" {
+		t.Errorf("BulkTokenRequest schema = %+v", bulk)
+	}
+	if expires := doc.Components.Schemas["AuthResponse"].Properties["expires_at"]; expires.Format != "date-time" {
+		t.Errorf("AuthResponse.expires_at = %+v", expires)
+	}
+
+	if len((&UnifiedTokenizer{}).apiRoutes()) >= len(routes) {
+		t.Error("key management routes listed without KEK/DEK")
+	}
+}
+
+func TestAPIVersionRouter(t *testing.T) {
+	router := apiversion.New(2)
+	served := func(name string) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			io.WriteString(w, name+" "+r.URL.Path)
+		}
+	}
+	router.Mux(1).HandleFunc("/health", served("health"))
+	router.Mux(1).HandleFunc("/api/v1/tokens", served("v1 list"))
+	router.Mux(1).HandleFunc("/api/v1/tokens/", served("v1 token"))
+	router.Mux(1).HandleFunc("/api/v1/users", served("v1 users"))
+	router.Mux(2).HandleFunc("/api/v2/tokens", served("v2 list"))
+
+	sunset := time.Date(2027, 6, 30, 0, 0, 0, 0, time.UTC)
+	router.Deprecate(1, "/api/v1/tokens", apiversion.Deprecation{
+		Method: "GET", Since: time.Unix(1700000000, 0), Sunset: sunset, Successor: "/api/v2/tokens",
+	})
+	var deprecated int
+	router.OnDeprecated = func(r *http.Request, version int, pattern string) { deprecated++ }
+	now := sunset.Add(-time.Hour)
+	router.Now = func() time.Time { return now }
+
+	// The middleware sees the path of the version that serves the request
+	var seen string
+	handler := router.Handler(func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			seen = r.URL.Path
+			h.ServeHTTP(w, r)
+		})
+	})
+	get := func(method, path string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(method, path, nil))
+		return rec
+	}
+
+	for _, tc := range []struct {
+		path, body, version, seen string
+	}{
+		{"/health", "health /health", "", "/health"},
+		{"/api/v2/tokens", "v2 list /api/v2/tokens", "2", "/api/v2/tokens"},
+		{"/api/v2/tokens/tok_1", "v1 token /api/v1/tokens/tok_1", "1", "/api/v1/tokens/tok_1"},
+		{"/api/v2/users", "v1 users /api/v1/users", "1", "/api/v1/users"},
+		{"/api/v1/users", "v1 users /api/v1/users", "1", "/api/v1/users"},
+	} {
+		rec := get("GET", tc.path)
+		if rec.Code != http.StatusOK || rec.Body.String() != tc.body || rec.Header().Get(apiversion.Header) != tc.version || seen != tc.seen {
+			t.Errorf("GET %s = %d %q, version %q, middleware saw %q", tc.path, rec.Code, rec.Body.String(), rec.Header().Get(apiversion.Header), seen)
+		}
+		if rec.Header().Get("Deprecation") != "" {
+			t.Errorf("GET %s is marked deprecated", tc.path)
+		}
+	}
+	if rec := get("GET", "/api/v3/tokens"); rec.Code != http.StatusNotFound {
+		t.Errorf("unknown version = %d", rec.Code)
+	}
+	if rec := get("GET", "/api/v2/nothing"); rec.Code != http.StatusNotFound {
+		t.Errorf("unregistered path = %d", rec.Code)
+	}
+
+	rec := get("GET", "/api/v1/tokens")
+	if rec.Code != http.StatusOK || rec.Header().Get("Deprecation") != "@1700000000" ||
+		rec.Header().Get("Sunset") != "Wed, 30 Jun 2027 00:00:00 GMT" ||
+		rec.Header().Get("Link") != `</api/v2/tokens>; rel="successor-version"` || deprecated != 1 {
+		t.Errorf("deprecated list = %d %v, counted %d", rec.Code, rec.Header(), deprecated)
+	}
+	// Only GET is deprecated
+	if rec := get("POST", "/api/v1/tokens"); rec.Header().Get("Deprecation") != "" || deprecated != 1 {
+		t.Errorf("POST is marked deprecated: %v", rec.Header())
+	}
+
+	now = sunset
+	rec = get("GET", "/api/v1/tokens")
+	var body map[string]string
+	json.Unmarshal(rec.Body.Bytes(), &body)
+	if rec.Code != http.StatusGone || !strings.Contains(body["error"], "/api/v2/tokens") {
+		t.Errorf("after sunset = %d %s", rec.Code, rec.Body.String())
+	}
+}
+
+func TestAPIErrors(t *testing.T) {
+	handler := apierror.RequestIDs(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		apierror.WriteDetails(w, r, http.StatusConflict, apierror.JobRunning, "A job is already running", map[string]interface{}{"check_id": "chk_1"})
+	}))
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("POST", "/api/v1/integrity-checks", nil))
+	var body map[string]interface{}
+	if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+		t.Fatal(err)
+	}
+	id := rec.Header().Get(apierror.RequestIDHeader)
+	details, _ := body["details"].(map[string]interface{})
+	if rec.Code != http.StatusConflict || !strings.HasPrefix(id, "req_") || body["request_id"] != id ||
+		body["code"] != apierror.JobRunning || body["message"] != "A job is already running" || details["check_id"] != "chk_1" {
+		t.Errorf("error response = %d %s, request ID %q", rec.Code, rec.Body.String(), id)
+	}
+	// Legacy fields
+	if body["error"] != body["message"] || body["check_id"] != "chk_1" {
+		t.Errorf("legacy fields missing: %s", rec.Body.String())
+	}
+
+	// A usable client request ID is kept; anything else is replaced
+	for given, kept := range map[string]bool{"trace-42.a:b": true, "": false, "has space": false, strings.Repeat("x", 65): false} {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Header.Set(apierror.RequestIDHeader, given)
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		if got := rec.Header().Get(apierror.RequestIDHeader); (got == given) != kept || got == "" {
+			t.Errorf("request ID %q became %q", given, got)
+		}
+	}
+
+	for status, code := range map[int]string{
+		http.StatusBadRequest:            apierror.InvalidRequest,
+		http.StatusUnauthorized:          apierror.AuthenticationRequired,
+		http.StatusNotFound:              apierror.NotFound,
+		http.StatusTooManyRequests:       apierror.RateLimited,
+		http.StatusServiceUnavailable:    apierror.InternalError,
+		http.StatusRequestEntityTooLarge: apierror.InvalidRequest,
+	} {
+		if got := apierror.CodeForStatus(status); got != code {
+			t.Errorf("CodeForStatus(%d) = %s, want %s", status, got, code)
+		}
+	}
+}
+
+func TestCompression(t *testing.T) {
+	body := []byte(strings.Repeat(`{"card_number":"4111111111111111"}`, 50))
+	for _, coding := range []string{"gzip", "x-gzip", "deflate", "gzip, deflate", "identity", ""} {
+		encoded, err := compression.Encode(coding, body)
+		if err != nil {
+			t.Fatalf("Encode(%q): %v", coding, err)
+		}
+		decoded, err := compression.Decode(coding, encoded, int64(len(body)))
+		if err != nil || !bytes.Equal(decoded, body) {
+			t.Errorf("%q round trip = %q, %v", coding, decoded, err)
+		}
+		if _, err := compression.Decode(coding, encoded, int64(len(body)-1)); !errors.Is(err, compression.ErrTooLarge) {
+			t.Errorf("%q over the limit: %v", coding, err)
+		}
+	}
+
+	// Raw DEFLATE, as some servers send for "deflate"
+	var raw bytes.Buffer
+	fw, _ := flate.NewWriter(&raw, flate.DefaultCompression)
+	fw.Write(body)
+	fw.Close()
+	if decoded, err := compression.Decode("deflate", raw.Bytes(), 1<<20); err != nil || !bytes.Equal(decoded, body) {
+		t.Errorf("raw deflate = %q, %v", decoded, err)
+	}
+
+	var unsupported *compression.UnsupportedError
+	if _, err := compression.Decode("br", body, 1<<20); !errors.As(err, &unsupported) || unsupported.Coding != "br" {
+		t.Errorf("Decode(br) error = %v", err)
+	}
+	if compression.Supported("gzip, zstd") || !compression.Supported("GZIP") || compression.Encoded("identity") || !compression.Encoded("br") {
+		t.Error("Supported or Encoded misjudged a coding")
+	}
+	for header, want := range map[string]string{
+		"gzip, deflate, br":    "gzip, deflate",
+		"br;q=1.0, gzip;q=0.5": "gzip;q=0.5",
+		"br, zstd":             "",
+		"*":                    "gzip, deflate",
+	} {
+		if got := compression.AcceptEncoding(header); got != want {
+			t.Errorf("AcceptEncoding(%q) = %q, want %q", header, got, want)
+		}
+	}
+
+	handler := compression.Gzip(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if r.URL.Path == "/small" {
+			w.Write([]byte(`{}`))
+			return
+		}
+		w.Write(body[:100])
+		w.Write(body[100:])
+	}), 1024)
+	for _, tc := range []struct {
+		path, accept, encoding string
+	}{
+		{"/large", "gzip, deflate", "gzip"},
+		{"/large", "gzip;q=0", ""},
+		{"/large", "", ""},
+		{"/small", "gzip", ""},
+	} {
+		req := httptest.NewRequest("GET", tc.path, nil)
+		req.Header.Set("Accept-Encoding", tc.accept)
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		got := rec.Body.Bytes()
+		if enc := rec.Header().Get("Content-Encoding"); enc != tc.encoding {
+			t.Errorf("%s with Accept-Encoding %q: Content-Encoding %q, want %q", tc.path, tc.accept, enc, tc.encoding)
+			continue
+		}
+		decoded, err := compression.Decode(tc.encoding, got, 1<<20)
+		want := body
+		if tc.path == "/small" {
+			want = []byte(`{}`)
+		}
+		if err != nil || !bytes.Equal(decoded, want) || rec.Header().Get("Vary") != "Accept-Encoding" {
+			t.Errorf("%s with Accept-Encoding %q: body %q, %v", tc.path, tc.accept, decoded, err)
+		}
+	}
+}
+
+func TestCharset(t *testing.T) {
+	text := `{"name":"José Müller €","card_number":"4111111111111111"}`
+	for _, tc := range []struct {
+		contentType string
+		head        []byte
+		want        charset.Encoding
+	}{
+		{"application/json", []byte(`{"a"`), charset.Encoding{Name: charset.UTF8}},
+		{"application/json; charset=ISO-8859-1", []byte(`{"a"`), charset.Encoding{Name: charset.ISO88591}},
+		{"text/html; charset=latin1", []byte(`<htm`), charset.Encoding{Name: charset.ISO88591}},
+		{"text/html; charset=\"windows-1252\"", nil, charset.Encoding{Name: charset.Windows1252}},
+		{"application/json; charset=utf-16", []byte{0xFF, 0xFE, '{', 0}, charset.Encoding{Name: charset.UTF16LE, BOM: true}},
+		{"application/json; charset=utf-16", []byte{0, '{', 0, '"'}, charset.Encoding{Name: charset.UTF16BE}},
+		{"application/json", []byte{'{', 0, '"', 0}, charset.Encoding{Name: charset.UTF16LE}},
+		{"application/json", []byte{0, '{', 0, '"'}, charset.Encoding{Name: charset.UTF16BE}},
+		{"application/json", []byte{0xEF, 0xBB, 0xBF, '{'}, charset.Encoding{Name: charset.UTF8, BOM: true}},
+		{"text/plain", []byte{'a', 0}, charset.Encoding{Name: charset.UTF8}},
+	} {
+		if got, err := charset.Detect(tc.contentType, tc.head); err != nil || got != tc.want {
+			t.Errorf("Detect(%q, %q) = %+v, %v, want %+v", tc.contentType, tc.head, got, err, tc.want)
+		}
+	}
+	var unsupported *charset.UnsupportedError
+	if _, err := charset.Detect("text/html; charset=Shift_JIS", nil); !errors.As(err, &unsupported) || unsupported.Charset != "shift_jis" {
+		t.Errorf("Detect(Shift_JIS) error = %v", err)
+	}
+
+	latin1 := []byte("{\"name\":\"Jos\xe9\"}")
+	if got, err := (charset.Encoding{Name: charset.ISO88591}).Decode(latin1); err != nil || got != `{"name":"José"}` {
+		t.Errorf("ISO-8859-1 Decode = %q, %v", got, err)
+	}
+	if got, err := (charset.Encoding{Name: charset.Windows1252}).Decode([]byte{0x80, 0x93}); err != nil || got != "€“" {
+		t.Errorf("Windows-1252 Decode = %q, %v", got, err)
+	}
+	if _, err := (charset.Encoding{Name: charset.ISO88591}).Encode("€"); err == nil {
+		t.Error("ISO-8859-1 Encode of € succeeded")
+	}
+
+	for _, enc := range []charset.Encoding{
+		{Name: charset.UTF8, BOM: true},
+		{Name: charset.Windows1252},
+		{Name: charset.UTF16LE},
+		{Name: charset.UTF16LE, BOM: true},
+		{Name: charset.UTF16BE, BOM: true},
+	} {
+		encoded, err := enc.Encode(text)
+		if err != nil {
+			t.Fatalf("%+v Encode: %v", enc, err)
+		}
+		detected, err := charset.Detect("application/json", encoded)
+		if err != nil || (enc.BOM || enc.Name == charset.UTF16LE) && detected != enc {
+			t.Errorf("%+v detected as %+v, %v", enc, detected, err)
+		}
+		decoded, err := enc.Decode(encoded)
+		if err != nil || decoded != text {
+			t.Errorf("%+v round trip = %q, %v", enc, decoded, err)
+		}
+
+		// Streamed a byte at a time, splitting characters across writes
+		var streamed bytes.Buffer
+		w := enc.NewWriter(&streamed)
+		for i := 0; i < len(text); i++ {
+			w.Write([]byte{text[i]})
+		}
+		w.Close()
+		if !bytes.Equal(streamed.Bytes(), encoded) {
+			t.Errorf("%+v streamed encoding = %q, want %q", enc, streamed.Bytes(), encoded)
+		}
+	}
+
+	// Characters outside the BMP take a surrogate pair
+	utf16be := charset.Encoding{Name: charset.UTF16BE}
+	if encoded, _ := utf16be.Encode("😀"); !bytes.Equal(encoded, []byte{0xD8, 0x3D, 0xDE, 0x00}) {
+		t.Errorf("UTF-16BE Encode(😀) = % x", encoded)
+	} else if decoded, err := utf16be.Decode(encoded); err != nil || decoded != "😀" {
+		t.Errorf("UTF-16BE Decode = %q, %v", decoded, err)
+	}
+}
+
+func TestDeepScan(t *testing.T) {
+	rules, err := deepscan.Parse("payload, Data:base64,*:json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for field, want := range map[string][2]bool{
+		"PAYLOAD": {true, true},
+		"data":    {true, true},
+		"other":   {true, false},
+	} {
+		if asJSON, asBase64 := rules.Match(field); asJSON != want[0] || asBase64 != want[1] {
+			t.Errorf("Match(%q) = %v, %v, want %v", field, asJSON, asBase64, want)
+		}
+	}
+	for _, bad := range []string{"payload:xml", ":json"} {
+		if _, err := deepscan.Parse(bad); err == nil {
+			t.Errorf("Parse(%q) succeeded", bad)
+		}
+	}
+	if rules, _ := deepscan.Parse(""); len(rules) != 0 {
+		t.Errorf("Parse(\"\") = %v, want no rules", rules)
+	}
+
+	inner := `{"card_number":"4111111111111111"}`
+	for _, tc := range []struct {
+		value            string
+		asJSON, asBase64 bool
+		mode             string
+	}{
+		{inner, true, false, deepscan.JSON},
+		{base64.StdEncoding.EncodeToString([]byte(inner)), false, true, deepscan.Base64},
+		{base64.RawURLEncoding.EncodeToString([]byte(`[` + inner + `]`)), true, true, deepscan.Base64},
+	} {
+		value, wrapping, ok := deepscan.Decode(tc.value, tc.asJSON, tc.asBase64)
+		if !ok || wrapping.Mode() != tc.mode {
+			t.Errorf("Decode(%q) = %v, %v, want %s", tc.value, value, ok, tc.mode)
+			continue
+		}
+		if encoded, err := wrapping.Encode(value); err != nil || encoded != tc.value {
+			t.Errorf("Encode of %q = %q, %v", tc.value, encoded, err)
+		}
+	}
+	for _, value := range []string{"4111111111111111", `"quoted"`, "aGVsbG8gd29ybGQ=", "not json {"} {
+		if _, _, ok := deepscan.Decode(value, true, true); ok {
+			t.Errorf("Decode(%q) found nested JSON", value)
+		}
+	}
+	if _, _, ok := deepscan.Decode(inner, false, true); ok {
+		t.Error("Decode found JSON text where only base64 was allowed")
+	}
+}
+
+func TestMailScan(t *testing.T) {
+	card := "4111111111111111"
+	replace := func(text string) (string, int) {
+		return strings.ReplaceAll(text, card, "[card]"), strings.Count(text, card)
+	}
+	csv, _ := (charset.Encoding{Name: charset.ISO88591}).Encode("né," + card + "\n")
+	msg := "From: agent@example.com\r\n" +
+		"Subject: =?utf-8?q?Carte_de_Zo=C3=AB_" + card + "?=\r\n" +
+		"Message-ID: <1@example.com>\r\n" +
+		"MIME-Version: 1.0\r\n" +
+		"Content-Type: multipart/mixed; boundary=\"b1\"\r\n" +
+		"\r\n" +
+		"preamble\r\n" +
+		"--b1\r\n" +
+		"Content-Type: text/plain; charset=utf-8\r\n" +
+		"Content-Transfer-Encoding: quoted-printable\r\n" +
+		"\r\n" +
+		"Caf=C3=A9 card 41111111=\r\n11111111 ok\r\n" +
+		"--b1\r\n" +
+		"Content-Type: text/csv; charset=iso-8859-1; name=\"cards.csv\"\r\n" +
+		"Content-Transfer-Encoding: base64\r\n" +
+		"\r\n" +
+		base64.StdEncoding.EncodeToString(csv) + "\r\n" +
+		"--b1\r\n" +
+		"Content-Type: image/png\r\n" +
+		"Content-Transfer-Encoding: base64\r\n" +
+		"\r\n" +
+		"iVBORw0KGgo=\r\n" +
+		"--b1\r\n" +
+		"\r\n" +
+		"nothing here\r\n" +
+		"--b1--\r\n" +
+		"epilogue\r\n"
+
+	out, result, err := mailscan.Rewrite([]byte(msg), replace)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Replaced != 3 || result.Scanned != 4 || result.Skipped != 1 || result.MessageID != "<1@example.com>" {
+		t.Errorf("Result = %+v", result)
+	}
+	text := string(out)
+	for _, want := range []string{
+		"Subject: =?utf-8?q?Carte_de_Zo=C3=AB_[card]?=\r\nMessage-ID",
+		"preamble\r\n--b1\r\n",
+		"\r\n\r\nCaf=C3=A9 card [card] ok\r\n--b1\r\n",
+		"iVBORw0KGgo=\r\n--b1\r\n\r\nnothing here\r\n--b1--\r\nepilogue\r\n",
+	} {
+		if !strings.Contains(text, want) {
+			t.Errorf("rewritten message lacks %q:\n%s", want, text)
+		}
+	}
+	if strings.Contains(text, card) || strings.Contains(text, base64.StdEncoding.EncodeToString(csv)) {
+		t.Errorf("card left in rewritten message:\n%s", text)
+	}
+	wantCSV, _ := (charset.Encoding{Name: charset.ISO88591}).Encode("né,[card]\n")
+	if !strings.Contains(text, base64.StdEncoding.EncodeToString(wantCSV)+"\r\n--b1") {
+		t.Errorf("attachment not re-encoded in ISO-8859-1 base64:\n%s", text)
+	}
+
+	// A message with nothing replaced comes back byte for byte
+	none := func(text string) (string, int) { return text, 0 }
+	if out, result, err := mailscan.Rewrite([]byte(msg), none); err != nil || string(out) != msg || result.Replaced != 0 {
+		t.Errorf("message with nothing replaced changed: %+v, %v", result, err)
+	}
+	if _, _, err := mailscan.Rewrite([]byte(strings.Replace(msg, "--b1--", "--b2--", 1)), replace); !errors.Is(err, mailscan.ErrMalformed) {
+		t.Errorf("unterminated multipart error = %v", err)
+	}
+}
+
+func TestSMTPRelay(t *testing.T) {
+	serve := func(s *smtprelay.Server) string {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { ln.Close() })
+		go func() {
+			for {
+				conn, err := ln.Accept()
+				if err != nil {
+					return
+				}
+				go s.Serve(conn)
+			}
+		}()
+		return ln.Addr().String()
+	}
+
+	// The next hop records what it receives
+	var relayed []byte
+	var relayedTo []string
+	next := serve(&smtprelay.Server{
+		Hostname: "next.example",
+		Filter:   func(env *smtprelay.Envelope, msg []byte) ([]byte, error) { return msg, nil },
+		Relay: func(env *smtprelay.Envelope, msg []byte) error {
+			relayed, relayedTo = msg, env.To
+			return nil
+		},
+	})
+	sender := &smtprelay.Sender{Addr: next, Hostname: "filter.example", Timeout: 5 * time.Second}
+	filter := serve(&smtprelay.Server{
+		Hostname: "filter.example",
+		Filter: func(env *smtprelay.Envelope, msg []byte) ([]byte, error) {
+			if strings.Contains(string(msg), "reject me") {
+				return nil, &smtprelay.Reply{Code: 554, Message: "5.6.0 Refused"}
+			}
+			return []byte(strings.ReplaceAll(string(msg), "secret", "******")), nil
+		},
+		Relay:   sender.Send,
+		MaxSize: 1024,
+		Timeout: 5 * time.Second,
+	})
+
+	msg := "Subject: test\r\n\r\nthe secret\r\n.leading dot\r\n"
+	if err := smtp.SendMail(filter, nil, "agent@example.com", []string{"a@example.com", "b@example.com"}, []byte(msg)); err != nil {
+		t.Fatal(err)
+	}
+	if want := "Subject: test\n\nthe ******\n.leading dot\n"; string(relayed) != want || len(relayedTo) != 2 {
+		t.Errorf("relayed %q to %v, want %q", relayed, relayedTo, want)
+	}
+
+	var reply *textproto.Error
+	err := smtp.SendMail(filter, nil, "agent@example.com", []string{"a@example.com"}, []byte("\r\nreject me\r\n"))
+	if !errors.As(err, &reply) || reply.Code != 554 {
+		t.Errorf("filtered-out message: %v, want 554", err)
+	}
+	err = smtp.SendMail(filter, nil, "agent@example.com", []string{"a@example.com"}, []byte(strings.Repeat("x", 2048)))
+	if !errors.As(err, &reply) || reply.Code != 552 {
+		t.Errorf("oversized message: %v, want 552", err)
+	}
+}
+
+func TestBatchFile(t *testing.T) {
+	card, other := "4111111111111111", "5555555555554444"
+	tokens := 0
+	tokenize := func(pan string) (string, error) {
+		tokens++
+		return fmt.Sprintf("9%015d", tokens), nil
+	}
+	ut := &UnifiedTokenizer{scanner: scanner.New([]scanner.TokenPattern{scanner.PrefixTokens()}, true)}
+
+	columns, err := batchfile.ParseColumns(batchfile.CSV, "PAN,3")
+	if err != nil || len(columns) != 2 || columns[0].Name != "pan" || columns[1].Index != 3 {
+		t.Fatalf("ParseColumns = %+v, %v", columns, err)
+	}
+	p := &batchfile.Processor{
+		Layout:   batchfile.Layout{Format: batchfile.CSV, Columns: columns, Delimiter: ',', Header: true},
+		Tokenize: tokenize,
+		Mask:     ut.maskCardDigits,
+	}
+	in := "id,pan,backup,note\r\n" +
+		"1," + card + ",,\"paid, thanks\"\r\n" +
+		"2,4111 1111 1111 1111,12345,card " + other + " on file\r\n" +
+		"3\r\n"
+	out, report, err := p.Process([]byte(in))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "id,pan,backup,note\r\n" +
+		"1,9000000000000001,,\"paid, thanks\"\r\n" +
+		"2,9000000000000002,12345,card ************4444 on file\r\n" +
+		"3\r\n"
+	if string(out) != want {
+		t.Errorf("CSV output =\n%s\nwant\n%s", out, want)
+	}
+	if report.Rows != 3 || report.Tokenized != 2 || report.Masked != 1 || report.ErrorCount != 3 {
+		t.Errorf("CSV report = %+v", report)
+	}
+	if report.Errors[0] != (batchfile.RowError{Line: 3, Column: "3", Message: "not a card number"}) {
+		t.Errorf("first row error = %+v", report.Errors[0])
+	}
+
+	// Fixed width: columns keep their width and alignment
+	columns, err = batchfile.ParseColumns(batchfile.Fixed, "4-23")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.Layout = batchfile.Layout{Format: batchfile.Fixed, Columns: columns, RecordPrefix: "D"}
+	in = "H  20261016 " + other + "\n" +
+		"D01" + card + "    EUR000100\n" +
+		"D02    " + other + "USD000200\n" +
+		"D03                    GBP000300\n"
+	out, report, err = p.Process([]byte(in))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = "H  20261016 ************4444\n" +
+		"D019000000000000003    EUR000100\n" +
+		"D02    9000000000000004USD000200\n" +
+		"D03                    GBP000300\n"
+	if string(out) != want {
+		t.Errorf("fixed-width output =\n%s\nwant\n%s", out, want)
+	}
+	if report.Rows != 3 || report.Tokenized != 2 || report.Masked != 1 || report.ErrorCount != 0 {
+		t.Errorf("fixed-width report = %+v", report)
+	}
+
+	// Files that do not match the layout, and tokens that do not fit
+	var formatErr *batchfile.FormatError
+	p.Layout = batchfile.Layout{Format: batchfile.CSV, Columns: []batchfile.Column{{Name: "card"}}, Delimiter: ',', Header: true}
+	if _, _, err := p.Process([]byte("pan\n" + card + "\n")); !errors.As(err, &formatErr) {
+		t.Errorf("missing header column error = %v", err)
+	}
+	p.Layout = batchfile.Layout{Format: batchfile.Fixed, Columns: []batchfile.Column{{Start: 1, End: 16}}}
+	p.Tokenize = func(string) (string, error) { return "tok_" + strings.Repeat("x", 44), nil }
+	if _, _, err := p.Process([]byte(card + "\n")); !errors.As(err, &formatErr) || formatErr.Line != 1 {
+		t.Errorf("oversized token error = %v", err)
+	}
+	p.Tokenize = func(string) (string, error) { return "", errors.New("database down") }
+	if _, _, err := p.Process([]byte(card + "\n")); err == nil || errors.As(err, &formatErr) {
+		t.Errorf("tokenization failure = %v, want a retryable error", err)
+	}
+	for _, bad := range []string{"", "5-", "0-4", "9-3"} {
+		if _, err := batchfile.ParseColumns(batchfile.Fixed, bad); err == nil {
+			t.Errorf("ParseColumns(fixed, %q) accepted", bad)
+		}
+	}
+
+	// Archives decrypt to the original
+	ut.encryptionKey = &fernet.Key{}
+	sealed, err := ut.sealBatchArchive([]byte(in))
+	if err != nil || bytes.Contains(sealed, []byte(card)) {
+		t.Fatalf("sealBatchArchive = %q, %v", sealed, err)
+	}
+	if opened, err := ut.openBatchArchive(sealed); err != nil || string(opened) != in {
+		t.Errorf("openBatchArchive = %q, %v", opened, err)
+	}
+	if _, err := ut.openBatchArchive([]byte(in)); err == nil {
+		t.Error("openBatchArchive accepted a file that is not an archive")
+	}
+}
+
+func TestDropFolder(t *testing.T) {
+	dir := t.TempDir()
+	for name, content := range map[string]string{"a.csv": "a", "b.csv.part": "b", ".c.csv": "c"} {
+		os.WriteFile(filepath.Join(dir, name), []byte(content), 0600)
+	}
+	os.Mkdir(filepath.Join(dir, "sub"), 0700)
+	conn, _ := dropfolder.Dir(dir).Open()
+	files, err := conn.List()
+	if err != nil || len(files) != 1 || files[0].Name != "a.csv" {
+		t.Fatalf("List = %+v, %v", files, err)
+	}
+
+	// A file is ready once it is listed unchanged twice
+	var stable dropfolder.Stable
+	if ready := stable.Ready(files); len(ready) != 0 {
+		t.Errorf("first poll ready = %+v", ready)
+	}
+	grown := append([]dropfolder.File(nil), files...)
+	grown[0].Size++
+	if ready := stable.Ready(grown); len(ready) != 0 {
+		t.Errorf("growing file ready = %+v", ready)
+	}
+	if ready := stable.Ready(grown); len(ready) != 1 {
+		t.Errorf("unchanged file not ready: %+v", ready)
+	}
+	if _, err := conn.Read("a.csv", 0); err == nil {
+		t.Error("Read ignored the size limit")
+	}
+
+	// The SFTP client against a server holding one file
+	clientEnd, serverEnd := net.Pipe()
+	defer clientEnd.Close()
+	content := strings.Repeat("0123456789", 5000)
+	go fakeSFTPServer(serverEnd, "in.csv", content)
+	client, err := sftp.NewClient(clientEnd, clientEnd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries, err := client.ReadDir("/inbox")
+	if err != nil || len(entries) != 1 || entries[0].Name != "in.csv" || entries[0].Size != int64(len(content)) {
+		t.Fatalf("ReadDir = %+v, %v", entries, err)
+	}
+	if data, err := client.ReadFile("/inbox/in.csv", 1<<20); err != nil || string(data) != content {
+		t.Errorf("ReadFile = %d bytes, %v", len(data), err)
+	}
+	if _, err := client.ReadFile("/inbox/in.csv", 100); err == nil {
+		t.Error("ReadFile ignored the size limit")
+	}
+	if err := client.Remove("/inbox/in.csv"); err != nil {
+		t.Error(err)
+	}
+	if err := client.Remove("/inbox/in.csv"); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("second Remove = %v, want not exist", err)
+	}
+}
+
+// fakeSFTPServer answers an SFTP client over conn for a directory holding
+// one file
+func fakeSFTPServer(conn net.Conn, name, content string) {
+	defer conn.Close()
+	u32 := func(b []byte, v uint32) []byte { return append(b, byte(v>>24), byte(v>>16), byte(v>>8), byte(v)) }
+	str := func(b []byte, s string) []byte { return append(u32(b, uint32(len(s))), s...) }
+	send := func(typ byte, payload []byte) {
+		conn.Write(append(u32(nil, uint32(len(payload)+1)), append([]byte{typ}, payload...)...))
+	}
+	status := func(id, code uint32) {
+		send(101, str(str(u32(u32(nil, id), code), "status"), ""))
+	}
+	listed, removed := false, false
+	for {
+		header := make([]byte, 5)
+		if _, err := io.ReadFull(conn, header); err != nil {
+			return
+		}
+		payload := make([]byte, int(header[0])<<24|int(header[1])<<16|int(header[2])<<8|int(header[3])-1)
+		io.ReadFull(conn, payload)
+		if header[4] == 1 { // INIT
+			send(2, u32(nil, 3))
+			continue
+		}
+		id := uint32(payload[0])<<24 | uint32(payload[1])<<16 | uint32(payload[2])<<8 | uint32(payload[3])
+		switch header[4] {
+		case 3, 11: // OPEN, OPENDIR
+			send(102, str(u32(nil, id), "h"))
+		case 4: // CLOSE
+			status(id, 0)
+		case 12: // READDIR
+			if listed {
+				status(id, 1)
+				continue
+			}
+			listed = true
+			entry := u32(str(str(u32(u32(nil, id), 2), "."), "."), 0)
+			entry = str(str(entry, name), "-rw------- "+name)
+			entry = u32(entry, 0x1|0x8)
+			entry = append(u32(u32(entry, 0), uint32(len(content))), 0, 0, 0, 0, 0x65, 0x00, 0x00, 0x00)
+			send(104, entry)
+		case 5: // READ
+			offset := int(binary.BigEndian.Uint64(payload[4+4+1 : 4+4+1+8]))
+			if offset >= len(content) {
+				status(id, 1)
+				continue
+			}
+			end := offset + 32<<10
+			if end > len(content) {
+				end = len(content)
+			}
+			send(103, str(u32(nil, id), content[offset:end]))
+		case 13: // REMOVE
+			if removed {
+				status(id, 2)
+				continue
+			}
+			removed = true
+			status(id, 0)
+		}
+	}
+}
+
+func TestLoadgen(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	for i := 0; i < 100; i++ {
+		if card := loadgen.CardNumber(rng); !scanner.IsPAN(card) {
+			t.Fatalf("CardNumber() = %s, not a valid PAN", card)
+		}
+	}
+
+	for _, size := range []int{0, 512, 4096} {
+		body := loadgen.Payload("tok_abc", size)
+		var order map[string]interface{}
+		if err := json.Unmarshal(body, &order); err != nil || order["card_number"] != "tok_abc" {
+			t.Errorf("Payload(%d) = %s, want JSON carrying the card number", size, body)
+		}
+		if size > 0 && (len(body) > size || len(body) < size-67) {
+			t.Errorf("Payload(%d) is %d bytes", size, len(body))
+		}
+	}
+
+	var calls int64
+	result := loadgen.Run(context.Background(), loadgen.Config{Concurrency: 4, Requests: 200}, func(ctx context.Context, rng *rand.Rand) error {
+		if atomic.AddInt64(&calls, 1)%10 == 0 {
+			return fmt.Errorf("failed")
+		}
+		return nil
+	})
+	if result.Requests != 200 || calls != 200 || result.Errors != 20 {
+		t.Errorf("Run() sent %d requests (%d calls) with %d errors, want 200 with 20 errors", result.Requests, calls, result.Errors)
+	}
+	if result.Percentile(50) > result.Percentile(99) || result.Percentile(99) > result.Percentile(100) {
+		t.Errorf("percentiles out of order: p50 %s p99 %s max %s", result.Percentile(50), result.Percentile(99), result.Percentile(100))
+	}
+}
+
+// benchmarkLoad sends b.N requests through op and reports latency
+// percentiles alongside ns/op. Set LOADGEN_CONCURRENCY, LOADGEN_PAYLOAD_SIZE
+// and LOADGEN_TOKEN_HIT_RATIO to change the traffic shape.
+func benchmarkLoad(b *testing.B, newOp func(cfg loadgen.Config) loadgen.Op) {
+	cfg := loadgen.Config{
+		Concurrency:   utils.ParseIntEnv("LOADGEN_CONCURRENCY", 8),
+		Requests:      b.N,
+		PayloadSize:   utils.ParseIntEnv("LOADGEN_PAYLOAD_SIZE", 512),
+		TokenHitRatio: 0.9,
+	}
+	if ratio, err := strconv.ParseFloat(os.Getenv("LOADGEN_TOKEN_HIT_RATIO"), 64); err == nil {
+		cfg.TokenHitRatio = ratio
+	}
+	op := newOp(cfg)
+
+	b.ResetTimer()
+	result := loadgen.Run(context.Background(), cfg, op)
+	b.StopTimer()
+
+	if result.Errors > 0 {
+		b.Fatalf("%d of %d requests failed, first: %v", result.Errors, result.Requests, result.FirstErr)
+	}
+	b.ReportMetric(float64(result.Percentile(50).Microseconds()), "p50-us")
+	b.ReportMetric(float64(result.Percentile(95).Microseconds()), "p95-us")
+	b.ReportMetric(float64(result.Percentile(99).Microseconds()), "p99-us")
+}
+
+// BenchmarkLoadICAP drives REQMOD through the ICAP server. Without
+// LOADGEN_ICAP_URL it runs against an in-process server backed by
+// stubDetokenizer, which measures the protocol path without the vault.
+func BenchmarkLoadICAP(b *testing.B) {
+	icapURL := os.Getenv("LOADGEN_ICAP_URL")
+	tokens := []string{"tok_test123"}
+	if icapURL == "" {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			b.Fatal(err)
+		}
+		defer ln.Close()
+		pool := icap.NewPool(icap.NewServer(stubDetokenizer{}, false), 100, 200, 5*time.Second)
+		go func() {
+			for {
+				conn, err := ln.Accept()
+				if err != nil {
+					return
+				}
+				pool.Serve(conn)
+			}
+		}()
+		icapURL = "icap://" + ln.Addr().String() + "/reqmod"
+		// The server logs every request
+		log.SetOutput(io.Discard)
+		defer log.SetOutput(os.Stderr)
+	}
+	client, err := icap.NewClient(icapURL, nil)
+	if err != nil {
+		b.Fatal(err)
+	}
+	benchmarkLoad(b, func(cfg loadgen.Config) loadgen.Op {
+		return loadgen.ICAP(client, tokens, cfg)
+	})
+}
+
+// BenchmarkLoadProxy posts orders through a running tokenizing proxy at
+// LOADGEN_PROXY_URL
+func BenchmarkLoadProxy(b *testing.B) {
+	proxyURL := os.Getenv("LOADGEN_PROXY_URL")
+	if proxyURL == "" {
+		b.Skip("LOADGEN_PROXY_URL not set")
+	}
+	benchmarkLoad(b, func(cfg loadgen.Config) loadgen.Op {
+		return loadgen.Proxy(loadBenchClient(cfg), proxyURL, cfg)
+	})
+}
+
+// BenchmarkLoadAPI looks tokens up through a running API at LOADGEN_API_URL
+// using LOADGEN_API_KEY, seeding known tokens first
+func BenchmarkLoadAPI(b *testing.B) {
+	apiURL, apiKey := os.Getenv("LOADGEN_API_URL"), os.Getenv("LOADGEN_API_KEY")
+	if apiURL == "" || apiKey == "" {
+		b.Skip("LOADGEN_API_URL and LOADGEN_API_KEY not set")
+	}
+	auth := loadgen.Auth{APIKey: apiKey}
+	client := loadBenchClient(loadgen.Config{Concurrency: utils.ParseIntEnv("LOADGEN_CONCURRENCY", 8)})
+	tokens, err := loadgen.SeedTokens(client, apiURL, auth, 100, rand.New(rand.NewSource(time.Now().UnixNano())))
+	if err != nil {
+		b.Fatal(err)
+	}
+	benchmarkLoad(b, func(cfg loadgen.Config) loadgen.Op {
+		return loadgen.API(client, apiURL, auth, tokens, cfg)
+	})
+}
+
+func loadBenchClient(cfg loadgen.Config) *http.Client {
+	return &http.Client{
+		Timeout:   30 * time.Second,
+		Transport: &http.Transport{MaxIdleConnsPerHost: cfg.Concurrency},
+	}
+}
+
+func TestKafkaRecords(t *testing.T) {
+	base := time.UnixMilli(1700000000000)
+	records := []kafka.Record{
+		{Key: []byte("k1"), Value: []byte(`{"a":1}`), Timestamp: base,
+			Headers: []kafka.Header{{Key: "trace", Value: []byte("x")}}},
+		{Value: []byte("second"), Timestamp: base.Add(time.Second)},
+		{Key: []byte("k3"), Timestamp: base.Add(2 * time.Second)}, // Tombstone
+	}
+	batch := kafka.EncodeRecords(records)
+	got, next, err := kafka.DecodeRecords(batch, 0, nil)
+	if err != nil || next != 3 || len(got) != 3 {
+		t.Fatalf("DecodeRecords = %d records, next %d, %v", len(got), next, err)
+	}
+	if string(got[0].Key) != "k1" || string(got[0].Value) != `{"a":1}` || len(got[0].Headers) != 1 ||
+		got[0].Headers[0].Key != "trace" || !got[0].Timestamp.Equal(base) {
+		t.Errorf("record 0 = %+v", got[0])
+	}
+	if got[1].Key != nil || got[1].Offset != 1 || got[2].Value != nil || !got[2].Timestamp.Equal(base.Add(2*time.Second)) {
+		t.Errorf("records 1-2 = %+v %+v", got[1], got[2])
+	}
+
+	// Records before the fetch offset are skipped; a cut-off batch is ignored
+	if got, next, _ := kafka.DecodeRecords(batch, 2, nil); len(got) != 1 || got[0].Offset != 2 || next != 3 {
+		t.Errorf("from offset 2 = %+v, next %d", got, next)
+	}
+	if got, next, err := kafka.DecodeRecords(batch[:len(batch)-1], 0, nil); err != nil || len(got) != 0 || next != 0 {
+		t.Errorf("truncated batch = %d records, next %d, %v", len(got), next, err)
+	}
+	corrupt := append([]byte(nil), batch...)
+	corrupt[len(corrupt)-1] ^= 1
+	if _, _, err := kafka.DecodeRecords(corrupt, 0, nil); err == nil {
+		t.Error("corrupt batch decoded")
+	}
+
+	// A gzip batch: the same records with the body compressed
+	var zbody bytes.Buffer
+	zw := gzip.NewWriter(&zbody)
+	zw.Write(batch[61:])
+	zw.Close()
+	gz := append(append([]byte(nil), batch[:61]...), zbody.Bytes()...)
+	binary.BigEndian.PutUint32(gz[8:], uint32(len(gz)-12))
+	binary.BigEndian.PutUint16(gz[21:], 1)
+	binary.BigEndian.PutUint32(gz[17:], crc32.Checksum(gz[21:], crc32.MakeTable(crc32.Castagnoli)))
+	if got, _, err := kafka.DecodeRecords(gz, 0, nil); err != nil || len(got) != 3 || string(got[1].Value) != "second" {
+		t.Errorf("gzip batch = %+v, %v", got, err)
+	}
+
+	// Batches of an aborted transaction are skipped along with its marker
+	txn := kafka.EncodeRecords(records[:1])
+	binary.BigEndian.PutUint64(txn, 3)
+	binary.BigEndian.PutUint64(txn[43:], 7) // Producer ID
+	binary.BigEndian.PutUint16(txn[21:], 0x10)
+	binary.BigEndian.PutUint32(txn[17:], crc32.Checksum(txn[21:], crc32.MakeTable(crc32.Castagnoli)))
+	both := append(append([]byte(nil), batch...), txn...)
+	aborted := []kafka.AbortedTransaction{{ProducerID: 7, FirstOffset: 3}}
+	if got, next, err := kafka.DecodeRecords(both, 0, aborted); err != nil || len(got) != 3 || next != 4 {
+		t.Errorf("aborted transaction = %d records, next %d, %v", len(got), next, err)
+	}
+
+	// Kafka's default partitioner (murmur2, as in the Java client's tests)
+	for key, want := range map[string]int32{"21": -973932308, "foobar": -790332482, "a-little-bit-long-string": -985981536} {
+		if got := kafka.Partition([]byte(key), 1<<30); got != (want&0x7fffffff)%(1<<30) {
+			t.Errorf("Partition(%q) = %d", key, got)
+		}
+	}
+}
+
+func TestKafkaClient(t *testing.T) {
+	broker := newFakeKafkaBroker(t, map[string]int{"in": 2, "out": 1})
+	client := kafka.NewClient(kafka.Config{Brokers: []string{broker.addr}, Timeout: 5 * time.Second})
+	defer client.Close()
+
+	if err := client.RefreshMetadata("in", "missing"); !errors.Is(err, kafka.ErrUnknownTopicPartition) {
+		t.Errorf("RefreshMetadata(missing) = %v", err)
+	}
+	partitions, err := client.Partitions("in")
+	if err != nil || len(partitions) != 2 {
+		t.Fatalf("Partitions = %+v, %v", partitions, err)
+	}
+	for i := 0; i < 3; i++ {
+		if err := client.Produce("in", 1, []kafka.Record{{Value: []byte(strconv.Itoa(i)), Timestamp: time.Now()}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if offset, err := client.ListOffset("in", 1, kafka.Latest); err != nil || offset != 3 {
+		t.Errorf("ListOffset(latest) = %d, %v", offset, err)
+	}
+	results, err := client.Fetch(broker.addr, []kafka.FetchPartition{{Topic: "in", Partition: 1, Offset: 1}}, 100*time.Millisecond, 1<<20)
+	if err != nil || len(results) != 1 || results[0].Err != nil || len(results[0].Records) != 2 ||
+		string(results[0].Records[0].Value) != "1" || results[0].Next != 3 {
+		t.Fatalf("Fetch = %+v, %v", results, err)
+	}
+
+	if offsets, err := client.CommittedOffsets("g", "in", []int32{0, 1}); err != nil || len(offsets) != 0 {
+		t.Errorf("CommittedOffsets before commit = %v, %v", offsets, err)
+	}
+	if err := client.CommitOffsets("g", "in", map[int32]int64{1: 3}); err != nil {
+		t.Fatal(err)
+	}
+	if offsets, err := client.CommittedOffsets("g", "in", []int32{0, 1}); err != nil || len(offsets) != 1 || offsets[1] != 3 {
+		t.Errorf("CommittedOffsets = %v, %v", offsets, err)
+	}
+}
+
+func TestAvro(t *testing.T) {
+	schema, err := avro.Parse(`{"type": "record", "name": "Payment", "namespace": "shop", "fields": [
+		{"name": "id", "type": "long"},
+		{"name": "card_number", "type": ["null", "string"]},
+		{"name": "amount", "type": {"type": "bytes", "logicalType": "decimal", "precision": 9, "scale": 2}},
+		{"name": "status", "type": {"type": "enum", "name": "Status", "symbols": ["OK", "DECLINED"]}},
+		{"name": "tags", "type": {"type": "array", "items": "string"}},
+		{"name": "meta", "type": {"type": "map", "values": "int"}},
+		{"name": "digest", "type": {"type": "fixed", "name": "MD5", "size": 4}},
+		{"name": "refund", "type": ["null", "Payment"]},
+		{"name": "rate", "type": "double"}
+	]}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	value := map[string]interface{}{
+		"id": int64(1) << 40, "card_number": "4111111111111111", "amount": []byte{0x01, 0x2c},
+		"status": "DECLINED", "tags": []interface{}{"a", "b"}, "meta": map[string]interface{}{"x": int32(-5)},
+		"digest": []byte("abcd"), "rate": 1.5,
+		"refund": map[string]interface{}{
+			"id": int64(2), "card_number": nil, "amount": []byte{}, "status": "OK", "tags": []interface{}{},
+			"meta": map[string]interface{}{}, "digest": []byte("efgh"), "refund": nil, "rate": 0.0,
+		},
+	}
+	data, err := avro.Encode(schema, value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded, err := avro.Decode(schema, data)
+	if err != nil || !reflect.DeepEqual(decoded, value) {
+		t.Fatalf("Decode = %#v, %v", decoded, err)
+	}
+	if _, err := avro.Decode(schema, append(data, 0)); err == nil {
+		t.Error("trailing data decoded")
+	}
+	if _, err := avro.Decode(schema, data[:len(data)-1]); err == nil {
+		t.Error("truncated data decoded")
+	}
+	value["card_number"] = 4111111111111111.0
+	if _, err := avro.Encode(schema, value); err == nil {
+		t.Error("a number encoded as a string union")
+	}
+
+	id, payload, err := avro.SplitWireFormat(avro.JoinWireFormat(42, data))
+	if err != nil || id != 42 || !bytes.Equal(payload, data) {
+		t.Errorf("wire format = %d, %v", id, err)
+	}
+	if _, _, err := avro.SplitWireFormat([]byte(`{"a":1}`)); !errors.Is(err, avro.ErrWireFormat) {
+		t.Errorf("SplitWireFormat(JSON) = %v", err)
+	}
+
+	registry := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/schemas/ids/7" {
+			http.NotFound(w, r)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]string{"schema": `"string"`})
+	}))
+	defer registry.Close()
+	reg := &avro.Registry{URL: registry.URL}
+	if s, err := reg.Schema(7); err != nil || s.Type != "string" {
+		t.Errorf("Schema(7) = %+v, %v", s, err)
+	}
+	if _, err := reg.Schema(8); !errors.Is(err, avro.ErrUnknownSchema) {
+		t.Errorf("Schema(8) = %v", err)
+	}
+}
+
+func TestKafkaSanitize(t *testing.T) {
+	ut := &UnifiedTokenizer{scanner: scanner.New([]scanner.TokenPattern{scanner.PrefixTokens()}, true)}
+	sanitize := func(msg string) (string, int, error) {
+		var v interface{}
+		dec := json.NewDecoder(strings.NewReader(msg))
+		dec.UseNumber()
+		dec.Decode(&v)
+		n, err := ut.sanitizeKafkaValue(&v)
+		out, _ := json.Marshal(v)
+		return string(out), n, err
+	}
+
+	out, n, err := sanitize(`{"card_number":"tok_abc","note":"paid with 4111111111111111","items":["5555555555554444"]}`)
+	if err != nil || n != 2 || strings.Contains(out, "4111111111111111") || strings.Contains(out, "5555555555554444") ||
+		!strings.Contains(out, "************1111") || !strings.Contains(out, "tok_abc") {
+		t.Errorf("sanitize = %s, %d, %v", out, n, err)
+	}
+	// A card number left in a card field means tokenization failed: retried
+	if _, _, err := sanitize(`{"payment":{"pan":"4111111111111111"}}`); err == nil {
+		t.Error("untokenized card field accepted")
+	} else if errors.As(err, new(*kafkaRejectError)) {
+		t.Errorf("untokenized card field rejected for good: %v", err)
+	}
+	// A card number held as a number cannot become a token: dead-lettered
+	if _, _, err := sanitize(`{"card_number":4111111111111111}`); !errors.As(err, new(*kafkaRejectError)) {
+		t.Errorf("numeric card field = %v, want a rejection", err)
+	}
+
+	// Dead letters from tokenize routes are masked, with their origin in headers
+	p := &kafkaPartition{route: &kafkaRoute{source: "payments", tokenize: true}, id: 2}
+	letter := ut.kafkaDeadLetter(p, kafka.Record{Offset: 9, Key: []byte("4111111111111111"), Value: []byte("not json 4111111111111111")}, "bad")
+	if strings.Contains(string(letter.Key)+string(letter.Value), "4111111111111111") || len(letter.Value) != 25 {
+		t.Errorf("dead letter = %q %q", letter.Key, letter.Value)
+	}
+	headers := map[string]string{}
+	for _, h := range letter.Headers {
+		headers[h.Key] = string(h.Value)
+	}
+	if headers["tokenshield.error"] != "bad" || headers["tokenshield.topic"] != "payments" ||
+		headers["tokenshield.partition"] != "2" || headers["tokenshield.offset"] != "9" {
+		t.Errorf("dead letter headers = %v", headers)
+	}
+
+	if routes, err := parseKafkaRoutes("a:b, c:d", true); err != nil || len(routes) != 2 || routes[1].destination != "d" {
+		t.Errorf("parseKafkaRoutes = %+v, %v", routes, err)
+	}
+	for _, bad := range []string{"a", "a:", "a:a"} {
+		if _, err := parseKafkaRoutes(bad, true); err == nil {
+			t.Errorf("parseKafkaRoutes(%q) accepted", bad)
+		}
+	}
+}
+
+// fakeKafkaBroker is a one-node Kafka cluster holding topics in memory,
+// enough for the bridge: metadata, fetch, produce and group offsets
+type fakeKafkaBroker struct {
+	addr    string
+	mu      sync.Mutex
+	topics  map[string][][]kafka.Record
+	offsets map[string]int64 // group/topic/partition
+}
+
+func newFakeKafkaBroker(t *testing.T, topics map[string]int) *fakeKafkaBroker {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	b := &fakeKafkaBroker{addr: l.Addr().String(), topics: make(map[string][][]kafka.Record), offsets: make(map[string]int64)}
+	for name, n := range topics {
+		b.topics[name] = make([][]kafka.Record, n)
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go b.serve(conn)
+		}
+	}()
+	return b
+}
+
+// records returns a partition's records
+func (b *fakeKafkaBroker) records(topic string, partition int) []kafka.Record {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return append([]kafka.Record(nil), b.topics[topic][partition]...)
+}
+
+// append adds records to a partition, numbering them
+func (b *fakeKafkaBroker) append(topic string, partition int, records ...kafka.Record) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, r := range records {
+		r.Offset = int64(len(b.topics[topic][partition]))
+		b.topics[topic][partition] = append(b.topics[topic][partition], r)
+	}
+}
+
+// kafkaWire reads request fields
+type kafkaWire struct{ buf []byte }
+
+func (w *kafkaWire) i8() int8   { v := int8(w.buf[0]); w.buf = w.buf[1:]; return v }
+func (w *kafkaWire) i16() int16 { v := int16(binary.BigEndian.Uint16(w.buf)); w.buf = w.buf[2:]; return v }
+func (w *kafkaWire) i32() int32 { v := int32(binary.BigEndian.Uint32(w.buf)); w.buf = w.buf[4:]; return v }
+func (w *kafkaWire) i64() int64 { v := int64(binary.BigEndian.Uint64(w.buf)); w.buf = w.buf[8:]; return v }
+func (w *kafkaWire) str() string {
+	n := w.i16()
+	if n < 0 {
+		return ""
+	}
+	s := string(w.buf[:n])
+	w.buf = w.buf[n:]
+	return s
+}
+func (w *kafkaWire) bytes() []byte {
+	n := w.i32()
+	b := w.buf[:n]
+	w.buf = w.buf[n:]
+	return b
+}
+
+func (b *fakeKafkaBroker) serve(conn net.Conn) {
+	defer conn.Close()
+	i16 := func(out []byte, v int16) []byte { return binary.BigEndian.AppendUint16(out, uint16(v)) }
+	i32 := func(out []byte, v int32) []byte { return binary.BigEndian.AppendUint32(out, uint32(v)) }
+	i64 := func(out []byte, v int64) []byte { return binary.BigEndian.AppendUint64(out, uint64(v)) }
+	str := func(out []byte, s string) []byte { return append(i16(out, int16(len(s))), s...) }
+	host, portStr, _ := net.SplitHostPort(b.addr)
+	port, _ := strconv.Atoi(portStr)
+
+	for {
+		var size [4]byte
+		if _, err := io.ReadFull(conn, size[:]); err != nil {
+			return
+		}
+		req := make([]byte, binary.BigEndian.Uint32(size[:]))
+		if _, err := io.ReadFull(conn, req); err != nil {
+			return
+		}
+		w := &kafkaWire{buf: req}
+		apiKey := w.i16()
+		w.i16() // Version
+		correlationID := w.i32()
+		w.str() // Client ID
+
+		var out []byte
+		b.mu.Lock()
+		switch apiKey {
+		case 3: // Metadata
+			out = i32(str(i32(i32(out, 1), 0), host), int32(port))
+			out = i16(out, -1) // Rack
+			out = i32(out, 0)  // Controller
+			n := w.i32()
+			out = i32(out, n)
+			for ; n > 0; n-- {
+				name := w.str()
+				partitions, ok := b.topics[name]
+				if !ok {
+					out = i32(append(str(i16(out, 3), name), 0), 0)
+					continue
+				}
+				out = i32(append(str(i16(out, 0), name), 0), int32(len(partitions)))
+				for p := range partitions {
+					out = i32(i32(i32(i32(i32(i32(i16(out, 0), int32(p)), 0), 1), 0), 1), 0)
+				}
+			}
+		case 10: // FindCoordinator
+			out = i32(str(i32(i16(i16(i32(out, 0), 0), -1), 0), host), int32(port))
+		case 9: // OffsetFetch
+			group := w.str()
+			n := w.i32()
+			out = i32(out, n)
+			for ; n > 0; n-- {
+				topic := w.str()
+				p := w.i32()
+				out = i32(str(out, topic), p)
+				for ; p > 0; p-- {
+					partition := w.i32()
+					offset, ok := b.offsets[fmt.Sprintf("%s/%s/%d", group, topic, partition)]
+					if !ok {
+						offset = -1
+					}
+					out = i16(i16(i64(i32(out, partition), offset), -1), 0)
+				}
+			}
+		case 8: // OffsetCommit
+			group := w.str()
+			w.i32()
+			w.str()
+			w.i64()
+			n := w.i32()
+			out = i32(out, n)
+			for ; n > 0; n-- {
+				topic := w.str()
+				p := w.i32()
+				out = i32(str(out, topic), p)
+				for ; p > 0; p-- {
+					partition := w.i32()
+					b.offsets[fmt.Sprintf("%s/%s/%d", group, topic, partition)] = w.i64()
+					w.str()
+					out = i16(i32(out, partition), 0)
+				}
+			}
+		case 2: // ListOffsets
+			w.i32()
+			n := w.i32()
+			out = i32(out, n)
+			for ; n > 0; n-- {
+				topic := w.str()
+				p := w.i32()
+				out = i32(str(out, topic), p)
+				for ; p > 0; p-- {
+					partition := w.i32()
+					offset := int64(0)
+					if w.i64() == kafka.Latest {
+						offset = int64(len(b.topics[topic][partition]))
+					}
+					out = i64(i64(i16(i32(out, partition), 0), -1), offset)
+				}
+			}
+		case 1: // Fetch
+			w.i32()
+			maxWait := time.Duration(w.i32()) * time.Millisecond
+			w.i32()
+			w.i32()
+			w.i8()
+			n := w.i32()
+			out = i32(i32(out, 0), n)
+			empty := true
+			for ; n > 0; n-- {
+				topic := w.str()
+				p := w.i32()
+				out = i32(str(out, topic), p)
+				for ; p > 0; p-- {
+					partition := w.i32()
+					offset := w.i64()
+					w.i32()
+					log := b.topics[topic][partition]
+					hw := int64(len(log))
+					out = i32(i64(i64(i16(i32(out, partition), 0), hw), hw), -1)
+					if offset >= hw {
+						out = i32(out, 0)
+						continue
+					}
+					empty = false
+					batch := kafka.EncodeRecords(log[offset:])
+					binary.BigEndian.PutUint64(batch, uint64(offset))
+					out = append(i32(out, int32(len(batch))), batch...)
+				}
+			}
+			if empty {
+				b.mu.Unlock()
+				time.Sleep(min(maxWait, 50*time.Millisecond))
+				b.mu.Lock()
+			}
+		case 0: // Produce
+			w.str()
+			w.i16()
+			w.i32()
+			n := w.i32()
+			out = i32(out, n)
+			for ; n > 0; n-- {
+				topic := w.str()
+				p := w.i32()
+				out = i32(str(out, topic), p)
+				for ; p > 0; p-- {
+					partition := w.i32()
+					records, _, err := kafka.DecodeRecords(w.bytes(), 0, nil)
+					code := int16(0)
+					if err != nil {
+						code = 2
+					}
+					base := int64(len(b.topics[topic][partition]))
+					for _, r := range records {
+						r.Offset = int64(len(b.topics[topic][partition]))
+						b.topics[topic][partition] = append(b.topics[topic][partition], r)
+					}
+					out = i64(i64(i16(i32(out, partition), code), base), -1)
+				}
+			}
+			out = i32(out, 0)
+		}
+		b.mu.Unlock()
+
+		resp := i32(i32(nil, int32(len(out)+4)), correlationID)
+		if _, err := conn.Write(append(resp, out...)); err != nil {
+			return
+		}
+	}
+}
+
+func TestSessionBinding(t *testing.T) {
+	if mode, err := sessionbind.ParseMode(""); err != nil || mode != sessionbind.Off {
+		t.Errorf("ParseMode(\"\") = %q, %v", mode, err)
+	}
+	if mode, err := sessionbind.ParseMode(" Step_Up "); err != nil || mode != sessionbind.StepUp {
+		t.Errorf("ParseMode(Step_Up) = %q, %v", mode, err)
+	}
+	if _, err := sessionbind.ParseMode("paranoid"); err == nil {
+		t.Error("ParseMode accepted an unknown mode")
+	}
+
+	for ua, want := range map[string]string{
+		"Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/129.0.0.0 Safari/537.36":                         "Chrome on Windows",
+		"Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/129.0.0.0 Safari/537.36 Edg/129.0.0.0":           "Edge on Windows",
+		"Mozilla/5.0 (iPhone; CPU iPhone OS 17_6 like Mac OS X) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/17.6 Mobile/15E148 Safari/604.1": "Safari on iOS",
+		"Mozilla/5.0 (X11; Linux x86_64; rv:131.0) Gecko/20100101 Firefox/131.0":                                                                  "Firefox on Linux",
+		"curl/8.4.0": "curl",
+		"":           "",
+	} {
+		if got := sessionbind.Family(ua); got != want {
+			t.Errorf("Family(%q) = %q, want %q", ua, got, want)
+		}
+	}
+
+	policy := sessionbind.Policy{Mode: sessionbind.StepUp, IPv4Prefix: 24, IPv6Prefix: 64, UserAgent: true}
+	chrome129 := "Mozilla/5.0 (Windows NT 10.0) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/129.0.0.0 Safari/537.36"
+	chrome130 := "Mozilla/5.0 (Windows NT 10.0) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/130.0.0.0 Safari/537.36"
+	for _, c := range []struct {
+		ip, ua string
+		want   string
+	}{
+		{"203.0.113.7", chrome129, ""},
+		{"203.0.113.250", chrome130, ""},
+		{"::ffff:203.0.113.9", chrome129, ""},
+		{"203.0.114.7", chrome129, "network"},
+		{"2001:db8::1", chrome129, "network"},
+		{"203.0.113.7", "curl/8.4.0", "user_agent"},
+		{"198.51.100.1", "curl/8.4.0", "network,user_agent"},
+	} {
+		if got := strings.Join(policy.Mismatch("203.0.113.7", chrome129, c.ip, c.ua), ","); got != c.want {
+			t.Errorf("Mismatch(%s, %q) = %q, want %q", c.ip, c.ua, got, c.want)
+		}
+	}
+	if got := policy.Mismatch("2001:db8:1:2::1", "", "2001:db8:1:2:ffff::9", ""); len(got) != 0 {
+		t.Errorf("same /64: %v", got)
+	}
+	if got := policy.Mismatch("2001:db8:1:2::1", "", "2001:db8:1:3::1", ""); len(got) != 1 {
+		t.Errorf("other /64: %v", got)
+	}
+
+	// Zero prefixes and no User-Agent check bind nothing but the address family
+	loose := sessionbind.Policy{Mode: sessionbind.Log}
+	if got := loose.Mismatch("203.0.113.7", chrome129, "198.51.100.1", "curl/8.4.0"); len(got) != 0 {
+		t.Errorf("loose policy: %v", got)
+	}
+	if (sessionbind.Policy{}).Enabled() || !loose.Enabled() {
+		t.Error("Enabled")
+	}
+}
+
+func TestLoginChallenge(t *testing.T) {
+	if kind, err := loginchallenge.ParseKind(""); err != nil || kind != loginchallenge.Off {
+		t.Errorf("ParseKind(\"\") = %q, %v", kind, err)
+	}
+	if kind, err := loginchallenge.ParseKind("Turnstile"); err != nil || !kind.Captcha() {
+		t.Errorf("ParseKind(Turnstile) = %q, %v", kind, err)
+	}
+	if _, err := loginchallenge.ParseKind("recaptcha"); err == nil {
+		t.Error("ParseKind accepted an unknown challenge")
+	}
+
+	solution := loginchallenge.Solve("lch_test", 12)
+	if !loginchallenge.Solved("lch_test", solution, 12) {
+		t.Errorf("Solve gave %q, which does not solve the puzzle", solution)
+	}
+	if loginchallenge.Solved("lch_other", solution, 12) && loginchallenge.Solved("lch_other2", solution, 12) {
+		t.Error("one solution solved unrelated puzzles")
+	}
+	if loginchallenge.Solved("lch_test", "", 0) {
+		t.Error("an empty solution was accepted")
+	}
+	if loginchallenge.Solved("lch_test", solution, 256) {
+		t.Error("a solution passed an impossible difficulty")
+	}
+
+	var form url.Values
+	provider := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		form = r.PostForm
+		switch r.PostForm.Get("response") {
+		case "good":
+			w.Write([]byte(`{"success": true}`))
+		case "secret":
+			w.Write([]byte(`{"success": false, "error-codes": ["invalid-input-secret"]}`))
+		default:
+			w.Write([]byte(`{"success": false, "error-codes": ["invalid-input-response"]}`))
+		}
+	}))
+	defer provider.Close()
+	verifier := &loginchallenge.Verifier{Secret: "s3cret", URL: provider.URL}
+	if ok, err := verifier.Verify(context.Background(), loginchallenge.HCaptcha, "good", "203.0.113.7"); !ok || err != nil {
+		t.Errorf("good answer: %v, %v", ok, err)
+	}
+	if form.Get("secret") != "s3cret" || form.Get("remoteip") != "203.0.113.7" {
+		t.Errorf("provider was sent %v", form)
+	}
+	if ok, err := verifier.Verify(context.Background(), loginchallenge.Turnstile, "bad", ""); ok || err != nil {
+		t.Errorf("bad answer: %v, %v", ok, err)
+	}
+	if _, err := verifier.Verify(context.Background(), loginchallenge.Turnstile, "secret", ""); err == nil {
+		t.Error("a rejected secret was blamed on the user")
+	}
+}
+
+func TestObjectStore(t *testing.T) {
+	ctx := context.Background()
+	if _, err := objstore.New(objstore.Config{Kind: objstore.File, Bucket: filepath.Join(t.TempDir(), "missing")}); err == nil {
+		t.Error("a missing directory was accepted")
+	}
+	if _, err := objstore.New(objstore.Config{Kind: objstore.S3, Bucket: "audit", Region: "eu-west-1"}); err == nil {
+		t.Error("S3 without credentials was accepted")
+	}
+
+	dir := t.TempDir()
+	files, err := objstore.New(objstore.Config{Kind: objstore.File, Bucket: dir, Prefix: "/audit/"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := files.Put(ctx, "security_audit_log/2026/01/a.jsonl.gz", []byte("archive")); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := os.ReadFile(filepath.Join(dir, "audit", "security_audit_log", "2026", "01", "a.jsonl.gz")); err != nil || string(data) != "archive" {
+		t.Errorf("stored file: %q, %v", data, err)
+	}
+	if data, err := files.Get(ctx, "security_audit_log/2026/01/a.jsonl.gz"); err != nil || string(data) != "archive" {
+		t.Errorf("Get: %q, %v", data, err)
+	}
+	if _, err := files.Get(ctx, "nothing"); err != objstore.ErrNotFound {
+		t.Errorf("Get of a missing object: %v", err)
+	}
+	if err := files.Put(ctx, "../escape", []byte("x")); err == nil {
+		t.Error("a key leaving the directory was accepted")
+	}
+
+	objects := map[string][]byte{}
+	var authorization string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		authorization = r.Header.Get("Authorization")
+		body, _ := io.ReadAll(r.Body)
+		sum := sha256.Sum256(body)
+		if r.Header.Get("X-Amz-Content-Sha256") != hex.EncodeToString(sum[:]) {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		switch r.Method {
+		case "PUT":
+			objects[r.URL.Path] = body
+		case "GET":
+			data, ok := objects[r.URL.Path]
+			if !ok {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			w.Write(data)
+		}
+	}))
+	defer server.Close()
+
+	bucket, err := objstore.New(objstore.Config{Kind: objstore.GCS, Bucket: "audit", Prefix: "prod", Endpoint: server.URL,
+		AccessKeyID: "GOOGHMAC", SecretAccessKey: "secret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bucket.Name() != "gs://audit/prod" {
+		t.Errorf("Name() = %q", bucket.Name())
+	}
+	if err := bucket.Put(ctx, "user_audit_log/a b.jsonl.gz", []byte("archive")); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := objects["/audit/prod/user_audit_log/a b.jsonl.gz"]; !ok {
+		t.Errorf("objects stored at %v", objects)
+	}
+	if !strings.HasPrefix(authorization, "AWS4-HMAC-SHA256 Credential=GOOGHMAC/") || !strings.Contains(authorization, "/auto/s3/aws4_request") {
+		t.Errorf("Authorization: %s", authorization)
+	}
+	if data, err := bucket.Get(ctx, "user_audit_log/a b.jsonl.gz"); err != nil || string(data) != "archive" {
+		t.Errorf("Get: %q, %v", data, err)
+	}
+	if _, err := bucket.Get(ctx, "nothing"); err != objstore.ErrNotFound {
+		t.Errorf("Get of a missing object: %v", err)
+	}
+}
+
+func TestAuditRecordMatches(t *testing.T) {
+	record := map[string]interface{}{"event_type": "login_failed", "ip_address": "203.0.113.7", "created_at": "2026-01-15T10:00:00.5Z"}
+	at := func(s string) time.Time {
+		v, _ := time.Parse(time.RFC3339, s)
+		return v
+	}
+	for _, c := range []struct {
+		query      string
+		start, end time.Time
+		want       bool
+	}{
+		{"", time.Time{}, time.Time{}, true},
+		{"event_type=login_failed&ip_address=203.0.113.7", time.Time{}, time.Time{}, true},
+		{"event_type=login_success", time.Time{}, time.Time{}, false},
+		{"action=login_failed", time.Time{}, time.Time{}, false},
+		{"", at("2026-01-15T00:00:00Z"), at("2026-01-16T00:00:00Z"), true},
+		{"", at("2026-01-15T10:00:01Z"), time.Time{}, false},
+		{"", time.Time{}, at("2026-01-15T09:59:59Z"), false},
+	} {
+		query, _ := url.ParseQuery(c.query)
+		if got := auditRecordMatches(record, query, c.start, c.end); got != c.want {
+			t.Errorf("auditRecordMatches(%q, %v, %v) = %v", c.query, c.start, c.end, got)
+		}
+	}
+}
+
+func TestParseReportPeriod(t *testing.T) {
+	now := time.Date(2026, 10, 16, 12, 0, 0, 0, time.UTC)
+	day := func(s string) time.Time {
+		v, _ := time.Parse("2006-01-02", s)
+		return v
+	}
+	for _, c := range []struct {
+		query      string
+		start, end time.Time
+		err        bool
+	}{
+		{"", now.AddDate(0, 0, -90), now, false},
+		{"quarter=2026-Q1", day("2026-01-01"), day("2026-04-01"), false},
+		{"quarter=2025-q4", day("2025-10-01"), day("2026-01-01"), false},
+		{"start=2026-07-01&end=2026-09-30", day("2026-07-01"), day("2026-10-01"), false},
+		{"start=2026-07-01T00:00:00Z&end=2026-07-02T06:00:00Z", day("2026-07-01"), day("2026-07-02").Add(6 * time.Hour), false},
+		{"end=2026-06-30", day("2026-07-01").AddDate(0, 0, -90), day("2026-07-01"), false},
+		{"quarter=2026-Q5", time.Time{}, time.Time{}, true},
+		{"quarter=Q1", time.Time{}, time.Time{}, true},
+		{"start=yesterday", time.Time{}, time.Time{}, true},
+		{"start=2026-09-01&end=2026-08-01", time.Time{}, time.Time{}, true},
+		{"start=2024-01-01&end=2026-01-01", time.Time{}, time.Time{}, true},
+		{"start=2026-11-01&end=2026-12-01", time.Time{}, time.Time{}, true},
+	} {
+		query, _ := url.ParseQuery(c.query)
+		start, end, err := parseReportPeriod(query, now)
+		if c.err {
+			if err == nil {
+				t.Errorf("parseReportPeriod(%q) = %v, %v; want an error", c.query, start, end)
+			}
+			continue
+		}
+		if err != nil || !start.Equal(c.start) || !end.Equal(c.end) {
+			t.Errorf("parseReportPeriod(%q) = %v, %v, %v; want %v, %v", c.query, start, end, err, c.start, c.end)
+		}
+	}
+}
+
+func TestComplianceReportPDF(t *testing.T) {
+	now := time.Date(2026, 10, 16, 12, 0, 0, 0, time.UTC)
+	report := &ComplianceReport{
+		GeneratedAt:  now,
+		GeneratedBy:  "admin",
+		Start:        now.AddDate(0, -3, 0),
+		End:          now,
+		SigningKeyID: "0123456789abcdef",
+		Keys:         ComplianceKeys{KEKDEK: true, Keys: []ComplianceKey{{KeyID: "dek_1", KeyType: "DEK", Version: 1, Status: "active", AgeDays: 40}}},
+		AccessReview: ComplianceAccessReview{Active: 60},
+		Tokens:       ComplianceTokens{Created: 12, BySource: map[string]int64{"import": 12}},
+		Notes:        []string{"A note (with parentheses)"},
+	}
+	for i := 0; i < 60; i++ {
+		report.AccessReview.Users = append(report.AccessReview.Users, ComplianceUser{Username: fmt.Sprintf("user%02d", i), Role: "viewer", Active: true})
+	}
+	doc := complianceReportPDF(report)
+
+	if !bytes.HasPrefix(doc, []byte("%PDF-1.4\n")) || !bytes.HasSuffix(doc, []byte("%%EOF\n")) {
+		t.Fatalf("not a PDF document: %q ... %q", doc[:20], doc[len(doc)-20:])
+	}
+	// Every cross-reference entry must point at its object
+	xrefAt := bytes.LastIndex(doc, []byte("\nxref\n")) + 1
+	startxref := fmt.Sprintf("startxref\n%d\n", xrefAt)
+	if !bytes.Contains(doc, []byte(startxref)) {
+		t.Fatalf("startxref does not point at the xref table at %d", xrefAt)
+	}
+	lines := strings.Split(string(doc[xrefAt:]), "\n")
+	var count int
+	fmt.Sscanf(lines[1], "0 %d", &count)
+	if count < 9 {
+		t.Fatalf("xref has %d objects, want a second page for 60 users", count)
+	}
+	for n := 1; n < count; n++ {
+		var offset int
+		fmt.Sscanf(lines[2+n], "%d", &offset)
+		if want := fmt.Sprintf("%d 0 obj\n", n); !bytes.HasPrefix(doc[offset:], []byte(want)) {
+			t.Errorf("xref entry %d points at %q", n, doc[offset:offset+10])
+		}
+	}
+	for _, want := range []string{"(user59", "Tokens created in the period: 12 \\(import 12\\)", "A note \\(with parentheses\\)", "page 2 of"} {
+		if !bytes.Contains(doc, []byte(want)) {
+			t.Errorf("report does not contain %q", want)
+		}
+	}
+
+	// The signing key derived from the blind index key is stable and signs
+	// the exact bytes
+	ut := &UnifiedTokenizer{encryptionKey: &fernet.Key{}}
+	copy(ut.encryptionKey[:], "0123456789abcdef0123456789abcdef")
+	key, err := ut.reportSigningKey()
+	if err != nil {
+		t.Fatalf("reportSigningKey() error: %v", err)
+	}
+	again, _ := ut.reportSigningKey()
+	if !key.Equal(again) {
+		t.Error("reportSigningKey() derived two different keys")
+	}
+	signature := ed25519.Sign(key, doc)
+	public := key.Public().(ed25519.PublicKey)
+	if !ed25519.Verify(public, doc, signature) || ed25519.Verify(public, append(doc, ' '), signature) {
+		t.Error("signature does not cover exactly the document")
+	}
+	if len(reportKeyID(public)) != 16 {
+		t.Errorf("reportKeyID() = %q", reportKeyID(public))
+	}
+}
+
+func TestAccessReviewPath(t *testing.T) {
+	for _, tc := range []struct {
+		path, reviewID string
+		itemID         int64
+		action         string
+		ok             bool
+	}{
+		{"/api/v1/access-reviews/rev_1", "rev_1", 0, "", true},
+		{"/api/v1/access-reviews/rev_1/close", "rev_1", 0, "close", true},
+		{"/api/v1/access-reviews/rev_1/items/42", "rev_1", 42, "item", true},
+		{"/api/v1/access-reviews/", "", 0, "", false},
+		{"/api/v1/access-reviews/rev_1/items", "", 0, "", false},
+		{"/api/v1/access-reviews/rev_1/items/0", "", 0, "", false},
+		{"/api/v1/access-reviews/rev_1/items/abc", "", 0, "", false},
+		{"/api/v1/access-reviews/rev_1/open", "", 0, "", false},
+	} {
+		reviewID, itemID, action, ok := accessReviewPath(tc.path)
+		if reviewID != tc.reviewID || itemID != tc.itemID || action != tc.action || ok != tc.ok {
+			t.Errorf("%s: %q, %d, %q, %v", tc.path, reviewID, itemID, action, ok)
+		}
+	}
+
+	if name := defaultReviewName(time.Date(2026, 10, 16, 0, 0, 0, 0, time.UTC)); name != "2026-Q4 access review" {
+		t.Errorf("defaultReviewName = %q", name)
+	}
+
+	schemas, err := loadRequestSchemas("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		endpoint, body string
+		valid          bool
+	}{
+		{"/api/v1/access-reviews", `{}`, true},
+		{"/api/v1/access-reviews", `{"name": "Q4", "due_in_days": 30}`, true},
+		{"/api/v1/access-reviews", `{"due_in_days": 91}`, false},
+		{"/api/v1/access-reviews/{review_id}/items/{item_id}", `{"decision": "revoke", "comment": "left the team"}`, true},
+		{"/api/v1/access-reviews/{review_id}/items/{item_id}", `{"decision": "keep"}`, false},
+		{"/api/v1/access-reviews/{review_id}/items/{item_id}", `{"comment": "ok"}`, false},
+	} {
+		var body interface{}
+		json.Unmarshal([]byte(tc.body), &body)
+		if errs := schemas[tc.endpoint].Validate(body); (len(errs) == 0) != tc.valid {
+			t.Errorf("%s %s: %v", tc.endpoint, tc.body, errs)
+		}
+	}
+}
+
+func TestInactivityAction(t *testing.T) {
+	now := time.Date(2026, 10, 16, 12, 0, 0, 0, time.UTC)
+	ago := func(days int) time.Time { return now.AddDate(0, 0, -days) }
+	warned := func(days int) sql.NullTime { return sql.NullTime{Time: ago(days), Valid: true} }
+	for _, c := range []struct {
+		name       string
+		lastActive time.Time
+		warnedAt   sql.NullTime
+		days, warn int
+		want       string
+	}{
+		{"policy off", ago(400), sql.NullTime{}, 0, 7, ""},
+		{"active", ago(10), sql.NullTime{}, 90, 7, ""},
+		{"within the warning", ago(85), sql.NullTime{}, 90, 7, inactivityWarn},
+		{"already warned", ago(85), warned(1), 90, 7, ""},
+		{"past the deadline, never warned", ago(200), sql.NullTime{}, 90, 7, inactivityWarn},
+		{"past the deadline, warned too recently", ago(200), warned(3), 90, 7, ""},
+		{"past the deadline, warned long enough ago", ago(90), warned(7), 90, 7, inactivityDisable},
+		{"warned before the last login", ago(85), warned(100), 90, 7, inactivityWarn},
+		{"no warnings", ago(90), sql.NullTime{}, 90, 0, inactivityDisable},
+		{"no warnings, active", ago(89), sql.NullTime{}, 90, 0, ""},
+	} {
+		if got := inactivityAction(c.lastActive, c.warnedAt, c.days, c.warn, now); got != c.want {
+			t.Errorf("%s: inactivityAction = %q, want %q", c.name, got, c.want)
+		}
+	}
+}